@@ -0,0 +1,229 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	arpClient "github.com/mdlayher/arp"
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+)
+
+const (
+	// DefaultDADTimeout is the default time waiting for the answers to the
+	// duplicate address detection
+	DefaultDADTimeout = time.Second
+
+	icmpv6NeighborSolicit = 135
+)
+
+// DetectDuplicate probes whether another host on the link of the given net
+// interface holds the ip before it is claimed, by an ARP probe (RFC 5227)
+// for IPv4 addresses and a duplicate address detection neighbor
+// solicitation (RFC 4862) for IPv6 addresses. It returns the hardware
+// address of the holder, or nil if no one answers within the timeout.
+func DetectDuplicate(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	var frame []byte
+	var proto raw.Protocol
+	var dst net.HardwareAddr
+	var parse func(b []byte, hwAddr net.HardwareAddr, ip net.IP) net.HardwareAddr
+	if ip.To4() != nil {
+		frame, err = newProbeFrame(dev.HardwareAddr, ip)
+		proto, dst, parse = raw.ProtocolARP, ethernet.Broadcast, parseARPConflict
+	} else {
+		frame, err = newNeighborSolicitFrame(dev.HardwareAddr, ip)
+		proto, dst, parse = protocolIPv6, solicitedNodeHardwareAddr(ip), parseNDPConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := raw.ListenPacket(dev, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteTo(frame, &raw.Addr{HardwareAddr: dst}); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dev.MTU+14)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if holder := parse(buf[:n], dev.HardwareAddr, ip); holder != nil {
+			return holder, nil
+		}
+	}
+}
+
+// newProbeFrame returns an ethernet frame carrying an ARP probe for the ip,
+// whose sender address is unspecified so that no cache is updated
+func newProbeFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	packet, err := arpClient.NewPacket(arpClient.OperationRequest, hwAddr, net.IPv4zero, make(net.HardwareAddr, len(hwAddr)), ip)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      hwAddr,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     payload,
+	}
+
+	return frame.MarshalBinary()
+}
+
+// parseARPConflict returns the hardware address of another host claiming
+// the ip in the frame, either by using it as the sender address or by
+// probing it at the same time, or nil if the frame does not conflict
+func parseARPConflict(b []byte, hwAddr net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	frame := &ethernet.Frame{}
+	if err := frame.UnmarshalBinary(b); err != nil || frame.EtherType != ethernet.EtherTypeARP {
+		return nil
+	}
+	packet := &arpClient.Packet{}
+	if err := packet.UnmarshalBinary(frame.Payload); err != nil {
+		return nil
+	}
+	// our own probe looped back
+	if bytes.Equal(packet.SenderHardwareAddr, hwAddr) {
+		return nil
+	}
+	if packet.SenderIP.Equal(ip) {
+		return packet.SenderHardwareAddr
+	}
+	if packet.Operation == arpClient.OperationRequest && packet.SenderIP.Equal(net.IPv4zero) && packet.TargetIP.Equal(ip) {
+		return packet.SenderHardwareAddr
+	}
+	return nil
+}
+
+// solicitedNodeMulticast returns the solicited-node multicast address of the
+// ip, ff02::1:ffXX:XXXX
+func solicitedNodeMulticast(ip net.IP) net.IP {
+	addr := net.ParseIP("ff02::1:ff00:0")
+	copy(addr[13:], ip.To16()[13:])
+	return addr
+}
+
+// solicitedNodeHardwareAddr returns the ethernet multicast address of the
+// solicited-node multicast address of the ip
+func solicitedNodeHardwareAddr(ip net.IP) net.HardwareAddr {
+	hwAddr := net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0}
+	copy(hwAddr[2:], solicitedNodeMulticast(ip)[12:])
+	return hwAddr
+}
+
+// newNeighborSolicitFrame returns an ethernet frame carrying the neighbor
+// solicitation of the duplicate address detection of the ip, from the
+// unspecified address to the solicited-node multicast address of the ip
+func newNeighborSolicitFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("invalid ethernet address %v", hwAddr)
+	}
+	if ip.To4() != nil || ip.To16() == nil {
+		return nil, fmt.Errorf("neighbor solicitation requires an IPv6 address, got %v", ip)
+	}
+
+	dst := solicitedNodeMulticast(ip)
+	// the source link-layer address option must not be sent from the
+	// unspecified address
+	icmp := make([]byte, 24)
+	icmp[0] = icmpv6NeighborSolicit
+	copy(icmp[8:24], ip.To16())
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(net.IPv6unspecified, dst, icmp))
+
+	packet := make([]byte, ipv6HeaderLen+len(icmp))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(icmp)))
+	packet[6] = protocolICMPv6
+	packet[7] = 255
+	copy(packet[8:24], net.IPv6unspecified)
+	copy(packet[24:40], dst)
+	copy(packet[40:], icmp)
+
+	frame := &ethernet.Frame{
+		Destination: solicitedNodeHardwareAddr(ip),
+		Source:      hwAddr,
+		EtherType:   ethernet.EtherTypeIPv6,
+		Payload:     packet,
+	}
+
+	return frame.MarshalBinary()
+}
+
+// parseNDPConflict returns the hardware address of another host claiming
+// the ip in the frame, either by advertising it or by running the
+// duplicate address detection of it at the same time, or nil if the frame
+// does not conflict
+func parseNDPConflict(b []byte, hwAddr net.HardwareAddr, ip net.IP) net.HardwareAddr {
+	frame := &ethernet.Frame{}
+	if err := frame.UnmarshalBinary(b); err != nil || frame.EtherType != ethernet.EtherTypeIPv6 {
+		return nil
+	}
+	// our own solicitation looped back
+	if bytes.Equal(frame.Source, hwAddr) {
+		return nil
+	}
+	packet := frame.Payload
+	if len(packet) < ipv6HeaderLen+24 || packet[6] != protocolICMPv6 {
+		return nil
+	}
+	icmp := packet[ipv6HeaderLen:]
+	if !net.IP(icmp[8:24]).Equal(ip) {
+		return nil
+	}
+	switch icmp[0] {
+	case icmpv6NeighborAdvert:
+		// prefer the target link-layer address option
+		if len(icmp) >= 32 && icmp[24] == optTargetLinkLayerAddr && icmp[25] == 1 {
+			return net.HardwareAddr(icmp[26:32])
+		}
+		return frame.Source
+	case icmpv6NeighborSolicit:
+		if net.IP(packet[8:24]).Equal(net.IPv6unspecified) {
+			return frame.Source
+		}
+	}
+	return nil
+}
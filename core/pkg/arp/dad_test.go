@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNeighborSolicitFrame(t *testing.T) {
+	hwAddr := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	ip := net.ParseIP("fd00::1:2:100")
+
+	b, err := newNeighborSolicitFrame(hwAddr, ip)
+	assert.Nil(t, err)
+
+	frame := &ethernet.Frame{}
+	assert.Nil(t, frame.UnmarshalBinary(b))
+	assert.Equal(t, net.HardwareAddr{0x33, 0x33, 0xff, 0x02, 0x01, 0x00}, frame.Destination)
+	packet := frame.Payload
+	assert.Equal(t, net.IPv6unspecified, net.IP(packet[8:24]))
+	assert.Equal(t, net.ParseIP("ff02::1:ff02:100"), net.IP(packet[24:40]))
+	icmp := packet[ipv6HeaderLen:]
+	assert.Equal(t, byte(icmpv6NeighborSolicit), icmp[0])
+	assert.Equal(t, ip.To16(), net.IP(icmp[8:24]))
+	assert.Equal(t, uint16(0), icmpv6Checksum(net.IPv6unspecified, net.IP(packet[24:40]), icmp))
+
+	// our own solicitation is not a conflict, the ones of others are
+	assert.Nil(t, parseNDPConflict(b, hwAddr, ip))
+	other := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}
+	b, err = newNeighborSolicitFrame(other, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, other, parseNDPConflict(b, hwAddr, ip))
+	assert.Nil(t, parseNDPConflict(b, hwAddr, net.ParseIP("fd00::1:2:101")))
+
+	// the holder advertises the ip
+	b, err = newNeighborAdvertFrame(other, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, other, parseNDPConflict(b, hwAddr, ip))
+}
+
+func TestNewProbeFrame(t *testing.T) {
+	hwAddr := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	other := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x03}
+	ip := net.ParseIP("10.0.0.100")
+
+	b, err := newProbeFrame(hwAddr, ip)
+	assert.Nil(t, err)
+	assert.Nil(t, parseARPConflict(b, hwAddr, ip))
+
+	// simultaneous probe
+	b, err = newProbeFrame(other, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, other, parseARPConflict(b, hwAddr, ip))
+	assert.Nil(t, parseARPConflict(b, hwAddr, net.ParseIP("10.0.0.101")))
+
+	// the holder announces the ip
+	b, err = newGratuitousFrame(other, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, other, parseARPConflict(b, hwAddr, ip))
+}
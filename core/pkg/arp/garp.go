@@ -0,0 +1,77 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"fmt"
+	"net"
+
+	arpClient "github.com/mdlayher/arp"
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+)
+
+// GratuitousARP broadcasts a gratuitous ARP request for the given ip through
+// the given net interface, so that the neighbors and switches update their
+// ARP and CAM tables to point to this host.
+func GratuitousARP(iface string, ip net.IP) error {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	if ip.To4() == nil {
+		return fmt.Errorf("gratuitous arp requires an IPv4 address, got %v", ip)
+	}
+
+	frame, err := newGratuitousFrame(dev.HardwareAddr, ip)
+	if err != nil {
+		return err
+	}
+
+	conn, err := raw.ListenPacket(dev, raw.ProtocolARP)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo(frame, &raw.Addr{HardwareAddr: ethernet.Broadcast})
+	return err
+}
+
+// newGratuitousFrame returns an ethernet frame carrying a gratuitous ARP
+// request whose sender and target are both the given ip
+func newGratuitousFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	packet, err := arpClient.NewPacket(arpClient.OperationRequest, hwAddr, ip, ethernet.Broadcast, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      hwAddr,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     payload,
+	}
+
+	return frame.MarshalBinary()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+)
+
+const (
+	protocolIPv6   raw.Protocol = 0x86DD
+	protocolICMPv6              = 58
+
+	icmpv6NeighborAdvert = 136
+	// naFlagOverride asks the receivers to override their cached link-layer
+	// address of the target
+	naFlagOverride = 0x20000000
+	// optTargetLinkLayerAddr carries the link-layer address of the target
+	optTargetLinkLayerAddr = 2
+
+	ipv6HeaderLen = 40
+)
+
+var (
+	// allNodesMulticast is ff02::1
+	allNodesMulticast = net.ParseIP("ff02::1")
+	// allNodesHardwareAddr is the ethernet multicast address of ff02::1
+	allNodesHardwareAddr = net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01}
+)
+
+// Announce tells the neighbors that the ip is at this host, by a gratuitous
+// ARP for IPv4 addresses and an unsolicited neighbor advertisement for IPv6
+// addresses
+func Announce(iface string, ip net.IP) error {
+	if ip.To4() != nil {
+		return GratuitousARP(iface, ip)
+	}
+	return UnsolicitedNA(iface, ip)
+}
+
+// UnsolicitedNA sends an unsolicited neighbor advertisement (RFC 4861 7.2.6)
+// for the given ip to all nodes through the given net interface, it is the
+// IPv6 counterpart of the gratuitous ARP.
+func UnsolicitedNA(iface string, ip net.IP) error {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	if ip.To4() != nil || ip.To16() == nil {
+		return fmt.Errorf("unsolicited neighbor advertisement requires an IPv6 address, got %v", ip)
+	}
+
+	frame, err := newNeighborAdvertFrame(dev.HardwareAddr, ip)
+	if err != nil {
+		return err
+	}
+
+	conn, err := raw.ListenPacket(dev, protocolIPv6)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteTo(frame, &raw.Addr{HardwareAddr: allNodesHardwareAddr})
+	return err
+}
+
+// newNeighborAdvertFrame returns an ethernet frame carrying an unsolicited
+// neighbor advertisement from the ip to ff02::1, which overrides the caches
+func newNeighborAdvertFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("invalid ethernet address %v", hwAddr)
+	}
+
+	// ICMPv6 neighbor advertisement with the target link-layer address option
+	icmp := make([]byte, 24+8)
+	icmp[0] = icmpv6NeighborAdvert
+	binary.BigEndian.PutUint32(icmp[4:8], naFlagOverride)
+	copy(icmp[8:24], ip.To16())
+	icmp[24] = optTargetLinkLayerAddr
+	icmp[25] = 1 // in units of 8 octets
+	copy(icmp[26:32], hwAddr)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip.To16(), allNodesMulticast, icmp))
+
+	packet := make([]byte, ipv6HeaderLen+len(icmp))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(icmp)))
+	packet[6] = protocolICMPv6
+	// neighbor discovery messages must have a hop limit of 255
+	packet[7] = 255
+	copy(packet[8:24], ip.To16())
+	copy(packet[24:40], allNodesMulticast)
+	copy(packet[40:], icmp)
+
+	frame := &ethernet.Frame{
+		Destination: allNodesHardwareAddr,
+		Source:      hwAddr,
+		EtherType:   ethernet.EtherTypeIPv6,
+		Payload:     packet,
+	}
+
+	return frame.MarshalBinary()
+}
+
+// icmpv6Checksum computes the checksum of the ICMPv6 message with the IPv6
+// pseudo header, the checksum field of the message must be zero
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+
+	add(src.To16())
+	add(dst.To16())
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(msg)))
+	add(length)
+	add([]byte{0, 0, 0, protocolICMPv6})
+	add(msg)
+
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
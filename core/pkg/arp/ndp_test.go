@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewNeighborAdvertFrame(t *testing.T) {
+	hwAddr := net.HardwareAddr{0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	ip := net.ParseIP("fd00::100")
+
+	b, err := newNeighborAdvertFrame(hwAddr, ip)
+	assert.Nil(t, err)
+
+	frame := &ethernet.Frame{}
+	assert.Nil(t, frame.UnmarshalBinary(b))
+	assert.Equal(t, allNodesHardwareAddr, frame.Destination)
+	assert.Equal(t, hwAddr, frame.Source)
+	assert.Equal(t, ethernet.EtherTypeIPv6, frame.EtherType)
+
+	packet := frame.Payload
+	assert.Equal(t, byte(6<<4), packet[0])
+	assert.Equal(t, byte(protocolICMPv6), packet[6])
+	assert.Equal(t, byte(255), packet[7])
+	assert.Equal(t, ip.To16(), net.IP(packet[8:24]))
+	assert.Equal(t, allNodesMulticast.To16(), net.IP(packet[24:40]))
+
+	icmp := packet[ipv6HeaderLen:]
+	assert.Equal(t, int(binary.BigEndian.Uint16(packet[4:6])), len(icmp))
+	assert.Equal(t, byte(icmpv6NeighborAdvert), icmp[0])
+	// override, neither router nor solicited
+	assert.Equal(t, uint32(naFlagOverride), binary.BigEndian.Uint32(icmp[4:8]))
+	assert.Equal(t, ip.To16(), net.IP(icmp[8:24]))
+	assert.Equal(t, hwAddr, net.HardwareAddr(icmp[26:32]))
+	// the checksum of a valid message including its checksum is zero
+	assert.Equal(t, uint16(0), icmpv6Checksum(ip, allNodesMulticast, icmp))
+}
+
+func TestNewNeighborAdvertFrameInvalid(t *testing.T) {
+	_, err := newNeighborAdvertFrame(net.HardwareAddr{0x02}, net.ParseIP("fd00::100"))
+	assert.NotNil(t, err)
+}
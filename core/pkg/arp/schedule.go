@@ -0,0 +1,225 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/zoumo/logdog"
+)
+
+// Schedule is when an address taken over is announced, e.g. after a
+// failover
+type Schedule struct {
+	// Repeat is the number of the announcements once the address is taken
+	// over, Interval apart
+	Repeat   int
+	Interval time.Duration
+	// Delay is the time after the takeover the Repeat announcements are
+	// sent again, so the switches suppressing ARP for a while after a
+	// change learn the address too. They are sent once if zero.
+	Delay time.Duration
+	// Refresh is the interval of the announcements while the address is
+	// held, RefreshRepeat at a time. There are none if zero.
+	Refresh       time.Duration
+	RefreshRepeat int
+}
+
+// Scheduler announces the addresses taken over by their schedules in
+// background until they are released
+type Scheduler struct {
+	announce func(iface string, ip net.IP) error
+
+	mu    sync.Mutex
+	addrs map[string]*scheduled
+	wg    sync.WaitGroup
+}
+
+type scheduled struct {
+	iface    string
+	ip       net.IP
+	schedule Schedule
+	// updated wakes the announcer up to wait by the updated schedule
+	updated chan struct{}
+	stopCh  chan struct{}
+}
+
+// NewScheduler returns a Scheduler sending the announcements by announce,
+// e.g. Announce
+func NewScheduler(announce func(iface string, ip net.IP) error) *Scheduler {
+	return &Scheduler{
+		announce: announce,
+		addrs:    make(map[string]*scheduled),
+	}
+}
+
+func scheduleKey(iface string, ip net.IP) string {
+	return iface + "/" + ip.String()
+}
+
+// Takeover starts announcing the address taken over by the schedule, the
+// schedule of an address announced already is updated instead
+func (s *Scheduler) Takeover(iface string, ip net.IP, schedule Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scheduleKey(iface, ip)
+	if _, ok := s.addrs[key]; ok {
+		s.update(key, schedule)
+		return
+	}
+	a := &scheduled{
+		iface:    iface,
+		ip:       ip,
+		schedule: schedule,
+		updated:  make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+	s.addrs[key] = a
+	s.wg.Add(1)
+	go s.run(a)
+}
+
+// Update updates the schedule of an address announced, it is not announced
+// again right away so a new schedule does not disturb the traffic. An
+// address not announced is ignored.
+func (s *Scheduler) Update(iface string, ip net.IP, schedule Schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.update(scheduleKey(iface, ip), schedule)
+}
+
+func (s *Scheduler) update(key string, schedule Schedule) {
+	a, ok := s.addrs[key]
+	if !ok || a.schedule == schedule {
+		return
+	}
+	a.schedule = schedule
+	select {
+	case a.updated <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule returns the schedule of the address, false if it is not
+// announced
+func (s *Scheduler) Schedule(iface string, ip net.IP) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addrs[scheduleKey(iface, ip)]
+	if !ok {
+		return Schedule{}, false
+	}
+	return a.schedule, true
+}
+
+// Release stops announcing the address
+func (s *Scheduler) Release(iface string, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := scheduleKey(iface, ip)
+	if a, ok := s.addrs[key]; ok {
+		close(a.stopCh)
+		delete(s.addrs, key)
+	}
+}
+
+// Stop releases all addresses and waits for their announcers to return
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	for key, a := range s.addrs {
+		close(a.stopCh)
+		delete(s.addrs, key)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) scheduleOf(a *scheduled) Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return a.schedule
+}
+
+// run sends the burst of the takeover, the delayed one and then the
+// refreshes, the waits restart by the schedule once it is updated
+func (s *Scheduler) run(a *scheduled) {
+	defer s.wg.Done()
+
+	schedule := s.scheduleOf(a)
+	if !s.burst(a, schedule.Repeat, schedule.Interval) {
+		return
+	}
+	delayed := false
+	for {
+		schedule = s.scheduleOf(a)
+		if schedule.Delay <= 0 {
+			delayed = true
+		}
+		wait, count := schedule.Refresh, schedule.RefreshRepeat
+		if !delayed {
+			wait, count = schedule.Delay, schedule.Repeat
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-a.stopCh:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-a.updated:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-timeout:
+		}
+		delayed = true
+		if !s.burst(a, count, schedule.Interval) {
+			return
+		}
+	}
+}
+
+// burst sends count announcements interval apart, it returns false if the
+// address is released meanwhile
+func (s *Scheduler) burst(a *scheduled, count int, interval time.Duration) bool {
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-a.stopCh:
+				return false
+			}
+		}
+		select {
+		case <-a.stopCh:
+			return false
+		default:
+		}
+		if err := s.announce(a.iface, a.ip); err != nil {
+			log.Warn("announce address error", log.Fields{"iface": a.iface, "ip": a.ip, "err": err})
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAnnouncer struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeAnnouncer) announce(iface string, ip net.IP) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, iface+" "+ip.String())
+	return nil
+}
+
+func (f *fakeAnnouncer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.calls)
+	f.calls = nil
+	return n
+}
+
+func TestScheduler(t *testing.T) {
+	f := &fakeAnnouncer{}
+	s := NewScheduler(f.announce)
+	ip := net.ParseIP("10.0.0.100")
+
+	// a burst right away and another one after the delay
+	schedule := Schedule{Repeat: 3, Interval: time.Millisecond, Delay: 100 * time.Millisecond}
+	s.Takeover("eth0", ip, schedule)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 3, f.count())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 3, f.count())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, f.count())
+
+	// taking over again updates the schedule without announcing, and the
+	// refreshes follow it
+	schedule = Schedule{Repeat: 3, Interval: time.Millisecond, Refresh: 100 * time.Millisecond, RefreshRepeat: 2}
+	s.Takeover("eth0", ip, schedule)
+	got, ok := s.Schedule("eth0", ip)
+	assert.True(t, ok)
+	assert.Equal(t, schedule, got)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, f.count())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, f.count())
+
+	// updating an address not announced does nothing
+	s.Update("eth1", ip, schedule)
+	_, ok = s.Schedule("eth1", ip)
+	assert.False(t, ok)
+
+	// released
+	s.Release("eth0", ip)
+	_, ok = s.Schedule("eth0", ip)
+	assert.False(t, ok)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 0, f.count())
+
+	s.Takeover("eth0", ip, Schedule{Repeat: 1, Refresh: time.Millisecond, RefreshRepeat: 1})
+	time.Sleep(20 * time.Millisecond)
+	s.Stop()
+	assert.True(t, f.count() > 1)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, f.count())
+}
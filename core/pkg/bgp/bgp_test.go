@@ -0,0 +1,284 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestMessages(t *testing.T) {
+	b := &bytes.Buffer{}
+	open := &Open{AS: 4200000001, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1").To4(), Families: []int{afiIPv6}}
+	assert.Nil(t, WriteMessage(b, open))
+	assert.Equal(t, []byte{0x5b, 0xa0}, b.Bytes()[20:22], "4-octet as is sent as AS_TRANS")
+	msg, err := ReadMessage(b, false)
+	assert.Nil(t, err)
+	assert.Equal(t, &Open{AS: 4200000001, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1").To4(), Families: []int{afiIPv6}, FourOctetAS: true}, msg)
+
+	for _, update := range []*Update{
+		{Announced: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100")), mustParseCIDR("10.1.0.0/17")}, NextHop: net.ParseIP("10.0.0.1").To4(), AS: 64512, FourOctetAS: true},
+		{Announced: []*net.IPNet{HostRoute(net.ParseIP("2001:db8::100"))}, NextHop: net.ParseIP("2001:db8::1"), AS: 64512},
+		{Withdrawn: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100")), HostRoute(net.ParseIP("2001:db8::100"))}},
+		{Announced: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100"))}, NextHop: net.ParseIP("10.0.0.1").To4()},
+	} {
+		assert.Nil(t, WriteMessage(b, update))
+		msg, err := ReadMessage(b, update.FourOctetAS)
+		assert.Nil(t, err)
+		decoded := msg.(*Update)
+		if update.Withdrawn == nil {
+			update.Withdrawn = []*net.IPNet{}
+		}
+		if update.Announced == nil {
+			update.Announced = []*net.IPNet{}
+		}
+		assert.Equal(t, update, decoded)
+	}
+
+	// the ipv4 routes need an ipv4 next hop
+	assert.NotNil(t, WriteMessage(b, &Update{Announced: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100"))}, NextHop: net.ParseIP("2001:db8::1")}))
+
+	assert.Nil(t, WriteMessage(b, &Notification{Code: ErrCease, Subcode: SubcodeAdminShutdown}))
+	msg, err = ReadMessage(b, false)
+	assert.Nil(t, err)
+	assert.Equal(t, &Notification{Code: ErrCease, Subcode: SubcodeAdminShutdown, Data: []byte{}}, msg)
+
+	_, err = ReadMessage(bytes.NewReader(make([]byte, headerLen)), false)
+	assert.Equal(t, &Notification{Code: ErrMessageHeader, Subcode: 1}, err)
+}
+
+// unhex returns the bytes of the hex dump, the fields are separated by the
+// spaces and the lines
+func unhex(t *testing.T, dump string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(dump), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestWireFormat checks the messages against the layouts of the RFCs
+// instead of the encoder, the messages of the peers are the ones of the
+// common router implementations
+func TestWireFormat(t *testing.T) {
+	header := "ffffffffffffffffffffffffffffffff"
+
+	// the OPEN of a router putting each capability in its own optional
+	// parameter: multiprotocol ipv4 unicast, the route refresh ones,
+	// graceful restart and the 4-octet AS 64513
+	open := unhex(t, header+`003b 01
+		04 fc01 00b4 0a0000fe 1e
+		02 06 01 04 0001 00 01
+		02 02 80 00
+		02 02 02 00
+		02 04 40 02 0078
+		02 06 41 04 0000fc01`)
+	msg, err := ReadMessage(bytes.NewReader(open), false)
+	assert.Nil(t, err)
+	assert.Equal(t, &Open{AS: 64513, HoldTime: 180, RouterID: net.ParseIP("10.0.0.254").To4(), Families: []int{afiIPv4}, FourOctetAS: true}, msg)
+
+	// the announcement to a 4-octet peer: ORIGIN, AS_PATH, NEXT_HOP and
+	// the NLRI
+	b := &bytes.Buffer{}
+	assert.Nil(t, WriteMessage(b, &Update{Announced: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100"))}, NextHop: net.ParseIP("10.0.0.1"), AS: 64512, FourOctetAS: true}))
+	assert.Equal(t, unhex(t, header+`0030 02
+		0000
+		0014
+		40 01 01 00
+		40 02 06 02 01 0000fc00
+		40 03 04 0a000001
+		20 c0a80064`), b.Bytes())
+
+	// the 2-octet peers get AS_TRANS in AS_PATH and the AS in AS4_PATH
+	b.Reset()
+	update := &Update{Announced: []*net.IPNet{HostRoute(net.ParseIP("192.168.0.100"))}, NextHop: net.ParseIP("10.0.0.1").To4(), AS: 4200000001}
+	assert.Nil(t, WriteMessage(b, update))
+	assert.Equal(t, unhex(t, header+`0037 02
+		0000
+		001b
+		40 01 01 00
+		40 02 04 02 01 5ba0
+		40 03 04 0a000001
+		c0 11 06 02 01 fa56ea01
+		20 c0a80064`), b.Bytes())
+	msg, err = ReadMessage(b, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(4200000001), msg.(*Update).AS)
+
+	// the routes of a peer with the attributes the speaker ignores, the
+	// ipv6 multicast ones in MP_REACH_NLRI are not unicast routes
+	msg, err = ReadMessage(bytes.NewReader(unhex(t, header+`0062 02
+		0000
+		0047
+		40 01 01 00
+		40 02 0a 02 02 0000fc01 0000fde8
+		40 03 04 0a0000fe
+		80 04 04 00000000
+		c0 08 04 fc010064
+		80 0e 1e 0002 02 10 20010db80000000000000000000000fe 00 40 20010db800000000
+		18 0a0100`)), true)
+	assert.Nil(t, err)
+	assert.Equal(t, &Update{
+		Withdrawn:   []*net.IPNet{},
+		Announced:   []*net.IPNet{mustParseCIDR("10.1.0.0/24")},
+		NextHop:     net.ParseIP("10.0.0.254").To4(),
+		AS:          64513,
+		FourOctetAS: true,
+	}, msg)
+}
+
+// router is an in-process BGP speaker accepting a session, the messages it
+// receives after the handshake are sent to its channel
+type router struct {
+	ln   net.Listener
+	as   uint32
+	hold uint16
+	msgs chan Message
+}
+
+func newRouter(t *testing.T, as uint32, hold uint16) *router {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &router{ln: ln, as: as, hold: hold, msgs: make(chan Message, 100)}
+	go r.serve()
+	return r
+}
+
+func (r *router) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if _, err := ReadMessage(conn, false); err != nil {
+				return
+			}
+			WriteMessage(conn, &Open{AS: r.as, HoldTime: r.hold, RouterID: net.ParseIP("10.0.0.254"), Families: []int{afiIPv4}})
+			WriteMessage(conn, &Keepalive{})
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Second):
+						WriteMessage(conn, &Keepalive{})
+					}
+				}
+			}()
+			for {
+				msg, err := ReadMessage(conn, true)
+				if err != nil {
+					return
+				}
+				if _, ok := msg.(*Keepalive); !ok {
+					r.msgs <- msg
+				}
+			}
+		}()
+	}
+}
+
+func (r *router) peer() Peer {
+	addr := r.ln.Addr().(*net.TCPAddr)
+	return Peer{Address: addr.IP, Port: addr.Port, ASN: r.as}
+}
+
+func (r *router) next(t *testing.T) Message {
+	select {
+	case msg := <-r.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func TestSpeaker(t *testing.T) {
+	r := newRouter(t, 64513, 3)
+	defer r.ln.Close()
+	s := NewSpeaker(Config{ASN: 64512, RouterID: net.ParseIP("10.0.0.1"), ConnectRetry: 50 * time.Millisecond, Peers: []Peer{r.peer()}})
+
+	vip := HostRoute(net.ParseIP("192.168.0.100"))
+	s.Announce([]*net.IPNet{vip, HostRoute(net.ParseIP("2001:db8::100"))})
+	s.Start()
+
+	// the ipv4 routes are announced to the ipv4 peer
+	update := r.next(t).(*Update)
+	assert.Equal(t, []*net.IPNet{vip}, update.Announced)
+	assert.Equal(t, "127.0.0.1", update.NextHop.String())
+	assert.Equal(t, uint32(64512), update.AS)
+	status := s.Status()[0]
+	assert.Equal(t, StateEstablished, status.State)
+	assert.Equal(t, 1, status.Routes)
+	assert.Equal(t, "127.0.0.1:"+strconv.Itoa(r.peer().Port), status.Address)
+	assert.Equal(t, 1.0, sessionEstablished.Get(status.Address))
+
+	// the keepalives keep the session established beyond the hold time
+	time.Sleep(4 * time.Second)
+	assert.Equal(t, StateEstablished, s.Status()[0].State)
+
+	s.Announce(nil)
+	update = r.next(t).(*Update)
+	assert.Equal(t, []*net.IPNet{vip}, update.Withdrawn)
+	s.Announce([]*net.IPNet{vip})
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*Update).Announced)
+
+	// the routes are withdrawn before the session is ceased
+	s.Stop()
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*Update).Withdrawn)
+	assert.Equal(t, &Notification{Code: ErrCease, Subcode: SubcodeAdminShutdown, Data: []byte{}}, r.next(t))
+	assert.Equal(t, StateIdle, s.Status()[0].State)
+	assert.Equal(t, 0.0, sessionEstablished.Get(status.Address))
+}
+
+func TestSpeakerBadPeerAS(t *testing.T) {
+	r := newRouter(t, 64513, 90)
+	defer r.ln.Close()
+	peer := r.peer()
+	peer.ASN = 64514
+	s := NewSpeaker(Config{ASN: 64512, RouterID: net.ParseIP("10.0.0.1"), ConnectRetry: time.Hour, Peers: []Peer{peer}})
+	s.Start()
+	defer s.Stop()
+
+	assert.Equal(t, &Notification{Code: ErrOpenMessage, Subcode: SubcodeBadPeerAS, Data: []byte{}}, r.next(t))
+	for i := 0; i < 100 && s.Status()[0].Error == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, StateIdle, s.Status()[0].State)
+	assert.Contains(t, s.Status()[0].Error, "code 2 subcode 2")
+}
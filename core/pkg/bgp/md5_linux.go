@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpMD5Sig is struct tcp_md5sig of linux/tcp.h
+type tcpMD5Sig struct {
+	addr      [128]byte
+	flags     uint8
+	prefixlen uint8
+	keylen    uint16
+	ifindex   uint32
+	key       [80]byte
+}
+
+const tcpMD5SIG = 14
+
+// md5Control returns the control of the dialer signing the segments to the
+// peer by the TCP MD5 signature option (RFC 2385)
+func md5Control(peer net.IP, password string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if len(password) > 80 {
+			return fmt.Errorf("tcp md5 password longer than 80 bytes")
+		}
+		sig := tcpMD5Sig{keylen: uint16(len(password))}
+		copy(sig.key[:], password)
+		if ip4 := peer.To4(); ip4 != nil {
+			*(*uint16)(unsafe.Pointer(&sig.addr[0])) = syscall.AF_INET
+			copy(sig.addr[4:8], ip4)
+		} else {
+			*(*uint16)(unsafe.Pointer(&sig.addr[0])) = syscall.AF_INET6
+			copy(sig.addr[8:24], peer.To16())
+		}
+
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, syscall.IPPROTO_TCP, tcpMD5SIG, uintptr(unsafe.Pointer(&sig)), unsafe.Sizeof(sig), 0)
+			if errno != 0 {
+				serr = fmt.Errorf("set tcp md5 signature error: %v", errno)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}
+}
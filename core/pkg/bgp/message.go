@@ -0,0 +1,502 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bgp is a minimal BGP-4 speaker (RFC 4271) announcing host routes
+// to its peers. It only originates routes, the routes of the peers are
+// ignored, so it suits the nodes announcing the VIPs they serve to the
+// upstream routers for ECMP. It negotiates the unicast families of RFC 4760
+// and the 4-octet ASes of RFC 6793 only, the route refresh, graceful
+// restart and add-path capabilities of the peers are not, so the peers
+// fall back to their plain behavior.
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Message types
+const (
+	TypeOpen         = 1
+	TypeUpdate       = 2
+	TypeNotification = 3
+	TypeKeepalive    = 4
+)
+
+// Notification error codes and the subcodes used
+const (
+	ErrMessageHeader   = 1
+	ErrOpenMessage     = 2
+	ErrUpdateMessage   = 3
+	ErrHoldTimeExpired = 4
+	ErrFSM             = 5
+	ErrCease           = 6
+
+	// SubcodeBadPeerAS is the OPEN message error of an unexpected AS
+	SubcodeBadPeerAS = 2
+	// SubcodeUnacceptableHoldTime is the OPEN message error of a hold time
+	// of 1 or 2 seconds
+	SubcodeUnacceptableHoldTime = 6
+	// SubcodeAdminShutdown is the cease of a session shut down
+	SubcodeAdminShutdown = 2
+)
+
+const (
+	headerLen = 19
+	maxLen    = 4096
+	version   = 4
+
+	// asTrans is the 2-octet AS in the OPEN messages of the 4-octet ASes
+	asTrans = 23456
+
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	safiUnicast = 1
+
+	attrFlagOptional = 0x80
+	attrFlagTransit  = 0x40
+	attrFlagExtended = 0x10
+
+	attrOrigin        = 1
+	attrASPath        = 2
+	attrNextHop       = 3
+	attrLocalPref     = 5
+	attrMPReachNLRI   = 14
+	attrMPUnreachNLRI = 15
+	attrAS4Path       = 17
+
+	originIGP        = 0
+	asSequence       = 2
+	defaultLocalPref = 100
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+// Message is a BGP message
+type Message interface {
+	// Type returns the type of the message
+	Type() uint8
+	encode() ([]byte, error)
+}
+
+// Open is the OPEN message
+type Open struct {
+	AS       uint32
+	HoldTime uint16
+	RouterID net.IP
+	// Families are the multiprotocol capabilities, IPv4 unicast is
+	// assumed if there is none
+	Families []int
+	// FourOctetAS is true if the 4-octet AS capability is present, AS is
+	// the one in the capability then
+	FourOctetAS bool
+}
+
+// Type implements Message
+func (m *Open) Type() uint8 { return TypeOpen }
+
+func (m *Open) encode() ([]byte, error) {
+	id := m.RouterID.To4()
+	if id == nil {
+		return nil, fmt.Errorf("router id %v is not an IPv4 address", m.RouterID)
+	}
+	caps := &bytes.Buffer{}
+	for _, afi := range m.Families {
+		caps.Write([]byte{capMultiprotocol, 4, byte(afi >> 8), byte(afi), 0, safiUnicast})
+	}
+	caps.Write([]byte{capFourOctetAS, 4})
+	binary.Write(caps, binary.BigEndian, m.AS)
+
+	b := &bytes.Buffer{}
+	as := uint16(asTrans)
+	if m.AS <= 0xffff {
+		as = uint16(m.AS)
+	}
+	b.WriteByte(version)
+	binary.Write(b, binary.BigEndian, as)
+	binary.Write(b, binary.BigEndian, m.HoldTime)
+	b.Write(id)
+	// the capabilities in a single optional parameter
+	b.Write([]byte{byte(caps.Len() + 2), 2, byte(caps.Len())})
+	b.Write(caps.Bytes())
+	return b.Bytes(), nil
+}
+
+func decodeOpen(b []byte) (*Open, error) {
+	if len(b) < 10 {
+		return nil, errors.New("open message too short")
+	}
+	if b[0] != version {
+		return nil, &Notification{Code: ErrOpenMessage, Subcode: 1, Data: []byte{0, version}}
+	}
+	m := &Open{
+		AS:       uint32(binary.BigEndian.Uint16(b[1:3])),
+		HoldTime: binary.BigEndian.Uint16(b[3:5]),
+		RouterID: net.IP(append([]byte(nil), b[5:9]...)),
+	}
+	params := b[10:]
+	if int(b[9]) != len(params) {
+		return nil, errors.New("invalid optional parameters length")
+	}
+	for len(params) >= 2 {
+		typ, n := params[0], int(params[1])
+		if len(params) < 2+n {
+			return nil, errors.New("invalid optional parameter")
+		}
+		value := params[2 : 2+n]
+		params = params[2+n:]
+		if typ != 2 {
+			continue
+		}
+		for len(value) >= 2 {
+			code, cn := value[0], int(value[1])
+			if len(value) < 2+cn {
+				return nil, errors.New("invalid capability")
+			}
+			cv := value[2 : 2+cn]
+			value = value[2+cn:]
+			switch {
+			case code == capMultiprotocol && cn == 4 && cv[3] == safiUnicast:
+				m.Families = append(m.Families, int(binary.BigEndian.Uint16(cv)))
+			case code == capFourOctetAS && cn == 4:
+				m.FourOctetAS = true
+				m.AS = binary.BigEndian.Uint32(cv)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Keepalive is the KEEPALIVE message
+type Keepalive struct{}
+
+// Type implements Message
+func (m *Keepalive) Type() uint8 { return TypeKeepalive }
+
+func (m *Keepalive) encode() ([]byte, error) { return nil, nil }
+
+// Notification is the NOTIFICATION message, it is also the error closing
+// a session
+type Notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+// Type implements Message
+func (m *Notification) Type() uint8 { return TypeNotification }
+
+func (m *Notification) encode() ([]byte, error) {
+	return append([]byte{m.Code, m.Subcode}, m.Data...), nil
+}
+
+func (m *Notification) Error() string {
+	return fmt.Sprintf("bgp notification code %d subcode %d", m.Code, m.Subcode)
+}
+
+// Update is the UPDATE message of the routes originated by the speaker,
+// the prefixes of a family share the next hop
+type Update struct {
+	Withdrawn []*net.IPNet
+	Announced []*net.IPNet
+	NextHop   net.IP
+	// AS is the AS prepended to the path, zero for the internal peers
+	AS uint32
+	// FourOctetAS encodes the path with 4-octet ASes
+	FourOctetAS bool
+}
+
+// Type implements Message
+func (m *Update) Type() uint8 { return TypeUpdate }
+
+func family(n *net.IPNet) int {
+	if n.IP.To4() != nil {
+		return afiIPv4
+	}
+	return afiIPv6
+}
+
+func writePrefix(b *bytes.Buffer, n *net.IPNet) {
+	ones, _ := n.Mask.Size()
+	ip := n.IP.To4()
+	if ip == nil {
+		ip = n.IP.To16()
+	}
+	b.WriteByte(byte(ones))
+	b.Write(ip[:(ones+7)/8])
+}
+
+func writeAttr(b *bytes.Buffer, flags, typ uint8, value []byte) {
+	if len(value) > 255 {
+		b.Write([]byte{flags | attrFlagExtended, typ, byte(len(value) >> 8), byte(len(value))})
+	} else {
+		b.Write([]byte{flags, typ, byte(len(value))})
+	}
+	b.Write(value)
+}
+
+func (m *Update) encode() ([]byte, error) {
+	withdrawn4, withdrawn6 := &bytes.Buffer{}, &bytes.Buffer{}
+	announced4, announced6 := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, n := range m.Withdrawn {
+		if family(n) == afiIPv4 {
+			writePrefix(withdrawn4, n)
+		} else {
+			writePrefix(withdrawn6, n)
+		}
+	}
+	for _, n := range m.Announced {
+		if family(n) == afiIPv4 {
+			writePrefix(announced4, n)
+		} else {
+			writePrefix(announced6, n)
+		}
+	}
+
+	// the attributes are in the ascending order of their types
+	attrs := &bytes.Buffer{}
+	var as4Path []byte
+	if len(m.Announced) > 0 {
+		writeAttr(attrs, attrFlagTransit, attrOrigin, []byte{originIGP})
+		path := &bytes.Buffer{}
+		if m.AS != 0 {
+			path.Write([]byte{asSequence, 1})
+			switch {
+			case m.FourOctetAS:
+				binary.Write(path, binary.BigEndian, m.AS)
+			case m.AS > 0xffff:
+				// the 2-octet peers get AS_TRANS in the path and the
+				// 4-octet AS in AS4_PATH, see RFC 6793
+				binary.Write(path, binary.BigEndian, uint16(asTrans))
+				as4Path = make([]byte, 6)
+				as4Path[0], as4Path[1] = asSequence, 1
+				binary.BigEndian.PutUint32(as4Path[2:], m.AS)
+			default:
+				binary.Write(path, binary.BigEndian, uint16(m.AS))
+			}
+		}
+		writeAttr(attrs, attrFlagTransit, attrASPath, path.Bytes())
+		if announced4.Len() > 0 {
+			nh := m.NextHop.To4()
+			if nh == nil {
+				return nil, fmt.Errorf("next hop %v of ipv4 routes is not an ipv4 address", m.NextHop)
+			}
+			writeAttr(attrs, attrFlagTransit, attrNextHop, nh)
+		}
+		if m.AS == 0 {
+			pref := make([]byte, 4)
+			binary.BigEndian.PutUint32(pref, defaultLocalPref)
+			writeAttr(attrs, attrFlagTransit, attrLocalPref, pref)
+		}
+		if announced6.Len() > 0 {
+			nh := m.NextHop.To16()
+			if nh == nil || m.NextHop.To4() != nil {
+				return nil, fmt.Errorf("next hop %v of ipv6 routes is not an ipv6 address", m.NextHop)
+			}
+			reach := &bytes.Buffer{}
+			reach.Write([]byte{0, afiIPv6, safiUnicast, 16})
+			reach.Write(nh)
+			reach.WriteByte(0)
+			reach.Write(announced6.Bytes())
+			writeAttr(attrs, attrFlagOptional, attrMPReachNLRI, reach.Bytes())
+		}
+	}
+	if withdrawn6.Len() > 0 {
+		unreach := &bytes.Buffer{}
+		unreach.Write([]byte{0, afiIPv6, safiUnicast})
+		unreach.Write(withdrawn6.Bytes())
+		writeAttr(attrs, attrFlagOptional, attrMPUnreachNLRI, unreach.Bytes())
+	}
+	if as4Path != nil {
+		writeAttr(attrs, attrFlagOptional|attrFlagTransit, attrAS4Path, as4Path)
+	}
+
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, uint16(withdrawn4.Len()))
+	b.Write(withdrawn4.Bytes())
+	binary.Write(b, binary.BigEndian, uint16(attrs.Len()))
+	b.Write(attrs.Bytes())
+	b.Write(announced4.Bytes())
+	return b.Bytes(), nil
+}
+
+func readPrefixes(b []byte, afi int) ([]*net.IPNet, error) {
+	size := net.IPv4len
+	if afi == afiIPv6 {
+		size = net.IPv6len
+	}
+	ret := make([]*net.IPNet, 0)
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > size*8 || len(b) < 1+n {
+			return nil, errors.New("invalid prefix")
+		}
+		ip := make(net.IP, size)
+		copy(ip, b[1:1+n])
+		ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, size*8)})
+		b = b[1+n:]
+	}
+	return ret, nil
+}
+
+// decodeUpdate decodes the prefixes, the next hop and the first AS of the
+// path of the UPDATE message, the other attributes and the families but
+// the unicast ones are ignored
+func decodeUpdate(b []byte, fourOctetAS bool) (*Update, error) {
+	invalid := &Notification{Code: ErrUpdateMessage, Subcode: 1}
+	if len(b) < 4 {
+		return nil, invalid
+	}
+	wn := int(binary.BigEndian.Uint16(b))
+	if len(b) < 4+wn {
+		return nil, invalid
+	}
+	m := &Update{FourOctetAS: fourOctetAS}
+	var err error
+	if m.Withdrawn, err = readPrefixes(b[2:2+wn], afiIPv4); err != nil {
+		return nil, invalid
+	}
+	b = b[2+wn:]
+	an := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+an {
+		return nil, invalid
+	}
+	attrs := b[2 : 2+an]
+	if m.Announced, err = readPrefixes(b[2+an:], afiIPv4); err != nil {
+		return nil, invalid
+	}
+	as4 := uint32(0)
+	for len(attrs) >= 3 {
+		flags, typ := attrs[0], attrs[1]
+		n, off := int(attrs[2]), 3
+		if flags&attrFlagExtended != 0 {
+			if len(attrs) < 4 {
+				return nil, invalid
+			}
+			n, off = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < off+n {
+			return nil, invalid
+		}
+		value := attrs[off : off+n]
+		attrs = attrs[off+n:]
+		switch typ {
+		case attrNextHop:
+			if n == 4 {
+				m.NextHop = net.IP(append([]byte(nil), value...))
+			}
+		case attrASPath:
+			switch {
+			case len(value) < 2 || value[1] == 0:
+			case fourOctetAS && len(value) >= 6:
+				m.AS = binary.BigEndian.Uint32(value[2:6])
+			case !fourOctetAS && len(value) >= 4:
+				m.AS = uint32(binary.BigEndian.Uint16(value[2:4]))
+			}
+		case attrAS4Path:
+			if !fourOctetAS && len(value) >= 6 && value[1] > 0 {
+				as4 = binary.BigEndian.Uint32(value[2:6])
+			}
+		case attrMPReachNLRI:
+			if len(value) < 5 || int(binary.BigEndian.Uint16(value)) != afiIPv6 || value[2] != safiUnicast {
+				continue
+			}
+			nh := int(value[3])
+			if len(value) < 5+nh || nh < 16 {
+				return nil, invalid
+			}
+			m.NextHop = net.IP(append([]byte(nil), value[4:20]...))
+			prefixes, err := readPrefixes(value[5+nh:], afiIPv6)
+			if err != nil {
+				return nil, invalid
+			}
+			m.Announced = append(m.Announced, prefixes...)
+		case attrMPUnreachNLRI:
+			if len(value) < 3 || int(binary.BigEndian.Uint16(value)) != afiIPv6 || value[2] != safiUnicast {
+				continue
+			}
+			prefixes, err := readPrefixes(value[3:], afiIPv6)
+			if err != nil {
+				return nil, invalid
+			}
+			m.Withdrawn = append(m.Withdrawn, prefixes...)
+		}
+	}
+	if m.AS == asTrans && as4 != 0 {
+		m.AS = as4
+	}
+	return m, nil
+}
+
+// WriteMessage writes the message with its header
+func WriteMessage(w io.Writer, m Message) error {
+	body, err := m.encode()
+	if err != nil {
+		return err
+	}
+	if headerLen+len(body) > maxLen {
+		return fmt.Errorf("bgp message of %d bytes too long", headerLen+len(body))
+	}
+	b := make([]byte, headerLen, headerLen+len(body))
+	copy(b, marker)
+	binary.BigEndian.PutUint16(b[16:], uint16(headerLen+len(body)))
+	b[18] = m.Type()
+	_, err = w.Write(append(b, body...))
+	return err
+}
+
+// ReadMessage reads a message, the UPDATE messages are decoded with the
+// 4-octet ASes if fourOctetAS is true. A Notification is returned as the
+// error of the malformed messages.
+func ReadMessage(r io.Reader, fourOctetAS bool) (Message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:16], marker) {
+		return nil, &Notification{Code: ErrMessageHeader, Subcode: 1}
+	}
+	n := int(binary.BigEndian.Uint16(header[16:18]))
+	if n < headerLen || n > maxLen {
+		return nil, &Notification{Code: ErrMessageHeader, Subcode: 2, Data: header[16:18]}
+	}
+	body := make([]byte, n-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch header[18] {
+	case TypeOpen:
+		return decodeOpen(body)
+	case TypeUpdate:
+		return decodeUpdate(body, fourOctetAS)
+	case TypeNotification:
+		if len(body) < 2 {
+			return nil, &Notification{Code: ErrMessageHeader, Subcode: 2}
+		}
+		return &Notification{Code: body[0], Subcode: body[1], Data: body[2:]}, nil
+	case TypeKeepalive:
+		return &Keepalive{}, nil
+	}
+	return nil, &Notification{Code: ErrMessageHeader, Subcode: 3, Data: header[18:]}
+}
@@ -0,0 +1,543 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// DefaultPort is the port of the peers
+	DefaultPort = 179
+	// DefaultHoldTime is the hold time proposed to the peers
+	DefaultHoldTime = 90 * time.Second
+	// DefaultConnectRetry is the delay of the reconnections to a peer
+	DefaultConnectRetry = 5 * time.Second
+
+	// maxPrefixes is the most of the prefixes in an UPDATE message, so
+	// that it fits in the longest message
+	maxPrefixes = 200
+)
+
+var (
+	sessionEstablished = metrics.NewGaugeVec(
+		"loadbalancer_provider_bgp_session_established",
+		"Whether the BGP session to the peer is established",
+		"peer",
+	)
+	announcedRoutes = metrics.NewGaugeVec(
+		"loadbalancer_provider_bgp_announced_routes",
+		"Number of the routes announced to the BGP peer",
+		"peer",
+	)
+)
+
+func init() {
+	metrics.MustRegister(sessionEstablished, announcedRoutes)
+}
+
+var errStopped = errors.New("bgp speaker stopped")
+
+// State is the state of a session
+type State string
+
+// The states of the sessions, the speaker always connects actively
+const (
+	StateIdle        State = "Idle"
+	StateConnect     State = "Connect"
+	StateOpenSent    State = "OpenSent"
+	StateOpenConfirm State = "OpenConfirm"
+	StateEstablished State = "Established"
+)
+
+// Peer is a BGP peer
+type Peer struct {
+	Address net.IP
+	// Port defaults to DefaultPort
+	Port int
+	ASN  uint32
+	// Password is the key of the TCP MD5 signatures, the segments are not
+	// signed if it is empty
+	Password string
+}
+
+func (p Peer) String() string {
+	port := p.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(p.Address.String(), strconv.Itoa(port))
+}
+
+// Config configures the Speaker
+type Config struct {
+	ASN      uint32
+	RouterID net.IP
+	// HoldTime defaults to DefaultHoldTime, the keepalives are sent every
+	// third of the hold time negotiated
+	HoldTime time.Duration
+	// ConnectRetry defaults to DefaultConnectRetry
+	ConnectRetry time.Duration
+	Peers        []Peer
+}
+
+// PeerStatus is the status of the session to a peer
+type PeerStatus struct {
+	Address string `json:"address"`
+	ASN     uint32 `json:"asn"`
+	State   State  `json:"state"`
+	// Since is the time the session entered the state
+	Since time.Time `json:"since"`
+	// Routes is the number of the routes announced to the peer
+	Routes int `json:"routes"`
+	// Error is the error closing the session last
+	Error string `json:"error,omitempty"`
+}
+
+// Speaker announces the routes to its peers. The routes are announced to
+// the peers of their families, with the local address of the session as
+// the next hop, and withdrawn on Stop before the sessions are ceased.
+type Speaker struct {
+	cfg  Config
+	dial func(ctx context.Context, peer Peer) (net.Conn, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	routes   map[string]*net.IPNet
+	sessions []*session
+}
+
+// NewSpeaker returns a Speaker of the peers, the sessions are connected
+// once it is started
+func NewSpeaker(cfg Config) *Speaker {
+	if cfg.HoldTime <= 0 {
+		cfg.HoldTime = DefaultHoldTime
+	}
+	if cfg.ConnectRetry <= 0 {
+		cfg.ConnectRetry = DefaultConnectRetry
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Speaker{
+		cfg:    cfg,
+		dial:   dialPeer,
+		ctx:    ctx,
+		cancel: cancel,
+		routes: make(map[string]*net.IPNet),
+	}
+	for _, peer := range cfg.Peers {
+		s.sessions = append(s.sessions, &session{
+			speaker: s,
+			peer:    peer,
+			changed: make(chan struct{}, 1),
+			status:  PeerStatus{Address: peer.String(), ASN: peer.ASN, State: StateIdle, Since: time.Now()},
+		})
+	}
+	return s
+}
+
+// dialPeer connects to the peer, the segments are signed by its password
+func dialPeer(ctx context.Context, peer Peer) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if peer.Password != "" {
+		d.Control = md5Control(peer.Address, peer.Password)
+	}
+	return d.DialContext(ctx, "tcp", peer.String())
+}
+
+// Start connects the sessions to the peers, they are reconnected until the
+// speaker is stopped
+func (s *Speaker) Start() {
+	for _, ss := range s.sessions {
+		s.wg.Add(1)
+		go func(ss *session) {
+			defer s.wg.Done()
+			ss.run()
+		}(ss)
+	}
+}
+
+// Stop withdraws the routes from the peers and closes the sessions
+func (s *Speaker) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// Announce replaces the routes announced to the peers, the routes not in
+// prefixes are withdrawn
+func (s *Speaker) Announce(prefixes []*net.IPNet) {
+	routes := make(map[string]*net.IPNet, len(prefixes))
+	for _, n := range prefixes {
+		routes[n.String()] = n
+	}
+	s.mu.Lock()
+	s.routes = routes
+	s.mu.Unlock()
+	for _, ss := range s.sessions {
+		select {
+		case ss.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns the statuses of the sessions in the order of the peers
+func (s *Speaker) Status() []PeerStatus {
+	ret := make([]PeerStatus, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		ss.mu.Lock()
+		ret = append(ret, ss.status)
+		ss.mu.Unlock()
+	}
+	return ret
+}
+
+// desired returns the routes of the family
+func (s *Speaker) desired(afi int) map[string]*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make(map[string]*net.IPNet)
+	for key, n := range s.routes {
+		if family(n) == afi {
+			ret[key] = n
+		}
+	}
+	return ret
+}
+
+// session is the session to a peer
+type session struct {
+	speaker *Speaker
+	peer    Peer
+	changed chan struct{}
+
+	mu     sync.Mutex
+	status PeerStatus
+}
+
+func (ss *session) setState(state State) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.status.State == state {
+		return
+	}
+	log.Info("BGP session state changed", log.Fields{"peer": ss.status.Address, "from": ss.status.State, "to": state})
+	ss.status.State = state
+	ss.status.Since = time.Now()
+	established := 0.0
+	if state == StateEstablished {
+		established = 1
+	}
+	sessionEstablished.Set(established, ss.status.Address)
+}
+
+func (ss *session) setRoutes(n int) {
+	ss.mu.Lock()
+	ss.status.Routes = n
+	ss.mu.Unlock()
+	announcedRoutes.Set(float64(n), ss.status.Address)
+}
+
+func (ss *session) setError(err error) {
+	ss.mu.Lock()
+	ss.status.Error = err.Error()
+	ss.mu.Unlock()
+}
+
+// run connects the session until the speaker is stopped
+func (ss *session) run() {
+	ctx := ss.speaker.ctx
+	for {
+		err := ss.connect()
+		ss.setState(StateIdle)
+		ss.setRoutes(0)
+		if err == errStopped {
+			return
+		}
+		log.Warn("BGP session closed", log.Fields{"peer": ss.status.Address, "err": err})
+		ss.setError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ss.speaker.cfg.ConnectRetry):
+		}
+	}
+}
+
+// connect establishes the session and keeps the routes announced until it
+// is closed
+func (ss *session) connect() error {
+	s := ss.speaker
+	select {
+	case <-s.ctx.Done():
+		return errStopped
+	default:
+	}
+
+	ss.setState(StateConnect)
+	conn, err := s.dial(s.ctx, ss.peer)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return errStopped
+		}
+		return err
+	}
+	defer conn.Close()
+
+	// the connection is closed on the stop during the handshake, the
+	// established session withdraws the routes before
+	handshaking := make(chan struct{})
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			conn.Close()
+		case <-handshaking:
+		}
+	}()
+	hold, fourOctetAS, err := ss.handshake(conn)
+	close(handshaking)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return errStopped
+		}
+		return err
+	}
+	ss.setState(StateEstablished)
+	return ss.established(conn, hold, fourOctetAS)
+}
+
+// handshake exchanges the OPEN messages, it returns the hold time and
+// whether the 4-octet ASes are used
+func (ss *session) handshake(conn net.Conn) (time.Duration, bool, error) {
+	s := ss.speaker
+	afi := afiIPv4
+	if ss.peer.Address.To4() == nil {
+		afi = afiIPv6
+	}
+	open := &Open{AS: s.cfg.ASN, HoldTime: uint16(s.cfg.HoldTime / time.Second), RouterID: s.cfg.RouterID, Families: []int{afi}}
+	if err := WriteMessage(conn, open); err != nil {
+		return 0, false, err
+	}
+	ss.setState(StateOpenSent)
+
+	conn.SetReadDeadline(time.Now().Add(s.cfg.HoldTime))
+	msg, err := ReadMessage(conn, false)
+	if err != nil {
+		return 0, false, notify(conn, err)
+	}
+	peerOpen, ok := msg.(*Open)
+	if !ok {
+		return 0, false, notify(conn, unexpected(msg))
+	}
+	if peerOpen.AS != ss.peer.ASN {
+		return 0, false, notify(conn, &Notification{Code: ErrOpenMessage, Subcode: SubcodeBadPeerAS})
+	}
+	if peerOpen.HoldTime == 1 || peerOpen.HoldTime == 2 {
+		return 0, false, notify(conn, &Notification{Code: ErrOpenMessage, Subcode: SubcodeUnacceptableHoldTime})
+	}
+	hold := s.cfg.HoldTime
+	if peer := time.Duration(peerOpen.HoldTime) * time.Second; peer < hold {
+		hold = peer
+	}
+	if err := WriteMessage(conn, &Keepalive{}); err != nil {
+		return 0, false, err
+	}
+	ss.setState(StateOpenConfirm)
+
+	msg, err = ReadMessage(conn, peerOpen.FourOctetAS)
+	if err != nil {
+		return 0, false, notify(conn, err)
+	}
+	if _, ok := msg.(*Keepalive); !ok {
+		return 0, false, notify(conn, unexpected(msg))
+	}
+	return hold, peerOpen.FourOctetAS, nil
+}
+
+// unexpected returns the error of an unexpected message, the Notification
+// of the peer itself
+func unexpected(msg Message) error {
+	if n, ok := msg.(*Notification); ok {
+		return n
+	}
+	return &Notification{Code: ErrFSM}
+}
+
+// notify sends the Notification of the error to the peer unless it is
+// the one of the peer or of the connection, and returns the error
+func notify(conn net.Conn, err error) error {
+	if n, ok := err.(*Notification); ok {
+		WriteMessage(conn, n)
+		return fmt.Errorf("%v sent", n)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		WriteMessage(conn, &Notification{Code: ErrHoldTimeExpired})
+		return fmt.Errorf("hold timer expired")
+	}
+	return err
+}
+
+// established keeps the routes announced to the peer until the session is
+// closed or the speaker is stopped
+func (ss *session) established(conn net.Conn, hold time.Duration, fourOctetAS bool) error {
+	s := ss.speaker
+	afi := afiIPv4
+	if ss.peer.Address.To4() == nil {
+		afi = afiIPv6
+	}
+	nextHop := conn.LocalAddr().(*net.TCPAddr).IP
+	as := s.cfg.ASN
+	if ss.peer.ASN == s.cfg.ASN {
+		// the internal peers get the path empty
+		as = 0
+	}
+
+	msgs := make(chan Message)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			if hold > 0 {
+				conn.SetReadDeadline(time.Now().Add(hold))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			msg, err := ReadMessage(conn, fourOctetAS)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case msgs <- msg:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var keepalive <-chan time.Time
+	if hold > 0 {
+		ticker := time.NewTicker(hold / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	advertised := make(map[string]*net.IPNet)
+	send := func(withdrawn, announced []*net.IPNet) error {
+		for len(withdrawn) > 0 || len(announced) > 0 {
+			w, a := withdrawn, announced
+			if len(w) > maxPrefixes {
+				w = w[:maxPrefixes]
+			}
+			if len(a) > maxPrefixes-len(w) {
+				a = a[:maxPrefixes-len(w)]
+			}
+			withdrawn, announced = withdrawn[len(w):], announced[len(a):]
+			update := &Update{Withdrawn: w, Announced: a, NextHop: nextHop, AS: as, FourOctetAS: fourOctetAS}
+			if err := WriteMessage(conn, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	reconcile := func() error {
+		desired := s.desired(afi)
+		withdrawn, announced := make([]*net.IPNet, 0), make([]*net.IPNet, 0)
+		for key, n := range advertised {
+			if _, ok := desired[key]; !ok {
+				withdrawn = append(withdrawn, n)
+			}
+		}
+		for key, n := range desired {
+			if _, ok := advertised[key]; !ok {
+				announced = append(announced, n)
+			}
+		}
+		if len(withdrawn) == 0 && len(announced) == 0 {
+			return nil
+		}
+		sortPrefixes(withdrawn)
+		sortPrefixes(announced)
+		log.Info("Updating BGP routes", log.Fields{"peer": ss.status.Address, "announced": announced, "withdrawn": withdrawn})
+		if err := send(withdrawn, announced); err != nil {
+			return err
+		}
+		advertised = desired
+		ss.setRoutes(len(advertised))
+		return nil
+	}
+
+	if err := reconcile(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			withdrawn := make([]*net.IPNet, 0, len(advertised))
+			for _, n := range advertised {
+				withdrawn = append(withdrawn, n)
+			}
+			sortPrefixes(withdrawn)
+			log.Info("Withdrawing BGP routes", log.Fields{"peer": ss.status.Address, "withdrawn": withdrawn})
+			send(withdrawn, nil)
+			WriteMessage(conn, &Notification{Code: ErrCease, Subcode: SubcodeAdminShutdown})
+			return errStopped
+		case <-ss.changed:
+			if err := reconcile(); err != nil {
+				return err
+			}
+		case <-keepalive:
+			if err := WriteMessage(conn, &Keepalive{}); err != nil {
+				return err
+			}
+		case msg := <-msgs:
+			switch m := msg.(type) {
+			case *Notification:
+				return fmt.Errorf("%v received", m)
+			case *Open:
+				return notify(conn, &Notification{Code: ErrFSM})
+			}
+		case err := <-errs:
+			return notify(conn, err)
+		}
+	}
+}
+
+func sortPrefixes(prefixes []*net.IPNet) {
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].String() < prefixes[j].String() })
+}
+
+// HostRoute returns the /32 or /128 prefix of the address
+func HostRoute(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conntrack deletes the conntrack entries of an address, e.g. when
+// a VIP moves to this node, so the flows established before are not
+// blackholed by stale entries.
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+// Protocol is the layer 4 protocol of conntrack entries
+type Protocol string
+
+const (
+	// ProtocolTCP is tcp
+	ProtocolTCP Protocol = "tcp"
+	// ProtocolUDP is udp
+	ProtocolUDP Protocol = "udp"
+
+	// DefaultTimeout bounds a flush
+	DefaultTimeout = 10 * time.Second
+)
+
+// Direction selects which address of the entries is matched
+type Direction string
+
+const (
+	// OrigSrc matches the source of the original direction
+	OrigSrc Direction = "--orig-src"
+	// OrigDst matches the destination of the original direction
+	OrigDst Direction = "--orig-dst"
+	// ReplySrc matches the source of the reply direction
+	ReplySrc Direction = "--reply-src"
+	// ReplyDst matches the destination of the reply direction
+	ReplyDst Direction = "--reply-dst"
+)
+
+var directions = []Direction{OrigDst, OrigSrc, ReplySrc, ReplyDst}
+
+var flushedEntries = metrics.NewCounterVec(
+	"loadbalancer_provider_conntrack_entries_flushed_total",
+	"Number of conntrack entries deleted on failover",
+	"address",
+)
+
+func init() {
+	metrics.MustRegister(flushedEntries)
+}
+
+// Handle deletes conntrack entries
+type Handle interface {
+	// Delete deletes the entries of the protocol whose address of the
+	// direction is ip, it returns the number of deleted entries
+	Delete(ip net.IP, protocol Protocol, direction Direction, timeout time.Duration) (int, error)
+}
+
+// NewHandle returns a Handle driving conntrack(8)
+func NewHandle() Handle {
+	return &conntrackCmd{exec: k8sexec.New()}
+}
+
+type conntrackCmd struct {
+	exec k8sexec.Interface
+}
+
+// e.g. conntrack v1.4.4 (conntrack-tools): 3 flow entries have been deleted.
+var deletedRegexp = regexp.MustCompile(`(\d+) flow entries have been deleted`)
+
+func (c *conntrackCmd) Delete(ip net.IP, protocol Protocol, direction Direction, timeout time.Duration) (int, error) {
+	args := []string{"-D", "-p", string(protocol), string(direction), ip.String()}
+	if ip.To4() == nil {
+		args = append(args, "-f", "ipv6")
+	}
+	cmd := c.exec.Command("conntrack", args...)
+
+	type result struct {
+		out []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		out, err := cmd.CombinedOutput()
+		ch <- result{out, err}
+	}()
+
+	select {
+	case r := <-ch:
+		// conntrack exits with 1 if no entry is deleted
+		m := deletedRegexp.FindSubmatch(r.out)
+		if m == nil {
+			if r.err != nil {
+				return 0, fmt.Errorf("conntrack %s error: %v\n%s", strings.Join(args, " "), r.err, r.out)
+			}
+			return 0, nil
+		}
+		n, _ := strconv.Atoi(string(m[1]))
+		return n, nil
+	case <-time.After(timeout):
+		cmd.Stop()
+		return 0, fmt.Errorf("conntrack %s timed out after %v", strings.Join(args, " "), timeout)
+	}
+}
+
+// Flusher deletes all conntrack entries of an address within the timeout
+type Flusher struct {
+	handle  Handle
+	Timeout time.Duration
+}
+
+// NewFlusher returns a Flusher working on the handle
+func NewFlusher(handle Handle) *Flusher {
+	return &Flusher{handle: handle, Timeout: DefaultTimeout}
+}
+
+var defaultFlusher = NewFlusher(NewHandle())
+
+// FlushForIP deletes the conntrack entries of the protocols whose
+// original or reply tuple involves the ip
+func FlushForIP(ip net.IP, protocols []Protocol) error {
+	_, err := defaultFlusher.Flush(ip, protocols)
+	return err
+}
+
+// Flush deletes the conntrack entries of the protocols whose original or
+// reply tuple involves the ip, it returns the number of deleted entries.
+// The whole flush is bounded by the Timeout.
+func (f *Flusher) Flush(ip net.IP, protocols []Protocol) (int, error) {
+	deadline := time.Now().Add(f.Timeout)
+	total := 0
+	errs := make([]error, 0)
+
+	for _, p := range protocols {
+		for _, d := range directions {
+			left := deadline.Sub(time.Now())
+			if left <= 0 {
+				errs = append(errs, fmt.Errorf("flush conntrack of %v timed out after %v", ip, f.Timeout))
+				break
+			}
+			n, err := f.handle.Delete(ip, p, d, left)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			total += n
+		}
+	}
+
+	flushedEntries.Add(float64(total), ip.String())
+	log.Info("Flushed conntrack entries", log.Fields{"ip": ip, "protocols": protocols, "deleted": total})
+	return total, utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,43 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conntrack
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntegrationFlushForIP(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	if _, err := exec.LookPath("conntrack"); err != nil {
+		t.Skip("requires conntrack")
+	}
+
+	// flushing an address without entries succeeds and deletes nothing
+	n, err := NewFlusher(NewHandle()).Flush(net.ParseIP("192.0.2.200"), []Protocol{ProtocolTCP, ProtocolUDP})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeHandle struct {
+	calls   []string
+	deleted int
+	err     error
+	delay   time.Duration
+}
+
+func (f *fakeHandle) Delete(ip net.IP, protocol Protocol, direction Direction, timeout time.Duration) (int, error) {
+	f.calls = append(f.calls, fmt.Sprintf("%s %s %s", protocol, direction, ip))
+	time.Sleep(f.delay)
+	return f.deleted, f.err
+}
+
+func TestFlush(t *testing.T) {
+	handle := &fakeHandle{deleted: 2}
+	f := NewFlusher(handle)
+	ip := net.ParseIP("10.0.0.100")
+
+	before := flushedEntries.Get(ip.String())
+	n, err := f.Flush(ip, []Protocol{ProtocolTCP, ProtocolUDP})
+	assert.Nil(t, err)
+	assert.Equal(t, 16, n)
+	assert.Equal(t, float64(16), flushedEntries.Get(ip.String())-before)
+	assert.Equal(t, []string{
+		"tcp --orig-dst 10.0.0.100",
+		"tcp --orig-src 10.0.0.100",
+		"tcp --reply-src 10.0.0.100",
+		"tcp --reply-dst 10.0.0.100",
+		"udp --orig-dst 10.0.0.100",
+		"udp --orig-src 10.0.0.100",
+		"udp --reply-src 10.0.0.100",
+		"udp --reply-dst 10.0.0.100",
+	}, handle.calls)
+}
+
+func TestFlushError(t *testing.T) {
+	handle := &fakeHandle{err: fmt.Errorf("boom")}
+	_, err := NewFlusher(handle).Flush(net.ParseIP("10.0.0.100"), []Protocol{ProtocolTCP})
+	assert.NotNil(t, err)
+	// an error does not stop the flush of other directions
+	assert.Equal(t, 4, len(handle.calls))
+}
+
+func TestFlushTimeout(t *testing.T) {
+	handle := &fakeHandle{delay: 20 * time.Millisecond}
+	f := NewFlusher(handle)
+	f.Timeout = 30 * time.Millisecond
+
+	_, err := f.Flush(net.ParseIP("10.0.0.100"), []Protocol{ProtocolTCP, ProtocolUDP})
+	assert.NotNil(t, err)
+	assert.True(t, len(handle.calls) < 8)
+}
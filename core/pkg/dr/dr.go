@@ -0,0 +1,257 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dr prepares a node to be a real server of ipvs direct routing.
+// Every real server must carry the VIP on the loopback with a host mask and
+// must neither answer nor announce ARP for it, otherwise the real servers
+// steal the VIP from the director. IPv6 neighbor discovery only answers
+// for the addresses of the incoming interface, so IPv6 VIPs need nothing
+// but the address.
+package dr
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/kubernetes/pkg/util/sysctl"
+)
+
+const (
+	// LoopbackLink is the link where the VIP is bound on the real servers
+	LoopbackLink = "lo"
+	// OwnerLabel labels the VIPs added by the provider, the addresses without
+	// it are never deleted
+	OwnerLabel = LoopbackLink + ":lbp"
+)
+
+// vipBound reports the VIPs bound on the loopback, one series per family
+// for dual-stack LoadBalancers
+var vipBound = metrics.NewGaugeVec(
+	"loadbalancer_provider_vip_bound",
+	"Whether the VIP is bound on the loopback of the real server",
+	"address", "family",
+)
+
+func init() {
+	metrics.MustRegister(vipBound)
+}
+
+type drSysctl struct {
+	key   string
+	value int
+}
+
+// drSysctls are the ARP settings required by the real servers of IPv4 VIPs
+var drSysctls = []drSysctl{
+	// reply only if the target IP address is configured on the incoming interface
+	{"net/ipv4/conf/all/arp_ignore", 1},
+	{"net/ipv4/conf/" + LoopbackLink + "/arp_ignore", 1},
+	// always use the best local address for ARP requests
+	{"net/ipv4/conf/all/arp_announce", 2},
+	{"net/ipv4/conf/" + LoopbackLink + "/arp_announce", 2},
+}
+
+// RealServer configures the node as a real server of ipvs direct routing
+type RealServer struct {
+	addrs  corenet.AddrHandle
+	sysctl sysctl.Interface
+
+	mu sync.Mutex
+	// ownedIPv6 records the IPv6 VIPs added by us, since IPv6 addresses can
+	// not carry the OwnerLabel
+	ownedIPv6 map[string]bool
+}
+
+// NewRealServer returns a RealServer working on the given handles
+func NewRealServer(addrs corenet.AddrHandle, sysctl sysctl.Interface) *RealServer {
+	return &RealServer{
+		addrs:     addrs,
+		sysctl:    sysctl,
+		ownedIPv6: make(map[string]bool),
+	}
+}
+
+var defaultRealServer = NewRealServer(corenet.NewAddrHandle(), sysctl.New())
+
+// EnsureDRRealServer configures the node as a real server of the VIP
+func EnsureDRRealServer(vip net.IP) error {
+	return defaultRealServer.Ensure(vip)
+}
+
+// TeardownDRRealServer removes the VIP from the node
+func TeardownDRRealServer(vip net.IP) error {
+	return defaultRealServer.Teardown(vip)
+}
+
+// CheckDRRealServer reports the problems of the node as a real server of
+// the VIP without changing anything
+func CheckDRRealServer(vip net.IP) error {
+	return defaultRealServer.Check(vip)
+}
+
+// Ensure sets the ARP behavior, binds the VIP on the loopback and verifies
+// the result. It only repairs what is wrong, so it is cheap to call on
+// every sync.
+func (r *RealServer) Ensure(vip net.IP) error {
+	if vip.To16() == nil {
+		return fmt.Errorf("invalid VIP %v", vip)
+	}
+
+	for _, s := range sysctlsOf(vip) {
+		cur, err := r.sysctl.GetSysctl(s.key)
+		if err != nil {
+			return err
+		}
+		if cur == s.value {
+			continue
+		}
+		log.Info("Setting sysctl for dr real server", log.Fields{"key": s.key, "old": cur, "new": s.value})
+		if err := r.sysctl.SetSysctl(s.key, s.value); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, err := r.findVIP(vip)
+	if err != nil {
+		return err
+	}
+	if cur != nil && !isHostMask(cur.Mask) && r.owned(cur) {
+		// repair the mask of our own address
+		log.Info("Deleting vip with a wrong mask", log.Fields{"addr": cur})
+		if err := r.addrs.AddrDel(*cur); err != nil {
+			return err
+		}
+		cur = nil
+	}
+	if cur == nil {
+		addr := corenet.NewAddr(vip, LoopbackLink)
+		addr.Label = OwnerLabel
+		log.Info("Adding vip for dr real server", log.Fields{"addr": addr})
+		if err := r.addrs.AddrAdd(addr); err != nil {
+			return err
+		}
+		if vip.To4() == nil {
+			r.ownedIPv6[vip.String()] = true
+		}
+	}
+
+	if err := r.check(vip); err != nil {
+		return err
+	}
+	vipBound.Set(1, vip.String(), string(corenet.FamilyOf(vip)))
+	return nil
+}
+
+// Teardown deletes the VIP from the loopback if it was added by Ensure,
+// the sysctl settings are left as they are since other VIPs may need them
+func (r *RealServer) Teardown(vip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, err := r.findVIP(vip)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		return nil
+	}
+	if !r.owned(cur) {
+		log.Warn("Skip deleting vip not owned by provider", log.Fields{"addr": cur})
+		return nil
+	}
+	log.Info("Deleting vip for dr real server", log.Fields{"addr": cur})
+	if err := r.addrs.AddrDel(*cur); err != nil {
+		return err
+	}
+	delete(r.ownedIPv6, vip.String())
+	vipBound.Delete(vip.String(), string(corenet.FamilyOf(vip)))
+	return nil
+}
+
+// Check returns all problems of the node as a real server of the VIP
+func (r *RealServer) Check(vip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.check(vip)
+}
+
+func (r *RealServer) check(vip net.IP) error {
+	errs := make([]error, 0)
+	for _, s := range sysctlsOf(vip) {
+		cur, err := r.sysctl.GetSysctl(s.key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if cur != s.value {
+			errs = append(errs, fmt.Errorf("sysctl %s is %d, expected %d", s.key, cur, s.value))
+		}
+	}
+
+	cur, err := r.findVIP(vip)
+	switch {
+	case err != nil:
+		errs = append(errs, err)
+	case cur == nil:
+		errs = append(errs, fmt.Errorf("vip %v is not bound on %s", vip, LoopbackLink))
+	case !isHostMask(cur.Mask):
+		errs = append(errs, fmt.Errorf("vip %v on %s is not a host address", cur.IPNet, LoopbackLink))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+func (r *RealServer) findVIP(vip net.IP) (*corenet.Addr, error) {
+	addrs, err := r.addrs.AddrList(LoopbackLink)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		if addrs[i].IP.Equal(vip) {
+			return &addrs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// owned returns true if the address is added by us
+func (r *RealServer) owned(addr *corenet.Addr) bool {
+	if addr.IP.To4() == nil {
+		return r.ownedIPv6[addr.IP.String()]
+	}
+	return addr.Label == OwnerLabel
+}
+
+// sysctlsOf returns the sysctl settings required by the VIP
+func sysctlsOf(vip net.IP) []drSysctl {
+	if vip.To4() == nil {
+		return nil
+	}
+	return drSysctls
+}
+
+func isHostMask(mask net.IPMask) bool {
+	ones, bits := mask.Size()
+	return ones == bits
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dr
+
+import (
+	"net"
+	"testing"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSysctl map[string]int
+
+func (f fakeSysctl) GetSysctl(key string) (int, error) {
+	return f[key], nil
+}
+
+func (f fakeSysctl) SetSysctl(key string, value int) error {
+	f[key] = value
+	return nil
+}
+
+var vip = net.ParseIP("10.0.0.100")
+
+func TestEnsureFresh(t *testing.T) {
+	addrs := corenet.NewFakeAddrHandle(corenet.NewAddr(net.ParseIP("127.0.0.1"), LoopbackLink))
+	sys := fakeSysctl{}
+	r := NewRealServer(addrs, sys)
+
+	assert.NotNil(t, r.Check(vip))
+	assert.Nil(t, r.Ensure(vip))
+	assert.Nil(t, r.Check(vip))
+	assert.Equal(t, 1, sys["net/ipv4/conf/all/arp_ignore"])
+	assert.Equal(t, 2, sys["net/ipv4/conf/lo/arp_announce"])
+
+	added := addrs.AddedAddrs()
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, OwnerLabel, added[0].Label)
+
+	// idempotent
+	assert.Nil(t, r.Ensure(vip))
+	assert.Equal(t, 1, len(addrs.AddedAddrs()))
+
+	assert.Nil(t, r.Teardown(vip))
+	assert.NotNil(t, r.Check(vip))
+}
+
+func TestEnsureRepair(t *testing.T) {
+	wrongMask := corenet.Addr{IPNet: &net.IPNet{IP: vip, Mask: net.CIDRMask(24, 32)}, Link: LoopbackLink, Label: OwnerLabel}
+	addrs := corenet.NewFakeAddrHandle(wrongMask)
+	sys := fakeSysctl{
+		"net/ipv4/conf/all/arp_ignore":   1,
+		"net/ipv4/conf/lo/arp_ignore":    1,
+		"net/ipv4/conf/all/arp_announce": 0,
+		"net/ipv4/conf/lo/arp_announce":  2,
+	}
+	r := NewRealServer(addrs, sys)
+
+	assert.NotNil(t, r.Check(vip))
+	assert.Nil(t, r.Ensure(vip))
+	assert.Equal(t, 2, sys["net/ipv4/conf/all/arp_announce"])
+
+	list, err := addrs.AddrList(LoopbackLink)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.True(t, isHostMask(list[0].Mask))
+}
+
+func TestTeardownForeign(t *testing.T) {
+	addrs := corenet.NewFakeAddrHandle(corenet.NewAddr(vip, LoopbackLink))
+	r := NewRealServer(addrs, fakeSysctl{})
+
+	// the address is not added by us
+	assert.Nil(t, r.Teardown(vip))
+	list, err := addrs.AddrList(LoopbackLink)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+}
+
+func TestEnsureIPv6(t *testing.T) {
+	vip6 := net.ParseIP("fd00::100")
+	addrs := corenet.NewFakeAddrHandle(corenet.NewAddr(net.ParseIP("::1"), LoopbackLink))
+	sys := fakeSysctl{}
+	r := NewRealServer(addrs, sys)
+
+	assert.Nil(t, r.Ensure(vip6))
+	assert.Nil(t, r.Check(vip6))
+	assert.Equal(t, float64(1), vipBound.Get("fd00::100", "IPv6"))
+	// no ARP settings for IPv6
+	assert.Equal(t, 0, len(sys))
+
+	added := addrs.AddedAddrs()
+	assert.Equal(t, 1, len(added))
+	assert.Equal(t, "fd00::100/128", added[0].IPNet.String())
+
+	assert.Nil(t, r.Teardown(vip6))
+	assert.NotNil(t, r.Check(vip6))
+	assert.Equal(t, float64(0), vipBound.Get("fd00::100", "IPv6"))
+}
+
+func TestTeardownForeignIPv6(t *testing.T) {
+	vip6 := net.ParseIP("fd00::100")
+	addrs := corenet.NewFakeAddrHandle(corenet.NewAddr(vip6, LoopbackLink))
+	r := NewRealServer(addrs, fakeSysctl{})
+
+	// the address is not added by this RealServer
+	assert.Nil(t, r.Teardown(vip6))
+	list, err := addrs.AddrList(LoopbackLink)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	// AllowChain is the chain in the filter table dropping the packets to
+	// the ports of VIPs from outside their source ranges
+	AllowChain utiliptables.Chain = "LOADBALANCER-SOURCE-RANGES"
+
+	allowComment = "loadbalancer-provider source ranges"
+)
+
+type allowRules struct {
+	vip    net.IP
+	ports  []corenet.Port
+	ranges []*net.IPNet
+}
+
+// Allowlist drops the packets to the ports of VIPs unless they come from
+// the source ranges of the VIPs, the VIPs without source ranges are
+// reachable by all clients
+type Allowlist struct {
+	ipt utiliptables.Interface
+
+	mu    sync.Mutex
+	rules map[string]*allowRules
+	// current is the chain restored last, the chain is not restored again
+	// if it is unchanged
+	current []byte
+}
+
+// NewAllowlist returns an Allowlist working on the iptables
+func NewAllowlist(ipt utiliptables.Interface) *Allowlist {
+	return &Allowlist{
+		ipt:   ipt,
+		rules: make(map[string]*allowRules),
+	}
+}
+
+// EnsureAllowRules allows the source ranges only to reach the ports of the
+// VIP, all ports if they are empty. The ranges of the other family than
+// the VIP are ignored, so the VIP is unreachable if none is left, and the
+// rules of the VIP are deleted if the ranges are empty. It is a no-op to
+// call it repeatedly.
+func (a *Allowlist) EnsureAllowRules(vip net.IP, ports []corenet.Port, ranges []*net.IPNet) error {
+	if vip == nil || (vip.To4() == nil) != a.ipt.IsIpv6() {
+		return fmt.Errorf("invalid VIP %v for the iptables", vip)
+	}
+	for _, p := range ports {
+		if (p.Protocol != "tcp" && p.Protocol != "udp") || p.Port == 0 {
+			return fmt.Errorf("invalid port %v", p)
+		}
+	}
+	if len(ranges) == 0 {
+		return a.DeleteAllowRules(vip)
+	}
+
+	family := corenet.FamilyOf(vip)
+	allowed := make([]*net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if corenet.FamilyOf(r.IP) == family {
+			allowed = append(allowed, r)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules[vip.String()] = &allowRules{
+		vip:    vip,
+		ports:  append([]corenet.Port(nil), ports...),
+		ranges: allowed,
+	}
+	return a.sync()
+}
+
+// DeleteAllowRules allows all clients to reach the VIP
+func (a *Allowlist) DeleteAllowRules(vip net.IP) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.rules[vip.String()]; !ok {
+		return nil
+	}
+	delete(a.rules, vip.String())
+	return a.sync()
+}
+
+// VIPs returns the VIPs with source ranges
+func (a *Allowlist) VIPs() []net.IP {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	vips := make([]net.IP, 0, len(a.rules))
+	for _, r := range a.rules {
+		vips = append(vips, r.vip)
+	}
+	return vips
+}
+
+// Cleanup deletes the jump to the chain and the chain itself
+func (a *Allowlist) Cleanup() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rules = make(map[string]*allowRules)
+	a.current = nil
+	log.Info("Deleting iptables chain", log.Fields{"table": utiliptables.TableFilter, "chain": AllowChain})
+	if err := a.ipt.DeleteRule(utiliptables.TableFilter, utiliptables.ChainInput, allowJumpArgs()...); err != nil {
+		return err
+	}
+	// the chain may not exist
+	a.ipt.FlushChain(utiliptables.TableFilter, AllowChain)
+	a.ipt.DeleteChain(utiliptables.TableFilter, AllowChain)
+	return nil
+}
+
+// sync rewrites the chain atomically by iptables-restore if it changed, so
+// the clients of the unchanged ranges are never dropped in between
+func (a *Allowlist) sync() error {
+	if _, err := a.ipt.EnsureChain(utiliptables.TableFilter, AllowChain); err != nil {
+		return err
+	}
+	// the packets are dropped before the accepting rules of others
+	if _, err := a.ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableFilter, utiliptables.ChainInput, allowJumpArgs()...); err != nil {
+		return err
+	}
+
+	data := a.buildRules()
+	if bytes.Equal(data, a.current) {
+		return nil
+	}
+	log.Debug("Restoring iptables rules", log.Fields{"rules": string(data)})
+	if err := a.ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters); err != nil {
+		return err
+	}
+	a.current = data
+	return nil
+}
+
+func (a *Allowlist) buildRules() []byte {
+	vips := make([]string, 0, len(a.rules))
+	for vip := range a.rules {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "*%s\n", utiliptables.TableFilter)
+	// declaring the chain flushes it
+	fmt.Fprintf(buf, ":%s - [0:0]\n", AllowChain)
+	for _, vip := range vips {
+		r := a.rules[vip]
+		dests := make([][]string, 0, len(r.ports))
+		for _, p := range r.ports {
+			dests = append(dests, destArgs(r.vip, &p))
+		}
+		if len(dests) == 0 {
+			dests = append(dests, destArgs(r.vip, nil))
+		}
+		for _, dest := range dests {
+			for _, ipnet := range r.ranges {
+				fmt.Fprintf(buf, "-A %s %s -s %s -j RETURN\n", AllowChain, strings.Join(dest, " "), ipnet)
+			}
+			fmt.Fprintf(buf, "-A %s %s -j DROP\n", AllowChain, strings.Join(dest, " "))
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func allowJumpArgs() []string {
+	return []string{"-m", "comment", "--comment", allowComment, "-j", string(AllowChain)}
+}
+
+// destArgs returns the arguments matching the packets to the port of the
+// VIP, to all ports if it is nil
+func destArgs(vip net.IP, p *corenet.Port) []string {
+	bits := 32
+	if vip.To4() == nil {
+		bits = 128
+	}
+	args := []string{"-d", fmt.Sprintf("%s/%d", vip, bits)}
+	if p != nil {
+		args = append(args, "-p", p.Protocol, "-m", p.Protocol, "--dport", fmt.Sprint(p.Port))
+	}
+	return args
+}
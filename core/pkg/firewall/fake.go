@@ -0,0 +1,192 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firewall
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+// FakeIPTables is an in-memory utiliptables.Interface for tests, it keeps
+// the rules of every chain in the form of arguments joined by spaces
+type FakeIPTables struct {
+	mu     sync.Mutex
+	ipv6   bool
+	chains map[string][]string
+	// Restored records the data passed to Restore and RestoreAll
+	Restored []string
+}
+
+var _ utiliptables.Interface = &FakeIPTables{}
+
+// NewFakeIPTables returns an empty FakeIPTables
+func NewFakeIPTables(ipv6 bool) *FakeIPTables {
+	return &FakeIPTables{
+		ipv6:   ipv6,
+		chains: make(map[string][]string),
+	}
+}
+
+func chainKey(table utiliptables.Table, chain utiliptables.Chain) string {
+	return string(table) + "/" + string(chain)
+}
+
+// Rules returns the rules of the chain, nil if the chain does not exist
+func (f *FakeIPTables) Rules(table utiliptables.Table, chain utiliptables.Chain) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.chains[chainKey(table, chain)]...)
+}
+
+// HasChain returns true if the chain exists
+func (f *FakeIPTables) HasChain(table utiliptables.Table, chain utiliptables.Chain) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.chains[chainKey(table, chain)]
+	return ok
+}
+
+// GetVersion implements utiliptables.Interface
+func (f *FakeIPTables) GetVersion() (string, error) {
+	return "1.6.1", nil
+}
+
+// EnsureChain implements utiliptables.Interface
+func (f *FakeIPTables) EnsureChain(table utiliptables.Table, chain utiliptables.Chain) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := chainKey(table, chain)
+	if _, ok := f.chains[key]; ok {
+		return true, nil
+	}
+	f.chains[key] = []string{}
+	return false, nil
+}
+
+// FlushChain implements utiliptables.Interface
+func (f *FakeIPTables) FlushChain(table utiliptables.Table, chain utiliptables.Chain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := chainKey(table, chain)
+	if _, ok := f.chains[key]; !ok {
+		return fmt.Errorf("chain %s does not exist", key)
+	}
+	f.chains[key] = []string{}
+	return nil
+}
+
+// DeleteChain implements utiliptables.Interface
+func (f *FakeIPTables) DeleteChain(table utiliptables.Table, chain utiliptables.Chain) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := chainKey(table, chain)
+	if _, ok := f.chains[key]; !ok {
+		return fmt.Errorf("chain %s does not exist", key)
+	}
+	delete(f.chains, key)
+	return nil
+}
+
+// EnsureRule implements utiliptables.Interface, the builtin chains are
+// created on demand
+func (f *FakeIPTables) EnsureRule(position utiliptables.RulePosition, table utiliptables.Table, chain utiliptables.Chain, args ...string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := chainKey(table, chain)
+	rule := strings.Join(args, " ")
+	for _, r := range f.chains[key] {
+		if r == rule {
+			return true, nil
+		}
+	}
+	if position == utiliptables.Prepend {
+		f.chains[key] = append([]string{rule}, f.chains[key]...)
+	} else {
+		f.chains[key] = append(f.chains[key], rule)
+	}
+	return false, nil
+}
+
+// DeleteRule implements utiliptables.Interface
+func (f *FakeIPTables) DeleteRule(table utiliptables.Table, chain utiliptables.Chain, args ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := chainKey(table, chain)
+	rule := strings.Join(args, " ")
+	for i, r := range f.chains[key] {
+		if r == rule {
+			f.chains[key] = append(f.chains[key][:i], f.chains[key][i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// IsIpv6 implements utiliptables.Interface
+func (f *FakeIPTables) IsIpv6() bool {
+	return f.ipv6
+}
+
+// Save implements utiliptables.Interface
+func (f *FakeIPTables) Save(table utiliptables.Table) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// SaveAll implements utiliptables.Interface
+func (f *FakeIPTables) SaveAll() ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// Restore implements utiliptables.Interface
+func (f *FakeIPTables) Restore(table utiliptables.Table, data []byte, flush utiliptables.FlushFlag, counters utiliptables.RestoreCountersFlag) error {
+	return f.RestoreAll(data, flush, counters)
+}
+
+// RestoreAll implements utiliptables.Interface, the declared chains are
+// replaced by the rules appended to them
+func (f *FakeIPTables) RestoreAll(data []byte, flush utiliptables.FlushFlag, counters utiliptables.RestoreCountersFlag) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Restored = append(f.Restored, string(data))
+
+	var table string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0 || line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, ":"):
+			f.chains[table+"/"+fields[0][1:]] = []string{}
+		case fields[0] == "-A" && len(fields) > 2:
+			key := table + "/" + fields[1]
+			f.chains[key] = append(f.chains[key], strings.Join(fields[2:], " "))
+		default:
+			return fmt.Errorf("unsupported restore line %q", line)
+		}
+	}
+	return nil
+}
+
+// AddReloadFunc implements utiliptables.Interface
+func (f *FakeIPTables) AddReloadFunc(reloadFunc func()) {}
+
+// Destroy implements utiliptables.Interface
+func (f *FakeIPTables) Destroy() {}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package firewall manages the iptables rules of the providers. The rules
+// live in chains owned by the provider, the rules of others, e.g.
+// kube-proxy, are never touched.
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	// TableMangle is the mangle table of iptables
+	TableMangle utiliptables.Table = "mangle"
+	// MarkChain is the chain in the mangle table holding the MARK rules
+	MarkChain utiliptables.Chain = "LOADBALANCER-FWMARK"
+
+	markComment = "loadbalancer-provider fwmark"
+)
+
+type markRules struct {
+	vip   net.IP
+	ports []corenet.Port
+	mark  uint32
+}
+
+// Marker marks the packets to the ports of VIPs with firewall marks, so a
+// ipvs virtual server keyed by the fwmark serves several ports
+type Marker struct {
+	ipt utiliptables.Interface
+
+	mu    sync.Mutex
+	rules map[string]*markRules
+}
+
+// NewMarker returns a Marker working on the iptables
+func NewMarker(ipt utiliptables.Interface) *Marker {
+	return &Marker{
+		ipt:   ipt,
+		rules: make(map[string]*markRules),
+	}
+}
+
+// EnsureMarkRules marks the packets to the ports of the VIP with the mark,
+// the ports of the VIP which were marked by the previous call but are
+// missing now are unmarked. It is a no-op to call it repeatedly.
+func (m *Marker) EnsureMarkRules(vip net.IP, ports []corenet.Port, mark uint32) error {
+	if vip == nil || (vip.To4() == nil) != m.ipt.IsIpv6() {
+		return fmt.Errorf("invalid VIP %v for the iptables", vip)
+	}
+	if mark == 0 {
+		return fmt.Errorf("invalid fwmark 0")
+	}
+	for _, p := range ports {
+		if (p.Protocol != "tcp" && p.Protocol != "udp") || p.Port == 0 {
+			return fmt.Errorf("invalid port %v", p)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules[vip.String()] = &markRules{
+		vip:   vip,
+		ports: append([]corenet.Port(nil), ports...),
+		mark:  mark,
+	}
+	return m.sync()
+}
+
+// DeleteMarkRules unmarks all ports of the VIP
+func (m *Marker) DeleteMarkRules(vip net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[vip.String()]; !ok {
+		return nil
+	}
+	delete(m.rules, vip.String())
+	return m.sync()
+}
+
+// Cleanup deletes the jump to the chain and the chain itself
+func (m *Marker) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rules = make(map[string]*markRules)
+	log.Info("Deleting iptables chain", log.Fields{"table": TableMangle, "chain": MarkChain})
+	if err := m.ipt.DeleteRule(TableMangle, utiliptables.ChainPrerouting, jumpArgs()...); err != nil {
+		return err
+	}
+	// the chain may not exist
+	m.ipt.FlushChain(TableMangle, MarkChain)
+	m.ipt.DeleteChain(TableMangle, MarkChain)
+	return nil
+}
+
+// sync rewrites the chain atomically by iptables-restore, the other chains
+// are kept since the tables are not flushed
+func (m *Marker) sync() error {
+	if _, err := m.ipt.EnsureChain(TableMangle, MarkChain); err != nil {
+		return err
+	}
+	if _, err := m.ipt.EnsureRule(utiliptables.Append, TableMangle, utiliptables.ChainPrerouting, jumpArgs()...); err != nil {
+		return err
+	}
+
+	data := m.buildRules()
+	log.Debug("Restoring iptables rules", log.Fields{"rules": string(data)})
+	return m.ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+}
+
+func (m *Marker) buildRules() []byte {
+	vips := make([]string, 0, len(m.rules))
+	for vip := range m.rules {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "*%s\n", TableMangle)
+	// declaring the chain flushes it
+	fmt.Fprintf(buf, ":%s - [0:0]\n", MarkChain)
+	for _, vip := range vips {
+		r := m.rules[vip]
+		for _, p := range r.ports {
+			fmt.Fprintf(buf, "-A %s %s\n", MarkChain, strings.Join(markArgs(r.vip, p, r.mark), " "))
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func jumpArgs() []string {
+	return []string{"-m", "comment", "--comment", markComment, "-j", string(MarkChain)}
+}
+
+func markArgs(vip net.IP, p corenet.Port, mark uint32) []string {
+	bits := 32
+	if vip.To4() == nil {
+		bits = 128
+	}
+	return []string{
+		"-d", fmt.Sprintf("%s/%d", vip, bits),
+		"-p", p.Protocol, "-m", p.Protocol, "--dport", fmt.Sprint(p.Port),
+		"-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0xffffffff", mark),
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+func TestEnsureMarkRules(t *testing.T) {
+	ipt := NewFakeIPTables(false)
+	// kube-proxy rules are kept
+	ipt.EnsureRule(utiliptables.Append, TableMangle, utiliptables.ChainPrerouting, "-j", "KUBE-MARK")
+	ipt.EnsureChain(TableMangle, "KUBE-MARK")
+	ipt.EnsureRule(utiliptables.Append, TableMangle, "KUBE-MARK", "-j", "MARK", "--set-xmark", "0x4000/0x4000")
+
+	m := NewMarker(ipt)
+	vip := net.ParseIP("10.0.0.100")
+	ports := []corenet.Port{{Protocol: "tcp", Port: 80}, {Protocol: "tcp", Port: 443}}
+
+	assert.Nil(t, m.EnsureMarkRules(vip, ports, 1))
+	assert.Nil(t, m.EnsureMarkRules(net.ParseIP("10.0.0.101"), []corenet.Port{{Protocol: "udp", Port: 53}}, 2))
+	// idempotent
+	assert.Nil(t, m.EnsureMarkRules(vip, ports, 1))
+
+	assert.Equal(t, []string{
+		"-j KUBE-MARK",
+		"-m comment --comment loadbalancer-provider fwmark -j LOADBALANCER-FWMARK",
+	}, ipt.Rules(TableMangle, utiliptables.ChainPrerouting))
+	assert.Equal(t, []string{
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -j MARK --set-xmark 0x1/0xffffffff",
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -j MARK --set-xmark 0x1/0xffffffff",
+		"-d 10.0.0.101/32 -p udp -m udp --dport 53 -j MARK --set-xmark 0x2/0xffffffff",
+	}, ipt.Rules(TableMangle, MarkChain))
+
+	// a removed port is unmarked
+	assert.Nil(t, m.EnsureMarkRules(vip, ports[1:], 1))
+	assert.Nil(t, m.DeleteMarkRules(net.ParseIP("10.0.0.101")))
+	assert.Equal(t, []string{
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -j MARK --set-xmark 0x1/0xffffffff",
+	}, ipt.Rules(TableMangle, MarkChain))
+
+	assert.Nil(t, m.Cleanup())
+	assert.False(t, ipt.HasChain(TableMangle, MarkChain))
+	assert.Equal(t, []string{"-j KUBE-MARK"}, ipt.Rules(TableMangle, utiliptables.ChainPrerouting))
+	assert.Equal(t, 1, len(ipt.Rules(TableMangle, "KUBE-MARK")))
+}
+
+func TestEnsureMarkRulesInvalid(t *testing.T) {
+	m := NewMarker(NewFakeIPTables(false))
+	vip := net.ParseIP("10.0.0.100")
+
+	assert.NotNil(t, m.EnsureMarkRules(vip, []corenet.Port{{Protocol: "tcp", Port: 80}}, 0))
+	assert.NotNil(t, m.EnsureMarkRules(vip, []corenet.Port{{Protocol: "sctp", Port: 80}}, 1))
+	assert.NotNil(t, m.EnsureMarkRules(net.ParseIP("2001:db8::1"), []corenet.Port{{Protocol: "tcp", Port: 80}}, 1))
+}
+
+func TestEnsureMasqueradeRules(t *testing.T) {
+	ipt := NewFakeIPTables(false)
+	m := NewMasquerader(ipt)
+	vip := net.ParseIP("10.0.0.100")
+	ports := []corenet.Port{{Protocol: "tcp", Port: 80}, {Protocol: "udp", Port: 53}}
+
+	assert.Nil(t, m.EnsureMasqueradeRules(vip, ports))
+	assert.Nil(t, m.EnsureMasqueradeRules(vip, ports))
+	assert.Equal(t, []string{
+		"-m comment --comment loadbalancer-provider masquerade -j LOADBALANCER-MASQUERADE",
+	}, ipt.Rules(utiliptables.TableNAT, utiliptables.ChainPostrouting))
+	assert.Equal(t, []string{
+		"-m ipvs --ipvs --vaddr 10.0.0.100/32 --vport 80 --vproto tcp --vmethod MASQ -j MASQUERADE",
+		"-m ipvs --ipvs --vaddr 10.0.0.100/32 --vport 53 --vproto udp --vmethod MASQ -j MASQUERADE",
+	}, ipt.Rules(utiliptables.TableNAT, MasqueradeChain))
+
+	// no port deletes the rules of the vip
+	assert.Nil(t, m.EnsureMasqueradeRules(vip, nil))
+	assert.Empty(t, ipt.Rules(utiliptables.TableNAT, MasqueradeChain))
+	assert.Empty(t, m.VIPs())
+	assert.NotNil(t, m.EnsureMasqueradeRules(net.ParseIP("2001:db8::1"), ports))
+
+	assert.Nil(t, m.Cleanup())
+	assert.False(t, ipt.HasChain(utiliptables.TableNAT, MasqueradeChain))
+	assert.Empty(t, ipt.Rules(utiliptables.TableNAT, utiliptables.ChainPostrouting))
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, ipnet, _ := net.ParseCIDR(c)
+		ret = append(ret, ipnet)
+	}
+	return ret
+}
+
+func TestEnsureAllowRules(t *testing.T) {
+	ipt := NewFakeIPTables(false)
+	// kube-proxy rules are kept
+	ipt.EnsureRule(utiliptables.Append, utiliptables.TableFilter, utiliptables.ChainInput, "-j", "KUBE-FIREWALL")
+
+	a := NewAllowlist(ipt)
+	vip := net.ParseIP("10.0.0.100")
+	ports := []corenet.Port{{Protocol: "tcp", Port: 80}, {Protocol: "udp", Port: 53}}
+
+	// added, the IPv6 ranges are ignored
+	assert.Nil(t, a.EnsureAllowRules(vip, ports, parseCIDRs("10.1.0.0/16", "2001:db8::/32", "192.168.1.1/32")))
+	assert.Nil(t, a.EnsureAllowRules(net.ParseIP("10.0.0.101"), nil, parseCIDRs("2001:db8::/32")))
+	assert.Equal(t, []string{
+		"-m comment --comment loadbalancer-provider source ranges -j LOADBALANCER-SOURCE-RANGES",
+		"-j KUBE-FIREWALL",
+	}, ipt.Rules(utiliptables.TableFilter, utiliptables.ChainInput))
+	assert.Equal(t, []string{
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 10.1.0.0/16 -j RETURN",
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 192.168.1.1/32 -j RETURN",
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -j DROP",
+		"-d 10.0.0.100/32 -p udp -m udp --dport 53 -s 10.1.0.0/16 -j RETURN",
+		"-d 10.0.0.100/32 -p udp -m udp --dport 53 -s 192.168.1.1/32 -j RETURN",
+		"-d 10.0.0.100/32 -p udp -m udp --dport 53 -j DROP",
+		"-d 10.0.0.101/32 -j DROP",
+	}, ipt.Rules(utiliptables.TableFilter, AllowChain))
+
+	// unchanged, not restored again
+	restored := len(ipt.Restored)
+	assert.Nil(t, a.EnsureAllowRules(vip, ports, parseCIDRs("10.1.0.0/16", "2001:db8::/32", "192.168.1.1/32")))
+	assert.Len(t, ipt.Restored, restored)
+
+	// shrunk
+	assert.Nil(t, a.EnsureAllowRules(vip, ports[:1], parseCIDRs("192.168.1.1/32")))
+	assert.Equal(t, []string{
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 192.168.1.1/32 -j RETURN",
+		"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -j DROP",
+		"-d 10.0.0.101/32 -j DROP",
+	}, ipt.Rules(utiliptables.TableFilter, AllowChain))
+
+	// removed
+	assert.Nil(t, a.EnsureAllowRules(vip, ports, nil))
+	assert.Nil(t, a.DeleteAllowRules(net.ParseIP("10.0.0.101")))
+	assert.Empty(t, ipt.Rules(utiliptables.TableFilter, AllowChain))
+	assert.Empty(t, a.VIPs())
+
+	assert.Nil(t, a.Cleanup())
+	assert.False(t, ipt.HasChain(utiliptables.TableFilter, AllowChain))
+	assert.Equal(t, []string{"-j KUBE-FIREWALL"}, ipt.Rules(utiliptables.TableFilter, utiliptables.ChainInput))
+
+	assert.NotNil(t, a.EnsureAllowRules(net.ParseIP("2001:db8::1"), nil, parseCIDRs("2001:db8::/32")))
+	assert.NotNil(t, a.EnsureAllowRules(vip, []corenet.Port{{Protocol: "sctp", Port: 80}}, parseCIDRs("10.1.0.0/16")))
+}
+
+func TestEnsureLimitRules(t *testing.T) {
+	ipt := NewFakeIPTables(false)
+	ipt.EnsureRule(utiliptables.Append, utiliptables.TableFilter, utiliptables.ChainInput, "-j", "KUBE-FIREWALL")
+
+	l := NewLimiter(ipt)
+	vip := net.ParseIP("10.0.0.100")
+	http := corenet.Port{Protocol: "tcp", Port: 80}
+	limits := []Limit{
+		{MaxConnections: 10000, ConnectionRate: 500},
+		{Port: &http, MaxConnections: 1000},
+		// nothing limited
+		{Port: &corenet.Port{Protocol: "udp", Port: 53}},
+	}
+
+	assert.Nil(t, l.EnsureLimitRules(vip, limits))
+	assert.Equal(t, []string{
+		"-m comment --comment loadbalancer-provider rate limits -j LOADBALANCER-RATE-LIMIT",
+		"-j KUBE-FIREWALL",
+	}, ipt.Rules(utiliptables.TableFilter, utiliptables.ChainInput))
+	assert.Equal(t, []string{
+		`-d 10.0.0.100/32 -m conntrack --ctstate NEW -m connlimit --connlimit-above 10000 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 all max-connections" -j DROP`,
+		`-d 10.0.0.100/32 -m conntrack --ctstate NEW -m hashlimit --hashlimit-above 500/sec --hashlimit-burst 500 --hashlimit-name ` + hashlimitName("10.0.0.100", "all", 500) + ` -m comment --comment "10.0.0.100 all connection-rate" -j DROP`,
+		`-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -m conntrack --ctstate NEW -m connlimit --connlimit-above 1000 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 tcp/80 max-connections" -j DROP`,
+	}, ipt.Rules(utiliptables.TableFilter, LimitChain))
+
+	// unchanged, not restored again
+	restored := len(ipt.Restored)
+	assert.Nil(t, l.EnsureLimitRules(vip, limits))
+	assert.Len(t, ipt.Restored, restored)
+
+	// changed in place, the hashlimit table is renamed with the rate
+	assert.Nil(t, l.EnsureLimitRules(vip, []Limit{{ConnectionRate: 200}}))
+	assert.NotEqual(t, hashlimitName("10.0.0.100", "all", 500), hashlimitName("10.0.0.100", "all", 200))
+	assert.Equal(t, []string{
+		`-d 10.0.0.100/32 -m conntrack --ctstate NEW -m hashlimit --hashlimit-above 200/sec --hashlimit-burst 200 --hashlimit-name ` + hashlimitName("10.0.0.100", "all", 200) + ` -m comment --comment "10.0.0.100 all connection-rate" -j DROP`,
+	}, ipt.Rules(utiliptables.TableFilter, LimitChain))
+
+	// the counters are read from the saved table
+	l.save = func() ([]byte, error) {
+		return []byte(`*filter
+:INPUT ACCEPT [100:6000]
+:LOADBALANCER-RATE-LIMIT - [0:0]
+[3:180] -A INPUT -m comment --comment "loadbalancer-provider rate limits" -j LOADBALANCER-RATE-LIMIT
+[42:2520] -A LOADBALANCER-RATE-LIMIT -d 10.0.0.100/32 -m conntrack --ctstate NEW -m hashlimit --hashlimit-above 200/sec --hashlimit-burst 200 --hashlimit-mode srcip --hashlimit-name lb-0 -m comment --comment "10.0.0.100 all connection-rate" -j DROP
+COMMIT
+`), nil
+	}
+	counters, err := l.Counters()
+	assert.Nil(t, err)
+	assert.Equal(t, []LimitCounter{{VIP: "10.0.0.100", Port: "all", Limit: LimitConnectionRate, Packets: 42}}, counters)
+	families := NewLimitCollector(l).Collect()
+	if assert.Len(t, families, 1) && assert.Len(t, families[0].Samples, 1) {
+		assert.Equal(t, []string{"10.0.0.100", "all", LimitConnectionRate}, families[0].Samples[0].LabelValues)
+		assert.Equal(t, 42.0, families[0].Samples[0].Value)
+	}
+
+	// removed
+	assert.Nil(t, l.EnsureLimitRules(vip, nil))
+	assert.Empty(t, ipt.Rules(utiliptables.TableFilter, LimitChain))
+	assert.Empty(t, l.VIPs())
+	counters, err = l.Counters()
+	assert.Nil(t, err)
+	assert.Empty(t, counters)
+
+	assert.Nil(t, l.Cleanup())
+	assert.False(t, ipt.HasChain(utiliptables.TableFilter, LimitChain))
+	assert.Equal(t, []string{"-j KUBE-FIREWALL"}, ipt.Rules(utiliptables.TableFilter, utiliptables.ChainInput))
+
+	assert.NotNil(t, l.EnsureLimitRules(net.ParseIP("2001:db8::1"), limits))
+	assert.NotNil(t, l.EnsureLimitRules(vip, []Limit{{Port: &corenet.Port{Protocol: "sctp", Port: 80}, MaxConnections: 1}}))
+	assert.NotNil(t, l.EnsureLimitRules(vip, []Limit{{MaxConnections: -1}}))
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firewall
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	// LimitChain is the chain in the filter table dropping the new
+	// connections to VIPs beyond their limits
+	LimitChain utiliptables.Chain = "LOADBALANCER-RATE-LIMIT"
+
+	limitComment = "loadbalancer-provider rate limits"
+
+	// LimitMaxConnections labels the rules capping the concurrent
+	// connections
+	LimitMaxConnections = "max-connections"
+	// LimitConnectionRate labels the rules capping the new connections per
+	// second
+	LimitConnectionRate = "connection-rate"
+
+	// limitAllPorts labels the rules of all ports of a VIP
+	limitAllPorts = "all"
+)
+
+// Limit caps the new connections to the VIP, or to the port of the VIP if
+// Port is set, a zero cap is unlimited
+type Limit struct {
+	Port           *corenet.Port
+	MaxConnections int
+	ConnectionRate int
+}
+
+type limitRules struct {
+	vip    net.IP
+	limits []Limit
+}
+
+// Limiter drops the new connections to VIPs beyond their limits by the
+// connlimit and hashlimit matches, the connections established before are
+// never dropped
+type Limiter struct {
+	ipt utiliptables.Interface
+	// save dumps the filter table with the counters of the rules
+	save func() ([]byte, error)
+
+	mu    sync.Mutex
+	rules map[string]*limitRules
+	// current is the chain restored last, the chain is not restored again
+	// if it is unchanged
+	current []byte
+}
+
+// NewLimiter returns a Limiter working on the iptables
+func NewLimiter(ipt utiliptables.Interface) *Limiter {
+	cmd := "iptables-save"
+	if ipt.IsIpv6() {
+		cmd = "ip6tables-save"
+	}
+	execer := k8sexec.New()
+	return &Limiter{
+		ipt: ipt,
+		// utiliptables saves the tables without the counters
+		save: func() ([]byte, error) {
+			return execer.Command(cmd, "-c", "-t", string(utiliptables.TableFilter)).Output()
+		},
+		rules: make(map[string]*limitRules),
+	}
+}
+
+// EnsureLimitRules caps the new connections to the VIP by the limits, the
+// rules of the VIP are deleted if nothing is limited. Changing the limits
+// replaces the rules in place. It is a no-op to call it repeatedly.
+func (l *Limiter) EnsureLimitRules(vip net.IP, limits []Limit) error {
+	if vip == nil || (vip.To4() == nil) != l.ipt.IsIpv6() {
+		return fmt.Errorf("invalid VIP %v for the iptables", vip)
+	}
+	effective := make([]Limit, 0, len(limits))
+	for _, limit := range limits {
+		if p := limit.Port; p != nil && ((p.Protocol != "tcp" && p.Protocol != "udp") || p.Port == 0) {
+			return fmt.Errorf("invalid port %v", *p)
+		}
+		if limit.MaxConnections < 0 || limit.ConnectionRate < 0 {
+			return fmt.Errorf("invalid limit %+v", limit)
+		}
+		if limit.MaxConnections != 0 || limit.ConnectionRate != 0 {
+			effective = append(effective, limit)
+		}
+	}
+	if len(effective) == 0 {
+		return l.DeleteLimitRules(vip)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules[vip.String()] = &limitRules{vip: vip, limits: effective}
+	return l.sync()
+}
+
+// DeleteLimitRules stops limiting the connections to the VIP
+func (l *Limiter) DeleteLimitRules(vip net.IP) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.rules[vip.String()]; !ok {
+		return nil
+	}
+	delete(l.rules, vip.String())
+	return l.sync()
+}
+
+// VIPs returns the VIPs with limits
+func (l *Limiter) VIPs() []net.IP {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	vips := make([]net.IP, 0, len(l.rules))
+	for _, r := range l.rules {
+		vips = append(vips, r.vip)
+	}
+	return vips
+}
+
+// Cleanup deletes the jump to the chain and the chain itself
+func (l *Limiter) Cleanup() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rules = make(map[string]*limitRules)
+	l.current = nil
+	log.Info("Deleting iptables chain", log.Fields{"table": utiliptables.TableFilter, "chain": LimitChain})
+	if err := l.ipt.DeleteRule(utiliptables.TableFilter, utiliptables.ChainInput, limitJumpArgs()...); err != nil {
+		return err
+	}
+	// the chain may not exist
+	l.ipt.FlushChain(utiliptables.TableFilter, LimitChain)
+	l.ipt.DeleteChain(utiliptables.TableFilter, LimitChain)
+	return nil
+}
+
+// sync rewrites the chain atomically by iptables-restore if it changed
+func (l *Limiter) sync() error {
+	if _, err := l.ipt.EnsureChain(utiliptables.TableFilter, LimitChain); err != nil {
+		return err
+	}
+	if _, err := l.ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableFilter, utiliptables.ChainInput, limitJumpArgs()...); err != nil {
+		return err
+	}
+
+	data := l.buildRules()
+	if bytes.Equal(data, l.current) {
+		return nil
+	}
+	log.Debug("Restoring iptables rules", log.Fields{"rules": string(data)})
+	if err := l.ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters); err != nil {
+		return err
+	}
+	l.current = data
+	return nil
+}
+
+func (l *Limiter) buildRules() []byte {
+	vips := make([]string, 0, len(l.rules))
+	for vip := range l.rules {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "*%s\n", utiliptables.TableFilter)
+	// declaring the chain flushes it
+	fmt.Fprintf(buf, ":%s - [0:0]\n", LimitChain)
+	for _, vip := range vips {
+		r := l.rules[vip]
+		bits := 32
+		if r.vip.To4() == nil {
+			bits = 128
+		}
+		for _, limit := range r.limits {
+			dest := strings.Join(destArgs(r.vip, limit.Port), " ")
+			port := limitAllPorts
+			if limit.Port != nil {
+				port = limit.Port.String()
+			}
+			if limit.MaxConnections != 0 {
+				// connlimit counts the connections matched by the rule
+				// only, i.e. the ones to the port of the VIP
+				fmt.Fprintf(buf, "-A %s %s -m conntrack --ctstate NEW -m connlimit --connlimit-above %d --connlimit-mask %d --connlimit-daddr -m comment --comment %q -j DROP\n",
+					LimitChain, dest, limit.MaxConnections, bits, limitRuleComment(vip, port, LimitMaxConnections))
+			}
+			if limit.ConnectionRate != 0 {
+				fmt.Fprintf(buf, "-A %s %s -m conntrack --ctstate NEW -m hashlimit --hashlimit-above %d/sec --hashlimit-burst %d --hashlimit-name %s -m comment --comment %q -j DROP\n",
+					LimitChain, dest, limit.ConnectionRate, limit.ConnectionRate, hashlimitName(vip, port, limit.ConnectionRate), limitRuleComment(vip, port, LimitConnectionRate))
+			}
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func limitJumpArgs() []string {
+	return []string{"-m", "comment", "--comment", limitComment, "-j", string(LimitChain)}
+}
+
+func limitRuleComment(vip, port, limit string) string {
+	return strings.Join([]string{vip, port, limit}, " ")
+}
+
+// hashlimitName returns the name of the hashlimit table of the rate of the
+// port. The kernel keeps the parameters of a table until all rules of its
+// name are gone, so the name changes with the rate to apply a new one in
+// place.
+func hashlimitName(vip, port string, rate int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s %s %d", vip, port, rate)
+	return fmt.Sprintf("lb-%08x", h.Sum32())
+}
+
+// LimitCounter is the number of the packets dropped by a limit of a VIP
+type LimitCounter struct {
+	VIP string
+	// Port is the port of the limit, all for the limits of the VIP
+	Port string
+	// Limit is LimitMaxConnections or LimitConnectionRate
+	Limit   string
+	Packets uint64
+}
+
+var limitCounterRegexp = regexp.MustCompile(`^\[(\d+):\d+\] -A ` + string(LimitChain) + ` .*--comment "([^"]*)"`)
+
+// Counters returns the counters of the limits, none if nothing is limited
+func (l *Limiter) Counters() ([]LimitCounter, error) {
+	l.mu.Lock()
+	limited := len(l.rules) != 0
+	l.mu.Unlock()
+	if !limited {
+		return nil, nil
+	}
+
+	data, err := l.save()
+	if err != nil {
+		return nil, err
+	}
+	counters := make([]LimitCounter, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		match := limitCounterRegexp.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		fields := strings.Fields(match[2])
+		if len(fields) != 3 {
+			continue
+		}
+		packets, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, LimitCounter{VIP: fields[0], Port: fields[1], Limit: fields[2], Packets: packets})
+	}
+	return counters, scanner.Err()
+}
+
+// NewLimitCollector returns a collector exporting the counters of the
+// limiters in one family, the limiters failing to read them are skipped
+func NewLimitCollector(limiters ...*Limiter) metrics.Collector {
+	return metrics.CollectorFunc(func() []*metrics.Family {
+		family := &metrics.Family{
+			Name:       "loadbalancer_provider_rate_limited_packets_total",
+			Help:       "Number of the packets of the new connections to the VIP dropped by the limit",
+			Type:       metrics.TypeCounter,
+			LabelNames: []string{"vip", "port", "limit"},
+		}
+		for _, l := range limiters {
+			counters, err := l.Counters()
+			if err != nil {
+				log.Warn("read rate limit counters error", log.Fields{"err": err})
+				continue
+			}
+			for _, c := range counters {
+				family.Samples = append(family.Samples, metrics.Sample{LabelValues: []string{c.VIP, c.Port, c.Limit}, Value: float64(c.Packets)})
+			}
+		}
+		return []*metrics.Family{family}
+	})
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package firewall
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+const (
+	// MasqueradeChain is the chain in the nat table masquerading the
+	// connections forwarded by ipvs NAT
+	MasqueradeChain utiliptables.Chain = "LOADBALANCER-MASQUERADE"
+
+	masqueradeComment = "loadbalancer-provider masquerade"
+)
+
+type masqueradeRules struct {
+	vip   net.IP
+	ports []corenet.Port
+}
+
+// Masquerader masquerades the connections to the ports of VIPs which ipvs
+// forwards by NAT, so the real servers reply through the node whatever
+// their routes are
+type Masquerader struct {
+	ipt utiliptables.Interface
+
+	mu    sync.Mutex
+	rules map[string]*masqueradeRules
+}
+
+// NewMasquerader returns a Masquerader working on the iptables
+func NewMasquerader(ipt utiliptables.Interface) *Masquerader {
+	return &Masquerader{
+		ipt:   ipt,
+		rules: make(map[string]*masqueradeRules),
+	}
+}
+
+// EnsureMasqueradeRules masquerades the connections to the ports of the
+// VIP, the rules of the VIP are deleted if the ports are empty. It is a
+// no-op to call it repeatedly.
+func (m *Masquerader) EnsureMasqueradeRules(vip net.IP, ports []corenet.Port) error {
+	if vip == nil || (vip.To4() == nil) != m.ipt.IsIpv6() {
+		return fmt.Errorf("invalid VIP %v for the iptables", vip)
+	}
+	for _, p := range ports {
+		if (p.Protocol != "tcp" && p.Protocol != "udp") || p.Port == 0 {
+			return fmt.Errorf("invalid port %v", p)
+		}
+	}
+	if len(ports) == 0 {
+		return m.DeleteMasqueradeRules(vip)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules[vip.String()] = &masqueradeRules{
+		vip:   vip,
+		ports: append([]corenet.Port(nil), ports...),
+	}
+	return m.sync()
+}
+
+// DeleteMasqueradeRules stops masquerading the connections to the VIP
+func (m *Masquerader) DeleteMasqueradeRules(vip net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rules[vip.String()]; !ok {
+		return nil
+	}
+	delete(m.rules, vip.String())
+	return m.sync()
+}
+
+// VIPs returns the VIPs with masqueraded ports
+func (m *Masquerader) VIPs() []net.IP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vips := make([]net.IP, 0, len(m.rules))
+	for _, r := range m.rules {
+		vips = append(vips, r.vip)
+	}
+	return vips
+}
+
+// Cleanup deletes the jump to the chain and the chain itself
+func (m *Masquerader) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rules = make(map[string]*masqueradeRules)
+	log.Info("Deleting iptables chain", log.Fields{"table": utiliptables.TableNAT, "chain": MasqueradeChain})
+	if err := m.ipt.DeleteRule(utiliptables.TableNAT, utiliptables.ChainPostrouting, masqueradeJumpArgs()...); err != nil {
+		return err
+	}
+	// the chain may not exist
+	m.ipt.FlushChain(utiliptables.TableNAT, MasqueradeChain)
+	m.ipt.DeleteChain(utiliptables.TableNAT, MasqueradeChain)
+	return nil
+}
+
+// sync rewrites the chain atomically by iptables-restore
+func (m *Masquerader) sync() error {
+	if _, err := m.ipt.EnsureChain(utiliptables.TableNAT, MasqueradeChain); err != nil {
+		return err
+	}
+	if _, err := m.ipt.EnsureRule(utiliptables.Append, utiliptables.TableNAT, utiliptables.ChainPostrouting, masqueradeJumpArgs()...); err != nil {
+		return err
+	}
+
+	data := m.buildRules()
+	log.Debug("Restoring iptables rules", log.Fields{"rules": string(data)})
+	return m.ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+}
+
+func (m *Masquerader) buildRules() []byte {
+	vips := make([]string, 0, len(m.rules))
+	for vip := range m.rules {
+		vips = append(vips, vip)
+	}
+	sort.Strings(vips)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "*%s\n", utiliptables.TableNAT)
+	// declaring the chain flushes it
+	fmt.Fprintf(buf, ":%s - [0:0]\n", MasqueradeChain)
+	for _, vip := range vips {
+		r := m.rules[vip]
+		for _, p := range r.ports {
+			fmt.Fprintf(buf, "-A %s %s\n", MasqueradeChain, strings.Join(masqueradeArgs(r.vip, p), " "))
+		}
+	}
+	buf.WriteString("COMMIT\n")
+	return buf.Bytes()
+}
+
+func masqueradeJumpArgs() []string {
+	return []string{"-m", "comment", "--comment", masqueradeComment, "-j", string(MasqueradeChain)}
+}
+
+// masqueradeArgs matches the connections ipvs forwards by NAT from the port
+// of the VIP, the connections forwarded by DR keep their source
+func masqueradeArgs(vip net.IP, p corenet.Port) []string {
+	bits := 32
+	if vip.To4() == nil {
+		bits = 128
+	}
+	return []string{
+		"-m", "ipvs", "--ipvs", "--vaddr", fmt.Sprintf("%s/%d", vip, bits),
+		"--vport", fmt.Sprint(p.Port), "--vproto", p.Protocol, "--vmethod", "MASQ",
+		"-j", "MASQUERADE",
+	}
+}
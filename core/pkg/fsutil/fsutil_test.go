@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "file")
+
+	assert.Nil(t, WriteFileAtomic(filename, []byte("old"), 0644))
+	assert.Nil(t, WriteFileAtomic(filename, []byte("new"), 0600))
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+	if info, err := os.Stat(filename); assert.Nil(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// the temporary file is removed when the rename fails
+	sub := filepath.Join(dir, "sub")
+	assert.Nil(t, os.Mkdir(sub, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(sub, "file"), nil, 0644))
+	assert.NotNil(t, WriteFileAtomic(sub, []byte("data"), 0644))
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.Equal(t, []string{"file", "sub"}, names)
+}
@@ -0,0 +1,456 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package healthcheck probes the real servers actively, so a node which is
+// Ready but whose proxy is broken stops receiving new traffic.
+package healthcheck
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+)
+
+// Protocol is the protocol of a health check
+type Protocol string
+
+const (
+	// ProtocolTCP checks if a tcp connection can be established
+	ProtocolTCP Protocol = "tcp"
+	// ProtocolHTTP checks if a GET request gets the expected status
+	ProtocolHTTP Protocol = "http"
+	// ProtocolUDP sends a datagram and checks the response if one is
+	// expected, otherwise only that the port is not unreachable
+	ProtocolUDP Protocol = "udp"
+)
+
+const (
+	// DefaultInterval is the default interval of the probes of a target
+	DefaultInterval = 5 * time.Second
+	// DefaultWorkers is the default number of concurrent probes
+	DefaultWorkers = 10
+
+	defaultTimeoutSeconds = 3
+	defaultRise           = 2
+	defaultFall           = 3
+	defaultPath           = "/"
+)
+
+var (
+	targetHealthy = metrics.NewGaugeVec(
+		"loadbalancer_provider_healthcheck_healthy",
+		"Whether the health check target is healthy",
+		"target",
+	)
+	targetFailures = metrics.NewCounterVec(
+		"loadbalancer_provider_healthcheck_failures_total",
+		"Number of failed probes of the health check target",
+		"target",
+	)
+)
+
+func init() {
+	metrics.MustRegister(targetHealthy, targetFailures)
+}
+
+// Check is the health check of a port of the real servers
+type Check struct {
+	Protocol Protocol `json:"protocol"`
+	Port     int      `json:"port"`
+	// Path is the path of the http request, / by default
+	Path string `json:"path,omitempty"`
+	// ExpectedStatus is the status of a healthy response, 200 by default
+	ExpectedStatus int `json:"expectedStatus,omitempty"`
+	// Send is the hex encoded payload of the udp datagram, it is empty by
+	// default
+	Send string `json:"send,omitempty"`
+	// Expect is the hex encoded bytes a healthy udp response contains, no
+	// response is expected if it is empty
+	Expect         string `json:"expect,omitempty"`
+	TimeoutSeconds int    `json:"timeoutSeconds,omitempty"`
+	// Rise is the number of consecutive successful probes to consider an
+	// unhealthy target healthy
+	Rise int `json:"rise,omitempty"`
+	// Fall is the number of consecutive failed probes to consider a
+	// healthy target unhealthy
+	Fall int `json:"fall,omitempty"`
+}
+
+// SetDefaults fills the unset fields with the defaults
+func (c *Check) SetDefaults() {
+	if c.Protocol == ProtocolHTTP {
+		if c.Path == "" {
+			c.Path = defaultPath
+		}
+		if c.ExpectedStatus == 0 {
+			c.ExpectedStatus = http.StatusOK
+		}
+	}
+	if c.TimeoutSeconds == 0 {
+		c.TimeoutSeconds = defaultTimeoutSeconds
+	}
+	if c.Rise == 0 {
+		c.Rise = defaultRise
+	}
+	if c.Fall == 0 {
+		c.Fall = defaultFall
+	}
+}
+
+// Validate returns an error if the check is invalid
+func (c *Check) Validate() error {
+	if c.Protocol != ProtocolTCP && c.Protocol != ProtocolHTTP && c.Protocol != ProtocolUDP {
+		return fmt.Errorf("unsupported health check protocol %q", c.Protocol)
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", c.Port)
+	}
+	if c.Protocol != ProtocolUDP && (c.Send != "" || c.Expect != "") {
+		return fmt.Errorf("%s health check of port %d has a udp payload", c.Protocol, c.Port)
+	}
+	if _, err := hex.DecodeString(c.Send); err != nil {
+		return fmt.Errorf("invalid udp payload of health check of port %d: %v", c.Port, err)
+	}
+	if _, err := hex.DecodeString(c.Expect); err != nil {
+		return fmt.Errorf("invalid udp response of health check of port %d: %v", c.Port, err)
+	}
+	if c.TimeoutSeconds < 0 || c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("negative timeout, rise or fall of health check of port %d", c.Port)
+	}
+	return nil
+}
+
+// Transport returns the transport protocol of the check, the checks of a
+// port are distinct per transport
+func (c *Check) Transport() string {
+	if c.Protocol == ProtocolUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// Target is a health check of a real server
+type Target struct {
+	IP    net.IP
+	Check Check
+}
+
+func (t Target) address() string {
+	return net.JoinHostPort(t.IP.String(), strconv.Itoa(t.Check.Port))
+}
+
+// String returns the target in the form of an url, e.g.
+// http://10.0.0.1:80/healthz
+func (t Target) String() string {
+	switch t.Check.Protocol {
+	case ProtocolHTTP:
+		return "http://" + t.address() + t.Check.Path
+	case ProtocolUDP:
+		return "udp://" + t.address()
+	}
+	return "tcp://" + t.address()
+}
+
+// State is the health state of a target
+type State struct {
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	// Successes and Failures are the numbers of consecutive successful and
+	// failed probes
+	Successes int       `json:"successes"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"lastError,omitempty"`
+	LastProbe time.Time `json:"lastProbe"`
+}
+
+type target struct {
+	Target
+	state State
+}
+
+// Checker probes the targets on an interval, with a bounded number of
+// concurrent probes. A target turns unhealthy after Fall consecutive failed
+// probes, and healthy again after Rise consecutive successful ones. New
+// targets are healthy until proven otherwise.
+type Checker struct {
+	Interval time.Duration
+	Workers  int
+	// OnChange is called when a target turns healthy or unhealthy
+	OnChange func(t Target, healthy bool)
+
+	probe func(Target) error
+	now   func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*target
+}
+
+// NewChecker returns a Checker calling onChange on the transitions
+func NewChecker(onChange func(t Target, healthy bool)) *Checker {
+	return &Checker{
+		Interval: DefaultInterval,
+		Workers:  DefaultWorkers,
+		OnChange: onChange,
+		probe:    probe,
+		now:      time.Now,
+		targets:  make(map[string]*target),
+	}
+}
+
+// SetTargets replaces the targets, the states of the remaining ones are
+// kept
+func (c *Checker) SetTargets(targets []Target) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	desired := make(map[string]*target, len(targets))
+	for _, t := range targets {
+		t.Check.SetDefaults()
+		key := t.String()
+		if cur, ok := c.targets[key]; ok {
+			cur.Target = t
+			desired[key] = cur
+			continue
+		}
+		desired[key] = &target{Target: t, state: State{Target: key, Healthy: true}}
+		targetHealthy.Set(1, key)
+	}
+	for key := range c.targets {
+		if _, ok := desired[key]; !ok {
+			targetHealthy.Delete(key)
+			targetFailures.Delete(key)
+		}
+	}
+	c.targets = desired
+}
+
+// Healthy returns false if any target of the ip is unhealthy
+func (c *Checker) Healthy(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range c.targets {
+		if t.IP.Equal(ip) && !t.state.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// States returns the states of the targets sorted by target
+func (c *Checker) States() []State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	states := make([]State, 0, len(c.targets))
+	for _, t := range c.targets {
+		states = append(states, t.state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Target < states[j].Target })
+	return states
+}
+
+// ServeHTTP implements http.Handler, it writes the states in json for
+// debugging
+func (c *Checker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.States()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Run probes the targets every Interval until stopCh is closed
+func (c *Checker) Run(stopCh <-chan struct{}) {
+	log.Info("Health checker started", log.Fields{"interval": c.Interval, "workers": c.Workers})
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			log.Info("Health checker stopped")
+			return
+		case <-ticker.C:
+			c.round()
+		}
+	}
+}
+
+// round probes all targets once and waits for the probes
+func (c *Checker) round() {
+	c.mu.Lock()
+	targets := make([]Target, 0, len(c.targets))
+	for _, t := range c.targets {
+		targets = append(targets, t.Target)
+	}
+	c.mu.Unlock()
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	errs := make([]error, len(targets))
+	wg := sync.WaitGroup{}
+	for i := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = c.probe(targets[i])
+		}(i)
+	}
+	wg.Wait()
+
+	changed := make([]Target, 0)
+	c.mu.Lock()
+	for i, t := range targets {
+		if c.report(t.String(), errs[i]) {
+			changed = append(changed, t)
+		}
+	}
+	healthy := make([]bool, len(changed))
+	for i, t := range changed {
+		healthy[i] = c.targets[t.String()].state.Healthy
+	}
+	c.mu.Unlock()
+
+	if c.OnChange == nil {
+		return
+	}
+	for i, t := range changed {
+		c.OnChange(t, healthy[i])
+	}
+}
+
+// report records the result of a probe, it returns true if the target
+// turns healthy or unhealthy
+func (c *Checker) report(key string, err error) bool {
+	t, ok := c.targets[key]
+	if !ok {
+		// removed during the probe
+		return false
+	}
+	s := &t.state
+	s.LastProbe = c.now()
+
+	if err == nil {
+		s.Failures = 0
+		s.Successes++
+		s.LastError = ""
+		if s.Healthy || s.Successes < t.Check.Rise {
+			return false
+		}
+		s.Healthy = true
+		targetHealthy.Set(1, key)
+		log.Info("Health check target turned healthy", log.Fields{"target": key})
+		return true
+	}
+
+	s.Successes = 0
+	s.Failures++
+	s.LastError = err.Error()
+	targetFailures.Inc(key)
+	if !s.Healthy || s.Failures < t.Check.Fall {
+		return false
+	}
+	s.Healthy = false
+	targetHealthy.Set(0, key)
+	log.Warn("Health check target turned unhealthy", log.Fields{"target": key, "err": err})
+	return true
+}
+
+func probe(t Target) error {
+	timeout := time.Duration(t.Check.TimeoutSeconds) * time.Second
+	switch t.Check.Protocol {
+	case ProtocolHTTP:
+		return probeHTTP(t, timeout)
+	case ProtocolUDP:
+		return probeUDP(t, timeout)
+	}
+	return probeTCP(t, timeout)
+}
+
+func probeTCP(t Target, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", t.address(), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeUDP sends the payload and waits for a response until the timeout. A
+// port without a listener is reported by an ICMP port unreachable, which
+// fails the read. Without an expected response, the silence of the target
+// is healthy since it is present.
+func probeUDP(t Target, timeout time.Duration) error {
+	send, _ := hex.DecodeString(t.Check.Send)
+	expect, _ := hex.DecodeString(t.Check.Expect)
+
+	conn, err := net.DialTimeout("udp", t.address(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(send); err != nil {
+		return err
+	}
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && len(expect) == 0 {
+			return nil
+		}
+		return err
+	}
+	if !bytes.Contains(buf[:n], expect) {
+		return fmt.Errorf("unexpected response %x, expect %x", buf[:n], expect)
+	}
+	return nil
+}
+
+func probeHTTP(t Target, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DisableKeepAlives: true},
+		// the status of a redirect is checked as is
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(t.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != t.Check.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d, expect %d", resp.StatusCode, t.Check.ExpectedStatus)
+	}
+	return nil
+}
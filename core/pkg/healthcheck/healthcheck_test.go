@@ -0,0 +1,199 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package healthcheck
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type change struct {
+	target  string
+	healthy bool
+}
+
+func newTestChecker() (*Checker, *[]change) {
+	changes := make([]change, 0)
+	c := NewChecker(func(t Target, healthy bool) {
+		changes = append(changes, change{t.String(), healthy})
+	})
+	c.Workers = 2
+	return c, &changes
+}
+
+// refusedPort returns a local port nobody listens on
+func refusedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func serverPort(t *testing.T, s *httptest.Server) int {
+	u, err := url.Parse(s.URL)
+	assert.Nil(t, err)
+	port, err := strconv.Atoi(u.Port())
+	assert.Nil(t, err)
+	return port
+}
+
+func TestCheckerHTTPFlapping(t *testing.T) {
+	var status int32 = http.StatusOK
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer s.Close()
+
+	c, changes := newTestChecker()
+	ip := net.ParseIP("127.0.0.1")
+	target := Target{IP: ip, Check: Check{Protocol: ProtocolHTTP, Port: serverPort(t, s), Path: "/healthz", Rise: 2, Fall: 3}}
+	c.SetTargets([]Target{target})
+	key := c.States()[0].Target
+
+	c.round()
+	assert.True(t, c.Healthy(ip))
+
+	// two failures are not enough to fall
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	c.round()
+	c.round()
+	assert.True(t, c.Healthy(ip))
+	assert.Equal(t, 2, c.States()[0].Failures)
+
+	// a success in between resets the failures
+	atomic.StoreInt32(&status, http.StatusOK)
+	c.round()
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	c.round()
+	c.round()
+	assert.True(t, c.Healthy(ip))
+	assert.Empty(t, *changes)
+
+	c.round()
+	assert.False(t, c.Healthy(ip))
+	assert.Equal(t, []change{{key, false}}, *changes)
+	assert.Equal(t, float64(0), targetHealthy.Get(key))
+
+	// a single success is not enough to rise
+	atomic.StoreInt32(&status, http.StatusOK)
+	c.round()
+	assert.False(t, c.Healthy(ip))
+	c.round()
+	assert.True(t, c.Healthy(ip))
+	assert.Equal(t, []change{{key, false}, {key, true}}, *changes)
+	assert.Equal(t, float64(1), targetHealthy.Get(key))
+}
+
+func TestCheckerTCP(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	defer s.Close()
+
+	c, changes := newTestChecker()
+	up := Target{IP: net.ParseIP("127.0.0.1"), Check: Check{Protocol: ProtocolTCP, Port: serverPort(t, s), Fall: 1}}
+	down := Target{IP: net.ParseIP("127.0.0.2"), Check: Check{Protocol: ProtocolTCP, Port: refusedPort(t), Fall: 1}}
+	// the status is not checked by tcp
+	notFound := Target{IP: net.ParseIP("127.0.0.1"), Check: Check{Protocol: ProtocolHTTP, Port: serverPort(t, s), ExpectedStatus: http.StatusNotFound, Fall: 1}}
+	c.SetTargets([]Target{up, down, notFound})
+
+	c.round()
+	assert.True(t, c.Healthy(up.IP))
+	assert.False(t, c.Healthy(down.IP))
+	assert.Equal(t, []change{{down.String(), false}}, *changes)
+
+	states := c.States()
+	assert.Equal(t, 3, len(states))
+	assert.NotEmpty(t, states[2].LastError)
+
+	// the states of the remaining targets are kept, the removed ones are
+	// forgotten
+	c.SetTargets([]Target{down})
+	assert.Equal(t, 1, len(c.States()))
+	assert.False(t, c.Healthy(down.IP))
+	c.SetTargets(nil)
+	assert.True(t, c.Healthy(down.IP))
+}
+
+// udpServer answers pong to ping, and is silent otherwise
+func udpServer(t *testing.T) (*net.UDPConn, int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Nil(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "ping" {
+				conn.WriteToUDP([]byte("pong"), addr)
+			}
+		}
+	}()
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestProbeUDP(t *testing.T) {
+	conn, port := udpServer(t)
+	defer conn.Close()
+
+	ping := hex.EncodeToString([]byte("ping"))
+	pong := hex.EncodeToString([]byte("pong"))
+	cases := []struct {
+		name    string
+		check   Check
+		healthy bool
+	}{
+		{"response", Check{Port: port, Send: ping, Expect: pong}, true},
+		{"unexpected response", Check{Port: port, Send: ping, Expect: ping}, false},
+		{"presence", Check{Port: port}, true},
+		{"silence", Check{Port: port, Expect: pong}, false},
+		{"unreachable", Check{Port: refusedPort(t)}, false},
+	}
+	for _, c := range cases {
+		c.check.Protocol = ProtocolUDP
+		c.check.TimeoutSeconds = 1
+		c.check.SetDefaults()
+		target := Target{IP: net.ParseIP("127.0.0.1"), Check: c.check}
+		assert.Equal(t, "udp://127.0.0.1:"+strconv.Itoa(c.check.Port), target.String())
+		err := probe(target)
+		assert.Equal(t, c.healthy, err == nil, c.name+": %v", err)
+	}
+}
+
+func TestCheckValidate(t *testing.T) {
+	c := Check{Protocol: ProtocolHTTP, Port: 80}
+	assert.Nil(t, c.Validate())
+	c.SetDefaults()
+	assert.Equal(t, Check{Protocol: ProtocolHTTP, Port: 80, Path: "/", ExpectedStatus: 200, TimeoutSeconds: 3, Rise: 2, Fall: 3}, c)
+
+	assert.Nil(t, (&Check{Protocol: ProtocolUDP, Port: 53, Send: "0001", Expect: "00"}).Validate())
+	assert.NotNil(t, (&Check{Protocol: "sctp", Port: 80}).Validate())
+	assert.NotNil(t, (&Check{Protocol: ProtocolUDP, Port: 53, Send: "ping"}).Validate())
+	assert.NotNil(t, (&Check{Protocol: ProtocolTCP, Port: 80, Send: "00"}).Validate())
+	assert.NotNil(t, (&Check{Protocol: ProtocolTCP}).Validate())
+	assert.NotNil(t, (&Check{Protocol: ProtocolTCP, Port: 80, Fall: -1}).Validate())
+}
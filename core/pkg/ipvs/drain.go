@@ -0,0 +1,148 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// DefaultDrainTimeout is the default time a removed real server is
+	// drained before it is deleted anyway
+	DefaultDrainTimeout = time.Minute
+)
+
+var drainedRealServers = metrics.NewCounterVec(
+	"loadbalancer_provider_ipvs_drained_real_servers_total",
+	"Number of removed real servers deleted after draining, by whether the connections drained or the timeout expired",
+	"reason",
+)
+
+func init() {
+	metrics.MustRegister(drainedRealServers)
+}
+
+// Drainer drains the real servers being removed: they are weighted to zero
+// so no new connections arrive, and deleted once their active connections
+// drop to Threshold or Timeout expires. The state is kept across calls, so
+// the callers re-evaluate on every sync instead of blocking until drained.
+type Drainer struct {
+	Timeout   time.Duration
+	Threshold int
+
+	handle Handle
+	now    func() time.Time
+
+	mu       sync.Mutex
+	draining map[string]time.Time
+}
+
+// NewDrainer returns a Drainer reading the active connections by handle
+func NewDrainer(handle Handle, timeout time.Duration, threshold int) *Drainer {
+	return &Drainer{
+		Timeout:   timeout,
+		Threshold: threshold,
+		handle:    handle,
+		now:       time.Now,
+		draining:  make(map[string]time.Time),
+	}
+}
+
+func drainKey(vs *VirtualServer, rs *RealServer) string {
+	return vs.Key() + " " + rs.Key()
+}
+
+// Drain starts or continues draining the stale real servers of the virtual
+// server. It returns the ones which are still being drained with zero
+// weights, the others are drained and should be deleted.
+func (d *Drainer) Drain(vs *VirtualServer, stale []RealServer) []RealServer {
+	if len(stale) == 0 {
+		return nil
+	}
+
+	conns, err := d.handle.GetActiveConns(vs)
+	if err != nil {
+		// only the timeout is checked if the connections are unknown
+		log.Warn("get active connections error", log.Fields{"vs": vs, "err": err})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	ret := make([]RealServer, 0)
+	for _, rs := range stale {
+		key := drainKey(vs, &rs)
+		start, ok := d.draining[key]
+		if !ok {
+			start = now
+			d.draining[key] = start
+			log.Info("Draining ipvs real server", log.Fields{"vs": vs, "rs": rs.Key(), "timeout": d.Timeout})
+		}
+
+		n, known := conns[rs.Key()]
+		switch {
+		case err == nil && !known:
+			// it is gone already
+			delete(d.draining, key)
+		case known && n <= d.Threshold:
+			log.Info("ipvs real server drained", log.Fields{"vs": vs, "rs": rs.Key(), "conns": n, "elapsed": now.Sub(start)})
+			delete(d.draining, key)
+			drainedRealServers.Inc("drained")
+		case now.Sub(start) >= d.Timeout:
+			log.Warn("ipvs real server drain timeout", log.Fields{"vs": vs, "rs": rs.Key(), "conns": n, "timeout": d.Timeout})
+			delete(d.draining, key)
+			drainedRealServers.Inc("timeout")
+		default:
+			rs.Weight = 0
+			ret = append(ret, rs)
+		}
+	}
+	return ret
+}
+
+// Forget stops draining the real server, e.g. it is desired again
+func (d *Drainer) Forget(vs *VirtualServer, rs *RealServer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.draining, drainKey(vs, rs))
+}
+
+// forgetVirtualServer stops draining the real servers of the virtual server
+// of the key
+func (d *Drainer) forgetVirtualServer(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefix := key + " "
+	for key := range d.draining {
+		if strings.HasPrefix(key, prefix) {
+			delete(d.draining, key)
+		}
+	}
+}
+
+// Len returns the number of the real servers being drained
+func (d *Drainer) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.draining)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type drainEnv struct {
+	handle *FakeHandle
+	m      *Manager
+	now    time.Time
+	vs     VirtualServer
+	rs     RealServer
+}
+
+// newDrainEnv returns a Manager which has ensured a virtual server of two
+// real servers, the second one is about to be removed
+func newDrainEnv(t *testing.T) *drainEnv {
+	env := &drainEnv{
+		handle: NewFakeHandle(),
+		now:    time.Unix(1500000000, 0),
+		rs:     newRealServer("192.168.0.2", 1),
+	}
+	env.m = NewManager(env.handle)
+	env.m.Drainer = NewDrainer(env.handle, time.Minute, 0)
+	env.m.Drainer.now = func() time.Time { return env.now }
+
+	env.vs = newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), env.rs)
+	assert.Nil(t, env.m.Ensure([]VirtualServer{env.vs}))
+	env.handle.ResetCalls()
+	return env
+}
+
+func (env *drainEnv) remove(t *testing.T) []string {
+	env.handle.ResetCalls()
+	assert.Nil(t, env.m.Ensure([]VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))}))
+	return env.handle.Calls
+}
+
+func (env *drainEnv) kernelRealServers(t *testing.T) []RealServer {
+	vs, err := env.m.Get(env.vs.Key())
+	assert.Nil(t, err)
+	return vs.RealServers
+}
+
+func TestDrainConnections(t *testing.T) {
+	env := newDrainEnv(t)
+	env.handle.SetActiveConns(env.vs.Key(), env.rs.Key(), 10)
+
+	// weighted to zero instead of deleted
+	assert.Equal(t, []string{"UpdateRealServer TCP/10.0.0.100:80 192.168.0.2:80"}, env.remove(t))
+	assert.Equal(t, 1, env.m.Draining())
+	rss := env.kernelRealServers(t)
+	assert.Equal(t, 2, len(rss))
+	assert.Equal(t, 0, rss[1].Weight)
+
+	// the connections are declining
+	env.handle.SetActiveConns(env.vs.Key(), env.rs.Key(), 3)
+	env.now = env.now.Add(10 * time.Second)
+	assert.Nil(t, env.remove(t))
+	assert.Equal(t, 1, env.m.Draining())
+
+	env.handle.SetActiveConns(env.vs.Key(), env.rs.Key(), 0)
+	env.now = env.now.Add(10 * time.Second)
+	assert.Equal(t, []string{"DeleteRealServer TCP/10.0.0.100:80 192.168.0.2:80"}, env.remove(t))
+	assert.Equal(t, 0, env.m.Draining())
+	assert.Equal(t, 1, len(env.kernelRealServers(t)))
+}
+
+func TestDrainTimeout(t *testing.T) {
+	env := newDrainEnv(t)
+	env.handle.SetActiveConns(env.vs.Key(), env.rs.Key(), 10)
+
+	assert.Equal(t, []string{"UpdateRealServer TCP/10.0.0.100:80 192.168.0.2:80"}, env.remove(t))
+	env.now = env.now.Add(59 * time.Second)
+	assert.Nil(t, env.remove(t))
+
+	env.now = env.now.Add(time.Second)
+	assert.Equal(t, []string{"DeleteRealServer TCP/10.0.0.100:80 192.168.0.2:80"}, env.remove(t))
+	assert.Equal(t, 0, env.m.Draining())
+}
+
+func TestDrainReadded(t *testing.T) {
+	env := newDrainEnv(t)
+	env.handle.SetActiveConns(env.vs.Key(), env.rs.Key(), 10)
+	env.remove(t)
+	assert.Equal(t, 1, env.m.Draining())
+
+	// the weight is restored in place
+	env.handle.ResetCalls()
+	assert.Nil(t, env.m.Ensure([]VirtualServer{env.vs}))
+	assert.Equal(t, []string{"UpdateRealServer TCP/10.0.0.100:80 192.168.0.2:80"}, env.handle.Calls)
+	assert.Equal(t, 0, env.m.Draining())
+	assert.Equal(t, env.vs.RealServers, env.kernelRealServers(t))
+
+	// removing the virtual server forgets the draining real servers
+	env.remove(t)
+	assert.Nil(t, env.m.Cleanup())
+	assert.Equal(t, 0, env.m.Draining())
+}
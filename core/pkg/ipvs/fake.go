@@ -0,0 +1,266 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeHandle is an in-memory Handle for tests, it records every call
+type FakeHandle struct {
+	mu      sync.Mutex
+	vss     map[string]*VirtualServer
+	order   []string
+	daemons map[SyncState]SyncDaemon
+	conns   map[string]map[string]int
+	stats   map[string]ServiceStats
+	// Calls records the calls in the form of "Method key[ rs]"
+	Calls []string
+}
+
+var _ Handle = &FakeHandle{}
+
+// NewFakeHandle returns a FakeHandle holding the given virtual servers
+func NewFakeHandle(vss ...VirtualServer) *FakeHandle {
+	f := &FakeHandle{
+		vss:     make(map[string]*VirtualServer),
+		daemons: make(map[SyncState]SyncDaemon),
+		conns:   make(map[string]map[string]int),
+		stats:   make(map[string]ServiceStats),
+	}
+	for i := range vss {
+		vs := vss[i]
+		vs.RealServers = append([]RealServer(nil), vss[i].RealServers...)
+		f.vss[vs.Key()] = &vs
+		f.order = append(f.order, vs.Key())
+	}
+	return f
+}
+
+// ResetCalls clears the recorded calls
+func (f *FakeHandle) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = nil
+}
+
+// GetVirtualServers implements Handle
+func (f *FakeHandle) GetVirtualServers() ([]*VirtualServer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]*VirtualServer, 0, len(f.vss))
+	for _, key := range f.order {
+		vs := *f.vss[key]
+		vs.RealServers = append([]RealServer(nil), vs.RealServers...)
+		ret = append(ret, &vs)
+	}
+	return ret, nil
+}
+
+// AddVirtualServer implements Handle
+func (f *FakeHandle) AddVirtualServer(vs *VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "AddVirtualServer "+vs.Key())
+	if _, ok := f.vss[vs.Key()]; ok {
+		return fmt.Errorf("virtual server %v exists", vs)
+	}
+	added := *vs
+	added.RealServers = nil
+	f.vss[vs.Key()] = &added
+	f.order = append(f.order, vs.Key())
+	return nil
+}
+
+// UpdateVirtualServer implements Handle
+func (f *FakeHandle) UpdateVirtualServer(vs *VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "UpdateVirtualServer "+vs.Key())
+	cur, ok := f.vss[vs.Key()]
+	if !ok {
+		return fmt.Errorf("virtual server %v not found", vs)
+	}
+	cur.Scheduler, cur.Flags, cur.Timeout, cur.Netmask = vs.Scheduler, vs.Flags, vs.Timeout, vs.Netmask
+	return nil
+}
+
+// DeleteVirtualServer implements Handle
+func (f *FakeHandle) DeleteVirtualServer(vs *VirtualServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "DeleteVirtualServer "+vs.Key())
+	if _, ok := f.vss[vs.Key()]; !ok {
+		return fmt.Errorf("virtual server %v not found", vs)
+	}
+	delete(f.vss, vs.Key())
+	for i, key := range f.order {
+		if key == vs.Key() {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// AddRealServer implements Handle
+func (f *FakeHandle) AddRealServer(vs *VirtualServer, rs *RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "AddRealServer "+vs.Key()+" "+rs.Key())
+	cur, ok := f.vss[vs.Key()]
+	if !ok {
+		return fmt.Errorf("virtual server %v not found", vs)
+	}
+	if cur.findRealServer(rs.Key()) >= 0 {
+		return fmt.Errorf("real server %v exists", rs)
+	}
+	cur.RealServers = append(cur.RealServers, *rs)
+	return nil
+}
+
+// UpdateRealServer implements Handle
+func (f *FakeHandle) UpdateRealServer(vs *VirtualServer, rs *RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "UpdateRealServer "+vs.Key()+" "+rs.Key())
+	cur, ok := f.vss[vs.Key()]
+	if !ok {
+		return fmt.Errorf("virtual server %v not found", vs)
+	}
+	i := cur.findRealServer(rs.Key())
+	if i < 0 {
+		return fmt.Errorf("real server %v not found", rs)
+	}
+	cur.RealServers[i] = *rs
+	return nil
+}
+
+// DeleteRealServer implements Handle
+func (f *FakeHandle) DeleteRealServer(vs *VirtualServer, rs *RealServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "DeleteRealServer "+vs.Key()+" "+rs.Key())
+	cur, ok := f.vss[vs.Key()]
+	if !ok {
+		return fmt.Errorf("virtual server %v not found", vs)
+	}
+	i := cur.findRealServer(rs.Key())
+	if i < 0 {
+		return fmt.Errorf("real server %v not found", rs)
+	}
+	cur.RealServers = append(cur.RealServers[:i], cur.RealServers[i+1:]...)
+	return nil
+}
+
+// SetActiveConns sets the number of the active connections of the real
+// server of the virtual server identified by the keys
+func (f *FakeHandle) SetActiveConns(vsKey, rsKey string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns[vsKey] == nil {
+		f.conns[vsKey] = make(map[string]int)
+	}
+	f.conns[vsKey][rsKey] = n
+}
+
+// GetActiveConns implements Handle
+func (f *FakeHandle) GetActiveConns(vs *VirtualServer) (map[string]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, ok := f.vss[vs.Key()]
+	if !ok {
+		return nil, fmt.Errorf("virtual server %v not found", vs)
+	}
+	conns := make(map[string]int, len(cur.RealServers))
+	for _, rs := range cur.RealServers {
+		conns[rs.Key()] = f.conns[vs.Key()][rs.Key()]
+	}
+	return conns, nil
+}
+
+// SetStats sets the counters of the virtual server identified by the key
+// of the stats
+func (f *FakeHandle) SetStats(stats ServiceStats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats[stats.Key] = stats
+}
+
+// GetStats implements Handle, the virtual and real servers without stats
+// set have zero counters
+func (f *FakeHandle) GetStats() ([]ServiceStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]ServiceStats, 0, len(f.order))
+	for _, key := range f.order {
+		cur := f.stats[key]
+		stats := ServiceStats{Key: key, Stats: cur.Stats, RealServers: make(map[string]Stats)}
+		for _, rs := range f.vss[key].RealServers {
+			stats.RealServers[rs.Key()] = cur.RealServers[rs.Key()]
+		}
+		ret = append(ret, stats)
+	}
+	return ret, nil
+}
+
+// GetSyncDaemons implements Handle
+func (f *FakeHandle) GetSyncDaemons() ([]SyncDaemon, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]SyncDaemon, 0, len(f.daemons))
+	for _, state := range []SyncState{SyncStateMaster, SyncStateBackup} {
+		if d, ok := f.daemons[state]; ok {
+			ret = append(ret, d)
+		}
+	}
+	return ret, nil
+}
+
+// StartSyncDaemon implements Handle
+func (f *FakeHandle) StartSyncDaemon(state SyncState, iface string, syncid int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, fmt.Sprintf("StartSyncDaemon %s %s %d", state, iface, syncid))
+	if _, ok := f.daemons[state]; ok {
+		return fmt.Errorf("%s sync daemon is running", state)
+	}
+	f.daemons[state] = SyncDaemon{State: state, Interface: iface, SyncID: syncid}
+	return nil
+}
+
+// StopSyncDaemon implements Handle
+func (f *FakeHandle) StopSyncDaemon(state SyncState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, fmt.Sprintf("StopSyncDaemon %s", state))
+	if _, ok := f.daemons[state]; !ok {
+		return fmt.Errorf("%s sync daemon is not running", state)
+	}
+	delete(f.daemons, state)
+	return nil
+}
+
+func (vs *VirtualServer) findRealServer(key string) int {
+	for i := range vs.RealServers {
+		if vs.RealServers[i].Key() == key {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+// Handle talks to the ipvs table of the kernel
+type Handle interface {
+	// GetVirtualServers returns all virtual servers with their real servers
+	GetVirtualServers() ([]*VirtualServer, error)
+	// AddVirtualServer adds a virtual server without real servers
+	AddVirtualServer(vs *VirtualServer) error
+	// UpdateVirtualServer updates the attributes of a virtual server in place
+	UpdateVirtualServer(vs *VirtualServer) error
+	// DeleteVirtualServer deletes a virtual server and its real servers
+	DeleteVirtualServer(vs *VirtualServer) error
+	// AddRealServer adds a real server to the virtual server
+	AddRealServer(vs *VirtualServer, rs *RealServer) error
+	// UpdateRealServer updates the weight and forwarding method in place
+	UpdateRealServer(vs *VirtualServer, rs *RealServer) error
+	// DeleteRealServer deletes a real server from the virtual server
+	DeleteRealServer(vs *VirtualServer, rs *RealServer) error
+	// GetActiveConns returns the numbers of the active connections of the
+	// real servers of the virtual server keyed by RealServer.Key
+	GetActiveConns(vs *VirtualServer) (map[string]int, error)
+	// GetStats returns the counters of all virtual servers and their real
+	// servers
+	GetStats() ([]ServiceStats, error)
+	// GetSyncDaemons returns the running connection synchronization daemons
+	GetSyncDaemons() ([]SyncDaemon, error)
+	// StartSyncDaemon starts the connection synchronization daemon of the
+	// state, multicasting on the interface
+	StartSyncDaemon(state SyncState, iface string, syncid int) error
+	// StopSyncDaemon stops the connection synchronization daemon of the state
+	StopSyncDaemon(state SyncState) error
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Manager reconciles the virtual servers of the kernel ipvs table with
+// the desired state. It only touches the virtual servers it derived from
+// the desired set, others are left alone and never adopted.
+type Manager struct {
+	// Drainer drains the real servers being removed instead of deleting
+	// them immediately if it is not nil
+	Drainer *Drainer
+
+	handle Handle
+	// recordPath is the file recording the keys of the owned virtual
+	// servers, they are only kept in memory if it is empty
+	recordPath string
+
+	mu    sync.Mutex
+	owned map[string]bool
+	// recorded are the keys in the record file
+	recorded []string
+}
+
+// NewManager returns a Manager working on the given handle, it keeps the
+// ownership of the virtual servers in memory only, so the ones it added
+// are unknown to the next process. Use NewRecordedManager if the Manager
+// adds virtual servers.
+func NewManager(handle Handle) *Manager {
+	return &Manager{
+		handle: handle,
+		owned:  make(map[string]bool),
+	}
+}
+
+// Ensure makes the kernel state of the managed virtual servers match the
+// desired ones. Virtual servers which were desired by the previous call
+// but are missing now are deleted. Only the differences are applied, so
+// the unchanged virtual and real servers keep their connections.
+func (m *Manager) Ensure(desired []VirtualServer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	desiredMap := make(map[string]*VirtualServer, len(desired))
+	for i := range desired {
+		vs := &desired[i]
+		if err := vs.Protocol.validate(); vs.FWMark == 0 && err != nil {
+			return fmt.Errorf("virtual server %v: %v", vs, err)
+		}
+		if err := ValidateScheduler(vs.Scheduler); err != nil {
+			return fmt.Errorf("virtual server %v: %v", vs, err)
+		}
+		if err := vs.validateFamily(); err != nil {
+			return fmt.Errorf("virtual server %v: %v", vs, err)
+		}
+		if _, ok := desiredMap[vs.Key()]; ok {
+			return fmt.Errorf("duplicate virtual server %v", vs)
+		}
+		desiredMap[vs.Key()] = vs
+	}
+
+	current, err := m.currentVirtualServers()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+
+	// a virtual server in the kernel which is not owned was added by
+	// somebody else, e.g. kube-proxy or an administrator, it is not adopted
+	for _, key := range sortedKeys(desiredMap) {
+		if _, ok := current[key]; ok && !m.owned[key] {
+			errs = append(errs, fmt.Errorf("virtual server %s exists and is not managed by us", key))
+			delete(desiredMap, key)
+		}
+	}
+
+	// record the ownership before any change, so a partial failure or a
+	// restart is cleaned up by the following calls
+	for key := range desiredMap {
+		m.owned[key] = true
+	}
+	if err := m.saveRecord(); err != nil {
+		return err
+	}
+
+	// delete stale virtual servers firstly, a protocol change leads to a
+	// deletion and an addition
+	for _, key := range m.ownedKeys() {
+		if _, ok := desiredMap[key]; ok {
+			continue
+		}
+		if vs, ok := current[key]; ok {
+			log.Info("Deleting ipvs virtual server", log.Fields{"vs": vs})
+			if err := m.handle.DeleteVirtualServer(vs); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if m.Drainer != nil {
+			m.Drainer.forgetVirtualServer(key)
+		}
+		delete(m.owned, key)
+	}
+
+	for _, key := range sortedKeys(desiredMap) {
+		if err := m.ensureVirtualServer(desiredMap[key], current[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := m.saveRecord(); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (m *Manager) ensureVirtualServer(desired, current *VirtualServer) error {
+	if current == nil {
+		log.Info("Adding ipvs virtual server", log.Fields{"vs": desired})
+		if err := m.handle.AddVirtualServer(desired); err != nil {
+			return err
+		}
+		current = &VirtualServer{}
+	} else if !desired.equal(current) {
+		log.Info("Updating ipvs virtual server", log.Fields{"vs": desired, "scheduler": desired.Scheduler})
+		if err := m.handle.UpdateVirtualServer(desired); err != nil {
+			return err
+		}
+	}
+
+	currentRSs := make(map[string]*RealServer, len(current.RealServers))
+	for i := range current.RealServers {
+		rs := &current.RealServers[i]
+		currentRSs[rs.Key()] = rs
+	}
+
+	errs := make([]error, 0)
+	desiredRSs := make(map[string]bool, len(desired.RealServers))
+	for i := range desired.RealServers {
+		rs := &desired.RealServers[i]
+		desiredRSs[rs.Key()] = true
+		if m.Drainer != nil {
+			m.Drainer.Forget(desired, rs)
+		}
+
+		cur, ok := currentRSs[rs.Key()]
+		switch {
+		case !ok:
+			log.Info("Adding ipvs real server", log.Fields{"vs": desired, "rs": rs, "weight": rs.Weight})
+			if err := m.handle.AddRealServer(desired, rs); err != nil {
+				errs = append(errs, err)
+			}
+		case !rs.equal(cur):
+			log.Info("Updating ipvs real server", log.Fields{"vs": desired, "rs": rs, "weight": rs.Weight})
+			if err := m.handle.UpdateRealServer(desired, rs); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	stale := make([]RealServer, 0)
+	for _, rs := range current.RealServers {
+		if !desiredRSs[rs.Key()] {
+			stale = append(stale, rs)
+		}
+	}
+
+	draining := make(map[string]bool)
+	if m.Drainer != nil {
+		for _, rs := range m.Drainer.Drain(desired, stale) {
+			draining[rs.Key()] = true
+			if currentRSs[rs.Key()].Weight == 0 {
+				continue
+			}
+			log.Info("Weighting draining ipvs real server to zero", log.Fields{"vs": desired, "rs": rs})
+			if err := m.handle.UpdateRealServer(desired, &rs); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for i := range stale {
+		rs := &stale[i]
+		if draining[rs.Key()] {
+			continue
+		}
+		log.Info("Deleting ipvs real server", log.Fields{"vs": desired, "rs": rs})
+		if err := m.handle.DeleteRealServer(desired, rs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// Get returns the kernel state of the managed virtual server identified by
+// the key, it returns nil if the virtual server is not managed or does not
+// exist in the kernel
+func (m *Manager) Get(key string) (*VirtualServer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.owned[key] {
+		return nil, nil
+	}
+	current, err := m.currentVirtualServers()
+	if err != nil {
+		return nil, err
+	}
+	return current[key], nil
+}
+
+// List returns the kernel state of all managed virtual servers
+func (m *Manager) List() ([]*VirtualServer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, err := m.currentVirtualServers()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*VirtualServer, 0, len(m.owned))
+	for _, key := range m.ownedKeys() {
+		if vs, ok := current[key]; ok {
+			ret = append(ret, vs)
+		}
+	}
+	return ret, nil
+}
+
+// Check returns an error by the key of each virtual server which is not in
+// the kernel or has no real server of a positive weight, the virtual
+// servers need not be managed, e.g. the ones of keepalived
+func (m *Manager) Check(vss []VirtualServer) (map[string]error, error) {
+	current, err := m.currentVirtualServers()
+	if err != nil {
+		return nil, err
+	}
+	errs := make(map[string]error)
+	for i := range vss {
+		key := vss[i].Key()
+		vs, ok := current[key]
+		if !ok {
+			errs[key] = fmt.Errorf("virtual server %s is not in the kernel", key)
+			continue
+		}
+		ready := false
+		for _, rs := range vs.RealServers {
+			if rs.Weight > 0 {
+				ready = true
+				break
+			}
+		}
+		if !ready {
+			errs[key] = fmt.Errorf("virtual server %s has no ready real server", key)
+		}
+	}
+	return errs, nil
+}
+
+// Stats returns the counters of all virtual servers in the kernel, not only
+// the managed ones
+func (m *Manager) Stats() ([]ServiceStats, error) {
+	return m.handle.GetStats()
+}
+
+// ActiveConns returns the numbers of the active connections of the real
+// servers of the virtual server keyed by RealServer.Key
+func (m *Manager) ActiveConns(vs *VirtualServer) (map[string]int, error) {
+	return m.handle.GetActiveConns(vs)
+}
+
+// Draining returns the number of the real servers being drained, the
+// caller should call Ensure again later to finish the draining
+func (m *Manager) Draining() int {
+	if m.Drainer == nil {
+		return 0
+	}
+	return m.Drainer.Len()
+}
+
+// Cleanup deletes all managed virtual servers
+func (m *Manager) Cleanup() error {
+	return m.Ensure(nil)
+}
+
+func (m *Manager) currentVirtualServers() (map[string]*VirtualServer, error) {
+	vss, err := m.handle.GetVirtualServers()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*VirtualServer, len(vss))
+	for _, vs := range vss {
+		current[vs.Key()] = vs
+	}
+	return current, nil
+}
+
+func (m *Manager) ownedKeys() []string {
+	keys := make([]string, 0, len(m.owned))
+	for k := range m.owned {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]*VirtualServer) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
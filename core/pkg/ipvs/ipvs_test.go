@@ -0,0 +1,373 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"net"
+	"testing"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func newVirtualServer(protocol Protocol, rss ...RealServer) VirtualServer {
+	return VirtualServer{
+		Address:     net.ParseIP("10.0.0.100"),
+		Port:        80,
+		Protocol:    protocol,
+		Scheduler:   "rr",
+		RealServers: rss,
+	}
+}
+
+func newRealServer(ip string, weight int) RealServer {
+	return RealServer{
+		Address:          net.ParseIP(ip),
+		Port:             80,
+		Weight:           weight,
+		ForwardingMethod: ForwardingMethodDR,
+	}
+}
+
+func TestManagerEnsure(t *testing.T) {
+	foreign := VirtualServer{
+		Address:     net.ParseIP("10.0.0.1"),
+		Port:        53,
+		Protocol:    ProtocolUDP,
+		Scheduler:   "wrr",
+		RealServers: []RealServer{newRealServer("192.168.0.9", 1)},
+	}
+
+	tests := []struct {
+		name      string
+		initial   []VirtualServer
+		desired   []VirtualServer
+		wantCalls []string
+	}{
+		{
+			name:    "add",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))},
+			desired: []VirtualServer{
+				newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 1)),
+			},
+			wantCalls: []string{
+				"AddRealServer TCP/10.0.0.100:80 192.168.0.2:80",
+			},
+		},
+		{
+			name:    "weight update",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 1))},
+			desired: []VirtualServer{
+				newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 5)),
+			},
+			wantCalls: []string{
+				"UpdateRealServer TCP/10.0.0.100:80 192.168.0.2:80",
+			},
+		},
+		{
+			name:    "weight to zero",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 100))},
+			desired: []VirtualServer{
+				newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 0)),
+			},
+			wantCalls: []string{
+				"UpdateRealServer TCP/10.0.0.100:80 192.168.0.2:80",
+			},
+		},
+		{
+			name:    "delete stale real servers",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 1))},
+			desired: []VirtualServer{
+				newVirtualServer(ProtocolTCP, newRealServer("192.168.0.2", 1)),
+			},
+			wantCalls: []string{
+				"DeleteRealServer TCP/10.0.0.100:80 192.168.0.1:80",
+			},
+		},
+		{
+			name:    "protocol change",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))},
+			desired: []VirtualServer{
+				newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 1)),
+			},
+			wantCalls: []string{
+				"DeleteVirtualServer TCP/10.0.0.100:80",
+				"AddVirtualServer UDP/10.0.0.100:80",
+				"AddRealServer UDP/10.0.0.100:80 192.168.0.1:80",
+			},
+		},
+		{
+			name:    "delete all",
+			initial: []VirtualServer{newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))},
+			desired: nil,
+			wantCalls: []string{
+				"DeleteVirtualServer TCP/10.0.0.100:80",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle := NewFakeHandle(foreign)
+			m := NewManager(handle)
+
+			// the initial state is applied by a previous sync
+			assert.Nil(t, m.Ensure(tt.initial))
+			handle.ResetCalls()
+
+			assert.Nil(t, m.Ensure(tt.desired))
+			assert.Equal(t, tt.wantCalls, handle.Calls)
+
+			// the kernel state converges, and the foreign service is untouched
+			vss, err := handle.GetVirtualServers()
+			assert.Nil(t, err)
+			assert.Equal(t, 1+len(tt.desired), len(vss))
+			assert.Equal(t, foreign.Key(), vss[0].Key())
+			assert.Equal(t, foreign.RealServers, vss[0].RealServers)
+
+			listed, err := m.List()
+			assert.Nil(t, err)
+			assert.Equal(t, len(tt.desired), len(listed))
+			for i := range tt.desired {
+				assert.Equal(t, tt.desired[i].RealServers, listed[i].RealServers)
+			}
+
+			// idempotent
+			handle.ResetCalls()
+			assert.Nil(t, m.Ensure(tt.desired))
+			assert.Nil(t, handle.Calls)
+		})
+	}
+}
+
+func TestManagerGet(t *testing.T) {
+	vs := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+	m := NewManager(NewFakeHandle(vs))
+
+	// existing but not managed
+	got, err := m.Get(vs.Key())
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+
+	other := newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 1))
+	assert.Nil(t, m.Ensure([]VirtualServer{other}))
+	got, err = m.Get(other.Key())
+	assert.Nil(t, err)
+	assert.Equal(t, other.RealServers, got.RealServers)
+}
+
+func TestManagerNotAdopting(t *testing.T) {
+	foreign := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.9", 1))
+	handle := NewFakeHandle(foreign)
+	m := NewManager(handle)
+
+	// a virtual server of the same key added by somebody else is neither
+	// rewritten nor deleted, the others are still ensured
+	desired := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+	other := newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 1))
+	assert.EqualError(t, m.Ensure([]VirtualServer{desired, other}),
+		"virtual server TCP/10.0.0.100:80 exists and is not managed by us")
+	assert.Equal(t, []string{
+		"AddVirtualServer UDP/10.0.0.100:80",
+		"AddRealServer UDP/10.0.0.100:80 192.168.0.1:80",
+	}, handle.Calls)
+
+	assert.Nil(t, m.Cleanup())
+	vss, err := handle.GetVirtualServers()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(vss))
+	assert.Equal(t, foreign.RealServers, vss[0].RealServers)
+}
+
+func TestManagerCheck(t *testing.T) {
+	ready := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 0), newRealServer("192.168.0.2", 1))
+	drained := newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 0))
+	missing := newVirtualServer(ProtocolTCP)
+	missing.Port = 443
+	// not managed, e.g. by keepalived
+	m := NewManager(NewFakeHandle(ready, drained))
+
+	errs, err := m.Check([]VirtualServer{ready, drained, missing})
+	assert.Nil(t, err)
+	assert.Len(t, errs, 2)
+	assert.EqualError(t, errs[drained.Key()], "virtual server UDP/10.0.0.100:80 has no ready real server")
+	assert.EqualError(t, errs[missing.Key()], "virtual server TCP/10.0.0.100:443 is not in the kernel")
+}
+
+func TestManagerEnsureInvalid(t *testing.T) {
+	m := NewManager(NewFakeHandle())
+	assert.NotNil(t, m.Ensure([]VirtualServer{newVirtualServer("SCTP")}))
+	assert.NotNil(t, m.Ensure([]VirtualServer{newVirtualServer(ProtocolTCP), newVirtualServer(ProtocolTCP)}))
+}
+
+func TestManagerScheduler(t *testing.T) {
+	for _, scheduler := range []string{"rr", "wrr", "lc", "wlc", "sh", "mh"} {
+		t.Run(scheduler, func(t *testing.T) {
+			handle := NewFakeHandle()
+			m := NewManager(handle)
+
+			vs := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+			vs.Scheduler = scheduler
+			assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+
+			got, err := m.Get(vs.Key())
+			assert.Nil(t, err)
+			assert.Equal(t, scheduler, got.Scheduler)
+		})
+	}
+
+	for _, scheduler := range []string{"", "fifo", "RR"} {
+		t.Run("invalid "+scheduler, func(t *testing.T) {
+			vs := newVirtualServer(ProtocolTCP)
+			vs.Scheduler = scheduler
+			assert.NotNil(t, NewManager(NewFakeHandle()).Ensure([]VirtualServer{vs}))
+		})
+	}
+}
+
+func TestManagerSchedulerChangeInPlace(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	vs := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1), newRealServer("192.168.0.2", 1))
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	handle.ResetCalls()
+
+	vs.Scheduler = SchedulerSH
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	// the service is updated, never deleted and re-added
+	assert.Equal(t, []string{"UpdateVirtualServer TCP/10.0.0.100:80"}, handle.Calls)
+
+	got, err := m.Get(vs.Key())
+	assert.Nil(t, err)
+	assert.Equal(t, SchedulerSH, got.Scheduler)
+	assert.Equal(t, vs.RealServers, got.RealServers)
+}
+
+func TestManagerPersistenceInPlace(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	vs := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+
+	for _, c := range []struct {
+		name    string
+		flags   Flags
+		timeout uint32
+		netmask net.IPMask
+	}{
+		{"on", FlagPersistent, 360, nil},
+		{"timeout changed", FlagPersistent, 600, nil},
+		{"netmask changed", FlagPersistent, 600, net.CIDRMask(24, 32)},
+		{"off", 0, 0, nil},
+	} {
+		handle.ResetCalls()
+		vs.Flags, vs.Timeout, vs.Netmask = c.flags, c.timeout, c.netmask
+		assert.Nil(t, m.Ensure([]VirtualServer{vs}), c.name)
+		// the service is updated, never deleted and re-added
+		assert.Equal(t, []string{"UpdateVirtualServer TCP/10.0.0.100:80"}, handle.Calls, c.name)
+
+		got, err := m.Get(vs.Key())
+		assert.Nil(t, err)
+		assert.Equal(t, c.flags, got.Flags, c.name)
+		assert.Equal(t, c.timeout, got.Timeout, c.name)
+		assert.Equal(t, c.netmask, got.Netmask, c.name)
+	}
+
+	// the full netmask is the default one
+	vs.Flags, vs.Timeout, vs.Netmask = FlagPersistent, 600, nil
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	handle.ResetCalls()
+	vs.Netmask = net.CIDRMask(32, 32)
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	assert.Empty(t, handle.Calls)
+
+	// the netmask of the other family
+	vs.Netmask = net.CIDRMask(64, 128)
+	assert.NotNil(t, m.Ensure([]VirtualServer{vs}))
+}
+
+func TestManagerFWMark(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	vs := VirtualServer{
+		FWMark:      1,
+		Scheduler:   SchedulerSH,
+		RealServers: []RealServer{{Address: net.ParseIP("192.168.0.1"), Weight: 1, ForwardingMethod: ForwardingMethodDR}},
+	}
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	assert.Equal(t, []string{
+		"AddVirtualServer FWM/1",
+		"AddRealServer FWM/1 192.168.0.1:0",
+	}, handle.Calls)
+}
+
+func TestManagerDualStack(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	template := VirtualServer{
+		Port:      80,
+		Protocol:  ProtocolTCP,
+		Scheduler: SchedulerRR,
+		RealServers: []RealServer{
+			newRealServer("192.168.0.1", 1),
+			newRealServer("fd00::1", 1),
+		},
+	}
+	vips := []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("fd00::100")}
+	assert.Nil(t, m.Ensure(PerFamily(template, vips)))
+	assert.Equal(t, []string{
+		"AddVirtualServer TCP/10.0.0.100:80",
+		"AddRealServer TCP/10.0.0.100:80 192.168.0.1:80",
+		"AddVirtualServer TCP/[fd00::100]:80",
+		"AddRealServer TCP/[fd00::100]:80 [fd00::1]:80",
+	}, handle.Calls)
+
+	// the fwmark virtual servers of both families share the mark
+	handle.ResetCalls()
+	template.Port, template.Protocol, template.FWMark = 0, "", 1
+	assert.Nil(t, m.Ensure(PerFamily(template, vips)))
+	assert.Equal(t, []string{
+		"DeleteVirtualServer TCP/10.0.0.100:80",
+		"DeleteVirtualServer TCP/[fd00::100]:80",
+		"AddVirtualServer FWM/1",
+		"AddRealServer FWM/1 192.168.0.1:80",
+		"AddVirtualServer FWM6/1",
+		"AddRealServer FWM6/1 [fd00::1]:80",
+	}, handle.Calls)
+}
+
+func TestManagerIPv6Only(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	template := newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 1), newRealServer("fd00::1", 1))
+	vss := PerFamily(template, []net.IP{net.ParseIP("fd00::100")})
+	assert.Equal(t, 1, len(vss))
+	assert.Equal(t, corenet.FamilyIPv6, vss[0].AddressFamily())
+	assert.Nil(t, m.Ensure(vss))
+	assert.Equal(t, []string{
+		"AddVirtualServer UDP/[fd00::100]:80",
+		"AddRealServer UDP/[fd00::100]:80 [fd00::1]:80",
+	}, handle.Calls)
+
+	// DR can not forward across families
+	assert.NotNil(t, m.Ensure([]VirtualServer{template}))
+}
@@ -0,0 +1,751 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"unsafe"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// the generic netlink family of ipvs, see uapi/linux/ip_vs.h
+const (
+	ipvsGenlName    = "IPVS"
+	ipvsGenlVersion = 1
+)
+
+// commands of the ipvs family
+const (
+	ipvsCmdNewService = 1
+	ipvsCmdSetService = 2
+	ipvsCmdDelService = 3
+	ipvsCmdGetService = 4
+	ipvsCmdNewDest    = 5
+	ipvsCmdSetDest    = 6
+	ipvsCmdDelDest    = 7
+	ipvsCmdGetDest    = 8
+	ipvsCmdNewDaemon  = 9
+	ipvsCmdDelDaemon  = 10
+	ipvsCmdGetDaemon  = 11
+)
+
+// attributes of the commands
+const (
+	ipvsCmdAttrService = 1
+	ipvsCmdAttrDest    = 2
+	ipvsCmdAttrDaemon  = 3
+)
+
+// attributes of a virtual server
+const (
+	ipvsSvcAttrAF        = 1
+	ipvsSvcAttrProtocol  = 2
+	ipvsSvcAttrAddr      = 3
+	ipvsSvcAttrPort      = 4
+	ipvsSvcAttrFWMark    = 5
+	ipvsSvcAttrSchedName = 6
+	ipvsSvcAttrFlags     = 7
+	ipvsSvcAttrTimeout   = 8
+	ipvsSvcAttrNetmask   = 9
+	ipvsSvcAttrStats     = 10
+	ipvsSvcAttrStats64   = 12
+)
+
+// attributes of a real server
+const (
+	ipvsDestAttrAddr        = 1
+	ipvsDestAttrPort        = 2
+	ipvsDestAttrFwdMethod   = 3
+	ipvsDestAttrWeight      = 4
+	ipvsDestAttrUThresh     = 5
+	ipvsDestAttrLThresh     = 6
+	ipvsDestAttrActiveConns = 7
+	ipvsDestAttrStats       = 10
+	ipvsDestAttrAddrFamily  = 11
+	ipvsDestAttrStats64     = 12
+)
+
+// attributes of a sync daemon
+const (
+	ipvsDaemonAttrState    = 1
+	ipvsDaemonAttrMcastIfn = 2
+	ipvsDaemonAttrSyncID   = 3
+)
+
+// attributes of the counters
+const (
+	ipvsStatsAttrConns    = 1
+	ipvsStatsAttrInPkts   = 2
+	ipvsStatsAttrOutPkts  = 3
+	ipvsStatsAttrInBytes  = 4
+	ipvsStatsAttrOutBytes = 5
+)
+
+// the states of the sync daemons, IP_VS_STATE_*
+const (
+	ipvsStateMaster = 1
+	ipvsStateBackup = 2
+)
+
+// the forwarding methods, IP_VS_CONN_F_*
+const (
+	ipvsFwdMasq   = 0
+	ipvsFwdTunnel = 2
+	ipvsFwdDroute = 3
+	ipvsFwdMask   = 0x7
+)
+
+// the address families and protocols in the attributes, they are the same
+// on all linux platforms
+const (
+	afInet      = 2
+	afInet6     = 10
+	protocolTCP = 6
+	protocolUDP = 17
+)
+
+const (
+	nlaHeaderLen = 4
+	nlaFNested   = 0x8000
+	nlaTypeMask  = 0x3fff
+)
+
+// knownFlags are the flags of a virtual server kept in the model, the
+// others like IP_VS_SVC_F_HASHED are internal to the kernel
+const knownFlags = FlagPersistent | FlagOnePacket | FlagSchedSHFallback | FlagSchedSHPort
+
+// nativeEndian is the byte order of the netlink headers and of the integer
+// attributes except the ports
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// genlConn sends the requests of the ipvs generic netlink family
+type genlConn interface {
+	// execute sends the command with the attributes and returns the
+	// attributes of the replies, the command is a dump if dump is true
+	execute(cmd uint8, attrs []byte, dump bool) ([][]byte, error)
+}
+
+// netlinkHandle is a Handle talking to the kernel by generic netlink, the
+// way ipvsadm(8) does, without running any external process
+type netlinkHandle struct {
+	conn genlConn
+}
+
+// destination is a real server with its state in the kernel
+type destination struct {
+	RealServer
+	activeConns int
+	stats       Stats
+}
+
+func (h *netlinkHandle) GetVirtualServers() ([]*VirtualServer, error) {
+	vss, _, err := h.services()
+	if err != nil {
+		return nil, err
+	}
+	for _, vs := range vss {
+		dests, err := h.destinations(vs)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dests {
+			vs.RealServers = append(vs.RealServers, d.RealServer)
+		}
+	}
+	return vss, nil
+}
+
+func (h *netlinkHandle) AddVirtualServer(vs *VirtualServer) error {
+	_, err := h.conn.execute(ipvsCmdNewService, putNested(nil, ipvsCmdAttrService, encodeService(vs, true)), false)
+	return err
+}
+
+func (h *netlinkHandle) UpdateVirtualServer(vs *VirtualServer) error {
+	_, err := h.conn.execute(ipvsCmdSetService, putNested(nil, ipvsCmdAttrService, encodeService(vs, true)), false)
+	return err
+}
+
+func (h *netlinkHandle) DeleteVirtualServer(vs *VirtualServer) error {
+	_, err := h.conn.execute(ipvsCmdDelService, putNested(nil, ipvsCmdAttrService, encodeService(vs, false)), false)
+	return err
+}
+
+func (h *netlinkHandle) AddRealServer(vs *VirtualServer, rs *RealServer) error {
+	_, err := h.conn.execute(ipvsCmdNewDest, destAttrs(vs, rs, true), false)
+	return err
+}
+
+func (h *netlinkHandle) UpdateRealServer(vs *VirtualServer, rs *RealServer) error {
+	_, err := h.conn.execute(ipvsCmdSetDest, destAttrs(vs, rs, true), false)
+	return err
+}
+
+func (h *netlinkHandle) DeleteRealServer(vs *VirtualServer, rs *RealServer) error {
+	_, err := h.conn.execute(ipvsCmdDelDest, destAttrs(vs, rs, false), false)
+	return err
+}
+
+func (h *netlinkHandle) GetActiveConns(vs *VirtualServer) (map[string]int, error) {
+	dests, err := h.destinations(vs)
+	if err != nil {
+		return nil, err
+	}
+	conns := make(map[string]int, len(dests))
+	for _, d := range dests {
+		conns[d.Key()] = d.activeConns
+	}
+	return conns, nil
+}
+
+func (h *netlinkHandle) GetStats() ([]ServiceStats, error) {
+	vss, stats, err := h.services()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]ServiceStats, 0, len(vss))
+	for i, vs := range vss {
+		dests, err := h.destinations(vs)
+		if err != nil {
+			return nil, err
+		}
+		s := ServiceStats{Key: vs.Key(), Stats: stats[i], RealServers: make(map[string]Stats, len(dests))}
+		for _, d := range dests {
+			s.RealServers[d.Key()] = d.stats
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+func (h *netlinkHandle) GetSyncDaemons() ([]SyncDaemon, error) {
+	replies, err := h.conn.execute(ipvsCmdGetDaemon, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	daemons := make([]SyncDaemon, 0, len(replies))
+	for _, reply := range replies {
+		attrs, err := parseAttrs(reply)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := attrs[ipvsCmdAttrDaemon]; ok {
+			d, err := decodeDaemon(b)
+			if err != nil {
+				return nil, err
+			}
+			daemons = append(daemons, d)
+		}
+	}
+	return daemons, nil
+}
+
+func (h *netlinkHandle) StartSyncDaemon(state SyncState, iface string, syncid int) error {
+	b := putAttr(nil, ipvsDaemonAttrState, putU32(syncStateNumber(state)))
+	b = putAttr(b, ipvsDaemonAttrMcastIfn, putString(iface))
+	b = putAttr(b, ipvsDaemonAttrSyncID, putU32(uint32(syncid)))
+	_, err := h.conn.execute(ipvsCmdNewDaemon, putNested(nil, ipvsCmdAttrDaemon, b), false)
+	return err
+}
+
+func (h *netlinkHandle) StopSyncDaemon(state SyncState) error {
+	b := putAttr(nil, ipvsDaemonAttrState, putU32(syncStateNumber(state)))
+	_, err := h.conn.execute(ipvsCmdDelDaemon, putNested(nil, ipvsCmdAttrDaemon, b), false)
+	return err
+}
+
+// services returns all virtual servers without their real servers and
+// their counters, the ones of unsupported protocols are skipped
+func (h *netlinkHandle) services() ([]*VirtualServer, []Stats, error) {
+	replies, err := h.conn.execute(ipvsCmdGetService, nil, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	vss := make([]*VirtualServer, 0, len(replies))
+	stats := make([]Stats, 0, len(replies))
+	for _, reply := range replies {
+		attrs, err := parseAttrs(reply)
+		if err != nil {
+			return nil, nil, err
+		}
+		b, ok := attrs[ipvsCmdAttrService]
+		if !ok {
+			continue
+		}
+		vs, s, err := decodeService(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		if vs == nil {
+			continue
+		}
+		vss = append(vss, vs)
+		stats = append(stats, s)
+	}
+	return vss, stats, nil
+}
+
+// destinations returns the real servers of the virtual server
+func (h *netlinkHandle) destinations(vs *VirtualServer) ([]destination, error) {
+	replies, err := h.conn.execute(ipvsCmdGetDest, putNested(nil, ipvsCmdAttrService, encodeService(vs, false)), true)
+	if err != nil {
+		return nil, err
+	}
+	dests := make([]destination, 0, len(replies))
+	for _, reply := range replies {
+		attrs, err := parseAttrs(reply)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := attrs[ipvsCmdAttrDest]
+		if !ok {
+			continue
+		}
+		d, err := decodeDest(b, vs.AddressFamily())
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, d)
+	}
+	return dests, nil
+}
+
+// encodeService returns the attributes identifying the virtual server,
+// followed by the other ones if full is true
+func encodeService(vs *VirtualServer, full bool) []byte {
+	b := putAttr(nil, ipvsSvcAttrAF, putU16(familyNumber(vs.AddressFamily())))
+	if vs.FWMark != 0 {
+		b = putAttr(b, ipvsSvcAttrFWMark, putU32(vs.FWMark))
+	} else {
+		b = putAttr(b, ipvsSvcAttrProtocol, putU16(protocolNumber(vs.Protocol)))
+		b = putAttr(b, ipvsSvcAttrAddr, putAddr(vs.Address))
+		b = putAttr(b, ipvsSvcAttrPort, putPort(vs.Port))
+	}
+	if !full {
+		return b
+	}
+
+	var timeout uint32
+	if vs.Flags&FlagPersistent != 0 {
+		timeout = vs.Timeout
+	}
+	b = putAttr(b, ipvsSvcAttrSchedName, putString(vs.Scheduler))
+	// struct ip_vs_flags, the flags and the mask of the flags to set
+	b = putAttr(b, ipvsSvcAttrFlags, append(putU32(uint32(vs.Flags&knownFlags)), putU32(^uint32(0))...))
+	b = putAttr(b, ipvsSvcAttrTimeout, putU32(timeout))
+	return putAttr(b, ipvsSvcAttrNetmask, putNetmask(vs))
+}
+
+// decodeService returns the virtual server and its counters in the
+// attributes, the virtual server is nil if its protocol is unsupported
+func decodeService(b []byte) (*VirtualServer, Stats, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	af, err := attrU16(attrs, ipvsSvcAttrAF)
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	family, ok := familyOfNumber(af)
+	if !ok {
+		return nil, Stats{}, nil
+	}
+
+	vs := &VirtualServer{}
+	if mark, err := attrU32(attrs, ipvsSvcAttrFWMark); err == nil && mark != 0 {
+		vs.FWMark = mark
+		if family == corenet.FamilyIPv6 {
+			vs.Family = family
+		}
+	} else {
+		proto, err := attrU16(attrs, ipvsSvcAttrProtocol)
+		if err != nil {
+			return nil, Stats{}, err
+		}
+		if vs.Protocol, ok = protocolOfNumber(proto); !ok {
+			return nil, Stats{}, nil
+		}
+		if vs.Address, err = attrAddr(attrs, ipvsSvcAttrAddr, family); err != nil {
+			return nil, Stats{}, err
+		}
+		if vs.Port, err = attrPort(attrs, ipvsSvcAttrPort); err != nil {
+			return nil, Stats{}, err
+		}
+	}
+
+	if name, ok := attrs[ipvsSvcAttrSchedName]; ok {
+		vs.Scheduler = string(name[:clen(name)])
+	}
+	if flags, ok := attrs[ipvsSvcAttrFlags]; ok && len(flags) >= 4 {
+		vs.Flags = Flags(nativeEndian.Uint32(flags)) & knownFlags
+	}
+	if vs.Flags&FlagPersistent != 0 {
+		if vs.Timeout, err = attrU32(attrs, ipvsSvcAttrTimeout); err != nil {
+			return nil, Stats{}, err
+		}
+		if netmask, ok := attrs[ipvsSvcAttrNetmask]; ok && len(netmask) >= 4 {
+			vs.Netmask = decodeNetmask(netmask, family)
+		}
+	}
+
+	stats, err := decodeStats(attrs, ipvsSvcAttrStats, ipvsSvcAttrStats64)
+	return vs, stats, err
+}
+
+// destAttrs returns the attributes of a command on a real server of the
+// virtual server
+func destAttrs(vs *VirtualServer, rs *RealServer, full bool) []byte {
+	d := putAttr(nil, ipvsDestAttrAddr, putAddr(rs.Address))
+	d = putAttr(d, ipvsDestAttrPort, putPort(rs.Port))
+	if family := corenet.FamilyOf(rs.Address); family != vs.AddressFamily() {
+		// a tunneled real server of the other family
+		d = putAttr(d, ipvsDestAttrAddrFamily, putU16(familyNumber(family)))
+	}
+	if full {
+		d = putAttr(d, ipvsDestAttrFwdMethod, putU32(forwardingNumber(rs.ForwardingMethod)))
+		d = putAttr(d, ipvsDestAttrWeight, putU32(uint32(rs.Weight)))
+		d = putAttr(d, ipvsDestAttrUThresh, putU32(0))
+		d = putAttr(d, ipvsDestAttrLThresh, putU32(0))
+	}
+	b := putNested(nil, ipvsCmdAttrService, encodeService(vs, false))
+	return putNested(b, ipvsCmdAttrDest, d)
+}
+
+// decodeDest returns the real server in the attributes, its address is of
+// the family of the virtual server unless told otherwise
+func decodeDest(b []byte, family corenet.Family) (destination, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return destination{}, err
+	}
+	if af, err := attrU16(attrs, ipvsDestAttrAddrFamily); err == nil {
+		if f, ok := familyOfNumber(af); ok {
+			family = f
+		}
+	}
+
+	d := destination{}
+	if d.Address, err = attrAddr(attrs, ipvsDestAttrAddr, family); err != nil {
+		return destination{}, err
+	}
+	if d.Port, err = attrPort(attrs, ipvsDestAttrPort); err != nil {
+		return destination{}, err
+	}
+	if method, err := attrU32(attrs, ipvsDestAttrFwdMethod); err == nil {
+		d.ForwardingMethod = forwardingOfNumber(method)
+	}
+	if weight, err := attrU32(attrs, ipvsDestAttrWeight); err == nil {
+		d.Weight = int(int32(weight))
+	}
+	if conns, err := attrU32(attrs, ipvsDestAttrActiveConns); err == nil {
+		d.activeConns = int(conns)
+	}
+	d.stats, err = decodeStats(attrs, ipvsDestAttrStats, ipvsDestAttrStats64)
+	return d, err
+}
+
+func decodeDaemon(b []byte) (SyncDaemon, error) {
+	attrs, err := parseAttrs(b)
+	if err != nil {
+		return SyncDaemon{}, err
+	}
+	state, err := attrU32(attrs, ipvsDaemonAttrState)
+	if err != nil {
+		return SyncDaemon{}, err
+	}
+	syncid, err := attrU32(attrs, ipvsDaemonAttrSyncID)
+	if err != nil {
+		return SyncDaemon{}, err
+	}
+	d := SyncDaemon{SyncID: int(syncid)}
+	switch state {
+	case ipvsStateMaster:
+		d.State = SyncStateMaster
+	case ipvsStateBackup:
+		d.State = SyncStateBackup
+	default:
+		return SyncDaemon{}, fmt.Errorf("unknown sync daemon state %d", state)
+	}
+	if ifn, ok := attrs[ipvsDaemonAttrMcastIfn]; ok {
+		d.Interface = string(ifn[:clen(ifn)])
+	}
+	return d, nil
+}
+
+// decodeStats returns the counters in the nested attribute of the 64-bit
+// counters, or the one of the older kernels which only has 32-bit packets
+func decodeStats(attrs map[uint16][]byte, stats, stats64 uint16) (Stats, error) {
+	if b, ok := attrs[stats64]; ok {
+		nested, err := parseAttrs(b)
+		if err != nil {
+			return Stats{}, err
+		}
+		return Stats{
+			Conns:      attrU64(nested, ipvsStatsAttrConns),
+			InPackets:  attrU64(nested, ipvsStatsAttrInPkts),
+			OutPackets: attrU64(nested, ipvsStatsAttrOutPkts),
+			InBytes:    attrU64(nested, ipvsStatsAttrInBytes),
+			OutBytes:   attrU64(nested, ipvsStatsAttrOutBytes),
+		}, nil
+	}
+	b, ok := attrs[stats]
+	if !ok {
+		return Stats{}, nil
+	}
+	nested, err := parseAttrs(b)
+	if err != nil {
+		return Stats{}, err
+	}
+	u32 := func(typ uint16) uint64 {
+		v, _ := attrU32(nested, typ)
+		return uint64(v)
+	}
+	return Stats{
+		Conns:      u32(ipvsStatsAttrConns),
+		InPackets:  u32(ipvsStatsAttrInPkts),
+		OutPackets: u32(ipvsStatsAttrOutPkts),
+		InBytes:    attrU64(nested, ipvsStatsAttrInBytes),
+		OutBytes:   attrU64(nested, ipvsStatsAttrOutBytes),
+	}, nil
+}
+
+// putNetmask returns the persistence netmask attribute, the kernel takes
+// an IPv4 netmask in network byte order and an IPv6 one as the prefix length
+func putNetmask(vs *VirtualServer) []byte {
+	if vs.AddressFamily() == corenet.FamilyIPv6 {
+		return putU32(uint32(vs.netmaskSize()))
+	}
+	return []byte(net.CIDRMask(vs.netmaskSize(), 8*net.IPv4len))
+}
+
+// decodeNetmask is the reverse of putNetmask, the full netmask is nil
+func decodeNetmask(b []byte, family corenet.Family) net.IPMask {
+	var mask net.IPMask
+	if family == corenet.FamilyIPv6 {
+		mask = net.CIDRMask(int(nativeEndian.Uint32(b)), 8*net.IPv6len)
+	} else {
+		mask = net.IPMask(append([]byte(nil), b[:net.IPv4len]...))
+	}
+	if ones, bits := mask.Size(); ones == bits {
+		return nil
+	}
+	return mask
+}
+
+func familyNumber(family corenet.Family) uint16 {
+	if family == corenet.FamilyIPv6 {
+		return afInet6
+	}
+	return afInet
+}
+
+func familyOfNumber(af uint16) (corenet.Family, bool) {
+	switch af {
+	case afInet:
+		return corenet.FamilyIPv4, true
+	case afInet6:
+		return corenet.FamilyIPv6, true
+	}
+	return "", false
+}
+
+func protocolNumber(p Protocol) uint16 {
+	if p == ProtocolUDP {
+		return protocolUDP
+	}
+	return protocolTCP
+}
+
+func protocolOfNumber(proto uint16) (Protocol, bool) {
+	switch proto {
+	case protocolTCP:
+		return ProtocolTCP, true
+	case protocolUDP:
+		return ProtocolUDP, true
+	}
+	return "", false
+}
+
+// forwardingNumber returns the forwarding method of the kernel, it defaults
+// to direct routing like ipvsadm
+func forwardingNumber(m ForwardingMethod) uint32 {
+	switch m {
+	case ForwardingMethodNAT:
+		return ipvsFwdMasq
+	case ForwardingMethodTUN:
+		return ipvsFwdTunnel
+	}
+	return ipvsFwdDroute
+}
+
+func forwardingOfNumber(method uint32) ForwardingMethod {
+	switch method & ipvsFwdMask {
+	case ipvsFwdMasq:
+		return ForwardingMethodNAT
+	case ipvsFwdTunnel:
+		return ForwardingMethodTUN
+	case ipvsFwdDroute:
+		return ForwardingMethodDR
+	}
+	return ""
+}
+
+func syncStateNumber(state SyncState) uint32 {
+	if state == SyncStateBackup {
+		return ipvsStateBackup
+	}
+	return ipvsStateMaster
+}
+
+// putAttr appends the attribute to b, the value is padded to the alignment
+// of the attributes
+func putAttr(b []byte, typ uint16, value []byte) []byte {
+	l := nlaHeaderLen + len(value)
+	hdr := make([]byte, nlaHeaderLen)
+	nativeEndian.PutUint16(hdr[0:2], uint16(l))
+	nativeEndian.PutUint16(hdr[2:4], typ)
+	b = append(b, hdr...)
+	b = append(b, value...)
+	return append(b, make([]byte, nlaAlign(l)-l)...)
+}
+
+// putNested appends the attribute holding the encoded attributes to b
+func putNested(b []byte, typ uint16, attrs []byte) []byte {
+	return putAttr(b, typ|nlaFNested, attrs)
+}
+
+// parseAttrs returns the values of the attributes in b keyed by their types
+func parseAttrs(b []byte) (map[uint16][]byte, error) {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= nlaHeaderLen {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < nlaHeaderLen || l > len(b) {
+			return nil, fmt.Errorf("invalid netlink attribute length %d", l)
+		}
+		attrs[nativeEndian.Uint16(b[2:4])&nlaTypeMask] = b[nlaHeaderLen:l]
+		if nlaAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlaAlign(l):]
+	}
+	return attrs, nil
+}
+
+func nlaAlign(l int) int {
+	return (l + nlaHeaderLen - 1) &^ (nlaHeaderLen - 1)
+}
+
+func putU16(v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return b
+}
+
+func putU32(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+// putPort returns the port in network byte order
+func putPort(port uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, port)
+	return b
+}
+
+// putAddr returns the address in the 16 bytes of union nf_inet_addr
+func putAddr(ip net.IP) []byte {
+	b := make([]byte, net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(b, ip4)
+	} else {
+		copy(b, ip.To16())
+	}
+	return b
+}
+
+// putString returns the NULL terminated string
+func putString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func attrU16(attrs map[uint16][]byte, typ uint16) (uint16, error) {
+	b, ok := attrs[typ]
+	if !ok || len(b) < 2 {
+		return 0, fmt.Errorf("missing netlink attribute %d", typ)
+	}
+	return nativeEndian.Uint16(b), nil
+}
+
+func attrU32(attrs map[uint16][]byte, typ uint16) (uint32, error) {
+	b, ok := attrs[typ]
+	if !ok || len(b) < 4 {
+		return 0, fmt.Errorf("missing netlink attribute %d", typ)
+	}
+	return nativeEndian.Uint32(b), nil
+}
+
+// attrU64 returns the counter, a missing one is zero
+func attrU64(attrs map[uint16][]byte, typ uint16) uint64 {
+	b, ok := attrs[typ]
+	if !ok || len(b) < 8 {
+		return 0
+	}
+	return nativeEndian.Uint64(b)
+}
+
+func attrPort(attrs map[uint16][]byte, typ uint16) (uint16, error) {
+	b, ok := attrs[typ]
+	if !ok || len(b) < 2 {
+		return 0, fmt.Errorf("missing netlink attribute %d", typ)
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func attrAddr(attrs map[uint16][]byte, typ uint16, family corenet.Family) (net.IP, error) {
+	b, ok := attrs[typ]
+	if family == corenet.FamilyIPv6 {
+		if !ok || len(b) < net.IPv6len {
+			return nil, fmt.Errorf("missing netlink attribute %d", typ)
+		}
+		return net.IP(append([]byte(nil), b[:net.IPv6len]...)), nil
+	}
+	if !ok || len(b) < net.IPv4len {
+		return nil, fmt.Errorf("missing netlink attribute %d", typ)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3]), nil
+}
+
+// clen returns the index of the first NULL byte in b or len(b)
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// the generic netlink controller, see uapi/linux/genetlink.h
+const (
+	genlHeaderLen      = 4
+	genlIDCtrl         = 0x10
+	genlCtrlVersion    = 2
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+)
+
+// errIPVSUnavailable is returned if the kernel has no ipvs family
+var errIPVSUnavailable = errors.New("ipvs is not available in the kernel, is the ip_vs module loaded")
+
+// NewHandle returns a Handle talking to the kernel by generic netlink
+func NewHandle() Handle {
+	return &netlinkHandle{conn: &genlSocket{}}
+}
+
+// genlSocket sends each request on a new generic netlink socket, the id of
+// the ipvs family is resolved by the first request
+type genlSocket struct {
+	mu     sync.Mutex
+	family uint16
+	seq    uint32
+}
+
+func (s *genlSocket) execute(cmd uint8, attrs []byte, dump bool) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.family == 0 {
+		family, err := s.resolveFamily()
+		if err != nil {
+			return nil, err
+		}
+		s.family = family
+	}
+	replies, err := s.roundTrip(s.family, cmd, ipvsGenlVersion, attrs, dump)
+	if err != nil {
+		return nil, fmt.Errorf("ipvs command %d error: %v", cmd, err)
+	}
+	return replies, nil
+}
+
+// resolveFamily returns the id of the ipvs family
+func (s *genlSocket) resolveFamily() (uint16, error) {
+	replies, err := s.roundTrip(genlIDCtrl, ctrlCmdGetFamily, genlCtrlVersion,
+		putAttr(nil, ctrlAttrFamilyName, putString(ipvsGenlName)), false)
+	if err == syscall.ENOENT {
+		return 0, errIPVSUnavailable
+	}
+	if err != nil {
+		return 0, fmt.Errorf("resolve generic netlink family %s error: %v", ipvsGenlName, err)
+	}
+	for _, reply := range replies {
+		attrs, err := parseAttrs(reply)
+		if err != nil {
+			return 0, err
+		}
+		if id, err := attrU16(attrs, ctrlAttrFamilyID); err == nil {
+			return id, nil
+		}
+	}
+	return 0, errIPVSUnavailable
+}
+
+// roundTrip sends the command to the family and returns the attributes of
+// the replies, a request which is not a dump is acknowledged
+func (s *genlSocket) roundTrip(family uint16, cmd, version uint8, attrs []byte, dump bool) ([][]byte, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// the kernel answers at once, the timeout only guards against a lost
+	// reply blocking the caller forever
+	tv := syscall.Timeval{Sec: 10}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	s.seq++
+	seq := s.seq
+	flags := uint16(syscall.NLM_F_REQUEST)
+	if dump {
+		flags |= syscall.NLM_F_DUMP
+	} else {
+		flags |= syscall.NLM_F_ACK
+	}
+
+	req := make([]byte, syscall.NLMSG_HDRLEN+genlHeaderLen, syscall.NLMSG_HDRLEN+genlHeaderLen+len(attrs))
+	req = append(req, attrs...)
+	nativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:6], family)
+	nativeEndian.PutUint16(req[6:8], flags)
+	nativeEndian.PutUint32(req[8:12], seq)
+	req[syscall.NLMSG_HDRLEN] = cmd
+	req[syscall.NLMSG_HDRLEN+1] = version
+
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	replies := make([][]byte, 0)
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// the acknowledgement
+				return replies, nil
+			}
+			if len(m.Data) < genlHeaderLen {
+				return nil, fmt.Errorf("truncated generic netlink message")
+			}
+			// the buffer is reused by the next receive
+			replies = append(replies, append([]byte(nil), m.Data[genlHeaderLen:]...))
+		}
+	}
+}
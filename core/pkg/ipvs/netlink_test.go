@@ -0,0 +1,293 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+type genlRequest struct {
+	cmd   uint8
+	attrs []byte
+	dump  bool
+}
+
+// fakeConn records the requests and answers them with the replies of the
+// commands
+type fakeConn struct {
+	requests []genlRequest
+	replies  map[uint8][][]byte
+	// dests are the replies of GET_DEST keyed by the virtual server
+	dests map[string][][]byte
+}
+
+func (c *fakeConn) execute(cmd uint8, attrs []byte, dump bool) ([][]byte, error) {
+	c.requests = append(c.requests, genlRequest{cmd: cmd, attrs: attrs, dump: dump})
+	if cmd != ipvsCmdGetDest {
+		return c.replies[cmd], nil
+	}
+	vs, err := c.service(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return c.dests[vs.Key()], nil
+}
+
+// service decodes the virtual server of a request
+func (c *fakeConn) service(attrs []byte) (*VirtualServer, error) {
+	parsed, err := parseAttrs(attrs)
+	if err != nil {
+		return nil, err
+	}
+	vs, _, err := decodeService(parsed[ipvsCmdAttrService])
+	if err != nil {
+		return nil, err
+	}
+	if vs == nil {
+		return nil, fmt.Errorf("no virtual server in the request")
+	}
+	return vs, nil
+}
+
+func putStats64(s Stats) []byte {
+	u64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		nativeEndian.PutUint64(b, v)
+		return b
+	}
+	b := putAttr(nil, ipvsStatsAttrConns, u64(s.Conns))
+	b = putAttr(b, ipvsStatsAttrInPkts, u64(s.InPackets))
+	b = putAttr(b, ipvsStatsAttrOutPkts, u64(s.OutPackets))
+	b = putAttr(b, ipvsStatsAttrInBytes, u64(s.InBytes))
+	return putAttr(b, ipvsStatsAttrOutBytes, u64(s.OutBytes))
+}
+
+// serviceReply returns a reply of GET_SERVICE
+func serviceReply(vs *VirtualServer, s Stats) []byte {
+	b := encodeService(vs, true)
+	b = putNested(b, ipvsSvcAttrStats64, putStats64(s))
+	return putNested(nil, ipvsCmdAttrService, b)
+}
+
+// destReply returns a reply of GET_DEST
+func destReply(vs *VirtualServer, rs *RealServer, activeConns int, s Stats) []byte {
+	attrs, _ := parseAttrs(destAttrs(vs, rs, true))
+	b := append([]byte(nil), attrs[ipvsCmdAttrDest]...)
+	b = putAttr(b, ipvsDestAttrActiveConns, putU32(uint32(activeConns)))
+	b = putNested(b, ipvsDestAttrStats64, putStats64(s))
+	return putNested(nil, ipvsCmdAttrDest, b)
+}
+
+func TestNetlinkServiceRoundTrip(t *testing.T) {
+	for _, vs := range []VirtualServer{
+		{Address: net.ParseIP("10.0.0.1"), Port: 80, Protocol: ProtocolTCP, Scheduler: SchedulerRR},
+		{Address: net.ParseIP("10.0.0.1"), Port: 53, Protocol: ProtocolUDP, Scheduler: SchedulerSH,
+			Flags: FlagPersistent | FlagOnePacket | FlagSchedSHPort, Timeout: 360, Netmask: net.CIDRMask(24, 32)},
+		{Address: net.ParseIP("fd00::1"), Port: 443, Protocol: ProtocolTCP, Scheduler: SchedulerRR,
+			Flags: FlagPersistent, Timeout: 60, Netmask: net.CIDRMask(64, 128)},
+		{FWMark: 1, Scheduler: SchedulerRR},
+		{FWMark: 2, Family: corenet.FamilyIPv6, Scheduler: SchedulerRR, Flags: FlagPersistent, Timeout: 600},
+	} {
+		got, _, err := decodeService(encodeService(&vs, true))
+		assert.Nil(t, err, vs.Key())
+		assert.Equal(t, &vs, got, vs.Key())
+	}
+
+	// the flags internal to the kernel, e.g. IP_VS_SVC_F_HASHED, and an
+	// unsupported protocol
+	vs := VirtualServer{Address: net.ParseIP("10.0.0.1"), Port: 80, Protocol: ProtocolTCP, Scheduler: SchedulerRR}
+	attrs := putAttr(encodeService(&vs, false), ipvsSvcAttrFlags, append(putU32(0x2), putU32(^uint32(0))...))
+	got, _, err := decodeService(attrs)
+	assert.Nil(t, err)
+	assert.Equal(t, Flags(0), got.Flags)
+	sctp := putAttr(nil, ipvsSvcAttrAF, putU16(afInet))
+	sctp = putAttr(sctp, ipvsSvcAttrProtocol, putU16(132))
+	got, _, err = decodeService(sctp)
+	assert.Nil(t, err)
+	assert.Nil(t, got)
+}
+
+func TestNetlinkServiceAttributes(t *testing.T) {
+	vs := VirtualServer{
+		Address:   net.ParseIP("10.0.0.1"),
+		Port:      80,
+		Protocol:  ProtocolTCP,
+		Scheduler: SchedulerRR,
+		Flags:     FlagPersistent,
+		Timeout:   360,
+		Netmask:   net.CIDRMask(24, 32),
+	}
+	attrs, err := parseAttrs(encodeService(&vs, true))
+	assert.Nil(t, err)
+	assert.Equal(t, putU16(afInet), attrs[ipvsSvcAttrAF])
+	assert.Equal(t, putU16(protocolTCP), attrs[ipvsSvcAttrProtocol])
+	assert.Equal(t, []byte{10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, attrs[ipvsSvcAttrAddr])
+	// the port and the IPv4 netmask are in network byte order
+	assert.Equal(t, []byte{0, 80}, attrs[ipvsSvcAttrPort])
+	assert.Equal(t, []byte{255, 255, 255, 0}, attrs[ipvsSvcAttrNetmask])
+	assert.Equal(t, []byte("rr\x00"), attrs[ipvsSvcAttrSchedName])
+	assert.Equal(t, append(putU32(1), putU32(^uint32(0))...), attrs[ipvsSvcAttrFlags])
+	assert.Equal(t, putU32(360), attrs[ipvsSvcAttrTimeout])
+
+	// the IPv6 netmask is the prefix length, the identity of a fwmark
+	// virtual server is its mark
+	vs = VirtualServer{FWMark: 7, Family: corenet.FamilyIPv6, Scheduler: SchedulerRR, Netmask: net.CIDRMask(64, 128)}
+	attrs, err = parseAttrs(encodeService(&vs, true))
+	assert.Nil(t, err)
+	assert.Equal(t, putU16(afInet6), attrs[ipvsSvcAttrAF])
+	assert.Equal(t, putU32(7), attrs[ipvsSvcAttrFWMark])
+	assert.Equal(t, putU32(64), attrs[ipvsSvcAttrNetmask])
+	assert.Nil(t, attrs[ipvsSvcAttrAddr])
+
+	attrs, err = parseAttrs(encodeService(&vs, false))
+	assert.Nil(t, err)
+	assert.Len(t, attrs, 2)
+}
+
+func TestNetlinkHandleGetVirtualServers(t *testing.T) {
+	web := VirtualServer{Address: net.ParseIP("10.0.0.1"), Port: 80, Protocol: ProtocolTCP, Scheduler: SchedulerRR}
+	mark := VirtualServer{FWMark: 1, Scheduler: SchedulerSH}
+	rs1 := RealServer{Address: net.ParseIP("192.168.0.1"), Port: 80, Weight: 1, ForwardingMethod: ForwardingMethodDR}
+	rs2 := RealServer{Address: net.ParseIP("192.168.0.2"), Port: 80, Weight: 0, ForwardingMethod: ForwardingMethodNAT}
+	rs3 := RealServer{Address: net.ParseIP("fd00::1"), Port: 0, Weight: 5, ForwardingMethod: ForwardingMethodTUN}
+
+	conn := &fakeConn{
+		replies: map[uint8][][]byte{
+			ipvsCmdGetService: {
+				serviceReply(&web, Stats{Conns: 5, InPackets: 30, InBytes: 2000}),
+				serviceReply(&mark, Stats{Conns: 1 << 40}),
+			},
+		},
+		dests: map[string][][]byte{
+			web.Key(): {
+				destReply(&web, &rs1, 12, Stats{Conns: 3}),
+				destReply(&web, &rs2, 0, Stats{Conns: 2}),
+			},
+			mark.Key(): {
+				destReply(&mark, &rs3, 1, Stats{OutBytes: 100}),
+			},
+		},
+	}
+	h := &netlinkHandle{conn: conn}
+
+	vss, err := h.GetVirtualServers()
+	assert.Nil(t, err)
+	web.RealServers = []RealServer{rs1, rs2}
+	mark.RealServers = []RealServer{rs3}
+	assert.Equal(t, []*VirtualServer{&web, &mark}, vss)
+	assert.True(t, conn.requests[0].dump)
+
+	conns, err := h.GetActiveConns(&web)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"192.168.0.1:80": 12, "192.168.0.2:80": 0}, conns)
+
+	stats, err := h.GetStats()
+	assert.Nil(t, err)
+	assert.Equal(t, []ServiceStats{
+		{
+			Key:   "TCP/10.0.0.1:80",
+			Stats: Stats{Conns: 5, InPackets: 30, InBytes: 2000},
+			RealServers: map[string]Stats{
+				"192.168.0.1:80": {Conns: 3},
+				"192.168.0.2:80": {Conns: 2},
+			},
+		},
+		{
+			Key:         "FWM/1",
+			Stats:       Stats{Conns: 1 << 40},
+			RealServers: map[string]Stats{"[fd00::1]:0": {OutBytes: 100}},
+		},
+	}, stats)
+}
+
+func TestNetlinkHandleCommands(t *testing.T) {
+	vs := VirtualServer{Address: net.ParseIP("10.0.0.1"), Port: 80, Protocol: ProtocolTCP, Scheduler: SchedulerRR}
+	rs := RealServer{Address: net.ParseIP("192.168.0.1"), Port: 8080, Weight: 3}
+
+	conn := &fakeConn{}
+	h := &netlinkHandle{conn: conn}
+	assert.Nil(t, h.AddVirtualServer(&vs))
+	assert.Nil(t, h.UpdateVirtualServer(&vs))
+	assert.Nil(t, h.AddRealServer(&vs, &rs))
+	assert.Nil(t, h.UpdateRealServer(&vs, &rs))
+	assert.Nil(t, h.DeleteRealServer(&vs, &rs))
+	assert.Nil(t, h.DeleteVirtualServer(&vs))
+
+	cmds := make([]uint8, 0)
+	for _, req := range conn.requests {
+		assert.False(t, req.dump)
+		cmds = append(cmds, req.cmd)
+		got, err := conn.service(req.attrs)
+		assert.Nil(t, err)
+		assert.Equal(t, vs.Key(), got.Key())
+	}
+	assert.Equal(t, []uint8{
+		ipvsCmdNewService, ipvsCmdSetService,
+		ipvsCmdNewDest, ipvsCmdSetDest, ipvsCmdDelDest,
+		ipvsCmdDelService,
+	}, cmds)
+
+	// the real server defaults to direct routing like ipvsadm
+	attrs, err := parseAttrs(conn.requests[2].attrs)
+	assert.Nil(t, err)
+	d, err := decodeDest(attrs[ipvsCmdAttrDest], corenet.FamilyIPv4)
+	assert.Nil(t, err)
+	rs.ForwardingMethod = ForwardingMethodDR
+	assert.Equal(t, rs, d.RealServer)
+
+	// the deletions only identify the servers
+	attrs, err = parseAttrs(conn.requests[4].attrs)
+	assert.Nil(t, err)
+	dest, err := parseAttrs(attrs[ipvsCmdAttrDest])
+	assert.Nil(t, err)
+	assert.Len(t, dest, 2)
+}
+
+func TestNetlinkHandleSyncDaemons(t *testing.T) {
+	daemon := func(state uint32, iface string, syncid uint32) []byte {
+		b := putAttr(nil, ipvsDaemonAttrState, putU32(state))
+		b = putAttr(b, ipvsDaemonAttrMcastIfn, putString(iface))
+		b = putAttr(b, ipvsDaemonAttrSyncID, putU32(syncid))
+		return putNested(nil, ipvsCmdAttrDaemon, b)
+	}
+	conn := &fakeConn{
+		replies: map[uint8][][]byte{
+			ipvsCmdGetDaemon: {
+				daemon(ipvsStateMaster, "eth0", 50),
+				daemon(ipvsStateBackup, "bond0.100", 7),
+			},
+		},
+	}
+	h := &netlinkHandle{conn: conn}
+
+	daemons, err := h.GetSyncDaemons()
+	assert.Nil(t, err)
+	assert.Equal(t, []SyncDaemon{
+		{State: SyncStateMaster, Interface: "eth0", SyncID: 50},
+		{State: SyncStateBackup, Interface: "bond0.100", SyncID: 7},
+	}, daemons)
+
+	assert.Nil(t, h.StartSyncDaemon(SyncStateBackup, "eth0", 200))
+	assert.Nil(t, h.StopSyncDaemon(SyncStateMaster))
+	assert.Equal(t, daemon(ipvsStateBackup, "eth0", 200), conn.requests[1].attrs)
+	assert.Equal(t, putNested(nil, ipvsCmdAttrDaemon, putAttr(nil, ipvsDaemonAttrState, putU32(ipvsStateMaster))), conn.requests[2].attrs)
+}
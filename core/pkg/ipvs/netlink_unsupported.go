@@ -0,0 +1,35 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import "errors"
+
+var errIPVSUnsupported = errors.New("ipvs is only supported on linux")
+
+// NewHandle returns a Handle failing every call on this platform
+func NewHandle() Handle {
+	return &netlinkHandle{conn: unsupportedConn{}}
+}
+
+type unsupportedConn struct{}
+
+func (unsupportedConn) execute(cmd uint8, attrs []byte, dump bool) ([][]byte, error) {
+	return nil, errIPVSUnsupported
+}
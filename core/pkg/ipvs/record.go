@@ -0,0 +1,92 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+)
+
+// DefaultRecordPath is the default file recording the virtual servers owned
+// by a Manager. It is on a tmpfs like the ipvs table, so both are gone after
+// a reboot, a containerized provider should mount it from the host to keep
+// the record across the restarts of the container.
+const DefaultRecordPath = "/var/run/loadbalancer-provider/ipvs-owned.json"
+
+// ownershipRecord is the content of the record file
+type ownershipRecord struct {
+	// VirtualServers are the keys of the owned virtual servers
+	VirtualServers []string `json:"virtualServers"`
+}
+
+// NewRecordedManager returns a Manager working on the given handle which
+// records the keys of the virtual servers it owns in the file at path. The
+// new Manager owns the virtual servers in the record again, so the ones a
+// previous process added and which are not desired any more are deleted by
+// the first Ensure.
+func NewRecordedManager(handle Handle, path string) (*Manager, error) {
+	m := NewManager(handle)
+	m.recordPath = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := ownershipRecord{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid ipvs ownership record %s: %v", path, err)
+	}
+	for _, key := range record.VirtualServers {
+		m.owned[key] = true
+	}
+	m.recorded = m.ownedKeys()
+	return m, nil
+}
+
+// saveRecord writes the keys of the owned virtual servers to the record
+// file if they are changed
+func (m *Manager) saveRecord() error {
+	if m.recordPath == "" {
+		return nil
+	}
+	keys := m.ownedKeys()
+	if reflect.DeepEqual(keys, m.recorded) {
+		return nil
+	}
+
+	data, err := json.Marshal(ownershipRecord{VirtualServers: keys})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.recordPath), 0755); err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(m.recordPath, data, 0644); err != nil {
+		return fmt.Errorf("write ipvs ownership record %s error: %v", m.recordPath, err)
+	}
+	m.recorded = keys
+	return nil
+}
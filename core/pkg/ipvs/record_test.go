@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordedManagerRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "ipvs-owned.json")
+
+	foreign := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.9", 1))
+	foreign.Port = 53
+	kept := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+	stale := newVirtualServer(ProtocolUDP, newRealServer("192.168.0.1", 1))
+
+	handle := NewFakeHandle(foreign)
+	m, err := NewRecordedManager(handle, path)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Ensure([]VirtualServer{kept, stale}))
+
+	// the process restarts, the kernel still has its virtual servers
+	handle.ResetCalls()
+	m, err = NewRecordedManager(handle, path)
+	assert.Nil(t, err)
+	listed, err := m.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(listed))
+
+	kept.RealServers = append(kept.RealServers, newRealServer("192.168.0.2", 1))
+	assert.Nil(t, m.Ensure([]VirtualServer{kept}))
+	// the stale virtual server of the previous process is deleted, the
+	// kept one is updated in place and the foreign one is untouched
+	assert.Equal(t, []string{
+		"DeleteVirtualServer UDP/10.0.0.100:80",
+		"AddRealServer TCP/10.0.0.100:80 192.168.0.2:80",
+	}, handle.Calls)
+
+	vss, err := handle.GetVirtualServers()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(vss))
+	assert.Equal(t, foreign.Key(), vss[0].Key())
+	assert.Equal(t, foreign.RealServers, vss[0].RealServers)
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"virtualServers":["TCP/10.0.0.100:80"]}`, string(data))
+
+	// another restart cleans up everything it owns
+	m, err = NewRecordedManager(handle, path)
+	assert.Nil(t, err)
+	assert.Nil(t, m.Cleanup())
+	vss, err = handle.GetVirtualServers()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(vss))
+	assert.Equal(t, foreign.Key(), vss[0].Key())
+}
+
+func TestRecordedManagerInvalidRecord(t *testing.T) {
+	f, err := ioutil.TempFile("", "ipvs-owned")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("{")
+	f.Close()
+
+	_, err = NewRecordedManager(NewFakeHandle(), f.Name())
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// SchedulerRR - Round Robin
+	SchedulerRR = "rr"
+	// SchedulerWRR - Weighted Round Robin
+	SchedulerWRR = "wrr"
+	// SchedulerLC - Least Connections
+	SchedulerLC = "lc"
+	// SchedulerWLC - Weighted Least Connections
+	SchedulerWLC = "wlc"
+	// SchedulerLBLC - Locality-Based Least Connections
+	SchedulerLBLC = "lblc"
+	// SchedulerDH - Destination Hashing
+	SchedulerDH = "dh"
+	// SchedulerSH - Source Hashing
+	SchedulerSH = "sh"
+	// SchedulerMH - Maglev Hashing
+	SchedulerMH = "mh"
+
+	// DefaultScheduler is used when no scheduler is specified
+	DefaultScheduler = SchedulerRR
+)
+
+// schedulers is the whitelist of schedulers, lblc and dh are kept for the
+// LoadBalancers which have already used them
+var schedulers = map[string]bool{
+	SchedulerRR:   true,
+	SchedulerWRR:  true,
+	SchedulerLC:   true,
+	SchedulerWLC:  true,
+	SchedulerLBLC: true,
+	SchedulerDH:   true,
+	SchedulerSH:   true,
+	SchedulerMH:   true,
+}
+
+// ValidateScheduler returns an error if the scheduler is not supported
+func ValidateScheduler(scheduler string) error {
+	if schedulers[scheduler] {
+		return nil
+	}
+	supported := make([]string, 0, len(schedulers))
+	for s := range schedulers {
+		supported = append(supported, s)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("unsupported ipvs scheduler %q, must be one of %s", scheduler, strings.Join(supported, ", "))
+}
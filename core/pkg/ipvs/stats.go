@@ -0,0 +1,117 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultStatsRetention is how long the counters of a virtual or real
+// server missing from the kernel are kept, so they continue from where they
+// were when it is added again
+const DefaultStatsRetention = 10 * time.Minute
+
+// StatsTracker keeps the counters of the virtual and real servers monotonic.
+// The kernel counters start from zero again when a server is deleted and
+// added back, e.g. by a restart of keepalived, the tracker adds the values
+// before such a reset to the ones read after it. A server recreated and
+// counting past its last value between two reads is not noticed.
+type StatsTracker struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*trackedStats
+}
+
+type trackedStats struct {
+	last   Stats
+	offset Stats
+	seen   time.Time
+}
+
+// NewStatsTracker returns a StatsTracker which forgets the servers missing
+// for retention
+func NewStatsTracker(retention time.Duration) *StatsTracker {
+	return &StatsTracker{
+		retention: retention,
+		now:       time.Now,
+		series:    make(map[string]*trackedStats),
+	}
+}
+
+// Track returns a copy of the stats read from the kernel with the counters
+// reset since the last call added up
+func (t *StatsTracker) Track(stats []ServiceStats) []ServiceStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	ret := make([]ServiceStats, 0, len(stats))
+	for _, vs := range stats {
+		tracked := ServiceStats{
+			Key:         vs.Key,
+			Stats:       t.track(vs.Key, vs.Stats, now),
+			RealServers: make(map[string]Stats, len(vs.RealServers)),
+		}
+		for rs, s := range vs.RealServers {
+			tracked.RealServers[rs] = t.track(vs.Key+" "+rs, s, now)
+		}
+		ret = append(ret, tracked)
+	}
+	for key, s := range t.series {
+		if now.Sub(s.seen) > t.retention {
+			delete(t.series, key)
+		}
+	}
+	return ret
+}
+
+func (t *StatsTracker) track(key string, cur Stats, now time.Time) Stats {
+	s, ok := t.series[key]
+	if !ok {
+		s = &trackedStats{}
+		t.series[key] = s
+	}
+	if cur.less(s.last) {
+		s.offset = s.offset.add(s.last)
+	}
+	s.last, s.seen = cur, now
+	return cur.add(s.offset)
+}
+
+// add returns the sums of the counters
+func (s Stats) add(other Stats) Stats {
+	return Stats{
+		Conns:      s.Conns + other.Conns,
+		InPackets:  s.InPackets + other.InPackets,
+		OutPackets: s.OutPackets + other.OutPackets,
+		InBytes:    s.InBytes + other.InBytes,
+		OutBytes:   s.OutBytes + other.OutBytes,
+	}
+}
+
+// less returns true if any counter is less than the other one, the
+// counters only decrease on a reset
+func (s Stats) less(other Stats) bool {
+	return s.Conns < other.Conns ||
+		s.InPackets < other.InPackets ||
+		s.OutPackets < other.OutPackets ||
+		s.InBytes < other.InBytes ||
+		s.OutBytes < other.OutBytes
+}
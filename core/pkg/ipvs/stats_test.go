@@ -0,0 +1,88 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsTracker(t *testing.T) {
+	vs := newVirtualServer(ProtocolTCP, newRealServer("192.168.0.1", 1))
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+
+	now := time.Unix(1500000000, 0)
+	tracker := NewStatsTracker(DefaultStatsRetention)
+	tracker.now = func() time.Time { return now }
+	read := func(vsStats Stats, rsStats Stats) ServiceStats {
+		handle.SetStats(ServiceStats{Key: vs.Key(), Stats: vsStats, RealServers: map[string]Stats{"192.168.0.1:80": rsStats}})
+		stats, err := m.Stats()
+		assert.Nil(t, err)
+		tracked := tracker.Track(stats)
+		if len(tracked) == 0 {
+			return ServiceStats{}
+		}
+		return tracked[0]
+	}
+
+	stats := read(Stats{Conns: 5, InBytes: 100}, Stats{Conns: 5, InBytes: 100})
+	assert.Equal(t, "TCP/10.0.0.100:80", stats.Key)
+	assert.Equal(t, Stats{Conns: 5, InBytes: 100}, stats.Stats)
+	assert.Equal(t, Stats{Conns: 5, InBytes: 100}, stats.RealServers["192.168.0.1:80"])
+
+	stats = read(Stats{Conns: 8, InBytes: 300}, Stats{Conns: 8, InBytes: 300})
+	assert.Equal(t, Stats{Conns: 8, InBytes: 300}, stats.Stats)
+
+	// the virtual server is recreated, the counters continue
+	stats = read(Stats{Conns: 1, InBytes: 50}, Stats{Conns: 1, InBytes: 50})
+	assert.Equal(t, Stats{Conns: 9, InBytes: 350}, stats.Stats)
+	assert.Equal(t, Stats{Conns: 9, InBytes: 350}, stats.RealServers["192.168.0.1:80"])
+	stats = read(Stats{Conns: 2, InBytes: 80}, Stats{Conns: 2, InBytes: 80})
+	assert.Equal(t, Stats{Conns: 10, InBytes: 380}, stats.Stats)
+
+	// a single counter going back is a reset too
+	stats = read(Stats{Conns: 2, InBytes: 10}, Stats{Conns: 2, InBytes: 80})
+	assert.Equal(t, Stats{Conns: 12, InBytes: 390}, stats.Stats)
+	assert.Equal(t, Stats{Conns: 10, InBytes: 380}, stats.RealServers["192.168.0.1:80"])
+
+	// the real server is missing for a while
+	handle.ResetCalls()
+	assert.Nil(t, m.Ensure([]VirtualServer{newVirtualServer(ProtocolTCP)}))
+	now = now.Add(time.Minute)
+	stats = read(Stats{Conns: 3, InBytes: 20}, Stats{})
+	assert.Empty(t, stats.RealServers)
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	now = now.Add(time.Minute)
+	stats = read(Stats{Conns: 3, InBytes: 20}, Stats{Conns: 1, InBytes: 5})
+	assert.Equal(t, Stats{Conns: 13, InBytes: 400}, stats.Stats)
+	assert.Equal(t, Stats{Conns: 11, InBytes: 385}, stats.RealServers["192.168.0.1:80"])
+
+	// the virtual server missing longer than the retention starts over
+	assert.Nil(t, m.Cleanup())
+	read(Stats{}, Stats{})
+	now = now.Add(DefaultStatsRetention + time.Second)
+	read(Stats{}, Stats{})
+	assert.Empty(t, tracker.series)
+	assert.Nil(t, m.Ensure([]VirtualServer{vs}))
+	stats = read(Stats{Conns: 1}, Stats{Conns: 1})
+	assert.Equal(t, Stats{Conns: 1}, stats.Stats)
+	assert.Equal(t, Stats{Conns: 1}, stats.RealServers["192.168.0.1:80"])
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// SyncState is the state of the ipvs connection synchronization daemon
+type SyncState string
+
+const (
+	// SyncStateMaster sends the connection states to the backups
+	SyncStateMaster SyncState = "master"
+	// SyncStateBackup receives the connection states from the master
+	SyncStateBackup SyncState = "backup"
+)
+
+// SyncDaemon is a running ipvs connection synchronization daemon
+type SyncDaemon struct {
+	State     SyncState `json:"state"`
+	Interface string    `json:"interface"`
+	SyncID    int       `json:"syncid"`
+}
+
+func (d SyncDaemon) String() string {
+	return fmt.Sprintf("%s(mcast=%s, syncid=%d)", d.State, d.Interface, d.SyncID)
+}
+
+func (s SyncState) validate() error {
+	switch s {
+	case SyncStateMaster, SyncStateBackup:
+		return nil
+	}
+	return fmt.Errorf("unsupported sync daemon state %q", s)
+}
+
+func (s SyncState) opposite() SyncState {
+	if s == SyncStateMaster {
+		return SyncStateBackup
+	}
+	return SyncStateMaster
+}
+
+// EnsureSyncDaemon makes the sync daemon of the given state run on the
+// interface with the syncid, the daemon of the opposite state is stopped,
+// e.g. on a VRRP transition from BACKUP to MASTER. A running daemon with
+// different parameters is restarted.
+func (m *Manager) EnsureSyncDaemon(state SyncState, iface string, syncid int) error {
+	if err := state.validate(); err != nil {
+		return err
+	}
+	if syncid < 0 || syncid > 255 {
+		return fmt.Errorf("invalid syncid %d, must be in [0, 255]", syncid)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running, err := m.syncDaemons()
+	if err != nil {
+		return err
+	}
+
+	desired := SyncDaemon{State: state, Interface: iface, SyncID: syncid}
+	if cur, ok := running[state.opposite()]; ok {
+		log.Info("Stopping ipvs sync daemon", log.Fields{"daemon": cur})
+		if err := m.handle.StopSyncDaemon(cur.State); err != nil {
+			return err
+		}
+	}
+	if cur, ok := running[state]; ok {
+		if cur == desired {
+			return nil
+		}
+		log.Info("Restarting ipvs sync daemon", log.Fields{"daemon": cur})
+		if err := m.handle.StopSyncDaemon(cur.State); err != nil {
+			return err
+		}
+	}
+
+	log.Info("Starting ipvs sync daemon", log.Fields{"daemon": desired})
+	return m.handle.StartSyncDaemon(state, iface, syncid)
+}
+
+// StopSyncDaemons stops all running sync daemons
+func (m *Manager) StopSyncDaemons() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running, err := m.syncDaemons()
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, state := range []SyncState{SyncStateMaster, SyncStateBackup} {
+		if cur, ok := running[state]; ok {
+			log.Info("Stopping ipvs sync daemon", log.Fields{"daemon": cur})
+			if err := m.handle.StopSyncDaemon(state); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// SyncDaemons returns the running sync daemons
+func (m *Manager) SyncDaemons() ([]SyncDaemon, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handle.GetSyncDaemons()
+}
+
+func (m *Manager) syncDaemons() (map[SyncState]SyncDaemon, error) {
+	daemons, err := m.handle.GetSyncDaemons()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[SyncState]SyncDaemon, len(daemons))
+	for _, d := range daemons {
+		ret[d.State] = d
+	}
+	return ret, nil
+}
@@ -0,0 +1,54 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSyncDaemonIntegration drives the kernel by netlink, it needs root and
+// the ip_vs module, run it by `go test -tags integration`
+func TestSyncDaemonIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	handle := NewHandle()
+	if _, err := handle.GetSyncDaemons(); err != nil {
+		t.Skipf("requires ipvs: %v", err)
+	}
+
+	m := NewManager(handle)
+	defer m.StopSyncDaemons()
+
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateBackup, "lo", 200))
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateMaster, "lo", 200))
+
+	daemons, err := m.SyncDaemons()
+	assert.Nil(t, err)
+	assert.Equal(t, []SyncDaemon{{State: SyncStateMaster, Interface: "lo", SyncID: 200}}, daemons)
+
+	assert.Nil(t, m.StopSyncDaemons())
+	daemons, err = m.SyncDaemons()
+	assert.Nil(t, err)
+	assert.Empty(t, daemons)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureSyncDaemon(t *testing.T) {
+	handle := NewFakeHandle()
+	m := NewManager(handle)
+
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateBackup, "eth0", 50))
+	assert.Equal(t, []string{"StartSyncDaemon backup eth0 50"}, handle.Calls)
+
+	// idempotent
+	handle.ResetCalls()
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateBackup, "eth0", 50))
+	assert.Nil(t, handle.Calls)
+
+	// BACKUP -> MASTER
+	handle.ResetCalls()
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateMaster, "eth0", 50))
+	assert.Equal(t, []string{"StopSyncDaemon backup", "StartSyncDaemon master eth0 50"}, handle.Calls)
+
+	// syncid changed
+	handle.ResetCalls()
+	assert.Nil(t, m.EnsureSyncDaemon(SyncStateMaster, "eth0", 51))
+	assert.Equal(t, []string{"StopSyncDaemon master", "StartSyncDaemon master eth0 51"}, handle.Calls)
+
+	daemons, err := m.SyncDaemons()
+	assert.Nil(t, err)
+	assert.Equal(t, []SyncDaemon{{State: SyncStateMaster, Interface: "eth0", SyncID: 51}}, daemons)
+
+	handle.ResetCalls()
+	assert.Nil(t, m.StopSyncDaemons())
+	assert.Equal(t, []string{"StopSyncDaemon master"}, handle.Calls)
+
+	assert.NotNil(t, m.EnsureSyncDaemon("both", "eth0", 50))
+	assert.NotNil(t, m.EnsureSyncDaemon(SyncStateMaster, "eth0", 256))
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// Protocol is the transport protocol of a virtual server
+type Protocol string
+
+const (
+	// ProtocolTCP is the TCP protocol
+	ProtocolTCP Protocol = "TCP"
+	// ProtocolUDP is the UDP protocol
+	ProtocolUDP Protocol = "UDP"
+)
+
+// ForwardingMethod is the packet forwarding method of a real server
+type ForwardingMethod string
+
+const (
+	// ForwardingMethodDR is direct routing, a.k.a. gatewaying
+	ForwardingMethodDR ForwardingMethod = "DR"
+	// ForwardingMethodNAT is masquerading
+	ForwardingMethodNAT ForwardingMethod = "NAT"
+	// ForwardingMethodTUN is ipip tunneling
+	ForwardingMethodTUN ForwardingMethod = "TUN"
+)
+
+// Flags are the flags of a virtual server, the values are the same as
+// IP_VS_SVC_F_* in the kernel
+type Flags uint32
+
+const (
+	// FlagPersistent makes the connections of a client go to the same
+	// real server during the timeout of the virtual server
+	FlagPersistent Flags = 0x1
+	// FlagOnePacket schedules every UDP datagram separately
+	FlagOnePacket Flags = 0x4
+	// FlagSchedSHFallback makes the sh scheduler fall back to another
+	// real server if the selected one is unavailable
+	FlagSchedSHFallback Flags = 0x8
+	// FlagSchedSHPort makes the sh scheduler hash the source port too
+	FlagSchedSHPort Flags = 0x10
+)
+
+// VirtualServer is an ipvs virtual service
+type VirtualServer struct {
+	Address  net.IP
+	Port     uint16
+	Protocol Protocol
+	// FWMark identifies the virtual server by the firewall mark of the
+	// packets instead of the address, port and protocol if it is not zero,
+	// e.g. to make a persistence domain across several ports
+	FWMark uint32
+	// Family is the address family of a fwmark virtual server, it defaults
+	// to IPv4. The family of other virtual servers is the one of Address.
+	Family    corenet.Family
+	Scheduler string
+	Flags     Flags
+	// Timeout is the persistence timeout in seconds, it takes effect only
+	// if FlagPersistent is set
+	Timeout uint32
+	// Netmask is the granularity of the persistence, the clients in the
+	// same network share the real server. It is of the family of the
+	// virtual server, each client alone if it is nil.
+	Netmask     net.IPMask
+	RealServers []RealServer
+}
+
+// RealServer is a destination of a virtual server
+type RealServer struct {
+	Address          net.IP
+	Port             uint16
+	Weight           int
+	ForwardingMethod ForwardingMethod
+}
+
+// Stats are the counters of a virtual or real server since it was added
+type Stats struct {
+	Conns      uint64
+	InPackets  uint64
+	OutPackets uint64
+	InBytes    uint64
+	OutBytes   uint64
+}
+
+// ServiceStats are the counters of a virtual server and its real servers
+type ServiceStats struct {
+	// Key is the VirtualServer.Key of the virtual server
+	Key string
+	Stats
+	// RealServers are the counters of the real servers keyed by
+	// RealServer.Key
+	RealServers map[string]Stats
+}
+
+// Key returns the identity of the virtual server
+func (vs *VirtualServer) Key() string {
+	if vs.FWMark != 0 {
+		prefix := "FWM/"
+		if vs.AddressFamily() == corenet.FamilyIPv6 {
+			prefix = "FWM6/"
+		}
+		return prefix + strconv.FormatUint(uint64(vs.FWMark), 10)
+	}
+	return string(vs.Protocol) + "/" + joinHostPort(vs.Address, vs.Port)
+}
+
+// AddressFamily returns the address family of the virtual server
+func (vs *VirtualServer) AddressFamily() corenet.Family {
+	if vs.FWMark != 0 {
+		if vs.Family == "" {
+			return corenet.FamilyIPv4
+		}
+		return vs.Family
+	}
+	return corenet.FamilyOf(vs.Address)
+}
+
+// validateFamily returns an error if a real server is not of the family of
+// the virtual server, only tunneling can forward across families
+func (vs *VirtualServer) validateFamily() error {
+	family := vs.AddressFamily()
+	if family != corenet.FamilyIPv4 && family != corenet.FamilyIPv6 {
+		return fmt.Errorf("unsupported address family %q", family)
+	}
+	if vs.Netmask != nil && len(vs.Netmask)*8 != familyBits(family) {
+		return fmt.Errorf("persistence netmask %v is not an %s netmask", vs.Netmask, family)
+	}
+	for i := range vs.RealServers {
+		rs := &vs.RealServers[i]
+		if rs.ForwardingMethod != ForwardingMethodTUN && corenet.FamilyOf(rs.Address) != family {
+			return fmt.Errorf("real server %v is not an %s address", rs, family)
+		}
+	}
+	return nil
+}
+
+// PerFamily returns a copy of the template virtual server for each VIP,
+// each copy only keeps the real servers of the family of its VIP. The
+// copies of a fwmark template share the mark and differ in Family.
+func PerFamily(template VirtualServer, vips []net.IP) []VirtualServer {
+	ret := make([]VirtualServer, 0, len(vips))
+	for _, vip := range vips {
+		family := corenet.FamilyOf(vip)
+		vs := template
+		if vs.FWMark != 0 {
+			vs.Family = family
+		} else {
+			vs.Address = vip
+		}
+		vs.RealServers = make([]RealServer, 0, len(template.RealServers))
+		for _, rs := range template.RealServers {
+			if corenet.FamilyOf(rs.Address) == family {
+				vs.RealServers = append(vs.RealServers, rs)
+			}
+		}
+		ret = append(ret, vs)
+	}
+	return ret
+}
+
+// String implements fmt.Stringer
+func (vs *VirtualServer) String() string {
+	return vs.Key()
+}
+
+// equal returns true if the attributes of the virtual servers, except the
+// real servers, are equal
+func (vs *VirtualServer) equal(other *VirtualServer) bool {
+	return vs.Key() == other.Key() &&
+		vs.Scheduler == other.Scheduler &&
+		vs.Flags == other.Flags &&
+		(vs.Flags&FlagPersistent == 0 || (vs.Timeout == other.Timeout && vs.netmaskSize() == other.netmaskSize()))
+}
+
+// netmaskSize returns the length of the persistence netmask, a nil one is
+// the full length of the family
+func (vs *VirtualServer) netmaskSize() int {
+	if vs.Netmask == nil {
+		return familyBits(vs.AddressFamily())
+	}
+	ones, _ := vs.Netmask.Size()
+	return ones
+}
+
+// familyBits returns the length of the addresses of the family
+func familyBits(family corenet.Family) int {
+	if family == corenet.FamilyIPv6 {
+		return 8 * net.IPv6len
+	}
+	return 8 * net.IPv4len
+}
+
+// Key returns the identity of the real server inside a virtual server
+func (rs *RealServer) Key() string {
+	return joinHostPort(rs.Address, rs.Port)
+}
+
+// String implements fmt.Stringer
+func (rs *RealServer) String() string {
+	return rs.Key()
+}
+
+func (rs *RealServer) equal(other *RealServer) bool {
+	return rs.Key() == other.Key() &&
+		rs.Weight == other.Weight &&
+		rs.ForwardingMethod == other.ForwardingMethod
+}
+
+func joinHostPort(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+func (p Protocol) validate() error {
+	switch p {
+	case ProtocolTCP, ProtocolUDP:
+		return nil
+	}
+	return fmt.Errorf("unsupported protocol %q", p)
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics is a tiny metrics registry which renders its collectors
+// in the prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// TypeCounter is the type of monotonically increasing series
+	TypeCounter = "counter"
+	// TypeGauge is the type of series which can go up and down
+	TypeGauge = "gauge"
+)
+
+// DefaultRegistry is the registry used by the package level functions
+var DefaultRegistry = NewRegistry()
+
+// Sample is a single value of a metric family
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Family is a group of samples sharing the same name, help and label names
+type Family struct {
+	Name       string
+	Help       string
+	Type       string
+	LabelNames []string
+	Samples    []Sample
+}
+
+// Collector is anything that can produce metric families on scrape
+type Collector interface {
+	Collect() []*Family
+}
+
+// CollectorFunc adapts an ordinary function to a Collector
+type CollectorFunc func() []*Family
+
+// Collect calls f()
+func (f CollectorFunc) Collect() []*Family {
+	return f()
+}
+
+// Registry holds a set of collectors
+type Registry struct {
+	mu         sync.RWMutex
+	collectors []Collector
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// MustRegister registers collectors to the registry
+func (r *Registry) MustRegister(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, cs...)
+}
+
+// MustRegister registers collectors to the DefaultRegistry
+func MustRegister(cs ...Collector) {
+	DefaultRegistry.MustRegister(cs...)
+}
+
+// Gather collects all families of the registry, sorted by name
+func (r *Registry) Gather() []*Family {
+	r.mu.RLock()
+	collectors := make([]Collector, len(r.collectors))
+	copy(collectors, r.collectors)
+	r.mu.RUnlock()
+
+	families := make([]*Family, 0)
+	for _, c := range collectors {
+		families = append(families, c.Collect()...)
+	}
+	sort.SliceStable(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// WriteTo writes all families of the registry in text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, f := range r.Gather() {
+		n, err := writeFamily(w, f)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP implements http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// Handler returns an http.Handler for the DefaultRegistry
+func Handler() http.Handler {
+	return DefaultRegistry
+}
+
+func writeFamily(w io.Writer, f *Family) (int, error) {
+	var buf bytes.Buffer
+	if f.Help != "" {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", f.Name, escape(f.Help, false))
+	}
+	fmt.Fprintf(&buf, "# TYPE %s %s\n", f.Name, f.Type)
+	for _, s := range f.Samples {
+		buf.WriteString(f.Name)
+		if len(f.LabelNames) > 0 {
+			buf.WriteByte('{')
+			for i, name := range f.LabelNames {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				value := ""
+				if i < len(s.LabelValues) {
+					value = s.LabelValues[i]
+				}
+				fmt.Fprintf(&buf, "%s=\"%s\"", name, escape(value, true))
+			}
+			buf.WriteByte('}')
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+	return io.WriteString(w, buf.String())
+}
+
+func escape(s string, quote bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quote {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+// vec is the shared implementation of CounterVec and GaugeVec
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+func newVec(typ, name, help string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		values:     make(map[string]*Sample),
+	}
+}
+
+func (v *vec) sample(lvs []string) *Sample {
+	if len(lvs) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labelNames), len(lvs)))
+	}
+	key := strings.Join(lvs, "\xff")
+	s, ok := v.values[key]
+	if !ok {
+		s = &Sample{LabelValues: append([]string(nil), lvs...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(lvs []string, delta float64) {
+	v.mu.Lock()
+	v.sample(lvs).Value += delta
+	v.mu.Unlock()
+}
+
+func (v *vec) set(lvs []string, value float64) {
+	v.mu.Lock()
+	v.sample(lvs).Value = value
+	v.mu.Unlock()
+}
+
+func (v *vec) get(lvs []string) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.sample(lvs).Value
+}
+
+func (v *vec) delete(lvs []string) {
+	v.mu.Lock()
+	delete(v.values, strings.Join(lvs, "\xff"))
+	v.mu.Unlock()
+}
+
+func (v *vec) reset() {
+	v.mu.Lock()
+	v.values = make(map[string]*Sample)
+	v.mu.Unlock()
+}
+
+// Collect implements Collector
+func (v *vec) Collect() []*Family {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f := &Family{
+		Name:       v.name,
+		Help:       v.help,
+		Type:       v.typ,
+		LabelNames: v.labelNames,
+		Samples:    make([]Sample, 0, len(keys)),
+	}
+	for _, k := range keys {
+		f.Samples = append(f.Samples, *v.values[k])
+	}
+	return []*Family{f}
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec returns a new CounterVec
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(TypeCounter, name, help, labelNames)}
+}
+
+// Inc increments the counter of the given label values by 1
+func (c *CounterVec) Inc(lvs ...string) {
+	c.add(lvs, 1)
+}
+
+// Add adds delta, which must not be negative, to the counter
+func (c *CounterVec) Add(delta float64, lvs ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metric %s: counter can not decrease", c.name))
+	}
+	c.add(lvs, delta)
+}
+
+// Get returns the current value of the counter
+func (c *CounterVec) Get(lvs ...string) float64 {
+	return c.get(lvs)
+}
+
+// Delete removes the series of the given label values
+func (c *CounterVec) Delete(lvs ...string) {
+	c.delete(lvs)
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec returns a new GaugeVec
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(TypeGauge, name, help, labelNames)}
+}
+
+// Set sets the gauge of the given label values
+func (g *GaugeVec) Set(value float64, lvs ...string) {
+	g.set(lvs, value)
+}
+
+// Add adds delta to the gauge
+func (g *GaugeVec) Add(delta float64, lvs ...string) {
+	g.add(lvs, delta)
+}
+
+// Get returns the current value of the gauge
+func (g *GaugeVec) Get(lvs ...string) float64 {
+	return g.get(lvs)
+}
+
+// Delete removes the series of the given label values
+func (g *GaugeVec) Delete(lvs ...string) {
+	g.delete(lvs)
+}
+
+// Reset removes all series of the gauge
+func (g *GaugeVec) Reset() {
+	g.reset()
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	r := NewRegistry()
+	restores := NewCounterVec("vip_restores_total", "VIP restores", "address")
+	state := NewGaugeVec("vrrp_state", "", "instance", "node")
+	r.MustRegister(state, restores)
+
+	restores.Inc("10.0.0.1")
+	restores.Add(2, "10.0.0.1")
+	restores.Inc("10.0.0.2")
+	state.Set(2, "vips", `a"b`)
+
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, `# HELP vip_restores_total VIP restores
+# TYPE vip_restores_total counter
+vip_restores_total{address="10.0.0.1"} 3
+vip_restores_total{address="10.0.0.2"} 1
+# TYPE vrrp_state gauge
+vrrp_state{instance="vips",node="a\"b"} 2
+`, buf.String())
+
+	assert.Equal(t, float64(3), restores.Get("10.0.0.1"))
+	assert.Panics(t, func() { restores.Add(-1, "10.0.0.1") })
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mocks provides mocks of the seams of the backends to the
+// dataplane and of the Provider, they record their calls and return the
+// results of their func fields. The mocks are generated by mockgen, run
+// go generate in this directory after changing the interfaces.
+//
+// mockgen is in-tree since neither gomock nor counterfeiter is vendored,
+// it needs the standard library only and TestGeneratedMocks keeps the
+// mocks in sync with the interfaces. Unlike gomock there are no
+// expectations, the tests assert the recorded calls instead, and the
+// interfaces embedding others are not supported.
+package mocks
+
+//go:generate go run ./mockgen -source ../ipvs/handle.go -import github.com/caicloud/loadbalancer-provider/core/pkg/ipvs -interface Handle -mock IPVSHandle -out ipvs_handle.go
+//go:generate go run ./mockgen -source ../net/addr.go -import github.com/caicloud/loadbalancer-provider/core/pkg/net -interface AddrHandle -out addr_handle.go
+//go:generate go run ./mockgen -source ../net/vlan.go -import github.com/caicloud/loadbalancer-provider/core/pkg/net -interface LinkHandle -out link_handle.go
+//go:generate go run ./mockgen -source ../net/route.go -import github.com/caicloud/loadbalancer-provider/core/pkg/net -interface RouteHandle -out route_handle.go
+//go:generate go run ./mockgen -source ../conntrack/conntrack.go -import github.com/caicloud/loadbalancer-provider/core/pkg/conntrack -interface Handle -mock ConntrackHandle -out conntrack_handle.go
+//go:generate go run ./mockgen -source ../sysctl/fs.go -import github.com/caicloud/loadbalancer-provider/core/pkg/sysctl -interface FSWriter -out fs_writer.go
+//go:generate go run ./mockgen -source ../tc/tc.go -import github.com/caicloud/loadbalancer-provider/core/pkg/tc -interface Runner -mock TCRunner -out tc_runner.go
+//go:generate go run ./mockgen -source ../../../vendor/k8s.io/kubernetes/pkg/util/exec/exec.go -import k8s.io/kubernetes/pkg/util/exec -interface Interface -mock Exec -out exec.go
+//go:generate go run ./mockgen -source ../../../vendor/k8s.io/kubernetes/pkg/util/exec/exec.go -import k8s.io/kubernetes/pkg/util/exec -interface Cmd -mock ExecCmd -out exec_cmd.go
+//go:generate go run ./mockgen -source ../../provider/types.go -import github.com/caicloud/loadbalancer-provider/core/provider -interface Provider -out provider.go
@@ -0,0 +1,368 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// mockgen generates a mock of an interface recording its calls, the
+// methods call the func fields of the mock if they are set and return the
+// zero values otherwise. It reads the interface from the source file only,
+// so the embedded interfaces are not supported.
+//
+// Usage:
+//
+//	mockgen -source ../ipvs/handle.go -import github.com/caicloud/loadbalancer-provider/core/pkg/ipvs -interface Handle -mock IPVSHandle -out ipvs_handle.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const header = `/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+`
+
+var mockTemplate = template.Must(template.New("mock").Parse(`// Code generated by mockgen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .StdImports}}
+	{{.}}
+{{- end}}
+{{if .StdImports}}{{end}}
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// {{.Mock}} is a mock of {{.Interface}} recording its calls, the methods
+// call the func fields if they are set and return the zero values
+// otherwise
+type {{.Mock}} struct {
+	Recorder
+{{range .Methods}}
+	{{.Name}}Func func({{.ParamTypes}}){{.Results}}
+{{- end}}
+}
+
+var _ {{.Interface}} = &{{.Mock}}{}
+{{range .Methods}}
+// {{.Name}} records the call and calls {{.Name}}Func
+func (m *{{$.Mock}}) {{.Name}}({{.Params}}){{.NamedResults}} {
+	m.Record("{{.Name}}"{{range .Args}}, {{.}}{{end}})
+	if m.{{.Name}}Func != nil {
+		{{if .Results}}return {{end}}m.{{.Name}}Func({{.CallArgs}})
+	}
+	{{- if .Results}}
+	return
+	{{- end}}
+}
+{{end}}`))
+
+type method struct {
+	Name         string
+	Params       string
+	ParamTypes   string
+	Args         []string
+	CallArgs     string
+	Results      string
+	NamedResults string
+}
+
+// predeclared are the predeclared types, they are not qualified
+var predeclared = map[string]bool{
+	"bool": true, "byte": true, "complex64": true, "complex128": true, "error": true,
+	"float32": true, "float64": true, "int": true, "int8": true, "int16": true,
+	"int32": true, "int64": true, "rune": true, "string": true, "uint": true,
+	"uint8": true, "uint16": true, "uint32": true, "uint64": true, "uintptr": true,
+}
+
+// generator qualifies the types of the source package and collects the
+// imports the types refer to
+type generator struct {
+	pkg      string
+	imports  map[string]string
+	used     map[string]string
+	unsolved []string
+}
+
+// qualify returns the expression with the types of the source package
+// qualified by its name
+func (g *generator) qualify(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if predeclared[e.Name] || !ast.IsExported(e.Name) {
+			return e
+		}
+		return &ast.SelectorExpr{X: ast.NewIdent(g.pkg), Sel: ast.NewIdent(e.Name)}
+	case *ast.SelectorExpr:
+		name := e.X.(*ast.Ident).Name
+		if p, ok := g.imports[name]; ok {
+			g.used[name] = p
+		} else {
+			g.unsolved = append(g.unsolved, name)
+		}
+		return e
+	case *ast.StarExpr:
+		return &ast.StarExpr{X: g.qualify(e.X)}
+	case *ast.Ellipsis:
+		return &ast.Ellipsis{Elt: g.qualify(e.Elt)}
+	case *ast.ArrayType:
+		return &ast.ArrayType{Len: e.Len, Elt: g.qualify(e.Elt)}
+	case *ast.MapType:
+		return &ast.MapType{Key: g.qualify(e.Key), Value: g.qualify(e.Value)}
+	case *ast.ChanType:
+		return &ast.ChanType{Dir: e.Dir, Value: g.qualify(e.Value)}
+	case *ast.FuncType:
+		return &ast.FuncType{Params: g.qualifyFields(e.Params), Results: g.qualifyFields(e.Results)}
+	}
+	return expr
+}
+
+func (g *generator) qualifyFields(fields *ast.FieldList) *ast.FieldList {
+	if fields == nil {
+		return nil
+	}
+	q := &ast.FieldList{}
+	for _, f := range fields.List {
+		q.List = append(q.List, &ast.Field{Names: f.Names, Type: g.qualify(f.Type)})
+	}
+	return q
+}
+
+// print prints the expression on a line, the positions of the source are
+// not used since the qualified identifiers have none
+func (g *generator) print(expr ast.Expr) string {
+	var buf bytes.Buffer
+	printer.Fprint(&buf, token.NewFileSet(), expr)
+	return buf.String()
+}
+
+// fields returns the types of the fields, one per name
+func (g *generator) fields(fields *ast.FieldList) []string {
+	types := make([]string, 0)
+	if fields == nil {
+		return types
+	}
+	for _, f := range fields.List {
+		t := g.print(g.qualify(f.Type))
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+func (g *generator) method(name string, fn *ast.FuncType) method {
+	m := method{Name: name}
+	params := g.fields(fn.Params)
+	variadic := len(fn.Params.List) > 0 && isEllipsis(fn.Params.List[len(fn.Params.List)-1].Type)
+	named, callArgs := make([]string, 0, len(params)), make([]string, 0, len(params))
+	for i, t := range params {
+		arg := fmt.Sprintf("p%d", i)
+		named = append(named, arg+" "+t)
+		m.Args = append(m.Args, arg)
+		if variadic && i == len(params)-1 {
+			arg += "..."
+		}
+		callArgs = append(callArgs, arg)
+	}
+	m.Params = strings.Join(named, ", ")
+	m.ParamTypes = strings.Join(params, ", ")
+	m.CallArgs = strings.Join(callArgs, ", ")
+
+	results := g.fields(fn.Results)
+	if len(results) == 0 {
+		return m
+	}
+	named = make([]string, 0, len(results))
+	for i, t := range results {
+		named = append(named, fmt.Sprintf("r%d %s", i, t))
+	}
+	m.NamedResults = " (" + strings.Join(named, ", ") + ")"
+	if len(results) == 1 {
+		m.Results = " " + results[0]
+	} else {
+		m.Results = " (" + strings.Join(results, ", ") + ")"
+	}
+	return m
+}
+
+func isEllipsis(expr ast.Expr) bool {
+	_, ok := expr.(*ast.Ellipsis)
+	return ok
+}
+
+func generate(source, importPath, iface, mock, pkg string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, source, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &generator{
+		pkg:     file.Name.Name,
+		imports: map[string]string{file.Name.Name: importPath},
+		used:    map[string]string{file.Name.Name: importPath},
+	}
+	for _, imp := range file.Imports {
+		p, _ := strconv.Unquote(imp.Path.Value)
+		name := path.Base(p)
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		g.imports[name] = p
+	}
+
+	var it *ast.InterfaceType
+	ast.Inspect(file, func(n ast.Node) bool {
+		if spec, ok := n.(*ast.TypeSpec); ok && spec.Name.Name == iface {
+			it, _ = spec.Type.(*ast.InterfaceType)
+		}
+		return it == nil
+	})
+	if it == nil {
+		return nil, fmt.Errorf("interface %s not found in %s", iface, source)
+	}
+
+	methods := make([]method, 0, len(it.Methods.List))
+	for _, f := range it.Methods.List {
+		fn, ok := f.Type.(*ast.FuncType)
+		if !ok || len(f.Names) == 0 {
+			return nil, fmt.Errorf("embedded interface %s of %s is not supported", g.print(f.Type), iface)
+		}
+		methods = append(methods, g.method(f.Names[0].Name, fn))
+	}
+	if len(g.unsolved) > 0 {
+		return nil, fmt.Errorf("unknown packages %v", g.unsolved)
+	}
+
+	// the standard packages are grouped apart as goimports does
+	stdImports, imports := make([]string, 0), make([]string, 0)
+	for name, p := range g.used {
+		spec := strconv.Quote(p)
+		if path.Base(p) != name {
+			spec = name + " " + spec
+		}
+		if strings.Contains(strings.Split(p, "/")[0], ".") {
+			imports = append(imports, spec)
+		} else {
+			stdImports = append(stdImports, spec)
+		}
+	}
+	sort.Strings(stdImports)
+	sort.Strings(imports)
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	err = mockTemplate.Execute(&buf, map[string]interface{}{
+		"Source":     filepath.Base(source),
+		"Package":    pkg,
+		"StdImports": stdImports,
+		"Imports":    imports,
+		"Mock":       mock,
+		"Interface":  g.pkg + "." + iface,
+		"Methods":    methods,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// options are the options of a mock to generate
+type options struct {
+	source     string
+	importPath string
+	iface      string
+	mock       string
+	pkg        string
+	out        string
+}
+
+// parseOptions parses the options from the arguments
+func parseOptions(args []string) (*options, error) {
+	o := &options{}
+	fs := flag.NewFlagSet("mockgen", flag.ContinueOnError)
+	fs.StringVar(&o.source, "source", "", "the source file of the interface")
+	fs.StringVar(&o.importPath, "import", "", "the import path of the package of the source file")
+	fs.StringVar(&o.iface, "interface", "", "the name of the interface")
+	fs.StringVar(&o.mock, "mock", "", "the name of the mock, the name of the interface if it is empty")
+	fs.StringVar(&o.pkg, "package", "mocks", "the package of the mock")
+	fs.StringVar(&o.out, "out", "", "the output file, stdout if it is empty")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if o.source == "" || o.importPath == "" || o.iface == "" {
+		return nil, fmt.Errorf("-source, -import and -interface are required")
+	}
+	if o.mock == "" {
+		o.mock = o.iface
+	}
+	return o, nil
+}
+
+func main() {
+	o, err := parseOptions(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mockgen: %v\n", err)
+		os.Exit(2)
+	}
+	data, err := generate(o.source, o.importPath, o.iface, o.mock, o.pkg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mockgen: %v\n", err)
+		os.Exit(1)
+	}
+	if o.out == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	if err := ioutil.WriteFile(o.out, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "mockgen: %v\n", err)
+		os.Exit(1)
+	}
+}
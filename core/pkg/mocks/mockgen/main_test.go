@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGeneratedMocks regenerates the mocks of the go:generate directives
+// of the mocks package, they have to match the checked in ones
+func TestGeneratedMocks(t *testing.T) {
+	const directive = "//go:generate go run ./mockgen "
+	doc, err := ioutil.ReadFile("../doc.go")
+	assert.Nil(t, err)
+
+	n := 0
+	for _, line := range strings.Split(string(doc), "\n") {
+		if !strings.HasPrefix(line, directive) {
+			continue
+		}
+		n++
+		o, err := parseOptions(strings.Fields(strings.TrimPrefix(line, directive)))
+		if !assert.Nil(t, err, line) {
+			continue
+		}
+		data, err := generate(filepath.Join("..", o.source), o.importPath, o.iface, o.mock, o.pkg)
+		if !assert.Nil(t, err, line) {
+			continue
+		}
+		checkedIn, err := ioutil.ReadFile(filepath.Join("..", o.out))
+		assert.Nil(t, err, line)
+		assert.Equal(t, string(checkedIn), string(data), "%s is out of date, run go generate", o.out)
+	}
+	assert.NotZero(t, n)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	_, err := parseOptions([]string{"-source", "main.go"})
+	assert.NotNil(t, err)
+
+	_, err = generate("main.go", "mockgen", "Missing", "Missing", "mocks")
+	assert.EqualError(t, err, "interface Missing not found in main.go")
+
+	// the embedded interfaces are not supported
+	dir, err := ioutil.TempDir("", "mockgen")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	source := filepath.Join(dir, "source.go")
+	assert.Nil(t, ioutil.WriteFile(source, []byte("package source\n\nimport \"io\"\n\ntype ReadCloser interface {\n\tio.Reader\n\tClose() error\n}\n"), 0644))
+	_, err = generate(source, "source", "ReadCloser", "ReadCloser", "mocks")
+	assert.EqualError(t, err, "embedded interface io.Reader of ReadCloser is not supported")
+}
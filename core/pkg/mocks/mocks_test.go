@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mocks
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/kubernetes/pkg/util/exec"
+)
+
+func TestIPVSHandle(t *testing.T) {
+	m := &IPVSHandle{}
+	vs := &ipvs.VirtualServer{FWMark: 1}
+
+	// the zero values without the funcs
+	vss, err := m.GetVirtualServers()
+	assert.Nil(t, vss)
+	assert.Nil(t, err)
+
+	m.AddVirtualServerFunc = func(*ipvs.VirtualServer) error { return fmt.Errorf("busy") }
+	assert.EqualError(t, m.AddVirtualServer(vs), "busy")
+	m.GetActiveConnsFunc = func(*ipvs.VirtualServer) (map[string]int, error) {
+		return map[string]int{"192.168.1.1:0": 3}, nil
+	}
+	conns, err := m.GetActiveConns(vs)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"192.168.1.1:0": 3}, conns)
+
+	assert.Equal(t, []string{"GetVirtualServers", "AddVirtualServer", "GetActiveConns"}, m.Methods())
+	assert.Equal(t, []Call{{Method: "AddVirtualServer", Args: []interface{}{vs}}}, m.Calls("AddVirtualServer"))
+	assert.Equal(t, 1, m.CallCount("GetActiveConns"))
+	m.Reset()
+	assert.Empty(t, m.Calls())
+}
+
+func TestExec(t *testing.T) {
+	cmd := &ExecCmd{CombinedOutputFunc: func() ([]byte, error) { return []byte("ok"), nil }}
+	m := &Exec{CommandFunc: func(string, ...string) exec.Cmd { return cmd }}
+
+	out, err := m.Command("ip", "addr", "show").CombinedOutput()
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(out))
+	assert.Equal(t, []Call{{Method: "Command", Args: []interface{}{"ip", []string{"addr", "show"}}}}, m.Calls())
+	assert.Equal(t, []string{"CombinedOutput"}, cmd.Methods())
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mocks
+
+import (
+	"sync"
+)
+
+// Call is a recorded call of a mock
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Recorder records the calls of a mock, it is embedded in the mocks and
+// safe for concurrent use
+type Recorder struct {
+	mu    sync.Mutex
+	calls []Call
+}
+
+// Record records the call of the method with the arguments
+func (r *Recorder) Record(method string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{Method: method, Args: args})
+}
+
+// Calls returns the calls of the methods in order, all calls if no
+// method is given
+func (r *Recorder) Calls(methods ...string) []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := make([]Call, 0, len(r.calls))
+	for _, c := range r.calls {
+		if len(methods) == 0 || contains(methods, c.Method) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Methods returns the methods called in order
+func (r *Recorder) Methods() []string {
+	calls := r.Calls()
+	methods := make([]string, 0, len(calls))
+	for _, c := range calls {
+		methods = append(methods, c.Method)
+	}
+	return methods
+}
+
+// CallCount returns the number of the calls of the method
+func (r *Recorder) CallCount(method string) int {
+	return len(r.Calls(method))
+}
+
+// Reset forgets the calls recorded
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+// Addr is an IP address bound to a link
+type Addr struct {
+	*net.IPNet
+	// Link is the name of the link the address is bound to
+	Link string
+	// Label is the optional label of an IPv4 address, it must be the link
+	// name or start with the link name followed by a colon, e.g. lo:lbp.
+	// IPv6 addresses can not be labeled, it is ignored for them.
+	Label string
+}
+
+// NewAddr returns an Addr of ip with a full length mask on the link
+func NewAddr(ip net.IP, link string) Addr {
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	return Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Link:  link,
+	}
+}
+
+// String returns the address in the format of ip(8)
+func (a Addr) String() string {
+	return fmt.Sprintf("%v dev %s", a.IPNet, a.Link)
+}
+
+// key identifies the address regardless of its mask
+func (a Addr) key() string {
+	return a.Link + "/" + a.IP.String()
+}
+
+// AddrUpdate is the notification of an address change on a link
+type AddrUpdate struct {
+	Addr
+	// NewAddr is true when the address is added, and false when it is removed
+	NewAddr bool
+	// Resync is true when changes were lost, e.g. by an overrun of the
+	// netlink receive buffer. Addr is empty, the addresses have to be
+	// listed again.
+	Resync bool
+}
+
+// AddrHandle manipulates addresses of links
+type AddrHandle interface {
+	// AddrAdd adds the address to its link, it is a no-op if the address
+	// has already existed
+	AddrAdd(addr Addr) error
+	// AddrDel deletes the address from its link, it is a no-op if the
+	// address does not exist
+	AddrDel(addr Addr) error
+	// AddrList lists the addresses of the link
+	AddrList(link string) ([]Addr, error)
+}
+
+// NewAddrHandle returns an AddrHandle which drives ip(8)
+func NewAddrHandle() AddrHandle {
+	return &ipAddrHandle{exec: k8sexec.New()}
+}
+
+type ipAddrHandle struct {
+	exec k8sexec.Interface
+}
+
+func (h *ipAddrHandle) AddrAdd(addr Addr) error {
+	args := []string{"addr", "add", addr.IPNet.String(), "dev", addr.Link}
+	if addr.Label != "" && addr.IP.To4() != nil {
+		args = append(args, "label", addr.Label)
+	}
+	out, err := h.exec.Command("ip", args...).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "File exists") {
+		return fmt.Errorf("add address %v error: %v\n%s", addr, err, out)
+	}
+	return nil
+}
+
+func (h *ipAddrHandle) AddrDel(addr Addr) error {
+	out, err := h.exec.Command("ip", "addr", "del", addr.IPNet.String(), "dev", addr.Link).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "Cannot assign requested address") {
+		return fmt.Errorf("delete address %v error: %v\n%s", addr, err, out)
+	}
+	return nil
+}
+
+func (h *ipAddrHandle) AddrList(link string) ([]Addr, error) {
+	out, err := h.exec.Command("ip", "-o", "addr", "show", "dev", link).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("list addresses of %s error: %v\n%s", link, err, out)
+	}
+	return parseAddrShow(link, out)
+}
+
+// parseAddrShow parses the output of `ip -o addr show dev <link>`, e.g.
+//
+//	1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+//	1: lo    inet 10.0.0.100/32 scope global lo:lbp\       valid_lft forever preferred_lft forever
+//	1: lo    inet6 ::1/128 scope host \       valid_lft forever preferred_lft forever
+func parseAddrShow(link string, out []byte) ([]Addr, error) {
+	ret := make([]Addr, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(strings.SplitN(line, "\\", 2)[0])
+		if len(fields) < 4 || (fields[2] != "inet" && fields[2] != "inet6") {
+			continue
+		}
+		ip, ipnet, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		addr := Addr{IPNet: &net.IPNet{IP: ip, Mask: ipnet.Mask}, Link: link}
+		if last := fields[len(fields)-1]; fields[2] == "inet" && strings.HasPrefix(last, link+":") {
+			addr.Label = last
+		}
+		ret = append(ret, addr)
+	}
+	return ret, nil
+}
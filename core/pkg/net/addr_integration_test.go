@@ -0,0 +1,73 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNetlinkAddrHandleIntegration binds addresses on the loopback, it
+// needs root, run it by `go test -tags integration`
+func TestNetlinkAddrHandleIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	h := NewNetlinkAddrHandle()
+
+	labeled := NewAddr(net.ParseIP("10.255.255.100"), "lo")
+	labeled.Label = "lo:lbp"
+	ipv6 := NewAddr(net.ParseIP("fd00:ffff::100"), "lo")
+	for _, addr := range []Addr{labeled, ipv6} {
+		assert.Nil(t, h.AddrAdd(addr))
+		defer h.AddrDel(addr)
+		// a no-op if the address exists
+		assert.Nil(t, h.AddrAdd(addr))
+	}
+
+	addrs, err := h.AddrList("lo")
+	assert.Nil(t, err)
+	found := make(map[string]Addr)
+	for _, a := range addrs {
+		found[a.IP.String()] = a
+	}
+	assert.Equal(t, labeled.String(), found["10.255.255.100"].String())
+	assert.Equal(t, "lo:lbp", found["10.255.255.100"].Label)
+	assert.Equal(t, ipv6.String(), found["fd00:ffff::100"].String())
+	assert.Equal(t, "", found["127.0.0.1"].Label)
+
+	for _, addr := range []Addr{labeled, ipv6} {
+		assert.Nil(t, h.AddrDel(addr))
+		// a no-op if the address does not exist
+		assert.Nil(t, h.AddrDel(addr))
+	}
+	addrs, err = h.AddrList("lo")
+	assert.Nil(t, err)
+	for _, a := range addrs {
+		assert.NotEqual(t, "10.255.255.100", a.IP.String())
+		assert.NotEqual(t, "fd00:ffff::100", a.IP.String())
+	}
+
+	_, err = h.AddrList("nonexistent0")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	log "github.com/zoumo/logdog"
+)
+
+// SubscribeAddr subscribes to the netlink RTNLGRP_IPV4_IFADDR and
+// RTNLGRP_IPV6_IFADDR groups and sends every address change to ch
+// until done is closed. A Resync update is sent once changes are lost.
+func SubscribeAddr(ch chan<- AddrUpdate, done <-chan struct{}) error {
+	s, err := subscribe(rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr)
+	if err != nil {
+		return err
+	}
+
+	go s.receive(done, func(m syscall.NetlinkMessage) {
+		update, ok := parseAddrMessage(m)
+		if !ok {
+			return
+		}
+		sendAddrUpdate(ch, update, done)
+	}, func() {
+		sendAddrUpdate(ch, AddrUpdate{Resync: true}, done)
+	})
+
+	return nil
+}
+
+func sendAddrUpdate(ch chan<- AddrUpdate, update AddrUpdate, done <-chan struct{}) {
+	select {
+	case ch <- update:
+	case <-done:
+	}
+}
+
+func parseAddrMessage(m syscall.NetlinkMessage) (AddrUpdate, bool) {
+	if m.Header.Type != syscall.RTM_NEWADDR && m.Header.Type != syscall.RTM_DELADDR {
+		return AddrUpdate{}, false
+	}
+	if len(m.Data) < syscall.SizeofIfAddrmsg {
+		return AddrUpdate{}, false
+	}
+	msg := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		log.Warn("parse netlink address message error", log.Fields{"err": err})
+		return AddrUpdate{}, false
+	}
+
+	var ip net.IP
+	var label string
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFA_LOCAL:
+			// IFA_LOCAL is the local address, IFA_ADDRESS is the peer
+			// address on point-to-point links
+			ip = net.IP(attr.Value)
+		case syscall.IFA_ADDRESS:
+			if ip == nil {
+				ip = net.IP(attr.Value)
+			}
+		case syscall.IFA_LABEL:
+			label = string(attr.Value[:clen(attr.Value)])
+		}
+	}
+	if ip == nil {
+		return AddrUpdate{}, false
+	}
+
+	link := label
+	if iface, err := net.InterfaceByIndex(int(msg.Index)); err == nil {
+		link = iface.Name
+	}
+
+	bits := 8 * len(ip)
+	addr := Addr{
+		IPNet: &net.IPNet{IP: append(net.IP(nil), ip...), Mask: net.CIDRMask(int(msg.Prefixlen), bits)},
+		Link:  link,
+	}
+	if ip.To4() != nil && strings.HasPrefix(label, link+":") {
+		addr.Label = label
+	}
+	return AddrUpdate{
+		Addr:    addr,
+		NewAddr: m.Header.Type == syscall.RTM_NEWADDR,
+	}, true
+}
+
+// NewNetlinkAddrHandle returns an AddrHandle talking to the kernel by
+// netlink, for the backends which run no external process
+func NewNetlinkAddrHandle() AddrHandle {
+	return &netlinkAddrHandle{}
+}
+
+type netlinkAddrHandle struct{}
+
+func (h *netlinkAddrHandle) AddrAdd(addr Addr) error {
+	data, err := addrRequest(addr, true)
+	if err == nil {
+		_, err = request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data)
+	}
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("add address %v error: %v", addr, err)
+	}
+	return nil
+}
+
+func (h *netlinkAddrHandle) AddrDel(addr Addr) error {
+	data, err := addrRequest(addr, false)
+	if err == nil {
+		_, err = request(syscall.RTM_DELADDR, 0, data)
+	}
+	if err != nil && err != syscall.EADDRNOTAVAIL {
+		return fmt.Errorf("delete address %v error: %v", addr, err)
+	}
+	return nil
+}
+
+func (h *netlinkAddrHandle) AddrList(link string) ([]Addr, error) {
+	iface, err := net.InterfaceByName(link)
+	if err != nil {
+		return nil, fmt.Errorf("list addresses of %s error: %v", link, err)
+	}
+	msgs, err := request(syscall.RTM_GETADDR, syscall.NLM_F_DUMP, make([]byte, syscall.SizeofIfAddrmsg))
+	if err != nil {
+		return nil, fmt.Errorf("list addresses of %s error: %v", link, err)
+	}
+	ret := make([]Addr, 0)
+	for _, m := range msgs {
+		if len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		if msg := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0])); int(msg.Index) != iface.Index {
+			continue
+		}
+		if update, ok := parseAddrMessage(m); ok {
+			ret = append(ret, update.Addr)
+		}
+	}
+	return ret, nil
+}
+
+// addrRequest returns the ifaddrmsg and the attributes adding or deleting
+// the address, only an added IPv4 address is labeled
+func addrRequest(addr Addr, add bool) ([]byte, error) {
+	iface, err := net.InterfaceByName(addr.Link)
+	if err != nil {
+		return nil, err
+	}
+	family, ip := syscall.AF_INET6, addr.IP.To16()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+	ones, _ := addr.Mask.Size()
+
+	data := make([]byte, syscall.SizeofIfAddrmsg)
+	*(*syscall.IfAddrmsg)(unsafe.Pointer(&data[0])) = syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(ones),
+		Index:     uint32(iface.Index),
+	}
+	data = putRtAttr(data, syscall.IFA_LOCAL, ip)
+	data = putRtAttr(data, syscall.IFA_ADDRESS, ip)
+	if add && addr.Label != "" && family == syscall.AF_INET {
+		data = putRtAttr(data, syscall.IFA_LABEL, append([]byte(addr.Label), 0))
+	}
+	return data, nil
+}
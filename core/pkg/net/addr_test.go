@@ -0,0 +1,39 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddrShow(t *testing.T) {
+	out := []byte(`1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+1: lo    inet 10.0.0.100/32 scope global lo:lbp\       valid_lft forever preferred_lft forever
+1: lo    inet6 ::1/128 scope host \       valid_lft forever preferred_lft forever
+`)
+	addrs, err := parseAddrShow("lo", out)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(addrs))
+	assert.Equal(t, "127.0.0.1/8 dev lo", addrs[0].String())
+	assert.Equal(t, "", addrs[0].Label)
+	assert.Equal(t, NewAddr(net.ParseIP("10.0.0.100"), "lo").String(), addrs[1].String())
+	assert.Equal(t, "lo:lbp", addrs[1].Label)
+	assert.Equal(t, "::1/128 dev lo", addrs[2].String())
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// DialOnInterface connects to the address on the named network like
+// net.DialTimeout, with the socket bound to the interface so the traffic
+// leaves through it. The socket is not bound if iface is empty.
+func DialOnInterface(network, address, iface string, timeout time.Duration) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if iface != "" {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = bindToDevice(fd, iface)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	return d.Dial(network, address)
+}
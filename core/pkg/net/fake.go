@@ -0,0 +1,289 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeAddrHandle is an in-memory AddrHandle for tests
+type FakeAddrHandle struct {
+	mu    sync.Mutex
+	addrs []Addr
+	added []Addr
+}
+
+var _ AddrHandle = &FakeAddrHandle{}
+
+// NewFakeAddrHandle returns a FakeAddrHandle holding the given addresses
+func NewFakeAddrHandle(addrs ...Addr) *FakeAddrHandle {
+	return &FakeAddrHandle{addrs: append([]Addr(nil), addrs...)}
+}
+
+// AddrAdd implements AddrHandle
+func (f *FakeAddrHandle) AddrAdd(addr Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.added = append(f.added, addr)
+	if f.find(addr) < 0 {
+		f.addrs = append(f.addrs, addr)
+	}
+	return nil
+}
+
+// AddrDel implements AddrHandle
+func (f *FakeAddrHandle) AddrDel(addr Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if i := f.find(addr); i >= 0 {
+		f.addrs = append(f.addrs[:i], f.addrs[i+1:]...)
+	}
+	return nil
+}
+
+// AddrList implements AddrHandle
+func (f *FakeAddrHandle) AddrList(link string) ([]Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]Addr, 0)
+	for _, a := range f.addrs {
+		if a.Link == link {
+			ret = append(ret, a)
+		}
+	}
+	return ret, nil
+}
+
+// AddedAddrs returns the addresses passed to AddrAdd in order
+func (f *FakeAddrHandle) AddedAddrs() []Addr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Addr(nil), f.added...)
+}
+
+func (f *FakeAddrHandle) find(addr Addr) int {
+	for i := range f.addrs {
+		if f.addrs[i].key() == addr.key() {
+			return i
+		}
+	}
+	return -1
+}
+
+// FakeRouteHandle is an in-memory RouteHandle for tests
+type FakeRouteHandle struct {
+	mu     sync.Mutex
+	rules  []Rule
+	routes []Route
+	// Calls records the calls in the form of "Method rule|route"
+	Calls []string
+}
+
+var _ RouteHandle = &FakeRouteHandle{}
+
+// NewFakeRouteHandle returns a FakeRouteHandle holding the rules
+func NewFakeRouteHandle(rules ...Rule) *FakeRouteHandle {
+	return &FakeRouteHandle{rules: append([]Rule(nil), rules...)}
+}
+
+// Rules returns the current rules
+func (f *FakeRouteHandle) Rules() []Rule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Rule(nil), f.rules...)
+}
+
+// ResetCalls clears the recorded calls
+func (f *FakeRouteHandle) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = nil
+}
+
+// RuleList implements RouteHandle
+func (f *FakeRouteHandle) RuleList(ipv6 bool) ([]Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]Rule, 0)
+	for _, r := range f.rules {
+		if r.Src == nil || (r.Src.IP.To4() == nil) == ipv6 {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// RuleAdd implements RouteHandle
+func (f *FakeRouteHandle) RuleAdd(rule Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "RuleAdd "+rule.String())
+	f.rules = append(f.rules, rule)
+	return nil
+}
+
+// RuleDel implements RouteHandle
+func (f *FakeRouteHandle) RuleDel(rule Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "RuleDel "+rule.String())
+	for i, r := range f.rules {
+		if r.String() == rule.String() {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// RouteList implements RouteHandle
+func (f *FakeRouteHandle) RouteList(table int, ipv6 bool) ([]Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]Route, 0)
+	for _, r := range f.routes {
+		if r.Table == table {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// RouteReplace implements RouteHandle
+func (f *FakeRouteHandle) RouteReplace(route Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "RouteReplace "+route.String())
+	for i, r := range f.routes {
+		if r.Table == route.Table && r.Dst.String() == route.Dst.String() {
+			f.routes[i] = route
+			return nil
+		}
+	}
+	f.routes = append(f.routes, route)
+	return nil
+}
+
+// RouteDel implements RouteHandle
+func (f *FakeRouteHandle) RouteDel(route Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "RouteDel "+route.String())
+	for i, r := range f.routes {
+		if r.String() == route.String() {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// FakeLinkHandle is an in-memory LinkHandle for tests
+type FakeLinkHandle struct {
+	mu    sync.Mutex
+	links map[string]Link
+	// Calls records the calls in the form of "Method link"
+	Calls []string
+}
+
+var _ LinkHandle = &FakeLinkHandle{}
+
+// NewFakeLinkHandle returns a FakeLinkHandle holding the links
+func NewFakeLinkHandle(links ...Link) *FakeLinkHandle {
+	f := &FakeLinkHandle{links: make(map[string]Link)}
+	for _, l := range links {
+		f.links[l.Name] = l
+	}
+	return f
+}
+
+// Link returns the link, nil if it does not exist
+func (f *FakeLinkHandle) Link(name string) *Link {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l, ok := f.links[name]
+	if !ok {
+		return nil
+	}
+	return &l
+}
+
+// ResetCalls clears the recorded calls
+func (f *FakeLinkHandle) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = nil
+}
+
+// LinkGet implements LinkHandle
+func (f *FakeLinkHandle) LinkGet(name string) (*Link, error) {
+	return f.Link(name), nil
+}
+
+// VLANAdd implements LinkHandle
+func (f *FakeLinkHandle) VLANAdd(vlan VLAN) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "VLANAdd "+vlan.String())
+	if _, ok := f.links[vlan.Name]; ok {
+		return fmt.Errorf("link %s exists", vlan.Name)
+	}
+	mtu := vlan.MTU
+	if mtu == 0 {
+		mtu = 1500
+	}
+	f.links[vlan.Name] = Link{Name: vlan.Name, Parent: vlan.Parent, VLANID: vlan.ID, MTU: mtu, Alias: VLANOwnerAlias}
+	return nil
+}
+
+// LinkSetUp implements LinkHandle
+func (f *FakeLinkHandle) LinkSetUp(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "LinkSetUp "+name)
+	l, ok := f.links[name]
+	if !ok {
+		return fmt.Errorf("link %s does not exist", name)
+	}
+	l.Up = true
+	f.links[name] = l
+	return nil
+}
+
+// LinkSetMTU implements LinkHandle
+func (f *FakeLinkHandle) LinkSetMTU(name string, mtu int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, fmt.Sprintf("LinkSetMTU %s %d", name, mtu))
+	l, ok := f.links[name]
+	if !ok {
+		return fmt.Errorf("link %s does not exist", name)
+	}
+	l.MTU = mtu
+	f.links[name] = l
+	return nil
+}
+
+// LinkDel implements LinkHandle
+func (f *FakeLinkHandle) LinkDel(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Calls = append(f.Calls, "LinkDel "+name)
+	delete(f.links, name)
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+)
+
+// Family is the address family of an IP address
+type Family string
+
+const (
+	// FamilyIPv4 is the IPv4 address family
+	FamilyIPv4 Family = "IPv4"
+	// FamilyIPv6 is the IPv6 address family
+	FamilyIPv6 Family = "IPv6"
+)
+
+// FamilyOf returns the address family of the ip
+func FamilyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// FilterFamily returns the ips of the family
+func FilterFamily(ips []net.IP, family Family) []net.IP {
+	ret := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if FamilyOf(ip) == family {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// DefaultLinkDebounce is the default time a link must stay up before
+	// the addresses on it are announced
+	DefaultLinkDebounce = 2 * time.Second
+	// DefaultAnnounceBurst is the default number of announcements of every
+	// address after the link comes up
+	DefaultAnnounceBurst = 3
+	// DefaultAnnounceInterval is the default interval of the announcements
+	// in a burst
+	DefaultAnnounceInterval = time.Second
+)
+
+var (
+	linkUps = metrics.NewCounterVec(
+		"loadbalancer_provider_link_up_total",
+		"Number of transitions of the monitored links to the operational state up",
+		"link",
+	)
+	linkAnnouncements = metrics.NewCounterVec(
+		"loadbalancer_provider_link_up_announcements_total",
+		"Number of announcement bursts of the managed addresses after a link came up",
+		"link",
+	)
+	linkAnnouncementsSuppressed = metrics.NewCounterVec(
+		"loadbalancer_provider_link_up_announcements_suppressed_total",
+		"Number of announcement bursts suppressed because the link went down again within the debounce time",
+		"link",
+	)
+)
+
+func init() {
+	metrics.MustRegister(linkUps, linkAnnouncements, linkAnnouncementsSuppressed)
+}
+
+// LinkUpdate is the notification of a link change
+type LinkUpdate struct {
+	Link string
+	// Up is true if the operational state of the link is up
+	Up bool
+}
+
+// LinkMonitor announces the managed addresses once their links come back
+// up, e.g. after a switch reboot or a cable reseat, so the upstream devices
+// relearn them without waiting for the next periodic announcement.
+//
+// Only the managed addresses which are present on the link are announced,
+// the owner of an address can keep it managed while it is not held. Links
+// are assumed to be up when the monitor starts.
+type LinkMonitor struct {
+	// Debounce is the time a link must stay up before the addresses are
+	// announced, so a flapping link does not lead to an announcement storm
+	Debounce time.Duration
+	// Burst is the number of announcements of every address, Interval apart
+	Burst    int
+	Interval time.Duration
+
+	handle    AddrHandle
+	subscribe func(chan<- LinkUpdate, <-chan struct{}) error
+	announce  func(link string, ip net.IP) error
+
+	mu    sync.Mutex
+	addrs map[string][]net.IP
+
+	// the following are only accessed by Run
+	down    map[string]bool
+	gen     map[string]int
+	pending map[string]*time.Timer
+}
+
+type linkFire struct {
+	link string
+	gen  int
+}
+
+// NewLinkMonitor returns a new LinkMonitor looking up the addresses of the
+// links by handle
+func NewLinkMonitor(handle AddrHandle) *LinkMonitor {
+	return &LinkMonitor{
+		Debounce:  DefaultLinkDebounce,
+		Burst:     DefaultAnnounceBurst,
+		Interval:  DefaultAnnounceInterval,
+		handle:    handle,
+		subscribe: SubscribeLink,
+		announce:  announce,
+		addrs:     make(map[string][]net.IP),
+		down:      make(map[string]bool),
+		gen:       make(map[string]int),
+		pending:   make(map[string]*time.Timer),
+	}
+}
+
+// SetAddrs replaces the managed addresses
+func (m *LinkMonitor) SetAddrs(addrs []Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.addrs = make(map[string][]net.IP)
+	for _, a := range addrs {
+		m.addrs[a.Link] = append(m.addrs[a.Link], a.IP)
+	}
+}
+
+// Run monitors link changes until stopCh is closed
+func (m *LinkMonitor) Run(stopCh <-chan struct{}) error {
+	updates := make(chan LinkUpdate, 64)
+	if err := m.subscribe(updates, stopCh); err != nil {
+		return fmt.Errorf("subscribe link updates error: %v", err)
+	}
+
+	fired := make(chan linkFire, 16)
+	log.Info("Link monitor started")
+	for {
+		select {
+		case <-stopCh:
+			for _, t := range m.pending {
+				t.Stop()
+			}
+			log.Info("Link monitor stopped")
+			return nil
+		case u := <-updates:
+			m.process(u, fired, stopCh)
+		case f := <-fired:
+			if f.gen != m.gen[f.link] || m.down[f.link] {
+				// the link went down after the timer fired
+				continue
+			}
+			delete(m.pending, f.link)
+			linkAnnouncements.Inc(f.link)
+			go m.announceLink(f.link, stopCh)
+		}
+	}
+}
+
+func (m *LinkMonitor) process(u LinkUpdate, fired chan<- linkFire, stopCh <-chan struct{}) {
+	if !m.managed(u.Link) {
+		return
+	}
+
+	// a link keeps sending updates in the same operational state, e.g.
+	// on mtu changes, only the transitions matter
+	if u.Up != m.down[u.Link] {
+		return
+	}
+
+	if !u.Up {
+		m.down[u.Link] = true
+		log.Warn("Link went down", log.Fields{"link": u.Link})
+		if t, ok := m.pending[u.Link]; ok {
+			t.Stop()
+			delete(m.pending, u.Link)
+			linkAnnouncementsSuppressed.Inc(u.Link)
+			log.Warn("Link is flapping, announcement suppressed", log.Fields{"link": u.Link})
+		}
+		return
+	}
+
+	delete(m.down, u.Link)
+	linkUps.Inc(u.Link)
+	log.Info("Link came up", log.Fields{"link": u.Link, "debounce": m.Debounce})
+
+	m.gen[u.Link]++
+	f := linkFire{link: u.Link, gen: m.gen[u.Link]}
+	m.pending[u.Link] = time.AfterFunc(m.Debounce, func() {
+		select {
+		case fired <- f:
+		case <-stopCh:
+		}
+	})
+}
+
+func (m *LinkMonitor) managed(link string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.addrs[link]) > 0
+}
+
+// held returns the managed addresses which are present on the link
+func (m *LinkMonitor) held(link string) []net.IP {
+	current, err := m.handle.AddrList(link)
+	if err != nil {
+		log.Error("list addresses error", log.Fields{"link": link, "err": err})
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ret := make([]net.IP, 0)
+	for _, ip := range m.addrs[link] {
+		for _, a := range current {
+			if a.IP.Equal(ip) {
+				ret = append(ret, ip)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// announceLink sends the burst of announcements of the addresses held on
+// the link, it gives up once stopCh is closed
+func (m *LinkMonitor) announceLink(link string, stopCh <-chan struct{}) {
+	ips := m.held(link)
+	if len(ips) == 0 {
+		return
+	}
+
+	log.Info("Announcing addresses after link came up", log.Fields{"link": link, "addrs": ips})
+	for i := 0; i < m.Burst; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(m.Interval):
+			case <-stopCh:
+				return
+			}
+		}
+		for _, ip := range ips {
+			if err := m.announce(link, ip); err != nil {
+				log.Warn("announce address error", log.Fields{"link": link, "addr": ip, "err": err})
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	log "github.com/zoumo/logdog"
+)
+
+// operational states of links, see IF_OPER_* in if.h
+const (
+	ifOperUp = 6
+)
+
+// SubscribeLink subscribes to the netlink RTNLGRP_LINK group and sends
+// every link change to ch until done is closed.
+func SubscribeLink(ch chan<- LinkUpdate, done <-chan struct{}) error {
+	s, err := subscribe(rtmgrpLink)
+	if err != nil {
+		return err
+	}
+
+	go s.receive(done, func(m syscall.NetlinkMessage) {
+		update, ok := parseLinkMessage(m)
+		if !ok {
+			return
+		}
+		select {
+		case ch <- update:
+		case <-done:
+		}
+	}, nil)
+
+	return nil
+}
+
+func parseLinkMessage(m syscall.NetlinkMessage) (LinkUpdate, bool) {
+	if m.Header.Type != syscall.RTM_NEWLINK && m.Header.Type != syscall.RTM_DELLINK {
+		return LinkUpdate{}, false
+	}
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return LinkUpdate{}, false
+	}
+	msg := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		log.Warn("parse netlink link message error", log.Fields{"err": err})
+		return LinkUpdate{}, false
+	}
+
+	var name string
+	operstate := -1
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFLA_IFNAME:
+			name = string(attr.Value[:clen(attr.Value)])
+		case syscall.IFLA_OPERSTATE:
+			if len(attr.Value) > 0 {
+				operstate = int(attr.Value[0])
+			}
+		}
+	}
+	if name == "" {
+		if iface, err := net.InterfaceByIndex(int(msg.Index)); err == nil {
+			name = iface.Name
+		}
+	}
+	if name == "" {
+		return LinkUpdate{}, false
+	}
+
+	return LinkUpdate{
+		Link: name,
+		Up:   m.Header.Type == syscall.RTM_NEWLINK && operstate == ifOperUp,
+	}, true
+}
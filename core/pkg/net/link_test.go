@@ -0,0 +1,146 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type linkEnv struct {
+	monitor   *LinkMonitor
+	updates   chan<- LinkUpdate
+	announced chan net.IP
+	stopCh    chan struct{}
+	done      chan error
+}
+
+func newLinkEnv(t *testing.T, link string) *linkEnv {
+	held := NewAddr(net.ParseIP("10.0.0.100"), link)
+	held6 := NewAddr(net.ParseIP("fd00::100"), link)
+	// managed but held by another node
+	released := NewAddr(net.ParseIP("10.0.0.101"), link)
+	// held but not managed
+	node := NewAddr(net.ParseIP("10.0.0.2"), link)
+
+	// the counters survive the repeated runs of a test
+	for _, c := range []*metrics.CounterVec{linkUps, linkAnnouncements, linkAnnouncementsSuppressed} {
+		c.Delete(link)
+	}
+
+	env := &linkEnv{
+		monitor:   NewLinkMonitor(NewFakeAddrHandle(held, held6, node)),
+		announced: make(chan net.IP, 100),
+		stopCh:    make(chan struct{}),
+		done:      make(chan error, 1),
+	}
+	env.monitor.Debounce = 50 * time.Millisecond
+	env.monitor.Burst = 2
+	env.monitor.Interval = time.Millisecond
+	env.monitor.announce = func(l string, ip net.IP) error {
+		assert.Equal(t, link, l)
+		env.announced <- ip
+		return nil
+	}
+	ready := make(chan chan<- LinkUpdate, 1)
+	env.monitor.subscribe = func(ch chan<- LinkUpdate, done <-chan struct{}) error {
+		ready <- ch
+		return nil
+	}
+	env.monitor.SetAddrs([]Addr{held, held6, released})
+
+	go func() { env.done <- env.monitor.Run(env.stopCh) }()
+	select {
+	case env.updates = <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for subscription")
+	}
+	return env
+}
+
+func (env *linkEnv) send(link string, up ...bool) {
+	for _, u := range up {
+		env.updates <- LinkUpdate{Link: link, Up: u}
+	}
+}
+
+// collect returns the addresses announced within the given time
+func (env *linkEnv) collect(d time.Duration) []string {
+	ret := make([]string, 0)
+	timeout := time.After(d)
+	for {
+		select {
+		case ip := <-env.announced:
+			ret = append(ret, ip.String())
+		case <-timeout:
+			return ret
+		}
+	}
+}
+
+func TestLinkMonitorUp(t *testing.T) {
+	env := newLinkEnv(t, "link-up0")
+	defer close(env.stopCh)
+
+	// updates in the same state and of other links are ignored
+	env.send("link-up0", true, true)
+	env.send("eth9", false, true)
+	assert.Empty(t, env.collect(100*time.Millisecond))
+
+	env.send("link-up0", false, true)
+	assert.Equal(t, []string{"10.0.0.100", "fd00::100", "10.0.0.100", "fd00::100"}, env.collect(200*time.Millisecond))
+	assert.Equal(t, float64(1), linkUps.Get("link-up0"))
+	assert.Equal(t, float64(1), linkAnnouncements.Get("link-up0"))
+	assert.Equal(t, float64(0), linkAnnouncementsSuppressed.Get("link-up0"))
+}
+
+func TestLinkMonitorFlapping(t *testing.T) {
+	env := newLinkEnv(t, "link-flap0")
+	defer close(env.stopCh)
+
+	// down-up-down within the debounce time
+	env.send("link-flap0", false, true, false, true, false)
+	assert.Empty(t, env.collect(150*time.Millisecond))
+	assert.Equal(t, float64(2), linkUps.Get("link-flap0"))
+	assert.Equal(t, float64(2), linkAnnouncementsSuppressed.Get("link-flap0"))
+
+	// a single burst once the link settles
+	env.send("link-flap0", true, false, true)
+	assert.Equal(t, 4, len(env.collect(200*time.Millisecond)))
+	assert.Equal(t, float64(1), linkAnnouncements.Get("link-flap0"))
+	assert.Equal(t, float64(3), linkAnnouncementsSuppressed.Get("link-flap0"))
+}
+
+func TestLinkMonitorShutdown(t *testing.T) {
+	env := newLinkEnv(t, "link-stop0")
+
+	env.send("link-stop0", false, true)
+	close(env.stopCh)
+	select {
+	case err := <-env.done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the monitor to stop")
+	}
+	// the pending announcement is cancelled
+	assert.Empty(t, env.collect(100*time.Millisecond))
+	assert.Equal(t, float64(0), linkAnnouncements.Get("link-stop0"))
+}
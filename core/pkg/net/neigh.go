@@ -0,0 +1,34 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+// FlushNeighbors deletes the neighbor entries of the ip on the link, e.g.
+// the stale entry pointing to the node holding a VIP before
+func FlushNeighbors(link string, ip net.IP) error {
+	out, err := k8sexec.New().Command("ip", "neigh", "flush", "to", ip.String(), "dev", link).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("flush neighbors of %v dev %s error: %v\n%s", ip, link, err, out)
+	}
+	return nil
+}
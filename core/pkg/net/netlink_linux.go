@@ -0,0 +1,202 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	log "github.com/zoumo/logdog"
+)
+
+// multicast groups of netlink route sockets, see rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// requestSeq is the sequence number of the last request
+var requestSeq uint32
+
+// subscription is a netlink route socket bound to multicast groups
+type subscription struct {
+	fd       int
+	recvfrom func(fd int, p []byte, flags int) (int, syscall.Sockaddr, error)
+}
+
+// subscribe opens a netlink route socket and joins the groups
+func subscribe(groups uint32) (*subscription, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// closing the fd does not wake up a blocking recvfrom, so we use a
+	// receive timeout to check the done channel periodically
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	return &subscription{fd: fd, recvfrom: syscall.Recvfrom}, nil
+}
+
+// receive reads messages from the socket and passes them to fn until done
+// is closed, the socket is closed afterwards. overrun is called once the
+// kernel dropped messages because the receive buffer was full, the state
+// the messages describe has to be listed again then. The overruns are
+// only logged if it is nil.
+func (s *subscription) receive(done <-chan struct{}, fn func(syscall.NetlinkMessage), overrun func()) {
+	defer syscall.Close(s.fd)
+
+	buf := make([]byte, syscall.Getpagesize()*4)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		n, _, err := s.recvfrom(s.fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.ENOBUFS {
+				log.Warn("netlink receive buffer overrun, some events are lost")
+				if overrun != nil {
+					overrun()
+				}
+				continue
+			}
+			log.Error("netlink receive error", log.Fields{"err": err})
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			log.Warn("parse netlink message error", log.Fields{"err": err})
+			continue
+		}
+		for _, m := range msgs {
+			fn(m)
+		}
+	}
+}
+
+// request sends the message to the kernel on a new netlink route socket
+// and returns the replies, a request which is not a dump is acknowledged
+func request(typ, flags uint16, data []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	dump := flags&syscall.NLM_F_DUMP == syscall.NLM_F_DUMP
+	if !dump {
+		flags |= syscall.NLM_F_ACK
+	}
+	seq := atomic.AddUint32(&requestSeq, 1)
+	req := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	req = append(req, data...)
+	*(*syscall.NlMsghdr)(unsafe.Pointer(&req[0])) = syscall.NlMsghdr{
+		Len:   uint32(len(req)),
+		Type:  typ,
+		Flags: flags | syscall.NLM_F_REQUEST,
+		Seq:   seq,
+	}
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, os.NewSyscallError("sendto", err)
+	}
+
+	replies := make([]syscall.NetlinkMessage, 0)
+	buf := make([]byte, syscall.Getpagesize()*4)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error")
+				}
+				if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				// the acknowledgement
+				return replies, nil
+			}
+			// the buffer is reused by the next receive
+			m.Data = append([]byte(nil), m.Data...)
+			replies = append(replies, m)
+		}
+	}
+}
+
+// putRtAttr appends the route attribute to b, the value is padded to the
+// alignment of the attributes
+func putRtAttr(b []byte, typ uint16, value []byte) []byte {
+	l := syscall.SizeofRtAttr + len(value)
+	hdr := make([]byte, syscall.SizeofRtAttr)
+	*(*syscall.RtAttr)(unsafe.Pointer(&hdr[0])) = syscall.RtAttr{Len: uint16(l), Type: typ}
+	b = append(b, hdr...)
+	b = append(b, value...)
+	return append(b, make([]byte, rtaAlign(l)-l)...)
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// clen returns the index of the first NULL byte in b or len(b)
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
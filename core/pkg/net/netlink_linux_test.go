@@ -0,0 +1,51 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveOverrun(t *testing.T) {
+	done := make(chan struct{})
+	errs := []error{syscall.EINTR, syscall.ENOBUFS}
+	s := &subscription{fd: -1, recvfrom: func(fd int, p []byte, flags int) (int, syscall.Sockaddr, error) {
+		if len(errs) == 0 {
+			close(done)
+			return 0, nil, syscall.EAGAIN
+		}
+		err := errs[0]
+		errs = errs[1:]
+		return 0, nil, err
+	}}
+
+	overruns := 0
+	s.receive(done, func(syscall.NetlinkMessage) {
+		t.Error("unexpected message")
+	}, func() {
+		overruns++
+	})
+	assert.Equal(t, 1, overruns)
+
+	// the overruns are only logged without the callback
+	done = make(chan struct{})
+	errs = []error{syscall.ENOBUFS}
+	s.receive(done, func(syscall.NetlinkMessage) {}, nil)
+}
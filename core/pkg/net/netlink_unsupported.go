@@ -0,0 +1,54 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import "errors"
+
+var errNetlinkUnsupported = errors.New("netlink is only supported on linux")
+
+// SubscribeAddr is not supported on this platform
+func SubscribeAddr(ch chan<- AddrUpdate, done <-chan struct{}) error {
+	return errNetlinkUnsupported
+}
+
+// SubscribeLink is not supported on this platform
+func SubscribeLink(ch chan<- LinkUpdate, done <-chan struct{}) error {
+	return errNetlinkUnsupported
+}
+
+// NewNetlinkAddrHandle returns an AddrHandle failing every call on this
+// platform
+func NewNetlinkAddrHandle() AddrHandle {
+	return unsupportedAddrHandle{}
+}
+
+type unsupportedAddrHandle struct{}
+
+func (unsupportedAddrHandle) AddrAdd(addr Addr) error {
+	return errNetlinkUnsupported
+}
+
+func (unsupportedAddrHandle) AddrDel(addr Addr) error {
+	return errNetlinkUnsupported
+}
+
+func (unsupportedAddrHandle) AddrList(link string) ([]Addr, error) {
+	return nil, errNetlinkUnsupported
+}
@@ -0,0 +1,288 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Port is a transport port
+type Port struct {
+	// Protocol is tcp or udp
+	Protocol string `json:"protocol"`
+	Port     uint16 `json:"port"`
+}
+
+func (p Port) String() string {
+	return fmt.Sprintf("%s/%d", p.Protocol, p.Port)
+}
+
+// Conflict is a socket of the node which prevents a listener on the port
+type Conflict struct {
+	Port
+	// Address is the local address of the socket, it may be the unspecified
+	// address
+	Address net.IP
+	Inode   uint64
+	// PID, PPID and Process are zero values if the owner is not found
+	PID     int
+	PPID    int
+	Process string
+}
+
+func (c Conflict) String() string {
+	owner := "unknown process"
+	if c.PID != 0 {
+		owner = fmt.Sprintf("%s(pid %d)", c.Process, c.PID)
+	}
+	return fmt.Sprintf("%s is in use on %v by %s", c.Port, c.Address, owner)
+}
+
+const procRoot = "/proc"
+
+// socket states in /proc/net/{tcp,udp}
+const (
+	tcpEstablished = "01"
+	tcpListen      = "0A"
+	udpClose       = "07"
+)
+
+// CheckPortsFree returns the sockets which listen on the ports of the ip or
+// of the unspecified address
+func CheckPortsFree(ip net.IP, ports []Port) ([]Conflict, error) {
+	return checkPortsFree(procRoot, ip, ports)
+}
+
+func checkPortsFree(root string, ip net.IP, ports []Port) ([]Conflict, error) {
+	wanted := make(map[Port]bool, len(ports))
+	for _, p := range ports {
+		wanted[p] = true
+	}
+
+	conflicts := make([]Conflict, 0)
+	for _, file := range []struct {
+		name     string
+		protocol string
+		state    string
+	}{
+		{"tcp", "tcp", tcpListen},
+		{"tcp6", "tcp", tcpListen},
+		{"udp", "udp", udpClose},
+		{"udp6", "udp", udpClose},
+	} {
+		sockets, err := parseProcNet(filepath.Join(root, "net", file.name))
+		if os.IsNotExist(err) {
+			// e.g. ipv6 is disabled
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sockets {
+			port := Port{Protocol: file.protocol, Port: s.port}
+			if s.state != file.state || !wanted[port] {
+				continue
+			}
+			if !s.ip.IsUnspecified() && !s.ip.Equal(ip) {
+				continue
+			}
+			conflicts = append(conflicts, Conflict{Port: port, Address: s.ip, Inode: s.inode})
+		}
+	}
+
+	if len(conflicts) > 0 {
+		findOwners(root, conflicts)
+	}
+	return conflicts, nil
+}
+
+// CountConnections returns the number of the established TCP connections
+// of the process and its children, e.g. of a nginx master and its workers
+func CountConnections(pid int) (int, error) {
+	return countConnections(procRoot, pid)
+}
+
+func countConnections(root string, pid int) (int, error) {
+	pids := []int{pid}
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range dirs {
+		child, err := strconv.Atoi(d.Name())
+		if err != nil || child == pid {
+			continue
+		}
+		if _, ppid := readProcStat(root, child); ppid == pid {
+			pids = append(pids, child)
+		}
+	}
+
+	inodes := make(map[string]bool)
+	for _, p := range pids {
+		fdDir := filepath.Join(root, strconv.Itoa(p), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		for _, fd := range fds {
+			if link, err := os.Readlink(filepath.Join(fdDir, fd.Name())); err == nil {
+				inodes[link] = true
+			}
+		}
+	}
+
+	count := 0
+	for _, name := range []string{"tcp", "tcp6"} {
+		sockets, err := parseProcNet(filepath.Join(root, "net", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		for _, s := range sockets {
+			if s.state == tcpEstablished && inodes[fmt.Sprintf("socket:[%d]", s.inode)] {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+type procSocket struct {
+	ip    net.IP
+	port  uint16
+	state string
+	inode uint64
+}
+
+// parseProcNet parses /proc/net/{tcp,tcp6,udp,udp6}
+func parseProcNet(path string) ([]procSocket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sockets := make([]procSocket, 0)
+	scanner := bufio.NewScanner(f)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		ip, port, err := parseHexAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid inode %q", path, fields[9])
+		}
+		sockets = append(sockets, procSocket{ip: ip, port: port, state: fields[3], inode: inode})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseHexAddr parses an address like 0100007F:0050, the address is made
+// of 32 bits words in host byte order, which is little endian here
+func parseHexAddr(s string) (net.IP, uint16, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", s)
+	}
+	return net.IP(b), uint16(port), nil
+}
+
+// findOwners fills the owner processes of the conflicts by looking for the
+// socket inodes in the fds of all processes, the processes which can not
+// be inspected are skipped
+func findOwners(root string, conflicts []Conflict) {
+	byInode := make(map[string][]int, len(conflicts))
+	for i := range conflicts {
+		link := fmt.Sprintf("socket:[%d]", conflicts[i].Inode)
+		byInode[link] = append(byInode[link], i)
+	}
+
+	pids, err := ioutil.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, p := range pids {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fds, err := ioutil.ReadDir(filepath.Join(root, p.Name(), "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(root, p.Name(), "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			for _, i := range byInode[link] {
+				conflicts[i].PID = pid
+				conflicts[i].Process, conflicts[i].PPID = readProcStat(root, pid)
+			}
+		}
+	}
+}
+
+// readProcStat returns the command name and the parent pid of the process
+func readProcStat(root string, pid int) (string, int) {
+	data, err := ioutil.ReadFile(filepath.Join(root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return "", 0
+	}
+	// e.g. 1234 (nginx: master) S 1 ..., the command may contain spaces
+	stat := string(data)
+	start, end := strings.Index(stat, "("), strings.LastIndex(stat, ")")
+	if start < 0 || end < start {
+		return "", 0
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return stat[start+1 : end], 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return stat[start+1 : end], ppid
+}
@@ -0,0 +1,48 @@
+//go:build integration
+// +build integration
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCheckPortsFreeIntegration binds a real port, run it by
+// `go test -tags integration`
+func TestCheckPortsFreeIntegration(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	port := Port{Protocol: "tcp", Port: uint16(l.Addr().(*net.TCPAddr).Port)}
+	conflicts, err := CheckPortsFree(net.ParseIP("127.0.0.1"), []Port{port})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(conflicts)) {
+		assert.Equal(t, port, conflicts[0].Port)
+		assert.Equal(t, os.Getpid(), conflicts[0].PID)
+	}
+
+	conflicts, err = CheckPortsFree(net.ParseIP("127.0.0.2"), []Port{port})
+	assert.Nil(t, err)
+	assert.Empty(t, conflicts)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPortsFree(t *testing.T) {
+	vip := net.ParseIP("10.0.0.100")
+	conflicts, err := checkPortsFree("testdata/proc", vip, []Port{
+		{"tcp", 80},
+		{"tcp", 443},
+		{"tcp", 8080},
+		{"udp", 53},
+		{"udp", 80},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(conflicts))
+
+	// 0.0.0.0:80
+	assert.Equal(t, Port{"tcp", 80}, conflicts[0].Port)
+	assert.True(t, conflicts[0].Address.IsUnspecified())
+	assert.Equal(t, 1234, conflicts[0].PID)
+	assert.Equal(t, 1, conflicts[0].PPID)
+	assert.Equal(t, "nginx: master", conflicts[0].Process)
+	assert.Equal(t, "tcp/80 is in use on 0.0.0.0 by nginx: master(pid 1234)", conflicts[0].String())
+
+	// 10.0.0.100:443 of an unknown process
+	assert.Equal(t, Port{"tcp", 443}, conflicts[1].Port)
+	assert.True(t, conflicts[1].Address.Equal(vip))
+	assert.Equal(t, 0, conflicts[1].PID)
+
+	// [::]:53
+	assert.Equal(t, Port{"udp", 53}, conflicts[2].Port)
+	assert.Equal(t, uint64(2001), conflicts[2].Inode)
+}
+
+func TestCountConnections(t *testing.T) {
+	// the worker holds two connections and a listener, the client of
+	// another process is not counted
+	count, err := countConnections("testdata/proc", 1234)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = countConnections("testdata/proc", 1300)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	count, err = countConnections("testdata/proc", 4321)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestParseHexAddr(t *testing.T) {
+	ip, port, err := parseHexAddr("0100007F:0050")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", ip.String())
+	assert.Equal(t, uint16(80), port)
+
+	ip, _, err = parseHexAddr("B80D0120000000000000000001000000:0035")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", ip.String())
+
+	_, _, err = parseHexAddr("0100007F")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,394 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	// RouteProtocol tags the routes added by the provider, the routes
+	// without it are never deleted
+	RouteProtocol = 201
+
+	// SourceRulePriorityBase is the first priority of the policy routing
+	// rules added by the provider, the rules out of
+	// [SourceRulePriorityBase, SourceRulePriorityBase+SourceRulePriorityRange)
+	// are never deleted
+	SourceRulePriorityBase = 10000
+	// SourceRulePriorityRange is the number of priorities reserved for the
+	// rules added by the provider
+	SourceRulePriorityRange = 1000
+)
+
+// Rule is a policy routing rule looking up the table for the packets from
+// the source
+type Rule struct {
+	Priority int
+	Src      *net.IPNet
+	Table    int
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%d: from %v lookup %d", r.Priority, r.Src, r.Table)
+}
+
+// Route is a route in a routing table, a nil Dst is the default route
+type Route struct {
+	Dst      *net.IPNet
+	Gw       net.IP
+	Dev      string
+	Table    int
+	Protocol int
+}
+
+func (r Route) String() string {
+	dst := "default"
+	if r.Dst != nil {
+		dst = r.Dst.String()
+	}
+	return fmt.Sprintf("%s via %v dev %s table %d proto %d", dst, r.Gw, r.Dev, r.Table, r.Protocol)
+}
+
+// RouteHandle manipulates policy routing rules and routes
+type RouteHandle interface {
+	// RuleList lists the rules of the family, ipv6 or not
+	RuleList(ipv6 bool) ([]Rule, error)
+	// RuleAdd adds the rule
+	RuleAdd(rule Rule) error
+	// RuleDel deletes the rule, it is a no-op if the rule does not exist
+	RuleDel(rule Rule) error
+	// RouteList lists the routes of the family in the table
+	RouteList(table int, ipv6 bool) ([]Route, error)
+	// RouteReplace adds the route or replaces the route with the same
+	// destination in the table
+	RouteReplace(route Route) error
+	// RouteDel deletes the route, it is a no-op if the route does not exist
+	RouteDel(route Route) error
+}
+
+// NewRouteHandle returns a RouteHandle which drives ip(8)
+func NewRouteHandle() RouteHandle {
+	return &ipRouteHandle{exec: k8sexec.New()}
+}
+
+type ipRouteHandle struct {
+	exec k8sexec.Interface
+}
+
+func familyArgs(ipv6 bool, args ...string) []string {
+	if ipv6 {
+		return append([]string{"-6"}, args...)
+	}
+	return append([]string{"-4"}, args...)
+}
+
+func (h *ipRouteHandle) run(args ...string) ([]byte, error) {
+	out, err := h.exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("ip %s error: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+func (h *ipRouteHandle) RuleList(ipv6 bool) ([]Rule, error) {
+	out, err := h.run(familyArgs(ipv6, "rule", "show")...)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleShow(out)
+}
+
+func (h *ipRouteHandle) RuleAdd(rule Rule) error {
+	_, err := h.run(ruleArgs("add", rule)...)
+	return err
+}
+
+func (h *ipRouteHandle) RuleDel(rule Rule) error {
+	out, err := h.run(ruleArgs("del", rule)...)
+	if err != nil && !strings.Contains(string(out), "No such file or directory") {
+		return err
+	}
+	return nil
+}
+
+func (h *ipRouteHandle) RouteList(table int, ipv6 bool) ([]Route, error) {
+	out, err := h.run(familyArgs(ipv6, "route", "show", "table", strconv.Itoa(table))...)
+	if err != nil {
+		return nil, err
+	}
+	return parseRouteShow(table, out)
+}
+
+func (h *ipRouteHandle) RouteReplace(route Route) error {
+	_, err := h.run(routeArgs("replace", route)...)
+	return err
+}
+
+func (h *ipRouteHandle) RouteDel(route Route) error {
+	out, err := h.run(routeArgs("del", route)...)
+	if err != nil && !strings.Contains(string(out), "No such process") {
+		return err
+	}
+	return nil
+}
+
+func ruleArgs(action string, rule Rule) []string {
+	return familyArgs(rule.Src.IP.To4() == nil, "rule", action,
+		"from", rule.Src.String(),
+		"lookup", strconv.Itoa(rule.Table),
+		"priority", strconv.Itoa(rule.Priority),
+	)
+}
+
+func routeArgs(action string, route Route) []string {
+	dst := "default"
+	ipv6 := route.Gw != nil && route.Gw.To4() == nil
+	if route.Dst != nil {
+		dst = route.Dst.String()
+		ipv6 = route.Dst.IP.To4() == nil
+	}
+	args := []string{"route", action, dst}
+	if route.Gw != nil {
+		args = append(args, "via", route.Gw.String())
+	}
+	if route.Dev != "" {
+		args = append(args, "dev", route.Dev)
+	}
+	args = append(args, "table", strconv.Itoa(route.Table))
+	if route.Protocol != 0 {
+		args = append(args, "proto", strconv.Itoa(route.Protocol))
+	}
+	return familyArgs(ipv6, args...)
+}
+
+var tableNames = map[string]int{
+	"default": 253,
+	"main":    254,
+	"local":   255,
+}
+
+func isReservedTable(table int) bool {
+	for _, t := range tableNames {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTable(s string) (int, error) {
+	if t, ok := tableNames[s]; ok {
+		return t, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// parseRuleShow parses the output of `ip rule show`, e.g.
+//
+//	0:	from all lookup local
+//	10000:	from 10.0.0.100 lookup 100
+//	32766:	from all lookup main
+//
+// the rules without a table, e.g. goto or blackhole, are ignored
+func parseRuleShow(out []byte) ([]Rule, error) {
+	rules := make([]Rule, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		priority, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q", line)
+		}
+		rule := Rule{Priority: priority, Table: -1}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "from":
+				rule.Src = parseIPNet(fields[i+1])
+			case "lookup", "table":
+				if rule.Table, err = parseTable(fields[i+1]); err != nil {
+					rule.Table = -1
+				}
+			}
+		}
+		if rule.Table >= 0 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// parseRouteShow parses the output of `ip route show table <table>`, e.g.
+//
+//	default via 192.168.1.1 dev eth1 proto 201
+//	192.168.1.0/24 dev eth1 scope link
+func parseRouteShow(table int, out []byte) ([]Route, error) {
+	routes := make([]Route, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		route := Route{Table: table}
+		if fields[0] != "default" {
+			route.Dst = parseIPNet(fields[0])
+			if route.Dst == nil {
+				// e.g. unreachable, broadcast
+				continue
+			}
+		}
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				route.Gw = net.ParseIP(fields[i+1])
+			case "dev":
+				route.Dev = fields[i+1]
+			case "proto":
+				route.Protocol, _ = strconv.Atoi(fields[i+1])
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// parseIPNet parses an address or a CIDR, it returns nil for all
+func parseIPNet(s string) *net.IPNet {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil
+		}
+		return NewAddr(ip, "").IPNet
+	}
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: ipnet.Mask}
+}
+
+func ownedRule(rule Rule) bool {
+	return rule.Priority >= SourceRulePriorityBase &&
+		rule.Priority < SourceRulePriorityBase+SourceRulePriorityRange
+}
+
+// EnsureSourceRule makes the packets from the VIP look up the table whose
+// default route goes via the gateway on the device, so the return traffic
+// of the VIP leaves by the uplink the VIP belongs to. The priority of the
+// rule is the first one in the reserved range not used by other rules.
+func EnsureSourceRule(handle RouteHandle, vip net.IP, table int, gw net.IP, dev string) error {
+	ipv6 := vip.To4() == nil
+	if gw == nil || (gw.To4() == nil) != ipv6 {
+		return fmt.Errorf("invalid gateway %v for vip %v", gw, vip)
+	}
+	if table <= 0 || isReservedTable(table) {
+		return fmt.Errorf("invalid routing table %d", table)
+	}
+
+	routes, err := handle.RouteList(table, ipv6)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Protocol != RouteProtocol {
+			return fmt.Errorf("table %d has a default route %v not added by provider", table, r)
+		}
+	}
+	route := Route{Gw: gw, Dev: dev, Table: table, Protocol: RouteProtocol}
+	log.Info("Replacing default route for source rule", log.Fields{"route": route})
+	if err := handle.RouteReplace(route); err != nil {
+		return err
+	}
+
+	rules, err := handle.RuleList(ipv6)
+	if err != nil {
+		return err
+	}
+	src := NewAddr(vip, "").IPNet
+	used := make(map[int]bool, len(rules))
+	for _, r := range rules {
+		if r.Src != nil && r.Src.String() == src.String() && r.Table == table {
+			// already exists
+			return nil
+		}
+		used[r.Priority] = true
+	}
+	for p := SourceRulePriorityBase; p < SourceRulePriorityBase+SourceRulePriorityRange; p++ {
+		if used[p] {
+			continue
+		}
+		rule := Rule{Priority: p, Src: src, Table: table}
+		log.Info("Adding source rule", log.Fields{"rule": rule})
+		return handle.RuleAdd(rule)
+	}
+	return fmt.Errorf("no free priority for the source rule of %v", vip)
+}
+
+// DeleteSourceRule deletes the rules added by EnsureSourceRule for the VIP
+// and the default route of the table if no other rule of the provider
+// looks up the table
+func DeleteSourceRule(handle RouteHandle, vip net.IP, table int) error {
+	ipv6 := vip.To4() == nil
+	rules, err := handle.RuleList(ipv6)
+	if err != nil {
+		return err
+	}
+
+	src := NewAddr(vip, "").IPNet
+	errs := make([]error, 0)
+	inUse := false
+	for _, r := range rules {
+		if !ownedRule(r) || r.Table != table || r.Src == nil {
+			continue
+		}
+		if r.Src.String() != src.String() {
+			inUse = true
+			continue
+		}
+		log.Info("Deleting source rule", log.Fields{"rule": r})
+		if err := handle.RuleDel(r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if inUse || len(errs) > 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+
+	routes, err := handle.RouteList(table, ipv6)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Protocol == RouteProtocol {
+			log.Info("Deleting default route for source rule", log.Fields{"route": r})
+			if err := handle.RouteDel(r); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRuleShow(t *testing.T) {
+	out := []byte(`0:	from all lookup local
+10000:	from 10.0.0.100 lookup 100
+10001:	from 10.0.0.0/24 lookup uplink
+32766:	from all lookup main
+32767:	from all lookup default
+`)
+	rules, err := parseRuleShow(out)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(rules))
+	assert.Equal(t, "10000: from 10.0.0.100/32 lookup 100", rules[1].String())
+	assert.Equal(t, 254, rules[2].Table)
+
+	routes, err := parseRouteShow(100, []byte(`default via 192.168.1.1 dev eth1 proto 201
+192.168.1.0/24 dev eth1 scope link
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "default via 192.168.1.1 dev eth1 table 100 proto 201", routes[0].String())
+}
+
+func TestEnsureSourceRule(t *testing.T) {
+	vip := net.ParseIP("10.0.0.100")
+	gw := net.ParseIP("192.168.1.1")
+
+	// the first priority is used by someone else
+	handle := NewFakeRouteHandle(Rule{Priority: SourceRulePriorityBase, Src: parseIPNet("10.1.0.0/16"), Table: 50})
+
+	assert.Nil(t, EnsureSourceRule(handle, vip, 100, gw, "eth1"))
+	assert.Equal(t, []string{
+		"RouteReplace default via 192.168.1.1 dev eth1 table 100 proto 201",
+		"RuleAdd 10001: from 10.0.0.100/32 lookup 100",
+	}, handle.Calls)
+
+	// already exists
+	handle.ResetCalls()
+	assert.Nil(t, EnsureSourceRule(handle, vip, 100, gw, "eth1"))
+	assert.Equal(t, []string{
+		"RouteReplace default via 192.168.1.1 dev eth1 table 100 proto 201",
+	}, handle.Calls)
+
+	// teardown never touches others' rules
+	handle.ResetCalls()
+	assert.Nil(t, DeleteSourceRule(handle, vip, 100))
+	assert.Equal(t, []string{
+		"RuleDel 10001: from 10.0.0.100/32 lookup 100",
+		"RouteDel default via 192.168.1.1 dev eth1 table 100 proto 201",
+	}, handle.Calls)
+	assert.Equal(t, 1, len(handle.Rules()))
+}
+
+func TestEnsureSourceRuleConflict(t *testing.T) {
+	vip := net.ParseIP("10.0.0.100")
+	gw := net.ParseIP("192.168.1.1")
+
+	handle := NewFakeRouteHandle()
+	handle.routes = []Route{{Gw: net.ParseIP("192.168.2.1"), Dev: "eth2", Table: 100}}
+	assert.NotNil(t, EnsureSourceRule(handle, vip, 100, gw, "eth1"))
+	assert.NotNil(t, EnsureSourceRule(handle, vip, 254, gw, "eth1"))
+	assert.NotNil(t, EnsureSourceRule(handle, vip, 101, net.ParseIP("2001:db8::1"), "eth1"))
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/zoumo/logdog"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+// VLANOwnerAlias is the alias of the VLAN subinterfaces created by the
+// provider, the ones without it are never deleted
+const VLANOwnerAlias = "loadbalancer-provider"
+
+// Link is a network interface
+type Link struct {
+	Name string
+	// Parent is the lower link of a VLAN subinterface
+	Parent string
+	// VLANID is the id of a VLAN subinterface, zero for the other links
+	VLANID int
+	MTU    int
+	// Up is true if the link is administratively up
+	Up    bool
+	Alias string
+}
+
+// VLAN is a VLAN subinterface of its parent link
+type VLAN struct {
+	Name   string
+	Parent string
+	ID     int
+	// MTU is the MTU of the subinterface, the one of the parent if zero
+	MTU int
+}
+
+func (v VLAN) String() string {
+	return fmt.Sprintf("%s link %s id %d mtu %d", v.Name, v.Parent, v.ID, v.MTU)
+}
+
+// ParseVLAN returns the VLAN subinterface of the name in the form of
+// <parent>.<id>, e.g. bond0.120, false if the name is not of the form
+func ParseVLAN(name string) (VLAN, bool) {
+	i := strings.LastIndex(name, ".")
+	if i <= 0 {
+		return VLAN{}, false
+	}
+	id, err := strconv.Atoi(name[i+1:])
+	if err != nil || id < 1 || id > 4094 {
+		return VLAN{}, false
+	}
+	return VLAN{Name: name, Parent: name[:i], ID: id}, true
+}
+
+// VLANConflictError is returned if a link of the name of a VLAN
+// subinterface exists but is configured differently, the link is left
+// alone
+type VLANConflictError struct {
+	VLAN VLAN
+	Link Link
+}
+
+func (e *VLANConflictError) Error() string {
+	return fmt.Sprintf("link %s exists as link %s id %d mtu %d, expected link %s id %d mtu %d",
+		e.Link.Name, e.Link.Parent, e.Link.VLANID, e.Link.MTU, e.VLAN.Parent, e.VLAN.ID, e.VLAN.MTU)
+}
+
+// LinkHandle manipulates the links
+type LinkHandle interface {
+	// LinkGet returns the link, nil if it does not exist
+	LinkGet(name string) (*Link, error)
+	// VLANAdd creates the VLAN subinterface with VLANOwnerAlias
+	VLANAdd(vlan VLAN) error
+	// LinkSetUp brings the link up
+	LinkSetUp(name string) error
+	// LinkSetMTU sets the MTU of the link
+	LinkSetMTU(name string, mtu int) error
+	// LinkDel deletes the link, it is a no-op if the link does not exist
+	LinkDel(name string) error
+}
+
+// EnsureVLAN creates the VLAN subinterface and brings it up if it does
+// not exist, an existing one of the same parent and id is adopted. The MTU
+// of an adopted one is only changed if the provider created it. It returns
+// a VLANConflictError if the existing link is configured differently.
+func EnsureVLAN(h LinkHandle, vlan VLAN) error {
+	link, err := h.LinkGet(vlan.Name)
+	if err != nil {
+		return err
+	}
+	if link == nil {
+		log.Info("Creating vlan subinterface", log.Fields{"vlan": vlan})
+		if err := h.VLANAdd(vlan); err != nil {
+			return err
+		}
+		return h.LinkSetUp(vlan.Name)
+	}
+
+	owned := link.Alias == VLANOwnerAlias
+	if link.Parent != vlan.Parent || link.VLANID != vlan.ID || (vlan.MTU > 0 && link.MTU != vlan.MTU && !owned) {
+		return &VLANConflictError{VLAN: vlan, Link: *link}
+	}
+	if vlan.MTU > 0 && link.MTU != vlan.MTU {
+		log.Info("Changing mtu of vlan subinterface", log.Fields{"vlan": vlan, "mtu": link.MTU})
+		if err := h.LinkSetMTU(vlan.Name, vlan.MTU); err != nil {
+			return err
+		}
+	}
+	if !link.Up {
+		return h.LinkSetUp(vlan.Name)
+	}
+	return nil
+}
+
+// DeleteVLAN deletes the VLAN subinterface if the provider created it,
+// it returns true if it is deleted
+func DeleteVLAN(h LinkHandle, name string) (bool, error) {
+	link, err := h.LinkGet(name)
+	if err != nil || link == nil || link.Alias != VLANOwnerAlias {
+		return false, err
+	}
+	log.Info("Deleting vlan subinterface", log.Fields{"link": name})
+	return true, h.LinkDel(name)
+}
+
+// NewLinkHandle returns a LinkHandle which drives ip(8)
+func NewLinkHandle() LinkHandle {
+	return &ipLinkHandle{exec: k8sexec.New()}
+}
+
+type ipLinkHandle struct {
+	exec k8sexec.Interface
+}
+
+func (h *ipLinkHandle) run(args ...string) ([]byte, error) {
+	out, err := h.exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("ip %s error: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+func (h *ipLinkHandle) LinkGet(name string) (*Link, error) {
+	out, err := h.run("-d", "-o", "link", "show", "dev", name)
+	if err != nil {
+		if strings.Contains(string(out), "does not exist") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseLinkShow(name, out)
+}
+
+func (h *ipLinkHandle) VLANAdd(vlan VLAN) error {
+	args := []string{"link", "add", "link", vlan.Parent, "name", vlan.Name}
+	if vlan.MTU > 0 {
+		args = append(args, "mtu", strconv.Itoa(vlan.MTU))
+	}
+	args = append(args, "type", "vlan", "id", strconv.Itoa(vlan.ID))
+	if _, err := h.run(args...); err != nil {
+		return err
+	}
+	_, err := h.run("link", "set", "dev", vlan.Name, "alias", VLANOwnerAlias)
+	return err
+}
+
+func (h *ipLinkHandle) LinkSetUp(name string) error {
+	_, err := h.run("link", "set", "dev", name, "up")
+	return err
+}
+
+func (h *ipLinkHandle) LinkSetMTU(name string, mtu int) error {
+	_, err := h.run("link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	return err
+}
+
+func (h *ipLinkHandle) LinkDel(name string) error {
+	out, err := h.run("link", "del", "dev", name)
+	if err != nil && !strings.Contains(string(out), "Cannot find device") {
+		return err
+	}
+	return nil
+}
+
+// parseLinkShow parses the output of `ip -d -o link show dev <link>`, e.g.
+//
+//	5: bond0.120@bond0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vlan protocol 802.1Q id 120 <REORDER_HDR> addrgenmode eui64 \    alias loadbalancer-provider
+func parseLinkShow(name string, out []byte) (*Link, error) {
+	line := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	parts := strings.Split(line, "\\")
+	fields := strings.Fields(parts[0])
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid link %s: %q", name, line)
+	}
+
+	link := &Link{Name: name}
+	if i := strings.Index(fields[1], "@"); i >= 0 {
+		link.Parent = strings.TrimSuffix(fields[1][i+1:], ":")
+	}
+	flags := strings.Split(strings.Trim(fields[2], "<>"), ",")
+	for _, f := range flags {
+		if f == "UP" {
+			link.Up = true
+		}
+	}
+	for i := 3; i+1 < len(fields); i++ {
+		if fields[i] == "mtu" {
+			link.MTU, _ = strconv.Atoi(fields[i+1])
+		}
+	}
+	for _, part := range parts[1:] {
+		f := strings.Fields(part)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "vlan":
+			for i := 1; i+1 < len(f); i++ {
+				if f[i] == "id" {
+					link.VLANID, _ = strconv.Atoi(f[i+1])
+				}
+			}
+		case "alias":
+			link.Alias = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part), "alias"))
+		}
+	}
+	return link, nil
+}
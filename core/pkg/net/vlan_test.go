@@ -0,0 +1,98 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVLAN(t *testing.T) {
+	vlan, ok := ParseVLAN("bond0.120")
+	assert.True(t, ok)
+	assert.Equal(t, VLAN{Name: "bond0.120", Parent: "bond0", ID: 120}, vlan)
+	vlan, ok = ParseVLAN("eth0.100.200")
+	assert.True(t, ok)
+	assert.Equal(t, VLAN{Name: "eth0.100.200", Parent: "eth0.100", ID: 200}, vlan)
+
+	for _, name := range []string{"eth0", ".120", "eth0.", "eth0.0", "eth0.4095", "eth0.x"} {
+		_, ok := ParseVLAN(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestParseLinkShow(t *testing.T) {
+	link, err := parseLinkShow("bond0.120", []byte(`5: bond0.120@bond0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 9000 qdisc noqueue state UP mode DEFAULT group default qlen 1000\    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff promiscuity 0 \    vlan protocol 802.1Q id 120 <REORDER_HDR> addrgenmode eui64 numtxqueues 1 \    alias loadbalancer-provider
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, &Link{Name: "bond0.120", Parent: "bond0", VLANID: 120, MTU: 9000, Up: true, Alias: VLANOwnerAlias}, link)
+
+	link, err = parseLinkShow("eth0", []byte(`2: eth0: <BROADCAST,MULTICAST> mtu 1500 qdisc mq state DOWN mode DEFAULT group default qlen 1000\    link/ether 52:54:00:12:34:57 brd ff:ff:ff:ff:ff:ff promiscuity 0 addrgenmode eui64
+`))
+	assert.Nil(t, err)
+	assert.Equal(t, &Link{Name: "eth0", MTU: 1500}, link)
+}
+
+func TestEnsureVLAN(t *testing.T) {
+	vlan := VLAN{Name: "bond0.120", Parent: "bond0", ID: 120, MTU: 9000}
+
+	// created
+	h := NewFakeLinkHandle()
+	assert.Nil(t, EnsureVLAN(h, vlan))
+	assert.Equal(t, []string{"VLANAdd bond0.120 link bond0 id 120 mtu 9000", "LinkSetUp bond0.120"}, h.Calls)
+	h.ResetCalls()
+	assert.Nil(t, EnsureVLAN(h, vlan))
+	assert.Empty(t, h.Calls)
+	// the mtu of the created one follows
+	vlan.MTU = 1400
+	assert.Nil(t, EnsureVLAN(h, vlan))
+	assert.Equal(t, []string{"LinkSetMTU bond0.120 1400"}, h.Calls)
+
+	// adopted, and brought up
+	h = NewFakeLinkHandle(Link{Name: "bond0.120", Parent: "bond0", VLANID: 120, MTU: 1400})
+	assert.Nil(t, EnsureVLAN(h, vlan))
+	assert.Equal(t, []string{"LinkSetUp bond0.120"}, h.Calls)
+	deleted, err := DeleteVLAN(h, "bond0.120")
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+	assert.NotNil(t, h.Link("bond0.120"))
+
+	// configured differently, reported but left alone
+	for _, l := range []Link{
+		{Name: "bond0.120", MTU: 1400, Up: true},
+		{Name: "bond0.120", Parent: "bond1", VLANID: 120, MTU: 1400, Up: true},
+		{Name: "bond0.120", Parent: "bond0", VLANID: 121, MTU: 1400, Up: true},
+		{Name: "bond0.120", Parent: "bond0", VLANID: 120, MTU: 1500, Up: true},
+	} {
+		h = NewFakeLinkHandle(l)
+		err := EnsureVLAN(h, vlan)
+		assert.IsType(t, &VLANConflictError{}, err, "%v", l)
+		assert.Empty(t, h.Calls)
+	}
+
+	// deleted only if created by the provider
+	h = NewFakeLinkHandle()
+	assert.Nil(t, EnsureVLAN(h, vlan))
+	deleted, err = DeleteVLAN(h, "bond0.120")
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.Nil(t, h.Link("bond0.120"))
+	deleted, err = DeleteVLAN(h, "bond0.120")
+	assert.Nil(t, err)
+	assert.False(t, deleted)
+}
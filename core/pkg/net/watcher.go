@@ -0,0 +1,266 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// DefaultMaxRestoresPerMinute is the default flapping limit of AddrWatcher
+	DefaultMaxRestoresPerMinute = 5
+
+	restoreWindow = time.Minute
+)
+
+var (
+	vipRestores = metrics.NewCounterVec(
+		"loadbalancer_provider_vip_restores_total",
+		"Number of managed addresses restored after being removed by others",
+		"address",
+	)
+	vipRestoresSuppressed = metrics.NewCounterVec(
+		"loadbalancer_provider_vip_restores_suppressed_total",
+		"Number of address restores suppressed by the flapping limit",
+		"address",
+	)
+)
+
+func init() {
+	metrics.MustRegister(vipRestores, vipRestoresSuppressed)
+}
+
+// EventFunc receives events which should be recorded on the LoadBalancer,
+// eventtype is one of v1.EventTypeNormal and v1.EventTypeWarning
+type EventFunc func(eventtype, reason, message string)
+
+// AddrWatcher watches the managed addresses and restores them once they
+// are removed by something else, e.g. NetworkManager or a reboot script
+// flushing the addresses of a link.
+//
+// The owner of an address must remove it from the managed set by SetAddrs
+// before deleting it, otherwise the watcher will add it back.
+type AddrWatcher struct {
+	// MaxRestoresPerMinute limits how many times an address is restored
+	// per minute, so that a genuinely conflicting agent does not lead to
+	// a fight loop
+	MaxRestoresPerMinute int
+	// Recorder receives an event for every restore
+	Recorder EventFunc
+
+	handle    AddrHandle
+	subscribe func(chan<- AddrUpdate, <-chan struct{}) error
+	announce  func(link string, ip net.IP) error
+	now       func() time.Time
+
+	mu         sync.Mutex
+	addrs      map[string]Addr
+	restores   map[string][]time.Time
+	suppressed map[string]bool
+}
+
+// NewAddrWatcher returns a new AddrWatcher restoring addresses by handle
+func NewAddrWatcher(handle AddrHandle, recorder EventFunc) *AddrWatcher {
+	return &AddrWatcher{
+		MaxRestoresPerMinute: DefaultMaxRestoresPerMinute,
+		Recorder:             recorder,
+		handle:               handle,
+		subscribe:            SubscribeAddr,
+		announce:             announce,
+		now:                  time.Now,
+		addrs:                make(map[string]Addr),
+		restores:             make(map[string][]time.Time),
+		suppressed:           make(map[string]bool),
+	}
+}
+
+// SetAddrs replaces the managed addresses
+func (w *AddrWatcher) SetAddrs(addrs []Addr) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.addrs = make(map[string]Addr, len(addrs))
+	for _, a := range addrs {
+		w.addrs[a.key()] = a
+	}
+	for k := range w.restores {
+		if _, ok := w.addrs[k]; !ok {
+			delete(w.restores, k)
+			delete(w.suppressed, k)
+		}
+	}
+}
+
+// Run watches address changes until stopCh is closed
+func (w *AddrWatcher) Run(stopCh <-chan struct{}) error {
+	updates := make(chan AddrUpdate, 64)
+	if err := w.subscribe(updates, stopCh); err != nil {
+		return fmt.Errorf("subscribe address updates error: %v", err)
+	}
+
+	log.Info("Address watcher started")
+	for {
+		select {
+		case <-stopCh:
+			log.Info("Address watcher stopped")
+			return nil
+		case u := <-updates:
+			w.process(u)
+		}
+	}
+}
+
+// process restores the removed address if it is managed. The lock is only
+// held to read and update the state, the address is restored and the
+// events are recorded without it, so that a slow netlink call or recorder
+// does not block SetAddrs.
+func (w *AddrWatcher) process(u AddrUpdate) {
+	if u.Resync {
+		w.resync()
+		return
+	}
+	if u.NewAddr {
+		return
+	}
+
+	key := u.key()
+	w.mu.Lock()
+	addr, ok := w.addrs[key]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	allowed := w.allowRestore(key)
+	report := !allowed && !w.suppressed[key]
+	if report {
+		w.suppressed[key] = true
+	}
+	w.mu.Unlock()
+
+	log.Warn("Managed address removed by others", log.Fields{"addr": addr})
+
+	if !allowed {
+		if report {
+			vipRestoresSuppressed.Inc(addr.IP.String())
+			w.record(v1.EventTypeWarning, "VIPRestoreSuppressed",
+				fmt.Sprintf("address %v was removed %d times in %v, stop restoring it", addr, w.MaxRestoresPerMinute, restoreWindow))
+		}
+		return
+	}
+
+	if err := w.handle.AddrAdd(addr); err != nil {
+		log.Error("restore address error", log.Fields{"addr": addr, "err": err})
+		w.record(v1.EventTypeWarning, "VIPRestoreFailed", fmt.Sprintf("failed to restore address %v: %v", addr, err))
+		return
+	}
+
+	w.mu.Lock()
+	_, managed := w.addrs[key]
+	if managed {
+		w.restores[key] = append(w.restores[key], w.now())
+		w.suppressed[key] = false
+	}
+	w.mu.Unlock()
+
+	// the owner released the address while it was restored, it is removed
+	// again instead of leaking
+	if !managed {
+		if err := w.handle.AddrDel(addr); err != nil {
+			log.Error("remove released address error", log.Fields{"addr": addr, "err": err})
+		}
+		return
+	}
+	vipRestores.Inc(addr.IP.String())
+
+	if err := w.announce(addr.Link, addr.IP); err != nil {
+		log.Warn("announce restored address error", log.Fields{"addr": addr, "err": err})
+	}
+
+	log.Info("Managed address restored", log.Fields{"addr": addr})
+	w.record(v1.EventTypeNormal, "VIPRestored", fmt.Sprintf("address %v was removed by others and has been restored", addr))
+}
+
+// resync lists the addresses of the links of the managed addresses after
+// their updates were lost, and processes the missing ones as removed
+func (w *AddrWatcher) resync() {
+	w.mu.Lock()
+	links := make(map[string][]Addr)
+	for _, a := range w.addrs {
+		links[a.Link] = append(links[a.Link], a)
+	}
+	w.mu.Unlock()
+
+	log.Info("Address updates lost, resyncing the managed addresses")
+	for link, addrs := range links {
+		present, err := w.handle.AddrList(link)
+		if err != nil {
+			log.Error("list addresses error", log.Fields{"link": link, "err": err})
+			continue
+		}
+		held := make(map[string]bool, len(present))
+		for _, a := range present {
+			held[a.key()] = true
+		}
+		for _, a := range addrs {
+			if !held[a.key()] {
+				w.process(AddrUpdate{Addr: a})
+			}
+		}
+	}
+}
+
+// allowRestore drops the restores out of the window and reports whether
+// the address can be restored once more
+func (w *AddrWatcher) allowRestore(key string) bool {
+	since := w.now().Add(-restoreWindow)
+	recent := w.restores[key][:0]
+	for _, t := range w.restores[key] {
+		if t.After(since) {
+			recent = append(recent, t)
+		}
+	}
+	w.restores[key] = recent
+	return len(recent) < w.MaxRestoresPerMinute
+}
+
+func (w *AddrWatcher) record(eventtype, reason, message string) {
+	if w.Recorder != nil {
+		w.Recorder(eventtype, reason, message)
+	}
+}
+
+// announce sends a gratuitous ARP for IPv4 addresses and an unsolicited
+// neighbor advertisement for IPv6 addresses on non-loopback links
+func announce(link string, ip net.IP) error {
+	iface, err := net.InterfaceByName(link)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		return nil
+	}
+	return arp.Announce(link, ip)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type event struct {
+	eventtype, reason string
+}
+
+type watcherEnv struct {
+	watcher   *AddrWatcher
+	handle    *FakeAddrHandle
+	updates   chan<- AddrUpdate
+	announced []net.IP
+	events    chan event
+	now       time.Time
+	stopCh    chan struct{}
+}
+
+func newWatcherEnv(t *testing.T, addrs ...Addr) *watcherEnv {
+	env := &watcherEnv{
+		handle: NewFakeAddrHandle(),
+		events: make(chan event, 100),
+		now:    time.Unix(1500000000, 0),
+		stopCh: make(chan struct{}),
+	}
+	env.watcher = NewAddrWatcher(env.handle, func(eventtype, reason, message string) {
+		env.events <- event{eventtype, reason}
+	})
+	env.watcher.MaxRestoresPerMinute = 2
+	env.watcher.now = func() time.Time { return env.now }
+	env.watcher.announce = func(link string, ip net.IP) error {
+		env.announced = append(env.announced, ip)
+		return nil
+	}
+	ready := make(chan chan<- AddrUpdate, 1)
+	env.watcher.subscribe = func(ch chan<- AddrUpdate, done <-chan struct{}) error {
+		ready <- ch
+		return nil
+	}
+	env.watcher.SetAddrs(addrs)
+
+	go env.watcher.Run(env.stopCh)
+	select {
+	case env.updates = <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for subscription")
+	}
+	return env
+}
+
+// remove processes the removal of addr synchronously
+func (env *watcherEnv) remove(addr Addr) {
+	env.watcher.process(AddrUpdate{Addr: addr})
+}
+
+func (env *watcherEnv) nextEvent(t *testing.T) string {
+	select {
+	case e := <-env.events:
+		return e.reason
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return ""
+}
+
+func TestAddrWatcherRestore(t *testing.T) {
+	vip := NewAddr(net.ParseIP("10.0.0.100"), "eth0")
+	env := newWatcherEnv(t, vip)
+	defer close(env.stopCh)
+
+	before := vipRestores.Get("10.0.0.100")
+
+	// additions and unmanaged addresses are ignored
+	env.updates <- AddrUpdate{Addr: vip, NewAddr: true}
+	env.updates <- AddrUpdate{Addr: NewAddr(net.ParseIP("10.0.0.101"), "eth0")}
+	env.updates <- AddrUpdate{Addr: NewAddr(net.ParseIP("10.0.0.100"), "eth1")}
+
+	env.updates <- AddrUpdate{Addr: vip}
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+	assert.Equal(t, 1, len(env.handle.AddedAddrs()))
+	assert.Equal(t, vip.String(), env.handle.AddedAddrs()[0].String())
+	assert.Equal(t, []net.IP{vip.IP}, env.announced)
+	assert.Equal(t, before+1, vipRestores.Get("10.0.0.100"))
+}
+
+func TestAddrWatcherFlapLimit(t *testing.T) {
+	vip := NewAddr(net.ParseIP("10.0.0.200"), "eth0")
+	env := newWatcherEnv(t, vip)
+	defer close(env.stopCh)
+
+	env.remove(vip)
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+	env.remove(vip)
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+
+	// the third removal in a minute is not restored, and only reported once
+	env.remove(vip)
+	assert.Equal(t, "VIPRestoreSuppressed", env.nextEvent(t))
+	env.remove(vip)
+	env.remove(vip)
+	assert.Equal(t, 2, len(env.handle.AddedAddrs()))
+
+	// restores are allowed again once the window has passed
+	env.now = env.now.Add(restoreWindow + time.Second)
+	env.remove(vip)
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+	assert.Equal(t, 3, len(env.handle.AddedAddrs()))
+	assert.Equal(t, 0, len(env.events))
+}
+
+func TestAddrWatcherSetAddrs(t *testing.T) {
+	vip := NewAddr(net.ParseIP("10.0.0.100"), "lo")
+	env := newWatcherEnv(t, vip)
+	defer close(env.stopCh)
+
+	// the owner releases the address before deleting it
+	env.watcher.SetAddrs(nil)
+	env.remove(vip)
+
+	vip2 := NewAddr(net.ParseIP("10.0.0.101"), "lo")
+	env.watcher.SetAddrs([]Addr{vip2})
+	env.remove(vip2)
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+	assert.Equal(t, 1, len(env.handle.AddedAddrs()))
+	assert.Equal(t, vip2.String(), env.handle.AddedAddrs()[0].String())
+}
+
+func TestAddrWatcherResync(t *testing.T) {
+	held := NewAddr(net.ParseIP("10.0.0.100"), "eth0")
+	lost := NewAddr(net.ParseIP("10.0.0.101"), "eth0")
+	env := newWatcherEnv(t, held, lost)
+	defer close(env.stopCh)
+	env.handle.AddrAdd(held)
+
+	// the removal of lost was dropped by an overrun, the resync lists the
+	// addresses and restores it
+	env.updates <- AddrUpdate{Resync: true}
+	assert.Equal(t, "VIPRestored", env.nextEvent(t))
+	added := env.handle.AddedAddrs()
+	if assert.Equal(t, 2, len(added)) {
+		assert.Equal(t, lost.String(), added[1].String())
+	}
+	assert.Equal(t, []net.IP{lost.IP}, env.announced)
+}
+
+func TestAddrWatcherRecorderUnlocked(t *testing.T) {
+	vip := NewAddr(net.ParseIP("10.0.0.100"), "lo")
+	env := newWatcherEnv(t, vip)
+	defer close(env.stopCh)
+
+	// the recorder may call back into the watcher, it is not called with
+	// the lock held
+	done := make(chan struct{})
+	env.watcher.Recorder = func(eventtype, reason, message string) {
+		env.watcher.SetAddrs([]Addr{vip})
+		close(done)
+	}
+	go env.remove(vip)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("recorder blocked by the lock of the watcher")
+	}
+}
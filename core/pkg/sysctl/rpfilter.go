@@ -0,0 +1,105 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysctl
+
+import (
+	"fmt"
+	"strconv"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// RPFilterOff disables the reverse path filtering
+	RPFilterOff = 0
+	// RPFilterStrict drops the packets which would not be routed back
+	// through the incoming interface
+	RPFilterStrict = 1
+	// RPFilterLoose drops the packets whose source is not reachable through
+	// any interface
+	RPFilterLoose = 2
+
+	rpFilter = "rp_filter"
+)
+
+// EnsureLooseRPFilter sets the reverse path filtering of the interfaces
+// whose effective mode is strict to loose, so the asymmetric traffic of
+// the VIPs, e.g. with policy routing, is not dropped. The effective mode is
+// the max of the values of "all" and the interface, so only the interfaces
+// are changed. The original values are put back by Restore.
+func (m *Manager) EnsureLooseRPFilter(ifaces []string) error {
+	values := make(map[string]string)
+	for _, iface := range ifaces {
+		all, cur, err := m.readRPFilter(iface)
+		if err != nil {
+			return err
+		}
+		if effectiveRPFilter(all, cur) == RPFilterStrict {
+			values[InterfaceKey("ipv4", iface, rpFilter)] = strconv.Itoa(RPFilterLoose)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return m.Apply(values)
+}
+
+// CheckRPFilter returns an error naming the interfaces whose effective
+// reverse path filtering is strict, e.g. reset by others after
+// EnsureLooseRPFilter
+func (m *Manager) CheckRPFilter(ifaces []string) error {
+	errs := make([]error, 0)
+	for _, iface := range ifaces {
+		all, cur, err := m.readRPFilter(iface)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if effectiveRPFilter(all, cur) == RPFilterStrict {
+			errs = append(errs, fmt.Errorf("rp_filter of %s is strict (all=%d, %s=%d), the asymmetric traffic of the vips is dropped", iface, all, iface, cur))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// readRPFilter returns the rp_filter of "all" and the interface
+func (m *Manager) readRPFilter(iface string) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make([]int, 0, 2)
+	for _, name := range []string{"all", iface} {
+		key := InterfaceKey("ipv4", name, rpFilter)
+		s, err := m.read(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid sysctl %s: %q", key, s)
+		}
+		values = append(values, v)
+	}
+	return values[0], values[1], nil
+}
+
+func effectiveRPFilter(all, iface int) int {
+	if all > iface {
+		return all
+	}
+	return iface
+}
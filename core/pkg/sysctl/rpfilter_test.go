@@ -0,0 +1,74 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureLooseRPFilter(t *testing.T) {
+	root := newFakeRoot(t, map[string]string{
+		"net.ipv4.conf.all.rp_filter":  "1",
+		"net.ipv4.conf.eth0.rp_filter": "0",
+		"net.ipv4.conf.eth1.rp_filter": "2",
+		"net.ipv4.conf.eth2.rp_filter": "1",
+	})
+	defer os.RemoveAll(root)
+
+	m := NewManager(root)
+	ifaces := []string{"eth0", "eth1"}
+	assert.NotNil(t, m.CheckRPFilter(ifaces))
+
+	assert.Nil(t, m.EnsureLooseRPFilter(ifaces))
+	assert.Nil(t, m.CheckRPFilter(ifaces))
+	// strict by "all"
+	assert.Equal(t, "2", read(t, root, "net.ipv4.conf.eth0.rp_filter"))
+	// already loose
+	assert.Equal(t, "2\n", read(t, root, "net.ipv4.conf.eth1.rp_filter"))
+	// the interfaces not used and "all" are untouched
+	assert.Equal(t, "1\n", read(t, root, "net.ipv4.conf.eth2.rp_filter"))
+	assert.Equal(t, "1\n", read(t, root, "net.ipv4.conf.all.rp_filter"))
+
+	// drift
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "net/ipv4/conf/eth0/rp_filter"), []byte("1\n"), 0644))
+	assert.NotNil(t, m.CheckRPFilter(ifaces))
+	assert.Nil(t, m.EnsureLooseRPFilter(ifaces))
+	assert.Nil(t, m.CheckRPFilter(ifaces))
+
+	// the original value is restored
+	assert.Nil(t, m.Restore())
+	assert.Equal(t, "0", read(t, root, "net.ipv4.conf.eth0.rp_filter"))
+}
+
+func TestEnsureLooseRPFilterOff(t *testing.T) {
+	root := newFakeRoot(t, map[string]string{
+		"net.ipv4.conf.all.rp_filter":  "0",
+		"net.ipv4.conf.eth0.rp_filter": "0",
+	})
+	defer os.RemoveAll(root)
+
+	m := NewManager(root)
+	assert.Nil(t, m.EnsureLooseRPFilter([]string{"eth0"}))
+	// no filtering is left as it is
+	assert.Equal(t, "0\n", read(t, root, "net.ipv4.conf.eth0.rp_filter"))
+	assert.NotNil(t, m.EnsureLooseRPFilter([]string{"eth9"}))
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sysctl applies kernel parameters and puts them back when the
+// provider is uninstalled, so the nodes are left as they were found.
+package sysctl
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// DefaultRoot is the root of the kernel parameters
+const DefaultRoot = "/proc/sys"
+
+// knownKeys are the parameters the providers are expected to change, the
+// interface part of a per-interface parameter is a wildcard
+var knownKeys = []string{
+	"net/ipv4/ip_forward",
+	"net/ipv4/ip_nonlocal_bind",
+	"net/ipv4/vs/conntrack",
+	"net/ipv4/vs/expire_nodest_conn",
+	"net/ipv4/vs/expire_quiescent_template",
+	"net/ipv4/conf/*/rp_filter",
+	"net/ipv4/conf/*/arp_ignore",
+	"net/ipv4/conf/*/arp_announce",
+	"net/ipv4/conf/*/accept_local",
+	"net/ipv4/conf/*/send_redirects",
+	"net/ipv6/ip_nonlocal_bind",
+	"net/ipv6/conf/*/forwarding",
+}
+
+// Key converts a key in the format of sysctl(8), e.g. net.ipv4.ip_forward,
+// to the path relative to the root. A key containing a slash is already a
+// path and returned as is.
+func Key(key string) string {
+	if strings.Contains(key, "/") {
+		return key
+	}
+	return strings.Replace(key, ".", "/", -1)
+}
+
+// InterfaceKey returns the key of a per-interface parameter, e.g.
+// InterfaceKey("ipv4", "eth0.100", "rp_filter"). The key is a path since the
+// interface name may contain dots.
+func InterfaceKey(family, iface, name string) string {
+	return path.Join("net", family, "conf", iface, name)
+}
+
+func isKnown(key string) bool {
+	for _, pattern := range knownKeys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type applied struct {
+	key      string
+	previous string
+	value    string
+}
+
+// Manager applies kernel parameters and remembers the values they had
+// before, so they can be restored
+type Manager struct {
+	fs   FSWriter
+	root string
+	// Force allows setting parameters which are not known to the providers
+	Force bool
+
+	mu      sync.Mutex
+	applied []*applied
+}
+
+// NewManager returns a Manager working on the parameters under the root,
+// it is DefaultRoot except in tests
+func NewManager(root string) *Manager {
+	return NewFSManager(osFS{}, root)
+}
+
+// NewFSManager returns a Manager working on the parameters under the root
+// through the FSWriter, e.g. a mock in tests
+func NewFSManager(fs FSWriter, root string) *Manager {
+	return &Manager{fs: fs, root: root}
+}
+
+// Apply sets the parameters and records the previous values of the
+// parameters which are applied for the first time. Nothing is changed if
+// any key is unknown.
+func (m *Manager) Apply(values map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		key := Key(k)
+		if !m.Force && !isKnown(key) {
+			return fmt.Errorf("refuse to set unknown sysctl %s", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		key, value := Key(k), values[k]
+		cur, err := m.read(key)
+		if err != nil {
+			return err
+		}
+
+		a := m.find(key)
+		if a == nil {
+			a = &applied{key: key, previous: cur}
+			m.applied = append(m.applied, a)
+		}
+		a.value = value
+
+		if normalize(cur) == normalize(value) {
+			continue
+		}
+		log.Info("Setting sysctl", log.Fields{"key": key, "old": cur, "new": value})
+		if err := m.write(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify returns an error if any applied parameter has been changed by
+// others
+func (m *Manager) Verify() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make([]error, 0)
+	for _, a := range m.applied {
+		cur, err := m.read(a.key)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if normalize(cur) != normalize(a.value) {
+			errs = append(errs, fmt.Errorf("sysctl %s drifted to %s, expected %s", a.key, cur, a.value))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Restore sets the applied parameters back to their previous values in
+// the reverse order of applying
+func (m *Manager) Restore() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make([]error, 0)
+	for i := len(m.applied) - 1; i >= 0; i-- {
+		a := m.applied[i]
+		log.Info("Restoring sysctl", log.Fields{"key": a.key, "value": a.previous})
+		if err := m.write(a.key, a.previous); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	m.applied = nil
+	return utilerrors.NewAggregate(errs)
+}
+
+func (m *Manager) find(key string) *applied {
+	for _, a := range m.applied {
+		if a.key == key {
+			return a
+		}
+	}
+	return nil
+}
+
+func (m *Manager) read(key string) (string, error) {
+	data, err := m.fs.ReadFile(filepath.Join(m.root, key))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (m *Manager) write(key, value string) error {
+	return m.fs.WriteFile(filepath.Join(m.root, key), []byte(value), 0640)
+}
+
+// normalize folds the whitespaces of values with multiple fields, e.g.
+// "32768	60999"
+func normalize(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysctl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeRoot creates a fake /proc/sys tree holding the values
+func newFakeRoot(t *testing.T, values map[string]string) string {
+	root, err := ioutil.TempDir("", "sysctl")
+	assert.Nil(t, err)
+	for k, v := range values {
+		p := filepath.Join(root, Key(k))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.Nil(t, ioutil.WriteFile(p, []byte(v+"\n"), 0644))
+	}
+	return root
+}
+
+func read(t *testing.T, root, key string) string {
+	data, err := ioutil.ReadFile(filepath.Join(root, Key(key)))
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestApplyVerifyRestore(t *testing.T) {
+	root := newFakeRoot(t, map[string]string{
+		"net.ipv4.ip_forward":              "0",
+		"net/ipv4/conf/eth0.100/rp_filter": "1",
+		"net.ipv4.conf.all.arp_ignore":     "0",
+	})
+	defer os.RemoveAll(root)
+
+	m := NewManager(root)
+	assert.Nil(t, m.Apply(map[string]string{
+		"net.ipv4.ip_forward":                         "1",
+		InterfaceKey("ipv4", "eth0.100", "rp_filter"): "2",
+	}))
+	assert.Equal(t, "1", read(t, root, "net.ipv4.ip_forward"))
+	assert.Equal(t, "2", read(t, root, "net/ipv4/conf/eth0.100/rp_filter"))
+	assert.Nil(t, m.Verify())
+
+	// the second apply of a key keeps the original value for restoring
+	assert.Nil(t, m.Apply(map[string]string{"net.ipv4.ip_forward": "1", "net.ipv4.conf.all.arp_ignore": "1"}))
+
+	// drift
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(root, "net/ipv4/ip_forward"), []byte("0\n"), 0644))
+	assert.NotNil(t, m.Verify())
+
+	assert.Nil(t, m.Restore())
+	assert.Equal(t, "0", read(t, root, "net.ipv4.ip_forward"))
+	assert.Equal(t, "1", read(t, root, "net/ipv4/conf/eth0.100/rp_filter"))
+	assert.Equal(t, "0", read(t, root, "net.ipv4.conf.all.arp_ignore"))
+
+	// nothing to verify after restoring
+	assert.Nil(t, m.Verify())
+}
+
+func TestRestoreOrder(t *testing.T) {
+	root := newFakeRoot(t, map[string]string{
+		"net.ipv4.conf.all.rp_filter": "1",
+		"net.ipv4.conf.lo.rp_filter":  "1",
+	})
+	defer os.RemoveAll(root)
+
+	m := NewManager(root)
+	assert.Nil(t, m.Apply(map[string]string{"net.ipv4.conf.all.rp_filter": "0"}))
+	assert.Nil(t, m.Apply(map[string]string{"net.ipv4.conf.lo.rp_filter": "0"}))
+
+	order := make([]string, 0)
+	for i := len(m.applied) - 1; i >= 0; i-- {
+		order = append(order, m.applied[i].key)
+	}
+	assert.Equal(t, []string{"net/ipv4/conf/lo/rp_filter", "net/ipv4/conf/all/rp_filter"}, order)
+
+	assert.Nil(t, m.Restore())
+	assert.Equal(t, "1", read(t, root, "net.ipv4.conf.all.rp_filter"))
+	assert.Equal(t, "1", read(t, root, "net.ipv4.conf.lo.rp_filter"))
+}
+
+func TestApplyUnknown(t *testing.T) {
+	root := newFakeRoot(t, map[string]string{
+		"net.ipv4.ip_forward": "0",
+		"net.core.somaxconn":  "128",
+	})
+	defer os.RemoveAll(root)
+
+	m := NewManager(root)
+	assert.NotNil(t, m.Apply(map[string]string{"net.ipv4.ip_forward": "1", "net.core.somaxconn": "1024"}))
+	// nothing is changed
+	assert.Equal(t, "0\n", read(t, root, "net.ipv4.ip_forward"))
+
+	m.Force = true
+	assert.Nil(t, m.Apply(map[string]string{"net.core.somaxconn": "1024"}))
+	assert.Equal(t, "1024", read(t, root, "net.core.somaxconn"))
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rateUnits are the units of tc(8) in bits per second, bps is bytes per
+// second as tc does
+var rateUnits = map[string]float64{
+	"bit":   1,
+	"kbit":  1e3,
+	"mbit":  1e6,
+	"gbit":  1e9,
+	"tbit":  1e12,
+	"kibit": 1 << 10,
+	"mibit": 1 << 20,
+	"gibit": 1 << 30,
+	"tibit": 1 << 40,
+	"bps":   8,
+	"kbps":  8e3,
+	"mbps":  8e6,
+	"gbps":  8e9,
+	"tbps":  8e12,
+}
+
+var rateRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([a-zA-Z]+)$`)
+
+// ParseRate parses a rate in the format of tc(8), e.g. 100Mbit, to bits
+// per second. The unit is required and the rate must be positive.
+func ParseRate(s string) (uint64, error) {
+	m := rateRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid rate %q, must be a number followed by a unit, e.g. 100Mbit", s)
+	}
+	unit, ok := rateUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q, unknown unit %q", s, m[2])
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %v", s, err)
+	}
+	bits := uint64(v * unit)
+	if bits == 0 {
+		return 0, fmt.Errorf("invalid rate %q, must be at least 1bit", s)
+	}
+	return bits, nil
+}
+
+// FormatRate formats bits per second for tc(8)
+func FormatRate(bits uint64) string {
+	return strconv.FormatUint(bits, 10) + "bit"
+}
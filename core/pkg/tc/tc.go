@@ -0,0 +1,443 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tc limits the bandwidth of VIPs by tc(8). The egress traffic
+// from a VIP is shaped by a htb class under a root qdisc created by the
+// provider, and the ingress traffic to a VIP is policed by a filter of
+// the ingress qdisc. The qdiscs and filters of others are never touched.
+package tc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	// rootHandle is the handle of the htb root qdisc created by the provider
+	rootHandle = "1ff:"
+	// ingressHandle is the fixed handle of the ingress qdisc
+	ingressHandle = "ffff:"
+
+	minID = 0x10
+	maxID = 0xffff
+)
+
+// defaultQdiscs are the root qdiscs set by the kernel, they can be replaced
+var defaultQdiscs = map[string]bool{
+	"pfifo_fast": true,
+	"mq":         true,
+	"fq_codel":   true,
+	"noqueue":    true,
+}
+
+// Limit is the bandwidth limit of a VIP in bits per second, zero means
+// unlimited
+type Limit struct {
+	VIP     net.IP
+	Ingress uint64
+	Egress  uint64
+}
+
+// Runner runs tc(8)
+type Runner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+type execRunner struct {
+	exec k8sexec.Interface
+}
+
+// NewRunner returns a Runner executing tc(8)
+func NewRunner() Runner {
+	return &execRunner{exec: k8sexec.New()}
+}
+
+func (r *execRunner) Run(args ...string) ([]byte, error) {
+	out, err := r.exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("tc %s error: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+// Manager reconciles the bandwidth limits of the VIPs on a device
+type Manager struct {
+	dev    string
+	runner Runner
+	mu     sync.Mutex
+}
+
+// NewManager returns a Manager of the device
+func NewManager(dev string, runner Runner) *Manager {
+	return &Manager{dev: dev, runner: runner}
+}
+
+// idFor returns the class minor id and the filter priority of the VIP
+func idFor(vip net.IP) int {
+	h := fnv.New32a()
+	h.Write(vip.To4())
+	return int(h.Sum32()%(maxID-minID)) + minID
+}
+
+// Ensure makes the limits on the device match the desired ones, the limits
+// of the VIPs which are not desired any more are removed
+func (m *Manager) Ensure(limits []Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	egress := make(map[int]Limit)
+	ingress := make(map[int]Limit)
+	for _, l := range limits {
+		if l.VIP.To4() == nil {
+			return fmt.Errorf("invalid IPv4 VIP %v", l.VIP)
+		}
+		id := idFor(l.VIP)
+		if l.Egress > 0 {
+			if other, ok := egress[id]; ok && !other.VIP.Equal(l.VIP) {
+				return fmt.Errorf("VIP %v and %v are hashed to the same class", other.VIP, l.VIP)
+			}
+			egress[id] = l
+		}
+		if l.Ingress > 0 {
+			if other, ok := ingress[id]; ok && !other.VIP.Equal(l.VIP) {
+				return fmt.Errorf("VIP %v and %v are hashed to the same filter", other.VIP, l.VIP)
+			}
+			ingress[id] = l
+		}
+	}
+
+	qdiscs, err := m.qdiscs()
+	if err != nil {
+		return err
+	}
+	return utilerrors.NewAggregate([]error{
+		m.ensureEgress(qdiscs, egress),
+		m.ensureIngress(qdiscs, ingress),
+	})
+}
+
+// Cleanup removes all limits created by the Manager
+func (m *Manager) Cleanup() error {
+	return m.Ensure(nil)
+}
+
+func (m *Manager) ensureEgress(qdiscs []qdisc, desired map[int]Limit) error {
+	var root *qdisc
+	for i := range qdiscs {
+		if qdiscs[i].root {
+			root = &qdiscs[i]
+		}
+	}
+	owned := root != nil && root.kind == "htb" && root.handle == rootHandle
+
+	if len(desired) == 0 {
+		if owned {
+			log.Info("Deleting tc root qdisc", log.Fields{"dev": m.dev})
+			return m.run("qdisc", "del", "dev", m.dev, "root")
+		}
+		return nil
+	}
+
+	if !owned {
+		if root != nil && !defaultQdiscs[root.kind] {
+			return fmt.Errorf("root qdisc %s %s of %s is not created by provider", root.kind, root.handle, m.dev)
+		}
+		log.Info("Replacing tc root qdisc", log.Fields{"dev": m.dev})
+		// the unclassified traffic is not shaped
+		if err := m.run("qdisc", "replace", "dev", m.dev, "root", "handle", rootHandle, "htb", "default", "0"); err != nil {
+			return err
+		}
+	}
+
+	classes := make(map[int]uint64)
+	if owned {
+		var err error
+		if classes, err = m.classes(); err != nil {
+			return err
+		}
+	}
+
+	errs := make([]error, 0)
+	for _, id := range sortedIDs(desired) {
+		l := desired[id]
+		classid := fmt.Sprintf("%s%x", rootHandle, id)
+		rate, ok := classes[id]
+		switch {
+		case !ok:
+			log.Info("Adding tc egress class", log.Fields{"dev": m.dev, "vip": l.VIP, "rate": l.Egress})
+			if err := m.run(classArgs("add", m.dev, classid, l.Egress)...); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := m.run("filter", "add", "dev", m.dev, "parent", rootHandle, "protocol", "ip", "prio", strconv.Itoa(id),
+				"u32", "match", "ip", "src", l.VIP.String()+"/32", "flowid", classid); err != nil {
+				errs = append(errs, err)
+			}
+		case rate != l.Egress:
+			log.Info("Changing tc egress class", log.Fields{"dev": m.dev, "vip": l.VIP, "rate": l.Egress})
+			if err := m.run(classArgs("change", m.dev, classid, l.Egress)...); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for id := range classes {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		classid := fmt.Sprintf("%s%x", rootHandle, id)
+		log.Info("Deleting tc egress class", log.Fields{"dev": m.dev, "classid": classid})
+		if err := m.run("filter", "del", "dev", m.dev, "parent", rootHandle, "protocol", "ip", "prio", strconv.Itoa(id)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := m.run("class", "del", "dev", m.dev, "classid", classid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (m *Manager) ensureIngress(qdiscs []qdisc, desired map[int]Limit) error {
+	hasIngress := false
+	for _, q := range qdiscs {
+		if q.kind == "ingress" {
+			hasIngress = true
+		}
+	}
+
+	if !hasIngress {
+		if len(desired) == 0 {
+			return nil
+		}
+		log.Info("Adding tc ingress qdisc", log.Fields{"dev": m.dev})
+		if err := m.run("qdisc", "add", "dev", m.dev, "handle", ingressHandle, "ingress"); err != nil {
+			return err
+		}
+	}
+
+	current := make(map[int]*policeFilter)
+	if hasIngress {
+		out, err := m.runOutput("filter", "show", "dev", m.dev, "parent", ingressHandle)
+		if err != nil {
+			return err
+		}
+		for _, f := range parsePoliceFilters(out) {
+			// only the filters whose priority is derived from the VIP are ours
+			if f.dst != nil && idFor(f.dst) == f.pref {
+				current[f.pref] = f
+			}
+		}
+	}
+
+	errs := make([]error, 0)
+	for _, id := range sortedIDs(desired) {
+		l := desired[id]
+		cur, ok := current[id]
+		if ok && cur.rate == l.Ingress {
+			continue
+		}
+		if ok {
+			// a police filter can not be changed in place
+			if err := m.run(ingressDelArgs(m.dev, id)...); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		log.Info("Adding tc ingress filter", log.Fields{"dev": m.dev, "vip": l.VIP, "rate": l.Ingress})
+		if err := m.run(ingressAddArgs(m.dev, id, l)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for id := range current {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		log.Info("Deleting tc ingress filter", log.Fields{"dev": m.dev, "vip": current[id].dst})
+		if err := m.run(ingressDelArgs(m.dev, id)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func classArgs(action, dev, classid string, rate uint64) []string {
+	return []string{"class", action, "dev", dev, "parent", rootHandle, "classid", classid,
+		"htb", "rate", FormatRate(rate), "ceil", FormatRate(rate)}
+}
+
+func ingressAddArgs(dev string, id int, l Limit) []string {
+	return []string{"filter", "add", "dev", dev, "parent", ingressHandle, "protocol", "ip", "prio", strconv.Itoa(id),
+		"u32", "match", "ip", "dst", l.VIP.String() + "/32",
+		"police", "rate", FormatRate(l.Ingress), "burst", strconv.FormatUint(burst(l.Ingress), 10), "drop", "flowid", ":1"}
+}
+
+func ingressDelArgs(dev string, id int) []string {
+	return []string{"filter", "del", "dev", dev, "parent", ingressHandle, "protocol", "ip", "prio", strconv.Itoa(id)}
+}
+
+// burst returns the bytes sent in 10ms at the rate, at least 10 full
+// sized frames
+func burst(rate uint64) uint64 {
+	b := rate / 8 / 100
+	if b < 15140 {
+		b = 15140
+	}
+	return b
+}
+
+func (m *Manager) run(args ...string) error {
+	_, err := m.runner.Run(args...)
+	return err
+}
+
+func (m *Manager) runOutput(args ...string) ([]byte, error) {
+	return m.runner.Run(args...)
+}
+
+type qdisc struct {
+	kind   string
+	handle string
+	root   bool
+}
+
+func (m *Manager) qdiscs() ([]qdisc, error) {
+	out, err := m.runOutput("qdisc", "show", "dev", m.dev)
+	if err != nil {
+		return nil, err
+	}
+	return parseQdiscs(out), nil
+}
+
+// parseQdiscs parses the output of `tc qdisc show dev <dev>`, e.g.
+//
+//	qdisc htb 1ff: root refcnt 2 r2q 10 default 0 direct_packets_stat 0
+//	qdisc ingress ffff: parent ffff:fff1 ----------------
+func parseQdiscs(out []byte) []qdisc {
+	ret := make([]qdisc, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "qdisc" {
+			continue
+		}
+		ret = append(ret, qdisc{kind: fields[1], handle: fields[2], root: fields[3] == "root"})
+	}
+	return ret
+}
+
+func (m *Manager) classes() (map[int]uint64, error) {
+	out, err := m.runOutput("class", "show", "dev", m.dev)
+	if err != nil {
+		return nil, err
+	}
+	return parseClasses(out)
+}
+
+// parseClasses parses the output of `tc class show dev <dev>` and returns
+// the rates of the classes under the root qdisc of the provider, e.g.
+//
+//	class htb 1ff:a2 root prio 0 rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b
+func parseClasses(out []byte) (map[int]uint64, error) {
+	ret := make(map[int]uint64)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "class" || !strings.HasPrefix(fields[2], rootHandle) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(fields[2], rootHandle), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid classid %q", fields[2])
+		}
+		for i := 3; i+1 < len(fields); i++ {
+			if fields[i] == "rate" {
+				rate, err := ParseRate(fields[i+1])
+				if err != nil {
+					return nil, err
+				}
+				ret[int(id)] = rate
+			}
+		}
+	}
+	return ret, nil
+}
+
+type policeFilter struct {
+	pref int
+	dst  net.IP
+	rate uint64
+}
+
+// parsePoliceFilters parses the output of
+// `tc filter show dev <dev> parent ffff:`, e.g.
+//
+//	filter protocol ip pref 162 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid :1
+//	  match 0a000064/ffffffff at 16
+//	 police 0x1 rate 100Mbit burst 125000b mtu 2Kb action drop overhead 0b
+func parsePoliceFilters(out []byte) []*policeFilter {
+	ret := make([]*policeFilter, 0)
+	var cur *policeFilter
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "filter":
+			cur = nil
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "pref" {
+					if pref, err := strconv.Atoi(fields[i+1]); err == nil {
+						cur = &policeFilter{pref: pref}
+						ret = append(ret, cur)
+					}
+				}
+			}
+		case cur == nil:
+		case fields[0] == "match" && len(fields) >= 4 && fields[3] == "16":
+			// the destination address of an ipv4 header
+			parts := strings.Split(fields[1], "/")
+			if len(parts) == 2 && parts[1] == "ffffffff" {
+				if v, err := strconv.ParseUint(parts[0], 16, 32); err == nil {
+					cur.dst = net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+				}
+			}
+		case fields[0] == "police":
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "rate" {
+					cur.rate, _ = ParseRate(fields[i+1])
+				}
+			}
+		}
+	}
+	return ret
+}
+
+func sortedIDs(m map[int]Limit) []int {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRunner returns the outputs of the show commands and records the
+// other commands
+type fakeRunner struct {
+	outputs map[string]string
+	calls   []string
+}
+
+func (f *fakeRunner) Run(args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	if out, ok := f.outputs[cmd]; ok {
+		return []byte(out), nil
+	}
+	if strings.Contains(cmd, " show ") {
+		return nil, nil
+	}
+	f.calls = append(f.calls, cmd)
+	return nil, nil
+}
+
+func TestParseRate(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"100Mbit": 100000000,
+		"1gbit":   1000000000,
+		"1.5Mbit": 1500000,
+		"10mbps":  80000000,
+		"1Kibit":  1024,
+		"800bit":  800,
+	} {
+		got, err := ParseRate(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	for _, s := range []string{"", "100", "100 Mbit", "-1Mbit", "0Mbit", "100Mb", "Mbit", "1e3bit"} {
+		_, err := ParseRate(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+var vip = net.ParseIP("10.0.0.100")
+
+func TestEnsureCreate(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"qdisc show dev eth0": "qdisc pfifo_fast 0: root refcnt 2 bands 3 priomap  1 2 2 2 1 2 0 0 1 1 1 1 1 1 1 1\n",
+	}}
+	m := NewManager("eth0", runner)
+	id := idFor(vip)
+
+	assert.Nil(t, m.Ensure([]Limit{{VIP: vip, Ingress: 100000000, Egress: 50000000}}))
+	assert.Equal(t, []string{
+		"qdisc replace dev eth0 root handle 1ff: htb default 0",
+		fmt.Sprintf("class add dev eth0 parent 1ff: classid 1ff:%x htb rate 50000000bit ceil 50000000bit", id),
+		fmt.Sprintf("filter add dev eth0 parent 1ff: protocol ip prio %d u32 match ip src 10.0.0.100/32 flowid 1ff:%x", id, id),
+		"qdisc add dev eth0 handle ffff: ingress",
+		fmt.Sprintf("filter add dev eth0 parent ffff: protocol ip prio %d u32 match ip dst 10.0.0.100/32 police rate 100000000bit burst 125000 drop flowid :1", id),
+	}, runner.calls)
+}
+
+func existingRunner(egress, ingress string) *fakeRunner {
+	id := idFor(vip)
+	return &fakeRunner{outputs: map[string]string{
+		"qdisc show dev eth0": "qdisc htb 1ff: root refcnt 2 r2q 10 default 0 direct_packets_stat 0\n" +
+			"qdisc ingress ffff: parent ffff:fff1 ----------------\n",
+		"class show dev eth0": fmt.Sprintf("class htb 1ff:%x root prio 0 rate %s ceil %s burst 1600b cburst 1600b\n", id, egress, egress),
+		"filter show dev eth0 parent ffff:": fmt.Sprintf(`filter protocol ip pref 5 u32 chain 0
+filter protocol ip pref 5 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 flowid :1
+  match 0a000001/ffffffff at 16
+ police 0x2 rate 1Mbit burst 15140b mtu 2Kb action drop overhead 0b
+filter protocol ip pref %d u32 chain 0
+filter protocol ip pref %d u32 chain 0 fh 801::800 order 2048 key ht 801 bkt 0 flowid :1
+  match 0a000064/ffffffff at 16
+ police 0x1 rate %s burst 125000b mtu 2Kb action drop overhead 0b
+`, id, id, ingress),
+	}}
+}
+
+func TestEnsureRateChange(t *testing.T) {
+	id := idFor(vip)
+
+	// unchanged
+	runner := existingRunner("50Mbit", "100Mbit")
+	assert.Nil(t, NewManager("eth0", runner).Ensure([]Limit{{VIP: vip, Ingress: 100000000, Egress: 50000000}}))
+	assert.Nil(t, runner.calls)
+
+	runner = existingRunner("50Mbit", "100Mbit")
+	assert.Nil(t, NewManager("eth0", runner).Ensure([]Limit{{VIP: vip, Ingress: 200000000, Egress: 20000000}}))
+	assert.Equal(t, []string{
+		fmt.Sprintf("class change dev eth0 parent 1ff: classid 1ff:%x htb rate 20000000bit ceil 20000000bit", id),
+		fmt.Sprintf("filter del dev eth0 parent ffff: protocol ip prio %d", id),
+		fmt.Sprintf("filter add dev eth0 parent ffff: protocol ip prio %d u32 match ip dst 10.0.0.100/32 police rate 200000000bit burst 250000 drop flowid :1", id),
+	}, runner.calls)
+}
+
+func TestCleanup(t *testing.T) {
+	id := idFor(vip)
+	runner := existingRunner("50Mbit", "100Mbit")
+	assert.Nil(t, NewManager("eth0", runner).Cleanup())
+	// the filter of pref 5 is not ours
+	assert.Equal(t, []string{
+		"qdisc del dev eth0 root",
+		fmt.Sprintf("filter del dev eth0 parent ffff: protocol ip prio %d", id),
+	}, runner.calls)
+}
+
+func TestEnsureForeignRoot(t *testing.T) {
+	runner := &fakeRunner{outputs: map[string]string{
+		"qdisc show dev eth0": "qdisc tbf 8001: root refcnt 2 rate 1Gbit burst 1Mb lat 50ms\n",
+	}}
+	assert.NotNil(t, NewManager("eth0", runner).Ensure([]Limit{{VIP: vip, Egress: 50000000}}))
+	assert.Nil(t, runner.calls)
+}
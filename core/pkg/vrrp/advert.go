@@ -0,0 +1,148 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vrrp allocates the virtual router ids of the LoadBalancers and
+// parses the VRRP advertisements on the wire to detect other VRRP instances
+// using the same virtual router id
+package vrrp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	log "github.com/zoumo/logdog"
+)
+
+// Protocol is the IP protocol number of VRRP
+const Protocol = 112
+
+var errShortAdvert = errors.New("vrrp advertisement too short")
+
+// Advert is a VRRP advertisement
+type Advert struct {
+	Version  int
+	VRID     int
+	Priority int
+	// Addrs are the virtual addresses advertised
+	Addrs []net.IP
+	// Source is the address of the sender
+	Source net.IP
+}
+
+// ParseAdvert parses the VRRP message, without the IP header, of an IPv4
+// packet from the source. Both VRRPv2 (RFC 3768) and VRRPv3 (RFC 5798) are
+// accepted, the checksum is not verified.
+func ParseAdvert(source net.IP, b []byte) (*Advert, error) {
+	if len(b) < 8 {
+		return nil, errShortAdvert
+	}
+	version, typ := int(b[0]>>4), b[0]&0x0f
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported vrrp version %d", version)
+	}
+	if typ != 1 {
+		return nil, fmt.Errorf("unsupported vrrp message type %d", typ)
+	}
+
+	adv := &Advert{
+		Version:  version,
+		VRID:     int(b[1]),
+		Priority: int(b[2]),
+		Source:   source,
+	}
+	count := int(b[3])
+	if len(b) < 8+count*net.IPv4len {
+		return nil, errShortAdvert
+	}
+	for i := 0; i < count; i++ {
+		off := 8 + i*net.IPv4len
+		adv.Addrs = append(adv.Addrs, net.IP(append([]byte(nil), b[off:off+net.IPv4len]...)))
+	}
+	return adv, nil
+}
+
+// Conflict is an advertisement of another VRRP instance using the virtual
+// router id
+type Conflict struct {
+	Advert
+	// SourceMAC is the hardware address of the sender if it is known
+	SourceMAC net.HardwareAddr
+}
+
+func (c Conflict) String() string {
+	src := c.Source.String()
+	if c.SourceMAC != nil {
+		src = fmt.Sprintf("%s (%s)", src, c.SourceMAC)
+	}
+	return fmt.Sprintf("vrid %d is used by %s for %v", c.VRID, src, c.Addrs)
+}
+
+// IsConflict returns true if the advertisement is of the virtual router id
+// but advertises other addresses than the VIPs. The peers advertise the
+// same VIPs, so they are not conflicts.
+func IsConflict(adv *Advert, vrid int, vips []net.IP) bool {
+	if adv.VRID != vrid {
+		return false
+	}
+	want := make([]string, 0, len(vips))
+	for _, vip := range vips {
+		if vip.To4() != nil {
+			want = append(want, vip.String())
+		}
+	}
+	got := make([]string, 0, len(adv.Addrs))
+	for _, addr := range adv.Addrs {
+		got = append(got, addr.String())
+	}
+	sort.Strings(want)
+	sort.Strings(got)
+	if len(want) != len(got) {
+		return true
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectConflicts listens for the VRRP advertisements on the interface for
+// the duration, and returns the ones of other instances using the virtual
+// router id. Listening requires a raw socket, i.e. CAP_NET_RAW.
+func DetectConflicts(iface string, vrid int, vips []net.IP, duration time.Duration) ([]Conflict, error) {
+	adverts, err := Listen(iface, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []Conflict{}
+	seen := make(map[string]bool)
+	for _, adv := range adverts {
+		if !IsConflict(adv, vrid, vips) || seen[adv.Source.String()] {
+			continue
+		}
+		seen[adv.Source.String()] = true
+		c := Conflict{Advert: *adv}
+		c.SourceMAC, _ = resolveMAC(iface, adv.Source)
+		log.Warn("vrrp conflict detected", log.Fields{"iface": iface, "conflict": c})
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, nil
+}
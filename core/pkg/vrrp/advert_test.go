@@ -0,0 +1,80 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrrp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecode(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	assert.Nil(t, err)
+	return b
+}
+
+func TestParseAdvert(t *testing.T) {
+	src := net.ParseIP("192.168.1.2")
+
+	// VRRPv2, vrid 50, priority 100, simple text authentication "secret"
+	adv, err := ParseAdvert(src, mustDecode(t, "213264010101190ec0a863c87365637265740000"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, adv.Version)
+	assert.Equal(t, 50, adv.VRID)
+	assert.Equal(t, 100, adv.Priority)
+	assert.Equal(t, "[192.168.99.200]", fmt.Sprint(adv.Addrs))
+	assert.Equal(t, src, adv.Source)
+
+	// VRRPv3, vrid 51, priority 150, two addresses
+	adv, err = ParseAdvert(src, mustDecode(t, "3133960200644d45c0a863c8c0a863c9"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, adv.Version)
+	assert.Equal(t, 51, adv.VRID)
+	assert.Equal(t, 150, adv.Priority)
+	assert.Equal(t, "[192.168.99.200 192.168.99.201]", fmt.Sprint(adv.Addrs))
+
+	// truncated addresses
+	_, err = ParseAdvert(src, mustDecode(t, "3133960200644d45c0a863c8"))
+	assert.NotNil(t, err)
+	// not an advertisement
+	_, err = ParseAdvert(src, mustDecode(t, "3233960200644d45c0a863c8c0a863c9"))
+	assert.NotNil(t, err)
+	_, err = ParseAdvert(src, mustDecode(t, "4133960200644d45c0a863c8c0a863c9"))
+	assert.NotNil(t, err)
+}
+
+func TestIsConflict(t *testing.T) {
+	adv := &Advert{VRID: 50, Addrs: []net.IP{net.ParseIP("192.168.99.201").To4(), net.ParseIP("192.168.99.200").To4()}}
+	vips := []net.IP{net.ParseIP("192.168.99.200"), net.ParseIP("192.168.99.201"), net.ParseIP("fd00::200")}
+
+	// a peer, the IPv6 vip is not advertised by the IPv4 instance
+	assert.False(t, IsConflict(adv, 50, vips))
+	// another vrid
+	assert.False(t, IsConflict(adv, 51, vips[:1]))
+	// other vips
+	assert.True(t, IsConflict(adv, 50, vips[:1]))
+	assert.True(t, IsConflict(adv, 50, []net.IP{net.ParseIP("192.168.99.200"), net.ParseIP("192.168.99.202")}))
+
+	c := Conflict{Advert: Advert{VRID: 50, Source: net.ParseIP("192.168.1.9"), Addrs: adv.Addrs}}
+	assert.Equal(t, "vrid 50 is used by 192.168.1.9 for [192.168.99.201 192.168.99.200]", c.String())
+	c.SourceMAC, _ = net.ParseMAC("02:42:ac:11:00:02")
+	assert.Equal(t, "vrid 50 is used by 192.168.1.9 (02:42:ac:11:00:02) for [192.168.99.201 192.168.99.200]", c.String())
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrrp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// MinVRID and MaxVRID bound the virtual router ids
+	MinVRID = 1
+	MaxVRID = 255
+	// AllocationsKey is the key of the allocations in the ConfigMap, they
+	// are the owners keyed by the vrids in json
+	AllocationsKey = "vrids"
+
+	allocationUpdateRetries = 5
+)
+
+// ConfigMapClient gets, creates and updates the ConfigMap of the
+// allocations, the typed client of the ConfigMaps in its namespace
+// implements it
+type ConfigMapClient interface {
+	Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error)
+	Create(*v1.ConfigMap) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// Allocator allocates the vrids of the LoadBalancers from a ConfigMap
+// shared by the cluster, keyed by the UIDs of the LoadBalancers so every
+// instance of a LoadBalancer gets the same vrid. The ConfigMap is created
+// once the first vrid is allocated, the updates of the one which lost a
+// race are retried.
+type Allocator struct {
+	client ConfigMapClient
+	name   string
+}
+
+// NewAllocator returns an allocator of the vrids in the named ConfigMap
+func NewAllocator(client ConfigMapClient, name string) *Allocator {
+	return &Allocator{client: client, name: name}
+}
+
+// Allocate returns the vrid of the owner, a free one is allocated if it
+// has none yet. The preferred vrid is allocated if it is free, e.g. the one
+// a LoadBalancer was assigned before, the lowest free one otherwise.
+func (a *Allocator) Allocate(owner string, preferred int) (int, error) {
+	if owner == "" {
+		return 0, fmt.Errorf("allocate vrid error: no owner")
+	}
+	vrid := 0
+	err := a.update(func(allocations map[int]string) (bool, error) {
+		for id, o := range allocations {
+			if o == owner {
+				vrid = id
+				return false, nil
+			}
+		}
+		if preferred >= MinVRID && preferred <= MaxVRID && allocations[preferred] == "" {
+			vrid = preferred
+		} else {
+			for id := MinVRID; id <= MaxVRID; id++ {
+				if allocations[id] == "" {
+					vrid = id
+					break
+				}
+			}
+		}
+		if vrid == 0 {
+			return false, fmt.Errorf("no free vrid in configmap %s, %d are allocated", a.name, len(allocations))
+		}
+		allocations[vrid] = owner
+		log.Info("Allocating vrid", log.Fields{"vrid": vrid, "owner": owner, "configmap": a.name})
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return vrid, nil
+}
+
+// Release releases the vrid of the owner, it is a no-op if the owner has
+// none
+func (a *Allocator) Release(owner string) error {
+	return a.update(func(allocations map[int]string) (bool, error) {
+		for id, o := range allocations {
+			if o == owner {
+				log.Info("Releasing vrid", log.Fields{"vrid": id, "owner": owner, "configmap": a.name})
+				delete(allocations, id)
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+// update applies the change to the allocations in the ConfigMap, which is
+// created if it does not exist. It is retried on the conflicting updates,
+// the ConfigMap is not updated if the change returns false.
+func (a *Allocator) update(change func(allocations map[int]string) (bool, error)) error {
+	var lastErr error
+	for i := 0; i < allocationUpdateRetries; i++ {
+		cm, err := a.client.Get(a.name, metav1.GetOptions{})
+		exists := err == nil
+		if errors.IsNotFound(err) {
+			cm = &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: a.name}}
+		} else if err != nil {
+			return err
+		}
+
+		allocations, err := parseAllocations(cm)
+		if err != nil {
+			return err
+		}
+		changed, err := change(allocations)
+		if err != nil || !changed {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[AllocationsKey] = formatAllocations(allocations)
+		if exists {
+			_, err = a.client.Update(cm)
+		} else {
+			_, err = a.client.Create(cm)
+		}
+		if !errors.IsConflict(err) && !errors.IsAlreadyExists(err) {
+			return err
+		}
+		lastErr = err
+		log.Info("vrid allocations changed by others, retry", log.Fields{"configmap": a.name})
+	}
+	return fmt.Errorf("update vrid allocations in configmap %s error: %v", a.name, lastErr)
+}
+
+// parseAllocations returns the owners of the vrids in the ConfigMap
+func parseAllocations(cm *v1.ConfigMap) (map[int]string, error) {
+	allocations := make(map[int]string)
+	data, ok := cm.Data[AllocationsKey]
+	if !ok {
+		return allocations, nil
+	}
+	raw := make(map[string]string)
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, fmt.Errorf("invalid vrid allocations in configmap %s: %v", cm.Name, err)
+	}
+	for key, owner := range raw {
+		id, err := strconv.Atoi(key)
+		if err != nil || id < MinVRID || id > MaxVRID {
+			return nil, fmt.Errorf("invalid vrid allocations in configmap %s: invalid vrid %q", cm.Name, key)
+		}
+		allocations[id] = owner
+	}
+	return allocations, nil
+}
+
+// formatAllocations returns the json of the allocations keyed by the vrids
+func formatAllocations(allocations map[int]string) string {
+	ids := make([]int, 0, len(allocations))
+	for id := range allocations {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	raw := make(map[string]string, len(allocations))
+	for _, id := range ids {
+		raw[strconv.Itoa(id)] = allocations[id]
+	}
+	data, _ := json.Marshal(raw)
+	return string(data)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrrp
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeConfigMaps stores the ConfigMaps, the updates of a stale copy
+// conflict
+type fakeConfigMaps struct {
+	lock sync.Mutex
+	cms  map[string]*v1.ConfigMap
+}
+
+func newFakeConfigMaps() *fakeConfigMaps {
+	return &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cm, ok := f.cms[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.cms[cm.Name]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	cm = copyConfigMap(cm)
+	cm.ResourceVersion = "1"
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cur, ok := f.cms[cm.Name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	if cm.ResourceVersion != cur.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("stale"))
+	}
+	cm = copyConfigMap(cm)
+	version, _ := strconv.Atoi(cm.ResourceVersion)
+	cm.ResourceVersion = strconv.Itoa(version + 1)
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func copyConfigMap(cm *v1.ConfigMap) *v1.ConfigMap {
+	ret := *cm
+	ret.Data = make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		ret.Data[k] = v
+	}
+	return &ret
+}
+
+func TestAllocator(t *testing.T) {
+	cms := newFakeConfigMaps()
+	// the allocators of two nodes sharing the ConfigMap
+	node1 := NewAllocator(cms, "vrids")
+	node2 := NewAllocator(cms, "vrids")
+
+	// the ConfigMap is created by the first allocation
+	vrid, err := node1.Allocate("uid-a", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, vrid)
+	assert.Equal(t, `{"1":"uid-a"}`, cms.cms["vrids"].Data[AllocationsKey])
+
+	// every instance of a LoadBalancer gets the same vrid
+	vrid, err = node2.Allocate("uid-a", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, vrid)
+
+	// the others get the free ones
+	vrid, err = node2.Allocate("uid-b", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, vrid)
+
+	// the preferred vrid is allocated if it is free
+	vrid, err = node1.Allocate("uid-c", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, vrid)
+	vrid, err = node2.Allocate("uid-d", 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, vrid)
+
+	// the released vrid is allocated again
+	assert.Nil(t, node1.Release("uid-b"))
+	assert.Nil(t, node1.Release("uid-unknown"))
+	vrid, err = node2.Allocate("uid-e", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, vrid)
+	assert.Equal(t, `{"1":"uid-a","100":"uid-c","2":"uid-e","3":"uid-d"}`, cms.cms["vrids"].Data[AllocationsKey])
+
+	_, err = node1.Allocate("", 0)
+	assert.NotNil(t, err)
+}
+
+func TestAllocatorExhausted(t *testing.T) {
+	cms := newFakeConfigMaps()
+	a := NewAllocator(cms, "vrids")
+	for i := MinVRID; i <= MaxVRID; i++ {
+		_, err := a.Allocate(fmt.Sprintf("uid-%d", i), 0)
+		assert.Nil(t, err)
+	}
+	_, err := a.Allocate("uid-full", 0)
+	assert.NotNil(t, err)
+
+	// the owners still get theirs
+	vrid, err := a.Allocate("uid-10", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, vrid)
+}
+
+func TestAllocatorInvalid(t *testing.T) {
+	cms := newFakeConfigMaps()
+	cms.cms["vrids"] = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vrids", ResourceVersion: "1"},
+		Data:       map[string]string{AllocationsKey: `{"256":"uid-a"}`},
+	}
+	_, err := NewAllocator(cms, "vrids").Allocate("uid-b", 0)
+	assert.NotNil(t, err)
+}
+
+func TestAllocatorConcurrent(t *testing.T) {
+	cms := newFakeConfigMaps()
+	owners := 4
+	vrids := make([]int, owners)
+	errs := make([]error, owners)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < owners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vrids[i], errs[i] = NewAllocator(cms, "vrids").Allocate(fmt.Sprintf("uid-%d", i), 0)
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	for i := 0; i < owners; i++ {
+		assert.Nil(t, errs[i])
+		assert.False(t, seen[vrids[i]], "vrid %d is allocated twice", vrids[i])
+		seen[vrids[i]] = true
+	}
+}
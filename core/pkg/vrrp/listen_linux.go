@@ -0,0 +1,89 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrrp
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	log "github.com/zoumo/logdog"
+)
+
+// multicastGroup is the address the VRRP advertisements are sent to
+var multicastGroup = [4]byte{224, 0, 0, 18}
+
+// Listen returns the VRRP advertisements received on the interface within
+// the duration, both the multicast and the unicast ones
+func Listen(iface string, duration time.Duration) ([]*Advert, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = os.NewSyscallError("setsockopt", syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface))
+				if err != nil {
+					return
+				}
+				mreq := &syscall.IPMreqn{Multiaddr: multicastGroup, Ifindex: int32(ifi.Index)}
+				err = os.NewSyscallError("setsockopt", syscall.SetsockoptIPMreqn(int(fd), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, mreq))
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	pc, err := lc.ListenPacket(context.Background(), "ip4:112", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	if err := pc.SetReadDeadline(time.Now().Add(duration)); err != nil {
+		return nil, err
+	}
+
+	adverts := []*Advert{}
+	buf := make([]byte, 1500)
+	for {
+		// the IPv4 header is stripped
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return adverts, nil
+			}
+			return adverts, err
+		}
+		adv, err := ParseAdvert(addr.(*net.IPAddr).IP, buf[:n])
+		if err != nil {
+			log.Debug("skip invalid vrrp advertisement", log.Fields{"src": addr, "err": err})
+			continue
+		}
+		adverts = append(adverts, adv)
+	}
+}
+
+func resolveMAC(iface string, ip net.IP) (net.HardwareAddr, error) {
+	return arp.Resolve(iface, ip.String())
+}
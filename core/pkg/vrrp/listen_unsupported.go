@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vrrp
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errListenUnsupported = errors.New("listening for vrrp advertisements is only supported on linux")
+
+// Listen is not supported on this platform
+func Listen(iface string, duration time.Duration) ([]*Advert, error) {
+	return nil, errListenUnsupported
+}
+
+func resolveMAC(iface string, ip net.IP) (net.HardwareAddr, error) {
+	return nil, errListenUnsupported
+}
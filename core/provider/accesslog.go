@@ -0,0 +1,129 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// AnnotationKeyAccessLog is the access log of the requests in json, e.g.
+// {"enabled":true,"format":"json","syslog":"10.0.0.10:514","sampling":10}.
+// The logs are written to the stdout of the backend unless a syslog server
+// is set, the backends keep their own default if it is absent.
+const AnnotationKeyAccessLog = "loadbalancer.caicloud.io/access-log"
+
+const (
+	// DefaultSyslogPort is the port of the syslog server if it is omitted
+	DefaultSyslogPort = 514
+	// MaxAccessLogSampling is the sparsest sampling of the access log
+	MaxAccessLogSampling = 10000
+)
+
+// AccessLogFormat is a predefined format of the access log
+type AccessLogFormat string
+
+const (
+	// AccessLogFormatCombined is the combined log format of the Apache
+	// HTTP server
+	AccessLogFormatCombined AccessLogFormat = "combined"
+	// AccessLogFormatJSON is a json object per request
+	AccessLogFormatJSON AccessLogFormat = "json"
+)
+
+// AccessLog is the access log of the LoadBalancer
+type AccessLog struct {
+	Enabled bool `json:"enabled"`
+	// Format is combined by default
+	Format AccessLogFormat `json:"format,omitempty"`
+	// Syslog is the host[:port] of the syslog server receiving the logs in
+	// udp, the logs are written to stdout if it is empty
+	Syslog string `json:"syslog,omitempty"`
+	// Sampling logs one of every Sampling requests, all if it is 0 or 1
+	Sampling uint32 `json:"sampling,omitempty"`
+}
+
+// GetAccessLog returns the access log of the LoadBalancer with the default
+// format filled and the syslog server in the host:port form, nil if not
+// specified. It returns a PermanentError if the access log is invalid.
+func GetAccessLog(lb *netv1alpha1.LoadBalancer) (*AccessLog, error) {
+	value, ok := lb.Annotations[AnnotationKeyAccessLog]
+	if !ok {
+		return nil, nil
+	}
+
+	l := &AccessLog{}
+	if err := json.Unmarshal([]byte(value), l); err != nil {
+		return nil, NewPermanentError("InvalidAccessLog", fmt.Errorf("invalid access log %q: %v", value, err))
+	}
+	if !l.Enabled {
+		return &AccessLog{}, nil
+	}
+	switch l.Format {
+	case "":
+		l.Format = AccessLogFormatCombined
+	case AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return nil, NewPermanentError("InvalidAccessLog", fmt.Errorf("unsupported access log format %q, expect %s or %s", l.Format, AccessLogFormatCombined, AccessLogFormatJSON))
+	}
+	if l.Sampling > MaxAccessLogSampling {
+		return nil, NewPermanentError("InvalidAccessLog", fmt.Errorf("access log sampling %d is sparser than 1/%d", l.Sampling, MaxAccessLogSampling))
+	}
+	if l.Sampling == 1 {
+		l.Sampling = 0
+	}
+	if l.Syslog != "" {
+		addr, err := parseSyslogServer(l.Syslog)
+		if err != nil {
+			return nil, NewPermanentError("InvalidAccessLog", fmt.Errorf("invalid syslog server %q: %v", l.Syslog, err))
+		}
+		l.Syslog = addr
+	}
+	return l, nil
+}
+
+// parseSyslogServer returns the host:port of the syslog server, the port
+// defaults to DefaultSyslogPort
+func parseSyslogServer(value string) (string, error) {
+	host, port := value, strconv.Itoa(DefaultSyslogPort)
+	if strings.HasPrefix(value, "[") || strings.Count(value, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(value); err != nil {
+			return "", err
+		}
+	}
+	if net.ParseIP(host) == nil {
+		if errs := validation.IsDNS1123Subdomain(host); len(errs) > 0 {
+			return "", fmt.Errorf("%s", strings.Join(errs, ", "))
+		}
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if errs := validation.IsValidPortNum(n); len(errs) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// AnnotationKeyRealServerIP overrides the address of a Node used as the
+// real server, a comma separated list for dual-stack nodes
+const AnnotationKeyRealServerIP = "loadbalancer.caicloud.io/real-server-ip"
+
+// DefaultAddressTypes is the default preference of the node address types
+var DefaultAddressTypes = []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}
+
+// AddressPolicy selects the address of a Node used as the real server, the
+// override annotation takes precedence over the address types in order
+type AddressPolicy struct {
+	Types []v1.NodeAddressType
+}
+
+// NewAddressPolicy returns an AddressPolicy preferring the types in order,
+// DefaultAddressTypes if none is given
+func NewAddressPolicy(types []v1.NodeAddressType) *AddressPolicy {
+	if len(types) == 0 {
+		types = DefaultAddressTypes
+	}
+	return &AddressPolicy{Types: types}
+}
+
+// ParseAddressTypes parses a comma separated list of address types, e.g.
+// InternalIP,ExternalIP
+func ParseAddressTypes(s string) ([]v1.NodeAddressType, error) {
+	types := make([]v1.NodeAddressType, 0)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		switch v1.NodeAddressType(t) {
+		case v1.NodeExternalIP, v1.NodeInternalIP, v1.NodeLegacyHostIP:
+			types = append(types, v1.NodeAddressType(t))
+		default:
+			return nil, fmt.Errorf("unsupported node address type %q", t)
+		}
+	}
+	return types, nil
+}
+
+// NodeIP returns the address of the node of the family, any family if the
+// family is empty. The address must be a global unicast one.
+func (p *AddressPolicy) NodeIP(node *v1.Node, family corenet.Family) (net.IP, error) {
+	if value, ok := node.Annotations[AnnotationKeyRealServerIP]; ok {
+		for _, s := range strings.Split(value, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if err := validateNodeIP(ip); err != nil {
+				return nil, fmt.Errorf("node %s: invalid %s %q: %v", node.Name, AnnotationKeyRealServerIP, s, err)
+			}
+			if family == "" || corenet.FamilyOf(ip) == family {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("node %s: no %s address in %s %q", node.Name, family, AnnotationKeyRealServerIP, value)
+	}
+
+	for _, t := range p.Types {
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != t {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			if validateNodeIP(ip) != nil {
+				continue
+			}
+			if family == "" || corenet.FamilyOf(ip) == family {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("node %s: no %s address of types %v; known addresses: %v", node.Name, family, p.Types, node.Status.Addresses)
+}
+
+func validateNodeIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("not an IP address")
+	}
+	if !ip.IsGlobalUnicast() {
+		return fmt.Errorf("not a global unicast address")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestAddressPolicy(t *testing.T) {
+	both := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node1"},
+		{Type: v1.NodeInternalIP, Address: "192.168.1.1"},
+		{Type: v1.NodeInternalIP, Address: "fd00::1"},
+		{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+	}
+
+	tests := []struct {
+		name        string
+		types       []v1.NodeAddressType
+		addresses   []v1.NodeAddress
+		annotations map[string]string
+		family      corenet.Family
+		want        string
+	}{
+		{"default prefers external", nil, both, nil, "", "203.0.113.1"},
+		{"internal first", []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP}, both, nil, "", "192.168.1.1"},
+		{"family", []v1.NodeAddressType{v1.NodeInternalIP}, both, nil, corenet.FamilyIPv6, "fd00::1"},
+		{"fall back", nil, both[:3], nil, corenet.FamilyIPv4, "192.168.1.1"},
+		{"skip loopback", nil, []v1.NodeAddress{{Type: v1.NodeExternalIP, Address: "127.0.0.1"}, {Type: v1.NodeInternalIP, Address: "192.168.1.1"}}, nil, "", "192.168.1.1"},
+		{"none", nil, both[:1], nil, "", ""},
+		{"no family", []v1.NodeAddressType{v1.NodeExternalIP}, both, nil, corenet.FamilyIPv6, ""},
+		{"override", nil, both, map[string]string{AnnotationKeyRealServerIP: "10.0.0.1"}, "", "10.0.0.1"},
+		{"override dual-stack", nil, both, map[string]string{AnnotationKeyRealServerIP: "10.0.0.1,fd00::10"}, corenet.FamilyIPv6, "fd00::10"},
+		{"override invalid", nil, both, map[string]string{AnnotationKeyRealServerIP: "fe80::1"}, "", ""},
+		{"override no family", nil, both, map[string]string{AnnotationKeyRealServerIP: "10.0.0.1"}, corenet.FamilyIPv6, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: tt.annotations},
+				Status:     v1.NodeStatus{Addresses: tt.addresses},
+			}
+			ip, err := NewAddressPolicy(tt.types).NodeIP(node, tt.family)
+			if tt.want == "" {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, net.ParseIP(tt.want), ip)
+		})
+	}
+}
+
+func TestParseAddressTypes(t *testing.T) {
+	types, err := ParseAddressTypes("InternalIP, ExternalIP")
+	assert.Nil(t, err)
+	assert.Equal(t, []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP}, types)
+
+	_, err = ParseAddressTypes("Hostname")
+	assert.NotNil(t, err)
+}
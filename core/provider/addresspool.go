@@ -0,0 +1,497 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyAddressPool is the address pool the VIP of the
+	// LoadBalancer is allocated from if the vip in the ipvsdr spec is
+	// empty, the pools are defined in the ConfigMap of the provider
+	AnnotationKeyAddressPool = "loadbalancer.caicloud.io/address-pool"
+
+	// AddressPoolsKey is the key of the pools by name in json in the
+	// ConfigMap of the address pools, e.g.
+	// {"public":{"cidrs":["192.168.10.0/24"],"exclude":["192.168.10.1","192.168.10.240/28"]}}
+	AddressPoolsKey = "pools"
+	// AddressAllocationsKey is the key of the owners of the allocated
+	// addresses by address in json, e.g. {"192.168.10.2":"default/lb"}, it
+	// is maintained by the providers
+	AddressAllocationsKey = "allocations"
+
+	// addressPoolRetryPeriod is how long the LoadBalancer waits for an
+	// address released from an exhausted pool
+	addressPoolRetryPeriod = time.Minute
+	// addressPoolUpdateRetries bounds the retries of the updates of the
+	// ConfigMap conflicting with the ones of the other providers
+	addressPoolUpdateRetries = 10
+)
+
+// AddressPool is the addresses the VIPs are allocated from
+type AddressPool struct {
+	CIDRs []string `json:"cidrs"`
+	// Exclude are the addresses and the CIDRs in the pool never allocated,
+	// e.g. the gateway
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// addressPool is a parsed AddressPool
+type addressPool struct {
+	cidrs   []*net.IPNet
+	exclude []*net.IPNet
+}
+
+// parseCIDR parses a CIDR or a single address
+func parseCIDR(s string) (*net.IPNet, error) {
+	if ip := net.ParseIP(s); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// parseAddressPools returns the pools in the ConfigMap by name. It returns
+// a PermanentError if they are invalid.
+func parseAddressPools(cm *v1.ConfigMap) (map[string]*addressPool, error) {
+	pools := make(map[string]AddressPool)
+	if err := json.Unmarshal([]byte(cm.Data[AddressPoolsKey]), &pools); err != nil {
+		return nil, NewPermanentError("InvalidAddressPools", fmt.Errorf("invalid address pools in configmap %s/%s: %v", cm.Namespace, cm.Name, err))
+	}
+	ret := make(map[string]*addressPool, len(pools))
+	for name, pool := range pools {
+		p := &addressPool{}
+		for _, s := range pool.CIDRs {
+			n, err := parseCIDR(s)
+			if err != nil {
+				return nil, NewPermanentError("InvalidAddressPools", fmt.Errorf("invalid cidr %q of address pool %s: %v", s, name, err))
+			}
+			p.cidrs = append(p.cidrs, n)
+		}
+		for _, s := range pool.Exclude {
+			n, err := parseCIDR(s)
+			if err != nil {
+				return nil, NewPermanentError("InvalidAddressPools", fmt.Errorf("invalid exclusion %q of address pool %s: %v", s, name, err))
+			}
+			p.exclude = append(p.exclude, n)
+		}
+		if len(p.cidrs) == 0 {
+			return nil, NewPermanentError("InvalidAddressPools", fmt.Errorf("address pool %s has no cidr", name))
+		}
+		ret[name] = p
+	}
+	return ret, nil
+}
+
+// contains returns true if the ip is in a CIDR of the pool, excluded or not
+func (p *addressPool) contains(ip net.IP) bool {
+	for _, n := range p.cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// each calls the function with the addresses of the pool which are not
+// excluded in order until it returns true. The first and the last addresses
+// of the IPv4 subnets and the first one of the IPv6 subnets are never
+// allocated, they are the network, the broadcast and the subnet-router
+// addresses.
+func (p *addressPool) each(fn func(ip net.IP) bool) {
+	for _, n := range p.cidrs {
+		first, last := firstIP(n), lastIP(n)
+		ones, bits := n.Mask.Size()
+		if bits-ones > 1 {
+			first = nextIP(first)
+			if bits == 32 {
+				last = prevIP(last)
+			}
+		}
+	candidates:
+		for cur := first; ; cur = nextIP(cur) {
+			for _, e := range p.exclude {
+				if e.Contains(cur) {
+					// skip the rest of the excluded range
+					cur = lastIP(e)
+					if bytes.Compare(cur, last) >= 0 {
+						break candidates
+					}
+					continue candidates
+				}
+			}
+			if fn(cur) || bytes.Equal(cur, last) {
+				break
+			}
+		}
+	}
+}
+
+// normalizeIP returns the 4 byte form of the IPv4 addresses
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// firstIP returns the first address of the CIDR
+func firstIP(n *net.IPNet) net.IP {
+	return normalizeIP(n.IP.Mask(n.Mask))
+}
+
+// lastIP returns the last address of the CIDR
+func lastIP(n *net.IPNet) net.IP {
+	ip := firstIP(n)
+	mask := n.Mask
+	if len(mask) != len(ip) {
+		mask = mask[len(mask)-len(ip):]
+	}
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^mask[i]
+	}
+	return last
+}
+
+// nextIP returns the address after the ip, it wraps around after the last
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// prevIP returns the address before the ip
+func prevIP(ip net.IP) net.IP {
+	prev := append(net.IP(nil), ip...)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// configMapClient gets and updates the ConfigMap of the address pools, the
+// typed client of the ConfigMaps in its namespace implements it
+type configMapClient interface {
+	Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// AddressAllocator allocates the VIPs from the pools in a ConfigMap, the
+// allocations are recorded in the ConfigMap too. The providers of all
+// LoadBalancers share the ConfigMap, the updates of the one which lost a
+// race are retried.
+type AddressAllocator struct {
+	client configMapClient
+	name   string
+	// detect returns the hardware address of the host holding the address
+	// on a link of the node, nil if no one does
+	detect func(ip net.IP) (net.HardwareAddr, error)
+}
+
+// NewAddressAllocator returns an allocator of the pools in the named
+// ConfigMap, the addresses are probed by the duplicate address detection
+// before they are allocated
+func NewAddressAllocator(client configMapClient, name string) *AddressAllocator {
+	return &AddressAllocator{client: client, name: name, detect: detectDuplicate}
+}
+
+// detectDuplicate probes the address on the link of the node it is on, the
+// addresses routed to the node are not probed
+func detectDuplicate(ip net.IP) (net.HardwareAddr, error) {
+	iface, err := corenet.InterfaceOnLink(ip)
+	if err != nil || iface == nil {
+		return nil, err
+	}
+	return arp.DetectDuplicate(iface.Name, ip, arp.DefaultDADTimeout)
+}
+
+// update applies the change to the pools and the allocations in the
+// ConfigMap, it is retried on the conflicting updates. The ConfigMap is
+// not updated if the change returns false.
+func (a *AddressAllocator) update(change func(pools map[string]*addressPool, allocations map[string]string) (bool, error)) error {
+	var lastErr error
+	for i := 0; i < addressPoolUpdateRetries; i++ {
+		cm, err := a.client.Get(a.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return NewPermanentError("AddressPoolsNotFound", fmt.Errorf("configmap %s of the address pools not found", a.name))
+		}
+		if err != nil {
+			return err
+		}
+		pools, err := parseAddressPools(cm)
+		if err != nil {
+			return err
+		}
+		allocations := make(map[string]string)
+		if data, ok := cm.Data[AddressAllocationsKey]; ok {
+			if err := json.Unmarshal([]byte(data), &allocations); err != nil {
+				return NewPermanentError("InvalidAddressPools", fmt.Errorf("invalid address allocations in configmap %s/%s: %v", cm.Namespace, cm.Name, err))
+			}
+		}
+
+		changed, err := change(pools, allocations)
+		if err != nil || !changed {
+			return err
+		}
+		data, _ := json.Marshal(allocations)
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[AddressAllocationsKey] = string(data)
+		_, err = a.client.Update(cm)
+		if !errors.IsConflict(err) {
+			return err
+		}
+		lastErr = err
+		log.Info("address allocations changed by others, retry", log.Fields{"configmap": a.name})
+	}
+	return fmt.Errorf("update address allocations in configmap %s error: %v", a.name, lastErr)
+}
+
+// Allocate returns the address of the owner in the pool, a free one is
+// allocated if it has none yet, and its addresses in the other pools are
+// released. The addresses held by other hosts on the link of the node are
+// skipped. It returns a PermanentError if the pool does not exist, and a
+// RetryAfterError if it is exhausted.
+func (a *AddressAllocator) Allocate(name, owner string) (net.IP, error) {
+	var allocated net.IP
+	// held are the addresses held by others, which are not probed again
+	// when the update is retried
+	held := make(map[string]bool)
+	err := a.update(func(pools map[string]*addressPool, allocations map[string]string) (bool, error) {
+		allocated = nil
+		pool, ok := pools[name]
+		if !ok {
+			return false, NewPermanentError("AddressPoolNotFound", fmt.Errorf("address pool %s not found", name))
+		}
+		changed := false
+		for _, addr := range sortedAddresses(allocations) {
+			if allocations[addr] != owner {
+				continue
+			}
+			if ip := net.ParseIP(addr); allocated == nil && pool.contains(ip) {
+				allocated = normalizeIP(ip)
+				continue
+			}
+			delete(allocations, addr)
+			changed = true
+		}
+		if allocated != nil {
+			return changed, nil
+		}
+
+		var err error
+		pool.each(func(ip net.IP) bool {
+			if _, ok := allocations[ip.String()]; ok || held[ip.String()] {
+				return false
+			}
+			var holder net.HardwareAddr
+			holder, err = a.detect(ip)
+			if err != nil {
+				err = fmt.Errorf("detect duplicate of %v error: %v", ip, err)
+				return true
+			}
+			if holder != nil {
+				log.Warn("address of pool is held by another host, skip it", log.Fields{"pool": name, "ip": ip, "holder": holder})
+				held[ip.String()] = true
+				return false
+			}
+			allocations[ip.String()] = owner
+			allocated = ip
+			return true
+		})
+		if err != nil {
+			return false, err
+		}
+		if allocated != nil {
+			return true, nil
+		}
+		return false, NewRetryAfterError(addressPoolRetryPeriod, fmt.Errorf("address pool %s is exhausted", name))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocated, nil
+}
+
+// Reserve records the address of the owner if it is in a pool, so that it
+// is not allocated to others, and releases its other addresses. It returns
+// a PermanentError if the address is allocated to another owner.
+func (a *AddressAllocator) Reserve(ip net.IP, owner string) error {
+	ip = normalizeIP(ip)
+	return a.update(func(pools map[string]*addressPool, allocations map[string]string) (bool, error) {
+		if o, ok := allocations[ip.String()]; ok && o != owner {
+			return false, NewPermanentError("VIPAllocated", fmt.Errorf("vip %v is allocated to %s from an address pool", ip, o))
+		}
+		changed := false
+		for addr, o := range allocations {
+			if o == owner && addr != ip.String() {
+				delete(allocations, addr)
+				changed = true
+			}
+		}
+		for _, pool := range pools {
+			if pool.contains(ip) {
+				if _, ok := allocations[ip.String()]; !ok {
+					allocations[ip.String()] = owner
+					changed = true
+				}
+				break
+			}
+		}
+		return changed, nil
+	})
+}
+
+// Release releases the addresses of the owner
+func (a *AddressAllocator) Release(owner string) error {
+	return a.update(func(pools map[string]*addressPool, allocations map[string]string) (bool, error) {
+		changed := false
+		for addr, o := range allocations {
+			if o == owner {
+				delete(allocations, addr)
+				changed = true
+			}
+		}
+		return changed, nil
+	})
+}
+
+// sortedAddresses returns the allocated addresses in order
+func sortedAddresses(allocations map[string]string) []string {
+	addrs := make([]string, 0, len(allocations))
+	for addr := range allocations {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// allocationOwner returns the owner of the allocations of the LoadBalancer
+func allocationOwner(lb *netv1alpha1.LoadBalancer) string {
+	return lb.Namespace + "/" + lb.Name
+}
+
+// allocateVIP returns the LoadBalancer with the vip allocated from its
+// address pool if the vip in the ipvsdr spec is empty, the allocation is
+// recorded in the ipvsdr status. The vip in the spec is reserved instead if
+// it is in a pool. The ConfigMap of the pools is not read again while the
+// LoadBalancer keeps its pool or vip.
+func (p *GenericProvider) allocateVIP(lb *netv1alpha1.LoadBalancer) (*netv1alpha1.LoadBalancer, error) {
+	if lb.Spec.Providers.Ipvsdr == nil {
+		return lb, nil
+	}
+	pool, ok := lb.Annotations[AnnotationKeyAddressPool]
+	vip := strings.TrimSpace(lb.Spec.Providers.Ipvsdr.Vip)
+	if vip == "" && !ok {
+		// the validation rejects the empty vip
+		return lb, nil
+	}
+	if p.allocator == nil {
+		if vip == "" {
+			return nil, NewPermanentError("AddressPoolsNotConfigured", fmt.Errorf("the provider allocates no vip from the address pool %s, set the vip", pool))
+		}
+		return lb, nil
+	}
+
+	if vip != "" {
+		ip := net.ParseIP(vip)
+		if ip == nil || p.allocatedFor == "vip:"+vip {
+			return lb, nil
+		}
+		if err := p.allocator.Reserve(ip, allocationOwner(lb)); err != nil {
+			return nil, err
+		}
+		p.allocatedFor = "vip:" + vip
+		return lb, nil
+	}
+
+	if p.allocatedFor != "pool:"+pool {
+		ip, err := p.allocator.Allocate(pool, allocationOwner(lb))
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Allocated vip from address pool", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "pool": pool, "vip": ip})
+		p.allocatedFor, p.allocatedVIP = "pool:"+pool, ip
+	}
+	p.reportAllocatedVIP(lb, p.allocatedVIP)
+
+	copied := *lb
+	ipvsdr := *lb.Spec.Providers.Ipvsdr
+	ipvsdr.Vip = p.allocatedVIP.String()
+	copied.Spec.Providers.Ipvsdr = &ipvsdr
+	return &copied, nil
+}
+
+// reportAllocatedVIP records the vip allocated from the address pool in the
+// ipvsdr status of the LoadBalancer
+func (p *GenericProvider) reportAllocatedVIP(lb *netv1alpha1.LoadBalancer, vip net.IP) {
+	if s := lb.Status.ProvidersStatuses.Ipvsdr; s != nil && s.Vip == vip.String() {
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"providersStatuses": map[string]interface{}{
+				"ipvsdr": map[string]interface{}{"vip": vip.String()},
+			},
+		},
+	})
+	if err := p.patchLoadBalancer(lb.Namespace, lb.Name, patch); err != nil {
+		log.Error("record allocated vip error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "vip": vip, "err": err})
+	}
+}
+
+// releaseVIP releases the addresses allocated to the deleted LoadBalancer
+func (p *GenericProvider) releaseVIP(lb *netv1alpha1.LoadBalancer) error {
+	if p.allocator == nil {
+		return nil
+	}
+	if err := p.allocator.Release(allocationOwner(lb)); err != nil {
+		return err
+	}
+	p.allocatedFor, p.allocatedVIP = "", nil
+	return nil
+}
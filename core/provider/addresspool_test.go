@@ -0,0 +1,274 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeConfigMaps stores a ConfigMap, the updates of a stale copy conflict
+type fakeConfigMaps struct {
+	lock    sync.Mutex
+	cm      *v1.ConfigMap
+	updates int
+}
+
+func newFakeConfigMaps(pools string) *fakeConfigMaps {
+	return &fakeConfigMaps{cm: &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "pools", ResourceVersion: "1"},
+		Data:       map[string]string{AddressPoolsKey: pools},
+	}}
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.cm == nil || f.cm.Name != name {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	cm := *f.cm
+	cm.Data = make(map[string]string)
+	for k, v := range f.cm.Data {
+		cm.Data[k] = v
+	}
+	return &cm, nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if cm.ResourceVersion != f.cm.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("stale"))
+	}
+	version, _ := strconv.Atoi(cm.ResourceVersion)
+	cm.ResourceVersion = strconv.Itoa(version + 1)
+	f.cm = cm
+	f.updates++
+	return cm, nil
+}
+
+func (f *fakeConfigMaps) allocations() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.cm.Data[AddressAllocationsKey]
+}
+
+func newTestAllocator(f *fakeConfigMaps, held ...string) *AddressAllocator {
+	a := NewAddressAllocator(f, "pools")
+	a.detect = func(ip net.IP) (net.HardwareAddr, error) {
+		for _, h := range held {
+			if ip.String() == h {
+				return net.HardwareAddr{0, 1, 2, 3, 4, 5}, nil
+			}
+		}
+		return nil, nil
+	}
+	return a
+}
+
+func TestAddressPoolEach(t *testing.T) {
+	cases := []struct {
+		pool     string
+		expected []string
+	}{
+		{`{"cidrs":["10.0.0.0/29"]}`, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		{`{"cidrs":["10.0.0.0/29"],"exclude":["10.0.0.1","10.0.0.4/31"]}`, []string{"10.0.0.2", "10.0.0.3", "10.0.0.6"}},
+		{`{"cidrs":["10.0.0.0/29","10.0.1.8/31"],"exclude":["10.0.0.0/30","10.0.0.4/30"]}`, []string{"10.0.1.8", "10.0.1.9"}},
+		{`{"cidrs":["10.0.0.5","fd00::/126"]}`, []string{"10.0.0.5", "fd00::1", "fd00::2", "fd00::3"}},
+	}
+	for _, c := range cases {
+		pools, err := parseAddressPools(&v1.ConfigMap{Data: map[string]string{AddressPoolsKey: `{"p":` + c.pool + `}`}})
+		if !assert.Nil(t, err, c.pool) {
+			continue
+		}
+		ips := []string{}
+		pools["p"].each(func(ip net.IP) bool {
+			ips = append(ips, ip.String())
+			return false
+		})
+		assert.Equal(t, c.expected, ips, c.pool)
+	}
+
+	for _, invalid := range []string{`x`, `{"p":{}}`, `{"p":{"cidrs":["10.0.0.0/33"]}}`, `{"p":{"cidrs":["10.0.0.0/24"],"exclude":["x"]}}`} {
+		_, err := parseAddressPools(&v1.ConfigMap{Data: map[string]string{AddressPoolsKey: invalid}})
+		if assert.IsType(t, &PermanentError{}, err, invalid) {
+			assert.Equal(t, "InvalidAddressPools", err.(*PermanentError).Reason)
+		}
+	}
+}
+
+func TestAddressAllocator(t *testing.T) {
+	f := newFakeConfigMaps(`{"public":{"cidrs":["10.0.0.0/29"],"exclude":["10.0.0.1"]},"private":{"cidrs":["10.1.0.0/30"]}}`)
+	// 10.0.0.2 is held by a host unknown to the pool
+	a := newTestAllocator(f, "10.0.0.2")
+
+	ip, err := a.Allocate("public", "default/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.3", ip.String())
+	// idempotent
+	ip, err = a.Allocate("public", "default/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.3", ip.String())
+	assert.Equal(t, 1, f.updates)
+
+	ip, err = a.Allocate("public", "default/b")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.4", ip.String())
+
+	// moved to another pool
+	ip, err = a.Allocate("private", "default/b")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.1", ip.String())
+	assert.Equal(t, `{"10.0.0.3":"default/a","10.1.0.1":"default/b"}`, f.allocations())
+
+	// the explicit vips in a pool are reserved, and must not collide
+	assert.Nil(t, a.Reserve(net.ParseIP("10.0.0.6"), "default/c"))
+	err = a.Reserve(net.ParseIP("10.0.0.3"), "default/d")
+	if assert.IsType(t, &PermanentError{}, err) {
+		assert.Equal(t, "VIPAllocated", err.(*PermanentError).Reason)
+	}
+	// the ones out of the pools are not recorded
+	assert.Nil(t, a.Reserve(net.ParseIP("192.168.0.1"), "default/d"))
+	assert.Equal(t, `{"10.0.0.3":"default/a","10.0.0.6":"default/c","10.1.0.1":"default/b"}`, f.allocations())
+
+	// released by default/b
+	ip, err = a.Allocate("public", "default/e")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.4", ip.String())
+	ip, err = a.Allocate("public", "default/f")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.5", ip.String())
+	_, err = a.Allocate("public", "default/g")
+	assert.IsType(t, &RetryAfterError{}, err)
+
+	assert.Nil(t, a.Release("default/a"))
+	ip, err = a.Allocate("public", "default/g")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.3", ip.String())
+
+	_, err = a.Allocate("unknown", "default/h")
+	if assert.IsType(t, &PermanentError{}, err) {
+		assert.Equal(t, "AddressPoolNotFound", err.(*PermanentError).Reason)
+	}
+}
+
+func TestAddressAllocatorConcurrency(t *testing.T) {
+	f := newFakeConfigMaps(`{"public":{"cidrs":["10.0.0.0/24"]}}`)
+	a := newTestAllocator(f)
+
+	// every conflict is an update by another one, the retries of the
+	// allocations never run out
+	owners := 2 * (addressPoolUpdateRetries - 1)
+	ips := make([]net.IP, owners)
+	errs := make([]error, owners)
+	var wg sync.WaitGroup
+	for i := 0; i < owners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// the providers on the nodes of a LoadBalancer race too
+			ips[i], errs[i] = a.Allocate("public", fmt.Sprintf("default/lb-%d", i/2))
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[string]int)
+	for i := 0; i < owners; i++ {
+		if !assert.Nil(t, errs[i]) {
+			continue
+		}
+		if j, ok := allocated[ips[i].String()]; ok {
+			assert.Equal(t, j/2, i/2, "%v allocated to lb-%d and lb-%d", ips[i], j/2, i/2)
+		}
+		allocated[ips[i].String()] = i
+	}
+	assert.Len(t, allocated, owners/2)
+	assert.Equal(t, owners/2, f.updates)
+}
+
+func TestAllocateVIP(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{AnnotationKeyAddressPool: "public"}},
+		Spec: netv1alpha1.LoadBalancerSpec{
+			Providers: netv1alpha1.ProvidersSpec{Ipvsdr: &netv1alpha1.IpvsdrProvider{Scheduler: netv1alpha1.IpvsSchedulerRR}},
+		},
+	}
+	f := newFakeConfigMaps(`{"public":{"cidrs":["10.0.0.0/30"]}}`)
+	patches := []string{}
+	p := &GenericProvider{
+		cfg:       &Configuration{},
+		allocator: newTestAllocator(f),
+		patchLoadBalancer: func(namespace, name string, patch []byte) error {
+			patches = append(patches, string(patch))
+			return nil
+		},
+	}
+
+	allocated, err := p.allocateVIP(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", allocated.Spec.Providers.Ipvsdr.Vip)
+	assert.Equal(t, "", lb.Spec.Providers.Ipvsdr.Vip)
+	assert.Equal(t, []string{`{"status":{"providersStatuses":{"ipvsdr":{"vip":"10.0.0.1"}}}}`}, patches)
+
+	// recorded already
+	lb.Status.ProvidersStatuses.Ipvsdr = &netv1alpha1.IpvsdrProviderStatus{Vip: "10.0.0.1"}
+	_, err = p.allocateVIP(lb)
+	assert.Nil(t, err)
+	assert.Len(t, patches, 1)
+	assert.Equal(t, 1, f.updates)
+
+	// the allocator is not configured
+	p.allocator, p.allocatedFor = nil, ""
+	_, err = p.allocateVIP(lb)
+	if assert.IsType(t, &PermanentError{}, err) {
+		assert.Equal(t, "AddressPoolsNotConfigured", err.(*PermanentError).Reason)
+	}
+}
+
+func TestReleaseVIPOnDelete(t *testing.T) {
+	f := newFakeConfigMaps(`{"public":{"cidrs":["10.0.0.0/30"]}}`)
+	f.cm.Data[AddressAllocationsKey] = `{"10.0.0.1":"default/lb","10.0.0.2":"default/other"}`
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p := &GenericProvider{
+		cfg:          &Configuration{LoadBalancerNamespace: "default", LoadBalancerName: "lb"},
+		lbLister:     netlisters.NewLoadBalancerLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		recorder:     record.NewFakeRecorder(10),
+		allocator:    newTestAllocator(f),
+		allocatedFor: "pool:public",
+		allocatedVIP: net.ParseIP("10.0.0.1"),
+	}
+
+	assert.Nil(t, p.syncLoadBalancer(lb))
+	assert.Equal(t, `{"10.0.0.2":"default/other"}`, f.allocations())
+	assert.Equal(t, "", p.allocatedFor)
+	assert.Nil(t, p.allocatedVIP)
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/healthcheck"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/tc"
+)
+
+const (
+	// AnnotationKeyDualStackVIP is the VIP of the other address family than
+	// the one in the ipvsdr spec, which makes the LoadBalancer dual-stack
+	AnnotationKeyDualStackVIP = "loadbalancer.caicloud.io/dual-stack-vip"
+	// AnnotationKeyAdditionalVIPs is the VIPs served with the same ports
+	// besides the ones above in json, the interface is optional and
+	// defaults to the one of the node, e.g. [{"vip": "10.1.0.100", "interface": "eth1"}]
+	AnnotationKeyAdditionalVIPs = "loadbalancer.caicloud.io/additional-vips"
+	// AnnotationKeyServedVIPs is the comma separated VIPs the provider
+	// serves, it is updated by the provider after every sync
+	AnnotationKeyServedVIPs = "loadbalancer.caicloud.io/served-vips"
+	// AnnotationKeyProvisionedAddresses is the comma separated addresses
+	// provisioned by an AddressProvider, it is updated by the provider
+	// after every sync since the status has no room for them
+	AnnotationKeyProvisionedAddresses = "loadbalancer.caicloud.io/provisioned-addresses"
+	// AnnotationKeyProvisionedHostname is the DNS name provisioned by a
+	// HostnameProvider, it is updated by the provider after every sync
+	AnnotationKeyProvisionedHostname = "loadbalancer.caicloud.io/provisioned-hostname"
+	// AnnotationKeyDrainingNodes is the comma separated nodes of the
+	// LoadBalancer drained by the node annotation loadbalancer.caicloud.io/drain,
+	// it is updated by the provider after every sync
+	AnnotationKeyDrainingNodes = "loadbalancer.caicloud.io/draining-nodes"
+	// AnnotationKeyProviderInfo is the information of the provider in json,
+	// it is updated by the provider after every sync
+	AnnotationKeyProviderInfo = "loadbalancer.caicloud.io/provider-info"
+	// AnnotationKeyServingCertificates is the certificates served by a
+	// CertificateProvider in json, it is updated by the provider after
+	// every sync, e.g. [{"port":443,"secret":"cert","fingerprint":"...","notAfter":"2018-01-01T00:00:00Z"}]
+	AnnotationKeyServingCertificates = "loadbalancer.caicloud.io/serving-certificates"
+
+	// AnnotationKeyIpvsScheduler overrides the ipvs scheduler in the
+	// ipvsdr spec of the LoadBalancer, e.g. mh which is not in the spec
+	AnnotationKeyIpvsScheduler = "loadbalancer.caicloud.io/ipvs-scheduler"
+	// AnnotationKeyPersistence is the session persistence of the
+	// LoadBalancer in json, the connections of a client go to the same
+	// real server until it is idle for the timeout in seconds, and the
+	// IPv4 clients in the network of the netmask share the real server,
+	// e.g. {"enabled": true, "timeout": 600, "netmask": "255.255.255.0"}
+	AnnotationKeyPersistence = "loadbalancer.caicloud.io/persistence"
+
+	// AnnotationKeySourceRouteTable is the routing table looked up by the
+	// traffic from the VIP, policy routing is disabled if it is absent
+	AnnotationKeySourceRouteTable = "loadbalancer.caicloud.io/source-route-table"
+	// AnnotationKeySourceRouteGateway is the gateway of the default route in
+	// the source routing table
+	AnnotationKeySourceRouteGateway = "loadbalancer.caicloud.io/source-route-gateway"
+	// AnnotationKeySourceRouteDevice is the uplink of the default route in
+	// the source routing table, it is optional
+	AnnotationKeySourceRouteDevice = "loadbalancer.caicloud.io/source-route-device"
+
+	// AnnotationKeySourceRanges is the comma separated CIDRs of the clients
+	// allowed to reach the ports of the LoadBalancer, all clients are
+	// allowed if it is absent or empty, e.g. 10.0.0.0/8,2001:db8::/32
+	AnnotationKeySourceRanges = "loadbalancer.caicloud.io/source-ranges"
+
+	// AnnotationKeyPorts is the ports served by the LoadBalancer in json,
+	// e.g. [{"protocol": "tcp", "port": 80}]
+	AnnotationKeyPorts = "loadbalancer.caicloud.io/ports"
+
+	// AnnotationKeyIngressRate limits the bandwidth of the traffic to the
+	// VIP, e.g. 100Mbit
+	AnnotationKeyIngressRate = "loadbalancer.caicloud.io/ingress-rate"
+	// AnnotationKeyEgressRate limits the bandwidth of the traffic from the
+	// VIP, e.g. 100Mbit
+	AnnotationKeyEgressRate = "loadbalancer.caicloud.io/egress-rate"
+
+	// AnnotationKeyHealthChecks is the active health checks of the real
+	// servers in json, e.g. [{"protocol": "http", "port": 80, "path": "/healthz"}]
+	AnnotationKeyHealthChecks = "loadbalancer.caicloud.io/health-checks"
+)
+
+// DefaultPorts are served if the LoadBalancer does not specify the ports
+var DefaultPorts = []corenet.Port{
+	{Protocol: "tcp", Port: 80},
+	{Protocol: "tcp", Port: 443},
+}
+
+// GetPorts returns the ports served by the LoadBalancer, DefaultPorts if
+// not specified. It returns a PermanentError if the ports are invalid.
+func GetPorts(lb *netv1alpha1.LoadBalancer) ([]corenet.Port, error) {
+	value, ok := lb.Annotations[AnnotationKeyPorts]
+	if !ok {
+		return DefaultPorts, nil
+	}
+
+	ports := make([]corenet.Port, 0)
+	if err := json.Unmarshal([]byte(value), &ports); err != nil {
+		return nil, NewPermanentError("InvalidPorts", fmt.Errorf("invalid ports %q: %v", value, err))
+	}
+	seen := make(map[corenet.Port]bool, len(ports))
+	for i := range ports {
+		p := &ports[i]
+		p.Protocol = strings.ToLower(p.Protocol)
+		if (p.Protocol != "tcp" && p.Protocol != "udp") || p.Port == 0 {
+			return nil, NewPermanentError("InvalidPorts", fmt.Errorf("invalid port %v", p))
+		}
+		if seen[*p] {
+			return nil, NewPermanentError("InvalidPorts", fmt.Errorf("duplicate port %v", p))
+		}
+		seen[*p] = true
+	}
+	return ports, nil
+}
+
+// VIP is an address served by the LoadBalancer
+type VIP struct {
+	IP net.IP `json:"vip"`
+	// Interface is the interface the VIP is served on, the one of the node
+	// if empty
+	Interface string `json:"interface,omitempty"`
+}
+
+// GetVIPs returns the VIPs of the LoadBalancer, the one in the ipvsdr spec
+// goes first. It returns a PermanentError if a VIP is invalid, see
+// GetVIPList.
+func GetVIPs(lb *netv1alpha1.LoadBalancer) ([]net.IP, error) {
+	list, err := GetVIPList(lb)
+	if err != nil || list == nil {
+		return nil, err
+	}
+	vips := make([]net.IP, 0, len(list))
+	for _, vip := range list {
+		vips = append(vips, vip.IP)
+	}
+	return vips, nil
+}
+
+// GetVIPList returns the VIPs of the LoadBalancer with their interfaces,
+// the one in the ipvsdr spec goes first, then the dual-stack one and the
+// additional ones. The VIPs without their own interface are served on the
+// one of AnnotationKeyVIPInterface if any. It returns a PermanentError if a VIP is invalid or
+// duplicate, if the dual-stack VIP is of the same family as the one in the
+// spec, or if an additional VIP is of neither family.
+func GetVIPList(lb *netv1alpha1.LoadBalancer) ([]VIP, error) {
+	if lb.Spec.Providers.Ipvsdr == nil {
+		return nil, nil
+	}
+	vip := net.ParseIP(lb.Spec.Providers.Ipvsdr.Vip)
+	if vip == nil {
+		return nil, NewPermanentError("InvalidVIP", fmt.Errorf("invalid vip %q", lb.Spec.Providers.Ipvsdr.Vip))
+	}
+	vips := []VIP{{IP: vip}}
+	families := map[corenet.Family]bool{corenet.FamilyOf(vip): true}
+
+	if value, ok := lb.Annotations[AnnotationKeyDualStackVIP]; ok {
+		other := net.ParseIP(value)
+		if other == nil {
+			return nil, NewPermanentError("InvalidVIP", fmt.Errorf("invalid dual-stack vip %q", value))
+		}
+		if corenet.FamilyOf(other) == corenet.FamilyOf(vip) {
+			return nil, NewPermanentError("InvalidVIP", fmt.Errorf("dual-stack vip %v is of the same family as vip %v", other, vip))
+		}
+		vips = append(vips, VIP{IP: other})
+		families[corenet.FamilyOf(other)] = true
+	}
+
+	additional := make([]VIP, 0)
+	if value, ok := lb.Annotations[AnnotationKeyAdditionalVIPs]; ok {
+		if err := json.Unmarshal([]byte(value), &additional); err != nil {
+			return nil, NewPermanentError("InvalidVIP", fmt.Errorf("invalid additional vips %q: %v", value, err))
+		}
+	}
+	for _, a := range additional {
+		if a.IP == nil {
+			return nil, NewPermanentError("InvalidVIP", fmt.Errorf("additional vip without an address"))
+		}
+		for _, v := range vips {
+			if v.IP.Equal(a.IP) {
+				return nil, NewPermanentError("InvalidVIP", fmt.Errorf("duplicate vip %v", a.IP))
+			}
+		}
+		// the families are mixed by the dual-stack vip only
+		if !families[corenet.FamilyOf(a.IP)] {
+			return nil, NewPermanentError("InvalidVIP", fmt.Errorf("additional vip %v is of another family than vip %v, set the dual-stack vip first", a.IP, vip))
+		}
+		vips = append(vips, a)
+	}
+
+	if iface := lb.Annotations[AnnotationKeyVIPInterface]; iface != "" {
+		for i := range vips {
+			if vips[i].Interface == "" {
+				vips[i].Interface = iface
+			}
+		}
+	}
+	return vips, nil
+}
+
+// ValidateFamilies returns a PermanentError if a VIP is of a family not in
+// the supported ones
+func ValidateFamilies(vips []net.IP, supported []corenet.Family) error {
+	for _, vip := range vips {
+		family := corenet.FamilyOf(vip)
+		ok := false
+		for _, f := range supported {
+			if f == family {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return NewPermanentError("UnsupportedFamily", fmt.Errorf("vip %v: %s is not supported by the provider", vip, family))
+		}
+	}
+	return nil
+}
+
+// GetIpvsScheduler returns the ipvs scheduler of the LoadBalancer, the
+// annotation takes precedence over the ipvsdr spec. It returns a
+// PermanentError if the scheduler is not supported.
+func GetIpvsScheduler(lb *netv1alpha1.LoadBalancer) (string, error) {
+	scheduler := ""
+	if lb.Spec.Providers.Ipvsdr != nil {
+		scheduler = string(lb.Spec.Providers.Ipvsdr.Scheduler)
+	}
+	if s, ok := lb.Annotations[AnnotationKeyIpvsScheduler]; ok {
+		scheduler = s
+	}
+	if scheduler == "" {
+		return ipvs.DefaultScheduler, nil
+	}
+
+	if err := ipvs.ValidateScheduler(scheduler); err != nil {
+		return "", NewPermanentError("InvalidScheduler", err)
+	}
+	return scheduler, nil
+}
+
+const (
+	// DefaultPersistenceTimeout is the persistence timeout in seconds if
+	// the persistence is enabled without one
+	DefaultPersistenceTimeout = 360
+	// MaxPersistenceTimeout is the longest persistence timeout in
+	// seconds, the expiry of the haproxy stick tables is limited to it
+	MaxPersistenceTimeout = 24 * 24 * 3600
+)
+
+// Persistence is the session persistence of the LoadBalancer
+type Persistence struct {
+	Enabled bool `json:"enabled"`
+	// Timeout is in seconds
+	Timeout uint32 `json:"timeout,omitempty"`
+	// Netmask is the granularity of the persistence of the IPv4 clients,
+	// every client has its own real server if it is empty
+	Netmask string `json:"netmask,omitempty"`
+
+	// Mask is the parsed netmask, nil if it is empty
+	Mask net.IPMask `json:"-"`
+}
+
+// GetPersistence returns the session persistence of the LoadBalancer with
+// the default timeout filled, nil if not specified. It returns a
+// PermanentError if the persistence is invalid.
+func GetPersistence(lb *netv1alpha1.LoadBalancer) (*Persistence, error) {
+	value, ok := lb.Annotations[AnnotationKeyPersistence]
+	if !ok {
+		return nil, nil
+	}
+
+	p := &Persistence{}
+	if err := json.Unmarshal([]byte(value), p); err != nil {
+		return nil, NewPermanentError("InvalidPersistence", fmt.Errorf("invalid persistence %q: %v", value, err))
+	}
+	if !p.Enabled {
+		return &Persistence{}, nil
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultPersistenceTimeout
+	}
+	if p.Timeout > MaxPersistenceTimeout {
+		return nil, NewPermanentError("InvalidPersistence", fmt.Errorf("persistence timeout %d is longer than %d seconds", p.Timeout, MaxPersistenceTimeout))
+	}
+	if p.Netmask != "" {
+		ip := net.ParseIP(p.Netmask).To4()
+		if ip == nil {
+			return nil, NewPermanentError("InvalidPersistence", fmt.Errorf("invalid persistence netmask %q", p.Netmask))
+		}
+		mask := net.IPMask(ip)
+		// a non-canonical mask has no size, and the empty one sends all
+		// the clients to one real server
+		if ones, _ := mask.Size(); ones == 0 {
+			return nil, NewPermanentError("InvalidPersistence", fmt.Errorf("invalid persistence netmask %q", p.Netmask))
+		}
+		p.Mask = mask
+	}
+	return p, nil
+}
+
+// GetSourceRanges returns the networks of the clients allowed to reach the
+// LoadBalancer without the duplicates, nil if all clients are allowed. It
+// returns a PermanentError if a CIDR is invalid.
+func GetSourceRanges(lb *netv1alpha1.LoadBalancer) ([]*net.IPNet, error) {
+	value := strings.TrimSpace(lb.Annotations[AnnotationKeySourceRanges])
+	if value == "" {
+		return nil, nil
+	}
+	ranges := make([]*net.IPNet, 0)
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(value, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, NewPermanentError("InvalidSourceRanges", fmt.Errorf("invalid source range %q: %v", s, err))
+		}
+		if seen[ipnet.String()] {
+			continue
+		}
+		seen[ipnet.String()] = true
+		ranges = append(ranges, ipnet)
+	}
+	return ranges, nil
+}
+
+// SourceRoute is the policy routing of the traffic from the VIP
+type SourceRoute struct {
+	Table   int
+	Gateway net.IP
+	Device  string
+}
+
+// GetSourceRoute returns the policy routing of the LoadBalancer, it returns
+// nil if the policy routing is not enabled, and a PermanentError if the
+// annotations are invalid.
+func GetSourceRoute(lb *netv1alpha1.LoadBalancer) (*SourceRoute, error) {
+	t, ok := lb.Annotations[AnnotationKeySourceRouteTable]
+	if !ok {
+		return nil, nil
+	}
+	table, err := strconv.Atoi(t)
+	if err != nil || table <= 0 {
+		return nil, NewPermanentError("InvalidSourceRoute", fmt.Errorf("invalid routing table %q", t))
+	}
+	gw := net.ParseIP(lb.Annotations[AnnotationKeySourceRouteGateway])
+	if gw == nil {
+		return nil, NewPermanentError("InvalidSourceRoute", fmt.Errorf("invalid gateway %q", lb.Annotations[AnnotationKeySourceRouteGateway]))
+	}
+	return &SourceRoute{
+		Table:   table,
+		Gateway: gw,
+		Device:  lb.Annotations[AnnotationKeySourceRouteDevice],
+	}, nil
+}
+
+// GetBandwidth returns the ingress and egress bandwidth limits of the
+// LoadBalancer in bits per second, zero means unlimited. It returns a
+// PermanentError if a rate is invalid.
+func GetBandwidth(lb *netv1alpha1.LoadBalancer) (ingress, egress uint64, err error) {
+	if v, ok := lb.Annotations[AnnotationKeyIngressRate]; ok {
+		if ingress, err = tc.ParseRate(v); err != nil {
+			return 0, 0, NewPermanentError("InvalidBandwidth", err)
+		}
+	}
+	if v, ok := lb.Annotations[AnnotationKeyEgressRate]; ok {
+		if egress, err = tc.ParseRate(v); err != nil {
+			return 0, 0, NewPermanentError("InvalidBandwidth", err)
+		}
+	}
+	return ingress, egress, nil
+}
+
+// GetHealthChecks returns the active health checks of the real servers of
+// the LoadBalancer with the defaults filled, nil if not specified. It
+// returns a PermanentError if the checks are invalid.
+func GetHealthChecks(lb *netv1alpha1.LoadBalancer) ([]healthcheck.Check, error) {
+	value, ok := lb.Annotations[AnnotationKeyHealthChecks]
+	if !ok {
+		return nil, nil
+	}
+
+	checks := make([]healthcheck.Check, 0)
+	if err := json.Unmarshal([]byte(value), &checks); err != nil {
+		return nil, NewPermanentError("InvalidHealthCheck", fmt.Errorf("invalid health checks %q: %v", value, err))
+	}
+	// tcp/53 and udp/53 are distinct services, each may be checked
+	seen := make(map[string]bool, len(checks))
+	for i := range checks {
+		c := &checks[i]
+		c.Protocol = healthcheck.Protocol(strings.ToLower(string(c.Protocol)))
+		if err := c.Validate(); err != nil {
+			return nil, NewPermanentError("InvalidHealthCheck", err)
+		}
+		key := fmt.Sprintf("%s/%d", c.Transport(), c.Port)
+		if seen[key] {
+			return nil, NewPermanentError("InvalidHealthCheck", fmt.Errorf("duplicate health check of port %s", key))
+		}
+		seen[key] = true
+		c.SetDefaults()
+	}
+	return checks, nil
+}
@@ -0,0 +1,361 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/healthcheck"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetIpvsScheduler(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        netv1alpha1.IpvsScheduler
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{"default", "", nil, "rr", false},
+		{"spec", "wlc", nil, "wlc", false},
+		{"annotation", "wlc", map[string]string{AnnotationKeyIpvsScheduler: "mh"}, "mh", false},
+		{"invalid", "", map[string]string{AnnotationKeyIpvsScheduler: "fifo"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &netv1alpha1.LoadBalancer{}
+			lb.Annotations = tt.annotations
+			lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Scheduler: tt.spec}
+
+			got, err := GetIpvsScheduler(lb)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantErr, IsPermanentError(err))
+		})
+	}
+}
+
+func TestGetSourceRoute(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	sr, err := GetSourceRoute(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, sr)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeySourceRouteTable:   "100",
+		AnnotationKeySourceRouteGateway: "192.168.1.1",
+		AnnotationKeySourceRouteDevice:  "eth1",
+	}
+	sr, err = GetSourceRoute(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &SourceRoute{Table: 100, Gateway: net.ParseIP("192.168.1.1"), Device: "eth1"}, sr)
+
+	lb.Annotations[AnnotationKeySourceRouteGateway] = "uplink"
+	_, err = GetSourceRoute(lb)
+	assert.True(t, IsPermanentError(err))
+}
+
+func TestGetPorts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	ports, err := GetPorts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultPorts, ports)
+
+	lb.Annotations = map[string]string{AnnotationKeyPorts: `[{"protocol": "TCP", "port": 8080}, {"protocol": "udp", "port": 53}]`}
+	ports, err = GetPorts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []corenet.Port{{Protocol: "tcp", Port: 8080}, {Protocol: "udp", Port: 53}}, ports)
+
+	for _, invalid := range []string{
+		`80`,
+		`[{"protocol": "sctp", "port": 80}]`,
+		`[{"protocol": "tcp", "port": 0}]`,
+		`[{"protocol": "tcp", "port": 80}, {"protocol": "tcp", "port": 80}]`,
+	} {
+		lb.Annotations[AnnotationKeyPorts] = invalid
+		_, err = GetPorts(lb)
+		assert.True(t, IsPermanentError(err), invalid)
+	}
+}
+
+func TestGetBandwidth(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	lb.Annotations = map[string]string{AnnotationKeyIngressRate: "100Mbit"}
+	ingress, egress, err := GetBandwidth(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100000000), ingress)
+	assert.Equal(t, uint64(0), egress)
+
+	lb.Annotations[AnnotationKeyEgressRate] = "100"
+	_, _, err = GetBandwidth(lb)
+	assert.True(t, IsPermanentError(err))
+}
+
+func TestGetVIPs(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	vips, err := GetVIPs(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, vips)
+
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100"}
+	vips, err = GetVIPs(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.100")}, vips)
+
+	lb.Annotations = map[string]string{AnnotationKeyDualStackVIP: "fd00::100"}
+	vips, err = GetVIPs(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("fd00::100")}, vips)
+
+	for _, invalid := range []string{"10.0.0.101", "vip"} {
+		lb.Annotations[AnnotationKeyDualStackVIP] = invalid
+		_, err = GetVIPs(lb)
+		assert.True(t, IsPermanentError(err))
+	}
+
+	// v6-only
+	lb.Annotations = nil
+	lb.Spec.Providers.Ipvsdr.Vip = "fd00::100"
+	vips, err = GetVIPs(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("fd00::100")}, vips)
+}
+
+func TestGetVIPList(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100"}
+	lb.Annotations = map[string]string{
+		AnnotationKeyAdditionalVIPs: `[{"vip": "10.1.0.100", "interface": "eth1"}, {"vip": "10.0.0.101"}]`,
+	}
+	vips, err := GetVIPList(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []VIP{
+		{IP: net.ParseIP("10.0.0.100")},
+		{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"},
+		{IP: net.ParseIP("10.0.0.101")},
+	}, vips)
+
+	for _, invalid := range []string{
+		`[{"vip": "10.0.0.100"}]`,
+		`[{"vip": "10.1.0.100"}, {"vip": "10.1.0.100", "interface": "eth1"}]`,
+		`[{"vip": "fd00::101"}]`,
+		`[{"interface": "eth1"}]`,
+		`[{"vip": "vip"}]`,
+		`10.1.0.100`,
+	} {
+		lb.Annotations[AnnotationKeyAdditionalVIPs] = invalid
+		_, err = GetVIPList(lb)
+		assert.True(t, IsPermanentError(err), invalid)
+	}
+
+	// the interface of the loadbalancer
+	lb.Annotations = map[string]string{
+		AnnotationKeyAdditionalVIPs: `[{"vip": "10.1.0.100", "interface": "eth1"}]`,
+		AnnotationKeyVIPInterface:   "bond0.120",
+	}
+	vips, err = GetVIPList(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []VIP{
+		{IP: net.ParseIP("10.0.0.100"), Interface: "bond0.120"},
+		{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"},
+	}, vips)
+
+	// mixed families with the dual-stack vip
+	lb.Annotations = map[string]string{
+		AnnotationKeyDualStackVIP:   "fd00::100",
+		AnnotationKeyAdditionalVIPs: `[{"vip": "fd00::101"}]`,
+	}
+	ips, err := GetVIPs(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("fd00::100"), net.ParseIP("fd00::101")}, ips)
+}
+
+func TestValidateFamilies(t *testing.T) {
+	dual := []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("fd00::100")}
+	assert.Nil(t, ValidateFamilies(dual, []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}))
+	assert.True(t, IsPermanentError(ValidateFamilies(dual, []corenet.Family{corenet.FamilyIPv4})))
+	assert.Nil(t, ValidateFamilies(dual[1:], []corenet.Family{corenet.FamilyIPv6}))
+}
+
+func TestGetHealthChecks(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	checks, err := GetHealthChecks(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, checks)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyHealthChecks: `[{"protocol": "HTTP", "port": 80, "path": "/healthz"}, {"protocol": "tcp", "port": 443, "fall": 1}]`,
+	}
+	checks, err = GetHealthChecks(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []healthcheck.Check{
+		{Protocol: healthcheck.ProtocolHTTP, Port: 80, Path: "/healthz", ExpectedStatus: 200, TimeoutSeconds: 3, Rise: 2, Fall: 3},
+		{Protocol: healthcheck.ProtocolTCP, Port: 443, TimeoutSeconds: 3, Rise: 2, Fall: 1},
+	}, checks)
+
+	// the checks of tcp/53 and udp/53 coexist
+	lb.Annotations[AnnotationKeyHealthChecks] = `[{"protocol": "tcp", "port": 53}, {"protocol": "UDP", "port": 53, "send": "00"}]`
+	checks, err = GetHealthChecks(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []healthcheck.Check{
+		{Protocol: healthcheck.ProtocolTCP, Port: 53, TimeoutSeconds: 3, Rise: 2, Fall: 3},
+		{Protocol: healthcheck.ProtocolUDP, Port: 53, Send: "00", TimeoutSeconds: 3, Rise: 2, Fall: 3},
+	}, checks)
+
+	for _, value := range []string{
+		`{"port": 80}`,
+		`[{"protocol": "sctp", "port": 53}]`,
+		`[{"protocol": "udp", "port": 53}, {"protocol": "udp", "port": 53, "send": "00"}]`,
+		`[{"protocol": "tcp", "port": 80}, {"protocol": "http", "port": 80}]`,
+	} {
+		lb.Annotations[AnnotationKeyHealthChecks] = value
+		_, err := GetHealthChecks(lb)
+		assert.True(t, IsPermanentError(err), value)
+	}
+}
+
+func TestGetPersistence(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	p, err := GetPersistence(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, p)
+
+	for _, c := range []struct {
+		value string
+		want  *Persistence
+	}{
+		{`{"enabled": false, "timeout": 600}`, &Persistence{}},
+		{`{"enabled": true}`, &Persistence{Enabled: true, Timeout: DefaultPersistenceTimeout}},
+		{`{"enabled": true, "timeout": 600, "netmask": "255.255.255.0"}`, &Persistence{Enabled: true, Timeout: 600, Netmask: "255.255.255.0", Mask: net.CIDRMask(24, 32)}},
+	} {
+		lb.Annotations = map[string]string{AnnotationKeyPersistence: c.value}
+		p, err := GetPersistence(lb)
+		assert.Nil(t, err, c.value)
+		assert.Equal(t, c.want, p, c.value)
+	}
+
+	for _, invalid := range []string{
+		`{"enabled": "yes"}`,
+		`{"enabled": true, "timeout": 3000000}`,
+		`{"enabled": true, "netmask": "255.0.255.0"}`,
+		`{"enabled": true, "netmask": "0.0.0.0"}`,
+		`{"enabled": true, "netmask": "ffff:ffff::"}`,
+	} {
+		lb.Annotations = map[string]string{AnnotationKeyPersistence: invalid}
+		_, err := GetPersistence(lb)
+		assert.True(t, IsPermanentError(err), invalid)
+	}
+}
+
+func TestGetAccessLog(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	l, err := GetAccessLog(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, l)
+
+	for _, c := range []struct {
+		value string
+		want  *AccessLog
+	}{
+		{`{"enabled": false, "format": "json"}`, &AccessLog{}},
+		{`{"enabled": true}`, &AccessLog{Enabled: true, Format: AccessLogFormatCombined}},
+		{`{"enabled": true, "sampling": 1}`, &AccessLog{Enabled: true, Format: AccessLogFormatCombined}},
+		{`{"enabled": true, "format": "json", "syslog": "10.0.0.10", "sampling": 10}`, &AccessLog{Enabled: true, Format: AccessLogFormatJSON, Syslog: "10.0.0.10:514", Sampling: 10}},
+		{`{"enabled": true, "syslog": "syslog.example.com:1514"}`, &AccessLog{Enabled: true, Format: AccessLogFormatCombined, Syslog: "syslog.example.com:1514"}},
+		{`{"enabled": true, "syslog": "2001:db8::10"}`, &AccessLog{Enabled: true, Format: AccessLogFormatCombined, Syslog: "[2001:db8::10]:514"}},
+		{`{"enabled": true, "syslog": "[2001:db8::10]:1514"}`, &AccessLog{Enabled: true, Format: AccessLogFormatCombined, Syslog: "[2001:db8::10]:1514"}},
+	} {
+		lb.Annotations = map[string]string{AnnotationKeyAccessLog: c.value}
+		l, err := GetAccessLog(lb)
+		assert.Nil(t, err, c.value)
+		assert.Equal(t, c.want, l, c.value)
+	}
+
+	for _, invalid := range []string{
+		`{"enabled": "yes"}`,
+		`{"enabled": true, "format": "common"}`,
+		`{"enabled": true, "sampling": 100000}`,
+		`{"enabled": true, "syslog": "udp://10.0.0.10:514"}`,
+		`{"enabled": true, "syslog": "/dev/log"}`,
+		`{"enabled": true, "syslog": "10.0.0.10:0"}`,
+		`{"enabled": true, "syslog": "10.0.0.10:syslog"}`,
+		`{"enabled": true, "syslog": "Syslog_Server"}`,
+	} {
+		lb.Annotations = map[string]string{AnnotationKeyAccessLog: invalid}
+		_, err := GetAccessLog(lb)
+		assert.True(t, IsPermanentError(err), invalid)
+	}
+}
+
+func TestGetSourceRanges(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	ranges, err := GetSourceRanges(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, ranges)
+
+	lb.Annotations = map[string]string{AnnotationKeySourceRanges: " "}
+	ranges, err = GetSourceRanges(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, ranges)
+
+	lb.Annotations[AnnotationKeySourceRanges] = "10.1.2.3/8, 2001:db8::/32,10.0.0.0/8,192.168.1.1/32"
+	ranges, err = GetSourceRanges(lb)
+	assert.Nil(t, err)
+	got := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		got = append(got, r.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1/32"}, got)
+
+	for _, invalid := range []string{"10.0.0.1", "10.0.0.0/33", "10.0.0.0/8,", "any"} {
+		lb.Annotations[AnnotationKeySourceRanges] = invalid
+		_, err := GetSourceRanges(lb)
+		assert.True(t, IsPermanentError(err), invalid)
+	}
+}
+
+func TestGetVIPVLAN(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	vlan, err := GetVIPVLAN(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, vlan)
+
+	lb.Annotations = map[string]string{AnnotationKeyVIPInterface: "eth1"}
+	vlan, err = GetVIPVLAN(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, vlan)
+
+	lb.Annotations = map[string]string{AnnotationKeyVIPInterface: "bond0.120", AnnotationKeyVIPInterfaceMTU: "9000"}
+	vlan, err = GetVIPVLAN(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &corenet.VLAN{Name: "bond0.120", Parent: "bond0", ID: 120, MTU: 9000}, vlan)
+
+	for _, invalid := range []map[string]string{
+		{AnnotationKeyVIPInterface: ""},
+		{AnnotationKeyVIPInterface: "bond0.120", AnnotationKeyVIPInterfaceMTU: "10"},
+		{AnnotationKeyVIPInterface: "bond0.120", AnnotationKeyVIPInterfaceMTU: "x"},
+		{AnnotationKeyVIPInterface: "eth1", AnnotationKeyVIPInterfaceMTU: "9000"},
+	} {
+		lb.Annotations = invalid
+		_, err = GetVIPVLAN(lb)
+		assert.True(t, IsPermanentError(err), "%v", invalid)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1listers "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// AnnotationKeyBackendProtocolPrefix prefixes the annotations of the
+	// protocol to the backends of a port, e.g.
+	// loadbalancer.caicloud.io/backend-protocol.443: HTTPS re-encrypts the
+	// requests terminated on the port 443. The HTTP ports default to HTTP
+	// and the TCP ports to TCP.
+	AnnotationKeyBackendProtocolPrefix = "loadbalancer.caicloud.io/backend-protocol."
+	// AnnotationKeyBackendCASecretPrefix prefixes the annotations of the
+	// Secret in the namespace of the LoadBalancer holding the CA
+	// certificates the HTTPS backends of a port are verified with, e.g.
+	// loadbalancer.caicloud.io/backend-ca-secret.443: backend-ca. The
+	// backends are not verified without it.
+	AnnotationKeyBackendCASecretPrefix = "loadbalancer.caicloud.io/backend-ca-secret."
+
+	// BackendCAKey is the key of the PEM encoded CA certificates in the
+	// Secret
+	BackendCAKey = "ca.crt"
+)
+
+// BackendProtocol is the protocol a port speaks to its backends
+type BackendProtocol string
+
+const (
+	// BackendProtocolHTTP proxies the requests in plain HTTP
+	BackendProtocolHTTP BackendProtocol = "HTTP"
+	// BackendProtocolHTTPS re-encrypts the requests to the backends
+	BackendProtocolHTTPS BackendProtocol = "HTTPS"
+	// BackendProtocolTCP passes the connections through as they are, e.g.
+	// to the backends terminating TLS themselves
+	BackendProtocolTCP BackendProtocol = "TCP"
+)
+
+// PortBackendProtocol is the backend protocol of a port of the LoadBalancer
+type PortBackendProtocol struct {
+	Port     int
+	Protocol BackendProtocol
+	// CASecret is the name of the Secret verifying the HTTPS backends, they
+	// are not verified if it is empty
+	CASecret string
+}
+
+// GetBackendProtocols returns the backend protocols annotated on the HTTP
+// and TCP ports of the LoadBalancer sorted by port, the ports without the
+// annotations are omitted. It returns a PermanentError if they are invalid,
+// annotate a port not served or conflict with it: a https port terminating
+// TLS can not pass it through, a TCP port does not proxy HTTP, and only the
+// HTTPS backends are verified.
+func GetBackendProtocols(lb *netv1alpha1.LoadBalancer) ([]PortBackendProtocol, error) {
+	bps := make(map[int]*PortBackendProtocol)
+	get := func(key, prefix string) (*PortBackendProtocol, error) {
+		port, err := strconv.Atoi(strings.TrimPrefix(key, prefix))
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, NewPermanentError("InvalidBackendProtocol", fmt.Errorf("invalid port of the annotation %s", key))
+		}
+		if bps[port] == nil {
+			bps[port] = &PortBackendProtocol{Port: port}
+		}
+		return bps[port], nil
+	}
+	for key, value := range lb.Annotations {
+		switch {
+		case strings.HasPrefix(key, AnnotationKeyBackendProtocolPrefix):
+			bp, err := get(key, AnnotationKeyBackendProtocolPrefix)
+			if err != nil {
+				return nil, err
+			}
+			bp.Protocol = BackendProtocol(strings.ToUpper(value))
+			if bp.Protocol != BackendProtocolHTTP && bp.Protocol != BackendProtocolHTTPS && bp.Protocol != BackendProtocolTCP {
+				return nil, NewPermanentError("InvalidBackendProtocol", fmt.Errorf("invalid backend protocol %q of port %d, expect HTTP, HTTPS or TCP", value, bp.Port))
+			}
+		case strings.HasPrefix(key, AnnotationKeyBackendCASecretPrefix):
+			bp, err := get(key, AnnotationKeyBackendCASecretPrefix)
+			if err != nil {
+				return nil, err
+			}
+			if bp.CASecret = value; value == "" {
+				return nil, NewPermanentError("InvalidBackendProtocol", fmt.Errorf("empty backend ca secret of port %d", bp.Port))
+			}
+		}
+	}
+	if len(bps) == 0 {
+		return nil, nil
+	}
+
+	httpPorts, err := GetHTTPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	tcpPorts, err := GetTCPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	protocols := make(map[int]HTTPProtocol, len(httpPorts)+len(tcpPorts))
+	for _, p := range httpPorts {
+		protocols[p.Port] = p.Protocol
+	}
+	// the TCP ports terminate no HTTP protocol
+	for _, p := range tcpPorts {
+		protocols[p.Port] = ""
+	}
+
+	ret := make([]PortBackendProtocol, 0, len(bps))
+	for _, bp := range bps {
+		protocol, ok := protocols[bp.Port]
+		if bp.Protocol == "" {
+			bp.Protocol = BackendProtocolHTTP
+			if ok && protocol == "" {
+				bp.Protocol = BackendProtocolTCP
+			}
+		}
+		switch {
+		case !ok:
+			return nil, NewPermanentError("InvalidBackendProtocol", fmt.Errorf("backend protocol of port %d which is not served", bp.Port))
+		case protocol == HTTPProtocolHTTPS && bp.Protocol == BackendProtocolTCP:
+			return nil, NewPermanentError("ConflictingBackendProtocol", fmt.Errorf("https port %d terminates tls, it can not pass the connections through as TCP", bp.Port))
+		case protocol == "" && bp.Protocol != BackendProtocolTCP:
+			return nil, NewPermanentError("ConflictingBackendProtocol", fmt.Errorf("tcp port %d does not proxy %s", bp.Port, bp.Protocol))
+		case bp.CASecret != "" && bp.Protocol != BackendProtocolHTTPS:
+			return nil, NewPermanentError("ConflictingBackendProtocol", fmt.Errorf("backend ca secret of port %d whose backend protocol %s is not HTTPS", bp.Port, bp.Protocol))
+		}
+		ret = append(ret, *bp)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Port < ret[j].Port })
+	return ret, nil
+}
+
+// hasBackendProtocols returns true if the LoadBalancer annotates the
+// backend protocol of a port
+func hasBackendProtocols(lb *netv1alpha1.LoadBalancer) bool {
+	for key := range lb.Annotations {
+		if strings.HasPrefix(key, AnnotationKeyBackendProtocolPrefix) || strings.HasPrefix(key, AnnotationKeyBackendCASecretPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBackendCA returns the PEM encoded CA certificates in the named Secret
+// in the namespace of the LoadBalancer. It returns a PermanentError if the
+// Secret is missing or holds no certificate, the LoadBalancer is resynced
+// when the Secret changes.
+func GetBackendCA(lb *netv1alpha1.LoadBalancer, secrets v1listers.SecretLister, name string) ([]byte, error) {
+	if secrets == nil {
+		return nil, fmt.Errorf("no secret lister to get the backend ca secret %s/%s", lb.Namespace, name)
+	}
+	secret, err := secrets.Secrets(lb.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, NewPermanentError("BackendCASecretNotFound", fmt.Errorf("backend ca secret %s/%s not found", lb.Namespace, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	ca := secret.Data[BackendCAKey]
+	if !x509.NewCertPool().AppendCertsFromPEM(ca) {
+		return nil, NewPermanentError("InvalidBackendCASecret", fmt.Errorf("no certificate in %s of the backend ca secret %s/%s", BackendCAKey, lb.Namespace, name))
+	}
+	return ca, nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetBackendProtocols(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		AnnotationKeyHTTPPorts: `[
+			{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":443},
+			{"port":8443,"service":"web","servicePort":443},
+			{"port":80,"service":"web","servicePort":80}
+		]`,
+		AnnotationKeyTCPPorts: `[{"port":6443}]`,
+	}}}
+	bps, err := GetBackendProtocols(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, bps)
+
+	lb.Annotations[AnnotationKeyBackendProtocolPrefix+"443"] = "HTTPS"
+	lb.Annotations[AnnotationKeyBackendCASecretPrefix+"443"] = "backend-ca"
+	lb.Annotations[AnnotationKeyBackendProtocolPrefix+"8443"] = "tcp"
+	lb.Annotations[AnnotationKeyBackendProtocolPrefix+"6443"] = "TCP"
+	bps, err = GetBackendProtocols(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []PortBackendProtocol{
+		{Port: 443, Protocol: BackendProtocolHTTPS, CASecret: "backend-ca"},
+		{Port: 6443, Protocol: BackendProtocolTCP},
+		{Port: 8443, Protocol: BackendProtocolTCP},
+	}, bps)
+	assert.True(t, referencesSecret(lb, "backend-ca"))
+
+	for _, tt := range []struct {
+		key, value, reason string
+	}{
+		{AnnotationKeyBackendProtocolPrefix + "http", "HTTP", "InvalidBackendProtocol"},
+		{AnnotationKeyBackendProtocolPrefix + "70000", "HTTP", "InvalidBackendProtocol"},
+		{AnnotationKeyBackendProtocolPrefix + "80", "GRPC", "InvalidBackendProtocol"},
+		{AnnotationKeyBackendProtocolPrefix + "8080", "HTTP", "InvalidBackendProtocol"},
+		{AnnotationKeyBackendCASecretPrefix + "80", "", "InvalidBackendProtocol"},
+		{AnnotationKeyBackendProtocolPrefix + "443", "TCP", "ConflictingBackendProtocol"},
+		{AnnotationKeyBackendProtocolPrefix + "6443", "HTTPS", "ConflictingBackendProtocol"},
+		// the protocol of the port defaults to HTTP
+		{AnnotationKeyBackendCASecretPrefix + "80", "backend-ca", "ConflictingBackendProtocol"},
+	} {
+		old, ok := lb.Annotations[tt.key]
+		lb.Annotations[tt.key] = tt.value
+		_, err = GetBackendProtocols(lb)
+		if assert.True(t, IsPermanentError(err), tt.key) {
+			assert.Equal(t, tt.reason, err.(*PermanentError).Reason, tt.key)
+		}
+		delete(lb.Annotations, tt.key)
+		if ok {
+			lb.Annotations[tt.key] = old
+		}
+	}
+}
+
+func TestGetBackendCA(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := v1listers.NewSecretLister(indexer)
+	ca, _ := newTestCertificate(t, time.Now().Add(time.Hour))
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "backend-ca"},
+		Data:       map[string][]byte{BackendCAKey: ca},
+	}
+	indexer.Add(secret)
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+
+	got, err := GetBackendCA(lb, secrets, "backend-ca")
+	assert.Nil(t, err)
+	assert.Equal(t, ca, got)
+
+	_, err = GetBackendCA(lb, secrets, "missing")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "BackendCASecretNotFound", err.(*PermanentError).Reason)
+
+	secret.Data[BackendCAKey] = []byte("invalid")
+	_, err = GetBackendCA(lb, secrets, "backend-ca")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "InvalidBackendCASecret", err.(*PermanentError).Reason)
+}
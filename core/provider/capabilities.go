@@ -0,0 +1,238 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// Feature is an optional feature of the LoadBalancer a backend may support
+type Feature string
+
+const (
+	// FeatureHTTP terminates HTTP on the ports of AnnotationKeyHTTPPorts
+	FeatureHTTP Feature = "http"
+	// FeatureTCPProxy proxies TCP on the ports of AnnotationKeyTCPPorts
+	FeatureTCPProxy Feature = "tcp-proxy"
+	// FeatureProxyProtocol accepts or sends the PROXY protocol of
+	// AnnotationKeyProxyProtocol
+	FeatureProxyProtocol Feature = "proxy-protocol"
+	// FeaturePersistence keeps the server of a client by
+	// AnnotationKeyPersistence
+	FeaturePersistence Feature = "persistence"
+	// FeatureAccessLog logs the requests by AnnotationKeyAccessLog
+	FeatureAccessLog Feature = "access-log"
+	// FeatureSourceRanges allows the clients of AnnotationKeySourceRanges
+	// only
+	FeatureSourceRanges Feature = "source-ranges"
+	// FeatureLocalTraffic routes to the real servers restricted by the
+	// Local traffic policy of AnnotationKeyTrafficPolicy
+	FeatureLocalTraffic Feature = "local-traffic"
+	// FeatureBackendProtocol proxies the HTTP and TCP ports to the backends
+	// by AnnotationKeyBackendProtocolPrefix
+	FeatureBackendProtocol Feature = "backend-protocol"
+	// FeatureMaxConnections caps the concurrent connections by
+	// AnnotationKeyRateLimit
+	FeatureMaxConnections Feature = "max-connections"
+	// FeatureConnectionRate caps the new connections per second by
+	// AnnotationKeyRateLimit
+	FeatureConnectionRate Feature = "connection-rate"
+	// FeatureRequestRate caps the HTTP requests per second by
+	// AnnotationKeyRateLimit
+	FeatureRequestRate Feature = "request-rate"
+	// FeatureEndpointPorts routes the ports of AnnotationKeyEndpointPorts
+	// to the endpoints of the Services
+	FeatureEndpointPorts Feature = "endpoint-ports"
+	// FeatureHTTPHosts routes the hosts of the ports of
+	// AnnotationKeyHTTPPorts to their own Services
+	FeatureHTTPHosts Feature = "http-hosts"
+	// FeatureSSLRedirect redirects the http ports to https by
+	// AnnotationKeySSLRedirect
+	FeatureSSLRedirect Feature = "ssl-redirect"
+)
+
+// Capabilities are what a backend supports, the LoadBalancers requesting
+// others are rejected before OnUpdate
+type Capabilities struct {
+	// Protocols are the protocols of AnnotationKeyPorts, any if empty
+	Protocols []string `json:"protocols,omitempty"`
+	// Families are the address families of the VIPs, the ones of the
+	// FamilyProvider if empty
+	Families []corenet.Family `json:"families,omitempty"`
+	Features []Feature        `json:"features,omitempty"`
+	// MaxPorts bounds the ports of the LoadBalancer, unbounded if zero
+	MaxPorts int `json:"maxPorts,omitempty"`
+}
+
+// HasFeature returns true if the feature is supported
+func (c *Capabilities) HasFeature(f Feature) bool {
+	for _, feature := range c.Features {
+		if feature == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) hasProtocol(protocol string) bool {
+	if len(c.Protocols) == 0 {
+		return true
+	}
+	for _, p := range c.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateCapabilities returns a PermanentError if the LoadBalancer
+// requests what the capabilities do not support, all is supported with nil
+// capabilities
+func ValidateCapabilities(lb *netv1alpha1.LoadBalancer, c *Capabilities) error {
+	if c == nil {
+		return nil
+	}
+	for _, fk := range []struct {
+		feature Feature
+		key     string
+	}{
+		{FeatureHTTP, AnnotationKeyHTTPPorts},
+		{FeatureTCPProxy, AnnotationKeyTCPPorts},
+		{FeatureProxyProtocol, AnnotationKeyProxyProtocol},
+		{FeatureSourceRanges, AnnotationKeySourceRanges},
+		{FeatureEndpointPorts, AnnotationKeyEndpointPorts},
+	} {
+		if _, ok := lb.Annotations[fk.key]; ok && !c.HasFeature(fk.feature) {
+			return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", fk.feature, fk.key))
+		}
+	}
+	persistence, err := GetPersistence(lb)
+	if err != nil {
+		return err
+	}
+	if persistence != nil && persistence.Enabled && !c.HasFeature(FeaturePersistence) {
+		return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", FeaturePersistence, AnnotationKeyPersistence))
+	}
+	accessLog, err := GetAccessLog(lb)
+	if err != nil {
+		return err
+	}
+	if accessLog != nil && accessLog.Enabled && !c.HasFeature(FeatureAccessLog) {
+		return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", FeatureAccessLog, AnnotationKeyAccessLog))
+	}
+	sslRedirect, err := GetSSLRedirect(lb)
+	if err != nil {
+		return err
+	}
+	if sslRedirect != nil && !c.HasFeature(FeatureSSLRedirect) {
+		return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", FeatureSSLRedirect, AnnotationKeySSLRedirect))
+	}
+	policy, _, err := GetTrafficPolicy(lb)
+	if err != nil {
+		return err
+	}
+	if policy == TrafficPolicyLocal && !c.HasFeature(FeatureLocalTraffic) {
+		return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", FeatureLocalTraffic, AnnotationKeyTrafficPolicy))
+	}
+
+	rateLimit, err := GetRateLimit(lb)
+	if err != nil {
+		return err
+	}
+	if rateLimit != nil {
+		limits := []Limits{rateLimit.Limits}
+		for _, p := range rateLimit.Ports {
+			limits = append(limits, p.Limits)
+		}
+		for _, l := range limits {
+			for _, fl := range []struct {
+				feature Feature
+				limit   int
+			}{
+				{FeatureMaxConnections, l.MaxConnections},
+				{FeatureConnectionRate, l.ConnectionRate},
+				{FeatureRequestRate, l.RequestRate},
+			} {
+				if fl.limit != 0 && !c.HasFeature(fl.feature) {
+					return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", fl.feature, AnnotationKeyRateLimit))
+				}
+			}
+		}
+	}
+
+	// the providers forwarding the packets pass them through as they are
+	if hasBackendProtocols(lb) {
+		if c.HasFeature(FeatureBackendProtocol) {
+			if _, err := GetBackendProtocols(lb); err != nil {
+				return err
+			}
+		} else if c.HasFeature(FeatureHTTP) || c.HasFeature(FeatureTCPProxy) {
+			return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotations %s<port>", FeatureBackendProtocol, AnnotationKeyBackendProtocolPrefix))
+		}
+	}
+
+	count := 0
+	if _, ok := lb.Annotations[AnnotationKeyPorts]; ok {
+		ports, err := GetPorts(lb)
+		if err != nil {
+			return err
+		}
+		unsupported := make([]string, 0)
+		for _, p := range ports {
+			if !c.hasProtocol(p.Protocol) {
+				unsupported = append(unsupported, p.String())
+			}
+		}
+		if len(unsupported) > 0 {
+			return NewPermanentError("UnsupportedProtocol", fmt.Errorf("the provider does not support the ports %s, expect the protocols %s", strings.Join(unsupported, ", "), strings.Join(c.Protocols, ", ")))
+		}
+		count += len(ports)
+	}
+	httpPorts, err := GetHTTPPorts(lb)
+	if err != nil {
+		return err
+	}
+	tcpPorts, err := GetTCPPorts(lb)
+	if err != nil {
+		return err
+	}
+	for _, p := range httpPorts {
+		if len(p.Hosts) > 0 && !c.HasFeature(FeatureHTTPHosts) {
+			return NewPermanentError("UnsupportedFeature", fmt.Errorf("the provider does not support %s of the annotation %s", FeatureHTTPHosts, AnnotationKeyHTTPPorts))
+		}
+	}
+	count += len(httpPorts) + len(tcpPorts)
+	if c.MaxPorts > 0 && count > c.MaxPorts {
+		return NewPermanentError("TooManyPorts", fmt.Errorf("the provider supports at most %d ports, got %d", c.MaxPorts, count))
+	}
+	return nil
+}
+
+// ValidateBackend returns the error of the ValidatingProvider as a
+// PermanentError, since the LoadBalancer has to change to fix it
+func ValidateBackend(lb *netv1alpha1.LoadBalancer, v ValidatingProvider) error {
+	err := v.ValidateLoadBalancer(lb)
+	if err == nil || IsPermanentError(err) {
+		return err
+	}
+	return NewPermanentError("InvalidLoadBalancer", err)
+}
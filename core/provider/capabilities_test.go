@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type capabilitiesBackend struct {
+	Provider
+	capabilities *Capabilities
+}
+
+func (b *capabilitiesBackend) Info() Info {
+	return Info{Name: "fake", Capabilities: b.capabilities}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	l4 := &GenericProvider{cfg: &Configuration{Backend: &capabilitiesBackend{capabilities: &Capabilities{
+		Protocols: []string{"tcp"},
+		Families:  []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6},
+		Features:  []Feature{FeaturePersistence, FeatureLocalTraffic, FeatureMaxConnections},
+		MaxPorts:  2,
+	}}}}
+	l7 := &GenericProvider{cfg: &Configuration{Backend: &capabilitiesBackend{capabilities: &Capabilities{
+		Features: []Feature{FeatureHTTP, FeatureProxyProtocol, FeatureRequestRate},
+	}}}}
+	permissive := &GenericProvider{cfg: &Configuration{Backend: &capabilitiesBackend{}}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// the reasons of the errors of l4, l7 and the permissive one,
+		// empty if it is valid
+		reasons [3]string
+	}{
+		{"none", nil, [3]string{"", "", ""}},
+		{
+			"tcp ports",
+			map[string]string{AnnotationKeyPorts: `[{"protocol":"tcp","port":80},{"protocol":"tcp","port":443}]`},
+			[3]string{"", "", ""},
+		},
+		{
+			"udp port",
+			map[string]string{AnnotationKeyPorts: `[{"protocol":"udp","port":53}]`},
+			[3]string{"UnsupportedProtocol", "", ""},
+		},
+		{
+			"too many ports",
+			map[string]string{AnnotationKeyPorts: `[{"protocol":"tcp","port":80},{"protocol":"tcp","port":443},{"protocol":"tcp","port":8080}]`},
+			[3]string{"TooManyPorts", "", ""},
+		},
+		{
+			"http",
+			map[string]string{AnnotationKeyHTTPPorts: `[{"port":80,"protocol":"http","service":"web","servicePort":80}]`},
+			[3]string{"UnsupportedFeature", "", ""},
+		},
+		{
+			"http hosts",
+			map[string]string{AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]}]`},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"ssl redirect",
+			map[string]string{
+				AnnotationKeyHTTPPorts:   `[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`,
+				AnnotationKeySSLRedirect: "true",
+			},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"tcp proxy",
+			map[string]string{AnnotationKeyTCPPorts: `[{"port":3306,"service":"mysql","servicePort":3306}]`},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"proxy protocol",
+			map[string]string{AnnotationKeyProxyProtocol: `[{"port":80,"accept":true}]`},
+			[3]string{"UnsupportedFeature", "", ""},
+		},
+		{
+			"persistence",
+			map[string]string{AnnotationKeyPersistence: `{"enabled":true}`},
+			[3]string{"", "UnsupportedFeature", ""},
+		},
+		{
+			"access log",
+			map[string]string{AnnotationKeyAccessLog: `{"enabled":true}`},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"source ranges",
+			map[string]string{AnnotationKeySourceRanges: "10.0.0.0/8"},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"local traffic",
+			map[string]string{AnnotationKeyTrafficPolicy: "Local"},
+			[3]string{"", "UnsupportedFeature", ""},
+		},
+		{
+			"cluster traffic",
+			map[string]string{AnnotationKeyTrafficPolicy: "Cluster"},
+			[3]string{"", "", ""},
+		},
+		{
+			"backend protocol",
+			map[string]string{
+				AnnotationKeyHTTPPorts:                    `[{"port":80,"protocol":"http","service":"web","servicePort":80}]`,
+				AnnotationKeyBackendProtocolPrefix + "80": "HTTPS",
+			},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			// the packets of the ports are forwarded as they are
+			"backend protocol of forwarded port",
+			map[string]string{
+				AnnotationKeyPorts:                         `[{"protocol":"tcp","port":443}]`,
+				AnnotationKeyBackendProtocolPrefix + "443": "HTTPS",
+			},
+			[3]string{"", "UnsupportedFeature", ""},
+		},
+		{
+			"max connections",
+			map[string]string{AnnotationKeyRateLimit: `{"maxConnections":1000}`},
+			[3]string{"", "UnsupportedFeature", ""},
+		},
+		{
+			"request rate of port",
+			map[string]string{AnnotationKeyRateLimit: `{"ports":[{"port":80,"requestRate":100}]}`},
+			[3]string{"UnsupportedFeature", "", ""},
+		},
+		{
+			"connection rate",
+			map[string]string{AnnotationKeyRateLimit: `{"connectionRate":100}`},
+			[3]string{"UnsupportedFeature", "UnsupportedFeature", ""},
+		},
+		{
+			"invalid rate limit",
+			map[string]string{AnnotationKeyRateLimit: `{"maxConnections":-1}`},
+			[3]string{"InvalidRateLimit", "InvalidRateLimit", ""},
+		},
+		{
+			"persistence disabled",
+			map[string]string{AnnotationKeyPersistence: `{"enabled":false}`},
+			[3]string{"", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+		for i, p := range []*GenericProvider{l4, l7, permissive} {
+			err := p.checkCapabilities(lb)
+			if tt.reasons[i] == "" {
+				assert.Nil(t, err, "%s %d", tt.name, i)
+				continue
+			}
+			if assert.True(t, IsPermanentError(err), "%s %d", tt.name, i) {
+				assert.Equal(t, tt.reasons[i], err.(*PermanentError).Reason, "%s %d", tt.name, i)
+			}
+		}
+	}
+
+	// the families of the capabilities take precedence
+	lb := &netv1alpha1.LoadBalancer{}
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "2001:db8::1"}
+	assert.Nil(t, l4.checkFamilies(lb))
+	assert.NotNil(t, l7.checkFamilies(lb))
+	assert.NotNil(t, permissive.checkFamilies(lb))
+}
+
+// validatingBackend rejects the LoadBalancers with the error
+type validatingBackend struct {
+	capabilitiesBackend
+	err error
+}
+
+func (b *validatingBackend) ValidateLoadBalancer(*netv1alpha1.LoadBalancer) error {
+	return b.err
+}
+
+func TestValidateBackend(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	p := &GenericProvider{cfg: &Configuration{}}
+	p.setBackend(&capabilitiesBackend{})
+	assert.Nil(t, p.validateBackend(lb))
+
+	p.setBackend(&validatingBackend{})
+	assert.Nil(t, p.validateBackend(lb))
+
+	// the errors are permanent, with their own reasons if any
+	p.setBackend(&validatingBackend{err: fmt.Errorf("unsupported combination")})
+	err := p.validateBackend(lb)
+	if assert.True(t, IsPermanentError(err)) {
+		assert.Equal(t, "InvalidLoadBalancer", err.(*PermanentError).Reason)
+		assert.EqualError(t, err, "unsupported combination")
+	}
+	p.setBackend(&validatingBackend{err: NewPermanentError("ConflictingPorts", fmt.Errorf("conflict"))})
+	err = p.validateBackend(lb)
+	if assert.True(t, IsPermanentError(err)) {
+		assert.Equal(t, "ConflictingPorts", err.(*PermanentError).Reason)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	p := &GenericProvider{cfg: &Configuration{Backend: &capabilitiesBackend{capabilities: &Capabilities{
+		Features: []Feature{FeatureHTTP},
+	}}}}
+	w := httptest.NewRecorder()
+	p.VersionHandler().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	info := Info{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, Info{Name: "fake", Capabilities: &Capabilities{
+		Families: []corenet.Family{corenet.FamilyIPv4},
+		Features: []Feature{FeatureHTTP},
+	}}, info)
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chaos wraps a backend in a Provider injecting faults, for
+// verifying the behavior of the GenericProvider under a misbehaving backend:
+// failed and slow syncs, panics, slow starts and flapping health. The faults
+// are drawn from random streams seeded by the policy, so that a run is
+// reproduced by its seed.
+package chaos
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+)
+
+var (
+	_ core.Provider         = &ChaosProvider{}
+	_ core.DeletionProvider = &ChaosProvider{}
+	_ core.HealthzProvider  = &ChaosProvider{}
+	_ core.Wrapper          = &ChaosProvider{}
+)
+
+// Distribution is the distribution of the injected latency
+type Distribution string
+
+const (
+	// DistributionFixed delays by Min, DistributionUniform by a duration
+	// uniformly distributed in [Min, Max), DistributionExponential by Min
+	// plus an exponentially distributed duration of the mean Mean, capped
+	// at Max if it is set
+	DistributionFixed       Distribution = "fixed"
+	DistributionUniform     Distribution = "uniform"
+	DistributionExponential Distribution = "exponential"
+
+	// FaultUpdateError, FaultDeleteError, FaultPanic, FaultLatency,
+	// FaultStartDelay and FaultHealthz are the kinds of the injected faults
+	FaultUpdateError = "UpdateError"
+	FaultDeleteError = "DeleteError"
+	FaultPanic       = "Panic"
+	FaultLatency     = "Latency"
+	FaultStartDelay  = "StartDelay"
+	FaultHealthz     = "Healthz"
+)
+
+var (
+	injectedFaults = metrics.NewCounterVec(
+		"loadbalancer_provider_chaos_faults_total",
+		"Number of the faults injected into the backend by kind",
+		"fault",
+	)
+)
+
+func init() {
+	metrics.MustRegister(injectedFaults)
+}
+
+// Latency is the latency injected into the syncs
+type Latency struct {
+	Distribution Distribution
+	Min          time.Duration
+	Max          time.Duration
+	Mean         time.Duration
+	// Rate is the probability of a sync to be delayed
+	Rate float64
+}
+
+// ChaosPolicy is the policy of the faults injected by a ChaosProvider, the
+// rates are probabilities in [0, 1]. The zero value injects none.
+type ChaosPolicy struct {
+	// Seed seeds the random streams of the faults, a random seed is
+	// chosen and logged if it is zero
+	Seed int64
+	// UpdateErrorRate and DeleteErrorRate are the probabilities of OnUpdate
+	// and OnDelete to fail without calling the backend
+	UpdateErrorRate float64
+	DeleteErrorRate float64
+	// PanicRate is the probability of OnUpdate to panic without calling
+	// the backend
+	PanicRate float64
+	// Latency delays OnUpdate and OnDelete before anything else
+	Latency Latency
+	// StartDelay delays WaitForStart
+	StartDelay time.Duration
+	// HealthzFlapRate is the probability of Healthz to report the backend
+	// unhealthy without asking it
+	HealthzFlapRate float64
+}
+
+// Faults are the numbers of the faults injected by a ChaosProvider
+type Faults struct {
+	UpdateErrors    int `json:"updateErrors"`
+	DeleteErrors    int `json:"deleteErrors"`
+	Panics          int `json:"panics"`
+	Delays          int `json:"delays"`
+	StartDelays     int `json:"startDelays"`
+	HealthzFailures int `json:"healthzFailures"`
+}
+
+// InjectedError is an error injected by a ChaosProvider
+type InjectedError struct {
+	Fault string
+}
+
+// Error implements error
+func (e *InjectedError) Error() string {
+	return fmt.Sprintf("chaos: injected %s", e.Fault)
+}
+
+// IsInjectedError returns true if the error is an InjectedError
+func IsInjectedError(err error) bool {
+	_, ok := err.(*InjectedError)
+	return ok
+}
+
+// stream is a random stream of a kind of fault, each kind draws from its
+// own so that the faults of a kind do not depend on the calls of the others
+type stream struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newStream(seed int64) *stream {
+	return &stream{rand: rand.New(rand.NewSource(seed))}
+}
+
+// roll returns true with the probability rate
+func (s *stream) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < rate
+}
+
+// duration returns a duration of the distribution of the latency
+func (s *stream) duration(l Latency) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch l.Distribution {
+	case DistributionUniform:
+		if l.Max <= l.Min {
+			return l.Min
+		}
+		return l.Min + time.Duration(s.rand.Int63n(int64(l.Max-l.Min)))
+	case DistributionExponential:
+		d := l.Min + time.Duration(s.rand.ExpFloat64()*float64(l.Mean))
+		if l.Max > 0 && d > l.Max {
+			d = l.Max
+		}
+		return d
+	}
+	return l.Min
+}
+
+// ChaosProvider is a Provider injecting the faults of its ChaosPolicy into
+// the calls of the wrapped backend. The optional interfaces of the backend
+// but DeletionProvider and HealthzProvider are detected on the backend, see
+// core.Wrapper. It is safe for concurrent use.
+type ChaosProvider struct {
+	inner  core.Provider
+	policy ChaosPolicy
+	sleep  func(time.Duration)
+
+	updateErrors *stream
+	deleteErrors *stream
+	panics       *stream
+	latency      *stream
+	healthz      *stream
+
+	mu     sync.Mutex
+	faults Faults
+}
+
+// WrapProvider returns a ChaosProvider injecting the faults of the policy
+// into the calls of inner
+func WrapProvider(inner core.Provider, policy ChaosPolicy) *ChaosProvider {
+	if policy.Seed == 0 {
+		policy.Seed = time.Now().UnixNano()
+	}
+	log.Warn("Injecting faults into the backend", log.Fields{"seed": policy.Seed, "policy": fmt.Sprintf("%+v", policy)})
+	return &ChaosProvider{
+		inner:        inner,
+		policy:       policy,
+		sleep:        time.Sleep,
+		updateErrors: newStream(policy.Seed),
+		deleteErrors: newStream(policy.Seed + 1),
+		panics:       newStream(policy.Seed + 2),
+		latency:      newStream(policy.Seed + 3),
+		healthz:      newStream(policy.Seed + 4),
+	}
+}
+
+// Wrap wraps inner in a ChaosProvider of the policy parsed from spec, see
+// ParsePolicy. It returns inner itself if spec is empty.
+func Wrap(inner core.Provider, spec string) (core.Provider, error) {
+	if spec == "" {
+		return inner, nil
+	}
+	policy, err := ParsePolicy(spec)
+	if err != nil {
+		return nil, err
+	}
+	return WrapProvider(inner, policy), nil
+}
+
+// Unwrap implements core.Wrapper
+func (c *ChaosProvider) Unwrap() core.Provider {
+	return c.inner
+}
+
+// Policy returns the policy with the seed used
+func (c *ChaosProvider) Policy() ChaosPolicy {
+	return c.policy
+}
+
+// Faults returns the numbers of the faults injected
+func (c *ChaosProvider) Faults() Faults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.faults
+}
+
+// inject counts the fault of the kind
+func (c *ChaosProvider) inject(fault string) {
+	c.mu.Lock()
+	switch fault {
+	case FaultUpdateError:
+		c.faults.UpdateErrors++
+	case FaultDeleteError:
+		c.faults.DeleteErrors++
+	case FaultPanic:
+		c.faults.Panics++
+	case FaultLatency:
+		c.faults.Delays++
+	case FaultStartDelay:
+		c.faults.StartDelays++
+	case FaultHealthz:
+		c.faults.HealthzFailures++
+	}
+	c.mu.Unlock()
+	injectedFaults.Inc(fault)
+}
+
+// delay delays the sync as the latency of the policy
+func (c *ChaosProvider) delay() {
+	if !c.latency.roll(c.policy.Latency.Rate) {
+		return
+	}
+	d := c.latency.duration(c.policy.Latency)
+	c.inject(FaultLatency)
+	c.sleep(d)
+}
+
+// OnUpdate fails or panics as the policy, or updates the backend
+func (c *ChaosProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	c.delay()
+	if c.panics.roll(c.policy.PanicRate) {
+		c.inject(FaultPanic)
+		panic(&InjectedError{Fault: FaultPanic})
+	}
+	if c.updateErrors.roll(c.policy.UpdateErrorRate) {
+		c.inject(FaultUpdateError)
+		return &InjectedError{Fault: FaultUpdateError}
+	}
+	return c.inner.OnUpdate(lb)
+}
+
+// OnDelete implements core.DeletionProvider, it fails as the policy or
+// calls the backend if it is a DeletionProvider
+func (c *ChaosProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	c.delay()
+	if c.deleteErrors.roll(c.policy.DeleteErrorRate) {
+		c.inject(FaultDeleteError)
+		return &InjectedError{Fault: FaultDeleteError}
+	}
+	if d, ok := c.inner.(core.DeletionProvider); ok {
+		return d.OnDelete(lb)
+	}
+	return nil
+}
+
+// Healthz implements core.HealthzProvider, it flaps as the policy or asks
+// the backend if it is a HealthzProvider
+func (c *ChaosProvider) Healthz() error {
+	if c.healthz.roll(c.policy.HealthzFlapRate) {
+		c.inject(FaultHealthz)
+		return &InjectedError{Fault: FaultHealthz}
+	}
+	if h, ok := c.inner.(core.HealthzProvider); ok {
+		return h.Healthz()
+	}
+	return nil
+}
+
+// WaitForStart waits for the backend after the start delay of the policy
+func (c *ChaosProvider) WaitForStart() bool {
+	if c.policy.StartDelay > 0 {
+		c.inject(FaultStartDelay)
+		c.sleep(c.policy.StartDelay)
+	}
+	return c.inner.WaitForStart()
+}
+
+// Start starts the backend
+func (c *ChaosProvider) Start() {
+	c.inner.Start()
+}
+
+// Stop stops the backend
+func (c *ChaosProvider) Stop() error {
+	return c.inner.Stop()
+}
+
+// Info returns the information of the backend
+func (c *ChaosProvider) Info() core.Info {
+	return c.inner.Info()
+}
+
+// SetListers sets the listers of the backend
+func (c *ChaosProvider) SetListers(lister core.StoreLister) {
+	c.inner.SetListers(lister)
+}
+
+// validRate returns an error if the rate is not a probability
+func validRate(name string, rate float64) error {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return fmt.Errorf("invalid %s %v, expect a probability in [0, 1]", name, rate)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	seed  = 42
+	calls = 10000
+)
+
+func TestParsePolicy(t *testing.T) {
+	policy, err := ParsePolicy("seed=42, update-error-rate=0.1,delete-error-rate=0.2,panic-rate=0.01,latency=uniform:10ms-200ms,start-delay=5s,healthz-flap-rate=0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, ChaosPolicy{
+		Seed:            42,
+		UpdateErrorRate: 0.1,
+		DeleteErrorRate: 0.2,
+		PanicRate:       0.01,
+		Latency:         Latency{Distribution: DistributionUniform, Min: 10 * time.Millisecond, Max: 200 * time.Millisecond, Rate: 1},
+		StartDelay:      5 * time.Second,
+		HealthzFlapRate: 0.5,
+	}, policy)
+
+	policy, err = ParsePolicy("latency-rate=0.3,latency=exponential:50ms-1s")
+	assert.Nil(t, err)
+	assert.Equal(t, Latency{Distribution: DistributionExponential, Mean: 50 * time.Millisecond, Max: time.Second, Rate: 0.3}, policy.Latency)
+
+	policy, err = ParsePolicy("")
+	assert.Nil(t, err)
+	assert.Equal(t, ChaosPolicy{}, policy)
+
+	for _, spec := range []string{
+		"update-error-rate",
+		"update-error-rate=1.5",
+		"panic-rate=-0.1",
+		"healthz-flap-rate=often",
+		"seed=x",
+		"latency=100ms",
+		"latency=fixed:10ms-20ms",
+		"latency=uniform:20ms-10ms",
+		"latency=normal:10ms",
+		"start-delay=5",
+		"crash-rate=0.1",
+	} {
+		_, err := ParsePolicy(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	p, err := Wrap(backend, "")
+	assert.Nil(t, err)
+	assert.Equal(t, backend, p)
+
+	p, err = Wrap(backend, "seed=1,update-error-rate=0.5")
+	assert.Nil(t, err)
+	if assert.IsType(t, &ChaosProvider{}, p) {
+		assert.Equal(t, backend, p.(*ChaosProvider).Unwrap())
+		assert.Equal(t, int64(1), p.(*ChaosProvider).Policy().Seed)
+	}
+	// the optional interfaces of the backend are kept
+	assert.Equal(t, core.DetectExtensions(backend), core.DetectExtensions(p))
+
+	_, err = Wrap(backend, "update-error-rate=2")
+	assert.NotNil(t, err)
+}
+
+func TestFaultRates(t *testing.T) {
+	lb := providertesting.NewLoadBalancer("10.0.0.100")
+	tests := []struct {
+		name   string
+		policy ChaosPolicy
+		rate   float64
+		// call calls the provider once and returns whether a fault was
+		// injected
+		call   func(c *ChaosProvider, slept *int) bool
+		faults func(Faults) int
+	}{
+		{
+			name:   "update error",
+			policy: ChaosPolicy{UpdateErrorRate: 0.2},
+			rate:   0.2,
+			call: func(c *ChaosProvider, slept *int) bool {
+				return IsInjectedError(c.OnUpdate(lb))
+			},
+			faults: func(f Faults) int { return f.UpdateErrors },
+		},
+		{
+			name:   "delete error",
+			policy: ChaosPolicy{DeleteErrorRate: 0.5},
+			rate:   0.5,
+			call: func(c *ChaosProvider, slept *int) bool {
+				return IsInjectedError(c.OnDelete(lb))
+			},
+			faults: func(f Faults) int { return f.DeleteErrors },
+		},
+		{
+			name:   "panic",
+			policy: ChaosPolicy{PanicRate: 0.05},
+			rate:   0.05,
+			call: func(c *ChaosProvider, slept *int) (injected bool) {
+				defer func() {
+					if r := recover(); r != nil {
+						injected = true
+					}
+				}()
+				c.OnUpdate(lb)
+				return false
+			},
+			faults: func(f Faults) int { return f.Panics },
+		},
+		{
+			name:   "latency",
+			policy: ChaosPolicy{Latency: Latency{Distribution: DistributionFixed, Min: time.Millisecond, Rate: 0.3}},
+			rate:   0.3,
+			call: func(c *ChaosProvider, slept *int) bool {
+				before := *slept
+				c.OnUpdate(lb)
+				return *slept > before
+			},
+			faults: func(f Faults) int { return f.Delays },
+		},
+		{
+			name:   "healthz flapping",
+			policy: ChaosPolicy{HealthzFlapRate: 0.1},
+			rate:   0.1,
+			call: func(c *ChaosProvider, slept *int) bool {
+				return IsInjectedError(c.Healthz())
+			},
+			faults: func(f Faults) int { return f.HealthzFailures },
+		},
+	}
+
+	for _, tt := range tests {
+		// the faults of the same seed are the same
+		var runs [2][]bool
+		for i := range runs {
+			backend := fake.NewFakeProvider("fake")
+			tt.policy.Seed = seed
+			c := WrapProvider(backend, tt.policy)
+			slept := 0
+			c.sleep = func(time.Duration) { slept++ }
+
+			injected := 0
+			for n := 0; n < calls; n++ {
+				fault := tt.call(c, &slept)
+				if fault {
+					injected++
+				}
+				runs[i] = append(runs[i], fault)
+			}
+			assert.Equal(t, injected, tt.faults(c.Faults()), tt.name)
+			assert.InDelta(t, tt.rate, float64(injected)/calls, 0.02, tt.name)
+		}
+		assert.Equal(t, runs[0], runs[1], tt.name)
+	}
+}
+
+func TestNoFaults(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.SetHealthz(fmt.Errorf("down"))
+	c := WrapProvider(backend, ChaosPolicy{Seed: seed})
+	c.sleep = func(time.Duration) { t.Fatalf("unexpected sleep") }
+	lb := providertesting.NewLoadBalancer("10.0.0.100")
+
+	for n := 0; n < 100; n++ {
+		assert.Nil(t, c.OnUpdate(lb))
+	}
+	assert.Nil(t, c.OnDelete(lb))
+	assert.EqualError(t, c.Healthz(), "down")
+	assert.True(t, c.WaitForStart())
+	assert.Equal(t, Faults{}, c.Faults())
+	assert.Equal(t, 100, backend.CallCount(fake.MethodOnUpdate))
+	assert.Equal(t, 1, backend.CallCount(fake.MethodOnDelete))
+}
+
+func TestStartDelay(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	c := WrapProvider(backend, ChaosPolicy{Seed: seed, StartDelay: time.Minute})
+	var slept time.Duration
+	c.sleep = func(d time.Duration) { slept += d }
+
+	assert.True(t, c.WaitForStart())
+	assert.Equal(t, time.Minute, slept)
+	assert.Equal(t, 1, c.Faults().StartDelays)
+	assert.Equal(t, 1, backend.CallCount(fake.MethodWaitForStart))
+}
+
+func TestLatencyDistributions(t *testing.T) {
+	tests := []struct {
+		latency  Latency
+		min, max time.Duration
+		mean     time.Duration
+	}{
+		{Latency{Distribution: DistributionFixed, Min: 10 * time.Millisecond}, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+		{Latency{Distribution: DistributionUniform, Min: 10 * time.Millisecond, Max: 30 * time.Millisecond}, 10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond},
+		{Latency{Distribution: DistributionExponential, Mean: 20 * time.Millisecond}, 0, time.Hour, 20 * time.Millisecond},
+		{Latency{Distribution: DistributionExponential, Mean: 20 * time.Millisecond, Max: 25 * time.Millisecond}, 0, 25 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		s := newStream(seed)
+		var sum time.Duration
+		for n := 0; n < calls; n++ {
+			d := s.duration(tt.latency)
+			assert.True(t, d >= tt.min && d <= tt.max, "%v: %v out of [%v, %v]", tt.latency, d, tt.min, tt.max)
+			sum += d
+		}
+		if tt.mean > 0 {
+			assert.InDelta(t, float64(tt.mean), float64(sum/calls), float64(tt.mean)/20, "%v", tt.latency)
+		}
+	}
+}
+
+func TestChaosProviderWithHarness(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	c := WrapProvider(backend, ChaosPolicy{Seed: seed, UpdateErrorRate: 0.5})
+	env := providertesting.NewTestEnv(t, c)
+	defer env.Stop()
+
+	// the injected errors are retried until the backend is updated
+	lb := providertesting.NewLoadBalancer("10.0.0.100")
+	if _, err := env.TPRClient.NetworkingV1alpha1().LoadBalancers(lb.Namespace).Create(lb); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, backend.WaitForOnUpdateCount(1, env.Timeout))
+	assert.Contains(t, env.Provider.Info().Extensions, "StateReporter")
+}
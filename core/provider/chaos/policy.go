@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParsePolicy parses a ChaosPolicy from the comma separated key=value
+// pairs of spec, e.g.
+//
+//	seed=42,update-error-rate=0.1,panic-rate=0.01,latency=uniform:10ms-200ms
+//
+// The keys are seed, update-error-rate, delete-error-rate, panic-rate,
+// latency, latency-rate, start-delay and healthz-flap-rate. The latency is
+// fixed:D, uniform:MIN-MAX or exponential:MEAN with an optional cap as
+// exponential:MEAN-MAX, every sync is delayed unless latency-rate is set.
+func ParsePolicy(spec string) (ChaosPolicy, error) {
+	policy := ChaosPolicy{}
+	latencyRate := -1.0
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return policy, fmt.Errorf("invalid chaos policy %q, expect key=value", pair)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "seed":
+			policy.Seed, err = strconv.ParseInt(value, 10, 64)
+		case "update-error-rate":
+			policy.UpdateErrorRate, err = parseRate(key, value)
+		case "delete-error-rate":
+			policy.DeleteErrorRate, err = parseRate(key, value)
+		case "panic-rate":
+			policy.PanicRate, err = parseRate(key, value)
+		case "healthz-flap-rate":
+			policy.HealthzFlapRate, err = parseRate(key, value)
+		case "latency-rate":
+			latencyRate, err = parseRate(key, value)
+		case "latency":
+			policy.Latency, err = parseLatency(value)
+		case "start-delay":
+			policy.StartDelay, err = time.ParseDuration(value)
+		default:
+			return policy, fmt.Errorf("unknown chaos policy key %q", key)
+		}
+		if err != nil {
+			return policy, fmt.Errorf("invalid chaos policy %q: %v", pair, err)
+		}
+	}
+	if policy.Latency.Distribution != "" {
+		policy.Latency.Rate = 1
+	}
+	if latencyRate >= 0 {
+		policy.Latency.Rate = latencyRate
+	}
+	return policy, nil
+}
+
+func parseRate(name, value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return rate, validRate(name, rate)
+}
+
+// parseLatency parses fixed:D, uniform:MIN-MAX or exponential:MEAN[-MAX]
+func parseLatency(value string) (Latency, error) {
+	l := Latency{}
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return l, fmt.Errorf("expect distribution:durations")
+	}
+	bounds := strings.SplitN(parts[1], "-", 2)
+	durations := make([]time.Duration, 0, 2)
+	for _, b := range bounds {
+		d, err := time.ParseDuration(b)
+		if err != nil {
+			return l, err
+		}
+		if d < 0 {
+			return l, fmt.Errorf("negative latency %v", d)
+		}
+		durations = append(durations, d)
+	}
+
+	l.Distribution = Distribution(parts[0])
+	switch l.Distribution {
+	case DistributionFixed:
+		if len(durations) != 1 {
+			return l, fmt.Errorf("expect fixed:D")
+		}
+		l.Min = durations[0]
+	case DistributionUniform:
+		if len(durations) != 2 || durations[1] < durations[0] {
+			return l, fmt.Errorf("expect uniform:MIN-MAX")
+		}
+		l.Min, l.Max = durations[0], durations[1]
+	case DistributionExponential:
+		l.Mean = durations[0]
+		if len(durations) == 2 {
+			l.Max = durations[1]
+		}
+	default:
+		return l, fmt.Errorf("unknown distribution %q", parts[0])
+	}
+	return l, nil
+}
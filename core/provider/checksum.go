@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+)
+
+const (
+	// AnnotationKeyForceResync forces the providers to write and apply
+	// their configuration on the next sync even if it is unchanged, the
+	// value is arbitrary and any change of it forces another sync, e.g. a
+	// timestamp
+	AnnotationKeyForceResync = "loadbalancer.caicloud.io/force-resync"
+)
+
+var (
+	skippedSyncs = metrics.NewCounterVec(
+		"loadbalancer_provider_skipped_syncs_total",
+		"Number of syncs whose rendered configuration was applied already, nothing is written or reloaded",
+		"backend",
+	)
+	appliedSyncs = metrics.NewCounterVec(
+		"loadbalancer_provider_applied_syncs_total",
+		"Number of syncs whose rendered configuration was written and applied",
+		"backend",
+	)
+)
+
+func init() {
+	metrics.MustRegister(skippedSyncs, appliedSyncs)
+}
+
+// Checksum short-circuits the syncs of a backend rendering its
+// configuration: a sync whose rendered configuration hashes to the last one
+// applied successfully writes and reloads nothing, unless the LoadBalancer
+// forces a resync by AnnotationKeyForceResync.
+type Checksum struct {
+	backend string
+
+	mu      sync.Mutex
+	applied string
+	force   string
+}
+
+// NewChecksum returns a Checksum counting the syncs of the backend
+func NewChecksum(backend string) *Checksum {
+	return &Checksum{backend: backend}
+}
+
+// Sum returns the hash of the parts of a rendered configuration
+func Sum(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+		// separates the parts, the concatenation of others may be equal
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Forced returns true if the LoadBalancer forces a resync, the backends
+// apply their configuration even if it is unchanged
+func (c *Checksum) Forced(lb *netv1alpha1.LoadBalancer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return lb.Annotations[AnnotationKeyForceResync] != c.force
+}
+
+// Unchanged returns true if hash is the one applied last and the
+// LoadBalancer does not force a resync, the sync is counted as skipped
+func (c *Checksum) Unchanged(lb *netv1alpha1.LoadBalancer, hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.applied == "" || hash != c.applied || lb.Annotations[AnnotationKeyForceResync] != c.force {
+		return false
+	}
+	skippedSyncs.Inc(c.backend)
+	return true
+}
+
+// Applied records hash as applied successfully with the resync forced by
+// the LoadBalancer, and counts the sync as applied
+func (c *Checksum) Applied(lb *netv1alpha1.LoadBalancer, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = hash
+	c.force = lb.Annotations[AnnotationKeyForceResync]
+	appliedSyncs.Inc(c.backend)
+}
+
+// Invalidate forgets the hash applied last, the next sync writes and
+// applies the configuration. It is called when an apply fails since the
+// state of the dataplane is unknown.
+func (c *Checksum) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = ""
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestChecksum(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	c := NewChecksum("test")
+	hash := Sum([]byte("global"), []byte("frontend"))
+	assert.NotEqual(t, hash, Sum([]byte("globalfrontend")))
+
+	skipped, applied := skippedSyncs.Get("test"), appliedSyncs.Get("test")
+	// nothing is applied yet
+	assert.False(t, c.Unchanged(lb, hash))
+	c.Applied(lb, hash)
+	assert.True(t, c.Unchanged(lb, hash))
+	assert.False(t, c.Unchanged(lb, Sum([]byte("global"))))
+
+	// a forced resync bypasses the checksum once
+	lb.ObjectMeta = metav1.ObjectMeta{Annotations: map[string]string{AnnotationKeyForceResync: "1"}}
+	assert.True(t, c.Forced(lb))
+	assert.False(t, c.Unchanged(lb, hash))
+	c.Applied(lb, hash)
+	assert.False(t, c.Forced(lb))
+	assert.True(t, c.Unchanged(lb, hash))
+
+	c.Invalidate()
+	assert.False(t, c.Unchanged(lb, hash))
+
+	assert.Equal(t, float64(2), skippedSyncs.Get("test")-skipped)
+	assert.Equal(t, float64(2), appliedSyncs.Get("test")-applied)
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Condition is a condition of the LoadBalancer. The LoadBalancer status has
+// no conditions, so each of them is kept in an annotation in json.
+type Condition struct {
+	Status             v1.ConditionStatus `json:"status"`
+	Reason             string             `json:"reason"`
+	Message            string             `json:"message,omitempty"`
+	LastTransitionTime metav1.Time        `json:"lastTransitionTime"`
+}
+
+// GetCondition returns the condition in the annotation of the LoadBalancer,
+// nil if it is absent or invalid
+func GetCondition(lb *netv1alpha1.LoadBalancer, key string) *Condition {
+	v, ok := lb.Annotations[key]
+	if !ok {
+		return nil
+	}
+	cond := &Condition{}
+	if err := json.Unmarshal([]byte(v), cond); err != nil {
+		log.Warn("invalid condition", log.Fields{"key": key, "value": v, "err": err})
+		return nil
+	}
+	return cond
+}
+
+// setCondition updates the condition in the annotation of the LoadBalancer
+// if it changes, a Warning event is recorded if it turns false
+func (p *GenericProvider) setCondition(lb *netv1alpha1.LoadBalancer, key string, cond Condition) {
+	cur := GetCondition(lb, key)
+	if cur != nil && cur.Status == cond.Status && cur.Reason == cond.Reason && cur.Message == cond.Message {
+		return
+	}
+
+	if cond.Status == v1.ConditionFalse {
+		p.recorder.Event(lb, v1.EventTypeWarning, cond.Reason, cond.Message)
+	}
+	log.Info("Condition changed", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "condition": key, "reason": cond.Reason, "message": cond.Message})
+
+	cond.LastTransitionTime = metav1.Now()
+	if err := p.patchCondition(lb, key, cond); err != nil {
+		log.Error("update condition error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "condition": key, "err": err})
+	}
+}
+
+func (p *GenericProvider) patchCondition(lb *netv1alpha1.LoadBalancer, key string, cond Condition) error {
+	value, err := json.Marshal(cond)
+	if err != nil {
+		return err
+	}
+	return p.patchAnnotation(lb, key, string(value))
+}
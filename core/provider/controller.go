@@ -17,43 +17,187 @@ limitations under the License.
 package provider
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/zoumo/logdog"
 
 	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
-	"github.com/caicloud/loadbalancer-controller/pkg/informers"
 	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
-	"github.com/caicloud/loadbalancer-controller/pkg/tprclient"
 	controllerutil "github.com/caicloud/loadbalancer-controller/pkg/util/controller"
 	"github.com/caicloud/loadbalancer-controller/pkg/util/validation"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/healthcheck"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
 
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 	"k8s.io/client-go/util/workqueue"
 )
 
+// drainResyncPeriod is the resync period of the LoadBalancer while the
+// backend is draining real servers
+const drainResyncPeriod = 5 * time.Second
+
 // Configuration contains all the settings required by an LoadBalancer controller
+//
+// KubeClient, Backend, LoadBalancers, Nodes and StatusWriter are required,
+// NewLoadBalancerProvider returns an error if one of them is nil. The tpr
+// package fills the missing sources and StatusWriter from a TPR client.
 type Configuration struct {
-	KubeClient            kubernetes.Interface
-	TPRClient             tprclient.Interface
+	KubeClient kubernetes.Interface
+	// LoadBalancers, Nodes and StatusWriter are the sources of the
+	// LoadBalancers and the Nodes and the writer of their status. The
+	// provider waits for the sources to sync before starting the backend.
+	LoadBalancers LoadBalancerSource
+	Nodes         NodeSource
+	StatusWriter  StatusWriter
+	// Informers are started with the provider, e.g. the factory of the
+	// sources. The informers of the programs running their own are started
+	// by them instead.
+	Informers             []InformerStarter
 	Backend               Provider
 	LoadBalancerName      string
 	LoadBalancerNamespace string
+	// NodeIP is the address of the node the provider runs on, the MTU of
+	// its interface is the local MTU
+	NodeIP net.IP
+	// NodeName is the name of the node the provider runs on
+	NodeName string
+	// ExpectedMTU is the MTU all nodes of the LoadBalancer should have,
+	// the local MTU is expected if it is zero
+	ExpectedMTU int
+	// SkipMTUCheck disables the MTU consistency check of the nodes. The
+	// backends whose traffic does not pass the node the provider runs on,
+	// e.g. the ones programming a cloud load balancer, an appliance or the
+	// DNS, skip it.
+	SkipMTUCheck bool
+	// AddressTypes is the preference of the node address types used as
+	// the real servers, DefaultAddressTypes if it is empty
+	AddressTypes []v1.NodeAddressType
+	// LooseRPFilter sets the strict reverse path filtering of the
+	// interfaces of an InterfaceProvider backend to loose, and restores
+	// them on stop
+	LooseRPFilter bool
+	// WeightPolicy derives the weights of the real servers from the
+	// conditions of the nodes, DefaultWeightPolicy if it is nil
+	WeightPolicy WeightPolicy
+	// EligibilityPolicy excludes the nodes of the LoadBalancer from the
+	// real servers unless it includes the ineligible nodes by the
+	// annotation, DefaultEligibilityPolicy if it is nil
+	EligibilityPolicy *EligibilityPolicy
+	// HealthCheckInterval is the interval of the active health checks of
+	// the real servers, healthcheck.DefaultInterval if it is zero
+	HealthCheckInterval time.Duration
+	// HealthCheckWorkers bounds the concurrent health check probes,
+	// healthcheck.DefaultWorkers if it is zero
+	HealthCheckWorkers int
+	// VerifyReachability probes the ports of the VIPs after every
+	// successful sync, and rechecks periodically while they are not
+	// reachable
+	VerifyReachability bool
+	// WatchServices watches the Services and Endpoints in the namespace of
+	// the LoadBalancer for the backends proxying to them, the listers of
+	// the StoreLister are nil otherwise
+	WatchServices bool
+	// ReportServiceStatus sets the ingress points of the LoadBalancer on
+	// the status of the Services of type LoadBalancer it exposes and owns,
+	// and clears them once it is deleted, it implies WatchServices
+	ReportServiceStatus bool
+	// ConfigMaps are the names of the ConfigMaps in the namespace of the
+	// LoadBalancer the backend reads, it is resynced when they change. The
+	// ConfigMaps are not watched if it is empty, the lister of the
+	// StoreLister is nil then.
+	ConfigMaps []string
+	// AddressPools is the namespace/name of the ConfigMap of the address
+	// pools the VIPs of the LoadBalancers requesting one by annotation are
+	// allocated from, the VIPs are not allocated if it is empty
+	AddressPools string
+	// RecordPath is the file the inputs and the results of the syncs are
+	// recorded to for replaying them offline, the syncs are not recorded
+	// if it is empty. The file is rotated at RecordMaxBytes, keeping
+	// RecordMaxFiles rotated ones, the defaults are used if they are zero.
+	RecordPath     string
+	RecordMaxBytes int64
+	RecordMaxFiles int
 }
 
 // GenericProvider holds the boilerplate code required to build an LoadBalancer Provider.
 type GenericProvider struct {
 	cfg *Configuration
+	// ext are the optional interfaces of the backend
+	ext extensions
 
-	queue    workqueue.RateLimitingInterface
-	factory  informers.SharedInformerFactory
-	lbLister netlisters.LoadBalancerLister
+	queue      workqueue.RateLimitingInterface
+	factory    informers.SharedInformerFactory
+	lbLister   netlisters.LoadBalancerLister
+	nodeLister v1listers.NodeLister
+	lister     StoreLister
 
 	helper *controllerutil.Helper
+	// syncing is the number of the syncs in progress
+	syncing int32
+	// started is 1 once the backend has started and -1 if it failed to
+	started int32
+	// syncs are the last syncs by the keys of the LoadBalancers
+	syncLock sync.Mutex
+	syncs    map[string]*SyncState
+	// records is the recording of the syncs, nil unless it is configured
+	records *RecordWriter
+
+	recorder record.EventRecorder
+
+	checkPortsFree func(net.IP, []corenet.Port) ([]corenet.Conflict, error)
+	interfaceByIP  func(net.IP) (*net.Interface, error)
+	probeVIP       func(net.IP, corenet.Port, string, time.Duration) error
+	sysctl         *sysctl.Manager
+	checker        *healthcheck.Checker
+
+	patchLoadBalancer func(namespace, name string, patch []byte) error
+	getService        func(namespace, name string) (*v1.Service, error)
+	patchService      func(namespace, name string, patch []byte) error
+	// reportedStatus is the status fragment of the backend last merged,
+	// the fields unknown to the LoadBalancer status are not read back
+	reportedStatus string
+
+	// allocator allocates the VIP from the address pools, nil if they are
+	// not configured. allocatedFor is the pool or the vip of the
+	// LoadBalancer last allocated or reserved, allocatedVIP the vip
+	// allocated from the pool.
+	allocator    *AddressAllocator
+	allocatedFor string
+	allocatedVIP net.IP
+
+	roleLock   sync.Mutex
+	role       Role
+	roleEvents flowcontrol.RateLimiter
+
+	// localNodes are the nodes the real servers are restricted to by the
+	// Local traffic policy, all nodes if it is nil. lastLocalNodes are the
+	// last ones hosting a ready endpoint.
+	localLock      sync.Mutex
+	localNodes     sets.String
+	lastLocalNodes sets.String
 
 	// stopLock is used to enforce only a single call to Stop is active.
 	// Needed because we allow stopping through an http endpoint and
@@ -61,20 +205,60 @@ type GenericProvider struct {
 	stopLock *sync.Mutex
 	stopCh   chan struct{}
 	shutdown bool
+	// cacheSynced are the HasSynced of the informers of the listers
+	cacheSynced []cache.InformerSynced
+
+	// workers are the backend starting and the worker syncing, the backend
+	// is stopped once they are done. stopped is closed when it is.
+	workers sync.WaitGroup
+	stopped chan struct{}
 }
 
-// NewLoadBalancerProvider returns a configured LoadBalancer controller
-func NewLoadBalancerProvider(cfg *Configuration) *GenericProvider {
+// NewLoadBalancerProvider returns a configured LoadBalancer controller, the
+// defaults are applied to a copy of the Configuration. It returns an error
+// if a required field of the Configuration is missing.
+func NewLoadBalancerProvider(cfg *Configuration) (*GenericProvider, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	copied := *cfg
+	cfg = &copied
 
-	gp := &GenericProvider{
-		cfg:      cfg,
-		factory:  informers.NewSharedInformerFactory(cfg.KubeClient, cfg.TPRClient, 0),
-		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "loadbalancer"),
-		stopLock: &sync.Mutex{},
-		stopCh:   make(chan struct{}),
+	gp := newGenericProvider(cfg)
+	gp.patchLoadBalancer = cfg.StatusWriter.PatchLoadBalancer
+	gp.getService = func(namespace, name string) (*v1.Service, error) {
+		return cfg.KubeClient.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	}
+	gp.patchService = func(namespace, name string, patch []byte) error {
+		_, err := cfg.KubeClient.CoreV1().Services(namespace).Patch(name, types.MergePatchType, patch, "status")
+		return err
 	}
 
-	lbinformer := gp.factory.Networking().V1alpha1().LoadBalancer()
+	if cfg.RecordPath != "" {
+		records, err := NewRecordWriter(cfg.RecordPath, cfg.RecordMaxBytes, cfg.RecordMaxFiles)
+		if err != nil {
+			log.Error("open the recording of the syncs error, they are not recorded", log.Fields{"path": cfg.RecordPath, "err": err})
+		} else {
+			gp.records = records
+		}
+	}
+
+	if cfg.AddressPools != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(cfg.AddressPools)
+		if err != nil || namespace == "" {
+			namespace, name = cfg.LoadBalancerNamespace, cfg.AddressPools
+		}
+		gp.allocator = NewAddressAllocator(cfg.KubeClient.CoreV1().ConfigMaps(namespace), name)
+	}
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(log.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: cfg.KubeClient.CoreV1().Events("")})
+	gp.recorder = eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{
+		Component: fmt.Sprintf("%s-provider", cfg.Backend.Info().Name),
+	})
+
+	lbinformer := cfg.LoadBalancers
 	lbinformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    gp.addLoadBalancer,
 		UpdateFunc: gp.updateLoadBalancer,
@@ -82,72 +266,290 @@ func NewLoadBalancerProvider(cfg *Configuration) *GenericProvider {
 	})
 
 	// sync nodes
-	nodeinformer := gp.factory.Core().V1().Nodes()
-	nodeinformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{})
+	nodeinformer := cfg.Nodes
+	nodeinformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    gp.addNode,
+		UpdateFunc: gp.updateNode,
+		DeleteFunc: gp.deleteNode,
+	})
 
-	gp.cfg.Backend.SetListers(StoreLister{
-		Node:         nodeinformer.Lister(),
-		LoadBalancer: lbinformer.Lister(),
+	// sync the secrets referenced by the loadbalancer, only the ones in its
+	// namespace are watched
+	secretinformer := gp.factory.InformerFor(&v1.Secret{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+		return newSecretInformer(client, cfg.LoadBalancerNamespace, resync)
+	})
+	gp.cacheSynced = append(gp.cacheSynced, lbinformer.Informer().HasSynced, nodeinformer.Informer().HasSynced, secretinformer.HasSynced)
+	secretinformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    gp.addSecret,
+		UpdateFunc: gp.updateSecret,
+		DeleteFunc: gp.deleteSecret,
 	})
 
-	gp.helper = controllerutil.NewHelperForKeyFunc(&netv1alpha1.LoadBalancer{}, gp.queue, gp.syncLoadBalancer, controllerutil.PassthroughKeyFunc)
+	var serviceLister v1listers.ServiceLister
+	var endpointsLister v1listers.EndpointsLister
+	if cfg.ReportServiceStatus {
+		cfg.WatchServices = true
+	}
+	if cfg.WatchServices {
+		serviceinformer := gp.factory.InformerFor(&v1.Service{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newServiceInformer(client, cfg.LoadBalancerNamespace, resync)
+		})
+		serviceinformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    gp.addService,
+			UpdateFunc: gp.updateService,
+			DeleteFunc: gp.deleteService,
+		})
+		endpointsinformer := gp.factory.InformerFor(&v1.Endpoints{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newEndpointsInformer(client, cfg.LoadBalancerNamespace, resync)
+		})
+		endpointsinformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    gp.addEndpoints,
+			UpdateFunc: gp.updateEndpoints,
+			DeleteFunc: gp.deleteEndpoints,
+		})
+		gp.cacheSynced = append(gp.cacheSynced, serviceinformer.HasSynced, endpointsinformer.HasSynced)
+		serviceLister = v1listers.NewServiceLister(serviceinformer.GetIndexer())
+		endpointsLister = v1listers.NewEndpointsLister(endpointsinformer.GetIndexer())
+	}
+
+	var configMapLister v1listers.ConfigMapLister
+	if len(cfg.ConfigMaps) > 0 {
+		configmapinformer := gp.factory.InformerFor(&v1.ConfigMap{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return newConfigMapInformer(client, cfg.LoadBalancerNamespace, resync)
+		})
+		configmapinformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    gp.addConfigMap,
+			UpdateFunc: gp.updateConfigMap,
+			DeleteFunc: gp.deleteConfigMap,
+		})
+		gp.cacheSynced = append(gp.cacheSynced, configmapinformer.HasSynced)
+		configMapLister = v1listers.NewConfigMapLister(configmapinformer.GetIndexer())
+	}
+
+	if cfg.WeightPolicy == nil {
+		cfg.WeightPolicy = DefaultWeightPolicy
+	}
+	if cfg.EligibilityPolicy == nil {
+		cfg.EligibilityPolicy = DefaultEligibilityPolicy
+	}
+
+	if cfg.HealthCheckInterval > 0 {
+		gp.checker.Interval = cfg.HealthCheckInterval
+	}
+	if cfg.HealthCheckWorkers > 0 {
+		gp.checker.Workers = cfg.HealthCheckWorkers
+	}
+
+	gp.lister = StoreLister{
+		Node:          nodeinformer.Lister(),
+		LoadBalancer:  lbinformer.Lister(),
+		Secret:        v1listers.NewSecretLister(secretinformer.GetIndexer()),
+		Service:       serviceLister,
+		Endpoints:     endpointsLister,
+		ConfigMap:     configMapLister,
+		AddressPolicy: NewAddressPolicy(cfg.AddressTypes),
+		WeightPolicy:  cfg.WeightPolicy,
+		Healthy:       gp.checker.Healthy,
+		Eligible:      gp.nodeEligible,
+		Local:         gp.nodeLocal,
+		HasSynced:     gp.hasSynced,
+	}
+	gp.setupBackend()
+
 	gp.lbLister = lbinformer.Lister()
+	gp.nodeLister = nodeinformer.Lister()
+
+	return gp, nil
+}
 
+// validate returns an error naming the required fields of the
+// Configuration which are missing
+func (cfg *Configuration) validate() error {
+	var missing []string
+	if cfg.KubeClient == nil {
+		missing = append(missing, "KubeClient")
+	}
+	if cfg.Backend == nil {
+		missing = append(missing, "Backend")
+	}
+	if cfg.LoadBalancers == nil {
+		missing = append(missing, "LoadBalancers")
+	}
+	if cfg.Nodes == nil {
+		missing = append(missing, "Nodes")
+	}
+	if cfg.StatusWriter == nil {
+		missing = append(missing, "StatusWriter")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("invalid configuration, missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// newGenericProvider returns the GenericProvider of the Configuration with
+// its state, the health checker and the worker syncing the queue. The
+// listers, the clients and the backend are set up by the callers.
+func newGenericProvider(cfg *Configuration) *GenericProvider {
+	gp := &GenericProvider{
+		cfg:      cfg,
+		ext:      newExtensions(cfg.Backend),
+		factory:  informers.NewSharedInformerFactory(cfg.KubeClient, 0),
+		queue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "loadbalancer"),
+		stopLock: &sync.Mutex{},
+		stopCh:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+		syncs:    make(map[string]*SyncState),
+		// the ports of ListenerProvider are checked before updating
+		checkPortsFree: corenet.CheckPortsFree,
+		interfaceByIP:  corenet.InterfaceByIP,
+		probeVIP:       ProbeVIP,
+		sysctl:         sysctl.NewManager(sysctl.DefaultRoot),
+		roleEvents:     newRoleEventLimiter(),
+	}
+	// a transition of a real server leads to a resync, which weights the
+	// unhealthy ones to zero
+	gp.checker = healthcheck.NewChecker(func(t healthcheck.Target, healthy bool) {
+		log.Info("Real server health changed", log.Fields{"target": t, "healthy": healthy})
+		gp.enqueueLoadBalancer()
+	})
+	gp.helper = controllerutil.NewHelperForKeyFunc(&netv1alpha1.LoadBalancer{}, gp.queue, gp.sync, controllerutil.PassthroughKeyFunc)
 	return gp
 }
 
+// hasSynced returns true once the caches of the listers have synced
+func (p *GenericProvider) hasSynced() bool {
+	for _, synced := range p.cacheSynced {
+		if !synced() {
+			return false
+		}
+	}
+	return true
+}
+
+// setupBackend passes the listers and the handlers to the backend
+func (p *GenericProvider) setupBackend() {
+	p.cfg.Backend.SetListers(p.lister)
+	if p.ext.role != nil {
+		p.ext.role.SetRoleHandler(p.onRoleChange)
+	}
+	if p.ext.event != nil {
+		p.ext.event.SetEventHandler(p.onEvent)
+	}
+}
+
 // Start starts the LoadBalancer Provider.
 func (p *GenericProvider) Start() {
 	defer utilruntime.HandleCrash()
-	log.Info("Startting provider")
+	info := p.Info()
+	log.Info("Startting provider", log.Fields{"name": info.Name, "release": info.Release, "build": info.Build, "repository": info.Repository})
+	if info.Capabilities != nil {
+		log.Info("Provider capabilities", log.Fields{"protocols": info.Capabilities.Protocols, "families": info.Capabilities.Families, "features": info.Capabilities.Features, "maxPorts": info.Capabilities.MaxPorts})
+	}
+	log.Info("Provider extensions", log.Fields{"extensions": info.Extensions})
 
 	p.factory.Start(p.stopCh)
+	for _, starter := range p.cfg.Informers {
+		starter.Start(p.stopCh)
+	}
 
-	// wait cache synced
+	// wait cache synced, the backend is started once the listers it was
+	// given are complete
 	log.Info("Wait for all caches synced")
-	synced := p.factory.WaitForCacheSync(p.stopCh)
-	for tpy, sync := range synced {
-		if !sync {
-			log.Error("Wait for cache sync timeout", log.Fields{"type": tpy})
-			return
-		}
+	if !cache.WaitForCacheSync(p.stopCh, p.cacheSynced...) {
+		log.Error("Wait for cache sync timeout")
+		return
 	}
 	log.Info("All caches have synced, Running LoadBalancer Controller ...")
+	p.run()
+}
+
+// run starts the backend and the worker once the caches have synced, it
+// blocks until the provider is stopped and the backend with it
+func (p *GenericProvider) run() {
+	p.stopLock.Lock()
+	if p.shutdown {
+		p.stopLock.Unlock()
+		return
+	}
+	p.workers.Add(1)
+	p.stopLock.Unlock()
 
 	// start backend
 	p.cfg.Backend.Start()
 	if !p.cfg.Backend.WaitForStart() {
 		log.Error("Wait for backend start timeout")
+		atomic.StoreInt32(&p.started, -1)
+		p.workers.Done()
 		return
 	}
+	atomic.StoreInt32(&p.started, 1)
+	p.ensureRPFilter()
+	go p.checker.Run(p.stopCh)
 
-	// start worker
-	p.helper.Run(1, p.stopCh)
+	// start worker, it syncs until the queue is shut down
+	go func() {
+		defer p.workers.Done()
+		p.worker()
+	}()
 
-	<-p.stopCh
+	<-p.stopped
+}
 
+// worker syncs the LoadBalancers of the queue until it is shut down
+func (p *GenericProvider) worker() {
+	for p.processNextWorkItem() {
+	}
+}
+
+// processNextWorkItem syncs the next LoadBalancer of the queue, it returns
+// false once the queue is shut down. The sync returns its panic as the
+// error.
+func (p *GenericProvider) processNextWorkItem() bool {
+	obj, quit := p.queue.Get()
+	if quit {
+		return false
+	}
+	defer p.queue.Done(obj)
+
+	p.helper.HandleSyncError(p.helper.SyncHandler(obj), obj)
+	return true
 }
 
 // Stop stops the LoadBalancer Provider.
 func (p *GenericProvider) Stop() error {
 	log.Info("Shutting down provider")
 	p.stopLock.Lock()
-	defer p.stopLock.Unlock()
 	// Only try draining the workqueue if we haven't already.
-	if !p.shutdown {
-		p.shutdown = true
-		log.Info("close channel")
-		close(p.stopCh)
-		// stop backend
-		log.Info("stop backend")
-		p.cfg.Backend.Stop()
-		// stop syncing
-		log.Info("shutting down controller queue")
-		p.helper.ShutDown()
-		return nil
+	if p.shutdown {
+		p.stopLock.Unlock()
+		return fmt.Errorf("shutdown already in progress")
 	}
+	p.shutdown = true
+	log.Info("close channel")
+	close(p.stopCh)
+	// the lock is not held while waiting, the health endpoints report the
+	// shutdown meanwhile
+	p.stopLock.Unlock()
 
-	return fmt.Errorf("shutdown already in progress")
+	// stop syncing, the sync in flight finishes before the backend stops
+	log.Info("shutting down controller queue")
+	p.helper.ShutDown()
+	p.workers.Wait()
+
+	// stop backend
+	log.Info("stop backend")
+	p.cfg.Backend.Stop()
+	if err := p.sysctl.Restore(); err != nil {
+		log.Error("restore rp_filter error", log.Fields{"err": err})
+	}
+	if p.records != nil {
+		if err := p.records.Close(); err != nil {
+			log.Error("close the recording of the syncs error", log.Fields{"err": err})
+		}
+	}
+	close(p.stopped)
+	return nil
 }
 
 func (p *GenericProvider) addLoadBalancer(obj interface{}) {
@@ -203,6 +605,253 @@ func (p *GenericProvider) deleteLoadBalancer(obj interface{}) {
 	p.helper.Enqueue(lb)
 }
 
+func (p *GenericProvider) addNode(obj interface{}) {
+	p.enqueueForNode(obj.(*v1.Node).Name)
+}
+
+func (p *GenericProvider) updateNode(oldObj, curObj interface{}) {
+	old := oldObj.(*v1.Node)
+	cur := curObj.(*v1.Node)
+
+	if old.ResourceVersion == cur.ResourceVersion {
+		return
+	}
+	// the heartbeats of kubelet update the nodes frequently, only the
+	// changes of the drain, the eligibility and the weights lead to a
+	// resync
+	if IsNodeDraining(old) != IsNodeDraining(cur) {
+		log.Info("Node drain changed", log.Fields{"node": cur.Name, "draining": IsNodeDraining(cur)})
+		p.enqueueForNode(cur.Name)
+		return
+	}
+	if reason := p.cfg.EligibilityPolicy.ExclusionReason(cur); reason != p.cfg.EligibilityPolicy.ExclusionReason(old) {
+		log.Info("Node eligibility changed", log.Fields{"node": cur.Name, "excluded": reason})
+		p.enqueueForNode(cur.Name)
+		return
+	}
+	if p.cfg.WeightPolicy.NodeWeight(old) == p.cfg.WeightPolicy.NodeWeight(cur) {
+		return
+	}
+	log.Info("Node weight changed", log.Fields{"node": cur.Name, "weight": p.cfg.WeightPolicy.NodeWeight(cur)})
+	p.enqueueForNode(cur.Name)
+}
+
+// nodeEligible returns true if the node is eligible as a real server of
+// the LoadBalancer
+func (p *GenericProvider) nodeEligible(node *v1.Node) bool {
+	if p.cfg.EligibilityPolicy.Eligible(node) {
+		return true
+	}
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	return err == nil && IncludesIneligibleNodes(lb)
+}
+
+func (p *GenericProvider) deleteNode(obj interface{}) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		node, ok = tombstone.Obj.(*v1.Node)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not a Node %#v", obj))
+			return
+		}
+	}
+	p.enqueueForNode(node.Name)
+}
+
+func (p *GenericProvider) addSecret(obj interface{}) {
+	p.enqueueForSecret(obj.(*v1.Secret).Name)
+}
+
+func (p *GenericProvider) updateSecret(oldObj, curObj interface{}) {
+	old := oldObj.(*v1.Secret)
+	cur := curObj.(*v1.Secret)
+
+	if old.ResourceVersion == cur.ResourceVersion {
+		return
+	}
+	p.enqueueForSecret(cur.Name)
+}
+
+func (p *GenericProvider) deleteSecret(obj interface{}) {
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		secret, ok = tombstone.Obj.(*v1.Secret)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not a Secret %#v", obj))
+			return
+		}
+	}
+	p.enqueueForSecret(secret.Name)
+}
+
+// enqueueForSecret enqueues the LoadBalancer if it references the secret
+func (p *GenericProvider) enqueueForSecret(name string) {
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return
+	}
+	if !referencesSecret(lb, name) {
+		return
+	}
+	log.Info("Secret of LoadBalancer changed", log.Fields{"secret": name})
+	p.helper.Enqueue(lb)
+}
+
+func (p *GenericProvider) addConfigMap(obj interface{}) {
+	p.enqueueForConfigMap(obj.(*v1.ConfigMap).Name)
+}
+
+func (p *GenericProvider) updateConfigMap(oldObj, curObj interface{}) {
+	old := oldObj.(*v1.ConfigMap)
+	cur := curObj.(*v1.ConfigMap)
+
+	if old.ResourceVersion == cur.ResourceVersion {
+		return
+	}
+	p.enqueueForConfigMap(cur.Name)
+}
+
+func (p *GenericProvider) deleteConfigMap(obj interface{}) {
+	configMap, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		configMap, ok = tombstone.Obj.(*v1.ConfigMap)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not a ConfigMap %#v", obj))
+			return
+		}
+	}
+	p.enqueueForConfigMap(configMap.Name)
+}
+
+// enqueueForConfigMap enqueues the LoadBalancer if the backend reads the
+// ConfigMap
+func (p *GenericProvider) enqueueForConfigMap(name string) {
+	if !referencesConfigMap(p.cfg.ConfigMaps, name) {
+		return
+	}
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return
+	}
+	log.Info("ConfigMap of backend changed", log.Fields{"configmap": name})
+	p.helper.Enqueue(lb)
+}
+
+func (p *GenericProvider) addService(obj interface{}) {
+	p.enqueueForService(obj.(*v1.Service).Name)
+}
+
+func (p *GenericProvider) updateService(oldObj, curObj interface{}) {
+	old := oldObj.(*v1.Service)
+	cur := curObj.(*v1.Service)
+
+	if old.ResourceVersion == cur.ResourceVersion {
+		return
+	}
+	p.enqueueForService(cur.Name)
+}
+
+func (p *GenericProvider) deleteService(obj interface{}) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		svc, ok = tombstone.Obj.(*v1.Service)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not a Service %#v", obj))
+			return
+		}
+	}
+	p.enqueueForService(svc.Name)
+}
+
+func (p *GenericProvider) addEndpoints(obj interface{}) {
+	p.enqueueForService(obj.(*v1.Endpoints).Name)
+}
+
+func (p *GenericProvider) updateEndpoints(oldObj, curObj interface{}) {
+	old := oldObj.(*v1.Endpoints)
+	cur := curObj.(*v1.Endpoints)
+
+	// the leader elections update the annotations of their Endpoints
+	// frequently, only the changes of the addresses lead to a resync
+	if reflect.DeepEqual(old.Subsets, cur.Subsets) {
+		return
+	}
+	p.enqueueForService(cur.Name)
+}
+
+func (p *GenericProvider) deleteEndpoints(obj interface{}) {
+	eps, ok := obj.(*v1.Endpoints)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		eps, ok = tombstone.Obj.(*v1.Endpoints)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not an Endpoints %#v", obj))
+			return
+		}
+	}
+	p.enqueueForService(eps.Name)
+}
+
+// enqueueForService enqueues the LoadBalancer if it proxies to the Service
+func (p *GenericProvider) enqueueForService(name string) {
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return
+	}
+	if !referencesService(lb, name) {
+		return
+	}
+	log.Info("Service of LoadBalancer changed", log.Fields{"service": name})
+	p.helper.Enqueue(lb)
+}
+
+// enqueueForNode enqueues the LoadBalancer if the node is one of its nodes
+func (p *GenericProvider) enqueueForNode(name string) {
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return
+	}
+	for _, n := range lb.Spec.Nodes.Names {
+		if n == name {
+			p.helper.Enqueue(lb)
+			return
+		}
+	}
+}
+
+// enqueueLoadBalancer enqueues the LoadBalancer of the provider
+func (p *GenericProvider) enqueueLoadBalancer() {
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return
+	}
+	p.helper.Enqueue(lb)
+}
+
 func (p *GenericProvider) filtered(lb *netv1alpha1.LoadBalancer) bool {
 	if lb.Namespace == p.cfg.LoadBalancerNamespace && lb.Name == p.cfg.LoadBalancerName {
 		return false
@@ -212,24 +861,38 @@ func (p *GenericProvider) filtered(lb *netv1alpha1.LoadBalancer) bool {
 }
 
 func (p *GenericProvider) syncLoadBalancer(obj interface{}) error {
+	atomic.AddInt32(&p.syncing, 1)
+	defer atomic.AddInt32(&p.syncing, -1)
+
 	lb, ok := obj.(*netv1alpha1.LoadBalancer)
 	if !ok {
 		return fmt.Errorf("expect loadbalancer, got %v", obj)
 	}
 
-	// Validate loadbalancer scheme
-	if err := validation.ValidateLoadBalancer(lb); err != nil {
-		log.Debug("invalid loadbalancer scheme", log.Fields{"err": err})
-		return err
-	}
-
 	key, _ := controllerutil.KeyFunc(lb)
 
 	nlb, err := p.lbLister.LoadBalancers(lb.Namespace).Get(lb.Name)
 	if errors.IsNotFound(err) {
 		log.Warn("LoadBalancer has been deleted", log.Fields{"lb": key})
-		// deleted
-		// TODO shutdown?
+		if err := p.clearServiceStatus(lb); err != nil {
+			log.Error("clear the status of the services of deleted LoadBalancer error", log.Fields{"lb": key, "err": err})
+			return err
+		}
+		if err := p.releaseVIP(lb); err != nil {
+			log.Error("release the vip of deleted LoadBalancer error", log.Fields{"lb": key, "err": err})
+			return err
+		}
+		// the resources out of the node are released, the rest goes with
+		// the provider
+		if p.ext.deletion == nil {
+			return nil
+		}
+		p.setSyncInput(lb, CallOnDelete)
+		if err := p.ext.deletion.OnDelete(lb); err != nil {
+			log.Error("release the resources of deleted LoadBalancer error", log.Fields{"lb": key, "err": err})
+			return p.handleRetryAfterError(lb, err)
+		}
+		p.resyncIfRequested(lb)
 		return nil
 	}
 	if err != nil {
@@ -245,5 +908,442 @@ func (p *GenericProvider) syncLoadBalancer(obj interface{}) error {
 
 	lb = nlb
 
-	return p.cfg.Backend.OnUpdate(lb)
+	// the empty vip requesting an allocation fails the validation
+	lb, err = p.allocateVIP(lb)
+	if err != nil {
+		return p.handlePermanentError(nlb, p.handleRetryAfterError(nlb, err))
+	}
+
+	// Validate loadbalancer scheme
+	if err := validation.ValidateLoadBalancer(lb); err != nil {
+		log.Debug("invalid loadbalancer scheme", log.Fields{"err": err})
+		return p.handlePermanentError(lb, NewPermanentError("InvalidLoadBalancer", err))
+	}
+
+	if err := p.checkFamilies(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.checkCapabilities(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.validateBackend(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.checkPorts(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if _, err := GetNodeHealthPath(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.ensureHealthChecks(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.ensureTrafficPolicy(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	if err := p.ensureEndpointPorts(lb); err != nil {
+		return p.handlePermanentError(lb, err)
+	}
+
+	p.setSyncInput(lb, CallOnUpdate)
+	if err := p.cfg.Backend.OnUpdate(lb); err != nil {
+		return p.handlePermanentError(lb, p.handleRetryAfterError(lb, err))
+	}
+	p.reportServedVIPs(lb)
+	p.reportProviderInfo(lb)
+	p.reportDrainingNodes(lb)
+	p.reportProvisionedAddresses(lb)
+	p.reportProvisionedHostname(lb)
+	p.reportServingCertificates(lb)
+	p.reportStatus(lb)
+	p.reportServiceStatus(lb)
+
+	// the draining real servers are re-evaluated on the resyncs, instead
+	// of blocking the worker until they drain
+	if p.ext.draining != nil && p.ext.draining.Draining() {
+		p.helper.EnqueueAfter(lb, drainResyncPeriod)
+	}
+	p.resyncIfRequested(lb)
+
+	// the interfaces may change with the LoadBalancer
+	p.ensureRPFilter()
+	p.checkMTU(lb)
+
+	// an unreachable VIP does not fail the sync, since retrying the sync
+	// can not fix the network, but it is rechecked later
+	if p.cfg.VerifyReachability && !p.verifyReachability(lb) {
+		p.helper.EnqueueAfter(lb, reachabilityRecheckPeriod)
+	}
+	return nil
+}
+
+// ensureHealthChecks sets the targets of the health checker to the checks
+// of the LoadBalancer on its nodes of the families of the VIPs
+func (p *GenericProvider) ensureHealthChecks(lb *netv1alpha1.LoadBalancer) error {
+	checks, err := GetHealthChecks(lb)
+	if err != nil {
+		return err
+	}
+	vips, err := GetVIPs(lb)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]healthcheck.Target, 0)
+	for _, vip := range vips {
+		for _, ip := range p.lister.NodeIPs(lb.Spec.Nodes.Names, corenet.FamilyOf(vip)) {
+			for _, c := range checks {
+				targets = append(targets, healthcheck.Target{IP: ip, Check: c})
+			}
+		}
+	}
+	p.checker.SetTargets(targets)
+	return nil
+}
+
+// reportServedVIPs sets the served VIPs annotation of the LoadBalancer, the
+// status has room for the VIP in the spec only
+func (p *GenericProvider) reportServedVIPs(lb *netv1alpha1.LoadBalancer) {
+	vips, err := GetVIPs(lb)
+	if err != nil {
+		return
+	}
+	served := make([]string, 0, len(vips))
+	for _, vip := range vips {
+		served = append(served, vip.String())
+	}
+	value := strings.Join(served, ",")
+	if lb.Annotations[AnnotationKeyServedVIPs] == value {
+		return
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyServedVIPs, value); err != nil {
+		log.Error("update served vips error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// reportProviderInfo sets the provider info annotation of the LoadBalancer
+// to the information of the backend serving it
+func (p *GenericProvider) reportProviderInfo(lb *netv1alpha1.LoadBalancer) {
+	data, err := json.Marshal(p.Info())
+	if err != nil {
+		return
+	}
+	value := string(data)
+	if lb.Annotations[AnnotationKeyProviderInfo] == value {
+		return
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyProviderInfo, value); err != nil {
+		log.Error("update provider info error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// reportDrainingNodes sets the draining nodes annotation of the
+// LoadBalancer to its nodes drained by the node annotation
+func (p *GenericProvider) reportDrainingNodes(lb *netv1alpha1.LoadBalancer) {
+	draining := make([]string, 0)
+	for _, name := range lb.Spec.Nodes.Names {
+		node, err := p.lister.Node.Get(name)
+		if err == nil && IsNodeDraining(node) {
+			draining = append(draining, name)
+		}
+	}
+	value := strings.Join(draining, ",")
+	if lb.Annotations[AnnotationKeyDrainingNodes] == value {
+		return
+	}
+	// the annotation is removed once no node is draining
+	var patch interface{} = value
+	if value == "" {
+		patch = nil
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyDrainingNodes, patch); err != nil {
+		log.Error("update draining nodes error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// reportProvisionedAddresses sets the provisioned addresses annotation of
+// the LoadBalancer if the backend is an AddressProvider
+func (p *GenericProvider) reportProvisionedAddresses(lb *netv1alpha1.LoadBalancer) {
+	ap := p.ext.address
+	if ap == nil {
+		return
+	}
+	addrs := make([]string, 0)
+	for _, ip := range ap.Addresses() {
+		addrs = append(addrs, ip.String())
+	}
+	value := strings.Join(addrs, ",")
+	if lb.Annotations[AnnotationKeyProvisionedAddresses] == value {
+		return
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyProvisionedAddresses, value); err != nil {
+		log.Error("update provisioned addresses error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// reportServingCertificates sets the serving certificates annotation of the
+// LoadBalancer if the backend is a CertificateProvider, it is removed if
+// there is none
+func (p *GenericProvider) reportServingCertificates(lb *netv1alpha1.LoadBalancer) {
+	cp := p.ext.certificate
+	if cp == nil {
+		return
+	}
+	value := ""
+	if certs := cp.ServingCertificates(); len(certs) > 0 {
+		data, err := json.Marshal(certs)
+		if err != nil {
+			return
+		}
+		value = string(data)
+	}
+	if lb.Annotations[AnnotationKeyServingCertificates] == value {
+		return
+	}
+	var patch interface{} = value
+	if value == "" {
+		patch = nil
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyServingCertificates, patch); err != nil {
+		log.Error("update serving certificates error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// reportProvisionedHostname sets the provisioned hostname annotation of the
+// LoadBalancer if the backend is a HostnameProvider
+func (p *GenericProvider) reportProvisionedHostname(lb *netv1alpha1.LoadBalancer) {
+	hp := p.ext.hostname
+	if hp == nil {
+		return
+	}
+	value := hp.Hostname()
+	if lb.Annotations[AnnotationKeyProvisionedHostname] == value {
+		return
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyProvisionedHostname, value); err != nil {
+		log.Error("update provisioned hostname error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// resyncIfRequested enqueues the LoadBalancer again after the time the
+// backend asks for if it is a ResyncProvider
+func (p *GenericProvider) resyncIfRequested(lb *netv1alpha1.LoadBalancer) {
+	if p.ext.resync != nil {
+		if d := p.ext.resync.ResyncAfter(); d > 0 {
+			p.helper.EnqueueAfter(lb, d)
+		}
+	}
+}
+
+// Lister returns the listers of the caches the LoadBalancers are synced from
+func (p *GenericProvider) Lister() StoreLister {
+	return p.lister
+}
+
+// Idle returns true if no LoadBalancer is queued or syncing, the ones
+// waiting for a delayed retry or resync are not counted
+func (p *GenericProvider) Idle() bool {
+	return p.queue.Len() == 0 && atomic.LoadInt32(&p.syncing) == 0
+}
+
+// HealthCheckHandler returns the states of the health checks of the real
+// servers in json for the debug endpoint
+func (p *GenericProvider) HealthCheckHandler() http.Handler {
+	return p.checker
+}
+
+// Healthz returns an error if the provider is shut down or the backend is
+// unhealthy
+func (p *GenericProvider) Healthz() error {
+	p.stopLock.Lock()
+	shutdown := p.shutdown
+	p.stopLock.Unlock()
+	if shutdown {
+		return fmt.Errorf("provider is shut down")
+	}
+	if p.ext.healthz != nil {
+		return p.ext.healthz.Healthz()
+	}
+	return nil
+}
+
+// HealthzHandler returns the health of the provider for the health endpoint,
+// it responds 500 with the error if it is unhealthy
+func (p *GenericProvider) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Healthz(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// backendInterfaces returns the interfaces whose rp_filter is managed, it
+// returns nil if LooseRPFilter is disabled
+func (p *GenericProvider) backendInterfaces() []string {
+	if !p.cfg.LooseRPFilter {
+		return nil
+	}
+	ip := p.ext.iface
+	if ip == nil {
+		return nil
+	}
+	return ip.Interfaces()
+}
+
+func (p *GenericProvider) ensureRPFilter() {
+	ifaces := p.backendInterfaces()
+	if len(ifaces) == 0 {
+		return
+	}
+	if err := p.sysctl.EnsureLooseRPFilter(ifaces); err != nil {
+		log.Error("ensure loose rp_filter error", log.Fields{"ifaces": ifaces, "err": err})
+	}
+}
+
+// CheckRPFilter returns an error if the reverse path filtering of the
+// interfaces of the backend has been set back to strict by others, it is a
+// warning for the health endpoint
+func (p *GenericProvider) CheckRPFilter() error {
+	ifaces := p.backendInterfaces()
+	if len(ifaces) == 0 {
+		return nil
+	}
+	return p.sysctl.CheckRPFilter(ifaces)
+}
+
+// checkFamilies returns a PermanentError if the LoadBalancer has a VIP of
+// an address family the backend does not support
+func (p *GenericProvider) checkFamilies(lb *netv1alpha1.LoadBalancer) error {
+	vips, err := GetVIPs(lb)
+	if err != nil {
+		return err
+	}
+	return ValidateFamilies(vips, p.supportedFamilies())
+}
+
+// supportedFamilies returns the address families of the capabilities of
+// the backend, or of the FamilyProvider, IPv4 by default
+func (p *GenericProvider) supportedFamilies() []corenet.Family {
+	return supportedFamilies(p.cfg.Backend, p.ext)
+}
+
+// SupportedFamilies returns the address families the Provider supports, as
+// the GenericProvider checks the VIPs against
+func SupportedFamilies(backend Provider) []corenet.Family {
+	return supportedFamilies(backend, newExtensions(backend))
+}
+
+func supportedFamilies(backend Provider, ext extensions) []corenet.Family {
+	if c := backend.Info().Capabilities; c != nil && len(c.Families) > 0 {
+		return c.Families
+	}
+	if ext.family != nil {
+		return ext.family.SupportedFamilies()
+	}
+	return []corenet.Family{corenet.FamilyIPv4}
+}
+
+// checkCapabilities returns a PermanentError if the LoadBalancer requests
+// a feature, a protocol or more ports than the backend supports
+func (p *GenericProvider) checkCapabilities(lb *netv1alpha1.LoadBalancer) error {
+	return ValidateCapabilities(lb, p.cfg.Backend.Info().Capabilities)
+}
+
+// validateBackend returns a PermanentError if a ValidatingProvider backend
+// rejects the LoadBalancer
+func (p *GenericProvider) validateBackend(lb *netv1alpha1.LoadBalancer) error {
+	if p.ext.validating == nil {
+		return nil
+	}
+	return ValidateBackend(lb, p.ext.validating)
+}
+
+// Info returns the information of the backend, with the address families
+// it supports filled in the capabilities and the optional interfaces it
+// implements
+func (p *GenericProvider) Info() Info {
+	info := p.cfg.Backend.Info()
+	info.Extensions = p.ext.detected().Names()
+	if info.Capabilities != nil {
+		c := *info.Capabilities
+		c.Families = p.supportedFamilies()
+		info.Capabilities = &c
+	}
+	return info
+}
+
+// VersionHandler serves the information of the backend in json
+func (p *GenericProvider) VersionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.Info()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// checkPorts returns a PermanentError naming the culprits if the ports the
+// backend listens on are in use by others, the sockets of the provider
+// and its children, e.g. a proxy serving the ports, are not conflicts
+func (p *GenericProvider) checkPorts(lb *netv1alpha1.LoadBalancer) error {
+	lp := p.ext.listener
+	if lp == nil {
+		return nil
+	}
+	ip, ports, err := lp.Listeners(lb)
+	if err != nil {
+		return err
+	}
+	conflicts, err := p.checkPortsFree(ip, ports)
+	if err != nil {
+		return err
+	}
+
+	msgs := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		if c.PID == os.Getpid() || c.PPID == os.Getpid() {
+			continue
+		}
+		msgs = append(msgs, c.String())
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return NewPermanentError("PortConflict", fmt.Errorf("%s", strings.Join(msgs, "; ")))
+}
+
+// handleRetryAfterError enqueues the LoadBalancer again after the time the
+// RetryAfterError asks for and swallows it, so that it is retried beyond the
+// limited retries of the queue
+func (p *GenericProvider) handleRetryAfterError(lb *netv1alpha1.LoadBalancer, err error) error {
+	rerr, ok := err.(*RetryAfterError)
+	if !ok {
+		return err
+	}
+	log.Warn("Error syncing LoadBalancer, retry later", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "after": rerr.After, "err": rerr.Err})
+	p.recordSyncError(lb, SyncResultRetryAfter, err)
+	p.helper.EnqueueAfter(lb, rerr.After)
+	return nil
+}
+
+// handlePermanentError records a permanent error as an Event on the
+// LoadBalancer and swallows it, since retrying can not fix it
+func (p *GenericProvider) handlePermanentError(lb *netv1alpha1.LoadBalancer, err error) error {
+	perr, ok := err.(*PermanentError)
+	if !ok {
+		return err
+	}
+	log.Error("Permanent error syncing LoadBalancer, skip retrying", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "reason": perr.Reason, "err": perr.Err})
+	p.recordSyncError(lb, SyncResultPermanentError, err)
+	p.recorder.Event(lb, v1.EventTypeWarning, perr.Reason, perr.Error())
+	return nil
 }
@@ -0,0 +1,285 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider_test
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const waitTimeout = 5 * time.Second
+
+func newTestLoadBalancer() *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", UID: "1"}}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100", Scheduler: netv1alpha1.IpvsSchedulerRR}
+	return lb
+}
+
+// startTestProvider runs a TestProvider of the backend with the
+// LoadBalancer, it is stopped when the test ends
+func startTestProvider(t *testing.T, backend *fake.FakeProvider, lb *netv1alpha1.LoadBalancer) *core.TestProvider {
+	p := core.NewTestProvider(backend)
+	assert.Nil(t, p.LoadBalancers.Add(lb))
+	go p.Run()
+	assert.Nil(t, backend.WaitForCallCount(fake.MethodWaitForStart, 1, waitTimeout))
+	return p
+}
+
+func TestProviderLifecycle(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.SetStatus([]byte(`{"providersStatuses":{"fake":{"ready":true}}}`))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(1, waitTimeout))
+	assert.Equal(t, []*netv1alpha1.LoadBalancer{lb}, backend.Updates())
+	assert.Nil(t, p.Stop())
+	assert.NotNil(t, p.Stop())
+	// the syncs are recorded for the state
+	if last := p.State().LoadBalancers[0].LastSync; assert.NotNil(t, last) {
+		assert.Equal(t, core.SyncResultSuccess, last.Result)
+	}
+
+	assert.Equal(t, []string{
+		fake.MethodSetListers,
+		fake.MethodSetRoleHandler,
+		fake.MethodSetEventHandler,
+		fake.MethodStart,
+		fake.MethodWaitForStart,
+		fake.MethodOnUpdate,
+		fake.MethodStop,
+	}, backend.Methods())
+	calls := backend.Calls()
+	for i := 1; i < len(calls); i++ {
+		assert.False(t, calls[i].Time.Before(calls[i-1].Time))
+	}
+	assert.NotNil(t, backend.Lister().LoadBalancer)
+	assert.Contains(t, p.Patches(), `{"status":{"providersStatuses":{"fake":{"ready":true}}}}`)
+}
+
+func TestNewLoadBalancerProviderRequired(t *testing.T) {
+	p, err := core.NewLoadBalancerProvider(&core.Configuration{Backend: fake.NewFakeProvider("fake")})
+	assert.Nil(t, p)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "invalid configuration, missing KubeClient, LoadBalancers, Nodes, StatusWriter", err.Error())
+	}
+}
+
+func TestProviderBackendNotStarted(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodWaitForStart, fake.FailTimes(fmt.Errorf("timeout"), 1))
+	p := core.NewTestProvider(backend)
+
+	// the worker is not started
+	p.Run()
+	p.Enqueue(newTestLoadBalancer())
+	assert.NotNil(t, backend.WaitForOnUpdateCount(1, 100*time.Millisecond))
+	assert.Nil(t, p.Stop())
+}
+
+// slowBackend takes its time to update, it counts the updates overlapping
+// with or following Stop
+type slowBackend struct {
+	*fake.FakeProvider
+	updating int32
+	stopped  int32
+	overlaps int32
+}
+
+func (b *slowBackend) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	atomic.AddInt32(&b.updating, 1)
+	defer atomic.AddInt32(&b.updating, -1)
+	if atomic.LoadInt32(&b.stopped) != 0 {
+		atomic.AddInt32(&b.overlaps, 1)
+	}
+	time.Sleep(50 * time.Millisecond)
+	return b.FakeProvider.OnUpdate(lb)
+}
+
+func (b *slowBackend) Stop() error {
+	atomic.StoreInt32(&b.stopped, 1)
+	if atomic.LoadInt32(&b.updating) != 0 {
+		atomic.AddInt32(&b.overlaps, 1)
+	}
+	return b.FakeProvider.Stop()
+}
+
+func TestStopWaitsForSync(t *testing.T) {
+	backend := &slowBackend{FakeProvider: fake.NewFakeProvider("fake")}
+	lb := newTestLoadBalancer()
+	p := core.NewTestProvider(backend)
+	assert.Nil(t, p.LoadBalancers.Add(lb))
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+	assert.Nil(t, backend.WaitForCallCount(fake.MethodWaitForStart, 1, waitTimeout))
+
+	// the LoadBalancer keeps being enqueued while stopping
+	enqueued := make(chan struct{})
+	go func() {
+		defer close(enqueued)
+		for i := 0; i < 20; i++ {
+			p.Enqueue(lb)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	assert.Nil(t, backend.WaitForOnUpdateCount(1, waitTimeout))
+	assert.Nil(t, p.Stop())
+	<-enqueued
+
+	// the run returns once the backend is stopped
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatal("provider not stopped")
+	}
+	assert.Equal(t, 1, backend.CallCount(fake.MethodStop))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&backend.overlaps))
+	methods := backend.Methods()
+	assert.Equal(t, fake.MethodStop, methods[len(methods)-1])
+}
+
+func TestStoreListerWaitForCacheSync(t *testing.T) {
+	assert.True(t, core.StoreLister{}.WaitForCacheSync(0))
+
+	var synced int32
+	lister := core.StoreLister{HasSynced: func() bool { return atomic.LoadInt32(&synced) != 0 }}
+	assert.False(t, lister.WaitForCacheSync(200*time.Millisecond))
+	time.AfterFunc(100*time.Millisecond, func() { atomic.StoreInt32(&synced, 1) })
+	assert.True(t, lister.WaitForCacheSync(waitTimeout))
+}
+
+func TestSyncRetriesBackendErrors(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodOnUpdate, fake.FailTimes(fmt.Errorf("busy"), 2))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(3, waitTimeout))
+	// no more retries after the success
+	assert.NotNil(t, backend.WaitForOnUpdateCount(4, 100*time.Millisecond))
+}
+
+func TestSyncPermanentError(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodOnUpdate, fake.FailTimes(core.NewPermanentError("Broken", fmt.Errorf("broken")), 1))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	// reported by an event, not retried
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(1, waitTimeout))
+	select {
+	case event := <-p.Recorder.Events:
+		assert.Equal(t, "Warning Broken broken", event)
+	case <-time.After(waitTimeout):
+		t.Fatal("no event recorded")
+	}
+	assert.NotNil(t, backend.WaitForOnUpdateCount(2, 100*time.Millisecond))
+}
+
+func TestSyncRetryAfterError(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	after := 200 * time.Millisecond
+	backend.Script(fake.MethodOnUpdate, fake.FailTimes(core.NewRetryAfterError(after, fmt.Errorf("pending")), 1))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(2, waitTimeout))
+	calls := backend.Calls(fake.MethodOnUpdate)
+	assert.True(t, calls[1].Time.Sub(calls[0].Time) >= after)
+}
+
+func TestSyncSerialized(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	release := make(chan struct{})
+	backend.Script(fake.MethodOnUpdate, fake.BlockUntil(release))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	// the changes during a sync are synced once after it
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(1, waitTimeout))
+	p.Enqueue(lb)
+	p.Enqueue(lb)
+	assert.NotNil(t, backend.WaitForOnUpdateCount(2, 100*time.Millisecond))
+	close(release)
+	assert.Nil(t, backend.WaitForOnUpdateCount(2, waitTimeout))
+	assert.NotNil(t, backend.WaitForOnUpdateCount(3, 100*time.Millisecond))
+}
+
+func TestSyncBackendPanic(t *testing.T) {
+	// the panic is recovered by the worker, it does not crash the process
+	assert.True(t, utilruntime.ReallyCrash)
+
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodOnUpdate, fake.PanicOnce("boom"))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	// the sync which panicked is retried, and the worker goes on
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(2, waitTimeout))
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForOnUpdateCount(3, waitTimeout))
+}
+
+func TestSyncDeletedLoadBalancer(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodOnDelete, fake.FailTimes(fmt.Errorf("busy"), 1))
+	lb := newTestLoadBalancer()
+	p := startTestProvider(t, backend, lb)
+	defer p.Stop()
+
+	assert.Nil(t, p.LoadBalancers.Delete(lb))
+	p.Enqueue(lb)
+	assert.Nil(t, backend.WaitForCallCount(fake.MethodOnDelete, 2, waitTimeout))
+	assert.Equal(t, lb, backend.Calls(fake.MethodOnDelete)[1].Object)
+	assert.Equal(t, 0, backend.CallCount(fake.MethodOnUpdate))
+}
+
+func TestBackendEvents(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	p := startTestProvider(t, backend, newTestLoadBalancer())
+	defer p.Stop()
+
+	backend.Event("Warning", "Conflict", "vrid 50 is in use")
+	assert.Equal(t, "Warning Conflict vrid 50 is in use on node ", <-p.Recorder.Events)
+	backend.SetRole(core.RoleFault)
+	assert.Equal(t, core.RoleFault, p.Role())
+}
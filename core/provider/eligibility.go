@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// AnnotationKeyIncludeIneligibleNodes includes the nodes of the
+// LoadBalancer excluded by the EligibilityPolicy in the real servers if it
+// is "true", for the dedicated setups serving the traffic on all nodes
+const AnnotationKeyIncludeIneligibleNodes = "loadbalancer.caicloud.io/include-ineligible-nodes"
+
+const (
+	// labelNodeRolePrefix is the prefix of the role labels of the nodes,
+	// e.g. node-role.kubernetes.io/master
+	labelNodeRolePrefix = "node-role.kubernetes.io/"
+	// taintNodeLifecyclePrefix is the prefix of the taints kubernetes sets
+	// on the conditions of the nodes, e.g. node.kubernetes.io/not-ready,
+	// they are left to the WeightPolicy
+	taintNodeLifecyclePrefix = "node.kubernetes.io/"
+)
+
+// TaintMatcher matches the taints of a node, an empty field matches any.
+// The matchers without a key do not match the lifecycle taints
+// node.kubernetes.io/*, which the WeightPolicy weights by the conditions.
+type TaintMatcher struct {
+	Key    string
+	Value  string
+	Effect v1.TaintEffect
+}
+
+// Matches returns true if the taint matches
+func (m TaintMatcher) Matches(taint v1.Taint) bool {
+	if m.Key == "" && strings.HasPrefix(taint.Key, taintNodeLifecyclePrefix) {
+		return false
+	}
+	return (m.Key == "" || m.Key == taint.Key) &&
+		(m.Value == "" || m.Value == taint.Value) &&
+		(m.Effect == "" || m.Effect == taint.Effect)
+}
+
+// String returns the matcher in the form ParseTaintMatchers accepts
+func (m TaintMatcher) String() string {
+	s := m.Key
+	if m.Value != "" {
+		s += "=" + m.Value
+	}
+	if m.Effect != "" {
+		s += ":" + string(m.Effect)
+	}
+	return s
+}
+
+// ParseTaintMatchers parses a comma separated list of key[=value][:effect],
+// e.g. dedicated=db:NoSchedule,:NoExecute
+func ParseTaintMatchers(s string) ([]TaintMatcher, error) {
+	matchers := make([]TaintMatcher, 0)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		m := TaintMatcher{}
+		if i := strings.LastIndex(entry, ":"); i >= 0 {
+			m.Effect = v1.TaintEffect(entry[i+1:])
+			entry = entry[:i]
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		m.Key = parts[0]
+		if len(parts) == 2 {
+			m.Value = parts[1]
+		}
+		switch {
+		case m.Effect != "" && m.Effect != v1.TaintEffectNoSchedule && m.Effect != v1.TaintEffectPreferNoSchedule && m.Effect != v1.TaintEffectNoExecute:
+			return nil, fmt.Errorf("invalid effect of taint %q, expect NoSchedule, PreferNoSchedule or NoExecute", entry)
+		case m.Key == "" && (m.Value != "" || m.Effect == ""):
+			return nil, fmt.Errorf("invalid taint %q, expect key[=value][:effect]", entry)
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// EligibilityPolicy selects the nodes of the LoadBalancer eligible as the
+// real servers, the others do not receive the traffic of the VIPs
+type EligibilityPolicy struct {
+	// ExcludedRoles are the roles of the node-role.kubernetes.io/<role>
+	// labels of the excluded nodes
+	ExcludedRoles []string
+	// ExcludedTaints match the taints of the excluded nodes
+	ExcludedTaints []TaintMatcher
+}
+
+// DefaultEligibilityPolicy keeps the user traffic off the control plane
+// and the nodes tainted against the workloads
+var DefaultEligibilityPolicy = &EligibilityPolicy{
+	ExcludedRoles: []string{"master", "control-plane"},
+	ExcludedTaints: []TaintMatcher{
+		{Effect: v1.TaintEffectNoSchedule},
+		{Effect: v1.TaintEffectNoExecute},
+	},
+}
+
+// ParseEligibilityPolicy parses the comma separated roles and taint
+// matchers of the excluded nodes, e.g. master,control-plane and
+// :NoSchedule,:NoExecute
+func ParseEligibilityPolicy(roles, taints string) (*EligibilityPolicy, error) {
+	p := &EligibilityPolicy{}
+	for _, role := range strings.Split(roles, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			p.ExcludedRoles = append(p.ExcludedRoles, role)
+		}
+	}
+	var err error
+	if p.ExcludedTaints, err = ParseTaintMatchers(taints); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Eligible returns true if the node is eligible as a real server, all
+// nodes are eligible with a nil policy
+func (p *EligibilityPolicy) Eligible(node *v1.Node) bool {
+	return p.ExclusionReason(node) == ""
+}
+
+// ExclusionReason returns why the node is not eligible as a real server,
+// empty if it is eligible
+func (p *EligibilityPolicy) ExclusionReason(node *v1.Node) string {
+	if p == nil {
+		return ""
+	}
+	for _, role := range p.ExcludedRoles {
+		if _, ok := node.Labels[labelNodeRolePrefix+role]; ok {
+			return "role " + role
+		}
+	}
+	for _, taint := range node.Spec.Taints {
+		for _, m := range p.ExcludedTaints {
+			if m.Matches(taint) {
+				return "taint " + TaintMatcher{Key: taint.Key, Value: taint.Value, Effect: taint.Effect}.String()
+			}
+		}
+	}
+	return ""
+}
+
+// IncludesIneligibleNodes returns true if the LoadBalancer includes the
+// nodes excluded by the EligibilityPolicy in the real servers
+func IncludesIneligibleNodes(lb *netv1alpha1.LoadBalancer) bool {
+	return lb.Annotations[AnnotationKeyIncludeIneligibleNodes] == "true"
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	controllerutil "github.com/caicloud/loadbalancer-controller/pkg/util/controller"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func newEligibilityTestNode(name, ip string, labels map[string]string, taints ...v1.Taint) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	node.Spec.Taints = taints
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}}
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	return node
+}
+
+func TestEligibilityPolicy(t *testing.T) {
+	noSchedule := v1.Taint{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoSchedule}
+	preferNoSchedule := v1.Taint{Key: "dedicated", Value: "db", Effect: v1.TaintEffectPreferNoSchedule}
+	notReady := v1.Taint{Key: "node.kubernetes.io/not-ready", Effect: v1.TaintEffectNoExecute}
+
+	tests := []struct {
+		name   string
+		policy *EligibilityPolicy
+		node   *v1.Node
+		reason string
+	}{
+		{"worker", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", map[string]string{"node-role.kubernetes.io/worker": ""}), ""},
+		{"master", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", map[string]string{"node-role.kubernetes.io/master": ""}), "role master"},
+		{"control plane", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", map[string]string{"node-role.kubernetes.io/control-plane": "true"}), "role control-plane"},
+		{"no schedule", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", nil, noSchedule), "taint dedicated=db:NoSchedule"},
+		{"prefer no schedule", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", nil, preferNoSchedule), ""},
+		// weighted by the conditions instead
+		{"lifecycle taint", DefaultEligibilityPolicy, newEligibilityTestNode("n", "", nil, notReady), ""},
+		{"lifecycle taint by key", &EligibilityPolicy{ExcludedTaints: []TaintMatcher{{Key: "node.kubernetes.io/not-ready"}}}, newEligibilityTestNode("n", "", nil, notReady), "taint node.kubernetes.io/not-ready:NoExecute"},
+		{"other value", &EligibilityPolicy{ExcludedTaints: []TaintMatcher{{Key: "dedicated", Value: "lb"}}}, newEligibilityTestNode("n", "", nil, noSchedule), ""},
+		{"nil policy", nil, newEligibilityTestNode("n", "", map[string]string{"node-role.kubernetes.io/master": ""}, noSchedule), ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.reason, tt.policy.ExclusionReason(tt.node), tt.name)
+		assert.Equal(t, tt.reason == "", tt.policy.Eligible(tt.node), tt.name)
+	}
+}
+
+func TestParseTaintMatchers(t *testing.T) {
+	matchers, err := ParseTaintMatchers(" :NoSchedule, dedicated=db:NoExecute,gpu,")
+	assert.Nil(t, err)
+	assert.Equal(t, []TaintMatcher{
+		{Effect: v1.TaintEffectNoSchedule},
+		{Key: "dedicated", Value: "db", Effect: v1.TaintEffectNoExecute},
+		{Key: "gpu"},
+	}, matchers)
+	assert.Equal(t, "dedicated=db:NoExecute", matchers[1].String())
+
+	for _, s := range []string{"gpu:Never", "=db", ":", "=db:NoSchedule"} {
+		_, err := ParseTaintMatchers(s)
+		assert.NotNil(t, err, s)
+	}
+
+	policy, err := ParseEligibilityPolicy("master, control-plane", ":NoSchedule,:NoExecute")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultEligibilityPolicy, policy)
+}
+
+func TestRealServersEligible(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newEligibilityTestNode("master", "192.168.1.1", map[string]string{"node-role.kubernetes.io/master": ""}))
+	nodes.Add(newEligibilityTestNode("tainted", "192.168.1.2", nil, v1.Taint{Key: "dedicated", Effect: v1.TaintEffectNoExecute}))
+	nodes.Add(newEligibilityTestNode("worker", "192.168.1.3", nil))
+
+	lbs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lbs.Add(&netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}})
+	p := &GenericProvider{
+		cfg:      &Configuration{LoadBalancerNamespace: "default", LoadBalancerName: "lb", EligibilityPolicy: DefaultEligibilityPolicy},
+		lbLister: netlisters.NewLoadBalancerLister(lbs),
+	}
+	lister := StoreLister{Node: v1listers.NewNodeLister(nodes), Eligible: p.nodeEligible}
+	names := []string{"master", "tainted", "worker"}
+
+	assert.Equal(t, []RealServer{{Node: "worker", IP: net.ParseIP("192.168.1.3"), Weight: 100}}, lister.RealServers(names, corenet.FamilyIPv4))
+	// the addresses of all nodes, e.g. the peers of the provider
+	assert.Len(t, lister.NodeIPs(names, corenet.FamilyIPv4), 3)
+
+	// the dedicated setups opt back in
+	lbs.Update(&netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "lb",
+		Annotations: map[string]string{AnnotationKeyIncludeIneligibleNodes: "true"},
+	}})
+	assert.Len(t, lister.RealServers(names, corenet.FamilyIPv4), 3)
+}
+
+func TestUpdateNodeEligibility(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	lb.Spec.Nodes.Names = []string{"node1"}
+	lbs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lbs.Add(lb)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	p := &GenericProvider{
+		cfg: &Configuration{
+			LoadBalancerNamespace: "default",
+			LoadBalancerName:      "lb",
+			WeightPolicy:          DefaultWeightPolicy,
+			EligibilityPolicy:     DefaultEligibilityPolicy,
+		},
+		lbLister: netlisters.NewLoadBalancerLister(lbs),
+		queue:    queue,
+		helper:   controllerutil.NewHelperForKeyFunc(&netv1alpha1.LoadBalancer{}, queue, nil, controllerutil.PassthroughKeyFunc),
+	}
+
+	old := newEligibilityTestNode("node1", "192.168.1.1", nil)
+	old.ResourceVersion = "1"
+	// a heartbeat
+	cur := newEligibilityTestNode("node1", "192.168.1.1", nil)
+	cur.ResourceVersion = "2"
+	p.updateNode(old, cur)
+	assert.Equal(t, 0, queue.Len())
+
+	// the taint is added, the weight is the same
+	tainted := newEligibilityTestNode("node1", "192.168.1.1", nil, v1.Taint{Key: "dedicated", Effect: v1.TaintEffectNoSchedule})
+	tainted.ResourceVersion = "3"
+	p.updateNode(cur, tainted)
+	assert.Equal(t, 1, queue.Len())
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyEndpointPorts is the ports of AnnotationKeyPorts routed
+	// to the ready endpoints of a port of a Service in the namespace of the
+	// LoadBalancer instead of the nodes, in json, e.g.
+	// [{"protocol":"tcp","port":80,"service":"web","servicePort":80}]
+	AnnotationKeyEndpointPorts = "loadbalancer.caicloud.io/endpoint-ports"
+	// AnnotationKeyEndpointsCondition is the Condition of the endpoints of
+	// the endpoint ports of a LoadBalancer
+	AnnotationKeyEndpointsCondition = "loadbalancer.caicloud.io/endpoints-condition"
+
+	// EndpointsReady is the reason of the condition if all endpoint ports
+	// have a ready endpoint
+	EndpointsReady = "EndpointsReady"
+	// NoEndpoints is the reason of the condition and the Warning event if
+	// some endpoint ports have no ready endpoint
+	NoEndpoints = "NoEndpoints"
+)
+
+// EndpointPort is a port of the LoadBalancer routed to the endpoints of a
+// port of a Service
+type EndpointPort struct {
+	// Protocol is tcp or udp
+	Protocol    string `json:"protocol"`
+	Port        int    `json:"port"`
+	Service     string `json:"service"`
+	ServicePort int    `json:"servicePort"`
+}
+
+// CorePort returns the port of the LoadBalancer
+func (p EndpointPort) CorePort() corenet.Port {
+	return corenet.Port{Protocol: p.Protocol, Port: uint16(p.Port)}
+}
+
+// GetEndpointPorts returns the endpoint ports of the LoadBalancer sorted by
+// protocol and port, nil if not specified. It returns a PermanentError if
+// they are invalid.
+func GetEndpointPorts(lb *netv1alpha1.LoadBalancer) ([]EndpointPort, error) {
+	value, ok := lb.Annotations[AnnotationKeyEndpointPorts]
+	if !ok {
+		return nil, nil
+	}
+
+	ports := make([]EndpointPort, 0)
+	if err := json.Unmarshal([]byte(value), &ports); err != nil {
+		return nil, NewPermanentError("InvalidEndpointPorts", fmt.Errorf("invalid endpoint ports %q: %v", value, err))
+	}
+	seen := make(map[corenet.Port]bool, len(ports))
+	for i := range ports {
+		p := &ports[i]
+		p.Protocol = strings.ToLower(p.Protocol)
+		switch {
+		case (p.Protocol != "tcp" && p.Protocol != "udp") || p.Port <= 0 || p.Port > 65535:
+			return nil, NewPermanentError("InvalidEndpointPorts", fmt.Errorf("invalid port %s/%d", p.Protocol, p.Port))
+		case seen[p.CorePort()]:
+			return nil, NewPermanentError("InvalidEndpointPorts", fmt.Errorf("duplicate port %v", p.CorePort()))
+		case p.Service == "" || p.ServicePort <= 0 || p.ServicePort > 65535:
+			return nil, NewPermanentError("InvalidEndpointPorts", fmt.Errorf("invalid service %q port %d of port %v", p.Service, p.ServicePort, p.CorePort()))
+		}
+		seen[p.CorePort()] = true
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Protocol != ports[j].Protocol {
+			return ports[i].Protocol < ports[j].Protocol
+		}
+		return ports[i].Port < ports[j].Port
+	})
+	return ports, nil
+}
+
+// CheckEndpointPorts returns a PermanentError if an endpoint port is not
+// one of the ports served
+func CheckEndpointPorts(endpointPorts []EndpointPort, ports []corenet.Port) error {
+	served := make(map[corenet.Port]bool, len(ports))
+	for _, p := range ports {
+		served[p] = true
+	}
+	for _, p := range endpointPorts {
+		if !served[p.CorePort()] {
+			return NewPermanentError("InvalidEndpointPorts", fmt.Errorf("endpoint port %v is not served", p.CorePort()))
+		}
+	}
+	return nil
+}
+
+// PortEndpoints returns the ready endpoints of the endpoint port sorted by
+// address, it returns a PermanentError if the Service is missing or has no
+// such port
+func (s StoreLister) PortEndpoints(namespace string, port EndpointPort) ([]Endpoint, error) {
+	return s.serviceEndpoints(namespace, port.Service, port.ServicePort, v1.Protocol(strings.ToUpper(port.Protocol)))
+}
+
+// ensureEndpointPorts records whether the endpoint ports of the LoadBalancer
+// have a ready endpoint as a condition. The ports without one keep their
+// virtual servers with no real server, and the Endpoints changes resync the
+// LoadBalancer, so the condition follows the endpoints.
+func (p *GenericProvider) ensureEndpointPorts(lb *netv1alpha1.LoadBalancer) error {
+	ports, err := GetEndpointPorts(lb)
+	if err != nil {
+		return err
+	}
+	if len(ports) == 0 {
+		if _, ok := lb.Annotations[AnnotationKeyEndpointsCondition]; ok {
+			if err := p.patchAnnotation(lb, AnnotationKeyEndpointsCondition, nil); err != nil {
+				log.Error("delete condition error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "condition": AnnotationKeyEndpointsCondition, "err": err})
+			}
+		}
+		return nil
+	}
+	if p.lister.Service == nil || p.lister.Endpoints == nil {
+		return NewPermanentError("InvalidEndpointPorts", fmt.Errorf("the endpoint ports require the provider to watch the services"))
+	}
+
+	empty := make([]string, 0)
+	for _, port := range ports {
+		endpoints, err := p.lister.PortEndpoints(lb.Namespace, port)
+		if err != nil {
+			return err
+		}
+		if len(endpoints) == 0 {
+			empty = append(empty, fmt.Sprintf("%v (service %s port %d)", port.CorePort(), port.Service, port.ServicePort))
+		}
+	}
+
+	if len(empty) == 0 {
+		p.setCondition(lb, AnnotationKeyEndpointsCondition, Condition{
+			Status:  v1.ConditionTrue,
+			Reason:  EndpointsReady,
+			Message: fmt.Sprintf("all %d endpoint ports have a ready endpoint", len(ports)),
+		})
+		return nil
+	}
+	p.setCondition(lb, AnnotationKeyEndpointsCondition, Condition{
+		Status:  v1.ConditionFalse,
+		Reason:  NoEndpoints,
+		Message: fmt.Sprintf("no ready endpoint of the ports %s, they have no real server", strings.Join(empty, ", ")),
+	})
+	return nil
+}
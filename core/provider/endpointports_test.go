@@ -0,0 +1,127 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestGetEndpointPorts(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []EndpointPort
+		valid bool
+	}{
+		{`[{"protocol":"UDP","port":53,"service":"dns","servicePort":53},{"protocol":"tcp","port":80,"service":"web","servicePort":8080}]`, []EndpointPort{
+			{Protocol: "tcp", Port: 80, Service: "web", ServicePort: 8080},
+			{Protocol: "udp", Port: 53, Service: "dns", ServicePort: 53},
+		}, true},
+		{`[{"protocol":"tcp","port":53,"service":"dns","servicePort":53},{"protocol":"udp","port":53,"service":"dns","servicePort":53}]`, []EndpointPort{
+			{Protocol: "tcp", Port: 53, Service: "dns", ServicePort: 53},
+			{Protocol: "udp", Port: 53, Service: "dns", ServicePort: 53},
+		}, true},
+		{`{}`, nil, false},
+		{`[{"protocol":"sctp","port":80,"service":"web","servicePort":80}]`, nil, false},
+		{`[{"protocol":"tcp","port":0,"service":"web","servicePort":80}]`, nil, false},
+		{`[{"protocol":"tcp","port":80,"servicePort":80}]`, nil, false},
+		{`[{"protocol":"tcp","port":80,"service":"web"}]`, nil, false},
+		{`[{"protocol":"tcp","port":80,"service":"web","servicePort":80},{"protocol":"TCP","port":80,"service":"api","servicePort":80}]`, nil, false},
+	}
+	for _, tt := range tests {
+		lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationKeyEndpointPorts: tt.value}}}
+		ports, err := GetEndpointPorts(lb)
+		if !tt.valid {
+			assert.True(t, IsPermanentError(err), tt.value)
+			continue
+		}
+		assert.Nil(t, err, tt.value)
+		assert.Equal(t, tt.want, ports)
+	}
+
+	ports := []EndpointPort{{Protocol: "tcp", Port: 80, Service: "web", ServicePort: 80}}
+	assert.Nil(t, CheckEndpointPorts(ports, []corenet.Port{{Protocol: "tcp", Port: 80}}))
+	assert.True(t, IsPermanentError(CheckEndpointPorts(ports, []corenet.Port{{Protocol: "udp", Port: 80}})))
+}
+
+func TestEnsureEndpointPorts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "lb",
+		Annotations: map[string]string{
+			AnnotationKeyEndpointPorts: `[{"protocol":"tcp","port":80,"service":"web","servicePort":80},{"protocol":"udp","port":53,"service":"dns","servicePort":53}]`,
+		},
+	}}
+	p, recorder, patches := newRoleTestProvider(lb, flowcontrol.NewFakeAlwaysRateLimiter())
+
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	endpoints := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	p.lister = StoreLister{
+		Service:   v1listers.NewServiceLister(services),
+		Endpoints: v1listers.NewEndpointsLister(endpoints),
+	}
+
+	// the Services are missing
+	assert.True(t, IsPermanentError(p.ensureEndpointPorts(lb)))
+
+	services.Add(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}}})
+	services.Add(&v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns"}, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP},
+		{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+	}}})
+	assert.Nil(t, p.ensureEndpointPorts(lb))
+	assert.Equal(t, []string{"Warning NoEndpoints no ready endpoint of the ports tcp/80 (service web port 80), udp/53 (service dns port 53), they have no real server"}, drainEvents(recorder))
+
+	// the endpoints of the tcp port of dns do not serve udp
+	endpoints.Add(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.244.1.1"}},
+		Ports:     []v1.EndpointPort{{Name: "http", Port: 8080}},
+	}}})
+	endpoints.Add(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns"}, Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.244.1.2"}},
+		Ports:     []v1.EndpointPort{{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP}},
+	}}})
+	assert.Nil(t, p.ensureEndpointPorts(lb))
+	assert.Equal(t, []string{"Warning NoEndpoints no ready endpoint of the ports udp/53 (service dns port 53), they have no real server"}, drainEvents(recorder))
+
+	endpoints.Update(&v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "dns"}, Subsets: []v1.EndpointSubset{{
+		Addresses: []v1.EndpointAddress{{IP: "10.244.1.2"}},
+		Ports:     []v1.EndpointPort{{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP}},
+	}}})
+	assert.Nil(t, p.ensureEndpointPorts(lb))
+	assert.Contains(t, (*patches)[len(*patches)-1], "all 2 endpoint ports have a ready endpoint")
+
+	// the condition is removed with the endpoint ports
+	lb.Annotations = map[string]string{AnnotationKeyEndpointsCondition: "{}"}
+	*patches = nil
+	assert.Nil(t, p.ensureEndpointPorts(lb))
+	assert.Equal(t, []string{`{"metadata":{"annotations":{"loadbalancer.caicloud.io/endpoints-condition":null}}}`}, *patches)
+
+	// the endpoint ports need the Services
+	lb.Annotations[AnnotationKeyEndpointPorts] = `[{"protocol":"tcp","port":80,"service":"web","servicePort":80}]`
+	p.lister.Endpoints = nil
+	assert.True(t, IsPermanentError(p.ensureEndpointPorts(lb)))
+}
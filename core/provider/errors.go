@@ -0,0 +1,70 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import "time"
+
+// PermanentError is an error which can not be fixed by retrying, e.g. an
+// invalid LoadBalancer spec. The sync of the LoadBalancer is not retried
+// and the error is recorded as a Warning Event on the LoadBalancer.
+type PermanentError struct {
+	// Reason is a short, machine understandable string used as the reason
+	// of the Event, e.g. InvalidScheduler
+	Reason string
+	Err    error
+}
+
+// NewPermanentError returns a PermanentError with the reason
+func NewPermanentError(reason string, err error) error {
+	return &PermanentError{Reason: reason, Err: err}
+}
+
+// Error implements error
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// IsPermanentError returns true if the error is a PermanentError
+func IsPermanentError(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
+
+// RetryAfterError is an error which is fixed by retrying later, e.g. an
+// exceeded quota or a resource busy with an operation of a cloud. The sync
+// of the LoadBalancer is retried after the time, instead of the few quick
+// retries of the queue.
+type RetryAfterError struct {
+	After time.Duration
+	Err   error
+}
+
+// NewRetryAfterError returns a RetryAfterError retried after the time
+func NewRetryAfterError(after time.Duration, err error) error {
+	return &RetryAfterError{After: after, Err: err}
+}
+
+// Error implements error
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRetryAfterError returns true if the error is a RetryAfterError
+func IsRetryAfterError(err error) bool {
+	_, ok := err.(*RetryAfterError)
+	return ok
+}
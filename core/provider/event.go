@@ -0,0 +1,41 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+
+	log "github.com/zoumo/logdog"
+)
+
+// EventProvider is implemented by the Providers which report the events of
+// their dataplane on the node, e.g. the repairs of their configuration,
+// which are recorded on the LoadBalancer
+type EventProvider interface {
+	// SetEventHandler sets the handler of the events
+	SetEventHandler(func(eventtype, reason, message string))
+}
+
+// onEvent records the event of the backend on the LoadBalancer
+func (p *GenericProvider) onEvent(eventtype, reason, message string) {
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		log.Error("get loadbalancer error", log.Fields{"err": err})
+		return
+	}
+	p.recorder.Event(lb, eventtype, reason, fmt.Sprintf("%s on node %s", message, p.cfg.NodeName))
+}
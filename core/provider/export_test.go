@@ -0,0 +1,104 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sync"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// TestProvider is a GenericProvider syncing the LoadBalancer default/lb of
+// an indexer instead of the informers, for the tests out of the package
+type TestProvider struct {
+	*GenericProvider
+	LoadBalancers cache.Indexer
+	Recorder      *record.FakeRecorder
+
+	mu      sync.Mutex
+	patches []string
+}
+
+// NewTestProvider returns a TestProvider of the backend, the listers and
+// the handlers are set on the backend already
+func NewTestProvider(backend Provider) *TestProvider {
+	t := &TestProvider{
+		LoadBalancers: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		Recorder:      record.NewFakeRecorder(100),
+	}
+	nodes := v1listers.NewNodeLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	p := newGenericProvider(&Configuration{
+		Backend:               backend,
+		LoadBalancerNamespace: "default",
+		LoadBalancerName:      "lb",
+		SkipMTUCheck:          true,
+		WeightPolicy:          DefaultWeightPolicy,
+		EligibilityPolicy:     DefaultEligibilityPolicy,
+	})
+	p.lbLister = netlisters.NewLoadBalancerLister(t.LoadBalancers)
+	p.nodeLister = nodes
+	p.recorder = t.Recorder
+	p.patchLoadBalancer = func(namespace, name string, patch []byte) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.patches = append(t.patches, string(patch))
+		return nil
+	}
+	p.lister = StoreLister{
+		Node:          nodes,
+		LoadBalancer:  p.lbLister,
+		AddressPolicy: NewAddressPolicy(nil),
+		WeightPolicy:  p.cfg.WeightPolicy,
+		Healthy:       p.checker.Healthy,
+		Eligible:      p.nodeEligible,
+		Local:         p.nodeLocal,
+		HasSynced:     p.hasSynced,
+	}
+	p.setupBackend()
+	t.GenericProvider = p
+	return t
+}
+
+// Run starts the backend and the worker as Start does once the caches
+// have synced, it blocks until the provider is stopped
+func (t *TestProvider) Run() {
+	t.run()
+}
+
+// Enqueue enqueues the LoadBalancer to sync
+func (t *TestProvider) Enqueue(lb *netv1alpha1.LoadBalancer) {
+	t.helper.Enqueue(lb)
+}
+
+// Patches returns the patches of the LoadBalancer in order
+func (t *TestProvider) Patches() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.patches...)
+}
+
+// setBackend replaces the backend of the provider with its optional
+// interfaces
+func (p *GenericProvider) setBackend(backend Provider) {
+	p.cfg.Backend = backend
+	p.ext = newExtensions(backend)
+}
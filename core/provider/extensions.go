@@ -0,0 +1,190 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+// Extensions are the optional interfaces a Provider implements besides the
+// Provider interface, the GenericProvider detects them once as it is built.
+// A backend gains a feature by implementing one, the Provider interface
+// itself is kept as it is so that the existing backends keep building.
+type Extensions struct {
+	Listener    bool
+	Interface   bool
+	Family      bool
+	Draining    bool
+	Resync      bool
+	Deletion    bool
+	Address     bool
+	Hostname    bool
+	Certificate bool
+	Status      bool
+	Healthz     bool
+	PortHealth  bool
+	Role        bool
+	Event       bool
+	State       bool
+	Validating  bool
+	DryRun      bool
+}
+
+// DetectExtensions returns the optional interfaces the Provider implements
+func DetectExtensions(p Provider) Extensions {
+	return newExtensions(p).detected()
+}
+
+// Names returns the names of the interfaces implemented, in the order of
+// the fields
+func (e Extensions) Names() []string {
+	names := make([]string, 0)
+	for _, ext := range []struct {
+		name        string
+		implemented bool
+	}{
+		{"ListenerProvider", e.Listener},
+		{"InterfaceProvider", e.Interface},
+		{"FamilyProvider", e.Family},
+		{"DrainingProvider", e.Draining},
+		{"ResyncProvider", e.Resync},
+		{"DeletionProvider", e.Deletion},
+		{"AddressProvider", e.Address},
+		{"HostnameProvider", e.Hostname},
+		{"CertificateProvider", e.Certificate},
+		{"StatusProvider", e.Status},
+		{"HealthzProvider", e.Healthz},
+		{"PortHealthProvider", e.PortHealth},
+		{"RoleProvider", e.Role},
+		{"EventProvider", e.Event},
+		{"StateReporter", e.State},
+		{"ValidatingProvider", e.Validating},
+		{"DryRunProvider", e.DryRun},
+	} {
+		if ext.implemented {
+			names = append(names, ext.name)
+		}
+	}
+	return names
+}
+
+// extensions holds the optional interfaces of the backend as asserted once,
+// each is nil unless the backend implements it
+type extensions struct {
+	listener    ListenerProvider
+	iface       InterfaceProvider
+	family      FamilyProvider
+	draining    DrainingProvider
+	resync      ResyncProvider
+	deletion    DeletionProvider
+	address     AddressProvider
+	hostname    HostnameProvider
+	certificate CertificateProvider
+	status      StatusProvider
+	healthz     HealthzProvider
+	portHealth  PortHealthProvider
+	role        RoleProvider
+	event       EventProvider
+	state       StateReporter
+	validating  ValidatingProvider
+	dryRun      DryRunProvider
+}
+
+// Wrapper is implemented by the Providers wrapping another one, e.g. to
+// inject faults. The optional interfaces the wrapper does not implement
+// itself are detected on the wrapped Provider.
+type Wrapper interface {
+	// Unwrap returns the wrapped Provider
+	Unwrap() Provider
+}
+
+func newExtensions(p Provider) extensions {
+	var e extensions
+	if w, ok := p.(Wrapper); ok {
+		e = newExtensions(w.Unwrap())
+	}
+	if v, ok := p.(ListenerProvider); ok {
+		e.listener = v
+	}
+	if v, ok := p.(InterfaceProvider); ok {
+		e.iface = v
+	}
+	if v, ok := p.(FamilyProvider); ok {
+		e.family = v
+	}
+	if v, ok := p.(DrainingProvider); ok {
+		e.draining = v
+	}
+	if v, ok := p.(ResyncProvider); ok {
+		e.resync = v
+	}
+	if v, ok := p.(DeletionProvider); ok {
+		e.deletion = v
+	}
+	if v, ok := p.(AddressProvider); ok {
+		e.address = v
+	}
+	if v, ok := p.(HostnameProvider); ok {
+		e.hostname = v
+	}
+	if v, ok := p.(CertificateProvider); ok {
+		e.certificate = v
+	}
+	if v, ok := p.(StatusProvider); ok {
+		e.status = v
+	}
+	if v, ok := p.(HealthzProvider); ok {
+		e.healthz = v
+	}
+	if v, ok := p.(PortHealthProvider); ok {
+		e.portHealth = v
+	}
+	if v, ok := p.(RoleProvider); ok {
+		e.role = v
+	}
+	if v, ok := p.(EventProvider); ok {
+		e.event = v
+	}
+	if v, ok := p.(StateReporter); ok {
+		e.state = v
+	}
+	if v, ok := p.(ValidatingProvider); ok {
+		e.validating = v
+	}
+	if v, ok := p.(DryRunProvider); ok {
+		e.dryRun = v
+	}
+	return e
+}
+
+func (e extensions) detected() Extensions {
+	return Extensions{
+		Listener:    e.listener != nil,
+		Interface:   e.iface != nil,
+		Family:      e.family != nil,
+		Draining:    e.draining != nil,
+		Resync:      e.resync != nil,
+		Deletion:    e.deletion != nil,
+		Address:     e.address != nil,
+		Hostname:    e.hostname != nil,
+		Certificate: e.certificate != nil,
+		Status:      e.status != nil,
+		Healthz:     e.healthz != nil,
+		PortHealth:  e.portHealth != nil,
+		Role:        e.role != nil,
+		Event:       e.event != nil,
+		State:       e.state != nil,
+		Validating:  e.validating != nil,
+		DryRun:      e.dryRun != nil,
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+// extendedBackend implements all the optional interfaces
+type extendedBackend struct {
+	Provider
+	roleHandler  func(Role)
+	eventHandler func(eventtype, reason, message string)
+	healthz      error
+}
+
+func (b *extendedBackend) Info() Info                 { return Info{Name: "extended"} }
+func (b *extendedBackend) SetListers(StoreLister)     {}
+func (b *extendedBackend) Interfaces() []string       { return []string{"eth1"} }
+func (b *extendedBackend) Draining() bool             { return false }
+func (b *extendedBackend) ResyncAfter() time.Duration { return 0 }
+func (b *extendedBackend) Addresses() []net.IP        { return nil }
+func (b *extendedBackend) Hostname() string           { return "" }
+func (b *extendedBackend) Status() json.RawMessage    { return nil }
+func (b *extendedBackend) State() json.RawMessage     { return nil }
+func (b *extendedBackend) Healthz() error             { return b.healthz }
+func (b *extendedBackend) PortHealth() []PortHealth   { return nil }
+
+func (b *extendedBackend) Listeners(*netv1alpha1.LoadBalancer) (net.IP, []corenet.Port, error) {
+	return nil, nil, fmt.Errorf("no listeners")
+}
+
+func (b *extendedBackend) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+func (b *extendedBackend) OnDelete(*netv1alpha1.LoadBalancer) error { return nil }
+
+func (b *extendedBackend) ValidateLoadBalancer(*netv1alpha1.LoadBalancer) error { return nil }
+
+func (b *extendedBackend) DryRun(*netv1alpha1.LoadBalancer) (json.RawMessage, error) { return nil, nil }
+
+func (b *extendedBackend) ServingCertificates() []ServingCertificate { return nil }
+
+func (b *extendedBackend) SetRoleHandler(handler func(Role)) { b.roleHandler = handler }
+
+func (b *extendedBackend) SetEventHandler(handler func(eventtype, reason, message string)) {
+	b.eventHandler = handler
+}
+
+func TestDetectExtensions(t *testing.T) {
+	assert.Equal(t, Extensions{}, DetectExtensions(struct{ Provider }{}))
+	assert.Empty(t, Extensions{}.Names())
+
+	assert.Equal(t, Extensions{
+		Listener: true, Interface: true, Family: true, Draining: true, Resync: true, Deletion: true, Address: true,
+		Hostname: true, Certificate: true, Status: true, Healthz: true, PortHealth: true, Role: true, Event: true,
+		State: true, Validating: true, DryRun: true,
+	}, DetectExtensions(&extendedBackend{}))
+	assert.Equal(t, []string{
+		"ListenerProvider", "InterfaceProvider", "FamilyProvider", "DrainingProvider", "ResyncProvider",
+		"DeletionProvider", "AddressProvider", "HostnameProvider", "CertificateProvider", "StatusProvider",
+		"HealthzProvider", "PortHealthProvider", "RoleProvider", "EventProvider", "StateReporter",
+		"ValidatingProvider", "DryRunProvider",
+	}, DetectExtensions(&extendedBackend{}).Names())
+	assert.Equal(t, []string{"DeletionProvider"}, Extensions{Deletion: true}.Names())
+}
+
+func TestExtensionsAbsent(t *testing.T) {
+	p := &GenericProvider{cfg: &Configuration{LooseRPFilter: true}, stopLock: &sync.Mutex{}}
+	p.setBackend(&capabilitiesBackend{})
+	lb := &netv1alpha1.LoadBalancer{}
+
+	assert.Empty(t, p.Info().Extensions)
+	assert.Nil(t, p.Healthz())
+	assert.Nil(t, p.checkPorts(lb))
+	assert.Nil(t, p.backendInterfaces())
+	assert.Equal(t, []corenet.Family{corenet.FamilyIPv4}, p.supportedFamilies())
+}
+
+func TestExtensionsPresent(t *testing.T) {
+	backend := &extendedBackend{healthz: fmt.Errorf("down")}
+	p := &GenericProvider{cfg: &Configuration{LooseRPFilter: true}, stopLock: &sync.Mutex{}}
+	p.setBackend(backend)
+	lb := &netv1alpha1.LoadBalancer{}
+
+	assert.Equal(t, DetectExtensions(backend).Names(), p.Info().Extensions)
+	assert.Equal(t, backend.healthz, p.Healthz())
+	assert.EqualError(t, p.checkPorts(lb), "no listeners")
+	assert.Equal(t, []string{"eth1"}, p.backendInterfaces())
+	assert.Equal(t, backend.SupportedFamilies(), p.supportedFamilies())
+
+	p.setupBackend()
+	assert.NotNil(t, backend.roleHandler)
+	assert.NotNil(t, backend.eventHandler)
+}
+
+func TestExtensionsDetectedOnce(t *testing.T) {
+	// the backend is not asserted again after the provider is built
+	backend := &extendedBackend{healthz: fmt.Errorf("down")}
+	p := &GenericProvider{cfg: &Configuration{}, stopLock: &sync.Mutex{}}
+	p.setBackend(backend)
+	p.cfg.Backend = &capabilitiesBackend{}
+	assert.Equal(t, backend.healthz, p.Healthz())
+}
+
+// healthzWrapper wraps a Provider and reports its own health
+type healthzWrapper struct {
+	Provider
+}
+
+func (w *healthzWrapper) Unwrap() Provider { return w.Provider }
+func (w *healthzWrapper) Healthz() error   { return fmt.Errorf("wrapper down") }
+
+func TestExtensionsOfWrapper(t *testing.T) {
+	backend := &extendedBackend{healthz: fmt.Errorf("down")}
+	wrapper := &healthzWrapper{backend}
+	assert.Equal(t, DetectExtensions(backend), DetectExtensions(wrapper))
+
+	// the interfaces of the wrapper take precedence
+	p := &GenericProvider{cfg: &Configuration{}, stopLock: &sync.Mutex{}}
+	p.setBackend(wrapper)
+	assert.EqualError(t, p.Healthz(), "wrapper down")
+	assert.Equal(t, []string{"eth1"}, p.ext.iface.Interfaces())
+
+	assert.Equal(t, []string{"HealthzProvider"}, DetectExtensions(&healthzWrapper{&capabilitiesBackend{}}).Names())
+}
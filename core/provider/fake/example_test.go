@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake_test
+
+import (
+	"fmt"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// The real servers of a backend are computed from the nodes of the
+// StoreLister, as OnUpdate does
+func ExampleNewStoreListerFromObjects() {
+	lister := fake.NewStoreListerFromObjects(
+		fake.NewNode("node1", "192.168.1.1"),
+		fake.NewNode("node2", "192.168.1.2"),
+	)
+
+	// node3 is missing, it is skipped
+	for _, rs := range lister.RealServers([]string{"node1", "node2", "node3"}, corenet.FamilyIPv4) {
+		fmt.Println(rs.Node, rs.IP, rs.Weight)
+	}
+	// Output:
+	// node1 192.168.1.1 100
+	// node2 192.168.1.2 100
+}
+
+// The Store changes the nodes under the StoreLister to test how the real
+// servers follow the churn
+func ExampleStore() {
+	store := fake.NewStore(
+		fake.NewNode("node1", "192.168.1.1"),
+		fake.NewNode("node2", "192.168.1.2"),
+	)
+	lister := store.Lister()
+	names := []string{"node1", "node2"}
+
+	// a node going not ready is weighted to zero
+	notReady := fake.NewNode("node1", "192.168.1.1")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+	store.Update(notReady)
+	fmt.Println(lister.RealServers(names, corenet.FamilyIPv4))
+
+	// an ineligible node is not a real server
+	lister.Eligible = func(node *v1.Node) bool { return node.Name != "node2" }
+	fmt.Println(lister.RealServers(names, corenet.FamilyIPv4))
+
+	// a deleted node is not either
+	store.Delete(notReady)
+	fmt.Println(lister.RealServers(names, corenet.FamilyIPv4))
+	// Output:
+	// [{node1 192.168.1.1 0} {node2 192.168.1.2 100}]
+	// [{node1 192.168.1.1 0}]
+	// []
+}
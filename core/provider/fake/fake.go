@@ -0,0 +1,433 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides a Provider recording its calls and behaving as
+// scripted, for testing the GenericProvider and the ones embedding it
+// without a real backend.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+)
+
+// The methods recorded by the FakeProvider, the getters called on every
+// sync, e.g. Info and Status, are not recorded
+const (
+	MethodSetListers      = "SetListers"
+	MethodOnUpdate        = "OnUpdate"
+	MethodOnDelete        = "OnDelete"
+	MethodDryRun          = "DryRun"
+	MethodStart           = "Start"
+	MethodWaitForStart    = "WaitForStart"
+	MethodStop            = "Stop"
+	MethodSetRoleHandler  = "SetRoleHandler"
+	MethodSetEventHandler = "SetEventHandler"
+)
+
+// Call is a recorded call of a method of the FakeProvider
+type Call struct {
+	Method string
+	Time   time.Time
+	// Object is the argument of the call if any, e.g. the LoadBalancer of
+	// OnUpdate, as it was passed
+	Object interface{}
+}
+
+// Behavior is the scripted behavior of the calls of a method, the calls
+// without one succeed
+type Behavior struct {
+	// Times is the number of the calls behaving so, one if it is zero
+	Times int
+	// Release blocks the calls until it is closed
+	Release <-chan struct{}
+	// Panic is the value the calls panic with if it is not nil
+	Panic interface{}
+	// Err is returned by the calls, WaitForStart returns false instead
+	Err error
+}
+
+// FailTimes returns the behavior of failing n calls with err
+func FailTimes(err error, n int) Behavior {
+	return Behavior{Times: n, Err: err}
+}
+
+// BlockUntil returns the behavior of blocking a call until release is
+// closed
+func BlockUntil(release <-chan struct{}) Behavior {
+	return Behavior{Release: release}
+}
+
+// PanicOnce returns the behavior of panicking a call with v
+func PanicOnce(v interface{}) Behavior {
+	return Behavior{Panic: v}
+}
+
+// FakeProvider is a Provider which records the calls of its methods and
+// behaves as scripted, it implements the optional DeletionProvider,
+// ResyncProvider, StatusProvider, HealthzProvider, DrainingProvider,
+// RoleProvider, EventProvider and StateReporter too. It is safe for concurrent use.
+type FakeProvider struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	info      core.Info
+	calls     []Call
+	behaviors map[string][]Behavior
+	// changed is closed and replaced on every recorded call
+	changed chan struct{}
+
+	lister       core.StoreLister
+	roleHandler  func(core.Role)
+	eventHandler func(eventtype, reason, message string)
+	resyncAfter  time.Duration
+	status       json.RawMessage
+	state        json.RawMessage
+	healthz      error
+	draining     bool
+}
+
+var (
+	_ core.Provider         = &FakeProvider{}
+	_ core.DeletionProvider = &FakeProvider{}
+	_ core.ResyncProvider   = &FakeProvider{}
+	_ core.StatusProvider   = &FakeProvider{}
+	_ core.HealthzProvider  = &FakeProvider{}
+	_ core.DrainingProvider = &FakeProvider{}
+	_ core.RoleProvider     = &FakeProvider{}
+	_ core.EventProvider    = &FakeProvider{}
+	_ core.StateReporter    = &FakeProvider{}
+	_ core.DryRunProvider   = &FakeProvider{}
+)
+
+// NewFakeProvider returns a FakeProvider of the name, the calls succeed
+// until they are scripted
+func NewFakeProvider(name string) *FakeProvider {
+	return &FakeProvider{
+		now:       time.Now,
+		info:      core.Info{Name: name},
+		behaviors: make(map[string][]Behavior),
+		changed:   make(chan struct{}),
+	}
+}
+
+// Script appends the behaviors of the next calls of the method, they are
+// taken in order
+func (f *FakeProvider) Script(method string, behaviors ...Behavior) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, b := range behaviors {
+		if b.Times <= 0 {
+			b.Times = 1
+		}
+		f.behaviors[method] = append(f.behaviors[method], b)
+	}
+}
+
+// call records the call and returns its behavior
+func (f *FakeProvider) call(method string, obj interface{}) Behavior {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, Call{Method: method, Time: f.now(), Object: obj})
+	close(f.changed)
+	f.changed = make(chan struct{})
+
+	scripted := f.behaviors[method]
+	if len(scripted) == 0 {
+		return Behavior{}
+	}
+	b := scripted[0]
+	scripted[0].Times--
+	if scripted[0].Times == 0 {
+		f.behaviors[method] = scripted[1:]
+	}
+	return b
+}
+
+// behave blocks and panics as the behavior says, and returns its error
+func (b Behavior) behave() error {
+	if b.Release != nil {
+		<-b.Release
+	}
+	if b.Panic != nil {
+		panic(b.Panic)
+	}
+	return b.Err
+}
+
+// Calls returns the recorded calls in order, of the methods if any are
+// given
+func (f *FakeProvider) Calls(methods ...string) []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]Call, 0, len(f.calls))
+	for _, c := range f.calls {
+		if len(methods) == 0 || contains(methods, c.Method) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// Methods returns the methods of the recorded calls in order
+func (f *FakeProvider) Methods() []string {
+	calls := f.Calls()
+	ret := make([]string, 0, len(calls))
+	for _, c := range calls {
+		ret = append(ret, c.Method)
+	}
+	return ret
+}
+
+// CallCount returns the number of the recorded calls of the method
+func (f *FakeProvider) CallCount(method string) int {
+	return len(f.Calls(method))
+}
+
+// Updates returns the LoadBalancers passed to OnUpdate in order
+func (f *FakeProvider) Updates() []*netv1alpha1.LoadBalancer {
+	return f.loadBalancers(MethodOnUpdate)
+}
+
+// DryRuns returns the LoadBalancers passed to DryRun in order
+func (f *FakeProvider) DryRuns() []*netv1alpha1.LoadBalancer {
+	return f.loadBalancers(MethodDryRun)
+}
+
+func (f *FakeProvider) loadBalancers(method string) []*netv1alpha1.LoadBalancer {
+	calls := f.Calls(method)
+	ret := make([]*netv1alpha1.LoadBalancer, 0, len(calls))
+	for _, c := range calls {
+		ret = append(ret, c.Object.(*netv1alpha1.LoadBalancer))
+	}
+	return ret
+}
+
+// WaitForCallCount waits until the method has been called n times, it
+// returns an error if the timeout expires first
+func (f *FakeProvider) WaitForCallCount(method string, n int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.mu.Lock()
+		count := 0
+		for _, c := range f.calls {
+			if c.Method == method {
+				count++
+			}
+		}
+		changed := f.changed
+		f.mu.Unlock()
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%s called %d times, expected %d in %v", method, count, n, timeout)
+		}
+	}
+}
+
+// WaitForOnUpdateCount waits until OnUpdate has been called n times
+func (f *FakeProvider) WaitForOnUpdateCount(n int, timeout time.Duration) error {
+	return f.WaitForCallCount(MethodOnUpdate, n, timeout)
+}
+
+// Info implements core.Provider
+func (f *FakeProvider) Info() core.Info {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.info
+}
+
+// SetCapabilities sets the capabilities of the Info
+func (f *FakeProvider) SetCapabilities(c *core.Capabilities) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.info.Capabilities = c
+}
+
+// SetListers implements core.Provider
+func (f *FakeProvider) SetListers(lister core.StoreLister) {
+	f.call(MethodSetListers, lister).behave()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lister = lister
+}
+
+// Lister returns the StoreLister last set
+func (f *FakeProvider) Lister() core.StoreLister {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lister
+}
+
+// OnUpdate implements core.Provider
+func (f *FakeProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	return f.call(MethodOnUpdate, lb).behave()
+}
+
+// OnDelete implements core.DeletionProvider
+func (f *FakeProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	return f.call(MethodOnDelete, lb).behave()
+}
+
+// DryRun implements core.DryRunProvider, it returns the state set by
+// SetState unless it is scripted to fail
+func (f *FakeProvider) DryRun(lb *netv1alpha1.LoadBalancer) (json.RawMessage, error) {
+	if err := f.call(MethodDryRun, lb).behave(); err != nil {
+		return nil, err
+	}
+	return f.State(), nil
+}
+
+// Start implements core.Provider
+func (f *FakeProvider) Start() {
+	f.call(MethodStart, nil).behave()
+}
+
+// WaitForStart implements core.Provider, it returns false if the call is
+// scripted to fail
+func (f *FakeProvider) WaitForStart() bool {
+	return f.call(MethodWaitForStart, nil).behave() == nil
+}
+
+// Stop implements core.Provider
+func (f *FakeProvider) Stop() error {
+	return f.call(MethodStop, nil).behave()
+}
+
+// SetRoleHandler implements core.RoleProvider
+func (f *FakeProvider) SetRoleHandler(handler func(core.Role)) {
+	f.call(MethodSetRoleHandler, nil).behave()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roleHandler = handler
+}
+
+// SetRole reports the role to the handler if it is set
+func (f *FakeProvider) SetRole(role core.Role) {
+	f.mu.Lock()
+	handler := f.roleHandler
+	f.mu.Unlock()
+	if handler != nil {
+		handler(role)
+	}
+}
+
+// SetEventHandler implements core.EventProvider
+func (f *FakeProvider) SetEventHandler(handler func(eventtype, reason, message string)) {
+	f.call(MethodSetEventHandler, nil).behave()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.eventHandler = handler
+}
+
+// Event reports the event to the handler if it is set
+func (f *FakeProvider) Event(eventtype, reason, message string) {
+	f.mu.Lock()
+	handler := f.eventHandler
+	f.mu.Unlock()
+	if handler != nil {
+		handler(eventtype, reason, message)
+	}
+}
+
+// ResyncAfter implements core.ResyncProvider
+func (f *FakeProvider) ResyncAfter() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.resyncAfter
+}
+
+// SetResyncAfter sets the resync ResyncAfter asks for, none if it is zero
+func (f *FakeProvider) SetResyncAfter(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resyncAfter = d
+}
+
+// Status implements core.StatusProvider
+func (f *FakeProvider) Status() json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// SetStatus sets the status fragment Status returns
+func (f *FakeProvider) SetStatus(status json.RawMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+// State implements core.StateReporter
+func (f *FakeProvider) State() json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+// SetState sets the section State returns
+func (f *FakeProvider) SetState(state json.RawMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+// Healthz implements core.HealthzProvider
+func (f *FakeProvider) Healthz() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.healthz
+}
+
+// SetHealthz sets the error Healthz returns
+func (f *FakeProvider) SetHealthz(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.healthz = err
+}
+
+// Draining implements core.DrainingProvider
+func (f *FakeProvider) Draining() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.draining
+}
+
+// SetDraining sets whether Draining returns true
+func (f *FakeProvider) SetDraining(draining bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.draining = draining
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
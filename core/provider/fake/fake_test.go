@@ -0,0 +1,68 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeProviderScript(t *testing.T) {
+	f := NewFakeProvider("fake")
+	busy, broken := fmt.Errorf("busy"), fmt.Errorf("broken")
+	f.Script(MethodOnUpdate, FailTimes(busy, 2), Behavior{Err: broken})
+	f.Script(MethodWaitForStart, FailTimes(broken, 1))
+
+	assert.False(t, f.WaitForStart())
+	assert.True(t, f.WaitForStart())
+	assert.Equal(t, busy, f.OnUpdate(nil))
+	assert.Equal(t, busy, f.OnUpdate(nil))
+	assert.Equal(t, broken, f.OnUpdate(nil))
+	assert.Nil(t, f.OnUpdate(nil))
+	assert.Nil(t, f.OnDelete(nil))
+	assert.Equal(t, 4, f.CallCount(MethodOnUpdate))
+	assert.Equal(t, []string{MethodWaitForStart, MethodWaitForStart, MethodOnUpdate, MethodOnUpdate, MethodOnUpdate, MethodOnUpdate, MethodOnDelete}, f.Methods())
+
+	f.Script(MethodStop, PanicOnce("boom"))
+	assert.Panics(t, func() { f.Stop() })
+	assert.Nil(t, f.Stop())
+}
+
+func TestFakeProviderConcurrent(t *testing.T) {
+	f := NewFakeProvider("fake")
+	release := make(chan struct{})
+	f.Script(MethodOnUpdate, Behavior{Times: 5, Release: release})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.OnUpdate(nil)
+		}()
+	}
+	// the blocked calls are recorded
+	assert.Nil(t, f.WaitForOnUpdateCount(10, 5*time.Second))
+	assert.NotNil(t, f.WaitForOnUpdateCount(11, 10*time.Millisecond))
+	close(release)
+	wg.Wait()
+	assert.Len(t, f.Updates(), 10)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"fmt"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Store holds the objects listed by a StoreLister in indexers as the
+// informers do, they are added, updated and deleted through it to simulate
+// the churn of the caches after the StoreLister is built
+type Store struct {
+	LoadBalancers cache.Indexer
+	Nodes         cache.Indexer
+	Secrets       cache.Indexer
+	Services      cache.Indexer
+	Endpoints     cache.Indexer
+	ConfigMaps    cache.Indexer
+}
+
+// NewStore returns a Store of the objects, the LoadBalancers, Nodes,
+// Secrets, Services, Endpoints and ConfigMaps. It panics on the objects of
+// other types.
+func NewStore(objects ...runtime.Object) *Store {
+	newIndexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+	s := &Store{
+		LoadBalancers: newIndexer(),
+		Nodes:         newIndexer(),
+		Secrets:       newIndexer(),
+		Services:      newIndexer(),
+		Endpoints:     newIndexer(),
+		ConfigMaps:    newIndexer(),
+	}
+	if err := s.Add(objects...); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewStoreListerFromObjects returns a StoreLister of the objects, as
+// NewStore does, with the default policies
+func NewStoreListerFromObjects(objects ...runtime.Object) core.StoreLister {
+	return NewStore(objects...).Lister()
+}
+
+// Lister returns a StoreLister listing the objects of the Store, all the
+// listers are set. The policies and the filters are the defaults, they are
+// set on the returned StoreLister by the tests changing them.
+func (s *Store) Lister() core.StoreLister {
+	return core.StoreLister{
+		LoadBalancer: netlisters.NewLoadBalancerLister(s.LoadBalancers),
+		Node:         v1listers.NewNodeLister(s.Nodes),
+		Secret:       v1listers.NewSecretLister(s.Secrets),
+		Service:      v1listers.NewServiceLister(s.Services),
+		Endpoints:    v1listers.NewEndpointsLister(s.Endpoints),
+		ConfigMap:    v1listers.NewConfigMapLister(s.ConfigMaps),
+	}
+}
+
+// Add adds the objects to the Store
+func (s *Store) Add(objects ...runtime.Object) error {
+	return s.each(objects, cache.Indexer.Add)
+}
+
+// Update replaces the objects of the Store with the same keys
+func (s *Store) Update(objects ...runtime.Object) error {
+	return s.each(objects, cache.Indexer.Update)
+}
+
+// Delete deletes the objects with the same keys from the Store
+func (s *Store) Delete(objects ...runtime.Object) error {
+	return s.each(objects, cache.Indexer.Delete)
+}
+
+func (s *Store) each(objects []runtime.Object, apply func(cache.Indexer, interface{}) error) error {
+	for _, obj := range objects {
+		indexer, err := s.indexerFor(obj)
+		if err != nil {
+			return err
+		}
+		if err := apply(indexer, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) indexerFor(obj runtime.Object) (cache.Indexer, error) {
+	switch obj.(type) {
+	case *netv1alpha1.LoadBalancer:
+		return s.LoadBalancers, nil
+	case *v1.Node:
+		return s.Nodes, nil
+	case *v1.Secret:
+		return s.Secrets, nil
+	case *v1.Service:
+		return s.Services, nil
+	case *v1.Endpoints:
+		return s.Endpoints, nil
+	case *v1.ConfigMap:
+		return s.ConfigMaps, nil
+	}
+	return nil, fmt.Errorf("unsupported object %T", obj)
+}
+
+// NewNode returns a ready Node of the internal ip
+func NewNode(name, ip string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	node.Status.Addresses = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}}
+	node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	return node
+}
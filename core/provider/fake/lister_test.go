@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestStore(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tls"}}
+	service := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	endpoints := &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	cm := &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"}}
+	s := NewStore(lb, NewNode("node1", "192.168.1.1"), secret, service, endpoints, cm)
+	lister := s.Lister()
+
+	got, err := lister.LoadBalancer.LoadBalancers("default").Get("lb")
+	assert.Nil(t, err)
+	assert.Equal(t, lb, got)
+	nodes, err := lister.Node.List(labels.Everything())
+	assert.Nil(t, err)
+	assert.Len(t, nodes, 1)
+	_, err = lister.Secret.Secrets("default").Get("tls")
+	assert.Nil(t, err)
+	_, err = lister.Service.Services("default").Get("web")
+	assert.Nil(t, err)
+	_, err = lister.Endpoints.Endpoints("default").Get("web")
+	assert.Nil(t, err)
+	_, err = lister.ConfigMap.ConfigMaps("default").Get("config")
+	assert.Nil(t, err)
+
+	// the churn is seen by the lister built before
+	updated := NewNode("node1", "192.168.1.10")
+	assert.Nil(t, s.Update(updated))
+	node, err := lister.Node.Get("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, updated, node)
+	assert.Nil(t, s.Add(NewNode("node2", "192.168.1.2")))
+	assert.Nil(t, s.Delete(secret, updated))
+	_, err = lister.Secret.Secrets("default").Get("tls")
+	assert.True(t, errors.IsNotFound(err))
+	nodes, err = lister.Node.List(labels.Everything())
+	assert.Nil(t, err)
+	if assert.Len(t, nodes, 1) {
+		assert.Equal(t, "node2", nodes[0].Name)
+	}
+
+	assert.NotNil(t, s.Add(&v1.Pod{}))
+	assert.Panics(t, func() { NewStoreListerFromObjects(&v1.Pod{}) })
+}
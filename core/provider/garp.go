@@ -0,0 +1,79 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+)
+
+const (
+	// AnnotationKeyGARPMasterDelay is the seconds after a node takes the
+	// VIPs over the gratuitous ARPs are sent again, so the switches
+	// suppressing ARP for a while after a change learn them too, 0 sends
+	// them once
+	AnnotationKeyGARPMasterDelay = "loadbalancer.caicloud.io/garp-master-delay"
+	// AnnotationKeyGARPMasterRepeat is the number of the gratuitous ARPs of
+	// every VIP sent at a time after the takeover
+	AnnotationKeyGARPMasterRepeat = "loadbalancer.caicloud.io/garp-master-repeat"
+	// AnnotationKeyGARPMasterRefresh is the interval in seconds of the
+	// gratuitous ARPs while the node holds the VIPs, 0 disables them
+	AnnotationKeyGARPMasterRefresh = "loadbalancer.caicloud.io/garp-master-refresh"
+	// AnnotationKeyGARPMasterRefreshRepeat is the number of the gratuitous
+	// ARPs of every VIP sent at a time by the refreshes
+	AnnotationKeyGARPMasterRefreshRepeat = "loadbalancer.caicloud.io/garp-master-refresh-repeat"
+)
+
+const (
+	maxGARPMasterDelay   = 60
+	maxGARPMasterRepeat  = 100
+	maxGARPMasterRefresh = 3600
+)
+
+// GetGARPSchedule returns the schedule of the gratuitous ARPs after the
+// takeover of the VIPs, the annotations of the LoadBalancer override the
+// defaults of the backend. It returns a PermanentError if a value is invalid
+// or out of range.
+func GetGARPSchedule(lb *netv1alpha1.LoadBalancer, defaults arp.Schedule) (arp.Schedule, error) {
+	schedule := defaults
+	for _, v := range []struct {
+		key string
+		min int
+		max int
+		set func(int)
+	}{
+		{AnnotationKeyGARPMasterDelay, 0, maxGARPMasterDelay, func(n int) { schedule.Delay = time.Duration(n) * time.Second }},
+		{AnnotationKeyGARPMasterRepeat, 1, maxGARPMasterRepeat, func(n int) { schedule.Repeat = n }},
+		{AnnotationKeyGARPMasterRefresh, 0, maxGARPMasterRefresh, func(n int) { schedule.Refresh = time.Duration(n) * time.Second }},
+		{AnnotationKeyGARPMasterRefreshRepeat, 1, maxGARPMasterRepeat, func(n int) { schedule.RefreshRepeat = n }},
+	} {
+		s, ok := lb.Annotations[v.key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < v.min || n > v.max {
+			return arp.Schedule{}, NewPermanentError("InvalidGARPConfig", fmt.Errorf("invalid %s %q, it must be in [%d, %d]", v.key, s, v.min, v.max))
+		}
+		v.set(n)
+	}
+	return schedule, nil
+}
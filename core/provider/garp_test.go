@@ -0,0 +1,57 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGARPSchedule(t *testing.T) {
+	defaults := arp.Schedule{Repeat: 3, Interval: time.Second, Refresh: 30 * time.Second, RefreshRepeat: 1}
+	lb := &netv1alpha1.LoadBalancer{}
+	schedule, err := GetGARPSchedule(lb, defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, defaults, schedule)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyGARPMasterDelay:         "10",
+		AnnotationKeyGARPMasterRepeat:        "5",
+		AnnotationKeyGARPMasterRefresh:       "0",
+		AnnotationKeyGARPMasterRefreshRepeat: "2",
+	}
+	schedule, err = GetGARPSchedule(lb, defaults)
+	assert.Nil(t, err)
+	assert.Equal(t, arp.Schedule{Repeat: 5, Interval: time.Second, Delay: 10 * time.Second, RefreshRepeat: 2}, schedule)
+
+	for key, values := range map[string][]string{
+		AnnotationKeyGARPMasterDelay:         {"-1", "61", "5s"},
+		AnnotationKeyGARPMasterRepeat:        {"0", "101"},
+		AnnotationKeyGARPMasterRefresh:       {"-1", "3601"},
+		AnnotationKeyGARPMasterRefreshRepeat: {"0", "many"},
+	} {
+		for _, v := range values {
+			lb.Annotations = map[string]string{key: v}
+			_, err := GetGARPSchedule(lb, defaults)
+			assert.True(t, IsPermanentError(err), "%s=%s", key, v)
+		}
+	}
+}
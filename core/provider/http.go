@@ -0,0 +1,366 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// AnnotationKeyHTTPPorts is the ports terminating HTTP and HTTPS in json,
+// e.g. [{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}],
+// they are proxied to the Endpoints of the Services in the namespace of
+// the LoadBalancer. The hosts of a port are routed to their own Services
+// by SNI or the Host header, e.g. "hosts":[{"host":"api.example.com","tlsSecret":"api-cert","service":"api","servicePort":80}],
+// the Service of the port serves the hosts which do not match.
+const AnnotationKeyHTTPPorts = "loadbalancer.caicloud.io/http-ports"
+
+// HTTPProtocol is the protocol a HTTPPort terminates
+type HTTPProtocol string
+
+const (
+	// HTTPProtocolHTTP terminates plain HTTP
+	HTTPProtocolHTTP HTTPProtocol = "http"
+	// HTTPProtocolHTTPS terminates TLS with the certificate in a Secret
+	HTTPProtocolHTTPS HTTPProtocol = "https"
+)
+
+// HTTPPort is a port terminating HTTP and proxying to a port of a Service
+type HTTPPort struct {
+	Port int `json:"port"`
+	// Protocol defaults to http
+	Protocol HTTPProtocol `json:"protocol,omitempty"`
+	// TLSSecret is the name of the kubernetes.io/tls Secret in the
+	// namespace of the LoadBalancer, required by https
+	TLSSecret   string `json:"tlsSecret,omitempty"`
+	Service     string `json:"service"`
+	ServicePort int    `json:"servicePort"`
+	// Hosts are routed to their own Services, sorted by host
+	Hosts []HTTPHost `json:"hosts,omitempty"`
+}
+
+// HTTPHost is a host of a HTTPPort proxied to a port of a Service
+type HTTPHost struct {
+	Host string `json:"host"`
+	// TLSSecret is the name of the kubernetes.io/tls Secret of the host on
+	// a https port, the one of the port if empty
+	TLSSecret   string `json:"tlsSecret,omitempty"`
+	Service     string `json:"service"`
+	ServicePort int    `json:"servicePort"`
+}
+
+// GetHTTPPorts returns the HTTP ports of the LoadBalancer sorted by port,
+// nil if not specified. It returns a PermanentError if they are invalid.
+func GetHTTPPorts(lb *netv1alpha1.LoadBalancer) ([]HTTPPort, error) {
+	value, ok := lb.Annotations[AnnotationKeyHTTPPorts]
+	if !ok {
+		return nil, nil
+	}
+
+	ports := make([]HTTPPort, 0)
+	if err := json.Unmarshal([]byte(value), &ports); err != nil {
+		return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid http ports %q: %v", value, err))
+	}
+	seen := make(map[int]bool, len(ports))
+	for i := range ports {
+		p := &ports[i]
+		if p.Protocol == "" {
+			p.Protocol = HTTPProtocolHTTP
+		}
+		switch {
+		case p.Port <= 0 || p.Port > 65535:
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid port %d", p.Port))
+		case seen[p.Port]:
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("duplicate port %d", p.Port))
+		case p.Protocol != HTTPProtocolHTTP && p.Protocol != HTTPProtocolHTTPS:
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid protocol %q of port %d", p.Protocol, p.Port))
+		case p.Protocol == HTTPProtocolHTTPS && p.TLSSecret == "":
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("https port %d has no tls secret", p.Port))
+		case p.Protocol == HTTPProtocolHTTP && p.TLSSecret != "":
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("http port %d has a tls secret", p.Port))
+		case p.Service == "" || p.ServicePort <= 0 || p.ServicePort > 65535:
+			return nil, NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid service %q port %d of port %d", p.Service, p.ServicePort, p.Port))
+		}
+		if err := validateHTTPHosts(p); err != nil {
+			return nil, err
+		}
+		seen[p.Port] = true
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports, nil
+}
+
+// validateHTTPHosts returns a PermanentError if the hosts of the port are
+// invalid or duplicate, it defaults their tls Secrets to the one of the
+// port and sorts them by host
+func validateHTTPHosts(p *HTTPPort) error {
+	seen := make(map[string]bool, len(p.Hosts))
+	for i := range p.Hosts {
+		h := &p.Hosts[i]
+		h.Host = strings.ToLower(h.Host)
+		switch {
+		case len(validation.IsDNS1123Subdomain(h.Host)) > 0:
+			return NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid host %q of port %d", h.Host, p.Port))
+		case seen[h.Host]:
+			return NewPermanentError("InvalidHTTPPorts", fmt.Errorf("duplicate host %q of port %d", h.Host, p.Port))
+		case p.Protocol == HTTPProtocolHTTP && h.TLSSecret != "":
+			return NewPermanentError("InvalidHTTPPorts", fmt.Errorf("host %q of http port %d has a tls secret", h.Host, p.Port))
+		case h.Service == "" || h.ServicePort <= 0 || h.ServicePort > 65535:
+			return NewPermanentError("InvalidHTTPPorts", fmt.Errorf("invalid service %q port %d of host %q of port %d", h.Service, h.ServicePort, h.Host, p.Port))
+		}
+		if h.TLSSecret == "" {
+			h.TLSSecret = p.TLSSecret
+		}
+		seen[h.Host] = true
+	}
+	sort.Slice(p.Hosts, func(i, j int) bool { return p.Hosts[i].Host < p.Hosts[j].Host })
+	return nil
+}
+
+// TLSCertificate is the PEM encoded certificate chain and key of a
+// kubernetes.io/tls Secret
+type TLSCertificate struct {
+	Cert []byte
+	Key  []byte
+	// Fingerprint is the hex encoded SHA-256 of the leaf certificate
+	Fingerprint string
+	// NotAfter is the expiry of the leaf certificate
+	NotAfter time.Time
+}
+
+// String implements fmt.Stringer without the key
+func (c TLSCertificate) String() string {
+	return fmt.Sprintf("{%d bytes cert ******}", len(c.Cert))
+}
+
+// GoString implements fmt.GoStringer without the key
+func (c TLSCertificate) GoString() string {
+	return c.String()
+}
+
+// GetTLSCertificate returns the certificate in the named Secret in the
+// namespace of the LoadBalancer. It returns a PermanentError if the Secret
+// is missing, the certificate does not match the key or it is expired, the
+// LoadBalancer is resynced when the Secret changes.
+func GetTLSCertificate(lb *netv1alpha1.LoadBalancer, secrets v1listers.SecretLister, name string) (*TLSCertificate, error) {
+	if secrets == nil {
+		return nil, fmt.Errorf("no secret lister to get the tls secret %s/%s", lb.Namespace, name)
+	}
+	secret, err := secrets.Secrets(lb.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, NewPermanentError("TLSSecretNotFound", fmt.Errorf("tls secret %s/%s not found", lb.Namespace, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &TLSCertificate{Cert: secret.Data[v1.TLSCertKey], Key: secret.Data[v1.TLSPrivateKeyKey]}
+	pair, err := tls.X509KeyPair(cert.Cert, cert.Key)
+	if err != nil {
+		return nil, NewPermanentError("InvalidTLSSecret", fmt.Errorf("invalid certificate in tls secret %s/%s: %v", lb.Namespace, name, err))
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, NewPermanentError("InvalidTLSSecret", fmt.Errorf("invalid certificate in tls secret %s/%s: %v", lb.Namespace, name, err))
+	}
+	// the listener keeps serving the previous certificate instead
+	if time.Now().After(leaf.NotAfter) {
+		return nil, NewPermanentError("ExpiredTLSSecret", fmt.Errorf("certificate in tls secret %s/%s expired at %v", lb.Namespace, name, leaf.NotAfter))
+	}
+	sum := sha256.Sum256(leaf.Raw)
+	cert.Fingerprint = hex.EncodeToString(sum[:])
+	cert.NotAfter = leaf.NotAfter
+	return cert, nil
+}
+
+// Endpoint is an address serving a port of a Service
+type Endpoint struct {
+	IP   net.IP
+	Port int
+}
+
+// String returns the address in the host:port form
+func (e Endpoint) String() string {
+	return net.JoinHostPort(e.IP.String(), strconv.Itoa(e.Port))
+}
+
+// ServiceEndpoints returns the ready endpoints of the port of the Service,
+// sorted by address. It returns a PermanentError if the Service is missing
+// or has no such port, the LoadBalancer is resynced when the Service or its
+// Endpoints change. The listers are only set if the Configuration watches
+// the Services.
+func (s StoreLister) ServiceEndpoints(namespace, name string, port int) ([]Endpoint, error) {
+	return s.serviceEndpoints(namespace, name, port, v1.ProtocolTCP)
+}
+
+// serviceEndpoints returns the ready endpoints of the port of the protocol
+// of the Service like ServiceEndpoints
+func (s StoreLister) serviceEndpoints(namespace, name string, port int, protocol v1.Protocol) ([]Endpoint, error) {
+	if s.Service == nil || s.Endpoints == nil {
+		return nil, fmt.Errorf("no service lister to get the service %s/%s", namespace, name)
+	}
+	svc, err := s.Service.Services(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, NewPermanentError("ServiceNotFound", fmt.Errorf("service %s/%s not found", namespace, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var svcPort *v1.ServicePort
+	for i := range svc.Spec.Ports {
+		if int(svc.Spec.Ports[i].Port) == port && protocolOf(svc.Spec.Ports[i].Protocol) == protocol {
+			svcPort = &svc.Spec.Ports[i]
+			break
+		}
+	}
+	if svcPort == nil {
+		return nil, NewPermanentError("InvalidServicePort", fmt.Errorf("service %s/%s has no %s port %d", namespace, name, strings.ToLower(string(protocol)), port))
+	}
+
+	eps, err := s.Endpoints.Endpoints(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	endpoints := make([]Endpoint, 0)
+	for _, subset := range eps.Subsets {
+		for _, p := range subset.Ports {
+			if p.Name != svcPort.Name || protocolOf(p.Protocol) != protocol {
+				continue
+			}
+			for _, addr := range subset.Addresses {
+				ip := net.ParseIP(addr.IP)
+				if ip == nil {
+					continue
+				}
+				endpoints = append(endpoints, Endpoint{IP: ip, Port: int(p.Port)})
+			}
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].String() < endpoints[j].String() })
+	return endpoints, nil
+}
+
+// protocolOf returns the protocol of a port of a Service or Endpoints, it
+// defaults to TCP
+func protocolOf(protocol v1.Protocol) v1.Protocol {
+	if protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return protocol
+}
+
+// referencesService returns true if a HTTP or TCP port of the LoadBalancer
+// proxies to the Service or it lists the Service
+func referencesService(lb *netv1alpha1.LoadBalancer, name string) bool {
+	for _, s := range referencedServices(lb) {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// referencedServices returns the names of the Services the LoadBalancer
+// lists or its HTTP, TCP and endpoint ports route to, without the
+// duplicates
+func referencedServices(lb *netv1alpha1.LoadBalancer) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, s := range GetServices(lb) {
+		add(s)
+	}
+	httpPorts, _ := GetHTTPPorts(lb)
+	for _, p := range httpPorts {
+		add(p.Service)
+		for _, h := range p.Hosts {
+			add(h.Service)
+		}
+	}
+	tcpPorts, _ := GetTCPPorts(lb)
+	for _, p := range tcpPorts {
+		add(p.Service)
+	}
+	endpointPorts, _ := GetEndpointPorts(lb)
+	for _, p := range endpointPorts {
+		add(p.Service)
+	}
+	return names
+}
+
+// newServiceInformer returns an informer of the Services in the namespace
+func newServiceInformer(client kubernetes.Interface, namespace string, resync time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Services(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Services(namespace).Watch(options)
+			},
+		},
+		&v1.Service{},
+		resync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
+
+// newEndpointsInformer returns an informer of the Endpoints in the namespace
+func newEndpointsInformer(client kubernetes.Interface, namespace string, resync time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Endpoints(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Endpoints(namespace).Watch(options)
+			},
+		},
+		&v1.Endpoints{},
+		resync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetHTTPPorts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	ports, err := GetHTTPPorts(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, ports)
+
+	lb.Annotations = map[string]string{AnnotationKeyHTTPPorts: `[
+		{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+		{"port":80,"service":"web","servicePort":80}
+	]`}
+	ports, err = GetHTTPPorts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []HTTPPort{
+		{Port: 80, Protocol: HTTPProtocolHTTP, Service: "web", ServicePort: 80},
+		{Port: 443, Protocol: HTTPProtocolHTTPS, TLSSecret: "cert", Service: "web", ServicePort: 80},
+	}, ports)
+
+	for _, value := range []string{
+		`{"port":80}`,
+		`[{"port":0,"service":"web","servicePort":80}]`,
+		`[{"port":80,"service":"web","servicePort":80},{"port":80,"service":"api","servicePort":80}]`,
+		`[{"port":80,"protocol":"tcp","service":"web","servicePort":80}]`,
+		`[{"port":443,"protocol":"https","service":"web","servicePort":80}]`,
+		`[{"port":80,"tlsSecret":"cert","service":"web","servicePort":80}]`,
+		`[{"port":80,"servicePort":80}]`,
+		`[{"port":80,"service":"web"}]`,
+		`[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"-example.com","service":"api","servicePort":80}]}]`,
+		`[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80},{"host":"API.example.com","service":"web","servicePort":80}]}]`,
+		`[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","tlsSecret":"api-cert","service":"api","servicePort":80}]}]`,
+		`[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","servicePort":80}]}]`,
+	} {
+		lb.Annotations[AnnotationKeyHTTPPorts] = value
+		_, err = GetHTTPPorts(lb)
+		assert.True(t, IsPermanentError(err), value)
+	}
+}
+
+func TestGetHTTPHosts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	lb.Annotations = map[string]string{AnnotationKeyHTTPPorts: `[
+		{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[
+			{"host":"www.example.com","service":"web","servicePort":8080},
+			{"host":"API.example.com","tlsSecret":"api-cert","service":"api","servicePort":80}
+		]},
+		{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]}
+	]`}
+	ports, err := GetHTTPPorts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []HTTPPort{
+		{Port: 80, Protocol: HTTPProtocolHTTP, Service: "web", ServicePort: 80, Hosts: []HTTPHost{
+			{Host: "api.example.com", Service: "api", ServicePort: 80},
+		}},
+		{Port: 443, Protocol: HTTPProtocolHTTPS, TLSSecret: "cert", Service: "web", ServicePort: 80, Hosts: []HTTPHost{
+			{Host: "api.example.com", TLSSecret: "api-cert", Service: "api", ServicePort: 80},
+			{Host: "www.example.com", TLSSecret: "cert", Service: "web", ServicePort: 8080},
+		}},
+	}, ports)
+
+	// the Services and the Secrets of the hosts resync the LoadBalancer
+	assert.Equal(t, []string{"web", "api"}, referencedServices(lb))
+	assert.True(t, referencesSecret(lb, "api-cert"))
+	assert.False(t, referencesSecret(lb, "www-cert"))
+}
+
+func TestGetTLSCertificate(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := v1listers.NewSecretLister(indexer)
+	notAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	cert, key := newTestCertificate(t, notAfter)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cert"},
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	}
+	indexer.Add(secret)
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+
+	got, err := GetTLSCertificate(lb, secrets, "cert")
+	assert.Nil(t, err)
+	assert.Equal(t, cert, got.Cert)
+	assert.Equal(t, key, got.Key)
+	assert.Len(t, got.Fingerprint, 64)
+	assert.True(t, notAfter.Equal(got.NotAfter))
+	// the key is not printed
+	assert.NotContains(t, fmt.Sprintf("%v %+v %#v", *got, got, got), "PRIVATE KEY")
+
+	_, err = GetTLSCertificate(lb, secrets, "missing")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "TLSSecretNotFound", err.(*PermanentError).Reason)
+
+	// the key of another certificate
+	_, other := newTestCertificate(t, notAfter)
+	for _, k := range [][]byte{[]byte("invalid"), other} {
+		secret.Data[v1.TLSPrivateKeyKey] = k
+		_, err = GetTLSCertificate(lb, secrets, "cert")
+		assert.True(t, IsPermanentError(err))
+		assert.Equal(t, "InvalidTLSSecret", err.(*PermanentError).Reason)
+	}
+
+	secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey] = newTestCertificate(t, time.Now().Add(-time.Minute))
+	_, err = GetTLSCertificate(lb, secrets, "cert")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "ExpiredTLSSecret", err.(*PermanentError).Reason)
+}
+
+func TestServiceEndpoints(t *testing.T) {
+	svcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	epsIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	s := StoreLister{
+		Service:   v1listers.NewServiceLister(svcIndexer),
+		Endpoints: v1listers.NewEndpointsLister(epsIndexer),
+	}
+	meta := metav1.ObjectMeta{Namespace: "default", Name: "web"}
+
+	_, err := s.ServiceEndpoints("default", "web", 80)
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "ServiceNotFound", err.(*PermanentError).Reason)
+
+	svcIndexer.Add(&v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+		{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+		{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP},
+	}}})
+	_, err = s.ServiceEndpoints("default", "web", 8080)
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "InvalidServicePort", err.(*PermanentError).Reason)
+
+	// no endpoints yet
+	eps, err := s.ServiceEndpoints("default", "web", 80)
+	assert.Nil(t, err)
+	assert.Empty(t, eps)
+
+	epsIndexer.Add(&v1.Endpoints{ObjectMeta: meta, Subsets: []v1.EndpointSubset{
+		{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.1.3"}, {IP: "10.0.1.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.1.4"}},
+			Ports: []v1.EndpointPort{
+				{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP},
+				{Name: "metrics", Port: 9090, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}})
+	eps, err = s.ServiceEndpoints("default", "web", 80)
+	assert.Nil(t, err)
+	assert.Equal(t, []Endpoint{
+		{IP: net.ParseIP("10.0.1.2"), Port: 8080},
+		{IP: net.ParseIP("10.0.1.3"), Port: 8080},
+	}, eps)
+	assert.Equal(t, "10.0.1.2:8080", eps[0].String())
+}
+
+// newTestCertificate returns a PEM encoded self-signed certificate and key
+// expiring at the time
+func newTestCertificate(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestGetTCPPorts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	ports, err := GetTCPPorts(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, ports)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyTCPPorts: `[{"port":6443},{"port":3306,"service":"mysql","servicePort":3306},{"port":8443,"nodePort":443}]`,
+	}
+	ports, err = GetTCPPorts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []TCPPort{
+		{Port: 3306, Service: "mysql", ServicePort: 3306},
+		{Port: 6443, NodePort: 6443},
+		{Port: 8443, NodePort: 443},
+	}, ports)
+	assert.True(t, referencesService(lb, "mysql"))
+	assert.False(t, referencesService(lb, "web"))
+
+	lb.Annotations[AnnotationKeyHTTPPorts] = `[{"port":80,"service":"web","servicePort":80}]`
+	for _, value := range []string{
+		`{"port":80}`,
+		`[{"port":70000}]`,
+		`[{"port":80}]`,
+		`[{"port":3306},{"port":3306}]`,
+		`[{"port":3306,"service":"mysql"}]`,
+		`[{"port":3306,"service":"mysql","servicePort":3306,"nodePort":3306}]`,
+		`[{"port":3306,"servicePort":3306}]`,
+	} {
+		lb.Annotations[AnnotationKeyTCPPorts] = value
+		_, err = GetTCPPorts(lb)
+		assert.True(t, IsPermanentError(err), value)
+	}
+}
+
+func TestGetProxyProtocols(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	pps, err := GetProxyProtocols(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, pps)
+	assert.Nil(t, RejectProxyProtocol(lb, "ipvsdr"))
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyProxyProtocol: `[{"port":3306,"send":"v2"},{"port":80,"accept":true,"send":"v1"}]`,
+	}
+	pps, err = GetProxyProtocols(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []ProxyProtocol{
+		{Port: 80, Accept: true, Send: ProxyProtocolV1},
+		{Port: 3306, Send: ProxyProtocolV2},
+	}, pps)
+	err = RejectProxyProtocol(lb, "ipvsdr")
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "UnsupportedProxyProtocol", err.(*PermanentError).Reason)
+
+	for _, value := range []string{
+		`{"port":80}`,
+		`[{"port":0,"accept":true}]`,
+		`[{"port":80,"accept":true},{"port":80,"send":"v1"}]`,
+		`[{"port":80,"send":"v3"}]`,
+		`[{"port":80}]`,
+	} {
+		lb.Annotations[AnnotationKeyProxyProtocol] = value
+		_, err = GetProxyProtocols(lb)
+		assert.True(t, IsPermanentError(err), value)
+	}
+}
+
+type certificateBackend struct {
+	Provider
+	certs []ServingCertificate
+}
+
+func (b *certificateBackend) ServingCertificates() []ServingCertificate {
+	return b.certs
+}
+
+func TestReportServingCertificates(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p, _, patches := newRoleTestProvider(lb, nil)
+	backend := &certificateBackend{}
+	p.setBackend(backend)
+
+	p.reportServingCertificates(lb)
+	assert.Empty(t, *patches)
+
+	backend.certs = []ServingCertificate{{Port: 443, Secret: "cert", Fingerprint: "ab", NotAfter: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	p.reportServingCertificates(lb)
+	assert.Equal(t, []string{
+		`{"metadata":{"annotations":{"loadbalancer.caicloud.io/serving-certificates":"[{\"port\":443,\"secret\":\"cert\",\"fingerprint\":\"ab\",\"notAfter\":\"2018-01-01T00:00:00Z\"}]"}}}`,
+	}, *patches)
+
+	// removed once no certificate is served
+	lb.Annotations = map[string]string{AnnotationKeyServingCertificates: "[]"}
+	backend.certs = nil
+	*patches = nil
+	p.reportServingCertificates(lb)
+	assert.Equal(t, []string{`{"metadata":{"annotations":{"loadbalancer.caicloud.io/serving-certificates":null}}}`}, *patches)
+}
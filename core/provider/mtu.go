@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyNodeMTU is published on the Nodes by the node-local agent,
+	// it is the MTU of the interface carrying the node IP
+	AnnotationKeyNodeMTU = "loadbalancer.caicloud.io/mtu"
+	// AnnotationKeyMTUCondition is the Condition of the MTU consistency of
+	// the nodes of the LoadBalancer
+	AnnotationKeyMTUCondition = "loadbalancer.caicloud.io/mtu-condition"
+
+	// MTUConsistent is the reason of the condition if all nodes match
+	MTUConsistent = "MTUConsistent"
+	// MTUMismatch is the reason of the condition and the Warning event if
+	// some nodes do not match
+	MTUMismatch = "MTUMismatch"
+	// MTUUnknown is the reason of the condition if the MTU of some nodes is
+	// not published
+	MTUUnknown = "MTUUnknown"
+)
+
+// NodeMTU is the MTU of a node, zero if it is unknown
+type NodeMTU struct {
+	Node string
+	MTU  int
+}
+
+// String implements fmt.Stringer
+func (n NodeMTU) String() string {
+	if n.MTU == 0 {
+		return n.Node + "(unknown)"
+	}
+	return fmt.Sprintf("%s(%d)", n.Node, n.MTU)
+}
+
+// CheckNodesMTU compares the MTU of the nodes with the expected one. The
+// MTU of the local node, whose address is localIP, is localMTU, the others
+// are read from AnnotationKeyNodeMTU. It returns the mismatched nodes and
+// the nodes without a valid annotation, sorted by name.
+func CheckNodesMTU(nodes []*v1.Node, expected int, localIP net.IP, localMTU int) (mismatched, unknown []NodeMTU) {
+	mismatched, unknown = []NodeMTU{}, []NodeMTU{}
+	for _, node := range nodes {
+		mtu := 0
+		if localIP != nil && localMTU > 0 && hasAddress(node, localIP) {
+			mtu = localMTU
+		} else if v, ok := node.Annotations[AnnotationKeyNodeMTU]; ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				mtu = n
+			}
+		}
+
+		switch {
+		case mtu == 0:
+			unknown = append(unknown, NodeMTU{Node: node.Name})
+		case mtu != expected:
+			mismatched = append(mismatched, NodeMTU{Node: node.Name, MTU: mtu})
+		}
+	}
+	sort.Slice(mismatched, func(i, j int) bool { return mismatched[i].Node < mismatched[j].Node })
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Node < unknown[j].Node })
+	return mismatched, unknown
+}
+
+// newMTUCondition returns the condition of the result of CheckNodesMTU, a
+// mismatch takes precedence over unknown nodes
+func newMTUCondition(expected int, mismatched, unknown []NodeMTU) Condition {
+	switch {
+	case len(mismatched) > 0:
+		return Condition{
+			Status:  v1.ConditionFalse,
+			Reason:  MTUMismatch,
+			Message: fmt.Sprintf("expected MTU %d, got %s", expected, joinNodeMTUs(mismatched)),
+		}
+	case len(unknown) > 0:
+		return Condition{
+			Status:  v1.ConditionUnknown,
+			Reason:  MTUUnknown,
+			Message: fmt.Sprintf("MTU of %s is not published", joinNodeMTUs(unknown)),
+		}
+	}
+	return Condition{
+		Status: v1.ConditionTrue,
+		Reason: MTUConsistent,
+	}
+}
+
+// checkMTU records the MTU consistency of the nodes of the LoadBalancer as
+// a condition, and a Warning event on mismatches. It never fails the sync,
+// since a mismatch leads to path MTU problems rather than an outage.
+func (p *GenericProvider) checkMTU(lb *netv1alpha1.LoadBalancer) {
+	if p.cfg.SkipMTUCheck {
+		return
+	}
+
+	localMTU := 0
+	if p.cfg.NodeIP != nil {
+		iface, err := p.interfaceByIP(p.cfg.NodeIP)
+		if err != nil {
+			log.Warn("detect local interface error", log.Fields{"ip": p.cfg.NodeIP, "err": err})
+		} else {
+			localMTU = iface.MTU
+		}
+	}
+	expected := p.cfg.ExpectedMTU
+	if expected == 0 {
+		expected = localMTU
+	}
+	if expected == 0 {
+		log.Warn("Skip checking MTU, neither the expected nor the local MTU is known")
+		return
+	}
+
+	nodes := make([]*v1.Node, 0, len(lb.Spec.Nodes.Names))
+	for _, name := range lb.Spec.Nodes.Names {
+		node, err := p.nodeLister.Get(name)
+		if err != nil {
+			nodes = append(nodes, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}})
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+
+	mismatched, unknown := CheckNodesMTU(nodes, expected, p.cfg.NodeIP, localMTU)
+	p.setCondition(lb, AnnotationKeyMTUCondition, newMTUCondition(expected, mismatched, unknown))
+}
+
+func hasAddress(node *v1.Node, ip net.IP) bool {
+	for _, addr := range node.Status.Addresses {
+		if ip.Equal(net.ParseIP(addr.Address)) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinNodeMTUs(nodes []NodeMTU) string {
+	ss := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ss = append(ss, n.String())
+	}
+	return strings.Join(ss, ", ")
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func newNode(name, ip string, annotations map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func TestCheckNodesMTU(t *testing.T) {
+	localIP := net.ParseIP("192.168.1.1")
+	tests := []struct {
+		name           string
+		nodes          []*v1.Node
+		wantMismatched []NodeMTU
+		wantUnknown    []NodeMTU
+		wantReason     string
+	}{
+		{
+			name: "match",
+			nodes: []*v1.Node{
+				newNode("node1", "192.168.1.1", nil),
+				newNode("node2", "192.168.1.2", map[string]string{AnnotationKeyNodeMTU: "1500"}),
+			},
+			wantMismatched: []NodeMTU{},
+			wantUnknown:    []NodeMTU{},
+			wantReason:     MTUConsistent,
+		},
+		{
+			name: "mismatch",
+			nodes: []*v1.Node{
+				newNode("node1", "192.168.1.1", nil),
+				newNode("node3", "192.168.1.3", map[string]string{AnnotationKeyNodeMTU: "1450"}),
+				newNode("node2", "192.168.1.2", nil),
+			},
+			wantMismatched: []NodeMTU{{Node: "node3", MTU: 1450}},
+			wantUnknown:    []NodeMTU{{Node: "node2"}},
+			wantReason:     MTUMismatch,
+		},
+		{
+			name: "missing",
+			nodes: []*v1.Node{
+				newNode("node1", "192.168.1.1", nil),
+				newNode("node2", "192.168.1.2", map[string]string{AnnotationKeyNodeMTU: "jumbo"}),
+			},
+			wantMismatched: []NodeMTU{},
+			wantUnknown:    []NodeMTU{{Node: "node2"}},
+			wantReason:     MTUUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatched, unknown := CheckNodesMTU(tt.nodes, 1500, localIP, 1500)
+			assert.Equal(t, tt.wantMismatched, mismatched)
+			assert.Equal(t, tt.wantUnknown, unknown)
+			assert.Equal(t, tt.wantReason, newMTUCondition(1500, mismatched, unknown).Reason)
+		})
+	}
+}
+
+func TestCheckNodesMTULocal(t *testing.T) {
+	// the MTU of the local node is detected, the stale annotation is ignored
+	node := newNode("node1", "192.168.1.1", map[string]string{AnnotationKeyNodeMTU: "1500"})
+	mismatched, _ := CheckNodesMTU([]*v1.Node{node}, 1500, net.ParseIP("192.168.1.1"), 9000)
+	assert.Equal(t, []NodeMTU{{Node: "node1", MTU: 9000}}, mismatched)
+
+	cond := newMTUCondition(1500, mismatched, nil)
+	assert.Equal(t, v1.ConditionFalse, cond.Status)
+	assert.Equal(t, "expected MTU 1500, got node1(9000)", cond.Message)
+}
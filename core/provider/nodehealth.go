@@ -0,0 +1,120 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+)
+
+// AnnotationKeyNodeHealthPath is the path the health of the node serving
+// the LoadBalancer is served on, for the upstream load balancers or routers
+// to probe whether the node should receive the traffic of the VIPs. It is
+// /healthz/<namespace>/<name> by default.
+const AnnotationKeyNodeHealthPath = "loadbalancer.caicloud.io/node-health-path"
+
+// NodeHealth is the health of the dataplane of the LoadBalancer on the node
+type NodeHealth struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Healthy   bool   `json:"healthy"`
+	// Reasons are why the node should not receive the traffic
+	Reasons []string `json:"reasons,omitempty"`
+	// Role is the role of the node if the backend elects the node holding
+	// the VIPs
+	Role  Role         `json:"role,omitempty"`
+	Ports []PortHealth `json:"ports,omitempty"`
+}
+
+// GetNodeHealthPath returns the path of the health of the node serving the
+// LoadBalancer, it returns a PermanentError if the path is not absolute
+func GetNodeHealthPath(lb *netv1alpha1.LoadBalancer) (string, error) {
+	path, ok := lb.Annotations[AnnotationKeyNodeHealthPath]
+	if !ok {
+		return fmt.Sprintf("/healthz/%s/%s", lb.Namespace, lb.Name), nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", NewPermanentError("InvalidNodeHealthPath", fmt.Errorf("invalid node health path %q, it must be absolute", path))
+	}
+	return path, nil
+}
+
+// NodeHealth returns the health of the dataplane of the LoadBalancer on the
+// node. The node is unhealthy if the provider is, it is not the master of
+// a backend electing one or a port of a PortHealthProvider is unhealthy.
+func (p *GenericProvider) NodeHealth() NodeHealth {
+	h := NodeHealth{
+		Namespace: p.cfg.LoadBalancerNamespace,
+		Name:      p.cfg.LoadBalancerName,
+		Reasons:   make([]string, 0),
+	}
+	if err := p.Healthz(); err != nil {
+		h.Reasons = append(h.Reasons, err.Error())
+	}
+	if p.ext.role != nil {
+		h.Role = p.Role()
+		if h.Role != RoleMaster {
+			h.Reasons = append(h.Reasons, fmt.Sprintf("the node is not the master, role %q", h.Role))
+		}
+	}
+	if p.ext.portHealth != nil {
+		h.Ports = p.ext.portHealth.PortHealth()
+		for _, port := range h.Ports {
+			if !port.Healthy {
+				h.Reasons = append(h.Reasons, fmt.Sprintf("port %s/%d is unhealthy: %s", port.Protocol, port.Port, port.Reason))
+			}
+		}
+	}
+	h.Healthy = len(h.Reasons) == 0
+	return h
+}
+
+// NodeHealthHandler returns the health of the node serving the LoadBalancer
+// in json on the path of the LoadBalancer, it responds 503 if the node is
+// unhealthy and 404 on other paths
+func (p *GenericProvider) NodeHealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		path, err := GetNodeHealthPath(lb)
+		if err != nil || r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		h := p.NodeHealth()
+		w.Header().Set("Content-Type", "application/json")
+		if !h.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(h)
+	})
+}
+
+// ServeNodeHealth serves the health of the node serving the LoadBalancer on
+// the address until the listener fails
+func (p *GenericProvider) ServeNodeHealth(address string) error {
+	log.Info("Serving node health", log.Fields{"address": address})
+	return http.ListenAndServe(address, p.NodeHealthHandler())
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+type nodeHealthBackend struct {
+	Provider
+	healthz error
+	ports   []PortHealth
+}
+
+func (b *nodeHealthBackend) Healthz() error            { return b.healthz }
+func (b *nodeHealthBackend) PortHealth() []PortHealth  { return b.ports }
+func (b *nodeHealthBackend) SetRoleHandler(func(Role)) {}
+
+func TestNodeHealthHandler(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p, _, _ := newRoleTestProvider(lb, flowcontrol.NewFakeAlwaysRateLimiter())
+	backend := &nodeHealthBackend{ports: []PortHealth{{Protocol: "tcp", Port: 80, Healthy: true}}}
+	p.setBackend(backend)
+	p.stopLock = &sync.Mutex{}
+	handler := p.NodeHealthHandler()
+
+	get := func(path string) (int, NodeHealth) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		h := NodeHealth{}
+		if w.Code != http.StatusNotFound {
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &h))
+		}
+		return w.Code, h
+	}
+
+	// the health of other LoadBalancers is not served
+	code, _ := get("/healthz/default/other")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// not the master yet
+	code, h := get("/healthz/default/lb")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{`the node is not the master, role ""`}, h.Reasons)
+
+	p.role = RoleMaster
+	code, h = get("/healthz/default/lb")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, NodeHealth{Namespace: "default", Name: "lb", Healthy: true, Role: RoleMaster, Ports: backend.ports}, h)
+
+	// the transitions of the ports and the backend
+	backend.ports = append(backend.ports, PortHealth{Protocol: "udp", Port: 53, Reason: "virtual server UDP/10.0.0.100:53 has no ready real server"})
+	code, h = get("/healthz/default/lb")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"port udp/53 is unhealthy: virtual server UDP/10.0.0.100:53 has no ready real server"}, h.Reasons)
+	assert.Len(t, h.Ports, 2)
+	backend.ports = backend.ports[:1]
+	backend.healthz = fmt.Errorf("keepalived is not running")
+	code, h = get("/healthz/default/lb")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, []string{"keepalived is not running"}, h.Reasons)
+	backend.healthz = nil
+
+	// the path of the LoadBalancer
+	lb.Annotations = map[string]string{AnnotationKeyNodeHealthPath: "/lb"}
+	code, _ = get("/healthz/default/lb")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/lb")
+	assert.Equal(t, http.StatusOK, code)
+
+	lb.Annotations[AnnotationKeyNodeHealthPath] = "lb"
+	_, err := GetNodeHealthPath(lb)
+	assert.True(t, IsPermanentError(err))
+}
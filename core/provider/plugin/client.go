@@ -0,0 +1,358 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	_ core.Provider         = &Client{}
+	_ core.DeletionProvider = &Client{}
+	_ core.HealthzProvider  = &Client{}
+)
+
+const (
+	// DefaultTimeout is the default timeout of the dials and the calls but
+	// the syncs and the wait for the start
+	DefaultTimeout = 10 * time.Second
+	// DefaultSyncTimeout is the default timeout of the syncs
+	DefaultSyncTimeout = time.Minute
+	// DefaultStartTimeout is the default time the plugin is waited for to
+	// start
+	DefaultStartTimeout = 5 * time.Minute
+	// DefaultRetryAfter is the default delay of the retries of the syncs
+	// failed on the connection
+	DefaultRetryAfter = 5 * time.Second
+
+	// waitWindow is how long the plugin waits for its start per call,
+	// dialRetry is the delay between the dials while waiting for it
+	waitWindow = time.Second
+	dialRetry  = time.Second
+)
+
+// Config configures the Client
+type Config struct {
+	// Address is the address of the plugin, unix:///path/to/socket or
+	// tcp://host:port, see ParseAddress
+	Address string
+	// Timeout is the timeout of the dials and the calls but the syncs and
+	// the wait for the start
+	Timeout time.Duration
+	// SyncTimeout is the timeout of OnUpdate and OnDelete
+	SyncTimeout time.Duration
+	// StartTimeout is how long the plugin is waited for to start, it may
+	// be started after the provider
+	StartTimeout time.Duration
+	// RetryAfter is the delay of the retries of the syncs failed on the
+	// connection
+	RetryAfter time.Duration
+}
+
+// ParseAddress returns the network and the address of a plugin address,
+// unix:///path/to/socket or tcp://host:port. An absolute path is the one of
+// a unix socket.
+func ParseAddress(address string) (network, addr string, err error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		network, addr = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		network, addr = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		network, addr = "unix", address
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("invalid plugin address %q, expect unix:///path/to/socket or tcp://host:port", address)
+	}
+	return network, addr, nil
+}
+
+// ConnectionError is an error of the connection to the plugin, the call
+// may or may not have reached it
+type ConnectionError struct {
+	Method string
+	Err    error
+}
+
+// Error implements error
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("call plugin %s error: %v", e.Method, e.Err)
+}
+
+// IsConnectionError returns true if the error is a ConnectionError
+func IsConnectionError(err error) bool {
+	_, ok := err.(*ConnectionError)
+	return ok
+}
+
+// Client is a Provider forwarding the calls to a plugin. It connects on
+// demand and again once the connection is lost: a lost connection makes
+// the provider unhealthy and the sync is retried after Config.RetryAfter.
+// A call without a reply in time drops the connection, the late reply is
+// read by nobody.
+type Client struct {
+	cfg         Config
+	network     string
+	address     string
+	storeLister core.StoreLister
+
+	mu      sync.Mutex
+	client  *rpc.Client
+	info    *core.Info
+	started bool
+}
+
+// NewClient returns a Client of the plugin, the zero fields of the Config
+// are defaulted
+func NewClient(cfg Config) (*Client, error) {
+	network, address, err := ParseAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.SyncTimeout <= 0 {
+		cfg.SyncTimeout = DefaultSyncTimeout
+	}
+	if cfg.StartTimeout <= 0 {
+		cfg.StartTimeout = DefaultStartTimeout
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = DefaultRetryAfter
+	}
+	return &Client{cfg: cfg, network: network, address: address}, nil
+}
+
+// connect returns the connection to the plugin, it dials if there is none
+func (c *Client) connect() (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	conn, err := net.DialTimeout(c.network, c.address, c.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.client = jsonrpc.NewClient(conn)
+	log.Info("Connected to plugin", log.Fields{"address": c.cfg.Address})
+	return c.client, nil
+}
+
+// disconnect closes the connection, the plugin may be another one on the
+// next connection
+func (c *Client) disconnect(client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == client {
+		c.client = nil
+		c.info = nil
+	}
+	client.Close()
+}
+
+// call calls the method of the plugin, a failure of the connection or no
+// reply in the timeout is a ConnectionError
+func (c *Client) call(method string, timeout time.Duration, args, reply interface{}) error {
+	client, err := c.connect()
+	if err != nil {
+		return &ConnectionError{Method: method, Err: err}
+	}
+
+	call := client.Go(ServiceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			return nil
+		}
+		if _, ok := call.Error.(rpc.ServerError); ok {
+			return fmt.Errorf("call plugin %s error: %v", method, call.Error)
+		}
+		err = call.Error
+	case <-timer.C:
+		err = fmt.Errorf("no reply in %v", timeout)
+	}
+	log.Warn("plugin connection lost", log.Fields{"address": c.cfg.Address, "method": method, "err": err})
+	c.disconnect(client)
+	return &ConnectionError{Method: method, Err: err}
+}
+
+// sync calls OnUpdate or OnDelete of the plugin, the sync failed on the
+// connection is retried after Config.RetryAfter
+func (c *Client) sync(method string, args interface{}) error {
+	reply := &Reply{}
+	if err := c.call(method, c.cfg.SyncTimeout, args, reply); err != nil {
+		if IsConnectionError(err) {
+			return core.NewRetryAfterError(c.cfg.RetryAfter, err)
+		}
+		return err
+	}
+	return reply.Error.Err()
+}
+
+// OnUpdate sends the LoadBalancer with its nodes to the plugin
+func (c *Client) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	update := &Update{
+		LoadBalancer: lb,
+		Nodes:        make([]*v1.Node, 0, len(lb.Spec.Nodes.Names)),
+	}
+	for _, name := range lb.Spec.Nodes.Names {
+		node, err := c.storeLister.Node.Get(name)
+		if err != nil {
+			continue
+		}
+		update.Nodes = append(update.Nodes, node)
+	}
+	family := corenet.FamilyIPv4
+	if vips, _ := core.GetVIPs(lb); len(vips) > 0 {
+		family = corenet.FamilyOf(vips[0])
+	}
+	update.RealServers = c.storeLister.RealServers(lb.Spec.Nodes.Names, family)
+	return c.sync("OnUpdate", update)
+}
+
+// OnDelete implements core.DeletionProvider, the deletion is sent to the
+// plugin
+func (c *Client) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	return c.sync("OnDelete", &DeleteRequest{LoadBalancer: lb})
+}
+
+// start calls Start of the plugin once
+func (c *Client) start() error {
+	c.mu.Lock()
+	started := c.started
+	c.mu.Unlock()
+	if started {
+		return nil
+	}
+	if err := c.call("Start", c.cfg.Timeout, &Empty{}, &Empty{}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.started = true
+	c.mu.Unlock()
+	return nil
+}
+
+// Start starts the plugin, it is started by WaitForStart if it is not
+// reachable yet
+func (c *Client) Start() {
+	if err := c.start(); err != nil {
+		log.Warn("start plugin error, waiting for it", log.Fields{"address": c.cfg.Address, "err": err})
+	}
+}
+
+// WaitForStart waits for the plugin to start up to Config.StartTimeout,
+// asking it again every second
+func (c *Client) WaitForStart() bool {
+	deadline := time.Now().Add(c.cfg.StartTimeout)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return false
+		}
+		window := waitWindow
+		if remaining < window {
+			window = remaining
+		}
+		err := c.start()
+		if err == nil {
+			reply := &WaitReply{}
+			err = c.call("WaitForStart", window+c.cfg.Timeout, &WaitRequest{Timeout: window}, reply)
+			if err == nil && reply.Done {
+				return reply.Started
+			}
+			if err == nil {
+				continue
+			}
+		}
+		log.Warn("wait for plugin error", log.Fields{"address": c.cfg.Address, "err": err})
+		if remaining > dialRetry {
+			remaining = dialRetry
+		}
+		time.Sleep(remaining)
+	}
+}
+
+// Stop stops the plugin and closes the connection
+func (c *Client) Stop() error {
+	reply := &Reply{}
+	err := c.call("Stop", c.cfg.Timeout, &Empty{}, reply)
+	c.mu.Lock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return reply.Error.Err()
+}
+
+// Healthz implements core.HealthzProvider, the provider is unhealthy if
+// the plugin is or it is not reachable
+func (c *Client) Healthz() error {
+	reply := &Reply{}
+	if err := c.call("Healthz", c.cfg.Timeout, &Empty{}, reply); err != nil {
+		return err
+	}
+	return reply.Error.Err()
+}
+
+// Info returns the information of the plugin, the name plugin only if it
+// is not reachable
+func (c *Client) Info() core.Info {
+	c.mu.Lock()
+	if c.info != nil {
+		info := *c.info
+		c.mu.Unlock()
+		return info
+	}
+	c.mu.Unlock()
+
+	reply := &InfoReply{}
+	if err := c.call("Info", c.cfg.Timeout, &Empty{}, reply); err != nil {
+		log.Warn("get plugin info error", log.Fields{"address": c.cfg.Address, "err": err})
+		return core.Info{Name: "plugin"}
+	}
+	c.mu.Lock()
+	c.info = &reply.Info
+	c.mu.Unlock()
+	return reply.Info
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (c *Client) SetListers(lister core.StoreLister) {
+	c.storeLister = lister
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// toyPlugin records the updates and the deletions, it fails or blocks them
+// as set
+type toyPlugin struct {
+	mu      sync.Mutex
+	updates []*Update
+	deletes []*netv1alpha1.LoadBalancer
+	stopped bool
+	err     error
+	healthz error
+	block   chan struct{}
+}
+
+func (p *toyPlugin) Info() core.Info {
+	return core.Info{Name: "toy", Release: "v0.0.1"}
+}
+
+func (p *toyPlugin) OnUpdate(update *Update) error {
+	p.mu.Lock()
+	block := p.block
+	p.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates = append(p.updates, update)
+	return p.err
+}
+
+func (p *toyPlugin) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deletes = append(p.deletes, lb)
+	return nil
+}
+
+func (p *toyPlugin) Start() {}
+
+func (p *toyPlugin) WaitForStart() bool {
+	return true
+}
+
+func (p *toyPlugin) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	return nil
+}
+
+func (p *toyPlugin) Healthz() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.healthz
+}
+
+func (p *toyPlugin) set(f func(*toyPlugin)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(p)
+}
+
+// serve serves the plugin on a unix socket in dir, the Server has to be
+// closed
+func serve(t *testing.T, dir string, plugin Plugin) (*Server, string) {
+	address := "unix://" + filepath.Join(dir, "plugin.sock")
+	l, err := Listen(address)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	s := NewServer(plugin)
+	go s.Serve(l)
+	return s, address
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{"unix:///run/plugin.sock", "unix", "/run/plugin.sock", false},
+		{"/run/plugin.sock", "unix", "/run/plugin.sock", false},
+		{"tcp://127.0.0.1:9000", "tcp", "127.0.0.1:9000", false},
+		{"127.0.0.1:9000", "", "", true},
+		{"unix://", "", "", true},
+	}
+	for _, tt := range tests {
+		network, addr, err := ParseAddress(tt.address)
+		assert.Equal(t, tt.wantErr, err != nil, tt.address)
+		assert.Equal(t, tt.network, network, tt.address)
+		assert.Equal(t, tt.addr, addr, tt.address)
+	}
+}
+
+func TestError(t *testing.T) {
+	assert.Nil(t, newError(nil).Err())
+
+	err := newError(core.NewPermanentError("InvalidPool", fmt.Errorf("no pool"))).Err()
+	if assert.True(t, core.IsPermanentError(err)) {
+		assert.Equal(t, "InvalidPool", err.(*core.PermanentError).Reason)
+	}
+	err = newError(core.NewRetryAfterError(time.Minute, fmt.Errorf("quota"))).Err()
+	if assert.True(t, core.IsRetryAfterError(err)) {
+		assert.Equal(t, time.Minute, err.(*core.RetryAfterError).After)
+	}
+	err = newError(fmt.Errorf("busy")).Err()
+	assert.Equal(t, "plugin error: busy", err.Error())
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugin := &toyPlugin{}
+	server, address := serve(t, dir, plugin)
+	defer server.Close()
+	client, err := NewClient(Config{Address: address})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := providertesting.NewTestEnv(t, client)
+	defer env.Stop()
+
+	assert.Equal(t, "toy", client.Info().Name)
+
+	env.AddNode("node1", "192.168.0.1")
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1", "node2"))
+	plugin.set(func(p *toyPlugin) {
+		if assert.NotEmpty(t, p.updates) {
+			update := p.updates[len(p.updates)-1]
+			assert.Equal(t, lb.UID, update.LoadBalancer.UID)
+			if assert.Len(t, update.Nodes, 1) {
+				assert.Equal(t, "node1", update.Nodes[0].Name)
+			}
+			if assert.Len(t, update.RealServers, 1) {
+				assert.Equal(t, "192.168.0.1", update.RealServers[0].IP.String())
+			}
+		}
+	})
+
+	plugin.set(func(p *toyPlugin) { p.healthz = fmt.Errorf("dataplane down") })
+	assert.EqualError(t, client.Healthz(), "plugin error: dataplane down")
+	plugin.set(func(p *toyPlugin) { p.healthz = nil })
+	assert.Nil(t, client.Healthz())
+
+	env.DeleteLB(lb)
+	plugin.set(func(p *toyPlugin) {
+		if assert.Len(t, p.deletes, 1) {
+			assert.Equal(t, lb.UID, p.deletes[0].UID)
+		}
+	})
+
+	env.Stop()
+	plugin.set(func(p *toyPlugin) { assert.True(t, p.stopped) })
+}
+
+func TestClientErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugin := &toyPlugin{}
+	server, address := serve(t, dir, plugin)
+	client, err := NewClient(Config{Address: address, SyncTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetListers(fake.NewStoreListerFromObjects(fake.NewNode("node1", "192.168.0.1")))
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+
+	// the errors of the plugin keep their kind
+	plugin.set(func(p *toyPlugin) { p.err = core.NewPermanentError("InvalidPool", fmt.Errorf("no pool")) })
+	assert.True(t, core.IsPermanentError(client.OnUpdate(lb)))
+	plugin.set(func(p *toyPlugin) { p.err = nil })
+	assert.Nil(t, client.OnUpdate(lb))
+
+	// a sync without a reply in time is retried
+	release := make(chan struct{})
+	plugin.set(func(p *toyPlugin) { p.block = release })
+	err = client.OnUpdate(lb)
+	if assert.True(t, core.IsRetryAfterError(err)) {
+		assert.Equal(t, DefaultRetryAfter, err.(*core.RetryAfterError).After)
+		assert.True(t, IsConnectionError(err.(*core.RetryAfterError).Err))
+	}
+	plugin.set(func(p *toyPlugin) { p.block = nil })
+	close(release)
+	assert.Nil(t, client.Healthz())
+
+	// the lost connection makes the provider unhealthy and the syncs
+	// retried, until the plugin is back
+	server.Close()
+	assert.True(t, IsConnectionError(client.Healthz()))
+	assert.True(t, core.IsRetryAfterError(client.OnUpdate(lb)))
+
+	server, _ = serve(t, dir, plugin)
+	defer server.Close()
+	assert.Nil(t, client.Healthz())
+	assert.Nil(t, client.OnUpdate(lb))
+}
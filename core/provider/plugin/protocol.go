@@ -0,0 +1,124 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package plugin runs a backend out of the tree of the providers: the
+// GenericProvider drives a Client, which forwards the calls of the Provider
+// contract to a plugin process serving them through a Server.
+//
+// The protocol is JSON-RPC 1.0 over a unix socket or a TCP connection, the
+// methods of the service Plugin mirror the Provider contract, see the
+// request and reply types. A plugin written in another language implements
+// the same methods.
+package plugin
+
+import (
+	"fmt"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// ServiceName is the name of the service of the plugins
+	ServiceName = "Plugin"
+)
+
+// Update is an update of the LoadBalancer with its nodes, a plugin does not
+// watch the API server
+type Update struct {
+	LoadBalancer *netv1alpha1.LoadBalancer `json:"loadBalancer"`
+	// Nodes are the nodes of the LoadBalancer which exist
+	Nodes []*v1.Node `json:"nodes"`
+	// RealServers are the eligible nodes of the family of the first VIP
+	// with the addresses and the weights resolved by the GenericProvider
+	RealServers []core.RealServer `json:"realServers"`
+}
+
+// Empty is the request and the reply of the methods without any
+type Empty struct{}
+
+// InfoReply is the reply of Plugin.Info
+type InfoReply struct {
+	Info core.Info `json:"info"`
+}
+
+// WaitRequest is the request of Plugin.WaitForStart
+type WaitRequest struct {
+	// Timeout is how long the plugin waits for the start before replying
+	Timeout time.Duration `json:"timeout"`
+}
+
+// WaitReply is the reply of Plugin.WaitForStart, the client asks again
+// until the wait is done
+type WaitReply struct {
+	// Done is true once the plugin returned from WaitForStart, Started is
+	// what it returned
+	Done    bool `json:"done"`
+	Started bool `json:"started"`
+}
+
+// DeleteRequest is the request of Plugin.OnDelete
+type DeleteRequest struct {
+	LoadBalancer *netv1alpha1.LoadBalancer `json:"loadBalancer"`
+}
+
+// Reply is the reply of Plugin.OnUpdate, Plugin.OnDelete, Plugin.Healthz
+// and Plugin.Stop, the error of the plugin if any
+type Reply struct {
+	Error *Error `json:"error,omitempty"`
+}
+
+// Error is an error returned by a plugin, the PermanentErrors and the
+// RetryAfterErrors keep their kind through the protocol
+type Error struct {
+	Message string `json:"message"`
+	// Reason is the reason of a PermanentError
+	Reason    string `json:"reason,omitempty"`
+	Permanent bool   `json:"permanent,omitempty"`
+	// RetryAfter is the delay of a RetryAfterError
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+}
+
+// newError returns the Error of err, nil if err is nil
+func newError(err error) *Error {
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *core.PermanentError:
+		return &Error{Message: e.Error(), Reason: e.Reason, Permanent: true}
+	case *core.RetryAfterError:
+		return &Error{Message: e.Error(), RetryAfter: e.After}
+	}
+	return &Error{Message: err.Error()}
+}
+
+// Err returns the error of the kind of the Error, nil if e is nil
+func (e *Error) Err() error {
+	if e == nil {
+		return nil
+	}
+	err := fmt.Errorf("plugin error: %s", e.Message)
+	if e.Permanent {
+		return core.NewPermanentError(e.Reason, err)
+	}
+	if e.RetryAfter > 0 {
+		return core.NewRetryAfterError(e.RetryAfter, err)
+	}
+	return err
+}
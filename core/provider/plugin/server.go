@@ -0,0 +1,210 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+)
+
+// Plugin is the backend a plugin process embeds a Server for, it is the
+// Provider contract without the listers: the nodes come with the updates
+type Plugin interface {
+	// Info returns information of the plugin
+	Info() core.Info
+	// OnUpdate applies the update of the LoadBalancer
+	OnUpdate(*Update) error
+	// OnDelete releases the resources of the deleted LoadBalancer
+	OnDelete(*netv1alpha1.LoadBalancer) error
+	// Start starts the plugin
+	Start()
+	// WaitForStart waits for the plugin fully run
+	WaitForStart() bool
+	// Stop shuts down the plugin
+	Stop() error
+	// Healthz returns an error if the plugin is unhealthy
+	Healthz() error
+}
+
+// Server serves a Plugin to the Clients, the plugin is started once
+// however many Clients connect
+type Server struct {
+	plugin Plugin
+	rpc    *rpc.Server
+
+	startOnce sync.Once
+	started   chan struct{}
+	startedOK bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+}
+
+// NewServer returns a Server of the plugin
+func NewServer(plugin Plugin) *Server {
+	s := &Server{
+		plugin:    plugin,
+		rpc:       rpc.NewServer(),
+		started:   make(chan struct{}),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	// the methods of service match the requirements of net/rpc, it fails
+	// on a programming error only
+	if err := s.rpc.RegisterName(ServiceName, &service{s}); err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ListenAndServe listens on the address and serves the plugin, see Listen
+func (s *Server) ListenAndServe(address string) error {
+	l, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves the plugin on the connections accepted by the listener
+// until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listeners[l] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go func() {
+			s.rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes the listeners and the connections of the Server, the plugin
+// is not stopped
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// waitForStart waits for the plugin to start up to the timeout, it starts
+// waiting on the first call
+func (s *Server) waitForStart(timeout time.Duration) (done, started bool) {
+	s.startOnce.Do(func() {
+		go func() {
+			s.startedOK = s.plugin.WaitForStart()
+			close(s.started)
+		}()
+	})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.started:
+		return true, s.startedOK
+	case <-timer.C:
+		return false, false
+	}
+}
+
+// Listen listens on the address of a plugin, a unix socket left by a
+// previous plugin process is removed first
+func Listen(address string) (net.Listener, error) {
+	network, addr, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// service is the rpc service of the Server
+type service struct {
+	s *Server
+}
+
+func (svc *service) Info(req *Empty, reply *InfoReply) error {
+	reply.Info = svc.s.plugin.Info()
+	return nil
+}
+
+func (svc *service) Start(req *Empty, reply *Empty) error {
+	svc.s.plugin.Start()
+	return nil
+}
+
+func (svc *service) WaitForStart(req *WaitRequest, reply *WaitReply) error {
+	reply.Done, reply.Started = svc.s.waitForStart(req.Timeout)
+	return nil
+}
+
+func (svc *service) OnUpdate(req *Update, reply *Reply) error {
+	reply.Error = newError(svc.s.plugin.OnUpdate(req))
+	if reply.Error != nil {
+		log.Error("update LoadBalancer error", log.Fields{"lb.ns": req.LoadBalancer.Namespace, "lb.name": req.LoadBalancer.Name, "err": reply.Error.Message})
+	}
+	return nil
+}
+
+func (svc *service) OnDelete(req *DeleteRequest, reply *Reply) error {
+	reply.Error = newError(svc.s.plugin.OnDelete(req.LoadBalancer))
+	return nil
+}
+
+func (svc *service) Healthz(req *Empty, reply *Reply) error {
+	reply.Error = newError(svc.s.plugin.Healthz())
+	return nil
+}
+
+func (svc *service) Stop(req *Empty, reply *Reply) error {
+	reply.Error = newError(svc.s.plugin.Stop())
+	return nil
+}
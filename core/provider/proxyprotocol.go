@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+)
+
+// AnnotationKeyProxyProtocol is the PROXY protocol of the ports in json,
+// e.g. [{"port":80,"accept":true},{"port":3306,"send":"v2"}]. Accept
+// expects the header from a load balancer in front of the port, send passes
+// the address of the client to the backends in the header.
+const AnnotationKeyProxyProtocol = "loadbalancer.caicloud.io/proxy-protocol"
+
+// ProxyProtocolVersion is the version of the PROXY protocol header
+type ProxyProtocolVersion string
+
+const (
+	// ProxyProtocolV1 is the human readable header
+	ProxyProtocolV1 ProxyProtocolVersion = "v1"
+	// ProxyProtocolV2 is the binary header
+	ProxyProtocolV2 ProxyProtocolVersion = "v2"
+)
+
+// ProxyProtocol is the PROXY protocol of a port of the LoadBalancer
+type ProxyProtocol struct {
+	Port int `json:"port"`
+	// Accept expects the header of either version on the connections of
+	// the clients
+	Accept bool `json:"accept,omitempty"`
+	// Send is the version of the header sent to the backends, none if
+	// empty
+	Send ProxyProtocolVersion `json:"send,omitempty"`
+}
+
+// GetProxyProtocols returns the PROXY protocol of the ports of the
+// LoadBalancer sorted by port, nil if not specified. It returns a
+// PermanentError if they are invalid.
+func GetProxyProtocols(lb *netv1alpha1.LoadBalancer) ([]ProxyProtocol, error) {
+	value, ok := lb.Annotations[AnnotationKeyProxyProtocol]
+	if !ok {
+		return nil, nil
+	}
+
+	pps := make([]ProxyProtocol, 0)
+	if err := json.Unmarshal([]byte(value), &pps); err != nil {
+		return nil, NewPermanentError("InvalidProxyProtocol", fmt.Errorf("invalid proxy protocol %q: %v", value, err))
+	}
+	seen := make(map[int]bool, len(pps))
+	for _, pp := range pps {
+		switch {
+		case pp.Port <= 0 || pp.Port > 65535:
+			return nil, NewPermanentError("InvalidProxyProtocol", fmt.Errorf("invalid port %d", pp.Port))
+		case seen[pp.Port]:
+			return nil, NewPermanentError("InvalidProxyProtocol", fmt.Errorf("duplicate port %d", pp.Port))
+		case pp.Send != "" && pp.Send != ProxyProtocolV1 && pp.Send != ProxyProtocolV2:
+			return nil, NewPermanentError("InvalidProxyProtocol", fmt.Errorf("invalid version %q of port %d, expect v1 or v2", pp.Send, pp.Port))
+		case !pp.Accept && pp.Send == "":
+			return nil, NewPermanentError("InvalidProxyProtocol", fmt.Errorf("port %d neither accepts nor sends the proxy protocol", pp.Port))
+		}
+		seen[pp.Port] = true
+	}
+	sort.Slice(pps, func(i, j int) bool { return pps[i].Port < pps[j].Port })
+	return pps, nil
+}
+
+// RejectProxyProtocol returns a PermanentError if the LoadBalancer
+// specifies the PROXY protocol, for the providers forwarding the packets of
+// the clients as they are, which can neither strip nor add the header
+func RejectProxyProtocol(lb *netv1alpha1.LoadBalancer, provider string) error {
+	if _, ok := lb.Annotations[AnnotationKeyProxyProtocol]; !ok {
+		return nil
+	}
+	return NewPermanentError("UnsupportedProxyProtocol", fmt.Errorf("the proxy protocol is not supported by the %s provider, which forwards the packets without proxying the connections", provider))
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// AnnotationKeyRateLimit is the limits of the connections and requests of
+// the LoadBalancer on each node in json, e.g.
+// {"maxConnections":10000,"connectionRate":500,"ports":[{"port":80,"requestRate":100}]}.
+// The limits of the LoadBalancer apply to all its ports together, and the
+// ones of a port to the port alone. The connections and requests beyond
+// them are rejected.
+const AnnotationKeyRateLimit = "loadbalancer.caicloud.io/rate-limit"
+
+// Limits caps the connections and requests, a zero one is unlimited
+type Limits struct {
+	// MaxConnections caps the concurrent connections
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// ConnectionRate caps the new connections per second
+	ConnectionRate int `json:"connectionRate,omitempty"`
+	// RequestRate caps the HTTP requests per second
+	RequestRate int `json:"requestRate,omitempty"`
+}
+
+// IsZero returns true if nothing is limited
+func (l Limits) IsZero() bool {
+	return l.MaxConnections == 0 && l.ConnectionRate == 0 && l.RequestRate == 0
+}
+
+// PortRateLimit is the limits of a port of the LoadBalancer
+type PortRateLimit struct {
+	// Protocol is tcp or udp, it defaults to tcp
+	Protocol string `json:"protocol,omitempty"`
+	Port     int    `json:"port"`
+	Limits
+}
+
+// RateLimit is the limits of the LoadBalancer and its ports
+type RateLimit struct {
+	Limits
+	Ports []PortRateLimit `json:"ports,omitempty"`
+}
+
+// GetRateLimit returns the limits of the LoadBalancer with the ports sorted
+// by protocol and port, nil if not specified. It returns a PermanentError
+// if they are invalid.
+func GetRateLimit(lb *netv1alpha1.LoadBalancer) (*RateLimit, error) {
+	value, ok := lb.Annotations[AnnotationKeyRateLimit]
+	if !ok {
+		return nil, nil
+	}
+
+	rl := &RateLimit{}
+	if err := json.Unmarshal([]byte(value), rl); err != nil {
+		return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("invalid rate limit %q: %v", value, err))
+	}
+	if err := validateLimits(rl.Limits); err != nil {
+		return nil, NewPermanentError("InvalidRateLimit", err)
+	}
+	seen := make(map[string]bool, len(rl.Ports))
+	for i := range rl.Ports {
+		p := &rl.Ports[i]
+		if p.Protocol == "" {
+			p.Protocol = "tcp"
+		}
+		key := fmt.Sprintf("%s/%d", p.Protocol, p.Port)
+		switch {
+		case p.Protocol != "tcp" && p.Protocol != "udp":
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("invalid protocol %q of port %d", p.Protocol, p.Port))
+		case p.Port <= 0 || p.Port > 65535:
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("invalid port %d", p.Port))
+		case seen[key]:
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("duplicate port %s", key))
+		case p.IsZero():
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("port %s limits nothing", key))
+		case p.Protocol == "udp" && p.RequestRate != 0:
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("udp port %d serves no request", p.Port))
+		}
+		if err := validateLimits(p.Limits); err != nil {
+			return nil, NewPermanentError("InvalidRateLimit", fmt.Errorf("port %s: %v", key, err))
+		}
+		seen[key] = true
+	}
+	sort.Slice(rl.Ports, func(i, j int) bool {
+		if rl.Ports[i].Protocol != rl.Ports[j].Protocol {
+			return rl.Ports[i].Protocol < rl.Ports[j].Protocol
+		}
+		return rl.Ports[i].Port < rl.Ports[j].Port
+	})
+	return rl, nil
+}
+
+func validateLimits(l Limits) error {
+	if l.MaxConnections < 0 || l.ConnectionRate < 0 || l.RequestRate < 0 {
+		return fmt.Errorf("negative limits %+v", l)
+	}
+	return nil
+}
+
+// CorePort returns the port in the form of the ports of the VIPs
+func (p PortRateLimit) CorePort() corenet.Port {
+	return corenet.Port{Protocol: p.Protocol, Port: uint16(p.Port)}
+}
+
+// CheckRateLimitPorts returns a PermanentError if a port of the limits is
+// not one of the ports served
+func CheckRateLimitPorts(rl *RateLimit, ports []corenet.Port) error {
+	if rl == nil {
+		return nil
+	}
+	served := make(map[corenet.Port]bool, len(ports))
+	for _, p := range ports {
+		served[p] = true
+	}
+	for _, p := range rl.Ports {
+		if !served[p.CorePort()] {
+			return NewPermanentError("InvalidRateLimit", fmt.Errorf("port %v of the rate limit is not served", p.CorePort()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetRateLimit(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+	rl, err := GetRateLimit(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, rl)
+
+	lb.Annotations[AnnotationKeyRateLimit] = `{
+		"maxConnections":10000,
+		"connectionRate":500,
+		"ports":[
+			{"protocol":"udp","port":53,"connectionRate":100},
+			{"port":443,"maxConnections":1000},
+			{"port":80,"requestRate":50}
+		]
+	}`
+	rl, err = GetRateLimit(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &RateLimit{
+		Limits: Limits{MaxConnections: 10000, ConnectionRate: 500},
+		Ports: []PortRateLimit{
+			{Protocol: "tcp", Port: 80, Limits: Limits{RequestRate: 50}},
+			{Protocol: "tcp", Port: 443, Limits: Limits{MaxConnections: 1000}},
+			{Protocol: "udp", Port: 53, Limits: Limits{ConnectionRate: 100}},
+		},
+	}, rl)
+
+	assert.Nil(t, CheckRateLimitPorts(rl, []corenet.Port{{Protocol: "udp", Port: 53}, {Protocol: "tcp", Port: 80}, {Protocol: "tcp", Port: 443}}))
+	err = CheckRateLimitPorts(rl, DefaultPorts)
+	if assert.True(t, IsPermanentError(err)) {
+		assert.Equal(t, "InvalidRateLimit", err.(*PermanentError).Reason)
+	}
+	assert.Nil(t, CheckRateLimitPorts(nil, DefaultPorts))
+
+	for _, value := range []string{
+		`10000`,
+		`{"maxConnections":-1}`,
+		`{"ports":[{"port":80,"requestRate":-1}]}`,
+		`{"ports":[{"port":80}]}`,
+		`{"ports":[{"port":0,"maxConnections":1}]}`,
+		`{"ports":[{"protocol":"sctp","port":80,"maxConnections":1}]}`,
+		`{"ports":[{"protocol":"udp","port":53,"requestRate":1}]}`,
+		`{"ports":[{"port":80,"maxConnections":1},{"protocol":"tcp","port":80,"requestRate":1}]}`,
+	} {
+		lb.Annotations[AnnotationKeyRateLimit] = value
+		_, err = GetRateLimit(lb)
+		if assert.True(t, IsPermanentError(err), value) {
+			assert.Equal(t, "InvalidRateLimit", err.(*PermanentError).Reason, value)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyReachabilityCondition is the Condition of the
+	// reachability of the VIPs after the last sync
+	AnnotationKeyReachabilityCondition = "loadbalancer.caicloud.io/reachability-condition"
+
+	// VIPReachable is the reason of the condition if all ports of the VIPs
+	// are reachable
+	VIPReachable = "VIPReachable"
+	// VIPUnreachable is the reason of the condition and the Warning event
+	// if some ports of the VIPs are not reachable
+	VIPUnreachable = "VIPUnreachable"
+
+	reachabilityTimeout = 2 * time.Second
+	// reachabilityRecheckPeriod is the resync period of the LoadBalancer
+	// while its VIPs are not reachable
+	reachabilityRecheckPeriod = 30 * time.Second
+)
+
+var vipReachable = metrics.NewGaugeVec(
+	"loadbalancer_provider_vip_reachable",
+	"Whether the port of the VIP is reachable from the provider after the last sync",
+	"address", "protocol", "port",
+)
+
+func init() {
+	metrics.MustRegister(vipReachable)
+}
+
+// ProbeVIP checks if the port of the VIP is reachable, the probe leaves
+// through iface if it is not empty. A tcp port is reachable if a
+// connection can be established. A udp port is unreachable only if an
+// ICMP port unreachable comes back, silence is not conclusive.
+func ProbeVIP(vip net.IP, port corenet.Port, iface string, timeout time.Duration) error {
+	address := net.JoinHostPort(vip.String(), strconv.Itoa(int(port.Port)))
+	conn, err := corenet.DialOnInterface(port.Protocol, address, iface, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if port.Protocol != "udp" {
+		return nil
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil
+		}
+		if isConnRefused(err) {
+			return fmt.Errorf("%s %s: port unreachable", port.Protocol, address)
+		}
+		return err
+	}
+	return nil
+}
+
+func isConnRefused(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// verifyReachability probes every port of the VIPs of the LoadBalancer
+// through the uplink of the backend, so a misconfigured switch port or
+// reverse path filter shows up right after the sync. It records the result
+// as a condition, and returns false if some ports are unreachable.
+func (p *GenericProvider) verifyReachability(lb *netv1alpha1.LoadBalancer) bool {
+	vips, err := GetVIPs(lb)
+	if err != nil {
+		return true
+	}
+	ports, err := GetPorts(lb)
+	if err != nil {
+		return true
+	}
+	iface := ""
+	if p.ext.iface != nil {
+		if ifaces := p.ext.iface.Interfaces(); len(ifaces) > 0 {
+			iface = ifaces[0]
+		}
+	}
+
+	failures := make([]string, 0)
+	for _, vip := range vips {
+		for _, port := range ports {
+			portStr := strconv.Itoa(int(port.Port))
+			if err := p.probeVIP(vip, port, iface, reachabilityTimeout); err != nil {
+				log.Warn("VIP is not reachable", log.Fields{"vip": vip, "port": port, "iface": iface, "err": err})
+				vipReachable.Set(0, vip.String(), port.Protocol, portStr)
+				failures = append(failures, fmt.Sprintf("%s/%s: %v", port.Protocol, net.JoinHostPort(vip.String(), portStr), err))
+				continue
+			}
+			vipReachable.Set(1, vip.String(), port.Protocol, portStr)
+		}
+	}
+
+	if len(failures) > 0 {
+		p.setCondition(lb, AnnotationKeyReachabilityCondition, Condition{
+			Status:  v1.ConditionFalse,
+			Reason:  VIPUnreachable,
+			Message: strings.Join(failures, "; "),
+		})
+		return false
+	}
+	p.setCondition(lb, AnnotationKeyReachabilityCondition, Condition{
+		Status: v1.ConditionTrue,
+		Reason: VIPReachable,
+	})
+	return true
+}
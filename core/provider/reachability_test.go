@@ -0,0 +1,61 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeVIP(t *testing.T) {
+	loopback := net.ParseIP("127.0.0.1")
+	timeout := 200 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	tcpPort := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	u, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer u.Close()
+	udpPort := uint16(u.LocalAddr().(*net.UDPAddr).Port)
+
+	// free ports nobody listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedTCP := uint16(closed.Addr().(*net.TCPAddr).Port)
+	closed.Close()
+	closedUDP, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedUDP := uint16(closedUDP.LocalAddr().(*net.UDPAddr).Port)
+	closedUDP.Close()
+
+	assert.Nil(t, ProbeVIP(loopback, corenet.Port{Protocol: "tcp", Port: tcpPort}, "", timeout))
+	// bound to the interface
+	assert.Nil(t, ProbeVIP(loopback, corenet.Port{Protocol: "tcp", Port: tcpPort}, "lo", timeout))
+	assert.NotNil(t, ProbeVIP(loopback, corenet.Port{Protocol: "tcp", Port: tcpPort}, "nonexistent0", timeout))
+	assert.NotNil(t, ProbeVIP(loopback, corenet.Port{Protocol: "tcp", Port: refusedTCP}, "", timeout))
+
+	// a silent udp port is reachable
+	assert.Nil(t, ProbeVIP(loopback, corenet.Port{Protocol: "udp", Port: udpPort}, "", timeout))
+	assert.NotNil(t, ProbeVIP(loopback, corenet.Port{Protocol: "udp", Port: refusedUDP}, "", timeout))
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/zoumo/logdog"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// DefaultRecordMaxBytes is the size the recording is rotated at
+	DefaultRecordMaxBytes = 64 << 20
+	// DefaultRecordMaxFiles is the number of the rotated recordings kept
+	DefaultRecordMaxFiles = 3
+
+	// CallOnUpdate and CallOnDelete are the methods of the backend a
+	// recorded sync called
+	CallOnUpdate = "OnUpdate"
+	CallOnDelete = "OnDelete"
+
+	// maxRecordSize bounds the length read from a recording, a larger one
+	// is taken as a corruption
+	maxRecordSize = 64 << 20
+)
+
+// Record is a recorded sync of a LoadBalancer, the inputs the backend was
+// called with and the result, for replaying it offline
+type Record struct {
+	Key string `json:"key"`
+	// Call is the method of the backend the sync called, empty if the sync
+	// ended before calling the backend, e.g. on an invalid LoadBalancer
+	Call string `json:"call,omitempty"`
+	// LoadBalancer is the LoadBalancer passed to the backend, or the one
+	// last seen if the backend was not called, with the redacted
+	// annotations
+	LoadBalancer *netv1alpha1.LoadBalancer `json:"loadBalancer"`
+	// Nodes are the nodes of the LoadBalancer found, Services and
+	// Endpoints the ones of the Services it lists if they are watched
+	Nodes     []*v1.Node      `json:"nodes"`
+	Services  []*v1.Service   `json:"services,omitempty"`
+	Endpoints []*v1.Endpoints `json:"endpoints,omitempty"`
+	// RealServers are the real servers resolved from the nodes by the
+	// policies of the provider
+	RealServers []RealServerState `json:"realServers"`
+	// Sync is the time and the result of the sync
+	Sync SyncState `json:"sync"`
+}
+
+// RecordWriter appends the Records to a file, each one is the big endian
+// uint32 length of its json followed by the json. The file is rotated once
+// it reaches the max bytes, to the path suffixed by .1, the previous .1 to
+// .2 and so on, the ones beyond the max files are removed.
+type RecordWriter struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRecordWriter returns a RecordWriter appending to the file of the
+// path, the defaults are used for the max bytes and files if they are not
+// positive
+func NewRecordWriter(path string, maxBytes int64, maxFiles int) (*RecordWriter, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultRecordMaxBytes
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultRecordMaxFiles
+	}
+	w := &RecordWriter{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RecordWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// Write appends the Record, rotating the file first if the Record does not
+// fit in it
+func (w *RecordWriter) Write(r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("recording %s is closed", w.path)
+	}
+	if w.size > 0 && w.size+int64(len(buf)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	return err
+}
+
+// rotate shifts the rotated files and reopens the file of the path
+func (w *RecordWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+	for i := w.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the file, the Records written later are rejected
+func (w *RecordWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// RecordReader reads the Records written by a RecordWriter
+type RecordReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordReader returns a RecordReader of the reader
+func NewRecordReader(r io.Reader) *RecordReader {
+	return &RecordReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next Record, io.EOF at the end of the recording and
+// io.ErrUnexpectedEOF if the last one is truncated
+func (r *RecordReader) Read() (*Record, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds %d", size, maxRecordSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadRecordFile returns the Records of the file in order, the rotated
+// files are read separately
+func ReadRecordFile(path string) ([]*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := make([]*Record, 0)
+	reader := NewRecordReader(file)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+// setSyncInput notes the LoadBalancer passed to the method of the backend
+// by the running sync, for the recording
+func (p *GenericProvider) setSyncInput(lb *netv1alpha1.LoadBalancer, call string) {
+	if p.records == nil {
+		return
+	}
+	key := lb.Namespace + "/" + lb.Name
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+	if s, ok := p.syncs[key]; ok {
+		s.input, s.call = lb, call
+	}
+}
+
+// recordSync appends the inputs and the result of the finished sync of the
+// LoadBalancer to the recording
+func (p *GenericProvider) recordSync(obj interface{}, s SyncState) {
+	lb, ok := obj.(*netv1alpha1.LoadBalancer)
+	if !ok {
+		return
+	}
+	r := &Record{
+		Key:         lb.Namespace + "/" + lb.Name,
+		Call:        s.call,
+		Nodes:       make([]*v1.Node, 0),
+		RealServers: make([]RealServerState, 0),
+		Sync:        s,
+	}
+	if s.input != nil {
+		lb = s.input
+	} else if nlb, err := p.lbLister.LoadBalancers(lb.Namespace).Get(lb.Name); err == nil {
+		lb = nlb
+	}
+	r.LoadBalancer = redactLoadBalancer(lb)
+	for _, name := range lb.Spec.Nodes.Names {
+		if node, err := p.lister.Node.Get(name); err == nil {
+			r.Nodes = append(r.Nodes, node)
+		}
+	}
+	if p.lister.Service != nil && p.lister.Endpoints != nil {
+		for _, name := range GetServices(lb) {
+			if svc, err := p.lister.Service.Services(lb.Namespace).Get(name); err == nil {
+				r.Services = append(r.Services, svc)
+			}
+			if ep, err := p.lister.Endpoints.Endpoints(lb.Namespace).Get(name); err == nil {
+				r.Endpoints = append(r.Endpoints, ep)
+			}
+		}
+	}
+	if s.call != CallOnDelete {
+		vips, _ := GetVIPList(lb)
+		r.RealServers = p.realServerStates(lb, vips)
+	}
+	if err := p.records.Write(r); err != nil {
+		log.Error("record sync error", log.Fields{"lb": r.Key, "err": err})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newRecord(i int) *Record {
+	return &Record{
+		Key:          "default/lb",
+		Call:         CallOnUpdate,
+		LoadBalancer: &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", ResourceVersion: fmt.Sprint(i)}},
+		Sync:         SyncState{Result: SyncResultSuccess},
+	}
+}
+
+func TestRecordWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "syncs")
+
+	// every record fits in a file alone
+	w, err := NewRecordWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, w.Write(newRecord(i)))
+	}
+	assert.NoError(t, w.Close())
+	assert.Error(t, w.Write(newRecord(4)))
+
+	for suffix, version := range map[string]string{"": "3", ".1": "2", ".2": "1"} {
+		records, err := ReadRecordFile(path + suffix)
+		assert.NoError(t, err)
+		if assert.Len(t, records, 1, suffix) {
+			assert.Equal(t, version, records[0].LoadBalancer.ResourceVersion, suffix)
+		}
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// the records are appended to the existing file
+	w, err = NewRecordWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, w.Write(newRecord(4)))
+	assert.NoError(t, w.Close())
+	records, err := ReadRecordFile(path)
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "4", records[1].LoadBalancer.ResourceVersion)
+	}
+}
+
+func TestRecordReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "syncs")
+	w, err := NewRecordWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, w.Write(newRecord(1)))
+	assert.NoError(t, w.Write(newRecord(2)))
+	w.Close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRecordReader(bytes.NewReader(data))
+	for _, version := range []string{"1", "2"} {
+		record, err := r.Read()
+		if assert.NoError(t, err) {
+			assert.Equal(t, version, record.LoadBalancer.ResourceVersion)
+			assert.Equal(t, CallOnUpdate, record.Call)
+			assert.Equal(t, SyncResultSuccess, record.Sync.Result)
+		}
+	}
+	_, err = r.Read()
+	assert.Equal(t, io.EOF, err)
+
+	// a truncated record
+	r = NewRecordReader(bytes.NewReader(data[:len(data)-1]))
+	_, err = r.Read()
+	assert.NoError(t, err)
+	_, err = r.Read()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// a corrupted length
+	_, err = NewRecordReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})).Read()
+	assert.Error(t, err)
+}
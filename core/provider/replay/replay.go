@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package replay feeds the syncs recorded by a GenericProvider back
+// through a backend offline in dry-run, for debugging the backend on the
+// inputs it saw in a cluster.
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/zoumo/logdog"
+	cli "gopkg.in/urfave/cli.v1"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	"github.com/caicloud/loadbalancer-provider/core/provider/validate"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Result is the result of a replayed sync next to the recorded one
+type Result struct {
+	Key  string `json:"key"`
+	Call string `json:"call,omitempty"`
+	// Recorded is the recorded sync, Result and Error the replayed result
+	// of the call, they are empty if the recorded sync did not call the
+	// backend
+	Recorded core.SyncState `json:"recorded"`
+	Result   string         `json:"result,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	// Backend is the state the backend would apply, DryRun is false if it
+	// is not a DryRunProvider and only the offline checks of the validate
+	// command ran
+	Backend json.RawMessage `json:"backend,omitempty"`
+	DryRun  bool            `json:"dryRun"`
+	// Diff is true if the replayed result differs from the recorded one
+	Diff bool `json:"diff"`
+}
+
+// Run replays the Records in order through the backend in dry-run, it is
+// neither started nor are OnUpdate and OnDelete called. The updates are
+// checked as the validate command does and passed to DryRun if the
+// backend is a DryRunProvider, the deletions apply nothing. The backend
+// lists the recorded objects only, and the real servers are restricted to
+// the recorded ones, nothing is read from or written to a cluster. The
+// Records not calling the backend are passed through.
+func Run(records []*core.Record, backend core.Provider) []Result {
+	dryRun, _ := backend.(core.DryRunProvider)
+
+	results := make([]Result, 0, len(records))
+	for _, record := range records {
+		result := Result{Key: record.Key, Call: record.Call, Recorded: record.Sync, DryRun: dryRun != nil}
+		if record.Call == "" || record.LoadBalancer == nil {
+			results = append(results, result)
+			continue
+		}
+
+		var err error
+		switch record.Call {
+		case core.CallOnUpdate:
+			if errs := validate.Validate(record.LoadBalancer, backend); len(errs) > 0 {
+				err = core.NewPermanentError("Invalid", utilerrors.NewAggregate(fieldErrors(errs)))
+				break
+			}
+			if dryRun != nil {
+				backend.SetListers(lister(record))
+				result.Backend, err = dryRun.DryRun(record.LoadBalancer)
+			}
+		case core.CallOnDelete:
+		default:
+			err = fmt.Errorf("unknown call %q", record.Call)
+		}
+		result.Result = resultOf(record.Call, err)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Diff = result.Result != record.Sync.Result || result.Error != record.Sync.Error
+		results = append(results, result)
+	}
+	return results
+}
+
+// RunFile replays the recording of the path through the backend as Run
+// does, and writes the Results to the writer in json, one per line
+func RunFile(path string, backend core.Provider, w io.Writer) error {
+	records, err := core.ReadRecordFile(path)
+	if err != nil {
+		return fmt.Errorf("read recording %s: %v", path, err)
+	}
+	diffs := 0
+	encoder := json.NewEncoder(w)
+	for _, result := range Run(records, backend) {
+		if result.Diff {
+			diffs++
+		}
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	}
+	log.Info("Replayed the recording", log.Fields{"path": path, "syncs": len(records), "diffs": diffs})
+	return nil
+}
+
+// Command returns the replay command of a provider binary, it replays the
+// recording of the file argument through the backend as Run does and
+// prints the Results. Nothing of the provider is set up, so the zero value
+// of the backend type is enough for the in-tree backends.
+func Command(backend core.Provider) cli.Command {
+	return CommandFunc(func() (core.Provider, error) {
+		return backend, nil
+	})
+}
+
+// CommandFunc is Command for the backends which are built from the flags,
+// e.g. a plugin, newBackend is called once the command runs
+func CommandFunc(newBackend func() (core.Provider, error)) cli.Command {
+	return cli.Command{
+		Name:      "replay",
+		Usage:     "replay the syncs recorded by --record through the provider in dry-run offline, nothing is applied",
+		ArgsUsage: "FILE",
+		Action: func(c *cli.Context) error {
+			path := c.Args().First()
+			if path == "" {
+				return cli.NewExitError("the recording file is required", 1)
+			}
+			backend, err := newBackend()
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			if err := RunFile(path, backend, os.Stdout); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		},
+	}
+}
+
+// lister returns a StoreLister of the recorded objects, the real servers
+// are restricted to the recorded ones
+func lister(record *core.Record) core.StoreLister {
+	objects := []runtime.Object{record.LoadBalancer}
+	for _, node := range record.Nodes {
+		objects = append(objects, node)
+	}
+	for _, svc := range record.Services {
+		objects = append(objects, svc)
+	}
+	for _, ep := range record.Endpoints {
+		objects = append(objects, ep)
+	}
+	l := fake.NewStoreListerFromObjects(objects...)
+	servers := sets.NewString()
+	for _, rs := range record.RealServers {
+		servers.Insert(rs.Node)
+	}
+	l.Local = servers.Has
+	return l
+}
+
+func fieldErrors(errs []validate.FieldError) []error {
+	ret := make([]error, 0, len(errs))
+	for _, err := range errs {
+		ret = append(ret, err)
+	}
+	return ret
+}
+
+// resultOf returns the SyncResult the GenericProvider records for the
+// error of the call of the backend, the deletions are not failed
+// permanently
+func resultOf(call string, err error) string {
+	switch {
+	case err == nil:
+		return core.SyncResultSuccess
+	case core.IsPermanentError(err) && call == core.CallOnUpdate:
+		return core.SyncResultPermanentError
+	case core.IsRetryAfterError(err):
+		return core.SyncResultRetryAfter
+	}
+	return core.SyncResultError
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replay_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	"github.com/caicloud/loadbalancer-provider/core/provider/replay"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// readCalls reads the recording until it holds the records of the calls
+// of the backend, the last one is written after the call returns
+func readCalls(t *testing.T, path string, calls int) []*core.Record {
+	deadline := time.Now().Add(providertesting.DefaultTimeout)
+	for {
+		records, err := core.ReadRecordFile(path)
+		if err != nil {
+			t.Fatalf("read recording error: %v", err)
+		}
+		n := 0
+		for _, r := range records {
+			if r.Call != "" {
+				n++
+			}
+		}
+		if n >= calls || time.Now().After(deadline) {
+			return records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "syncs")
+
+	backend := fake.NewFakeProvider("fake")
+	env := providertesting.NewTestEnv(t, backend, func(cfg *core.Configuration) {
+		cfg.RecordPath = path
+	})
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	env.AddNode("node2", "192.168.0.2")
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+	lb.Annotations = map[string]string{"example.com/api-token": "s3cr3t"}
+	lb = env.CreateLB(lb)
+	lb = env.UpdateLB(lb, func(lb *netv1alpha1.LoadBalancer) {
+		lb.Spec.Nodes.Names = []string{"node1", "node2"}
+	})
+	env.DeleteLB(lb)
+	if err := backend.WaitForCallCount(fake.MethodOnDelete, 1, providertesting.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	records := readCalls(t, path, backend.CallCount(fake.MethodOnUpdate)+1)
+	env.Stop()
+
+	for _, r := range records {
+		assert.Equal(t, "default/lb", r.Key)
+		assert.Equal(t, "<redacted>", r.LoadBalancer.Annotations["example.com/api-token"])
+		assert.Equal(t, core.SyncResultSuccess, r.Sync.Result)
+	}
+	last := records[len(records)-1]
+	assert.Equal(t, core.CallOnDelete, last.Call)
+	for _, r := range records {
+		if r.Call == core.CallOnUpdate && len(r.LoadBalancer.Spec.Nodes.Names) == 2 {
+			assert.Len(t, r.Nodes, 2)
+			assert.Len(t, r.RealServers, 2)
+		}
+	}
+
+	replayed := fake.NewFakeProvider("replayed")
+	results := replay.Run(records, replayed)
+	assert.Len(t, results, len(records))
+	for _, result := range results {
+		assert.False(t, result.Diff, "%+v", result)
+	}
+	// nothing is applied
+	assert.Equal(t, []string{fake.MethodSetListers, fake.MethodDryRun}, replayed.Methods()[:2])
+	assert.Equal(t, 0, replayed.CallCount(fake.MethodStart))
+	assert.Equal(t, 0, replayed.CallCount(fake.MethodOnUpdate))
+	assert.Equal(t, 0, replayed.CallCount(fake.MethodOnDelete))
+
+	// the dry-run is passed the same LoadBalancers as OnUpdate, except
+	// for the redacted annotation
+	original := backend.Updates()
+	if assert.Equal(t, len(original), replayed.CallCount(fake.MethodDryRun)) {
+		for i, lb := range replayed.DryRuns() {
+			expected := *original[i]
+			expected.Annotations = map[string]string{}
+			for key, value := range original[i].Annotations {
+				expected.Annotations[key] = value
+			}
+			expected.Annotations["example.com/api-token"] = "<redacted>"
+			assert.Equal(t, &expected, lb)
+		}
+	}
+}
+
+func TestReplayDiff(t *testing.T) {
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+	records := []*core.Record{
+		{Key: "default/lb", Call: core.CallOnUpdate, LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultSuccess}},
+		{Key: "default/lb", LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultPermanentError, Error: "invalid"}},
+		{Key: "default/lb", Call: core.CallOnUpdate, LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultRetryAfter, Error: "busy"}},
+	}
+	backend := fake.NewFakeProvider("fake")
+	backend.SetState(json.RawMessage(`{"rendered":true}`))
+	backend.Script(fake.MethodDryRun, fake.Behavior{Err: fmt.Errorf("boom")})
+
+	results := replay.Run(records, backend)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, core.SyncResultError, results[0].Result)
+		assert.Equal(t, "boom", results[0].Error)
+		assert.True(t, results[0].Diff)
+		assert.True(t, results[0].DryRun)
+		// the sync not calling the backend is passed through
+		assert.Equal(t, "", results[1].Result)
+		assert.False(t, results[1].Diff)
+		assert.Equal(t, core.SyncResultSuccess, results[2].Result)
+		assert.JSONEq(t, `{"rendered":true}`, string(results[2].Backend))
+		assert.True(t, results[2].Diff)
+	}
+	assert.Equal(t, 2, backend.CallCount(fake.MethodDryRun))
+	assert.Equal(t, 0, backend.CallCount(fake.MethodOnUpdate))
+}
+
+func TestReplayChecksOnly(t *testing.T) {
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+	invalid := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+	invalid.Annotations = map[string]string{core.AnnotationKeyPorts: "invalid"}
+	records := []*core.Record{
+		{Key: "default/lb", Call: core.CallOnUpdate, LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultSuccess}},
+		{Key: "default/lb", Call: core.CallOnUpdate, LoadBalancer: invalid, Sync: core.SyncState{Result: core.SyncResultSuccess}},
+		{Key: "default/lb", Call: core.CallOnDelete, LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultSuccess}},
+	}
+
+	// only the offline checks run if the backend can not dry-run
+	backend := fake.NewFakeProvider("fake")
+	results := replay.Run(records, struct{ core.Provider }{backend})
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, core.SyncResultSuccess, results[0].Result)
+		assert.False(t, results[0].DryRun)
+		assert.Equal(t, core.SyncResultPermanentError, results[1].Result)
+		assert.Contains(t, results[1].Error, "loadbalancer.caicloud.io/ports")
+		assert.True(t, results[1].Diff)
+		assert.Equal(t, core.SyncResultSuccess, results[2].Result)
+		assert.False(t, results[2].Diff)
+	}
+	assert.Empty(t, backend.Calls())
+}
+
+func TestRunFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "syncs")
+	w, err := core.NewRecordWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1")
+	assert.NoError(t, w.Write(&core.Record{Key: "default/lb", Call: core.CallOnUpdate, LoadBalancer: lb, Sync: core.SyncState{Result: core.SyncResultSuccess}}))
+	w.Close()
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, replay.RunFile(path, fake.NewFakeProvider("fake"), out))
+	result := replay.Result{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, core.SyncResultSuccess, result.Result)
+	assert.False(t, result.Diff)
+
+	assert.Error(t, replay.RunFile(filepath.Join(dir, "missing"), fake.NewFakeProvider("fake"), out))
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// AnnotationKeyMaster is the name of the node which holds the VIPs, it is
+// set by the provider on the node when it becomes the master, and removed
+// when the master steps down
+const AnnotationKeyMaster = "loadbalancer.caicloud.io/master"
+
+const (
+	// roleEventQPS and roleEventBurst limit the events of the role
+	// transitions, so a flapping node does not flood the events
+	roleEventQPS   = 0.1
+	roleEventBurst = 5
+)
+
+// Role is the role of the node in the election of the node holding the VIPs
+type Role string
+
+// The roles are the states of the VRRP instance
+const (
+	RoleMaster Role = "MASTER"
+	RoleBackup Role = "BACKUP"
+	RoleFault  Role = "FAULT"
+	RoleStop   Role = "STOP"
+)
+
+// RoleProvider is implemented by the Providers which elect the node holding
+// the VIPs, they report the role transitions of the node to the handler
+type RoleProvider interface {
+	// SetRoleHandler sets the handler of the role transitions
+	SetRoleHandler(func(Role))
+}
+
+// Role returns the role of the node, it is empty if the backend is not a
+// RoleProvider or has not reported any
+func (p *GenericProvider) Role() Role {
+	p.roleLock.Lock()
+	defer p.roleLock.Unlock()
+	return p.role
+}
+
+// onRoleChange records an event of the transition and updates the master
+// annotation of the LoadBalancer
+func (p *GenericProvider) onRoleChange(role Role) {
+	p.roleLock.Lock()
+	if p.role == role {
+		p.roleLock.Unlock()
+		return
+	}
+	p.role = role
+	p.roleLock.Unlock()
+
+	log.Info("Role changed", log.Fields{"node": p.cfg.NodeName, "role": role})
+
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		log.Error("get loadbalancer error", log.Fields{"err": err})
+		return
+	}
+
+	if p.roleEvents.TryAccept() {
+		eventtype := v1.EventTypeNormal
+		if role == RoleFault {
+			eventtype = v1.EventTypeWarning
+		}
+		p.recorder.Event(lb, eventtype, "RoleChanged", fmt.Sprintf("became %s on node %s", role, p.cfg.NodeName))
+	} else {
+		log.Warn("Role change event suppressed", log.Fields{"node": p.cfg.NodeName, "role": role})
+	}
+
+	var master interface{}
+	switch {
+	case role == RoleMaster:
+		master = p.cfg.NodeName
+	case lb.Annotations[AnnotationKeyMaster] == p.cfg.NodeName:
+		// stepped down, the annotation is removed unless another node
+		// has taken over
+		master = nil
+	default:
+		return
+	}
+	if err := p.patchAnnotation(lb, AnnotationKeyMaster, master); err != nil {
+		log.Error("update master error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+}
+
+// patchAnnotation sets the annotation of the LoadBalancer, a nil value
+// removes it
+func (p *GenericProvider) patchAnnotation(lb *netv1alpha1.LoadBalancer, key string, value interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				key: value,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return p.patchLoadBalancer(lb.Namespace, lb.Name, patch)
+}
+
+func newRoleEventLimiter() flowcontrol.RateLimiter {
+	return flowcontrol.NewTokenBucketRateLimiter(roleEventQPS, roleEventBurst)
+}
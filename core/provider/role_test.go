@@ -0,0 +1,115 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func newRoleTestProvider(lb *netv1alpha1.LoadBalancer, events flowcontrol.RateLimiter) (*GenericProvider, *record.FakeRecorder, *[]string) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(lb)
+	recorder := record.NewFakeRecorder(100)
+	patches := &[]string{}
+	p := &GenericProvider{
+		cfg:        &Configuration{LoadBalancerNamespace: lb.Namespace, LoadBalancerName: lb.Name, NodeName: "node-1"},
+		lbLister:   netlisters.NewLoadBalancerLister(indexer),
+		recorder:   recorder,
+		roleEvents: events,
+		patchLoadBalancer: func(namespace, name string, patch []byte) error {
+			*patches = append(*patches, string(patch))
+			return nil
+		},
+	}
+	return p, recorder, patches
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestOnRoleChange(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p, recorder, patches := newRoleTestProvider(lb, flowcontrol.NewFakeAlwaysRateLimiter())
+
+	p.onRoleChange(RoleBackup)
+	assert.Equal(t, RoleBackup, p.Role())
+	assert.Equal(t, []string{"Normal RoleChanged became BACKUP on node node-1"}, drainEvents(recorder))
+	// not the master, nothing to update
+	assert.Len(t, *patches, 0)
+
+	p.onRoleChange(RoleMaster)
+	p.onRoleChange(RoleMaster)
+	assert.Equal(t, RoleMaster, p.Role())
+	assert.Equal(t, []string{"Normal RoleChanged became MASTER on node node-1"}, drainEvents(recorder))
+	assert.Equal(t, []string{`{"metadata":{"annotations":{"loadbalancer.caicloud.io/master":"node-1"}}}`}, *patches)
+
+	// stepped down
+	lb.Annotations = map[string]string{AnnotationKeyMaster: "node-1"}
+	p.onRoleChange(RoleFault)
+	assert.Equal(t, []string{"Warning RoleChanged became FAULT on node node-1"}, drainEvents(recorder))
+	assert.Equal(t, `{"metadata":{"annotations":{"loadbalancer.caicloud.io/master":null}}}`, (*patches)[1])
+
+	// another node has taken over
+	lb.Annotations = map[string]string{AnnotationKeyMaster: "node-2"}
+	p.onRoleChange(RoleBackup)
+	assert.Len(t, *patches, 2)
+}
+
+func TestOnRoleChangeFlapping(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p, recorder, patches := newRoleTestProvider(lb, flowcontrol.NewTokenBucketRateLimiter(0.001, 3))
+
+	for i := 0; i < 5; i++ {
+		p.onRoleChange(RoleMaster)
+		p.onRoleChange(RoleBackup)
+	}
+	// the events are limited, the annotation is not
+	assert.Len(t, drainEvents(recorder), 3)
+	assert.Len(t, *patches, 5)
+	assert.Equal(t, RoleBackup, p.Role())
+}
+
+func TestOnEvent(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p, recorder, _ := newRoleTestProvider(lb, flowcontrol.NewFakeAlwaysRateLimiter())
+
+	p.onEvent("Warning", "ConfigDrift", "the configuration was changed")
+	assert.Equal(t, []string{"Warning ConfigDrift the configuration was changed on node node-1"}, drainEvents(recorder))
+
+	// the event is dropped without the LoadBalancer
+	p.cfg.LoadBalancerName = "missing"
+	p.onEvent("Warning", "ConfigDrift", "the configuration was changed")
+	assert.Empty(t, drainEvents(recorder))
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// AnnotationKeyVRRPAuthSecret is the name of the Secret in the namespace
+	// of the LoadBalancer holding the VRRP authentication, VRRP is not
+	// authenticated if it is absent
+	AnnotationKeyVRRPAuthSecret = "loadbalancer.caicloud.io/vrrp-auth-secret"
+
+	// VRRPAuthTypeKey is the key of the authentication type in the Secret,
+	// PASS or AH, it defaults to PASS
+	VRRPAuthTypeKey = "auth-type"
+	// VRRPAuthPassKey is the key of the password in the Secret
+	VRRPAuthPassKey = "auth-pass"
+
+	// maxVRRPAuthPass is the longest password keepalived accepts, the
+	// longer ones are truncated silently
+	maxVRRPAuthPass = 8
+)
+
+// VRRPAuth is the authentication of the VRRP advertisements
+type VRRPAuth struct {
+	Type     string
+	Password string
+}
+
+// String implements fmt.Stringer without the password
+func (a VRRPAuth) String() string {
+	return fmt.Sprintf("{%s ******}", a.Type)
+}
+
+// GoString implements fmt.GoStringer without the password
+func (a VRRPAuth) GoString() string {
+	return a.String()
+}
+
+// GetVRRPAuth returns the VRRP authentication in the Secret referenced by
+// the LoadBalancer, nil if it references none. It returns a PermanentError
+// if the Secret is missing or invalid, the LoadBalancer is resynced when
+// the Secret changes.
+func GetVRRPAuth(lb *netv1alpha1.LoadBalancer, secrets v1listers.SecretLister) (*VRRPAuth, error) {
+	name, ok := lb.Annotations[AnnotationKeyVRRPAuthSecret]
+	if !ok {
+		return nil, nil
+	}
+	if secrets == nil {
+		return nil, fmt.Errorf("no secret lister to get the vrrp auth secret %s/%s", lb.Namespace, name)
+	}
+
+	secret, err := secrets.Secrets(lb.Namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil, NewPermanentError("VRRPAuthSecretNotFound", fmt.Errorf("vrrp auth secret %s/%s not found", lb.Namespace, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &VRRPAuth{Type: "PASS", Password: string(secret.Data[VRRPAuthPassKey])}
+	if t, ok := secret.Data[VRRPAuthTypeKey]; ok {
+		auth.Type = string(t)
+	}
+	if auth.Type != "PASS" && auth.Type != "AH" {
+		return nil, NewPermanentError("InvalidVRRPAuth", fmt.Errorf("invalid vrrp auth type %q in secret %s/%s", auth.Type, lb.Namespace, name))
+	}
+	if len(auth.Password) == 0 || len(auth.Password) > maxVRRPAuthPass {
+		return nil, NewPermanentError("InvalidVRRPAuth", fmt.Errorf("the vrrp auth password in secret %s/%s must have 1 to %d characters", lb.Namespace, name, maxVRRPAuthPass))
+	}
+	return auth, nil
+}
+
+// referencesSecret returns true if the LoadBalancer references the Secret
+// for the VRRP authentication, the certificate of a HTTP port or the CA of
+// its backends
+func referencesSecret(lb *netv1alpha1.LoadBalancer, name string) bool {
+	if lb.Annotations[AnnotationKeyVRRPAuthSecret] == name {
+		return true
+	}
+	for key, value := range lb.Annotations {
+		if strings.HasPrefix(key, AnnotationKeyBackendCASecretPrefix) && value == name {
+			return true
+		}
+	}
+	ports, _ := GetHTTPPorts(lb)
+	for _, p := range ports {
+		if p.TLSSecret == name {
+			return true
+		}
+		for _, h := range p.Hosts {
+			if h.TLSSecret == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newSecretInformer returns an informer of the Secrets in the namespace, the
+// provider does not need to watch the Secrets of the whole cluster
+func newSecretInformer(client kubernetes.Interface, namespace string, resync time.Duration) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Secrets(namespace).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Secrets(namespace).Watch(options)
+			},
+		},
+		&v1.Secret{},
+		resync,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetVRRPAuth(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := v1listers.NewSecretLister(indexer)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vrrp"},
+		Data:       map[string][]byte{VRRPAuthPassKey: []byte("s3cret")},
+	}
+	indexer.Add(secret)
+
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	auth, err := GetVRRPAuth(lb, secrets)
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	lb.Annotations = map[string]string{AnnotationKeyVRRPAuthSecret: "vrrp"}
+	auth, err = GetVRRPAuth(lb, secrets)
+	assert.Nil(t, err)
+	assert.Equal(t, &VRRPAuth{Type: "PASS", Password: "s3cret"}, auth)
+	// the password is not printed
+	assert.NotContains(t, fmt.Sprintf("%v %+v %#v", *auth, auth, auth), "s3cret")
+
+	// rotated
+	rotated := &v1.Secret{
+		ObjectMeta: secret.ObjectMeta,
+		Data:       map[string][]byte{VRRPAuthTypeKey: []byte("AH"), VRRPAuthPassKey: []byte("rotated")},
+	}
+	indexer.Update(rotated)
+	auth, err = GetVRRPAuth(lb, secrets)
+	assert.Nil(t, err)
+	assert.Equal(t, &VRRPAuth{Type: "AH", Password: "rotated"}, auth)
+
+	// invalid
+	rotated.Data[VRRPAuthPassKey] = []byte("toolongpassword")
+	_, err = GetVRRPAuth(lb, secrets)
+	assert.True(t, IsPermanentError(err))
+	rotated.Data[VRRPAuthPassKey] = []byte("s3cret")
+	rotated.Data[VRRPAuthTypeKey] = []byte("MD5")
+	_, err = GetVRRPAuth(lb, secrets)
+	assert.True(t, IsPermanentError(err))
+
+	// missing
+	indexer.Delete(rotated)
+	_, err = GetVRRPAuth(lb, secrets)
+	assert.True(t, IsPermanentError(err))
+	assert.Equal(t, "VRRPAuthSecretNotFound", err.(*PermanentError).Reason)
+}
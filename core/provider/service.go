@@ -0,0 +1,195 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyServices is the comma separated names of the Services
+	// in the namespace of the LoadBalancer exposed by its VIPs, in addition
+	// to the ones its HTTP and TCP ports proxy to
+	AnnotationKeyServices = "loadbalancer.caicloud.io/services"
+	// AnnotationKeyLoadBalancer is set on a Service to the name of the
+	// LoadBalancer owning its load balancer status, the status of the
+	// Services without it is never touched
+	AnnotationKeyLoadBalancer = "loadbalancer.caicloud.io/loadbalancer"
+)
+
+// serviceStatusRetries bounds the retries of a conflicting patch of the
+// status of a Service
+const serviceStatusRetries = 3
+
+// GetServices returns the names of the Services listed in the annotation
+// of the LoadBalancer
+func GetServices(lb *netv1alpha1.LoadBalancer) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(lb.Annotations[AnnotationKeyServices], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ownsService returns true if the status of the Service belongs to the
+// LoadBalancer
+func ownsService(lb *netv1alpha1.LoadBalancer, svc *v1.Service) bool {
+	return svc.Namespace == lb.Namespace &&
+		svc.Spec.Type == v1.ServiceTypeLoadBalancer &&
+		svc.Annotations[AnnotationKeyLoadBalancer] == lb.Name
+}
+
+// serviceIngress returns the ingress points of the LoadBalancer, the
+// provisioned addresses and hostname if the backend provides them or the
+// VIPs otherwise, and false if the backend has not provisioned any yet
+func (p *GenericProvider) serviceIngress(lb *netv1alpha1.LoadBalancer) ([]v1.LoadBalancerIngress, bool) {
+	ingress := make([]v1.LoadBalancerIngress, 0)
+	if p.ext.address != nil {
+		for _, ip := range p.ext.address.Addresses() {
+			ingress = append(ingress, v1.LoadBalancerIngress{IP: ip.String()})
+		}
+	} else {
+		vips, err := GetVIPs(lb)
+		if err != nil {
+			return nil, false
+		}
+		for _, vip := range vips {
+			ingress = append(ingress, v1.LoadBalancerIngress{IP: vip.String()})
+		}
+	}
+	if p.ext.hostname != nil {
+		if hostname := p.ext.hostname.Hostname(); hostname != "" {
+			ingress = append(ingress, v1.LoadBalancerIngress{Hostname: hostname})
+		}
+	}
+	return ingress, len(ingress) > 0
+}
+
+// reportServiceStatus sets the ingress points of the LoadBalancer on the
+// status of the Services it owns and exposes, and clears them on the
+// Services it owns but no longer exposes
+func (p *GenericProvider) reportServiceStatus(lb *netv1alpha1.LoadBalancer) {
+	if !p.cfg.ReportServiceStatus || p.lister.Service == nil {
+		return
+	}
+	ingress, provisioned := p.serviceIngress(lb)
+	for _, svc := range p.ownedServices(lb) {
+		desired := ingress
+		if !referencesService(lb, svc.Name) {
+			desired = nil
+		} else if !provisioned {
+			// pending until the backend provisions the addresses
+			continue
+		}
+		if err := p.setServiceIngress(lb, svc, desired); err != nil {
+			log.Error("update service status error", log.Fields{"svc.ns": svc.Namespace, "svc.name": svc.Name, "err": err})
+		}
+	}
+}
+
+// clearServiceStatus clears the ingress points on the status of the
+// Services the deleted LoadBalancer owns
+func (p *GenericProvider) clearServiceStatus(lb *netv1alpha1.LoadBalancer) error {
+	if !p.cfg.ReportServiceStatus || p.lister.Service == nil {
+		return nil
+	}
+	for _, svc := range p.ownedServices(lb) {
+		if err := p.setServiceIngress(lb, svc, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedServices returns the Services whose status belongs to the
+// LoadBalancer
+func (p *GenericProvider) ownedServices(lb *netv1alpha1.LoadBalancer) []*v1.Service {
+	services, err := p.lister.Service.Services(lb.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	owned := make([]*v1.Service, 0)
+	for _, svc := range services {
+		if ownsService(lb, svc) {
+			owned = append(owned, svc)
+		}
+	}
+	return owned
+}
+
+// setServiceIngress patches the ingress points on the status of the
+// Service unless it already has them, the patch is conditional on the
+// resource version and retried with the latest Service on conflicts
+func (p *GenericProvider) setServiceIngress(lb *netv1alpha1.LoadBalancer, svc *v1.Service, ingress []v1.LoadBalancerIngress) error {
+	for i := 0; ; i++ {
+		if ingressEqual(svc.Status.LoadBalancer.Ingress, ingress) {
+			return nil
+		}
+		err := p.patchService(svc.Namespace, svc.Name, serviceStatusPatch(svc.ResourceVersion, ingress))
+		if err == nil || !errors.IsConflict(err) || i >= serviceStatusRetries {
+			return err
+		}
+		log.Debug("service status conflicted, retrying", log.Fields{"svc.ns": svc.Namespace, "svc.name": svc.Name})
+		svc, err = p.getService(svc.Namespace, svc.Name)
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the ownership may have changed meanwhile
+		if !ownsService(lb, svc) {
+			return nil
+		}
+	}
+}
+
+// serviceStatusPatch returns the merge patch setting the ingress points of
+// the status of a Service of the resource version, an empty ingress
+// removes them
+func serviceStatusPatch(resourceVersion string, ingress []v1.LoadBalancerIngress) []byte {
+	var value interface{}
+	if len(ingress) > 0 {
+		value = ingress
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": resourceVersion},
+		"status": map[string]interface{}{
+			"loadBalancer": map[string]interface{}{"ingress": value},
+		},
+	})
+	return patch
+}
+
+// ingressEqual returns true if the ingress points are the same, nil and
+// empty ones are equal
+func ingressEqual(a, b []v1.LoadBalancerIngress) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
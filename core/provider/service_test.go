@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+type addressBackend struct {
+	Provider
+	addrs []net.IP
+}
+
+func (b *addressBackend) Addresses() []net.IP {
+	return b.addrs
+}
+
+func newServiceTestProvider(backend Provider, services ...*v1.Service) (*GenericProvider, cache.Indexer, *[]string) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, svc := range services {
+		indexer.Add(svc)
+	}
+	patches := &[]string{}
+	p := &GenericProvider{
+		cfg:    &Configuration{Backend: backend, ReportServiceStatus: true},
+		ext:    newExtensions(backend),
+		lister: StoreLister{Service: v1listers.NewServiceLister(indexer)},
+		patchService: func(namespace, name string, patch []byte) error {
+			*patches = append(*patches, name+" "+string(patch))
+			return nil
+		},
+	}
+	return p, indexer, patches
+}
+
+func newTestService(name, owner string) *v1.Service {
+	svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: "1"}}
+	svc.Spec.Type = v1.ServiceTypeLoadBalancer
+	if owner != "" {
+		svc.Annotations = map[string]string{AnnotationKeyLoadBalancer: owner}
+	}
+	return svc
+}
+
+func TestReportServiceStatus(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	lb.Annotations = map[string]string{AnnotationKeyServices: "web, foreign,other,cluster"}
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100"}
+
+	cluster := newTestService("cluster", "lb")
+	cluster.Spec.Type = v1.ServiceTypeClusterIP
+	// the vips without an AddressProvider
+	p, indexer, patches := newServiceTestProvider(struct{ Provider }{},
+		newTestService("web", "lb"),
+		newTestService("foreign", ""),
+		newTestService("other", "other-lb"),
+		cluster,
+	)
+
+	p.reportServiceStatus(lb)
+	assert.Equal(t, []string{
+		`web {"metadata":{"resourceVersion":"1"},"status":{"loadBalancer":{"ingress":[{"ip":"10.0.0.100"}]}}}`,
+	}, *patches)
+
+	// idempotent once the status is observed
+	web := newTestService("web", "lb")
+	web.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "10.0.0.100"}}
+	indexer.Update(web)
+	*patches = nil
+	p.reportServiceStatus(lb)
+	assert.Empty(t, *patches)
+
+	// pending until the addresses are provisioned
+	backend := &addressBackend{}
+	p.setBackend(backend)
+	p.reportServiceStatus(lb)
+	assert.Empty(t, *patches)
+	backend.addrs = []net.IP{net.ParseIP("203.0.113.10")}
+	p.reportServiceStatus(lb)
+	assert.Equal(t, []string{
+		`web {"metadata":{"resourceVersion":"1"},"status":{"loadBalancer":{"ingress":[{"ip":"203.0.113.10"}]}}}`,
+	}, *patches)
+
+	// cleared once no longer exposed
+	p.setBackend(struct{ Provider }{})
+	lb.Annotations[AnnotationKeyServices] = "foreign"
+	*patches = nil
+	p.reportServiceStatus(lb)
+	assert.Equal(t, []string{
+		`web {"metadata":{"resourceVersion":"1"},"status":{"loadBalancer":{"ingress":null}}}`,
+	}, *patches)
+
+	// cleared once the loadbalancer is deleted
+	lb.Annotations[AnnotationKeyServices] = "web"
+	*patches = nil
+	assert.Nil(t, p.clearServiceStatus(lb))
+	assert.Equal(t, []string{
+		`web {"metadata":{"resourceVersion":"1"},"status":{"loadBalancer":{"ingress":null}}}`,
+	}, *patches)
+}
+
+func TestSetServiceIngressConflict(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	svc := newTestService("web", "lb")
+	p, _, _ := newServiceTestProvider(nil, svc)
+	ingress := []v1.LoadBalancerIngress{{IP: "10.0.0.100"}}
+
+	latest := newTestService("web", "lb")
+	latest.ResourceVersion = "2"
+	p.getService = func(namespace, name string) (*v1.Service, error) {
+		return latest, nil
+	}
+	patches := []string{}
+	conflict := errors.NewConflict(schema.GroupResource{Resource: "services"}, "web", nil)
+	p.patchService = func(namespace, name string, patch []byte) error {
+		patches = append(patches, string(patch))
+		if len(patches) == 1 {
+			return conflict
+		}
+		return nil
+	}
+	assert.Nil(t, p.setServiceIngress(lb, svc, ingress))
+	assert.Len(t, patches, 2)
+	assert.Contains(t, patches[1], `"resourceVersion":"2"`)
+
+	// the latest service already has the ingress
+	patches = nil
+	latest.Status.LoadBalancer.Ingress = ingress
+	assert.Nil(t, p.setServiceIngress(lb, svc, ingress))
+	assert.Len(t, patches, 1)
+
+	// the ownership changed meanwhile
+	patches = nil
+	latest.Status.LoadBalancer.Ingress = nil
+	latest.Annotations[AnnotationKeyLoadBalancer] = "other-lb"
+	assert.Nil(t, p.setServiceIngress(lb, svc, ingress))
+	assert.Len(t, patches, 1)
+
+	// the retries are bounded
+	patches = nil
+	p.patchService = func(namespace, name string, patch []byte) error {
+		patches = append(patches, string(patch))
+		return conflict
+	}
+	latest.Annotations[AnnotationKeyLoadBalancer] = "lb"
+	assert.True(t, errors.IsConflict(p.setServiceIngress(lb, svc, ingress)))
+	assert.Len(t, patches, serviceStatusRetries+1)
+}
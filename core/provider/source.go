@@ -0,0 +1,51 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// LoadBalancerSource is the informer and the lister of the LoadBalancers
+// the GenericProvider watches, the LoadBalancer informers of the
+// loadbalancer-controller satisfy it
+type LoadBalancerSource interface {
+	Informer() cache.SharedIndexInformer
+	Lister() netlisters.LoadBalancerLister
+}
+
+// NodeSource is the informer and the lister of the Nodes the GenericProvider
+// watches, the Node informers of client-go satisfy it
+type NodeSource interface {
+	Informer() cache.SharedIndexInformer
+	Lister() v1listers.NodeLister
+}
+
+// StatusWriter writes the merge patches of the LoadBalancers, the status
+// reported by the GenericProvider among them
+type StatusWriter interface {
+	PatchLoadBalancer(namespace, name string, patch []byte) error
+}
+
+// InformerStarter starts the informers it made until the stop channel is
+// closed, the SharedInformerFactories satisfy it
+type InformerStarter interface {
+	Start(stopCh <-chan struct{})
+}
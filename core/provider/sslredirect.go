@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+)
+
+const (
+	// AnnotationKeySSLRedirect redirects the requests of the http ports of
+	// AnnotationKeyHTTPPorts to https on the same host with the same path
+	// and query, "true" redirects all of them and the comma separated
+	// ports, e.g. "80,8080", the ones listed
+	AnnotationKeySSLRedirect = "loadbalancer.caicloud.io/ssl-redirect"
+	// AnnotationKeySSLRedirectExemptACME proxies the requests of the
+	// HTTP-01 challenges of ACME under ACMEChallengePath instead of
+	// redirecting them if "true", so that the certificates of the https
+	// ports can be issued through the http ones
+	AnnotationKeySSLRedirectExemptACME = "loadbalancer.caicloud.io/ssl-redirect-exempt-acme-challenge"
+
+	// ACMEChallengePath is the path prefix of the HTTP-01 challenges
+	ACMEChallengePath = "/.well-known/acme-challenge/"
+)
+
+// SSLRedirect is how the http ports are redirected to https
+type SSLRedirect struct {
+	// Ports are the http ports redirected, sorted
+	Ports []int
+	// HTTPSPort is the https port the requests are redirected to, 443 if it
+	// is served and the first https port otherwise
+	HTTPSPort int
+	// ExemptACME proxies the requests of the ACME challenges instead of
+	// redirecting them
+	ExemptACME bool
+}
+
+// Redirects returns true if the requests of the port are redirected
+func (r *SSLRedirect) Redirects(port int) bool {
+	if r == nil {
+		return false
+	}
+	for _, p := range r.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSSLRedirect returns how the http ports of the LoadBalancer are
+// redirected to https, nil if they are not. It returns a PermanentError if
+// the annotations are invalid, a port listed is not a http port, or there
+// is no https port to redirect to.
+func GetSSLRedirect(lb *netv1alpha1.LoadBalancer) (*SSLRedirect, error) {
+	value, ok := lb.Annotations[AnnotationKeySSLRedirect]
+	if !ok {
+		return nil, nil
+	}
+	value = strings.TrimSpace(value)
+	all, err := strconv.ParseBool(value)
+	if err == nil && !all {
+		return nil, nil
+	}
+
+	ports, err := GetHTTPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	protocols := make(map[int]HTTPProtocol, len(ports))
+	r := &SSLRedirect{}
+	for _, p := range ports {
+		protocols[p.Port] = p.Protocol
+		if p.Protocol != HTTPProtocolHTTPS {
+			if all {
+				r.Ports = append(r.Ports, p.Port)
+			}
+			continue
+		}
+		if r.HTTPSPort == 0 || p.Port == 443 {
+			r.HTTPSPort = p.Port
+		}
+	}
+	if r.HTTPSPort == 0 {
+		return nil, NewPermanentError("InvalidSSLRedirect", fmt.Errorf("ssl redirect without a https port to redirect to, add a port of the protocol https to the annotation %s", AnnotationKeyHTTPPorts))
+	}
+
+	if !all {
+		for _, s := range strings.Split(value, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return nil, NewPermanentError("InvalidSSLRedirect", fmt.Errorf("invalid ssl redirect %q, expect true, false or the comma separated http ports", value))
+			}
+			switch protocols[port] {
+			case "":
+				return nil, NewPermanentError("InvalidSSLRedirect", fmt.Errorf("ssl redirect of port %d which is not a http port", port))
+			case HTTPProtocolHTTPS:
+				return nil, NewPermanentError("InvalidSSLRedirect", fmt.Errorf("ssl redirect of the https port %d", port))
+			}
+			if !r.Redirects(port) {
+				r.Ports = append(r.Ports, port)
+			}
+		}
+		sort.Ints(r.Ports)
+	}
+
+	if v, ok := lb.Annotations[AnnotationKeySSLRedirectExemptACME]; ok {
+		if r.ExemptACME, err = strconv.ParseBool(v); err != nil {
+			return nil, NewPermanentError("InvalidSSLRedirect", fmt.Errorf("invalid %s %q: %v", AnnotationKeySSLRedirectExemptACME, v, err))
+		}
+	}
+	return r, nil
+}
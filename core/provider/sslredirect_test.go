@@ -0,0 +1,89 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetSSLRedirect(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		AnnotationKeyHTTPPorts: `[
+			{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+			{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+			{"port":80,"service":"web","servicePort":80},
+			{"port":8080,"service":"web","servicePort":80}
+		]`,
+	}}}
+	r, err := GetSSLRedirect(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, r)
+
+	for _, c := range []struct {
+		value string
+		want  *SSLRedirect
+	}{
+		{"false", nil},
+		{"8080", &SSLRedirect{Ports: []int{8080}, HTTPSPort: 443}},
+		{"8080, 80", &SSLRedirect{Ports: []int{80, 8080}, HTTPSPort: 443}},
+		{"true", &SSLRedirect{Ports: []int{80, 8080}, HTTPSPort: 443}},
+	} {
+		lb.Annotations[AnnotationKeySSLRedirect] = c.value
+		r, err = GetSSLRedirect(lb)
+		assert.Nil(t, err, c.value)
+		assert.Equal(t, c.want, r, c.value)
+	}
+	assert.True(t, r.Redirects(80))
+	assert.False(t, r.Redirects(443))
+
+	lb.Annotations[AnnotationKeySSLRedirectExemptACME] = "true"
+	r, err = GetSSLRedirect(lb)
+	assert.Nil(t, err)
+	assert.True(t, r.ExemptACME)
+
+	// the first https port is redirected to without 443
+	lb.Annotations[AnnotationKeyHTTPPorts] = `[{"port":80,"service":"web","servicePort":80},{"port":9443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`
+	r, err = GetSSLRedirect(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, 8443, r.HTTPSPort)
+
+	for _, c := range []struct {
+		httpPorts string
+		value     string
+		exempt    string
+	}{
+		// no https port to redirect to
+		{`[{"port":80,"service":"web","servicePort":80}]`, "true", ""},
+		{`[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`, "yes", ""},
+		{`[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`, "8080", ""},
+		{`[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`, "443", ""},
+		{`[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`, "true", "yes"},
+	} {
+		lb.Annotations = map[string]string{AnnotationKeyHTTPPorts: c.httpPorts, AnnotationKeySSLRedirect: c.value}
+		if c.exempt != "" {
+			lb.Annotations[AnnotationKeySSLRedirectExemptACME] = c.exempt
+		}
+		_, err = GetSSLRedirect(lb)
+		assert.True(t, IsPermanentError(err), c.value)
+		assert.Equal(t, "InvalidSSLRedirect", err.(*PermanentError).Reason, c.value)
+	}
+}
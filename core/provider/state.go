@@ -0,0 +1,273 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	controllerutil "github.com/caicloud/loadbalancer-controller/pkg/util/controller"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// LifecycleStarting, LifecycleRunning, LifecycleFailed and
+	// LifecycleStopped are the lifecycle states of the provider: it is
+	// starting until the backend has started or failed to, and stopped once
+	// Stop is called
+	LifecycleStarting = "Starting"
+	LifecycleRunning  = "Running"
+	LifecycleFailed   = "Failed"
+	LifecycleStopped  = "Stopped"
+
+	// SyncResultSuccess, SyncResultError, SyncResultRetryAfter and
+	// SyncResultPermanentError are the results of the syncs, the errors are
+	// retried by the queue, after a delay or not at all respectively
+	SyncResultSuccess        = "Success"
+	SyncResultError          = "Error"
+	SyncResultRetryAfter     = "RetryAfter"
+	SyncResultPermanentError = "PermanentError"
+
+	// redacted replaces the values of the redacted annotations
+	redacted = "<redacted>"
+)
+
+// redactedAnnotation matches the keys of the annotations whose values are
+// redacted from the state. The LoadBalancer names the Secrets it uses
+// instead of holding them, the ones looking like credentials are redacted
+// anyway, and the last applied configuration which copies them.
+var redactedAnnotation = regexp.MustCompile(`(?i)(password|passwd|token|credential|private-key|last-applied-configuration)`)
+
+// ProviderState is the state of the provider served in json on /state, the
+// field names are stable for the tools scraping it
+type ProviderState struct {
+	Info      Info   `json:"info"`
+	Lifecycle string `json:"lifecycle"`
+	// Healthy is false with the error if the provider is unhealthy
+	Healthy     bool   `json:"healthy"`
+	HealthError string `json:"healthError,omitempty"`
+	// Role is the role of the node, if the backend reports any
+	Role Role `json:"role,omitempty"`
+	// QueueLength is the number of the LoadBalancers waiting to be synced,
+	// Syncing the number being synced
+	QueueLength   int                 `json:"queueLength"`
+	Syncing       int                 `json:"syncing"`
+	LoadBalancers []LoadBalancerState `json:"loadBalancers"`
+	// Backend is the section of the backend if it is a StateReporter
+	Backend json.RawMessage `json:"backend,omitempty"`
+}
+
+// LoadBalancerState is the state of a LoadBalancer of the provider
+type LoadBalancerState struct {
+	Key string `json:"key"`
+	// Object is the LoadBalancer last seen with the redacted annotations,
+	// nil if it is not found
+	Object *netv1alpha1.LoadBalancer `json:"object,omitempty"`
+	// VIPs are the VIPs claimed by the LoadBalancer with their interfaces
+	VIPs []VIP `json:"vips"`
+	// RealServers are the real servers of the families of the VIPs
+	RealServers []RealServerState `json:"realServers"`
+	// LastSync is nil until the LoadBalancer is synced
+	LastSync *SyncState `json:"lastSync,omitempty"`
+}
+
+// RealServerState is a real server of the LoadBalancer
+type RealServerState struct {
+	Node   string         `json:"node"`
+	IP     string         `json:"ip"`
+	Family corenet.Family `json:"family"`
+	Weight int            `json:"weight"`
+}
+
+// SyncState is the last sync of a LoadBalancer
+type SyncState struct {
+	Time time.Time `json:"time"`
+	// Duration is the duration of the sync in milliseconds
+	Duration int64 `json:"durationMillis"`
+	// Result is one of the SyncResults, empty while the sync is running
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	// input is the LoadBalancer passed to the call of the backend, noted
+	// for the recording only
+	input *netv1alpha1.LoadBalancer
+	call  string
+}
+
+// sync syncs the LoadBalancer and records the result for the state. A
+// panic of the sync is recovered here, it is logged, recorded and returned
+// as the error, so the worker goes on and the LoadBalancer is retried.
+func (p *GenericProvider) sync(obj interface{}) (err error) {
+	key := ""
+	if lb, ok := obj.(*netv1alpha1.LoadBalancer); ok {
+		key, _ = controllerutil.KeyFunc(lb)
+	}
+	start := time.Now()
+	p.syncLock.Lock()
+	p.syncs[key] = &SyncState{Time: start}
+	p.syncLock.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("sync panic", log.Fields{"panic": r, "stack": string(debug.Stack())})
+			err = fmt.Errorf("panic: %v", r)
+		}
+		p.syncLock.Lock()
+		s := p.syncs[key]
+		s.Duration = int64(time.Since(start) / time.Millisecond)
+		if err != nil {
+			s.Result, s.Error = SyncResultError, err.Error()
+		} else if s.Result == "" {
+			s.Result = SyncResultSuccess
+		}
+		last := *s
+		p.syncLock.Unlock()
+		if p.records != nil {
+			p.recordSync(obj, last)
+		}
+	}()
+	return p.syncLoadBalancer(obj)
+}
+
+// recordSyncError records the error swallowed by the sync of the
+// LoadBalancer
+func (p *GenericProvider) recordSyncError(lb *netv1alpha1.LoadBalancer, result string, err error) {
+	key, _ := controllerutil.KeyFunc(lb)
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+	if s, ok := p.syncs[key]; ok {
+		s.Result, s.Error = result, err.Error()
+	}
+}
+
+// lifecycle returns the lifecycle state of the provider
+func (p *GenericProvider) lifecycle() string {
+	p.stopLock.Lock()
+	shutdown := p.shutdown
+	p.stopLock.Unlock()
+	if shutdown {
+		return LifecycleStopped
+	}
+	switch atomic.LoadInt32(&p.started) {
+	case 1:
+		return LifecycleRunning
+	case -1:
+		return LifecycleFailed
+	}
+	return LifecycleStarting
+}
+
+// State returns the state of the provider, it is safe to call concurrently
+// with the syncs
+func (p *GenericProvider) State() *ProviderState {
+	state := &ProviderState{
+		Info:          p.Info(),
+		Lifecycle:     p.lifecycle(),
+		Healthy:       true,
+		Role:          p.Role(),
+		QueueLength:   p.queue.Len(),
+		Syncing:       int(atomic.LoadInt32(&p.syncing)),
+		LoadBalancers: []LoadBalancerState{p.loadBalancerState()},
+	}
+	if err := p.Healthz(); err != nil {
+		state.Healthy, state.HealthError = false, err.Error()
+	}
+	if p.ext.state != nil {
+		state.Backend = p.ext.state.State()
+	}
+	return state
+}
+
+// loadBalancerState returns the state of the LoadBalancer of the provider
+func (p *GenericProvider) loadBalancerState() LoadBalancerState {
+	key := p.cfg.LoadBalancerNamespace + "/" + p.cfg.LoadBalancerName
+	state := LoadBalancerState{
+		Key:         key,
+		VIPs:        make([]VIP, 0),
+		RealServers: make([]RealServerState, 0),
+	}
+	p.syncLock.Lock()
+	if s, ok := p.syncs[key]; ok {
+		last := *s
+		state.LastSync = &last
+	}
+	p.syncLock.Unlock()
+
+	lb, err := p.lbLister.LoadBalancers(p.cfg.LoadBalancerNamespace).Get(p.cfg.LoadBalancerName)
+	if err != nil {
+		return state
+	}
+	state.Object = redactLoadBalancer(lb)
+	vips, _ := GetVIPList(lb)
+	state.VIPs = append(state.VIPs, vips...)
+	state.RealServers = p.realServerStates(lb, vips)
+	return state
+}
+
+// realServerStates returns the real servers of the LoadBalancer of the
+// families of the VIPs, IPv4 if there are none
+func (p *GenericProvider) realServerStates(lb *netv1alpha1.LoadBalancer, vips []VIP) []RealServerState {
+	states := make([]RealServerState, 0)
+	families := make([]corenet.Family, 0, 2)
+	seen := make(map[corenet.Family]bool)
+	for _, vip := range vips {
+		if family := corenet.FamilyOf(vip.IP); !seen[family] {
+			seen[family] = true
+			families = append(families, family)
+		}
+	}
+	if len(families) == 0 {
+		families = append(families, corenet.FamilyIPv4)
+	}
+	for _, family := range families {
+		for _, rs := range p.lister.RealServers(lb.Spec.Nodes.Names, family) {
+			states = append(states, RealServerState{Node: rs.Node, IP: rs.IP.String(), Family: family, Weight: rs.Weight})
+		}
+	}
+	return states
+}
+
+// redactLoadBalancer returns a copy of the LoadBalancer with the redacted
+// annotations, the rest is shared with the informer and read only
+func redactLoadBalancer(lb *netv1alpha1.LoadBalancer) *netv1alpha1.LoadBalancer {
+	c := *lb
+	c.Annotations = make(map[string]string, len(lb.Annotations))
+	for key, value := range lb.Annotations {
+		if redactedAnnotation.MatchString(key) {
+			value = redacted
+		}
+		c.Annotations[key] = value
+	}
+	return &c
+}
+
+// StateHandler serves the state of the provider in json for debugging
+func (p *GenericProvider) StateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.State()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
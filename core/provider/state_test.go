@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedactLoadBalancer(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Name: "lb", Annotations: map[string]string{
+		AnnotationKeyVRRPAuthSecret:                        "vrrp",
+		"example.com/api-token":                            "s3cr3t",
+		"example.com/DB-Password":                          "s3cr3t",
+		"kubectl.kubernetes.io/last-applied-configuration": `{"metadata":{"annotations":{"example.com/api-token":"s3cr3t"}}}`,
+	}}}
+
+	c := redactLoadBalancer(lb)
+	assert.Equal(t, map[string]string{
+		AnnotationKeyVRRPAuthSecret:                        "vrrp",
+		"example.com/api-token":                            redacted,
+		"example.com/DB-Password":                          redacted,
+		"kubectl.kubernetes.io/last-applied-configuration": redacted,
+	}, c.Annotations)
+	assert.Equal(t, "lb", c.Name)
+	// the LoadBalancer of the informer is left alone
+	assert.Equal(t, "s3cr3t", lb.Annotations["example.com/api-token"])
+}
+
+func TestLifecycle(t *testing.T) {
+	p := &GenericProvider{stopLock: &sync.Mutex{}}
+	assert.Equal(t, LifecycleStarting, p.lifecycle())
+	p.started = -1
+	assert.Equal(t, LifecycleFailed, p.lifecycle())
+	p.started = 1
+	assert.Equal(t, LifecycleRunning, p.lifecycle())
+	p.shutdown = true
+	assert.Equal(t, LifecycleStopped, p.lifecycle())
+}
+
+func TestRecordSyncError(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	p := &GenericProvider{syncs: map[string]*SyncState{"default/lb": {}}}
+
+	p.recordSyncError(lb, SyncResultRetryAfter, fmt.Errorf("quota exceeded"))
+	assert.Equal(t, &SyncState{Result: SyncResultRetryAfter, Error: "quota exceeded"}, p.syncs["default/lb"])
+
+	// the errors out of a sync are not recorded
+	lb.Name = "other"
+	p.recordSyncError(lb, SyncResultRetryAfter, fmt.Errorf("quota exceeded"))
+	assert.Len(t, p.syncs, 1)
+}
+
+func TestSyncPanic(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	// the sync panics without the listers
+	p := &GenericProvider{syncs: map[string]*SyncState{}}
+
+	err := p.sync(lb)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "panic: ")
+	}
+	if s := p.syncs["default/lb"]; assert.NotNil(t, s) {
+		assert.Equal(t, SyncResultError, s.Result)
+		assert.Equal(t, err.Error(), s.Error)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"reflect"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+)
+
+// reportStatus merges the status fragment of the backend into the status
+// of the LoadBalancer if it is a StatusProvider, unless the status already
+// contains it or it is the one last merged
+func (p *GenericProvider) reportStatus(lb *netv1alpha1.LoadBalancer) {
+	sp := p.ext.status
+	if sp == nil {
+		return
+	}
+	fragment := sp.Status()
+	if len(fragment) == 0 || string(fragment) == p.reportedStatus {
+		return
+	}
+	contained, err := statusContains(lb.Status, fragment)
+	if err != nil {
+		log.Error("invalid status fragment", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "status": string(fragment), "err": err})
+		return
+	}
+	if contained {
+		return
+	}
+	patch, _ := json.Marshal(map[string]json.RawMessage{"status": fragment})
+	if err := p.patchLoadBalancer(lb.Namespace, lb.Name, patch); err != nil {
+		log.Error("update status error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+		return
+	}
+	p.reportedStatus = string(fragment)
+}
+
+// statusContains returns true if merging the fragment into the status
+// changes nothing
+func statusContains(status netv1alpha1.LoadBalancerStatus, fragment json.RawMessage) (bool, error) {
+	var patch interface{}
+	if err := json.Unmarshal(fragment, &patch); err != nil {
+		return false, err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return false, err
+	}
+	var cur interface{}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return false, err
+	}
+	return mergeContains(cur, patch), nil
+}
+
+// mergeContains returns true if merging the patch into the object as a json
+// merge patch changes nothing, the null values delete the fields
+func mergeContains(obj, patch interface{}) bool {
+	patchMap, ok := patch.(map[string]interface{})
+	if !ok {
+		return reflect.DeepEqual(obj, patch)
+	}
+	objMap, ok := obj.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for key, value := range patchMap {
+		cur, ok := objMap[key]
+		if value == nil {
+			if ok && cur != nil {
+				return false
+			}
+			continue
+		}
+		if !ok || !mergeContains(cur, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusContains(t *testing.T) {
+	vrid := 10
+	status := netv1alpha1.LoadBalancerStatus{
+		ProvidersStatuses: netv1alpha1.ProvidersStatuses{
+			Ipvsdr: &netv1alpha1.IpvsdrProviderStatus{Vip: "10.0.0.100", Vrid: &vrid},
+		},
+	}
+	for _, c := range []struct {
+		fragment string
+		want     bool
+	}{
+		{`{}`, true},
+		{`{"providersStatuses":{"ipvsdr":{"vip":"10.0.0.100"}}}`, true},
+		{`{"providersStatuses":{"ipvsdr":{"vip":"10.0.0.101"}}}`, false},
+		{`{"providersStatuses":{"ipvsdr":{"vrid":10}}}`, true},
+		{`{"providersStatuses":{"azure":null}}`, true},
+		{`{"providersStatuses":{"ipvsdr":null}}`, false},
+		{`{"providersStatuses":{"webhook":{"state":"ready"}}}`, false},
+		{`{"proxyStatus":{"replicas":1}}`, false},
+	} {
+		contained, err := statusContains(status, []byte(c.fragment))
+		assert.Nil(t, err, c.fragment)
+		assert.Equal(t, c.want, contained, c.fragment)
+	}
+
+	_, err := statusContains(status, []byte(`{"invalid"`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+)
+
+// AnnotationKeyTCPPorts is the ports proxying TCP in json, e.g.
+// [{"port":3306,"service":"mysql","servicePort":3306},{"port":6443,"nodePort":6443}],
+// they are proxied to the Endpoints of the Service in the namespace of the
+// LoadBalancer, or to the nodes of the LoadBalancer if the Service is empty
+const AnnotationKeyTCPPorts = "loadbalancer.caicloud.io/tcp-ports"
+
+// TCPPort is a port proxying TCP to a port of a Service or of the nodes
+type TCPPort struct {
+	Port        int    `json:"port"`
+	Service     string `json:"service,omitempty"`
+	ServicePort int    `json:"servicePort,omitempty"`
+	// NodePort is the port of the nodes without a Service, it defaults to
+	// the port
+	NodePort int `json:"nodePort,omitempty"`
+}
+
+// GetTCPPorts returns the TCP ports of the LoadBalancer sorted by port, nil
+// if not specified. It returns a PermanentError if they are invalid or
+// conflict with the HTTP ports.
+func GetTCPPorts(lb *netv1alpha1.LoadBalancer) ([]TCPPort, error) {
+	value, ok := lb.Annotations[AnnotationKeyTCPPorts]
+	if !ok {
+		return nil, nil
+	}
+
+	ports := make([]TCPPort, 0)
+	if err := json.Unmarshal([]byte(value), &ports); err != nil {
+		return nil, NewPermanentError("InvalidTCPPorts", fmt.Errorf("invalid tcp ports %q: %v", value, err))
+	}
+	httpPorts, err := GetHTTPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool, len(ports)+len(httpPorts))
+	for _, p := range httpPorts {
+		seen[p.Port] = true
+	}
+	for i := range ports {
+		p := &ports[i]
+		if p.Service == "" && p.NodePort == 0 {
+			p.NodePort = p.Port
+		}
+		switch {
+		case p.Port <= 0 || p.Port > 65535:
+			return nil, NewPermanentError("InvalidTCPPorts", fmt.Errorf("invalid port %d", p.Port))
+		case seen[p.Port]:
+			return nil, NewPermanentError("InvalidTCPPorts", fmt.Errorf("duplicate port %d", p.Port))
+		case p.Service != "" && (p.ServicePort <= 0 || p.ServicePort > 65535 || p.NodePort != 0):
+			return nil, NewPermanentError("InvalidTCPPorts", fmt.Errorf("invalid service %q port %d of port %d", p.Service, p.ServicePort, p.Port))
+		case p.Service == "" && (p.ServicePort != 0 || p.NodePort < 0 || p.NodePort > 65535):
+			return nil, NewPermanentError("InvalidTCPPorts", fmt.Errorf("invalid node port %d of port %d", p.NodePort, p.Port))
+		}
+		seen[p.Port] = true
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports, nil
+}
@@ -0,0 +1,505 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// kinds are the kinds of the resources served by the APIServer by their
+// plural names
+var kinds = map[string]string{
+	"nodes":                        "Node",
+	"secrets":                      "Secret",
+	"services":                     "Service",
+	"endpoints":                    "Endpoints",
+	"configmaps":                   "ConfigMap",
+	"events":                       "Event",
+	netv1alpha1.LoadBalancerPlural: "LoadBalancer",
+}
+
+// object is an object of the APIServer as decoded from json
+type object map[string]interface{}
+
+// metadata returns the metadata of the object, it is added if missing
+func (o object) metadata() map[string]interface{} {
+	m, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+		o["metadata"] = m
+	}
+	return m
+}
+
+func (o object) field(name string) string {
+	s, _ := o.metadata()[name].(string)
+	return s
+}
+
+func (o object) clone() object {
+	data, _ := json.Marshal(o)
+	var c object
+	json.Unmarshal(data, &c)
+	return c
+}
+
+// request is the resource an API request is on
+type request struct {
+	// groupVersion is the group and the version of the resource as in
+	// the path, e.g. api/v1
+	groupVersion string
+	resource     string
+	namespace    string
+	name         string
+	subresource  string
+}
+
+func parseRequest(path string) (*request, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	req := &request{}
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		req.groupVersion, parts = strings.Join(parts[:2], "/"), parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		req.groupVersion, parts = strings.Join(parts[:3], "/"), parts[3:]
+	default:
+		return nil, false
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		req.namespace, parts = parts[1], parts[2:]
+	}
+	switch len(parts) {
+	case 3:
+		req.subresource = parts[2]
+		fallthrough
+	case 2:
+		req.name = parts[1]
+		fallthrough
+	case 1:
+		req.resource = parts[0]
+	default:
+		return nil, false
+	}
+	if _, ok := kinds[req.resource]; !ok {
+		return nil, false
+	}
+	return req, true
+}
+
+// key returns the key of the resource of the request in the objects
+func (r *request) key() string {
+	return r.groupVersion + "/" + r.resource
+}
+
+func (r *request) groupResource() schema.GroupResource {
+	group := ""
+	if parts := strings.Split(r.groupVersion, "/"); len(parts) == 3 {
+		group = parts[1]
+	}
+	return schema.GroupResource{Group: group, Resource: r.resource}
+}
+
+// apiVersion returns the apiVersion of the objects of the request
+func (r *request) apiVersion() string {
+	return strings.SplitN(r.groupVersion, "/", 2)[1]
+}
+
+// watchEvent is a change of an object of the APIServer
+type watchEvent struct {
+	version   int64
+	key       string
+	namespace string
+	Type      watch.EventType `json:"type"`
+	Object    object          `json:"object"`
+}
+
+// APIServer is a fake API server serving the resources the GenericProvider
+// watches and writes from memory, the real clientsets talk to it over http.
+// It supports get, list, watch, create, update, merge patch and delete,
+// with optimistic concurrency on the resourceVersion, but neither the
+// selectors nor the validation.
+type APIServer struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	version int64
+	uid     int64
+	// objects are the objects by the key of the resource and the
+	// namespace/name of the object
+	objects map[string]map[string]object
+	events  []watchEvent
+	// changed is closed and renewed on every change
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+// NewAPIServer starts an APIServer, it has to be closed
+func NewAPIServer() *APIServer {
+	s := &APIServer{
+		objects: map[string]map[string]object{},
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Config returns the config of the clients of the APIServer, the requests
+// are not throttled
+func (s *APIServer) Config() *rest.Config {
+	return &rest.Config{
+		Host:        s.server.URL,
+		RateLimiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+	}
+}
+
+// Close ends the watches and shuts the APIServer down
+func (s *APIServer) Close() {
+	close(s.closed)
+	s.server.Close()
+}
+
+func (s *APIServer) serve(w http.ResponseWriter, r *http.Request) {
+	req, ok := parseRequest(r.URL.Path)
+	if !ok {
+		writeError(w, errors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && req.name == "" && r.URL.Query().Get("watch") == "true":
+		s.watch(w, r, req)
+	case r.Method == http.MethodGet && req.name == "":
+		s.list(w, req)
+	case r.Method == http.MethodGet:
+		s.get(w, req)
+	case r.Method == http.MethodPost && req.name == "":
+		s.create(w, r, req)
+	case r.Method == http.MethodPut && req.name != "":
+		s.update(w, r, req)
+	case r.Method == http.MethodPatch && req.name != "":
+		s.patch(w, r, req)
+	case r.Method == http.MethodDelete && req.name != "":
+		s.delete(w, req)
+	default:
+		writeError(w, errors.NewMethodNotSupported(req.groupResource(), r.Method))
+	}
+}
+
+func (s *APIServer) get(w http.ResponseWriter, req *request) {
+	s.mu.Lock()
+	obj, ok := s.objects[req.key()][req.namespace+"/"+req.name]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, errors.NewNotFound(req.groupResource(), req.name))
+		return
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *APIServer) list(w http.ResponseWriter, req *request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"kind":       kinds[req.resource] + "List",
+		"apiVersion": req.apiVersion(),
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.FormatInt(s.version, 10)},
+		"items":      s.listLocked(req),
+	})
+}
+
+// listLocked returns the objects of the resource in the namespace of the
+// request, all of them if it is empty, in the order of their keys
+func (s *APIServer) listLocked(req *request) []object {
+	objects := s.objects[req.key()]
+	keys := make([]string, 0, len(objects))
+	for key, obj := range objects {
+		if req.namespace == "" || obj.field("namespace") == req.namespace {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	items := make([]object, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, objects[key])
+	}
+	return items
+}
+
+// watch streams the changes after the resourceVersion, or all the objects
+// as added first if it is empty, until the client, the timeout or the
+// APIServer ends it
+func (s *APIServer) watch(w http.ResponseWriter, r *http.Request, req *request) {
+	query := r.URL.Query()
+	since, _ := strconv.ParseInt(query.Get("resourceVersion"), 10, 64)
+	var timeout <-chan time.Time
+	if seconds, err := strconv.Atoi(query.Get("timeoutSeconds")); err == nil && seconds > 0 {
+		timeout = time.After(time.Duration(seconds) * time.Second)
+	}
+
+	var pending []watchEvent
+	s.mu.Lock()
+	if since == 0 {
+		for _, obj := range s.listLocked(req) {
+			pending = append(pending, watchEvent{Type: watch.Added, Object: obj})
+		}
+		since = s.version
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		s.mu.Lock()
+		for _, e := range s.events {
+			if e.version > since && e.key == req.key() && (req.namespace == "" || e.namespace == req.namespace) {
+				pending = append(pending, e)
+			}
+		}
+		since = s.version
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, e := range pending {
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+		}
+		pending = nil
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *APIServer) create(w http.ResponseWriter, r *http.Request, req *request) {
+	var obj object
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeError(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	meta := obj.metadata()
+	if req.namespace != "" {
+		meta["namespace"] = req.namespace
+	}
+	if obj.field("name") == "" && obj.field("generateName") != "" {
+		meta["name"] = fmt.Sprintf("%s%d", obj.field("generateName"), s.uid+1)
+	}
+	name := obj.field("name")
+	if name == "" {
+		writeError(w, errors.NewBadRequest("name is required"))
+		return
+	}
+	if _, ok := s.objects[req.key()][req.namespace+"/"+name]; ok {
+		writeError(w, errors.NewAlreadyExists(req.groupResource(), name))
+		return
+	}
+	s.uid++
+	meta["uid"] = fmt.Sprintf("%d", s.uid)
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	s.storeLocked(req, name, obj, watch.Added)
+	writeJSON(w, http.StatusCreated, obj)
+}
+
+func (s *APIServer) update(w http.ResponseWriter, r *http.Request, req *request) {
+	var obj object
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		writeError(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.objects[req.key()][req.namespace+"/"+req.name]
+	if !ok {
+		writeError(w, errors.NewNotFound(req.groupResource(), req.name))
+		return
+	}
+	if version := obj.field("resourceVersion"); version != "" && version != stored.field("resourceVersion") {
+		writeError(w, errors.NewConflict(req.groupResource(), req.name, fmt.Errorf("the object has been modified")))
+		return
+	}
+	obj = s.updatedLocked(req, stored, obj)
+	s.storeLocked(req, req.name, obj, watch.Modified)
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *APIServer) patch(w http.ResponseWriter, r *http.Request, req *request) {
+	switch types.PatchType(r.Header.Get("Content-Type")) {
+	case types.MergePatchType, types.StrategicMergePatchType:
+	default:
+		writeError(w, &errors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusUnsupportedMediaType,
+			Message: fmt.Sprintf("unsupported patch type %q", r.Header.Get("Content-Type")),
+		}})
+		return
+	}
+	var patch interface{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, errors.NewBadRequest(err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.objects[req.key()][req.namespace+"/"+req.name]
+	if !ok {
+		writeError(w, errors.NewNotFound(req.groupResource(), req.name))
+		return
+	}
+	// the strategic merge patches are merged as json merge patches
+	merged, ok := mergePatch(map[string]interface{}(stored.clone()), patch).(map[string]interface{})
+	if !ok {
+		writeError(w, errors.NewBadRequest("the patch is not an object"))
+		return
+	}
+	obj := object(merged)
+	if obj.field("resourceVersion") != stored.field("resourceVersion") {
+		writeError(w, errors.NewConflict(req.groupResource(), req.name, fmt.Errorf("the object has been modified")))
+		return
+	}
+	updated := s.updatedLocked(req, stored, obj)
+	s.storeLocked(req, req.name, updated, watch.Modified)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// updatedLocked returns the stored object updated to the one of the
+// request, only the status is updated for the status subresource
+func (s *APIServer) updatedLocked(req *request, stored, obj object) object {
+	if req.subresource == "status" {
+		status := obj["status"]
+		obj = stored.clone()
+		obj["status"] = status
+	}
+	meta := obj.metadata()
+	for _, field := range []string{"uid", "creationTimestamp", "namespace", "name"} {
+		if value, ok := stored.metadata()[field]; ok {
+			meta[field] = value
+		}
+	}
+	return obj
+}
+
+func (s *APIServer) delete(w http.ResponseWriter, req *request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[req.key()][req.namespace+"/"+req.name]
+	if !ok {
+		writeError(w, errors.NewNotFound(req.groupResource(), req.name))
+		return
+	}
+	s.storeLocked(req, req.name, obj.clone(), watch.Deleted)
+	writeJSON(w, http.StatusOK, metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+	})
+}
+
+// storeLocked stores the object of the request with a new resourceVersion,
+// or removes it if it is deleted, and notifies the watches
+func (s *APIServer) storeLocked(req *request, name string, obj object, eventType watch.EventType) {
+	s.version++
+	obj["kind"] = kinds[req.resource]
+	obj["apiVersion"] = req.apiVersion()
+	obj.metadata()["resourceVersion"] = strconv.FormatInt(s.version, 10)
+
+	objects, ok := s.objects[req.key()]
+	if !ok {
+		objects = map[string]object{}
+		s.objects[req.key()] = objects
+	}
+	if eventType == watch.Deleted {
+		delete(objects, req.namespace+"/"+name)
+	} else {
+		objects[req.namespace+"/"+name] = obj
+	}
+	s.events = append(s.events, watchEvent{
+		version:   s.version,
+		key:       req.key(),
+		namespace: req.namespace,
+		Type:      eventType,
+		Object:    obj,
+	})
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// mergePatch applies the json merge patch to the target as of RFC 7386
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err *errors.StatusError) {
+	status := err.ErrStatus
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(status.Code), status)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing_test
+
+import (
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/caicloud/loadbalancer-provider/core/provider/tpr"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// loadBalancerSource is the LoadBalancerSource of an informer run by the
+// program embedding the provider
+type loadBalancerSource struct {
+	informer cache.SharedIndexInformer
+}
+
+func (s loadBalancerSource) Informer() cache.SharedIndexInformer {
+	return s.informer
+}
+
+func (s loadBalancerSource) Lister() netlisters.LoadBalancerLister {
+	return netlisters.NewLoadBalancerLister(s.informer.GetIndexer())
+}
+
+// recordingWriter records the patches written through the StatusWriter
+type recordingWriter struct {
+	core.StatusWriter
+	mu      sync.Mutex
+	patches []string
+}
+
+func (w *recordingWriter) PatchLoadBalancer(namespace, name string, patch []byte) error {
+	w.mu.Lock()
+	w.patches = append(w.patches, string(patch))
+	w.mu.Unlock()
+	return w.StatusWriter.PatchLoadBalancer(namespace, name, patch)
+}
+
+func (w *recordingWriter) Patches() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.patches...)
+}
+
+// TestEmbeddedInformers embeds the provider in a program running its own
+// informers, the provider starts none of the LoadBalancers and the Nodes
+func TestEmbeddedInformers(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.SetStatus([]byte(`{"providersStatuses":{"fake":{"ready":true}}}`))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	writer := &recordingWriter{}
+	var nodes informers.SharedInformerFactory
+	var env *providertesting.TestEnv
+	var embedded *core.Configuration
+
+	// the client of the LoadBalancers is the one of the env, the provider
+	// waits for their informer to be started once it is created
+	lbs := cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return env.TPRClient.NetworkingV1alpha1().LoadBalancers(metav1.NamespaceAll).List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return env.TPRClient.NetworkingV1alpha1().LoadBalancers(metav1.NamespaceAll).Watch(options)
+			},
+		},
+		&netv1alpha1.LoadBalancer{},
+		0,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+	env = providertesting.NewTestEnv(t, backend, func(cfg *core.Configuration) {
+		// the informers of a factory are started once they are requested
+		nodes = informers.NewSharedInformerFactory(cfg.KubeClient, 0)
+		cfg.Nodes = nodes.Core().V1().Nodes()
+		cfg.Nodes.Informer()
+		nodes.Start(stopCh)
+
+		cfg.LoadBalancers = loadBalancerSource{informer: lbs}
+		cfg.StatusWriter = writer
+		embedded = cfg
+	})
+	defer env.Stop()
+	writer.StatusWriter = tpr.NewStatusWriter(env.TPRClient)
+	go lbs.Run(stopCh)
+
+	env.AddNode("node1", "192.168.0.1")
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1"))
+	assert.Equal(t, lb.UID, lastUpdate(t, backend).UID)
+	assert.Contains(t, writer.Patches(), `{"status":{"providersStatuses":{"fake":{"ready":true}}}}`)
+	// the Configuration of the program is not modified
+	assert.Nil(t, embedded.Informers)
+	assert.True(t, embedded.StatusWriter == writer)
+
+	// the Nodes are the ones of the informer of the program
+	node, err := nodes.Core().V1().Nodes().Lister().Get("node1")
+	if assert.Nil(t, err) {
+		cached, err := env.Provider.Lister().Node.Get("node1")
+		assert.Nil(t, err)
+		assert.True(t, node == cached)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testing runs the GenericProvider of a backend against a fake API
+// server end to end, for testing the backends through the informers, the
+// workqueue and the status reports of the real provider.
+package testing
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-controller/pkg/tprclient"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	"github.com/caicloud/loadbalancer-provider/core/provider/tpr"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// Namespace and Name are of the LoadBalancer the GenericProvider of
+	// the TestEnv provides
+	Namespace = "default"
+	Name      = "lb"
+
+	// DefaultTimeout is the default time the TestEnv waits for the
+	// provider
+	DefaultTimeout = 10 * time.Second
+
+	// pollInterval is the interval the provider is polled at while
+	// waiting, idlePolls the number of the consecutive polls it has to
+	// be idle at to be considered idle
+	pollInterval = 10 * time.Millisecond
+	idlePolls    = 5
+)
+
+// TB is the part of testing.TB the TestEnv fails the test through
+type TB interface {
+	Fatalf(format string, args ...interface{})
+}
+
+// Option configures the GenericProvider of a TestEnv
+type Option func(*core.Configuration)
+
+// TestEnv runs a GenericProvider of a backend against an APIServer. The
+// changes made through it return once the provider has observed and
+// synced them, instead of sleeping.
+type TestEnv struct {
+	Provider   *core.GenericProvider
+	Server     *APIServer
+	KubeClient kubernetes.Interface
+	TPRClient  tprclient.Interface
+	// Timeout bounds the waits for the provider, the test fails once it
+	// expires
+	Timeout time.Duration
+
+	t        TB
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTestEnv starts a GenericProvider of the backend providing the
+// LoadBalancer Namespace/Name, the MTU check is skipped. It has to be
+// stopped.
+func NewTestEnv(t TB, backend core.Provider, options ...Option) *TestEnv {
+	server := NewAPIServer()
+	kubeClient, err := kubernetes.NewForConfig(server.Config())
+	if err != nil {
+		server.Close()
+		t.Fatalf("create kubernetes client error: %v", err)
+	}
+	tprClient, err := tprclient.NewForConfig(server.Config())
+	if err != nil {
+		server.Close()
+		t.Fatalf("create tpr client error: %v", err)
+	}
+
+	cfg := &core.Configuration{
+		KubeClient:            kubeClient,
+		Backend:               backend,
+		LoadBalancerNamespace: Namespace,
+		LoadBalancerName:      Name,
+		SkipMTUCheck:          true,
+	}
+	for _, option := range options {
+		option(cfg)
+	}
+
+	provider, err := tpr.NewLoadBalancerProvider(cfg, tprClient)
+	if err != nil {
+		server.Close()
+		t.Fatalf("create provider error: %v", err)
+	}
+
+	env := &TestEnv{
+		Provider:   provider,
+		Server:     server,
+		KubeClient: kubeClient,
+		TPRClient:  tprClient,
+		Timeout:    DefaultTimeout,
+		t:          t,
+		done:       make(chan struct{}),
+	}
+	go func() {
+		defer close(env.done)
+		env.Provider.Start()
+	}()
+	return env
+}
+
+// Stop stops the provider and the APIServer, it is a no-op once they are
+// stopped
+func (e *TestEnv) Stop() {
+	e.stopOnce.Do(func() {
+		e.Provider.Stop()
+		select {
+		case <-e.done:
+		case <-time.After(e.Timeout):
+			e.t.Fatalf("provider not stopped in %v", e.Timeout)
+		}
+		e.Server.Close()
+	})
+}
+
+// NewLoadBalancer returns an external ipvsdr LoadBalancer Namespace/Name of
+// the vip on the nodes
+func NewLoadBalancer(vip string, nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: Namespace, Name: Name}}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Nodes.Names = nodes
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: vip, Scheduler: netv1alpha1.IpvsSchedulerRR}
+	return lb
+}
+
+// CreateLB creates the LoadBalancer and waits for the provider to sync it
+func (e *TestEnv) CreateLB(lb *netv1alpha1.LoadBalancer) *netv1alpha1.LoadBalancer {
+	created, err := e.TPRClient.NetworkingV1alpha1().LoadBalancers(lb.Namespace).Create(lb)
+	if err != nil {
+		e.t.Fatalf("create LoadBalancer %s/%s error: %v", lb.Namespace, lb.Name, err)
+	}
+	e.waitForLB(created.Namespace, created.Name, created.ResourceVersion)
+	return created
+}
+
+// UpdateLB applies the update to the latest version of the LoadBalancer,
+// the ones written by the provider meanwhile included, and waits for the
+// provider to sync it
+func (e *TestEnv) UpdateLB(lb *netv1alpha1.LoadBalancer, update func(*netv1alpha1.LoadBalancer)) *netv1alpha1.LoadBalancer {
+	client := e.TPRClient.NetworkingV1alpha1().LoadBalancers(lb.Namespace)
+	latest, err := client.Get(lb.Name, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatalf("get LoadBalancer %s/%s error: %v", lb.Namespace, lb.Name, err)
+	}
+	update(latest)
+	updated, err := client.Update(latest)
+	if err != nil {
+		e.t.Fatalf("update LoadBalancer %s/%s error: %v", lb.Namespace, lb.Name, err)
+	}
+	e.waitForLB(updated.Namespace, updated.Name, updated.ResourceVersion)
+	return updated
+}
+
+// DeleteLB deletes the LoadBalancer and waits for the provider to sync the
+// deletion
+func (e *TestEnv) DeleteLB(lb *netv1alpha1.LoadBalancer) {
+	if err := e.TPRClient.NetworkingV1alpha1().LoadBalancers(lb.Namespace).Delete(lb.Name, &metav1.DeleteOptions{}); err != nil {
+		e.t.Fatalf("delete LoadBalancer %s/%s error: %v", lb.Namespace, lb.Name, err)
+	}
+	e.waitFor("LoadBalancer "+lb.Namespace+"/"+lb.Name+" deleted", func() bool {
+		_, err := e.Provider.Lister().LoadBalancer.LoadBalancers(lb.Namespace).Get(lb.Name)
+		return errors.IsNotFound(err)
+	})
+	e.WaitForIdle()
+}
+
+// GetLB returns the LoadBalancer as stored, e.g. with the status reported
+// by the provider
+func (e *TestEnv) GetLB(lb *netv1alpha1.LoadBalancer) *netv1alpha1.LoadBalancer {
+	latest, err := e.TPRClient.NetworkingV1alpha1().LoadBalancers(lb.Namespace).Get(lb.Name, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatalf("get LoadBalancer %s/%s error: %v", lb.Namespace, lb.Name, err)
+	}
+	return latest
+}
+
+// AddNode creates a ready Node of the internal ip and waits for the
+// provider to sync it
+func (e *TestEnv) AddNode(name, ip string) *v1.Node {
+	created, err := e.KubeClient.CoreV1().Nodes().Create(fake.NewNode(name, ip))
+	if err != nil {
+		e.t.Fatalf("create Node %s error: %v", name, err)
+	}
+	e.waitForNode(created)
+	return created
+}
+
+// SetNodeReady sets the Ready condition of the Node and waits for the
+// provider to sync it
+func (e *TestEnv) SetNodeReady(name string, ready bool) *v1.Node {
+	client := e.KubeClient.CoreV1().Nodes()
+	node, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatalf("get Node %s error: %v", name, err)
+	}
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	found := false
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == v1.NodeReady {
+			node.Status.Conditions[i].Status = status
+			found = true
+		}
+	}
+	if !found {
+		node.Status.Conditions = append(node.Status.Conditions, v1.NodeCondition{Type: v1.NodeReady, Status: status})
+	}
+	updated, err := client.UpdateStatus(node)
+	if err != nil {
+		e.t.Fatalf("update status of Node %s error: %v", name, err)
+	}
+	e.waitForNode(updated)
+	return updated
+}
+
+// WaitForIdle waits for the queue of the provider to drain and the syncs
+// to finish. The delayed resyncs and the retries backing off longer than
+// the idle polls are not waited for.
+func (e *TestEnv) WaitForIdle() {
+	polls := 0
+	e.waitFor("provider idle", func() bool {
+		if !e.Provider.Idle() {
+			polls = 0
+			return false
+		}
+		polls++
+		return polls >= idlePolls
+	})
+}
+
+// waitForLB waits for the provider to observe the version of the
+// LoadBalancer and to sync it
+func (e *TestEnv) waitForLB(namespace, name, resourceVersion string) {
+	e.waitFor("LoadBalancer "+namespace+"/"+name+" version "+resourceVersion, func() bool {
+		lb, err := e.Provider.Lister().LoadBalancer.LoadBalancers(namespace).Get(name)
+		return err == nil && newerOrSame(lb.ResourceVersion, resourceVersion)
+	})
+	e.WaitForIdle()
+}
+
+// waitForNode waits for the provider to observe the version of the Node
+// and to sync it
+func (e *TestEnv) waitForNode(node *v1.Node) {
+	e.waitFor("Node "+node.Name+" version "+node.ResourceVersion, func() bool {
+		cached, err := e.Provider.Lister().Node.Get(node.Name)
+		return err == nil && newerOrSame(cached.ResourceVersion, node.ResourceVersion)
+	})
+	e.WaitForIdle()
+}
+
+// waitFor polls the condition until it holds, the test fails if it does
+// not hold in the timeout
+func (e *TestEnv) waitFor(what string, condition func() bool) {
+	deadline := time.Now().Add(e.Timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			e.t.Fatalf("wait for %s timeout after %v", what, e.Timeout)
+			return
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// newerOrSame returns true if the resourceVersion of the APIServer is the
+// same as or newer than the expected one
+func newerOrSame(resourceVersion, expected string) bool {
+	v, err := strconv.ParseInt(resourceVersion, 10, 64)
+	if err != nil {
+		return false
+	}
+	ev, err := strconv.ParseInt(expected, 10, 64)
+	return err == nil && v >= ev
+}
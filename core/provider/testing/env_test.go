@@ -0,0 +1,135 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// lastUpdate returns the LoadBalancer of the last OnUpdate of the backend
+func lastUpdate(t *testing.T, backend *fake.FakeProvider) *netv1alpha1.LoadBalancer {
+	updates := backend.Updates()
+	if len(updates) == 0 {
+		t.Fatalf("no OnUpdate")
+	}
+	return updates[len(updates)-1]
+}
+
+func TestLoadBalancerLifecycle(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1"))
+	update := lastUpdate(t, backend)
+	assert.Equal(t, lb.UID, update.UID)
+	assert.Equal(t, "10.0.0.100", update.Spec.Providers.Ipvsdr.Vip)
+	assert.Equal(t, netv1alpha1.IpvsSchedulerRR, update.Spec.Providers.Ipvsdr.Scheduler)
+
+	env.UpdateLB(lb, func(lb *netv1alpha1.LoadBalancer) {
+		lb.Spec.Providers.Ipvsdr.Scheduler = netv1alpha1.IpvsSchedulerWRR
+	})
+	assert.Equal(t, netv1alpha1.IpvsSchedulerWRR, lastUpdate(t, backend).Spec.Providers.Ipvsdr.Scheduler)
+
+	// the weight of a node of the LoadBalancer going not ready changes
+	updates := backend.CallCount(fake.MethodOnUpdate)
+	env.SetNodeReady("node1", false)
+	assert.True(t, backend.CallCount(fake.MethodOnUpdate) > updates)
+	node, err := backend.Lister().Node.Get("node1")
+	assert.Nil(t, err)
+	assert.Equal(t, v1.ConditionFalse, node.Status.Conditions[0].Status)
+
+	env.DeleteLB(lb)
+	deletes := backend.Calls(fake.MethodOnDelete)
+	if assert.Len(t, deletes, 1) {
+		assert.Equal(t, lb.UID, deletes[0].Object.(*netv1alpha1.LoadBalancer).UID)
+	}
+
+	env.Stop()
+	assert.Equal(t, 1, backend.CallCount(fake.MethodStop))
+}
+
+// listingBackend lists the nodes when it is started
+type listingBackend struct {
+	*fake.FakeProvider
+	synced bool
+	nodes  []string
+}
+
+func (b *listingBackend) Start() {
+	lister := b.Lister()
+	b.synced = lister.HasSynced()
+	nodes, _ := lister.Node.List(labels.Everything())
+	for _, node := range nodes {
+		b.nodes = append(b.nodes, node.Name)
+	}
+	sort.Strings(b.nodes)
+	b.FakeProvider.Start()
+}
+
+func TestBackendStartedAfterCacheSync(t *testing.T) {
+	backend := &listingBackend{FakeProvider: fake.NewFakeProvider("fake")}
+	// the nodes exist before the provider watches them
+	env := providertesting.NewTestEnv(t, backend, func(cfg *core.Configuration) {
+		for i := 1; i <= 3; i++ {
+			name := fmt.Sprintf("node%d", i)
+			if _, err := cfg.KubeClient.CoreV1().Nodes().Create(fake.NewNode(name, fmt.Sprintf("192.168.0.%d", i))); err != nil {
+				t.Fatalf("create Node %s error: %v", name, err)
+			}
+		}
+	})
+	defer env.Stop()
+
+	assert.Nil(t, backend.WaitForCallCount(fake.MethodStart, 1, env.Timeout))
+	assert.True(t, backend.synced)
+	assert.Equal(t, []string{"node1", "node2", "node3"}, backend.nodes)
+	assert.True(t, backend.Lister().WaitForCacheSync(env.Timeout))
+}
+
+func TestLoadBalancerFiltered(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	lb := providertesting.NewLoadBalancer("10.0.0.100")
+	lb.Name = "other"
+	env.CreateLB(lb)
+	assert.Equal(t, 0, backend.CallCount(fake.MethodOnUpdate))
+}
+
+func TestLoadBalancerRetried(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.Script(fake.MethodOnUpdate, fake.FailTimes(fmt.Errorf("busy"), 2))
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100"))
+	assert.True(t, backend.CallCount(fake.MethodOnUpdate) >= 3)
+	assert.Equal(t, lb.UID, lastUpdate(t, backend).UID)
+}
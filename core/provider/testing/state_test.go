@@ -0,0 +1,131 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+// getState returns the state served by the provider, decoded and as the
+// raw fields
+func getState(t *testing.T, env *providertesting.TestEnv) (*core.ProviderState, map[string]json.RawMessage) {
+	w := httptest.NewRecorder()
+	env.Provider.StateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/state", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	state := &core.ProviderState{}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(w.Body.Bytes(), state); err != nil {
+		t.Fatalf("invalid state: %v", err)
+	}
+	json.Unmarshal(w.Body.Bytes(), &fields)
+	return state, fields
+}
+
+func TestStateHandler(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	backend.SetState(json.RawMessage(`{"config":"rendered"}`))
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	lb := providertesting.NewLoadBalancer("10.0.0.100", "node1", "node2")
+	lb.Annotations = map[string]string{"example.com/api-token": "s3cr3t"}
+	lb = env.CreateLB(lb)
+
+	state, fields := getState(t, env)
+	for _, field := range []string{"info", "lifecycle", "healthy", "queueLength", "syncing", "loadBalancers", "backend"} {
+		assert.Contains(t, fields, field)
+	}
+	assert.Equal(t, "fake", state.Info.Name)
+	assert.Equal(t, core.LifecycleRunning, state.Lifecycle)
+	assert.True(t, state.Healthy)
+	assert.Equal(t, 0, state.QueueLength)
+	assert.JSONEq(t, `{"config":"rendered"}`, string(state.Backend))
+	if assert.Len(t, state.LoadBalancers, 1) {
+		lbState := state.LoadBalancers[0]
+		assert.Equal(t, "default/lb", lbState.Key)
+		assert.Equal(t, lb.UID, lbState.Object.UID)
+		assert.Equal(t, "<redacted>", lbState.Object.Annotations["example.com/api-token"])
+		if assert.Len(t, lbState.VIPs, 1) {
+			assert.Equal(t, "10.0.0.100", lbState.VIPs[0].IP.String())
+		}
+		assert.Equal(t, []core.RealServerState{{Node: "node1", IP: "192.168.0.1", Family: corenet.FamilyIPv4, Weight: core.DefaultWeight}}, lbState.RealServers)
+		if assert.NotNil(t, lbState.LastSync) {
+			assert.Equal(t, core.SyncResultSuccess, lbState.LastSync.Result)
+		}
+	}
+
+	backend.SetHealthz(fmt.Errorf("dataplane down"))
+	backend.Script(fake.MethodOnUpdate, fake.Behavior{Err: core.NewPermanentError("InvalidConfig", fmt.Errorf("bad config"))})
+	env.UpdateLB(lb, func(lb *netv1alpha1.LoadBalancer) {
+		lb.Spec.Providers.Ipvsdr.Scheduler = netv1alpha1.IpvsSchedulerWRR
+	})
+	state, _ = getState(t, env)
+	assert.False(t, state.Healthy)
+	assert.Equal(t, "dataplane down", state.HealthError)
+	if last := state.LoadBalancers[0].LastSync; assert.NotNil(t, last) {
+		assert.Equal(t, core.SyncResultPermanentError, last.Result)
+		assert.Equal(t, "bad config", last.Error)
+	}
+
+	env.Stop()
+	state, _ = getState(t, env)
+	assert.Equal(t, core.LifecycleStopped, state.Lifecycle)
+}
+
+func TestStateConcurrentWithSyncs(t *testing.T) {
+	backend := fake.NewFakeProvider("fake")
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1"))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				getState(t, env)
+			}
+		}
+	}()
+	for _, ready := range []bool{false, true, false, true} {
+		env.SetNodeReady("node1", ready)
+	}
+	env.UpdateLB(lb, func(lb *netv1alpha1.LoadBalancer) {
+		lb.Spec.Providers.Ipvsdr.Scheduler = netv1alpha1.IpvsSchedulerWRR
+	})
+	close(done)
+	wg.Wait()
+}
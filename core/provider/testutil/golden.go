@@ -0,0 +1,191 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil holds the test helpers shared by the backends.
+//
+// GoldenConfigTest tests a config-rendering backend against the cases
+// checked in a directory, one subdirectory per case:
+//
+//	testdata/cases/
+//	  node-port/
+//	    loadbalancer.yaml  the LoadBalancer rendered
+//	    nodes.yaml         the list of the Nodes, optional
+//	    expected.golden    the rendered config
+//
+// The golden files are regenerated by running the tests with -update.
+package testutil
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/ghodss/yaml"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// LoadBalancerFile, NodesFile and GoldenFile are the files of a case
+	LoadBalancerFile = "loadbalancer.yaml"
+	NodesFile        = "nodes.yaml"
+	GoldenFile       = "expected.golden"
+)
+
+// Update is the -update flag of the tests importing the package, which
+// regenerates the golden files instead of comparing them. The packages
+// use it instead of defining their own.
+var Update = flag.Bool("update", false, "update the golden files in testdata")
+
+// trailingSpace matches the whitespace ending a line, blankLines the runs
+// of the blank lines
+var (
+	trailingSpace = regexp.MustCompile(`[ \t]+\n`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// RenderFunc renders the config of the LoadBalancer on the nodes
+type RenderFunc func(lb *netv1alpha1.LoadBalancer, nodes []*v1.Node) (string, error)
+
+// GoldenConfigTest renders the cases of the directory, in subtests named
+// by them, and compares the configs to the golden files. A config has to
+// be rendered the same twice. The golden files are written instead with
+// -update.
+func GoldenConfigTest(t *testing.T, render RenderFunc, casesDir string) {
+	infos, err := ioutil.ReadDir(casesDir)
+	if err != nil {
+		t.Fatalf("read cases: %v", err)
+	}
+	cases := 0
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		cases++
+		dir := filepath.Join(casesDir, info.Name())
+		t.Run(info.Name(), func(t *testing.T) {
+			goldenConfigTest(t, render, dir)
+		})
+	}
+	if cases == 0 {
+		t.Fatalf("no cases in %s", casesDir)
+	}
+}
+
+func goldenConfigTest(t *testing.T, render RenderFunc, dir string) {
+	got, err := renderCase(render, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := renderCase(render, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != got {
+		t.Fatalf("config not deterministic, rendered again:\n%s", Diff(got, again))
+	}
+
+	golden := filepath.Join(dir, GoldenFile)
+	if *Update {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	data, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("read golden file, run with -update to write it: %v", err)
+	}
+	if want := Normalize(string(data)); want != got {
+		t.Errorf("config differs from %s, run with -update if expected:\n%s", golden, Diff(want, got))
+	}
+}
+
+// renderCase loads the case of the directory and renders it normalized
+func renderCase(render RenderFunc, dir string) (string, error) {
+	lb, nodes, err := LoadCase(dir)
+	if err != nil {
+		return "", err
+	}
+	config, err := render(lb, nodes)
+	if err != nil {
+		return "", fmt.Errorf("render: %v", err)
+	}
+	return Normalize(config), nil
+}
+
+// LoadCase returns the LoadBalancer and the Nodes of the case of the
+// directory, there are no Nodes if the file is missing
+func LoadCase(dir string) (*netv1alpha1.LoadBalancer, []*v1.Node, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, LoadBalancerFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	lb := &netv1alpha1.LoadBalancer{}
+	if err := yaml.Unmarshal(data, lb); err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %v", LoadBalancerFile, err)
+	}
+
+	nodes := make([]*v1.Node, 0)
+	data, err = ioutil.ReadFile(filepath.Join(dir, NodesFile))
+	if os.IsNotExist(err) {
+		return lb, nodes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := yaml.Unmarshal(data, &nodes); err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %v", NodesFile, err)
+	}
+	return lb, nodes, nil
+}
+
+// Normalize strips the whitespace insignificant to the configs, the
+// carriage returns, the trailing whitespace of the lines, the runs of the
+// blank lines beyond one and the blank lines around the config, which
+// ends with a newline
+func Normalize(config string) string {
+	config = strings.Replace(config, "\r\n", "\n", -1)
+	config = trailingSpace.ReplaceAllString(config+"\n", "\n")
+	config = blankLines.ReplaceAllString(config, "\n\n")
+	config = strings.Trim(config, "\n")
+	if config == "" {
+		return ""
+	}
+	return config + "\n"
+}
+
+// Diff returns the unified diff of the configs by line
+func Diff(want, got string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(want),
+		B:        difflib.SplitLines(got),
+		FromFile: "want",
+		ToFile:   "got",
+		Context:  3,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return diff
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		config   string
+		expected string
+	}{
+		{"", ""},
+		{"\n\n", ""},
+		{"a\nb", "a\nb\n"},
+		{"a  \n\tb\t\n", "a\n\tb\n"},
+		{"\r\na\r\n\r\n\r\n\r\nb\r\n", "a\n\nb\n"},
+		{"a\n  \n \t\nb\n\n", "a\n\nb\n"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, Normalize(c.config), "%q", c.config)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	diff := Diff("a\nb\nc\n", "a\nB\nc\n")
+	assert.Contains(t, diff, "--- want")
+	assert.Contains(t, diff, "+++ got")
+	assert.Contains(t, diff, "-b\n")
+	assert.Contains(t, diff, "+B\n")
+	assert.Equal(t, "", Diff("a\n", "a\n"))
+}
+
+func writeCase(t *testing.T, dir string, files map[string]string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadCase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCase(t, filepath.Join(dir, "nodes"), map[string]string{
+		LoadBalancerFile: "metadata:\n  name: lb\nspec:\n  nodes:\n    names: [node1]\n",
+		NodesFile:        "- metadata:\n    name: node1\n  status:\n    addresses:\n    - type: InternalIP\n      address: 192.168.1.1\n",
+	})
+	lb, nodes, err := LoadCase(filepath.Join(dir, "nodes"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "lb", lb.Name)
+		assert.Equal(t, []string{"node1"}, lb.Spec.Nodes.Names)
+		if assert.Len(t, nodes, 1) {
+			assert.Equal(t, "node1", nodes[0].Name)
+			assert.Equal(t, "192.168.1.1", nodes[0].Status.Addresses[0].Address)
+		}
+	}
+
+	writeCase(t, filepath.Join(dir, "no-nodes"), map[string]string{LoadBalancerFile: "metadata:\n  name: lb\n"})
+	_, nodes, err = LoadCase(filepath.Join(dir, "no-nodes"))
+	assert.NoError(t, err)
+	assert.Empty(t, nodes)
+
+	writeCase(t, filepath.Join(dir, "invalid"), map[string]string{LoadBalancerFile: "metadata: [\n"})
+	_, _, err = LoadCase(filepath.Join(dir, "invalid"))
+	assert.Error(t, err)
+
+	_, _, err = LoadCase(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestGoldenConfigTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeCase(t, filepath.Join(dir, "two-nodes"), map[string]string{
+		LoadBalancerFile: "metadata:\n  name: lb\nspec:\n  nodes:\n    names: [node1, node2]\n",
+		NodesFile:        "- metadata:\n    name: node1\n- metadata:\n    name: node2\n",
+		// the whitespace is insignificant
+		GoldenFile: "lb lb  \r\n\n\nserver node1\nserver node2",
+	})
+	writeCase(t, filepath.Join(dir, "no-nodes"), map[string]string{
+		LoadBalancerFile: "metadata:\n  name: lb\n",
+		GoldenFile:       "lb lb\n",
+	})
+	// the files of the directory are not cases
+	writeCase(t, dir, map[string]string{"README": "cases"})
+
+	renders := 0
+	render := func(lb *netv1alpha1.LoadBalancer, nodes []*v1.Node) (string, error) {
+		renders++
+		lines := []string{"lb " + lb.Name, ""}
+		for _, node := range nodes {
+			lines = append(lines, fmt.Sprintf("server %s  ", node.Name))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+	GoldenConfigTest(t, render, dir)
+	// every case is rendered twice
+	assert.Equal(t, 4, renders)
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tpr adapts the GenericProvider to the TPR client of the
+// LoadBalancers, for the programs which run no informers of their own.
+package tpr
+
+import (
+	"github.com/caicloud/loadbalancer-controller/pkg/informers"
+	"github.com/caicloud/loadbalancer-controller/pkg/tprclient"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// NewLoadBalancerProvider returns the GenericProvider of the Configuration
+// whose missing sources are the informers of its KubeClient and the TPR
+// client, and which patches the LoadBalancers through the TPR client
+// unless it has a StatusWriter. The informers are started with the
+// provider, the Configuration is not modified. It returns the error of
+// core.NewLoadBalancerProvider.
+func NewLoadBalancerProvider(cfg *core.Configuration, client tprclient.Interface) (*core.GenericProvider, error) {
+	copied := *cfg
+	if copied.LoadBalancers == nil || copied.Nodes == nil {
+		factory := informers.NewSharedInformerFactory(copied.KubeClient, client, 0)
+		if copied.LoadBalancers == nil {
+			copied.LoadBalancers = factory.Networking().V1alpha1().LoadBalancer()
+		}
+		if copied.Nodes == nil {
+			copied.Nodes = factory.Core().V1().Nodes()
+		}
+		copied.Informers = append(append([]core.InformerStarter(nil), cfg.Informers...), factory)
+	}
+	if copied.StatusWriter == nil {
+		copied.StatusWriter = NewStatusWriter(client)
+	}
+	return core.NewLoadBalancerProvider(&copied)
+}
+
+// statusWriter is the StatusWriter of a TPR client
+type statusWriter struct {
+	client tprclient.Interface
+}
+
+// NewStatusWriter returns the StatusWriter patching the LoadBalancers
+// through the TPR client
+func NewStatusWriter(client tprclient.Interface) core.StatusWriter {
+	return &statusWriter{client: client}
+}
+
+func (w *statusWriter) PatchLoadBalancer(namespace, name string, patch []byte) error {
+	_, err := w.client.NetworkingV1alpha1().LoadBalancers(namespace).Patch(name, types.MergePatchType, patch)
+	return err
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+const (
+	// AnnotationKeyTrafficPolicy is the traffic policy of the LoadBalancer,
+	// "Local" routes the traffic of the VIPs to the nodes hosting a ready
+	// endpoint of its Services only, which preserves the client IP like the
+	// Local external traffic policy of the Services. It is "Cluster" by
+	// default.
+	AnnotationKeyTrafficPolicy = "loadbalancer.caicloud.io/traffic-policy"
+	// AnnotationKeyLocalFallback is what the Local traffic policy does when
+	// no node hosts a ready endpoint, "KeepLast" keeps the last nodes which
+	// did and "All" fails open to all nodes. It is "KeepLast" by default.
+	AnnotationKeyLocalFallback = "loadbalancer.caicloud.io/local-fallback"
+	// AnnotationKeyLocalEndpointsCondition is the Condition of the nodes
+	// hosting the endpoints of a LoadBalancer with the Local traffic policy
+	AnnotationKeyLocalEndpointsCondition = "loadbalancer.caicloud.io/local-endpoints-condition"
+
+	// LocalEndpointsReady is the reason of the condition if some nodes host
+	// a ready endpoint
+	LocalEndpointsReady = "LocalEndpointsReady"
+	// NoLocalEndpoints is the reason of the condition and the Warning event
+	// if no node hosts a ready endpoint
+	NoLocalEndpoints = "NoLocalEndpoints"
+)
+
+// TrafficPolicy is how the traffic of the VIPs is routed to the nodes
+type TrafficPolicy string
+
+const (
+	// TrafficPolicyCluster routes to all nodes of the LoadBalancer, which
+	// forward to the endpoints on other nodes
+	TrafficPolicyCluster TrafficPolicy = "Cluster"
+	// TrafficPolicyLocal routes to the nodes hosting the endpoints only
+	TrafficPolicyLocal TrafficPolicy = "Local"
+)
+
+// LocalFallback is the routing of the Local traffic policy when no node
+// hosts a ready endpoint
+type LocalFallback string
+
+const (
+	// LocalFallbackKeepLast keeps the last nodes hosting a ready endpoint,
+	// none before the first ones
+	LocalFallbackKeepLast LocalFallback = "KeepLast"
+	// LocalFallbackAll routes to all nodes of the LoadBalancer
+	LocalFallbackAll LocalFallback = "All"
+)
+
+// GetTrafficPolicy returns the traffic policy of the LoadBalancer and the
+// fallback of the Local one, it returns a PermanentError if they are
+// invalid
+func GetTrafficPolicy(lb *netv1alpha1.LoadBalancer) (TrafficPolicy, LocalFallback, error) {
+	policy := TrafficPolicy(lb.Annotations[AnnotationKeyTrafficPolicy])
+	switch policy {
+	case "":
+		policy = TrafficPolicyCluster
+	case TrafficPolicyCluster, TrafficPolicyLocal:
+	default:
+		return "", "", NewPermanentError("InvalidTrafficPolicy", fmt.Errorf("invalid traffic policy %q, expect %s or %s", policy, TrafficPolicyCluster, TrafficPolicyLocal))
+	}
+	fallback := LocalFallback(lb.Annotations[AnnotationKeyLocalFallback])
+	switch fallback {
+	case "":
+		fallback = LocalFallbackKeepLast
+	case LocalFallbackKeepLast, LocalFallbackAll:
+	default:
+		return "", "", NewPermanentError("InvalidTrafficPolicy", fmt.Errorf("invalid local fallback %q, expect %s or %s", fallback, LocalFallbackKeepLast, LocalFallbackAll))
+	}
+	return policy, fallback, nil
+}
+
+// localEndpointNodes returns the names of the nodes hosting a ready
+// endpoint of the Services, the endpoints without a node are skipped
+func (s StoreLister) localEndpointNodes(namespace string, services []string) (sets.String, error) {
+	nodes := sets.NewString()
+	for _, name := range services {
+		eps, err := s.Endpoints.Endpoints(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, subset := range eps.Subsets {
+			for _, addr := range subset.Addresses {
+				if addr.NodeName != nil && *addr.NodeName != "" {
+					nodes.Insert(*addr.NodeName)
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// ensureTrafficPolicy restricts the real servers to the nodes hosting a
+// ready endpoint of the Services of the LoadBalancer if its traffic policy
+// is Local, and records them as a condition. The Endpoints changes resync
+// the LoadBalancer, so the real servers follow the endpoints.
+func (p *GenericProvider) ensureTrafficPolicy(lb *netv1alpha1.LoadBalancer) error {
+	policy, fallback, err := GetTrafficPolicy(lb)
+	if err != nil {
+		return err
+	}
+	if policy == TrafficPolicyCluster {
+		p.setLocalNodes(nil)
+		if _, ok := lb.Annotations[AnnotationKeyLocalEndpointsCondition]; ok {
+			if err := p.patchAnnotation(lb, AnnotationKeyLocalEndpointsCondition, nil); err != nil {
+				log.Error("delete condition error", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "condition": AnnotationKeyLocalEndpointsCondition, "err": err})
+			}
+		}
+		return nil
+	}
+
+	services := referencedServices(lb)
+	if len(services) == 0 {
+		return NewPermanentError("InvalidTrafficPolicy", fmt.Errorf("the %s traffic policy requires the services of the LoadBalancer", TrafficPolicyLocal))
+	}
+	if p.lister.Endpoints == nil {
+		return NewPermanentError("InvalidTrafficPolicy", fmt.Errorf("the %s traffic policy requires the provider to watch the services", TrafficPolicyLocal))
+	}
+	nodes, err := p.lister.localEndpointNodes(lb.Namespace, services)
+	if err != nil {
+		return err
+	}
+
+	if nodes.Len() > 0 {
+		p.lastLocalNodes = nodes
+		p.setLocalNodes(nodes)
+		p.setCondition(lb, AnnotationKeyLocalEndpointsCondition, Condition{
+			Status:  v1.ConditionTrue,
+			Reason:  LocalEndpointsReady,
+			Message: fmt.Sprintf("routing to the nodes %s", strings.Join(nodes.List(), ", ")),
+		})
+		return nil
+	}
+
+	message := fmt.Sprintf("no node hosts a ready endpoint of the services %s", strings.Join(services, ", "))
+	if fallback == LocalFallbackAll {
+		p.setLocalNodes(nil)
+		message += ", routing to all nodes"
+	} else {
+		last := p.lastLocalNodes
+		if last == nil {
+			last = sets.NewString()
+		}
+		p.setLocalNodes(last)
+		message += fmt.Sprintf(", keeping the last nodes [%s]", strings.Join(last.List(), ", "))
+	}
+	p.setCondition(lb, AnnotationKeyLocalEndpointsCondition, Condition{
+		Status:  v1.ConditionFalse,
+		Reason:  NoLocalEndpoints,
+		Message: message,
+	})
+	return nil
+}
+
+// setLocalNodes sets the nodes the real servers are restricted to, all
+// nodes if it is nil
+func (p *GenericProvider) setLocalNodes(nodes sets.String) {
+	p.localLock.Lock()
+	defer p.localLock.Unlock()
+	p.localNodes = nodes
+}
+
+// nodeLocal returns true if the node may be a real server under the
+// traffic policy of the LoadBalancer
+func (p *GenericProvider) nodeLocal(name string) bool {
+	p.localLock.Lock()
+	defer p.localLock.Unlock()
+	return p.localNodes == nil || p.localNodes.Has(name)
+}
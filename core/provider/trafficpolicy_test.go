@@ -0,0 +1,150 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestGetTrafficPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		fallback string
+		want     TrafficPolicy
+		wantFb   LocalFallback
+		valid    bool
+	}{
+		{"", "", TrafficPolicyCluster, LocalFallbackKeepLast, true},
+		{"Local", "", TrafficPolicyLocal, LocalFallbackKeepLast, true},
+		{"Local", "All", TrafficPolicyLocal, LocalFallbackAll, true},
+		{"local", "", "", "", false},
+		{"Local", "None", "", "", false},
+	}
+	for _, tt := range tests {
+		lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			AnnotationKeyTrafficPolicy: tt.policy,
+			AnnotationKeyLocalFallback: tt.fallback,
+		}}}
+		policy, fallback, err := GetTrafficPolicy(lb)
+		if !tt.valid {
+			assert.True(t, IsPermanentError(err), tt.policy+"/"+tt.fallback)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, policy)
+		assert.Equal(t, tt.wantFb, fallback)
+	}
+}
+
+// newLocalTestEndpoints returns the Endpoints of the Service with a ready
+// endpoint on each node
+func newLocalTestEndpoints(name string, nodes ...string) *v1.Endpoints {
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Port: 8080, Protocol: v1.ProtocolTCP}}}
+	for i, node := range nodes {
+		node := node
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: fmt.Sprintf("10.244.0.%d", i+1), NodeName: &node})
+	}
+	return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}, Subsets: []v1.EndpointSubset{subset}}
+}
+
+func TestEnsureTrafficPolicy(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "lb",
+		Annotations: map[string]string{
+			AnnotationKeyServices:      "web,db",
+			AnnotationKeyTrafficPolicy: "Local",
+		},
+	}}
+	p, recorder, patches := newRoleTestProvider(lb, flowcontrol.NewFakeAlwaysRateLimiter())
+
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for i, name := range []string{"node1", "node2", "node3"} {
+		nodes.Add(newEligibilityTestNode(name, fmt.Sprintf("192.168.1.%d", i+1), nil))
+	}
+	endpoints := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	p.lister = StoreLister{
+		Node:      v1listers.NewNodeLister(nodes),
+		Endpoints: v1listers.NewEndpointsLister(endpoints),
+		Local:     p.nodeLocal,
+	}
+	names := []string{"node1", "node2", "node3"}
+	realServers := func() []string {
+		ips := []string{}
+		for _, rs := range p.lister.RealServers(names, corenet.FamilyIPv4) {
+			ips = append(ips, rs.IP.String())
+		}
+		return ips
+	}
+
+	// no endpoint yet, nothing to keep
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Empty(t, realServers())
+	assert.Contains(t, drainEvents(recorder), "Warning NoLocalEndpoints no node hosts a ready endpoint of the services web, db, keeping the last nodes []")
+
+	// the pods of the Services are scheduled
+	endpoints.Add(newLocalTestEndpoints("web", "node1"))
+	endpoints.Add(newLocalTestEndpoints("db", "node1", "node3"))
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.3"}, realServers())
+	assert.Contains(t, (*patches)[len(*patches)-1], "routing to the nodes node1, node3")
+
+	// the pod of db moves from node3 to node2
+	endpoints.Update(newLocalTestEndpoints("db", "node1", "node2"))
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, realServers())
+
+	// the pods are gone, the last nodes are kept
+	endpoints.Update(newLocalTestEndpoints("web"))
+	endpoints.Delete(newLocalTestEndpoints("db"))
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2"}, realServers())
+	assert.Contains(t, drainEvents(recorder), "Warning NoLocalEndpoints no node hosts a ready endpoint of the services web, db, keeping the last nodes [node1, node2]")
+
+	// or fail open
+	lb.Annotations[AnnotationKeyLocalFallback] = "All"
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}, realServers())
+	assert.True(t, strings.HasSuffix(drainEvents(recorder)[0], "routing to all nodes"))
+
+	// the condition is removed with the Local traffic policy
+	lb.Annotations[AnnotationKeyTrafficPolicy] = "Cluster"
+	lb.Annotations[AnnotationKeyLocalEndpointsCondition] = "{}"
+	*patches = nil
+	assert.Nil(t, p.ensureTrafficPolicy(lb))
+	assert.Len(t, realServers(), 3)
+	assert.Equal(t, []string{`{"metadata":{"annotations":{"loadbalancer.caicloud.io/local-endpoints-condition":null}}}`}, *patches)
+
+	// the Local traffic policy needs the Services
+	lb.Annotations = map[string]string{AnnotationKeyTrafficPolicy: "Local"}
+	assert.True(t, IsPermanentError(p.ensureTrafficPolicy(lb)))
+	lb.Annotations[AnnotationKeyServices] = "web"
+	p.lister.Endpoints = nil
+	assert.True(t, IsPermanentError(p.ensureTrafficPolicy(lb)))
+}
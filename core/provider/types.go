@@ -17,9 +17,17 @@ limitations under the License.
 package provider
 
 import (
+	"encoding/json"
+	"net"
+	"time"
+
 	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
 	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+	"k8s.io/apimachinery/pkg/util/wait"
 	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
 )
 
 // Provider holds the methods to handle an Provider backend
@@ -27,11 +35,13 @@ type Provider interface {
 	// Info returns information about the loadbalancer provider
 	Info() Info
 	// SetListers allows the access of store listers present in the generic controller
-	// This avoid the use of the kubernetes client.
+	// This avoid the use of the kubernetes client. It is called before the
+	// caches have synced, see StoreLister.HasSynced.
 	SetListers(StoreLister)
 	// OnUpdate callback invoked when loadbalancer changed
 	OnUpdate(*netv1alpha1.LoadBalancer) error
-	// Start starts the loadbalancer provider
+	// Start starts the loadbalancer provider, it is called once the caches
+	// of the listers have synced
 	Start()
 	// WaitForStart waits for provider fully run
 	WaitForStart() bool
@@ -39,6 +49,155 @@ type Provider interface {
 	Stop() error
 }
 
+// ListenerProvider is implemented by the Providers which bind listeners on
+// the node, the ports are checked for conflicts before OnUpdate
+type ListenerProvider interface {
+	// Listeners returns the address and the ports the provider listens on
+	// for the loadbalancer, the address may be the unspecified one
+	Listeners(*netv1alpha1.LoadBalancer) (net.IP, []corenet.Port, error)
+}
+
+// InterfaceProvider is implemented by the Providers which send and receive
+// the traffic of the VIPs through particular interfaces of the node
+type InterfaceProvider interface {
+	// Interfaces returns the names of the interfaces the provider uses
+	Interfaces() []string
+}
+
+// FamilyProvider is implemented by the Providers which declare the address
+// families they support, the Providers which do not implement it support
+// IPv4 only. The VIPs of other families are rejected before OnUpdate.
+type FamilyProvider interface {
+	// SupportedFamilies returns the address families the provider supports
+	SupportedFamilies() []corenet.Family
+}
+
+// DrainingProvider is implemented by the Providers which drain the removed
+// real servers instead of deleting them immediately, the LoadBalancer is
+// resynced periodically while any is being drained
+type DrainingProvider interface {
+	// Draining returns true if any real server is being drained
+	Draining() bool
+}
+
+// ResyncProvider is implemented by the Providers which hold back part of
+// the desired state for a while, e.g. to debounce changes, the LoadBalancer
+// is resynced once they may apply it
+type ResyncProvider interface {
+	// ResyncAfter returns the time after which the LoadBalancer should be
+	// resynced, zero if no resync is needed
+	ResyncAfter() time.Duration
+}
+
+// DeletionProvider is implemented by the Providers which own resources out
+// of the node, e.g. on a cloud, they are released once the LoadBalancer is
+// deleted. The deletion is resynced like an update by ResyncProvider.
+type DeletionProvider interface {
+	// OnDelete releases the resources of the deleted LoadBalancer
+	OnDelete(*netv1alpha1.LoadBalancer) error
+}
+
+// AddressProvider is implemented by the Providers which provision the
+// addresses of the LoadBalancer instead of serving the VIPs in the spec,
+// e.g. the public IPs of a cloud
+type AddressProvider interface {
+	// Addresses returns the provisioned addresses, nil until they are
+	// provisioned
+	Addresses() []net.IP
+}
+
+// HostnameProvider is implemented by the Providers which provision a DNS
+// name for the LoadBalancer, e.g. the cloud load balancers whose addresses
+// are not fixed
+type HostnameProvider interface {
+	// Hostname returns the provisioned DNS name, empty until it is
+	// provisioned
+	Hostname() string
+}
+
+// CertificateProvider is implemented by the Providers which terminate TLS,
+// the certificates are reported so that their expiry can be monitored
+type CertificateProvider interface {
+	// ServingCertificates returns the certificates the provider serves,
+	// sorted by port and host
+	ServingCertificates() []ServingCertificate
+}
+
+// ServingCertificate is a certificate served on a port of the LoadBalancer
+type ServingCertificate struct {
+	Port int `json:"port"`
+	// Host is the host the certificate is served for, empty for the one of
+	// the port
+	Host string `json:"host,omitempty"`
+	// Secret is the name of the tls Secret of the certificate
+	Secret      string    `json:"secret"`
+	Fingerprint string    `json:"fingerprint"`
+	NotAfter    time.Time `json:"notAfter"`
+}
+
+// StatusProvider is implemented by the Providers which report a part of the
+// LoadBalancer status, e.g. the one returned by an external system
+type StatusProvider interface {
+	// Status returns the fragment of the status in json, it is merged into
+	// the status of the LoadBalancer. It returns nil if there is none.
+	Status() json.RawMessage
+}
+
+// StateReporter is implemented by the Providers which contribute their own
+// section to the state dump of the provider, e.g. the configuration they
+// applied last
+type StateReporter interface {
+	// State returns the section in json, it is called concurrently with
+	// the syncs. It returns nil if there is none.
+	State() json.RawMessage
+}
+
+// ValidatingProvider is implemented by the Providers which reject the
+// LoadBalancers they can not configure beyond their capabilities, e.g. a
+// combination of the annotations. The LoadBalancer is validated before
+// OnUpdate, and offline by the validate command.
+type ValidatingProvider interface {
+	// ValidateLoadBalancer returns an error if the LoadBalancer is
+	// invalid for the provider, it must not use the listers
+	ValidateLoadBalancer(lb *netv1alpha1.LoadBalancer) error
+}
+
+// DryRunProvider is implemented by the Providers which can compute what
+// OnUpdate would apply for a LoadBalancer without applying it. The replays
+// of the recorded syncs call it instead of OnUpdate, so they change
+// nothing on the node or out of it.
+type DryRunProvider interface {
+	// DryRun returns the state the provider would apply for the
+	// LoadBalancer and the error OnUpdate would return, it may use the
+	// listers but must change nothing
+	DryRun(lb *netv1alpha1.LoadBalancer) (json.RawMessage, error)
+}
+
+// HealthzProvider is implemented by the Providers which supervise processes
+// or other resources that may fail after they are started
+type HealthzProvider interface {
+	// Healthz returns an error if the provider is not serving
+	Healthz() error
+}
+
+// PortHealthProvider is implemented by the Providers whose dataplane is
+// checked per port of the LoadBalancer, e.g. the ipvs rules or the
+// upstreams of the ports
+type PortHealthProvider interface {
+	// PortHealth returns the health of the ports of the last update
+	PortHealth() []PortHealth
+}
+
+// PortHealth is the health of the dataplane of a port of the LoadBalancer
+type PortHealth struct {
+	Protocol string `json:"protocol,omitempty"`
+	// Port is zero if the dataplane serves all ports of the VIPs alike
+	Port    int  `json:"port,omitempty"`
+	Healthy bool `json:"healthy"`
+	// Reason is why the port is unhealthy
+	Reason string `json:"reason,omitempty"`
+}
+
 // Info returns information about the provider.
 // This fields contains information that helps to track issues or to
 // map the running loadbalancer provider to source code
@@ -51,10 +210,122 @@ type Info struct {
 	Build string `json:"build"`
 	// Repository return information about the git repository
 	Repository string `json:"repository"`
+	// Capabilities returns what the backend supports, all is supported if
+	// it is nil
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// Extensions are the names of the optional interfaces the backend
+	// implements, they are detected by the GenericProvider
+	Extensions []string `json:"extensions,omitempty"`
 }
 
 // StoreLister returns the configured store for loadbalancers, nodes
 type StoreLister struct {
 	LoadBalancer netlisters.LoadBalancerLister
 	Node         v1listers.NodeLister
+	// Secret lists the Secrets in the namespace of the LoadBalancer
+	Secret v1listers.SecretLister
+	// Service and Endpoints list the ones in the namespace of the
+	// LoadBalancer, they are nil unless the Configuration watches Services
+	Service   v1listers.ServiceLister
+	Endpoints v1listers.EndpointsLister
+	// ConfigMap lists the ConfigMaps in the namespace of the LoadBalancer,
+	// it is nil unless the Configuration names the ones the backend reads
+	ConfigMap v1listers.ConfigMapLister
+	// AddressPolicy selects the addresses of the nodes
+	AddressPolicy *AddressPolicy
+	// WeightPolicy derives the weights of the nodes from their conditions
+	WeightPolicy WeightPolicy
+	// Healthy reports the result of the active health checks of a real
+	// server, the unhealthy ones are weighted to zero
+	Healthy func(net.IP) bool
+	// Eligible reports whether a node is eligible as a real server, all
+	// nodes are eligible if it is nil
+	Eligible func(*v1.Node) bool
+	// Local reports whether a named node may be a real server under the
+	// traffic policy of the LoadBalancer, all nodes may if it is nil
+	Local func(string) bool
+	// HasSynced reports whether the caches of the listers have synced, the
+	// ones read before Start may be empty or partial until they have. They
+	// are synced if it is nil.
+	HasSynced func() bool
+}
+
+// cacheSyncInterval is the interval the caches are polled at until they
+// have synced
+const cacheSyncInterval = 100 * time.Millisecond
+
+// WaitForCacheSync waits until the caches of the listers have synced, it
+// returns false if they have not in the timeout
+func (s StoreLister) WaitForCacheSync(timeout time.Duration) bool {
+	if s.HasSynced == nil {
+		return true
+	}
+	err := wait.PollImmediate(cacheSyncInterval, timeout, func() (bool, error) {
+		return s.HasSynced(), nil
+	})
+	return err == nil
+}
+
+// RealServer is a node serving the traffic of the VIPs
+type RealServer struct {
+	Node   string
+	IP     net.IP
+	Weight int
+}
+
+// NodeIPs returns the addresses of the family of the named nodes selected
+// by the AddressPolicy, including the ones not eligible as real servers.
+// The nodes which are missing or have no address of the family are
+// skipped.
+func (s StoreLister) NodeIPs(names []string, family corenet.Family) []net.IP {
+	rss := s.realServers(names, family, false)
+	ips := make([]net.IP, 0, len(rss))
+	for _, rs := range rss {
+		ips = append(ips, rs.IP)
+	}
+	return ips
+}
+
+// RealServers returns the named nodes as real servers of the family, with
+// the addresses selected by the AddressPolicy and the weights derived by
+// the WeightPolicy and the health checks. The nodes which are missing, not
+// eligible, excluded by the traffic policy or have no address of the
+// family are skipped.
+func (s StoreLister) RealServers(names []string, family corenet.Family) []RealServer {
+	return s.realServers(names, family, true)
+}
+
+func (s StoreLister) realServers(names []string, family corenet.Family, eligibleOnly bool) []RealServer {
+	policy := s.AddressPolicy
+	if policy == nil {
+		policy = NewAddressPolicy(nil)
+	}
+	weights := s.WeightPolicy
+	if weights == nil {
+		weights = DefaultWeightPolicy
+	}
+	rss := make([]RealServer, 0, len(names))
+	for _, name := range names {
+		node, err := s.Node.Get(name)
+		if err != nil {
+			continue
+		}
+		if eligibleOnly && s.Eligible != nil && !s.Eligible(node) {
+			continue
+		}
+		if eligibleOnly && s.Local != nil && !s.Local(name) {
+			continue
+		}
+		ip, err := policy.NodeIP(node, family)
+		if err != nil {
+			log.Warn("skip node without an address", log.Fields{"node": name, "err": err})
+			continue
+		}
+		weight := weights.NodeWeight(node)
+		if s.Healthy != nil && !s.Healthy(ip) {
+			weight = 0
+		}
+		rss = append(rss, RealServer{Node: name, IP: ip, Weight: weight})
+	}
+	return rss
 }
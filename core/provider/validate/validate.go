@@ -0,0 +1,326 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package validate checks a LoadBalancer manifest against a backend
+// offline, with the checks the GenericProvider runs before syncing it, so
+// that the problems show before the object reaches the cluster.
+package validate
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-controller/pkg/util/validation"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/ghodss/yaml"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+const (
+	// FieldSpec, FieldVIPs, FieldCapabilities and FieldBackend are the
+	// fields of the errors not of a single annotation, the spec checked by
+	// the in-tree validation, the VIPs of the spec and the annotations,
+	// the annotations the backend does not support and the LoadBalancer
+	// rejected by the backend
+	FieldSpec         = "spec"
+	FieldVIPs         = "vips"
+	FieldCapabilities = "capabilities"
+	FieldBackend      = "backend"
+)
+
+// FieldError is an error of a field of the LoadBalancer
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// Summary is what the backend would configure for a valid LoadBalancer
+type Summary struct {
+	Key       string
+	Backend   string
+	VIPs      []core.VIP
+	Nodes     []string
+	HTTPPorts []core.HTTPPort
+	TCPPorts  []core.TCPPort
+	Ports     []corenet.Port
+}
+
+// annotation returns the field of the annotation
+func annotation(key string) string {
+	return "metadata.annotations[" + key + "]"
+}
+
+// checks are the checks of the annotations parsed by the GenericProvider
+// and the backends, by the fields
+var checks = []struct {
+	field string
+	check func(*netv1alpha1.LoadBalancer) error
+}{
+	{annotation(core.AnnotationKeyIpvsScheduler), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetIpvsScheduler(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyPorts), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetPorts(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyHTTPPorts), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetHTTPPorts(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyTCPPorts), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetTCPPorts(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyProxyProtocol), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetProxyProtocols(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyBackendProtocolPrefix + "<port>"), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetBackendProtocols(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeySourceRanges), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetSourceRanges(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyPersistence), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetPersistence(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyAccessLog), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetAccessLog(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyRateLimit), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetRateLimit(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeySSLRedirect), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetSSLRedirect(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyTrafficPolicy), func(lb *netv1alpha1.LoadBalancer) error {
+		_, _, err := core.GetTrafficPolicy(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyEndpointPorts), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetEndpointPorts(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyHealthChecks), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetHealthChecks(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyNodeHealthPath), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetNodeHealthPath(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyVIPInterface), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetVIPVLAN(lb)
+		return err
+	}},
+	{"source-route", func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetSourceRoute(lb)
+		return err
+	}},
+	{"bandwidth", func(lb *netv1alpha1.LoadBalancer) error {
+		_, _, err := core.GetBandwidth(lb)
+		return err
+	}},
+	{"vrrp", func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetVRRPConfig(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyVRRPTrackScript), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetVRRPTrackScript(lb)
+		return err
+	}},
+	{annotation(core.AnnotationKeyVRRPTrackInterfaces), func(lb *netv1alpha1.LoadBalancer) error {
+		_, err := core.GetVRRPTrackInterfaces(lb)
+		return err
+	}},
+}
+
+// Validate returns the errors of the LoadBalancer for the backend, all the
+// checks run instead of stopping at the first error. The backend is
+// neither started nor given the listers, only its Info, the families it
+// supports and the ValidatingProvider are used.
+func Validate(lb *netv1alpha1.LoadBalancer, backend core.Provider) []FieldError {
+	errs := make([]FieldError, 0)
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, FieldError{Field: field, Message: err.Error()})
+		}
+	}
+
+	add(FieldSpec, validation.ValidateLoadBalancer(lb))
+	vips, err := core.GetVIPs(lb)
+	add(FieldVIPs, err)
+	if err == nil {
+		add(FieldVIPs, core.ValidateFamilies(vips, core.SupportedFamilies(backend)))
+	}
+	for _, c := range checks {
+		add(c.field, c.check(lb))
+	}
+	// the capabilities are checked once the annotations parse, as their
+	// errors are reported above
+	if len(errs) == 0 {
+		add(FieldCapabilities, core.ValidateCapabilities(lb, backend.Info().Capabilities))
+	}
+	if v, ok := backend.(core.ValidatingProvider); ok && len(errs) == 0 {
+		add(FieldBackend, core.ValidateBackend(lb, v))
+	}
+	return errs
+}
+
+// Summarize returns the Summary of a valid LoadBalancer for the backend
+func Summarize(lb *netv1alpha1.LoadBalancer, backend core.Provider) *Summary {
+	s := &Summary{
+		Key:     lb.Namespace + "/" + lb.Name,
+		Backend: backend.Info().Name,
+		Nodes:   lb.Spec.Nodes.Names,
+	}
+	s.VIPs, _ = core.GetVIPList(lb)
+	s.HTTPPorts, _ = core.GetHTTPPorts(lb)
+	s.TCPPorts, _ = core.GetTCPPorts(lb)
+	s.Ports, _ = core.GetPorts(lb)
+	return s
+}
+
+// Decode decodes the LoadBalancer of the manifest in yaml or json
+func Decode(data []byte) (*netv1alpha1.LoadBalancer, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, fmt.Errorf("empty manifest")
+	}
+	lb := &netv1alpha1.LoadBalancer{}
+	if err := yaml.Unmarshal(data, lb); err != nil {
+		return nil, err
+	}
+	if lb.Kind != "" && lb.Kind != "LoadBalancer" {
+		return nil, fmt.Errorf("kind %s is not LoadBalancer", lb.Kind)
+	}
+	if lb.Namespace == "" {
+		lb.Namespace = "default"
+	}
+	return lb, nil
+}
+
+// Run validates the manifest read from the reader for the backend, and
+// writes the errors or the summary to the writer. It returns the exit
+// code, 1 if the manifest is invalid or can not be read.
+func Run(in io.Reader, backend core.Provider, out io.Writer) int {
+	data, err := ioutil.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(out, "read manifest error: %v\n", err)
+		return 1
+	}
+	lb, err := Decode(data)
+	if err != nil {
+		fmt.Fprintf(out, "invalid manifest: %v\n", err)
+		return 1
+	}
+	key := lb.Namespace + "/" + lb.Name
+	errs := Validate(lb, backend)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(out, "%s: %v\n", key, e)
+		}
+		fmt.Fprintf(out, "LoadBalancer %s is invalid for %s: %d errors\n", key, backend.Info().Name, len(errs))
+		return 1
+	}
+	writeSummary(out, Summarize(lb, backend))
+	return 0
+}
+
+func writeSummary(out io.Writer, s *Summary) {
+	fmt.Fprintf(out, "LoadBalancer %s is valid for %s\n", s.Key, s.Backend)
+	for _, vip := range s.VIPs {
+		fmt.Fprintf(out, "  vip: %s (%s)", vip.IP, corenet.FamilyOf(vip.IP))
+		if vip.Interface != "" {
+			fmt.Fprintf(out, " on %s", vip.Interface)
+		}
+		fmt.Fprintln(out)
+	}
+	if len(s.Nodes) > 0 {
+		fmt.Fprintf(out, "  nodes: %s\n", strings.Join(s.Nodes, ", "))
+	}
+	for _, p := range s.HTTPPorts {
+		fmt.Fprintf(out, "  %s port %d: service %s:%d", p.Protocol, p.Port, p.Service, p.ServicePort)
+		for _, h := range p.Hosts {
+			fmt.Fprintf(out, ", host %s: service %s:%d", h.Host, h.Service, h.ServicePort)
+		}
+		fmt.Fprintln(out)
+	}
+	for _, p := range s.TCPPorts {
+		if p.Service != "" {
+			fmt.Fprintf(out, "  tcp port %d: service %s:%d\n", p.Port, p.Service, p.ServicePort)
+		} else {
+			fmt.Fprintf(out, "  tcp port %d: node port %d\n", p.Port, p.NodePort)
+		}
+	}
+	for _, p := range s.Ports {
+		fmt.Fprintf(out, "  port: %s\n", p)
+	}
+}
+
+// Command returns the validate command of a provider binary, it validates
+// the manifest of the file argument, or of stdin if it is missing or -,
+// for the backend. The backend needs no cluster, see Validate, so the zero
+// value of the backend type is enough for the in-tree backends.
+func Command(backend core.Provider) cli.Command {
+	return CommandFunc(func() (core.Provider, error) {
+		return backend, nil
+	})
+}
+
+// CommandFunc is Command for the backends which are built from the flags,
+// e.g. a plugin, newBackend is called once the command runs
+func CommandFunc(newBackend func() (core.Provider, error)) cli.Command {
+	return cli.Command{
+		Name:      "validate",
+		Usage:     "validate a LoadBalancer manifest for the provider offline",
+		ArgsUsage: "[FILE]",
+		Action: func(c *cli.Context) error {
+			backend, err := newBackend()
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			in := io.Reader(os.Stdin)
+			if path := c.Args().First(); path != "" && path != "-" {
+				file, err := os.Open(path)
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				defer file.Close()
+				in = file
+			}
+			if code := Run(in, backend, os.Stdout); code != 0 {
+				return cli.NewExitError("", code)
+			}
+			return nil
+		},
+	}
+}
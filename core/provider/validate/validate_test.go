@@ -0,0 +1,226 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	haproxy "github.com/caicloud/loadbalancer-provider/providers/haproxy/provider"
+	ipvsdr "github.com/caicloud/loadbalancer-provider/providers/ipvsdr/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+const manifest = `
+apiVersion: net.caicloud.io/v1alpha1
+kind: LoadBalancer
+metadata:
+  name: lb
+  annotations:
+%s
+spec:
+  type: external
+  nodes:
+    names: [node1, node2]
+  providers:
+    ipvsdr:
+      vip: 10.0.0.100
+      scheduler: rr
+`
+
+// newManifest returns the manifest with the annotations
+func newManifest(annotations ...string) string {
+	lines := make([]string, 0, len(annotations))
+	for _, a := range annotations {
+		lines = append(lines, "    "+a)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "    {}")
+	}
+	return fmt.Sprintf(manifest, strings.Join(lines, "\n"))
+}
+
+// httpBackend terminates HTTP and rejects the http ports below 1024 but 80
+// and 443
+type httpBackend struct {
+	*fake.FakeProvider
+}
+
+func (b *httpBackend) ValidateLoadBalancer(lb *netv1alpha1.LoadBalancer) error {
+	ports, err := core.GetHTTPPorts(lb)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if p.Port < 1024 && p.Port != 80 && p.Port != 443 {
+			return fmt.Errorf("http port %d is reserved", p.Port)
+		}
+	}
+	return nil
+}
+
+func newBackends() (core.Provider, core.Provider) {
+	l4 := fake.NewFakeProvider("l4")
+	l4.SetCapabilities(&core.Capabilities{Protocols: []string{"tcp", "udp"}})
+	http := &httpBackend{fake.NewFakeProvider("http")}
+	http.SetCapabilities(&core.Capabilities{Features: []core.Feature{core.FeatureHTTP, core.FeatureTCPProxy}})
+	return l4, http
+}
+
+func TestRun(t *testing.T) {
+	l4, http := newBackends()
+	ports := `loadbalancer.caicloud.io/ports: '[{"protocol":"TCP","port":8080},{"protocol":"UDP","port":53}]'`
+	httpPorts := `loadbalancer.caicloud.io/http-ports: '[{"port":80,"protocol":"http","service":"web","servicePort":8080}]'`
+	tcpPorts := `loadbalancer.caicloud.io/tcp-ports: '[{"port":3306,"service":"mysql","servicePort":3306}]'`
+
+	tests := []struct {
+		name     string
+		manifest string
+		backend  core.Provider
+		code     int
+		output   []string
+	}{
+		{
+			name:     "l4 ports",
+			manifest: newManifest(ports),
+			backend:  l4,
+			output: []string{
+				"LoadBalancer default/lb is valid for l4",
+				"  vip: 10.0.0.100 (IPv4)",
+				"  nodes: node1, node2",
+				"  port: tcp/8080",
+				"  port: udp/53",
+			},
+		},
+		{
+			name:     "http on l4",
+			manifest: newManifest(httpPorts),
+			backend:  l4,
+			code:     1,
+			output: []string{
+				"default/lb: capabilities: the provider does not support http of the annotation loadbalancer.caicloud.io/http-ports",
+				"LoadBalancer default/lb is invalid for l4: 1 errors",
+			},
+		},
+		{
+			name:     "sctp on l4",
+			manifest: newManifest(`loadbalancer.caicloud.io/ports: '[{"protocol":"SCTP","port":9000}]'`),
+			backend:  l4,
+			code:     1,
+		},
+		{
+			name:     "http ports",
+			manifest: newManifest(httpPorts, tcpPorts),
+			backend:  http,
+			output: []string{
+				"LoadBalancer default/lb is valid for http",
+				"  http port 80: service web:8080",
+				"  tcp port 3306: service mysql:3306",
+			},
+		},
+		{
+			name:     "rejected by the backend",
+			manifest: newManifest(`loadbalancer.caicloud.io/http-ports: '[{"port":81,"protocol":"http","service":"web","servicePort":8080}]'`),
+			backend:  http,
+			code:     1,
+			output: []string{
+				"default/lb: backend: http port 81 is reserved",
+				"LoadBalancer default/lb is invalid for http: 1 errors",
+			},
+		},
+		{
+			name:     "invalid annotations",
+			manifest: newManifest(`loadbalancer.caicloud.io/http-ports: '[{"port":80'`, `loadbalancer.caicloud.io/tcp-ports: 'mysql'`),
+			backend:  http,
+			code:     1,
+			output: []string{
+				"default/lb: metadata.annotations[loadbalancer.caicloud.io/http-ports]: ",
+				"default/lb: metadata.annotations[loadbalancer.caicloud.io/tcp-ports]: ",
+				"LoadBalancer default/lb is invalid for http: 2 errors",
+			},
+		},
+		// the zero values of the backend types the binaries validate with
+		{
+			name:     "l4 ports on ipvsdr",
+			manifest: newManifest(ports),
+			backend:  &ipvsdr.IpvsdrProvider{},
+			output:   []string{"LoadBalancer default/lb is valid for ipvsdr", "  port: udp/53"},
+		},
+		{
+			name:     "http on ipvsdr",
+			manifest: newManifest(httpPorts),
+			backend:  &ipvsdr.IpvsdrProvider{},
+			code:     1,
+			output:   []string{"default/lb: capabilities: the provider does not support http of the annotation loadbalancer.caicloud.io/http-ports"},
+		},
+		{
+			name:     "http ports on haproxy",
+			manifest: newManifest(httpPorts, tcpPorts),
+			backend:  &haproxy.HAProxyProvider{},
+			output:   []string{"LoadBalancer default/lb is valid for haproxy", "  http port 80: service web:8080"},
+		},
+		{
+			name:     "rejected by haproxy",
+			manifest: newManifest(httpPorts, `loadbalancer.caicloud.io/proxy-protocol: '[{"port":443,"accept":true}]'`),
+			backend:  &haproxy.HAProxyProvider{},
+			code:     1,
+			output:   []string{"default/lb: backend: proxy protocol of port 443 which is not served"},
+		},
+		{
+			name:     "invalid spec",
+			manifest: strings.Replace(newManifest(), "vip: 10.0.0.100", "vip: none", 1),
+			backend:  http,
+			code:     1,
+			output:   []string{"default/lb: spec: ipvsdr: vip is invalid"},
+		},
+		{
+			name:     "empty manifest",
+			manifest: "\n",
+			backend:  l4,
+			code:     1,
+			output:   []string{"invalid manifest: empty manifest"},
+		},
+		{
+			name:     "not a LoadBalancer",
+			manifest: "kind: Service\nmetadata:\n  name: web\n",
+			backend:  l4,
+			code:     1,
+			output:   []string{"invalid manifest: kind Service is not LoadBalancer"},
+		},
+	}
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		code := Run(strings.NewReader(tt.manifest), tt.backend, out)
+		assert.Equal(t, tt.code, code, tt.name)
+		for _, line := range tt.output {
+			assert.Contains(t, out.String(), line, tt.name)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	lb, err := Decode([]byte(`{"kind":"LoadBalancer","metadata":{"name":"lb","namespace":"system"}}`))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "system", lb.Namespace)
+		assert.Equal(t, "lb", lb.Name)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strconv"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+const (
+	// AnnotationKeyVIPInterface is the interface the VIPs without their
+	// own one are served on instead of the one of the node. The providers
+	// binding the VIPs create the VLAN subinterface of the form
+	// <parent>.<id> if it does not exist, e.g. bond0.120
+	AnnotationKeyVIPInterface = "loadbalancer.caicloud.io/vip-interface"
+	// AnnotationKeyVIPInterfaceMTU is the MTU of the VLAN subinterface of
+	// AnnotationKeyVIPInterface, the one of the parent if absent
+	AnnotationKeyVIPInterfaceMTU = "loadbalancer.caicloud.io/vip-interface-mtu"
+
+	minMTU = 68
+	maxMTU = 65535
+)
+
+// GetVIPVLAN returns the VLAN subinterface of AnnotationKeyVIPInterface,
+// nil if the interface is absent or not a VLAN subinterface. It returns a
+// PermanentError if the MTU is invalid or set for another interface.
+func GetVIPVLAN(lb *netv1alpha1.LoadBalancer) (*corenet.VLAN, error) {
+	name, ok := lb.Annotations[AnnotationKeyVIPInterface]
+	if !ok {
+		return nil, nil
+	}
+	if name == "" {
+		return nil, NewPermanentError("InvalidVIPInterface", fmt.Errorf("empty vip interface"))
+	}
+	vlan, ok := corenet.ParseVLAN(name)
+	value, hasMTU := lb.Annotations[AnnotationKeyVIPInterfaceMTU]
+	if !hasMTU {
+		if !ok {
+			return nil, nil
+		}
+		return &vlan, nil
+	}
+	if !ok {
+		return nil, NewPermanentError("InvalidVIPInterface", fmt.Errorf("the mtu is only set for the vlan subinterfaces <parent>.<id>, got %q", name))
+	}
+	mtu, err := strconv.Atoi(value)
+	if err != nil || mtu < minMTU || mtu > maxMTU {
+		return nil, NewPermanentError("InvalidVIPInterface", fmt.Errorf("invalid mtu %q of vip interface %s", value, name))
+	}
+	vlan.MTU = mtu
+	return &vlan, nil
+}
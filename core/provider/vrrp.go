@@ -0,0 +1,199 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+)
+
+const (
+	// AnnotationKeyVRRPPriority is the base priority of the nodes in the
+	// VRRP election, the nodes are ranked above it in the order of the
+	// LoadBalancer nodes
+	AnnotationKeyVRRPPriority = "loadbalancer.caicloud.io/vrrp-priority"
+	// AnnotationKeyVRRPPreempt makes a node with a higher priority take the
+	// VIPs back from the master when it recovers, true or false
+	AnnotationKeyVRRPPreempt = "loadbalancer.caicloud.io/vrrp-preempt"
+	// AnnotationKeyVRRPPreemptDelay is the seconds a recovered node waits
+	// before it preempts the master
+	AnnotationKeyVRRPPreemptDelay = "loadbalancer.caicloud.io/vrrp-preempt-delay"
+	// AnnotationKeyVRRPAdvertInt is the interval of the VRRP advertisements
+	// in seconds, e.g. 0.5
+	AnnotationKeyVRRPAdvertInt = "loadbalancer.caicloud.io/vrrp-advert-int"
+	// AnnotationKeyVRRPPreferredNode is the name of the node which is
+	// ranked above the others in the VRRP election
+	AnnotationKeyVRRPPreferredNode = "loadbalancer.caicloud.io/vrrp-preferred-node"
+	// AnnotationKeyVRRPTrackInterfaces is the comma separated interfaces
+	// tracked besides the ones of the VIPs, the node gives up the VIPs once
+	// one of them loses carrier, e.g. bond1,eth2
+	AnnotationKeyVRRPTrackInterfaces = "loadbalancer.caicloud.io/vrrp-track-interfaces"
+	// AnnotationKeyVRRPTrackScript is the tracking of the health of the
+	// dataplane of the node in json. The priority of the node moves by the
+	// weight once the check fails fall times in a row until it succeeds rise
+	// times, the node enters the fault state instead if the weight is zero,
+	// e.g. {"interval": 2, "weight": -20, "fall": 2, "rise": 2}
+	AnnotationKeyVRRPTrackScript = "loadbalancer.caicloud.io/vrrp-track-script"
+)
+
+const (
+	// DefaultVRRPPriority is the default base priority of the nodes
+	DefaultVRRPPriority = 100
+	// MaxVRRPPriority is the highest priority of a node not owning the
+	// VIPs, 255 is reserved for the owner
+	MaxVRRPPriority = 254
+	// DefaultVRRPAdvertInt is the default advertisement interval in seconds
+	DefaultVRRPAdvertInt = 1.0
+
+	// VRRPv3 carries the advertisement interval in centiseconds in 12 bits
+	minVRRPAdvertInt = 0.01
+	maxVRRPAdvertInt = 40.95
+	// keepalived limits preempt_delay to 1000 seconds
+	maxVRRPPreemptDelay = 1000
+
+	// DefaultVRRPTrackInterval is the default interval of the track script
+	// in seconds
+	DefaultVRRPTrackInterval = 2
+	// DefaultVRRPTrackFall and DefaultVRRPTrackRise are the default
+	// consecutive results of the track script changing its state
+	DefaultVRRPTrackFall = 2
+	DefaultVRRPTrackRise = 2
+	// keepalived limits the weights of the track scripts to [-253, 253]
+	maxVRRPTrackWeight   = 253
+	maxVRRPTrackInterval = 3600
+)
+
+// VRRPConfig is the VRRP election settings of the LoadBalancer
+type VRRPConfig struct {
+	Priority      int
+	Preempt       bool
+	PreemptDelay  int
+	AdvertInt     float64
+	PreferredNode string
+}
+
+// GetVRRPConfig returns the VRRP settings in the annotations of the
+// LoadBalancer. It returns a PermanentError if a value is invalid or out of
+// range.
+func GetVRRPConfig(lb *netv1alpha1.LoadBalancer) (*VRRPConfig, error) {
+	cfg := &VRRPConfig{
+		Priority:      DefaultVRRPPriority,
+		AdvertInt:     DefaultVRRPAdvertInt,
+		PreferredNode: lb.Annotations[AnnotationKeyVRRPPreferredNode],
+	}
+
+	if v, ok := lb.Annotations[AnnotationKeyVRRPPriority]; ok {
+		priority, err := strconv.Atoi(v)
+		if err != nil || priority < 1 || priority > MaxVRRPPriority {
+			return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp priority %q, it must be in [1, %d]", v, MaxVRRPPriority))
+		}
+		cfg.Priority = priority
+	}
+	if v, ok := lb.Annotations[AnnotationKeyVRRPPreempt]; ok {
+		preempt, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp preempt %q", v))
+		}
+		cfg.Preempt = preempt
+	}
+	if v, ok := lb.Annotations[AnnotationKeyVRRPPreemptDelay]; ok {
+		delay, err := strconv.Atoi(v)
+		if err != nil || delay < 0 || delay > maxVRRPPreemptDelay {
+			return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp preempt delay %q, it must be in [0, %d]", v, maxVRRPPreemptDelay))
+		}
+		cfg.PreemptDelay = delay
+	}
+	if v, ok := lb.Annotations[AnnotationKeyVRRPAdvertInt]; ok {
+		interval, err := strconv.ParseFloat(v, 64)
+		if err != nil || interval < minVRRPAdvertInt || interval > maxVRRPAdvertInt {
+			return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp advert interval %q, it must be in [%v, %v]", v, minVRRPAdvertInt, maxVRRPAdvertInt))
+		}
+		// centiseconds on the wire
+		cfg.AdvertInt = math.Round(interval*100) / 100
+	}
+	return cfg, nil
+}
+
+// VRRPTrackScript is the tracking of the health of the dataplane by VRRP
+type VRRPTrackScript struct {
+	// Interval is the interval of the checks in seconds, a check times out
+	// after the interval
+	Interval int `json:"interval,omitempty"`
+	// Weight is added to the priority of the node while the check fails if
+	// negative, or while it succeeds if positive. The node enters the fault
+	// state while the check fails if it is zero.
+	Weight int `json:"weight,omitempty"`
+	Fall   int `json:"fall,omitempty"`
+	Rise   int `json:"rise,omitempty"`
+}
+
+// GetVRRPTrackScript returns the track script of the LoadBalancer with the
+// defaults filled, nil if not specified. It returns a PermanentError if it
+// is invalid.
+func GetVRRPTrackScript(lb *netv1alpha1.LoadBalancer) (*VRRPTrackScript, error) {
+	value, ok := lb.Annotations[AnnotationKeyVRRPTrackScript]
+	if !ok {
+		return nil, nil
+	}
+	script := &VRRPTrackScript{}
+	if err := json.Unmarshal([]byte(value), script); err != nil {
+		return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp track script %q: %v", value, err))
+	}
+	if script.Interval == 0 {
+		script.Interval = DefaultVRRPTrackInterval
+	}
+	if script.Fall == 0 {
+		script.Fall = DefaultVRRPTrackFall
+	}
+	if script.Rise == 0 {
+		script.Rise = DefaultVRRPTrackRise
+	}
+	if script.Interval < 0 || script.Interval > maxVRRPTrackInterval {
+		return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp track script interval %d, it must be in [1, %d]", script.Interval, maxVRRPTrackInterval))
+	}
+	if script.Weight < -maxVRRPTrackWeight || script.Weight > maxVRRPTrackWeight {
+		return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp track script weight %d, it must be in [%d, %d]", script.Weight, -maxVRRPTrackWeight, maxVRRPTrackWeight))
+	}
+	if script.Fall < 0 || script.Rise < 0 {
+		return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp track script fall %d or rise %d", script.Fall, script.Rise))
+	}
+	return script, nil
+}
+
+// GetVRRPTrackInterfaces returns the interfaces tracked besides the ones of
+// the VIPs. It returns a PermanentError if an interface name is invalid.
+func GetVRRPTrackInterfaces(lb *netv1alpha1.LoadBalancer) ([]string, error) {
+	value, ok := lb.Annotations[AnnotationKeyVRRPTrackInterfaces]
+	if !ok {
+		return nil, nil
+	}
+	ifaces := make([]string, 0)
+	for _, iface := range strings.Split(value, ",") {
+		iface = strings.TrimSpace(iface)
+		// IFNAMSIZ
+		if iface == "" || len(iface) > 15 || strings.ContainsAny(iface, "/: \t") {
+			return nil, NewPermanentError("InvalidVRRPConfig", fmt.Errorf("invalid vrrp track interface %q", iface))
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
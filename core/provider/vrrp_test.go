@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVRRPConfig(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	cfg, err := GetVRRPConfig(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &VRRPConfig{Priority: 100, AdvertInt: 1}, cfg)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyVRRPPriority:      "150",
+		AnnotationKeyVRRPPreempt:       "true",
+		AnnotationKeyVRRPPreemptDelay:  "30",
+		AnnotationKeyVRRPAdvertInt:     "0.25",
+		AnnotationKeyVRRPPreferredNode: "node-1",
+	}
+	cfg, err = GetVRRPConfig(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &VRRPConfig{Priority: 150, Preempt: true, PreemptDelay: 30, AdvertInt: 0.25, PreferredNode: "node-1"}, cfg)
+
+	for key, values := range map[string][]string{
+		AnnotationKeyVRRPPriority:     {"0", "255", "high"},
+		AnnotationKeyVRRPPreempt:      {"maybe"},
+		AnnotationKeyVRRPPreemptDelay: {"-1", "1001", "1m"},
+		AnnotationKeyVRRPAdvertInt:    {"0", "0.001", "41", "1s"},
+	} {
+		for _, v := range values {
+			lb.Annotations = map[string]string{key: v}
+			_, err := GetVRRPConfig(lb)
+			assert.True(t, IsPermanentError(err), "%s=%s", key, v)
+		}
+	}
+}
+
+func TestGetVRRPTracking(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	script, err := GetVRRPTrackScript(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, script)
+	ifaces, err := GetVRRPTrackInterfaces(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, ifaces)
+
+	lb.Annotations = map[string]string{
+		AnnotationKeyVRRPTrackScript:     `{"weight": -20}`,
+		AnnotationKeyVRRPTrackInterfaces: "bond1, eth2",
+	}
+	script, err = GetVRRPTrackScript(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &VRRPTrackScript{Interval: 2, Weight: -20, Fall: 2, Rise: 2}, script)
+	ifaces, err = GetVRRPTrackInterfaces(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bond1", "eth2"}, ifaces)
+
+	for _, v := range []string{`{"weight": -254}`, `{"weight": 254}`, `{"interval": -1}`, `{"interval": 3601}`, `{"fall": -1}`, `-20`} {
+		lb.Annotations = map[string]string{AnnotationKeyVRRPTrackScript: v}
+		_, err := GetVRRPTrackScript(lb)
+		assert.True(t, IsPermanentError(err), v)
+	}
+	for _, v := range []string{"", "eth0,", "eth0:1", "averyveryverylongname"} {
+		lb.Annotations = map[string]string{AnnotationKeyVRRPTrackInterfaces: v}
+		_, err := GetVRRPTrackInterfaces(lb)
+		assert.True(t, IsPermanentError(err), v)
+	}
+}
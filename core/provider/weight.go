@@ -0,0 +1,159 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// AnnotationKeyWeight is the base weight of a Node as a real server, it
+// is DefaultWeight if absent
+const AnnotationKeyWeight = "loadbalancer.caicloud.io/weight"
+
+// AnnotationKeyDrain drains a Node for a planned maintenance if it is
+// "true", the Node receives no new connections while the established ones
+// are kept, without cordoning it. It is restored at its weight once the
+// annotation is removed.
+const AnnotationKeyDrain = "loadbalancer.caicloud.io/drain"
+
+// IsNodeDraining returns true if the Node is drained by the annotation
+func IsNodeDraining(node *v1.Node) bool {
+	return node.Annotations[AnnotationKeyDrain] == "true"
+}
+
+const (
+	// DefaultWeight is the base weight of the Nodes without the annotation
+	DefaultWeight = 100
+	// MaxWeight is the maximum weight of a real server
+	MaxWeight = 65535
+
+	// WeightConditionUnschedulable holds if the Node is cordoned
+	WeightConditionUnschedulable = "Unschedulable"
+	// WeightConditionNotReady holds if the Ready condition of the Node is
+	// not true
+	WeightConditionNotReady = "NotReady"
+)
+
+// WeightPolicy is the table of the factors the base weight of a Node is
+// multiplied by when the conditions hold. A condition is either one of the
+// WeightCondition constants or a NodeConditionType, e.g. MemoryPressure,
+// which holds if its status is true.
+type WeightPolicy map[string]float64
+
+// DefaultWeightPolicy halves the weight of a cordoned Node or a Node under
+// pressure, and takes a NotReady Node out of the new traffic
+var DefaultWeightPolicy = WeightPolicy{
+	WeightConditionUnschedulable:  0.5,
+	string(v1.NodeMemoryPressure): 0.5,
+	string(v1.NodeDiskPressure):   0.5,
+	WeightConditionNotReady:       0,
+}
+
+// ParseWeightPolicy parses a comma separated list of condition=factor, e.g.
+// Unschedulable=0.5,NotReady=0
+func ParseWeightPolicy(s string) (WeightPolicy, error) {
+	policy := make(WeightPolicy)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid weight policy entry %q, expect condition=factor", kv)
+		}
+		factor, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || factor < 0 || factor > 1 {
+			return nil, fmt.Errorf("invalid factor of condition %s %q, expect a number in [0, 1]", parts[0], parts[1])
+		}
+		policy[strings.TrimSpace(parts[0])] = factor
+	}
+	return policy, nil
+}
+
+// String returns the policy in the form ParseWeightPolicy accepts
+func (p WeightPolicy) String() string {
+	entries := make([]string, 0, len(p))
+	for cond, factor := range p {
+		entries = append(entries, cond+"="+strconv.FormatFloat(factor, 'g', -1, 64))
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// NodeWeight returns the weight of the Node as a real server, zero if it
+// is drained. A Node with a positive weight keeps at least weight 1, so it
+// is never taken out of the new traffic by rounding.
+func (p WeightPolicy) NodeWeight(node *v1.Node) int {
+	if IsNodeDraining(node) {
+		return 0
+	}
+	base := DefaultWeight
+	if value, ok := node.Annotations[AnnotationKeyWeight]; ok {
+		w, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || w < 0 || w > MaxWeight {
+			log.Warn("invalid node weight, use the default one", log.Fields{"node": node.Name, "weight": value, "default": DefaultWeight})
+		} else {
+			base = w
+		}
+	}
+	if base == 0 {
+		return 0
+	}
+
+	weight := float64(base)
+	for _, cond := range nodeConditions(node) {
+		if factor, ok := p[cond]; ok {
+			weight *= factor
+		}
+	}
+	if weight == 0 {
+		return 0
+	}
+	if weight < 1 {
+		return 1
+	}
+	return int(weight)
+}
+
+// nodeConditions returns the conditions holding for the Node
+func nodeConditions(node *v1.Node) []string {
+	conds := make([]string, 0)
+	if node.Spec.Unschedulable {
+		conds = append(conds, WeightConditionUnschedulable)
+	}
+	ready := false
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			ready = c.Status == v1.ConditionTrue
+			continue
+		}
+		if c.Status == v1.ConditionTrue {
+			conds = append(conds, string(c.Type))
+		}
+	}
+	if !ready {
+		conds = append(conds, WeightConditionNotReady)
+	}
+	return conds
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	netlisters "github.com/caicloud/loadbalancer-controller/pkg/listers/networking/v1alpha1"
+	controllerutil "github.com/caicloud/loadbalancer-controller/pkg/util/controller"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestNodeWeight(t *testing.T) {
+	ready := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue}
+	notReady := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse}
+	unknown := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionUnknown}
+	memory := v1.NodeCondition{Type: v1.NodeMemoryPressure, Status: v1.ConditionTrue}
+	noMemory := v1.NodeCondition{Type: v1.NodeMemoryPressure, Status: v1.ConditionFalse}
+	disk := v1.NodeCondition{Type: v1.NodeDiskPressure, Status: v1.ConditionTrue}
+
+	tests := []struct {
+		name          string
+		policy        WeightPolicy
+		weight        string
+		drain         string
+		unschedulable bool
+		conditions    []v1.NodeCondition
+		want          int
+	}{
+		{"ready", nil, "", "", false, []v1.NodeCondition{ready, noMemory}, 100},
+		{"annotation", nil, "30", "", false, []v1.NodeCondition{ready}, 30},
+		{"invalid annotation", nil, "-1", "", false, []v1.NodeCondition{ready}, 100},
+		{"manual zero", nil, "0", "", false, []v1.NodeCondition{ready}, 0},
+		{"unschedulable", nil, "", "", true, []v1.NodeCondition{ready}, 50},
+		{"memory pressure", nil, "", "", false, []v1.NodeCondition{ready, memory}, 50},
+		{"all pressure", nil, "", "", true, []v1.NodeCondition{ready, memory, disk}, 12},
+		{"never rounded to zero", nil, "1", "", true, []v1.NodeCondition{ready, memory, disk}, 1},
+		{"not ready", nil, "", "", false, []v1.NodeCondition{notReady}, 0},
+		{"ready unknown", nil, "", "", false, []v1.NodeCondition{unknown}, 0},
+		{"no ready condition", nil, "", "", false, nil, 0},
+		{"not ready and cordoned", nil, "200", "", true, []v1.NodeCondition{notReady, memory}, 0},
+		{"custom policy", WeightPolicy{WeightConditionUnschedulable: 0, WeightConditionNotReady: 1}, "", "", true, []v1.NodeCondition{ready}, 0},
+		{"custom policy ignores others", WeightPolicy{WeightConditionNotReady: 1}, "", "", false, []v1.NodeCondition{notReady, memory}, 100},
+		{"drained", nil, "200", "true", false, []v1.NodeCondition{ready}, 0},
+		{"not drained", nil, "200", "false", false, []v1.NodeCondition{ready}, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1", Annotations: map[string]string{}},
+				Spec:       v1.NodeSpec{Unschedulable: tt.unschedulable},
+				Status:     v1.NodeStatus{Conditions: tt.conditions},
+			}
+			if tt.weight != "" {
+				node.Annotations[AnnotationKeyWeight] = tt.weight
+			}
+			if tt.drain != "" {
+				node.Annotations[AnnotationKeyDrain] = tt.drain
+			}
+			policy := tt.policy
+			if policy == nil {
+				policy = DefaultWeightPolicy
+			}
+			assert.Equal(t, tt.want, policy.NodeWeight(node))
+		})
+	}
+}
+
+func TestParseWeightPolicy(t *testing.T) {
+	policy, err := ParseWeightPolicy(DefaultWeightPolicy.String())
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultWeightPolicy, policy)
+
+	policy, err = ParseWeightPolicy(" Unschedulable=0 , OutOfDisk=0.25")
+	assert.Nil(t, err)
+	assert.Equal(t, WeightPolicy{"Unschedulable": 0, "OutOfDisk": 0.25}, policy)
+
+	for _, s := range []string{"NotReady", "=0.5", "NotReady=x", "NotReady=2", "NotReady=-1"} {
+		_, err := ParseWeightPolicy(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestNodeDrain(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	node := newEligibilityTestNode("node1", "192.168.1.1", nil)
+	node.ResourceVersion = "1"
+	nodes.Add(node)
+	lb := &netv1alpha1.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}}
+	lb.Spec.Nodes.Names = []string{"node1"}
+	lbs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lbs.Add(lb)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+	patches := []string{}
+	p := &GenericProvider{
+		cfg: &Configuration{
+			LoadBalancerNamespace: "default",
+			LoadBalancerName:      "lb",
+			WeightPolicy:          DefaultWeightPolicy,
+		},
+		lbLister: netlisters.NewLoadBalancerLister(lbs),
+		lister:   StoreLister{Node: v1listers.NewNodeLister(nodes), WeightPolicy: DefaultWeightPolicy},
+		queue:    queue,
+		helper:   controllerutil.NewHelperForKeyFunc(&netv1alpha1.LoadBalancer{}, queue, nil, controllerutil.PassthroughKeyFunc),
+		patchLoadBalancer: func(namespace, name string, patch []byte) error {
+			patches = append(patches, string(patch))
+			return nil
+		},
+	}
+	weights := func() []int {
+		ret := []int{}
+		for _, rs := range p.lister.RealServers(lb.Spec.Nodes.Names, corenet.FamilyIPv4) {
+			ret = append(ret, rs.Weight)
+		}
+		return ret
+	}
+
+	// annotated, the node keeps its connections without new ones
+	drained := newEligibilityTestNode("node1", "192.168.1.1", nil)
+	drained.ResourceVersion = "2"
+	drained.Annotations = map[string]string{AnnotationKeyDrain: "true"}
+	nodes.Update(drained)
+	p.updateNode(node, drained)
+	assert.Equal(t, 1, queue.Len())
+	p.reportDrainingNodes(lb)
+	assert.Equal(t, []string{`{"metadata":{"annotations":{"loadbalancer.caicloud.io/draining-nodes":"node1"}}}`}, patches)
+	assert.Equal(t, []int{0}, weights())
+
+	// the drain lasts over the later syncs
+	lb.Annotations = map[string]string{AnnotationKeyDrainingNodes: "node1"}
+	for i := 0; i < 3; i++ {
+		p.reportDrainingNodes(lb)
+		assert.Equal(t, []int{0}, weights())
+	}
+	assert.Len(t, patches, 1)
+
+	// un-annotated, the node is restored at its weight
+	nodes.Update(node)
+	p.updateNode(drained, node)
+	p.reportDrainingNodes(lb)
+	assert.Equal(t, `{"metadata":{"annotations":{"loadbalancer.caicloud.io/draining-nodes":null}}}`, patches[1])
+	assert.Equal(t, []int{100}, weights())
+}
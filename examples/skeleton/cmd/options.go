@@ -0,0 +1,91 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// Options contains controller options
+type Options struct {
+	Debug                 bool
+	NodeAddressTypes      string
+	HTTPAddress           string
+	Kubeconfig            string
+	LoadBalancerNamespace string
+	LoadBalancerName      string
+	Chaos                 string
+	Record                string
+}
+
+// NewOptions reutrns a new Options
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// AddFlags add flags to app
+func (opts *Options) AddFlags(app *cli.App) {
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "kubeconfig",
+			Usage:       "Path to a kube config. Only required if out-of-cluster.",
+			Destination: &opts.Kubeconfig,
+		},
+		cli.BoolFlag{
+			Name:        "debug",
+			Usage:       "run with debug mode",
+			Destination: &opts.Debug,
+		},
+		cli.StringFlag{
+			Name:        "node-address-types",
+			Value:       "InternalIP",
+			Usage:       "the preference of the node address types resolved for the nodes, overridden by the node annotation loadbalancer.caicloud.io/real-server-ip",
+			Destination: &opts.NodeAddressTypes,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Value:       ":10254",
+			Usage:       "the address serving /metrics and /healthz, empty disables it",
+			Destination: &opts.HTTPAddress,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-namespace",
+			EnvVar:      "LOADBALANCER_NAMESPACE",
+			Usage:       "specify loadbalancer resource namespace",
+			Destination: &opts.LoadBalancerNamespace,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-name",
+			EnvVar:      "LOADBALANCER_NAME",
+			Usage:       "specify loadbalancer resource name",
+			Destination: &opts.LoadBalancerName,
+		},
+		cli.StringFlag{
+			Name:        "chaos",
+			Usage:       "the policy of the faults injected into the backend for resilience testing, e.g. seed=42,update-error-rate=0.1,latency=uniform:10ms-200ms, never set it in production",
+			Destination: &opts.Chaos,
+		},
+		cli.StringFlag{
+			Name:        "record",
+			Usage:       "the file the inputs and the results of the syncs are recorded to, with the secrets redacted, for replaying them offline with the replay command, empty disables it",
+			Destination: &opts.Record,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
+}
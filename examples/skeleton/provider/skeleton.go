@@ -0,0 +1,273 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package provider is the skeleton of a backend, a new backend starts as a
+// copy of it. The skeleton is complete and tested, the parts to replace are
+// marked as the extension points:
+//
+//   - render derives the desired State of the LoadBalancer from its spec
+//     and the nodes read through the StoreLister
+//   - Dataplane.Apply makes the dataplane serve the State
+//   - Dataplane.Cleanup removes the LoadBalancer from the dataplane once it
+//     is deleted
+//
+// The GenericProvider does the rest: it watches the LoadBalancer and the
+// nodes, validates the LoadBalancer, retries the failed syncs and reports
+// the status.
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/examples/skeleton/version"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	_ core.Provider         = &SkeletonProvider{}
+	_ core.FamilyProvider   = &SkeletonProvider{}
+	_ core.DeletionProvider = &SkeletonProvider{}
+	_ core.HealthzProvider  = &SkeletonProvider{}
+)
+
+// Server is a node serving the traffic of the LoadBalancer
+type Server struct {
+	Node   string `json:"node"`
+	IP     string `json:"ip"`
+	Weight int    `json:"weight"`
+}
+
+// State is the desired state of the dataplane for a LoadBalancer, it is
+// all a Dataplane gets to know of the LoadBalancer
+type State struct {
+	VIPs    []string       `json:"vips"`
+	Ports   []corenet.Port `json:"ports"`
+	Servers []Server       `json:"servers"`
+}
+
+// Dataplane is what the skeleton drives, a new backend replaces it by the
+// API of its dataplane. Both methods are idempotent, a failure is retried
+// on the next sync.
+type Dataplane interface {
+	// Apply makes the dataplane serve the desired state of the
+	// LoadBalancer of the key
+	Apply(key string, state *State) error
+	// Cleanup removes the LoadBalancer of the key from the dataplane
+	Cleanup(key string) error
+}
+
+// LogDataplane is a Dataplane which logs the states only
+type LogDataplane struct{}
+
+// Apply logs the state
+func (LogDataplane) Apply(key string, state *State) error {
+	log.Info("Applying state", log.Fields{"lb": key, "vips": state.VIPs, "ports": state.Ports, "servers": state.Servers})
+	return nil
+}
+
+// Cleanup logs the cleanup
+func (LogDataplane) Cleanup(key string) error {
+	log.Info("Cleaning up", log.Fields{"lb": key})
+	return nil
+}
+
+// SkeletonProvider renders the desired State of the LoadBalancer and
+// applies it to a Dataplane, skipping the syncs whose State is applied
+// already
+type SkeletonProvider struct {
+	storeLister core.StoreLister
+	dataplane   Dataplane
+	// checksum skips the syncs whose State is applied already
+	checksum *core.Checksum
+
+	mu      sync.Mutex
+	applied *State
+}
+
+// NewSkeletonProvider creates a new skeleton LoadBalancer Provider applying
+// the States to the dataplane
+func NewSkeletonProvider(dataplane Dataplane) *SkeletonProvider {
+	return &SkeletonProvider{
+		dataplane: dataplane,
+		checksum:  core.NewChecksum("skeleton"),
+	}
+}
+
+// render returns the desired State of the LoadBalancer, it is the first
+// extension point.
+//
+// The LoadBalancer and the objects of the StoreLister are shared with the
+// informers, they are read only: anything changed is copied first, e.g.
+// the names of the nodes are sorted on a copy, and a whole object by
+// api.Scheme.Copy.
+func (p *SkeletonProvider) render(lb *netv1alpha1.LoadBalancer) (*State, error) {
+	vips, err := core.GetVIPs(lb)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{
+		VIPs:    make([]string, 0, len(vips)),
+		Ports:   ports,
+		Servers: make([]Server, 0, len(lb.Spec.Nodes.Names)),
+	}
+	family := corenet.FamilyIPv4
+	for i, vip := range vips {
+		if i == 0 {
+			family = corenet.FamilyOf(vip)
+		}
+		state.VIPs = append(state.VIPs, vip.String())
+	}
+
+	names := append([]string(nil), lb.Spec.Nodes.Names...)
+	sort.Strings(names)
+	ready := make([]string, 0, len(names))
+	for _, name := range names {
+		node, err := p.storeLister.Node.Get(name)
+		if err != nil {
+			log.Warn("skip missing node", log.Fields{"node": name, "err": err})
+			continue
+		}
+		if !isNodeReady(node) {
+			continue
+		}
+		ready = append(ready, name)
+	}
+	// the addresses are selected by the AddressPolicy and the nodes not
+	// eligible are skipped
+	for _, rs := range p.storeLister.RealServers(ready, family) {
+		state.Servers = append(state.Servers, Server{Node: rs.Node, IP: rs.IP.String(), Weight: rs.Weight})
+	}
+	return state, nil
+}
+
+// isNodeReady returns true if the Ready condition of the node is true
+func isNodeReady(node *v1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// OnUpdate renders the State of the LoadBalancer and applies it unless it
+// is applied already
+func (p *SkeletonProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := lb.Namespace + "/" + lb.Name
+	state, err := p.render(lb)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	hash := core.Sum(data)
+	if p.checksum.Unchanged(lb, hash) {
+		return nil
+	}
+
+	if err := p.dataplane.Apply(key, state); err != nil {
+		// the dataplane may be applied partially
+		p.checksum.Invalidate()
+		return fmt.Errorf("apply state of %s error: %v", key, err)
+	}
+	p.applied = state
+	p.checksum.Applied(lb, hash)
+	log.Info("LoadBalancer applied", log.Fields{"lb": key, "servers": len(state.Servers)})
+	return nil
+}
+
+// OnDelete implements core.DeletionProvider, the LoadBalancer is cleaned
+// up from the dataplane
+func (p *SkeletonProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := lb.Namespace + "/" + lb.Name
+	if err := p.dataplane.Cleanup(key); err != nil {
+		return fmt.Errorf("clean up %s error: %v", key, err)
+	}
+	p.applied = nil
+	p.checksum.Invalidate()
+	log.Info("LoadBalancer cleaned up", log.Fields{"lb": key})
+	return nil
+}
+
+// Applied returns the State applied last, nil if none is
+func (p *SkeletonProvider) Applied() *State {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.applied
+}
+
+// Start ...
+func (p *SkeletonProvider) Start() {
+	log.Info("Startting skeleton provider")
+}
+
+// WaitForStart returns immediately, there is nothing to start
+func (p *SkeletonProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the dataplane serving, it is cleaned up on the deletion of
+// the LoadBalancer only
+func (p *SkeletonProvider) Stop() error {
+	log.Info("Shutting down skeleton provider")
+	return nil
+}
+
+// Healthz implements core.HealthzProvider, the provider is always healthy
+func (p *SkeletonProvider) Healthz() error {
+	return nil
+}
+
+// SupportedFamilies implements core.FamilyProvider, every VIP is accepted
+func (p *SkeletonProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *SkeletonProvider) Info() core.Info {
+	return core.Info{
+		Name:       "skeleton",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *SkeletonProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/mocks"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/fake"
+	providertesting "github.com/caicloud/loadbalancer-provider/core/provider/testing"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// recordingDataplane records the calls of the skeleton and fails the
+// applies as scripted
+type recordingDataplane struct {
+	mocks.Recorder
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (d *recordingDataplane) Apply(key string, state *State) error {
+	d.Record("Apply", key, state)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return fmt.Errorf("dataplane busy")
+	}
+	return nil
+}
+
+func (d *recordingDataplane) Cleanup(key string) error {
+	d.Record("Cleanup", key)
+	return nil
+}
+
+// lastApplied returns the State of the last Apply
+func (d *recordingDataplane) lastApplied(t *testing.T) *State {
+	calls := d.Calls("Apply")
+	if len(calls) == 0 {
+		t.Fatalf("no Apply")
+	}
+	return calls[len(calls)-1].Args[1].(*State)
+}
+
+func notReadyNode(name, ip string) *v1.Node {
+	node := fake.NewNode(name, ip)
+	node.Status.Conditions[0].Status = v1.ConditionFalse
+	return node
+}
+
+func TestRender(t *testing.T) {
+	weight := core.DefaultWeightPolicy.NodeWeight(fake.NewNode("node", "192.168.0.1"))
+
+	tests := []struct {
+		name    string
+		lb      *netv1alpha1.LoadBalancer
+		objects []runtime.Object
+		want    *State
+		wantErr bool
+	}{
+		{
+			name:    "sorted nodes",
+			lb:      providertesting.NewLoadBalancer("10.0.0.100", "node2", "node1"),
+			objects: []runtime.Object{fake.NewNode("node1", "192.168.0.1"), fake.NewNode("node2", "192.168.0.2")},
+			want: &State{
+				VIPs:    []string{"10.0.0.100"},
+				Ports:   core.DefaultPorts,
+				Servers: []Server{{"node1", "192.168.0.1", weight}, {"node2", "192.168.0.2", weight}},
+			},
+		},
+		{
+			name:    "not ready and missing nodes",
+			lb:      providertesting.NewLoadBalancer("10.0.0.100", "node1", "node2", "node3"),
+			objects: []runtime.Object{fake.NewNode("node1", "192.168.0.1"), notReadyNode("node2", "192.168.0.2")},
+			want: &State{
+				VIPs:    []string{"10.0.0.100"},
+				Ports:   core.DefaultPorts,
+				Servers: []Server{{"node1", "192.168.0.1", weight}},
+			},
+		},
+		{
+			name: "ports",
+			lb: func() *netv1alpha1.LoadBalancer {
+				lb := providertesting.NewLoadBalancer("10.0.0.100")
+				lb.Annotations = map[string]string{core.AnnotationKeyPorts: `[{"protocol":"UDP","port":53}]`}
+				return lb
+			}(),
+			want: &State{
+				VIPs:    []string{"10.0.0.100"},
+				Ports:   []corenet.Port{{Protocol: "udp", Port: 53}},
+				Servers: []Server{},
+			},
+		},
+		{
+			name:    "invalid vip",
+			lb:      providertesting.NewLoadBalancer("10.0.0"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		p := NewSkeletonProvider(&recordingDataplane{})
+		p.SetListers(fake.NewStoreListerFromObjects(tt.objects...))
+		names := append([]string(nil), tt.lb.Spec.Nodes.Names...)
+
+		state, err := p.render(tt.lb)
+		if tt.wantErr {
+			assert.NotNil(t, err, tt.name)
+			continue
+		}
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.want, state, tt.name)
+		// the LoadBalancer is read only
+		assert.Equal(t, names, tt.lb.Spec.Nodes.Names, tt.name)
+	}
+}
+
+func TestSkeletonProvider(t *testing.T) {
+	dataplane := &recordingDataplane{}
+	env := providertesting.NewTestEnv(t, NewSkeletonProvider(dataplane))
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	env.AddNode("node2", "192.168.0.2")
+	lb := env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1", "node2"))
+	assert.Equal(t, []string{"Apply"}, dataplane.Methods())
+	assert.Equal(t, "default/lb", dataplane.Calls("Apply")[0].Args[0])
+	assert.Len(t, dataplane.lastApplied(t).Servers, 2)
+
+	// a change of the LoadBalancer not changing the State applies nothing
+	env.UpdateLB(lb, func(lb *netv1alpha1.LoadBalancer) {
+		lb.Labels = map[string]string{"team": "network"}
+	})
+	assert.Equal(t, 1, dataplane.CallCount("Apply"))
+
+	tests := []struct {
+		name  string
+		ready bool
+		nodes []string
+	}{
+		{"node2 not ready", false, []string{"node1"}},
+		{"node2 ready again", true, []string{"node1", "node2"}},
+	}
+	for _, tt := range tests {
+		env.SetNodeReady("node2", tt.ready)
+		nodes := make([]string, 0)
+		for _, s := range dataplane.lastApplied(t).Servers {
+			nodes = append(nodes, s.Node)
+		}
+		assert.Equal(t, tt.nodes, nodes, tt.name)
+	}
+
+	env.DeleteLB(lb)
+	if calls := dataplane.Calls("Cleanup"); assert.Len(t, calls, 1) {
+		assert.Equal(t, "default/lb", calls[0].Args[0])
+	}
+}
+
+func TestSkeletonProviderRetried(t *testing.T) {
+	dataplane := &recordingDataplane{failures: 2}
+	backend := NewSkeletonProvider(dataplane)
+	env := providertesting.NewTestEnv(t, backend)
+	defer env.Stop()
+
+	env.AddNode("node1", "192.168.0.1")
+	env.CreateLB(providertesting.NewLoadBalancer("10.0.0.100", "node1"))
+	env.WaitForIdle()
+	assert.Equal(t, 3, dataplane.CallCount("Apply"))
+	assert.Equal(t, dataplane.lastApplied(t), backend.Applied())
+}
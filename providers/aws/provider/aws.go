@@ -0,0 +1,652 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/aws/version"
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var (
+	_ core.Provider         = &AWSProvider{}
+	_ core.ResyncProvider   = &AWSProvider{}
+	_ core.DeletionProvider = &AWSProvider{}
+	_ core.HostnameProvider = &AWSProvider{}
+)
+
+const (
+	// AnnotationKeyHealthCheck is the health check of the target groups in
+	// json, e.g. {"protocol": "http", "port": 8081, "path": "/healthz"}.
+	// The port defaults to the one of the target group, and the interval
+	// in seconds and the thresholds to the ones of AWS.
+	AnnotationKeyHealthCheck = "loadbalancer.caicloud.io/aws-health-check"
+
+	// uidTag tags the resources created for a LoadBalancer with its uid,
+	// the resources tagged otherwise are never touched
+	uidTag = "caicloud.io/loadbalancer-uid"
+	// ownerTag tags the resources with the namespace and the name of the
+	// LoadBalancer for the humans
+	ownerTag = "caicloud.io/loadbalancer"
+
+	// TargetTypeInstance registers the nodes by their instance ids, and
+	// TargetTypeIP by their addresses
+	TargetTypeInstance = "instance"
+	TargetTypeIP       = "ip"
+
+	// DefaultProvisionInterval is the default interval of checking the
+	// network load balancer in provisioning, which takes minutes
+	DefaultProvisionInterval = 15 * time.Second
+
+	stateProvisioning = "provisioning"
+	stateFailed       = "failed"
+)
+
+// Config configures the AWSProvider
+type Config struct {
+	Region string
+	// VPCID is the vpc of the nodes, the target groups are created in it
+	VPCID string
+	// Subnets are the subnets the network load balancer is created in
+	Subnets []string
+	// Scheme is internet-facing or internal, it defaults to
+	// internet-facing
+	Scheme string
+	// TargetType is TargetTypeInstance or TargetTypeIP, it defaults to
+	// TargetTypeInstance
+	TargetType string
+	// Endpoint defaults to the one of Elastic Load Balancing in the region
+	Endpoint string
+	// QPS and Burst limit the requests to AWS
+	QPS   float32
+	Burst int
+	// ProvisionInterval is the interval of checking the network load
+	// balancer in provisioning
+	ProvisionInterval time.Duration
+}
+
+// AWSProvider maps the LoadBalancer onto an AWS Network Load Balancer: a
+// listener and a target group of the nodes per port. The network load
+// balancer in provisioning is checked on the resyncs instead of blocking
+// the sync.
+type AWSProvider struct {
+	cfg         Config
+	client      client
+	storeLister core.StoreLister
+
+	mu           sync.Mutex
+	provisioning bool
+	hostname     string
+	// stale is the target groups of the deleted listeners, they are
+	// deleted until they are gone
+	stale map[string]bool
+}
+
+// NewAWSProvider creates a new AWS LoadBalancer Provider, it signs the
+// requests with the access key in the environment variables or the role of
+// the instance
+func NewAWSProvider(cfg Config) *AWSProvider {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = defaultEndpoint(cfg.Region)
+	}
+	if cfg.QPS <= 0 {
+		cfg.QPS = DefaultQPS
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = DefaultBurst
+	}
+	credentials := envCredentials()
+	if credentials == nil {
+		credentials = newInstanceRoleCredentials(metadataEndpoint)
+	}
+	limiter := flowcontrol.NewTokenBucketRateLimiter(cfg.QPS, cfg.Burst)
+	return newAWSProvider(cfg, newQueryClient(cfg.Endpoint, cfg.Region, credentials, limiter))
+}
+
+func newAWSProvider(cfg Config, c client) *AWSProvider {
+	if cfg.Scheme == "" {
+		cfg.Scheme = "internet-facing"
+	}
+	if cfg.TargetType == "" {
+		cfg.TargetType = TargetTypeInstance
+	}
+	if cfg.ProvisionInterval <= 0 {
+		cfg.ProvisionInterval = DefaultProvisionInterval
+	}
+	return &AWSProvider{cfg: cfg, client: c, stale: make(map[string]bool)}
+}
+
+// shortUID returns the uid of the LoadBalancer without the dashes, cut to
+// n characters to fit the names of AWS
+func shortUID(lb *netv1alpha1.LoadBalancer, n int) string {
+	uid := strings.Replace(string(lb.UID), "-", "", -1)
+	if len(uid) > n {
+		uid = uid[:n]
+	}
+	return uid
+}
+
+// loadBalancerName returns the name of the network load balancer, the
+// names are unique in the region and at most 32 characters
+func loadBalancerName(lb *netv1alpha1.LoadBalancer) string {
+	return "k8s-" + shortUID(lb, 28)
+}
+
+// targetGroupName returns the name of the target group of the port, in at
+// most 32 characters as well
+func targetGroupName(lb *netv1alpha1.LoadBalancer, protocol string, port int) string {
+	return fmt.Sprintf("k8s-%s-%s-%d", shortUID(lb, 16), strings.ToLower(strings.Replace(protocol, "_", "", -1)), port)
+}
+
+func ownerTags(lb *netv1alpha1.LoadBalancer) map[string]string {
+	return map[string]string{
+		uidTag:   string(lb.UID),
+		ownerTag: lb.Namespace + "/" + lb.Name,
+	}
+}
+
+// owned returns true if the resource is created for the LoadBalancer
+func (p *AWSProvider) owned(lb *netv1alpha1.LoadBalancer, arn string) (bool, error) {
+	tags, err := p.client.DescribeTags(arn)
+	if err != nil {
+		return false, err
+	}
+	return tags[uidTag] == string(lb.UID), nil
+}
+
+// checkOwner returns a PermanentError if the resource is not created for
+// the LoadBalancer
+func (p *AWSProvider) checkOwner(lb *netv1alpha1.LoadBalancer, kind, name, arn string) error {
+	owned, err := p.owned(lb, arn)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return core.NewPermanentError("AWSResourceConflict", fmt.Errorf("%s %s is not created for the loadbalancer, it is not tagged %s=%s", kind, name, uidTag, lb.UID))
+	}
+	return nil
+}
+
+// getHealthCheck returns the health check of the target groups in the
+// annotation. It returns a PermanentError if the health check is invalid.
+func getHealthCheck(lb *netv1alpha1.LoadBalancer) (healthCheck, error) {
+	spec := struct {
+		Protocol           string `json:"protocol"`
+		Port               int    `json:"port"`
+		Path               string `json:"path"`
+		Interval           int    `json:"interval"`
+		HealthyThreshold   int    `json:"healthyThreshold"`
+		UnhealthyThreshold int    `json:"unhealthyThreshold"`
+	}{
+		Protocol:           "tcp",
+		Interval:           30,
+		HealthyThreshold:   3,
+		UnhealthyThreshold: 3,
+	}
+	if value, ok := lb.Annotations[AnnotationKeyHealthCheck]; ok {
+		if err := json.Unmarshal([]byte(value), &spec); err != nil {
+			return healthCheck{}, core.NewPermanentError("InvalidAWSHealthCheck", fmt.Errorf("invalid health check %q: %v", value, err))
+		}
+	}
+
+	hc := healthCheck{
+		Protocol:           strings.ToUpper(spec.Protocol),
+		Port:               "traffic-port",
+		IntervalSeconds:    spec.Interval,
+		HealthyThreshold:   spec.HealthyThreshold,
+		UnhealthyThreshold: spec.UnhealthyThreshold,
+	}
+	switch hc.Protocol {
+	case "TCP":
+	case "HTTP", "HTTPS":
+		hc.Path = spec.Path
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+	default:
+		return healthCheck{}, core.NewPermanentError("InvalidAWSHealthCheck", fmt.Errorf("invalid health check protocol %q, it must be tcp, http or https", spec.Protocol))
+	}
+	if spec.Port < 0 || spec.Port > 65535 {
+		return healthCheck{}, core.NewPermanentError("InvalidAWSHealthCheck", fmt.Errorf("invalid health check port %d", spec.Port))
+	}
+	if spec.Port != 0 {
+		hc.Port = strconv.Itoa(spec.Port)
+	}
+	// the network load balancers check every 10 or 30 seconds only
+	if hc.IntervalSeconds != 10 && hc.IntervalSeconds != 30 {
+		return healthCheck{}, core.NewPermanentError("InvalidAWSHealthCheck", fmt.Errorf("invalid health check interval %d, it must be 10 or 30", hc.IntervalSeconds))
+	}
+	for _, threshold := range []int{hc.HealthyThreshold, hc.UnhealthyThreshold} {
+		if threshold < 2 || threshold > 10 {
+			return healthCheck{}, core.NewPermanentError("InvalidAWSHealthCheck", fmt.Errorf("invalid health check threshold %d, it must be in [2, 10]", threshold))
+		}
+	}
+	return hc, nil
+}
+
+// desiredListeners returns the listeners of the ports with their target
+// groups, the tcp and udp ports of the same number share a TCP_UDP listener
+// since the network load balancers listen on a port once
+func (p *AWSProvider) desiredListeners(lb *netv1alpha1.LoadBalancer, ports []corenet.Port, hc healthCheck) []targetGroup {
+	protocols := make(map[int]string, len(ports))
+	for _, port := range ports {
+		protocol := strings.ToUpper(port.Protocol)
+		if cur, ok := protocols[int(port.Port)]; ok && cur != protocol {
+			protocol = "TCP_UDP"
+		}
+		protocols[int(port.Port)] = protocol
+	}
+
+	tgs := make([]targetGroup, 0, len(protocols))
+	for port, protocol := range protocols {
+		tgs = append(tgs, targetGroup{
+			Name:        targetGroupName(lb, protocol, port),
+			Protocol:    protocol,
+			Port:        port,
+			TargetType:  p.cfg.TargetType,
+			healthCheck: hc,
+		})
+	}
+	sort.Slice(tgs, func(i, j int) bool { return tgs[i].Port < tgs[j].Port })
+	return tgs
+}
+
+// instanceID returns the id of the EC2 instance of the node in its
+// provider id, e.g. aws:///us-east-1a/i-0123456789abcdef0
+func instanceID(node *v1.Node) string {
+	id := node.Spec.ProviderID
+	if !strings.HasPrefix(id, "aws://") {
+		return ""
+	}
+	id = id[strings.LastIndex(id, "/")+1:]
+	if !strings.HasPrefix(id, "i-") {
+		return ""
+	}
+	return id
+}
+
+// desiredTargets returns the ids of the targets of the nodes, the nodes
+// weighted to zero, e.g. not ready, are left out
+func (p *AWSProvider) desiredTargets(lb *netv1alpha1.LoadBalancer) []string {
+	ids := make([]string, 0, len(lb.Spec.Nodes.Names))
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, corenet.FamilyIPv4) {
+		if rs.Weight == 0 {
+			continue
+		}
+		if p.cfg.TargetType == TargetTypeIP {
+			ids = append(ids, rs.IP.String())
+			continue
+		}
+		node, err := p.storeLister.Node.Get(rs.Node)
+		if err != nil {
+			continue
+		}
+		id := instanceID(node)
+		if id == "" {
+			log.Warn("skip node without an aws instance id", log.Fields{"node": rs.Node, "providerID": node.Spec.ProviderID})
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// OnUpdate ensures the network load balancer of the LoadBalancer, the
+// listeners and the target groups are ensured once it is active
+func (p *AWSProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return err
+	}
+	hc, err := getHealthCheck(lb)
+	if err != nil {
+		return err
+	}
+
+	nlb, err := p.ensureLoadBalancer(lb)
+	if err != nil {
+		return err
+	}
+	p.provisioning = nlb.State == stateProvisioning
+	switch nlb.State {
+	case stateProvisioning:
+		log.Info("aws network load balancer in provisioning", log.Fields{"name": nlb.Name})
+		return nil
+	case stateFailed:
+		return core.NewPermanentError("AWSLoadBalancerFailed", fmt.Errorf("network load balancer %s failed to provision", nlb.Name))
+	}
+	p.hostname = nlb.DNSName
+
+	if err := p.ensureListeners(lb, nlb, p.desiredListeners(lb, ports, hc), p.desiredTargets(lb)); err != nil {
+		return err
+	}
+	return p.deleteStale(lb)
+}
+
+// ensureLoadBalancer returns the network load balancer of the LoadBalancer,
+// it is created if absent and adopted if it is tagged with the uid
+func (p *AWSProvider) ensureLoadBalancer(lb *netv1alpha1.LoadBalancer) (*loadBalancer, error) {
+	name := loadBalancerName(lb)
+	nlb, err := p.client.DescribeLoadBalancer(name)
+	if err != nil {
+		return nil, err
+	}
+	if nlb != nil {
+		return nlb, p.checkOwner(lb, "network load balancer", name, nlb.ARN)
+	}
+
+	log.Info("Creating aws network load balancer", log.Fields{"name": name, "scheme": p.cfg.Scheme, "subnets": p.cfg.Subnets})
+	return p.client.CreateLoadBalancer(name, p.cfg.Scheme, p.cfg.Subnets, ownerTags(lb))
+}
+
+// ensureListeners ensures a listener forwarding to the target group of the
+// nodes per port, the listeners of the other ports are deleted
+func (p *AWSProvider) ensureListeners(lb *netv1alpha1.LoadBalancer, nlb *loadBalancer, desired []targetGroup, ids []string) error {
+	listeners, err := p.client.DescribeListeners(nlb.ARN)
+	if err != nil {
+		return err
+	}
+	byPort := make(map[int]listener, len(listeners))
+	for _, l := range listeners {
+		byPort[l.Port] = l
+	}
+
+	inUse := make(map[string]bool, len(desired))
+	for _, want := range desired {
+		tg, err := p.ensureTargetGroup(lb, want)
+		if err != nil {
+			return err
+		}
+		inUse[tg.ARN] = true
+		if err := p.ensureTargets(tg, ids); err != nil {
+			return err
+		}
+
+		l, ok := byPort[want.Port]
+		delete(byPort, want.Port)
+		switch {
+		case ok && l.Protocol == want.Protocol && l.TargetGroupARN == tg.ARN:
+			continue
+		case ok && l.Protocol == want.Protocol:
+			log.Info("Updating aws listener", log.Fields{"port": l.Port, "targetGroup": tg.Name})
+			p.stale[l.TargetGroupARN] = true
+			l.TargetGroupARN = tg.ARN
+			if err := p.client.ModifyListener(l); err != nil {
+				return err
+			}
+			continue
+		case ok:
+			// the protocol of a listener is changed by replacing it
+			if err := p.deleteListener(l); err != nil {
+				return err
+			}
+		}
+		log.Info("Creating aws listener", log.Fields{"protocol": want.Protocol, "port": want.Port, "targetGroup": tg.Name})
+		if err := p.client.CreateListener(nlb.ARN, listener{Protocol: want.Protocol, Port: want.Port, TargetGroupARN: tg.ARN}); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range byPort {
+		if err := p.deleteListener(l); err != nil {
+			return err
+		}
+	}
+	for arn := range inUse {
+		delete(p.stale, arn)
+	}
+	return nil
+}
+
+// deleteListener deletes the listener, its target group is deleted later
+func (p *AWSProvider) deleteListener(l listener) error {
+	log.Info("Deleting aws listener", log.Fields{"protocol": l.Protocol, "port": l.Port})
+	if err := p.client.DeleteListener(l.ARN); err != nil {
+		return err
+	}
+	if l.TargetGroupARN != "" {
+		p.stale[l.TargetGroupARN] = true
+	}
+	return nil
+}
+
+// ensureTargetGroup returns the target group of the port, it is created if
+// absent and its health check is updated if changed
+func (p *AWSProvider) ensureTargetGroup(lb *netv1alpha1.LoadBalancer, want targetGroup) (*targetGroup, error) {
+	tg, err := p.client.DescribeTargetGroup(want.Name)
+	if err != nil {
+		return nil, err
+	}
+	if tg == nil {
+		log.Info("Creating aws target group", log.Fields{"name": want.Name, "protocol": want.Protocol, "port": want.Port})
+		return p.client.CreateTargetGroup(want, p.cfg.VPCID, ownerTags(lb))
+	}
+	if err := p.checkOwner(lb, "target group", want.Name, tg.ARN); err != nil {
+		return nil, err
+	}
+	if tg.healthCheck != want.healthCheck {
+		log.Info("Updating aws target group health check", log.Fields{"name": want.Name, "healthCheck": want.healthCheck})
+		want.ARN = tg.ARN
+		if err := p.client.ModifyTargetGroup(want); err != nil {
+			return nil, err
+		}
+	}
+	return tg, nil
+}
+
+// ensureTargets registers the nodes on the port of the target group, and
+// deregisters the others
+func (p *AWSProvider) ensureTargets(tg *targetGroup, ids []string) error {
+	cur, err := p.client.DescribeTargets(tg.ARN)
+	if err != nil {
+		return err
+	}
+	registered := make(map[target]bool, len(cur))
+	for _, t := range cur {
+		registered[t] = true
+	}
+
+	register := make([]target, 0)
+	for _, id := range ids {
+		t := target{ID: id, Port: tg.Port}
+		if registered[t] {
+			delete(registered, t)
+			continue
+		}
+		register = append(register, t)
+	}
+	deregister := make([]target, 0, len(registered))
+	for t := range registered {
+		deregister = append(deregister, t)
+	}
+	sort.Slice(deregister, func(i, j int) bool { return deregister[i].String() < deregister[j].String() })
+
+	if len(register) > 0 {
+		log.Info("Registering aws targets", log.Fields{"targetGroup": tg.Name, "targets": register})
+		if err := p.client.RegisterTargets(tg.ARN, register); err != nil {
+			return err
+		}
+	}
+	if len(deregister) > 0 {
+		log.Info("Deregistering aws targets", log.Fields{"targetGroup": tg.Name, "targets": deregister})
+		if err := p.client.DeregisterTargets(tg.ARN, deregister); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteStale deletes the target groups of the deleted listeners which are
+// created for the LoadBalancer
+func (p *AWSProvider) deleteStale(lb *netv1alpha1.LoadBalancer) error {
+	arns := make([]string, 0, len(p.stale))
+	for arn := range p.stale {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+	for _, arn := range arns {
+		if err := p.deleteTargetGroup(lb, arn); err != nil {
+			return err
+		}
+		delete(p.stale, arn)
+	}
+	return nil
+}
+
+// deleteTargetGroup deletes the target group if it is created for the
+// LoadBalancer
+func (p *AWSProvider) deleteTargetGroup(lb *netv1alpha1.LoadBalancer, arn string) error {
+	owned, err := p.owned(lb, arn)
+	if isErrorCode(err, "TargetGroupNotFound") {
+		return nil
+	}
+	if err != nil || !owned {
+		return err
+	}
+	log.Info("Deleting aws target group", log.Fields{"arn": arn})
+	return p.client.DeleteTargetGroup(arn)
+}
+
+// OnDelete implements core.DeletionProvider, the network load balancer and
+// the target groups created for the LoadBalancer are deleted
+func (p *AWSProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := loadBalancerName(lb)
+	nlb, err := p.client.DescribeLoadBalancer(name)
+	if err != nil {
+		return err
+	}
+	if nlb != nil {
+		owned, err := p.owned(lb, nlb.ARN)
+		if err != nil {
+			return err
+		}
+		if owned {
+			listeners, err := p.client.DescribeListeners(nlb.ARN)
+			if err != nil {
+				return err
+			}
+			for _, l := range listeners {
+				if l.TargetGroupARN != "" {
+					p.stale[l.TargetGroupARN] = true
+				}
+			}
+			log.Info("Deleting aws network load balancer", log.Fields{"name": name})
+			// the listeners are deleted with the load balancer
+			if err := p.client.DeleteLoadBalancer(nlb.ARN); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the target groups of the current ports are looked up by the names in
+	// case the listeners are gone before
+	if ports, err := core.GetPorts(lb); err == nil {
+		for _, want := range p.desiredListeners(lb, ports, healthCheck{}) {
+			tg, err := p.client.DescribeTargetGroup(want.Name)
+			if err != nil {
+				return err
+			}
+			if tg != nil {
+				p.stale[tg.ARN] = true
+			}
+		}
+	}
+	// the target groups are in use until the deletion of the load balancer
+	// completes, they are retried on the error
+	if err := p.deleteStale(lb); err != nil {
+		return err
+	}
+
+	p.provisioning = false
+	p.hostname = ""
+	return nil
+}
+
+// ResyncAfter implements core.ResyncProvider, the network load balancer in
+// provisioning is checked on the resyncs
+func (p *AWSProvider) ResyncAfter() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.provisioning {
+		return p.cfg.ProvisionInterval
+	}
+	return 0
+}
+
+// Hostname implements core.HostnameProvider, the addresses of the network
+// load balancers are resolved by its DNS name
+func (p *AWSProvider) Hostname() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hostname
+}
+
+// Start ...
+func (p *AWSProvider) Start() {
+	log.Info("Startting aws provider")
+}
+
+// WaitForStart ...
+func (p *AWSProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the AWS resources alone, they outlive the provider and are
+// deleted with the LoadBalancer
+func (p *AWSProvider) Stop() error {
+	log.Info("Shutting down aws provider")
+	return nil
+}
+
+// Info ...
+func (p *AWSProvider) Info() core.Info {
+	return core.Info{
+		Name:       "aws",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *AWSProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
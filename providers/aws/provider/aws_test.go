@@ -0,0 +1,471 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testUID    = "7c1d0f4e-1111-2222-3333-444455556666"
+	testLBName = "k8s-7c1d0f4e11112222333344445555"
+)
+
+// fakeClient is an in-memory Elastic Load Balancing, the load balancers
+// created are in provisioning until activated
+type fakeClient struct {
+	mu        sync.Mutex
+	seq       int
+	lbs       map[string]*loadBalancer
+	tags      map[string]map[string]string
+	listeners map[string]*listener
+	// lbOf is the load balancer arn of the listeners
+	lbOf    map[string]string
+	tgs     map[string]*targetGroup
+	targets map[string][]target
+	calls   []string
+}
+
+var _ client = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		lbs:       make(map[string]*loadBalancer),
+		tags:      make(map[string]map[string]string),
+		listeners: make(map[string]*listener),
+		lbOf:      make(map[string]string),
+		tgs:       make(map[string]*targetGroup),
+		targets:   make(map[string][]target),
+	}
+}
+
+func (f *fakeClient) arn(kind, name string) string {
+	f.seq++
+	return fmt.Sprintf("arn:aws:elasticloadbalancing:us-east-1:123456789012:%s/%s/%d", kind, name, f.seq)
+}
+
+func (f *fakeClient) call(format string, args ...interface{}) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeClient) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// activate finishes the provisioning of the load balancers
+func (f *fakeClient) activate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, lb := range f.lbs {
+		lb.State = "active"
+	}
+}
+
+func (f *fakeClient) DescribeLoadBalancer(name string) (*loadBalancer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lb, ok := f.lbs[name]
+	if !ok {
+		return nil, nil
+	}
+	copied := *lb
+	return &copied, nil
+}
+
+func (f *fakeClient) CreateLoadBalancer(name, scheme string, subnets []string, tags map[string]string) (*loadBalancer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("CreateLoadBalancer %s %s %v", name, scheme, subnets)
+	lb := &loadBalancer{ARN: f.arn("loadbalancer/net", name), Name: name, DNSName: name + ".elb.us-east-1.amazonaws.com", State: "provisioning"}
+	f.lbs[name] = lb
+	f.tags[lb.ARN] = tags
+	copied := *lb
+	return &copied, nil
+}
+
+func (f *fakeClient) DeleteLoadBalancer(arn string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("DeleteLoadBalancer %s", arn)
+	for name, lb := range f.lbs {
+		if lb.ARN == arn {
+			delete(f.lbs, name)
+		}
+	}
+	for l, lbARN := range f.lbOf {
+		if lbARN == arn {
+			delete(f.listeners, l)
+			delete(f.lbOf, l)
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) DescribeTags(arn string) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tags, ok := f.tags[arn]
+	if !ok {
+		return nil, &apiError{Code: "TargetGroupNotFound"}
+	}
+	return tags, nil
+}
+
+func (f *fakeClient) DescribeListeners(lbARN string) ([]listener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []listener{}
+	for arn, l := range f.listeners {
+		if f.lbOf[arn] == lbARN {
+			ret = append(ret, *l)
+		}
+	}
+	return ret, nil
+}
+
+func (f *fakeClient) CreateListener(lbARN string, l listener) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("CreateListener %s/%d", l.Protocol, l.Port)
+	l.ARN = f.arn("listener/net", fmt.Sprint(l.Port))
+	f.listeners[l.ARN] = &l
+	f.lbOf[l.ARN] = lbARN
+	return nil
+}
+
+func (f *fakeClient) ModifyListener(l listener) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("ModifyListener %s/%d", l.Protocol, l.Port)
+	f.listeners[l.ARN].TargetGroupARN = l.TargetGroupARN
+	return nil
+}
+
+func (f *fakeClient) DeleteListener(arn string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	l := f.listeners[arn]
+	f.call("DeleteListener %s/%d", l.Protocol, l.Port)
+	delete(f.listeners, arn)
+	delete(f.lbOf, arn)
+	return nil
+}
+
+func (f *fakeClient) DescribeTargetGroup(name string) (*targetGroup, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tg, ok := f.tgs[name]
+	if !ok {
+		return nil, nil
+	}
+	copied := *tg
+	return &copied, nil
+}
+
+func (f *fakeClient) CreateTargetGroup(tg targetGroup, vpcID string, tags map[string]string) (*targetGroup, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("CreateTargetGroup %s %s", tg.Name, vpcID)
+	tg.ARN = f.arn("targetgroup", tg.Name)
+	f.tgs[tg.Name] = &tg
+	f.tags[tg.ARN] = tags
+	copied := tg
+	return &copied, nil
+}
+
+func (f *fakeClient) ModifyTargetGroup(tg targetGroup) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("ModifyTargetGroup %s", tg.Name)
+	f.tgs[tg.Name].healthCheck = tg.healthCheck
+	return nil
+}
+
+func (f *fakeClient) DeleteTargetGroup(arn string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range f.listeners {
+		if l.TargetGroupARN == arn {
+			return &apiError{Code: "ResourceInUse", Message: "target group is in use by a listener"}
+		}
+	}
+	for name, tg := range f.tgs {
+		if tg.ARN == arn {
+			f.call("DeleteTargetGroup %s", name)
+			delete(f.tgs, name)
+			delete(f.tags, arn)
+			delete(f.targets, arn)
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) DescribeTargets(tgARN string) ([]target, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]target{}, f.targets[tgARN]...), nil
+}
+
+func (f *fakeClient) RegisterTargets(tgARN string, targets []target) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("RegisterTargets %s %v", f.tgName(tgARN), targets)
+	f.targets[tgARN] = append(f.targets[tgARN], targets...)
+	return nil
+}
+
+func (f *fakeClient) DeregisterTargets(tgARN string, targets []target) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.call("DeregisterTargets %s %v", f.tgName(tgARN), targets)
+	remove := make(map[target]bool, len(targets))
+	for _, t := range targets {
+		remove[t] = true
+	}
+	kept := []target{}
+	for _, t := range f.targets[tgARN] {
+		if !remove[t] {
+			kept = append(kept, t)
+		}
+	}
+	f.targets[tgARN] = kept
+	return nil
+}
+
+func (f *fakeClient) tgName(arn string) string {
+	for name, tg := range f.tgs {
+		if tg.ARN == arn {
+			return name
+		}
+	}
+	return arn
+}
+
+// forwarding returns the listeners with the target groups and their targets
+func (f *fakeClient) forwarding() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []string{}
+	for _, l := range f.listeners {
+		targets := []string{}
+		for _, t := range f.targets[l.TargetGroupARN] {
+			targets = append(targets, t.String())
+		}
+		sort.Strings(targets)
+		ret = append(ret, fmt.Sprintf("%s/%d -> %s %v", l.Protocol, l.Port, f.tgName(l.TargetGroupARN), targets))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func newTestNode(name, ip, instance string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instance},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", UID: types.UID(testUID), Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func newTestProvider(c client, nodes cache.Indexer) *AWSProvider {
+	p := newAWSProvider(Config{Region: "us-east-1", VPCID: "vpc-1", Subnets: []string{"subnet-a", "subnet-b"}}, c)
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	return p
+}
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func TestOnUpdate(t *testing.T) {
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", "i-1", true))
+	nodes.Add(newTestNode("node2", "10.0.0.2", "i-2", true))
+	c := newFakeClient()
+	p := newTestProvider(c, nodes)
+	lb := newTestLoadBalancer("node1", "node2")
+
+	// create, the provisioning is checked on the resyncs
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"CreateLoadBalancer " + testLBName + " internet-facing [subnet-a subnet-b]"}, c.Calls())
+	assert.Equal(t, DefaultProvisionInterval, p.ResyncAfter())
+	assert.Equal(t, "", p.Hostname())
+	assert.Equal(t, testUID, c.tags[c.lbs[testLBName].ARN][uidTag])
+
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+
+	c.activate()
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"CreateTargetGroup k8s-7c1d0f4e11112222-tcp-80 vpc-1",
+		"RegisterTargets k8s-7c1d0f4e11112222-tcp-80 [i-1:80 i-2:80]",
+		"CreateListener TCP/80",
+		"CreateTargetGroup k8s-7c1d0f4e11112222-tcp-443 vpc-1",
+		"RegisterTargets k8s-7c1d0f4e11112222-tcp-443 [i-1:443 i-2:443]",
+		"CreateListener TCP/443",
+	}, c.Calls())
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+	assert.Equal(t, testLBName+".elb.us-east-1.amazonaws.com", p.Hostname())
+	assert.Equal(t, healthCheck{Protocol: "TCP", Port: "traffic-port", IntervalSeconds: 30, HealthyThreshold: 3, UnhealthyThreshold: 3}, c.tgs["k8s-7c1d0f4e11112222-tcp-80"].healthCheck)
+
+	// idempotent, also for a new provider adopting the resources
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+	p = newTestProvider(c, nodes)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+
+	// listener update, the tcp and udp 53 share a listener
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"tcp","port":53},{"protocol":"udp","port":53}]`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"CreateTargetGroup k8s-7c1d0f4e11112222-tcpudp-53 vpc-1",
+		"RegisterTargets k8s-7c1d0f4e11112222-tcpudp-53 [i-1:53 i-2:53]",
+		"CreateListener TCP_UDP/53",
+		"DeleteListener TCP/443",
+		"DeleteTargetGroup k8s-7c1d0f4e11112222-tcp-443",
+	}, c.Calls())
+	assert.Equal(t, []string{
+		"TCP/80 -> k8s-7c1d0f4e11112222-tcp-80 [i-1:80 i-2:80]",
+		"TCP_UDP/53 -> k8s-7c1d0f4e11112222-tcpudp-53 [i-1:53 i-2:53]",
+	}, c.forwarding())
+
+	// health check update
+	lb.Annotations[AnnotationKeyHealthCheck] = `{"protocol":"http","port":8081,"path":"/healthz","interval":10}`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"ModifyTargetGroup k8s-7c1d0f4e11112222-tcpudp-53",
+		"ModifyTargetGroup k8s-7c1d0f4e11112222-tcp-80",
+	}, c.Calls())
+	assert.Equal(t, healthCheck{Protocol: "HTTP", Port: "8081", Path: "/healthz", IntervalSeconds: 10, HealthyThreshold: 3, UnhealthyThreshold: 3}, c.tgs["k8s-7c1d0f4e11112222-tcp-80"].healthCheck)
+
+	lb.Annotations[AnnotationKeyHealthCheck] = `{"interval":5}`
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	delete(lb.Annotations, AnnotationKeyHealthCheck)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, c.Calls(), 2)
+
+	// target registration and deregistration
+	nodes.Add(newTestNode("node3", "10.0.0.3", "i-3", true))
+	lb.Spec.Nodes.Names = []string{"node1", "node2", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"RegisterTargets k8s-7c1d0f4e11112222-tcpudp-53 [i-3:53]",
+		"RegisterTargets k8s-7c1d0f4e11112222-tcp-80 [i-3:80]",
+	}, c.Calls())
+
+	nodes.Update(newTestNode("node1", "10.0.0.1", "i-1", false))
+	lb.Spec.Nodes.Names = []string{"node1", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"DeregisterTargets k8s-7c1d0f4e11112222-tcpudp-53 [i-1:53 i-2:53]",
+		"DeregisterTargets k8s-7c1d0f4e11112222-tcp-80 [i-1:80 i-2:80]",
+	}, c.Calls())
+	assert.Equal(t, []string{
+		"TCP/80 -> k8s-7c1d0f4e11112222-tcp-80 [i-3:80]",
+		"TCP_UDP/53 -> k8s-7c1d0f4e11112222-tcpudp-53 [i-3:53]",
+	}, c.forwarding())
+
+	// teardown, a foreign target group of the same name is left alone
+	c.tgs["k8s-7c1d0f4e11112222-tcp-443"] = &targetGroup{ARN: "foreign", Name: "k8s-7c1d0f4e11112222-tcp-443"}
+	c.tags["foreign"] = map[string]string{uidTag: "other"}
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"tcp","port":443},{"protocol":"udp","port":53}]`
+	assert.Nil(t, p.OnDelete(lb))
+	calls := c.Calls()
+	assert.Equal(t, "DeleteLoadBalancer "+"arn:aws:elasticloadbalancing:us-east-1:123456789012:loadbalancer/net/"+testLBName+"/1", calls[0])
+	assert.Equal(t, []string{"DeleteTargetGroup k8s-7c1d0f4e11112222-tcp-80", "DeleteTargetGroup k8s-7c1d0f4e11112222-tcpudp-53"}, calls[1:])
+	assert.Empty(t, c.lbs)
+	assert.Len(t, c.tgs, 1)
+	assert.Equal(t, "", p.Hostname())
+
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Empty(t, c.Calls())
+}
+
+func TestOnUpdateConflict(t *testing.T) {
+	c := newFakeClient()
+	c.CreateLoadBalancer(testLBName, "internal", nil, map[string]string{uidTag: "other"})
+	c.activate()
+	c.Calls()
+	p := newTestProvider(c, newIndexer())
+	lb := newTestLoadBalancer()
+
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Contains(t, err.Error(), "network load balancer "+testLBName+" is not created for the loadbalancer")
+	assert.Empty(t, c.Calls())
+
+	// the foreign load balancer is left alone
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Empty(t, c.Calls())
+	assert.Len(t, c.lbs, 1)
+}
+
+func TestDesiredTargetsByIP(t *testing.T) {
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", "i-1", true))
+	nodes.Add(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.2"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	})
+	p := newTestProvider(newFakeClient(), nodes)
+	lb := newTestLoadBalancer("node1", "node2")
+
+	// the node without an instance id is skipped
+	assert.Equal(t, []string{"i-1"}, p.desiredTargets(lb))
+
+	p.cfg.TargetType = TargetTypeIP
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, p.desiredTargets(lb))
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// apiVersion is the version of the Elastic Load Balancing v2 api
+	apiVersion = "2015-12-01"
+	service    = "elasticloadbalancing"
+
+	requestTimeout = 30 * time.Second
+
+	// DefaultQPS and DefaultBurst limit the requests to AWS, the api
+	// throttles the account as a whole
+	DefaultQPS   = 5
+	DefaultBurst = 10
+
+	// maxAttempts and baseBackoff bound the retries of the throttled
+	// requests, the delay doubles on every attempt
+	maxAttempts = 5
+	baseBackoff = 500 * time.Millisecond
+)
+
+// loadBalancer is an Elastic Load Balancer of the network type
+type loadBalancer struct {
+	ARN     string `xml:"LoadBalancerArn"`
+	Name    string `xml:"LoadBalancerName"`
+	DNSName string `xml:"DNSName"`
+	// State is one of provisioning, active, active_impaired and failed
+	State string `xml:"State>Code"`
+}
+
+// listener forwards a port of the load balancer to a target group
+type listener struct {
+	ARN            string `xml:"ListenerArn"`
+	Protocol       string `xml:"Protocol"`
+	Port           int    `xml:"Port"`
+	TargetGroupARN string `xml:"DefaultActions>member>TargetGroupArn"`
+}
+
+// healthCheck is the health check settings of a target group
+type healthCheck struct {
+	Protocol string `xml:"HealthCheckProtocol"`
+	// Port is traffic-port or a port number
+	Port               string `xml:"HealthCheckPort"`
+	Path               string `xml:"HealthCheckPath"`
+	IntervalSeconds    int    `xml:"HealthCheckIntervalSeconds"`
+	HealthyThreshold   int    `xml:"HealthyThresholdCount"`
+	UnhealthyThreshold int    `xml:"UnhealthyThresholdCount"`
+}
+
+// targetGroup is the targets serving a listener
+type targetGroup struct {
+	ARN        string `xml:"TargetGroupArn"`
+	Name       string `xml:"TargetGroupName"`
+	Protocol   string `xml:"Protocol"`
+	Port       int    `xml:"Port"`
+	TargetType string `xml:"TargetType"`
+	healthCheck
+}
+
+// target is an instance id or an ip address, on the port
+type target struct {
+	ID   string `xml:"Id"`
+	Port int    `xml:"Port"`
+}
+
+func (t target) String() string {
+	return t.ID + ":" + strconv.Itoa(t.Port)
+}
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// apiError is the error responded by AWS
+type apiError struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Error>Code"`
+	Message    string `xml:"Error>Message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// isErrorCode returns true if err is an apiError of one of the codes
+func isErrorCode(err error, codes ...string) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable returns true if the request is throttled or failed on the side
+// of AWS
+func retryable(err error) bool {
+	if isErrorCode(err, "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException") {
+		return true
+	}
+	e, ok := err.(*apiError)
+	return ok && e.StatusCode >= http.StatusInternalServerError
+}
+
+// client manages the network load balancers of a region. The describers of
+// a single resource return nil if it does not exist.
+type client interface {
+	DescribeLoadBalancer(name string) (*loadBalancer, error)
+	CreateLoadBalancer(name, scheme string, subnets []string, tags map[string]string) (*loadBalancer, error)
+	DeleteLoadBalancer(arn string) error
+	DescribeTags(arn string) (map[string]string, error)
+	DescribeListeners(lbARN string) ([]listener, error)
+	CreateListener(lbARN string, l listener) error
+	ModifyListener(l listener) error
+	DeleteListener(arn string) error
+	DescribeTargetGroup(name string) (*targetGroup, error)
+	CreateTargetGroup(tg targetGroup, vpcID string, tags map[string]string) (*targetGroup, error)
+	ModifyTargetGroup(tg targetGroup) error
+	DeleteTargetGroup(arn string) error
+	DescribeTargets(tgARN string) ([]target, error)
+	RegisterTargets(tgARN string, targets []target) error
+	DeregisterTargets(tgARN string, targets []target) error
+}
+
+// queryClient drives the query api of Elastic Load Balancing v2. The
+// requests are rate limited, and retried with backoff if they are
+// throttled.
+type queryClient struct {
+	endpoint    string
+	region      string
+	credentials credentialsProvider
+	limiter     flowcontrol.RateLimiter
+	http        *http.Client
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+var _ client = &queryClient{}
+
+func newQueryClient(endpoint, region string, credentials credentialsProvider, limiter flowcontrol.RateLimiter) *queryClient {
+	return &queryClient{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      region,
+		credentials: credentials,
+		limiter:     limiter,
+		http:        &http.Client{Timeout: requestTimeout},
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+}
+
+// defaultEndpoint returns the endpoint of Elastic Load Balancing in the
+// region
+func defaultEndpoint(region string) string {
+	return fmt.Sprintf("https://%s.%s.amazonaws.com", service, region)
+}
+
+// call calls the action, and decodes the response into out if it is not nil
+func (c *queryClient) call(action string, params url.Values, out interface{}) error {
+	for attempt := 1; ; attempt++ {
+		c.limiter.Accept()
+		err := c.do(action, params, out)
+		if err == nil || !retryable(err) || attempt >= maxAttempts {
+			return err
+		}
+		delay := baseBackoff << uint(attempt-1)
+		log.Warn("aws request throttled, retrying", log.Fields{"action": action, "attempt": attempt, "delay": delay, "err": err})
+		c.sleep(delay)
+	}
+}
+
+func (c *queryClient) do(action string, params url.Values, out interface{}) error {
+	form := url.Values{}
+	for k, v := range params {
+		form[k] = v
+	}
+	form.Set("Action", action)
+	form.Set("Version", apiVersion)
+	body := []byte(form.Encode())
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"/", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds, err := c.credentials.Credentials()
+	if err != nil {
+		return fmt.Errorf("get aws credentials error: %v", err)
+	}
+	sign(req, body, creds, c.region, service, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{StatusCode: resp.StatusCode}
+		if xml.Unmarshal(data, e) != nil || e.Code == "" {
+			e.Code = resp.Status
+			e.Message = string(data)
+		}
+		return e
+	}
+	if out != nil {
+		if err := xml.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s: decode response error: %v", action, err)
+		}
+	}
+	return nil
+}
+
+// setList sets the members of the list parameter
+func setList(params url.Values, name string, values []string) {
+	for i, v := range values {
+		params.Set(fmt.Sprintf("%s.member.%d", name, i+1), v)
+	}
+}
+
+// setTags sets the tags in order
+func setTags(params url.Values, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		params.Set(fmt.Sprintf("Tags.member.%d.Key", i+1), k)
+		params.Set(fmt.Sprintf("Tags.member.%d.Value", i+1), tags[k])
+	}
+}
+
+func setTargets(params url.Values, targets []target) {
+	for i, t := range targets {
+		params.Set(fmt.Sprintf("Targets.member.%d.Id", i+1), t.ID)
+		params.Set(fmt.Sprintf("Targets.member.%d.Port", i+1), strconv.Itoa(t.Port))
+	}
+}
+
+func setHealthCheck(params url.Values, hc healthCheck) {
+	params.Set("HealthCheckProtocol", hc.Protocol)
+	params.Set("HealthCheckPort", hc.Port)
+	if hc.Path != "" {
+		params.Set("HealthCheckPath", hc.Path)
+	}
+	params.Set("HealthCheckIntervalSeconds", strconv.Itoa(hc.IntervalSeconds))
+	params.Set("HealthyThresholdCount", strconv.Itoa(hc.HealthyThreshold))
+	params.Set("UnhealthyThresholdCount", strconv.Itoa(hc.UnhealthyThreshold))
+}
+
+func setForward(params url.Values, tgARN string) {
+	params.Set("DefaultActions.member.1.Type", "forward")
+	params.Set("DefaultActions.member.1.TargetGroupArn", tgARN)
+}
+
+func (c *queryClient) DescribeLoadBalancer(name string) (*loadBalancer, error) {
+	params := url.Values{}
+	setList(params, "Names", []string{name})
+	out := &struct {
+		LoadBalancers []loadBalancer `xml:"DescribeLoadBalancersResult>LoadBalancers>member"`
+	}{}
+	err := c.call("DescribeLoadBalancers", params, out)
+	if isErrorCode(err, "LoadBalancerNotFound") || (err == nil && len(out.LoadBalancers) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out.LoadBalancers[0], nil
+}
+
+func (c *queryClient) CreateLoadBalancer(name, scheme string, subnets []string, tags map[string]string) (*loadBalancer, error) {
+	params := url.Values{}
+	params.Set("Name", name)
+	params.Set("Type", "network")
+	params.Set("Scheme", scheme)
+	setList(params, "Subnets", subnets)
+	setTags(params, tags)
+	out := &struct {
+		LoadBalancers []loadBalancer `xml:"CreateLoadBalancerResult>LoadBalancers>member"`
+	}{}
+	if err := c.call("CreateLoadBalancer", params, out); err != nil {
+		return nil, err
+	}
+	if len(out.LoadBalancers) == 0 {
+		return nil, fmt.Errorf("CreateLoadBalancer: no load balancer in the response")
+	}
+	return &out.LoadBalancers[0], nil
+}
+
+func (c *queryClient) DeleteLoadBalancer(arn string) error {
+	return c.call("DeleteLoadBalancer", url.Values{"LoadBalancerArn": {arn}}, nil)
+}
+
+func (c *queryClient) DescribeTags(arn string) (map[string]string, error) {
+	params := url.Values{}
+	setList(params, "ResourceArns", []string{arn})
+	out := &struct {
+		Tags []tag `xml:"DescribeTagsResult>TagDescriptions>member>Tags>member"`
+	}{}
+	if err := c.call("DescribeTags", params, out); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(out.Tags))
+	for _, t := range out.Tags {
+		tags[t.Key] = t.Value
+	}
+	return tags, nil
+}
+
+func (c *queryClient) DescribeListeners(lbARN string) ([]listener, error) {
+	out := &struct {
+		Listeners []listener `xml:"DescribeListenersResult>Listeners>member"`
+	}{}
+	if err := c.call("DescribeListeners", url.Values{"LoadBalancerArn": {lbARN}}, out); err != nil {
+		return nil, err
+	}
+	return out.Listeners, nil
+}
+
+func (c *queryClient) CreateListener(lbARN string, l listener) error {
+	params := url.Values{}
+	params.Set("LoadBalancerArn", lbARN)
+	params.Set("Protocol", l.Protocol)
+	params.Set("Port", strconv.Itoa(l.Port))
+	setForward(params, l.TargetGroupARN)
+	return c.call("CreateListener", params, nil)
+}
+
+func (c *queryClient) ModifyListener(l listener) error {
+	params := url.Values{}
+	params.Set("ListenerArn", l.ARN)
+	setForward(params, l.TargetGroupARN)
+	return c.call("ModifyListener", params, nil)
+}
+
+func (c *queryClient) DeleteListener(arn string) error {
+	return c.call("DeleteListener", url.Values{"ListenerArn": {arn}}, nil)
+}
+
+func (c *queryClient) DescribeTargetGroup(name string) (*targetGroup, error) {
+	params := url.Values{}
+	setList(params, "Names", []string{name})
+	out := &struct {
+		TargetGroups []targetGroup `xml:"DescribeTargetGroupsResult>TargetGroups>member"`
+	}{}
+	err := c.call("DescribeTargetGroups", params, out)
+	if isErrorCode(err, "TargetGroupNotFound") || (err == nil && len(out.TargetGroups) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out.TargetGroups[0], nil
+}
+
+func (c *queryClient) CreateTargetGroup(tg targetGroup, vpcID string, tags map[string]string) (*targetGroup, error) {
+	params := url.Values{}
+	params.Set("Name", tg.Name)
+	params.Set("Protocol", tg.Protocol)
+	params.Set("Port", strconv.Itoa(tg.Port))
+	params.Set("TargetType", tg.TargetType)
+	params.Set("VpcId", vpcID)
+	setHealthCheck(params, tg.healthCheck)
+	setTags(params, tags)
+	out := &struct {
+		TargetGroups []targetGroup `xml:"CreateTargetGroupResult>TargetGroups>member"`
+	}{}
+	if err := c.call("CreateTargetGroup", params, out); err != nil {
+		return nil, err
+	}
+	if len(out.TargetGroups) == 0 {
+		return nil, fmt.Errorf("CreateTargetGroup: no target group in the response")
+	}
+	return &out.TargetGroups[0], nil
+}
+
+func (c *queryClient) ModifyTargetGroup(tg targetGroup) error {
+	params := url.Values{}
+	params.Set("TargetGroupArn", tg.ARN)
+	setHealthCheck(params, tg.healthCheck)
+	return c.call("ModifyTargetGroup", params, nil)
+}
+
+func (c *queryClient) DeleteTargetGroup(arn string) error {
+	err := c.call("DeleteTargetGroup", url.Values{"TargetGroupArn": {arn}}, nil)
+	if isErrorCode(err, "TargetGroupNotFound") {
+		return nil
+	}
+	return err
+}
+
+func (c *queryClient) DescribeTargets(tgARN string) ([]target, error) {
+	out := &struct {
+		Targets []target `xml:"DescribeTargetHealthResult>TargetHealthDescriptions>member>Target"`
+	}{}
+	if err := c.call("DescribeTargetHealth", url.Values{"TargetGroupArn": {tgARN}}, out); err != nil {
+		return nil, err
+	}
+	return out.Targets, nil
+}
+
+func (c *queryClient) RegisterTargets(tgARN string, targets []target) error {
+	params := url.Values{"TargetGroupArn": {tgARN}}
+	setTargets(params, targets)
+	return c.call("RegisterTargets", params, nil)
+}
+
+func (c *queryClient) DeregisterTargets(tgARN string, targets []target) error {
+	params := url.Values{"TargetGroupArn": {tgARN}}
+	setTargets(params, targets)
+	return c.call("DeregisterTargets", params, nil)
+}
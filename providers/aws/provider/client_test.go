@@ -0,0 +1,149 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestSign(t *testing.T) {
+	// the example of the signature version 4 documentation of AWS
+	req, _ := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	creds := &credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	sign(req, nil, creds, "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func TestQueryClient(t *testing.T) {
+	var forms []url.Values
+	throttled := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(data))
+		forms = append(forms, form)
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+
+		switch form.Get("Action") {
+		case "DescribeLoadBalancers":
+			if throttled > 0 {
+				throttled--
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>Throttling</Code><Message>Rate exceeded</Message></Error></ErrorResponse>`))
+				return
+			}
+			if form.Get("Names.member.1") == "missing" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>LoadBalancerNotFound</Code><Message>not found</Message></Error></ErrorResponse>`))
+				return
+			}
+			w.Write([]byte(`<DescribeLoadBalancersResponse xmlns="http://elasticloadbalancing.amazonaws.com/doc/2015-12-01/">
+  <DescribeLoadBalancersResult>
+    <LoadBalancers>
+      <member>
+        <LoadBalancerArn>arn:lb</LoadBalancerArn>
+        <LoadBalancerName>nlb</LoadBalancerName>
+        <DNSName>nlb.elb.amazonaws.com</DNSName>
+        <State><Code>active</Code></State>
+      </member>
+    </LoadBalancers>
+  </DescribeLoadBalancersResult>
+</DescribeLoadBalancersResponse>`))
+		case "DescribeListeners":
+			w.Write([]byte(`<DescribeListenersResponse>
+  <DescribeListenersResult>
+    <Listeners>
+      <member>
+        <ListenerArn>arn:listener</ListenerArn>
+        <Protocol>TCP</Protocol>
+        <Port>80</Port>
+        <DefaultActions><member><Type>forward</Type><TargetGroupArn>arn:tg</TargetGroupArn></member></DefaultActions>
+      </member>
+    </Listeners>
+  </DescribeListenersResult>
+</DescribeListenersResponse>`))
+		case "DescribeTargetHealth":
+			w.Write([]byte(`<DescribeTargetHealthResponse>
+  <DescribeTargetHealthResult>
+    <TargetHealthDescriptions>
+      <member><Target><Id>i-1</Id><Port>80</Port></Target><TargetHealth><State>healthy</State></TargetHealth></member>
+      <member><Target><Id>i-2</Id><Port>80</Port></Target><TargetHealth><State>initial</State></TargetHealth></member>
+    </TargetHealthDescriptions>
+  </DescribeTargetHealthResult>
+</DescribeTargetHealthResponse>`))
+		case "RegisterTargets":
+			w.Write([]byte(`<RegisterTargetsResponse><RegisterTargetsResult/></RegisterTargetsResponse>`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	c := newQueryClient(server.URL, "us-east-1", &staticCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, flowcontrol.NewFakeAlwaysRateLimiter())
+	var delays []time.Duration
+	c.sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	// the throttled requests are retried with backoff
+	lb, err := c.DescribeLoadBalancer("nlb")
+	assert.Nil(t, err)
+	assert.Equal(t, &loadBalancer{ARN: "arn:lb", Name: "nlb", DNSName: "nlb.elb.amazonaws.com", State: "active"}, lb)
+	assert.Equal(t, []time.Duration{baseBackoff, 2 * baseBackoff}, delays)
+	assert.Len(t, forms, 3)
+	assert.Equal(t, "2015-12-01", forms[2].Get("Version"))
+	assert.Equal(t, "nlb", forms[2].Get("Names.member.1"))
+
+	lb, err = c.DescribeLoadBalancer("missing")
+	assert.Nil(t, err)
+	assert.Nil(t, lb)
+
+	listeners, err := c.DescribeListeners("arn:lb")
+	assert.Nil(t, err)
+	assert.Equal(t, []listener{{ARN: "arn:listener", Protocol: "TCP", Port: 80, TargetGroupARN: "arn:tg"}}, listeners)
+
+	targets, err := c.DescribeTargets("arn:tg")
+	assert.Nil(t, err)
+	assert.Equal(t, []target{{ID: "i-1", Port: 80}, {ID: "i-2", Port: 80}}, targets)
+
+	forms = nil
+	assert.Nil(t, c.RegisterTargets("arn:tg", []target{{ID: "i-3", Port: 80}}))
+	assert.Equal(t, url.Values{
+		"Action":                {"RegisterTargets"},
+		"Version":               {"2015-12-01"},
+		"TargetGroupArn":        {"arn:tg"},
+		"Targets.member.1.Id":   {"i-3"},
+		"Targets.member.1.Port": {"80"},
+	}, forms[0])
+
+	// the server errors are retried until the attempts run out
+	delays = nil
+	err = c.DeleteListener("arn:listener")
+	assert.NotNil(t, err)
+	assert.True(t, retryable(err))
+	assert.Len(t, delays, maxAttempts-1)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metadataEndpoint is the endpoint of the instance metadata service
+	metadataEndpoint = "http://169.254.169.254"
+	// credentialsRefreshMargin refreshes the credentials of the instance
+	// role before they expire
+	credentialsRefreshMargin = 5 * time.Minute
+)
+
+// credentials signs the requests to AWS
+type credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// credentialsProvider returns the credentials of the requests
+type credentialsProvider interface {
+	Credentials() (*credentials, error)
+}
+
+// staticCredentials is the credentials of an access key
+type staticCredentials credentials
+
+// Credentials implements credentialsProvider
+func (c *staticCredentials) Credentials() (*credentials, error) {
+	return (*credentials)(c), nil
+}
+
+// envCredentials returns the access key in the environment variables
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, nil if
+// there is none
+func envCredentials() credentialsProvider {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil
+	}
+	return &staticCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+}
+
+// instanceRoleCredentials is the credentials of the role of the instance,
+// fetched from the instance metadata service by the session tokens of
+// IMDSv2 and reused until they are about to expire
+type instanceRoleCredentials struct {
+	endpoint string
+	http     *http.Client
+	now      func() time.Time
+
+	mu     sync.Mutex
+	cached *credentials
+}
+
+func newInstanceRoleCredentials(endpoint string) *instanceRoleCredentials {
+	return &instanceRoleCredentials{endpoint: endpoint, http: &http.Client{Timeout: requestTimeout}, now: time.Now}
+}
+
+// Credentials implements credentialsProvider
+func (c *instanceRoleCredentials) Credentials() (*credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cached != nil && c.now().Add(credentialsRefreshMargin).Before(c.cached.Expiration) {
+		return c.cached, nil
+	}
+
+	token, err := c.get(http.MethodPut, "/latest/api/token", "")
+	if err != nil {
+		return nil, err
+	}
+	roles, err := c.get(http.MethodGet, "/latest/meta-data/iam/security-credentials/", token)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return nil, fmt.Errorf("no role attached to the instance")
+	}
+	data, err := c.get(http.MethodGet, "/latest/meta-data/iam/security-credentials/"+role, token)
+	if err != nil {
+		return nil, err
+	}
+	out := &struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}{}
+	if err := json.Unmarshal([]byte(data), out); err != nil {
+		return nil, fmt.Errorf("decode credentials of role %s error: %v", role, err)
+	}
+	if out.Code != "Success" {
+		return nil, fmt.Errorf("get credentials of role %s: %s", role, out.Code)
+	}
+	c.cached = &credentials{AccessKeyID: out.AccessKeyID, SecretAccessKey: out.SecretAccessKey, SessionToken: out.Token, Expiration: out.Expiration}
+	return c.cached, nil
+}
+
+// get requests the path of the metadata service with the session token, an
+// empty token requests a new one
+func (c *instanceRoleCredentials) get(method, path, token string) (string, error) {
+	req, err := http.NewRequest(method, c.endpoint+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if token == "" {
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	} else {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultActiveDirectoryEndpoint issues the tokens of the service
+	// principals
+	DefaultActiveDirectoryEndpoint = "https://login.microsoftonline.com"
+	// msiEndpoint is the token endpoint of the instance metadata service
+	msiEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// armResource is the audience of the tokens
+	armResource = "https://management.azure.com/"
+	// tokenRefreshMargin refreshes the tokens before they expire
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// tokenSource returns the bearer tokens of the REST api
+type tokenSource interface {
+	Token() (string, error)
+}
+
+// tokenResponse is the token in the responses of both the active directory
+// and the instance metadata service, the numbers are strings
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresOn   string `json:"expires_on"`
+}
+
+// cachedToken reuses the token fetched until it is about to expire
+type cachedToken struct {
+	fetch func() (*http.Request, error)
+	http  *http.Client
+	now   func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newServicePrincipalToken returns the tokens of the service principal by
+// the client credentials grant
+func newServicePrincipalToken(endpoint, tenantID, clientID, clientSecret string) *cachedToken {
+	return newCachedToken(func() (*http.Request, error) {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"resource":      {armResource},
+		}
+		req, err := http.NewRequest(http.MethodPost, endpoint+"/"+tenantID+"/oauth2/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
+
+// newMSIToken returns the tokens of the managed identity of the node, the
+// client id selects a user assigned identity and may be empty
+func newMSIToken(endpoint, clientID string) *cachedToken {
+	return newCachedToken(func() (*http.Request, error) {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {armResource}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err := http.NewRequest(http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+		return req, nil
+	})
+}
+
+func newCachedToken(fetch func() (*http.Request, error)) *cachedToken {
+	return &cachedToken{fetch: fetch, http: &http.Client{Timeout: requestTimeout}, now: time.Now}
+}
+
+// Token implements tokenSource
+func (t *cachedToken) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && t.now().Add(tokenRefreshMargin).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	req, err := t.fetch()
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	token := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return "", fmt.Errorf("decode token error: %v", err)
+	}
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid token expiry %q", token.ExpiresOn)
+	}
+	t.token, t.expiry = token.AccessToken, time.Unix(expiresOn, 0)
+	return t.token, nil
+}
@@ -0,0 +1,522 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/version"
+	log "github.com/zoumo/logdog"
+)
+
+var (
+	_ core.Provider         = &AzureProvider{}
+	_ core.ResyncProvider   = &AzureProvider{}
+	_ core.DeletionProvider = &AzureProvider{}
+	_ core.AddressProvider  = &AzureProvider{}
+)
+
+const (
+	// AnnotationKeyPublicIP is the name of an existing public IP in the
+	// resource group to serve the LoadBalancer on, the provider creates one
+	// if it is absent
+	AnnotationKeyPublicIP = "loadbalancer.caicloud.io/azure-public-ip"
+
+	// ownerTag tags the resources created for a LoadBalancer with its
+	// namespace and name, the resources tagged otherwise are never touched
+	ownerTag = "caicloud-loadbalancer"
+
+	frontendName    = "frontend"
+	backendPoolName = "nodes"
+
+	probeInterval = 5
+	probeCount    = 2
+
+	// DefaultPollInterval is the default interval of polling the
+	// asynchronous operations
+	DefaultPollInterval = 5 * time.Second
+)
+
+// Config configures the AzureProvider
+type Config struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Location       string
+	// VirtualNetworkID is the id of the virtual network of the nodes, they
+	// join the backend pool by their addresses in it, which covers both
+	// the standalone virtual machines and the scale set instances
+	VirtualNetworkID string
+	// CredentialsSecret is the Secret in the namespace of the LoadBalancer
+	// holding the service principal in the keys tenantID, clientID and
+	// clientSecret. The managed identity of the node is used if it is
+	// empty, MSIClientID selects a user assigned one.
+	CredentialsSecret string
+	MSIClientID       string
+	// Endpoint and ActiveDirectoryEndpoint default to the ones of the
+	// public cloud
+	Endpoint                string
+	ActiveDirectoryEndpoint string
+	// PollInterval is the interval of polling the asynchronous operations
+	PollInterval time.Duration
+}
+
+// AzureProvider maps the LoadBalancer onto an Azure Load Balancer of the
+// standard sku: a public IP, a rule with a tcp probe per port and a backend
+// pool of the nodes. The asynchronous operations of Azure are polled on the
+// resyncs instead of blocking the sync.
+type AzureProvider struct {
+	cfg         Config
+	storeLister core.StoreLister
+	newClient   func(tokenSource) client
+
+	mu     sync.Mutex
+	client client
+	// secretVersion is the resource version of the credentials the client
+	// is created with
+	secretVersion string
+	pending       *operation
+	addresses     []net.IP
+}
+
+// NewAzureProvider creates a new Azure LoadBalancer Provider
+func NewAzureProvider(cfg Config) *AzureProvider {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	if cfg.ActiveDirectoryEndpoint == "" {
+		cfg.ActiveDirectoryEndpoint = DefaultActiveDirectoryEndpoint
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	p := &AzureProvider{cfg: cfg}
+	p.newClient = func(token tokenSource) client {
+		return newARMClient(cfg.Endpoint, cfg.SubscriptionID, cfg.ResourceGroup, token)
+	}
+	return p
+}
+
+// loadBalancerName returns the name of the Azure Load Balancer, the one in
+// the spec or the namespace and the name of the LoadBalancer
+func loadBalancerName(lb *netv1alpha1.LoadBalancer) string {
+	if name := lb.Spec.Providers.Azure.Name; name != "" {
+		return name
+	}
+	return lb.Namespace + "-" + lb.Name
+}
+
+// publicIPName returns the name of the public IP created for the Azure Load
+// Balancer
+func publicIPName(name string) string {
+	return name + "-ip"
+}
+
+func owner(lb *netv1alpha1.LoadBalancer) string {
+	return lb.Namespace + "/" + lb.Name
+}
+
+// checkOwner returns a PermanentError if the resource is not created for
+// the LoadBalancer
+func checkOwner(lb *netv1alpha1.LoadBalancer, kind, name string, tags map[string]string) error {
+	if value := tags[ownerTag]; value != owner(lb) {
+		return core.NewPermanentError("AzureResourceConflict", fmt.Errorf("%s %s is not created for the loadbalancer, it is tagged %s=%q", kind, name, ownerTag, value))
+	}
+	return nil
+}
+
+// getClient returns the client with the current credentials
+func (p *AzureProvider) getClient(lb *netv1alpha1.LoadBalancer) (client, error) {
+	if p.cfg.CredentialsSecret == "" {
+		if p.client == nil {
+			msi := newMSIToken(msiEndpoint, p.cfg.MSIClientID)
+			p.client = p.newClient(msi)
+		}
+		return p.client, nil
+	}
+
+	secret, err := p.storeLister.Secret.Secrets(lb.Namespace).Get(p.cfg.CredentialsSecret)
+	if err != nil {
+		return nil, fmt.Errorf("get azure credentials %s/%s error: %v", lb.Namespace, p.cfg.CredentialsSecret, err)
+	}
+	if p.client != nil && secret.ResourceVersion == p.secretVersion {
+		return p.client, nil
+	}
+	for _, key := range []string{"tenantID", "clientID", "clientSecret"} {
+		if len(secret.Data[key]) == 0 {
+			return nil, core.NewPermanentError("InvalidAzureCredentials", fmt.Errorf("azure credentials %s/%s has no %s", lb.Namespace, secret.Name, key))
+		}
+	}
+	token := newServicePrincipalToken(p.cfg.ActiveDirectoryEndpoint, string(secret.Data["tenantID"]), string(secret.Data["clientID"]), string(secret.Data["clientSecret"]))
+	p.client = p.newClient(token)
+	p.secretVersion = secret.ResourceVersion
+	return p.client, nil
+}
+
+// poll returns true if no operation is pending, the failure of the pending
+// operation is returned once
+func (p *AzureProvider) poll(c client) (bool, error) {
+	if p.pending == nil {
+		return true, nil
+	}
+	done, err := c.PollOperation(p.pending)
+	if !done {
+		if err == nil {
+			log.Debug("azure operation in progress", log.Fields{"op": p.pending})
+		}
+		return false, err
+	}
+	log.Info("azure operation done", log.Fields{"op": p.pending, "err": err})
+	p.pending = nil
+	return true, err
+}
+
+// wait records the operation to be polled on the resyncs
+func (p *AzureProvider) wait(op *operation) {
+	if op != nil {
+		log.Info("Waiting for azure operation", log.Fields{"op": op})
+	}
+	p.pending = op
+}
+
+// OnUpdate ensures the Azure resources of the LoadBalancer, it returns as
+// soon as an operation is pending and goes on once it is done
+func (p *AzureProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal || lb.Spec.Providers.Azure == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, err := p.getClient(lb)
+	if err != nil {
+		return err
+	}
+	if done, err := p.poll(c); !done || err != nil {
+		return err
+	}
+
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return err
+	}
+
+	name := loadBalancerName(lb)
+	ip, err := p.ensurePublicIP(c, lb, name)
+	if err != nil || ip == nil {
+		return err
+	}
+	if addr := net.ParseIP(ip.Properties.IPAddress); addr != nil {
+		p.addresses = []net.IP{addr}
+	}
+
+	if err := p.ensureLoadBalancer(c, lb, p.desiredLoadBalancer(lb, name, ip, ports)); err != nil || p.pending != nil {
+		return err
+	}
+
+	// the public ip created before the annotation is released once the
+	// load balancer moves to the one in the annotation
+	if _, ok := lb.Annotations[AnnotationKeyPublicIP]; ok {
+		return p.deletePublicIP(c, lb, publicIPName(name))
+	}
+	return nil
+}
+
+// ensurePublicIP returns the public IP in the annotation, or the one
+// created for the load balancer. It returns nil if the creation is pending.
+func (p *AzureProvider) ensurePublicIP(c client, lb *netv1alpha1.LoadBalancer, name string) (*publicIP, error) {
+	if existing, ok := lb.Annotations[AnnotationKeyPublicIP]; ok {
+		ip, err := c.GetPublicIP(existing)
+		if err != nil {
+			return nil, err
+		}
+		if ip == nil {
+			return nil, core.NewPermanentError("AzurePublicIPNotFound", fmt.Errorf("public ip %s not found in resource group %s", existing, p.cfg.ResourceGroup))
+		}
+		return ip, nil
+	}
+
+	name = publicIPName(name)
+	ip, err := c.GetPublicIP(name)
+	if err != nil {
+		return nil, err
+	}
+	if ip != nil {
+		return ip, checkOwner(lb, "public ip", name, ip.Tags)
+	}
+
+	log.Info("Creating azure public ip", log.Fields{"name": name})
+	op, err := c.PutPublicIP(&publicIP{
+		Name:     name,
+		Location: p.cfg.Location,
+		Tags:     map[string]string{ownerTag: owner(lb)},
+		Sku:      &sku{Name: "Standard"},
+		Properties: publicIPProperties{
+			PublicIPAllocationMethod: "Static",
+		},
+	})
+	if err != nil || op != nil {
+		p.wait(op)
+		return nil, err
+	}
+	return c.GetPublicIP(name)
+}
+
+// desiredLoadBalancer returns the load balancer serving the ports on the
+// public ip by the ready nodes
+func (p *AzureProvider) desiredLoadBalancer(lb *netv1alpha1.LoadBalancer, name string, ip *publicIP, ports []corenet.Port) *loadBalancer {
+	id := resourceID(p.cfg.SubscriptionID, p.cfg.ResourceGroup, "loadBalancers", name)
+	frontend := &subResource{ID: id + "/frontendIPConfigurations/" + frontendName}
+	pool := &subResource{ID: id + "/backendAddressPools/" + backendPoolName}
+
+	addresses := make([]backendAddress, 0)
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, corenet.FamilyIPv4) {
+		// the nodes weighted to zero, e.g. not ready, are left out
+		if rs.Weight == 0 {
+			continue
+		}
+		address := backendAddress{Name: rs.Node, Properties: backendAddressProperties{IPAddress: rs.IP.String()}}
+		if p.cfg.VirtualNetworkID != "" {
+			address.Properties.VirtualNetwork = &subResource{ID: p.cfg.VirtualNetworkID}
+		}
+		addresses = append(addresses, address)
+	}
+
+	rules := make([]loadBalancingRule, 0, len(ports))
+	probes := make([]probe, 0, len(ports))
+	for _, port := range ports {
+		ruleName := fmt.Sprintf("%s-%d", port.Protocol, port.Port)
+		// Azure probes by tcp or http only, so the udp ports are probed by
+		// tcp on the same port
+		probes = append(probes, probe{Name: ruleName, Properties: probeProperties{
+			Protocol:          "Tcp",
+			Port:              int(port.Port),
+			IntervalInSeconds: probeInterval,
+			NumberOfProbes:    probeCount,
+		}})
+		rules = append(rules, loadBalancingRule{Name: ruleName, Properties: loadBalancingRuleProperties{
+			FrontendIPConfiguration: frontend,
+			BackendAddressPool:      pool,
+			Probe:                   &subResource{ID: id + "/probes/" + ruleName},
+			Protocol:                strings.Title(port.Protocol),
+			FrontendPort:            int(port.Port),
+			BackendPort:             int(port.Port),
+		}})
+	}
+
+	return &loadBalancer{
+		Name:     name,
+		Location: p.cfg.Location,
+		Tags:     map[string]string{ownerTag: owner(lb)},
+		Sku:      &sku{Name: "Standard"},
+		Properties: loadBalancerProperties{
+			FrontendIPConfigurations: []frontendIPConfiguration{{
+				Name:       frontendName,
+				Properties: frontendIPConfigurationProperties{PublicIPAddress: &subResource{ID: ip.ID}},
+			}},
+			BackendAddressPools: []backendAddressPool{{
+				Name:       backendPoolName,
+				Properties: backendAddressPoolProperties{LoadBalancerBackendAddresses: addresses},
+			}},
+			LoadBalancingRules: rules,
+			Probes:             probes,
+		},
+	}
+}
+
+// ensureLoadBalancer puts the desired load balancer unless the existing one
+// is equal to it
+func (p *AzureProvider) ensureLoadBalancer(c client, lb *netv1alpha1.LoadBalancer, desired *loadBalancer) error {
+	cur, err := c.GetLoadBalancer(desired.Name)
+	if err != nil {
+		return err
+	}
+	if cur != nil {
+		if err := checkOwner(lb, "load balancer", desired.Name, cur.Tags); err != nil {
+			return err
+		}
+		if reflect.DeepEqual(normalize(cur), normalize(desired)) {
+			return nil
+		}
+	}
+
+	log.Info("Updating azure load balancer", log.Fields{"name": desired.Name, "create": cur == nil})
+	op, err := c.PutLoadBalancer(desired)
+	p.wait(op)
+	return err
+}
+
+// normalize returns the properties of the load balancer the provider
+// manages, in order and with the ids in lower case since they are case
+// insensitive
+func normalize(lb *loadBalancer) loadBalancerProperties {
+	ref := func(r *subResource) *subResource {
+		if r == nil {
+			return nil
+		}
+		return &subResource{ID: strings.ToLower(r.ID)}
+	}
+	ret := loadBalancerProperties{}
+	for _, f := range lb.Properties.FrontendIPConfigurations {
+		ret.FrontendIPConfigurations = append(ret.FrontendIPConfigurations, frontendIPConfiguration{
+			Name:       f.Name,
+			Properties: frontendIPConfigurationProperties{PublicIPAddress: ref(f.Properties.PublicIPAddress)},
+		})
+	}
+	for _, pool := range lb.Properties.BackendAddressPools {
+		addresses := make([]backendAddress, 0, len(pool.Properties.LoadBalancerBackendAddresses))
+		for _, a := range pool.Properties.LoadBalancerBackendAddresses {
+			a.Properties.VirtualNetwork = ref(a.Properties.VirtualNetwork)
+			addresses = append(addresses, a)
+		}
+		sort.Slice(addresses, func(i, j int) bool { return addresses[i].Name < addresses[j].Name })
+		ret.BackendAddressPools = append(ret.BackendAddressPools, backendAddressPool{
+			Name:       pool.Name,
+			Properties: backendAddressPoolProperties{LoadBalancerBackendAddresses: addresses},
+		})
+	}
+	for _, r := range lb.Properties.LoadBalancingRules {
+		r.Properties.FrontendIPConfiguration = ref(r.Properties.FrontendIPConfiguration)
+		r.Properties.BackendAddressPool = ref(r.Properties.BackendAddressPool)
+		r.Properties.Probe = ref(r.Properties.Probe)
+		// the default idle timeout is filled in by Azure
+		r.Properties.IdleTimeoutInMinutes = 0
+		ret.LoadBalancingRules = append(ret.LoadBalancingRules, r)
+	}
+	ret.Probes = append(ret.Probes, lb.Properties.Probes...)
+	sort.Slice(ret.FrontendIPConfigurations, func(i, j int) bool {
+		return ret.FrontendIPConfigurations[i].Name < ret.FrontendIPConfigurations[j].Name
+	})
+	sort.Slice(ret.BackendAddressPools, func(i, j int) bool { return ret.BackendAddressPools[i].Name < ret.BackendAddressPools[j].Name })
+	sort.Slice(ret.LoadBalancingRules, func(i, j int) bool { return ret.LoadBalancingRules[i].Name < ret.LoadBalancingRules[j].Name })
+	sort.Slice(ret.Probes, func(i, j int) bool { return ret.Probes[i].Name < ret.Probes[j].Name })
+	return ret
+}
+
+// deletePublicIP deletes the public ip if it is created for the LoadBalancer
+func (p *AzureProvider) deletePublicIP(c client, lb *netv1alpha1.LoadBalancer, name string) error {
+	ip, err := c.GetPublicIP(name)
+	if err != nil || ip == nil {
+		return err
+	}
+	if checkOwner(lb, "public ip", name, ip.Tags) != nil {
+		return nil
+	}
+	log.Info("Deleting azure public ip", log.Fields{"name": name})
+	op, err := c.DeletePublicIP(name)
+	p.wait(op)
+	return err
+}
+
+// OnDelete implements core.DeletionProvider, the load balancer and the
+// public ip created for the LoadBalancer are deleted
+func (p *AzureProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	if lb.Spec.Providers.Azure == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, err := p.getClient(lb)
+	if err != nil {
+		return err
+	}
+	if done, err := p.poll(c); !done || err != nil {
+		return err
+	}
+
+	name := loadBalancerName(lb)
+	cur, err := c.GetLoadBalancer(name)
+	if err != nil {
+		return err
+	}
+	if cur != nil && checkOwner(lb, "load balancer", name, cur.Tags) == nil {
+		log.Info("Deleting azure load balancer", log.Fields{"name": name})
+		op, err := c.DeleteLoadBalancer(name)
+		if err != nil || op != nil {
+			p.wait(op)
+			return err
+		}
+	}
+
+	if err := p.deletePublicIP(c, lb, publicIPName(name)); err != nil || p.pending != nil {
+		return err
+	}
+	p.addresses = nil
+	return nil
+}
+
+// ResyncAfter implements core.ResyncProvider, the pending operation is
+// polled on the resyncs
+func (p *AzureProvider) ResyncAfter() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending != nil {
+		return p.cfg.PollInterval
+	}
+	return 0
+}
+
+// Addresses implements core.AddressProvider
+func (p *AzureProvider) Addresses() []net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addresses
+}
+
+// Start ...
+func (p *AzureProvider) Start() {
+	log.Info("Startting azure provider")
+}
+
+// WaitForStart ...
+func (p *AzureProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the Azure resources alone, they outlive the provider and are
+// deleted with the LoadBalancer
+func (p *AzureProvider) Stop() error {
+	log.Info("Shutting down azure provider")
+	return nil
+}
+
+// Info ...
+func (p *AzureProvider) Info() core.Info {
+	return core.Info{
+		Name:       "azure",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *AzureProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testLBID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/loadBalancers/default-lb"
+	testIPID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/default-lb-ip"
+)
+
+// fakeClient is an in-memory Azure, the changes are applied once their
+// operations are polled if async is true
+type fakeClient struct {
+	mu    sync.Mutex
+	async bool
+	ips   map[string]*publicIP
+	lbs   map[string]*loadBalancer
+	ops   map[string]func()
+	seq   int
+	calls []string
+}
+
+var _ client = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		ips: make(map[string]*publicIP),
+		lbs: make(map[string]*loadBalancer),
+		ops: make(map[string]func()),
+	}
+}
+
+// copy returns a deep copy of in through json, as the REST api does
+func (f *fakeClient) copy(in, out interface{}) {
+	data, _ := json.Marshal(in)
+	json.Unmarshal(data, out)
+}
+
+// apply applies the change now or on the poll of the returned operation
+func (f *fakeClient) apply(description string, change func()) *operation {
+	if !f.async {
+		change()
+		return nil
+	}
+	f.seq++
+	op := &operation{URL: fmt.Sprintf("op-%d", f.seq), Description: description}
+	f.ops[op.URL] = change
+	return op
+}
+
+func (f *fakeClient) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *fakeClient) GetPublicIP(name string) (*publicIP, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, ok := f.ips[name]
+	if !ok {
+		return nil, nil
+	}
+	ip := &publicIP{}
+	f.copy(cur, ip)
+	return ip, nil
+}
+
+func (f *fakeClient) PutPublicIP(ip *publicIP) (*operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "PutPublicIP "+ip.Name)
+	stored := &publicIP{}
+	f.copy(ip, stored)
+	stored.ID = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/" + ip.Name
+	stored.Properties.IPAddress = fmt.Sprintf("52.0.0.%d", len(f.ips)+1)
+	return f.apply("put public ip", func() { f.ips[ip.Name] = stored }), nil
+}
+
+func (f *fakeClient) DeletePublicIP(name string) (*operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DeletePublicIP "+name)
+	return f.apply("delete public ip", func() { delete(f.ips, name) }), nil
+}
+
+func (f *fakeClient) GetLoadBalancer(name string) (*loadBalancer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cur, ok := f.lbs[name]
+	if !ok {
+		return nil, nil
+	}
+	lb := &loadBalancer{}
+	f.copy(cur, lb)
+	return lb, nil
+}
+
+func (f *fakeClient) PutLoadBalancer(lb *loadBalancer) (*operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "PutLoadBalancer "+lb.Name)
+	stored := &loadBalancer{}
+	f.copy(lb, stored)
+	stored.ID = testLBID
+	stored.Properties.ProvisioningState = "Succeeded"
+	// Azure fills in the defaults and may reorder
+	for i := range stored.Properties.LoadBalancingRules {
+		stored.Properties.LoadBalancingRules[i].Properties.IdleTimeoutInMinutes = 4
+	}
+	sort.Slice(stored.Properties.Probes, func(i, j int) bool {
+		return stored.Properties.Probes[i].Name > stored.Properties.Probes[j].Name
+	})
+	return f.apply("put load balancer", func() { f.lbs[lb.Name] = stored }), nil
+}
+
+func (f *fakeClient) DeleteLoadBalancer(name string) (*operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "DeleteLoadBalancer "+name)
+	return f.apply("delete load balancer", func() { delete(f.lbs, name) }), nil
+}
+
+func (f *fakeClient) PollOperation(op *operation) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "PollOperation "+op.URL)
+	change, ok := f.ops[op.URL]
+	if !ok {
+		return true, fmt.Errorf("operation %s not found", op.URL)
+	}
+	delete(f.ops, op.URL)
+	change()
+	return true, nil
+}
+
+// backendAddresses returns the addresses in the backend pool
+func (f *fakeClient) backendAddresses(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []string{}
+	for _, a := range f.lbs[name].Properties.BackendAddressPools[0].Properties.LoadBalancerBackendAddresses {
+		ret = append(ret, a.Name+"="+a.Properties.IPAddress)
+	}
+	return ret
+}
+
+// rules returns the load balancing rules with their probes
+func (f *fakeClient) rules(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []string{}
+	for _, r := range f.lbs[name].Properties.LoadBalancingRules {
+		ret = append(ret, fmt.Sprintf("%s %s/%d probe=%s", r.Name, r.Properties.Protocol, r.Properties.FrontendPort, r.Properties.Probe.ID[len(testLBID):]))
+	}
+	return ret
+}
+
+func newTestNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Azure = &netv1alpha1.AzureProvider{}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func newTestProvider(c client, nodes cache.Indexer, secrets cache.Indexer) *AzureProvider {
+	p := NewAzureProvider(Config{SubscriptionID: "sub", ResourceGroup: "rg", Location: "eastus", VirtualNetworkID: "vnet"})
+	p.newClient = func(tokenSource) client { return c }
+	p.SetListers(core.StoreLister{
+		Node:   v1listers.NewNodeLister(nodes),
+		Secret: v1listers.NewSecretLister(secrets),
+	})
+	return p
+}
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func TestOnUpdate(t *testing.T) {
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	nodes.Add(newTestNode("node2", "10.0.0.2", true))
+	c := newFakeClient()
+	c.async = true
+	p := newTestProvider(c, nodes, newIndexer())
+	lb := newTestLoadBalancer("node1", "node2")
+
+	// create, every operation is polled on the following resync
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PutPublicIP default-lb-ip"}, c.Calls())
+	assert.Equal(t, p.cfg.PollInterval, p.ResyncAfter())
+	assert.Nil(t, p.Addresses())
+
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PollOperation op-1", "PutLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, []net.IP{net.ParseIP("52.0.0.1")}, p.Addresses())
+	assert.Equal(t, p.cfg.PollInterval, p.ResyncAfter())
+
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PollOperation op-2"}, c.Calls())
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+	assert.Equal(t, []string{"node1=10.0.0.1", "node2=10.0.0.2"}, c.backendAddresses("default-lb"))
+	assert.Equal(t, []string{"tcp-80 Tcp/80 probe=/probes/tcp-80", "tcp-443 Tcp/443 probe=/probes/tcp-443"}, c.rules("default-lb"))
+	assert.Equal(t, testIPID, c.lbs["default-lb"].Properties.FrontendIPConfigurations[0].Properties.PublicIPAddress.ID)
+	assert.Equal(t, "default/lb", c.lbs["default-lb"].Tags[ownerTag])
+	assert.Equal(t, "vnet", c.lbs["default-lb"].Properties.BackendAddressPools[0].Properties.LoadBalancerBackendAddresses[0].Properties.VirtualNetwork.ID)
+
+	// idempotent against the existing resources
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+	p = newTestProvider(c, nodes, newIndexer())
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+	assert.Equal(t, []net.IP{net.ParseIP("52.0.0.1")}, p.Addresses())
+
+	c.async = false
+
+	// port update
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"udp","port":53}]`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PutLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, []string{"tcp-80 Tcp/80 probe=/probes/tcp-80", "udp-53 Udp/53 probe=/probes/udp-53"}, c.rules("default-lb"))
+
+	// node churn
+	nodes.Add(newTestNode("node3", "10.0.0.3", true))
+	lb.Spec.Nodes.Names = []string{"node1", "node2", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PutLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, []string{"node1=10.0.0.1", "node2=10.0.0.2", "node3=10.0.0.3"}, c.backendAddresses("default-lb"))
+
+	nodes.Update(newTestNode("node1", "10.0.0.1", false))
+	lb.Spec.Nodes.Names = []string{"node1", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PutLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, []string{"node3=10.0.0.3"}, c.backendAddresses("default-lb"))
+
+	// deletion cleanup
+	c.async = true
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"DeleteLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, p.cfg.PollInterval, p.ResyncAfter())
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"PollOperation op-3", "DeletePublicIP default-lb-ip"}, c.Calls())
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"PollOperation op-4"}, c.Calls())
+	assert.Empty(t, c.lbs)
+	assert.Empty(t, c.ips)
+	assert.Nil(t, p.Addresses())
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+}
+
+func TestOnUpdateExistingPublicIP(t *testing.T) {
+	c := newFakeClient()
+	c.PutPublicIP(&publicIP{Name: "shared", Tags: map[string]string{ownerTag: "other/lb"}})
+	c.Calls()
+	p := newTestProvider(c, newIndexer(), newIndexer())
+	lb := newTestLoadBalancer()
+	lb.Annotations[AnnotationKeyPublicIP] = "shared"
+
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"PutLoadBalancer default-lb"}, c.Calls())
+	assert.Equal(t, []net.IP{net.ParseIP("52.0.0.1")}, p.Addresses())
+
+	// the public ip in the annotation is not owned, so not deleted
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"DeleteLoadBalancer default-lb"}, c.Calls())
+	assert.Len(t, c.ips, 1)
+
+	lb.Annotations[AnnotationKeyPublicIP] = "missing"
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+}
+
+func TestOnUpdateConflict(t *testing.T) {
+	c := newFakeClient()
+	c.PutLoadBalancer(&loadBalancer{Name: "default-lb", Tags: map[string]string{ownerTag: "other/lb"}})
+	c.Calls()
+	p := newTestProvider(c, newIndexer(), newIndexer())
+	lb := newTestLoadBalancer()
+
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Contains(t, err.Error(), "load balancer default-lb is not created for the loadbalancer")
+	assert.Equal(t, []string{"PutPublicIP default-lb-ip"}, c.Calls())
+
+	// the foreign load balancer is left alone
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"DeletePublicIP default-lb-ip"}, c.Calls())
+	assert.Len(t, c.lbs, 1)
+}
+
+func TestGetClient(t *testing.T) {
+	secrets := newIndexer()
+	c := newFakeClient()
+	p := newTestProvider(c, newIndexer(), secrets)
+	p.cfg.CredentialsSecret = "azure"
+	created := 0
+	p.newClient = func(tokenSource) client {
+		created++
+		return c
+	}
+	lb := newTestLoadBalancer()
+
+	_, err := p.getClient(lb)
+	assert.NotNil(t, err)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "azure", ResourceVersion: "1"},
+		Data:       map[string][]byte{"tenantID": []byte("t"), "clientID": []byte("c")},
+	}
+	secrets.Add(secret)
+	_, err = p.getClient(lb)
+	assert.True(t, core.IsPermanentError(err))
+
+	secret.Data["clientSecret"] = []byte("s")
+	secrets.Update(secret)
+	_, err = p.getClient(lb)
+	assert.Nil(t, err)
+	_, err = p.getClient(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, created)
+
+	// rotated
+	rotated := *secret
+	rotated.ResourceVersion = "2"
+	secrets.Update(&rotated)
+	_, err = p.getClient(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, created)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEndpoint is the endpoint of the Azure Resource Manager
+	DefaultEndpoint = "https://management.azure.com"
+	// apiVersion supports the backend pools by addresses
+	apiVersion = "2020-06-01"
+
+	requestTimeout = 30 * time.Second
+)
+
+// operation is an asynchronous operation of Azure, it is polled until done
+type operation struct {
+	// URL is polled for the status of the operation
+	URL string
+	// Description tells what the operation does for the logs
+	Description string
+}
+
+func (op *operation) String() string {
+	return op.Description
+}
+
+// client manages the network resources in a resource group of Azure. The
+// getters return nil if the resource does not exist, and the changes return
+// the operation if they are not done synchronously.
+type client interface {
+	GetPublicIP(name string) (*publicIP, error)
+	PutPublicIP(ip *publicIP) (*operation, error)
+	DeletePublicIP(name string) (*operation, error)
+	GetLoadBalancer(name string) (*loadBalancer, error)
+	PutLoadBalancer(lb *loadBalancer) (*operation, error)
+	DeleteLoadBalancer(name string) (*operation, error)
+	// PollOperation returns true if the operation is done, and an error if
+	// it failed
+	PollOperation(op *operation) (bool, error)
+}
+
+// armClient drives the REST api of the Azure Resource Manager
+type armClient struct {
+	endpoint       string
+	subscriptionID string
+	resourceGroup  string
+	token          tokenSource
+	http           *http.Client
+}
+
+var _ client = &armClient{}
+
+func newARMClient(endpoint, subscriptionID, resourceGroup string, token tokenSource) *armClient {
+	return &armClient{
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		subscriptionID: subscriptionID,
+		resourceGroup:  resourceGroup,
+		token:          token,
+		http:           &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// resourceID returns the id of the network resource of the type
+func resourceID(subscriptionID, resourceGroup, typ, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/%s/%s", subscriptionID, resourceGroup, typ, name)
+}
+
+func (c *armClient) url(typ, name string) string {
+	return c.endpoint + resourceID(c.subscriptionID, c.resourceGroup, typ, name) + "?api-version=" + apiVersion
+}
+
+// do sends the request with the body in json, and decodes the response into
+// out if it is not nil. The responses of the unexpected statuses are
+// returned as errors.
+func (c *armClient) do(method, url string, body, out interface{}, expected ...int) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.token.Token()
+	if err != nil {
+		return nil, fmt.Errorf("get azure token error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range expected {
+		if resp.StatusCode != code {
+			continue
+		}
+		if out != nil && len(data) > 0 {
+			if err := json.Unmarshal(data, out); err != nil {
+				return nil, fmt.Errorf("%s %s: decode response error: %v", method, url, err)
+			}
+		}
+		return resp, nil
+	}
+
+	var e struct {
+		Error *armError `json:"error"`
+	}
+	if json.Unmarshal(data, &e) == nil && e.Error != nil {
+		return resp, fmt.Errorf("%s %s: %s: %v", method, url, resp.Status, e.Error)
+	}
+	return resp, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, data)
+}
+
+func (c *armClient) get(typ, name string, out interface{}) (bool, error) {
+	resp, err := c.do(http.MethodGet, c.url(typ, name), nil, out, http.StatusOK)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *armClient) put(typ, name string, body interface{}) (*operation, error) {
+	resp, err := c.do(http.MethodPut, c.url(typ, name), body, nil, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp, fmt.Sprintf("put %s %s", typ, name)), nil
+}
+
+func (c *armClient) delete(typ, name string) (*operation, error) {
+	resp, err := c.do(http.MethodDelete, c.url(typ, name), nil, nil, http.StatusOK, http.StatusAccepted, http.StatusNoContent)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return asyncOperation(resp, fmt.Sprintf("delete %s %s", typ, name)), nil
+}
+
+// asyncOperation returns the operation to poll if the response is not the
+// end of the request
+func asyncOperation(resp *http.Response, description string) *operation {
+	if url := resp.Header.Get("Azure-AsyncOperation"); url != "" {
+		return &operation{URL: url, Description: description}
+	}
+	if url := resp.Header.Get("Location"); url != "" && resp.StatusCode == http.StatusAccepted {
+		return &operation{URL: url, Description: description}
+	}
+	return nil
+}
+
+func (c *armClient) GetPublicIP(name string) (*publicIP, error) {
+	ip := &publicIP{}
+	found, err := c.get("publicIPAddresses", name, ip)
+	if !found {
+		return nil, err
+	}
+	return ip, nil
+}
+
+func (c *armClient) PutPublicIP(ip *publicIP) (*operation, error) {
+	return c.put("publicIPAddresses", ip.Name, ip)
+}
+
+func (c *armClient) DeletePublicIP(name string) (*operation, error) {
+	return c.delete("publicIPAddresses", name)
+}
+
+func (c *armClient) GetLoadBalancer(name string) (*loadBalancer, error) {
+	lb := &loadBalancer{}
+	found, err := c.get("loadBalancers", name, lb)
+	if !found {
+		return nil, err
+	}
+	return lb, nil
+}
+
+func (c *armClient) PutLoadBalancer(lb *loadBalancer) (*operation, error) {
+	return c.put("loadBalancers", lb.Name, lb)
+}
+
+func (c *armClient) DeleteLoadBalancer(name string) (*operation, error) {
+	return c.delete("loadBalancers", name)
+}
+
+// PollOperation polls the Azure-AsyncOperation url for the status in the
+// body, or the Location url which responds 202 until done
+func (c *armClient) PollOperation(op *operation) (bool, error) {
+	status := &operationStatus{}
+	resp, err := c.do(http.MethodGet, op.URL, nil, status, http.StatusOK, http.StatusAccepted, http.StatusNoContent)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		return false, nil
+	case status.Status == "" || status.Status == "Succeeded":
+		return true, nil
+	case status.Status == "Failed" || status.Status == "Canceled":
+		if status.Error != nil {
+			return true, fmt.Errorf("%v %s: %v", op, status.Status, status.Error)
+		}
+		return true, fmt.Errorf("%v %s", op, status.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticToken string
+
+func (t staticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+func TestARMClient(t *testing.T) {
+	const ipPath = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/publicIPAddresses/ip"
+	const lbPath = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Network/loadBalancers/lb"
+	polls := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if r.URL.Path != "/operations/1" {
+			assert.Equal(t, apiVersion, r.URL.Query().Get("api-version"))
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET " + ipPath:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"ResourceNotFound","message":"not found"}}`)
+		case "PUT " + ipPath:
+			ip := &publicIP{}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(ip))
+			assert.Equal(t, "Static", ip.Properties.PublicIPAllocationMethod)
+			w.Header().Set("Azure-AsyncOperation", server.URL+"/operations/1")
+			w.WriteHeader(http.StatusCreated)
+		case "GET /operations/1":
+			polls++
+			status := "InProgress"
+			if polls > 1 {
+				status = "Failed"
+			}
+			fmt.Fprintf(w, `{"status":%q,"error":{"code":"QuotaExceeded","message":"no more public ips"}}`, status)
+		case "GET " + lbPath:
+			fmt.Fprint(w, `{"name":"lb","tags":{"caicloud-loadbalancer":"default/lb"},"properties":{"provisioningState":"Succeeded"}}`)
+		case "PUT " + lbPath:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"code":"InvalidResourceReference","message":"bad probe"}}`)
+		case "DELETE " + lbPath:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	c := newARMClient(server.URL+"/", "sub", "rg", staticToken("token"))
+
+	ip, err := c.GetPublicIP("ip")
+	assert.Nil(t, err)
+	assert.Nil(t, ip)
+
+	op, err := c.PutPublicIP(&publicIP{Name: "ip", Properties: publicIPProperties{PublicIPAllocationMethod: "Static"}})
+	assert.Nil(t, err)
+	assert.Equal(t, &operation{URL: server.URL + "/operations/1", Description: "put publicIPAddresses ip"}, op)
+	done, err := c.PollOperation(op)
+	assert.False(t, done)
+	assert.Nil(t, err)
+	done, err = c.PollOperation(op)
+	assert.True(t, done)
+	assert.EqualError(t, err, "put publicIPAddresses ip Failed: QuotaExceeded: no more public ips")
+
+	lb, err := c.GetLoadBalancer("lb")
+	assert.Nil(t, err)
+	assert.Equal(t, "default/lb", lb.Tags[ownerTag])
+
+	_, err = c.PutLoadBalancer(lb)
+	assert.Contains(t, fmt.Sprint(err), "400 Bad Request: InvalidResourceReference: bad probe")
+
+	op, err = c.DeleteLoadBalancer("lb")
+	assert.Nil(t, err)
+	assert.Nil(t, op)
+}
+
+func TestServicePrincipalToken(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/tenant/oauth2/token", r.URL.Path)
+		assert.Nil(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "secret", r.PostForm.Get("client_secret"))
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_on":"%s"}`, requests, strconv.FormatInt(now.Add(time.Hour).Unix(), 10))
+	}))
+	defer server.Close()
+
+	token := newServicePrincipalToken(server.URL, "tenant", "client", "secret")
+	token.now = func() time.Time { return now }
+	s, err := token.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", s)
+
+	// cached until it is about to expire
+	now = now.Add(50 * time.Minute)
+	s, err = token.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-1", s)
+
+	now = now.Add(6 * time.Minute)
+	s, err = token.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-2", s)
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+// The following are the parts of the Azure Resource Manager network
+// resources the provider manages, in the json of the REST api
+
+// subResource refers to another resource by its id
+type subResource struct {
+	ID string `json:"id"`
+}
+
+type sku struct {
+	Name string `json:"name"`
+}
+
+// publicIP is a Microsoft.Network/publicIPAddresses
+type publicIP struct {
+	ID         string             `json:"id,omitempty"`
+	Name       string             `json:"name,omitempty"`
+	Location   string             `json:"location,omitempty"`
+	Tags       map[string]string  `json:"tags,omitempty"`
+	Sku        *sku               `json:"sku,omitempty"`
+	Properties publicIPProperties `json:"properties"`
+}
+
+type publicIPProperties struct {
+	PublicIPAllocationMethod string `json:"publicIPAllocationMethod,omitempty"`
+	IPAddress                string `json:"ipAddress,omitempty"`
+	ProvisioningState        string `json:"provisioningState,omitempty"`
+}
+
+// loadBalancer is a Microsoft.Network/loadBalancers
+type loadBalancer struct {
+	ID         string                 `json:"id,omitempty"`
+	Name       string                 `json:"name,omitempty"`
+	Location   string                 `json:"location,omitempty"`
+	Tags       map[string]string      `json:"tags,omitempty"`
+	Sku        *sku                   `json:"sku,omitempty"`
+	Properties loadBalancerProperties `json:"properties"`
+}
+
+type loadBalancerProperties struct {
+	FrontendIPConfigurations []frontendIPConfiguration `json:"frontendIPConfigurations"`
+	BackendAddressPools      []backendAddressPool      `json:"backendAddressPools"`
+	LoadBalancingRules       []loadBalancingRule       `json:"loadBalancingRules"`
+	Probes                   []probe                   `json:"probes"`
+	ProvisioningState        string                    `json:"provisioningState,omitempty"`
+}
+
+type frontendIPConfiguration struct {
+	Name       string                            `json:"name"`
+	Properties frontendIPConfigurationProperties `json:"properties"`
+}
+
+type frontendIPConfigurationProperties struct {
+	PublicIPAddress *subResource `json:"publicIPAddress,omitempty"`
+}
+
+type backendAddressPool struct {
+	Name       string                       `json:"name"`
+	Properties backendAddressPoolProperties `json:"properties"`
+}
+
+type backendAddressPoolProperties struct {
+	LoadBalancerBackendAddresses []backendAddress `json:"loadBalancerBackendAddresses"`
+}
+
+// backendAddress is a member of a backend pool by its address in the
+// virtual network
+type backendAddress struct {
+	Name       string                   `json:"name"`
+	Properties backendAddressProperties `json:"properties"`
+}
+
+type backendAddressProperties struct {
+	IPAddress      string       `json:"ipAddress"`
+	VirtualNetwork *subResource `json:"virtualNetwork,omitempty"`
+}
+
+type loadBalancingRule struct {
+	Name       string                      `json:"name"`
+	Properties loadBalancingRuleProperties `json:"properties"`
+}
+
+type loadBalancingRuleProperties struct {
+	FrontendIPConfiguration *subResource `json:"frontendIPConfiguration,omitempty"`
+	BackendAddressPool      *subResource `json:"backendAddressPool,omitempty"`
+	Probe                   *subResource `json:"probe,omitempty"`
+	Protocol                string       `json:"protocol"`
+	FrontendPort            int          `json:"frontendPort"`
+	BackendPort             int          `json:"backendPort"`
+	EnableFloatingIP        bool         `json:"enableFloatingIP"`
+	IdleTimeoutInMinutes    int          `json:"idleTimeoutInMinutes,omitempty"`
+}
+
+type probe struct {
+	Name       string          `json:"name"`
+	Properties probeProperties `json:"properties"`
+}
+
+type probeProperties struct {
+	Protocol          string `json:"protocol"`
+	Port              int    `json:"port"`
+	IntervalInSeconds int    `json:"intervalInSeconds"`
+	NumberOfProbes    int    `json:"numberOfProbes"`
+}
+
+// operationStatus is the status of an asynchronous operation
+type operationStatus struct {
+	Status string    `json:"status"`
+	Error  *armError `json:"error,omitempty"`
+}
+
+// armError is the error in the responses of the REST api
+type armError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *armError) Error() string {
+	return e.Code + ": " + e.Message
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// Options contains controller options
+type Options struct {
+	Debug                 bool
+	Interface             string
+	NodeAddressTypes      string
+	ReportServiceStatus   bool
+	AddressPools          string
+	HTTPAddress           string
+	NodeHealthAddress     string
+	Kubeconfig            string
+	LoadBalancerNamespace string
+	LoadBalancerName      string
+	Chaos                 string
+	Record                string
+	PodNamespace          string
+	PodName               string
+	ASN                   int
+	RouterID              string
+	Peers                 cli.StringSlice
+	PasswordSecret        string
+	HoldTime              time.Duration
+}
+
+// NewOptions reutrns a new Options
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// AddFlags add flags to app
+func (opts *Options) AddFlags(app *cli.App) {
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "kubeconfig",
+			Usage:       "Path to a kube config. Only required if out-of-cluster.",
+			Destination: &opts.Kubeconfig,
+		},
+		cli.BoolFlag{
+			Name:        "debug",
+			Usage:       "run with debug mode",
+			Destination: &opts.Debug,
+		},
+		cli.StringFlag{
+			Name:        "interface",
+			Value:       "lo",
+			Usage:       "the interface the vips are bound on unless they specify their own ones",
+			Destination: &opts.Interface,
+		},
+		cli.IntFlag{
+			Name:        "bgp-asn",
+			Usage:       "the local autonomous system number",
+			Destination: &opts.ASN,
+		},
+		cli.StringFlag{
+			Name:        "bgp-router-id",
+			Usage:       "the bgp identifier, defaults to the node ip",
+			Destination: &opts.RouterID,
+		},
+		cli.StringSliceFlag{
+			Name:  "bgp-peer",
+			Usage: "the bgp peer in the form of asn@address[:port], e.g. 64512@10.0.0.254, can be repeated",
+			Value: &opts.Peers,
+		},
+		cli.StringFlag{
+			Name:        "bgp-password-secret",
+			Usage:       "the Secret in the namespace of the loadbalancer holding the tcp md5 passwords, keyed by the peer address or password for all peers",
+			Destination: &opts.PasswordSecret,
+		},
+		cli.DurationFlag{
+			Name:        "bgp-hold-time",
+			Value:       bgp.DefaultHoldTime,
+			Usage:       "the proposed hold time of the bgp sessions",
+			Destination: &opts.HoldTime,
+		},
+		cli.StringFlag{
+			Name:        "node-address-types",
+			Value:       "ExternalIP,InternalIP",
+			Usage:       "the preference of the node address types used as the real servers, overridden by the node annotation loadbalancer.caicloud.io/real-server-ip",
+			Destination: &opts.NodeAddressTypes,
+		},
+		cli.BoolFlag{
+			Name:        "report-service-status",
+			Usage:       "set the vips on the status of the services of type LoadBalancer listed in the loadbalancer annotation loadbalancer.caicloud.io/services or proxied to, which are annotated with loadbalancer.caicloud.io/loadbalancer: <loadbalancer name>",
+			Destination: &opts.ReportServiceStatus,
+		},
+		cli.StringFlag{
+			Name:        "address-pools",
+			Usage:       "the namespace/name of the configmap of the address pools the vip is allocated from when it is empty and the loadbalancer annotation loadbalancer.caicloud.io/address-pool names a pool, the namespace defaults to the one of the loadbalancer, empty disables the allocation",
+			Destination: &opts.AddressPools,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Value:       ":10254",
+			Usage:       "the address serving /metrics and /healthz, empty disables it",
+			Destination: &opts.HTTPAddress,
+		},
+		cli.StringFlag{
+			Name:        "node-health-address",
+			Usage:       "the address serving the health of the node for the loadbalancer on /healthz/<namespace>/<name> or the loadbalancer annotation loadbalancer.caicloud.io/node-health-path, empty disables it",
+			Destination: &opts.NodeHealthAddress,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-namespace",
+			EnvVar:      "LOADBALANCER_NAMESPACE",
+			Usage:       "specify loadbalancer resource namespace",
+			Destination: &opts.LoadBalancerNamespace,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-name",
+			EnvVar:      "LOADBALANCER_NAME",
+			Usage:       "specify loadbalancer resource name",
+			Destination: &opts.LoadBalancerName,
+		},
+		cli.StringFlag{
+			Name:        "chaos",
+			Usage:       "the policy of the faults injected into the backend for resilience testing, e.g. seed=42,update-error-rate=0.1,latency=uniform:10ms-200ms, never set it in production",
+			Destination: &opts.Chaos,
+		},
+		cli.StringFlag{
+			Name:        "record",
+			Usage:       "the file the inputs and the results of the syncs are recorded to, with the secrets redacted, for replaying them offline with the replay command, empty disables it",
+			Destination: &opts.Record,
+		},
+		cli.StringFlag{
+			Name:        "pod-namespace",
+			EnvVar:      "POD_NAMESPACE",
+			Usage:       "specify pod namespace",
+			Destination: &opts.PodNamespace,
+		},
+		cli.StringFlag{
+			Name:        "pod-name",
+			EnvVar:      "POD_NAME",
+			Usage:       "specify pod name",
+			Destination: &opts.PodName,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/bgp/provider"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// getNodeIP returns the name and the address of the node the pod runs on
+func getNodeIP(client kubernetes.Interface, podName, podNamespace string, policy *core.AddressPolicy) (string, net.IP, error) {
+	if podName == "" || podNamespace == "" {
+		return "", nil, fmt.Errorf("Please check the manifest (for missing POD_NAME or POD_NAMESPACE env variables)")
+	}
+
+	pod, err := client.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to get pod: %s", err)
+	}
+
+	node, err := client.CoreV1().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to get node: %s", err)
+	}
+
+	ip, err := policy.NodeIP(node, "")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return node.Name, ip, nil
+}
+
+// getPeers parses the peers, their tcp md5 passwords are read from the
+// Secret by the peer address, or by the key password for all peers
+func getPeers(client kubernetes.Interface, flags []string, namespace, secretName string) ([]bgp.Peer, error) {
+	var data map[string][]byte
+	if secretName != "" {
+		secret, err := client.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get secret %s/%s: %v", namespace, secretName, err)
+		}
+		data = secret.Data
+	}
+
+	peers := make([]bgp.Peer, 0, len(flags))
+	for _, flag := range flags {
+		peer, err := provider.ParsePeer(flag)
+		if err != nil {
+			return nil, err
+		}
+		if password, ok := data[peer.Address.String()]; ok {
+			peer.Password = string(password)
+		} else if password, ok := data["password"]; ok {
+			peer.Password = string(password)
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/bgp/version"
+	log "github.com/zoumo/logdog"
+)
+
+var (
+	_ core.Provider           = &BGPProvider{}
+	_ core.InterfaceProvider  = &BGPProvider{}
+	_ core.FamilyProvider     = &BGPProvider{}
+	_ core.ResyncProvider     = &BGPProvider{}
+	_ core.DeletionProvider   = &BGPProvider{}
+	_ core.StatusProvider     = &BGPProvider{}
+	_ core.HealthzProvider    = &BGPProvider{}
+	_ core.PortHealthProvider = &BGPProvider{}
+)
+
+const (
+	// DefaultCheckInterval is the default interval of the checks of the
+	// dataplane
+	DefaultCheckInterval = 5 * time.Second
+	// StatusResyncPeriod is the period of the resyncs reporting the
+	// sessions in the status of the LoadBalancer
+	StatusResyncPeriod = 30 * time.Second
+)
+
+// Dataplane serves the traffic of the VIPs routed to the node, e.g. the
+// ipvs provider
+type Dataplane interface {
+	core.Provider
+	core.HealthzProvider
+}
+
+// Config configures the BGPProvider
+type Config struct {
+	// NodeName keys the status of the node in the LoadBalancer status
+	NodeName string
+	ASN      uint32
+	RouterID net.IP
+	Peers    []bgp.Peer
+	HoldTime time.Duration
+	// CheckInterval is the interval of the checks of the dataplane, the
+	// routes are withdrawn once it turns unhealthy
+	CheckInterval time.Duration
+}
+
+// ParsePeer parses a peer in the form of asn@address, with an optional
+// port, e.g. 64512@10.0.0.254 or 64512@[2001:db8::1]:1179
+func ParsePeer(s string) (bgp.Peer, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 {
+		return bgp.Peer{}, fmt.Errorf("invalid bgp peer %q, it must be asn@address", s)
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || asn == 0 {
+		return bgp.Peer{}, fmt.Errorf("invalid asn of bgp peer %q", s)
+	}
+	peer := bgp.Peer{ASN: uint32(asn)}
+	host := parts[1]
+	if h, port, err := net.SplitHostPort(parts[1]); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return bgp.Peer{}, fmt.Errorf("invalid port of bgp peer %q", s)
+		}
+		host, peer.Port = h, p
+	}
+	if peer.Address = net.ParseIP(host); peer.Address == nil {
+		return bgp.Peer{}, fmt.Errorf("invalid address of bgp peer %q", s)
+	}
+	return peer, nil
+}
+
+// BGPProvider announces the host routes of the VIPs to the upstream routers
+// by BGP while the dataplane of the node serves them, so the routers spread
+// the traffic across the nodes by ECMP instead of a single VRRP master.
+// The routes are withdrawn once the dataplane turns unhealthy, the
+// LoadBalancer is deleted or the provider stops.
+type BGPProvider struct {
+	cfg         Config
+	dataplane   Dataplane
+	speaker     *bgp.Speaker
+	storeLister core.StoreLister
+	stopCh      chan struct{}
+	stopped     sync.WaitGroup
+
+	mu sync.Mutex
+	// vips and nodes are the ones of the last update, err is its error
+	vips      []net.IP
+	nodes     []string
+	err       error
+	announced bool
+	reason    string
+}
+
+// NewBGPProvider creates a new BGP LoadBalancer Provider announcing the
+// VIPs served by the dataplane
+func NewBGPProvider(cfg Config, dataplane Dataplane) *BGPProvider {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultCheckInterval
+	}
+	return &BGPProvider{
+		cfg:       cfg,
+		dataplane: dataplane,
+		speaker: bgp.NewSpeaker(bgp.Config{
+			ASN:      cfg.ASN,
+			RouterID: cfg.RouterID,
+			HoldTime: cfg.HoldTime,
+			Peers:    cfg.Peers,
+		}),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// OnUpdate updates the dataplane, the routes are announced once it serves
+// the VIPs
+func (p *BGPProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	err := p.dataplane.OnUpdate(lb)
+	if err != nil {
+		log.Error("update dataplane error", log.Fields{"err": err})
+	}
+
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal || lb.Spec.Providers.Ipvsdr == nil {
+		return err
+	}
+	vips, verr := core.GetVIPs(lb)
+	if verr != nil {
+		return verr
+	}
+
+	p.mu.Lock()
+	p.vips = vips
+	p.nodes = lb.Spec.Nodes.Names
+	p.err = err
+	p.mu.Unlock()
+	p.check()
+	return err
+}
+
+// OnDelete implements core.DeletionProvider, the routes are withdrawn
+func (p *BGPProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	p.vips = nil
+	p.mu.Unlock()
+	p.check()
+	return nil
+}
+
+// unhealthy returns the reason the node can not serve the VIPs, empty if
+// it can
+func (p *BGPProvider) unhealthy() string {
+	if err := p.dataplane.Healthz(); err != nil {
+		return fmt.Sprintf("dataplane is unhealthy: %v", err)
+	}
+	p.mu.Lock()
+	vips, nodes, err := p.vips, p.nodes, p.err
+	p.mu.Unlock()
+	if len(vips) == 0 {
+		return "no vip"
+	}
+	if err != nil {
+		return fmt.Sprintf("dataplane update failed: %v", err)
+	}
+	for _, h := range p.PortHealth() {
+		if !h.Healthy {
+			return fmt.Sprintf("port %s/%d is unhealthy: %s", h.Protocol, h.Port, h.Reason)
+		}
+	}
+	families := make(map[corenet.Family]bool)
+	for _, vip := range vips {
+		family := corenet.FamilyOf(vip)
+		if families[family] {
+			continue
+		}
+		families[family] = true
+		ready := false
+		for _, rs := range p.storeLister.RealServers(nodes, family) {
+			if rs.Weight > 0 {
+				ready = true
+				break
+			}
+		}
+		if !ready {
+			return fmt.Sprintf("no %s real server is ready", family)
+		}
+	}
+	return ""
+}
+
+// check announces the routes of the VIPs if the node serves them, and
+// withdraws them otherwise
+func (p *BGPProvider) check() {
+	reason := p.unhealthy()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	routes := make([]*net.IPNet, 0, len(p.vips))
+	if reason == "" {
+		for _, vip := range p.vips {
+			routes = append(routes, bgp.HostRoute(vip))
+		}
+	}
+	if reason != p.reason {
+		if reason == "" {
+			log.Info("Announcing vips", log.Fields{"vips": p.vips})
+		} else {
+			log.Warn("Withdrawing vips", log.Fields{"vips": p.vips, "reason": reason})
+		}
+	}
+	p.speaker.Announce(routes)
+	p.announced = len(routes) > 0
+	p.reason = reason
+}
+
+// Start starts the dataplane and connects the sessions to the peers
+func (p *BGPProvider) Start() {
+	log.Info("Startting bgp provider", log.Fields{"asn": p.cfg.ASN, "routerID": p.cfg.RouterID, "peers": len(p.cfg.Peers)})
+	p.dataplane.Start()
+	p.speaker.Start()
+
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(p.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// WaitForStart waits for the dataplane
+func (p *BGPProvider) WaitForStart() bool {
+	return p.dataplane.WaitForStart()
+}
+
+// Stop withdraws the routes and closes the sessions before the dataplane
+// stops, so the routers move the traffic to the other nodes first
+func (p *BGPProvider) Stop() error {
+	log.Info("Shutting down bgp provider")
+	close(p.stopCh)
+	p.stopped.Wait()
+	p.speaker.Stop()
+	return p.dataplane.Stop()
+}
+
+// Healthz implements core.HealthzProvider, the provider is unhealthy if
+// the dataplane is or no session is established
+func (p *BGPProvider) Healthz() error {
+	if err := p.dataplane.Healthz(); err != nil {
+		return err
+	}
+	states := make([]string, 0, len(p.cfg.Peers))
+	for _, s := range p.speaker.Status() {
+		if s.State == bgp.StateEstablished {
+			return nil
+		}
+		states = append(states, s.Address+" "+string(s.State))
+	}
+	return fmt.Errorf("no bgp session established: %s", strings.Join(states, ", "))
+}
+
+// NodeStatus is the status of the node in the LoadBalancer status
+type NodeStatus struct {
+	Announced bool             `json:"announced"`
+	Reason    string           `json:"reason,omitempty"`
+	Peers     []bgp.PeerStatus `json:"peers"`
+}
+
+// Status implements core.StatusProvider, the status of the node is kept in
+// providersStatuses.bgp by the node name
+func (p *BGPProvider) Status() json.RawMessage {
+	p.mu.Lock()
+	status := NodeStatus{Announced: p.announced, Reason: p.reason, Peers: p.speaker.Status()}
+	p.mu.Unlock()
+	data, _ := json.Marshal(map[string]interface{}{
+		"providersStatuses": map[string]interface{}{
+			"bgp": map[string]interface{}{
+				p.cfg.NodeName: status,
+			},
+		},
+	})
+	return data
+}
+
+// ResyncAfter implements core.ResyncProvider, the sessions change without
+// the LoadBalancer, they are reported on the periodic resyncs
+func (p *BGPProvider) ResyncAfter() time.Duration {
+	return StatusResyncPeriod
+}
+
+// Interfaces implements core.InterfaceProvider by the dataplane
+func (p *BGPProvider) Interfaces() []string {
+	if ip, ok := p.dataplane.(core.InterfaceProvider); ok {
+		return ip.Interfaces()
+	}
+	return nil
+}
+
+// PortHealth implements core.PortHealthProvider by the dataplane, the routes
+// are withdrawn while a port is unhealthy
+func (p *BGPProvider) PortHealth() []core.PortHealth {
+	if php, ok := p.dataplane.(core.PortHealthProvider); ok {
+		return php.PortHealth()
+	}
+	return nil
+}
+
+// SupportedFamilies implements core.FamilyProvider, both families are
+// routed to the peers of their own
+func (p *BGPProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *BGPProvider) Info() core.Info {
+	return core.Info{
+		Name:       "bgp",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+		// the traffic is served by the dataplane
+		Capabilities: p.dataplane.Info().Capabilities,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *BGPProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+	p.dataplane.SetListers(lister)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	ipvsprovider "github.com/caicloud/loadbalancer-provider/providers/ipvs/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeDataplane records the updates, its health is set by the tests
+type fakeDataplane struct {
+	mu      sync.Mutex
+	updates int
+	health  error
+	ports   []core.PortHealth
+	stopped bool
+}
+
+func (f *fakeDataplane) Info() core.Info             { return core.Info{Name: "fake"} }
+func (f *fakeDataplane) SetListers(core.StoreLister) {}
+func (f *fakeDataplane) Start()                      {}
+func (f *fakeDataplane) WaitForStart() bool          { return true }
+func (f *fakeDataplane) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	f.mu.Lock()
+	f.updates++
+	f.mu.Unlock()
+	return nil
+}
+func (f *fakeDataplane) Stop() error         { f.mu.Lock(); f.stopped = true; f.mu.Unlock(); return nil }
+func (f *fakeDataplane) Healthz() error      { f.mu.Lock(); defer f.mu.Unlock(); return f.health }
+func (f *fakeDataplane) setHealth(err error) { f.mu.Lock(); f.health = err; f.mu.Unlock() }
+func (f *fakeDataplane) PortHealth() []core.PortHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ports
+}
+func (f *fakeDataplane) setPorts(ports ...core.PortHealth) {
+	f.mu.Lock()
+	f.ports = ports
+	f.mu.Unlock()
+}
+
+func newTestNode(name, ip string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100", Scheduler: netv1alpha1.IpvsSchedulerRR}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+// router is an in-process BGP speaker accepting a session, the messages it
+// receives after the handshake are sent to its channel
+type router struct {
+	ln   net.Listener
+	msgs chan bgp.Message
+}
+
+func newRouter(t *testing.T) *router {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &router{ln: ln, msgs: make(chan bgp.Message, 100)}
+	go r.serve()
+	return r
+}
+
+func (r *router) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if _, err := bgp.ReadMessage(conn, false); err != nil {
+				return
+			}
+			bgp.WriteMessage(conn, &bgp.Open{AS: 64513, HoldTime: 3, RouterID: net.ParseIP("10.0.0.254")})
+			bgp.WriteMessage(conn, &bgp.Keepalive{})
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-done:
+						return
+					case <-time.After(time.Second):
+						bgp.WriteMessage(conn, &bgp.Keepalive{})
+					}
+				}
+			}()
+			for {
+				msg, err := bgp.ReadMessage(conn, true)
+				if err != nil {
+					return
+				}
+				if _, ok := msg.(*bgp.Keepalive); !ok {
+					r.msgs <- msg
+				}
+			}
+		}()
+	}
+}
+
+func (r *router) peer() bgp.Peer {
+	addr := r.ln.Addr().(*net.TCPAddr)
+	return bgp.Peer{Address: addr.IP, Port: addr.Port, ASN: 64513}
+}
+
+func (r *router) next(t *testing.T) bgp.Message {
+	select {
+	case msg := <-r.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return nil
+}
+
+func TestParsePeer(t *testing.T) {
+	peer, err := ParsePeer("64513@10.0.0.254")
+	assert.Nil(t, err)
+	assert.Equal(t, bgp.Peer{Address: net.ParseIP("10.0.0.254"), ASN: 64513}, peer)
+	peer, err = ParsePeer("4200000001@[2001:db8::1]:1179")
+	assert.Nil(t, err)
+	assert.Equal(t, bgp.Peer{Address: net.ParseIP("2001:db8::1"), Port: 1179, ASN: 4200000001}, peer)
+
+	for _, s := range []string{"10.0.0.254", "0@10.0.0.254", "64513@router", "64513@10.0.0.254:bgp"} {
+		_, err := ParsePeer(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	dataplane := &ipvsprovider.IpvsProvider{}
+	p := NewBGPProvider(Config{NodeName: "node1"}, dataplane)
+	assert.Equal(t, dataplane.Info().Capabilities, p.Info().Capabilities)
+
+	// the ports the dataplane does not serve are rejected
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyHTTPPorts] = `[{"port":80,"service":"web","servicePort":80}]`
+	assert.NotNil(t, core.ValidateCapabilities(lb, p.Info().Capabilities))
+}
+
+func TestBGPProvider(t *testing.T) {
+	r := newRouter(t)
+	defer r.ln.Close()
+
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+	dp := &fakeDataplane{}
+	p := NewBGPProvider(Config{
+		NodeName:      "node1",
+		ASN:           64512,
+		RouterID:      net.ParseIP("192.168.1.1"),
+		Peers:         []bgp.Peer{r.peer()},
+		CheckInterval: 50 * time.Millisecond,
+	}, dp)
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	p.Start()
+
+	vip := bgp.HostRoute(net.ParseIP("10.0.0.100"))
+	lb := newTestLoadBalancer("node1")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, 1, dp.updates)
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Announced)
+	assert.Nil(t, p.Healthz())
+
+	status := map[string]map[string]map[string]NodeStatus{}
+	assert.Nil(t, json.Unmarshal(p.Status(), &status))
+	node := status["providersStatuses"]["bgp"]["node1"]
+	assert.True(t, node.Announced)
+	assert.Equal(t, bgp.StateEstablished, node.Peers[0].State)
+	assert.Equal(t, 1, node.Peers[0].Routes)
+
+	// the routes are withdrawn once the dataplane turns unhealthy, and
+	// announced again once it recovers
+	dp.setHealth(fmt.Errorf("ipvs is gone"))
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Withdrawn)
+	assert.NotNil(t, p.Healthz())
+	assert.Nil(t, json.Unmarshal(p.Status(), &status))
+	assert.False(t, status["providersStatuses"]["bgp"]["node1"].Announced)
+	assert.Equal(t, "dataplane is unhealthy: ipvs is gone", status["providersStatuses"]["bgp"]["node1"].Reason)
+	dp.setHealth(nil)
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Announced)
+
+	// no real server is ready
+	nodes.Update(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Withdrawn)
+	nodes.Update(newTestNode("node1", "192.168.1.1"))
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Announced)
+
+	// a port of the dataplane turns unhealthy
+	dp.setPorts(core.PortHealth{Protocol: "tcp", Port: 80, Healthy: true}, core.PortHealth{Protocol: "tcp", Port: 443, Reason: "no server"})
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Withdrawn)
+	assert.Nil(t, json.Unmarshal(p.Status(), &status))
+	assert.Equal(t, "port tcp/443 is unhealthy: no server", status["providersStatuses"]["bgp"]["node1"].Reason)
+	dp.setPorts(core.PortHealth{Protocol: "tcp", Port: 80, Healthy: true}, core.PortHealth{Protocol: "tcp", Port: 443, Healthy: true})
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Announced)
+
+	// deleted
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Withdrawn)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Announced)
+
+	// the routes are withdrawn and the session is ceased before the
+	// dataplane stops
+	assert.Nil(t, p.Stop())
+	assert.Equal(t, []*net.IPNet{vip}, r.next(t).(*bgp.Update).Withdrawn)
+	assert.Equal(t, &bgp.Notification{Code: bgp.ErrCease, Subcode: bgp.SubcodeAdminShutdown, Data: []byte{}}, r.next(t))
+	assert.True(t, dp.stopped)
+	assert.NotNil(t, p.Healthz())
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/caicloud/loadbalancer-controller/pkg/tprclient"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/chaos"
+	"github.com/caicloud/loadbalancer-provider/core/provider/replay"
+	"github.com/caicloud/loadbalancer-provider/core/provider/tpr"
+	"github.com/caicloud/loadbalancer-provider/core/provider/validate"
+	"github.com/caicloud/loadbalancer-provider/providers/bigip/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/bigip/version"
+	log "github.com/zoumo/logdog"
+	"gopkg.in/urfave/cli.v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func Run(opts *Options) error {
+	log.Info("Provider Build Information", log.Fields{
+		"release": version.RELEASE,
+		"commit":  version.COMMIT,
+		"repo":    version.REPO,
+	})
+
+	log.Info("Provider Running with", log.Fields{
+		"debug":     opts.Debug,
+		"kubconfig": opts.Kubeconfig,
+		"lb.ns":     opts.LoadBalancerNamespace,
+		"lb.name":   opts.LoadBalancerName,
+	})
+
+	if opts.Debug {
+		log.ApplyOptions(log.DebugLevel)
+	} else {
+		log.ApplyOptions(log.InfoLevel)
+	}
+
+	// build config
+	log.Infof("load kubeconfig from %s", opts.Kubeconfig)
+	config, err := clientcmd.BuildConfigFromFlags("", opts.Kubeconfig)
+	if err != nil {
+		log.Fatal("Create kubeconfig error", log.Fields{"err": err})
+		return err
+	}
+
+	// create clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal("Create kubernetes client error", log.Fields{"err": err})
+		return err
+	}
+
+	// create tpr clientset
+	tprclientset, err := tprclient.NewForConfig(config)
+	if err != nil {
+		log.Fatal("Create tpr client error", log.Fields{"err": err})
+		return err
+	}
+
+	_, err = tprclientset.NetworkingV1alpha1().LoadBalancers(opts.LoadBalancerNamespace).Get(opts.LoadBalancerName, metav1.GetOptions{})
+	if err != nil {
+		log.Fatal("Can not find loadbalancer resource", log.Fields{"lb.ns": opts.LoadBalancerNamespace, "lb.name": opts.LoadBalancerName})
+		return err
+	}
+
+	addressTypes, err := core.ParseAddressTypes(opts.NodeAddressTypes)
+	if err != nil {
+		log.Error("invalid node address types", log.Fields{"err": err})
+		return err
+	}
+
+	bigip := provider.NewBigIPProvider(provider.Config{
+		CredentialsSecret: opts.CredentialsSecret,
+	})
+
+	backend, err := chaos.Wrap(bigip, opts.Chaos)
+	if err != nil {
+		log.Error("invalid chaos policy", log.Fields{"err": err})
+		return err
+	}
+
+	lp, err := tpr.NewLoadBalancerProvider(&core.Configuration{
+		KubeClient:            clientset,
+		Backend:               backend,
+		RecordPath:            opts.Record,
+		LoadBalancerName:      opts.LoadBalancerName,
+		LoadBalancerNamespace: opts.LoadBalancerNamespace,
+		SkipMTUCheck:          true,
+		AddressTypes:          addressTypes,
+	}, tprclientset)
+	if err != nil {
+		log.Error("create loadbalancer provider error", log.Fields{"err": err})
+		return err
+	}
+
+	// handle shutdown
+	go handleSigterm(lp)
+
+	if opts.HTTPAddress != "" {
+		go serveHTTP(opts.HTTPAddress, lp)
+	}
+
+	lp.Start()
+
+	// never stop until sigterm processed
+	<-wait.NeverStop
+
+	return nil
+}
+
+func main() {
+	// fix for avoiding glog Noisy logs
+	flag.CommandLine.Parse([]string{})
+
+	app := cli.NewApp()
+	app.Name = "provider-bigip"
+	app.Version = "v0.1.0"
+	app.Compiled = time.Now()
+
+	// add flags to app
+	opts := NewOptions()
+	opts.AddFlags(app)
+
+	app.Commands = []cli.Command{validate.Command(&provider.BigIPProvider{}), replay.Command(&provider.BigIPProvider{})}
+
+	app.Action = func(c *cli.Context) error {
+		if err := Run(opts); err != nil {
+			msg := fmt.Sprintf("running loadbalancer controller failed, with err: %v\n", err)
+			return cli.NewExitError(msg, 1)
+		}
+		return nil
+	}
+
+	sort.Sort(cli.FlagsByName(app.Flags))
+
+	app.Run(os.Args)
+}
+
+func serveHTTP(address string, p *core.GenericProvider) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", p.HealthzHandler())
+	mux.Handle("/version", p.VersionHandler())
+	mux.Handle("/state", p.StateHandler())
+	log.Info("Serving http", log.Fields{"address": address})
+	err := http.ListenAndServe(address, mux)
+	log.Error("serve http error", log.Fields{"address": address, "err": err})
+}
+
+func handleSigterm(p *core.GenericProvider) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM)
+	<-signalChan
+	log.Infof("Received SIGTERM, shutting down")
+
+	exitCode := 0
+	if err := p.Stop(); err != nil {
+		log.Infof("Error during shutdown %v", err)
+		exitCode = 1
+	}
+
+	log.Infof("Exiting with %v", exitCode)
+	os.Exit(exitCode)
+}
@@ -0,0 +1,643 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/bigip/version"
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	_ core.Provider         = &BigIPProvider{}
+	_ core.DeletionProvider = &BigIPProvider{}
+)
+
+const (
+	// AnnotationKeyMonitor is the monitor of the pool members in json,
+	// e.g. {"type": "http", "port": 10254, "path": "/healthz"}. The type
+	// defaults to tcp, the port to the one of the member, and the interval
+	// and the timeout in seconds to 5 and 16.
+	AnnotationKeyMonitor = "loadbalancer.caicloud.io/bigip-monitor"
+	// AnnotationKeyClientSSL maps the tcp ports terminating tls to the tls
+	// Secrets in the namespace of the LoadBalancer in json, e.g.
+	// {"443": "example-tls"}
+	AnnotationKeyClientSSL = "loadbalancer.caicloud.io/bigip-client-ssl"
+
+	// uidKey and ownerKey are the keys of the description of the objects
+	// created for a LoadBalancer, the LoadBalancers of a namespace share
+	// its partition and the objects described otherwise are never touched
+	uidKey   = "caicloud.io/loadbalancer-uid"
+	ownerKey = "caicloud.io/loadbalancer"
+
+	// DefaultRetryDelay and DefaultMaxRetryDelay bound the backoff of the
+	// retries of the failed requests
+	DefaultRetryDelay    = 5 * time.Second
+	DefaultMaxRetryDelay = 5 * time.Minute
+)
+
+// Config configures the BigIPProvider
+type Config struct {
+	// CredentialsSecret is the Secret in the namespace of the LoadBalancer
+	// holding the url of the BIG-IP, e.g. https://10.0.0.10, and the user
+	// in the keys url, username and password. The certificate of the
+	// BIG-IP is not verified if the key insecure is true.
+	CredentialsSecret string
+	// RetryDelay is the delay of the first retry of the failed requests,
+	// it doubles on every retry up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// BigIPProvider programs the LoadBalancer onto a BIG-IP by iControl REST,
+// in the partition named after the namespace of the LoadBalancer: a
+// virtual server on the VIP and a pool of the nodes per port, a monitor of
+// the pool members and the optional client ssl profiles.
+type BigIPProvider struct {
+	cfg         Config
+	storeLister core.StoreLister
+	newClient   func(url, username, password string, insecure bool) *bigipClient
+
+	mu     sync.Mutex
+	client *bigipClient
+	// secretVersion is the resource version of the credentials the client
+	// is created with
+	secretVersion string
+	// failures counts the consecutive failed syncs for the backoff
+	failures uint
+}
+
+// NewBigIPProvider creates a new BIG-IP LoadBalancer Provider
+func NewBigIPProvider(cfg Config) *BigIPProvider {
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	return &BigIPProvider{cfg: cfg, newClient: newBigIPClient}
+}
+
+// description returns the description of the objects created for the
+// LoadBalancer
+func description(lb *netv1alpha1.LoadBalancer) string {
+	data, _ := json.Marshal(map[string]string{
+		uidKey:   string(lb.UID),
+		ownerKey: lb.Namespace + "/" + lb.Name,
+	})
+	return string(data)
+}
+
+// owned returns true if the description is the one of the LoadBalancer
+func owned(lb *netv1alpha1.LoadBalancer, desc string) bool {
+	values := make(map[string]string)
+	if json.Unmarshal([]byte(desc), &values) != nil {
+		return false
+	}
+	return values[uidKey] == string(lb.UID)
+}
+
+// checkOwner returns a PermanentError if the object is not created for the
+// LoadBalancer
+func checkOwner(lb *netv1alpha1.LoadBalancer, kind, name, desc string) error {
+	if !owned(lb, desc) {
+		return core.NewPermanentError("BigIPObjectConflict", fmt.Errorf("%s %s is not created for the loadbalancer, its description is %q", kind, name, desc))
+	}
+	return nil
+}
+
+func virtualName(lb *netv1alpha1.LoadBalancer, port corenet.Port) string {
+	return fmt.Sprintf("%s-%s-%d", lb.Name, port.Protocol, port.Port)
+}
+
+func poolName(lb *netv1alpha1.LoadBalancer, port corenet.Port) string {
+	return virtualName(lb, port) + "-pool"
+}
+
+func monitorName(lb *netv1alpha1.LoadBalancer, typ string) string {
+	return fmt.Sprintf("%s-%s-monitor", lb.Name, typ)
+}
+
+func clientSSLName(lb *netv1alpha1.LoadBalancer, port int) string {
+	return fmt.Sprintf("%s-%d-clientssl", lb.Name, port)
+}
+
+// addressPort returns the address and the port in the notation of BIG-IP,
+// the ipv6 ones are separated by a dot
+func addressPort(ip net.IP, port int) string {
+	if ip.To4() == nil {
+		return ip.String() + "." + strconv.Itoa(port)
+	}
+	return ip.String() + ":" + strconv.Itoa(port)
+}
+
+// getClient returns the client with the current credentials
+func (p *BigIPProvider) getClient(lb *netv1alpha1.LoadBalancer) (*bigipClient, error) {
+	secret, err := p.storeLister.Secret.Secrets(lb.Namespace).Get(p.cfg.CredentialsSecret)
+	if err != nil {
+		return nil, core.NewPermanentError("InvalidBigIPCredentials", fmt.Errorf("get bigip credentials %s/%s error: %v", lb.Namespace, p.cfg.CredentialsSecret, err))
+	}
+	if p.client != nil && secret.ResourceVersion == p.secretVersion {
+		return p.client, nil
+	}
+	for _, key := range []string{"url", "username", "password"} {
+		if len(secret.Data[key]) == 0 {
+			return nil, core.NewPermanentError("InvalidBigIPCredentials", fmt.Errorf("bigip credentials %s/%s has no %s", lb.Namespace, secret.Name, key))
+		}
+	}
+	insecure := string(secret.Data["insecure"]) == "true"
+	p.client = p.newClient(string(secret.Data["url"]), string(secret.Data["username"]), string(secret.Data["password"]), insecure)
+	p.secretVersion = secret.ResourceVersion
+	return p.client, nil
+}
+
+// getMonitor returns the monitor in the annotation, with the name and the
+// description left empty. It returns a PermanentError if it is invalid.
+func getMonitor(lb *netv1alpha1.LoadBalancer, vip net.IP) (string, *monitor, error) {
+	spec := struct {
+		Type     string `json:"type"`
+		Port     int    `json:"port"`
+		Path     string `json:"path"`
+		Interval int    `json:"interval"`
+		Timeout  int    `json:"timeout"`
+	}{Type: "tcp", Path: "/", Interval: 5, Timeout: 16}
+	if value, ok := lb.Annotations[AnnotationKeyMonitor]; ok {
+		if err := json.Unmarshal([]byte(value), &spec); err != nil {
+			return "", nil, core.NewPermanentError("InvalidBigIPMonitor", fmt.Errorf("invalid monitor %q: %v", value, err))
+		}
+	}
+	switch {
+	case spec.Type != "tcp" && spec.Type != "http":
+		return "", nil, core.NewPermanentError("InvalidBigIPMonitor", fmt.Errorf("invalid monitor type %q, it must be tcp or http", spec.Type))
+	case spec.Port < 0 || spec.Port > 65535:
+		return "", nil, core.NewPermanentError("InvalidBigIPMonitor", fmt.Errorf("invalid monitor port %d", spec.Port))
+	case spec.Interval <= 0 || spec.Timeout <= spec.Interval:
+		return "", nil, core.NewPermanentError("InvalidBigIPMonitor", fmt.Errorf("invalid monitor interval %d and timeout %d, the timeout must be longer", spec.Interval, spec.Timeout))
+	case !strings.HasPrefix(spec.Path, "/"):
+		return "", nil, core.NewPermanentError("InvalidBigIPMonitor", fmt.Errorf("invalid monitor path %q", spec.Path))
+	}
+
+	m := &monitor{Interval: spec.Interval, Timeout: spec.Timeout}
+	// the wildcard alias checks the members on their own ports
+	sep, port := ":", "*"
+	if vip.To4() == nil {
+		sep = "."
+	}
+	if spec.Port != 0 {
+		port = strconv.Itoa(spec.Port)
+	}
+	m.Destination = "*" + sep + port
+	if spec.Type == "http" {
+		m.Send = fmt.Sprintf("GET %s HTTP/1.0\\r\\n\\r\\n", spec.Path)
+		m.Recv = "^HTTP/1\\.[01] [23]"
+	}
+	return spec.Type, m, nil
+}
+
+// getClientSSL returns the tls Secrets of the tcp ports terminating tls. It
+// returns a PermanentError if they are invalid.
+func (p *BigIPProvider) getClientSSL(lb *netv1alpha1.LoadBalancer, ports []corenet.Port) (map[int]*v1.Secret, error) {
+	value, ok := lb.Annotations[AnnotationKeyClientSSL]
+	if !ok {
+		return nil, nil
+	}
+	names := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &names); err != nil {
+		return nil, core.NewPermanentError("InvalidBigIPClientSSL", fmt.Errorf("invalid client ssl %q: %v", value, err))
+	}
+	tcp := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		if port.Protocol == "tcp" {
+			tcp[int(port.Port)] = true
+		}
+	}
+
+	secrets := make(map[int]*v1.Secret, len(names))
+	for key, name := range names {
+		port, err := strconv.Atoi(key)
+		if err != nil || !tcp[port] {
+			return nil, core.NewPermanentError("InvalidBigIPClientSSL", fmt.Errorf("client ssl port %q is not a tcp port of the loadbalancer", key))
+		}
+		secret, err := p.storeLister.Secret.Secrets(lb.Namespace).Get(name)
+		if err != nil {
+			return nil, core.NewPermanentError("InvalidBigIPClientSSL", fmt.Errorf("get tls secret %s/%s error: %v", lb.Namespace, name, err))
+		}
+		if len(secret.Data[v1.TLSCertKey]) == 0 || len(secret.Data[v1.TLSPrivateKeyKey]) == 0 {
+			return nil, core.NewPermanentError("InvalidBigIPClientSSL", fmt.Errorf("tls secret %s/%s has no %s or %s", lb.Namespace, name, v1.TLSCertKey, v1.TLSPrivateKeyKey))
+		}
+		secrets[port] = secret
+	}
+	return secrets, nil
+}
+
+// members returns the pool members of the nodes on the port, the nodes
+// weighted to zero, e.g. not ready, are left out
+func (p *BigIPProvider) members(lb *netv1alpha1.LoadBalancer, family corenet.Family, port int) []member {
+	members := make([]member, 0, len(lb.Spec.Nodes.Names))
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, family) {
+		if rs.Weight == 0 {
+			continue
+		}
+		members = append(members, member{Name: addressPort(rs.IP, port), Address: rs.IP.String()})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// retry translates the failed requests into RetryAfterErrors, the delay
+// doubles on the consecutive ones
+func (p *BigIPProvider) retry(err error) error {
+	if err == nil {
+		p.failures = 0
+		return nil
+	}
+	if core.IsPermanentError(err) {
+		return err
+	}
+	delay := p.cfg.MaxRetryDelay
+	if p.failures < 16 {
+		if d := p.cfg.RetryDelay << p.failures; d < delay {
+			delay = d
+		}
+	}
+	p.failures++
+	return core.NewRetryAfterError(delay, err)
+}
+
+// OnUpdate reconciles the objects of the LoadBalancer in its partition, the
+// objects created for it but no longer desired are deleted
+func (p *BigIPProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retry(p.sync(lb))
+}
+
+func (p *BigIPProvider) sync(lb *netv1alpha1.LoadBalancer) error {
+	vips, err := core.GetVIPs(lb)
+	if err != nil {
+		return err
+	}
+	if len(vips) == 0 {
+		return core.NewPermanentError("NoVIP", fmt.Errorf("no vip to serve on the bigip"))
+	}
+	// the virtual servers listen on the VIP of the ipvsdr spec
+	vip := vips[0]
+	family := corenet.FamilyOf(vip)
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return err
+	}
+	typ, mon, err := getMonitor(lb, vip)
+	if err != nil {
+		return err
+	}
+	secrets, err := p.getClientSSL(lb, ports)
+	if err != nil {
+		return err
+	}
+	c, err := p.getClient(lb)
+	if err != nil {
+		return err
+	}
+
+	partition := lb.Namespace
+	if err := p.ensurePartition(c, partition); err != nil {
+		return err
+	}
+
+	mon.Name, mon.Partition, mon.Description = monitorName(lb, typ), partition, description(lb)
+	if err := p.ensureMonitor(c, lb, typ, mon); err != nil {
+		return err
+	}
+
+	keep := make(map[string]bool)
+	keep[fullPath(partition, mon.Name)] = true
+	for port, secret := range secrets {
+		profile, err := p.ensureClientSSL(c, lb, port, secret)
+		if err != nil {
+			return err
+		}
+		keep[profile] = true
+	}
+
+	for _, port := range ports {
+		pl := &pool{
+			Name:              poolName(lb, port),
+			Partition:         partition,
+			Description:       description(lb),
+			Monitor:           fullPath(partition, mon.Name),
+			LoadBalancingMode: "round-robin",
+			Members:           p.members(lb, family, int(port.Port)),
+		}
+		if err := p.ensurePool(c, lb, pl); err != nil {
+			return err
+		}
+		keep[fullPath(partition, pl.Name)] = true
+
+		vs := &virtual{
+			Name:                     virtualName(lb, port),
+			Partition:                partition,
+			Description:              description(lb),
+			Destination:              fullPath(partition, addressPort(vip, int(port.Port))),
+			IPProtocol:               port.Protocol,
+			Pool:                     fullPath(partition, pl.Name),
+			SourceAddressTranslation: map[string]string{"type": "automap"},
+			Profiles:                 []reference{{Name: "/Common/" + port.Protocol}},
+		}
+		if _, ok := secrets[int(port.Port)]; ok {
+			vs.Profiles = append(vs.Profiles, reference{Name: fullPath(partition, clientSSLName(lb, int(port.Port))), Context: "clientside"})
+		}
+		if err := p.ensureVirtual(c, lb, vs); err != nil {
+			return err
+		}
+		keep[fullPath(partition, vs.Name)] = true
+	}
+
+	return p.deleteObjects(c, lb, keep)
+}
+
+func (p *BigIPProvider) ensurePartition(c *bigipClient, name string) error {
+	err := c.do(http.MethodGet, "/mgmt/tm/"+kindPartition+"/"+name, nil, nil)
+	if !isNotFound(err) {
+		return err
+	}
+	log.Info("Creating bigip partition", log.Fields{"partition": name})
+	return c.create(kindPartition, &partition{Name: name, Description: "created for the loadbalancers of the namespace " + name})
+}
+
+func (p *BigIPProvider) ensureMonitor(c *bigipClient, lb *netv1alpha1.LoadBalancer, typ string, desired *monitor) error {
+	kind := kindTCPMonitor
+	if typ == "http" {
+		kind = kindHTTP
+	}
+	cur := &monitor{}
+	found, err := c.get(kind, desired.Partition, desired.Name, cur)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating bigip monitor", log.Fields{"name": desired.Name})
+		return c.create(kind, desired)
+	}
+	if err := checkOwner(lb, "monitor", desired.Name, cur.Description); err != nil {
+		return err
+	}
+	if cur.Destination == desired.Destination && cur.Interval == desired.Interval && cur.Timeout == desired.Timeout &&
+		strings.TrimSpace(cur.Send) == strings.TrimSpace(desired.Send) && cur.Recv == desired.Recv {
+		return nil
+	}
+	log.Info("Updating bigip monitor", log.Fields{"name": desired.Name})
+	return c.update(kind, desired.Partition, desired.Name, desired)
+}
+
+// ensureClientSSL installs the certificate and the key of the Secret, and
+// points the client ssl profile of the port to them. The names of the
+// certificate and the key carry the resource version of the Secret, the
+// replaced ones are deleted. It returns the full path of the profile.
+func (p *BigIPProvider) ensureClientSSL(c *bigipClient, lb *netv1alpha1.LoadBalancer, port int, secret *v1.Secret) (string, error) {
+	partition := lb.Namespace
+	base := fmt.Sprintf("%s-%d-%s", lb.Name, port, secret.ResourceVersion)
+	for _, obj := range []struct {
+		kind, name string
+		data       []byte
+	}{
+		{kindCert, base + ".crt", secret.Data[v1.TLSCertKey]},
+		{kindKey, base + ".key", secret.Data[v1.TLSPrivateKeyKey]},
+	} {
+		found, err := c.get(obj.kind, partition, obj.name, &reference{})
+		if err != nil {
+			return "", err
+		}
+		if found {
+			continue
+		}
+		log.Info("Installing bigip "+obj.kind[len("sys/crypto/"):], log.Fields{"name": obj.name, "secret": secret.Name})
+		if err := c.install(obj.kind, partition, obj.name, obj.data); err != nil {
+			return "", err
+		}
+	}
+
+	desired := &clientSSL{
+		Name:         clientSSLName(lb, port),
+		Partition:    partition,
+		Description:  description(lb),
+		DefaultsFrom: "/Common/clientssl",
+		Cert:         fullPath(partition, base+".crt"),
+		Key:          fullPath(partition, base+".key"),
+	}
+	cur := &clientSSL{}
+	found, err := c.get(kindClientSSL, partition, desired.Name, cur)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		log.Info("Creating bigip client ssl profile", log.Fields{"name": desired.Name})
+		return fullPath(partition, desired.Name), c.create(kindClientSSL, desired)
+	}
+	if err := checkOwner(lb, "client ssl profile", desired.Name, cur.Description); err != nil {
+		return "", err
+	}
+	if cur.Cert == desired.Cert && cur.Key == desired.Key {
+		return fullPath(partition, desired.Name), nil
+	}
+	log.Info("Updating bigip client ssl profile", log.Fields{"name": desired.Name, "cert": desired.Cert})
+	if err := c.update(kindClientSSL, partition, desired.Name, desired); err != nil {
+		return "", err
+	}
+	return fullPath(partition, desired.Name), p.deleteCertKey(c, cur)
+}
+
+// deleteCertKey deletes the certificate and the key of the profile
+func (p *BigIPProvider) deleteCertKey(c *bigipClient, profile *clientSSL) error {
+	for kind, path := range map[string]string{kindCert: profile.Cert, kindKey: profile.Key} {
+		if !strings.HasPrefix(path, "/"+profile.Partition+"/") {
+			continue
+		}
+		if err := c.delete(kind, profile.Partition, path[len(profile.Partition)+2:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *BigIPProvider) ensurePool(c *bigipClient, lb *netv1alpha1.LoadBalancer, desired *pool) error {
+	cur := &pool{}
+	found, err := c.get(kindPool, desired.Partition, desired.Name, cur)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating bigip pool", log.Fields{"name": desired.Name, "members": len(desired.Members)})
+		return c.create(kindPool, desired)
+	}
+	if err := checkOwner(lb, "pool", desired.Name, cur.Description); err != nil {
+		return err
+	}
+
+	members := make([]string, 0)
+	if cur.MembersReference != nil {
+		for _, m := range cur.MembersReference.Items {
+			members = append(members, m.Name)
+		}
+	}
+	sort.Strings(members)
+	want := make([]string, 0, len(desired.Members))
+	for _, m := range desired.Members {
+		want = append(want, m.Name)
+	}
+	if strings.TrimSpace(cur.Monitor) == desired.Monitor && strings.Join(members, ",") == strings.Join(want, ",") {
+		return nil
+	}
+	log.Info("Updating bigip pool", log.Fields{"name": desired.Name, "members": want})
+	return c.update(kindPool, desired.Partition, desired.Name, desired)
+}
+
+func (p *BigIPProvider) ensureVirtual(c *bigipClient, lb *netv1alpha1.LoadBalancer, desired *virtual) error {
+	cur := &virtual{}
+	found, err := c.get(kindVirtual, desired.Partition, desired.Name, cur)
+	if err != nil {
+		return err
+	}
+	if !found {
+		log.Info("Creating bigip virtual server", log.Fields{"name": desired.Name, "destination": desired.Destination})
+		return c.create(kindVirtual, desired)
+	}
+	if err := checkOwner(lb, "virtual server", desired.Name, cur.Description); err != nil {
+		return err
+	}
+
+	profiles := make([]string, 0)
+	if cur.ProfilesReference != nil {
+		for _, r := range cur.ProfilesReference.Items {
+			profiles = append(profiles, r.FullPath)
+		}
+	}
+	sort.Strings(profiles)
+	want := make([]string, 0, len(desired.Profiles))
+	for _, r := range desired.Profiles {
+		want = append(want, r.Name)
+	}
+	sort.Strings(want)
+	if cur.Destination == desired.Destination && cur.IPProtocol == desired.IPProtocol && cur.Pool == desired.Pool &&
+		strings.Join(profiles, ",") == strings.Join(want, ",") {
+		return nil
+	}
+	log.Info("Updating bigip virtual server", log.Fields{"name": desired.Name, "destination": desired.Destination})
+	return c.update(kindVirtual, desired.Partition, desired.Name, desired)
+}
+
+// deleteObjects deletes the objects created for the LoadBalancer in its
+// partition but the ones to keep, in the order of their references
+func (p *BigIPProvider) deleteObjects(c *bigipClient, lb *netv1alpha1.LoadBalancer, keep map[string]bool) error {
+	partition := lb.Namespace
+	for _, kind := range []string{kindVirtual, kindPool, kindClientSSL, kindTCPMonitor, kindHTTP} {
+		list := &struct {
+			Items []clientSSL `json:"items"`
+		}{}
+		if err := c.list(kind, partition, list); err != nil {
+			return err
+		}
+		sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if !owned(lb, obj.Description) || keep[fullPath(partition, obj.Name)] {
+				continue
+			}
+			log.Info("Deleting bigip object", log.Fields{"kind": kind, "name": obj.Name})
+			if err := c.delete(kind, partition, obj.Name); err != nil {
+				return err
+			}
+			if kind == kindClientSSL {
+				if err := p.deleteCertKey(c, obj); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// OnDelete implements core.DeletionProvider, the objects created for the
+// LoadBalancer are deleted, the partition is left for the others of the
+// namespace
+func (p *BigIPProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, err := p.getClient(lb)
+	if err != nil {
+		return err
+	}
+	err = c.do(http.MethodGet, "/mgmt/tm/"+kindPartition+"/"+lb.Namespace, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	if err == nil {
+		err = p.deleteObjects(c, lb, nil)
+	}
+	return p.retry(err)
+}
+
+// Start ...
+func (p *BigIPProvider) Start() {
+	log.Info("Startting bigip provider")
+}
+
+// WaitForStart ...
+func (p *BigIPProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the BIG-IP objects alone, they outlive the provider and are
+// deleted with the LoadBalancer
+func (p *BigIPProvider) Stop() error {
+	log.Info("Shutting down bigip provider")
+	return nil
+}
+
+// Info ...
+func (p *BigIPProvider) Info() core.Info {
+	return core.Info{
+		Name:       "bigip",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *BigIPProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
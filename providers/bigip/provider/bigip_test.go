@@ -0,0 +1,475 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeBigIP is an in-memory iControl REST server, the objects are kept by
+// their kinds and full paths
+type fakeBigIP struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	objects map[string]map[string]map[string]interface{}
+	uploads map[string][]byte
+	writes  []string
+	// fail fails the next requests with the status code
+	fail int
+}
+
+func newFakeBigIP() *fakeBigIP {
+	f := &fakeBigIP{
+		objects: make(map[string]map[string]map[string]interface{}),
+		uploads: make(map[string][]byte),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeBigIP) reply(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (f *fakeBigIP) error(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	f.reply(w, code, map[string]interface{}{"code": code, "message": fmt.Sprintf(format, args...)})
+}
+
+func (f *fakeBigIP) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+		f.error(w, http.StatusUnauthorized, "authorization failed")
+		return
+	}
+	if f.fail != 0 {
+		f.error(w, f.fail, "injected failure")
+		return
+	}
+	if r.Method != http.MethodGet {
+		f.writes = append(f.writes, r.Method+" "+r.URL.Path)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if strings.HasPrefix(r.URL.Path, "/mgmt/shared/file-transfer/uploads/") {
+		f.uploads[strings.TrimPrefix(r.URL.Path, "/mgmt/shared/file-transfer/uploads/")] = body
+		f.reply(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+
+	kind, key := strings.TrimPrefix(r.URL.Path, "/mgmt/tm/"), ""
+	if i := strings.Index(kind, "/~"); i >= 0 {
+		kind, key = kind[:i], strings.Replace(kind[i+1:], "~", "/", -1)
+	} else if strings.HasPrefix(kind, kindPartition+"/") {
+		kind, key = kindPartition, "/"+strings.TrimPrefix(kind, kindPartition+"/")
+	}
+	objects := f.objects[kind]
+	if objects == nil {
+		objects = make(map[string]map[string]interface{})
+		f.objects[kind] = objects
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		items := []interface{}{}
+		for _, obj := range objects {
+			if filter := r.URL.Query().Get("$filter"); filter == "" || filter == "partition eq "+obj["partition"].(string) {
+				items = append(items, obj)
+			}
+		}
+		f.reply(w, http.StatusOK, map[string]interface{}{"items": items})
+	case r.Method == http.MethodGet:
+		obj, ok := objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "%s %s was not found", kind, key)
+			return
+		}
+		f.reply(w, http.StatusOK, expand(obj, r.URL.Query().Get("expandSubcollections") == "true"))
+	case r.Method == http.MethodPost:
+		obj := make(map[string]interface{})
+		if err := json.Unmarshal(body, &obj); err != nil {
+			f.error(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		if obj["command"] == "install" {
+			file := strings.TrimPrefix(obj["from-local-file"].(string), downloadsDir)
+			if _, ok := f.uploads[file]; !ok {
+				f.error(w, http.StatusBadRequest, "file %s was not uploaded", file)
+				return
+			}
+			parts := strings.Split(obj["name"].(string), "/")
+			obj = map[string]interface{}{"name": parts[2], "partition": parts[1]}
+		}
+		partition, _ := obj["partition"].(string)
+		if kind == kindPartition {
+			partition = obj["name"].(string)
+		}
+		key = "/" + partition + "/" + obj["name"].(string)
+		if kind == kindPartition {
+			key = "/" + partition
+		}
+		if _, ok := objects[key]; ok {
+			f.error(w, http.StatusConflict, "%s %s already exists", kind, key)
+			return
+		}
+		obj["fullPath"] = key
+		objects[key] = obj
+		f.reply(w, http.StatusOK, obj)
+	case r.Method == http.MethodPatch:
+		obj, ok := objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "%s %s was not found", kind, key)
+			return
+		}
+		patch := make(map[string]interface{})
+		json.Unmarshal(body, &patch)
+		for k, v := range patch {
+			obj[k] = v
+		}
+		f.reply(w, http.StatusOK, obj)
+	case r.Method == http.MethodDelete:
+		if _, ok := objects[key]; !ok {
+			f.error(w, http.StatusNotFound, "%s %s was not found", kind, key)
+			return
+		}
+		// the objects in use can not be deleted
+		for _, others := range f.objects {
+			for other, obj := range others {
+				data, _ := json.Marshal(obj)
+				if other != key && strings.Contains(string(data), "\""+key+"\"") {
+					f.error(w, http.StatusBadRequest, "%s %s is in use by %s", kind, key, other)
+					return
+				}
+			}
+		}
+		delete(objects, key)
+		f.reply(w, http.StatusOK, map[string]interface{}{})
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	}
+}
+
+// expand returns the object as returned by BIG-IP, the subcollections are
+// moved into the references and the monitor gets a trailing space
+func expand(obj map[string]interface{}, subcollections bool) map[string]interface{} {
+	ret := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		ret[k] = v
+	}
+	if monitor, ok := ret["monitor"].(string); ok {
+		ret["monitor"] = monitor + " "
+	}
+	for _, collection := range []string{"members", "profiles"} {
+		items, ok := ret[collection].([]interface{})
+		if !ok {
+			continue
+		}
+		delete(ret, collection)
+		if !subcollections {
+			continue
+		}
+		expanded := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			copied := map[string]interface{}{}
+			for k, v := range item.(map[string]interface{}) {
+				copied[k] = v
+			}
+			name := copied["name"].(string)
+			if !strings.HasPrefix(name, "/") {
+				name = "/" + obj["partition"].(string) + "/" + name
+			}
+			copied["fullPath"] = name
+			expanded = append(expanded, copied)
+		}
+		ret[collection+"Reference"] = map[string]interface{}{"items": expanded}
+	}
+	return ret
+}
+
+// names returns the sorted full paths of the objects of the kind
+func (f *fakeBigIP) names(kind string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []string{}
+	for key := range f.objects[kind] {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (f *fakeBigIP) get(kind, key string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[kind][key]
+}
+
+// Writes returns and resets the requests changing the objects
+func (f *fakeBigIP) Writes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writes := f.writes
+	f.writes = nil
+	return writes
+}
+
+// members returns the names of the members of the pool
+func (f *fakeBigIP) members(key string) []string {
+	ret := []string{}
+	for _, m := range f.get(kindPool, key)["members"].([]interface{}) {
+		ret = append(ret, m.(map[string]interface{})["name"].(string))
+	}
+	return ret
+}
+
+func newTestNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestSecret(name, version string, data map[string]string) *v1.Secret {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, ResourceVersion: version},
+		Data:       make(map[string][]byte),
+	}
+	for k, v := range data {
+		secret.Data[k] = []byte(v)
+	}
+	return secret
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", UID: types.UID("7c1d0f4e-1111-2222-3333-444455556666"), Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "192.168.0.100"}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func newTestProvider(f *fakeBigIP, nodes, secrets cache.Indexer) *BigIPProvider {
+	secrets.Add(newTestSecret("bigip", "1", map[string]string{"url": f.URL, "username": "admin", "password": "secret"}))
+	p := NewBigIPProvider(Config{CredentialsSecret: "bigip", RetryDelay: time.Second, MaxRetryDelay: 4 * time.Second})
+	p.SetListers(core.StoreLister{
+		Node:   v1listers.NewNodeLister(nodes),
+		Secret: v1listers.NewSecretLister(secrets),
+	})
+	return p
+}
+
+func TestOnUpdate(t *testing.T) {
+	f := newFakeBigIP()
+	defer f.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	nodes.Add(newTestNode("node2", "10.0.0.2", true))
+	p := newTestProvider(f, nodes, newIndexer())
+	lb := newTestLoadBalancer("node1", "node2")
+
+	// an object of the partition not created for the loadbalancer
+	f.objects[kindPool] = map[string]map[string]interface{}{
+		"/default/other": {"name": "other", "partition": "default", "description": "", "members": []interface{}{}},
+	}
+
+	// create
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"/default"}, f.names(kindPartition))
+	assert.Equal(t, []string{"/default/lb-tcp-443", "/default/lb-tcp-80"}, f.names(kindVirtual))
+	assert.Equal(t, []string{"/default/lb-tcp-443-pool", "/default/lb-tcp-80-pool", "/default/other"}, f.names(kindPool))
+	assert.Equal(t, []string{"/default/lb-tcp-monitor"}, f.names(kindTCPMonitor))
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.2:80"}, f.members("/default/lb-tcp-80-pool"))
+	assert.Equal(t, "/default/lb-tcp-monitor", f.get(kindPool, "/default/lb-tcp-80-pool")["monitor"])
+	vs := f.get(kindVirtual, "/default/lb-tcp-80")
+	assert.Equal(t, "/default/192.168.0.100:80", vs["destination"])
+	assert.Equal(t, "/default/lb-tcp-80-pool", vs["pool"])
+	assert.Equal(t, "*:*", f.get(kindTCPMonitor, "/default/lb-tcp-monitor")["destination"])
+
+	// nothing changes
+	f.Writes()
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, f.Writes())
+
+	// the members follow the ready nodes
+	nodes.Update(newTestNode("node2", "10.0.0.2", false))
+	nodes.Add(newTestNode("node3", "10.0.0.3", true))
+	lb.Spec.Nodes.Names = []string{"node1", "node2", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"10.0.0.1:80", "10.0.0.3:80"}, f.members("/default/lb-tcp-80-pool"))
+	assert.Equal(t, []string{"10.0.0.1:443", "10.0.0.3:443"}, f.members("/default/lb-tcp-443-pool"))
+	assert.Equal(t, []string{
+		"PATCH /mgmt/tm/ltm/pool/~default~lb-tcp-80-pool",
+		"PATCH /mgmt/tm/ltm/pool/~default~lb-tcp-443-pool",
+	}, f.Writes())
+
+	// the removed ports and the replaced monitor are deleted after the
+	// objects referring to them
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"udp","port":53}]`
+	lb.Annotations[AnnotationKeyMonitor] = `{"type":"http","port":10254,"path":"/healthz"}`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"/default/lb-udp-53"}, f.names(kindVirtual))
+	assert.Equal(t, []string{"/default/lb-udp-53-pool", "/default/other"}, f.names(kindPool))
+	assert.Empty(t, f.names(kindTCPMonitor))
+	assert.Equal(t, []string{"/default/lb-http-monitor"}, f.names(kindHTTP))
+	monitor := f.get(kindHTTP, "/default/lb-http-monitor")
+	assert.Equal(t, "*:10254", monitor["destination"])
+	assert.Equal(t, "GET /healthz HTTP/1.0\\r\\n\\r\\n", monitor["send"])
+	assert.Equal(t, "udp", f.get(kindVirtual, "/default/lb-udp-53")["ipProtocol"])
+
+	// invalid monitor
+	lb.Annotations[AnnotationKeyMonitor] = `{"type":"http","interval":5,"timeout":5}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+func TestClientSSL(t *testing.T) {
+	f := newFakeBigIP()
+	defer f.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("tls", "7", map[string]string{v1.TLSCertKey: "cert", v1.TLSPrivateKeyKey: "key"}))
+	p := newTestProvider(f, nodes, secrets)
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[AnnotationKeyClientSSL] = `{"443":"tls"}`
+
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"/default/lb-443-7.crt"}, f.names(kindCert))
+	assert.Equal(t, []string{"/default/lb-443-7.key"}, f.names(kindKey))
+	assert.Equal(t, []byte("cert"), f.uploads["default_lb-443-7.crt"])
+	profile := f.get(kindClientSSL, "/default/lb-443-clientssl")
+	assert.Equal(t, "/default/lb-443-7.crt", profile["cert"])
+	assert.Equal(t, "/default/lb-443-7.key", profile["key"])
+	profiles, _ := json.Marshal(f.get(kindVirtual, "/default/lb-tcp-443")["profiles"])
+	assert.Equal(t, `[{"name":"/Common/tcp"},{"context":"clientside","name":"/default/lb-443-clientssl"}]`, string(profiles))
+	profiles, _ = json.Marshal(f.get(kindVirtual, "/default/lb-tcp-80")["profiles"])
+	assert.Equal(t, `[{"name":"/Common/tcp"}]`, string(profiles))
+
+	// the renewed certificate replaces the old one
+	secrets.Update(newTestSecret("tls", "8", map[string]string{v1.TLSCertKey: "cert2", v1.TLSPrivateKeyKey: "key2"}))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"/default/lb-443-8.crt"}, f.names(kindCert))
+	assert.Equal(t, []string{"/default/lb-443-8.key"}, f.names(kindKey))
+	assert.Equal(t, "/default/lb-443-8.crt", f.get(kindClientSSL, "/default/lb-443-clientssl")["cert"])
+
+	// the profile is deleted with its certificate and key
+	delete(lb.Annotations, AnnotationKeyClientSSL)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, f.names(kindClientSSL))
+	assert.Empty(t, f.names(kindCert))
+	assert.Empty(t, f.names(kindKey))
+
+	// udp ports do not terminate tls
+	lb.Annotations[AnnotationKeyClientSSL] = `{"53":"tls"}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+func TestOnDelete(t *testing.T) {
+	f := newFakeBigIP()
+	defer f.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("tls", "7", map[string]string{v1.TLSCertKey: "cert", v1.TLSPrivateKeyKey: "key"}))
+	p := newTestProvider(f, nodes, secrets)
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[AnnotationKeyClientSSL] = `{"443":"tls"}`
+
+	// nothing to delete
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Empty(t, f.Writes())
+
+	assert.Nil(t, p.OnUpdate(lb))
+	other := newTestLoadBalancer("node1")
+	other.Name, other.UID = "other", types.UID("other")
+	other.Spec.Providers.Ipvsdr.Vip = "192.168.0.101"
+	assert.Nil(t, p.OnUpdate(other))
+
+	// the objects of the other loadbalancer and the partition are left
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Equal(t, []string{"/default"}, f.names(kindPartition))
+	assert.Equal(t, []string{"/default/other-tcp-443", "/default/other-tcp-80"}, f.names(kindVirtual))
+	assert.Equal(t, []string{"/default/other-tcp-443-pool", "/default/other-tcp-80-pool"}, f.names(kindPool))
+	assert.Equal(t, []string{"/default/other-tcp-monitor"}, f.names(kindTCPMonitor))
+	assert.Empty(t, f.names(kindClientSSL))
+	assert.Empty(t, f.names(kindCert))
+	assert.Empty(t, f.names(kindKey))
+}
+
+func TestRetry(t *testing.T) {
+	f := newFakeBigIP()
+	defer f.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	secrets := newIndexer()
+	p := newTestProvider(f, nodes, secrets)
+	lb := newTestLoadBalancer("node1")
+
+	// the failed requests are retried with backoff
+	f.fail = http.StatusServiceUnavailable
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		err := p.OnUpdate(lb)
+		assert.True(t, core.IsRetryAfterError(err))
+		assert.Equal(t, delay, err.(*core.RetryAfterError).After)
+	}
+	assert.True(t, core.IsRetryAfterError(p.OnDelete(lb)))
+	f.fail = 0
+	assert.Nil(t, p.OnUpdate(lb))
+
+	// the client follows the credentials
+	secrets.Update(newTestSecret("bigip", "2", map[string]string{"url": f.URL, "username": "admin", "password": "wrong"}))
+	assert.True(t, core.IsRetryAfterError(p.OnUpdate(lb)))
+	secrets.Update(newTestSecret("bigip", "3", map[string]string{"url": f.URL, "username": "admin"}))
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+	secrets.Delete(newTestSecret("bigip", "3", nil))
+	assert.True(t, core.IsPermanentError(p.OnDelete(lb)))
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	// downloadsDir is where the uploaded files are put on the BIG-IP
+	downloadsDir = "/var/config/rest/downloads/"
+)
+
+// The iControl REST kinds of the objects the provider manages
+const (
+	kindPartition  = "auth/partition"
+	kindVirtual    = "ltm/virtual"
+	kindPool       = "ltm/pool"
+	kindTCPMonitor = "ltm/monitor/tcp"
+	kindHTTP       = "ltm/monitor/http"
+	kindClientSSL  = "ltm/profile/client-ssl"
+	kindCert       = "sys/crypto/cert"
+	kindKey        = "sys/crypto/key"
+)
+
+// apiError is the error responded by the iControl REST api
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Request is the method and the path of the request
+	Request string `json:"-"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: %d: %s", e.Request, e.Code, e.Message)
+}
+
+// bigipClient drives the iControl REST api of a BIG-IP
+type bigipClient struct {
+	url      string
+	username string
+	password string
+	http     *http.Client
+}
+
+func newBigIPClient(url, username, password string, insecure bool) *bigipClient {
+	transport := http.DefaultTransport
+	if insecure {
+		transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	return &bigipClient{
+		url:      strings.TrimSuffix(url, "/"),
+		username: username,
+		password: password,
+		http:     &http.Client{Timeout: requestTimeout, Transport: transport},
+	}
+}
+
+// path returns the path of the object of the kind in the partition, the
+// slashes of the full path are written as ~
+func path(kind, partition, name string) string {
+	return "/mgmt/tm/" + kind + "/~" + partition + "~" + name
+}
+
+// fullPath returns the full path of the object in the partition
+func fullPath(partition, name string) string {
+	return "/" + partition + "/" + name
+}
+
+// do sends the request with the body in json, and decodes the response into
+// out if it is not nil. The responses of the failed requests are returned
+// as apiErrors.
+func (c *bigipClient) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+func (c *bigipClient) send(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := &apiError{}
+		if json.Unmarshal(data, e) != nil || e.Message == "" {
+			e.Message = string(data)
+		}
+		e.Code = resp.StatusCode
+		e.Request = req.Method + " " + req.URL.Path
+		return e
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: decode response error: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return nil
+}
+
+// isNotFound returns true if the request failed with 404
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// get gets the object with its subcollections, it returns false if the
+// object does not exist
+func (c *bigipClient) get(kind, partition, name string, out interface{}) (bool, error) {
+	err := c.do(http.MethodGet, path(kind, partition, name)+"?expandSubcollections=true", nil, out)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// list lists the objects of the kind in the partition into the items of
+// out
+func (c *bigipClient) list(kind, partition string, out interface{}) error {
+	query := url.Values{"$filter": {"partition eq " + partition}, "expandSubcollections": {"true"}}
+	return c.do(http.MethodGet, "/mgmt/tm/"+kind+"?"+query.Encode(), nil, out)
+}
+
+func (c *bigipClient) create(kind string, obj interface{}) error {
+	return c.do(http.MethodPost, "/mgmt/tm/"+kind, obj, nil)
+}
+
+// update patches the object, the subcollections in obj replace the ones of
+// the object
+func (c *bigipClient) update(kind, partition, name string, obj interface{}) error {
+	return c.do(http.MethodPatch, path(kind, partition, name), obj, nil)
+}
+
+// delete deletes the object, the absent ones are ignored
+func (c *bigipClient) delete(kind, partition, name string) error {
+	err := c.do(http.MethodDelete, path(kind, partition, name), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// upload uploads the file to the downloads directory of the BIG-IP
+func (c *bigipClient) upload(file string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, c.url+"/mgmt/shared/file-transfer/uploads/"+file, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("0-%d/%d", len(data)-1, len(data)))
+	return c.send(req, nil)
+}
+
+// install uploads the certificate or the key, and installs it as the object
+// of the kind in the partition
+func (c *bigipClient) install(kind, partition, name string, data []byte) error {
+	file := partition + "_" + name
+	if err := c.upload(file, data); err != nil {
+		return err
+	}
+	return c.create(kind, map[string]string{
+		"command":         "install",
+		"name":            fullPath(partition, name),
+		"from-local-file": downloadsDir + file,
+	})
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+// The iControl REST objects, with the fields the provider manages. The
+// subcollections are written inline and read from the references expanded.
+
+// reference refers to an object by its full path
+type reference struct {
+	Name      string `json:"name"`
+	Partition string `json:"partition,omitempty"`
+	FullPath  string `json:"fullPath,omitempty"`
+	Context   string `json:"context,omitempty"`
+}
+
+type partition struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// virtual is a virtual server, it listens on a port of the VIP
+type virtual struct {
+	Name                     string            `json:"name"`
+	Partition                string            `json:"partition"`
+	Description              string            `json:"description"`
+	Destination              string            `json:"destination"`
+	IPProtocol               string            `json:"ipProtocol"`
+	Pool                     string            `json:"pool"`
+	SourceAddressTranslation map[string]string `json:"sourceAddressTranslation,omitempty"`
+	Profiles                 []reference       `json:"profiles,omitempty"`
+	ProfilesReference        *struct {
+		Items []reference `json:"items"`
+	} `json:"profilesReference,omitempty"`
+}
+
+// member is a member of a pool, named by its address and port
+type member struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+}
+
+// pool is the members serving a virtual server
+type pool struct {
+	Name              string   `json:"name"`
+	Partition         string   `json:"partition"`
+	Description       string   `json:"description"`
+	Monitor           string   `json:"monitor"`
+	LoadBalancingMode string   `json:"loadBalancingMode,omitempty"`
+	Members           []member `json:"members"`
+	MembersReference  *struct {
+		Items []member `json:"items"`
+	} `json:"membersReference,omitempty"`
+}
+
+// monitor is a tcp or http monitor of the pool members
+type monitor struct {
+	Name        string `json:"name"`
+	Partition   string `json:"partition"`
+	Description string `json:"description"`
+	// Destination is the alias address and port, *:* checks the members
+	Destination string `json:"destination,omitempty"`
+	Interval    int    `json:"interval"`
+	Timeout     int    `json:"timeout"`
+	Send        string `json:"send,omitempty"`
+	Recv        string `json:"recv,omitempty"`
+}
+
+// clientSSL is a client ssl profile terminating the tls of the clients
+type clientSSL struct {
+	Name         string `json:"name"`
+	Partition    string `json:"partition"`
+	Description  string `json:"description"`
+	DefaultsFrom string `json:"defaultsFrom,omitempty"`
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/caicloud/loadbalancer-provider/providers/dns/provider"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// Options contains controller options
+type Options struct {
+	Debug                 bool
+	Driver                string
+	Zone                  string
+	Owner                 string
+	TTL                   int
+	RFC2136Server         string
+	TSIGKeyName           string
+	TSIGSecret            string
+	TSIGAlgorithm         string
+	WebhookURL            string
+	WebhookToken          string
+	HTTPAddress           string
+	Kubeconfig            string
+	LoadBalancerNamespace string
+	LoadBalancerName      string
+	Chaos                 string
+	Record                string
+}
+
+// NewOptions reutrns a new Options
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// AddFlags add flags to app
+func (opts *Options) AddFlags(app *cli.App) {
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "kubeconfig",
+			Usage:       "Path to a kube config. Only required if out-of-cluster.",
+			Destination: &opts.Kubeconfig,
+		},
+		cli.BoolFlag{
+			Name:        "debug",
+			Usage:       "run with debug mode",
+			Destination: &opts.Debug,
+		},
+		cli.StringFlag{
+			Name:        "dns-driver",
+			Value:       "rfc2136",
+			Usage:       "the dns api maintaining the records, rfc2136 or webhook",
+			Destination: &opts.Driver,
+		},
+		cli.StringFlag{
+			Name:        "dns-zone",
+			Usage:       "the zone the hostnames must be in",
+			Destination: &opts.Zone,
+		},
+		cli.StringFlag{
+			Name:        "dns-owner",
+			Value:       provider.DefaultOwner,
+			Usage:       "the owner in the registry records, it must differ among the clusters sharing the zone",
+			Destination: &opts.Owner,
+		},
+		cli.IntFlag{
+			Name:        "dns-ttl",
+			Value:       provider.DefaultTTL,
+			Usage:       "the ttl of the records in seconds, overridden by the annotation loadbalancer.caicloud.io/dns-ttl",
+			Destination: &opts.TTL,
+		},
+		cli.StringFlag{
+			Name:        "rfc2136-server",
+			Usage:       "the address of the primary server of the zone",
+			Destination: &opts.RFC2136Server,
+		},
+		cli.StringFlag{
+			Name:        "rfc2136-tsig-key-name",
+			Usage:       "the name of the tsig key signing the updates and the zone transfers",
+			Destination: &opts.TSIGKeyName,
+		},
+		cli.StringFlag{
+			Name:        "rfc2136-tsig-secret",
+			EnvVar:      "RFC2136_TSIG_SECRET",
+			Usage:       "the base64 encoded secret of the tsig key",
+			Destination: &opts.TSIGSecret,
+		},
+		cli.StringFlag{
+			Name:        "rfc2136-tsig-algorithm",
+			Value:       "hmac-sha256",
+			Usage:       "the algorithm of the tsig key, hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512",
+			Destination: &opts.TSIGAlgorithm,
+		},
+		cli.StringFlag{
+			Name:        "dns-webhook-url",
+			Usage:       "the endpoint of the dns api of the webhook driver",
+			Destination: &opts.WebhookURL,
+		},
+		cli.StringFlag{
+			Name:        "dns-webhook-token",
+			EnvVar:      "DNS_WEBHOOK_TOKEN",
+			Usage:       "the bearer token of the requests of the webhook driver",
+			Destination: &opts.WebhookToken,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Value:       ":10254",
+			Usage:       "the address serving /metrics and /healthz, empty disables it",
+			Destination: &opts.HTTPAddress,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-namespace",
+			EnvVar:      "LOADBALANCER_NAMESPACE",
+			Usage:       "specify loadbalancer resource namespace",
+			Destination: &opts.LoadBalancerNamespace,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-name",
+			EnvVar:      "LOADBALANCER_NAME",
+			Usage:       "specify loadbalancer resource name",
+			Destination: &opts.LoadBalancerName,
+		},
+		cli.StringFlag{
+			Name:        "chaos",
+			Usage:       "the policy of the faults injected into the backend for resilience testing, e.g. seed=42,update-error-rate=0.1,latency=uniform:10ms-200ms, never set it in production",
+			Destination: &opts.Chaos,
+		},
+		cli.StringFlag{
+			Name:        "record",
+			Usage:       "the file the inputs and the results of the syncs are recorded to, with the secrets redacted, for replaying them offline with the replay command, empty disables it",
+			Destination: &opts.Record,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
+}
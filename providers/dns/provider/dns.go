@@ -0,0 +1,321 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/dns/version"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var (
+	_ core.Provider         = &DNSProvider{}
+	_ core.FamilyProvider   = &DNSProvider{}
+	_ core.DeletionProvider = &DNSProvider{}
+)
+
+const (
+	// AnnotationKeyHostnames is the comma separated hostnames pointing at
+	// the addresses of the LoadBalancer, e.g. www.example.com,example.com
+	AnnotationKeyHostnames = "loadbalancer.caicloud.io/hostnames"
+	// AnnotationKeyDNSTTL overrides the TTL of the records of the
+	// LoadBalancer in seconds
+	AnnotationKeyDNSTTL = "loadbalancer.caicloud.io/dns-ttl"
+
+	// DefaultTTL is the default TTL of the records in seconds
+	DefaultTTL = 300
+	// DefaultOwner is the default owner of the records
+	DefaultOwner = "default"
+
+	// heritage marks the registry records of the DNSProvider
+	heritage = "loadbalancer-provider"
+)
+
+// Config configures the DNSProvider
+type Config struct {
+	// Zone is the zone the hostnames must be in, any is accepted if empty
+	Zone string
+	// Owner identifies the provider among the ones sharing the zone, e.g.
+	// the cluster name
+	Owner string
+	// TTL is the TTL of the records unless the LoadBalancer overrides it
+	TTL uint32
+}
+
+// DNSProvider maintains the A and AAAA records of the hostnames of the
+// LoadBalancer pointing at its addresses, the provisioned ones if another
+// provider provisions them, or else the VIPs. It serves nothing itself,
+// so it runs standalone beside the provider serving the LoadBalancer.
+//
+// Every hostname it maintains has a TXT registry record naming the owner
+// and the LoadBalancer, the hostnames with records of others are never
+// touched, and the ones removed from the LoadBalancer are found by their
+// registry records even across restarts.
+type DNSProvider struct {
+	cfg    Config
+	driver Driver
+
+	// mu serializes the syncs, which read and then change the zone
+	mu sync.Mutex
+}
+
+// NewDNSProvider creates a new DNS LoadBalancer Provider maintaining the
+// records by the driver
+func NewDNSProvider(cfg Config, driver Driver) *DNSProvider {
+	if cfg.Owner == "" {
+		cfg.Owner = DefaultOwner
+	}
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	cfg.Zone = normalizeName(cfg.Zone)
+	return &DNSProvider{
+		cfg:    cfg,
+		driver: driver,
+	}
+}
+
+// registryValue returns the value of the registry records of the
+// LoadBalancer
+func (p *DNSProvider) registryValue(lb *netv1alpha1.LoadBalancer) string {
+	return fmt.Sprintf("heritage=%s,owner=%s,loadbalancer=%s/%s", heritage, p.cfg.Owner, lb.Namespace, lb.Name)
+}
+
+// getHostnames returns the hostnames and the TTL of the LoadBalancer, it
+// returns a PermanentError if they are invalid
+func (p *DNSProvider) getHostnames(lb *netv1alpha1.LoadBalancer) ([]string, uint32, error) {
+	ttl := p.cfg.TTL
+	if value, ok := lb.Annotations[AnnotationKeyDNSTTL]; ok {
+		t, err := strconv.ParseUint(strings.TrimSpace(value), 10, 31)
+		if err != nil || t == 0 {
+			return nil, 0, core.NewPermanentError("InvalidDNSTTL", fmt.Errorf("invalid annotation %s: %q", AnnotationKeyDNSTTL, value))
+		}
+		ttl = uint32(t)
+	}
+
+	hostnames := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(lb.Annotations[AnnotationKeyHostnames], ",") {
+		name := normalizeName(s)
+		if name == "" || seen[name] {
+			continue
+		}
+		check := validation.IsDNS1123Subdomain
+		if strings.HasPrefix(name, "*.") {
+			check = validation.IsWildcardDNS1123Subdomain
+		}
+		if errs := check(name); len(errs) > 0 {
+			return nil, 0, core.NewPermanentError("InvalidHostname", fmt.Errorf("invalid hostname %q: %s", name, strings.Join(errs, ", ")))
+		}
+		if p.cfg.Zone != "" && name != p.cfg.Zone && !strings.HasSuffix(name, "."+p.cfg.Zone) {
+			return nil, 0, core.NewPermanentError("InvalidHostname", fmt.Errorf("hostname %q is not in zone %s", name, p.cfg.Zone))
+		}
+		seen[name] = true
+		hostnames = append(hostnames, name)
+	}
+	sort.Strings(hostnames)
+	return hostnames, ttl, nil
+}
+
+// getAddresses returns the addresses the hostnames point at by type, the
+// provisioned addresses take precedence over the VIPs
+func getAddresses(lb *netv1alpha1.LoadBalancer) (map[string][]string, error) {
+	ips := make([]net.IP, 0)
+	if value := lb.Annotations[core.AnnotationKeyProvisionedAddresses]; value != "" {
+		for _, s := range strings.Split(value, ",") {
+			if ip := net.ParseIP(strings.TrimSpace(s)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	} else {
+		vips, err := core.GetVIPs(lb)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, vips...)
+	}
+
+	addrs := make(map[string][]string)
+	for _, ip := range ips {
+		rtype := TypeA
+		if corenet.FamilyOf(ip) == corenet.FamilyIPv6 {
+			rtype = TypeAAAA
+		}
+		addrs[rtype] = append(addrs[rtype], ip.String())
+	}
+	return addrs, nil
+}
+
+// plan returns the changes making the records of the hostnames point at
+// the addresses, and the errors of the hostnames held by others. The
+// hostnames are left as they are if there is no address yet.
+func (p *DNSProvider) plan(lb *netv1alpha1.LoadBalancer, hostnames []string, addrs map[string][]string, ttl uint32, records []Record) (*Changes, []error) {
+	registry := p.registryValue(lb)
+	byName := make(map[string]map[string]Record)
+	for _, r := range records {
+		if byName[r.Name] == nil {
+			byName[r.Name] = make(map[string]Record)
+		}
+		byName[r.Name][r.Type] = r
+	}
+	owned := func(name string) bool {
+		for _, v := range byName[name][TypeTXT].Values {
+			if v == registry {
+				return true
+			}
+		}
+		return false
+	}
+
+	changes := &Changes{}
+	errs := make([]error, 0)
+	desired := make(map[string]bool, len(hostnames))
+	for _, name := range hostnames {
+		desired[name] = true
+		if len(addrs) == 0 {
+			continue
+		}
+		current := byName[name]
+		if !owned(name) && len(current) > 0 {
+			errs = append(errs, fmt.Errorf("hostname %s has records not owned by loadbalancer %s/%s", name, lb.Namespace, lb.Name))
+			continue
+		}
+		for _, rtype := range []string{TypeA, TypeAAAA} {
+			r, ok := current[rtype]
+			if len(addrs[rtype]) == 0 {
+				if ok {
+					changes.Delete = append(changes.Delete, r)
+				}
+				continue
+			}
+			want := Record{Name: name, Type: rtype, TTL: ttl, Values: addrs[rtype]}
+			if !ok || !r.Equal(want) {
+				changes.Upsert = append(changes.Upsert, want)
+			}
+		}
+		want := Record{Name: name, Type: TypeTXT, TTL: ttl, Values: []string{registry}}
+		if r, ok := current[TypeTXT]; !ok || !r.Equal(want) {
+			changes.Upsert = append(changes.Upsert, want)
+		}
+	}
+
+	// the hostnames removed from the LoadBalancer
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if desired[name] || !owned(name) {
+			continue
+		}
+		for _, rtype := range []string{TypeA, TypeAAAA, TypeTXT} {
+			if r, ok := byName[name][rtype]; ok {
+				changes.Delete = append(changes.Delete, r)
+			}
+		}
+	}
+	return changes, errs
+}
+
+// sync makes the records of the hostnames point at the addresses
+func (p *DNSProvider) sync(lb *netv1alpha1.LoadBalancer, hostnames []string, addrs map[string][]string, ttl uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	records, err := p.driver.Records()
+	if err != nil {
+		return fmt.Errorf("list dns records error: %v", err)
+	}
+	changes, errs := p.plan(lb, hostnames, addrs, ttl, records)
+	for _, err := range errs {
+		log.Warn("skip hostname held by others", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "err": err})
+	}
+	if !changes.Empty() {
+		log.Info("Updating dns records", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "upsert": changes.Upsert, "delete": changes.Delete})
+		if err := p.driver.Apply(changes); err != nil {
+			errs = append(errs, fmt.Errorf("update dns records error: %v", err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// OnUpdate maintains the records of the hostnames of the LoadBalancer
+func (p *DNSProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	hostnames, ttl, err := p.getHostnames(lb)
+	if err != nil {
+		return err
+	}
+	addrs, err := getAddresses(lb)
+	if err != nil {
+		return err
+	}
+	return p.sync(lb, hostnames, addrs, ttl)
+}
+
+// OnDelete implements core.DeletionProvider, the records owned by the
+// LoadBalancer are deleted
+func (p *DNSProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	return p.sync(lb, nil, nil, p.cfg.TTL)
+}
+
+// Start ...
+func (p *DNSProvider) Start() {
+	log.Info("Startting dns provider", log.Fields{"zone": p.cfg.Zone, "owner": p.cfg.Owner})
+}
+
+// WaitForStart ...
+func (p *DNSProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the records, they are deleted with the LoadBalancer
+func (p *DNSProvider) Stop() error {
+	log.Info("Shutting down dns provider")
+	return nil
+}
+
+// SupportedFamilies implements core.FamilyProvider, the IPv6 addresses
+// are published as AAAA records
+func (p *DNSProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *DNSProvider) Info() core.Info {
+	return core.Info{
+		Name:       "dns",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *DNSProvider) SetListers(lister core.StoreLister) {
+}
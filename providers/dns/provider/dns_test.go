@@ -0,0 +1,122 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const registry = "heritage=loadbalancer-provider,owner=default,loadbalancer=default/lb"
+
+func newTestLoadBalancer(name, hostnames string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			Annotations: map[string]string{
+				AnnotationKeyHostnames:           hostnames,
+				core.AnnotationKeyDualStackVIP:   "2001:db8::100",
+				core.AnnotationKeyAdditionalVIPs: `[{"vip": "10.0.0.101"}]`,
+			},
+		},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100"}
+	return lb
+}
+
+func TestOnUpdate(t *testing.T) {
+	driver := NewFakeDriver()
+	p := NewDNSProvider(Config{Zone: "example.com."}, driver)
+
+	// create
+	lb := newTestLoadBalancer("lb", "www.example.com, API.example.com.")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, &Record{Name: "www.example.com", Type: TypeA, TTL: DefaultTTL, Values: []string{"10.0.0.100", "10.0.0.101"}}, driver.Get("www.example.com", TypeA))
+	assert.Equal(t, &Record{Name: "www.example.com", Type: TypeAAAA, TTL: DefaultTTL, Values: []string{"2001:db8::100"}}, driver.Get("www.example.com", TypeAAAA))
+	assert.Equal(t, &Record{Name: "www.example.com", Type: TypeTXT, TTL: DefaultTTL, Values: []string{registry}}, driver.Get("www.example.com", TypeTXT))
+	assert.NotNil(t, driver.Get("api.example.com", TypeA))
+
+	// idempotent
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, 1, driver.Applied)
+
+	// the provisioned addresses take precedence over the vips, the ttl is
+	// overridden
+	lb.Annotations[core.AnnotationKeyProvisionedAddresses] = "203.0.113.10"
+	lb.Annotations[AnnotationKeyDNSTTL] = "60"
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, &Record{Name: "www.example.com", Type: TypeA, TTL: 60, Values: []string{"203.0.113.10"}}, driver.Get("www.example.com", TypeA))
+	assert.Nil(t, driver.Get("www.example.com", TypeAAAA))
+	assert.Equal(t, uint32(60), driver.Get("www.example.com", TypeTXT).TTL)
+
+	// hostname removal
+	lb.Annotations[AnnotationKeyHostnames] = "www.example.com"
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Nil(t, driver.Get("api.example.com", TypeA))
+	assert.Nil(t, driver.Get("api.example.com", TypeTXT))
+
+	// the records are found by the registry after a restart
+	p = NewDNSProvider(Config{Zone: "example.com"}, driver)
+	assert.Nil(t, p.OnDelete(lb))
+	records, _ := driver.Records()
+	assert.Empty(t, records)
+}
+
+func TestOwnership(t *testing.T) {
+	foreign := []Record{
+		{Name: "mail.example.com", Type: TypeTXT, TTL: 300, Values: []string{"v=spf1 -all"}},
+		{Name: "other.example.com", Type: TypeA, TTL: 300, Values: []string{"192.0.2.2"}},
+		{Name: "other.example.com", Type: TypeTXT, TTL: 300, Values: []string{"heritage=loadbalancer-provider,owner=default,loadbalancer=default/other"}},
+		{Name: "www.example.com", Type: TypeA, TTL: 300, Values: []string{"192.0.2.1"}},
+	}
+	driver := NewFakeDriver(foreign...)
+	p := NewDNSProvider(Config{Zone: "example.com"}, driver)
+
+	// the hostnames with records of others are skipped
+	lb := newTestLoadBalancer("lb", "www.example.com,mail.example.com,other.example.com,new.example.com")
+	assert.NotNil(t, p.OnUpdate(lb))
+	assert.NotNil(t, driver.Get("new.example.com", TypeA))
+	for _, r := range foreign {
+		assert.Equal(t, &r, driver.Get(r.Name, r.Type))
+	}
+
+	// and never deleted
+	assert.Nil(t, p.OnDelete(lb))
+	records, _ := driver.Records()
+	assert.Equal(t, foreign, records)
+}
+
+func TestInvalidHostnames(t *testing.T) {
+	p := NewDNSProvider(Config{Zone: "example.com"}, NewFakeDriver())
+	for _, hostnames := range []string{"www.example.org", "www_example.com", "www..example.com"} {
+		_, ok := p.OnUpdate(newTestLoadBalancer("lb", hostnames)).(*core.PermanentError)
+		assert.True(t, ok, hostnames)
+	}
+	assert.Nil(t, p.OnUpdate(newTestLoadBalancer("lb", "*.example.com")))
+
+	lb := newTestLoadBalancer("lb", "www.example.com")
+	lb.Annotations[AnnotationKeyDNSTTL] = "0"
+	_, ok := p.OnUpdate(lb).(*core.PermanentError)
+	assert.True(t, ok)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"strings"
+)
+
+// The types of the records maintained by the DNSProvider
+const (
+	TypeA    = "A"
+	TypeAAAA = "AAAA"
+	TypeTXT  = "TXT"
+)
+
+// Record is a record set, the records of a name and a type
+type Record struct {
+	// Name is the fully qualified name in lower case without the trailing
+	// dot
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	TTL    uint32   `json:"ttl"`
+	Values []string `json:"values"`
+}
+
+// key identifies the record set
+func (r Record) key() string {
+	return r.Name + "/" + r.Type
+}
+
+// Equal returns true if the record sets have the same TTL and values
+// regardless of their order
+func (r Record) Equal(o Record) bool {
+	if r.key() != o.key() || r.TTL != o.TTL || len(r.Values) != len(o.Values) {
+		return false
+	}
+	a := append([]string(nil), r.Values...)
+	b := append([]string(nil), o.Values...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Changes are applied to a zone at once
+type Changes struct {
+	// Upsert replaces the record sets
+	Upsert []Record `json:"upsert,omitempty"`
+	// Delete deletes the record sets, their TTL and values are ignored
+	Delete []Record `json:"delete,omitempty"`
+}
+
+// Empty returns true if there is nothing to change
+func (c *Changes) Empty() bool {
+	return len(c.Upsert) == 0 && len(c.Delete) == 0
+}
+
+// Driver manipulates the records of a DNS zone
+type Driver interface {
+	// Records lists the A, AAAA and TXT record sets of the zone
+	Records() ([]Record, error)
+	// Apply applies the changes, atomically if the DNS API supports it
+	Apply(changes *Changes) error
+}
+
+// normalizeName returns the name in lower case without the trailing dot
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
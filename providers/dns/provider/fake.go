@@ -0,0 +1,78 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"sync"
+)
+
+// FakeDriver is an in-memory Driver for tests
+type FakeDriver struct {
+	mu      sync.Mutex
+	records map[string]Record
+	// Applied counts the calls of Apply
+	Applied int
+}
+
+var _ Driver = &FakeDriver{}
+
+// NewFakeDriver returns a FakeDriver holding the given records
+func NewFakeDriver(records ...Record) *FakeDriver {
+	f := &FakeDriver{records: make(map[string]Record)}
+	for _, r := range records {
+		f.records[r.key()] = r
+	}
+	return f
+}
+
+// Records implements Driver
+func (f *FakeDriver) Records() ([]Record, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := make([]Record, 0, len(f.records))
+	for _, r := range f.records {
+		ret = append(ret, r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].key() < ret[j].key() })
+	return ret, nil
+}
+
+// Apply implements Driver
+func (f *FakeDriver) Apply(changes *Changes) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Applied++
+	for _, r := range changes.Delete {
+		delete(f.records, r.key())
+	}
+	for _, r := range changes.Upsert {
+		f.records[r.key()] = r
+	}
+	return nil
+}
+
+// Get returns the record set of the name and the type, nil if absent
+func (f *FakeDriver) Get(name, rtype string) *Record {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.records[Record{Name: name, Type: rtype}.key()]
+	if !ok {
+		return nil
+	}
+	return &r
+}
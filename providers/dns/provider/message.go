@@ -0,0 +1,441 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// the DNS wire format of RFC 1035 needed by the RFC2136Driver, the names
+// are packed uncompressed and unpacked with compression
+
+const (
+	classINET = 1
+	classNONE = 254
+	classANY  = 255
+
+	typeA    = 1
+	typeSOA  = 6
+	typeTXT  = 16
+	typeAAAA = 28
+	typeTSIG = 250
+	typeAXFR = 252
+
+	opcodeQuery  = 0
+	opcodeUpdate = 5
+
+	headerLen = 12
+	// maxTXTString is the most octets of a character string
+	maxTXTString = 255
+	// maxPointers bounds the compression pointers followed in a name
+	maxPointers = 32
+
+	// tsigFudge is the allowed clock skew of the signed messages in seconds
+	tsigFudge = 300
+)
+
+// rcodeNames are the names of the response codes
+var rcodeNames = map[int]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// rr is a resource record with raw data
+type rr struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// message is a DNS message, the sections of an UPDATE are the zone, the
+// prerequisite, the update and the additional ones
+type message struct {
+	ID         uint16
+	Opcode     int
+	Response   bool
+	Rcode      int
+	Question   []question
+	Answer     []rr
+	Authority  []rr
+	Additional []rr
+}
+
+// packName appends the name in the wire format, it is absolute whether it
+// ends with a dot or not
+func packName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid dns name %q", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// unpackName returns the name at the offset without the trailing dot and
+// the offset after it
+func unpackName(msg []byte, off int) (string, int, error) {
+	labels := make([]string, 0)
+	end := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("dns name out of message")
+		}
+		c := int(msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				return strings.Join(labels, "."), end, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, fmt.Errorf("dns name out of message")
+			}
+			labels = append(labels, string(msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, fmt.Errorf("dns name out of message")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, fmt.Errorf("too many compression pointers in dns name")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			return "", 0, fmt.Errorf("invalid dns label type %#x", c)
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func packRR(b []byte, r rr) ([]byte, error) {
+	b, err := packName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, r.Type)
+	b = appendUint16(b, r.Class)
+	b = appendUint32(b, r.TTL)
+	b = appendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...), nil
+}
+
+// pack returns the message in the wire format
+func (m *message) pack() ([]byte, error) {
+	flags := uint16(m.Opcode&0xf)<<11 | uint16(m.Rcode&0xf)
+	if m.Response {
+		flags |= 1 << 15
+	}
+	b := make([]byte, 0, 512)
+	b = appendUint16(b, m.ID)
+	b = appendUint16(b, flags)
+	b = appendUint16(b, uint16(len(m.Question)))
+	b = appendUint16(b, uint16(len(m.Answer)))
+	b = appendUint16(b, uint16(len(m.Authority)))
+	b = appendUint16(b, uint16(len(m.Additional)))
+
+	var err error
+	for _, q := range m.Question {
+		if b, err = packName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, section := range [][]rr{m.Answer, m.Authority, m.Additional} {
+		for _, r := range section {
+			if b, err = packRR(b, r); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+// unpackMessage parses the message in the wire format
+func unpackMessage(b []byte) (*message, error) {
+	if len(b) < headerLen {
+		return nil, fmt.Errorf("dns message too short")
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &message{
+		ID:       binary.BigEndian.Uint16(b),
+		Opcode:   int(flags>>11) & 0xf,
+		Response: flags&(1<<15) != 0,
+		Rcode:    int(flags & 0xf),
+	}
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[4:])),
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])),
+		int(binary.BigEndian.Uint16(b[10:])),
+	}
+
+	off := headerLen
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := unpackName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, fmt.Errorf("dns question out of message")
+		}
+		m.Question = append(m.Question, question{Name: name, Type: binary.BigEndian.Uint16(b[next:]), Class: binary.BigEndian.Uint16(b[next+2:])})
+		off = next + 4
+	}
+	for i, section := range []*[]rr{&m.Answer, &m.Authority, &m.Additional} {
+		for j := 0; j < counts[i+1]; j++ {
+			name, next, err := unpackName(b, off)
+			if err != nil {
+				return nil, err
+			}
+			if next+10 > len(b) {
+				return nil, fmt.Errorf("dns record out of message")
+			}
+			r := rr{
+				Name:  name,
+				Type:  binary.BigEndian.Uint16(b[next:]),
+				Class: binary.BigEndian.Uint16(b[next+2:]),
+				TTL:   binary.BigEndian.Uint32(b[next+4:]),
+			}
+			length := int(binary.BigEndian.Uint16(b[next+8:]))
+			off = next + 10 + length
+			if off > len(b) {
+				return nil, fmt.Errorf("dns record data out of message")
+			}
+			r.Data = b[next+10 : off]
+			*section = append(*section, r)
+		}
+	}
+	return m, nil
+}
+
+// packTXT returns the data of a TXT record holding the value, split into
+// character strings of at most 255 octets
+func packTXT(value string) []byte {
+	b := make([]byte, 0, len(value)+len(value)/maxTXTString+1)
+	for {
+		n := len(value)
+		if n > maxTXTString {
+			n = maxTXTString
+		}
+		b = append(b, byte(n))
+		b = append(b, value[:n]...)
+		value = value[n:]
+		if value == "" {
+			return b
+		}
+	}
+}
+
+// unpackTXT returns the value of the data of a TXT record, the character
+// strings are concatenated
+func unpackTXT(data []byte) (string, error) {
+	var s []byte
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			return "", fmt.Errorf("invalid txt record")
+		}
+		s = append(s, data[1:1+n]...)
+		data = data[1+n:]
+	}
+	return string(s), nil
+}
+
+// tsigAlgorithms are the supported TSIG algorithms of RFC 8945
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int": md5.New,
+	"hmac-sha1":                sha1.New,
+	"hmac-sha256":              sha256.New,
+	"hmac-sha512":              sha512.New,
+}
+
+// tsigKey signs the messages by TSIG
+type tsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    []byte
+}
+
+// newTSIGKey returns the key of the algorithm, which defaults to
+// hmac-sha256
+func newTSIGKey(name, algorithm string, secret []byte) (*tsigKey, error) {
+	algorithm = normalizeName(algorithm)
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	if algorithm == "hmac-md5" {
+		algorithm = "hmac-md5.sig-alg.reg.int"
+	}
+	if _, ok := tsigAlgorithms[algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported tsig algorithm %s", algorithm)
+	}
+	return &tsigKey{Name: normalizeName(name), Algorithm: algorithm, Secret: secret}, nil
+}
+
+// mac returns the MAC of the message without the TSIG record, prefixed by
+// the MAC of the request for responses, and the TSIG variables
+func (k *tsigKey) mac(requestMAC, msg []byte, signed uint64, fudge uint16, tsigErr uint16, other []byte) []byte {
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	if requestMAC != nil {
+		h.Write(appendUint16(nil, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(msg)
+	vars, _ := packName(nil, k.Name)
+	vars = appendUint16(vars, classANY)
+	vars = appendUint32(vars, 0)
+	vars, _ = packName(vars, k.Algorithm)
+	vars = appendUint16(vars, uint16(signed>>32))
+	vars = appendUint32(vars, uint32(signed))
+	vars = appendUint16(vars, fudge)
+	vars = appendUint16(vars, tsigErr)
+	vars = appendUint16(vars, uint16(len(other)))
+	vars = append(vars, other...)
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+// sign appends the TSIG record to the packed message, the MAC of the
+// request is nil unless the message is a response. It returns the signed
+// message and its MAC.
+func (k *tsigKey) sign(msg, requestMAC []byte, now time.Time) ([]byte, []byte, error) {
+	signed := uint64(now.Unix())
+	mac := k.mac(requestMAC, msg, signed, tsigFudge, 0, nil)
+
+	data, err := packName(nil, k.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	data = appendUint16(data, uint16(signed>>32))
+	data = appendUint32(data, uint32(signed))
+	data = appendUint16(data, tsigFudge)
+	data = appendUint16(data, uint16(len(mac)))
+	data = append(data, mac...)
+	data = append(data, msg[0], msg[1])
+	data = appendUint16(data, 0)
+	data = appendUint16(data, 0)
+
+	out, err := packRR(append([]byte(nil), msg...), rr{Name: k.Name, Type: typeTSIG, Class: classANY, Data: data})
+	if err != nil {
+		return nil, nil, err
+	}
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return out, mac, nil
+}
+
+// verify checks the TSIG record at the end of the message, the MAC of the
+// request is nil unless the message is a response
+func (k *tsigKey) verify(b []byte, m *message, requestMAC []byte, now time.Time) error {
+	if len(m.Additional) == 0 || m.Additional[len(m.Additional)-1].Type != typeTSIG {
+		return fmt.Errorf("dns message is not signed")
+	}
+	r := m.Additional[len(m.Additional)-1]
+	if normalizeName(r.Name) != k.Name {
+		return fmt.Errorf("dns message is signed by unknown key %s", r.Name)
+	}
+
+	algorithm, off, err := unpackName(r.Data, 0)
+	if err != nil {
+		return err
+	}
+	data := r.Data[off:]
+	if len(data) < 10 {
+		return fmt.Errorf("invalid tsig record")
+	}
+	signed := uint64(binary.BigEndian.Uint16(data))<<32 | uint64(binary.BigEndian.Uint32(data[2:]))
+	fudge := binary.BigEndian.Uint16(data[6:])
+	size := int(binary.BigEndian.Uint16(data[8:]))
+	if len(data) < 10+size+6 {
+		return fmt.Errorf("invalid tsig record")
+	}
+	mac := data[10 : 10+size]
+	id := binary.BigEndian.Uint16(data[10+size:])
+	tsigErr := binary.BigEndian.Uint16(data[12+size:])
+	otherLen := int(binary.BigEndian.Uint16(data[14+size:]))
+	if len(data) < 16+size+otherLen {
+		return fmt.Errorf("invalid tsig record")
+	}
+	other := data[16+size : 16+size+otherLen]
+	if tsigErr != 0 {
+		return fmt.Errorf("dns message tsig error %d", tsigErr)
+	}
+	if normalizeName(algorithm) != k.Algorithm {
+		return fmt.Errorf("dns message is signed by unexpected algorithm %s", algorithm)
+	}
+
+	// the message the MAC covers has the original id and no TSIG record
+	unsigned := append([]byte(nil), b[:len(b)-tsigRecordLen(r)]...)
+	binary.BigEndian.PutUint16(unsigned, id)
+	binary.BigEndian.PutUint16(unsigned[10:], uint16(len(m.Additional)-1))
+	if !hmac.Equal(mac, k.mac(requestMAC, unsigned, signed, fudge, tsigErr, other)) {
+		return fmt.Errorf("dns message has a bad tsig signature")
+	}
+	if d := now.Unix() - int64(signed); d > int64(fudge) || -d > int64(fudge) {
+		return fmt.Errorf("dns message tsig time is out of the fudge")
+	}
+	return nil
+}
+
+// tsigRecordLen returns the length of the TSIG record in the wire format,
+// servers send it uncompressed as required by RFC 8945
+func tsigRecordLen(r rr) int {
+	name, _ := packName(nil, r.Name)
+	return len(name) + 10 + len(r.Data)
+}
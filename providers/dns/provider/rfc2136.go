@@ -0,0 +1,279 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// DefaultDNSTimeout is the default timeout of the exchanges with the DNS
+// server
+const DefaultDNSTimeout = 10 * time.Second
+
+// RFC2136Config configures the RFC2136Driver
+type RFC2136Config struct {
+	// Server is the address of the primary server of the zone, the port
+	// defaults to 53
+	Server string
+	// Zone is the zone the records are in
+	Zone string
+	// TSIGKeyName, TSIGSecret and TSIGAlgorithm are the TSIG key signing
+	// the messages, the secret is base64 encoded and the algorithm defaults
+	// to hmac-sha256. The messages are unsigned if the name is empty.
+	TSIGKeyName   string
+	TSIGSecret    string
+	TSIGAlgorithm string
+	// Timeout is the timeout of the exchanges
+	Timeout time.Duration
+}
+
+// RFC2136Driver maintains the records by the dynamic updates of RFC 2136
+// and lists them by the zone transfer, so the server must allow both to
+// the key. The exchanges are over TCP, and the TSIG signatures of the
+// update responses are verified.
+type RFC2136Driver struct {
+	cfg RFC2136Config
+	key *tsigKey
+	now func() time.Time
+}
+
+var _ Driver = &RFC2136Driver{}
+
+// NewRFC2136Driver returns a RFC2136Driver
+func NewRFC2136Driver(cfg RFC2136Config) (*RFC2136Driver, error) {
+	if cfg.Zone = normalizeName(cfg.Zone); cfg.Zone == "" {
+		return nil, fmt.Errorf("rfc2136 zone is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		cfg.Server = net.JoinHostPort(cfg.Server, "53")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultDNSTimeout
+	}
+	d := &RFC2136Driver{cfg: cfg, now: time.Now}
+	if cfg.TSIGKeyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(cfg.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tsig secret: %v", err)
+		}
+		if d.key, err = newTSIGKey(cfg.TSIGKeyName, cfg.TSIGAlgorithm, secret); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Records implements Driver by a zone transfer
+func (d *RFC2136Driver) Records() ([]Record, error) {
+	conn, err := d.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := &message{ID: uint16(rand.Intn(1 << 16)), Opcode: opcodeQuery, Question: []question{{Name: d.cfg.Zone, Type: typeAXFR, Class: classINET}}}
+	if _, err := d.send(conn, req); err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]*Record)
+	soas := 0
+	for soas < 2 {
+		_, resp, err := d.receive(conn, req.ID)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != 0 {
+			return nil, fmt.Errorf("transfer zone %s error: %s", d.cfg.Zone, rcodeName(resp.Rcode))
+		}
+		if len(resp.Answer) == 0 {
+			return nil, fmt.Errorf("transfer zone %s error: empty response", d.cfg.Zone)
+		}
+		for _, r := range resp.Answer {
+			if r.Type == typeSOA {
+				soas++
+				continue
+			}
+			var rtype, value string
+			switch r.Type {
+			case typeA:
+				if len(r.Data) != net.IPv4len {
+					return nil, fmt.Errorf("invalid A record %s", r.Name)
+				}
+				rtype, value = TypeA, net.IP(r.Data).String()
+			case typeAAAA:
+				if len(r.Data) != net.IPv6len {
+					return nil, fmt.Errorf("invalid AAAA record %s", r.Name)
+				}
+				rtype, value = TypeAAAA, net.IP(r.Data).String()
+			case typeTXT:
+				rtype = TypeTXT
+				if value, err = unpackTXT(r.Data); err != nil {
+					return nil, err
+				}
+			default:
+				continue
+			}
+			name := normalizeName(r.Name)
+			set, ok := sets[name+"/"+rtype]
+			if !ok {
+				set = &Record{Name: name, Type: rtype, TTL: r.TTL}
+				sets[name+"/"+rtype] = set
+			}
+			set.Values = append(set.Values, value)
+		}
+	}
+
+	records := make([]Record, 0, len(sets))
+	for _, set := range sets {
+		records = append(records, *set)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].key() < records[j].key() })
+	return records, nil
+}
+
+// Apply implements Driver by a dynamic update, the record sets are
+// replaced by deleting and adding them in the same update
+func (d *RFC2136Driver) Apply(changes *Changes) error {
+	req := &message{ID: uint16(rand.Intn(1 << 16)), Opcode: opcodeUpdate, Question: []question{{Name: d.cfg.Zone, Type: typeSOA, Class: classINET}}}
+	for _, r := range append(append([]Record(nil), changes.Delete...), changes.Upsert...) {
+		rtype, err := wireType(r.Type)
+		if err != nil {
+			return err
+		}
+		req.Authority = append(req.Authority, rr{Name: r.Name, Type: rtype, Class: classANY})
+	}
+	for _, r := range changes.Upsert {
+		rtype, _ := wireType(r.Type)
+		for _, v := range r.Values {
+			var data []byte
+			switch rtype {
+			case typeA:
+				data = net.ParseIP(v).To4()
+			case typeAAAA:
+				data = net.ParseIP(v).To16()
+			case typeTXT:
+				data = packTXT(v)
+			}
+			if data == nil {
+				return fmt.Errorf("invalid value %q of %s record %s", v, r.Type, r.Name)
+			}
+			req.Authority = append(req.Authority, rr{Name: r.Name, Type: rtype, Class: classINET, TTL: r.TTL, Data: data})
+		}
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	mac, err := d.send(conn, req)
+	if err != nil {
+		return err
+	}
+	b, resp, err := d.receive(conn, req.ID)
+	if err != nil {
+		return err
+	}
+	if d.key != nil {
+		if err := d.key.verify(b, resp, mac, d.now()); err != nil {
+			return err
+		}
+	}
+	if resp.Rcode != 0 {
+		return fmt.Errorf("update zone %s error: %s", d.cfg.Zone, rcodeName(resp.Rcode))
+	}
+	return nil
+}
+
+func (d *RFC2136Driver) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.cfg.Server, d.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(d.cfg.Timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// send writes the message signed by the key with the length prefix of
+// TCP, it returns the MAC of the message
+func (d *RFC2136Driver) send(conn net.Conn, m *message) ([]byte, error) {
+	b, err := m.pack()
+	if err != nil {
+		return nil, err
+	}
+	var mac []byte
+	if d.key != nil {
+		if b, mac, err = d.key.sign(b, nil, d.now()); err != nil {
+			return nil, err
+		}
+	}
+	_, err = conn.Write(append(appendUint16(nil, uint16(len(b))), b...))
+	return mac, err
+}
+
+// receive reads a response to the request of the id
+func (d *RFC2136Driver) receive(conn net.Conn, id uint16) ([]byte, *message, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+	m, err := unpackMessage(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !m.Response || m.ID != id {
+		return nil, nil, fmt.Errorf("unexpected dns message %d", m.ID)
+	}
+	return b, m, nil
+}
+
+// wireType returns the type of the record in the wire format
+func wireType(rtype string) (uint16, error) {
+	switch rtype {
+	case TypeA:
+		return typeA, nil
+	case TypeAAAA:
+		return typeAAAA, nil
+	case TypeTXT:
+		return typeTXT, nil
+	}
+	return 0, fmt.Errorf("unsupported record type %s", rtype)
+}
+
+// rcodeName returns the name of the response code
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dnsServer is an in-process primary server of a zone accepting the zone
+// transfers and the dynamic updates signed by its key
+type dnsServer struct {
+	ln   net.Listener
+	key  *tsigKey
+	zone string
+
+	mu      sync.Mutex
+	records []rr
+}
+
+func newDNSServer(t *testing.T, key *tsigKey, records ...rr) *dnsServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{ln: ln, key: key, zone: "example.com", records: records}
+	go s.serve()
+	return s
+}
+
+func (s *dnsServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *dnsServer) handle(conn net.Conn) {
+	defer conn.Close()
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	req, err := unpackMessage(b)
+	if err != nil {
+		return
+	}
+	write := func(m *message, requestMAC []byte) {
+		out, _ := m.pack()
+		if requestMAC != nil {
+			out, _, _ = s.key.sign(out, requestMAC, time.Now())
+		}
+		conn.Write(append(appendUint16(nil, uint16(len(out))), out...))
+	}
+
+	resp := &message{ID: req.ID, Opcode: req.Opcode, Response: true, Question: req.Question}
+	if err := s.key.verify(b, req, nil, time.Now()); err != nil {
+		resp.Rcode = 9
+		write(resp, nil)
+		return
+	}
+	tsig := req.Additional[len(req.Additional)-1].Data
+	_, off, _ := unpackName(tsig, 0)
+	size := int(binary.BigEndian.Uint16(tsig[off+8:]))
+	requestMAC := tsig[off+10 : off+10+size]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	soa := rr{Name: s.zone, Type: typeSOA, Class: classINET, TTL: 3600, Data: []byte{0, 0}}
+	if req.Opcode == opcodeQuery && req.Question[0].Type == typeAXFR {
+		// the records are sent in two messages between the soa records
+		half := len(s.records) / 2
+		resp.Answer = append([]rr{soa}, s.records[:half]...)
+		write(resp, requestMAC)
+		resp.Answer = append(append([]rr(nil), s.records[half:]...), soa)
+		write(resp, requestMAC)
+		return
+	}
+
+	for _, u := range req.Authority {
+		if u.Class == classANY {
+			kept := make([]rr, 0, len(s.records))
+			for _, r := range s.records {
+				if r.Name != u.Name || r.Type != u.Type {
+					kept = append(kept, r)
+				}
+			}
+			s.records = kept
+			continue
+		}
+		s.records = append(s.records, u)
+	}
+	write(resp, requestMAC)
+}
+
+func TestUnpackName(t *testing.T) {
+	b := make([]byte, headerLen)
+	b = append(b, "\x03www\x07example\x03com\x00"...)
+	b = append(b, "\x03api\xc0\x10"...)
+	name, off, err := unpackName(b, headerLen)
+	assert.Nil(t, err)
+	assert.Equal(t, "www.example.com", name)
+	name, end, err := unpackName(b, off)
+	assert.Nil(t, err)
+	assert.Equal(t, "api.example.com", name)
+	assert.Equal(t, len(b), end)
+
+	// pointer loop
+	b = append(make([]byte, headerLen), 0xc0, headerLen)
+	_, _, err = unpackName(b, headerLen)
+	assert.NotNil(t, err)
+}
+
+func TestRFC2136Driver(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	key, _ := newTSIGKey("lbp-key.", "hmac-sha256", secret)
+	s := newDNSServer(t, key,
+		rr{Name: "mail.example.com", Type: typeA, Class: classINET, TTL: 300, Data: net.ParseIP("192.0.2.1").To4()},
+		rr{Name: "mail.example.com", Type: typeTXT, Class: classINET, TTL: 300, Data: packTXT("v=spf1 -all")},
+	)
+	defer s.ln.Close()
+
+	d, err := NewRFC2136Driver(RFC2136Config{
+		Server:      s.ln.Addr().String(),
+		Zone:        "example.com.",
+		TSIGKeyName: "lbp-key",
+		TSIGSecret:  base64.StdEncoding.EncodeToString(secret),
+	})
+	assert.Nil(t, err)
+
+	long := string(make([]byte, 300))
+	assert.Nil(t, d.Apply(&Changes{Upsert: []Record{
+		{Name: "www.example.com", Type: TypeA, TTL: 60, Values: []string{"10.0.0.100", "10.0.0.101"}},
+		{Name: "www.example.com", Type: TypeAAAA, TTL: 60, Values: []string{"2001:db8::100"}},
+		{Name: "www.example.com", Type: TypeTXT, TTL: 60, Values: []string{long}},
+	}}))
+	// replaced
+	assert.Nil(t, d.Apply(&Changes{
+		Upsert: []Record{{Name: "www.example.com", Type: TypeA, TTL: 60, Values: []string{"10.0.0.102"}}},
+		Delete: []Record{{Name: "mail.example.com", Type: TypeA}},
+	}))
+
+	records, err := d.Records()
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{
+		{Name: "mail.example.com", Type: TypeTXT, TTL: 300, Values: []string{"v=spf1 -all"}},
+		{Name: "www.example.com", Type: TypeA, TTL: 60, Values: []string{"10.0.0.102"}},
+		{Name: "www.example.com", Type: TypeAAAA, TTL: 60, Values: []string{"2001:db8::100"}},
+		{Name: "www.example.com", Type: TypeTXT, TTL: 60, Values: []string{long}},
+	}, records)
+
+	// a bad key is refused
+	d, err = NewRFC2136Driver(RFC2136Config{
+		Server:      s.ln.Addr().String(),
+		Zone:        "example.com",
+		TSIGKeyName: "lbp-key",
+		TSIGSecret:  base64.StdEncoding.EncodeToString([]byte("bad")),
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, d.Apply(&Changes{Delete: []Record{{Name: "www.example.com", Type: TypeA}}}))
+	_, err = d.Records()
+	assert.NotNil(t, err)
+
+	_, err = NewRFC2136Driver(RFC2136Config{Server: "127.0.0.1", Zone: "example.com", TSIGKeyName: "lbp-key", TSIGAlgorithm: "hmac-sha384"})
+	assert.NotNil(t, err)
+}
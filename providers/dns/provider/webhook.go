@@ -0,0 +1,116 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxErrorBody is the most of the body of a failed response kept in the
+// error
+const maxErrorBody = 512
+
+// WebhookConfig configures the WebhookDriver
+type WebhookConfig struct {
+	// URL is the endpoint of the DNS API
+	URL string
+	// Token is the optional bearer token of the requests
+	Token string
+	// Timeout is the timeout of the requests
+	Timeout time.Duration
+}
+
+// WebhookDriver maintains the records by a DNS API behind an endpoint, so
+// the DNS services without a driver of their own are integrated by an
+// adapter. GET <url>/records returns the record sets of the zone in json,
+// and POST <url>/records applies the Changes in json.
+type WebhookDriver struct {
+	cfg    WebhookConfig
+	client *http.Client
+}
+
+var _ Driver = &WebhookDriver{}
+
+// NewWebhookDriver returns a WebhookDriver
+func NewWebhookDriver(cfg WebhookConfig) (*WebhookDriver, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("dns webhook url is required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultDNSTimeout
+	}
+	return &WebhookDriver{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// Records implements Driver
+func (d *WebhookDriver) Records() ([]Record, error) {
+	records := make([]Record, 0)
+	if err := d.do("GET", nil, &records); err != nil {
+		return nil, err
+	}
+	for i := range records {
+		records[i].Name = normalizeName(records[i].Name)
+	}
+	return records, nil
+}
+
+// Apply implements Driver
+func (d *WebhookDriver) Apply(changes *Changes) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	return d.do("POST", body, nil)
+}
+
+func (d *WebhookDriver) do(method string, body []byte, out interface{}) error {
+	url := strings.TrimSuffix(d.cfg.URL, "/") + "/records"
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if d.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.cfg.Token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,401 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/exec/version"
+	log "github.com/zoumo/logdog"
+)
+
+var (
+	_ core.Provider         = &ExecProvider{}
+	_ core.FamilyProvider   = &ExecProvider{}
+	_ core.DeletionProvider = &ExecProvider{}
+	_ core.HealthzProvider  = &ExecProvider{}
+)
+
+const (
+	// EventUpdate and EventDelete are the events passed to the command
+	EventUpdate = "update"
+	EventDelete = "delete"
+
+	// ExitPermanent is the exit code of the command failing permanently,
+	// the LoadBalancer is not retried until it changes. The other non-zero
+	// exit codes are retried.
+	ExitPermanent = 10
+
+	// DefaultTimeout is the default timeout of the command
+	DefaultTimeout = time.Minute
+	// DefaultRetryDelay and DefaultMaxRetryDelay bound the backoff of the
+	// retries of the failed commands
+	DefaultRetryDelay    = 5 * time.Second
+	DefaultMaxRetryDelay = 5 * time.Minute
+
+	// maxOutput is the most of the stdout and the stderr of the command
+	// kept for the logs
+	maxOutput = 64 * 1024
+	// maxErrorOutput is the most of the stderr kept in the error
+	maxErrorOutput = 512
+)
+
+// Config configures the ExecProvider
+type Config struct {
+	// Command is the path of the executable and Args its arguments
+	Command string
+	Args    []string
+	// Timeout is the timeout of the command, it is killed with its
+	// children once it times out
+	Timeout time.Duration
+	// RetryDelay is the delay of the first retry of the failed commands,
+	// it doubles on every retry up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Node is a node of the LoadBalancer, the ones weighted to zero, e.g. not
+// ready, should not receive new connections
+type Node struct {
+	Name   string `json:"name"`
+	IP     string `json:"ip"`
+	Weight int    `json:"weight"`
+}
+
+// Input is the stdin of the command in json
+type Input struct {
+	// Event is update or delete, the same as the environment variable
+	// EVENT
+	Event        string                    `json:"event"`
+	LoadBalancer *netv1alpha1.LoadBalancer `json:"loadBalancer"`
+	// VIPs, Ports and Nodes are computed from the LoadBalancer, they are
+	// empty on deletions
+	VIPs  []string       `json:"vips,omitempty"`
+	Ports []corenet.Port `json:"ports,omitempty"`
+	Nodes []Node         `json:"nodes,omitempty"`
+}
+
+// ExecProvider runs a program on every sync of the LoadBalancer, with the
+// LoadBalancer in json on its stdin and the environment variables
+// LB_NAMESPACE, LB_NAME and EVENT. The program must be idempotent.
+type ExecProvider struct {
+	cfg         Config
+	storeLister core.StoreLister
+
+	mu sync.Mutex
+	// locks serialize the runs of the command for each LoadBalancer
+	locks    map[string]*sync.Mutex
+	failures map[string]uint
+	startErr error
+}
+
+// NewExecProvider creates a new exec LoadBalancer Provider
+func NewExecProvider(cfg Config) *ExecProvider {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	return &ExecProvider{
+		cfg:      cfg,
+		locks:    make(map[string]*sync.Mutex),
+		failures: make(map[string]uint),
+	}
+}
+
+// checkCommand returns an error unless the command is an executable file
+func checkCommand(path string) error {
+	if path == "" {
+		return fmt.Errorf("no command configured")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("command %s is not a regular file", path)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("command %s is not executable", path)
+	}
+	return nil
+}
+
+// lock locks the runs of the command for the LoadBalancer and returns the
+// unlock
+func (p *ExecProvider) lock(key string) func() {
+	p.mu.Lock()
+	l, ok := p.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		p.locks[key] = l
+	}
+	p.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// limitedBuffer keeps the first bytes written up to its limit and drops the
+// rest, so that the command is never blocked on its output
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(data) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(data[:room])
+		}
+		return len(data), nil
+	}
+	return b.Buffer.Write(data)
+}
+
+func (b *limitedBuffer) String() string {
+	s := strings.TrimSpace(b.Buffer.String())
+	if b.truncated {
+		s += " ...(truncated)"
+	}
+	return s
+}
+
+// tail returns the end of the output for the errors
+func tail(s string) string {
+	if len(s) > maxErrorOutput {
+		return "..." + s[len(s)-maxErrorOutput:]
+	}
+	return s
+}
+
+// run runs the command with the input. It returns a PermanentError if the
+// command exits with ExitPermanent.
+func (p *ExecProvider) run(lb *netv1alpha1.LoadBalancer, input *Input) error {
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: maxOutput}
+
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = append(os.Environ(), "LB_NAMESPACE="+lb.Namespace, "LB_NAME="+lb.Name, "EVENT="+input.Event)
+	// the children are killed with the command in its process group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	timer := time.NewTimer(p.cfg.Timeout)
+	defer timer.Stop()
+	timedOut := false
+	select {
+	case err = <-done:
+	case <-timer.C:
+		timedOut = true
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-done
+	}
+
+	fields := log.Fields{
+		"lb.ns":    lb.Namespace,
+		"lb.name":  lb.Name,
+		"event":    input.Event,
+		"duration": time.Since(start),
+		"stdout":   stdout.String(),
+		"stderr":   stderr.String(),
+	}
+	switch {
+	case timedOut:
+		log.Error("Command timed out", fields)
+		return fmt.Errorf("command %s timed out after %v: %s", p.cfg.Command, p.cfg.Timeout, tail(stderr.String()))
+	case err == nil:
+		log.Info("Command succeeded", fields)
+		return nil
+	}
+	fields["err"] = err
+	log.Error("Command failed", fields)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() && status.ExitStatus() == ExitPermanent {
+			return core.NewPermanentError("CommandFailed", fmt.Errorf("command %s failed permanently: %s", p.cfg.Command, tail(stderr.String())))
+		}
+	}
+	return fmt.Errorf("command %s failed: %v: %s", p.cfg.Command, err, tail(stderr.String()))
+}
+
+// retry translates the failed commands into RetryAfterErrors, the delay
+// doubles on the consecutive ones of the LoadBalancer
+func (p *ExecProvider) retry(key string, err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.failures, key)
+		return nil
+	}
+	if core.IsPermanentError(err) {
+		return err
+	}
+	failures := p.failures[key]
+	delay := p.cfg.MaxRetryDelay
+	if failures < 16 {
+		if d := p.cfg.RetryDelay << failures; d < delay {
+			delay = d
+		}
+	}
+	p.failures[key] = failures + 1
+	return core.NewRetryAfterError(delay, err)
+}
+
+// input returns the input of the update of the LoadBalancer, the nodes are
+// the ones of the family of its first VIP
+func (p *ExecProvider) input(lb *netv1alpha1.LoadBalancer) (*Input, error) {
+	vips, err := core.GetVIPs(lb)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	family := corenet.FamilyIPv4
+	input := &Input{Event: EventUpdate, LoadBalancer: lb, Ports: ports, Nodes: make([]Node, 0)}
+	for i, vip := range vips {
+		if i == 0 {
+			family = corenet.FamilyOf(vip)
+		}
+		input.VIPs = append(input.VIPs, vip.String())
+	}
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, family) {
+		input.Nodes = append(input.Nodes, Node{Name: rs.Node, IP: rs.IP.String(), Weight: rs.Weight})
+	}
+	return input, nil
+}
+
+// OnUpdate runs the command with the LoadBalancer, its VIPs, ports and
+// nodes
+func (p *ExecProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal {
+		return nil
+	}
+	if err := p.Healthz(); err != nil {
+		return core.NewPermanentError("InvalidCommand", err)
+	}
+
+	key := lb.Namespace + "/" + lb.Name
+	unlock := p.lock(key)
+	defer unlock()
+
+	input, err := p.input(lb)
+	if err != nil {
+		return err
+	}
+	return p.retry(key, p.run(lb, input))
+}
+
+// OnDelete implements core.DeletionProvider, the command is run with the
+// deleted LoadBalancer
+func (p *ExecProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	if err := p.Healthz(); err != nil {
+		return core.NewPermanentError("InvalidCommand", err)
+	}
+
+	key := lb.Namespace + "/" + lb.Name
+	unlock := p.lock(key)
+	defer unlock()
+
+	return p.retry(key, p.run(lb, &Input{Event: EventDelete, LoadBalancer: lb}))
+}
+
+// Start checks the command is executable
+func (p *ExecProvider) Start() {
+	log.Info("Startting exec provider")
+
+	err := checkCommand(p.cfg.Command)
+	if err != nil {
+		log.Error("invalid command", log.Fields{"command": p.cfg.Command, "err": err})
+	}
+	p.mu.Lock()
+	p.startErr = err
+	p.mu.Unlock()
+}
+
+// WaitForStart returns false if the command is not executable
+func (p *ExecProvider) WaitForStart() bool {
+	return p.Healthz() == nil
+}
+
+// Stop lets the running command finish, the LoadBalancer outlives the
+// provider
+func (p *ExecProvider) Stop() error {
+	log.Info("Shutting down exec provider")
+	return nil
+}
+
+// Healthz implements core.HealthzProvider, the provider is unhealthy if
+// the command is not executable
+func (p *ExecProvider) Healthz() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startErr
+}
+
+// SupportedFamilies implements core.FamilyProvider, the VIPs are passed to
+// the command as they are
+func (p *ExecProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *ExecProvider) Info() core.Info {
+	return core.Info{
+		Name:       "exec",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *ExecProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
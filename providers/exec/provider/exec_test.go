@@ -0,0 +1,190 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestNode(name, ip string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "192.168.0.100"}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+// newTestProvider returns a started provider running the script
+func newTestProvider(t *testing.T, script string, args ...string) (*ExecProvider, string) {
+	dir, err := ioutil.TempDir("", "exec-provider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "script.sh")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "10.0.0.1"))
+	p := NewExecProvider(Config{Command: path, Args: args, Timeout: 500 * time.Millisecond, RetryDelay: time.Second, MaxRetryDelay: 4 * time.Second})
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	p.Start()
+	return p, dir
+}
+
+func TestOnUpdate(t *testing.T) {
+	p, dir := newTestProvider(t, `cat > "$1/$EVENT.json"; echo "$LB_NAMESPACE/$LB_NAME" > "$1/$EVENT.env"; echo done`)
+	defer os.RemoveAll(dir)
+	p.cfg.Args = []string{dir}
+	assert.True(t, p.WaitForStart())
+
+	lb := newTestLoadBalancer("node1")
+	assert.Nil(t, p.OnUpdate(lb))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "update.json"))
+	assert.Nil(t, err)
+	input := &Input{}
+	assert.Nil(t, json.Unmarshal(data, input))
+	assert.Equal(t, EventUpdate, input.Event)
+	assert.Equal(t, "lb", input.LoadBalancer.Name)
+	assert.Equal(t, []string{"192.168.0.100"}, input.VIPs)
+	assert.Equal(t, core.DefaultPorts, input.Ports)
+	assert.Equal(t, []Node{{Name: "node1", IP: "10.0.0.1", Weight: 100}}, input.Nodes)
+	env, _ := ioutil.ReadFile(filepath.Join(dir, "update.env"))
+	assert.Equal(t, "default/lb\n", string(env))
+
+	assert.Nil(t, p.OnDelete(lb))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "delete.json"))
+	input = &Input{}
+	assert.Nil(t, json.Unmarshal(data, input))
+	assert.Equal(t, EventDelete, input.Event)
+	assert.Empty(t, input.Nodes)
+}
+
+func TestExitCodes(t *testing.T) {
+	p, dir := newTestProvider(t, `echo "exit $(cat "$1/code")" >&2; exit $(cat "$1/code")`)
+	defer os.RemoveAll(dir)
+	p.cfg.Args = []string{dir}
+	lb := newTestLoadBalancer("node1")
+
+	code := func(c string) {
+		ioutil.WriteFile(filepath.Join(dir, "code"), []byte(c), 0644)
+	}
+
+	// the other exit codes are retried with backoff, the stderr is kept in
+	// the error
+	code("1")
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		err := p.OnUpdate(lb)
+		if assert.True(t, core.IsRetryAfterError(err), "%v", err) {
+			assert.Equal(t, delay, err.(*core.RetryAfterError).After)
+			assert.Contains(t, err.Error(), "exit 1")
+		}
+	}
+	code("0")
+	assert.Nil(t, p.OnUpdate(lb))
+
+	code("10")
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Contains(t, err.Error(), "exit 10")
+	code("2")
+	assert.Equal(t, time.Second, p.OnUpdate(lb).(*core.RetryAfterError).After)
+}
+
+func TestTimeout(t *testing.T) {
+	// the child holding the output is killed with the command
+	p, dir := newTestProvider(t, `echo started >&2; sleep 10 & wait`)
+	defer os.RemoveAll(dir)
+	lb := newTestLoadBalancer("node1")
+
+	start := time.Now()
+	err := p.OnUpdate(lb)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	if assert.True(t, core.IsRetryAfterError(err)) {
+		assert.Contains(t, err.Error(), "timed out")
+		assert.Contains(t, err.Error(), "started")
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	// the runs for the same loadbalancer never overlap
+	p, dir := newTestProvider(t, `mkdir "$1/running" || exit 1; sleep 0.05; rmdir "$1/running"`)
+	defer os.RemoveAll(dir)
+	p.cfg.Args = []string{dir}
+	lb := newTestLoadBalancer("node1")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- p.OnUpdate(lb)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	p, dir := newTestProvider(t, "exit 0")
+	defer os.RemoveAll(dir)
+	assert.Nil(t, p.Healthz())
+
+	os.Chmod(p.cfg.Command, 0644)
+	p.Start()
+	assert.False(t, p.WaitForStart())
+	assert.Contains(t, p.Healthz().Error(), "not executable")
+	assert.True(t, core.IsPermanentError(p.OnUpdate(newTestLoadBalancer())))
+
+	p.cfg.Command = dir
+	p.Start()
+	assert.NotNil(t, p.Healthz())
+	p.cfg.Command = filepath.Join(dir, "missing")
+	p.Start()
+	assert.NotNil(t, p.Healthz())
+}
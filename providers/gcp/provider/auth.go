@@ -0,0 +1,87 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// metadataTokenEndpoint issues the tokens of the service account of
+	// the instance
+	metadataTokenEndpoint = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// tokenRefreshMargin refreshes the tokens before they expire
+	tokenRefreshMargin = 5 * time.Minute
+)
+
+// tokenSource returns the bearer tokens of the REST api
+type tokenSource interface {
+	Token() (string, error)
+}
+
+// metadataToken is the token of the service account of the instance from
+// the metadata server, it is reused until it is about to expire
+type metadataToken struct {
+	endpoint string
+	http     *http.Client
+	now      func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newMetadataToken(endpoint string) *metadataToken {
+	return &metadataToken{endpoint: endpoint, http: &http.Client{Timeout: requestTimeout}, now: time.Now}
+}
+
+// Token implements tokenSource
+func (t *metadataToken) Token() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && t.now().Add(tokenRefreshMargin).Before(t.expiry) {
+		return t.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, t.endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	token := &struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(token); err != nil {
+		return "", fmt.Errorf("decode token error: %v", err)
+	}
+	t.token, t.expiry = token.AccessToken, t.now().Add(time.Duration(token.ExpiresIn)*time.Second)
+	return t.token, nil
+}
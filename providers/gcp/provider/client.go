@@ -0,0 +1,313 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEndpoint is the endpoint of the compute api
+	DefaultEndpoint = "https://compute.googleapis.com/compute/v1"
+	// linkPrefix is the prefix of the links between the resources, which
+	// do not depend on the endpoint
+	linkPrefix = "https://www.googleapis.com/compute/v1/"
+
+	requestTimeout = 30 * time.Second
+)
+
+// client manages the network resources of a region in a project of GCP.
+// The getters return nil if the resource does not exist, and the changes
+// return the operation to poll.
+type client interface {
+	GetAddress(name string) (*address, error)
+	InsertAddress(a *address) (*operation, error)
+	DeleteAddress(name string) (*operation, error)
+	GetHealthCheck(name string) (*httpHealthCheck, error)
+	InsertHealthCheck(hc *httpHealthCheck) (*operation, error)
+	UpdateHealthCheck(hc *httpHealthCheck) (*operation, error)
+	DeleteHealthCheck(name string) (*operation, error)
+	GetTargetPool(name string) (*targetPool, error)
+	InsertTargetPool(pool *targetPool) (*operation, error)
+	DeleteTargetPool(name string) (*operation, error)
+	AddInstances(pool string, instances []string) (*operation, error)
+	RemoveInstances(pool string, instances []string) (*operation, error)
+	// ListForwardingRules returns the forwarding rules whose names start
+	// with the prefix
+	ListForwardingRules(prefix string) ([]forwardingRule, error)
+	InsertForwardingRule(rule *forwardingRule) (*operation, error)
+	DeleteForwardingRule(name string) (*operation, error)
+	SetTarget(rule, target string) (*operation, error)
+	// PollOperation returns true if the operation is done, and an error if
+	// it failed
+	PollOperation(op *operation) (bool, error)
+}
+
+// computeClient drives the REST api of the compute engine
+type computeClient struct {
+	endpoint string
+	project  string
+	region   string
+	token    tokenSource
+	http     *http.Client
+}
+
+var _ client = &computeClient{}
+
+func newComputeClient(endpoint, project, region string, token tokenSource) *computeClient {
+	return &computeClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		project:  project,
+		region:   region,
+		token:    token,
+		http:     &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// regionalLink returns the link of the regional resource of the collection
+func regionalLink(project, region, collection, name string) string {
+	return fmt.Sprintf("%sprojects/%s/regions/%s/%s/%s", linkPrefix, project, region, collection, name)
+}
+
+// globalLink returns the link of the global resource of the collection
+func globalLink(project, collection, name string) string {
+	return fmt.Sprintf("%sprojects/%s/global/%s/%s", linkPrefix, project, collection, name)
+}
+
+// instanceLink returns the link of the instance in the zone
+func instanceLink(project, zone, name string) string {
+	return fmt.Sprintf("%sprojects/%s/zones/%s/instances/%s", linkPrefix, project, zone, name)
+}
+
+func (c *computeClient) regional(collection string, parts ...string) string {
+	return c.endpoint + "/" + strings.Join(append([]string{"projects", c.project, "regions", c.region, collection}, parts...), "/")
+}
+
+func (c *computeClient) global(collection string, parts ...string) string {
+	return c.endpoint + "/" + strings.Join(append([]string{"projects", c.project, "global", collection}, parts...), "/")
+}
+
+// do sends the request with the body in json, and decodes the response into
+// out if it is not nil. The error responses are returned as apiErrors.
+func (c *computeClient) do(method, url string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	token, err := c.token.Token()
+	if err != nil {
+		return fmt.Errorf("get gcp token error: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := struct {
+			Error *apiError `json:"error"`
+		}{}
+		if json.Unmarshal(data, &e) != nil || e.Error == nil {
+			e.Error = &apiError{Message: string(data)}
+		}
+		e.Error.Code = resp.StatusCode
+		return e.Error
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("%s %s: decode response error: %v", method, url, err)
+		}
+	}
+	return nil
+}
+
+// get returns false if the resource does not exist
+func (c *computeClient) get(url string, out interface{}) (bool, error) {
+	err := c.do(http.MethodGet, url, nil, out)
+	if e, ok := err.(*apiError); ok && e.Code == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *computeClient) mutate(method, url string, body interface{}) (*operation, error) {
+	op := &operation{}
+	if err := c.do(method, url, body, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (c *computeClient) delete(url string) (*operation, error) {
+	op, err := c.mutate(http.MethodDelete, url, nil)
+	if e, ok := err.(*apiError); ok && e.Code == http.StatusNotFound {
+		return nil, nil
+	}
+	return op, err
+}
+
+func (c *computeClient) GetAddress(name string) (*address, error) {
+	a := &address{}
+	found, err := c.get(c.regional("addresses", name), a)
+	if !found {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (c *computeClient) InsertAddress(a *address) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("addresses"), a)
+}
+
+func (c *computeClient) DeleteAddress(name string) (*operation, error) {
+	return c.delete(c.regional("addresses", name))
+}
+
+func (c *computeClient) GetHealthCheck(name string) (*httpHealthCheck, error) {
+	hc := &httpHealthCheck{}
+	found, err := c.get(c.global("httpHealthChecks", name), hc)
+	if !found {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func (c *computeClient) InsertHealthCheck(hc *httpHealthCheck) (*operation, error) {
+	return c.mutate(http.MethodPost, c.global("httpHealthChecks"), hc)
+}
+
+func (c *computeClient) UpdateHealthCheck(hc *httpHealthCheck) (*operation, error) {
+	return c.mutate(http.MethodPut, c.global("httpHealthChecks", hc.Name), hc)
+}
+
+func (c *computeClient) DeleteHealthCheck(name string) (*operation, error) {
+	return c.delete(c.global("httpHealthChecks", name))
+}
+
+func (c *computeClient) GetTargetPool(name string) (*targetPool, error) {
+	pool := &targetPool{}
+	found, err := c.get(c.regional("targetPools", name), pool)
+	if !found {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (c *computeClient) InsertTargetPool(pool *targetPool) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("targetPools"), pool)
+}
+
+func (c *computeClient) DeleteTargetPool(name string) (*operation, error) {
+	return c.delete(c.regional("targetPools", name))
+}
+
+type instanceReference struct {
+	Instance string `json:"instance"`
+}
+
+func instanceReferences(instances []string) interface{} {
+	refs := make([]instanceReference, 0, len(instances))
+	for _, i := range instances {
+		refs = append(refs, instanceReference{Instance: i})
+	}
+	return map[string][]instanceReference{"instances": refs}
+}
+
+func (c *computeClient) AddInstances(pool string, instances []string) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("targetPools", pool, "addInstance"), instanceReferences(instances))
+}
+
+func (c *computeClient) RemoveInstances(pool string, instances []string) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("targetPools", pool, "removeInstance"), instanceReferences(instances))
+}
+
+func (c *computeClient) ListForwardingRules(prefix string) ([]forwardingRule, error) {
+	rules := make([]forwardingRule, 0)
+	query := url.Values{"filter": {fmt.Sprintf("name eq %s.*", prefix)}}
+	for {
+		page := &struct {
+			Items         []forwardingRule `json:"items"`
+			NextPageToken string           `json:"nextPageToken"`
+		}{}
+		if err := c.do(http.MethodGet, c.regional("forwardingRules")+"?"+query.Encode(), nil, page); err != nil {
+			return nil, err
+		}
+		for _, rule := range page.Items {
+			if strings.HasPrefix(rule.Name, prefix) {
+				rules = append(rules, rule)
+			}
+		}
+		if page.NextPageToken == "" {
+			return rules, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+func (c *computeClient) InsertForwardingRule(rule *forwardingRule) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("forwardingRules"), rule)
+}
+
+func (c *computeClient) DeleteForwardingRule(name string) (*operation, error) {
+	return c.delete(c.regional("forwardingRules", name))
+}
+
+func (c *computeClient) SetTarget(rule, target string) (*operation, error) {
+	return c.mutate(http.MethodPost, c.regional("forwardingRules", rule, "setTarget"), map[string]string{"target": target})
+}
+
+// PollOperation gets the operation by its self link, the errors of the
+// done operation are returned as an apiError
+func (c *computeClient) PollOperation(op *operation) (bool, error) {
+	cur := &operation{}
+	if err := c.do(http.MethodGet, op.SelfLink, nil, cur); err != nil {
+		return false, err
+	}
+	if cur.Status != "DONE" {
+		return false, nil
+	}
+	if cur.Error != nil && len(cur.Error.Errors) > 0 {
+		return true, &apiError{Message: op.String(), Errors: cur.Error.Errors}
+	}
+	return true, nil
+}
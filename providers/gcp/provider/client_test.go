@@ -0,0 +1,93 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeToken string
+
+func (t fakeToken) Token() (string, error) {
+	return string(t), nil
+}
+
+func TestComputeClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/projects/p/regions/r/addresses/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "not found", "errors": [{"reason": "notFound", "message": "not found"}]}}`))
+		case "/projects/p/regions/r/addresses":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": {"code": 403, "message": "quota", "errors": [{"reason": "quotaExceeded", "message": "Quota 'STATIC_ADDRESSES' exceeded"}]}}`))
+		case "/projects/p/regions/r/forwardingRules":
+			if r.URL.Query().Get("pageToken") == "" {
+				assert.Equal(t, "name eq k8s-uid-.*", r.URL.Query().Get("filter"))
+				w.Write([]byte(`{"items": [{"name": "k8s-uid-tcp-80", "IPAddress": "35.0.0.1", "IPProtocol": "TCP", "portRange": "80-80"}], "nextPageToken": "next"}`))
+				return
+			}
+			w.Write([]byte(`{"items": [{"name": "k8s-uid-udp-53", "IPProtocol": "UDP", "portRange": "53-53"}]}`))
+		case "/projects/p/regions/r/targetPools/pool/addInstance":
+			json.NewEncoder(w).Encode(&operation{Name: "op-1", Status: "RUNNING", SelfLink: "http://" + r.Host + "/projects/p/regions/r/operations/op-1"})
+		case "/projects/p/regions/r/operations/op-1":
+			w.Write([]byte(`{"name": "op-1", "status": "DONE", "error": {"errors": [{"code": "RESOURCE_NOT_READY", "message": "The resource is not ready"}]}}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	c := newComputeClient(server.URL+"/", "p", "r", fakeToken("token"))
+
+	addr, err := c.GetAddress("missing")
+	assert.Nil(t, err)
+	assert.Nil(t, addr)
+
+	_, err = c.InsertAddress(&address{Name: "a"})
+	assert.True(t, retriable(err))
+	assert.Contains(t, err.Error(), "quotaExceeded")
+
+	rules, err := c.ListForwardingRules("k8s-uid-")
+	assert.Nil(t, err)
+	assert.Equal(t, []forwardingRule{
+		{Name: "k8s-uid-tcp-80", IPAddress: "35.0.0.1", IPProtocol: "TCP", PortRange: "80-80"},
+		{Name: "k8s-uid-udp-53", IPProtocol: "UDP", PortRange: "53-53"},
+	}, rules)
+
+	op, err := c.AddInstances("pool", []string{instanceLink("p", "z", "node1")})
+	assert.Nil(t, err)
+	done, err := c.PollOperation(op)
+	assert.True(t, done)
+	assert.True(t, retriable(err))
+
+	_, err = c.DeleteTargetPool("pool")
+	assert.True(t, retriable(err))
+
+	assert.Equal(t, `POST /projects/p/regions/r/targetPools/pool/addInstance {"instances":[{"instance":"https://www.googleapis.com/compute/v1/projects/p/zones/z/instances/node1"}]}`, requests[4])
+}
@@ -0,0 +1,680 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/gcp/version"
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	_ core.Provider         = &GCPProvider{}
+	_ core.ResyncProvider   = &GCPProvider{}
+	_ core.DeletionProvider = &GCPProvider{}
+	_ core.AddressProvider  = &GCPProvider{}
+)
+
+const (
+	// AnnotationKeyAddress is the name of an existing regional address to
+	// serve the LoadBalancer on, the provider reserves one if it is absent
+	AnnotationKeyAddress = "loadbalancer.caicloud.io/gcp-address"
+	// AnnotationKeyHealthCheck is the http health check of the nodes in
+	// json, e.g. {"port": 10254, "path": "/healthz", "interval": 5}. The
+	// unspecified fields default to the ones of DefaultHealthCheck.
+	AnnotationKeyHealthCheck = "loadbalancer.caicloud.io/gcp-health-check"
+
+	// uidKey and ownerKey are the keys of the description of the resources
+	// created for a LoadBalancer, the resources described otherwise are
+	// never touched
+	uidKey   = "caicloud.io/loadbalancer-uid"
+	ownerKey = "caicloud.io/loadbalancer"
+
+	// DefaultPollInterval is the default interval of polling the operations
+	DefaultPollInterval = 5 * time.Second
+	// DefaultRetryDelay and DefaultMaxRetryDelay bound the backoff of the
+	// retries of the quota exceeded and the busy resources
+	DefaultRetryDelay    = 5 * time.Second
+	DefaultMaxRetryDelay = 5 * time.Minute
+)
+
+// HealthCheck is the http health check of the nodes
+type HealthCheck struct {
+	Port               int    `json:"port"`
+	Path               string `json:"path"`
+	Interval           int    `json:"interval"`
+	Timeout            int    `json:"timeout"`
+	HealthyThreshold   int    `json:"healthyThreshold"`
+	UnhealthyThreshold int    `json:"unhealthyThreshold"`
+}
+
+// DefaultHealthCheck checks the /healthz of the providers on the nodes
+var DefaultHealthCheck = HealthCheck{
+	Port:               10254,
+	Path:               "/healthz",
+	Interval:           5,
+	Timeout:            5,
+	HealthyThreshold:   2,
+	UnhealthyThreshold: 2,
+}
+
+// Config configures the GCPProvider
+type Config struct {
+	Project string
+	Region  string
+	// Endpoint defaults to the one of the compute api
+	Endpoint string
+	// PollInterval is the interval of polling the operations
+	PollInterval time.Duration
+	// RetryDelay is the delay of the first retry of the retriable errors,
+	// it doubles on every retry up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// GCPProvider maps the LoadBalancer onto a regional external network load
+// balancer of GCP: an address, a forwarding rule per port and a target
+// pool of the nodes with an http health check. The operations of GCP are
+// polled on the resyncs instead of blocking the sync.
+type GCPProvider struct {
+	cfg         Config
+	client      client
+	storeLister core.StoreLister
+
+	mu        sync.Mutex
+	pending   []*operation
+	addresses []net.IP
+	// failures counts the consecutive retriable errors for the backoff
+	failures uint
+}
+
+// NewGCPProvider creates a new GCP LoadBalancer Provider, it authorizes
+// the requests by the service account of the instance
+func NewGCPProvider(cfg Config) *GCPProvider {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = DefaultEndpoint
+	}
+	return newGCPProvider(cfg, newComputeClient(cfg.Endpoint, cfg.Project, cfg.Region, newMetadataToken(metadataTokenEndpoint)))
+}
+
+func newGCPProvider(cfg Config, c client) *GCPProvider {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	return &GCPProvider{cfg: cfg, client: c}
+}
+
+// resourceName returns the name of the resources of the LoadBalancer, the
+// forwarding rules append the protocol and the port to it
+func resourceName(lb *netv1alpha1.LoadBalancer) string {
+	return "k8s-" + strings.Replace(string(lb.UID), "-", "", -1)
+}
+
+func ruleName(base string, port corenet.Port) string {
+	return fmt.Sprintf("%s-%s-%d", base, port.Protocol, port.Port)
+}
+
+// description returns the description of the resources created for the
+// LoadBalancer, the target pools and the health checks have no labels so
+// the ownership is recorded in the descriptions
+func description(lb *netv1alpha1.LoadBalancer) string {
+	data, _ := json.Marshal(map[string]string{
+		uidKey:   string(lb.UID),
+		ownerKey: lb.Namespace + "/" + lb.Name,
+	})
+	return string(data)
+}
+
+// owned returns true if the description is the one of the LoadBalancer
+func owned(lb *netv1alpha1.LoadBalancer, desc string) bool {
+	values := make(map[string]string)
+	if json.Unmarshal([]byte(desc), &values) != nil {
+		return false
+	}
+	return values[uidKey] == string(lb.UID)
+}
+
+// checkOwner returns a PermanentError if the resource is not created for
+// the LoadBalancer
+func checkOwner(lb *netv1alpha1.LoadBalancer, kind, name, desc string) error {
+	if !owned(lb, desc) {
+		return core.NewPermanentError("GCPResourceConflict", fmt.Errorf("%s %s is not created for the loadbalancer, its description is %q", kind, name, desc))
+	}
+	return nil
+}
+
+// getHealthCheck returns the health check in the annotation. It returns a
+// PermanentError if the health check is invalid.
+func getHealthCheck(lb *netv1alpha1.LoadBalancer) (HealthCheck, error) {
+	hc := DefaultHealthCheck
+	value, ok := lb.Annotations[AnnotationKeyHealthCheck]
+	if !ok {
+		return hc, nil
+	}
+	if err := json.Unmarshal([]byte(value), &hc); err != nil {
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check %q: %v", value, err))
+	}
+	switch {
+	case hc.Port <= 0 || hc.Port > 65535:
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check port %d", hc.Port))
+	case !strings.HasPrefix(hc.Path, "/"):
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check path %q", hc.Path))
+	case hc.Interval < 1 || hc.Interval > 300:
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check interval %d, it must be in [1, 300]", hc.Interval))
+	case hc.Timeout < 1 || hc.Timeout > hc.Interval:
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check timeout %d, it must be in [1, %d]", hc.Timeout, hc.Interval))
+	case hc.HealthyThreshold < 1 || hc.HealthyThreshold > 10 || hc.UnhealthyThreshold < 1 || hc.UnhealthyThreshold > 10:
+		return hc, core.NewPermanentError("InvalidGCPHealthCheck", fmt.Errorf("invalid health check thresholds %d/%d, they must be in [1, 10]", hc.HealthyThreshold, hc.UnhealthyThreshold))
+	}
+	return hc, nil
+}
+
+// instance returns the link of the instance of the node in its provider
+// id, e.g. gce://project/us-central1-a/node1
+func instance(node *v1.Node) string {
+	id := node.Spec.ProviderID
+	if !strings.HasPrefix(id, "gce://") {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(id, "gce://"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return ""
+	}
+	return instanceLink(parts[0], parts[1], parts[2])
+}
+
+// desiredInstances returns the instances of the nodes, the nodes weighted
+// to zero, e.g. not ready, are left out
+func (p *GCPProvider) desiredInstances(lb *netv1alpha1.LoadBalancer) []string {
+	instances := make([]string, 0, len(lb.Spec.Nodes.Names))
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, corenet.FamilyIPv4) {
+		if rs.Weight == 0 {
+			continue
+		}
+		node, err := p.storeLister.Node.Get(rs.Node)
+		if err != nil {
+			continue
+		}
+		link := instance(node)
+		if link == "" {
+			log.Warn("skip node without a gce instance", log.Fields{"node": rs.Node, "providerID": node.Spec.ProviderID})
+			continue
+		}
+		instances = append(instances, link)
+	}
+	sort.Strings(instances)
+	return instances
+}
+
+// poll returns true if no operation is pending, the failures of the done
+// operations are returned
+func (p *GCPProvider) poll() (bool, error) {
+	var failed error
+	pending := p.pending[:0]
+	for _, op := range p.pending {
+		done, err := p.client.PollOperation(op)
+		switch {
+		case !done && err == nil:
+			pending = append(pending, op)
+		case !done:
+			// the operation is polled again on the retry
+			pending = append(pending, op)
+			failed = err
+		default:
+			log.Info("gcp operation done", log.Fields{"op": op, "err": err})
+			if err != nil {
+				failed = err
+			}
+		}
+	}
+	p.pending = pending
+	return len(p.pending) == 0, failed
+}
+
+// wait records the operations to be polled on the resyncs
+func (p *GCPProvider) wait(ops ...*operation) {
+	for _, op := range ops {
+		if op != nil {
+			log.Info("Waiting for gcp operation", log.Fields{"op": op})
+			p.pending = append(p.pending, op)
+		}
+	}
+}
+
+// retry translates the retriable errors into RetryAfterErrors, the delay
+// doubles on the consecutive ones
+func (p *GCPProvider) retry(err error) error {
+	if err == nil {
+		p.failures = 0
+		return nil
+	}
+	if !retriable(err) {
+		return err
+	}
+	delay := p.cfg.MaxRetryDelay
+	if p.failures < 16 {
+		if d := p.cfg.RetryDelay << p.failures; d < delay {
+			delay = d
+		}
+	}
+	p.failures++
+	return core.NewRetryAfterError(delay, err)
+}
+
+// OnUpdate ensures the GCP resources of the LoadBalancer, it returns as
+// soon as an operation is pending and goes on once it is done
+func (p *GCPProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retry(p.sync(lb))
+}
+
+func (p *GCPProvider) sync(lb *netv1alpha1.LoadBalancer) error {
+	if done, err := p.poll(); !done || err != nil {
+		return err
+	}
+
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return err
+	}
+	hc, err := getHealthCheck(lb)
+	if err != nil {
+		return err
+	}
+
+	name := resourceName(lb)
+	addr, err := p.ensureAddress(lb, name)
+	if err != nil || addr == nil {
+		return err
+	}
+	if ip := net.ParseIP(addr.Address); ip != nil {
+		p.addresses = []net.IP{ip}
+	}
+
+	if err := p.ensureHealthCheck(lb, name, hc); err != nil || len(p.pending) > 0 {
+		return err
+	}
+	pool, err := p.ensureTargetPool(lb, name)
+	if err != nil || pool == nil {
+		return err
+	}
+	if err := p.ensureInstances(pool, p.desiredInstances(lb)); err != nil || len(p.pending) > 0 {
+		return err
+	}
+	if err := p.ensureForwardingRules(lb, name, addr.Address, pool.SelfLink, ports); err != nil || len(p.pending) > 0 {
+		return err
+	}
+
+	// the address reserved before the annotation is released once the
+	// forwarding rules move to the one in the annotation
+	if _, ok := lb.Annotations[AnnotationKeyAddress]; ok {
+		return p.deleteAddress(lb, name)
+	}
+	return nil
+}
+
+// ensureAddress returns the address in the annotation, or the one reserved
+// for the LoadBalancer. It returns nil if the reservation is pending.
+func (p *GCPProvider) ensureAddress(lb *netv1alpha1.LoadBalancer, name string) (*address, error) {
+	if existing, ok := lb.Annotations[AnnotationKeyAddress]; ok {
+		addr, err := p.client.GetAddress(existing)
+		if err != nil {
+			return nil, err
+		}
+		if addr == nil {
+			return nil, core.NewPermanentError("GCPAddressNotFound", fmt.Errorf("address %s not found in region %s", existing, p.cfg.Region))
+		}
+		return addr, nil
+	}
+
+	addr, err := p.client.GetAddress(name)
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		return addr, checkOwner(lb, "address", name, addr.Description)
+	}
+
+	log.Info("Reserving gcp address", log.Fields{"name": name})
+	op, err := p.client.InsertAddress(&address{Name: name, Description: description(lb)})
+	p.wait(op)
+	return nil, err
+}
+
+// ensureHealthCheck creates the health check of the nodes, or updates it if
+// changed
+func (p *GCPProvider) ensureHealthCheck(lb *netv1alpha1.LoadBalancer, name string, hc HealthCheck) error {
+	desired := &httpHealthCheck{
+		Name:               name,
+		Description:        description(lb),
+		Port:               hc.Port,
+		RequestPath:        hc.Path,
+		CheckIntervalSec:   hc.Interval,
+		TimeoutSec:         hc.Timeout,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+	}
+	cur, err := p.client.GetHealthCheck(name)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		log.Info("Creating gcp health check", log.Fields{"name": name})
+		op, err := p.client.InsertHealthCheck(desired)
+		p.wait(op)
+		return err
+	}
+	if err := checkOwner(lb, "health check", name, cur.Description); err != nil {
+		return err
+	}
+	cur.SelfLink = ""
+	if *cur == *desired {
+		return nil
+	}
+	log.Info("Updating gcp health check", log.Fields{"name": name, "healthCheck": hc})
+	op, err := p.client.UpdateHealthCheck(desired)
+	p.wait(op)
+	return err
+}
+
+// ensureTargetPool returns the target pool of the LoadBalancer, it returns
+// nil if the creation is pending
+func (p *GCPProvider) ensureTargetPool(lb *netv1alpha1.LoadBalancer, name string) (*targetPool, error) {
+	pool, err := p.client.GetTargetPool(name)
+	if err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		return pool, checkOwner(lb, "target pool", name, pool.Description)
+	}
+
+	log.Info("Creating gcp target pool", log.Fields{"name": name})
+	op, err := p.client.InsertTargetPool(&targetPool{
+		Name:         name,
+		Description:  description(lb),
+		HealthChecks: []string{globalLink(p.cfg.Project, "httpHealthChecks", name)},
+		Instances:    p.desiredInstances(lb),
+	})
+	p.wait(op)
+	return nil, err
+}
+
+// ensureInstances adds the missing instances to the target pool, and then
+// removes the others on the next sync, since the operations of a target
+// pool are serial
+func (p *GCPProvider) ensureInstances(pool *targetPool, instances []string) error {
+	members := make(map[string]string, len(pool.Instances))
+	for _, i := range pool.Instances {
+		members[resourcePath(i)] = i
+	}
+
+	add := make([]string, 0)
+	for _, i := range instances {
+		if _, ok := members[resourcePath(i)]; ok {
+			delete(members, resourcePath(i))
+			continue
+		}
+		add = append(add, i)
+	}
+	if len(add) > 0 {
+		log.Info("Adding gcp target pool instances", log.Fields{"pool": pool.Name, "instances": add})
+		op, err := p.client.AddInstances(pool.Name, add)
+		p.wait(op)
+		return err
+	}
+
+	remove := make([]string, 0, len(members))
+	for _, i := range members {
+		remove = append(remove, i)
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	sort.Strings(remove)
+	log.Info("Removing gcp target pool instances", log.Fields{"pool": pool.Name, "instances": remove})
+	op, err := p.client.RemoveInstances(pool.Name, remove)
+	p.wait(op)
+	return err
+}
+
+// ensureForwardingRules ensures a forwarding rule of the address to the
+// target pool per port. The forwarding rules are immutable but for the
+// target, so the changed ones are deleted first and created again on the
+// next sync.
+func (p *GCPProvider) ensureForwardingRules(lb *netv1alpha1.LoadBalancer, name, ip, pool string, ports []corenet.Port) error {
+	desired := make(map[string]*forwardingRule, len(ports))
+	for _, port := range ports {
+		rule := &forwardingRule{
+			Name:                ruleName(name, port),
+			Description:         description(lb),
+			IPAddress:           ip,
+			IPProtocol:          strings.ToUpper(port.Protocol),
+			PortRange:           fmt.Sprintf("%d-%d", port.Port, port.Port),
+			Target:              pool,
+			LoadBalancingScheme: "EXTERNAL",
+		}
+		desired[rule.Name] = rule
+	}
+
+	rules, err := p.client.ListForwardingRules(name + "-")
+	if err != nil {
+		return err
+	}
+	deletes := make([]string, 0)
+	retargets := make([]string, 0)
+	for _, cur := range rules {
+		if !owned(lb, cur.Description) {
+			continue
+		}
+		want, ok := desired[cur.Name]
+		delete(desired, cur.Name)
+		switch {
+		case !ok || cur.IPAddress != want.IPAddress || cur.IPProtocol != want.IPProtocol || cur.PortRange != want.PortRange:
+			deletes = append(deletes, cur.Name)
+		case resourcePath(cur.Target) != resourcePath(want.Target):
+			retargets = append(retargets, cur.Name)
+		}
+	}
+
+	if len(deletes) > 0 {
+		sort.Strings(deletes)
+		for _, rule := range deletes {
+			log.Info("Deleting gcp forwarding rule", log.Fields{"name": rule})
+			op, err := p.client.DeleteForwardingRule(rule)
+			p.wait(op)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sort.Strings(retargets)
+	for _, rule := range retargets {
+		log.Info("Updating gcp forwarding rule target", log.Fields{"name": rule, "target": pool})
+		op, err := p.client.SetTarget(rule, pool)
+		p.wait(op)
+		if err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Info("Creating gcp forwarding rule", log.Fields{"name": name, "ip": ip})
+		op, err := p.client.InsertForwardingRule(desired[name])
+		p.wait(op)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAddress releases the address if it is reserved for the LoadBalancer
+func (p *GCPProvider) deleteAddress(lb *netv1alpha1.LoadBalancer, name string) error {
+	addr, err := p.client.GetAddress(name)
+	if err != nil || addr == nil || !owned(lb, addr.Description) {
+		return err
+	}
+	log.Info("Releasing gcp address", log.Fields{"name": name})
+	op, err := p.client.DeleteAddress(name)
+	p.wait(op)
+	return err
+}
+
+// OnDelete implements core.DeletionProvider, the forwarding rules, the
+// target pool, the health check and the address created for the
+// LoadBalancer are deleted in the order of their references
+func (p *GCPProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retry(p.cleanup(lb))
+}
+
+func (p *GCPProvider) cleanup(lb *netv1alpha1.LoadBalancer) error {
+	if done, err := p.poll(); !done || err != nil {
+		return err
+	}
+
+	name := resourceName(lb)
+	rules, err := p.client.ListForwardingRules(name + "-")
+	if err != nil {
+		return err
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	for _, rule := range rules {
+		if !owned(lb, rule.Description) {
+			continue
+		}
+		log.Info("Deleting gcp forwarding rule", log.Fields{"name": rule.Name})
+		op, err := p.client.DeleteForwardingRule(rule.Name)
+		p.wait(op)
+		if err != nil {
+			return err
+		}
+	}
+	if len(p.pending) > 0 {
+		return nil
+	}
+
+	pool, err := p.client.GetTargetPool(name)
+	if err != nil {
+		return err
+	}
+	if pool != nil && owned(lb, pool.Description) {
+		log.Info("Deleting gcp target pool", log.Fields{"name": name})
+		op, err := p.client.DeleteTargetPool(name)
+		p.wait(op)
+		return err
+	}
+
+	hc, err := p.client.GetHealthCheck(name)
+	if err != nil {
+		return err
+	}
+	if hc != nil && owned(lb, hc.Description) {
+		log.Info("Deleting gcp health check", log.Fields{"name": name})
+		op, err := p.client.DeleteHealthCheck(name)
+		p.wait(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := p.deleteAddress(lb, name); err != nil || len(p.pending) > 0 {
+		return err
+	}
+	p.addresses = nil
+	return nil
+}
+
+// ResyncAfter implements core.ResyncProvider, the pending operations are
+// polled on the resyncs
+func (p *GCPProvider) ResyncAfter() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.pending) > 0 {
+		return p.cfg.PollInterval
+	}
+	return 0
+}
+
+// Addresses implements core.AddressProvider
+func (p *GCPProvider) Addresses() []net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.addresses
+}
+
+// Start ...
+func (p *GCPProvider) Start() {
+	log.Info("Startting gcp provider")
+}
+
+// WaitForStart ...
+func (p *GCPProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the GCP resources alone, they outlive the provider and are
+// deleted with the LoadBalancer
+func (p *GCPProvider) Stop() error {
+	log.Info("Shutting down gcp provider")
+	return nil
+}
+
+// Info ...
+func (p *GCPProvider) Info() core.Info {
+	return core.Info{
+		Name:       "gcp",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *GCPProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
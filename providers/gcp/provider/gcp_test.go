@@ -0,0 +1,480 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testUID  = "7c1d0f4e-1111-2222-3333-444455556666"
+	testName = "k8s-7c1d0f4e111122223333444455556666"
+)
+
+// fakeClient is an in-memory compute api, the changes are applied once
+// their operations are polled
+type fakeClient struct {
+	mu    sync.Mutex
+	addrs map[string]*address
+	hcs   map[string]*httpHealthCheck
+	pools map[string]*targetPool
+	rules map[string]*forwardingRule
+	ops   map[string]func() error
+	seq   int
+	calls []string
+	// fail fails the next call of the method
+	fail map[string]error
+}
+
+var _ client = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		addrs: make(map[string]*address),
+		hcs:   make(map[string]*httpHealthCheck),
+		pools: make(map[string]*targetPool),
+		rules: make(map[string]*forwardingRule),
+		ops:   make(map[string]func() error),
+		fail:  make(map[string]error),
+	}
+}
+
+// apply records the call and applies the change on the poll of the
+// returned operation
+func (f *fakeClient) apply(call, target string, change func() error) (*operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call+" "+target)
+	method := call
+	if err, ok := f.fail[method]; ok {
+		delete(f.fail, method)
+		return nil, err
+	}
+	f.seq++
+	op := &operation{Name: fmt.Sprintf("op-%d", f.seq), OperationType: call, TargetLink: target, Status: "RUNNING", SelfLink: fmt.Sprintf("op-%d", f.seq)}
+	f.ops[op.SelfLink] = change
+	return op, nil
+}
+
+func (f *fakeClient) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *fakeClient) GetAddress(name string) (*address, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if a, ok := f.addrs[name]; ok {
+		copied := *a
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeClient) InsertAddress(a *address) (*operation, error) {
+	stored := *a
+	return f.apply("InsertAddress", a.Name, func() error {
+		stored.Address = fmt.Sprintf("35.0.0.%d", len(f.addrs)+1)
+		stored.Status = "RESERVED"
+		f.addrs[a.Name] = &stored
+		return nil
+	})
+}
+
+func (f *fakeClient) DeleteAddress(name string) (*operation, error) {
+	return f.apply("DeleteAddress", name, func() error {
+		delete(f.addrs, name)
+		return nil
+	})
+}
+
+func (f *fakeClient) GetHealthCheck(name string) (*httpHealthCheck, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if hc, ok := f.hcs[name]; ok {
+		copied := *hc
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeClient) InsertHealthCheck(hc *httpHealthCheck) (*operation, error) {
+	stored := *hc
+	stored.SelfLink = globalLink("project", "httpHealthChecks", hc.Name)
+	return f.apply("InsertHealthCheck", hc.Name, func() error {
+		f.hcs[hc.Name] = &stored
+		return nil
+	})
+}
+
+func (f *fakeClient) UpdateHealthCheck(hc *httpHealthCheck) (*operation, error) {
+	stored := *hc
+	stored.SelfLink = globalLink("project", "httpHealthChecks", hc.Name)
+	return f.apply("UpdateHealthCheck", hc.Name, func() error {
+		f.hcs[hc.Name] = &stored
+		return nil
+	})
+}
+
+func (f *fakeClient) DeleteHealthCheck(name string) (*operation, error) {
+	return f.apply("DeleteHealthCheck", name, func() error {
+		for _, pool := range f.pools {
+			for _, hc := range pool.HealthChecks {
+				if hc == globalLink("project", "httpHealthChecks", name) {
+					return &apiError{Errors: []errorItem{{Code: "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE"}}}
+				}
+			}
+		}
+		delete(f.hcs, name)
+		return nil
+	})
+}
+
+func (f *fakeClient) GetTargetPool(name string) (*targetPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pool, ok := f.pools[name]; ok {
+		copied := *pool
+		copied.Instances = append([]string{}, pool.Instances...)
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeClient) InsertTargetPool(pool *targetPool) (*operation, error) {
+	stored := *pool
+	stored.SelfLink = regionalLink("project", "us-central1", "targetPools", pool.Name)
+	return f.apply("InsertTargetPool", pool.Name, func() error {
+		f.pools[pool.Name] = &stored
+		return nil
+	})
+}
+
+func (f *fakeClient) DeleteTargetPool(name string) (*operation, error) {
+	return f.apply("DeleteTargetPool", name, func() error {
+		delete(f.pools, name)
+		return nil
+	})
+}
+
+func (f *fakeClient) AddInstances(pool string, instances []string) (*operation, error) {
+	return f.apply("AddInstances", fmt.Sprintf("%s %v", pool, names(instances)), func() error {
+		f.pools[pool].Instances = append(f.pools[pool].Instances, instances...)
+		return nil
+	})
+}
+
+func (f *fakeClient) RemoveInstances(pool string, instances []string) (*operation, error) {
+	return f.apply("RemoveInstances", fmt.Sprintf("%s %v", pool, names(instances)), func() error {
+		remove := make(map[string]bool)
+		for _, i := range instances {
+			remove[i] = true
+		}
+		kept := []string{}
+		for _, i := range f.pools[pool].Instances {
+			if !remove[i] {
+				kept = append(kept, i)
+			}
+		}
+		f.pools[pool].Instances = kept
+		return nil
+	})
+}
+
+func (f *fakeClient) ListForwardingRules(prefix string) ([]forwardingRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.fail["ListForwardingRules"]; ok {
+		delete(f.fail, "ListForwardingRules")
+		return nil, err
+	}
+	ret := []forwardingRule{}
+	for name, rule := range f.rules {
+		if len(name) >= len(prefix) && name[:len(prefix)] == prefix {
+			ret = append(ret, *rule)
+		}
+	}
+	return ret, nil
+}
+
+func (f *fakeClient) InsertForwardingRule(rule *forwardingRule) (*operation, error) {
+	stored := *rule
+	return f.apply("InsertForwardingRule", rule.Name, func() error {
+		f.rules[rule.Name] = &stored
+		return nil
+	})
+}
+
+func (f *fakeClient) DeleteForwardingRule(name string) (*operation, error) {
+	return f.apply("DeleteForwardingRule", name, func() error {
+		delete(f.rules, name)
+		return nil
+	})
+}
+
+func (f *fakeClient) SetTarget(rule, target string) (*operation, error) {
+	return f.apply("SetTarget", rule, func() error {
+		f.rules[rule].Target = target
+		return nil
+	})
+}
+
+func (f *fakeClient) PollOperation(op *operation) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	change, ok := f.ops[op.SelfLink]
+	if !ok {
+		return true, fmt.Errorf("operation %s not found", op.SelfLink)
+	}
+	delete(f.ops, op.SelfLink)
+	return true, change()
+}
+
+// forwarding returns the forwarding rules with the instances of their
+// target pools
+func (f *fakeClient) forwarding() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ret := []string{}
+	for name, rule := range f.rules {
+		pool := f.pools[rule.Target[len(regionalLink("project", "us-central1", "targetPools", "")):]]
+		ret = append(ret, fmt.Sprintf("%s %s:%s/%s %v", name[len(testName):], rule.IPAddress, rule.PortRange, rule.IPProtocol, names(pool.Instances)))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// names returns the names of the instances in order
+func names(instances []string) []string {
+	ret := make([]string, 0, len(instances))
+	for _, i := range instances {
+		ret = append(ret, i[len(instanceLink("project", "us-central1-a", "")):])
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// converge syncs until no operation is pending, it returns the calls
+func converge(t *testing.T, c *fakeClient, sync func() error, resync func() time.Duration) []string {
+	calls := []string{}
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, sync())
+		calls = append(calls, c.Calls()...)
+		if resync() == 0 {
+			return calls
+		}
+	}
+	t.Fatalf("not converged: %v", calls)
+	return nil
+}
+
+func newTestNode(name string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ProviderID: "gce://project/us-central1-a/" + name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", UID: types.UID(testUID), Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func newTestProvider(c client, nodes cache.Indexer) *GCPProvider {
+	p := newGCPProvider(Config{Project: "project", Region: "us-central1"}, c)
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	return p
+}
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func TestOnUpdate(t *testing.T) {
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", true))
+	nodes.Add(newTestNode("node2", true))
+	c := newFakeClient()
+	p := newTestProvider(c, nodes)
+	lb := newTestLoadBalancer("node1", "node2")
+	update := func() error { return p.OnUpdate(lb) }
+
+	// create, every operation is polled on the following resync
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"InsertAddress " + testName}, c.Calls())
+	assert.Equal(t, DefaultPollInterval, p.ResyncAfter())
+	assert.Nil(t, p.Addresses())
+
+	assert.Equal(t, []string{
+		"InsertHealthCheck " + testName,
+		"InsertTargetPool " + testName,
+		"InsertForwardingRule " + testName + "-tcp-443",
+		"InsertForwardingRule " + testName + "-tcp-80",
+	}, converge(t, c, update, p.ResyncAfter))
+	assert.Equal(t, []net.IP{net.ParseIP("35.0.0.1")}, p.Addresses())
+	assert.Equal(t, []string{
+		"-tcp-443 35.0.0.1:443-443/TCP [node1 node2]",
+		"-tcp-80 35.0.0.1:80-80/TCP [node1 node2]",
+	}, c.forwarding())
+	assert.Equal(t, []string{globalLink("project", "httpHealthChecks", testName)}, c.pools[testName].HealthChecks)
+	assert.Equal(t, "/healthz", c.hcs[testName].RequestPath)
+	assert.True(t, owned(lb, c.rules[testName+"-tcp-80"].Description))
+
+	// idempotent, also for a new provider adopting the resources
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+	p = newTestProvider(c, nodes)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, c.Calls())
+	assert.Equal(t, []net.IP{net.ParseIP("35.0.0.1")}, p.Addresses())
+
+	// port update
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"udp","port":53}]`
+	assert.Equal(t, []string{
+		"DeleteForwardingRule " + testName + "-tcp-443",
+		"InsertForwardingRule " + testName + "-udp-53",
+	}, converge(t, c, update, p.ResyncAfter))
+
+	// health check update
+	lb.Annotations[AnnotationKeyHealthCheck] = `{"port":8081,"path":"/ready"}`
+	assert.Equal(t, []string{"UpdateHealthCheck " + testName}, converge(t, c, update, p.ResyncAfter))
+	assert.Equal(t, 8081, c.hcs[testName].Port)
+	assert.Equal(t, 5, c.hcs[testName].CheckIntervalSec)
+	lb.Annotations[AnnotationKeyHealthCheck] = `{"interval":5,"timeout":10}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+	delete(lb.Annotations, AnnotationKeyHealthCheck)
+	assert.Equal(t, []string{"UpdateHealthCheck " + testName}, converge(t, c, update, p.ResyncAfter))
+
+	// node churn, the instances are added before the others are removed
+	nodes.Add(newTestNode("node3", true))
+	nodes.Update(newTestNode("node1", false))
+	lb.Spec.Nodes.Names = []string{"node1", "node3"}
+	assert.Equal(t, []string{
+		"AddInstances " + testName + " [node3]",
+		"RemoveInstances " + testName + " [node1 node2]",
+	}, converge(t, c, update, p.ResyncAfter))
+	assert.Equal(t, []string{
+		"-tcp-80 35.0.0.1:80-80/TCP [node3]",
+		"-udp-53 35.0.0.1:53-53/UDP [node3]",
+	}, c.forwarding())
+
+	// the address in the annotation replaces the reserved one
+	c.addrs["shared"] = &address{Name: "shared", Address: "35.0.0.100"}
+	lb.Annotations[AnnotationKeyAddress] = "shared"
+	assert.Equal(t, []string{
+		"DeleteForwardingRule " + testName + "-tcp-80",
+		"DeleteForwardingRule " + testName + "-udp-53",
+		"InsertForwardingRule " + testName + "-tcp-80",
+		"InsertForwardingRule " + testName + "-udp-53",
+		"DeleteAddress " + testName,
+	}, converge(t, c, update, p.ResyncAfter))
+	assert.Equal(t, []net.IP{net.ParseIP("35.0.0.100")}, p.Addresses())
+
+	// deletion cleanup, the address in the annotation is not owned
+	assert.Equal(t, []string{
+		"DeleteForwardingRule " + testName + "-tcp-80",
+		"DeleteForwardingRule " + testName + "-udp-53",
+		"DeleteTargetPool " + testName,
+		"DeleteHealthCheck " + testName,
+	}, converge(t, c, func() error { return p.OnDelete(lb) }, p.ResyncAfter))
+	assert.Empty(t, c.rules)
+	assert.Empty(t, c.pools)
+	assert.Empty(t, c.hcs)
+	assert.Len(t, c.addrs, 1)
+	assert.Nil(t, p.Addresses())
+}
+
+func TestOnUpdateRetry(t *testing.T) {
+	c := newFakeClient()
+	p := newTestProvider(c, newIndexer())
+	lb := newTestLoadBalancer()
+
+	// the exceeded quota is retried with backoff
+	quota := &apiError{Code: 403, Errors: []errorItem{{Reason: "quotaExceeded", Message: "Quota 'IN_USE_ADDRESSES' exceeded"}}}
+	c.fail["InsertAddress"] = quota
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsRetryAfterError(err))
+	assert.Equal(t, DefaultRetryDelay, err.(*core.RetryAfterError).After)
+	c.fail["InsertAddress"] = quota
+	err = p.OnUpdate(lb)
+	assert.Equal(t, 2*DefaultRetryDelay, err.(*core.RetryAfterError).After)
+
+	// the failed operation as well, the backoff is reset by the success
+	// in between
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, uint(0), p.failures)
+	c.ops["op-1"] = func() error {
+		return &apiError{Errors: []errorItem{{Code: "QUOTA_EXCEEDED", Message: "Quota 'STATIC_ADDRESSES' exceeded"}}}
+	}
+	err = p.OnUpdate(lb)
+	assert.True(t, core.IsRetryAfterError(err))
+	assert.Equal(t, DefaultRetryDelay, err.(*core.RetryAfterError).After)
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+
+	// the other errors are not retried with backoff
+	c.fail["ListForwardingRules"] = &apiError{Code: 400, Errors: []errorItem{{Reason: "invalid"}}}
+	err = p.OnDelete(lb)
+	assert.NotNil(t, err)
+	assert.False(t, core.IsRetryAfterError(err))
+}
+
+func TestOnUpdateConflict(t *testing.T) {
+	c := newFakeClient()
+	c.addrs[testName] = &address{Name: testName, Description: "reserved by hand", Address: "35.0.0.1"}
+	p := newTestProvider(c, newIndexer())
+	lb := newTestLoadBalancer()
+
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Contains(t, err.Error(), "address "+testName+" is not created for the loadbalancer")
+	assert.Empty(t, c.Calls())
+
+	// the foreign address is left alone
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Empty(t, c.Calls())
+	assert.Len(t, c.addrs, 1)
+}
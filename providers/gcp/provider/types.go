@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The resources of the compute api, with the fields the provider manages
+
+// address is a regional external IP address
+type address struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Address     string `json:"address,omitempty"`
+	// Status is one of RESERVING, RESERVED and IN_USE
+	Status   string `json:"status,omitempty"`
+	SelfLink string `json:"selfLink,omitempty"`
+}
+
+// httpHealthCheck is the legacy http health check of the target pools
+type httpHealthCheck struct {
+	Name               string `json:"name"`
+	Description        string `json:"description,omitempty"`
+	Port               int    `json:"port"`
+	RequestPath        string `json:"requestPath"`
+	CheckIntervalSec   int    `json:"checkIntervalSec"`
+	TimeoutSec         int    `json:"timeoutSec"`
+	HealthyThreshold   int    `json:"healthyThreshold"`
+	UnhealthyThreshold int    `json:"unhealthyThreshold"`
+	SelfLink           string `json:"selfLink,omitempty"`
+}
+
+// targetPool is the instances a forwarding rule balances to
+type targetPool struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	HealthChecks []string `json:"healthChecks,omitempty"`
+	Instances    []string `json:"instances,omitempty"`
+	SelfLink     string   `json:"selfLink,omitempty"`
+}
+
+// forwardingRule forwards the traffic to an IP address and a range of ports
+// in a protocol to a target pool
+type forwardingRule struct {
+	Name                string `json:"name"`
+	Description         string `json:"description,omitempty"`
+	IPAddress           string `json:"IPAddress"`
+	IPProtocol          string `json:"IPProtocol"`
+	PortRange           string `json:"portRange"`
+	Target              string `json:"target"`
+	LoadBalancingScheme string `json:"loadBalancingScheme,omitempty"`
+	SelfLink            string `json:"selfLink,omitempty"`
+}
+
+// operation is an asynchronous operation of the compute api, it is polled
+// by the self link until done
+type operation struct {
+	Name          string `json:"name"`
+	OperationType string `json:"operationType,omitempty"`
+	TargetLink    string `json:"targetLink,omitempty"`
+	// Status is one of PENDING, RUNNING and DONE
+	Status   string `json:"status"`
+	SelfLink string `json:"selfLink"`
+	Error    *struct {
+		Errors []errorItem `json:"errors"`
+	} `json:"error,omitempty"`
+}
+
+func (op *operation) String() string {
+	return op.OperationType + " " + resourcePath(op.TargetLink)
+}
+
+// errorItem is an error in the responses and the operations, the responses
+// tell the reason and the operations the code
+type errorItem struct {
+	Reason  string `json:"reason,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// apiError is the error of a request or an operation of the compute api
+type apiError struct {
+	// Code is the http status of the request, zero for the operations
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Errors  []errorItem `json:"errors"`
+}
+
+func (e *apiError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, item := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s%s: %s", item.Reason, item.Code, item.Message))
+	}
+	if len(msgs) == 0 {
+		return fmt.Sprintf("%d: %s", e.Code, e.Message)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// hasReason returns true if err is an apiError with one of the reasons or
+// the codes
+func hasReason(err error, reasons ...string) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	for _, item := range e.Errors {
+		for _, reason := range reasons {
+			if item.Reason == reason || item.Code == reason {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retriable returns true if the error is fixed by retrying later: the
+// exceeded quotas and rate limits, the resources busy with the other
+// operations, and the failures on the side of the compute api
+func retriable(err error) bool {
+	if hasReason(err,
+		"quotaExceeded", "QUOTA_EXCEEDED",
+		"rateLimitExceeded", "userRateLimitExceeded", "RATE_LIMIT_EXCEEDED", "RESOURCE_OPERATION_RATE_EXCEEDED",
+		"resourceNotReady", "RESOURCE_NOT_READY",
+		"resourceInUseByAnotherResource", "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE",
+	) {
+		return true
+	}
+	e, ok := err.(*apiError)
+	return ok && (e.Code == 429 || e.Code >= 500)
+}
+
+// resourcePath returns the path of the resource from projects on, the links
+// of a resource differ in the host and the version
+func resourcePath(link string) string {
+	if i := strings.Index(link, "projects/"); i >= 0 {
+		return link[i:]
+	}
+	return link
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+)
+
+const (
+	// AnnotationKeyBalance is the balance algorithm of the backends, one of
+	// roundrobin, static-rr, leastconn, first and source, roundrobin by
+	// default
+	AnnotationKeyBalance = "loadbalancer.caicloud.io/haproxy-balance"
+	// AnnotationKeyTimeouts is the timeouts of the proxies in json, e.g.
+	// {"connect":"5s","client":"1m","server":"1m","tunnel":"1h"}, the
+	// absent ones are the defaults
+	AnnotationKeyTimeouts = "loadbalancer.caicloud.io/haproxy-timeouts"
+	// AnnotationKeyHealthCheck is the health check of the servers of the
+	// backends in json, e.g. {"protocol":"http","path":"/healthz","interval":"2s"},
+	// the servers are not checked if it is absent
+	AnnotationKeyHealthCheck = "loadbalancer.caicloud.io/haproxy-health-check"
+)
+
+// balanceAlgorithms are the supported balance algorithms
+var balanceAlgorithms = []string{"roundrobin", "static-rr", "leastconn", "first", "source"}
+
+// timeouts are the timeouts of the proxies in milliseconds
+type timeouts struct {
+	Connect int64
+	Client  int64
+	Server  int64
+	// Tunnel applies to the established tcp and websocket connections
+	Tunnel int64
+}
+
+var defaultTimeouts = timeouts{
+	Connect: 5000,
+	Client:  50000,
+	Server:  50000,
+	Tunnel:  3600000,
+}
+
+// healthCheck is the health check of the servers
+type healthCheck struct {
+	// Protocol is tcp or http
+	Protocol string `json:"protocol"`
+	// Path is the path of the http request, / by default
+	Path string `json:"path,omitempty"`
+	// Port is the port checked instead of the one of the servers
+	Port int `json:"port,omitempty"`
+	// Interval is the interval of the checks, 2s by default
+	Interval string `json:"interval,omitempty"`
+	Rise     int    `json:"rise,omitempty"`
+	Fall     int    `json:"fall,omitempty"`
+
+	// IntervalMillis is the parsed interval
+	IntervalMillis int64 `json:"-"`
+}
+
+// persistence is the stick table of the backends keeping the server of a
+// client until it is idle for the timeout
+type persistence struct {
+	// Timeout is in seconds
+	Timeout uint32
+	// Netmask is the prefix length grouping the IPv4 clients sharing the
+	// server, each client alone if it is zero
+	Netmask int
+}
+
+// getPersistence returns the persistence of the LoadBalancer, nil if it is
+// not enabled. It returns a PermanentError if it is invalid.
+func getPersistence(lb *netv1alpha1.LoadBalancer) (*persistence, error) {
+	p, err := core.GetPersistence(lb)
+	if err != nil || p == nil || !p.Enabled {
+		return nil, err
+	}
+	ret := &persistence{Timeout: p.Timeout}
+	if p.Mask != nil {
+		ret.Netmask, _ = p.Mask.Size()
+	}
+	return ret, nil
+}
+
+// accessLog is the log of the requests of the frontends, the http ones log
+// the requests and the tcp ones the connections
+type accessLog struct {
+	// Target is stdout or the host:port of the syslog server
+	Target string
+	// Sampling logs one of every Sampling requests, all if it is zero
+	Sampling uint32
+	Format   core.AccessLogFormat
+}
+
+// the log-format of the frontends, the combined format of the tcp ones is
+// the one of tcplog
+const (
+	combinedHTTPLogFormat = `"%ci - - [%trl] \"%HM %HU %HV\" %ST %B \"%[capture.req.hdr(0)]\" \"%[capture.req.hdr(1)]\""`
+	jsonHTTPLogFormat     = `"%{+E}o{\"time\":\"%trl\",\"remote_addr\":\"%ci\",\"request\":\"%HM %HU %HV\",\"status\":%ST,\"bytes_sent\":%B,\"request_time\":%Ta,\"backend\":\"%b\",\"server\":\"%s\"}"`
+	jsonTCPLogFormat      = `"%{+E}o{\"time\":\"%t\",\"remote_addr\":\"%ci\",\"bytes_read\":%B,\"session_time\":%Tt,\"backend\":\"%b\",\"server\":\"%s\"}"`
+)
+
+// Directives returns the directives logging the requests of a frontend of
+// the mode
+func (l accessLog) Directives(mode string) []string {
+	switch {
+	case mode == "http" && l.Format == core.AccessLogFormatJSON:
+		return []string{"log-format " + jsonHTTPLogFormat}
+	case mode == "http":
+		return []string{
+			"capture request header Referer len 128",
+			"capture request header User-Agent len 256",
+			"log-format " + combinedHTTPLogFormat,
+		}
+	case l.Format == core.AccessLogFormatJSON:
+		return []string{"log-format " + jsonTCPLogFormat}
+	}
+	return []string{"option tcplog"}
+}
+
+// getAccessLog returns the access log of the LoadBalancer, nil if it is not
+// enabled. It returns a PermanentError if it is invalid.
+func getAccessLog(lb *netv1alpha1.LoadBalancer) (*accessLog, error) {
+	l, err := core.GetAccessLog(lb)
+	if err != nil || l == nil || !l.Enabled {
+		return nil, err
+	}
+	ret := &accessLog{Target: "stdout", Sampling: l.Sampling, Format: l.Format}
+	if l.Syslog != "" {
+		ret.Target = l.Syslog
+	}
+	return ret, nil
+}
+
+// getBalance returns the balance algorithm of the LoadBalancer. It returns
+// a PermanentError if the algorithm is not supported.
+func getBalance(lb *netv1alpha1.LoadBalancer) (string, error) {
+	value, ok := lb.Annotations[AnnotationKeyBalance]
+	if !ok {
+		return "roundrobin", nil
+	}
+	for _, b := range balanceAlgorithms {
+		if value == b {
+			return value, nil
+		}
+	}
+	return "", core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("unsupported balance algorithm %q, expect one of %s", value, strings.Join(balanceAlgorithms, ", ")))
+}
+
+// getTimeouts returns the timeouts of the LoadBalancer with the defaults
+// filled. It returns a PermanentError if a timeout is invalid.
+func getTimeouts(lb *netv1alpha1.LoadBalancer) (timeouts, error) {
+	t := defaultTimeouts
+	value, ok := lb.Annotations[AnnotationKeyTimeouts]
+	if !ok {
+		return t, nil
+	}
+
+	raw := make(map[string]string)
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return t, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid timeouts %q: %v", value, err))
+	}
+	fields := map[string]*int64{
+		"connect": &t.Connect,
+		"client":  &t.Client,
+		"server":  &t.Server,
+		"tunnel":  &t.Tunnel,
+	}
+	for name, v := range raw {
+		field, ok := fields[name]
+		if !ok {
+			return t, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("unknown timeout %q", name))
+		}
+		ms, err := parseMillis(v)
+		if err != nil {
+			return t, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid %s timeout: %v", name, err))
+		}
+		*field = ms
+	}
+	return t, nil
+}
+
+// getHealthCheck returns the health check of the LoadBalancer with the
+// defaults filled, nil if not specified. It returns a PermanentError if the
+// check is invalid.
+func getHealthCheck(lb *netv1alpha1.LoadBalancer) (*healthCheck, error) {
+	value, ok := lb.Annotations[AnnotationKeyHealthCheck]
+	if !ok {
+		return nil, nil
+	}
+
+	c := &healthCheck{}
+	if err := json.Unmarshal([]byte(value), c); err != nil {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid health check %q: %v", value, err))
+	}
+	c.Protocol = strings.ToLower(c.Protocol)
+	if c.Protocol != "tcp" && c.Protocol != "http" {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("unsupported health check protocol %q", c.Protocol))
+	}
+	if c.Protocol == "http" && c.Path == "" {
+		c.Path = "/"
+	}
+	if c.Protocol == "tcp" && c.Path != "" {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("tcp health check has a path %q", c.Path))
+	}
+	if strings.ContainsAny(c.Path, " \t\n\"") || (c.Path != "" && !strings.HasPrefix(c.Path, "/")) {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid health check path %q", c.Path))
+	}
+	if c.Port < 0 || c.Port > 65535 || c.Rise < 0 || c.Fall < 0 {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid health check port, rise or fall in %q", value))
+	}
+	if c.Interval == "" {
+		c.Interval = "2s"
+	}
+	ms, err := parseMillis(c.Interval)
+	if err != nil {
+		return nil, core.NewPermanentError("InvalidHAProxyConfig", fmt.Errorf("invalid health check interval: %v", err))
+	}
+	c.IntervalMillis = ms
+	if c.Rise == 0 {
+		c.Rise = 2
+	}
+	if c.Fall == 0 {
+		c.Fall = 3
+	}
+	return c, nil
+}
+
+// parseMillis parses a positive duration in milliseconds
+func parseMillis(s string) (int64, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Millisecond {
+		return 0, fmt.Errorf("duration %q is shorter than 1ms", s)
+	}
+	return int64(d / time.Millisecond), nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTimeouts(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	got, err := getTimeouts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultTimeouts, got)
+
+	lb.Annotations = map[string]string{AnnotationKeyTimeouts: `{"connect":"1s","tunnel":"2h"}`}
+	got, err = getTimeouts(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, timeouts{Connect: 1000, Client: 50000, Server: 50000, Tunnel: 7200000}, got)
+
+	for _, value := range []string{`"1s"`, `{"idle":"1s"}`, `{"connect":"1"}`, `{"connect":"-1s"}`, `{"connect":"100us"}`} {
+		lb.Annotations[AnnotationKeyTimeouts] = value
+		_, err = getTimeouts(lb)
+		assert.True(t, core.IsPermanentError(err), value)
+	}
+}
+
+func TestGetHealthCheck(t *testing.T) {
+	lb := &netv1alpha1.LoadBalancer{}
+	c, err := getHealthCheck(lb)
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+
+	lb.Annotations = map[string]string{AnnotationKeyHealthCheck: `{"protocol":"HTTP"}`}
+	c, err = getHealthCheck(lb)
+	assert.Nil(t, err)
+	assert.Equal(t, &healthCheck{Protocol: "http", Path: "/", Interval: "2s", IntervalMillis: 2000, Rise: 2, Fall: 3}, c)
+
+	for _, value := range []string{
+		`{"protocol":"udp"}`,
+		`{"protocol":"tcp","path":"/"}`,
+		`{"protocol":"http","path":"healthz"}`,
+		`{"protocol":"http","path":"/ HTTP/1.1"}`,
+		`{"protocol":"tcp","port":70000}`,
+		`{"protocol":"tcp","interval":"0s"}`,
+		`{"protocol":"tcp","rise":-1}`,
+	} {
+		lb.Annotations[AnnotationKeyHealthCheck] = value
+		_, err = getHealthCheck(lb)
+		assert.True(t, core.IsPermanentError(err), value)
+	}
+
+	lb.Annotations[AnnotationKeyBalance] = "random"
+	_, err = getBalance(lb)
+	assert.True(t, core.IsPermanentError(err))
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	haproxyCfg    = "/etc/haproxy/haproxy.cfg"
+	haproxyTmpl   = "/root/haproxy.tmpl"
+	haproxyPid    = "/run/haproxy.pid"
+	haproxySocket = "/run/haproxy.sock"
+	certDir       = "/etc/haproxy/certs"
+
+	// maxServerWeight is the maximum weight of a haproxy server
+	maxServerWeight = 256
+
+	// defaultMaxConn is the maxconn of the LoadBalancers without the
+	// limit of the connections
+	defaultMaxConn = 50000
+)
+
+// frontend is a port of the LoadBalancer
+type frontend struct {
+	Name string
+	Port int
+	// Mode is http or tcp
+	Mode string
+	// Cert is the path of the certificate terminating TLS, empty for
+	// plain HTTP and TCP
+	Cert string
+	// HostCerts are the paths of the certificates of the hosts other than
+	// Cert, haproxy picks the one whose names match the SNI
+	HostCerts []string
+	// AcceptProxy expects the PROXY protocol header on the connections
+	AcceptProxy bool
+	// Backend serves the hosts not matched
+	Backend string
+	// Hosts are routed to their own backends by SNI if the frontend
+	// terminates TLS, by the Host header otherwise
+	Hosts []frontendHost
+	// Limits are the limits of the port alone, nil if it is unlimited
+	Limits *limits
+	// Redirect redirects the requests to https, nil if they are proxied
+	Redirect *redirect
+}
+
+// redirect is how the requests of a plain HTTP frontend are redirected to
+// https on the same host
+type redirect struct {
+	// Port is the https port redirected to, the default one if zero
+	Port int
+	// ExemptACME proxies the ACME challenges instead of redirecting them
+	ExemptACME bool
+}
+
+// frontendHost is a host of a frontend routed to its own backend
+type frontendHost struct {
+	Host    string
+	Backend string
+}
+
+// limits caps the connections and requests, a zero cap is unlimited
+type limits struct {
+	MaxConnections int
+	ConnectionRate int
+	RequestRate    int
+}
+
+// backend is the servers of a port of a Service or of the nodes
+type backend struct {
+	Name string
+	Mode string
+	// SendProxy is the version of the PROXY protocol header sent to the
+	// servers, none if empty
+	SendProxy core.ProxyProtocolVersion
+	// TLS re-encrypts the connections to the servers, nil for plain ones
+	TLS     *backendTLS
+	Servers []backendServer
+}
+
+// backendTLS is how the connections are re-encrypted to the servers
+type backendTLS struct {
+	// CAFile is the path of the CA certificates verifying the servers, they
+	// are not verified if it is empty
+	CAFile string
+}
+
+// TLSArgs returns the arguments of a server the connections are
+// re-encrypted to, the health checks are encrypted too
+func (b backend) TLSArgs() string {
+	switch {
+	case b.TLS == nil:
+		return ""
+	case b.TLS.CAFile == "":
+		return " ssl verify none"
+	}
+	return " ssl verify required ca-file " + b.TLS.CAFile
+}
+
+// ProxyArgs returns the arguments of a server sending the PROXY protocol,
+// the health checks send the header too since the server expects it
+func (b backend) ProxyArgs(check *healthCheck) string {
+	var args string
+	switch b.SendProxy {
+	case core.ProxyProtocolV1:
+		args = " send-proxy"
+	case core.ProxyProtocolV2:
+		args = " send-proxy-v2"
+	default:
+		return ""
+	}
+	if check != nil {
+		args += " check-send-proxy"
+	}
+	return args
+}
+
+type backendServer struct {
+	Name    string
+	Address string
+	Weight  int
+	// Node is the node the server is, empty for the endpoints
+	Node string
+}
+
+// model is what the configuration of haproxy is rendered from
+type model struct {
+	Frontends   []frontend
+	Backends    []backend
+	Balance     string
+	Timeouts    timeouts
+	HealthCheck *healthCheck
+	Persistence *persistence
+	// AccessLog is nil if the requests are not logged
+	AccessLog *accessLog
+	// SourceRanges are the CIDRs of the clients allowed, all if empty
+	SourceRanges []string
+	// Limits are the limits of all frontends together, nil if they are
+	// unlimited
+	Limits *limits
+}
+
+// maxConn returns the connections haproxy accepts at most
+func (m *model) maxConn() int {
+	if m.Limits != nil && m.Limits.MaxConnections != 0 {
+		return m.Limits.MaxConnections
+	}
+	return defaultMaxConn
+}
+
+// config renders the haproxy configuration and writes it with the
+// certificates it references
+type config struct {
+	tmpl        *template.Template
+	cfgPath     string
+	certDir     string
+	pidFile     string
+	statsSocket string
+	runner      Runner
+	// current is the last configuration written to cfgPath
+	current []byte
+}
+
+func newConfig(runner Runner) *config {
+	return &config{
+		cfgPath:     haproxyCfg,
+		certDir:     certDir,
+		pidFile:     haproxyPid,
+		statsSocket: haproxySocket,
+		runner:      runner,
+	}
+}
+
+func (c *config) loadTemplate() error {
+	tmpl, err := template.ParseFiles(haproxyTmpl)
+	if err != nil {
+		return err
+	}
+	c.tmpl = tmpl
+	return nil
+}
+
+// render renders the configuration of the model of the LoadBalancer
+func (c *config) render(namespace, name string, m *model) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := c.tmpl.Execute(buf, map[string]interface{}{
+		"namespace":    namespace,
+		"name":         name,
+		"pidFile":      c.pidFile,
+		"statsSocket":  c.statsSocket,
+		"frontends":    m.Frontends,
+		"backends":     m.Backends,
+		"balance":      m.Balance,
+		"timeouts":     m.Timeouts,
+		"healthCheck":  m.HealthCheck,
+		"persistence":  m.Persistence,
+		"accessLog":    m.AccessLog,
+		"sourceRanges": m.SourceRanges,
+		"limits":       m.Limits,
+		"maxConn":      m.maxConn(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// update validates the configuration with haproxy -c and replaces the file
+// atomically, it returns false if the configuration is unchanged. The file
+// is not touched if haproxy rejects the configuration.
+func (c *config) update(data []byte) (bool, error) {
+	old := c.current
+	if old == nil {
+		// the configuration haproxy is started with
+		old, _ = ioutil.ReadFile(c.cfgPath)
+	}
+	if bytes.Equal(data, old) {
+		c.current = data
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.cfgPath), "."+filepath.Base(c.cfgPath))
+	if err != nil {
+		return false, err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if _, verr := c.runner.Run("-c", "-q", "-f", tmp); verr != nil {
+			err = fmt.Errorf("haproxy rejected the configuration: %v", verr)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.cfgPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	c.current = data
+	return true, nil
+}
+
+// writeCertificate writes the certificate followed by the key in a file
+// readable by root only, as haproxy loads them. The file is named after its
+// content so the one referenced by the running configuration is never
+// overwritten.
+func (c *config) writeCertificate(cert *core.TLSCertificate) (string, error) {
+	data := append(append([]byte(nil), cert.Cert...), '\n')
+	data = append(data, cert.Key...)
+	sum := sha256.Sum256(data)
+	path := filepath.Join(c.certDir, hex.EncodeToString(sum[:])[:16]+".pem")
+
+	if err := os.MkdirAll(c.certDir, 0700); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := fsutil.WriteFileAtomic(path, data, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeCA writes the CA certificates verifying the servers to the file
+// named after their content, and returns its path
+func (c *config) writeCA(ca []byte) (string, error) {
+	sum := sha256.Sum256(ca)
+	path := filepath.Join(c.certDir, hex.EncodeToString(sum[:])[:16]+".ca.pem")
+
+	if err := os.MkdirAll(c.certDir, 0700); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := fsutil.WriteFileAtomic(path, ca, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeStaleCertificates removes the certificates the frontends and the
+// CAs the backends do not reference
+func (c *config) removeStaleCertificates(frontends []frontend, backends []backend) {
+	inUse := make(map[string]bool)
+	for _, f := range frontends {
+		if f.Cert != "" {
+			inUse[f.Cert] = true
+		}
+		for _, cert := range f.HostCerts {
+			inUse[cert] = true
+		}
+	}
+	for _, b := range backends {
+		if b.TLS != nil && b.TLS.CAFile != "" {
+			inUse[b.TLS.CAFile] = true
+		}
+	}
+	files, err := ioutil.ReadDir(c.certDir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		path := filepath.Join(c.certDir, f.Name())
+		if inUse[path] {
+			continue
+		}
+		log.Info("removing stale certificate", log.Fields{"file": path})
+		if err := os.Remove(path); err != nil {
+			log.Error("remove stale certificate error", log.Fields{"file": path, "err": err})
+		}
+	}
+}
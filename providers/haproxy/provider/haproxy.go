@@ -0,0 +1,607 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/haproxy/version"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var (
+	_ core.Provider           = &HAProxyProvider{}
+	_ core.HealthzProvider    = &HAProxyProvider{}
+	_ core.PortHealthProvider = &HAProxyProvider{}
+)
+
+// HAProxyProvider proxies the HTTP and TCP ports of the LoadBalancer with
+// haproxy to the endpoints of the Services or to the nodes
+type HAProxyProvider struct {
+	storeLister core.StoreLister
+	config      *config
+	runner      Runner
+	newProcess  func(cfgPath string) (process, error)
+	runtimeAPI  runtimeAPI
+	// pending is true if the written configuration is not reloaded, the
+	// reload is retried on the next update
+	pending bool
+	// applied is the model haproxy runs, and runtime the servers it runs
+	// after the runtime updates
+	applied *model
+	runtime runtimeState
+	// checksum skips the syncs whose rendered configuration haproxy runs
+	checksum *core.Checksum
+
+	// backoff delays the starts of haproxy after it crashes
+	backoff *flowcontrol.Backoff
+	stopCh  chan struct{}
+
+	mu       sync.Mutex
+	proc     process
+	started  bool
+	stopping bool
+	// exitErr is the error of the last unexpected exit of haproxy, it is
+	// cleared once haproxy is started again
+	exitErr error
+	// health is the health of the ports of the model haproxy runs
+	health []core.PortHealth
+	// statsLabels label the stats of the proxies of the model haproxy runs
+	statsLabels *statsLabels
+}
+
+// NewHAProxyProvider creates a new haproxy LoadBalancer Provider.
+func NewHAProxyProvider() (*HAProxyProvider, error) {
+	runner := NewRunner()
+	p := &HAProxyProvider{
+		config:     newConfig(runner),
+		runner:     runner,
+		newProcess: startHAProxy,
+		runtimeAPI: &socketAPI{path: haproxySocket},
+		checksum:   core.NewChecksum("haproxy"),
+		backoff:    flowcontrol.NewBackOff(haproxyInitialBackoff, haproxyMaxBackoff),
+		stopCh:     make(chan struct{}),
+	}
+	if err := p.config.loadTemplate(); err != nil {
+		return nil, err
+	}
+	metrics.MustRegister(newStatsCollector(p, &socketAPI{path: haproxySocket, timeout: statsTimeout}))
+	return p, nil
+}
+
+// OnUpdate renders the frontends of the ports of the LoadBalancer and
+// applies them to haproxy. The changes of the servers of the backends only
+// are applied through the runtime api, the others and the failed runtime
+// updates reload haproxy. A configuration rejected by haproxy fails the sync
+// and the previous one keeps serving. A configuration haproxy runs already
+// is neither written nor applied again unless the LoadBalancer forces a
+// resync.
+func (p *HAProxyProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	log.Info("Updating haproxy config", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name})
+
+	m, err := p.getModel(lb)
+	if err != nil {
+		return err
+	}
+	data, err := p.config.render(lb.Namespace, lb.Name, m)
+	if err != nil {
+		return err
+	}
+	hash := core.Sum(data)
+	if p.checksum.Unchanged(lb, hash) {
+		return nil
+	}
+	forced := p.checksum.Forced(lb)
+	if forced {
+		// the file may be changed by others
+		p.config.current = nil
+	}
+	// the configuration is written even if the runtime api applies the
+	// change, haproxy loads it when it is started again
+	changed, err := p.config.update(data)
+	if err != nil {
+		log.Error("update haproxy config error", log.Fields{"err": err})
+		return err
+	}
+	if !changed && !p.pending && !forced {
+		return nil
+	}
+
+	if p.canApplyRuntime(m) {
+		err := p.applyRuntime(m)
+		if err == nil {
+			p.setApplied(m)
+			p.checksum.Applied(lb, hash)
+			return nil
+		}
+		log.Warn("runtime update of haproxy failed, reloading", log.Fields{"err": err})
+	}
+
+	if err := p.reload(); err != nil {
+		p.pending = true
+		p.checksum.Invalidate()
+		return err
+	}
+	p.pending = false
+	p.runtime = newRuntimeState(m)
+	p.setApplied(m)
+	p.checksum.Applied(lb, hash)
+
+	p.config.removeStaleCertificates(m.Frontends, m.Backends)
+	return nil
+}
+
+// setApplied records the model haproxy runs and the health of its ports
+func (p *HAProxyProvider) setApplied(m *model) {
+	p.applied = m
+	p.mu.Lock()
+	p.health = portHealth(m)
+	p.statsLabels = newStatsLabels(m)
+	p.mu.Unlock()
+}
+
+// PortHealth implements core.PortHealthProvider, a port of the model
+// haproxy runs is healthy if its backend has a server with weight
+func (p *HAProxyProvider) PortHealth() []core.PortHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// portHealth returns the health of the ports of the frontends, a port whose
+// backend has no server with weight rejects the connections
+func portHealth(m *model) []core.PortHealth {
+	ready := make(map[string]bool, len(m.Backends))
+	for _, b := range m.Backends {
+		for _, s := range b.Servers {
+			if s.Weight > 0 {
+				ready[b.Name] = true
+				break
+			}
+		}
+	}
+	ret := make([]core.PortHealth, 0, len(m.Frontends))
+	for _, f := range m.Frontends {
+		h := core.PortHealth{Protocol: "tcp", Port: f.Port, Healthy: ready[f.Backend]}
+		if !h.Healthy {
+			h.Reason = fmt.Sprintf("backend %s has no ready server", f.Backend)
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// canApplyRuntime returns true if the running haproxy differs from the
+// model in the servers of the backends only
+func (p *HAProxyProvider) canApplyRuntime(m *model) bool {
+	return !p.pending && p.applied != nil && p.runtimeAPI != nil && p.running() && structurallyEqual(p.applied, m)
+}
+
+// applyRuntime reconciles the servers of the backends of the running
+// haproxy with the model through the runtime api. The state is left
+// unchanged if a command fails, a reload replaces it anyway.
+func (p *HAProxyProvider) applyRuntime(m *model) error {
+	state := p.runtime.copy()
+	for _, b := range m.Backends {
+		if err := state.reconcile(p.runtimeAPI, b, m.HealthCheck); err != nil {
+			return err
+		}
+	}
+	p.runtime = state
+	return nil
+}
+
+// getModel returns the frontends of the ports of the LoadBalancer and the
+// backends they proxy to, the certificates of the https ports are written
+// to the files the frontends reference
+func (p *HAProxyProvider) getModel(lb *netv1alpha1.LoadBalancer) (*model, error) {
+	if err := p.ValidateLoadBalancer(lb); err != nil {
+		return nil, err
+	}
+	httpPorts, err := core.GetHTTPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	tcpPorts, err := core.GetTCPPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	m := &model{}
+	if m.Balance, err = getBalance(lb); err != nil {
+		return nil, err
+	}
+	if m.Timeouts, err = getTimeouts(lb); err != nil {
+		return nil, err
+	}
+	if m.HealthCheck, err = getHealthCheck(lb); err != nil {
+		return nil, err
+	}
+	if m.Persistence, err = getPersistence(lb); err != nil {
+		return nil, err
+	}
+	if m.AccessLog, err = getAccessLog(lb); err != nil {
+		return nil, err
+	}
+	ranges, err := core.GetSourceRanges(lb)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		m.SourceRanges = append(m.SourceRanges, r.String())
+	}
+	pps, err := core.GetProxyProtocols(lb)
+	if err != nil {
+		return nil, err
+	}
+	proxyProtocols := make(map[int]core.ProxyProtocol, len(pps))
+	for _, pp := range pps {
+		proxyProtocols[pp.Port] = pp
+	}
+	bps, err := core.GetBackendProtocols(lb)
+	if err != nil {
+		return nil, err
+	}
+	sslRedirect, err := core.GetSSLRedirect(lb)
+	if err != nil {
+		return nil, err
+	}
+	backendProtocols := make(map[int]core.PortBackendProtocol, len(bps))
+	for _, bp := range bps {
+		backendProtocols[bp.Port] = bp
+	}
+
+	seen := make(map[string]bool)
+	// addBackend adds the backend of the port with the PROXY protocol it
+	// sends, the backends sending the header are distinct from the ones of
+	// the same servers which do not. It returns the name of the backend.
+	addBackend := func(port int, b backend) string {
+		if pp, ok := proxyProtocols[port]; ok && pp.Send != "" {
+			b.Name += "-proxy-" + string(pp.Send)
+			b.SendProxy = pp.Send
+		}
+		if !seen[b.Name] {
+			seen[b.Name] = true
+			m.Backends = append(m.Backends, b)
+		}
+		return b.Name
+	}
+	// addFrontend adds the frontend and its backend with the PROXY protocol
+	// of the port
+	addFrontend := func(f frontend, b backend) {
+		f.Backend = addBackend(f.Port, b)
+		if pp, ok := proxyProtocols[f.Port]; ok {
+			f.AcceptProxy = pp.Accept
+		}
+		m.Frontends = append(m.Frontends, f)
+	}
+
+	for _, port := range httpPorts {
+		f := frontend{Name: fmt.Sprintf("http-%d", port.Port), Port: port.Port, Mode: "http"}
+		if port.Protocol == core.HTTPProtocolHTTPS {
+			cert, err := core.GetTLSCertificate(lb, p.storeLister.Secret, port.TLSSecret)
+			if err != nil {
+				return nil, err
+			}
+			if f.Cert, err = p.config.writeCertificate(cert); err != nil {
+				return nil, err
+			}
+		}
+		bp := backendProtocols[port.Port]
+		// the connections are passed through without terminating HTTP
+		if bp.Protocol == core.BackendProtocolTCP {
+			f.Mode = "tcp"
+		}
+		if sslRedirect.Redirects(port.Port) {
+			f.Redirect = &redirect{Port: sslRedirect.HTTPSPort, ExemptACME: sslRedirect.ExemptACME}
+			if sslRedirect.HTTPSPort == 443 {
+				f.Redirect.Port = 0
+			}
+		}
+		b, err := p.httpBackend(lb, f.Mode, bp, port.Service, port.ServicePort)
+		if err != nil {
+			return nil, err
+		}
+		certs := map[string]bool{f.Cert: true}
+		for _, h := range port.Hosts {
+			hb, err := p.httpBackend(lb, f.Mode, bp, h.Service, h.ServicePort)
+			if err != nil {
+				return nil, err
+			}
+			f.Hosts = append(f.Hosts, frontendHost{Host: h.Host, Backend: addBackend(f.Port, hb)})
+			if f.Cert == "" {
+				continue
+			}
+			cert, err := core.GetTLSCertificate(lb, p.storeLister.Secret, h.TLSSecret)
+			if err != nil {
+				return nil, err
+			}
+			path, err := p.config.writeCertificate(cert)
+			if err != nil {
+				return nil, err
+			}
+			if !certs[path] {
+				certs[path] = true
+				f.HostCerts = append(f.HostCerts, path)
+			}
+		}
+		addFrontend(f, b)
+	}
+
+	for _, port := range tcpPorts {
+		f := frontend{Name: fmt.Sprintf("tcp-%d", port.Port), Port: port.Port, Mode: "tcp"}
+		var b backend
+		if port.Service != "" {
+			b, err = p.serviceBackend(lb, "tcp", port.Service, port.ServicePort)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			b = p.nodesBackend(lb, port.NodePort)
+		}
+		addFrontend(f, b)
+	}
+
+	rateLimit, err := core.GetRateLimit(lb)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRateLimits(m, rateLimit); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidateLoadBalancer implements core.ValidatingProvider, it returns a
+// PermanentError if the annotations of haproxy are invalid or the ports
+// they refer to are not served as they require. The Services and the
+// Secrets are checked by the sync.
+func (p *HAProxyProvider) ValidateLoadBalancer(lb *netv1alpha1.LoadBalancer) error {
+	httpPorts, err := core.GetHTTPPorts(lb)
+	if err != nil {
+		return err
+	}
+	tcpPorts, err := core.GetTCPPorts(lb)
+	if err != nil {
+		return err
+	}
+	if _, err := getBalance(lb); err != nil {
+		return err
+	}
+	if _, err := getTimeouts(lb); err != nil {
+		return err
+	}
+	if _, err := getHealthCheck(lb); err != nil {
+		return err
+	}
+	if _, err := getPersistence(lb); err != nil {
+		return err
+	}
+	if _, err := getAccessLog(lb); err != nil {
+		return err
+	}
+	bps, err := core.GetBackendProtocols(lb)
+	if err != nil {
+		return err
+	}
+	backendProtocols := make(map[int]core.PortBackendProtocol, len(bps))
+	for _, bp := range bps {
+		backendProtocols[bp.Port] = bp
+	}
+	sslRedirect, err := core.GetSSLRedirect(lb)
+	if err != nil {
+		return err
+	}
+
+	// the frontends are modeled by their ports and modes only
+	m := &model{}
+	for _, port := range httpPorts {
+		f := frontend{Port: port.Port, Mode: "http"}
+		// the connections are passed through without terminating HTTP
+		if backendProtocols[port.Port].Protocol == core.BackendProtocolTCP {
+			f.Mode = "tcp"
+			if len(port.Hosts) > 0 {
+				return core.NewPermanentError("UnsupportedHTTPHosts", fmt.Errorf("the hosts of port %d can not be routed, it passes the connections through as TCP", port.Port))
+			}
+			if sslRedirect.Redirects(port.Port) {
+				return core.NewPermanentError("ConflictingSSLRedirect", fmt.Errorf("the requests of port %d can not be redirected to https, it passes the connections through as TCP", port.Port))
+			}
+		}
+		m.Frontends = append(m.Frontends, f)
+	}
+	for _, port := range tcpPorts {
+		m.Frontends = append(m.Frontends, frontend{Port: port.Port, Mode: "tcp"})
+	}
+
+	pps, err := core.GetProxyProtocols(lb)
+	if err != nil {
+		return err
+	}
+	for _, pp := range pps {
+		served := false
+		for _, f := range m.Frontends {
+			served = served || f.Port == pp.Port
+		}
+		if !served {
+			return core.NewPermanentError("InvalidProxyProtocol", fmt.Errorf("proxy protocol of port %d which is not served", pp.Port))
+		}
+	}
+
+	rateLimit, err := core.GetRateLimit(lb)
+	if err != nil {
+		return err
+	}
+	return setRateLimits(m, rateLimit)
+}
+
+// setRateLimits sets the limits of all frontends together and the ones of
+// each frontend. It returns a PermanentError if a port is not served, or
+// limits the requests of a port which does not terminate HTTP.
+func setRateLimits(m *model, rl *core.RateLimit) error {
+	if rl == nil {
+		return nil
+	}
+	m.Limits = getLimits(rl.Limits)
+	for _, pl := range rl.Ports {
+		found := false
+		for i := range m.Frontends {
+			f := &m.Frontends[i]
+			if pl.Protocol != "tcp" || f.Port != pl.Port {
+				continue
+			}
+			if pl.RequestRate != 0 && f.Mode != "http" {
+				return core.NewPermanentError("InvalidRateLimit", fmt.Errorf("request rate of port %d which does not terminate http", pl.Port))
+			}
+			f.Limits, found = getLimits(pl.Limits), true
+		}
+		if !found {
+			return core.NewPermanentError("InvalidRateLimit", fmt.Errorf("rate limit of port %v which is not served", pl.CorePort()))
+		}
+	}
+	return nil
+}
+
+// getLimits returns the limits, nil if none
+func getLimits(l core.Limits) *limits {
+	if l.IsZero() {
+		return nil
+	}
+	return &limits{MaxConnections: l.MaxConnections, ConnectionRate: l.ConnectionRate, RequestRate: l.RequestRate}
+}
+
+// backendTLS returns how the connections are re-encrypted to the servers of
+// the port, the CA verifying them is written to the file it references
+func (p *HAProxyProvider) backendTLS(lb *netv1alpha1.LoadBalancer, bp core.PortBackendProtocol) (*backendTLS, error) {
+	if bp.CASecret == "" {
+		return &backendTLS{}, nil
+	}
+	ca, err := core.GetBackendCA(lb, p.storeLister.Secret, bp.CASecret)
+	if err != nil {
+		return nil, err
+	}
+	path, err := p.config.writeCA(ca)
+	if err != nil {
+		return nil, err
+	}
+	return &backendTLS{CAFile: path}, nil
+}
+
+// httpBackend returns the backend of the port of the Service a HTTP port
+// proxies to, the connections are re-encrypted by its backend protocol
+func (p *HAProxyProvider) httpBackend(lb *netv1alpha1.LoadBalancer, mode string, bp core.PortBackendProtocol, service string, port int) (backend, error) {
+	b, err := p.serviceBackend(lb, mode, service, port)
+	if err != nil {
+		return backend{}, err
+	}
+	if bp.Protocol == core.BackendProtocolHTTPS {
+		if b.TLS, err = p.backendTLS(lb, bp); err != nil {
+			return backend{}, err
+		}
+		// the backends re-encrypting the connections are distinct from
+		// the plain ones of the same servers
+		b.Name += "-tls"
+		if bp.CASecret != "" {
+			b.Name += "-" + bp.CASecret
+		}
+	}
+	return b, nil
+}
+
+// serviceBackend returns the backend of the ready endpoints of the port of
+// the Service
+func (p *HAProxyProvider) serviceBackend(lb *netv1alpha1.LoadBalancer, mode, service string, port int) (backend, error) {
+	eps, err := p.storeLister.ServiceEndpoints(lb.Namespace, service, port)
+	if err != nil {
+		return backend{}, err
+	}
+	b := backend{Name: fmt.Sprintf("%s-%s-%s-%d", mode, lb.Namespace, service, port), Mode: mode}
+	for _, ep := range eps {
+		b.Servers = append(b.Servers, backendServer{Name: fmt.Sprintf("%s-%d", ep.IP, ep.Port), Address: ep.String(), Weight: 1})
+	}
+	return b, nil
+}
+
+// nodesBackend returns the backend of the port of the nodes of the
+// LoadBalancer weighted by their conditions
+func (p *HAProxyProvider) nodesBackend(lb *netv1alpha1.LoadBalancer, port int) backend {
+	b := backend{Name: fmt.Sprintf("tcp-nodes-%d", port), Mode: "tcp"}
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, corenet.FamilyIPv4) {
+		weight := rs.Weight
+		if weight > maxServerWeight {
+			weight = maxServerWeight
+		}
+		b.Servers = append(b.Servers, backendServer{
+			Name:    rs.Node,
+			Address: core.Endpoint{IP: rs.IP, Port: port}.String(),
+			Weight:  weight,
+			Node:    rs.Node,
+		})
+	}
+	return b
+}
+
+// Start starts haproxy with the configuration in the image, the first
+// update reloads it with the frontends of the LoadBalancer
+func (p *HAProxyProvider) Start() {
+	log.Info("Startting haproxy provider")
+	go p.run()
+}
+
+// WaitForStart waits for haproxy fully run
+func (p *HAProxyProvider) WaitForStart() bool {
+	err := wait.Poll(time.Second, 60*time.Second, func() (bool, error) {
+		return p.running(), nil
+	})
+
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// Stop stops haproxy softly
+func (p *HAProxyProvider) Stop() error {
+	log.Info("Shutting down haproxy provider")
+	p.stopProcess()
+	return nil
+}
+
+// Info ...
+func (p *HAProxyProvider) Info() core.Info {
+	return core.Info{
+		Name:       "haproxy",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+		Capabilities: &core.Capabilities{
+			Features: []core.Feature{core.FeatureHTTP, core.FeatureTCPProxy, core.FeatureProxyProtocol, core.FeaturePersistence, core.FeatureAccessLog, core.FeatureSourceRanges, core.FeatureBackendProtocol, core.FeatureMaxConnections, core.FeatureConnectionRate, core.FeatureRequestRate, core.FeatureHTTPHosts, core.FeatureSSLRedirect},
+		},
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *HAProxyProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
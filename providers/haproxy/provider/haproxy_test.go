@@ -0,0 +1,778 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/testutil"
+	"github.com/caicloud/loadbalancer-provider/core/provider/validate"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var update = testutil.Update
+
+// fakeRunner records the haproxy commands, the check of a configuration
+// containing reject fails
+type fakeRunner struct {
+	reject string
+	calls  []string
+}
+
+func (f *fakeRunner) Run(args ...string) ([]byte, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	if args[0] == "-c" && f.reject != "" {
+		data, _ := ioutil.ReadFile(args[len(args)-1])
+		if strings.Contains(string(data), f.reject) {
+			return nil, fmt.Errorf("[ALERT] parsing: unknown keyword")
+		}
+	}
+	return nil, nil
+}
+
+// fakeProcess is a haproxy master which exits on SIGUSR1
+type fakeProcess struct {
+	mu      sync.Mutex
+	signals []os.Signal
+	exit    chan struct{}
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signals = append(p.signals, sig)
+	if sig == syscall.SIGUSR1 {
+		close(p.exit)
+	}
+	return nil
+}
+
+func (p *fakeProcess) Signals() []os.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]os.Signal(nil), p.signals...)
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exit
+	return nil
+}
+
+type testStore struct {
+	nodes     cache.Indexer
+	secrets   cache.Indexer
+	services  cache.Indexer
+	endpoints cache.Indexer
+}
+
+func newTestStore() *testStore {
+	newIndexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+	return &testStore{nodes: newIndexer(), secrets: newIndexer(), services: newIndexer(), endpoints: newIndexer()}
+}
+
+func (s *testStore) lister() core.StoreLister {
+	return core.StoreLister{
+		Node:      v1listers.NewNodeLister(s.nodes),
+		Secret:    v1listers.NewSecretLister(s.secrets),
+		Service:   v1listers.NewServiceLister(s.services),
+		Endpoints: v1listers.NewEndpointsLister(s.endpoints),
+	}
+}
+
+func (s *testStore) addNode(name, ip string, annotations map[string]string) {
+	s.nodes.Add(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	})
+}
+
+// addService adds a Service with the port 80 served by the addresses on
+// port 8080
+func (s *testStore) addService(name string, ips ...string) {
+	meta := metav1.ObjectMeta{Namespace: "default", Name: name}
+	s.services.Add(&v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}})
+	addrs := make([]v1.EndpointAddress, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, v1.EndpointAddress{IP: ip})
+	}
+	s.endpoints.Add(&v1.Endpoints{ObjectMeta: meta, Subsets: []v1.EndpointSubset{
+		{Addresses: addrs, Ports: []v1.EndpointPort{{Port: 8080}}},
+	}})
+}
+
+// addCASecret adds a Secret with the test certificate as the CA of the
+// backends
+func (s *testStore) addCASecret(t *testing.T, name string) {
+	ca, err := ioutil.ReadFile("testdata/tls.crt")
+	assert.Nil(t, err)
+	s.secrets.Add(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{core.BackendCAKey: ca},
+	})
+}
+
+func (s *testStore) addTLSSecret(t *testing.T, name string) {
+	s.addTLSSecretOf(t, name, "tls")
+}
+
+// addTLSSecretOf adds a Secret with the certificate and the key in the
+// testdata files of the base name
+func (s *testStore) addTLSSecretOf(t *testing.T, name, base string) {
+	cert, err := ioutil.ReadFile("testdata/" + base + ".crt")
+	assert.Nil(t, err)
+	key, err := ioutil.ReadFile("testdata/" + base + ".key")
+	assert.Nil(t, err)
+	s.secrets.Add(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	})
+}
+
+func newTestProvider(t *testing.T, dir string, runner Runner) *HAProxyProvider {
+	tmpl, err := template.ParseFiles("../haproxy.tmpl")
+	assert.Nil(t, err)
+	c := newConfig(runner)
+	c.tmpl = tmpl
+	c.cfgPath = filepath.Join(dir, "haproxy.cfg")
+	c.certDir = filepath.Join(dir, "certs")
+	return &HAProxyProvider{
+		config: c,
+		runner: runner,
+		newProcess: func(string) (process, error) {
+			return &fakeProcess{exit: make(chan struct{})}, nil
+		},
+		checksum: core.NewChecksum("haproxy"),
+		backoff:  flowcontrol.NewBackOff(haproxyInitialBackoff, haproxyMaxBackoff),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func newTestLoadBalancer(annotations map[string]string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: annotations},
+	}
+	lb.Spec.Nodes.Names = []string{"node1", "node2"}
+	return lb
+}
+
+func TestRenderConfig(t *testing.T) {
+	type testCase struct {
+		name        string
+		annotations map[string]string
+	}
+	cases := []testCase{
+		{
+			name:        "http",
+			annotations: map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`},
+		},
+		{
+			name:        "https",
+			annotations: map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`},
+		},
+		{
+			name:        "tcp",
+			annotations: map[string]string{core.AnnotationKeyTCPPorts: `[{"port":6443},{"port":3306,"service":"db","servicePort":80}]`},
+		},
+		{
+			name: "multi-port",
+			annotations: map[string]string{
+				core.AnnotationKeyHTTPPorts: `[
+					{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+					{"port":80,"service":"web","servicePort":80},
+					{"port":8080,"service":"idle","servicePort":80}
+				]`,
+				core.AnnotationKeyTCPPorts: `[{"port":8443,"nodePort":443},{"port":3306,"service":"web","servicePort":80}]`,
+			},
+		},
+		{
+			name: "tuned",
+			annotations: map[string]string{
+				core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+				AnnotationKeyBalance:        "leastconn",
+				AnnotationKeyTimeouts:       `{"connect":"1s","server":"5m"}`,
+				AnnotationKeyHealthCheck:    `{"protocol":"http","path":"/healthz","port":8081,"interval":"500ms","fall":5}`,
+			},
+		},
+		{
+			name: "persistence",
+			annotations: map[string]string{
+				core.AnnotationKeyHTTPPorts:   `[{"port":80,"service":"web","servicePort":80}]`,
+				core.AnnotationKeyTCPPorts:    `[{"port":3306,"service":"db","servicePort":80}]`,
+				core.AnnotationKeyPersistence: `{"enabled":true,"timeout":600,"netmask":"255.255.255.0"}`,
+			},
+		},
+		{
+			name: "proxy-protocol",
+			annotations: map[string]string{
+				core.AnnotationKeyHTTPPorts:     `[{"port":80,"service":"web","servicePort":80},{"port":8080,"service":"web","servicePort":80}]`,
+				core.AnnotationKeyTCPPorts:      `[{"port":6443},{"port":3306,"service":"db","servicePort":80}]`,
+				core.AnnotationKeyProxyProtocol: `[{"port":80,"accept":true,"send":"v1"},{"port":3306,"send":"v2"},{"port":6443,"accept":true}]`,
+				AnnotationKeyHealthCheck:        `{"protocol":"tcp"}`,
+			},
+		},
+	}
+	cases = append(cases, testCase{
+		name: "backend-protocol",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts: `[
+				{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+				{"port":80,"service":"web","servicePort":80},
+				{"port":8080,"service":"web","servicePort":80},
+				{"port":8443,"service":"web","servicePort":80}
+			]`,
+			core.AnnotationKeyTCPPorts:                       `[{"port":6443}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "443":  "HTTPS",
+			core.AnnotationKeyBackendCASecretPrefix + "443":  "backend-ca",
+			core.AnnotationKeyBackendProtocolPrefix + "80":   "HTTP",
+			core.AnnotationKeyBackendProtocolPrefix + "8080": "HTTPS",
+			core.AnnotationKeyBackendProtocolPrefix + "8443": "TCP",
+			core.AnnotationKeyBackendProtocolPrefix + "6443": "TCP",
+		},
+	}, testCase{
+		name: "source-ranges",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts:     `[{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeyTCPPorts:      `[{"port":3306,"service":"db","servicePort":80}]`,
+			core.AnnotationKeyProxyProtocol: `[{"port":3306,"accept":true}]`,
+			core.AnnotationKeySourceRanges:  "10.1.0.0/16, 192.168.1.1/32, 2001:db8::/32",
+		},
+	}, testCase{
+		name: "hosts",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts: `[
+				{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[
+					{"host":"www.example.com","service":"web","servicePort":80},
+					{"host":"api.example.com","tlsSecret":"api-cert","service":"db","servicePort":80}
+				]},
+				{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"db","servicePort":80}]},
+				{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[{"host":"api.example.com","tlsSecret":"api-cert","service":"db","servicePort":80}]}
+			]`,
+			core.AnnotationKeyProxyProtocol:                  `[{"port":80,"send":"v2"}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "8443": "HTTPS",
+		},
+	}, testCase{
+		name: "ssl-redirect",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts:   `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeySSLRedirect: "true",
+		},
+	}, testCase{
+		name: "ssl-redirect-disabled",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts:   `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeySSLRedirect: "false",
+		},
+	}, testCase{
+		name: "ssl-redirect-acme",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts: `[
+				{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+				{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"db","servicePort":80}]},
+				{"port":8080,"service":"db","servicePort":80}
+			]`,
+			core.AnnotationKeySSLRedirect:           "80",
+			core.AnnotationKeySSLRedirectExemptACME: "true",
+		},
+	}, testCase{
+		name: "rate-limit",
+		annotations: map[string]string{
+			core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80},{"port":8080,"service":"web","servicePort":80}]`,
+			core.AnnotationKeyTCPPorts:  `[{"port":3306,"service":"db","servicePort":80}]`,
+			core.AnnotationKeyRateLimit: `{
+				"maxConnections":10000,
+				"connectionRate":500,
+				"requestRate":1000,
+				"ports":[{"port":80,"requestRate":100},{"port":3306,"maxConnections":100,"connectionRate":10}]
+			}`,
+		},
+	})
+	for _, format := range []string{"combined", "json"} {
+		for _, syslog := range []string{"", "10.0.0.10"} {
+			for _, sampling := range []int{0, 3} {
+				c := testCase{
+					name: "access-log-" + format,
+					annotations: map[string]string{
+						core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+						core.AnnotationKeyTCPPorts:  `[{"port":3306,"service":"db","servicePort":80}]`,
+						core.AnnotationKeyAccessLog: fmt.Sprintf(`{"enabled":true,"format":%q,"syslog":%q,"sampling":%d}`, format, syslog, sampling),
+					},
+				}
+				if syslog != "" {
+					c.name += "-syslog"
+				}
+				if sampling != 0 {
+					c.name += "-sampled"
+				}
+				cases = append(cases, c)
+			}
+		}
+	}
+
+	store := newTestStore()
+	store.addNode("node1", "192.168.1.1", nil)
+	store.addNode("node2", "192.168.1.2", map[string]string{core.AnnotationKeyWeight: "1000"})
+	store.addService("web", "10.0.1.3", "10.0.1.2")
+	store.addService("db", "10.0.2.2")
+	store.addService("idle")
+	store.addTLSSecret(t, "cert")
+	store.addTLSSecretOf(t, "api-cert", "api")
+	store.addCASecret(t, "backend-ca")
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "haproxy")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		p := newTestProvider(t, dir, &fakeRunner{})
+		p.SetListers(store.lister())
+		assert.Nil(t, p.OnUpdate(newTestLoadBalancer(c.annotations)), c.name)
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err, c.name)
+		got := strings.Replace(string(data), dir, "/etc/haproxy", -1)
+
+		golden := filepath.Join("testdata", c.name+".golden")
+		if *update {
+			assert.Nil(t, ioutil.WriteFile(golden, []byte(got), 0644), c.name)
+		}
+		want, err := ioutil.ReadFile(golden)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, string(want), got, c.name)
+	}
+
+	// the proxy protocol of a port which is not served
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	p := newTestProvider(t, dir, &fakeRunner{})
+	p.SetListers(store.lister())
+	err = p.OnUpdate(newTestLoadBalancer(map[string]string{
+		core.AnnotationKeyHTTPPorts:     `[{"port":80,"service":"web","servicePort":80}]`,
+		core.AnnotationKeyProxyProtocol: `[{"port":443,"accept":true}]`,
+	}))
+	assert.True(t, core.IsPermanentError(err))
+
+	// the backend protocols conflicting with the ports, and a missing CA
+	for key, value := range map[string]string{
+		core.AnnotationKeyBackendProtocolPrefix + "443":  "TCP",
+		core.AnnotationKeyBackendProtocolPrefix + "6443": "HTTP",
+		core.AnnotationKeyBackendProtocolPrefix + "8080": "HTTP",
+		core.AnnotationKeyBackendCASecretPrefix + "80":   "backend-ca",
+		core.AnnotationKeyBackendCASecretPrefix + "443":  "missing",
+	} {
+		lb := newTestLoadBalancer(map[string]string{
+			core.AnnotationKeyHTTPPorts:                     `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeyTCPPorts:                      `[{"port":6443}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "443": "HTTPS",
+		})
+		lb.Annotations[key] = value
+		assert.True(t, core.IsPermanentError(p.OnUpdate(lb)), key)
+	}
+
+	// the limits of a port which is not served, and the requests of a
+	// port passing the connections through
+	for _, value := range []string{`{"ports":[{"port":443,"maxConnections":10}]}`, `{"ports":[{"port":3306,"requestRate":10}]}`} {
+		err = p.OnUpdate(newTestLoadBalancer(map[string]string{
+			core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeyTCPPorts:  `[{"port":3306,"service":"db","servicePort":80}]`,
+			core.AnnotationKeyRateLimit: value,
+		}))
+		assert.True(t, core.IsPermanentError(err), value)
+	}
+
+	// the hosts or the ssl redirect of a port passing the connections
+	// through, the Service of a host which is missing, and the ssl redirect
+	// without a https port
+	for reason, annotations := range map[string]map[string]string{
+		"UnsupportedHTTPHosts": {
+			core.AnnotationKeyHTTPPorts:                    `[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"db","servicePort":80}]}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "80": "TCP",
+		},
+		"ServiceNotFound": {
+			core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]}]`,
+		},
+		"ConflictingSSLRedirect": {
+			core.AnnotationKeyHTTPPorts:                    `[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "80": "TCP",
+			core.AnnotationKeySSLRedirect:                  "true",
+		},
+		"InvalidSSLRedirect": {
+			core.AnnotationKeyHTTPPorts:   `[{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeySSLRedirect: "true",
+		},
+	} {
+		err = p.OnUpdate(newTestLoadBalancer(annotations))
+		assert.True(t, core.IsPermanentError(err), reason)
+		assert.Equal(t, reason, err.(*core.PermanentError).Reason)
+	}
+}
+
+// TestValidateLoadBalancer validates the LoadBalancers without the
+// listers, as the validate command does
+func TestValidateLoadBalancer(t *testing.T) {
+	p := &HAProxyProvider{}
+	assert.Nil(t, p.ValidateLoadBalancer(newTestLoadBalancer(map[string]string{
+		core.AnnotationKeyHTTPPorts:     `[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]}]`,
+		core.AnnotationKeyTCPPorts:      `[{"port":3306,"service":"db","servicePort":80}]`,
+		core.AnnotationKeyProxyProtocol: `[{"port":3306,"accept":true}]`,
+		core.AnnotationKeyRateLimit:     `{"ports":[{"port":80,"requestRate":10}]}`,
+	})))
+
+	for reason, annotations := range map[string]map[string]string{
+		"UnsupportedHTTPHosts": {
+			core.AnnotationKeyHTTPPorts:                    `[{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"db","servicePort":80}]}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "80": "TCP",
+		},
+		"ConflictingSSLRedirect": {
+			core.AnnotationKeyHTTPPorts:                    `[{"port":80,"service":"web","servicePort":80},{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`,
+			core.AnnotationKeyBackendProtocolPrefix + "80": "TCP",
+			core.AnnotationKeySSLRedirect:                  "true",
+		},
+		"InvalidProxyProtocol": {
+			core.AnnotationKeyHTTPPorts:     `[{"port":80,"service":"web","servicePort":80}]`,
+			core.AnnotationKeyProxyProtocol: `[{"port":443,"accept":true}]`,
+		},
+		"InvalidRateLimit": {
+			core.AnnotationKeyTCPPorts:  `[{"port":3306,"service":"db","servicePort":80}]`,
+			core.AnnotationKeyRateLimit: `{"ports":[{"port":3306,"requestRate":10}]}`,
+		},
+	} {
+		err := p.ValidateLoadBalancer(newTestLoadBalancer(annotations))
+		if assert.True(t, core.IsPermanentError(err), reason) {
+			assert.Equal(t, reason, err.(*core.PermanentError).Reason)
+		}
+	}
+
+	// the manifest is validated by the backend after the in-tree checks
+	manifest := `
+kind: LoadBalancer
+metadata:
+  name: lb
+  annotations:
+    loadbalancer.caicloud.io/http-ports: '[{"port":80,"service":"web","servicePort":80}]'
+    loadbalancer.caicloud.io/proxy-protocol: '[{"port":443,"accept":true}]'
+spec:
+  type: external
+  providers:
+    ipvsdr:
+      vip: 10.0.0.100
+      scheduler: rr
+`
+	out := &bytes.Buffer{}
+	assert.Equal(t, 1, validate.Run(strings.NewReader(manifest), p, out))
+	assert.Equal(t, "default/lb: backend: proxy protocol of port 443 which is not served\nLoadBalancer default/lb is invalid for haproxy: 1 errors\n", out.String())
+
+	out.Reset()
+	manifest = strings.Replace(manifest, `"port":443`, `"port":80`, 1)
+	assert.Equal(t, 0, validate.Run(strings.NewReader(manifest), p, out))
+	assert.Contains(t, out.String(), "LoadBalancer default/lb is valid for haproxy\n")
+	assert.Contains(t, out.String(), "  http port 80: service web:80\n")
+}
+
+// TestRenderConfigCases renders the LoadBalancers of the cases on their
+// nodes, the Services and the Secrets are the ones of TestRenderConfig
+func TestRenderConfigCases(t *testing.T) {
+	render := func(lb *netv1alpha1.LoadBalancer, nodes []*v1.Node) (string, error) {
+		dir, err := ioutil.TempDir("", "haproxy")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(dir)
+
+		store := newTestStore()
+		for _, node := range nodes {
+			store.nodes.Add(node)
+		}
+		store.addService("web", "10.0.1.3", "10.0.1.2")
+		store.addService("db", "10.0.2.2")
+		store.addTLSSecret(t, "cert")
+
+		p := newTestProvider(t, dir, &fakeRunner{})
+		p.SetListers(store.lister())
+		if err := p.OnUpdate(lb); err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		if err != nil {
+			return "", err
+		}
+		return strings.Replace(string(data), dir, "/etc/haproxy", -1), nil
+	}
+	testutil.GoldenConfigTest(t, render, "testdata/cases")
+}
+
+func TestOnUpdateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	store.addService("api", "10.0.2.2")
+	runner := &fakeRunner{reject: "api"}
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, runner)
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.SetListers(store.lister())
+
+	// haproxy reads the configuration on start
+	lb := newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`})
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 1)
+	assert.True(t, strings.HasPrefix(runner.calls[0], "-c -q -f "+dir))
+	old, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	assert.Nil(t, p.Healthz())
+
+	// unchanged
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 1)
+	assert.Empty(t, proc.Signals())
+
+	// the endpoints changed, the configuration is checked before the reload
+	store.addService("web", "10.0.1.2", "10.0.1.3")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2}, proc.Signals())
+
+	// a rejected configuration fails the sync, the previous one is untouched
+	old, err = ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+	err = p.OnUpdate(newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"api","servicePort":80}]`}))
+	assert.NotNil(t, err)
+	assert.False(t, core.IsPermanentError(err))
+	data, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(old), string(data))
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2}, proc.Signals())
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), "."), "the temporary file is removed")
+	}
+
+	assert.Nil(t, p.Stop())
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2, syscall.SIGUSR1}, proc.Signals())
+	assert.NotNil(t, p.Healthz())
+}
+
+func TestOnUpdateChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	runner := &fakeRunner{}
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, runner)
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.SetListers(store.lister())
+
+	lb := newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`})
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	assert.Len(t, runner.calls, 1)
+
+	// the configuration haproxy runs is neither checked, written nor
+	// reloaded again
+	assert.Nil(t, os.Remove(p.config.cfgPath))
+	lb.Spec.Nodes.Names = []string{"node1"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 1)
+	assert.Empty(t, proc.Signals())
+	_, err = os.Stat(p.config.cfgPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// a forced resync writes and reloads the configuration once
+	lb.Annotations[core.AnnotationKeyForceResync] = "1"
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2}, proc.Signals())
+	_, err = os.Stat(p.config.cfgPath)
+	assert.Nil(t, err)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+
+	assert.Nil(t, p.Stop())
+}
+
+func TestOnUpdatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, &fakeRunner{})
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.SetListers(store.lister())
+
+	lb := newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`})
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	// the stick tables are changed by a seamless reload
+	for i, c := range []struct {
+		name        string
+		persistence string
+		want        []string
+	}{
+		{"on", `{"enabled":true}`, []string{"stick-table type ipv6 size 1m expire 360s", "stick on src\n"}},
+		{"timeout changed", `{"enabled":true,"timeout":600,"netmask":"255.255.255.0"}`, []string{"stick-table type ipv6 size 1m expire 600s", "stick on src,ipmask(24,128)\n"}},
+		{"off", `{"enabled":false}`, nil},
+	} {
+		lb.Annotations[core.AnnotationKeyPersistence] = c.persistence
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Len(t, proc.Signals(), i+1, c.name)
+
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		for _, want := range c.want {
+			assert.Contains(t, string(data), want, c.name)
+		}
+		if c.want == nil {
+			assert.NotContains(t, string(data), "stick", c.name)
+		}
+	}
+
+	lb.Annotations[core.AnnotationKeyPersistence] = `{"enabled":true,"timeout":-1}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+func TestOnUpdateAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, &fakeRunner{})
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.SetListers(store.lister())
+
+	lb := newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`})
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	// the access log is changed by a reload
+	for i, c := range []struct {
+		name      string
+		accessLog string
+		want      string
+	}{
+		{"on", `{"enabled":true}`, "log stdout format raw local0"},
+		{"syslog", `{"enabled":true,"syslog":"syslog.example.com","sampling":100}`, "log syslog.example.com:514 sample 1:100 local0"},
+		{"off", `{"enabled":false}`, ""},
+	} {
+		lb.Annotations[core.AnnotationKeyAccessLog] = c.accessLog
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Len(t, proc.Signals(), i+1, c.name)
+
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		if c.want == "" {
+			assert.NotContains(t, string(data), "log", c.name)
+		} else {
+			assert.Contains(t, string(data), c.want, c.name)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"enabled":true,"syslog":"tcp://10.0.0.10:514"}`,
+		`{"enabled":true,"syslog":"10.0.0.10:70000"}`,
+		`{"enabled":true,"format":"clf"}`,
+	} {
+		lb.Annotations[core.AnnotationKeyAccessLog] = invalid
+		assert.True(t, core.IsPermanentError(p.OnUpdate(lb)), invalid)
+	}
+}
+
+func TestOnUpdateSourceRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, &fakeRunner{})
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.SetListers(store.lister())
+
+	lb := newTestLoadBalancer(map[string]string{core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`})
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	// the source ranges are changed by a reload
+	for i, c := range []struct {
+		name   string
+		ranges string
+		want   string
+	}{
+		{"added", "10.1.0.0/16,192.168.1.1/32", "acl source_ranges src 10.1.0.0/16 192.168.1.1/32"},
+		{"shrunk", "10.1.0.0/16", "acl source_ranges src 10.1.0.0/16\n"},
+		{"removed", "", ""},
+	} {
+		lb.Annotations[core.AnnotationKeySourceRanges] = c.ranges
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Len(t, proc.Signals(), i+1, c.name)
+
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		if c.want == "" {
+			assert.NotContains(t, string(data), "source_ranges", c.name)
+		} else {
+			assert.Contains(t, string(data), c.want, c.name)
+		}
+	}
+
+	lb.Annotations[core.AnnotationKeySourceRanges] = "10.1.0.0/33"
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/zoumo/logdog"
+
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	haproxyBackoffID      = "haproxy"
+	haproxyInitialBackoff = time.Second
+	haproxyMaxBackoff     = time.Minute
+)
+
+// Runner runs the haproxy(1) commands, e.g. checking a configuration
+type Runner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+type execRunner struct {
+	exec k8sexec.Interface
+}
+
+// NewRunner returns a Runner executing haproxy(1)
+func NewRunner() Runner {
+	return &execRunner{exec: k8sexec.New()}
+}
+
+func (r *execRunner) Run(args ...string) ([]byte, error) {
+	out, err := r.exec.Command("haproxy", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("haproxy %s error: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+// process is the running haproxy master, it is reloaded and stopped by
+// signals
+type process interface {
+	Signal(os.Signal) error
+	// Wait waits for the process to exit
+	Wait() error
+}
+
+// cmdProcess is a process started by exec
+type cmdProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *cmdProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *cmdProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+// startHAProxy starts haproxy in master-worker mode in foreground
+func startHAProxy(cfgPath string) (process, error) {
+	cmd := exec.Command("haproxy", "-W", "-db", "-f", cfgPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdProcess{cmd: cmd}, nil
+}
+
+// run supervises haproxy until it is stopped, it is started again after an
+// exponential backoff if it exits. It reads the last written configuration
+// on start.
+func (p *HAProxyProvider) run() {
+	for {
+		proc, err := p.newProcess(p.config.cfgPath)
+		if err == nil {
+			p.mu.Lock()
+			p.proc, p.started, p.exitErr = proc, true, nil
+			stopping := p.stopping
+			p.mu.Unlock()
+			if stopping {
+				proc.Signal(syscall.SIGUSR1)
+			}
+			err = proc.Wait()
+		}
+
+		p.mu.Lock()
+		stopping := p.stopping
+		p.proc = nil
+		if !stopping {
+			if err == nil {
+				err = fmt.Errorf("haproxy exited")
+			}
+			p.exitErr = err
+		}
+		p.mu.Unlock()
+
+		if stopping {
+			log.Info("haproxy stopped")
+			return
+		}
+
+		p.backoff.Next(haproxyBackoffID, p.backoff.Clock.Now())
+		delay := p.backoff.Get(haproxyBackoffID)
+		log.Error("haproxy exited unexpectedly, starting it again", log.Fields{"err": err, "backoff": delay})
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Healthz implements core.HealthzProvider, it returns an error if haproxy
+// is not running
+func (p *HAProxyProvider) Healthz() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.stopping:
+		return fmt.Errorf("haproxy is stopped")
+	case p.exitErr != nil:
+		return fmt.Errorf("haproxy is not running: %v", p.exitErr)
+	case !p.started:
+		return fmt.Errorf("haproxy is not started")
+	}
+	return nil
+}
+
+// running returns true if the haproxy process is started
+func (p *HAProxyProvider) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proc != nil
+}
+
+// reload sends SIGUSR2 to the master, which starts new workers with the
+// configuration. They take over the listeners of the old workers through
+// the stats socket (-x), and the old ones finish their connections before
+// they exit (-sf). haproxy reads the configuration on start, so it is not
+// reloaded before it is started.
+func (p *HAProxyProvider) reload() error {
+	p.mu.Lock()
+	proc := p.proc
+	p.mu.Unlock()
+	if proc == nil {
+		log.Info("haproxy is not started, skip reloading")
+		return nil
+	}
+	log.Info("reloading haproxy")
+	if err := proc.Signal(syscall.SIGUSR2); err != nil {
+		return fmt.Errorf("error reloading haproxy: %v", err)
+	}
+	return nil
+}
+
+// stopProcess stops haproxy softly, the workers finish their connections,
+// and stops its supervision
+func (p *HAProxyProvider) stopProcess() {
+	p.mu.Lock()
+	proc := p.proc
+	if !p.stopping {
+		p.stopping = true
+		close(p.stopCh)
+	}
+	p.mu.Unlock()
+	if proc == nil {
+		return
+	}
+	log.Info("stop haproxy process")
+	if err := proc.Signal(syscall.SIGUSR1); err != nil {
+		log.Errorf("error stopping haproxy: %v", err)
+	}
+}
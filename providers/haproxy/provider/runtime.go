@@ -0,0 +1,256 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runtimeTimeout bounds a command of the runtime api
+const runtimeTimeout = 5 * time.Second
+
+// runtimeAPI executes the commands of the haproxy runtime api
+type runtimeAPI interface {
+	Execute(cmd string) (string, error)
+}
+
+// socketAPI executes the commands through the stats socket, one command per
+// connection
+type socketAPI struct {
+	path string
+	// timeout bounds a command, runtimeTimeout if it is zero
+	timeout time.Duration
+}
+
+func (s *socketAPI) Execute(cmd string) (string, error) {
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = runtimeTimeout
+	}
+	conn, err := net.DialTimeout("unix", s.path, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadAll(conn)
+	return string(out), err
+}
+
+// runtimeErrors are the responses of the failed commands, the successful
+// ones are empty or informational
+var runtimeErrors = []string{
+	"No such",
+	"Unknown command",
+	"Require",
+	"Invalid",
+	"invalid",
+	"Can't",
+	"cannot",
+	"error",
+}
+
+// execute executes the command and returns an error if haproxy rejects it
+func execute(api runtimeAPI, cmd string) error {
+	out, err := api.Execute(cmd)
+	if err != nil {
+		return fmt.Errorf("runtime api %q error: %v", cmd, err)
+	}
+	for _, e := range runtimeErrors {
+		if strings.Contains(out, e) {
+			return fmt.Errorf("runtime api %q error: %s", cmd, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// runtimeServer is a server of a backend in the running haproxy, a
+// disabled one is reused for the next added server
+type runtimeServer struct {
+	Name     string
+	Address  string
+	Weight   int
+	Disabled bool
+}
+
+// runtimeState is the servers of the backends in the running haproxy,
+// which differ from the rendered ones after the runtime updates
+type runtimeState map[string][]runtimeServer
+
+// newRuntimeState returns the servers haproxy runs after loading the
+// configuration of the model
+func newRuntimeState(m *model) runtimeState {
+	s := make(runtimeState, len(m.Backends))
+	for _, b := range m.Backends {
+		servers := make([]runtimeServer, 0, len(b.Servers))
+		for _, srv := range b.Servers {
+			servers = append(servers, runtimeServer{Name: srv.Name, Address: srv.Address, Weight: srv.Weight})
+		}
+		s[b.Name] = servers
+	}
+	return s
+}
+
+// copy returns a deep copy of the state
+func (s runtimeState) copy() runtimeState {
+	c := make(runtimeState, len(s))
+	for name, servers := range s {
+		c[name] = append([]runtimeServer(nil), servers...)
+	}
+	return c
+}
+
+// structurallyEqual returns true if the models differ in the servers of
+// the backends only, which the runtime api can change without a reload
+func structurallyEqual(old, cur *model) bool {
+	return reflect.DeepEqual(withoutServers(old), withoutServers(cur))
+}
+
+func withoutServers(m *model) *model {
+	c := *m
+	c.Backends = make([]backend, 0, len(m.Backends))
+	for _, b := range m.Backends {
+		c.Backends = append(c.Backends, backend{Name: b.Name, Mode: b.Mode, SendProxy: b.SendProxy, TLS: b.TLS})
+	}
+	return &c
+}
+
+// reconcile changes the servers of the backend in the running haproxy to
+// the desired ones, and updates the state accordingly. The servers which
+// are gone are disabled, the new ones reuse the disabled servers by
+// changing their addresses, or are added if none is left.
+func (s runtimeState) reconcile(api runtimeAPI, b backend, check *healthCheck) error {
+	servers := s[b.Name]
+	desired := make(map[string]backendServer, len(b.Servers))
+	for _, srv := range b.Servers {
+		desired[srv.Address] = srv
+	}
+
+	// disable the servers which are gone, and enable or reweight the ones
+	// still desired
+	running := make(map[string]bool, len(servers))
+	for i := range servers {
+		srv := &servers[i]
+		want, ok := desired[srv.Address]
+		if !ok {
+			if !srv.Disabled {
+				if err := execute(api, fmt.Sprintf("set server %s/%s state maint", b.Name, srv.Name)); err != nil {
+					return err
+				}
+				srv.Disabled = true
+			}
+			continue
+		}
+		running[srv.Address] = true
+		if srv.Weight != want.Weight {
+			if err := execute(api, fmt.Sprintf("set server %s/%s weight %d", b.Name, srv.Name, want.Weight)); err != nil {
+				return err
+			}
+			srv.Weight = want.Weight
+		}
+		if srv.Disabled {
+			if err := execute(api, fmt.Sprintf("set server %s/%s state ready", b.Name, srv.Name)); err != nil {
+				return err
+			}
+			srv.Disabled = false
+		}
+	}
+
+	for _, want := range b.Servers {
+		if running[want.Address] {
+			continue
+		}
+		host, port, err := net.SplitHostPort(want.Address)
+		if err != nil {
+			return err
+		}
+		slot := -1
+		for i := range servers {
+			if servers[i].Disabled && desired[servers[i].Address].Address == "" {
+				slot = i
+				break
+			}
+		}
+
+		if slot >= 0 {
+			srv := &servers[slot]
+			for _, cmd := range []string{
+				fmt.Sprintf("set server %s/%s addr %s port %s", b.Name, srv.Name, host, port),
+				fmt.Sprintf("set server %s/%s weight %d", b.Name, srv.Name, want.Weight),
+				fmt.Sprintf("set server %s/%s state ready", b.Name, srv.Name),
+			} {
+				if err := execute(api, cmd); err != nil {
+					return err
+				}
+			}
+			srv.Address, srv.Weight, srv.Disabled = want.Address, want.Weight, false
+			continue
+		}
+
+		// the dynamic servers are supported by haproxy 2.4 and later, they
+		// do not inherit the default-server settings and start disabled
+		name := uniqueServerName(servers, want.Name)
+		cmds := []string{fmt.Sprintf("add server %s/%s %s weight %d%s%s%s", b.Name, name, want.Address, want.Weight, checkArgs(check), b.ProxyArgs(check), b.TLSArgs())}
+		if check != nil {
+			cmds = append(cmds, fmt.Sprintf("enable health %s/%s", b.Name, name))
+		}
+		cmds = append(cmds, fmt.Sprintf("enable server %s/%s", b.Name, name))
+		for _, cmd := range cmds {
+			if err := execute(api, cmd); err != nil {
+				return err
+			}
+		}
+		servers = append(servers, runtimeServer{Name: name, Address: want.Address, Weight: want.Weight})
+	}
+	s[b.Name] = servers
+	return nil
+}
+
+// uniqueServerName returns the name, suffixed if a server of the backend
+// already has it
+func uniqueServerName(servers []runtimeServer, name string) string {
+	taken := make(map[string]bool, len(servers))
+	for _, srv := range servers {
+		taken[srv.Name] = true
+	}
+	unique := name
+	for i := 1; taken[unique]; i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+	return unique
+}
+
+// checkArgs returns the arguments of the health check of a server
+func checkArgs(c *healthCheck) string {
+	if c == nil {
+		return ""
+	}
+	args := fmt.Sprintf(" check inter %dms rise %d fall %d", c.IntervalMillis, c.Rise, c.Fall)
+	if c.Port != 0 {
+		args += fmt.Sprintf(" port %d", c.Port)
+	}
+	return args
+}
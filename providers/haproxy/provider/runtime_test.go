@@ -0,0 +1,229 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRuntime is a stats socket recording the commands, it responds to the
+// commands with the scripted responses by prefix and empty otherwise
+type fakeRuntime struct {
+	listener net.Listener
+
+	mu        sync.Mutex
+	responses map[string]string
+	cmds      []string
+}
+
+func newFakeRuntime(t *testing.T, path string) *fakeRuntime {
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	r := &fakeRuntime{listener: l, responses: make(map[string]string)}
+	go r.serve()
+	return r
+}
+
+func (r *fakeRuntime) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		cmd, _ := bufio.NewReader(conn).ReadString('\n')
+		cmd = strings.TrimSpace(cmd)
+		r.mu.Lock()
+		r.cmds = append(r.cmds, cmd)
+		resp := ""
+		for prefix, out := range r.responses {
+			if strings.HasPrefix(cmd, prefix) {
+				resp = out
+			}
+		}
+		r.mu.Unlock()
+		conn.Write([]byte(resp + "\n"))
+		conn.Close()
+	}
+}
+
+func (r *fakeRuntime) Respond(prefix, out string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responses[prefix] = out
+}
+
+// Commands returns and forgets the recorded commands
+func (r *fakeRuntime) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cmds := r.cmds
+	r.cmds = nil
+	return cmds
+}
+
+func (r *fakeRuntime) Close() {
+	r.listener.Close()
+}
+
+func TestOnUpdateRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "haproxy.sock")
+	rt := newFakeRuntime(t, socket)
+	defer rt.Close()
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2", "10.0.1.3")
+	runner := &fakeRunner{}
+	proc := &fakeProcess{exit: make(chan struct{})}
+	p := newTestProvider(t, dir, runner)
+	p.newProcess = func(string) (process, error) { return proc, nil }
+	p.runtimeAPI = &socketAPI{path: socket}
+	p.SetListers(store.lister())
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	lb := newTestLoadBalancer(map[string]string{
+		core.AnnotationKeyHTTPPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+		core.AnnotationKeyTCPPorts:  `[{"port":6443}]`,
+	})
+	store.addNode("node1", "192.168.1.1", nil)
+	store.addNode("node2", "192.168.1.2", nil)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2}, proc.Signals())
+	assert.Empty(t, rt.Commands())
+	assert.Equal(t, []core.PortHealth{{Protocol: "tcp", Port: 80, Healthy: true}, {Protocol: "tcp", Port: 6443, Healthy: true}}, p.PortHealth())
+
+	cases := []struct {
+		name   string
+		change func()
+		cmds   []string
+	}{
+		{
+			name:   "disable",
+			change: func() { store.addService("web", "10.0.1.2") },
+			cmds:   []string{"set server http-default-web-80/10.0.1.3-8080 state maint"},
+		},
+		{
+			name:   "add reusing the disabled server",
+			change: func() { store.addService("web", "10.0.1.2", "10.0.1.4") },
+			cmds: []string{
+				"set server http-default-web-80/10.0.1.3-8080 addr 10.0.1.4 port 8080",
+				"set server http-default-web-80/10.0.1.3-8080 weight 1",
+				"set server http-default-web-80/10.0.1.3-8080 state ready",
+			},
+		},
+		{
+			name:   "add a dynamic server",
+			change: func() { store.addService("web", "10.0.1.2", "10.0.1.3", "10.0.1.4") },
+			cmds: []string{
+				"add server http-default-web-80/10.0.1.3-8080-1 10.0.1.3:8080 weight 1",
+				"enable server http-default-web-80/10.0.1.3-8080-1",
+			},
+		},
+		{
+			name:   "weight change",
+			change: func() { store.addNode("node2", "192.168.1.2", map[string]string{core.AnnotationKeyWeight: "50"}) },
+			cmds:   []string{"set server tcp-nodes-6443/node2 weight 50"},
+		},
+		{
+			name:   "enable again",
+			change: func() { store.addService("web", "10.0.1.2", "10.0.1.3") },
+			cmds:   []string{"set server http-default-web-80/10.0.1.3-8080 state maint"},
+		},
+	}
+	for _, c := range cases {
+		c.change()
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Equal(t, c.cmds, rt.Commands(), c.name)
+		assert.Equal(t, []os.Signal{syscall.SIGUSR2}, proc.Signals(), c.name)
+	}
+
+	// the configuration is kept in sync for the restarts of haproxy
+	data, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "server 10.0.1.3-8080 10.0.1.3:8080 weight 1")
+	assert.NotContains(t, string(data), "10.0.1.4")
+
+	// haproxy lost the server, e.g. after it was restarted, so it is reloaded
+	rt.Respond("set server", "No such server.")
+	store.addService("web", "10.0.1.2")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"set server http-default-web-80/10.0.1.3-8080-1 state maint"}, rt.Commands())
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2, syscall.SIGUSR2}, proc.Signals())
+
+	// the runtime state is reset by the reload
+	rt.Respond("set server", "")
+	store.addService("web")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"set server http-default-web-80/10.0.1.2-8080 state maint"}, rt.Commands())
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Reason: "backend http-default-web-80 has no ready server"},
+		{Protocol: "tcp", Port: 6443, Healthy: true},
+	}, p.PortHealth())
+
+	// a structural change reloads
+	lb.Annotations[AnnotationKeyBalance] = "leastconn"
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, rt.Commands())
+	assert.Equal(t, []os.Signal{syscall.SIGUSR2, syscall.SIGUSR2, syscall.SIGUSR2}, proc.Signals())
+}
+
+func TestReconcileHealthCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "haproxy.sock")
+	rt := newFakeRuntime(t, socket)
+	defer rt.Close()
+
+	state := runtimeState{"b": nil}
+	check := &healthCheck{Protocol: "tcp", IntervalMillis: 2000, Rise: 2, Fall: 3, Port: 8081}
+	b := backend{Name: "b", Servers: []backendServer{{Name: "s", Address: "[fd00::1]:80", Weight: 10}}}
+	assert.Nil(t, state.reconcile(&socketAPI{path: socket}, b, check))
+	assert.Equal(t, []string{
+		"add server b/s [fd00::1]:80 weight 10 check inter 2000ms rise 2 fall 3 port 8081",
+		"enable health b/s",
+		"enable server b/s",
+	}, rt.Commands())
+	assert.Equal(t, runtimeState{"b": {{Name: "s", Address: "[fd00::1]:80", Weight: 10}}}, state)
+
+	// the added servers send the PROXY protocol of the backend
+	state = runtimeState{"p": nil}
+	pb := backend{Name: "p", SendProxy: core.ProxyProtocolV2, Servers: []backendServer{{Name: "s", Address: "10.0.0.1:80", Weight: 1}}}
+	assert.Nil(t, state.reconcile(&socketAPI{path: socket}, pb, check))
+	assert.Contains(t, rt.Commands(), "add server p/s 10.0.0.1:80 weight 1 check inter 2000ms rise 2 fall 3 port 8081 send-proxy-v2 check-send-proxy")
+
+	// haproxy before 2.4 can not add servers
+	rt.Respond("add server", "Unknown command. Please enter one of the following commands only :")
+	b.Servers = append(b.Servers, backendServer{Name: "t", Address: "10.0.0.2:80", Weight: 10})
+	assert.NotNil(t, state.reconcile(&socketAPI{path: socket}, b, nil))
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+)
+
+// statsTimeout bounds a command of a scrape, so a hung haproxy does not
+// hang the scrape
+const statsTimeout = 2 * time.Second
+
+// the types of the proxies in show stat
+const (
+	statTypeFrontend = "0"
+	statTypeBackend  = "1"
+	statTypeServer   = "2"
+)
+
+// statsLabels maps the proxies of haproxy back to the LoadBalancer
+type statsLabels struct {
+	// frontendPorts are the ports of the frontends, and backendPorts the
+	// ports proxied to the backends joined by commas
+	frontendPorts map[string]string
+	backendPorts  map[string]string
+	// nodes are the nodes of the server addresses
+	nodes map[string]string
+}
+
+// newStatsLabels returns the labels of the proxies of the model
+func newStatsLabels(m *model) *statsLabels {
+	l := &statsLabels{
+		frontendPorts: make(map[string]string, len(m.Frontends)),
+		backendPorts:  make(map[string]string, len(m.Backends)),
+		nodes:         make(map[string]string),
+	}
+	ports := make(map[string][]int)
+	for _, f := range m.Frontends {
+		l.frontendPorts[f.Name] = strconv.Itoa(f.Port)
+		ports[f.Backend] = append(ports[f.Backend], f.Port)
+	}
+	for backend, ps := range ports {
+		sort.Ints(ps)
+		strs := make([]string, 0, len(ps))
+		for _, p := range ps {
+			strs = append(strs, strconv.Itoa(p))
+		}
+		l.backendPorts[backend] = strings.Join(strs, ",")
+	}
+	for _, b := range m.Backends {
+		for _, s := range b.Servers {
+			if s.Node != "" {
+				l.nodes[s.Address] = s.Node
+			}
+		}
+	}
+	return l
+}
+
+// statsCollector exports the stats of haproxy read from the stats socket
+// on scrape. Only the proxies of the LoadBalancer are exported, a failed
+// read is exported by the scrape error.
+type statsCollector struct {
+	p   *HAProxyProvider
+	api runtimeAPI
+}
+
+func newStatsCollector(p *HAProxyProvider, api runtimeAPI) *statsCollector {
+	return &statsCollector{p: p, api: api}
+}
+
+// Collect implements metrics.Collector
+func (c *statsCollector) Collect() []*metrics.Family {
+	scrapeError := &metrics.Family{
+		Name:    "loadbalancer_provider_haproxy_stats_scrape_error",
+		Help:    "Whether reading the stats of haproxy failed in the scrape",
+		Type:    metrics.TypeGauge,
+		Samples: []metrics.Sample{{Value: 0}},
+	}
+	families, err := c.collect()
+	if err != nil {
+		log.Warn("read haproxy stats error", log.Fields{"err": err})
+		scrapeError.Samples[0].Value = 1
+		return []*metrics.Family{scrapeError}
+	}
+	return append(families, scrapeError)
+}
+
+func (c *statsCollector) collect() ([]*metrics.Family, error) {
+	c.p.mu.Lock()
+	labels := c.p.statsLabels
+	c.p.mu.Unlock()
+	if labels == nil {
+		// haproxy does not run the LoadBalancer yet
+		return nil, nil
+	}
+
+	out, err := c.api.Execute("show info")
+	if err != nil {
+		return nil, err
+	}
+	info := parseInfo(out)
+	out, err = c.api.Execute("show stat")
+	if err != nil {
+		return nil, err
+	}
+	stats, err := parseStat(out)
+	if err != nil {
+		return nil, err
+	}
+	return append(infoFamilies(info), statFamilies(stats, labels)...), nil
+}
+
+// parseInfo parses the output of show info into the values by name
+func parseInfo(out string) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			info[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return info
+}
+
+// parseStat parses the csv output of show stat into the fields of the
+// proxies by name
+func parseStat(out string) ([]map[string]string, error) {
+	if !strings.HasPrefix(out, "# ") {
+		return nil, fmt.Errorf("unexpected output of show stat: %q", firstLine(out))
+	}
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(out, "# ")))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parse show stat error: %v", err)
+	}
+	header := records[0]
+	stats := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		stat := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				stat[name] = record[i]
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func firstLine(s string) string {
+	return strings.SplitN(s, "\n", 2)[0]
+}
+
+// parseValue returns the number of a field, zero if it is empty
+func parseValue(s string) float64 {
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// isUp returns true if the status of a backend or server is up, a server
+// without health checks is always up
+func isUp(status string) bool {
+	return strings.HasPrefix(status, "UP") || status == "no check"
+}
+
+func infoFamilies(info map[string]string) []*metrics.Family {
+	return []*metrics.Family{
+		{
+			Name:    "loadbalancer_provider_haproxy_current_connections",
+			Help:    "Number of the current connections of haproxy",
+			Type:    metrics.TypeGauge,
+			Samples: []metrics.Sample{{Value: parseValue(info["CurrConns"])}},
+		},
+		{
+			Name:    "loadbalancer_provider_haproxy_connection_rate",
+			Help:    "Number of the connections haproxy accepted in the last second",
+			Type:    metrics.TypeGauge,
+			Samples: []metrics.Sample{{Value: parseValue(info["ConnRate"])}},
+		},
+	}
+}
+
+// statSeries is a field of show stat exported for the proxies of a type
+type statSeries struct {
+	name  string
+	help  string
+	typ   string
+	value func(stat map[string]string) float64
+}
+
+func statField(field string) func(map[string]string) float64 {
+	return func(stat map[string]string) float64 {
+		return parseValue(stat[field])
+	}
+}
+
+func statUp(stat map[string]string) float64 {
+	if isUp(stat["status"]) {
+		return 1
+	}
+	return 0
+}
+
+var (
+	frontendSeries = []statSeries{
+		{"current_sessions", "Number of the current sessions of the frontend", metrics.TypeGauge, statField("scur")},
+		{"session_rate", "Number of the sessions of the frontend in the last second", metrics.TypeGauge, statField("rate")},
+		{"sessions_total", "Number of the sessions of the frontend", metrics.TypeCounter, statField("stot")},
+	}
+	backendSeries = []statSeries{
+		{"up", "Whether the backend is up", metrics.TypeGauge, statUp},
+		{"current_sessions", "Number of the current sessions of the backend", metrics.TypeGauge, statField("scur")},
+		{"current_queue", "Number of the requests of the backend queued for a server", metrics.TypeGauge, statField("qcur")},
+		{"sessions_total", "Number of the sessions of the backend", metrics.TypeCounter, statField("stot")},
+	}
+	serverSeries = []statSeries{
+		{"up", "Whether the server is up", metrics.TypeGauge, statUp},
+		{"current_sessions", "Number of the current sessions of the server", metrics.TypeGauge, statField("scur")},
+		{"current_queue", "Number of the requests queued for the server", metrics.TypeGauge, statField("qcur")},
+		{"sessions_total", "Number of the sessions of the server", metrics.TypeCounter, statField("stot")},
+	}
+)
+
+// statFamilies returns the series of the frontends, backends and servers
+// of the LoadBalancer labeled by their ports and nodes
+func statFamilies(stats []map[string]string, labels *statsLabels) []*metrics.Family {
+	newFamilies := func(kind string, series []statSeries, labelNames ...string) []*metrics.Family {
+		families := make([]*metrics.Family, 0, len(series))
+		for _, s := range series {
+			families = append(families, &metrics.Family{
+				Name:       fmt.Sprintf("loadbalancer_provider_haproxy_%s_%s", kind, s.name),
+				Help:       s.help,
+				Type:       s.typ,
+				LabelNames: labelNames,
+			})
+		}
+		return families
+	}
+	// the last family is of the bytes in both directions
+	newBytesFamily := func(families []*metrics.Family, kind string) []*metrics.Family {
+		labelNames := families[0].LabelNames
+		return append(families, &metrics.Family{
+			Name:       fmt.Sprintf("loadbalancer_provider_haproxy_%s_bytes_total", kind),
+			Help:       fmt.Sprintf("Number of the bytes of the %s, in from the clients and out to them", kind),
+			Type:       metrics.TypeCounter,
+			LabelNames: append(append([]string(nil), labelNames...), "direction"),
+		})
+	}
+	add := func(families []*metrics.Family, series []statSeries, stat map[string]string, labelValues ...string) {
+		for i, s := range series {
+			families[i].Samples = append(families[i].Samples, metrics.Sample{LabelValues: labelValues, Value: s.value(stat)})
+		}
+		bytes := families[len(series)]
+		for _, d := range []struct{ direction, field string }{{"in", "bin"}, {"out", "bout"}} {
+			lvs := append(append([]string(nil), labelValues...), d.direction)
+			bytes.Samples = append(bytes.Samples, metrics.Sample{LabelValues: lvs, Value: parseValue(stat[d.field])})
+		}
+	}
+
+	frontends := newBytesFamily(newFamilies("frontend", frontendSeries, "frontend", "port"), "frontend")
+	backends := newBytesFamily(newFamilies("backend", backendSeries, "backend", "port"), "backend")
+	servers := newBytesFamily(newFamilies("server", serverSeries, "backend", "port", "server", "node"), "server")
+	for _, stat := range stats {
+		proxy := stat["pxname"]
+		switch stat["type"] {
+		case statTypeFrontend:
+			if port, ok := labels.frontendPorts[proxy]; ok {
+				add(frontends, frontendSeries, stat, proxy, port)
+			}
+		case statTypeBackend:
+			if port, ok := labels.backendPorts[proxy]; ok {
+				add(backends, backendSeries, stat, proxy, port)
+			}
+		case statTypeServer:
+			if port, ok := labels.backendPorts[proxy]; ok {
+				add(servers, serverSeries, stat, proxy, port, stat["svname"], labels.nodes[stat["addr"]])
+			}
+		}
+	}
+	return append(append(frontends, backends...), servers...)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// testShowStat is the output of show stat with the fields of the collector
+// only, the proxies are looked up by the names in the header
+const testShowStat = `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,status,weight,type,rate,addr,
+http-80,FRONTEND,,,3,10,50000,120,4096,8192,OPEN,,0,2,,
+tcp-3306,FRONTEND,,,1,2,50000,7,100,200,OPEN,,0,0,,
+tcp-nodes-3306,node-1,0,0,1,2,,7,100,200,UP,100,2,,192.168.1.1:3306,
+tcp-nodes-3306,node-2,0,0,0,1,,0,0,0,DOWN,100,2,,192.168.1.2:3306,
+tcp-nodes-3306,BACKEND,0,0,1,2,5000,7,100,200,UP,200,1,0,,
+http-default-web-8080,10.0.0.1-8080,2,3,3,10,,120,4096,8192,no check,1,2,,10.0.0.1:8080,
+http-default-web-8080,BACKEND,2,3,3,10,5000,120,4096,8192,UP,1,1,2,,
+loadbalancer-requests,BACKEND,0,0,0,0,5000,0,0,0,UP,0,1,0,,
+`
+
+const testShowInfo = `Name: HAProxy
+Version: 1.8.8
+CurrConns: 4
+ConnRate: 2
+`
+
+func scrape(t *testing.T, c metrics.Collector) string {
+	r := metrics.NewRegistry()
+	r.MustRegister(c)
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	assert.Nil(t, err)
+	return buf.String()
+}
+
+func TestStatsCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "haproxy.sock")
+	rt := newFakeRuntime(t, socket)
+	rt.Respond("show stat", testShowStat)
+	rt.Respond("show info", testShowInfo)
+	p := &HAProxyProvider{}
+	c := newStatsCollector(p, &socketAPI{path: socket, timeout: time.Second})
+
+	// nothing is read before haproxy runs the LoadBalancer
+	assert.Equal(t, "# HELP loadbalancer_provider_haproxy_stats_scrape_error Whether reading the stats of haproxy failed in the scrape\n# TYPE loadbalancer_provider_haproxy_stats_scrape_error gauge\nloadbalancer_provider_haproxy_stats_scrape_error 0\n", scrape(t, c))
+	assert.Empty(t, rt.Commands())
+
+	p.setApplied(&model{
+		Frontends: []frontend{
+			{Name: "http-80", Port: 80, Mode: "http", Backend: "http-default-web-8080"},
+			{Name: "http-8080", Port: 8080, Mode: "http", Backend: "http-default-web-8080"},
+			{Name: "tcp-3306", Port: 3306, Mode: "tcp", Backend: "tcp-nodes-3306"},
+		},
+		Backends: []backend{
+			{Name: "http-default-web-8080", Mode: "http", Servers: []backendServer{{Name: "10.0.0.1-8080", Address: "10.0.0.1:8080", Weight: 1}}},
+			{Name: "tcp-nodes-3306", Mode: "tcp", Servers: []backendServer{
+				{Name: "node-1", Address: "192.168.1.1:3306", Weight: 100, Node: "node-1"},
+				{Name: "node-2", Address: "192.168.1.2:3306", Weight: 100, Node: "node-2"},
+			}},
+		},
+	})
+	out := scrape(t, c)
+	assert.Contains(t, out, "loadbalancer_provider_haproxy_stats_scrape_error 0")
+	assert.Contains(t, out, "loadbalancer_provider_haproxy_current_connections 4")
+	assert.Contains(t, out, "loadbalancer_provider_haproxy_connection_rate 2")
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_frontend_current_sessions{frontend="http-80",port="80"} 3`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_frontend_session_rate{frontend="http-80",port="80"} 2`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_frontend_sessions_total{frontend="tcp-3306",port="3306"} 7`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_frontend_bytes_total{frontend="http-80",port="80",direction="out"} 8192`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_backend_up{backend="tcp-nodes-3306",port="3306"} 1`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_backend_current_queue{backend="http-default-web-8080",port="80,8080"} 2`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_server_up{backend="tcp-nodes-3306",port="3306",server="node-1",node="node-1"} 1`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_server_up{backend="tcp-nodes-3306",port="3306",server="node-2",node="node-2"} 0`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_server_up{backend="http-default-web-8080",port="80,8080",server="10.0.0.1-8080",node=""} 1`)
+	assert.Contains(t, out, `loadbalancer_provider_haproxy_server_bytes_total{backend="tcp-nodes-3306",port="3306",server="node-1",node="node-1",direction="in"} 100`)
+	// the proxies not of the LoadBalancer are not exported
+	assert.NotContains(t, out, "loadbalancer-requests")
+	assert.Equal(t, []string{"show info", "show stat"}, rt.Commands())
+
+	// a stale socket is a scrape error
+	rt.Close()
+	out = scrape(t, c)
+	assert.Contains(t, out, "loadbalancer_provider_haproxy_stats_scrape_error 1")
+	assert.NotContains(t, out, "loadbalancer_provider_haproxy_frontend")
+
+	// a hung haproxy does not hang the scrape
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	defer l.Close()
+	c = newStatsCollector(p, &socketAPI{path: socket, timeout: 100 * time.Millisecond})
+	assert.Contains(t, scrape(t, c), "loadbalancer_provider_haproxy_stats_scrape_error 1")
+}
+
+func TestParseStat(t *testing.T) {
+	stats, err := parseStat(testShowStat)
+	assert.Nil(t, err)
+	assert.Len(t, stats, 8)
+	assert.Equal(t, "tcp-nodes-3306", stats[2]["pxname"])
+	assert.Equal(t, "192.168.1.1:3306", stats[2]["addr"])
+	assert.Equal(t, "UP", stats[2]["status"])
+
+	_, err = parseStat("Unknown command.\n")
+	assert.NotNil(t, err)
+}
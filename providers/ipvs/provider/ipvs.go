@@ -0,0 +1,711 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-controller/pkg/util/validation"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/firewall"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	coresysctl "github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/ipvs/version"
+	log "github.com/zoumo/logdog"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	utildbus "k8s.io/kubernetes/pkg/util/dbus"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+var (
+	_ core.Provider           = &IpvsProvider{}
+	_ core.InterfaceProvider  = &IpvsProvider{}
+	_ core.FamilyProvider     = &IpvsProvider{}
+	_ core.HealthzProvider    = &IpvsProvider{}
+	_ core.PortHealthProvider = &IpvsProvider{}
+)
+
+const (
+	// ipvsProcFile exists once the ip_vs module is loaded
+	ipvsProcFile = "/proc/net/ip_vs"
+	// ownerLabelSuffix makes the label of the IPv4 vips bound by us, e.g.
+	// eth0:lbp, like the one of the vips on the loopback of the real servers
+	ownerLabelSuffix = ":lbp"
+	// maxLabelLen is the maximum length of an address label, IFNAMSIZ - 1
+	maxLabelLen = 15
+)
+
+// natSysctl is required by the masquerading of the endpoint ports, the
+// connections of ipvs are invisible to iptables without conntrack
+var natSysctl = map[string]string{
+	"net/ipv4/vs/conntrack": "1",
+}
+
+// IpvsProvider serves the VIPs by the ipvs of the node without keepalived.
+// The VIPs are bound on their interfaces unconditionally, so it suits the
+// LoadBalancers whose high availability is handled elsewhere, e.g. by the
+// cloud moving the VIP between the nodes. The nodes are the real servers of
+// direct routing, they must carry the VIPs on the loopback. The endpoint
+// ports are forwarded to the endpoints of their Services by masquerading
+// instead, so the pods need no VIP.
+//
+// It runs no process of its own, the kernel state is reconciled on every
+// update and cleaned up on Stop. The VIPs and the virtual servers are
+// programmed by netlink, iptables only runs for the source ranges, the rate
+// limits and the endpoint ports. The VIPs and the virtual servers it owns
+// are recorded under the state directory, so a restarted provider removes
+// the ones which are not desired any more.
+type IpvsProvider struct {
+	// AnnounceBurst is the number of the announcements of a VIP after it is
+	// bound, AnnounceInterval apart, unless the LoadBalancer overrides it
+	// by the GARP annotations. The VIPs are never announced if it is zero,
+	// e.g. when they are bound on the loopback.
+	AnnounceBurst    int
+	AnnounceInterval time.Duration
+
+	iface       string
+	storeLister core.StoreLister
+	ipvsManager *coreipvs.Manager
+	addrs       corenet.AddrHandle
+	// allowlists drop the clients outside the source ranges, by the family
+	// of the vips
+	allowlists map[corenet.Family]*firewall.Allowlist
+	// limiters drop the new connections beyond the rate limits, by the
+	// family of the vips
+	limiters map[corenet.Family]*firewall.Limiter
+	// masqueraders masquerade the connections to the endpoint ports, by
+	// the family of the vips
+	masqueraders map[corenet.Family]*firewall.Masquerader
+	sysctl       *coresysctl.Manager
+	announce     func(iface string, ip net.IP) error
+	// garp announces the vips bound by us
+	garp         *arp.Scheduler
+	checkModules func() error
+
+	mu   sync.Mutex
+	vips []core.VIP
+	// virtualServers are the desired ones of the last update
+	virtualServers []coreipvs.VirtualServer
+	// owned are the VIPs bound by us keyed by vipKey, the ones bound by
+	// others are never removed
+	owned map[string]corenet.Addr
+	// vipRecordPath is the file recording the owned VIPs, they are only
+	// kept in memory if it is empty
+	vipRecordPath string
+	vipRecorded   []recordedVIP
+	startErr      error
+}
+
+// NewIpvsProvider creates a new ipvs LoadBalancer Provider serving the VIPs
+// on iface unless they specify their own interfaces, the VIPs and the
+// virtual servers owned by a previous provider are read from the records
+func NewIpvsProvider(iface string) (*IpvsProvider, error) {
+	execer := k8sexec.New()
+	dbus := utildbus.New()
+	handle := coreipvs.NewHandle()
+	p := newIpvsProvider(iface, handle, corenet.NewNetlinkAddrHandle(),
+		utiliptables.New(execer, dbus, utiliptables.ProtocolIpv4), utiliptables.New(execer, dbus, utiliptables.ProtocolIpv6))
+
+	m, err := coreipvs.NewRecordedManager(handle, coreipvs.DefaultRecordPath)
+	if err != nil {
+		return nil, err
+	}
+	p.ipvsManager = m
+	if err := p.loadVIPRecord(DefaultVIPRecordPath); err != nil {
+		return nil, err
+	}
+
+	metrics.MustRegister(firewall.NewLimitCollector(p.limiters[corenet.FamilyIPv4], p.limiters[corenet.FamilyIPv6]))
+	return p, nil
+}
+
+func newIpvsProvider(iface string, handle coreipvs.Handle, addrs corenet.AddrHandle, ipt, ip6t utiliptables.Interface) *IpvsProvider {
+	p := &IpvsProvider{
+		AnnounceBurst:    corenet.DefaultAnnounceBurst,
+		AnnounceInterval: corenet.DefaultAnnounceInterval,
+		iface:            iface,
+		ipvsManager:      coreipvs.NewManager(handle),
+		addrs:            addrs,
+		allowlists: map[corenet.Family]*firewall.Allowlist{
+			corenet.FamilyIPv4: firewall.NewAllowlist(ipt),
+			corenet.FamilyIPv6: firewall.NewAllowlist(ip6t),
+		},
+		limiters: map[corenet.Family]*firewall.Limiter{
+			corenet.FamilyIPv4: firewall.NewLimiter(ipt),
+			corenet.FamilyIPv6: firewall.NewLimiter(ip6t),
+		},
+		masqueraders: map[corenet.Family]*firewall.Masquerader{
+			corenet.FamilyIPv4: firewall.NewMasquerader(ipt),
+			corenet.FamilyIPv6: firewall.NewMasquerader(ip6t),
+		},
+		sysctl:       coresysctl.NewManager(coresysctl.DefaultRoot),
+		announce:     arp.Announce,
+		checkModules: checkIPVSModules,
+		owned:        make(map[string]corenet.Addr),
+	}
+	p.garp = arp.NewScheduler(func(iface string, ip net.IP) error {
+		return p.announce(iface, ip)
+	})
+	return p
+}
+
+// checkIPVSModules returns an error if ipvs is not available in the kernel
+func checkIPVSModules() error {
+	if _, err := os.Stat(ipvsProcFile); err != nil {
+		return fmt.Errorf("ipvs is not available in the kernel, load the ip_vs module on the node by `modprobe ip_vs`: %v", err)
+	}
+	return nil
+}
+
+// OnUpdate ...
+func (p *IpvsProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	if err := validation.ValidateLoadBalancer(lb); err != nil {
+		log.Error("invalid loadbalancer", log.Fields{"err": err})
+		return nil
+	}
+
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal || lb.Spec.Providers.Ipvsdr == nil {
+		return nil
+	}
+	if err := core.RejectProxyProtocol(lb, "ipvs"); err != nil {
+		return err
+	}
+
+	vips, err := core.GetVIPList(lb)
+	if err != nil {
+		return err
+	}
+	garp, err := core.GetGARPSchedule(lb, arp.Schedule{Repeat: p.AnnounceBurst, Interval: p.AnnounceInterval, RefreshRepeat: 1})
+	if err != nil {
+		return err
+	}
+	scheduler, err := core.GetIpvsScheduler(lb)
+	if err != nil {
+		return err
+	}
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return err
+	}
+	persistence, err := core.GetPersistence(lb)
+	if err != nil {
+		return err
+	}
+	ranges, err := core.GetSourceRanges(lb)
+	if err != nil {
+		return err
+	}
+	rateLimit, err := core.GetRateLimit(lb)
+	if err != nil {
+		return err
+	}
+	if err := core.CheckRateLimitPorts(rateLimit, ports); err != nil {
+		return err
+	}
+	endpointPorts, err := core.GetEndpointPorts(lb)
+	if err != nil {
+		return err
+	}
+	if err := core.CheckEndpointPorts(endpointPorts, ports); err != nil {
+		return err
+	}
+	endpoints, err := p.getEndpoints(lb.Namespace, endpointPorts)
+	if err != nil {
+		return err
+	}
+
+	// the vips are bound after the clients outside the source ranges are
+	// dropped
+	if err := p.ensureSourceRanges(vips, ports, ranges); err != nil {
+		log.Error("ensure source ranges error", log.Fields{"err": err})
+		return err
+	}
+	if err := p.ensureRateLimits(vips, rateLimit); err != nil {
+		log.Error("ensure rate limits error", log.Fields{"err": err})
+		return err
+	}
+	if err := p.ensureMasquerade(vips, endpointPorts); err != nil {
+		log.Error("ensure masquerade error", log.Fields{"err": err})
+		return err
+	}
+	if err := p.ensureVIPs(vips, garp); err != nil {
+		log.Error("ensure vips error", log.Fields{"err": err})
+		return err
+	}
+
+	vss := p.getVirtualServers(lb.Spec.Nodes.Names, vips, ports, scheduler, persistence, endpoints)
+	p.mu.Lock()
+	p.virtualServers = vss
+	p.mu.Unlock()
+	if err := p.ipvsManager.Ensure(vss); err != nil {
+		log.Error("ensure ipvs virtual servers error", log.Fields{"err": err})
+		return err
+	}
+	return nil
+}
+
+// getEndpoints returns the ready endpoints of the endpoint ports, a port
+// without one has an empty slice
+func (p *IpvsProvider) getEndpoints(namespace string, endpointPorts []core.EndpointPort) (map[corenet.Port][]core.Endpoint, error) {
+	endpoints := make(map[corenet.Port][]core.Endpoint, len(endpointPorts))
+	for _, port := range endpointPorts {
+		eps, err := p.storeLister.PortEndpoints(namespace, port)
+		if err != nil {
+			return nil, err
+		}
+		endpoints[port.CorePort()] = append([]core.Endpoint{}, eps...)
+	}
+	return endpoints, nil
+}
+
+// getVirtualServers returns a virtual server per vip and port, the real
+// servers are the nodes of the family of the vip, or the endpoints of the
+// family of the vip forwarded by NAT if the port is an endpoint port. The
+// netmask of the persistence applies to the IPv4 vips only.
+func (p *IpvsProvider) getVirtualServers(names []string, vips []core.VIP, ports []corenet.Port, scheduler string, persistence *core.Persistence, endpoints map[corenet.Port][]core.Endpoint) []coreipvs.VirtualServer {
+	rss := make(map[corenet.Family][]core.RealServer)
+	vss := make([]coreipvs.VirtualServer, 0, len(vips)*len(ports))
+	for _, vip := range vips {
+		family := corenet.FamilyOf(vip.IP)
+		if _, ok := rss[family]; !ok {
+			rss[family] = p.storeLister.RealServers(names, family)
+		}
+		for _, port := range ports {
+			vs := coreipvs.VirtualServer{
+				Address:     vip.IP,
+				Port:        port.Port,
+				Protocol:    coreipvs.Protocol(strings.ToUpper(port.Protocol)),
+				Scheduler:   scheduler,
+				RealServers: make([]coreipvs.RealServer, 0, len(rss[family])),
+			}
+			if persistence != nil && persistence.Enabled {
+				vs.Flags, vs.Timeout = coreipvs.FlagPersistent, persistence.Timeout
+				if family == corenet.FamilyIPv4 {
+					vs.Netmask = persistence.Mask
+				}
+			}
+			if eps, ok := endpoints[port]; ok {
+				for _, ep := range eps {
+					if corenet.FamilyOf(ep.IP) != family {
+						continue
+					}
+					vs.RealServers = append(vs.RealServers, coreipvs.RealServer{
+						Address:          ep.IP,
+						Port:             uint16(ep.Port),
+						Weight:           1,
+						ForwardingMethod: coreipvs.ForwardingMethodNAT,
+					})
+				}
+				vss = append(vss, vs)
+				continue
+			}
+			for _, rs := range rss[family] {
+				vs.RealServers = append(vs.RealServers, coreipvs.RealServer{
+					Address:          rs.IP,
+					Port:             port.Port,
+					Weight:           rs.Weight,
+					ForwardingMethod: coreipvs.ForwardingMethodDR,
+				})
+			}
+			vss = append(vss, vs)
+		}
+	}
+	return vss
+}
+
+// ensureSourceRanges allows the source ranges only to reach the ports of
+// the vips, all clients if the ranges are empty. The rules of the vips
+// which are gone are deleted.
+func (p *IpvsProvider) ensureSourceRanges(vips []core.VIP, ports []corenet.Port, ranges []*net.IPNet) error {
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+		if err := p.allowlists[corenet.FamilyOf(vip.IP)].EnsureAllowRules(vip.IP, ports, ranges); err != nil {
+			return err
+		}
+	}
+	for _, a := range p.allowlists {
+		for _, vip := range a.VIPs() {
+			if desired[vip.String()] {
+				continue
+			}
+			if err := a.DeleteAllowRules(vip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureMasquerade masquerades the connections to the endpoint ports of the
+// vips, the rules of the vips which are gone or have no endpoint port are
+// deleted
+func (p *IpvsProvider) ensureMasquerade(vips []core.VIP, endpointPorts []core.EndpointPort) error {
+	ports := make([]corenet.Port, 0, len(endpointPorts))
+	for _, port := range endpointPorts {
+		ports = append(ports, port.CorePort())
+	}
+	if len(ports) > 0 {
+		if err := p.sysctl.Apply(natSysctl); err != nil {
+			return err
+		}
+	}
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+		if err := p.masqueraders[corenet.FamilyOf(vip.IP)].EnsureMasqueradeRules(vip.IP, ports); err != nil {
+			return err
+		}
+	}
+	for _, m := range p.masqueraders {
+		for _, vip := range m.VIPs() {
+			if desired[vip.String()] {
+				continue
+			}
+			if err := m.DeleteMasqueradeRules(vip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureRateLimits drops the new connections to the vips beyond the
+// limits, the rules of the vips which are gone or no longer limited are
+// deleted
+func (p *IpvsProvider) ensureRateLimits(vips []core.VIP, rateLimit *core.RateLimit) error {
+	limits := rateLimits(rateLimit)
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+		if err := p.limiters[corenet.FamilyOf(vip.IP)].EnsureLimitRules(vip.IP, limits); err != nil {
+			return err
+		}
+	}
+	for _, l := range p.limiters {
+		for _, vip := range l.VIPs() {
+			if desired[vip.String()] {
+				continue
+			}
+			if err := l.DeleteLimitRules(vip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rateLimits returns the limits of the vip and its ports, none if the rate
+// limit is nil
+func rateLimits(rateLimit *core.RateLimit) []firewall.Limit {
+	if rateLimit == nil {
+		return nil
+	}
+	limits := []firewall.Limit{{MaxConnections: rateLimit.MaxConnections, ConnectionRate: rateLimit.ConnectionRate}}
+	for _, rl := range rateLimit.Ports {
+		port := rl.CorePort()
+		limits = append(limits, firewall.Limit{Port: &port, MaxConnections: rl.MaxConnections, ConnectionRate: rl.ConnectionRate})
+	}
+	return limits
+}
+
+// vipAddr returns the address of the vip on its interface, an IPv4 vip
+// carries our label
+func (p *IpvsProvider) vipAddr(vip core.VIP) corenet.Addr {
+	iface := vip.Interface
+	if iface == "" {
+		iface = p.iface
+	}
+	addr := corenet.NewAddr(vip.IP, iface)
+	if vip.IP.To4() != nil {
+		addr.Label = ownerLabel(iface)
+	}
+	return addr
+}
+
+// ownerLabel returns the label of the IPv4 vips bound by us on the link,
+// it is empty if the link name is too long to be labeled
+func ownerLabel(link string) string {
+	label := link + ownerLabelSuffix
+	if len(label) > maxLabelLen {
+		return ""
+	}
+	return label
+}
+
+// ours returns true if the address on its link was bound by us. An IPv4
+// address carries our label unless its link name is too long, the others
+// are only known by the record.
+func (p *IpvsProvider) ours(addr corenet.Addr) bool {
+	if label := ownerLabel(addr.Link); addr.IP.To4() != nil && label != "" {
+		return addr.Label == label
+	}
+	_, ok := p.owned[vipKey(addr)]
+	return ok
+}
+
+// vipKey identifies the address on its link regardless of its mask
+func vipKey(addr corenet.Addr) string {
+	return addr.Link + "/" + addr.IP.String()
+}
+
+// ensureVIPs binds the vips on their interfaces and announces the newly
+// bound ones by the schedule, the owned vips which are not desired any more
+// are removed. The owned vips bound already follow the schedule from now
+// on, they are not announced again right away. The vips bound by a previous
+// provider are owned again by the record or by our label.
+func (p *IpvsProvider) ensureVIPs(vips []core.VIP, garp arp.Schedule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	desired := make(map[string]corenet.Addr, len(vips))
+	links := map[string]bool{p.iface: true}
+	for _, vip := range vips {
+		addr := p.vipAddr(vip)
+		desired[vipKey(addr)] = addr
+		links[addr.Link] = true
+	}
+	for _, addr := range p.owned {
+		links[addr.Link] = true
+	}
+
+	errs := make([]error, 0)
+	bound := make(map[string]corenet.Addr)
+	listed := make(map[string]bool, len(links))
+	for _, link := range sortedLinks(links) {
+		addrs, err := p.addrs.AddrList(link)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		listed[link] = true
+		for _, a := range addrs {
+			a.Link = link
+			bound[vipKey(a)] = a
+			if a.IP.To4() != nil && a.Label != "" && a.Label == ownerLabel(link) {
+				p.owned[vipKey(a)] = a
+			}
+		}
+	}
+
+	for _, key := range sortedAddrKeys(p.owned) {
+		addr := p.owned[key]
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		if !listed[addr.Link] {
+			// keep it until its link is listed again
+			continue
+		}
+		// the ones which lost our label were taken over by others
+		if cur, ok := bound[key]; ok && p.ours(cur) {
+			log.Info("Removing vip", log.Fields{"addr": cur})
+			p.garp.Release(cur.Link, cur.IP)
+			if err := p.addrs.AddrDel(cur); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		delete(p.owned, key)
+	}
+
+	for _, key := range sortedAddrKeys(desired) {
+		addr := desired[key]
+		if !listed[addr.Link] {
+			continue
+		}
+		if cur, ok := bound[key]; ok {
+			p.garp.Update(cur.Link, cur.IP, garp)
+			continue
+		}
+		// record the ownership before binding, so a restart in between
+		// still removes the vip
+		p.owned[key] = addr
+		if err := p.saveVIPRecord(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Info("Binding vip", log.Fields{"addr": addr})
+		if err := p.addrs.AddrAdd(addr); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if p.AnnounceBurst > 0 {
+			p.garp.Takeover(addr.Link, addr.IP, garp)
+		}
+	}
+
+	if err := p.saveVIPRecord(); err != nil {
+		errs = append(errs, err)
+	}
+	p.vips = vips
+	return utilerrors.NewAggregate(errs)
+}
+
+// Start ...
+func (p *IpvsProvider) Start() {
+	log.Info("Startting ipvs provider")
+
+	err := p.checkModules()
+	if err != nil {
+		log.Error("ipvs is not available", log.Fields{"err": err})
+	}
+	p.mu.Lock()
+	p.startErr = err
+	p.mu.Unlock()
+}
+
+// WaitForStart returns false if ipvs is not available in the kernel
+func (p *IpvsProvider) WaitForStart() bool {
+	return p.Healthz() == nil
+}
+
+// Stop deletes the virtual servers, the source ranges, the rate limits and
+// the masquerading, and removes the vips bound by the provider
+func (p *IpvsProvider) Stop() error {
+	log.Info("Shutting down ipvs provider")
+
+	p.garp.Stop()
+
+	errs := make([]error, 0)
+	if err := p.ipvsManager.Cleanup(); err != nil {
+		log.Error("delete ipvs virtual servers error", log.Fields{"err": err})
+		errs = append(errs, err)
+	}
+	if err := p.ensureVIPs(nil, arp.Schedule{}); err != nil {
+		log.Error("remove vips error", log.Fields{"err": err})
+		errs = append(errs, err)
+	}
+	for _, a := range p.allowlists {
+		if err := a.Cleanup(); err != nil {
+			log.Error("delete source ranges error", log.Fields{"err": err})
+			errs = append(errs, err)
+		}
+	}
+	for _, l := range p.limiters {
+		if err := l.Cleanup(); err != nil {
+			log.Error("delete rate limits error", log.Fields{"err": err})
+			errs = append(errs, err)
+		}
+	}
+	for _, m := range p.masqueraders {
+		if err := m.Cleanup(); err != nil {
+			log.Error("delete masquerade error", log.Fields{"err": err})
+			errs = append(errs, err)
+		}
+	}
+	if err := p.sysctl.Restore(); err != nil {
+		log.Error("reset sysctl error", log.Fields{"err": err})
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Healthz implements core.HealthzProvider, the provider is unhealthy if
+// ipvs is not available
+func (p *IpvsProvider) Healthz() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startErr
+}
+
+// PortHealth implements core.PortHealthProvider, a port is healthy if its
+// virtual servers of all vips are in the kernel with a ready real server
+func (p *IpvsProvider) PortHealth() []core.PortHealth {
+	p.mu.Lock()
+	vss := p.virtualServers
+	p.mu.Unlock()
+	return portHealth(p.ipvsManager, vss)
+}
+
+// portHealth returns the health of the ports of the virtual servers, in
+// the order of the virtual servers
+func portHealth(m *coreipvs.Manager, vss []coreipvs.VirtualServer) []core.PortHealth {
+	errs, err := m.Check(vss)
+	ret := make([]core.PortHealth, 0)
+	index := make(map[string]int)
+	for _, vs := range vss {
+		key := fmt.Sprintf("%s/%d", vs.Protocol, vs.Port)
+		i, ok := index[key]
+		if !ok {
+			i = len(ret)
+			index[key] = i
+			ret = append(ret, core.PortHealth{Protocol: strings.ToLower(string(vs.Protocol)), Port: int(vs.Port), Healthy: true})
+		}
+		vsErr := err
+		if vsErr == nil {
+			vsErr = errs[vs.Key()]
+		}
+		if vsErr != nil && ret[i].Healthy {
+			ret[i].Healthy, ret[i].Reason = false, vsErr.Error()
+		}
+	}
+	return ret
+}
+
+// Interfaces implements core.InterfaceProvider, the vips are served on the
+// configured interface or their own ones
+func (p *IpvsProvider) Interfaces() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ifaces := []string{p.iface}
+	seen := map[string]bool{p.iface: true}
+	for _, vip := range p.vips {
+		if link := p.vipAddr(vip).Link; !seen[link] {
+			seen[link] = true
+			ifaces = append(ifaces, link)
+		}
+	}
+	return ifaces
+}
+
+// SupportedFamilies implements core.FamilyProvider, the ipvs provider
+// serves both IPv4 and IPv6 VIPs
+func (p *IpvsProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *IpvsProvider) Info() core.Info {
+	return core.Info{
+		Name:       "ipvs",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+		Capabilities: &core.Capabilities{
+			Protocols: []string{"tcp", "udp"},
+			Features:  []core.Feature{core.FeaturePersistence, core.FeatureSourceRanges, core.FeatureLocalTraffic, core.FeatureMaxConnections, core.FeatureConnectionRate, core.FeatureEndpointPorts},
+		},
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *IpvsProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,662 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/firewall"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/mocks"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	coresysctl "github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeAnnouncer records the announcements
+type fakeAnnouncer struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (f *fakeAnnouncer) announce(iface string, ip net.IP) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, iface+" "+ip.String())
+	return nil
+}
+
+func (f *fakeAnnouncer) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+// waitCalls waits for n announcements at least and returns the ones so far
+func (f *fakeAnnouncer) waitCalls(n int) []string {
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		f.mu.Lock()
+		done := len(f.calls) >= n
+		f.mu.Unlock()
+		if done {
+			break
+		}
+	}
+	return f.Calls()
+}
+
+func newTestNode(name, ip string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100", Scheduler: netv1alpha1.IpvsSchedulerRR}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+// ipvsState returns the virtual servers in the kernel in the form of
+// "key scheduler rs:weight..."
+func ipvsState(t *testing.T, handle *coreipvs.FakeHandle) []string {
+	vss, err := handle.GetVirtualServers()
+	assert.Nil(t, err)
+	ret := []string{}
+	for _, vs := range vss {
+		s := vs.Key() + " " + vs.Scheduler
+		for _, rs := range vs.RealServers {
+			s += fmt.Sprintf(" %v:%d", rs.Key(), rs.Weight)
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func TestOnUpdate(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+	nodes.Add(newTestNode("node2", "192.168.1.2"))
+
+	handle := coreipvs.NewFakeHandle()
+	addrs := corenet.NewFakeAddrHandle()
+	announcer := &fakeAnnouncer{}
+	p := newIpvsProvider("eth0", handle, addrs, firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = announcer.announce
+	p.AnnounceInterval = 0
+	p.checkModules = func() error { return nil }
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	p.Start()
+	assert.True(t, p.WaitForStart())
+
+	// full create
+	lb := newTestLoadBalancer("node1", "node2")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"TCP/10.0.0.100:443 rr 192.168.1.1:443:100 192.168.1.2:443:100",
+		"TCP/10.0.0.100:80 rr 192.168.1.1:80:100 192.168.1.2:80:100",
+	}, ipvsState(t, handle))
+	bound, err := addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	vip := corenet.NewAddr(net.ParseIP("10.0.0.100"), "eth0")
+	vip.Label = "eth0:lbp"
+	assert.Equal(t, []corenet.Addr{vip}, bound)
+	assert.Equal(t, []string{"eth0 10.0.0.100", "eth0 10.0.0.100", "eth0 10.0.0.100"}, announcer.waitCalls(3))
+
+	// unchanged, nothing is touched nor announced
+	handle.ResetCalls()
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, handle.Calls)
+	assert.Empty(t, announcer.waitCalls(0))
+
+	// node added
+	nodes.Add(newTestNode("node3", "192.168.1.3"))
+	lb.Spec.Nodes.Names = []string{"node1", "node2", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"AddRealServer TCP/10.0.0.100:443 192.168.1.3:443",
+		"AddRealServer TCP/10.0.0.100:80 192.168.1.3:80",
+	}, handle.Calls)
+
+	// node removed
+	handle.ResetCalls()
+	lb.Spec.Nodes.Names = []string{"node2", "node3"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"DeleteRealServer TCP/10.0.0.100:443 192.168.1.1:443",
+		"DeleteRealServer TCP/10.0.0.100:80 192.168.1.1:80",
+	}, handle.Calls)
+
+	// port changed
+	handle.ResetCalls()
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"udp","port":53}]`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"DeleteVirtualServer TCP/10.0.0.100:443",
+		"AddVirtualServer UDP/10.0.0.100:53",
+		"AddRealServer UDP/10.0.0.100:53 192.168.1.2:53",
+		"AddRealServer UDP/10.0.0.100:53 192.168.1.3:53",
+	}, handle.Calls)
+	assert.Equal(t, []string{
+		"TCP/10.0.0.100:80 rr 192.168.1.2:80:100 192.168.1.3:80:100",
+		"UDP/10.0.0.100:53 rr 192.168.1.2:53:100 192.168.1.3:53:100",
+	}, ipvsState(t, handle))
+
+	// teardown
+	assert.Nil(t, p.Stop())
+	assert.Empty(t, ipvsState(t, handle))
+	bound, err = addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	assert.Empty(t, bound)
+}
+
+func TestOnUpdatePersistence(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+
+	handle := coreipvs.NewFakeHandle()
+	p := newIpvsProvider("eth0", handle, corenet.NewFakeAddrHandle(), firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceInterval = 0
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80}]`
+	assert.Nil(t, p.OnUpdate(lb))
+
+	for _, c := range []struct {
+		name        string
+		persistence string
+		flags       coreipvs.Flags
+		timeout     uint32
+		netmask     net.IPMask
+	}{
+		{"on", `{"enabled":true}`, coreipvs.FlagPersistent, core.DefaultPersistenceTimeout, nil},
+		{"timeout changed", `{"enabled":true,"timeout":600,"netmask":"255.255.255.0"}`, coreipvs.FlagPersistent, 600, net.CIDRMask(24, 32)},
+		{"off", `{"enabled":false}`, 0, 0, nil},
+	} {
+		handle.ResetCalls()
+		lb.Annotations[core.AnnotationKeyPersistence] = c.persistence
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		// updated in place, the connections are kept
+		assert.Equal(t, []string{"UpdateVirtualServer TCP/10.0.0.100:80"}, handle.Calls, c.name)
+
+		vs, err := p.ipvsManager.Get("TCP/10.0.0.100:80")
+		assert.Nil(t, err)
+		assert.Equal(t, c.flags, vs.Flags, c.name)
+		assert.Equal(t, c.timeout, vs.Timeout, c.name)
+		assert.Equal(t, c.netmask, vs.Netmask, c.name)
+	}
+
+	lb.Annotations[core.AnnotationKeyPersistence] = `{"enabled":true,"netmask":"255.0.255.0"}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+func TestOnUpdateProtocols(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+
+	handle := coreipvs.NewFakeHandle()
+	p := newIpvsProvider("eth0", handle, corenet.NewFakeAddrHandle(), firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceInterval = 0
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+
+	for _, c := range []struct {
+		name  string
+		ports string
+		state []string
+	}{
+		{"udp only", `[{"protocol":"udp","port":53}]`, []string{
+			"UDP/10.0.0.100:53 rr 192.168.1.1:53:100",
+		}},
+		// tcp/53 and udp/53 are distinct services
+		{"mixed", `[{"protocol":"udp","port":53},{"protocol":"TCP","port":53}]`, []string{
+			"UDP/10.0.0.100:53 rr 192.168.1.1:53:100",
+			"TCP/10.0.0.100:53 rr 192.168.1.1:53:100",
+		}},
+		{"tcp only", `[{"protocol":"tcp","port":53}]`, []string{
+			"TCP/10.0.0.100:53 rr 192.168.1.1:53:100",
+		}},
+	} {
+		lb := newTestLoadBalancer("node1")
+		lb.Annotations[core.AnnotationKeyPorts] = c.ports
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Equal(t, c.state, ipvsState(t, handle), c.name)
+	}
+
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"udp","port":53},{"protocol":"udp","port":53}]`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	// the packets are forwarded as they are, without the PROXY protocol
+	handle.ResetCalls()
+	lb = newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyProxyProtocol] = `[{"port":80,"send":"v2"}]`
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Equal(t, "UnsupportedProxyProtocol", err.(*core.PermanentError).Reason)
+	assert.Empty(t, handle.Calls)
+}
+
+func TestEnsureVIPs(t *testing.T) {
+	// the vip bound by others is left alone
+	existing := corenet.NewAddr(net.ParseIP("10.0.0.100"), "eth0")
+	addrs := corenet.NewFakeAddrHandle(existing)
+	announcer := &fakeAnnouncer{}
+	p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), addrs, firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = announcer.announce
+	p.AnnounceBurst = 1
+
+	first := core.VIP{IP: net.ParseIP("10.0.0.100")}
+	second := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"}
+	assert.Nil(t, p.ensureVIPs([]core.VIP{first, second}, arp.Schedule{Repeat: 1}))
+	assert.Equal(t, []string{"eth1 10.1.0.100"}, announcer.waitCalls(1))
+	assert.Equal(t, []string{"eth0", "eth1"}, p.Interfaces())
+
+	assert.Nil(t, p.ensureVIPs(nil, arp.Schedule{}))
+	bound, err := addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, []corenet.Addr{existing}, bound)
+	bound, err = addrs.AddrList("eth1")
+	assert.Nil(t, err)
+	assert.Empty(t, bound)
+}
+
+func TestEnsureVIPsRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipvs-vips")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	record := filepath.Join(dir, "vips.json")
+
+	foreign := corenet.NewAddr(net.ParseIP("10.0.0.200"), "eth0")
+	addrs := corenet.NewFakeAddrHandle(foreign)
+	newProvider := func() *IpvsProvider {
+		p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), addrs, firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+		p.announce = (&fakeAnnouncer{}).announce
+		assert.Nil(t, p.loadVIPRecord(record))
+		return p
+	}
+
+	p := newProvider()
+	vips := []core.VIP{
+		{IP: net.ParseIP("10.0.0.100")},
+		{IP: net.ParseIP("fd00::100")},
+		{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"},
+	}
+	assert.Nil(t, p.ensureVIPs(vips, arp.Schedule{}))
+	bound, err := addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	assert.Len(t, bound, 3)
+
+	// a restarted provider removes the vips which are not desired any more,
+	// including the ones on the links it does not serve now
+	p = newProvider()
+	assert.Nil(t, p.ensureVIPs([]core.VIP{{IP: net.ParseIP("10.0.0.101")}}, arp.Schedule{}))
+	vip := corenet.NewAddr(net.ParseIP("10.0.0.101"), "eth0")
+	vip.Label = "eth0:lbp"
+	bound, err = addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, []corenet.Addr{foreign, vip}, bound)
+	bound, err = addrs.AddrList("eth1")
+	assert.Nil(t, err)
+	assert.Empty(t, bound)
+
+	// the labeled vips are ours even without the record, the others are
+	// never adopted
+	assert.Nil(t, os.Remove(record))
+	p = newProvider()
+	assert.Nil(t, p.ensureVIPs(nil, arp.Schedule{}))
+	bound, err = addrs.AddrList("eth0")
+	assert.Nil(t, err)
+	assert.Equal(t, []corenet.Addr{foreign}, bound)
+}
+
+func TestOnUpdateGARP(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+
+	addrs := corenet.NewFakeAddrHandle()
+	announcer := &fakeAnnouncer{}
+	p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), addrs, firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = announcer.announce
+	p.AnnounceInterval = time.Millisecond
+	p.checkModules = func() error { return nil }
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	vip := net.ParseIP("10.0.0.100")
+
+	// the annotations override the burst
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyGARPMasterRepeat] = "5"
+	lb.Annotations[core.AnnotationKeyGARPMasterRefresh] = "30"
+	assert.Nil(t, p.OnUpdate(lb))
+	schedule, ok := p.garp.Schedule("eth0", vip)
+	assert.True(t, ok)
+	assert.Equal(t, arp.Schedule{Repeat: 5, Interval: time.Millisecond, Refresh: 30 * time.Second, RefreshRepeat: 1}, schedule)
+	assert.Len(t, announcer.waitCalls(5), 5)
+
+	// the new values apply without rebinding nor announcing the vip
+	lb.Annotations[core.AnnotationKeyGARPMasterDelay] = "10"
+	lb.Annotations[core.AnnotationKeyGARPMasterRefreshRepeat] = "2"
+	assert.Nil(t, p.OnUpdate(lb))
+	schedule, _ = p.garp.Schedule("eth0", vip)
+	assert.Equal(t, arp.Schedule{Repeat: 5, Interval: time.Millisecond, Delay: 10 * time.Second, Refresh: 30 * time.Second, RefreshRepeat: 2}, schedule)
+	assert.Empty(t, announcer.waitCalls(0))
+
+	lb.Annotations[core.AnnotationKeyGARPMasterRepeat] = "0"
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	// the vips on the loopback are never announced
+	assert.Nil(t, p.Stop())
+	p = newIpvsProvider("lo", coreipvs.NewFakeHandle(), corenet.NewFakeAddrHandle(), firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = announcer.announce
+	p.AnnounceBurst = 0
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	lb.Annotations[core.AnnotationKeyGARPMasterRepeat] = "5"
+	assert.Nil(t, p.OnUpdate(lb))
+	_, ok = p.garp.Schedule("lo", vip)
+	assert.False(t, ok)
+	assert.Empty(t, announcer.waitCalls(0))
+}
+
+func TestWaitForStart(t *testing.T) {
+	p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), corenet.NewFakeAddrHandle(), firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.checkModules = func() error { return fmt.Errorf("ipvs is not available") }
+	p.Start()
+	assert.False(t, p.WaitForStart())
+	assert.EqualError(t, p.Healthz(), "ipvs is not available")
+}
+
+func TestOnUpdateSourceRanges(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+	ipt := firewall.NewFakeIPTables(false)
+	p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), corenet.NewFakeAddrHandle(), ipt, firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceBurst = 0
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+
+	for _, c := range []struct {
+		name   string
+		ranges string
+		rules  []string
+	}{
+		{"added", "10.1.0.0/16,192.168.0.0/24", []string{
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 10.1.0.0/16 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 192.168.0.0/24 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -j DROP",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -s 10.1.0.0/16 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -s 192.168.0.0/24 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -j DROP",
+		}},
+		{"shrunk", "192.168.0.0/24", []string{
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -s 192.168.0.0/24 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 80 -j DROP",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -s 192.168.0.0/24 -j RETURN",
+			"-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -j DROP",
+		}},
+		{"removed", "", nil},
+	} {
+		lb := newTestLoadBalancer("node1")
+		lb.Annotations[core.AnnotationKeySourceRanges] = c.ranges
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Equal(t, c.rules, ipt.Rules("filter", firewall.AllowChain), c.name)
+	}
+
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeySourceRanges] = "10.1.0.0/16,10.2.0.0"
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	// the rules of the changed vip are moved
+	lb = newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeySourceRanges] = "10.1.0.0/16"
+	assert.Nil(t, p.OnUpdate(lb))
+	lb.Spec.Providers.Ipvsdr.Vip = "10.0.0.101"
+	assert.Nil(t, p.OnUpdate(lb))
+	for _, rule := range ipt.Rules("filter", firewall.AllowChain) {
+		assert.Contains(t, rule, "-d 10.0.0.101/32")
+	}
+
+	assert.Nil(t, p.Stop())
+	assert.False(t, ipt.HasChain("filter", firewall.AllowChain))
+}
+
+func TestOnUpdateRateLimit(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+	ipt := firewall.NewFakeIPTables(false)
+	p := newIpvsProvider("eth0", coreipvs.NewFakeHandle(), corenet.NewFakeAddrHandle(), ipt, firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceBurst = 0
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+
+	for _, c := range []struct {
+		name      string
+		rateLimit string
+		rules     []string
+	}{
+		{"added", `{"maxConnections":1000,"ports":[{"port":443,"maxConnections":100}]}`, []string{
+			`-d 10.0.0.100/32 -m conntrack --ctstate NEW -m connlimit --connlimit-above 1000 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 all max-connections" -j DROP`,
+			`-d 10.0.0.100/32 -p tcp -m tcp --dport 443 -m conntrack --ctstate NEW -m connlimit --connlimit-above 100 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 tcp/443 max-connections" -j DROP`,
+		}},
+		{"changed", `{"maxConnections":2000}`, []string{
+			`-d 10.0.0.100/32 -m conntrack --ctstate NEW -m connlimit --connlimit-above 2000 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 all max-connections" -j DROP`,
+		}},
+		{"removed", "", nil},
+	} {
+		lb := newTestLoadBalancer("node1")
+		if c.rateLimit != "" {
+			lb.Annotations[core.AnnotationKeyRateLimit] = c.rateLimit
+		}
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Equal(t, c.rules, ipt.Rules("filter", firewall.LimitChain), c.name)
+	}
+
+	// the ports of the limits must be served
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyRateLimit] = `{"ports":[{"port":8080,"maxConnections":100}]}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	assert.Nil(t, p.Stop())
+	assert.False(t, ipt.HasChain("filter", firewall.LimitChain))
+}
+
+// newEndpointsTestEndpoints returns the Endpoints of web with the ready
+// and not ready pods
+func newEndpointsTestEndpoints(ready []string, notReady ...string) *v1.Endpoints {
+	subset := v1.EndpointSubset{Ports: []v1.EndpointPort{{Name: "http", Port: 8080}}}
+	for _, ip := range ready {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: ip})
+	}
+	for _, ip := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, v1.EndpointAddress{IP: ip})
+	}
+	return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}, Subsets: []v1.EndpointSubset{subset}}
+}
+
+func TestOnUpdateEndpointPorts(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+	nodes.Add(newTestNode("node2", "192.168.1.2"))
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	services.Add(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}}},
+	})
+	endpoints := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	// the kernel parameters are kept in memory
+	conntrack := "/proc/sys/net/ipv4/vs/conntrack"
+	files := map[string]string{conntrack: "0\n"}
+	fs := &mocks.FSWriter{
+		ReadFileFunc: func(filename string) ([]byte, error) {
+			value, ok := files[filename]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return []byte(value), nil
+		},
+		WriteFileFunc: func(filename string, data []byte, perm os.FileMode) error {
+			files[filename] = string(data)
+			return nil
+		},
+	}
+
+	handle := coreipvs.NewFakeHandle()
+	ipt := firewall.NewFakeIPTables(false)
+	p := newIpvsProvider("eth0", handle, corenet.NewFakeAddrHandle(), ipt, firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceBurst = 0
+	p.sysctl = coresysctl.NewFSManager(fs, coresysctl.DefaultRoot)
+	p.SetListers(core.StoreLister{
+		Node:      v1listers.NewNodeLister(nodes),
+		Service:   v1listers.NewServiceLister(services),
+		Endpoints: v1listers.NewEndpointsLister(endpoints),
+	})
+
+	// port 80 routes to the pods, port 443 to the nodes
+	lb := newTestLoadBalancer("node1", "node2")
+	lb.Annotations[core.AnnotationKeyEndpointPorts] = `[{"protocol":"tcp","port":80,"service":"web","servicePort":80}]`
+	for _, c := range []struct {
+		name      string
+		endpoints *v1.Endpoints
+		want      string
+	}{
+		{"no endpoints", nil, "TCP/10.0.0.100:80 rr"},
+		{"pods created", newEndpointsTestEndpoints([]string{"10.244.1.2", "10.244.1.1"}), "TCP/10.0.0.100:80 rr 10.244.1.1:8080:1 10.244.1.2:8080:1"},
+		{"pod replaced", newEndpointsTestEndpoints([]string{"10.244.1.2", "10.244.2.1"}), "TCP/10.0.0.100:80 rr 10.244.1.2:8080:1 10.244.2.1:8080:1"},
+		{"pod not ready", newEndpointsTestEndpoints([]string{"10.244.2.1"}, "10.244.1.2"), "TCP/10.0.0.100:80 rr 10.244.2.1:8080:1"},
+		{"ipv6 pod", newEndpointsTestEndpoints([]string{"10.244.2.1", "fd00::1"}), "TCP/10.0.0.100:80 rr 10.244.2.1:8080:1"},
+		{"pods deleted", newEndpointsTestEndpoints(nil), "TCP/10.0.0.100:80 rr"},
+	} {
+		if c.endpoints != nil {
+			endpoints.Update(c.endpoints)
+		}
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		assert.Equal(t, []string{
+			"TCP/10.0.0.100:443 rr 192.168.1.1:443:100 192.168.1.2:443:100",
+			c.want,
+		}, ipvsState(t, handle), c.name)
+	}
+	for _, vs := range p.virtualServers {
+		for _, rs := range vs.RealServers {
+			if vs.Port == 80 {
+				assert.Equal(t, coreipvs.ForwardingMethodNAT, rs.ForwardingMethod)
+			} else {
+				assert.Equal(t, coreipvs.ForwardingMethodDR, rs.ForwardingMethod)
+			}
+		}
+	}
+	assert.Equal(t, []string{
+		"-m ipvs --ipvs --vaddr 10.0.0.100/32 --vport 80 --vproto tcp --vmethod MASQ -j MASQUERADE",
+	}, ipt.Rules("nat", firewall.MasqueradeChain))
+	assert.Equal(t, "1", files[conntrack])
+
+	// the endpoint ports must be served by existing Services
+	lb.Annotations[core.AnnotationKeyEndpointPorts] = `[{"protocol":"udp","port":80,"service":"web","servicePort":80}]`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+	lb.Annotations[core.AnnotationKeyEndpointPorts] = `[{"protocol":"tcp","port":80,"service":"api","servicePort":80}]`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	// back to the nodes
+	delete(lb.Annotations, core.AnnotationKeyEndpointPorts)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{
+		"TCP/10.0.0.100:443 rr 192.168.1.1:443:100 192.168.1.2:443:100",
+		"TCP/10.0.0.100:80 rr 192.168.1.1:80:100 192.168.1.2:80:100",
+	}, ipvsState(t, handle))
+	assert.Empty(t, ipt.Rules("nat", firewall.MasqueradeChain))
+
+	assert.Nil(t, p.Stop())
+	assert.False(t, ipt.HasChain("nat", firewall.MasqueradeChain))
+	assert.Equal(t, "0", files[conntrack])
+	assert.Equal(t, []mocks.Call{
+		{Method: "WriteFile", Args: []interface{}{conntrack, []byte("1"), os.FileMode(0640)}},
+		{Method: "WriteFile", Args: []interface{}{conntrack, []byte("0"), os.FileMode(0640)}},
+	}, fs.Calls("WriteFile"))
+}
+
+func TestPortHealth(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1"))
+
+	handle := coreipvs.NewFakeHandle()
+	p := newIpvsProvider("eth0", handle, corenet.NewFakeAddrHandle(), firewall.NewFakeIPTables(false), firewall.NewFakeIPTables(true))
+	p.announce = (&fakeAnnouncer{}).announce
+	p.AnnounceInterval = 0
+	healthy := true
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes), Healthy: func(net.IP) bool { return healthy }})
+
+	// nothing served yet
+	assert.Empty(t, p.PortHealth())
+
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80},{"protocol":"udp","port":53}]`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Healthy: true},
+		{Protocol: "udp", Port: 53, Healthy: true},
+	}, p.PortHealth())
+
+	// the real servers are weighted to zero
+	healthy = false
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Reason: "virtual server TCP/10.0.0.100:80 has no ready real server"},
+		{Protocol: "udp", Port: 53, Reason: "virtual server UDP/10.0.0.100:53 has no ready real server"},
+	}, p.PortHealth())
+
+	// the rules are flushed behind the provider
+	healthy = true
+	assert.Nil(t, p.OnUpdate(lb))
+	vss, _ := handle.GetVirtualServers()
+	for _, vs := range vss {
+		if vs.Protocol == coreipvs.ProtocolUDP {
+			assert.Nil(t, handle.DeleteVirtualServer(vs))
+		}
+	}
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Healthy: true},
+		{Protocol: "udp", Port: 53, Reason: "virtual server UDP/10.0.0.100:53 is not in the kernel"},
+	}, p.PortHealth())
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// DefaultVIPRecordPath is the default file recording the VIPs bound by the
+// provider, it is next to the record of the owned virtual servers
+var DefaultVIPRecordPath = filepath.Join(filepath.Dir(coreipvs.DefaultRecordPath), "ipvs-vips.json")
+
+// recordedVIP is a VIP on its link in the record file
+type recordedVIP struct {
+	Link string `json:"link"`
+	IP   string `json:"ip"`
+}
+
+// vipRecord is the content of the record file
+type vipRecord struct {
+	VIPs []recordedVIP `json:"vips"`
+}
+
+// loadVIPRecord owns the VIPs in the record file at path again and records
+// the owned VIPs there from now on. The IPv4 VIPs are recognized by our
+// label as well, the record is what keeps the IPv6 ones and the ones on the
+// links which are not configured any more.
+func (p *IpvsProvider) loadVIPRecord(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vipRecordPath = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	record := vipRecord{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("invalid vip record %s: %v", path, err)
+	}
+	for _, v := range record.VIPs {
+		ip := net.ParseIP(v.IP)
+		if ip == nil || v.Link == "" {
+			return fmt.Errorf("invalid vip record %s: invalid vip %s on %q", path, v.IP, v.Link)
+		}
+		addr := corenet.NewAddr(ip, v.Link)
+		if ip.To4() != nil {
+			addr.Label = ownerLabel(v.Link)
+		}
+		p.owned[vipKey(addr)] = addr
+	}
+	p.vipRecorded = p.recordedVIPs()
+	return nil
+}
+
+// saveVIPRecord writes the owned VIPs to the record file if they are
+// changed
+func (p *IpvsProvider) saveVIPRecord() error {
+	if p.vipRecordPath == "" {
+		return nil
+	}
+	vips := p.recordedVIPs()
+	if reflect.DeepEqual(vips, p.vipRecorded) {
+		return nil
+	}
+
+	data, err := json.Marshal(vipRecord{VIPs: vips})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.vipRecordPath), 0755); err != nil {
+		return err
+	}
+	if err := fsutil.WriteFileAtomic(p.vipRecordPath, data, 0644); err != nil {
+		return fmt.Errorf("write vip record %s error: %v", p.vipRecordPath, err)
+	}
+	p.vipRecorded = vips
+	return nil
+}
+
+// recordedVIPs returns the owned VIPs sorted by their keys
+func (p *IpvsProvider) recordedVIPs() []recordedVIP {
+	ret := make([]recordedVIP, 0, len(p.owned))
+	for _, key := range sortedAddrKeys(p.owned) {
+		addr := p.owned[key]
+		ret = append(ret, recordedVIP{Link: addr.Link, IP: addr.IP.String()})
+	}
+	return ret
+}
+
+func sortedAddrKeys(m map[string]corenet.Addr) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedLinks(m map[string]bool) []string {
+	links := make([]string, 0, len(m))
+	for link := range m {
+		links = append(links, link)
+	}
+	sort.Strings(links)
+	return links
+}
@@ -0,0 +1,5 @@
+#!/bin/sh
+# check-healthz.sh is the track script of keepalived, it fails if the
+# health endpoint of the provider at $1 does not answer 200 within $2
+# seconds, so the node gives up the vips before the users notice.
+exec wget -q -T "${2:-2}" -O /dev/null "$1"
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"sort"
@@ -26,7 +27,13 @@ import (
 	"time"
 
 	"github.com/caicloud/loadbalancer-controller/pkg/tprclient"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/vrrp"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/core/provider/chaos"
+	"github.com/caicloud/loadbalancer-provider/core/provider/replay"
+	"github.com/caicloud/loadbalancer-provider/core/provider/tpr"
+	"github.com/caicloud/loadbalancer-provider/core/provider/validate"
 	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr/provider"
 	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr/version"
 	log "github.com/zoumo/logdog"
@@ -35,6 +42,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -92,7 +100,31 @@ func Run(opts *Options) error {
 		return fmt.Errorf("no ipvsdr spec specified")
 	}
 
-	nodeIP, err := getNodeIP(clientset, opts.PodName, opts.PodNamespace)
+	addressTypes, err := core.ParseAddressTypes(opts.NodeAddressTypes)
+	if err != nil {
+		log.Error("invalid node address types", log.Fields{"err": err})
+		return err
+	}
+
+	weightPolicy, err := core.ParseWeightPolicy(opts.WeightPolicy)
+	if err != nil {
+		log.Error("invalid weight policy", log.Fields{"err": err})
+		return err
+	}
+
+	eligibilityPolicy, err := core.ParseEligibilityPolicy(opts.ExcludedNodeRoles, opts.ExcludedNodeTaints)
+	if err != nil {
+		log.Error("invalid node eligibility policy", log.Fields{"err": err})
+		return err
+	}
+
+	unicastPeers, err := parseUnicastPeers(opts.UnicastPeers)
+	if err != nil {
+		log.Error("invalid unicast peers", log.Fields{"err": err})
+		return err
+	}
+
+	nodeName, nodeIP, err := getNodeIP(clientset, opts.PodName, opts.PodNamespace, core.NewAddressPolicy(addressTypes))
 	if err != nil {
 		log.Fatal("Can not get node ip", log.Fields{"err": err})
 		return err
@@ -115,18 +147,74 @@ func Run(opts *Options) error {
 		log.Error("Create ipvsdr provider error", log.Fields{"err": err})
 		return err
 	}
+	ipvsdr.FlushConntrackOnFailover = opts.FlushConntrack
+	ipvsdr.DrainTimeout = opts.DrainTimeout
+	ipvsdr.DrainThreshold = opts.DrainThreshold
+	ipvsdr.UnicastPeers = unicastPeers
+	ipvsdr.PeerDebounce = opts.PeerDebounce
+	ipvsdr.VRIDConflictDetection = opts.VRIDConflictDetection
+	if opts.VRIDAllocations != "" {
+		namespace, name, err := cache.SplitMetaNamespaceKey(opts.VRIDAllocations)
+		if err != nil || namespace == "" {
+			namespace, name = opts.LoadBalancerNamespace, opts.VRIDAllocations
+		}
+		ipvsdr.VRIDAllocator = vrrp.NewAllocator(clientset.CoreV1().ConfigMaps(namespace), name)
+	}
+	ipvsdr.DriftCheckInterval = opts.ConfigCheckInterval
+	ipvsdr.RepairDrift = opts.RepairConfig
+	ipvsdr.NodeName = nodeName
+	ipvsdr.TrafficStatusInterval = opts.TrafficStatusInterval
+	if opts.HTTPAddress != "" {
+		url, err := healthzURL(opts.HTTPAddress)
+		if err != nil {
+			return err
+		}
+		ipvsdr.HealthzURL = url
+	}
+
+	backend, err := chaos.Wrap(ipvsdr, opts.Chaos)
+	if err != nil {
+		log.Error("invalid chaos policy", log.Fields{"err": err})
+		return err
+	}
 
-	lp := core.NewLoadBalancerProvider(&core.Configuration{
+	lp, err := tpr.NewLoadBalancerProvider(&core.Configuration{
 		KubeClient:            clientset,
-		TPRClient:             tprclientset,
-		Backend:               ipvsdr,
+		Backend:               backend,
+		RecordPath:            opts.Record,
 		LoadBalancerName:      opts.LoadBalancerName,
 		LoadBalancerNamespace: opts.LoadBalancerNamespace,
-	})
+		NodeIP:                nodeIP,
+		NodeName:              nodeName,
+		ExpectedMTU:           opts.ExpectedMTU,
+		SkipMTUCheck:          opts.SkipMTUCheck,
+		AddressTypes:          addressTypes,
+		LooseRPFilter:         opts.LooseRPFilter,
+		WeightPolicy:          weightPolicy,
+		EligibilityPolicy:     eligibilityPolicy,
+		HealthCheckInterval:   opts.HealthCheckInterval,
+		HealthCheckWorkers:    opts.HealthCheckWorkers,
+		VerifyReachability:    opts.VerifyReachability,
+		ReportServiceStatus:   opts.ReportServiceStatus,
+		AddressPools:          opts.AddressPools,
+		// the Local traffic policy follows the Endpoints of the Services
+		WatchServices: true,
+	}, tprclientset)
+	if err != nil {
+		log.Error("create loadbalancer provider error", log.Fields{"err": err})
+		return err
+	}
 
 	// handle shutdown
 	go handleSigterm(lp)
 
+	if opts.HTTPAddress != "" {
+		go serveHTTP(opts.HTTPAddress, lp, ipvsdr)
+	}
+	if opts.NodeHealthAddress != "" {
+		go serveNodeHealth(opts.NodeHealthAddress, lp)
+	}
+
 	lp.Start()
 
 	// never stop until sigterm processed
@@ -148,6 +236,8 @@ func main() {
 	opts := NewOptions()
 	opts.AddFlags(app)
 
+	app.Commands = []cli.Command{validate.Command(&provider.IpvsdrProvider{}), replay.Command(&provider.IpvsdrProvider{})}
+
 	app.Action = func(c *cli.Context) error {
 		if err := Run(opts); err != nil {
 			msg := fmt.Sprintf("running loadbalancer controller failed, with err: %v\n", err)
@@ -161,6 +251,24 @@ func main() {
 	app.Run(os.Args)
 }
 
+func serveHTTP(address string, p *core.GenericProvider, ipvsdr *provider.IpvsdrProvider) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", p.HealthzHandler())
+	mux.Handle("/version", p.VersionHandler())
+	mux.Handle("/state", p.StateHandler())
+	mux.Handle("/debug/health-checks", p.HealthCheckHandler())
+	mux.Handle("/vrrp", ipvsdr.VRRPHandler())
+	log.Info("Serving http", log.Fields{"address": address})
+	err := http.ListenAndServe(address, mux)
+	log.Error("serve http error", log.Fields{"address": address, "err": err})
+}
+
+func serveNodeHealth(address string, p *core.GenericProvider) {
+	err := p.ServeNodeHealth(address)
+	log.Error("serve node health error", log.Fields{"address": address, "err": err})
+}
+
 func handleSigterm(p *core.GenericProvider) {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGTERM)
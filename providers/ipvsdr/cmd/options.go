@@ -16,15 +16,48 @@ limitations under the License.
 
 package main
 
-import cli "gopkg.in/urfave/cli.v1"
+import (
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/healthcheck"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr/provider"
+	cli "gopkg.in/urfave/cli.v1"
+)
 
 // Options contains controller options
 type Options struct {
 	Debug                 bool
 	Unicast               bool
+	FlushConntrack        bool
+	ExpectedMTU           int
+	SkipMTUCheck          bool
+	NodeAddressTypes      string
+	LooseRPFilter         bool
+	WeightPolicy          string
+	ExcludedNodeRoles     string
+	ExcludedNodeTaints    string
+	HealthCheckInterval   time.Duration
+	HealthCheckWorkers    int
+	DrainTimeout          time.Duration
+	DrainThreshold        int
+	VerifyReachability    bool
+	UnicastPeers          string
+	PeerDebounce          time.Duration
+	VRIDConflictDetection time.Duration
+	VRIDAllocations       string
+	ConfigCheckInterval   time.Duration
+	RepairConfig          bool
+	ReportServiceStatus   bool
+	TrafficStatusInterval time.Duration
+	AddressPools          string
+	HTTPAddress           string
+	NodeHealthAddress     string
 	Kubeconfig            string
 	LoadBalancerNamespace string
 	LoadBalancerName      string
+	Chaos                 string
+	Record                string
 	PodNamespace          string
 	PodName               string
 }
@@ -53,6 +86,137 @@ func (opts *Options) AddFlags(app *cli.App) {
 			Usage:       "use unicast instead of multicast for communication with other keepalived instances",
 			Destination: &opts.Unicast,
 		},
+		cli.StringFlag{
+			Name:        "unicast-peers",
+			Usage:       "comma separated addresses of the unicast peers of keepalived, defaults to the addresses of the other nodes of the loadbalancer",
+			Destination: &opts.UnicastPeers,
+		},
+		cli.DurationFlag{
+			Name:        "peer-debounce",
+			Value:       provider.DefaultPeerDebounce,
+			Usage:       "the time a changed set of peers must stay unchanged before keepalived is reloaded with it, 0 applies the changes immediately",
+			Destination: &opts.PeerDebounce,
+		},
+		cli.DurationFlag{
+			Name:        "vrid-conflict-detection",
+			Usage:       "listen for the vrrp advertisements of other instances using the vrid for the duration before starting keepalived, a conflict fails the sync with an event, 0 disables it. It requires CAP_NET_RAW",
+			Destination: &opts.VRIDConflictDetection,
+		},
+		cli.StringFlag{
+			Name:        "vrid-allocations",
+			Usage:       "the namespace/name of the configmap the vrid is allocated from by the uid of the loadbalancer instead of using the one in the loadbalancer status, which is preferred then, the namespace defaults to the one of the loadbalancer, empty disables the allocation",
+			Destination: &opts.VRIDAllocations,
+		},
+		cli.DurationFlag{
+			Name:        "keepalived-config-check-interval",
+			Value:       provider.DefaultDriftCheckInterval,
+			Usage:       "the interval of checking the keepalived configuration on disk for the changes made out of band besides watching it, 0 only watches it",
+			Destination: &opts.ConfigCheckInterval,
+		},
+		cli.BoolFlag{
+			Name:        "repair-keepalived-config",
+			Usage:       "rewrite the keepalived configuration and reload keepalived when it is changed out of band, the changes are only reported otherwise",
+			Destination: &opts.RepairConfig,
+		},
+		cli.DurationFlag{
+			Name:        "traffic-status-interval",
+			Value:       provider.DefaultTrafficStatusInterval,
+			Usage:       "the interval of reporting the active connections of the real servers through this node in the loadbalancer status, 0 disables it",
+			Destination: &opts.TrafficStatusInterval,
+		},
+		cli.BoolFlag{
+			Name:        "flush-conntrack-on-failover",
+			Usage:       "flush the conntrack entries of the vip when this node becomes master, it breaks the flows established through this node",
+			Destination: &opts.FlushConntrack,
+		},
+		cli.IntFlag{
+			Name:        "expected-mtu",
+			Usage:       "the MTU all nodes of the loadbalancer should have, defaults to the MTU of this node",
+			Destination: &opts.ExpectedMTU,
+		},
+		cli.BoolFlag{
+			Name:        "skip-mtu-check",
+			Usage:       "do not check the MTU consistency of the nodes of the loadbalancer",
+			Destination: &opts.SkipMTUCheck,
+		},
+		cli.StringFlag{
+			Name:        "node-address-types",
+			Value:       "ExternalIP,InternalIP",
+			Usage:       "the preference of the node address types used as the real servers, overridden by the node annotation loadbalancer.caicloud.io/real-server-ip",
+			Destination: &opts.NodeAddressTypes,
+		},
+		cli.BoolFlag{
+			Name:        "loose-rp-filter",
+			Usage:       "set the strict reverse path filtering of the interfaces serving the vip to loose, and restore it on exit",
+			Destination: &opts.LooseRPFilter,
+		},
+		cli.StringFlag{
+			Name:        "weight-policy",
+			Value:       "DiskPressure=0.5,MemoryPressure=0.5,NotReady=0,Unschedulable=0.5",
+			Usage:       "the factors the weight of a node is multiplied by when the conditions hold, the base weight is set by the node annotation loadbalancer.caicloud.io/weight",
+			Destination: &opts.WeightPolicy,
+		},
+		cli.StringFlag{
+			Name:        "excluded-node-roles",
+			Value:       "master,control-plane",
+			Usage:       "the node-role.kubernetes.io roles of the nodes excluded from the real servers, unless the loadbalancer annotation loadbalancer.caicloud.io/include-ineligible-nodes is true",
+			Destination: &opts.ExcludedNodeRoles,
+		},
+		cli.StringFlag{
+			Name:        "excluded-node-taints",
+			Value:       ":NoSchedule,:NoExecute",
+			Usage:       "the taints key[=value][:effect] of the nodes excluded from the real servers, the ones without a key do not match the node.kubernetes.io taints",
+			Destination: &opts.ExcludedNodeTaints,
+		},
+		cli.DurationFlag{
+			Name:        "health-check-interval",
+			Value:       healthcheck.DefaultInterval,
+			Usage:       "the interval of the health checks of the real servers set by the loadbalancer annotation loadbalancer.caicloud.io/health-checks",
+			Destination: &opts.HealthCheckInterval,
+		},
+		cli.IntFlag{
+			Name:        "health-check-workers",
+			Value:       healthcheck.DefaultWorkers,
+			Usage:       "the maximum number of concurrent health check probes",
+			Destination: &opts.HealthCheckWorkers,
+		},
+		cli.DurationFlag{
+			Name:        "drain-timeout",
+			Value:       coreipvs.DefaultDrainTimeout,
+			Usage:       "the maximum time a removed node keeps its established connections with zero weight before it is deleted from the real servers, 0 deletes it immediately",
+			Destination: &opts.DrainTimeout,
+		},
+		cli.IntFlag{
+			Name:        "drain-threshold",
+			Usage:       "a draining node is deleted from the real servers once its active connections drop to the threshold",
+			Destination: &opts.DrainThreshold,
+		},
+		cli.BoolFlag{
+			Name:        "verify-reachability",
+			Usage:       "probe the ports of the vip through the uplink after every sync, the result is in the loadbalancer annotation loadbalancer.caicloud.io/reachability-condition",
+			Destination: &opts.VerifyReachability,
+		},
+		cli.BoolFlag{
+			Name:        "report-service-status",
+			Usage:       "set the vips on the status of the services of type LoadBalancer listed in the loadbalancer annotation loadbalancer.caicloud.io/services or proxied to, which are annotated with loadbalancer.caicloud.io/loadbalancer: <loadbalancer name>",
+			Destination: &opts.ReportServiceStatus,
+		},
+		cli.StringFlag{
+			Name:        "address-pools",
+			Usage:       "the namespace/name of the configmap of the address pools the vip is allocated from when it is empty and the loadbalancer annotation loadbalancer.caicloud.io/address-pool names a pool, the namespace defaults to the one of the loadbalancer, empty disables the allocation",
+			Destination: &opts.AddressPools,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Value:       ":10254",
+			Usage:       "the address serving /metrics, /healthz and /debug/health-checks, which the vrrp track script checks, empty disables it",
+			Destination: &opts.HTTPAddress,
+		},
+		cli.StringFlag{
+			Name:        "node-health-address",
+			Usage:       "the address serving the health of the node for the loadbalancer on /healthz/<namespace>/<name> or the loadbalancer annotation loadbalancer.caicloud.io/node-health-path, empty disables it",
+			Destination: &opts.NodeHealthAddress,
+		},
 		cli.StringFlag{
 			Name:        "loadbalancer-namespace",
 			EnvVar:      "LOADBALANCER_NAMESPACE",
@@ -65,6 +229,16 @@ func (opts *Options) AddFlags(app *cli.App) {
 			Usage:       "specify loadbalancer resource name",
 			Destination: &opts.LoadBalancerName,
 		},
+		cli.StringFlag{
+			Name:        "chaos",
+			Usage:       "the policy of the faults injected into the backend for resilience testing, e.g. seed=42,update-error-rate=0.1,latency=uniform:10ms-200ms, never set it in production",
+			Destination: &opts.Chaos,
+		},
+		cli.StringFlag{
+			Name:        "record",
+			Usage:       "the file the inputs and the results of the syncs are recorded to, with the secrets redacted, for replaying them offline with the replay command, empty disables it",
+			Destination: &opts.Record,
+		},
 		cli.StringFlag{
 			Name:        "pod-namespace",
 			EnvVar:      "POD_NAMESPACE",
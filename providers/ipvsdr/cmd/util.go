@@ -20,8 +20,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 
-	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr/provider"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	log "github.com/zoumo/logdog"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -29,27 +30,28 @@ import (
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 )
 
-func getNodeIP(client kubernetes.Interface, podName, podNamespace string) (net.IP, error) {
+// getNodeIP returns the name and the address of the node the pod runs on
+func getNodeIP(client kubernetes.Interface, podName, podNamespace string, policy *core.AddressPolicy) (string, net.IP, error) {
 	if podName == "" || podNamespace == "" {
-		return nil, fmt.Errorf("Please check the manifest (for missing POD_NAME or POD_NAMESPACE env variables)")
+		return "", nil, fmt.Errorf("Please check the manifest (for missing POD_NAME or POD_NAMESPACE env variables)")
 	}
 
 	pod, err := client.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get pod: %s", err)
+		return "", nil, fmt.Errorf("Unable to get pod: %s", err)
 	}
 
 	node, err := client.CoreV1().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("Unable to get node: %s", err)
+		return "", nil, fmt.Errorf("Unable to get node: %s", err)
 	}
 
-	ip, err := provider.GetNodeHostIP(node)
+	ip, err := policy.NodeIP(node, "")
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	return ip, nil
+	return node.Name, ip, nil
 }
 
 // loadIPVSModule load module require to use keepalived
@@ -73,3 +75,36 @@ func resetIPVS() error {
 
 	return nil
 }
+
+// parseUnicastPeers parses the comma separated addresses of the unicast peers
+func parseUnicastPeers(s string) ([]string, error) {
+	peers := []string{}
+	for _, peer := range strings.Split(s, ",") {
+		peer = strings.TrimSpace(peer)
+		if peer == "" {
+			continue
+		}
+		ip := net.ParseIP(peer)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer address %q", peer)
+		}
+		peers = append(peers, ip.String())
+	}
+	return peers, nil
+}
+
+// healthzURL returns the local url of /healthz served on the http address,
+// the unspecified host is the loopback
+func healthzURL(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid http address %q: %v", address, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/healthz", nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/mocks"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/tc"
+	"github.com/stretchr/testify/assert"
+)
+
+// tcCommands returns the tc commands run by the mock
+func tcCommands(runner *mocks.TCRunner) []string {
+	cmds := make([]string, 0)
+	for _, c := range runner.Calls() {
+		cmds = append(cmds, strings.Join(c.Args[0].([]string), " "))
+	}
+	return cmds
+}
+
+func TestEnsureBandwidth(t *testing.T) {
+	runner := &mocks.TCRunner{}
+	p := &IpvsdrProvider{
+		nodeInfo:  &nodeInfo{iface: "eth0"},
+		vips:      []net.IP{net.ParseIP("10.0.0.100"), net.ParseIP("2001:db8::1")},
+		bandwidth: tc.NewManager("eth0", runner),
+	}
+
+	// tc is not required until a limit is set
+	assert.Nil(t, p.ensureBandwidth(0, 0))
+	assert.Empty(t, runner.Calls())
+
+	// the IPv6 vip is not limited
+	assert.Nil(t, p.ensureBandwidth(1000000, 2000000))
+	assert.True(t, p.bandwidthLimited)
+	assert.Equal(t, []string{
+		"qdisc show dev eth0",
+		"qdisc replace dev eth0 root handle 1ff: htb default 0",
+		"class add dev eth0 parent 1ff: classid 1ff:b6cc htb rate 2000000bit ceil 2000000bit",
+		"filter add dev eth0 parent 1ff: protocol ip prio 46796 u32 match ip src 10.0.0.100/32 flowid 1ff:b6cc",
+		"qdisc add dev eth0 handle ffff: ingress",
+		"filter add dev eth0 parent ffff: protocol ip prio 46796 u32 match ip dst 10.0.0.100/32 police rate 1000000bit burst 15140 drop flowid :1",
+	}, tcCommands(runner))
+}
+
+func TestEnsureBandwidthError(t *testing.T) {
+	runner := &mocks.TCRunner{RunFunc: func(args ...string) ([]byte, error) {
+		if args[1] == "show" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("tc %s error: exit status 2", strings.Join(args, " "))
+	}}
+	p := &IpvsdrProvider{
+		nodeInfo:  &nodeInfo{iface: "eth0"},
+		vips:      []net.IP{net.ParseIP("10.0.0.100")},
+		bandwidth: tc.NewManager("eth0", runner),
+	}
+
+	// the limit is retried on the next update
+	assert.NotNil(t, p.ensureBandwidth(1000000, 0))
+	assert.False(t, p.bandwidthLimited)
+	assert.Equal(t, "qdisc show dev eth0", tcCommands(runner)[0])
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+)
+
+// drainRealServers returns the real servers of the family to configure:
+// the desired ones, followed by the removed ones which are still being
+// drained with zero weights. keepalived deletes the real servers missing
+// from the config on reload, so the draining ones are kept in it until
+// their connections drain or the timeout expires.
+func (p *IpvsdrProvider) drainRealServers(family corenet.Family, desired []realServer) []realServer {
+	if p.DrainTimeout <= 0 {
+		return desired
+	}
+	p.drainer.Timeout, p.drainer.Threshold = p.DrainTimeout, p.DrainThreshold
+
+	// the fwmark virtual server of the family in the kernel
+	vs := &coreipvs.VirtualServer{FWMark: acceptMark, Family: family}
+
+	desiredIPs := make(map[string]bool, len(desired))
+	for _, rs := range desired {
+		desiredIPs[rs.IP] = true
+		p.drainer.Forget(vs, toIpvsRealServer(rs))
+	}
+	stale := make([]coreipvs.RealServer, 0)
+	for _, rs := range p.realServers[family] {
+		if !desiredIPs[rs.IP] {
+			stale = append(stale, *toIpvsRealServer(rs))
+		}
+	}
+
+	ret := append([]realServer(nil), desired...)
+	for _, rs := range p.drainer.Drain(vs, stale) {
+		ret = append(ret, realServer{IP: rs.Address.String(), Weight: 0})
+	}
+	p.realServers[family] = ret
+	return ret
+}
+
+// Draining implements core.DrainingProvider
+func (p *IpvsdrProvider) Draining() bool {
+	return p.drainer.Len() > 0
+}
+
+func toIpvsRealServer(rs realServer) *coreipvs.RealServer {
+	return &coreipvs.RealServer{
+		Address:          net.ParseIP(rs.IP),
+		Weight:           rs.Weight,
+		ForwardingMethod: coreipvs.ForwardingMethodDR,
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainRealServers(t *testing.T) {
+	rs1 := realServer{IP: "192.168.1.1", Weight: 100}
+	rs2 := realServer{IP: "192.168.1.2", Weight: 100}
+
+	// the fwmark virtual server configured by keepalived
+	vs := coreipvs.VirtualServer{FWMark: acceptMark, Scheduler: "rr"}
+	for _, rs := range []realServer{rs1, rs2} {
+		vs.RealServers = append(vs.RealServers, coreipvs.RealServer{Address: net.ParseIP(rs.IP), Weight: rs.Weight, ForwardingMethod: coreipvs.ForwardingMethodDR})
+	}
+	handle := coreipvs.NewFakeHandle(vs)
+	handle.SetActiveConns(vs.Key(), "192.168.1.2:0", 5)
+
+	p := &IpvsdrProvider{
+		drainer:      coreipvs.NewDrainer(handle, 0, 0),
+		realServers:  make(map[corenet.Family][]realServer),
+		DrainTimeout: time.Minute,
+	}
+
+	assert.Equal(t, []realServer{rs1, rs2}, p.drainRealServers(corenet.FamilyIPv4, []realServer{rs1, rs2}))
+	assert.False(t, p.Draining())
+
+	// the removed node stays with zero weight while it has connections
+	assert.Equal(t, []realServer{rs1, {IP: rs2.IP}}, p.drainRealServers(corenet.FamilyIPv4, []realServer{rs1}))
+	assert.True(t, p.Draining())
+	assert.Equal(t, []realServer{rs1, {IP: rs2.IP}}, p.drainRealServers(corenet.FamilyIPv4, []realServer{rs1}))
+
+	handle.SetActiveConns(vs.Key(), "192.168.1.2:0", 0)
+	assert.Equal(t, []realServer{rs1}, p.drainRealServers(corenet.FamilyIPv4, []realServer{rs1}))
+	assert.False(t, p.Draining())
+
+	// draining is disabled
+	p.DrainTimeout = 0
+	assert.Equal(t, []realServer{rs1}, p.drainRealServers(corenet.FamilyIPv4, []realServer{rs1}))
+}
+
+func TestPortHealth(t *testing.T) {
+	vs := coreipvs.VirtualServer{
+		FWMark:      acceptMark,
+		Scheduler:   "rr",
+		RealServers: []coreipvs.RealServer{{Address: net.ParseIP("192.168.1.1"), Weight: 100, ForwardingMethod: coreipvs.ForwardingMethodDR}},
+	}
+	p := &IpvsdrProvider{
+		ipvsManager: coreipvs.NewManager(coreipvs.NewFakeHandle(vs)),
+	}
+	// not updated yet
+	assert.Nil(t, p.PortHealth())
+
+	// without the ports, all ports are reported alike
+	p.servedFamilies = []corenet.Family{corenet.FamilyIPv4}
+	assert.Equal(t, []core.PortHealth{{Healthy: true}}, p.PortHealth())
+
+	p.servedPorts = []corenet.Port{{Protocol: "tcp", Port: 80}, {Protocol: "udp", Port: 53}}
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Healthy: true},
+		{Protocol: "udp", Port: 53, Healthy: true},
+	}, p.PortHealth())
+
+	// keepalived has not installed the IPv6 virtual server
+	p.servedFamilies = append(p.servedFamilies, corenet.FamilyIPv6)
+	reason := "virtual server FWM6/1 is not in the kernel"
+	assert.Equal(t, []core.PortHealth{
+		{Protocol: "tcp", Port: 80, Reason: reason},
+		{Protocol: "udp", Port: 53, Reason: reason},
+	}, p.PortHealth())
+}
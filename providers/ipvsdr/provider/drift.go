@@ -0,0 +1,192 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// DefaultDriftCheckInterval is the period of checking the keepalived
+// configuration on disk, the changes missed by the file watcher are
+// detected by it
+const DefaultDriftCheckInterval = 30 * time.Second
+
+var keepalivedConfigDrifts = metrics.NewCounterVec(
+	"loadbalancer_provider_keepalived_config_drifts_total",
+	"Number of the changes of the keepalived configuration on disk made by others than the provider",
+)
+
+func init() {
+	metrics.MustRegister(keepalivedConfigDrifts)
+}
+
+// driftWatcher detects the changes of the keepalived configuration made by
+// others than the provider, e.g. the edits by hand on the node
+type driftWatcher struct {
+	// watch returns a channel notified when the file changes
+	watch func(path string, stopCh <-chan struct{}) (<-chan struct{}, error)
+
+	mu      sync.Mutex
+	onEvent func(eventtype, reason, message string)
+	// reported is the hash of the drifted configuration reported last, it
+	// is not reported again until the configuration changes
+	reported string
+}
+
+func newDriftWatcher() *driftWatcher {
+	return &driftWatcher{watch: watchFile}
+}
+
+func (d *driftWatcher) setEventHandler(handler func(eventtype, reason, message string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onEvent = handler
+}
+
+func (d *driftWatcher) event(eventtype, reason, message string) {
+	d.mu.Lock()
+	handler := d.onEvent
+	d.mu.Unlock()
+	if handler != nil {
+		handler(eventtype, reason, message)
+	}
+}
+
+// configHash returns the hash of the configuration
+func configHash(config []byte) string {
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:])
+}
+
+// watchDrift checks the configuration on disk whenever the file changes,
+// and every interval in case a change is missed, until keepalived is
+// stopped. The periodic check reads the file only if its size or
+// modification time changed. A drifted configuration is repaired if
+// repair is true, it is only reported otherwise.
+func (k *keepalived) watchDrift(interval time.Duration, repair bool) {
+	changes, err := k.drift.watch(k.cfgPath, k.stopCh)
+	if err != nil {
+		log.Warn("watch keepalived config error, checking it periodically only", log.Fields{"err": err})
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var last os.FileInfo
+	for {
+		select {
+		case <-k.stopCh:
+			return
+		case <-changes:
+		case <-tick:
+			info, err := os.Stat(k.cfgPath)
+			if err == nil && last != nil && info.Size() == last.Size() && info.ModTime().Equal(last.ModTime()) {
+				continue
+			}
+			last = info
+		}
+		k.checkDrift(repair)
+	}
+}
+
+// checkDrift compares the configuration on disk with the one written last,
+// nothing drifts before the first write. A drift is counted and reported
+// by an event once until the configuration on disk changes again. It is
+// repaired by writing the desired configuration and applying it to
+// keepalived if repair is true, in case keepalived has loaded the drifted
+// one. It returns true if the configuration drifted.
+func (k *keepalived) checkDrift(repair bool) bool {
+	k.cfgMu.Lock()
+	defer k.cfgMu.Unlock()
+
+	if k.config == nil {
+		return false
+	}
+	data, err := ioutil.ReadFile(k.cfgPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("read keepalived config error", log.Fields{"path": k.cfgPath, "err": err})
+		return false
+	}
+	hash := configHash(data)
+	if hash == k.configHash {
+		k.drift.reported = ""
+		return false
+	}
+	if !repair {
+		if hash != k.drift.reported {
+			k.drift.reported = hash
+			keepalivedConfigDrifts.Inc()
+			log.Warn("keepalived config drifted, not repairing it", log.Fields{"path": k.cfgPath})
+			k.drift.event(v1.EventTypeWarning, "KeepalivedConfigDrifted", fmt.Sprintf("keepalived configuration %s was changed out of band, it is not repaired", k.cfgPath))
+		}
+		return true
+	}
+
+	keepalivedConfigDrifts.Inc()
+	log.Warn("keepalived config drifted, repairing it", log.Fields{"path": k.cfgPath})
+	change := configReload
+	if restartKey(data) != restartKey(k.config) {
+		change = configRestart
+	}
+	err = fsutil.WriteFileAtomic(k.cfgPath, k.config, 0600)
+	if err == nil {
+		err = k.apply(change)
+	}
+	if err != nil {
+		log.Error("repair keepalived config error", log.Fields{"path": k.cfgPath, "err": err})
+		k.drift.event(v1.EventTypeWarning, "KeepalivedConfigDrifted", fmt.Sprintf("keepalived configuration %s was changed out of band, repairing it failed: %v", k.cfgPath, err))
+		return true
+	}
+	k.drift.event(v1.EventTypeWarning, "KeepalivedConfigRepaired", fmt.Sprintf("keepalived configuration %s was changed out of band, it is restored", k.cfgPath))
+	return true
+}
+
+// SetEventHandler implements core.EventProvider, the drifts of the
+// keepalived configuration and the restores of the VIPs are the events
+func (p *IpvsdrProvider) SetEventHandler(handler func(eventtype, reason, message string)) {
+	p.keepalived.drift.setEventHandler(handler)
+	p.eventLock.Lock()
+	defer p.eventLock.Unlock()
+	p.onEvent = handler
+}
+
+// event records the event on the LoadBalancer if the handler is set, it is
+// logged anyway
+func (p *IpvsdrProvider) event(eventtype, reason, message string) {
+	log.Info("address watcher event", log.Fields{"type": eventtype, "reason": reason, "message": message})
+	p.eventLock.Lock()
+	handler := p.onEvent
+	p.eventLock.Unlock()
+	if handler != nil {
+		handler(eventtype, reason, message)
+	}
+}
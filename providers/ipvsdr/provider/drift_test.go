@@ -0,0 +1,149 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (f *fakeEvents) handle(eventtype, reason, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, eventtype+" "+reason)
+}
+
+func (f *fakeEvents) get() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.events...)
+}
+
+func TestCheckDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	procs := &fakeProcesses{output: testReloadLog}
+	k.newProcess = procs.start
+	go k.run()
+	assert.Nil(t, waitRunning(k))
+	events := &fakeEvents{}
+	k.drift.setEventHandler(events.handle)
+
+	// nothing drifts before the first write
+	assert.False(t, k.checkDrift(true))
+
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+	change, err := k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, k.Apply(change))
+	desired, err := ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	// the writes of the provider are not drifts
+	assert.False(t, k.checkDrift(false))
+	drifts := keepalivedConfigDrifts.Get()
+
+	// the drift is reported once without repairing it
+	edited := strings.Replace(string(desired), "192.168.1.1 ", "192.168.1.9 ", 1)
+	assert.Nil(t, ioutil.WriteFile(k.cfgPath, []byte(edited), 0600))
+	assert.True(t, k.checkDrift(false))
+	assert.True(t, k.checkDrift(false))
+	assert.Equal(t, []string{"Warning KeepalivedConfigDrifted"}, events.get())
+	assert.Equal(t, drifts+1, keepalivedConfigDrifts.Get())
+	data, err := ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Equal(t, edited, string(data))
+	signals := len(procs.started()[len(procs.started())-1].Signals())
+
+	// the drift is repaired by a reload
+	assert.True(t, k.checkDrift(true))
+	assert.Equal(t, []string{"Warning KeepalivedConfigDrifted", "Warning KeepalivedConfigRepaired"}, events.get())
+	assert.Equal(t, drifts+2, keepalivedConfigDrifts.Get())
+	data, err = ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Equal(t, desired, data)
+	proc := procs.started()[len(procs.started())-1]
+	assert.Len(t, proc.Signals(), signals+1)
+	assert.Equal(t, syscall.SIGHUP, proc.Signals()[signals])
+	assert.False(t, k.checkDrift(true))
+
+	// a drift of the global definitions is repaired by a restart
+	started := len(procs.started())
+	assert.Nil(t, ioutil.WriteFile(k.cfgPath, []byte("global_defs {\n\n}\n"), 0600))
+	assert.True(t, k.checkDrift(true))
+	assert.Len(t, procs.started(), started+1)
+	assert.Equal(t, syscall.SIGTERM, proc.Signals()[len(proc.Signals())-1])
+	assert.False(t, k.checkDrift(false))
+}
+
+func TestWatchDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	changes := make(chan struct{}, 1)
+	k.drift.watch = func(path string, stopCh <-chan struct{}) (<-chan struct{}, error) {
+		return changes, nil
+	}
+	events := &fakeEvents{}
+	k.drift.setEventHandler(events.handle)
+	k.config = []byte("global_defs {\n\n}\n")
+	k.configHash = configHash(k.config)
+	assert.Nil(t, ioutil.WriteFile(k.cfgPath, k.config, 0600))
+	go k.watchDrift(0, false)
+	defer close(k.stopCh)
+
+	assert.Nil(t, ioutil.WriteFile(k.cfgPath, []byte("edited"), 0600))
+	changes <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for len(events.get()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"Warning KeepalivedConfigDrifted"}, events.get())
+}
+
+func TestSetEventHandler(t *testing.T) {
+	p := &IpvsdrProvider{keepalived: &keepalived{drift: newDriftWatcher()}}
+	p.addrWatcher = corenet.NewAddrWatcher(corenet.NewFakeAddrHandle(), p.event)
+	// the events before the handler is set are logged only
+	p.addrWatcher.Recorder("Normal", "VIPRestored", "address 10.0.0.100/32 on lo was restored")
+
+	events := &fakeEvents{}
+	p.SetEventHandler(events.handle)
+	p.addrWatcher.Recorder("Normal", "VIPRestored", "address 10.0.0.100/32 on lo was restored")
+	p.keepalived.drift.event("Warning", "KeepalivedConfigRepaired", "repaired")
+	assert.Equal(t, []string{"Normal VIPRestored", "Warning KeepalivedConfigRepaired"}, events.get())
+}
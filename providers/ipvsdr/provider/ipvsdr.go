@@ -18,43 +18,72 @@ package provider
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
 	"github.com/caicloud/loadbalancer-controller/pkg/util/validation"
 	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/dr"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/firewall"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	coresysctl "github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/tc"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/vrrp"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr/version"
 	log "github.com/zoumo/logdog"
 
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/flowcontrol"
 	utildbus "k8s.io/kubernetes/pkg/util/dbus"
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
-	"k8s.io/kubernetes/pkg/util/sysctl"
+	utilsysctl "k8s.io/kubernetes/pkg/util/sysctl"
 )
 
-var _ core.Provider = &IpvsdrProvider{}
+var (
+	_ core.Provider           = &IpvsdrProvider{}
+	_ core.InterfaceProvider  = &IpvsdrProvider{}
+	_ core.FamilyProvider     = &IpvsdrProvider{}
+	_ core.DrainingProvider   = &IpvsdrProvider{}
+	_ core.ResyncProvider     = &IpvsdrProvider{}
+	_ core.StatusProvider     = &IpvsdrProvider{}
+	_ core.HealthzProvider    = &IpvsdrProvider{}
+	_ core.PortHealthProvider = &IpvsdrProvider{}
+	_ core.RoleProvider       = &IpvsdrProvider{}
+	_ core.EventProvider      = &IpvsdrProvider{}
+	_ core.DeletionProvider   = &IpvsdrProvider{}
+)
 
 var (
 	// sysctl changes required by keepalived
-	sysctlAdjustments = map[string]int{
+	sysctlAdjustments = map[string]string{
 		// allows processes to bind() to non-local IP addresses
-		"net/ipv4/ip_nonlocal_bind": 1,
+		"net/ipv4/ip_nonlocal_bind": "1",
 		// enable connection tracking for LVS connections
-		"net/ipv4/vs/conntrack": 1,
+		"net/ipv4/vs/conntrack": "1",
 		// Reply only if the target IP address is local address configured on the incoming interface.
-		"net/ipv4/conf/all/arp_ignore": 1,
+		"net/ipv4/conf/all/arp_ignore": "1",
 		// Always use the best local address for ARP requests sent on interface.
-		"net/ipv4/conf/all/arp_announce": 2,
+		"net/ipv4/conf/all/arp_announce": "2",
 		// Reply only if the target IP address is local address configured on the incoming interface.
-		"net/ipv4/conf/lo/arp_ignore": 1,
+		"net/ipv4/conf/lo/arp_ignore": "1",
 		// Always use the best local address for ARP requests sent on interface.
-		"net/ipv4/conf/lo/arp_announce": 2,
+		"net/ipv4/conf/lo/arp_announce": "2",
 	}
+
+	// defaultPersistence is the persistence of the LoadBalancers without
+	// the annotation, the virtual servers of ipvsdr have been persistent
+	// ever since
+	defaultPersistence = &core.Persistence{Enabled: true, Timeout: core.DefaultPersistenceTimeout}
 )
 
 // IpvsdrProvider ...
@@ -63,11 +92,104 @@ type IpvsdrProvider struct {
 	reloadRateLimiter flowcontrol.RateLimiter
 	keepalived        *keepalived
 	storeLister       core.StoreLister
-	sysctlDefault     map[string]int
-	vip               string
-	cfgMD5            string
+	sysctl            *coresysctl.Manager
+	vips              []net.IP
+	vipIfaces         map[string]string
+	realServer        *dr.RealServer
 	ipt               utiliptables.Interface
+	ip6t              utiliptables.Interface
+	allowlists        map[corenet.Family]*firewall.Allowlist
+	limiters          map[corenet.Family]*firewall.Limiter
 	neighbors         []ipmac
+	addrWatcher       *corenet.AddrWatcher
+	linkMonitor       *corenet.LinkMonitor
+	ipvsManager       *coreipvs.Manager
+	drainer           *coreipvs.Drainer
+	realServers       map[corenet.Family][]realServer
+	peers             *peerDebouncer
+	routeHandle       corenet.RouteHandle
+	sourceRoute       *core.SourceRoute
+	bandwidth         *tc.Manager
+	bandwidthLimited  bool
+	traffic           *trafficReporter
+	// checksum skips the syncs whose configuration keepalived runs
+	checksum *core.Checksum
+	stopCh   chan struct{}
+
+	// eventLock guards onEvent, the handler recording the events of the
+	// provider on the LoadBalancer
+	eventLock sync.Mutex
+	onEvent   func(eventtype, reason, message string)
+
+	// FlushConntrackOnFailover flushes the conntrack entries of the VIP
+	// when this node becomes the VRRP master. It is disruptive to the
+	// flows established through this node, so it is disabled by default.
+	FlushConntrackOnFailover bool
+	// DrainTimeout bounds the draining of the removed nodes, they are
+	// weighted to zero until their active connections drop to
+	// DrainThreshold or the timeout expires. They are deleted immediately
+	// if it is zero.
+	DrainTimeout   time.Duration
+	DrainThreshold int
+	// UnicastPeers overrides the VRRP peers, which are the other nodes of
+	// the LoadBalancer by default
+	UnicastPeers []string
+	// PeerDebounce is the time a changed set of VRRP peers must stay
+	// unchanged before keepalived is reloaded with it
+	PeerDebounce time.Duration
+	// VRIDConflictDetection is the time to listen for the advertisements
+	// of other VRRP instances using the vrid before keepalived starts, it
+	// is disabled if zero. It requires CAP_NET_RAW.
+	VRIDConflictDetection time.Duration
+	// VRIDAllocator allocates the vrid keyed by the UID of the LoadBalancer
+	// from a ConfigMap shared by the cluster instead of using the one in
+	// the LoadBalancer status, which is only preferred then
+	VRIDAllocator *vrrp.Allocator
+	// DriftCheckInterval is the period of checking the keepalived
+	// configuration on disk besides watching it, the changes made by
+	// others than the provider are reported, and repaired from the desired
+	// configuration if RepairDrift is true
+	DriftCheckInterval time.Duration
+	RepairDrift        bool
+	// HealthzURL is the health endpoint of the provider checked by the
+	// track script of keepalived, the LoadBalancers can not track the
+	// health of the dataplane if it is empty
+	HealthzURL string
+	// NodeName is the name of this node, the traffic through it is reported
+	// in the LoadBalancer status by the name every TrafficStatusInterval.
+	// It is not reported if either is zero.
+	NodeName              string
+	TrafficStatusInterval time.Duration
+
+	mu        sync.Mutex
+	vrid      int
+	vrrpState string
+	// lbUID owns the vrid allocated by VRIDAllocator, allocatedVRID is the
+	// one allocated to it so far
+	lbUID         types.UID
+	allocatedVRID int
+	// vrrpTransitions counts the transitions of vrrpState, the last one
+	// happened at vrrpTransitionTime
+	vrrpTransitions    int
+	vrrpTransitionTime time.Time
+	// vrrpHistory are the last transitions of vrrpState, the latest last
+	vrrpHistory []vrrpTransition
+	// vrrpPriority, vrrpVIPs and vrrpPeers are of the VRRP instance in the
+	// last configuration written for keepalived
+	vrrpPriority int
+	vrrpVIPs     []string
+	vrrpPeers    []string
+	// vridConflicts are the other VRRP instances using the vrid
+	vridConflicts []vrrp.Conflict
+	onRole        func(core.Role)
+	// servedFamilies and servedPorts are the families of the fwmark
+	// virtual servers and the ports of the last update
+	servedFamilies []corenet.Family
+	servedPorts    []corenet.Port
+	// lbName and nodeNames, which are keyed by the addresses of the real
+	// servers, label the ipvs metrics
+	lbName    string
+	nodeNames map[string]string
 }
 
 // NewIpvsdrProvider creates a new ipvs-dr LoadBalancer Provider.
@@ -78,31 +200,78 @@ func NewIpvsdrProvider(nodeIP net.IP, lb *netv1alpha1.LoadBalancer, unicast bool
 		return nil, err
 	}
 
+	vips, err := core.GetVIPList(lb)
+	if err != nil {
+		log.Error("get vips err", log.Fields{"err": err})
+		return nil, err
+	}
+
 	execer := k8sexec.New()
 	dbus := utildbus.New()
 	iptInterface := utiliptables.New(execer, dbus, utiliptables.ProtocolIpv4)
 
+	ipvsHandle := coreipvs.NewHandle()
 	ipvs := &IpvsdrProvider{
 		nodeInfo:          nodeInfo,
 		reloadRateLimiter: flowcontrol.NewTokenBucketRateLimiter(10.0, 10),
-		vip:               lb.Spec.Providers.Ipvsdr.Vip,
-		sysctlDefault:     make(map[string]int, 0),
+		vipIfaces:         make(map[string]string),
+		realServer:        dr.NewRealServer(corenet.NewAddrHandle(), utilsysctl.New()),
+		sysctl:            coresysctl.NewManager(coresysctl.DefaultRoot),
 		ipt:               iptInterface,
+		ip6t:              utiliptables.New(execer, dbus, utiliptables.ProtocolIpv6),
 		neighbors:         make([]ipmac, 0),
+		ipvsManager:       coreipvs.NewManager(ipvsHandle),
+		drainer:           coreipvs.NewDrainer(ipvsHandle, coreipvs.DefaultDrainTimeout, 0),
+		realServers:       make(map[corenet.Family][]realServer),
+		DrainTimeout:      coreipvs.DefaultDrainTimeout,
+		peers:             newPeerDebouncer(DefaultPeerDebounce),
+		PeerDebounce:      DefaultPeerDebounce,
+		routeHandle:       corenet.NewRouteHandle(),
+		bandwidth:         tc.NewManager(nodeInfo.iface, tc.NewRunner()),
+		checksum:          core.NewChecksum("keepalived"),
+		traffic:           newTrafficReporter(),
+		stopCh:            make(chan struct{}),
+		lbUID:             lb.UID,
+	}
+
+	ipvs.DriftCheckInterval = DefaultDriftCheckInterval
+	ipvs.TrafficStatusInterval = DefaultTrafficStatusInterval
+	ipvs.allowlists = map[corenet.Family]*firewall.Allowlist{
+		corenet.FamilyIPv4: firewall.NewAllowlist(ipvs.ipt),
+		corenet.FamilyIPv6: firewall.NewAllowlist(ipvs.ip6t),
+	}
+	ipvs.limiters = map[corenet.Family]*firewall.Limiter{
+		corenet.FamilyIPv4: firewall.NewLimiter(ipvs.ipt),
+		corenet.FamilyIPv6: firewall.NewLimiter(ipvs.ip6t),
+	}
+
+	for _, vip := range vips {
+		ipvs.vips = append(ipvs.vips, vip.IP)
+		if vip.Interface != "" {
+			ipvs.vipIfaces[vip.IP.String()] = vip.Interface
+		}
 	}
 
-	// neighbors := getNodeNeighbors(nodeInfo, clusterNodes)
-	ipvs.keepalived = &keepalived{
-		nodeInfo:   nodeInfo,
-		useUnicast: unicast,
-		ipt:        iptInterface,
+	if lb.Status.ProvidersStatuses.Ipvsdr != nil && lb.Status.ProvidersStatuses.Ipvsdr.Vrid != nil {
+		ipvs.vrid = *lb.Status.ProvidersStatuses.Ipvsdr.Vrid
 	}
 
+	// the restores of the VIPs are recorded on the LoadBalancer
+	ipvs.addrWatcher = corenet.NewAddrWatcher(corenet.NewAddrHandle(), ipvs.event)
+
+	ipvs.linkMonitor = corenet.NewLinkMonitor(corenet.NewAddrHandle())
+
+	// neighbors := getNodeNeighbors(nodeInfo, clusterNodes)
+	ipvs.keepalived = newKeepalived(nodeInfo, unicast, iptInterface)
+
 	err = ipvs.keepalived.loadTemplate()
 	if err != nil {
 		return nil, err
 	}
 
+	metrics.MustRegister(newMetricsCollector(ipvs, DefaultStatsTTL))
+	metrics.MustRegister(firewall.NewLimitCollector(ipvs.limiters[corenet.FamilyIPv4], ipvs.limiters[corenet.FamilyIPv6]))
+
 	return ipvs, nil
 }
 
@@ -119,47 +288,246 @@ func (p *IpvsdrProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
 	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal || lb.Spec.Providers.Ipvsdr == nil {
 		return nil
 	}
+	if err := core.RejectProxyProtocol(lb, "ipvsdr"); err != nil {
+		return err
+	}
+
+	vipList, err := core.GetVIPList(lb)
+	if err != nil {
+		return err
+	}
+	if err := validateVIPInterfaces(vipList); err != nil {
+		return err
+	}
+	if err := p.ensureVIPs(vipList); err != nil {
+		log.Error("ensure vips error", log.Fields{"err": err})
+		return err
+	}
+
+	scheduler, err := core.GetIpvsScheduler(lb)
+	if err != nil {
+		return err
+	}
+	persistence, err := core.GetPersistence(lb)
+	if err != nil {
+		return err
+	}
+	if persistence == nil {
+		persistence = defaultPersistence
+	}
+	// without the ports, both tcp and udp of the vips are served as before
+	var ports []corenet.Port
+	if _, ok := lb.Annotations[core.AnnotationKeyPorts]; ok {
+		if ports, err = core.GetPorts(lb); err != nil {
+			return err
+		}
+	}
+
+	// the fwmark of the vips covers all their ports without the annotation
+	ranges, err := core.GetSourceRanges(lb)
+	if err != nil {
+		return err
+	}
+	if err := p.ensureSourceRanges(vipList, ports, ranges); err != nil {
+		log.Error("ensure source ranges error", log.Fields{"err": err})
+		return err
+	}
+
+	rateLimit, err := core.GetRateLimit(lb)
+	if err != nil {
+		return err
+	}
+	if ports != nil {
+		if err := core.CheckRateLimitPorts(rateLimit, ports); err != nil {
+			return err
+		}
+	}
+	if err := p.ensureRateLimits(vipList, rateLimit); err != nil {
+		log.Error("ensure rate limits error", log.Fields{"err": err})
+		return err
+	}
+
+	sourceRoute, err := core.GetSourceRoute(lb)
+	if err != nil {
+		return err
+	}
+	if err := p.ensureSourceRoute(sourceRoute); err != nil {
+		log.Error("ensure source route error", log.Fields{"err": err})
+		return err
+	}
+
+	ingress, egress, err := core.GetBandwidth(lb)
+	if err != nil {
+		return err
+	}
+	if err := p.ensureBandwidth(ingress, egress); err != nil {
+		log.Error("ensure bandwidth limit error", log.Fields{"err": err})
+		return err
+	}
+
+	auth, err := core.GetVRRPAuth(lb, p.storeLister.Secret)
+	if err != nil {
+		return err
+	}
+	// keepalived authenticates VRRPv2 only, which has no IPv6
+	if auth != nil && net.ParseIP(p.nodeInfo.ip).To4() == nil {
+		return core.NewPermanentError("InvalidVRRPAuth", fmt.Errorf("vrrp authentication is not supported on the IPv6 node %v", p.nodeInfo.ip))
+	}
+
+	vrrpConfig, err := core.GetVRRPConfig(lb)
+	if err != nil {
+		return err
+	}
+	garp, err := core.GetGARPSchedule(lb, defaultGARP)
+	if err != nil {
+		return err
+	}
+	trackInterfaces, err := core.GetVRRPTrackInterfaces(lb)
+	if err != nil {
+		return err
+	}
+	var script *trackScript
+	if s, err := core.GetVRRPTrackScript(lb); err != nil {
+		return err
+	} else if s != nil {
+		if p.HealthzURL == "" {
+			return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("the provider serves no health endpoint for the vrrp track script, set --http-address"))
+		}
+		script = &trackScript{VRRPTrackScript: *s, URL: p.HealthzURL}
+	}
+	// VRRPv2 advertises in whole seconds
+	if auth != nil && vrrpConfig.AdvertInt != math.Trunc(vrrpConfig.AdvertInt) {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("vrrp advert interval %v must be whole seconds with authentication", vrrpConfig.AdvertInt))
+	}
 
 	log.Notice("Updating config")
 
 	// get selected nodes' ip
-	selectedNodes := p.getNodesIP(lb.Spec.Nodes.Names)
+	nodeFamily := corenet.FamilyOf(net.ParseIP(p.nodeInfo.ip))
+	selectedNodes := p.getNodesIP(lb.Spec.Nodes.Names, nodeFamily)
 	if len(selectedNodes) == 0 {
 		return nil
 	}
 
-	svc := virtualServer{
-		VIP:        lb.Spec.Providers.Ipvsdr.Vip,
-		Scheduler:  string(lb.Spec.Providers.Ipvsdr.Scheduler),
-		RealServer: selectedNodes,
+	// a virtual server per family, the real servers of a virtual server
+	// must be of its family
+	vss := make([]virtualServer, 0, len(vipList))
+	rss := make(map[corenet.Family][]realServer)
+	for _, vip := range vipList {
+		family := corenet.FamilyOf(vip.IP)
+		if _, ok := rss[family]; !ok {
+			rss[family] = p.drainRealServers(family, p.getRealServers(lb.Spec.Nodes.Names, family))
+		}
+		vs := virtualServer{
+			VIP:        vip.IP.String(),
+			Interface:  vip.Interface,
+			Family:     family,
+			Scheduler:  scheduler,
+			Ports:      ports,
+			RealServer: rss[family],
+		}
+		if persistence.Enabled {
+			vs.PersistenceTimeout = persistence.Timeout
+			if family == corenet.FamilyIPv4 {
+				vs.PersistenceGranularity = persistence.Netmask
+			}
+		}
+		vss = append(vss, vs)
+	}
+
+	peers := getNeighbors(p.nodeInfo.ip, selectedNodes)
+	if len(p.UnicastPeers) > 0 {
+		peers = getNeighbors(p.nodeInfo.ip, p.UnicastPeers)
+	}
+	p.peers.period = p.PeerDebounce
+	neighbors := p.resolveNeighbors(p.peers.Peers(peers))
+
+	families := make([]corenet.Family, 0, len(rss))
+	seen := make(map[corenet.Family]bool)
+	for _, vs := range vss {
+		if !seen[vs.Family] {
+			seen[vs.Family] = true
+			families = append(families, vs.Family)
+		}
+	}
+
+	nodeNames := p.realServerNodes(lb.Spec.Nodes.Names, rss)
+	vrid, err := p.vridOf(lb)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.vrid = vrid
+	p.servedFamilies, p.servedPorts = families, ports
+	p.lbName, p.nodeNames = lb.Namespace+"/"+lb.Name, nodeNames
+	p.mu.Unlock()
+
+	if err := p.checkVRIDConflicts(vrid); err != nil {
+		return err
 	}
 
-	neighbors := p.resolveNeighbors(getNeighbors(p.nodeInfo.ip, selectedNodes))
+	preferred := ""
+	if vrrpConfig.PreferredNode != "" {
+		if ips := p.storeLister.NodeIPs([]string{vrrpConfig.PreferredNode}, nodeFamily); len(ips) > 0 {
+			preferred = ips[0].String()
+		}
+	}
+	priority := getNodePriority(p.nodeInfo.ip, selectedNodes, vrrpConfig.Priority, preferred)
+	if priority > core.MaxVRRPPriority {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("vrrp priority %v of the node exceeds %v, lower the base priority", priority, core.MaxVRRPPriority))
+	}
+	if script != nil {
+		priorities := make([]int, 0, len(selectedNodes))
+		for _, ip := range selectedNodes {
+			priorities = append(priorities, getNodePriority(ip, selectedNodes, vrrpConfig.Priority, preferred))
+		}
+		if err := validateTrackScript(&script.VRRPTrackScript, priorities, vrrpConfig.Preempt); err != nil {
+			return err
+		}
+	}
 
-	err := p.keepalived.UpdateConfig(
-		[]virtualServer{svc},
+	data, err := p.keepalived.Render(
+		vss,
 		neighbors,
-		getNodePriority(p.nodeInfo.ip, selectedNodes),
-		*lb.Status.ProvidersStatuses.Ipvsdr.Vrid,
+		vrrpElection{
+			Priority:        priority,
+			Preempt:         vrrpConfig.Preempt,
+			PreemptDelay:    vrrpConfig.PreemptDelay,
+			AdvertInt:       vrrpConfig.AdvertInt,
+			GARP:            garp,
+			TrackInterfaces: trackInterfaces,
+			TrackScript:     script,
+		},
+		vrid,
+		auth,
 	)
 	if err != nil {
 		return err
 	}
-
-	// check md5
-	md5, err := checksum(keepalivedCfg)
-	if err == nil && md5 == p.cfgMD5 {
+	p.setVRRPInstance(priority, getVIPs(vss), neighbors)
+	// the configuration keepalived runs is not written again
+	sum := core.Sum(data)
+	if p.checksum.Unchanged(lb, sum) {
+		return nil
+	}
+	change, err := p.keepalived.WriteConfig(data, p.checksum.Forced(lb))
+	if err != nil {
+		return err
+	}
+	// the desired state is unchanged
+	if change == configUnchanged {
 		return nil
 	}
 
 	p.ensureIptablesMark(neighbors)
 
-	p.cfgMD5 = md5
-	err = p.keepalived.Reload()
+	err = p.keepalived.Apply(change)
 	if err != nil {
 		log.Error("reload keepalived error", log.Fields{"err": err})
+		p.checksum.Invalidate()
 		return err
 	}
+	p.checksum.Applied(lb, sum)
 
 	return nil
 }
@@ -170,17 +538,22 @@ func (p *IpvsdrProvider) Start() {
 
 	p.changeSysctl()
 	p.setLoopbackVIP()
+	p.watchLoopbackVIP()
+	p.watchUplink()
+	if err := p.watchVRRPState(); err != nil {
+		log.Error("watch vrrp state error", log.Fields{"err": err})
+	}
+	p.allocateInitialVRID()
+	p.detectVRIDConflicts()
 	go p.keepalived.Start()
+	go p.keepalived.watchDrift(p.DriftCheckInterval, p.RepairDrift)
 	return
 }
 
 // WaitForStart waits for ipvsdr fully run
 func (p *IpvsdrProvider) WaitForStart() bool {
 	err := wait.Poll(time.Second, 60*time.Second, func() (bool, error) {
-		if p.keepalived.started && p.keepalived.cmd != nil && p.keepalived.cmd.Process != nil {
-			return true, nil
-		}
-		return false, nil
+		return p.keepalived.Running(), nil
 	})
 
 	if err != nil {
@@ -193,6 +566,9 @@ func (p *IpvsdrProvider) WaitForStart() bool {
 func (p *IpvsdrProvider) Stop() error {
 	log.Info("Shutting down ipvs dr provider")
 
+	// stop watching before the vip is released
+	close(p.stopCh)
+
 	err := p.resetSysctl()
 	if err != nil {
 		log.Error("reset sysctl error", log.Fields{"err": err})
@@ -205,11 +581,100 @@ func (p *IpvsdrProvider) Stop() error {
 
 	p.flushIptablesMark()
 
+	for _, a := range p.allowlists {
+		if err := a.Cleanup(); err != nil {
+			log.Error("delete source ranges error", log.Fields{"err": err})
+		}
+	}
+	for _, l := range p.limiters {
+		if err := l.Cleanup(); err != nil {
+			log.Error("delete rate limits error", log.Fields{"err": err})
+		}
+	}
+
+	err = p.ensureSourceRoute(nil)
+	if err != nil {
+		log.Error("delete source route error", log.Fields{"err": err})
+	}
+
+	err = p.ensureBandwidth(0, 0)
+	if err != nil {
+		log.Error("delete bandwidth limit error", log.Fields{"err": err})
+	}
+
 	p.keepalived.Stop()
 
+	err = p.ipvsManager.StopSyncDaemons()
+	if err != nil {
+		log.Error("stop ipvs sync daemons error", log.Fields{"err": err})
+	}
+
 	return nil
 }
 
+// Healthz implements core.HealthzProvider, the provider is unhealthy while
+// keepalived is not running
+func (p *IpvsdrProvider) Healthz() error {
+	return p.keepalived.Healthz()
+}
+
+// PortHealth implements core.PortHealthProvider, the ports are served by the
+// fwmark virtual server of each family which keepalived installs with the
+// ready real servers
+func (p *IpvsdrProvider) PortHealth() []core.PortHealth {
+	p.mu.Lock()
+	families, ports := p.servedFamilies, p.servedPorts
+	p.mu.Unlock()
+	if len(families) == 0 {
+		return nil
+	}
+
+	vss := make([]coreipvs.VirtualServer, 0, len(families))
+	for _, family := range families {
+		vss = append(vss, coreipvs.VirtualServer{FWMark: acceptMark, Family: family})
+	}
+	reason := ""
+	errs, err := p.ipvsManager.Check(vss)
+	if err != nil {
+		reason = err.Error()
+	}
+	for _, vs := range vss {
+		if reason == "" && errs[vs.Key()] != nil {
+			reason = errs[vs.Key()].Error()
+		}
+	}
+
+	// without the ports, all ports of the vips are served alike
+	if len(ports) == 0 {
+		ports = []corenet.Port{{}}
+	}
+	ret := make([]core.PortHealth, 0, len(ports))
+	for _, port := range ports {
+		ret = append(ret, core.PortHealth{Protocol: port.Protocol, Port: int(port.Port), Healthy: reason == "", Reason: reason})
+	}
+	return ret
+}
+
+// Interfaces implements core.InterfaceProvider, the vips are served on the
+// interface of the node ip or their own ones and leave by the device of the
+// source route
+func (p *IpvsdrProvider) Interfaces() []string {
+	ifaces := []string{p.nodeInfo.iface}
+	for _, vip := range p.vips {
+		ifaces = appendIfMissing(ifaces, p.vipInterface(vip))
+	}
+	if p.sourceRoute != nil && p.sourceRoute.Device != "" {
+		ifaces = appendIfMissing(ifaces, p.sourceRoute.Device)
+	}
+	return ifaces
+}
+
+// SupportedFamilies implements core.FamilyProvider, the ipvsdr provider
+// serves both IPv4 and IPv6 VIPs
+func (p *IpvsdrProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
 // Info ...
 func (p *IpvsdrProvider) Info() core.Info {
 	return core.Info{
@@ -217,6 +682,10 @@ func (p *IpvsdrProvider) Info() core.Info {
 		Release:    version.RELEASE,
 		Build:      version.COMMIT,
 		Repository: version.REPO,
+		Capabilities: &core.Capabilities{
+			Protocols: []string{"tcp", "udp"},
+			Features:  []core.Feature{core.FeaturePersistence, core.FeatureSourceRanges, core.FeatureLocalTraffic, core.FeatureMaxConnections, core.FeatureConnectionRate},
+		},
 	}
 }
 
@@ -225,93 +694,138 @@ func (p *IpvsdrProvider) SetListers(lister core.StoreLister) {
 	p.storeLister = lister
 }
 
-func (p *IpvsdrProvider) getNodesIP(names []string) []string {
+// getNodesIP returns the ips of the family of the nodes, the nodes without
+// an address of the family are skipped
+func (p *IpvsdrProvider) getNodesIP(names []string, family corenet.Family) []string {
 	ips := make([]string, 0)
-	if names == nil {
-		return ips
-	}
-
-	for _, name := range names {
-		node, err := p.storeLister.Node.Get(name)
-		if err != nil {
-			continue
-		}
-		ip, err := GetNodeHostIP(node)
-		if err != nil {
-			continue
-		}
+	for _, ip := range p.storeLister.NodeIPs(names, family) {
 		ips = append(ips, ip.String())
 	}
-
 	return ips
 }
 
+// getRealServers returns the nodes of the family as real servers weighted
+// by their conditions, the nodes without an address of the family are
+// skipped
+func (p *IpvsdrProvider) getRealServers(names []string, family corenet.Family) []realServer {
+	rss := make([]realServer, 0)
+	for _, rs := range p.storeLister.RealServers(names, family) {
+		rss = append(rss, realServer{IP: rs.IP.String(), Weight: rs.Weight})
+	}
+	return rss
+}
+
 // changeSysctl changes the required network setting in /proc to get
 // keepalived working in the local system.
 func (p *IpvsdrProvider) changeSysctl() error {
-	sys := sysctl.New()
-	for k, v := range sysctlAdjustments {
-		defVar, err := sys.GetSysctl(k)
-		if err != nil {
-			return err
-		}
-		p.sysctlDefault[k] = defVar
-
-		if err := sys.SetSysctl(k, v); err != nil {
-			return err
-		}
-	}
-	return nil
+	return p.sysctl.Apply(sysctlAdjustments)
 }
 
 // resetSysctl resets the network setting
 func (p *IpvsdrProvider) resetSysctl() error {
-	log.Info("reset sysctl to original value", log.Fields{"defaults": p.sysctlDefault})
-	sys := sysctl.New()
-	for k, v := range p.sysctlDefault {
-		if err := sys.SetSysctl(k, v); err != nil {
-			return err
+	log.Info("reset sysctl to original value")
+	return p.sysctl.Restore()
+}
+
+// setLoopbackVIP sets vips to dev lo
+func (p *IpvsdrProvider) setLoopbackVIP() error {
+	errs := make([]error, 0)
+	for _, vip := range p.vips {
+		if err := p.realServer.Ensure(vip); err != nil {
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	if len(errs) == 0 && len(p.vips) > 0 {
+		log.Info("vips bound on dev lo", log.Fields{"vips": p.vips})
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
-// setLoopbackVIP sets vip to dev lo
-func (p *IpvsdrProvider) setLoopbackVIP() error {
+// watchLoopbackVIP restores the vips on dev lo if something else removes them
+func (p *IpvsdrProvider) watchLoopbackVIP() {
+	p.addrWatcher.SetAddrs(p.loopbackAddrs())
+	go func() {
+		if err := p.addrWatcher.Run(p.stopCh); err != nil {
+			log.Error("watch loopback vip error", log.Fields{"err": err})
+		}
+	}()
+}
 
-	if p.vip == "" {
-		return nil
-	}
+// watchUplink announces the vips once the uplink comes back up, keepalived
+// only announces them on VRRP state transitions. The vips are added to the
+// uplink by keepalived on the master, so the backups announce nothing.
+func (p *IpvsdrProvider) watchUplink() {
+	p.linkMonitor.SetAddrs(p.uplinkAddrs())
+	go func() {
+		if err := p.linkMonitor.Run(p.stopCh); err != nil {
+			log.Error("watch uplink error", log.Fields{"err": err})
+		}
+	}()
+}
 
-	lo, err := getLoopBackInfo()
-	if err != nil {
-		return err
+// removeLoopbackVIP removes vips from dev lo
+func (p *IpvsdrProvider) removeLoopbackVIP() error {
+	log.Info("remove vips from dev lo", log.Fields{"vips": p.vips})
+
+	errs := make([]error, 0)
+	for _, vip := range p.vips {
+		if err := p.realServer.Teardown(vip); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return utilerrors.NewAggregate(errs)
+}
 
-	out, err := k8sexec.New().Command("ip", "addr", "add", p.vip+"/32", "dev", lo.iface).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("set VIP %s to dev lo error: %v\n%s", p.vip, err, out)
+// ensureSourceRoute makes the return traffic from the vips of the family of
+// the gateway leave by the uplink of the source route, the previous one is
+// deleted if it changes
+func (p *IpvsdrProvider) ensureSourceRoute(sr *core.SourceRoute) error {
+	if cur := p.sourceRoute; cur != nil && (sr == nil || sr.Table != cur.Table ||
+		corenet.FamilyOf(sr.Gateway) != corenet.FamilyOf(cur.Gateway)) {
+		for _, vip := range corenet.FilterFamily(p.vips, corenet.FamilyOf(cur.Gateway)) {
+			if err := corenet.DeleteSourceRule(p.routeHandle, vip, cur.Table); err != nil {
+				return err
+			}
+		}
+		p.sourceRoute = nil
+	}
+	if sr == nil {
+		return nil
 	}
+	for _, vip := range corenet.FilterFamily(p.vips, corenet.FamilyOf(sr.Gateway)) {
+		if err := corenet.EnsureSourceRule(p.routeHandle, vip, sr.Table, sr.Gateway, sr.Device); err != nil {
+			return err
+		}
+	}
+	p.sourceRoute = sr
 	return nil
 }
 
-// removeLoopbackVIP removes vip from dev lo
-func (p *IpvsdrProvider) removeLoopbackVIP() error {
-	log.Info("remove vip from dev lo", log.Fields{"vip": p.vip})
-
-	if p.vip == "" {
+// ensureBandwidth limits the bandwidth of the vips on the uplink, tc
+// matches IPv4 addresses only, so IPv6 vips are not limited, nor the vips
+// on other interfaces
+func (p *IpvsdrProvider) ensureBandwidth(ingress, egress uint64) error {
+	vips := make([]net.IP, 0)
+	for _, vip := range corenet.FilterFamily(p.vips, corenet.FamilyIPv4) {
+		if p.vipInterface(vip) == p.nodeInfo.iface {
+			vips = append(vips, vip)
+		}
+	}
+	limited := (ingress > 0 || egress > 0) && len(vips) > 0
+	if !limited && !p.bandwidthLimited {
+		// nothing to clean up, and tc is not required
 		return nil
 	}
-
-	lo, err := getLoopBackInfo()
-	if err != nil {
-		return err
+	limits := []tc.Limit{}
+	if limited {
+		for _, vip := range vips {
+			limits = append(limits, tc.Limit{VIP: vip, Ingress: ingress, Egress: egress})
+		}
 	}
-
-	out, err := k8sexec.New().Command("ip", "addr", "del", p.vip+"/32", "dev", lo.iface).CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("removing configured VIP from dev lo error: %v\n%s", err, out)
+	if err := p.bandwidth.Ensure(limits); err != nil {
+		return err
 	}
+	p.bandwidthLimited = limited
 	return nil
 }
 
@@ -330,19 +844,40 @@ func (p *IpvsdrProvider) resolveNeighbors(neighbors []string) []ipmac {
 	return resolvedNeighbors
 }
 
-func (p *IpvsdrProvider) setIptablesMark(protocol, mac string, mark int) (bool, error) {
-	if mac == "" {
-		return p.ipt.EnsureRule(utiliptables.Append, "mangle", "PREROUTING", "-i", p.nodeInfo.iface, "-d", p.vip, "-p", protocol, "-j", "MARK", "--set-mark", strconv.Itoa(mark))
+// iptablesOf returns the iptables of the family of the vip
+func (p *IpvsdrProvider) iptablesOf(vip net.IP) utiliptables.Interface {
+	if vip.To4() == nil {
+		return p.ip6t
 	}
-	return p.ipt.EnsureRule(utiliptables.Append, "mangle", "PREROUTING", "-i", p.nodeInfo.iface, "-d", p.vip, "-p", protocol, "-m", "mac", "--mac-source", mac, "-j", "MARK", "--set-mark", strconv.Itoa(mark))
+	return p.ipt
 }
 
-func (p *IpvsdrProvider) deleteIptablesMark(protocol, mac string, mark int) error {
-	if mac == "" {
-		return p.ipt.DeleteRule("mangle", "PREROUTING", "-i", p.nodeInfo.iface, "-d", p.vip, "-p", protocol, "-j", "MARK", "--set-mark", strconv.Itoa(mark))
+func (p *IpvsdrProvider) markArgs(vip net.IP, protocol, mac string, mark int) []string {
+	args := []string{"-i", p.vipInterface(vip), "-d", vip.String(), "-p", protocol}
+	if mac != "" {
+		args = append(args, "-m", "mac", "--mac-source", mac)
 	}
-	return p.ipt.DeleteRule("mangle", "PREROUTING", "-i", p.nodeInfo.iface, "-d", p.vip, "-p", protocol, "-m", "mac", "--mac-source", mac, "-j", "MARK", "--set-mark", strconv.Itoa(mark))
+	return append(args, "-j", "MARK", "--set-mark", strconv.Itoa(mark))
+}
 
+func (p *IpvsdrProvider) setIptablesMark(protocol, mac string, mark int) error {
+	errs := make([]error, 0)
+	for _, vip := range p.vips {
+		if _, err := p.iptablesOf(vip).EnsureRule(utiliptables.Append, "mangle", "PREROUTING", p.markArgs(vip, protocol, mac, mark)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (p *IpvsdrProvider) deleteIptablesMark(protocol, mac string, mark int) error {
+	errs := make([]error, 0)
+	for _, vip := range p.vips {
+		if err := p.iptablesOf(vip).DeleteRule("mangle", "PREROUTING", p.markArgs(vip, protocol, mac, mark)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
 }
 
 func (p *IpvsdrProvider) ensureIptablesMark(neighbors []ipmac) {
@@ -361,11 +896,11 @@ func (p *IpvsdrProvider) ensureIptablesMark(neighbors []ipmac) {
 	// make sure that all traffics which come from the neighbors will be marked with 2
 	// an than lvs will ignore it
 	for _, neighbor := range neighbors {
-		_, err := p.setIptablesMark("tcp", neighbor.MAC.String(), dropMark)
+		err := p.setIptablesMark("tcp", neighbor.MAC.String(), dropMark)
 		if err != nil {
 			log.Error("failed to ensure iptables tcp rule for", log.Fields{"ip": neighbor.IP, "mac": neighbor.MAC.String(), "mark": dropMark, "err": err})
 		}
-		_, err = p.setIptablesMark("udp", neighbor.MAC.String(), dropMark)
+		err = p.setIptablesMark("udp", neighbor.MAC.String(), dropMark)
 		if err != nil {
 			log.Error("failed to ensure iptables udp rule for", log.Fields{"ip": neighbor.IP, "mac": neighbor.MAC.String(), "mark": dropMark, "err": err})
 		}
@@ -17,15 +17,27 @@ limitations under the License.
 package provider
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"text/template"
+	"time"
 
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	log "github.com/zoumo/logdog"
 
+	"k8s.io/client-go/util/flowcontrol"
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 	"k8s.io/kubernetes/pkg/util/iptables"
 )
@@ -34,58 +46,383 @@ const (
 	iptablesChain  = "LOADBALANCER-IPVS-DR"
 	keepalivedCfg  = "/etc/keepalived/keepalived.conf"
 	keepalivedTmpl = "/root/keepalived.tmpl"
+	// trackScriptPath is the built-in track script checking the health
+	// endpoint of the provider
+	trackScriptPath = "/root/check-healthz.sh"
 
 	acceptMark = 1
 	dropMark   = 2
+
+	keepalivedBackoffID      = "keepalived"
+	keepalivedInitialBackoff = time.Second
+	keepalivedMaxBackoff     = time.Minute
+)
+
+var keepalivedExits = metrics.NewCounterVec(
+	"loadbalancer_provider_keepalived_unexpected_exits_total",
+	"Number of unexpected exits of keepalived, it is started again after a backoff",
 )
 
+func init() {
+	metrics.MustRegister(keepalivedExits)
+}
+
 type ipmac struct {
 	IP  string
 	MAC net.HardwareAddr
 }
 
 type virtualServer struct {
-	VIP        string
-	Scheduler  string
-	RealServer []string
+	VIP string
+	// Interface is the interface the vip is added to by keepalived, the
+	// one of the node if empty
+	Interface string
+	Family    corenet.Family
+	Scheduler string
+	// PersistenceTimeout is the persistence timeout in seconds, the
+	// persistence is disabled if it is zero
+	PersistenceTimeout uint32
+	// PersistenceGranularity is the netmask of the persistence, each
+	// client alone if empty
+	PersistenceGranularity string
+	// Ports are the ports served on the vip, the fwmark marks all the
+	// traffic of the vip, so both tcp and udp are served if empty
+	Ports      []corenet.Port
+	RealServer []realServer
+}
+
+// realServer is a node serving the vip, a zero weight node keeps the
+// established connections but receives no new ones
+type realServer struct {
+	IP     string
+	Weight int
+}
+
+// IPFamily returns the ip_family of the fwmark virtual server in keepalived
+func (vs virtualServer) IPFamily() string {
+	if vs.Family == corenet.FamilyIPv6 {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// HasTCP returns whether the virtual server serves tcp
+func (vs virtualServer) HasTCP() bool {
+	return vs.hasProtocol("tcp")
+}
+
+// HasUDP returns whether the virtual server serves udp
+func (vs virtualServer) HasUDP() bool {
+	return vs.hasProtocol("udp")
+}
+
+func (vs virtualServer) hasProtocol(protocol string) bool {
+	if len(vs.Ports) == 0 {
+		return true
+	}
+	for _, p := range vs.Ports {
+		if p.Protocol == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// TCPCheckPort returns the port of the TCP_CHECK of the real servers, the
+// first tcp port served
+func (vs virtualServer) TCPCheckPort() int {
+	for _, p := range vs.Ports {
+		if p.Protocol == "tcp" {
+			return int(p.Port)
+		}
+	}
+	return 80
+}
+
+// vrrpElection is how the node takes part in the VRRP election of the
+// instance
+type vrrpElection struct {
+	Priority     int
+	Preempt      bool
+	PreemptDelay int
+	// AdvertInt is in seconds
+	AdvertInt float64
+	// GARP is the schedule of the gratuitous ARPs once the node becomes
+	// the master, in whole seconds. The defaults of keepalived apply if it
+	// is zero.
+	GARP arp.Schedule
+	// TrackInterfaces are tracked besides the interfaces of the vips
+	TrackInterfaces []string
+	// TrackScript tracks the health of the dataplane, nil if not tracked
+	TrackScript *trackScript
+}
+
+// trackScript is the vrrp_script checking the health endpoint of the
+// provider
+type trackScript struct {
+	core.VRRPTrackScript
+	// URL is the health endpoint of the provider
+	URL string
+}
+
+// Script returns the command line of the check, it times out after the
+// interval
+func (s trackScript) Script() string {
+	return fmt.Sprintf("%s %s %d", trackScriptPath, s.URL, s.Interval)
 }
 
+// defaultGARP is the schedule of the gratuitous ARPs of keepalived by
+// default
+var defaultGARP = arp.Schedule{Repeat: 5, Delay: 5 * time.Second, RefreshRepeat: 1}
+
+// configChange is how keepalived applies a configuration change, the
+// greater ones include the lesser ones
+type configChange int
+
+const (
+	configUnchanged configChange = iota
+	// configReload is applied by SIGHUP without a VRRP re-election
+	configReload
+	// configRestart is not applied by a reload, keepalived is restarted
+	configRestart
+)
+
+// restartKeywords are the keywords of the vrrp instance keepalived does not
+// apply on reload
+var restartKeywords = []string{"interface", "version"}
+
 type keepalived struct {
-	started    bool
 	useUnicast bool
 	nodeInfo   *nodeInfo
 	ipt        iptables.Interface
-	cmd        *exec.Cmd
 	tmpl       *template.Template
 	vips       []string
+	vipDevs    map[string]string
+	cfgPath    string
+
+	// cfgMu serializes the writes of the configuration, the applies of the
+	// changes and the checks of drift
+	cfgMu sync.Mutex
+	// config is the last configuration written to cfgPath
+	config []byte
+	// configHash is the hash of config, the configuration on disk with
+	// another hash was changed by others
+	configHash string
+	// pending is the change not applied by a failed reload or restart, it
+	// is retried on the next update
+	pending configChange
+	// drift watches the configuration on disk
+	drift *driftWatcher
+
+	logs          *logWatcher
+	newProcess    func(io.Writer) (process, error)
+	reloadTimeout time.Duration
+	reloadSettle  time.Duration
+
+	// backoff delays the starts of keepalived after it crashes
+	backoff *flowcontrol.Backoff
+	stopCh  chan struct{}
+
+	mu         sync.Mutex
+	proc       process
+	started    bool
+	restarting bool
+	stopping   bool
+	// exitErr is the error of the last unexpected exit of keepalived, it
+	// is cleared once keepalived is started again
+	exitErr error
+}
+
+func newKeepalived(nodeInfo *nodeInfo, useUnicast bool, ipt iptables.Interface) *keepalived {
+	return &keepalived{
+		nodeInfo:      nodeInfo,
+		useUnicast:    useUnicast,
+		ipt:           ipt,
+		cfgPath:       keepalivedCfg,
+		logs:          newLogWatcher(os.Stdout),
+		newProcess:    startKeepalived,
+		reloadTimeout: defaultReloadTimeout,
+		reloadSettle:  defaultReloadSettle,
+		backoff:       flowcontrol.NewBackOff(keepalivedInitialBackoff, keepalivedMaxBackoff),
+		stopCh:        make(chan struct{}),
+		drift:         newDriftWatcher(),
+	}
 }
 
-// WriteCfg creates a new keepalived configuration file.
-// In case of an error with the generation it returns the error
-func (k *keepalived) UpdateConfig(vss []virtualServer, neighbors []ipmac, priority int, vrid int) error {
-	w, err := os.Create(keepalivedCfg)
+// UpdateConfig renders the keepalived configuration and writes it
+// atomically. It returns how keepalived applies the change, the file is not
+// touched if the configuration is unchanged.
+func (k *keepalived) UpdateConfig(vss []virtualServer, neighbors []ipmac, election vrrpElection, vrid int, auth *core.VRRPAuth) (configChange, error) {
+	data, err := k.Render(vss, neighbors, election, vrid, auth)
 	if err != nil {
-		return err
+		return configUnchanged, err
 	}
-	defer w.Close()
+	return k.WriteConfig(data, false)
+}
+
+// Render renders the keepalived configuration of the virtual servers, the
+// vips are saved for release when shutting down
+func (k *keepalived) Render(vss []virtualServer, neighbors []ipmac, election vrrpElection, vrid int, auth *core.VRRPAuth) ([]byte, error) {
+	k.cfgMu.Lock()
+	defer k.cfgMu.Unlock()
 
-	// save vips for release when shutting down
 	k.vips = getVIPs(vss)
+	k.vipDevs = getVIPDevs(vss)
+
+	buf := &bytes.Buffer{}
+	if err := k.tmpl.Execute(buf, k.newConfig(vss, neighbors, election, vrid, auth)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteConfig writes the rendered configuration atomically and returns how
+// keepalived applies the change. The file is not touched if the
+// configuration is unchanged, unless force which writes it and reloads
+// keepalived at least. The file is only readable by root since it may
+// contain the VRRP password.
+func (k *keepalived) WriteConfig(data []byte, force bool) (configChange, error) {
+	k.cfgMu.Lock()
+	defer k.cfgMu.Unlock()
+
+	old := k.config
+	if old == nil {
+		// the configuration keepalived is started with
+		old, _ = ioutil.ReadFile(k.cfgPath)
+	}
+	change := k.pending
+	if !bytes.Equal(data, old) {
+		change = configReload
+		if restartKey(data) != restartKey(old) {
+			change = configRestart
+		}
+		if k.pending > change {
+			change = k.pending
+		}
+	}
+	if force && change == configUnchanged {
+		change = configReload
+	}
+	if change == configUnchanged {
+		return change, nil
+	}
+
+	if err := fsutil.WriteFileAtomic(k.cfgPath, data, 0600); err != nil {
+		return configUnchanged, err
+	}
+	k.config, k.configHash = data, configHash(data)
+	return change, nil
+}
+
+// Apply applies the change of the configuration, a failed one is retried
+// by the next update
+func (k *keepalived) Apply(change configChange) error {
+	k.cfgMu.Lock()
+	defer k.cfgMu.Unlock()
+	return k.apply(change)
+}
+
+func (k *keepalived) apply(change configChange) error {
+	var err error
+	switch change {
+	case configReload:
+		err = k.Reload()
+	case configRestart:
+		err = k.Restart()
+	}
+	if err != nil {
+		k.pending = change
+		return err
+	}
+	k.pending = configUnchanged
+	return nil
+}
+
+// restartKey returns the parts of the configuration which keepalived does
+// not apply on reload: the global definitions and the restartKeywords
+func restartKey(config []byte) string {
+	key := []string{}
+	global := false
+	for _, line := range strings.Split(string(config), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "global_defs") {
+			global = true
+		}
+		if global {
+			key = append(key, line)
+			if line == "}" {
+				global = false
+			}
+			continue
+		}
+		for _, keyword := range restartKeywords {
+			if strings.HasPrefix(line, keyword+" ") {
+				key = append(key, line)
+			}
+		}
+	}
+	return strings.Join(key, "\n")
+}
+
+// newConfig returns the data of the keepalived configuration template
+func (k *keepalived) newConfig(vss []virtualServer, neighbors []ipmac, election vrrpElection, vrid int, auth *core.VRRPAuth) map[string]interface{} {
+	vips, excludedVips := splitVIPs(k.vips, k.nodeInfo.ip, k.useUnicast)
 
 	conf := make(map[string]interface{})
 	conf["iptablesChain"] = iptablesChain
 	conf["iface"] = k.nodeInfo.iface
 	conf["myIP"] = k.nodeInfo.ip
 	conf["netmask"] = k.nodeInfo.netmask
-	conf["vss"] = vss
-	conf["vips"] = k.vips
+	conf["vss"] = perFamily(vss)
+	conf["vips"] = vips
+	conf["excludedVips"] = excludedVips
+	conf["vipDevs"] = getVIPDevs(vss)
+	conf["trackInterfaces"] = getTrackInterfaces(vss, k.nodeInfo.iface, election.TrackInterfaces)
+	if election.TrackScript != nil {
+		conf["trackScript"] = election.TrackScript
+	}
 	conf["neighbors"] = neighbors
-	conf["priority"] = priority
+	conf["priority"] = election.Priority
+	conf["preempt"] = election.Preempt
+	conf["preemptDelay"] = election.PreemptDelay
+	conf["advertInt"] = election.AdvertInt
+	if election.GARP != (arp.Schedule{}) {
+		conf["garp"] = map[string]int{
+			"delay":         int(election.GARP.Delay / time.Second),
+			"repeat":        election.GARP.Repeat,
+			"refresh":       int(election.GARP.Refresh / time.Second),
+			"refreshRepeat": election.GARP.RefreshRepeat,
+		}
+	}
 	conf["useUnicast"] = k.useUnicast
 	conf["vrid"] = vrid
 	conf["acceptMark"] = acceptMark
+	conf["notifyFifo"] = keepalivedNotifyFifo
+	conf["auth"] = auth
 
-	return k.tmpl.Execute(w, conf)
+	return conf
+}
+
+// splitVIPs splits the vips into the ones advertised by VRRP and the
+// excluded ones. All addresses advertised by a VRRP instance must be of one
+// family, the family of the node ip, so the vips of the other family are
+// excluded, keepalived still adds and removes them along with the others.
+// Without unicast, a vrrp instance of only IPv6 vips advertises through
+// IPv6 multicast, so they are not excluded.
+func splitVIPs(vips []string, nodeIP string, useUnicast bool) ([]string, []string) {
+	family := corenet.FamilyOf(net.ParseIP(nodeIP))
+	advertised, excluded := []string{}, []string{}
+	for _, vip := range vips {
+		if corenet.FamilyOf(net.ParseIP(vip)) == family {
+			advertised = append(advertised, vip)
+		} else {
+			excluded = append(excluded, vip)
+		}
+	}
+	if len(advertised) == 0 && !useUnicast {
+		return excluded, []string{}
+	}
+	return advertised, excluded
 }
 
 // getVIPs returns a list of the virtual IP addresses to be used in keepalived
@@ -99,8 +436,53 @@ func getVIPs(svcs []virtualServer) []string {
 	return result
 }
 
-// Start starts a keepalived process in foreground.
-// In case of any error it will terminate the execution with a fatal error
+// getVIPDevs returns the interfaces of the vips which are not served on the
+// interface of the node
+func getVIPDevs(svcs []virtualServer) map[string]string {
+	devs := make(map[string]string)
+	for _, svc := range svcs {
+		if svc.Interface != "" {
+			devs[svc.VIP] = svc.Interface
+		}
+	}
+	return devs
+}
+
+// getTrackInterfaces returns the interfaces of the vips and the extra ones
+// besides the one of the node, the instance goes into FAULT if any of them
+// is down
+func getTrackInterfaces(svcs []virtualServer, iface string, extra []string) []string {
+	ifaces := []string{}
+	for _, svc := range svcs {
+		if svc.Interface != "" && svc.Interface != iface {
+			ifaces = appendIfMissing(ifaces, svc.Interface)
+		}
+	}
+	for _, e := range extra {
+		if e != iface {
+			ifaces = appendIfMissing(ifaces, e)
+		}
+	}
+	sort.Strings(ifaces)
+	return ifaces
+}
+
+// perFamily returns the first virtual server of every family, the traffic
+// of all the vips of a family is marked for one fwmark virtual server
+func perFamily(svcs []virtualServer) []virtualServer {
+	ret := []virtualServer{}
+	seen := make(map[corenet.Family]bool)
+	for _, svc := range svcs {
+		if !seen[svc.Family] {
+			seen[svc.Family] = true
+			ret = append(ret, svc)
+		}
+	}
+	return ret
+}
+
+// Start starts a keepalived process in foreground and supervises it until
+// it is stopped
 func (k *keepalived) Start() {
 	ae, err := k.ipt.EnsureChain(iptables.TableFilter, iptables.Chain(iptablesChain))
 	if err != nil {
@@ -110,40 +492,127 @@ func (k *keepalived) Start() {
 		log.Infof("chain %v already existed", iptablesChain)
 	}
 
-	k.cmd = exec.Command("keepalived",
-		"--dont-fork",
-		"--log-console",
-		"--release-vips",
-		"--pid", "/keepalived.pid")
-
-	k.cmd.Stdout = os.Stdout
-	k.cmd.Stderr = os.Stderr
-
-	k.started = true
+	k.run()
+}
 
-	if err := k.cmd.Start(); err != nil {
-		log.Errorf("keepalived error: %v", err)
+// run supervises keepalived until it is stopped. keepalived is started again
+// immediately if it exits for a restart, and after an exponential backoff if
+// it exits unexpectedly. It reads the last written configuration on start.
+func (k *keepalived) run() {
+	for {
+		proc, err := k.newProcess(k.logs)
+		if err == nil {
+			k.mu.Lock()
+			k.proc, k.started, k.exitErr = proc, true, nil
+			stopping := k.stopping
+			k.mu.Unlock()
+			if stopping {
+				proc.Signal(syscall.SIGTERM)
+			}
+			err = proc.Wait()
+		}
+
+		k.mu.Lock()
+		restarting, stopping := k.restarting, k.stopping
+		k.proc, k.restarting = nil, false
+		if !restarting && !stopping {
+			if err == nil {
+				err = fmt.Errorf("keepalived exited")
+			}
+			k.exitErr = err
+		}
+		k.mu.Unlock()
+
+		if stopping {
+			log.Info("keepalived stopped")
+			return
+		}
+		if restarting {
+			log.Info("keepalived exited, starting it again")
+			continue
+		}
+
+		keepalivedExits.Inc()
+		k.backoff.Next(keepalivedBackoffID, k.backoff.Clock.Now())
+		delay := k.backoff.Get(keepalivedBackoffID)
+		log.Error("keepalived exited unexpectedly, starting it again", log.Fields{"err": err, "backoff": delay})
+		select {
+		case <-k.stopCh:
+			return
+		case <-time.After(delay):
+		}
 	}
+}
 
-	if err := k.cmd.Wait(); err != nil {
-		log.Fatalf("keepalived error: %v", err)
+// Healthz returns an error if keepalived is not running
+func (k *keepalived) Healthz() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case k.stopping:
+		return fmt.Errorf("keepalived is stopped")
+	case k.exitErr != nil:
+		return fmt.Errorf("keepalived is not running: %v", k.exitErr)
+	case !k.started:
+		return fmt.Errorf("keepalived is not started")
 	}
+	return nil
+}
+
+// Running returns true if the keepalived process is started
+func (k *keepalived) Running() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.proc != nil
 }
 
 // Reload sends SIGHUP to keepalived to reload the configuration.
+// keepalived reads the configuration on start, so it is not reloaded
+// before it is started.
 func (k *keepalived) Reload() error {
-	if !k.started {
-		// TODO: add a warning indicating that keepalived is not started?
+	k.mu.Lock()
+	proc := k.proc
+	k.mu.Unlock()
+	if proc == nil {
+		log.Info("keepalived is not started, skip reloading")
 		return nil
 	}
 
 	log.Info("reloading keepalived")
-	err := syscall.Kill(k.cmd.Process.Pid, syscall.SIGHUP)
+	reads, errors := k.logs.mark()
+	err := proc.Signal(syscall.SIGHUP)
 	if err != nil {
 		return fmt.Errorf("error reloading keepalived: %v", err)
 	}
 
-	return nil
+	return k.logs.waitReload(reads, errors, k.reloadTimeout, k.reloadSettle)
+}
+
+// Restart stops keepalived and waits for it to be started again with the
+// configuration. The VIPs are released and the VRRP instance re-elects, so
+// it is only used for the changes keepalived does not reload.
+func (k *keepalived) Restart() error {
+	k.mu.Lock()
+	proc := k.proc
+	if proc != nil {
+		k.restarting = true
+	}
+	k.mu.Unlock()
+	if proc == nil {
+		log.Info("keepalived is not started, skip restarting")
+		return nil
+	}
+
+	log.Info("restarting keepalived")
+	reads, errors := k.logs.mark()
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
+		k.mu.Lock()
+		k.restarting = false
+		k.mu.Unlock()
+		return fmt.Errorf("error restarting keepalived: %v", err)
+	}
+
+	return k.logs.waitReload(reads, errors, k.reloadTimeout, k.reloadSettle)
 }
 
 // Stop stop keepalived process
@@ -158,17 +627,35 @@ func (k *keepalived) Stop() {
 		log.Errorf("unexpected error flushing iptables chain %v: %v", err, iptablesChain)
 	}
 
-	log.Info("kill keepalived process", log.Fields{"pid": k.cmd.Process.Pid})
-	err = syscall.Kill(k.cmd.Process.Pid, syscall.SIGTERM)
-	if err != nil {
+	k.stopProcess()
+}
+
+// stopProcess stops the keepalived process and its supervision
+func (k *keepalived) stopProcess() {
+	k.mu.Lock()
+	proc := k.proc
+	if !k.stopping {
+		k.stopping = true
+		close(k.stopCh)
+	}
+	k.mu.Unlock()
+	if proc == nil {
+		return
+	}
+	log.Info("kill keepalived process")
+	if err := proc.Signal(syscall.SIGTERM); err != nil {
 		log.Errorf("error stopping keepalived: %v", err)
 	}
-
 }
 
 func (k *keepalived) removeVIP(vip string) error {
-	log.Info("removing configured VIP %v from dev %v", vip, k.nodeInfo.iface)
-	out, err := k8sexec.New().Command("ip", "addr", "del", vip+"/32", "dev", k.nodeInfo.iface).CombinedOutput()
+	dev := k.nodeInfo.iface
+	if d, ok := k.vipDevs[vip]; ok {
+		dev = d
+	}
+	log.Info("removing configured VIP %v from dev %v", vip, dev)
+	addr := corenet.NewAddr(net.ParseIP(vip), dev)
+	out, err := k8sexec.New().Command("ip", "addr", "del", addr.IPNet.String(), "dev", dev).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error reloading keepalived: %v\n%s", err, out)
 	}
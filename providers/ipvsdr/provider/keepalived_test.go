@@ -17,13 +17,84 @@ limitations under the License.
 package provider
 
 import (
-	"html/template"
+	"bytes"
+	"flag"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"text/template"
+	"time"
 
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/stretchr/testify/assert"
 )
 
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// testElection is the default election of the first node
+var testElection = vrrpElection{Priority: 100, AdvertInt: 1}
+
+var testTrackScript = &trackScript{
+	VRRPTrackScript: core.VRRPTrackScript{Interval: 2, Weight: -20, Fall: 3, Rise: 2},
+	URL:             "http://127.0.0.1:10254/healthz",
+}
+
+// fakeProcess is a keepalived which logs the output on start and on SIGHUP,
+// and exits on SIGTERM
+type fakeProcess struct {
+	logs   io.Writer
+	output string
+
+	mu      sync.Mutex
+	signals []os.Signal
+	exit    chan struct{}
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signals = append(p.signals, sig)
+	switch sig {
+	case syscall.SIGHUP:
+		if p.logs != nil {
+			io.WriteString(p.logs, p.output)
+		}
+	case syscall.SIGTERM:
+		close(p.exit)
+	}
+	return nil
+}
+
+func (p *fakeProcess) Signals() []os.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]os.Signal(nil), p.signals...)
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exit
+	return nil
+}
+
+func newTestKeepalived(t *testing.T, dir string, useUnicast bool) *keepalived {
+	tmpl, err := template.ParseFiles("../keepalived.tmpl")
+	assert.Nil(t, err)
+	k := newKeepalived(&nodeInfo{iface: "eth0", ip: "192.168.1.1", netmask: 24}, useUnicast, nil)
+	k.tmpl = tmpl
+	k.cfgPath = filepath.Join(dir, "keepalived.conf")
+	k.logs = newLogWatcher(ioutil.Discard)
+	k.reloadTimeout = time.Second
+	k.reloadSettle = 10 * time.Millisecond
+	return k
+}
+
 func TestTemplate(t *testing.T) {
 	tmpl, _ := template.ParseFiles("../keepalived.tmpl")
 	conf := make(map[string]interface{})
@@ -36,17 +107,384 @@ func TestTemplate(t *testing.T) {
 		{
 			VIP:       "192.168.99.200",
 			Scheduler: "rr",
-			RealServer: []string{
-				"192.168.1.1",
-				"192.168.1.2",
+			RealServer: []realServer{
+				{IP: "192.168.1.1", Weight: 100},
+				{IP: "192.168.1.2", Weight: 100},
 			},
 		},
 	}
 	conf["vips"] = []string{"192.168.99.200"}
+	conf["vipDevs"] = map[string]string{}
 	conf["neighbors"] = []ipmac{{IP: "192.168.1.2"}}
 	conf["priority"] = 100
+	conf["advertInt"] = 1.0
 	conf["useUnicast"] = true
 	conf["vrid"] = 100
 	conf["acceptMark"] = acceptMark
+	conf["notifyFifo"] = keepalivedNotifyFifo
 	assert.Nil(t, tmpl.Execute(ioutil.Discard, conf))
 }
+
+func renderConfig(t *testing.T, useUnicast bool, vss []virtualServer) string {
+	tmpl, err := template.ParseFiles("../keepalived.tmpl")
+	assert.Nil(t, err)
+
+	k := &keepalived{
+		useUnicast: useUnicast,
+		nodeInfo:   &nodeInfo{iface: "eth0", ip: "192.168.1.1", netmask: 24},
+		vips:       getVIPs(vss),
+	}
+	buf := &bytes.Buffer{}
+	assert.Nil(t, tmpl.Execute(buf, k.newConfig(vss, []ipmac{{IP: "192.168.1.2"}}, testElection, 50, nil)))
+	// collapse the blank lines and indents of the template
+	return strings.Join(strings.Fields(buf.String()), " ")
+}
+
+func TestConfigDualStack(t *testing.T) {
+	conf := renderConfig(t, true, []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 0}}},
+		{VIP: "fd00::200", Family: corenet.FamilyIPv6, Scheduler: "rr", RealServer: []realServer{{"fd00::1", 100}, {"fd00::2", 50}}},
+	})
+
+	// the IPv6 vip is not advertised by the IPv4 instance
+	assert.Contains(t, conf, "virtual_ipaddress { 192.168.99.200 }")
+	assert.Contains(t, conf, "virtual_ipaddress_excluded { fd00::200 }")
+	// a fwmark virtual server per family and protocol
+	assert.Equal(t, 2, strings.Count(conf, "ip_family inet "))
+	assert.Equal(t, 2, strings.Count(conf, "ip_family inet6 "))
+	assert.Contains(t, conf, "protocol TCP ip_family inet6 real_server fd00::1 0")
+	assert.Contains(t, conf, "protocol UDP ip_family inet real_server 192.168.1.1 0")
+	// the weights of the nodes
+	assert.Equal(t, 2, strings.Count(conf, "real_server 192.168.1.2 0 { weight 0 "))
+	assert.Equal(t, 2, strings.Count(conf, "real_server fd00::2 0 { weight 50 "))
+}
+
+func TestConfigIPv6Only(t *testing.T) {
+	vss := []virtualServer{
+		{VIP: "fd00::200", Family: corenet.FamilyIPv6, Scheduler: "rr", RealServer: []realServer{{"fd00::1", 100}}},
+	}
+
+	conf := renderConfig(t, false, vss)
+	assert.Contains(t, conf, "virtual_ipaddress { fd00::200 }")
+	assert.NotContains(t, conf, "virtual_ipaddress_excluded")
+	assert.NotContains(t, conf, "ip_family inet ")
+
+	// the unicast peers are IPv4, so the instance is IPv4
+	conf = renderConfig(t, true, vss)
+	assert.Contains(t, conf, "virtual_ipaddress { }")
+	assert.Contains(t, conf, "virtual_ipaddress_excluded { fd00::200 }")
+}
+
+func TestConfigProtocols(t *testing.T) {
+	rss := []realServer{{"192.168.1.1", 100}}
+
+	// only the udp virtual server, which keepalived does not check
+	conf := renderConfig(t, true, []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", Ports: []corenet.Port{{Protocol: "udp", Port: 53}}, RealServer: rss},
+	})
+	assert.NotContains(t, conf, "protocol TCP")
+	assert.NotContains(t, conf, "TCP_CHECK")
+	assert.Contains(t, conf, "protocol UDP ip_family inet real_server 192.168.1.1 0 { weight 100 }")
+
+	// tcp/53 and udp/53 are distinct services
+	conf = renderConfig(t, true, []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", Ports: []corenet.Port{{Protocol: "udp", Port: 53}, {Protocol: "tcp", Port: 53}}, RealServer: rss},
+	})
+	assert.Contains(t, conf, "protocol TCP ip_family inet real_server 192.168.1.1 0 { weight 100 TCP_CHECK { connect_port 53 connect_timeout 3 } }")
+	assert.Contains(t, conf, "protocol UDP ip_family inet real_server 192.168.1.1 0 { weight 100 TCP_CHECK { connect_port 53 connect_timeout 3 } }")
+
+	// the tcp checks are of the first tcp port
+	conf = renderConfig(t, true, []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", Ports: []corenet.Port{{Protocol: "tcp", Port: 8080}, {Protocol: "tcp", Port: 80}}, RealServer: rss},
+	})
+	assert.Contains(t, conf, "connect_port 8080")
+	assert.NotContains(t, conf, "protocol UDP")
+}
+
+func TestConfigGolden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	neighbors := []ipmac{{IP: "192.168.1.2"}, {IP: "192.168.1.3"}}
+	cases := []struct {
+		name       string
+		useUnicast bool
+		vss        []virtualServer
+		auth       *core.VRRPAuth
+		election   *vrrpElection
+	}{
+		{
+			name:       "unicast",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 100}, {"192.168.1.3", 100}}},
+			},
+		},
+		{
+			name:       "unicast-auth",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 100}}},
+			},
+			auth: &core.VRRPAuth{Type: "PASS", Password: "s3cret"},
+		},
+		{
+			name:       "multicast-weighted",
+			useUnicast: false,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "wlc", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 50}, {"192.168.1.3", 0}}},
+			},
+		},
+		{
+			name:       "dual-stack",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 100}}},
+				{VIP: "fd00::200", Family: corenet.FamilyIPv6, Scheduler: "rr", RealServer: []realServer{{"fd00::1", 100}, {"fd00::2", 100}}},
+			},
+		},
+		{
+			name:       "multi-vip",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 100}}},
+				{VIP: "10.1.0.100", Interface: "eth1", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}, {"192.168.1.2", 100}}},
+			},
+		},
+		{
+			name:       "priority",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{Priority: 200, AdvertInt: 1},
+		},
+		{
+			name:       "preempt",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{Priority: 100, Preempt: true, AdvertInt: 1},
+		},
+		{
+			name:       "preempt-delay",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{Priority: 100, Preempt: true, PreemptDelay: 30, AdvertInt: 1},
+		},
+		{
+			name:       "advert-int",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{Priority: 100, AdvertInt: 0.25},
+		},
+		{
+			name:       "garp",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{Priority: 100, AdvertInt: 1, GARP: arp.Schedule{Repeat: 5, Delay: 10 * time.Second, Refresh: 60 * time.Second, RefreshRepeat: 2}},
+		},
+		{
+			name:       "track",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+				{VIP: "10.1.0.100", Interface: "eth1", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+			},
+			election: &vrrpElection{
+				Priority:        100,
+				Preempt:         true,
+				AdvertInt:       1,
+				TrackInterfaces: []string{"bond1", "eth1", "eth0"},
+				TrackScript:     testTrackScript,
+			},
+		},
+		{
+			name:       "persistence",
+			useUnicast: true,
+			vss: []virtualServer{
+				{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", PersistenceTimeout: 600, PersistenceGranularity: "255.255.255.0", RealServer: []realServer{{"192.168.1.1", 100}}},
+				{VIP: "fd00::200", Family: corenet.FamilyIPv6, Scheduler: "rr", PersistenceTimeout: 600, RealServer: []realServer{{"fd00::1", 100}}},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		k := newTestKeepalived(t, dir, c.useUnicast)
+		election := testElection
+		if c.election != nil {
+			election = *c.election
+		}
+		_, err := k.UpdateConfig(c.vss, neighbors, election, 50, c.auth)
+		assert.Nil(t, err, c.name)
+		got, err := ioutil.ReadFile(k.cfgPath)
+		assert.Nil(t, err, c.name)
+
+		golden := filepath.Join("testdata", c.name+".golden")
+		if *update {
+			assert.Nil(t, ioutil.WriteFile(golden, got, 0644), c.name)
+		}
+		want, err := ioutil.ReadFile(golden)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, string(want), string(got), c.name)
+	}
+}
+
+func TestUpdateConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+
+	// not started, nothing to reload
+	assert.False(t, k.Running())
+	assert.Nil(t, k.Reload())
+
+	proc := &fakeProcess{logs: k.logs, output: "Opening file '/etc/keepalived/keepalived.conf'.\n", exit: make(chan struct{})}
+	k.proc = proc
+	assert.True(t, k.Running())
+
+	change, err := k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, configUnchanged, change)
+	assert.Nil(t, k.Reload())
+	assert.Equal(t, []os.Signal{syscall.SIGHUP}, proc.Signals())
+
+	// the identical state is not written again
+	assert.Nil(t, os.Remove(k.cfgPath))
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configUnchanged, change)
+	_, err = os.Stat(k.cfgPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// a forced resync writes the identical state again
+	data, err := k.Render(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	change, err = k.WriteConfig(data, true)
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	_, err = os.Stat(k.cfgPath)
+	assert.Nil(t, err)
+	change, err = k.WriteConfig(data, false)
+	assert.Nil(t, err)
+	assert.Equal(t, configUnchanged, change)
+
+	// a new real server
+	vss[0].RealServer = append(vss[0].RealServer, realServer{"192.168.1.2", 100})
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	conf, err := ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(conf), "real_server 192.168.1.2 0")
+	// no temporary file is left
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// the election is applied by a reload
+	for _, election := range []vrrpElection{
+		{Priority: 150, AdvertInt: 1},
+		{Priority: 150, Preempt: true, AdvertInt: 1},
+		{Priority: 150, Preempt: true, PreemptDelay: 10, AdvertInt: 1},
+		{Priority: 150, Preempt: true, PreemptDelay: 10, AdvertInt: 0.5},
+		// the VIPs do not flap on the changes of the gratuitous ARPs
+		{Priority: 150, Preempt: true, PreemptDelay: 10, AdvertInt: 0.5, GARP: defaultGARP},
+		{Priority: 150, Preempt: true, PreemptDelay: 10, AdvertInt: 0.5, GARP: arp.Schedule{Repeat: 5, Delay: 10 * time.Second, RefreshRepeat: 1}},
+		// neither is the tracking
+		{Priority: 150, Preempt: true, AdvertInt: 1, TrackInterfaces: []string{"bond1"}},
+		{Priority: 150, Preempt: true, AdvertInt: 1, TrackInterfaces: []string{"bond1"}, TrackScript: testTrackScript},
+		{Priority: 150, Preempt: true, AdvertInt: 1},
+	} {
+		change, err = k.UpdateConfig(vss, neighbors, election, 50, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, configReload, change, "%+v", election)
+	}
+}
+
+func TestUpdateConfigPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+	_, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+
+	// keepalived edits the virtual servers in place on reload
+	for _, c := range []struct {
+		name        string
+		timeout     uint32
+		granularity string
+		want        []string
+	}{
+		{"on", 360, "", []string{"persistence_timeout 360"}},
+		{"timeout changed", 600, "255.255.255.0", []string{"persistence_timeout 600", "persistence_granularity 255.255.255.0"}},
+		{"off", 0, "255.255.255.0", nil},
+	} {
+		vss[0].PersistenceTimeout, vss[0].PersistenceGranularity = c.timeout, c.granularity
+		change, err := k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, configReload, change, c.name)
+
+		conf, err := ioutil.ReadFile(k.cfgPath)
+		assert.Nil(t, err)
+		for _, want := range c.want {
+			// the TCP and UDP virtual servers
+			assert.Equal(t, 2, strings.Count(string(conf), want+"\n"), c.name)
+		}
+		if c.want == nil {
+			assert.NotContains(t, string(conf), "persistence_", c.name)
+		}
+	}
+}
+
+func TestUpdateConfigAuthRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+
+	change, err := k.UpdateConfig(vss, neighbors, testElection, 50, &core.VRRPAuth{Type: "PASS", Password: "old"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, configUnchanged, change)
+	info, err := os.Stat(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, &core.VRRPAuth{Type: "PASS", Password: "old"})
+	assert.Nil(t, err)
+	assert.Equal(t, configUnchanged, change)
+
+	// the rotated password is rendered
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, &core.VRRPAuth{Type: "PASS", Password: "new"})
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	conf, err := ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(conf), "auth_pass new")
+	assert.NotContains(t, string(conf), "auth_pass old")
+}
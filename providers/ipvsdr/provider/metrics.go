@@ -0,0 +1,203 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// keepalived runs the only vrrp instance of the template
+	vrrpInstanceName = "vips"
+
+	// allPorts labels the series of the fwmark virtual servers
+	allPorts = "all"
+
+	// DefaultStatsTTL is how long the ipvs counters are cached between
+	// the scrapes
+	DefaultStatsTTL = 5 * time.Second
+)
+
+var vrrpStates = []string{vrrpStateMaster, vrrpStateBackup, vrrpStateFault, vrrpStateStop}
+
+// metricsCollector exports the VRRP state of keepalived and the counters of
+// the ipvs virtual servers of the LoadBalancer and their real servers. The
+// counters are read from the kernel and cached for ttl, so frequent scrapes
+// do not dump the ipvs table every time. They start over when keepalived
+// recreates the virtual servers on a restart, the tracker keeps them
+// counting up.
+type metricsCollector struct {
+	p       *IpvsdrProvider
+	ttl     time.Duration
+	now     func() time.Time
+	tracker *coreipvs.StatsTracker
+
+	mu      sync.Mutex
+	stats   []coreipvs.ServiceStats
+	updated time.Time
+}
+
+func newMetricsCollector(p *IpvsdrProvider, ttl time.Duration) *metricsCollector {
+	return &metricsCollector{p: p, ttl: ttl, now: time.Now, tracker: coreipvs.NewStatsTracker(coreipvs.DefaultStatsRetention)}
+}
+
+// Collect implements metrics.Collector
+func (c *metricsCollector) Collect() []*metrics.Family {
+	return append(c.collectVRRP(), c.collectIpvs()...)
+}
+
+func (c *metricsCollector) collectVRRP() []*metrics.Family {
+	c.p.mu.Lock()
+	state, transitions, last := c.p.vrrpState, c.p.vrrpTransitions, c.p.vrrpTransitionTime
+	c.p.mu.Unlock()
+
+	stateFamily := &metrics.Family{
+		Name:       "loadbalancer_provider_vrrp_state",
+		Help:       "Whether the VRRP instance is in the state, it is in none before the first transition",
+		Type:       metrics.TypeGauge,
+		LabelNames: []string{"instance", "state"},
+	}
+	for _, s := range vrrpStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		stateFamily.Samples = append(stateFamily.Samples, metrics.Sample{LabelValues: []string{vrrpInstanceName, s}, Value: value})
+	}
+
+	families := []*metrics.Family{
+		stateFamily,
+		{
+			Name:       "loadbalancer_provider_vrrp_transitions_total",
+			Help:       "Number of the state transitions of the VRRP instance",
+			Type:       metrics.TypeCounter,
+			LabelNames: []string{"instance"},
+			Samples:    []metrics.Sample{{LabelValues: []string{vrrpInstanceName}, Value: float64(transitions)}},
+		},
+	}
+	if !last.IsZero() {
+		families = append(families, &metrics.Family{
+			Name:       "loadbalancer_provider_vrrp_last_transition_timestamp_seconds",
+			Help:       "Unix time of the last state transition of the VRRP instance",
+			Type:       metrics.TypeGauge,
+			LabelNames: []string{"instance"},
+			Samples:    []metrics.Sample{{LabelValues: []string{vrrpInstanceName}, Value: float64(last.UnixNano()) / 1e9}},
+		})
+	}
+	return families
+}
+
+// ipvsStats returns the cached counters, they are read again once they
+// expire. The last ones are kept if reading fails.
+func (c *metricsCollector) ipvsStats() []coreipvs.ServiceStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if c.stats != nil && now.Sub(c.updated) < c.ttl {
+		return c.stats
+	}
+	stats, err := c.p.ipvsManager.Stats()
+	if err != nil {
+		log.Warn("read ipvs stats error", log.Fields{"err": err})
+		return c.stats
+	}
+	c.stats, c.updated = c.tracker.Track(servedStats(stats)), now
+	return c.stats
+}
+
+// servedStats returns the stats of the fwmark virtual servers of keepalived,
+// the other virtual servers in the kernel are not of the LoadBalancer
+func servedStats(stats []coreipvs.ServiceStats) []coreipvs.ServiceStats {
+	keys := make(map[string]bool)
+	for _, family := range []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6} {
+		vs := coreipvs.VirtualServer{FWMark: acceptMark, Family: family}
+		keys[vs.Key()] = true
+	}
+	ret := make([]coreipvs.ServiceStats, 0, len(stats))
+	for _, s := range stats {
+		if keys[s.Key] {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func (c *metricsCollector) collectIpvs() []*metrics.Family {
+	stats := c.ipvsStats()
+	lb, nodes := c.p.trafficLabels()
+
+	vsLabels := []string{"loadbalancer", "virtual_server", "port"}
+	vsDirLabels := []string{"loadbalancer", "virtual_server", "port", "direction"}
+	rsLabels := []string{"loadbalancer", "virtual_server", "port", "node", "real_server"}
+	rsDirLabels := []string{"loadbalancer", "virtual_server", "port", "node", "real_server", "direction"}
+	vsConns := &metrics.Family{Name: "loadbalancer_provider_ipvs_virtual_server_connections_total", Help: "Number of the connections of the ipvs virtual server", Type: metrics.TypeCounter, LabelNames: vsLabels}
+	vsPackets := &metrics.Family{Name: "loadbalancer_provider_ipvs_virtual_server_packets_total", Help: "Number of the packets of the ipvs virtual server by direction", Type: metrics.TypeCounter, LabelNames: vsDirLabels}
+	vsBytes := &metrics.Family{Name: "loadbalancer_provider_ipvs_virtual_server_bytes_total", Help: "Number of the bytes of the ipvs virtual server by direction", Type: metrics.TypeCounter, LabelNames: vsDirLabels}
+	rsConns := &metrics.Family{Name: "loadbalancer_provider_ipvs_real_server_connections_total", Help: "Number of the connections of the real server of the ipvs virtual server", Type: metrics.TypeCounter, LabelNames: rsLabels}
+	rsPackets := &metrics.Family{Name: "loadbalancer_provider_ipvs_real_server_packets_total", Help: "Number of the packets of the real server of the ipvs virtual server by direction", Type: metrics.TypeCounter, LabelNames: rsDirLabels}
+	rsBytes := &metrics.Family{Name: "loadbalancer_provider_ipvs_real_server_bytes_total", Help: "Number of the bytes of the real server of the ipvs virtual server by direction", Type: metrics.TypeCounter, LabelNames: rsDirLabels}
+
+	add := func(conns, packets, bytes *metrics.Family, labels []string, s coreipvs.Stats) {
+		with := func(direction string) []string {
+			return append(append([]string(nil), labels...), direction)
+		}
+		conns.Samples = append(conns.Samples, metrics.Sample{LabelValues: labels, Value: float64(s.Conns)})
+		packets.Samples = append(packets.Samples,
+			metrics.Sample{LabelValues: with("in"), Value: float64(s.InPackets)},
+			metrics.Sample{LabelValues: with("out"), Value: float64(s.OutPackets)},
+		)
+		bytes.Samples = append(bytes.Samples,
+			metrics.Sample{LabelValues: with("in"), Value: float64(s.InBytes)},
+			metrics.Sample{LabelValues: with("out"), Value: float64(s.OutBytes)},
+		)
+	}
+	// the fwmark covers all ports of the VIPs
+	for _, vs := range stats {
+		add(vsConns, vsPackets, vsBytes, []string{lb, vs.Key, allPorts}, vs.Stats)
+		for _, rs := range sortedStatsKeys(vs.RealServers) {
+			add(rsConns, rsPackets, rsBytes, []string{lb, vs.Key, allPorts, nodes[realServerIP(rs)], rs}, vs.RealServers[rs])
+		}
+	}
+	return []*metrics.Family{vsConns, vsPackets, vsBytes, rsConns, rsPackets, rsBytes}
+}
+
+// realServerIP returns the address of the key of a real server
+func realServerIP(key string) string {
+	host, _, err := net.SplitHostPort(key)
+	if err != nil {
+		return key
+	}
+	return host
+}
+
+func sortedStatsKeys(m map[string]coreipvs.Stats) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
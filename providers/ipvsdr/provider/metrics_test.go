@@ -0,0 +1,107 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, c metrics.Collector) string {
+	r := metrics.NewRegistry()
+	r.MustRegister(c)
+	buf := &bytes.Buffer{}
+	_, err := r.WriteTo(buf)
+	assert.Nil(t, err)
+	return buf.String()
+}
+
+func TestMetricsCollector(t *testing.T) {
+	handle := coreipvs.NewFakeHandle(coreipvs.VirtualServer{
+		FWMark:      acceptMark,
+		Scheduler:   "rr",
+		RealServers: []coreipvs.RealServer{{Address: net.ParseIP("192.168.1.1"), Weight: 100}},
+	}, coreipvs.VirtualServer{
+		// not of the LoadBalancer
+		Address:   net.ParseIP("10.0.0.1"),
+		Port:      53,
+		Protocol:  coreipvs.ProtocolUDP,
+		Scheduler: "rr",
+	})
+	handle.SetStats(coreipvs.ServiceStats{
+		Key:         "FWM/1",
+		Stats:       coreipvs.Stats{Conns: 5, InPackets: 30, InBytes: 2000},
+		RealServers: map[string]coreipvs.Stats{"192.168.1.1:0": {Conns: 5, InPackets: 30, InBytes: 2000}},
+	})
+	p := &IpvsdrProvider{
+		nodeInfo:    &nodeInfo{iface: "eth0"},
+		ipvsManager: coreipvs.NewManager(handle),
+		lbName:      "default/lb",
+		nodeNames:   map[string]string{"192.168.1.1": "node1"},
+	}
+	now := time.Unix(1500000000, 0)
+	c := newMetricsCollector(p, DefaultStatsTTL)
+	c.now = func() time.Time { return now }
+
+	// no transition yet
+	out := scrape(t, c)
+	assert.Contains(t, out, `loadbalancer_provider_vrrp_state{instance="vips",state="MASTER"} 0`)
+	assert.Contains(t, out, `loadbalancer_provider_vrrp_transitions_total{instance="vips"} 0`)
+	assert.NotContains(t, out, "loadbalancer_provider_vrrp_last_transition_timestamp_seconds")
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_virtual_server_connections_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all"} 5`)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_virtual_server_bytes_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all",direction="in"} 2000`)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_real_server_packets_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all",node="node1",real_server="192.168.1.1:0",direction="in"} 30`)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_real_server_packets_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all",node="node1",real_server="192.168.1.1:0",direction="out"} 0`)
+	assert.NotContains(t, out, "UDP/10.0.0.1:53")
+
+	p.onVRRPStateChange(vrrpStateBackup)
+	p.onVRRPStateChange(vrrpStateMaster)
+	p.onVRRPStateChange(vrrpStateMaster)
+	out = scrape(t, c)
+	assert.Contains(t, out, `loadbalancer_provider_vrrp_state{instance="vips",state="MASTER"} 1`)
+	assert.Contains(t, out, `loadbalancer_provider_vrrp_state{instance="vips",state="BACKUP"} 0`)
+	assert.Contains(t, out, `loadbalancer_provider_vrrp_transitions_total{instance="vips"} 2`)
+	assert.Contains(t, out, "loadbalancer_provider_vrrp_last_transition_timestamp_seconds")
+
+	// the counters are cached until they expire
+	handle.SetStats(coreipvs.ServiceStats{
+		Key:         "FWM/1",
+		Stats:       coreipvs.Stats{Conns: 9, InPackets: 40, InBytes: 3000},
+		RealServers: map[string]coreipvs.Stats{"192.168.1.1:0": {Conns: 9, InPackets: 40, InBytes: 3000}},
+	})
+	assert.Contains(t, scrape(t, c), `loadbalancer_provider_ipvs_virtual_server_connections_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all"} 5`)
+	now = now.Add(DefaultStatsTTL)
+	assert.Contains(t, scrape(t, c), `loadbalancer_provider_ipvs_virtual_server_connections_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all"} 9`)
+
+	// keepalived is restarted, the counters continue from the last ones
+	handle.SetStats(coreipvs.ServiceStats{
+		Key:         "FWM/1",
+		Stats:       coreipvs.Stats{Conns: 1, InPackets: 2, InBytes: 100},
+		RealServers: map[string]coreipvs.Stats{"192.168.1.1:0": {Conns: 1, InPackets: 2, InBytes: 100}},
+	})
+	now = now.Add(DefaultStatsTTL)
+	out = scrape(t, c)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_virtual_server_connections_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all"} 10`)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_real_server_bytes_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all",node="node1",real_server="192.168.1.1:0",direction="in"} 3100`)
+	assert.Contains(t, out, `loadbalancer_provider_ipvs_real_server_packets_total{loadbalancer="default/lb",virtual_server="FWM/1",port="all",node="node1",real_server="192.168.1.1:0",direction="in"} 42`)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/zoumo/logdog"
+)
+
+// DefaultPeerDebounce is the default time a new set of VRRP peers must stay
+// unchanged before it is applied
+const DefaultPeerDebounce = 10 * time.Second
+
+// peerDebouncer holds the changes of the VRRP peers back until the peer set
+// is stable, so the peers churning during a rolling update of the nodes do
+// not reload keepalived on every step
+type peerDebouncer struct {
+	period time.Duration
+	now    func() time.Time
+
+	applied []string
+	pending []string
+	since   time.Time
+}
+
+func newPeerDebouncer(period time.Duration) *peerDebouncer {
+	return &peerDebouncer{period: period, now: time.Now}
+}
+
+// Peers returns the peers to configure given the current ones. The first
+// set is applied immediately, a changed set once it has been unchanged for
+// the period, until then the applied set is returned.
+func (d *peerDebouncer) Peers(peers []string) []string {
+	peers = sortedPeers(peers)
+	if d.applied == nil || d.period <= 0 || equalPeers(peers, d.applied) {
+		d.applied, d.pending = peers, nil
+		return d.applied
+	}
+
+	now := d.now()
+	if d.pending == nil || !equalPeers(peers, d.pending) {
+		log.Info("vrrp peers changed, waiting for them to settle", log.Fields{"peers": peers, "applied": d.applied})
+		d.pending, d.since = peers, now
+	}
+	if now.Sub(d.since) >= d.period {
+		d.applied, d.pending = d.pending, nil
+	}
+	return d.applied
+}
+
+// Remaining returns the time until the pending peers are applied, zero if
+// none is pending
+func (d *peerDebouncer) Remaining() time.Duration {
+	if d.pending == nil {
+		return 0
+	}
+	remaining := d.period - d.now().Sub(d.since)
+	if remaining <= 0 {
+		// applied on the next sync
+		return time.Millisecond
+	}
+	return remaining
+}
+
+// ResyncAfter implements core.ResyncProvider, the pending VRRP peers are
+// applied by a resync once they settle, and the traffic is reported by the
+// periodic resyncs
+func (p *IpvsdrProvider) ResyncAfter() time.Duration {
+	d := p.peers.Remaining()
+	if p.reportsTraffic() {
+		if t := p.traffic.Remaining(p.TrafficStatusInterval); d == 0 || t < d {
+			d = t
+		}
+	}
+	return d
+}
+
+func sortedPeers(peers []string) []string {
+	ret := append([]string{}, peers...)
+	sort.Strings(ret)
+	return ret
+}
+
+func equalPeers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
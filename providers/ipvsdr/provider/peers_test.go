@@ -0,0 +1,108 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerDebouncer(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newPeerDebouncer(10 * time.Second)
+	d.now = func() time.Time { return now }
+
+	// the first set is applied immediately
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, d.Peers([]string{"10.0.0.3", "10.0.0.2"}))
+	assert.Equal(t, time.Duration(0), d.Remaining())
+
+	// a changed set waits
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, d.Peers([]string{"10.0.0.2", "10.0.0.4"}))
+	assert.Equal(t, 10*time.Second, d.Remaining())
+	now = now.Add(5 * time.Second)
+	// another change restarts the wait
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.3"}, d.Peers([]string{"10.0.0.4"}))
+	assert.Equal(t, 10*time.Second, d.Remaining())
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, []string{"10.0.0.4"}, d.Peers([]string{"10.0.0.4"}))
+	assert.Equal(t, time.Duration(0), d.Remaining())
+
+	// a change reverted before it settles is dropped
+	d.Peers([]string{"10.0.0.5"})
+	assert.Equal(t, []string{"10.0.0.4"}, d.Peers([]string{"10.0.0.4"}))
+	assert.Equal(t, time.Duration(0), d.Remaining())
+}
+
+func TestPeerChurnReloadsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+
+	now := time.Unix(0, 0)
+	d := newPeerDebouncer(10 * time.Second)
+	d.now = func() time.Time { return now }
+
+	update := func(peers ...string) bool {
+		neighbors := []ipmac{}
+		for _, peer := range d.Peers(peers) {
+			neighbors = append(neighbors, ipmac{IP: peer})
+		}
+		change, err := k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+		assert.Nil(t, err)
+		return change != configUnchanged
+	}
+
+	assert.True(t, update("192.168.1.2", "192.168.1.3"))
+
+	// a rolling update replaces the nodes one by one
+	changes := 0
+	for _, peers := range [][]string{
+		{"192.168.1.3"},
+		{"192.168.1.3", "192.168.1.4"},
+		{"192.168.1.4"},
+		{"192.168.1.4", "192.168.1.5"},
+	} {
+		if update(peers...) {
+			changes++
+		}
+		now = now.Add(2 * time.Second)
+	}
+	assert.Equal(t, 0, changes)
+
+	// the resyncs after the peers settle
+	for i := 0; i < 10; i++ {
+		now = now.Add(2 * time.Second)
+		if update("192.168.1.5", "192.168.1.4") {
+			changes++
+		}
+	}
+	assert.Equal(t, 1, changes)
+
+	conf, err := ioutil.ReadFile(k.cfgPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(conf), "192.168.1.4\n    192.168.1.5\n  }")
+}
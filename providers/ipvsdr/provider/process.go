@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keepalived logs the file on every read of the configuration, on
+	// start and on reload
+	keepalivedReloadMarker = "Opening file"
+
+	defaultReloadTimeout = 10 * time.Second
+	defaultReloadSettle  = time.Second
+)
+
+// keepalivedConfigErrors are the logs of keepalived rejecting the
+// configuration, in lower case
+var keepalivedConfigErrors = []string{
+	"unknown keyword",
+	"configuration error",
+	"config error",
+	"parse error",
+}
+
+// process is the running keepalived, it is reloaded and stopped by signals
+type process interface {
+	Signal(os.Signal) error
+	// Wait waits for the process to exit
+	Wait() error
+}
+
+// cmdProcess is a process started by exec
+type cmdProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *cmdProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *cmdProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+// startKeepalived starts a keepalived process in foreground writing its logs
+// to the writer
+func startKeepalived(logs io.Writer) (process, error) {
+	cmd := exec.Command("keepalived",
+		"--dont-fork",
+		"--log-console",
+		"--release-vips",
+		"--pid", "/keepalived.pid")
+
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdProcess{cmd: cmd}, nil
+}
+
+// logWatcher copies the logs of keepalived to its output and counts the
+// reads of the configuration and the configuration errors in them
+type logWatcher struct {
+	out io.Writer
+
+	mu      sync.Mutex
+	partial []byte
+	reads   int
+	errors  []string
+	// changed is closed and replaced on every read or error
+	changed chan struct{}
+}
+
+func newLogWatcher(out io.Writer) *logWatcher {
+	return &logWatcher{out: out, changed: make(chan struct{})}
+}
+
+// Write implements io.Writer
+func (w *logWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i >= 0 {
+		scanner := bufio.NewScanner(bytes.NewReader(w.partial[:i+1]))
+		for scanner.Scan() {
+			w.scan(scanner.Text())
+		}
+		w.partial = append([]byte(nil), w.partial[i+1:]...)
+	}
+	return w.out.Write(p)
+}
+
+func (w *logWatcher) scan(line string) {
+	notify := false
+	if strings.Contains(line, keepalivedReloadMarker) {
+		w.reads++
+		notify = true
+	}
+	lower := strings.ToLower(line)
+	for _, e := range keepalivedConfigErrors {
+		if strings.Contains(lower, e) {
+			w.errors = append(w.errors, line)
+			notify = true
+			break
+		}
+	}
+	if notify {
+		close(w.changed)
+		w.changed = make(chan struct{})
+	}
+}
+
+// mark returns the numbers of the reads and the errors seen so far
+func (w *logWatcher) mark() (int, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reads, len(w.errors)
+}
+
+// waitReload waits for keepalived to read the configuration after the mark.
+// The reload fails if no read is seen within the timeout, or if an error is
+// seen before the settle period after the read has passed.
+func (w *logWatcher) waitReload(reads, errors int, timeout, settle time.Duration) error {
+	deadline := time.After(timeout)
+	var settled <-chan time.Time
+	for {
+		w.mu.Lock()
+		if len(w.errors) > errors {
+			errs := append([]string(nil), w.errors[errors:]...)
+			w.mu.Unlock()
+			return fmt.Errorf("keepalived rejected the configuration: %s", strings.Join(errs, "; "))
+		}
+		if settled == nil && w.reads > reads {
+			settled = time.After(settle)
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-settled:
+			return nil
+		case <-deadline:
+			if settled != nil {
+				return nil
+			}
+			return fmt.Errorf("keepalived did not reload the configuration within %v", timeout)
+		}
+	}
+}
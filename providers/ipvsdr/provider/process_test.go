@@ -0,0 +1,289 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const testReloadLog = "Keepalived_vrrp[2]: Opening file '/etc/keepalived/keepalived.conf'.\n"
+
+// fakeProcesses starts fakeProcesses which log the reload output on start
+type fakeProcesses struct {
+	output string
+
+	mu    sync.Mutex
+	procs []*fakeProcess
+}
+
+func (f *fakeProcesses) start(logs io.Writer) (process, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	proc := &fakeProcess{logs: logs, output: f.output, exit: make(chan struct{})}
+	f.procs = append(f.procs, proc)
+	io.WriteString(logs, testReloadLog)
+	return proc, nil
+}
+
+func (f *fakeProcesses) started() []*fakeProcess {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*fakeProcess(nil), f.procs...)
+}
+
+func TestApplyReloadOrRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	procs := &fakeProcesses{output: testReloadLog}
+	k.newProcess = procs.start
+	go k.run()
+	assert.Nil(t, waitRunning(k))
+
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+	apply := func(auth *core.VRRPAuth) configChange {
+		change, err := k.UpdateConfig(vss, neighbors, testElection, 50, auth)
+		assert.Nil(t, err)
+		assert.Nil(t, k.Apply(change))
+		return change
+	}
+
+	// the first configuration replaces the empty global_defs of the
+	// configuration keepalived is started with
+	assert.Nil(t, ioutil.WriteFile(k.cfgPath, []byte("global_defs {\n\n}\n"), 0600))
+	assert.Equal(t, configRestart, apply(nil))
+	assert.Len(t, procs.started(), 2)
+	assert.Equal(t, []os.Signal{syscall.SIGTERM}, procs.started()[0].Signals())
+
+	// the real servers and the peers are reloaded
+	vss[0].RealServer = append(vss[0].RealServer, realServer{"192.168.1.3", 100})
+	assert.Equal(t, configReload, apply(nil))
+	neighbors = append(neighbors, ipmac{IP: "192.168.1.3"})
+	assert.Equal(t, configReload, apply(nil))
+	assert.Len(t, procs.started(), 2)
+	assert.Equal(t, []os.Signal{syscall.SIGHUP, syscall.SIGHUP}, procs.started()[1].Signals())
+
+	// the vrrp version changes with the authentication
+	assert.Equal(t, configRestart, apply(&core.VRRPAuth{Type: "PASS", Password: "s3cret"}))
+	assert.Len(t, procs.started(), 3)
+	assert.Equal(t, configReload, apply(&core.VRRPAuth{Type: "PASS", Password: "rotated"}))
+	assert.Equal(t, configUnchanged, apply(&core.VRRPAuth{Type: "PASS", Password: "rotated"}))
+	assert.Len(t, procs.started(), 3)
+}
+
+func TestApplyReloadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	k.reloadTimeout = 100 * time.Millisecond
+	procs := &fakeProcesses{}
+	k.newProcess = procs.start
+	go k.run()
+	assert.Nil(t, waitRunning(k))
+
+	vss := []virtualServer{
+		{VIP: "192.168.99.200", Family: corenet.FamilyIPv4, Scheduler: "rr", RealServer: []realServer{{"192.168.1.1", 100}}},
+	}
+	neighbors := []ipmac{{IP: "192.168.1.2"}}
+	change, err := k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, k.Apply(change))
+
+	// keepalived does not read the configuration
+	vss[0].RealServer = append(vss[0].RealServer, realServer{"192.168.1.3", 100})
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	assert.NotNil(t, k.Apply(change))
+
+	// keepalived rejects the configuration, the failed reload is retried
+	// although the configuration is unchanged
+	proc := procs.started()[len(procs.started())-1]
+	proc.output = testReloadLog + "Keepalived_vrrp[2]: Unknown keyword 'foo'\n"
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	err = k.Apply(change)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Unknown keyword 'foo'")
+
+	// fixed
+	proc.output = testReloadLog
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configReload, change)
+	assert.Nil(t, k.Apply(change))
+	change, err = k.UpdateConfig(vss, neighbors, testElection, 50, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, configUnchanged, change)
+}
+
+func TestLogWatcherPartialLines(t *testing.T) {
+	w := newLogWatcher(ioutil.Discard)
+	reads, errors := w.mark()
+	w.Write([]byte("Opening fi"))
+	assert.Equal(t, 0, w.reads)
+	w.Write([]byte("le 'keepalived.conf'.\nUnknown key"))
+	w.Write([]byte("word 'bar'\n"))
+	assert.NotNil(t, w.waitReload(reads, errors, time.Second, time.Second))
+	assert.Equal(t, 1, w.reads)
+	assert.Len(t, w.errors, 1)
+}
+
+// stubKeepalived starts a shell script in place of keepalived and records
+// the start times
+type stubKeepalived struct {
+	script string
+
+	mu     sync.Mutex
+	starts []time.Time
+}
+
+func (s *stubKeepalived) start(logs io.Writer) (process, error) {
+	cmd := exec.Command("sh", "-c", s.script)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.starts = append(s.starts, time.Now())
+	s.mu.Unlock()
+	return &cmdProcess{cmd: cmd}, nil
+}
+
+func (s *stubKeepalived) started() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.starts...)
+}
+
+func TestSuperviseCrash(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	k.backoff = flowcontrol.NewBackOff(50*time.Millisecond, 200*time.Millisecond)
+	assert.NotNil(t, k.Healthz())
+
+	// crashes shortly after the start
+	stub := &stubKeepalived{script: "sleep 0.05; exit 139"}
+	k.newProcess = stub.start
+	exits := keepalivedExits.Get()
+	done := make(chan struct{})
+	go func() {
+		k.run()
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.started()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	starts := stub.started()
+	assert.True(t, len(starts) >= 4)
+	assert.True(t, keepalivedExits.Get()-exits >= 3)
+	// the backoff doubles up to the max
+	for i, backoff := range []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond} {
+		gap := starts[i+1].Sub(starts[i])
+		assert.True(t, gap >= backoff, "restart %d after %v", i, gap)
+	}
+
+	// a crashed keepalived is unhealthy
+	deadline = time.Now().Add(5 * time.Second)
+	for k.Healthz() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Contains(t, k.Healthz().Error(), "exit status 139")
+
+	// stopping interrupts the backoff
+	k.stopProcess()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+}
+
+func TestSuperviseStop(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	dir, err := ioutil.TempDir("", "keepalived")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	k := newTestKeepalived(t, dir, true)
+	stub := &stubKeepalived{script: "exec sleep 10"}
+	k.newProcess = stub.start
+	exits := keepalivedExits.Get()
+	done := make(chan struct{})
+	go func() {
+		k.run()
+		close(done)
+	}()
+	assert.Nil(t, waitRunning(k))
+	assert.Nil(t, k.Healthz())
+
+	// an intentional stop is not restarted
+	k.stopProcess()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor did not stop")
+	}
+	assert.Len(t, stub.started(), 1)
+	assert.Equal(t, exits, keepalivedExits.Get())
+	assert.False(t, k.Running())
+	assert.NotNil(t, k.Healthz())
+}
+
+func waitRunning(k *keepalived) error {
+	deadline := time.Now().Add(time.Second)
+	for !k.Running() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("keepalived is not running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
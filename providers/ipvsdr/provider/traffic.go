@@ -0,0 +1,173 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+)
+
+// DefaultTrafficStatusInterval is the default period of reporting the
+// traffic of the real servers in the LoadBalancer status
+const DefaultTrafficStatusInterval = time.Minute
+
+// NodeTraffic is the traffic of the real servers through a node of the
+// LoadBalancer, it is reported in the status by the name of the node
+type NodeTraffic struct {
+	// ActiveConns are the active connections to the real servers keyed by
+	// their node names
+	ActiveConns map[string]int `json:"activeConns"`
+}
+
+// trafficReporter caches the status of the traffic, the connections change
+// all the time, so the status is read again once per interval instead of
+// patching the LoadBalancer on every sync
+type trafficReporter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	status  json.RawMessage
+	updated time.Time
+}
+
+func newTrafficReporter() *trafficReporter {
+	return &trafficReporter{now: time.Now}
+}
+
+// Status returns the status of the traffic of the node, it is read again by
+// read once it is older than interval. The last one is kept if reading
+// fails.
+func (r *trafficReporter) Status(interval time.Duration, node string, read func() (*NodeTraffic, error)) json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.status != nil && now.Sub(r.updated) < interval {
+		return r.status
+	}
+	traffic, err := read()
+	if err != nil {
+		log.Warn("read ipvs active connections error", log.Fields{"err": err})
+		return r.status
+	}
+	r.status, _ = json.Marshal(map[string]interface{}{
+		"providersStatuses": map[string]interface{}{
+			"ipvsdr": map[string]interface{}{
+				"traffic": map[string]*NodeTraffic{node: traffic},
+			},
+		},
+	})
+	r.updated = now
+	return r.status
+}
+
+// Remaining returns the time until the status is read again
+func (r *trafficReporter) Remaining(interval time.Duration) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == nil {
+		return interval
+	}
+	remaining := interval - r.now().Sub(r.updated)
+	if remaining <= 0 {
+		// read on the next sync
+		return time.Millisecond
+	}
+	return remaining
+}
+
+// reportsTraffic returns true if the traffic is reported in the status
+func (p *IpvsdrProvider) reportsTraffic() bool {
+	return p.NodeName != "" && p.TrafficStatusInterval > 0
+}
+
+// Status implements core.StatusProvider, it reports the active connections
+// of the real servers through this node every TrafficStatusInterval
+func (p *IpvsdrProvider) Status() json.RawMessage {
+	if !p.reportsTraffic() {
+		return nil
+	}
+	return p.traffic.Status(p.TrafficStatusInterval, p.NodeName, p.nodeTraffic)
+}
+
+// nodeTraffic sums up the active connections of the real servers of the
+// served families by their nodes, the real servers of unknown nodes are
+// keyed by their addresses
+func (p *IpvsdrProvider) nodeTraffic() (*NodeTraffic, error) {
+	p.mu.Lock()
+	families, nodes := p.servedFamilies, p.nodeNames
+	p.mu.Unlock()
+
+	traffic := &NodeTraffic{ActiveConns: make(map[string]int)}
+	for _, family := range families {
+		vs := coreipvs.VirtualServer{FWMark: acceptMark, Family: family}
+		conns, err := p.ipvsManager.ActiveConns(&vs)
+		if err != nil {
+			return nil, err
+		}
+		for rs, n := range conns {
+			ip := realServerIP(rs)
+			node, ok := nodes[ip]
+			if !ok {
+				node = ip
+			}
+			traffic.ActiveConns[node] += n
+		}
+	}
+	return traffic, nil
+}
+
+// trafficLabels returns the LoadBalancer and the node names of the real
+// servers which label the ipvs metrics
+func (p *IpvsdrProvider) trafficLabels() (string, map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lbName, p.nodeNames
+}
+
+// realServerNodes returns the names of the nodes keyed by the addresses of
+// the real servers, the removed nodes being drained keep the names they had
+func (p *IpvsdrProvider) realServerNodes(names []string, rss map[corenet.Family][]realServer) map[string]string {
+	nodes := make(map[string]string)
+	for _, name := range names {
+		for _, family := range []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6} {
+			for _, ip := range p.storeLister.NodeIPs([]string{name}, family) {
+				nodes[ip.String()] = name
+			}
+		}
+	}
+
+	p.mu.Lock()
+	last := p.nodeNames
+	p.mu.Unlock()
+	for _, servers := range rss {
+		for _, rs := range servers {
+			if _, ok := nodes[rs.IP]; ok {
+				continue
+			}
+			if name, ok := last[rs.IP]; ok {
+				nodes[rs.IP] = name
+			}
+		}
+	}
+	return nodes
+}
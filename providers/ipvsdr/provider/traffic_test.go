@@ -0,0 +1,75 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrafficStatus(t *testing.T) {
+	handle := coreipvs.NewFakeHandle(coreipvs.VirtualServer{
+		FWMark:    acceptMark,
+		Scheduler: "rr",
+		RealServers: []coreipvs.RealServer{
+			{Address: net.ParseIP("192.168.1.1"), Weight: 100},
+			{Address: net.ParseIP("192.168.1.2"), Weight: 100},
+		},
+	})
+	handle.SetActiveConns("FWM/1", "192.168.1.1:0", 12)
+	handle.SetActiveConns("FWM/1", "192.168.1.2:0", 3)
+	p := &IpvsdrProvider{
+		ipvsManager:    coreipvs.NewManager(handle),
+		peers:          newPeerDebouncer(DefaultPeerDebounce),
+		traffic:        newTrafficReporter(),
+		servedFamilies: []corenet.Family{corenet.FamilyIPv4},
+		nodeNames:      map[string]string{"192.168.1.1": "node1"},
+	}
+	now := time.Unix(1500000000, 0)
+	p.traffic.now = func() time.Time { return now }
+
+	// not reported without the node name
+	p.TrafficStatusInterval = DefaultTrafficStatusInterval
+	assert.Nil(t, p.Status())
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+
+	p.NodeName = "node0"
+	assert.Equal(t, DefaultTrafficStatusInterval, p.ResyncAfter())
+	assert.JSONEq(t, `{"providersStatuses":{"ipvsdr":{"traffic":{"node0":{"activeConns":{"node1":12,"192.168.1.2":3}}}}}}`, string(p.Status()))
+
+	// the status is not read again until the interval passes
+	handle.SetActiveConns("FWM/1", "192.168.1.1:0", 20)
+	now = now.Add(DefaultTrafficStatusInterval / 2)
+	assert.JSONEq(t, `{"providersStatuses":{"ipvsdr":{"traffic":{"node0":{"activeConns":{"node1":12,"192.168.1.2":3}}}}}}`, string(p.Status()))
+	assert.Equal(t, DefaultTrafficStatusInterval/2, p.ResyncAfter())
+	now = now.Add(DefaultTrafficStatusInterval / 2)
+	assert.Equal(t, time.Millisecond, p.ResyncAfter())
+	assert.JSONEq(t, `{"providersStatuses":{"ipvsdr":{"traffic":{"node0":{"activeConns":{"node1":20,"192.168.1.2":3}}}}}}`, string(p.Status()))
+
+	// the last status is kept if reading fails
+	now = now.Add(DefaultTrafficStatusInterval)
+	p.servedFamilies = []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+	assert.JSONEq(t, `{"providersStatuses":{"ipvsdr":{"traffic":{"node0":{"activeConns":{"node1":20,"192.168.1.2":3}}}}}}`, string(p.Status()))
+
+	p.TrafficStatusInterval = 0
+	assert.Nil(t, p.Status())
+}
@@ -17,18 +17,13 @@ limitations under the License.
 package provider
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"os"
 	"regexp"
 	"strings"
 
 	"github.com/golang/glog"
-	"k8s.io/client-go/pkg/api/v1"
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 )
 
@@ -39,24 +34,6 @@ var (
 	lvsRegex      = regexp.MustCompile(`NAT`)
 )
 
-// GetNodeHostIP returns the provided node's IP, based on the priority:
-// 1. NodeExternalIP
-// 2. NodeInternalIP
-func GetNodeHostIP(node *v1.Node) (net.IP, error) {
-	addresses := node.Status.Addresses
-	addressMap := make(map[v1.NodeAddressType][]v1.NodeAddress)
-	for i := range addresses {
-		addressMap[addresses[i].Type] = append(addressMap[addresses[i].Type], addresses[i])
-	}
-	if addresses, ok := addressMap[v1.NodeExternalIP]; ok {
-		return net.ParseIP(addresses[0].Address), nil
-	}
-	if addresses, ok := addressMap[v1.NodeInternalIP]; ok {
-		return net.ParseIP(addresses[0].Address), nil
-	}
-	return nil, fmt.Errorf("host IP unknown; known addresses: %v", addresses)
-}
-
 func appendIfMissing(slice []string, item string) []string {
 	for _, elem := range slice {
 		if elem == item {
@@ -201,23 +178,11 @@ func (slice stringSlice) pos(value string) int {
 }
 
 // getPriority returns the priority of one node using the
-// IP address as key. It starts in 100
-func getNodePriority(ip string, nodes []string) int {
-	return 100 + stringSlice(nodes).pos(ip)
-}
-
-func checksum(filename string) (string, error) {
-	var result []byte
-	file, err := os.Open(filename)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hash := md5.New()
-	_, err = io.Copy(hash, file)
-	if err != nil {
-		return "", err
+// IP address as key. It starts in base, the preferred node is ranked
+// above all the others
+func getNodePriority(ip string, nodes []string, base int, preferred string) int {
+	if preferred != "" && ip == preferred {
+		return base + len(nodes)
 	}
-	return hex.EncodeToString(hash.Sum(result)), nil
+	return base + stringSlice(nodes).pos(ip)
 }
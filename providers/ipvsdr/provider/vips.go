@@ -0,0 +1,235 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/dr"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/firewall"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// vipList returns the served vips with their interfaces
+func (p *IpvsdrProvider) vipList() []core.VIP {
+	ret := make([]core.VIP, 0, len(p.vips))
+	for _, vip := range p.vips {
+		ret = append(ret, core.VIP{IP: vip, Interface: p.vipIfaces[vip.String()]})
+	}
+	return ret
+}
+
+// vipInterface returns the interface the vip is served on
+func (p *IpvsdrProvider) vipInterface(vip net.IP) string {
+	if iface, ok := p.vipIfaces[vip.String()]; ok {
+		return iface
+	}
+	return p.nodeInfo.iface
+}
+
+// validateVIPInterfaces returns a PermanentError if the interface of a vip
+// does not exist on the node
+func validateVIPInterfaces(vips []core.VIP) error {
+	for _, vip := range vips {
+		if vip.Interface == "" {
+			continue
+		}
+		if _, err := net.InterfaceByName(vip.Interface); err != nil {
+			return core.NewPermanentError("InvalidVIP", fmt.Errorf("interface %v of vip %v: %v", vip.Interface, vip.IP, err))
+		}
+	}
+	return nil
+}
+
+// diffVIPs returns the vips added to and removed from the old ones, a vip
+// moved to another interface is both removed and added
+func diffVIPs(old, cur []core.VIP) (added, removed []core.VIP) {
+	key := func(vip core.VIP) string {
+		return vip.IP.String() + "%" + vip.Interface
+	}
+	oldKeys := make(map[string]bool, len(old))
+	for _, vip := range old {
+		oldKeys[key(vip)] = true
+	}
+	curKeys := make(map[string]bool, len(cur))
+	for _, vip := range cur {
+		curKeys[key(vip)] = true
+		if !oldKeys[key(vip)] {
+			added = append(added, vip)
+		}
+	}
+	for _, vip := range old {
+		if !curKeys[key(vip)] {
+			removed = append(removed, vip)
+		}
+	}
+	return added, removed
+}
+
+// ensureVIPs replaces the served vips. The state of the removed ones is torn
+// down, leaving the others alone, and the added ones are bound on dev lo.
+// The marks of the added ones are set by the following ensureIptablesMark,
+// and keepalived adds and removes them on the uplinks on reload.
+func (p *IpvsdrProvider) ensureVIPs(vips []core.VIP) error {
+	added, removed := diffVIPs(p.vipList(), vips)
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	log.Info("vips changed", log.Fields{"added": added, "removed": removed})
+
+	errs := make([]error, 0)
+	for _, vip := range removed {
+		errs = append(errs, p.deleteVIPMarks(vip.IP))
+		if sr := p.sourceRoute; sr != nil && corenet.FamilyOf(sr.Gateway) == corenet.FamilyOf(vip.IP) {
+			errs = append(errs, corenet.DeleteSourceRule(p.routeHandle, vip.IP, sr.Table))
+		}
+	}
+
+	p.vips = make([]net.IP, 0, len(vips))
+	p.vipIfaces = make(map[string]string)
+	for _, vip := range vips {
+		p.vips = append(p.vips, vip.IP)
+		if vip.Interface != "" {
+			p.vipIfaces[vip.IP.String()] = vip.Interface
+		}
+	}
+	// the watchers must not restore the removed ones
+	p.addrWatcher.SetAddrs(p.loopbackAddrs())
+	p.linkMonitor.SetAddrs(p.uplinkAddrs())
+
+	for _, vip := range removed {
+		if p.servesVIP(vip.IP) {
+			// moved to another interface
+			continue
+		}
+		errs = append(errs, p.realServer.Teardown(vip.IP))
+	}
+	for _, vip := range added {
+		errs = append(errs, p.realServer.Ensure(vip.IP))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// servesVIP returns true if the vip is served
+func (p *IpvsdrProvider) servesVIP(ip net.IP) bool {
+	for _, vip := range p.vips {
+		if vip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopbackAddrs returns the vips bound on dev lo
+func (p *IpvsdrProvider) loopbackAddrs() []corenet.Addr {
+	addrs := make([]corenet.Addr, 0, len(p.vips))
+	for _, vip := range p.vips {
+		addr := corenet.NewAddr(vip, dr.LoopbackLink)
+		addr.Label = dr.OwnerLabel
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// uplinkAddrs returns the vips on their uplinks
+func (p *IpvsdrProvider) uplinkAddrs() []corenet.Addr {
+	addrs := make([]corenet.Addr, 0, len(p.vips))
+	for _, vip := range p.vips {
+		addrs = append(addrs, corenet.NewAddr(vip, p.vipInterface(vip)))
+	}
+	return addrs
+}
+
+// deleteVIPMarks deletes the marks of the traffic to the vip
+func (p *IpvsdrProvider) deleteVIPMarks(vip net.IP) error {
+	errs := make([]error, 0)
+	ipt := p.iptablesOf(vip)
+	for _, protocol := range []string{"tcp", "udp"} {
+		errs = append(errs, ipt.DeleteRule("mangle", "PREROUTING", p.markArgs(vip, protocol, "", acceptMark)...))
+		for _, neighbor := range p.neighbors {
+			errs = append(errs, ipt.DeleteRule("mangle", "PREROUTING", p.markArgs(vip, protocol, neighbor.MAC.String(), dropMark)...))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ensureSourceRanges allows the source ranges only to reach the ports of
+// the vips, all clients if the ranges are empty. The rules of the vips
+// which are gone are deleted.
+func (p *IpvsdrProvider) ensureSourceRanges(vips []core.VIP, ports []corenet.Port, ranges []*net.IPNet) error {
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+		if err := p.allowlists[corenet.FamilyOf(vip.IP)].EnsureAllowRules(vip.IP, ports, ranges); err != nil {
+			return err
+		}
+	}
+	for _, a := range p.allowlists {
+		for _, vip := range a.VIPs() {
+			if desired[vip.String()] {
+				continue
+			}
+			if err := a.DeleteAllowRules(vip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureRateLimits drops the new connections to the vips beyond the
+// limits, the rules of the vips which are gone or no longer limited are
+// deleted
+func (p *IpvsdrProvider) ensureRateLimits(vips []core.VIP, rateLimit *core.RateLimit) error {
+	limits := rateLimits(rateLimit)
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+		if err := p.limiters[corenet.FamilyOf(vip.IP)].EnsureLimitRules(vip.IP, limits); err != nil {
+			return err
+		}
+	}
+	for _, l := range p.limiters {
+		for _, vip := range l.VIPs() {
+			if desired[vip.String()] {
+				continue
+			}
+			if err := l.DeleteLimitRules(vip); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rateLimits returns the limits of the vip and its ports, none if the rate
+// limit is nil
+func rateLimits(rateLimit *core.RateLimit) []firewall.Limit {
+	if rateLimit == nil {
+		return nil
+	}
+	limits := []firewall.Limit{{MaxConnections: rateLimit.MaxConnections, ConnectionRate: rateLimit.ConnectionRate}}
+	for _, rl := range rateLimit.Ports {
+		port := rl.CorePort()
+		limits = append(limits, firewall.Limit{Port: &port, MaxConnections: rl.MaxConnections, ConnectionRate: rl.ConnectionRate})
+	}
+	return limits
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"net"
+	"testing"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/dr"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/firewall"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+	utiliptables "k8s.io/kubernetes/pkg/util/iptables"
+)
+
+type fakeSysctl map[string]int
+
+func (f fakeSysctl) GetSysctl(key string) (int, error) {
+	return f[key], nil
+}
+
+func (f fakeSysctl) SetSysctl(key string, value int) error {
+	f[key] = value
+	return nil
+}
+
+func loopbackIPs(t *testing.T, addrs *corenet.FakeAddrHandle) []string {
+	list, err := addrs.AddrList(dr.LoopbackLink)
+	assert.Nil(t, err)
+	ips := []string{}
+	for _, a := range list {
+		ips = append(ips, a.IP.String())
+	}
+	return ips
+}
+
+func TestEnsureVIPs(t *testing.T) {
+	addrs := corenet.NewFakeAddrHandle()
+	ipt := firewall.NewFakeIPTables(false)
+	first := core.VIP{IP: net.ParseIP("10.0.0.100")}
+	p := &IpvsdrProvider{
+		nodeInfo:    &nodeInfo{iface: "eth0"},
+		vips:        []net.IP{first.IP},
+		vipIfaces:   map[string]string{},
+		realServer:  dr.NewRealServer(addrs, fakeSysctl{}),
+		ipt:         ipt,
+		addrWatcher: corenet.NewAddrWatcher(addrs, nil),
+		linkMonitor: corenet.NewLinkMonitor(addrs),
+	}
+	assert.Nil(t, p.setLoopbackVIP())
+	mac, _ := net.ParseMAC("52:54:00:00:00:02")
+	neighbors := []ipmac{{IP: "192.168.1.2", MAC: mac}}
+	p.ensureIptablesMark(neighbors)
+
+	// add a second vip on another interface
+	second := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"}
+	assert.Nil(t, p.ensureVIPs([]core.VIP{first, second}))
+	p.ensureIptablesMark(neighbors)
+	assert.Equal(t, []string{"10.0.0.100", "10.1.0.100"}, loopbackIPs(t, addrs))
+	assert.Equal(t, []string{"eth0", "eth1"}, p.Interfaces())
+	rules := ipt.Rules("mangle", "PREROUTING")
+	assert.Contains(t, rules, "-i eth1 -d 10.1.0.100 -p tcp -j MARK --set-mark 1")
+	assert.Contains(t, rules, "-i eth1 -d 10.1.0.100 -p udp -m mac --mac-source 52:54:00:00:00:02 -j MARK --set-mark 2")
+	assert.Contains(t, rules, "-i eth0 -d 10.0.0.100 -p tcp -j MARK --set-mark 1")
+	assert.Len(t, rules, 8)
+
+	// the state of the removed vip only is torn down
+	assert.Nil(t, p.ensureVIPs([]core.VIP{second}))
+	assert.Equal(t, []string{"10.1.0.100"}, loopbackIPs(t, addrs))
+	assert.Equal(t, []net.IP{second.IP}, p.vips)
+	rules = ipt.Rules("mangle", "PREROUTING")
+	assert.Len(t, rules, 4)
+	for _, rule := range rules {
+		assert.Contains(t, rule, "-i eth1 -d 10.1.0.100 ")
+	}
+
+	// unchanged
+	assert.Nil(t, p.ensureVIPs([]core.VIP{second}))
+	assert.Equal(t, []core.VIP{second}, p.vipList())
+}
+
+func TestDiffVIPs(t *testing.T) {
+	a := core.VIP{IP: net.ParseIP("10.0.0.100")}
+	b := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"}
+	moved := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth2"}
+
+	added, removed := diffVIPs([]core.VIP{a}, []core.VIP{a, b})
+	assert.Equal(t, []core.VIP{b}, added)
+	assert.Nil(t, removed)
+
+	added, removed = diffVIPs([]core.VIP{a, b}, []core.VIP{a, moved})
+	assert.Equal(t, []core.VIP{moved}, added)
+	assert.Equal(t, []core.VIP{b}, removed)
+}
+
+func TestEnsureSourceRanges(t *testing.T) {
+	ipt := firewall.NewFakeIPTables(false)
+	p := &IpvsdrProvider{
+		allowlists: map[corenet.Family]*firewall.Allowlist{
+			corenet.FamilyIPv4: firewall.NewAllowlist(ipt),
+			corenet.FamilyIPv6: firewall.NewAllowlist(firewall.NewFakeIPTables(true)),
+		},
+	}
+	_, cidr, _ := net.ParseCIDR("10.1.0.0/16")
+	first := core.VIP{IP: net.ParseIP("10.0.0.100")}
+	second := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"}
+
+	// all the ports of the vips without the ports annotation
+	assert.Nil(t, p.ensureSourceRanges([]core.VIP{first, second}, nil, []*net.IPNet{cidr}))
+	assert.Equal(t, []string{
+		"-d 10.0.0.100/32 -s 10.1.0.0/16 -j RETURN",
+		"-d 10.0.0.100/32 -j DROP",
+		"-d 10.1.0.100/32 -s 10.1.0.0/16 -j RETURN",
+		"-d 10.1.0.100/32 -j DROP",
+	}, ipt.Rules(utiliptables.TableFilter, firewall.AllowChain))
+
+	// the rules of the removed vip are deleted
+	ports := []corenet.Port{{Protocol: "tcp", Port: 80}}
+	assert.Nil(t, p.ensureSourceRanges([]core.VIP{second}, ports, []*net.IPNet{cidr}))
+	assert.Equal(t, []string{
+		"-d 10.1.0.100/32 -p tcp -m tcp --dport 80 -s 10.1.0.0/16 -j RETURN",
+		"-d 10.1.0.100/32 -p tcp -m tcp --dport 80 -j DROP",
+	}, ipt.Rules(utiliptables.TableFilter, firewall.AllowChain))
+
+	// all the clients are allowed without the ranges
+	assert.Nil(t, p.ensureSourceRanges([]core.VIP{second}, ports, nil))
+	assert.Nil(t, ipt.Rules(utiliptables.TableFilter, firewall.AllowChain))
+}
+
+func TestEnsureRateLimits(t *testing.T) {
+	ipt := firewall.NewFakeIPTables(false)
+	p := &IpvsdrProvider{
+		limiters: map[corenet.Family]*firewall.Limiter{
+			corenet.FamilyIPv4: firewall.NewLimiter(ipt),
+			corenet.FamilyIPv6: firewall.NewLimiter(firewall.NewFakeIPTables(true)),
+		},
+	}
+	first := core.VIP{IP: net.ParseIP("10.0.0.100")}
+	second := core.VIP{IP: net.ParseIP("10.1.0.100"), Interface: "eth1"}
+
+	rateLimit := &core.RateLimit{Ports: []core.PortRateLimit{{Protocol: "udp", Port: 53, Limits: core.Limits{MaxConnections: 100}}}}
+	assert.Nil(t, p.ensureRateLimits([]core.VIP{first, second}, rateLimit))
+	assert.Equal(t, []string{
+		`-d 10.0.0.100/32 -p udp -m udp --dport 53 -m conntrack --ctstate NEW -m connlimit --connlimit-above 100 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.0.0.100 udp/53 max-connections" -j DROP`,
+		`-d 10.1.0.100/32 -p udp -m udp --dport 53 -m conntrack --ctstate NEW -m connlimit --connlimit-above 100 --connlimit-mask 32 --connlimit-daddr -m comment --comment "10.1.0.100 udp/53 max-connections" -j DROP`,
+	}, ipt.Rules(utiliptables.TableFilter, firewall.LimitChain))
+
+	// the rules of the removed vip are deleted
+	assert.Nil(t, p.ensureRateLimits([]core.VIP{second}, rateLimit))
+	assert.Len(t, ipt.Rules(utiliptables.TableFilter, firewall.LimitChain), 1)
+
+	// nothing is limited without the rate limit
+	assert.Nil(t, p.ensureRateLimits([]core.VIP{second}, nil))
+	assert.Empty(t, ipt.Rules(utiliptables.TableFilter, firewall.LimitChain))
+}
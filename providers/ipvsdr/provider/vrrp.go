@@ -0,0 +1,299 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/conntrack"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/vrrp"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// keepalived writes the VRRP state transitions into the fifo
+	keepalivedNotifyFifo = "/keepalived.fifo"
+
+	vrrpStateMaster = "MASTER"
+	vrrpStateBackup = "BACKUP"
+	vrrpStateFault  = "FAULT"
+	vrrpStateStop   = "STOP"
+)
+
+// parseVRRPNotify parses a line written by keepalived into the notify
+// fifo, e.g.
+//
+//	INSTANCE "vips" MASTER 100
+//
+// only the transitions of VRRP instances are accepted
+func parseVRRPNotify(line string) (instance, state string, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "INSTANCE" {
+		return "", "", false
+	}
+	return strings.Trim(fields[1], "\""), fields[2], true
+}
+
+// watchVRRPState creates the notify fifo and handles the VRRP state
+// transitions until the provider is stopped
+func (p *IpvsdrProvider) watchVRRPState() error {
+	if err := syscall.Mkfifo(keepalivedNotifyFifo, 0600); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// open it for writing too, so reading does not block for a writer and
+	// does not end when keepalived restarts
+	fifo, err := os.OpenFile(keepalivedNotifyFifo, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-p.stopCh
+		fifo.Close()
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(fifo)
+		for scanner.Scan() {
+			instance, state, ok := parseVRRPNotify(scanner.Text())
+			if !ok {
+				continue
+			}
+			log.Info("VRRP state changed", log.Fields{"instance": instance, "state": state})
+			p.onVRRPStateChange(state)
+		}
+	}()
+
+	return nil
+}
+
+// onVRRPStateChange runs the ipvs sync daemon according to the VRRP state,
+// the master sends the connection states to the backups, so established
+// connections survive a failover
+func (p *IpvsdrProvider) onVRRPStateChange(state string) {
+	p.mu.Lock()
+	if state != p.vrrpState {
+		p.vrrpTransitions++
+		p.vrrpTransitionTime = time.Now()
+		p.recordVRRPTransition(vrrpTransition{From: p.vrrpState, To: state, Time: p.vrrpTransitionTime})
+	}
+	p.vrrpState = state
+	vrid := p.vrid
+	onRole := p.onRole
+	p.mu.Unlock()
+
+	if onRole != nil {
+		onRole(core.Role(state))
+	}
+
+	var err error
+	switch state {
+	case vrrpStateMaster:
+		err = p.ipvsManager.EnsureSyncDaemon(coreipvs.SyncStateMaster, p.nodeInfo.iface, vrid)
+	case vrrpStateBackup, vrrpStateFault:
+		err = p.ipvsManager.EnsureSyncDaemon(coreipvs.SyncStateBackup, p.nodeInfo.iface, vrid)
+	case vrrpStateStop:
+		err = p.ipvsManager.StopSyncDaemons()
+	}
+	if err != nil {
+		log.Error("ensure ipvs sync daemon error", log.Fields{"state": state, "err": err})
+	}
+
+	if state == vrrpStateMaster && p.FlushConntrackOnFailover {
+		// the entries created when the VIP was served by another node
+		// make the kernel drop the packets of the taken over flows
+		protocols := []conntrack.Protocol{conntrack.ProtocolTCP, conntrack.ProtocolUDP}
+		for _, vip := range p.vips {
+			if err := conntrack.FlushForIP(vip, protocols); err != nil {
+				log.Error("flush conntrack error", log.Fields{"vip": vip, "err": err})
+			}
+		}
+	}
+}
+
+// vridOf returns the vrid of the LoadBalancer, which is allocated by
+// VRIDAllocator if it is set, the one in the LoadBalancer status otherwise
+func (p *IpvsdrProvider) vridOf(lb *netv1alpha1.LoadBalancer) (int, error) {
+	status := 0
+	if s := lb.Status.ProvidersStatuses.Ipvsdr; s != nil && s.Vrid != nil {
+		status = *s.Vrid
+	}
+	if p.VRIDAllocator == nil {
+		if status == 0 {
+			return 0, fmt.Errorf("no vrid in the status of loadbalancer %s/%s", lb.Namespace, lb.Name)
+		}
+		return status, nil
+	}
+	return p.allocateVRID(lb.UID, status)
+}
+
+// allocateVRID returns the vrid allocated to the LoadBalancer by
+// VRIDAllocator, the preferred one is allocated if it is free. It is only
+// allocated once, the instances of the LoadBalancer on the other nodes get
+// the same vrid from the ConfigMap.
+func (p *IpvsdrProvider) allocateVRID(uid types.UID, preferred int) (int, error) {
+	p.mu.Lock()
+	allocated := p.allocatedVRID
+	p.mu.Unlock()
+	if allocated != 0 {
+		return allocated, nil
+	}
+
+	vrid, err := p.VRIDAllocator.Allocate(string(uid), preferred)
+	if err != nil {
+		return 0, err
+	}
+	if preferred != 0 && vrid != preferred {
+		log.Warn("the vrid in the loadbalancer status is allocated to another loadbalancer", log.Fields{"status": preferred, "vrid": vrid})
+	}
+	p.mu.Lock()
+	p.allocatedVRID = vrid
+	p.mu.Unlock()
+	return vrid, nil
+}
+
+// allocateInitialVRID allocates the vrid before keepalived starts, so the
+// conflicts are detected on the allocated one
+func (p *IpvsdrProvider) allocateInitialVRID() {
+	if p.VRIDAllocator == nil || p.lbUID == "" {
+		return
+	}
+	p.mu.Lock()
+	preferred := p.vrid
+	p.mu.Unlock()
+	vrid, err := p.allocateVRID(p.lbUID, preferred)
+	if err != nil {
+		log.Error("allocate vrid error, retried by the sync", log.Fields{"err": err})
+		return
+	}
+	p.mu.Lock()
+	p.vrid = vrid
+	p.mu.Unlock()
+}
+
+// OnDelete implements core.DeletionProvider, the vrid allocated by
+// VRIDAllocator is released
+func (p *IpvsdrProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	if p.VRIDAllocator == nil {
+		return nil
+	}
+	if err := p.VRIDAllocator.Release(string(lb.UID)); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.allocatedVRID = 0
+	p.mu.Unlock()
+	return nil
+}
+
+// detectVRIDConflicts listens for the advertisements of other VRRP instances
+// using the vrid with other VIPs before keepalived starts, so the provider
+// does not fight them for the vrid
+func (p *IpvsdrProvider) detectVRIDConflicts() {
+	if p.VRIDConflictDetection <= 0 {
+		return
+	}
+	p.mu.Lock()
+	vrid := p.vrid
+	p.mu.Unlock()
+	if vrid == 0 {
+		// not allocated yet
+		return
+	}
+
+	log.Info("detecting vrid conflicts", log.Fields{"iface": p.nodeInfo.iface, "vrid": vrid, "duration": p.VRIDConflictDetection})
+	conflicts, err := vrrp.DetectConflicts(p.nodeInfo.iface, vrid, p.vips, p.VRIDConflictDetection)
+	if err != nil {
+		log.Warn("detect vrid conflicts error, skipped", log.Fields{"err": err})
+		return
+	}
+	p.mu.Lock()
+	p.vridConflicts = conflicts
+	p.mu.Unlock()
+}
+
+// checkVRIDConflicts returns a PermanentError if another VRRP instance was
+// detected using the vrid
+func (p *IpvsdrProvider) checkVRIDConflicts(vrid int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msgs := []string{}
+	for _, c := range p.vridConflicts {
+		if c.VRID == vrid {
+			msgs = append(msgs, c.String())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return core.NewPermanentError("VRIDConflict", fmt.Errorf("%s", strings.Join(msgs, "; ")))
+}
+
+// SetRoleHandler implements core.RoleProvider, the VRRP state transitions
+// are the role transitions
+func (p *IpvsdrProvider) SetRoleHandler(handler func(core.Role)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onRole = handler
+}
+
+// SyncDaemons returns the running ipvs sync daemons for health checking
+func (p *IpvsdrProvider) SyncDaemons() ([]coreipvs.SyncDaemon, error) {
+	return p.ipvsManager.SyncDaemons()
+}
+
+// validateTrackScript returns a PermanentError if a failing track script
+// can not move the VIPs to another node of the priorities. The weight must
+// take the priority of every node across the one of the next node, within
+// [1, core.MaxVRRPPriority], and the nodes must preempt the master. The
+// node enters the fault state with a zero weight, which always fails over.
+func validateTrackScript(script *core.VRRPTrackScript, priorities []int, preempt bool) error {
+	if script.Weight == 0 || len(priorities) < 2 {
+		return nil
+	}
+	if !preempt {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("the vrrp track script of weight %d can not take the vips from the master without preempt, enable preempt or set the weight to 0", script.Weight))
+	}
+
+	sorted := append([]int(nil), priorities...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	weight := script.Weight
+	if weight < 0 {
+		weight = -weight
+	}
+	if gap := sorted[0] - sorted[1]; weight <= gap {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("the vrrp track script of weight %d can not move the vips from priority %d to %d, the weight must exceed %d", script.Weight, sorted[0], sorted[1], gap))
+	}
+	if lowest := sorted[len(sorted)-1]; script.Weight < 0 && lowest+script.Weight < 1 {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("the vrrp track script of weight %d takes priority %d below 1", script.Weight, lowest))
+	}
+	if script.Weight > 0 && sorted[0]+script.Weight > core.MaxVRRPPriority {
+		return core.NewPermanentError("InvalidVRRPConfig", fmt.Errorf("the vrrp track script of weight %d takes priority %d above %d", script.Weight, sorted[0], core.MaxVRRPPriority))
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/vrrp"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestParseVRRPNotify(t *testing.T) {
+	instance, state, ok := parseVRRPNotify(`INSTANCE "vips" MASTER 100`)
+	assert.True(t, ok)
+	assert.Equal(t, "vips", instance)
+	assert.Equal(t, vrrpStateMaster, state)
+
+	_, _, ok = parseVRRPNotify(`GROUP "group" BACKUP 0`)
+	assert.False(t, ok)
+}
+
+func TestOnVRRPStateChange(t *testing.T) {
+	handle := coreipvs.NewFakeHandle()
+	p := &IpvsdrProvider{
+		nodeInfo:    &nodeInfo{iface: "eth0"},
+		ipvsManager: coreipvs.NewManager(handle),
+		vrid:        50,
+	}
+	roles := []core.Role{}
+	p.SetRoleHandler(func(role core.Role) {
+		roles = append(roles, role)
+	})
+
+	p.onVRRPStateChange(vrrpStateBackup)
+	p.onVRRPStateChange(vrrpStateMaster)
+	p.onVRRPStateChange(vrrpStateStop)
+	assert.Equal(t, []string{
+		"StartSyncDaemon backup eth0 50",
+		"StopSyncDaemon backup",
+		"StartSyncDaemon master eth0 50",
+		"StopSyncDaemon master",
+	}, handle.Calls)
+	assert.Equal(t, []core.Role{core.RoleBackup, core.RoleMaster, core.RoleStop}, roles)
+}
+
+func TestCheckVRIDConflicts(t *testing.T) {
+	p := &IpvsdrProvider{}
+	assert.Nil(t, p.checkVRIDConflicts(50))
+
+	p.vridConflicts = []vrrp.Conflict{
+		{Advert: vrrp.Advert{VRID: 50, Source: net.ParseIP("192.168.1.9"), Addrs: []net.IP{net.ParseIP("192.168.99.9")}}},
+	}
+	err := p.checkVRIDConflicts(50)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Equal(t, "VRIDConflict", err.(*core.PermanentError).Reason)
+	assert.Equal(t, "vrid 50 is used by 192.168.1.9 for [192.168.99.9]", err.Error())
+
+	// the allocator assigned another vrid
+	assert.Nil(t, p.checkVRIDConflicts(51))
+}
+
+// fakeConfigMaps stores the ConfigMaps, the updates of a stale copy
+// conflict
+type fakeConfigMaps struct {
+	lock sync.Mutex
+	cms  map[string]*v1.ConfigMap
+}
+
+func newFakeConfigMaps() *fakeConfigMaps {
+	return &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cm, ok := f.cms[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.cms[cm.Name]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	cm = copyConfigMap(cm)
+	cm.ResourceVersion = "1"
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cur, ok := f.cms[cm.Name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	if cm.ResourceVersion != cur.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("stale"))
+	}
+	cm = copyConfigMap(cm)
+	version, _ := strconv.Atoi(cm.ResourceVersion)
+	cm.ResourceVersion = strconv.Itoa(version + 1)
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func copyConfigMap(cm *v1.ConfigMap) *v1.ConfigMap {
+	ret := *cm
+	ret.Data = make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		ret.Data[k] = v
+	}
+	return &ret
+}
+
+func vridLoadBalancer(uid string, vrid *int) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: uid, UID: types.UID(uid)},
+	}
+	lb.Status.ProvidersStatuses.Ipvsdr = &netv1alpha1.IpvsdrProviderStatus{Vrid: vrid}
+	return lb
+}
+
+func TestVRIDOf(t *testing.T) {
+	vrid := 10
+
+	// the one in the status without an allocator
+	p := &IpvsdrProvider{}
+	got, err := p.vridOf(vridLoadBalancer("lb-a", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, got)
+	_, err = p.vridOf(vridLoadBalancer("lb-a", nil))
+	assert.NotNil(t, err)
+	assert.Nil(t, p.OnDelete(vridLoadBalancer("lb-a", &vrid)))
+
+	// the instances of the LoadBalancers on two nodes share the ConfigMap,
+	// lb-b has the same vrid as lb-a in its status
+	cms := newFakeConfigMaps()
+	newProvider := func() *IpvsdrProvider {
+		return &IpvsdrProvider{VRIDAllocator: vrrp.NewAllocator(cms, "vrids")}
+	}
+	a1, a2, b1 := newProvider(), newProvider(), newProvider()
+
+	got, err = a1.vridOf(vridLoadBalancer("lb-a", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, got)
+	got, err = b1.vridOf(vridLoadBalancer("lb-b", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, got)
+	// the status is not required
+	got, err = a2.vridOf(vridLoadBalancer("lb-a", nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, got)
+
+	// the vrid is allocated once
+	cms.cms["vrids"].Data[vrrp.AllocationsKey] = "invalid"
+	got, err = a1.vridOf(vridLoadBalancer("lb-a", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, got)
+	cms.cms["vrids"].Data[vrrp.AllocationsKey] = `{"1":"lb-b","10":"lb-a"}`
+
+	// the vrid of the deleted LoadBalancer is allocated again
+	assert.Nil(t, a1.OnDelete(vridLoadBalancer("lb-a", &vrid)))
+	got, err = newProvider().vridOf(vridLoadBalancer("lb-c", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, got)
+}
+
+func TestAllocateInitialVRID(t *testing.T) {
+	cms := newFakeConfigMaps()
+	cms.cms["vrids"] = &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "vrids", ResourceVersion: "1"},
+		Data:       map[string]string{vrrp.AllocationsKey: `{"10":"lb-b"}`},
+	}
+	// the vrid in the status is allocated to lb-b
+	p := &IpvsdrProvider{VRIDAllocator: vrrp.NewAllocator(cms, "vrids"), lbUID: "lb-a", vrid: 10}
+	p.allocateInitialVRID()
+	assert.Equal(t, 1, p.vrid)
+
+	vrid := 10
+	got, err := p.vridOf(vridLoadBalancer("lb-a", &vrid))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, got)
+}
+
+func TestValidateTrackScript(t *testing.T) {
+	// the priorities of three nodes
+	priorities := []int{101, 100, 102}
+	for _, c := range []struct {
+		weight  int
+		preempt bool
+		valid   bool
+	}{
+		// the fault state always fails over
+		{0, false, true},
+		{-2, true, true},
+		{2, true, true},
+		{-50, true, true},
+		// the master is not preempted
+		{-50, false, false},
+		// the top node stays above the next one
+		{-1, true, false},
+		{1, true, false},
+		// out of [1, 254]
+		{-100, true, false},
+		{153, true, false},
+	} {
+		err := validateTrackScript(&core.VRRPTrackScript{Weight: c.weight}, priorities, c.preempt)
+		if c.valid {
+			assert.Nil(t, err, "%+v", c)
+		} else {
+			assert.True(t, core.IsPermanentError(err), "%+v", c)
+		}
+	}
+
+	// a single node has nothing to fail over to
+	assert.Nil(t, validateTrackScript(&core.VRRPTrackScript{Weight: -1}, []int{100}, false))
+}
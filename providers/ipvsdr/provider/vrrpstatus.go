@@ -0,0 +1,163 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// vrrpStateUnknown is the state of a running instance before its first
+	// transition is notified
+	vrrpStateUnknown = "UNKNOWN"
+	// vrrpHistorySize is the number of the last transitions kept
+	vrrpHistorySize = 10
+)
+
+// vrrpTransition is a state transition of the VRRP instance
+type vrrpTransition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// vrrpStatus is the VRRP instance of the node as served for debugging
+type vrrpStatus struct {
+	Instance string `json:"instance"`
+	// State is FAULT while keepalived is not running, the notified
+	// state may be stale then
+	State              string           `json:"state"`
+	Keepalived         string           `json:"keepalived"`
+	VRID               int              `json:"vrid"`
+	Priority           int              `json:"priority"`
+	VIPs               []string         `json:"vips"`
+	Unicast            bool             `json:"unicast"`
+	Peers              []string         `json:"peers,omitempty"`
+	Transitions        int              `json:"transitions"`
+	LastTransitionTime *time.Time       `json:"lastTransitionTime,omitempty"`
+	History            []vrrpTransition `json:"history"`
+}
+
+// setVRRPInstance records the VRRP instance of the configuration written
+// for keepalived, the peers are recorded in unicast mode only
+func (p *IpvsdrProvider) setVRRPInstance(priority int, vips []string, neighbors []ipmac) {
+	peers := []string{}
+	if p.keepalived.useUnicast {
+		for _, n := range neighbors {
+			peers = append(peers, n.IP)
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.vrrpPriority, p.vrrpVIPs, p.vrrpPeers = priority, vips, peers
+}
+
+// recordVRRPTransition keeps the transition in the history, the oldest one
+// is dropped once it is full. It must be called with p.mu held.
+func (p *IpvsdrProvider) recordVRRPTransition(t vrrpTransition) {
+	p.vrrpHistory = append(p.vrrpHistory, t)
+	if len(p.vrrpHistory) > vrrpHistorySize {
+		p.vrrpHistory = append([]vrrpTransition(nil), p.vrrpHistory[len(p.vrrpHistory)-vrrpHistorySize:]...)
+	}
+}
+
+// vrrpStatus returns the VRRP instance from the recorded state, it does not
+// touch keepalived or the kernel, so it answers while they hang
+func (p *IpvsdrProvider) vrrpStatus() vrrpStatus {
+	keepalived := "running"
+	err := p.keepalived.Healthz()
+	if err != nil {
+		keepalived = err.Error()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := vrrpStatus{
+		Instance:    vrrpInstanceName,
+		State:       p.vrrpState,
+		Keepalived:  keepalived,
+		VRID:        p.vrid,
+		Priority:    p.vrrpPriority,
+		VIPs:        append([]string{}, p.vrrpVIPs...),
+		Unicast:     p.keepalived.useUnicast,
+		Peers:       append([]string(nil), p.vrrpPeers...),
+		Transitions: p.vrrpTransitions,
+		History:     append([]vrrpTransition{}, p.vrrpHistory...),
+	}
+	switch {
+	case err != nil:
+		status.State = vrrpStateFault
+	case status.State == "":
+		status.State = vrrpStateUnknown
+	}
+	if !p.vrrpTransitionTime.IsZero() {
+		last := p.vrrpTransitionTime
+		status.LastTransitionTime = &last
+	}
+	return status
+}
+
+// VRRPHandler returns an http.Handler serving the VRRP instance of the node
+// for debugging, in json or in text if the request accepts text/plain
+func (p *IpvsdrProvider) VRRPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := p.vrrpStatus()
+		if strings.Contains(req.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeVRRPStatus(w, status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// writeVRRPStatus writes the status in a human readable form
+func writeVRRPStatus(w io.Writer, status vrrpStatus) {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(tw, "Instance:\t%s\n", status.Instance)
+	fmt.Fprintf(tw, "State:\t%s\n", status.State)
+	fmt.Fprintf(tw, "Keepalived:\t%s\n", status.Keepalived)
+	fmt.Fprintf(tw, "VRID:\t%d\n", status.VRID)
+	fmt.Fprintf(tw, "Priority:\t%d\n", status.Priority)
+	fmt.Fprintf(tw, "VIPs:\t%s\n", strings.Join(status.VIPs, ", "))
+	if status.Unicast {
+		fmt.Fprintf(tw, "Peers:\t%s\n", strings.Join(status.Peers, ", "))
+	}
+	last := "<none>"
+	if status.LastTransitionTime != nil {
+		last = status.LastTransitionTime.Format(time.RFC3339)
+	}
+	fmt.Fprintf(tw, "Last Transition:\t%s\n", last)
+	fmt.Fprintf(tw, "Transitions:\t%d\n", status.Transitions)
+	tw.Flush()
+	for _, t := range status.History {
+		from := t.From
+		if from == "" {
+			from = "<none>"
+		}
+		fmt.Fprintf(w, "  %s %s -> %s\n", t.Time.Format(time.RFC3339), from, t.To)
+	}
+}
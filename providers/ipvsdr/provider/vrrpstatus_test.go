@@ -0,0 +1,112 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	coreipvs "github.com/caicloud/loadbalancer-provider/core/pkg/ipvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func getVRRPStatus(p *IpvsdrProvider, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/vrrp", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	p.VRRPHandler().ServeHTTP(w, req)
+	return w
+}
+
+func TestVRRPHandler(t *testing.T) {
+	p := &IpvsdrProvider{
+		nodeInfo:    &nodeInfo{iface: "eth0"},
+		ipvsManager: coreipvs.NewManager(coreipvs.NewFakeHandle()),
+		keepalived:  newKeepalived(&nodeInfo{iface: "eth0", ip: "192.168.1.1", netmask: 24}, true, nil),
+		vrid:        50,
+	}
+
+	// keepalived is not started
+	w := getVRRPStatus(p, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	status := vrrpStatus{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, vrrpStateFault, status.State)
+	assert.Equal(t, "keepalived is not started", status.Keepalived)
+	assert.Nil(t, status.LastTransitionTime)
+
+	// running before the first transition
+	p.keepalived.started = true
+	p.setVRRPInstance(150, []string{"192.168.99.200"}, []ipmac{{IP: "192.168.1.2"}, {IP: "192.168.1.3"}})
+	status = vrrpStatus{}
+	assert.Nil(t, json.Unmarshal(getVRRPStatus(p, "").Body.Bytes(), &status))
+	assert.Equal(t, vrrpStatus{
+		Instance:   vrrpInstanceName,
+		State:      vrrpStateUnknown,
+		Keepalived: "running",
+		VRID:       50,
+		Priority:   150,
+		VIPs:       []string{"192.168.99.200"},
+		Unicast:    true,
+		Peers:      []string{"192.168.1.2", "192.168.1.3"},
+		History:    []vrrpTransition{},
+	}, status)
+
+	// the last transitions are kept
+	for i := 0; i < vrrpHistorySize; i++ {
+		p.onVRRPStateChange(vrrpStateBackup)
+		p.onVRRPStateChange(vrrpStateMaster)
+	}
+	status = vrrpStatus{}
+	assert.Nil(t, json.Unmarshal(getVRRPStatus(p, "").Body.Bytes(), &status))
+	assert.Equal(t, vrrpStateMaster, status.State)
+	assert.Equal(t, 2*vrrpHistorySize, status.Transitions)
+	assert.Len(t, status.History, vrrpHistorySize)
+	assert.Equal(t, vrrpTransition{From: vrrpStateBackup, To: vrrpStateMaster, Time: *status.LastTransitionTime}, status.History[vrrpHistorySize-1])
+
+	// the text form
+	last := time.Date(2017, 8, 1, 10, 0, 0, 0, time.UTC)
+	p.vrrpTransitions, p.vrrpTransitionTime = 1, last
+	p.vrrpHistory = []vrrpTransition{{To: vrrpStateMaster, Time: last}}
+	w = getVRRPStatus(p, "text/plain")
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf(`Instance:        vips
+State:           MASTER
+Keepalived:      running
+VRID:            50
+Priority:        150
+VIPs:            192.168.99.200
+Peers:           192.168.1.2, 192.168.1.3
+Last Transition: %[1]s
+Transitions:     1
+  %[1]s <none> -> MASTER
+`, last.Format(time.RFC3339)), w.Body.String())
+
+	// keepalived exited
+	p.keepalived.exitErr = fmt.Errorf("exit status 1")
+	status = vrrpStatus{}
+	assert.Nil(t, json.Unmarshal(getVRRPStatus(p, "application/json").Body.Bytes(), &status))
+	assert.Equal(t, vrrpStateFault, status.State)
+	assert.Equal(t, "keepalived is not running: exit status 1", status.Keepalived)
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// heartbeatUpdateRetries bounds the retries of the conflicting updates of
+// the heartbeats
+const heartbeatUpdateRetries = 5
+
+// ConfigMapClient gets, creates and updates the ConfigMap of the
+// heartbeats, the typed client of the ConfigMaps in the namespace of the
+// LoadBalancer implements it
+type ConfigMapClient interface {
+	Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error)
+	Create(*v1.ConfigMap) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// observation is the heartbeat of a node and the local time it was first
+// seen
+type observation struct {
+	value string
+	at    time.Time
+}
+
+// heartbeats publishes the liveness of the instances of the LoadBalancer
+// by the entries of the nodes in a ConfigMap. A live instance renews its
+// entry on every election and an unhealthy one withdraws it. An entry not
+// renewed for the lease duration is dead, the durations are measured by
+// the local clock from the time the entry was seen changing, so the clocks
+// of the nodes need not agree.
+type heartbeats struct {
+	client ConfigMapClient
+	name   string
+	node   string
+	lease  time.Duration
+	now    func() time.Time
+	// observed are the last heartbeats of the nodes
+	observed map[string]observation
+}
+
+func newHeartbeats(client ConfigMapClient, name, node string, lease time.Duration) *heartbeats {
+	return &heartbeats{
+		client:   client,
+		name:     name,
+		node:     node,
+		lease:    lease,
+		now:      time.Now,
+		observed: make(map[string]observation),
+	}
+}
+
+// beat renews the entry of the node if it is alive and withdraws it
+// otherwise, it returns the live nodes
+func (h *heartbeats) beat(alive bool) (map[string]bool, error) {
+	now := h.now()
+	data, err := h.update(func(data map[string]string) bool {
+		if alive {
+			data[h.node] = now.UTC().Format(time.RFC3339Nano)
+			return true
+		}
+		if _, ok := data[h.node]; ok {
+			delete(data, h.node)
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool, len(data))
+	for node, value := range data {
+		o, ok := h.observed[node]
+		if !ok || o.value != value {
+			o = observation{value: value, at: now}
+			h.observed[node] = o
+		}
+		if now.Sub(o.at) < h.lease {
+			live[node] = true
+		}
+	}
+	for node := range h.observed {
+		if _, ok := data[node]; !ok {
+			delete(h.observed, node)
+		}
+	}
+	live[h.node] = alive
+	return live, nil
+}
+
+// update applies the change to the heartbeats in the ConfigMap, which is
+// created if it does not exist, and returns them. The conflicting updates
+// are retried, the ConfigMap is not updated if the change returns false.
+func (h *heartbeats) update(change func(data map[string]string) bool) (map[string]string, error) {
+	var lastErr error
+	for i := 0; i < heartbeatUpdateRetries; i++ {
+		cm, err := h.client.Get(h.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			data := make(map[string]string)
+			if !change(data) {
+				return data, nil
+			}
+			_, err = h.client.Create(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: h.name}, Data: data})
+			if err == nil {
+				return data, nil
+			}
+			if !errors.IsAlreadyExists(err) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		if !change(cm.Data) {
+			return cm.Data, nil
+		}
+		_, err = h.client.Update(cm)
+		if err == nil {
+			return cm.Data, nil
+		}
+		if !errors.IsConflict(err) {
+			return nil, err
+		}
+		lastErr = err
+		log.Info("heartbeats changed by others, retry", log.Fields{"configmap": h.name})
+	}
+	return nil, fmt.Errorf("update heartbeats in configmap %s error: %v", h.name, lastErr)
+}
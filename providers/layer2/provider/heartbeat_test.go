@@ -0,0 +1,140 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// fakeConfigMaps stores the ConfigMaps, the updates of a stale copy
+// conflict
+type fakeConfigMaps struct {
+	lock sync.Mutex
+	cms  map[string]*v1.ConfigMap
+}
+
+func newFakeConfigMaps() *fakeConfigMaps {
+	return &fakeConfigMaps{cms: make(map[string]*v1.ConfigMap)}
+}
+
+func (f *fakeConfigMaps) Get(name string, options metav1.GetOptions) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cm, ok := f.cms[name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.cms[cm.Name]; ok {
+		return nil, errors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	cm = copyConfigMap(cm)
+	cm.ResourceVersion = "1"
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	cur, ok := f.cms[cm.Name]
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	if cm.ResourceVersion != cur.ResourceVersion {
+		return nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, fmt.Errorf("stale"))
+	}
+	cm = copyConfigMap(cm)
+	version, _ := strconv.Atoi(cm.ResourceVersion)
+	cm.ResourceVersion = strconv.Itoa(version + 1)
+	f.cms[cm.Name] = cm
+	return copyConfigMap(cm), nil
+}
+
+func copyConfigMap(cm *v1.ConfigMap) *v1.ConfigMap {
+	ret := *cm
+	ret.Data = make(map[string]string, len(cm.Data))
+	for k, v := range cm.Data {
+		ret.Data[k] = v
+	}
+	return &ret
+}
+
+func TestHeartbeats(t *testing.T) {
+	cms := newFakeConfigMaps()
+	now := time.Unix(1000, 0)
+	newHeartbeats := func(node string) *heartbeats {
+		h := newHeartbeats(cms, "lb-heartbeats", node, 15*time.Second)
+		h.now = func() time.Time { return now }
+		return h
+	}
+	node1, node2 := newHeartbeats("node1"), newHeartbeats("node2")
+
+	// the ConfigMap is created by the first one
+	live, err := node1.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node1": true}, live)
+	live, err = node2.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node1": true, "node2": true}, live)
+
+	// node1 stops renewing, it is dead once the lease expires by the
+	// clock of node2
+	now = now.Add(10 * time.Second)
+	live, err = node2.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node1": true, "node2": true}, live)
+	now = now.Add(10 * time.Second)
+	live, err = node2.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node2": true}, live)
+
+	// renewed, it is live again
+	_, err = node1.beat(true)
+	assert.Nil(t, err)
+	live, err = node2.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node1": true, "node2": true}, live)
+
+	// withdrawn, it is dead right away
+	live, err = node1.beat(false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node1": false, "node2": true}, live)
+	live, err = node2.beat(true)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"node2": true}, live)
+	cm, err := cms.Get("lb-heartbeats", metav1.GetOptions{})
+	assert.Nil(t, err)
+	_, ok := cm.Data["node1"]
+	assert.False(t, ok)
+}
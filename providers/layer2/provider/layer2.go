@@ -0,0 +1,621 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/dr"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/layer2/version"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/kubernetes/pkg/util/sysctl"
+)
+
+var (
+	_ core.Provider          = &Layer2Provider{}
+	_ core.InterfaceProvider = &Layer2Provider{}
+	_ core.FamilyProvider    = &Layer2Provider{}
+	_ core.DeletionProvider  = &Layer2Provider{}
+	_ core.HealthzProvider   = &Layer2Provider{}
+)
+
+const (
+	// DefaultCheckInterval is the default interval of the elections
+	DefaultCheckInterval = 5 * time.Second
+	// DefaultRefreshInterval is the default interval of the announcements
+	// of the claimed VIPs after the burst
+	DefaultRefreshInterval = 30 * time.Second
+)
+
+// Dataplane serves the traffic of the VIPs, e.g. the ipvs provider
+// binding them on the loopback
+type Dataplane interface {
+	core.Provider
+	core.HealthzProvider
+}
+
+// realServer prepares the node to serve the VIPs on the loopback without
+// answering ARP for them, see dr.RealServer
+type realServer interface {
+	Ensure(vip net.IP) error
+	Teardown(vip net.IP) error
+}
+
+// Config configures the Layer2Provider
+type Config struct {
+	// NodeName is the name of the node in the elections
+	NodeName string
+	// Interface is the interface the VIPs are claimed on unless they
+	// specify their own ones
+	Interface string
+	// CheckInterval is the interval of the elections, so a VIP is claimed
+	// by another node once its holder turns unready
+	CheckInterval time.Duration
+	// RefreshInterval is the interval of the announcements of the claimed
+	// VIPs, so the switches keep them, zero disables it. The LoadBalancer
+	// may override it by the GARP annotations.
+	RefreshInterval time.Duration
+	// DADTimeout is the time waiting for another holder of a VIP before it
+	// is claimed
+	DADTimeout time.Duration
+	// ConfigMaps is the client of the ConfigMaps in the namespace of the
+	// LoadBalancer, the instances publish their liveness by the heartbeats
+	// in the HeartbeatConfigMap of it. The VIPs are elected among the ready
+	// nodes regardless of their instances if it is nil.
+	ConfigMaps         ConfigMapClient
+	HeartbeatConfigMap string
+	// LeaseDuration is the time the heartbeat of an instance is valid, 3
+	// CheckIntervals if it is zero
+	LeaseDuration time.Duration
+}
+
+// Layer2Provider serves the VIPs MetalLB style on small bare-metal clusters
+// without VRRP. Every VIP is claimed by exactly one ready node of the
+// LoadBalancer, which binds it on the interface and answers ARP or NDP for
+// it, the others stand by with the VIP on the loopback as the real servers
+// of the dataplane. The holder is elected by ranking the ready nodes by the
+// hash of their names and the VIP, so every instance agrees without
+// coordination and the VIPs spread across the nodes. Only the nodes whose
+// instances are live by their heartbeats are elected, an instance whose
+// dataplane turns unhealthy withdraws its heartbeat. Once the holder turns
+// unready or dead the next one takes over.
+type Layer2Provider struct {
+	// AnnounceBurst is the number of the announcements of a VIP after it is
+	// claimed, AnnounceInterval apart, unless the LoadBalancer overrides it
+	// by the GARP annotations
+	AnnounceBurst    int
+	AnnounceInterval time.Duration
+
+	cfg         Config
+	dataplane   Dataplane
+	storeLister core.StoreLister
+	addrs       corenet.AddrHandle
+	links       corenet.LinkHandle
+	realServer  realServer
+	announce    func(iface string, ip net.IP) error
+	detect      func(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error)
+	flush       func(iface string, ip net.IP) error
+	// garp announces the claimed VIPs by the schedule of the LoadBalancer
+	garp *arp.Scheduler
+	// heartbeats publishes the liveness of the instance, nil if it is not
+	// published
+	heartbeats *heartbeats
+	stopCh     chan struct{}
+	stopped    sync.WaitGroup
+
+	// syncMu serializes the syncs, which may wait for the duplicate address
+	// detection
+	syncMu   sync.Mutex
+	vips     []core.VIP
+	nodes    []string
+	schedule arp.Schedule
+	err      error
+	// vlan is the VLAN subinterface of the VIPs the provider ensures, nil
+	// if they are not served on one. vlans are the names of the ones
+	// ensured, which are deleted once they serve no VIP if the provider
+	// created them.
+	vlan  *corenet.VLAN
+	vlans map[string]bool
+
+	mu sync.Mutex
+	// claimed records the addresses claimed by us
+	claimed map[string]*claim
+	// conflicts records the hardware addresses of the other holders of the
+	// addresses we failed to claim
+	conflicts map[string]string
+}
+
+// NewLayer2Provider creates a new layer2 LoadBalancer Provider claiming the
+// VIPs served by the dataplane
+func NewLayer2Provider(cfg Config, dataplane Dataplane) *Layer2Provider {
+	addrs := corenet.NewAddrHandle()
+	return newLayer2Provider(cfg, dataplane, addrs, dr.NewRealServer(addrs, sysctl.New()))
+}
+
+func newLayer2Provider(cfg Config, dataplane Dataplane, addrs corenet.AddrHandle, rs realServer) *Layer2Provider {
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = DefaultCheckInterval
+	}
+	if cfg.DADTimeout <= 0 {
+		cfg.DADTimeout = arp.DefaultDADTimeout
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 3 * cfg.CheckInterval
+	}
+	p := &Layer2Provider{
+		AnnounceBurst:    corenet.DefaultAnnounceBurst,
+		AnnounceInterval: corenet.DefaultAnnounceInterval,
+		cfg:              cfg,
+		dataplane:        dataplane,
+		addrs:            addrs,
+		links:            corenet.NewLinkHandle(),
+		realServer:       rs,
+		announce:         arp.Announce,
+		detect:           arp.DetectDuplicate,
+		flush:            corenet.FlushNeighbors,
+		stopCh:           make(chan struct{}),
+		claimed:          make(map[string]*claim),
+		conflicts:        make(map[string]string),
+		vlans:            make(map[string]bool),
+	}
+	p.garp = arp.NewScheduler(func(iface string, ip net.IP) error {
+		return p.announce(iface, ip)
+	})
+	if cfg.ConfigMaps != nil {
+		p.heartbeats = newHeartbeats(cfg.ConfigMaps, cfg.HeartbeatConfigMap, cfg.NodeName, cfg.LeaseDuration)
+	}
+	return p
+}
+
+// OnUpdate prepares the node to serve the VIPs, updates the dataplane and
+// claims the VIPs the node is elected for
+func (p *Layer2Provider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal || lb.Spec.Providers.Ipvsdr == nil {
+		return nil
+	}
+	vips, err := core.GetVIPList(lb)
+	if err != nil {
+		return err
+	}
+	schedule, err := core.GetGARPSchedule(lb, arp.Schedule{
+		Repeat:        p.AnnounceBurst,
+		Interval:      p.AnnounceInterval,
+		Refresh:       p.cfg.RefreshInterval,
+		RefreshRepeat: 1,
+	})
+	if err != nil {
+		return err
+	}
+	vlan, err := core.GetVIPVLAN(lb)
+	if err != nil {
+		return err
+	}
+
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+
+	// the conflicting subinterface is reported before anything changes
+	if vlan != nil {
+		if err := p.ensureVLAN(vlan); err != nil {
+			return err
+		}
+	}
+	p.vlan = vlan
+
+	errs := make([]error, 0)
+	// the VIPs are on the loopback of every node before the dataplane
+	// serves them, so no standby answers ARP for them
+	for _, vip := range vips {
+		if err := p.realServer.Ensure(vip.IP); err != nil {
+			log.Error("ensure dr real server error", log.Fields{"vip": vip.IP, "err": err})
+			errs = append(errs, err)
+		}
+	}
+	if err := p.dataplane.OnUpdate(lb); err != nil {
+		log.Error("update dataplane error", log.Fields{"err": err})
+		errs = append(errs, err)
+	}
+	p.teardown(p.removed(vips))
+
+	p.vips = vips
+	p.nodes = lb.Spec.Nodes.Names
+	p.schedule = schedule
+	p.err = utilerrors.NewAggregate(errs)
+	if err := p.sync(); err != nil {
+		errs = append(errs, err)
+	}
+	p.deleteVLANs()
+	return utilerrors.NewAggregate(errs)
+}
+
+// OnDelete implements core.DeletionProvider, the VIPs are released
+func (p *Layer2Provider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	vips := p.vips
+	p.vips = nil
+	err := p.sync()
+	p.teardown(vips)
+	p.deleteVLANs()
+	return err
+}
+
+// removed returns the VIPs which are not desired any more
+func (p *Layer2Provider) removed(vips []core.VIP) []core.VIP {
+	desired := make(map[string]bool, len(vips))
+	for _, vip := range vips {
+		desired[vip.IP.String()] = true
+	}
+	ret := make([]core.VIP, 0)
+	for _, vip := range p.vips {
+		if !desired[vip.IP.String()] {
+			ret = append(ret, vip)
+		}
+	}
+	return ret
+}
+
+// teardown removes the VIPs from the loopback
+func (p *Layer2Provider) teardown(vips []core.VIP) {
+	for _, vip := range vips {
+		if err := p.realServer.Teardown(vip.IP); err != nil {
+			log.Error("teardown dr real server error", log.Fields{"vip": vip.IP, "err": err})
+		}
+	}
+}
+
+// ensureVLAN creates the VLAN subinterface of the VIPs if it does not
+// exist. It returns a PermanentError if an existing link of the name is
+// configured differently, which is left alone. The syncMu must be held.
+func (p *Layer2Provider) ensureVLAN(vlan *corenet.VLAN) error {
+	if err := corenet.EnsureVLAN(p.links, *vlan); err != nil {
+		if _, ok := err.(*corenet.VLANConflictError); ok {
+			return core.NewPermanentError("ConflictingVIPInterface", err)
+		}
+		return fmt.Errorf("ensure vlan subinterface %s error: %v", vlan.Name, err)
+	}
+	p.vlans[vlan.Name] = true
+	return nil
+}
+
+// deleteVLANs deletes the VLAN subinterfaces created by the provider which
+// serve none of the VIPs, unless they hold other addresses, e.g. the VIPs
+// of other LoadBalancers. The syncMu must be held.
+func (p *Layer2Provider) deleteVLANs() {
+	used := make(map[string]bool, len(p.vips))
+	for _, vip := range p.vips {
+		used[p.vipAddr(vip).Link] = true
+	}
+	for name := range p.vlans {
+		if used[name] {
+			continue
+		}
+		link, err := p.links.LinkGet(name)
+		if err != nil {
+			log.Warn("get vlan subinterface error", log.Fields{"link": name, "err": err})
+			continue
+		}
+		if link == nil || link.Alias != corenet.VLANOwnerAlias {
+			// gone or adopted
+			delete(p.vlans, name)
+			continue
+		}
+		addrs, err := p.addrs.AddrList(name)
+		if err != nil {
+			log.Warn("list addresses of vlan subinterface error", log.Fields{"link": name, "err": err})
+			continue
+		}
+		held := make([]string, 0)
+		for _, a := range addrs {
+			if !a.IP.IsLinkLocalUnicast() {
+				held = append(held, a.IP.String())
+			}
+		}
+		if len(held) > 0 {
+			log.Info("vlan subinterface holds other addresses, keep it", log.Fields{"link": name, "addrs": held})
+			continue
+		}
+		if _, err := corenet.DeleteVLAN(p.links, name); err != nil {
+			log.Error("delete vlan subinterface error", log.Fields{"link": name, "err": err})
+			continue
+		}
+		delete(p.vlans, name)
+	}
+}
+
+// vipAddr returns the address of the vip on its interface
+func (p *Layer2Provider) vipAddr(vip core.VIP) corenet.Addr {
+	iface := vip.Interface
+	if iface == "" {
+		iface = p.cfg.Interface
+	}
+	return corenet.NewAddr(vip.IP, iface)
+}
+
+// leaderOf returns the node elected to claim the vip among the ready ones
+// which are live, empty if there is none. All ready nodes are live if live
+// is nil.
+func leaderOf(vip net.IP, rss []core.RealServer, live map[string]bool) string {
+	leader, best := "", []byte(nil)
+	for _, rs := range rss {
+		if rs.Weight <= 0 || (live != nil && !live[rs.Node]) {
+			continue
+		}
+		hash := sha256.Sum256([]byte(rs.Node + "#" + vip.String()))
+		if best == nil || bytes.Compare(hash[:], best) < 0 {
+			leader, best = rs.Node, hash[:]
+		}
+	}
+	return leader
+}
+
+// claim is an address claimed by us
+type claim struct {
+	addr corenet.Addr
+}
+
+// check runs the elections of the VIPs
+func (p *Layer2Provider) check() {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	if err := p.sync(); err != nil {
+		log.Warn("sync vips error", log.Fields{"err": err})
+	}
+}
+
+// sync claims the VIPs the node is elected for and releases the others.
+// The syncMu must be held.
+func (p *Layer2Provider) sync() error {
+	healthy := p.err == nil && p.dataplane.Healthz() == nil
+	live := p.liveness(healthy && len(p.vips) > 0)
+	leaders := make(map[string]string, len(p.vips))
+	rss := make(map[corenet.Family][]core.RealServer)
+	for _, vip := range p.vips {
+		family := corenet.FamilyOf(vip.IP)
+		if _, ok := rss[family]; !ok {
+			rss[family] = p.storeLister.RealServers(p.nodes, family)
+		}
+		if healthy {
+			leaders[p.vipAddr(vip).String()] = leaderOf(vip.IP, rss[family], live)
+		}
+	}
+
+	p.mu.Lock()
+	released := make([]corenet.Addr, 0)
+	for key, c := range p.claimed {
+		if leaders[key] != p.cfg.NodeName {
+			released = append(released, c.addr)
+		}
+	}
+	p.mu.Unlock()
+
+	errs := make([]error, 0)
+	for _, addr := range released {
+		if err := p.release(addr, leaders[addr.String()]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, vip := range p.vips {
+		addr := p.vipAddr(vip)
+		if leaders[addr.String()] != p.cfg.NodeName {
+			p.mu.Lock()
+			delete(p.conflicts, addr.String())
+			p.mu.Unlock()
+			continue
+		}
+		if err := p.claim(addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// liveness publishes the heartbeat of the instance, it returns the live
+// nodes. It returns nil if the heartbeats are not published or failed to,
+// the VIPs are elected among the ready nodes then.
+func (p *Layer2Provider) liveness(alive bool) map[string]bool {
+	if p.heartbeats == nil {
+		return nil
+	}
+	live, err := p.heartbeats.beat(alive)
+	if err != nil {
+		log.Warn("publish heartbeat error, elect by the readiness of the nodes", log.Fields{"err": err})
+		return nil
+	}
+	return live
+}
+
+// claim binds the address and starts announcing it by the schedule once
+// no other host holds it, the claimed ones follow the schedule from now on
+// without being announced again right away
+func (p *Layer2Provider) claim(addr corenet.Addr) error {
+	key := addr.String()
+	p.mu.Lock()
+	_, ok := p.claimed[key]
+	p.mu.Unlock()
+	if ok {
+		p.garp.Update(addr.Link, addr.IP, p.schedule)
+		return nil
+	}
+
+	holder, err := p.detect(addr.Link, addr.IP, p.cfg.DADTimeout)
+	if err != nil {
+		return fmt.Errorf("detect duplicate of %v error: %v", addr, err)
+	}
+	if holder != nil {
+		p.mu.Lock()
+		p.conflicts[key] = holder.String()
+		p.mu.Unlock()
+		log.Error("vip is held by another host, abort claiming", log.Fields{"addr": addr, "holder": holder})
+		return fmt.Errorf("vip %v is held by %v", addr, holder)
+	}
+
+	log.Info("Claiming vip", log.Fields{"addr": addr, "node": p.cfg.NodeName})
+	// the subinterface may be deleted by another LoadBalancer since
+	if p.vlan != nil && p.vlan.Name == addr.Link {
+		if err := p.ensureVLAN(p.vlan); err != nil {
+			return err
+		}
+	}
+	if err := p.addrs.AddrAdd(addr); err != nil {
+		return err
+	}
+	if err := p.flush(addr.Link, addr.IP); err != nil {
+		log.Warn("flush neighbors error", log.Fields{"addr": addr, "err": err})
+	}
+	p.mu.Lock()
+	p.claimed[key] = &claim{addr: addr}
+	delete(p.conflicts, key)
+	p.mu.Unlock()
+	p.garp.Takeover(addr.Link, addr.IP, p.schedule)
+	return nil
+}
+
+// release removes the claimed address from the interface, the leader is
+// the node elected for it instead, empty if none
+func (p *Layer2Provider) release(addr corenet.Addr, leader string) error {
+	log.Info("Releasing vip", log.Fields{"addr": addr, "leader": leader})
+	p.garp.Release(addr.Link, addr.IP)
+	if err := p.addrs.AddrDel(addr); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(p.claimed, addr.String())
+	p.mu.Unlock()
+	return nil
+}
+
+// Start starts the dataplane and the elections
+func (p *Layer2Provider) Start() {
+	log.Info("Startting layer2 provider", log.Fields{"node": p.cfg.NodeName, "interface": p.cfg.Interface})
+	p.dataplane.Start()
+
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(p.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// WaitForStart waits for the dataplane
+func (p *Layer2Provider) WaitForStart() bool {
+	return p.dataplane.WaitForStart()
+}
+
+// Stop releases the claimed VIPs and stops the dataplane
+func (p *Layer2Provider) Stop() error {
+	log.Info("Shutting down layer2 provider")
+	close(p.stopCh)
+	p.stopped.Wait()
+	p.garp.Stop()
+
+	p.syncMu.Lock()
+	vips := p.vips
+	p.vips = nil
+	errs := make([]error, 0)
+	if err := p.sync(); err != nil {
+		errs = append(errs, err)
+	}
+	p.deleteVLANs()
+	p.syncMu.Unlock()
+	if err := p.dataplane.Stop(); err != nil {
+		errs = append(errs, err)
+	}
+	p.teardown(vips)
+	return utilerrors.NewAggregate(errs)
+}
+
+// Healthz implements core.HealthzProvider, the provider is unhealthy if
+// the dataplane is or a VIP it is elected for is held by another host
+func (p *Layer2Provider) Healthz() error {
+	if err := p.dataplane.Healthz(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.conflicts) == 0 {
+		return nil
+	}
+	conflicts := make([]string, 0, len(p.conflicts))
+	for addr, holder := range p.conflicts {
+		conflicts = append(conflicts, fmt.Sprintf("%s is held by %s", addr, holder))
+	}
+	sort.Strings(conflicts)
+	return fmt.Errorf("vip conflicts: %s", strings.Join(conflicts, ", "))
+}
+
+// Interfaces implements core.InterfaceProvider, the vips are claimed on
+// the configured interface or their own ones
+func (p *Layer2Provider) Interfaces() []string {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	ifaces := []string{p.cfg.Interface}
+	seen := map[string]bool{p.cfg.Interface: true}
+	for _, vip := range p.vips {
+		if link := p.vipAddr(vip).Link; !seen[link] {
+			seen[link] = true
+			ifaces = append(ifaces, link)
+		}
+	}
+	return ifaces
+}
+
+// SupportedFamilies implements core.FamilyProvider, the IPv6 VIPs are
+// claimed by NDP
+func (p *Layer2Provider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *Layer2Provider) Info() core.Info {
+	return core.Info{
+		Name:       "layer2",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+		// the traffic is served by the dataplane
+		Capabilities: p.dataplane.Info().Capabilities,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *Layer2Provider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+	p.dataplane.SetListers(lister)
+}
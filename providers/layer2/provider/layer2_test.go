@@ -0,0 +1,441 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/dr"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	ipvsprovider "github.com/caicloud/loadbalancer-provider/providers/ipvs/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+type fakeSysctl map[string]int
+
+func (f fakeSysctl) GetSysctl(key string) (int, error) {
+	return f[key], nil
+}
+
+func (f fakeSysctl) SetSysctl(key string, value int) error {
+	f[key] = value
+	return nil
+}
+
+// fakeDataplane records the updates
+type fakeDataplane struct {
+	mu      sync.Mutex
+	updates int
+	stopped bool
+	healthz error
+}
+
+func (f *fakeDataplane) Info() core.Info             { return core.Info{Name: "fake"} }
+func (f *fakeDataplane) SetListers(core.StoreLister) {}
+func (f *fakeDataplane) Start()                      {}
+func (f *fakeDataplane) WaitForStart() bool          { return true }
+
+func (f *fakeDataplane) Healthz() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.healthz
+}
+
+func (f *fakeDataplane) setHealthz(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.healthz = err
+}
+
+func (f *fakeDataplane) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates++
+	return nil
+}
+
+func (f *fakeDataplane) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	return nil
+}
+
+// fakeLink records the announcements and the flushes of the providers on
+// a link, the duplicate address detection finds the addresses bound by the
+// other providers
+type fakeLink struct {
+	mu    sync.Mutex
+	calls []string
+	hosts map[string]*corenet.FakeAddrHandle
+}
+
+func (l *fakeLink) record(call string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, call)
+}
+
+func (l *fakeLink) Calls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	calls := l.calls
+	l.calls = nil
+	sort.Strings(calls)
+	return calls
+}
+
+func (l *fakeLink) newProvider(node string) *Layer2Provider {
+	addrs := corenet.NewFakeAddrHandle()
+	l.hosts[node] = addrs
+	p := newLayer2Provider(Config{NodeName: node, Interface: "eth0", RefreshInterval: time.Minute}, &fakeDataplane{}, addrs, dr.NewRealServer(addrs, fakeSysctl{}))
+	p.AnnounceBurst = 2
+	p.AnnounceInterval = time.Millisecond
+	p.announce = func(iface string, ip net.IP) error {
+		l.record(fmt.Sprintf("%s announce %s %v", node, iface, ip))
+		return nil
+	}
+	p.flush = func(iface string, ip net.IP) error {
+		l.record(fmt.Sprintf("%s flush %s %v", node, iface, ip))
+		return nil
+	}
+	p.detect = func(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+		for host, addrs := range l.hosts {
+			if host == node {
+				continue
+			}
+			bound, _ := addrs.AddrList(iface)
+			for _, addr := range bound {
+				if addr.IP.Equal(ip) {
+					return net.HardwareAddr{0x02, 0, 0, 0, 0, byte(len(host))}, nil
+				}
+			}
+		}
+		return nil, nil
+	}
+	return p
+}
+
+func newTestNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "10.0.0.100", Scheduler: netv1alpha1.IpvsSchedulerRR}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+// boundOn returns the links the ip is bound on
+func boundOn(addrs *corenet.FakeAddrHandle, ip string) []string {
+	links := make([]string, 0)
+	for _, link := range []string{"lo", "eth0"} {
+		bound, _ := addrs.AddrList(link)
+		for _, addr := range bound {
+			if addr.IP.String() == ip {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+func TestLeaderOf(t *testing.T) {
+	vip := net.ParseIP("10.0.0.100")
+	rss := []core.RealServer{{Node: "node1", Weight: 100}, {Node: "node2", Weight: 100}, {Node: "node3", Weight: 100}}
+	leader := leaderOf(vip, rss, nil)
+	assert.NotEmpty(t, leader)
+	// regardless of the order
+	assert.Equal(t, leader, leaderOf(vip, []core.RealServer{rss[2], rss[1], rss[0]}, nil))
+	// among the live ones
+	live := map[string]bool{"node1": true, "node2": true, "node3": true}
+	assert.Equal(t, leader, leaderOf(vip, rss, live))
+	live[leader] = false
+	next := leaderOf(vip, rss, live)
+	assert.NotEmpty(t, next)
+	assert.NotEqual(t, leader, next)
+	assert.Empty(t, leaderOf(vip, rss, map[string]bool{}))
+
+	// the vips spread across the nodes
+	leaders := map[string]bool{}
+	for i := 1; i <= 20; i++ {
+		leaders[leaderOf(net.ParseIP(fmt.Sprintf("10.0.0.%d", i)), rss, nil)] = true
+	}
+	assert.Equal(t, 3, len(leaders))
+
+	for i := range rss {
+		rss[i].Weight = 0
+	}
+	assert.Empty(t, leaderOf(vip, rss, nil))
+}
+
+func TestInfo(t *testing.T) {
+	dataplane := &ipvsprovider.IpvsProvider{}
+	p := NewLayer2Provider(Config{NodeName: "node1", Interface: "eth0"}, dataplane)
+	assert.Equal(t, dataplane.Info().Capabilities, p.Info().Capabilities)
+
+	// the ports the dataplane does not serve are rejected
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyHTTPPorts] = `[{"port":80,"service":"web","servicePort":80}]`
+	assert.NotNil(t, core.ValidateCapabilities(lb, p.Info().Capabilities))
+}
+
+func TestLayer2Provider(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1", true))
+	nodes.Add(newTestNode("node2", "192.168.1.2", true))
+	lister := core.StoreLister{Node: v1listers.NewNodeLister(nodes)}
+
+	link := &fakeLink{hosts: map[string]*corenet.FakeAddrHandle{}}
+	providers := map[string]*Layer2Provider{"node1": link.newProvider("node1"), "node2": link.newProvider("node2")}
+	leader := leaderOf(net.ParseIP("10.0.0.100"), []core.RealServer{{Node: "node1", Weight: 100}, {Node: "node2", Weight: 100}}, nil)
+	standby := "node1"
+	if leader == "node1" {
+		standby = "node2"
+	}
+	for _, p := range providers {
+		p.SetListers(lister)
+	}
+	waitForCalls := func(n int) []string {
+		calls := []string{}
+		for i := 0; i < 100 && len(calls) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+			calls = append(calls, link.Calls()...)
+		}
+		sort.Strings(calls)
+		return calls
+	}
+
+	// the leader claims the vip, the standby only serves it on the loopback
+	lb := newTestLoadBalancer("node1", "node2")
+	assert.Nil(t, providers[leader].OnUpdate(lb))
+	assert.Nil(t, providers[standby].OnUpdate(lb))
+	assert.Equal(t, 1, providers[leader].dataplane.(*fakeDataplane).updates)
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[standby], "10.0.0.100"))
+	assert.Equal(t, []string{
+		leader + " announce eth0 10.0.0.100",
+		leader + " announce eth0 10.0.0.100",
+		leader + " flush eth0 10.0.0.100",
+	}, waitForCalls(3))
+	assert.Nil(t, providers[leader].Healthz())
+
+	// the claimed vip is announced every refresh interval, not again on
+	// the next election
+	providers[leader].check()
+	assert.Empty(t, link.Calls())
+	schedule, ok := providers[leader].garp.Schedule("eth0", net.ParseIP("10.0.0.100"))
+	assert.True(t, ok)
+	assert.Equal(t, arp.Schedule{Repeat: 2, Interval: time.Millisecond, Refresh: time.Minute, RefreshRepeat: 1}, schedule)
+	_, ok = providers[standby].garp.Schedule("eth0", net.ParseIP("10.0.0.100"))
+	assert.False(t, ok)
+
+	// the GARP annotations apply without announcing the vip again
+	lb.Annotations[core.AnnotationKeyGARPMasterDelay] = "10"
+	lb.Annotations[core.AnnotationKeyGARPMasterRefresh] = "0"
+	assert.Nil(t, providers[leader].OnUpdate(lb))
+	schedule, _ = providers[leader].garp.Schedule("eth0", net.ParseIP("10.0.0.100"))
+	assert.Equal(t, arp.Schedule{Repeat: 2, Interval: time.Millisecond, Delay: 10 * time.Second, RefreshRepeat: 1}, schedule)
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Empty(t, waitForCalls(0))
+	lb.Annotations[core.AnnotationKeyGARPMasterRepeat] = "1000"
+	assert.True(t, core.IsPermanentError(providers[leader].OnUpdate(lb)))
+	lb = newTestLoadBalancer("node1", "node2")
+
+	// failover once the leader turns unready
+	nodes.Update(newTestNode(leader, "192.168.1.1", false))
+	providers[leader].check()
+	providers[standby].check()
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[standby], "10.0.0.100"))
+	assert.Equal(t, []string{
+		standby + " announce eth0 10.0.0.100",
+		standby + " announce eth0 10.0.0.100",
+		standby + " flush eth0 10.0.0.100",
+	}, waitForCalls(3))
+
+	// the leader recovers, it does not claim the vip until the standby
+	// releases it
+	nodes.Update(newTestNode(leader, "192.168.1.1", true))
+	assert.NotNil(t, providers[leader].OnUpdate(lb))
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.NotNil(t, providers[leader].Healthz())
+	providers[standby].check()
+	providers[leader].check()
+	assert.Nil(t, providers[leader].Healthz())
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[standby], "10.0.0.100"))
+	waitForCalls(3)
+
+	// the vip is released on deletion and stop
+	assert.Nil(t, providers[leader].OnDelete(lb))
+	assert.Empty(t, boundOn(link.hosts[leader], "10.0.0.100"))
+	providers[standby].Start()
+	assert.Nil(t, providers[standby].Stop())
+	assert.Empty(t, boundOn(link.hosts[standby], "10.0.0.100"))
+	assert.True(t, providers[standby].dataplane.(*fakeDataplane).stopped)
+}
+
+func TestLayer2ProviderHeartbeats(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1", true))
+	nodes.Add(newTestNode("node2", "192.168.1.2", true))
+	lister := core.StoreLister{Node: v1listers.NewNodeLister(nodes)}
+
+	cms := newFakeConfigMaps()
+	link := &fakeLink{hosts: map[string]*corenet.FakeAddrHandle{}}
+	providers := map[string]*Layer2Provider{}
+	for _, node := range []string{"node1", "node2"} {
+		p := link.newProvider(node)
+		p.heartbeats = newHeartbeats(cms, "lb-heartbeats", node, time.Minute)
+		p.SetListers(lister)
+		providers[node] = p
+	}
+	leader := leaderOf(net.ParseIP("10.0.0.100"), []core.RealServer{{Node: "node1", Weight: 100}, {Node: "node2", Weight: 100}}, nil)
+	standby := "node1"
+	if leader == "node1" {
+		standby = "node2"
+	}
+
+	lb := newTestLoadBalancer("node1", "node2")
+	assert.Nil(t, providers[leader].OnUpdate(lb))
+	assert.Nil(t, providers[standby].OnUpdate(lb))
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[standby], "10.0.0.100"))
+
+	// the dataplane of the holder turns unhealthy while its node is still
+	// ready, it releases the vip and the standby takes over
+	providers[leader].dataplane.(*fakeDataplane).setHealthz(fmt.Errorf("ipvs down"))
+	providers[leader].check()
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	providers[standby].check()
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[standby], "10.0.0.100"))
+
+	// it is elected again once it recovers and the standby releases it
+	providers[leader].dataplane.(*fakeDataplane).setHealthz(nil)
+	providers[leader].check()
+	providers[standby].check()
+	providers[leader].check()
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[leader], "10.0.0.100"))
+	assert.Equal(t, []string{"lo"}, boundOn(link.hosts[standby], "10.0.0.100"))
+
+	// the instance stopped withdraws its heartbeat, the vip moves on
+	assert.Nil(t, providers[leader].Stop())
+	providers[standby].check()
+	assert.Equal(t, []string{"lo", "eth0"}, boundOn(link.hosts[standby], "10.0.0.100"))
+	assert.Nil(t, providers[standby].Stop())
+}
+
+func TestLayer2ProviderVLAN(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "192.168.1.1", true))
+	lister := core.StoreLister{Node: v1listers.NewNodeLister(nodes)}
+	newProvider := func(links ...corenet.Link) (*Layer2Provider, *corenet.FakeLinkHandle) {
+		link := &fakeLink{hosts: map[string]*corenet.FakeAddrHandle{}}
+		p := link.newProvider("node1")
+		p.SetListers(lister)
+		handle := corenet.NewFakeLinkHandle(links...)
+		p.links = handle
+		return p, handle
+	}
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyVIPInterface] = "bond0.120"
+	lb.Annotations[core.AnnotationKeyVIPInterfaceMTU] = "9000"
+	vipOn := func(p *Layer2Provider, link string) bool {
+		bound, _ := p.addrs.AddrList(link)
+		for _, addr := range bound {
+			if addr.IP.String() == "10.0.0.100" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// created and the vip is claimed on it
+	p, links := newProvider()
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []string{"VLANAdd bond0.120 link bond0 id 120 mtu 9000", "LinkSetUp bond0.120"}, links.Calls)
+	assert.Equal(t, &corenet.Link{Name: "bond0.120", Parent: "bond0", VLANID: 120, MTU: 9000, Up: true, Alias: corenet.VLANOwnerAlias}, links.Link("bond0.120"))
+	assert.True(t, vipOn(p, "bond0.120"))
+	assert.Equal(t, []string{"eth0", "bond0.120"}, p.Interfaces())
+	links.ResetCalls()
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, links.Calls)
+
+	// kept while it holds the vip of another LoadBalancer
+	other := corenet.NewAddr(net.ParseIP("10.0.0.200"), "bond0.120")
+	p.addrs.AddrAdd(other)
+	assert.Nil(t, p.OnDelete(lb))
+	assert.False(t, vipOn(p, "bond0.120"))
+	assert.NotNil(t, links.Link("bond0.120"))
+	// deleted once the last vip is gone
+	p.addrs.AddrDel(other)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.True(t, vipOn(p, "bond0.120"))
+	delete(lb.Annotations, core.AnnotationKeyVIPInterface)
+	delete(lb.Annotations, core.AnnotationKeyVIPInterfaceMTU)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.True(t, vipOn(p, "eth0"))
+	assert.Nil(t, links.Link("bond0.120"))
+	lb.Annotations[core.AnnotationKeyVIPInterface] = "bond0.120"
+	lb.Annotations[core.AnnotationKeyVIPInterfaceMTU] = "9000"
+
+	// adopted, and never deleted
+	p, links = newProvider(corenet.Link{Name: "bond0.120", Parent: "bond0", VLANID: 120, MTU: 9000, Up: true})
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, links.Calls)
+	assert.True(t, vipOn(p, "bond0.120"))
+	assert.Nil(t, p.OnDelete(lb))
+	assert.False(t, vipOn(p, "bond0.120"))
+	assert.Empty(t, links.Calls)
+	assert.NotNil(t, links.Link("bond0.120"))
+
+	// configured differently, reported but left alone
+	p, links = newProvider(corenet.Link{Name: "bond0.120", Parent: "bond0", VLANID: 121, MTU: 9000, Up: true})
+	err := p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Contains(t, err.Error(), "bond0.120")
+	assert.Empty(t, links.Calls)
+	assert.False(t, vipOn(p, "bond0.120"))
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/providers/nginx/provider"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+// Options contains controller options
+type Options struct {
+	Debug                 bool
+	HTTPAddress           string
+	NodeHealthAddress     string
+	Kubeconfig            string
+	LoadBalancerNamespace string
+	LoadBalancerName      string
+	Chaos                 string
+	Record                string
+	TemplateConfigMap     string
+	ReloadStrategy        string
+	DrainThreshold        int
+	DrainTimeout          time.Duration
+}
+
+// NewOptions reutrns a new Options
+func NewOptions() *Options {
+	return &Options{}
+}
+
+// AddFlags add flags to app
+func (opts *Options) AddFlags(app *cli.App) {
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "kubeconfig",
+			Usage:       "Path to a kube config. Only required if out-of-cluster.",
+			Destination: &opts.Kubeconfig,
+		},
+		cli.BoolFlag{
+			Name:        "debug",
+			Usage:       "run with debug mode",
+			Destination: &opts.Debug,
+		},
+		cli.StringFlag{
+			Name:        "http-address",
+			Value:       ":10254",
+			Usage:       "the address serving /metrics and /healthz, empty disables it",
+			Destination: &opts.HTTPAddress,
+		},
+		cli.StringFlag{
+			Name:        "node-health-address",
+			Usage:       "the address serving the health of the node for the loadbalancer on /healthz/<namespace>/<name> or the loadbalancer annotation loadbalancer.caicloud.io/node-health-path, empty disables it",
+			Destination: &opts.NodeHealthAddress,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-namespace",
+			EnvVar:      "LOADBALANCER_NAMESPACE",
+			Usage:       "specify loadbalancer resource namespace",
+			Destination: &opts.LoadBalancerNamespace,
+		},
+		cli.StringFlag{
+			Name:        "loadbalancer-name",
+			EnvVar:      "LOADBALANCER_NAME",
+			Usage:       "specify loadbalancer resource name",
+			Destination: &opts.LoadBalancerName,
+		},
+		cli.StringFlag{
+			Name:        "chaos",
+			Usage:       "the policy of the faults injected into the backend for resilience testing, e.g. seed=42,update-error-rate=0.1,latency=uniform:10ms-200ms, never set it in production",
+			Destination: &opts.Chaos,
+		},
+		cli.StringFlag{
+			Name:        "record",
+			Usage:       "the file the inputs and the results of the syncs are recorded to, with the secrets redacted, for replaying them offline with the replay command, empty disables it",
+			Destination: &opts.Record,
+		},
+		cli.StringFlag{
+			Name:        "template-configmap",
+			Usage:       "the name of the configmap in the namespace of the loadbalancer whose key nginx.tmpl overrides the default nginx template, empty uses the default one",
+			Destination: &opts.TemplateConfigMap,
+		},
+		cli.StringFlag{
+			Name:        "reload-strategy",
+			Value:       string(provider.ReloadStrategyReload),
+			Usage:       "how nginx applies a new configuration, reload or blue-green which starts a new nginx and drains the previous one",
+			Destination: &opts.ReloadStrategy,
+		},
+		cli.IntFlag{
+			Name:        "drain-threshold",
+			Usage:       "the number of the connections the nginx retired by the blue-green reload strategy is stopped at",
+			Destination: &opts.DrainThreshold,
+		},
+		cli.DurationFlag{
+			Name:        "drain-timeout",
+			Value:       provider.DefaultDrainTimeout,
+			Usage:       "how long the nginx retired by the blue-green reload strategy serves its connections at most",
+			Destination: &opts.DrainTimeout,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
+}
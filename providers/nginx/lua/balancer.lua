@@ -0,0 +1,80 @@
+-- balancer picks the servers of the upstreams in round robin, the ones
+-- with persistence keep the server of a client in a shared dict until the
+-- client is idle for the timeout
+local bit = require("bit")
+local cjson = require("cjson.safe")
+local ngx_balancer = require("ngx.balancer")
+
+local upstreams = ngx.shared.upstreams
+local sticky = ngx.shared.sticky
+
+local _M = {}
+
+-- the decoded servers and the round robin position of the upstreams in
+-- this worker, decoded again once the upstream changes
+local cache = {}
+
+local function servers(name)
+    local data = upstreams:get(name)
+    if not data then
+        return nil
+    end
+    local c = cache[name]
+    if not c or c.data ~= data then
+        local u = cjson.decode(data) or {}
+        c = {data = data, servers = u.servers or {}, persistence = u.persistence, index = {}, pos = 0}
+        for _, s in ipairs(c.servers) do
+            c.index[s.host .. ":" .. s.port] = s
+        end
+        cache[name] = c
+    end
+    return c
+end
+
+-- client returns the key of the client in the sticky dict, the IPv4
+-- clients are masked by the netmask of the persistence
+local function client(name, netmask)
+    local addr = ngx.var.binary_remote_addr
+    if #addr == 4 and netmask and netmask < 32 then
+        local full = math.floor(netmask / 8)
+        local masked = addr:sub(1, full)
+        local rest = netmask % 8
+        if rest > 0 then
+            masked = masked .. string.char(bit.band(addr:byte(full + 1), 256 - 2 ^ (8 - rest)))
+        end
+        addr = masked .. string.rep("\0", 4 - #masked)
+    end
+    return name .. "|" .. addr
+end
+
+local function next_server(c)
+    c.pos = c.pos % #c.servers + 1
+    return c.servers[c.pos]
+end
+
+function _M.balance(name)
+    local c = servers(name)
+    if not c or #c.servers == 0 then
+        ngx.log(ngx.WARN, "upstream ", name, " has no servers")
+        return ngx.exit(ngx.ERROR)
+    end
+    local s
+    local p = c.persistence
+    if p then
+        -- a server which is gone is replaced, the entry is refreshed by
+        -- every request of the client
+        local key = client(name, p.netmask)
+        local addr = sticky:get(key)
+        s = addr and c.index[addr] or next_server(c)
+        sticky:set(key, s.host .. ":" .. s.port, p.timeout)
+    else
+        s = next_server(c)
+    end
+    local ok, err = ngx_balancer.set_current_peer(s.host, s.port)
+    if not ok then
+        ngx.log(ngx.ERR, "set peer ", s.host, ":", s.port, " of upstream ", name, " error: ", err)
+        return ngx.exit(ngx.ERROR)
+    end
+end
+
+return _M
@@ -0,0 +1,69 @@
+-- configuration keeps the servers of the upstreams in a shared dict, they
+-- are set by the provider through the api and loaded from the file the
+-- provider writes on start and reload
+local cjson = require("cjson.safe")
+
+local upstreams = ngx.shared.upstreams
+
+local _M = {}
+
+local function set(list)
+    for _, u in ipairs(list) do
+        if type(u.name) ~= "string" or type(u.servers) ~= "table" then
+            return "invalid upstream"
+        end
+        local p = u.persistence
+        if p ~= nil and (type(p) ~= "table" or type(p.timeout) ~= "number") then
+            return "invalid persistence"
+        end
+        local ok, err = upstreams:set(u.name, cjson.encode({servers = u.servers, persistence = p}))
+        if not ok then
+            return err
+        end
+    end
+    return nil
+end
+
+-- load sets the upstreams in the file, it runs in init_by_lua
+function _M.load(path)
+    local f = io.open(path, "r")
+    if not f then
+        return
+    end
+    local data = f:read("*a")
+    f:close()
+    local list = cjson.decode(data)
+    if type(list) ~= "table" then
+        ngx.log(ngx.ERR, "invalid upstreams in ", path)
+        return
+    end
+    local err = set(list)
+    if err then
+        ngx.log(ngx.ERR, "load upstreams error: ", err)
+    end
+end
+
+-- call sets the upstreams posted in json, e.g.
+-- [{"name":"default-web-80","servers":[{"host":"10.0.1.2","port":8080}],"persistence":{"timeout":360}}]
+function _M.call()
+    if ngx.req.get_method() ~= "POST" then
+        ngx.status = ngx.HTTP_NOT_ALLOWED
+        return
+    end
+    ngx.req.read_body()
+    local list = cjson.decode(ngx.req.get_body_data() or "")
+    if type(list) ~= "table" then
+        ngx.status = ngx.HTTP_BAD_REQUEST
+        ngx.print("invalid upstreams")
+        return
+    end
+    local err = set(list)
+    if err then
+        ngx.status = ngx.HTTP_INTERNAL_SERVER_ERROR
+        ngx.print(err)
+        return
+    end
+    ngx.status = ngx.HTTP_OK
+end
+
+return _M
@@ -0,0 +1,449 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+)
+
+// ReloadStrategy is how nginx applies a new configuration
+type ReloadStrategy string
+
+const (
+	// ReloadStrategyReload reloads the running nginx, the workers of the
+	// previous configuration are killed with the connections exceeding the
+	// worker_shutdown_timeout
+	ReloadStrategyReload ReloadStrategy = "reload"
+	// ReloadStrategyBlueGreen starts a new nginx master sharing the ports
+	// by SO_REUSEPORT with the running one, which stops accepting and is
+	// retired once its connections drain
+	ReloadStrategyBlueGreen ReloadStrategy = "blue-green"
+
+	// DefaultDrainTimeout is how long a retired nginx master serves its
+	// connections at most
+	DefaultDrainTimeout = 15 * time.Minute
+
+	versionsDir = "/etc/nginx/versions"
+	// handoffFile is the state of the handoffs in the versions directory
+	handoffFile = "handoff.json"
+)
+
+// handoffState is the state of the handoffs, it is persisted on every
+// transition so a restarted provider converges from it
+type handoffState struct {
+	// Version is the last version of the configuration directories
+	Version int `json:"version"`
+	// Active is the version serving, zero for the configuration nginx is
+	// started with before the first sync
+	Active    int `json:"active"`
+	ActivePid int `json:"activePid,omitempty"`
+	// Next is the version being started, zero if none
+	Next     int              `json:"next,omitempty"`
+	NextPid  int              `json:"nextPid,omitempty"`
+	Draining []drainingMaster `json:"draining,omitempty"`
+}
+
+// drainingMaster is a retired nginx master serving its connections only
+type drainingMaster struct {
+	Version  int       `json:"version"`
+	Pid      int       `json:"pid"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// blueGreen runs the handoffs between the nginx masters, each version of
+// the configuration lives in its own directory with the pid file of its
+// master
+type blueGreen struct {
+	dir          string
+	startTimeout time.Duration
+	pollInterval time.Duration
+	// countConnections, signal and alive work on the masters by pid, the
+	// masters started by another run of the provider are not its children
+	countConnections func(pid int) (int, error)
+	signal           func(pid int, sig syscall.Signal) error
+	alive            func(pid int) bool
+
+	mu    sync.Mutex
+	state handoffState
+}
+
+func newBlueGreen(dir string) *blueGreen {
+	return &blueGreen{
+		dir:              dir,
+		startTimeout:     10 * time.Second,
+		pollInterval:     time.Second,
+		countConnections: corenet.CountConnections,
+		signal:           syscall.Kill,
+		alive:            isNginx,
+	}
+}
+
+// isNginx returns true if the process is a nginx, so a pid reused by
+// another process is never signaled
+func isNginx(pid int) bool {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	return err == nil && strings.Contains(string(cmdline), "nginx")
+}
+
+func (b *blueGreen) versionDir(version int) string {
+	return filepath.Join(b.dir, strconv.Itoa(version))
+}
+
+func (b *blueGreen) configPath(version int) string {
+	return filepath.Join(b.versionDir(version), "nginx.conf")
+}
+
+func (b *blueGreen) pidPath(version int) string {
+	return filepath.Join(b.versionDir(version), "nginx.pid")
+}
+
+// load reads the persisted state, a missing one is the initial state
+func (b *blueGreen) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(b.dir, handoffFile))
+	if os.IsNotExist(err) {
+		b.state = handoffState{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &b.state)
+}
+
+// save persists the state, the caller holds the lock
+func (b *blueGreen) save() error {
+	data, err := json.Marshal(b.state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(filepath.Join(b.dir, handoffFile), data, 0644)
+}
+
+// saveOrLog persists the state and logs the error, the state in memory is
+// still right and persisted on the next transition
+func (b *blueGreen) saveOrLog() {
+	if err := b.save(); err != nil {
+		log.Error("persist nginx handoff state error", log.Fields{"err": err})
+	}
+}
+
+// nextVersion returns the version the next handoff starts
+func (b *blueGreen) nextVersion() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.Version + 1
+}
+
+// activeConfig returns the configuration of the version serving, empty if
+// it is the one nginx is started with
+func (b *blueGreen) activeConfig() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state.Active == 0 {
+		return ""
+	}
+	return b.configPath(b.state.Active)
+}
+
+// setActivePid records the master of the version serving
+func (b *blueGreen) setActivePid(pid int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state.ActivePid != pid {
+		b.state.ActivePid = pid
+		b.saveOrLog()
+	}
+}
+
+// removeVersion removes the directory of a version no master uses, the
+// caller holds the lock
+func (b *blueGreen) removeVersion(version int) {
+	if version == 0 || version == b.state.Active || version == b.state.Next {
+		return
+	}
+	for _, d := range b.state.Draining {
+		if d.Version == version {
+			return
+		}
+	}
+	if err := os.RemoveAll(b.versionDir(version)); err != nil {
+		log.Error("remove nginx configuration version error", log.Fields{"version": version, "err": err})
+	}
+}
+
+// activeConfig returns the configuration nginx is started with
+func (p *NginxProvider) activeConfig() string {
+	if p.ReloadStrategy == ReloadStrategyBlueGreen {
+		if cfg := p.blueGreen.activeConfig(); cfg != "" {
+			return cfg
+		}
+	}
+	return p.config.cfgPath
+}
+
+// prepareHandoff renders the configurations for the master of the next
+// version, which writes its own pid file and shares the ports
+func (p *NginxProvider) prepareHandoff() {
+	if p.ReloadStrategy != ReloadStrategyBlueGreen {
+		return
+	}
+	p.config.pidFile = p.blueGreen.pidPath(p.blueGreen.nextVersion())
+	p.config.reusePort = true
+}
+
+// handOff starts a master of the next version with the configuration
+// written last, and retires the running one once the new one is ready. The
+// retired master stops accepting and serves its connections until they
+// drain. The new master is stopped and the running one keeps serving if it
+// fails to start.
+func (p *NginxProvider) handOff() error {
+	b := p.blueGreen
+	data, err := ioutil.ReadFile(p.config.cfgPath)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	next := b.state.Version + 1
+	err = os.MkdirAll(b.versionDir(next), 0755)
+	if err == nil {
+		err = fsutil.WriteFileAtomic(b.configPath(next), data, 0644)
+	}
+	if err == nil {
+		b.state.Version, b.state.Next, b.state.NextPid = next, next, 0
+		err = b.save()
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !p.running() {
+		log.Info("nginx is not started, it starts with the new version", log.Fields{"version": next})
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		prev := b.state.Active
+		b.state.Active, b.state.ActivePid, b.state.Next = next, 0, 0
+		b.removeVersion(prev)
+		b.saveOrLog()
+		return nil
+	}
+
+	log.Info("handing off nginx", log.Fields{"version": next})
+	proc, err := p.newProcess(b.configPath(next))
+	if err == nil {
+		b.mu.Lock()
+		b.state.NextPid = proc.Pid()
+		b.saveOrLog()
+		b.mu.Unlock()
+		err = b.waitReady(proc, next)
+	}
+	if err != nil {
+		b.rollback(proc, next)
+		return fmt.Errorf("error handing off nginx: %v", err)
+	}
+
+	p.mu.Lock()
+	old := p.proc
+	p.proc = proc
+	p.mu.Unlock()
+
+	b.mu.Lock()
+	retired := drainingMaster{Version: b.state.Active, Pid: old.Pid(), Deadline: time.Now().Add(p.DrainTimeout)}
+	b.state.Active, b.state.ActivePid, b.state.Next, b.state.NextPid = next, proc.Pid(), 0, 0
+	b.state.Draining = append(b.state.Draining, retired)
+	b.saveOrLog()
+	b.mu.Unlock()
+
+	log.Info("nginx handed off, draining the previous master", log.Fields{"version": next, "pid": proc.Pid(), "previous": retired.Pid})
+	if err := old.Signal(syscall.SIGQUIT); err != nil {
+		log.Error("stop accepting on the previous nginx master error", log.Fields{"pid": retired.Pid, "err": err})
+	}
+	go p.drain(retired, old)
+	return nil
+}
+
+// waitReady waits for the master to write its pid file, which it does once
+// it listens on the ports
+func (b *blueGreen) waitReady(proc process, version int) error {
+	exited := make(chan error, 1)
+	go func() { exited <- proc.Wait() }()
+	timeout := time.After(b.startTimeout)
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for {
+		if data, err := ioutil.ReadFile(b.pidPath(version)); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(proc.Pid()) {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = fmt.Errorf("nginx exited")
+			}
+			return fmt.Errorf("new nginx master exited: %v", err)
+		case <-timeout:
+			return fmt.Errorf("new nginx master is not ready in %v", b.startTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// rollback stops the master of the version which failed to start and
+// removes the version
+func (b *blueGreen) rollback(proc process, version int) {
+	log.Warn("rolling back nginx handoff", log.Fields{"version": version})
+	if proc != nil {
+		if err := proc.Signal(syscall.SIGTERM); err != nil {
+			log.Error("stop new nginx master error", log.Fields{"pid": proc.Pid(), "err": err})
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state.Next, b.state.NextPid = 0, 0
+	b.removeVersion(version)
+	b.saveOrLog()
+}
+
+// drain waits for the connections of the retired master to drop to the
+// threshold or for its deadline, then stops it. proc is nil if the master
+// was retired by another run of the provider.
+func (p *NginxProvider) drain(d drainingMaster, proc process) {
+	b := p.blueGreen
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if proc != nil {
+			proc.Wait()
+			return
+		}
+		for b.alive(d.Pid) {
+			time.Sleep(b.pollInterval)
+		}
+	}()
+	signal := func(sig syscall.Signal) error {
+		if proc != nil {
+			return proc.Signal(sig)
+		}
+		return b.signal(d.Pid, sig)
+	}
+
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	stopped := false
+	for {
+		select {
+		case <-exited:
+			log.Info("previous nginx master retired", log.Fields{"version": d.Version, "pid": d.Pid})
+			b.mu.Lock()
+			for i := range b.state.Draining {
+				if b.state.Draining[i].Pid == d.Pid {
+					b.state.Draining = append(b.state.Draining[:i], b.state.Draining[i+1:]...)
+					break
+				}
+			}
+			b.removeVersion(d.Version)
+			b.saveOrLog()
+			b.mu.Unlock()
+			return
+		case <-ticker.C:
+		}
+		if stopped {
+			continue
+		}
+
+		reason := ""
+		if !time.Now().Before(d.Deadline) {
+			reason = "timeout"
+		} else if n, err := b.countConnections(d.Pid); err != nil {
+			log.Warn("count connections of the previous nginx master error", log.Fields{"pid": d.Pid, "err": err})
+		} else if n <= p.DrainThreshold {
+			reason = fmt.Sprintf("%d connections left", n)
+		}
+		if reason != "" {
+			log.Info("stopping the previous nginx master", log.Fields{"version": d.Version, "pid": d.Pid, "reason": reason})
+			if err := signal(syscall.SIGTERM); err != nil {
+				log.Error("stop the previous nginx master error", log.Fields{"pid": d.Pid, "err": err})
+			}
+			stopped = true
+		}
+	}
+}
+
+// recoverHandoff converges from the state a previous run of the provider
+// left. The version being started is rolled back, the masters still
+// running are drained, and the versions no master uses are removed.
+func (p *NginxProvider) recoverHandoff() {
+	b := p.blueGreen
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		log.Error("load nginx handoff state error, starting over", log.Fields{"err": err})
+		b.state = handoffState{}
+	}
+
+	if b.state.Next != 0 {
+		log.Warn("rolling back interrupted nginx handoff", log.Fields{"version": b.state.Next})
+		if pid := b.state.NextPid; pid != 0 && b.alive(pid) {
+			b.signal(pid, syscall.SIGTERM)
+		}
+		b.state.Next, b.state.NextPid = 0, 0
+	}
+	draining := make([]drainingMaster, 0, len(b.state.Draining)+1)
+	for _, d := range b.state.Draining {
+		if b.alive(d.Pid) {
+			draining = append(draining, d)
+		}
+	}
+	// the master serving before is replaced by the one started now
+	if pid := b.state.ActivePid; pid != 0 && b.alive(pid) {
+		d := drainingMaster{Version: b.state.Active, Pid: pid, Deadline: time.Now().Add(p.DrainTimeout)}
+		b.signal(pid, syscall.SIGQUIT)
+		draining = append(draining, d)
+	}
+	b.state.ActivePid = 0
+	b.state.Draining = draining
+
+	if entries, err := ioutil.ReadDir(b.dir); err == nil {
+		for _, e := range entries {
+			if version, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+				b.removeVersion(version)
+			}
+		}
+	}
+	b.saveOrLog()
+
+	for _, d := range draining {
+		log.Info("draining nginx master of the previous run", log.Fields{"version": d.Version, "pid": d.Pid})
+		go p.drain(d, nil)
+	}
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeMasters starts the fake nginx masters, which write their pid files
+// unless they fail, and drain the connections set for them
+type fakeMasters struct {
+	mu          sync.Mutex
+	lastPid     int
+	fail        bool
+	procs       map[int]*fakeProcess
+	configs     map[int]string
+	connections map[int]int
+}
+
+func newFakeMasters() *fakeMasters {
+	return &fakeMasters{lastPid: 100, procs: make(map[int]*fakeProcess), configs: make(map[int]string), connections: make(map[int]int)}
+}
+
+func (f *fakeMasters) start(cfgPath string) (process, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastPid++
+	proc := f.add(f.lastPid)
+	f.configs[proc.pid] = cfgPath
+	if f.fail {
+		proc.exited = true
+		close(proc.exit)
+		return proc, nil
+	}
+	pidFile := filepath.Join(filepath.Dir(cfgPath), "nginx.pid")
+	return proc, ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", proc.pid)), 0644)
+}
+
+// add adds a master, the caller holds the lock
+func (f *fakeMasters) add(pid int) *fakeProcess {
+	proc := &fakeProcess{pid: pid, drains: true, exit: make(chan struct{})}
+	f.procs[pid] = proc
+	return proc
+}
+
+func (f *fakeMasters) get(pid int) *fakeProcess {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.procs[pid]
+}
+
+func (f *fakeMasters) config(pid int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.configs[pid]
+}
+
+func (f *fakeMasters) setConnections(pid, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connections[pid] = n
+}
+
+func (f *fakeMasters) countConnections(pid int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections[pid], nil
+}
+
+func (f *fakeMasters) signal(pid int, sig syscall.Signal) error {
+	if proc := f.get(pid); proc != nil {
+		return proc.Signal(sig)
+	}
+	return syscall.ESRCH
+}
+
+func (f *fakeMasters) alive(pid int) bool {
+	proc := f.get(pid)
+	if proc == nil {
+		return false
+	}
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	return !proc.exited
+}
+
+func newBlueGreenTestProvider(t *testing.T, dir string) (*NginxProvider, *fakeMasters) {
+	masters := newFakeMasters()
+	p := newTestProvider(t, dir, &fakeRunner{})
+	p.newProcess = masters.start
+	p.ReloadStrategy = ReloadStrategyBlueGreen
+	p.DrainThreshold = 1
+	p.DrainTimeout = time.Minute
+	b := newBlueGreen(filepath.Join(dir, "versions"))
+	b.startTimeout = time.Second
+	b.pollInterval = 10 * time.Millisecond
+	b.countConnections = masters.countConnections
+	b.signal = masters.signal
+	b.alive = masters.alive
+	p.blueGreen = b
+	return p, masters
+}
+
+func handoffSnapshot(p *NginxProvider) handoffState {
+	p.blueGreen.mu.Lock()
+	defer p.blueGreen.mu.Unlock()
+	state := p.blueGreen.state
+	state.Draining = append([]drainingMaster(nil), state.Draining...)
+	return state
+}
+
+func waitUntil(cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	p, masters := newBlueGreenTestProvider(t, dir)
+	p.SetListers(store.lister())
+	p.Start()
+	waitUntil(p.running)
+
+	// nginx is started with the configuration in the image
+	initial := masters.get(101)
+	assert.Equal(t, p.config.cfgPath, masters.config(101))
+	masters.setConnections(101, 3)
+
+	lb := newTestLoadBalancer(`[{"port":80,"protocol":"http","service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	v1 := masters.get(102)
+	assert.Equal(t, filepath.Join(dir, "versions/1/nginx.conf"), masters.config(102))
+	cfg, err := ioutil.ReadFile(filepath.Join(dir, "versions/1/nginx.conf"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(cfg), "pid "+filepath.Join(dir, "versions/1/nginx.pid")+";")
+	assert.Contains(t, string(cfg), "listen 80 reuseport;")
+	assert.Contains(t, string(cfg), "listen 127.0.0.1:10246 reuseport;")
+	p.mu.Lock()
+	assert.Equal(t, v1, p.proc)
+	p.mu.Unlock()
+
+	// the previous master stops accepting and serves its connections
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT}, initial.Signals())
+	state := handoffSnapshot(p)
+	assert.Equal(t, 1, state.Active)
+	assert.Equal(t, 102, state.ActivePid)
+	assert.Len(t, state.Draining, 1)
+
+	// it is stopped once they drop to the threshold
+	masters.setConnections(101, 1)
+	waitUntil(func() bool { return len(handoffSnapshot(p).Draining) == 0 })
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT, syscall.SIGTERM}, initial.Signals())
+	assert.Empty(t, v1.Signals())
+
+	// or once the timeout passes
+	p.DrainTimeout = 50 * time.Millisecond
+	masters.setConnections(102, 100)
+	lb = newTestLoadBalancer(`[{"port":8080,"protocol":"http","service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	waitUntil(func() bool { return len(handoffSnapshot(p).Draining) == 0 })
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT, syscall.SIGTERM}, v1.Signals())
+	assert.Empty(t, masters.get(103).Signals())
+
+	// the retired version is removed and the state is persisted
+	_, err = os.Stat(filepath.Join(dir, "versions/1"))
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "versions", handoffFile))
+	assert.Nil(t, err)
+	var persisted handoffState
+	assert.Nil(t, json.Unmarshal(data, &persisted))
+	assert.Equal(t, handoffState{Version: 2, Active: 2, ActivePid: 103}, persisted)
+
+	assert.Nil(t, p.Stop())
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT}, masters.get(103).Signals())
+}
+
+func TestHandOffRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	p, masters := newBlueGreenTestProvider(t, dir)
+	p.SetListers(store.lister())
+	p.Start()
+	waitUntil(p.running)
+	initial := masters.get(101)
+
+	// the new master exits before it is ready, the running one keeps
+	// serving
+	masters.fail = true
+	lb := newTestLoadBalancer(`[{"port":80,"protocol":"http","service":"web","servicePort":80}]`)
+	assert.NotNil(t, p.OnUpdate(lb))
+	assert.Empty(t, initial.Signals())
+	assert.Equal(t, []os.Signal{syscall.SIGTERM}, masters.get(102).Signals())
+	assert.Equal(t, handoffState{Version: 1, ActivePid: 101}, handoffSnapshot(p))
+	_, err = os.Stat(filepath.Join(dir, "versions/1"))
+	assert.True(t, os.IsNotExist(err))
+	p.mu.Lock()
+	assert.Equal(t, initial, p.proc)
+	p.mu.Unlock()
+
+	// retried with the next version
+	masters.fail = false
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, filepath.Join(dir, "versions/2/nginx.conf"), masters.config(103))
+	assert.Equal(t, 2, handoffSnapshot(p).Active)
+	waitUntil(func() bool { return len(handoffSnapshot(p).Draining) == 0 })
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT, syscall.SIGTERM}, initial.Signals())
+
+	assert.Nil(t, p.Stop())
+}
+
+func TestRecoverHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the previous run crashed while starting version 4, version 3 was
+	// serving and version 2 draining, version 1 is stale
+	p, masters := newBlueGreenTestProvider(t, dir)
+	for v := 1; v <= 4; v++ {
+		assert.Nil(t, os.MkdirAll(p.blueGreen.versionDir(v), 0755))
+		assert.Nil(t, ioutil.WriteFile(p.blueGreen.configPath(v), []byte("# version"), 0644))
+	}
+	masters.mu.Lock()
+	active, draining, next := masters.add(201), masters.add(202), masters.add(203)
+	masters.mu.Unlock()
+	masters.setConnections(201, 10)
+	masters.setConnections(202, 10)
+	data, err := json.Marshal(handoffState{
+		Version:   4,
+		Active:    3,
+		ActivePid: 201,
+		Next:      4,
+		NextPid:   203,
+		Draining: []drainingMaster{
+			{Version: 2, Pid: 202, Deadline: time.Now().Add(-time.Second)},
+			{Version: 1, Pid: 299, Deadline: time.Now().Add(time.Hour)},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "versions", handoffFile), data, 0644))
+
+	p.Start()
+	waitUntil(p.running)
+
+	// the version being started is rolled back
+	assert.Equal(t, []os.Signal{syscall.SIGTERM}, next.Signals())
+	_, err = os.Stat(p.blueGreen.versionDir(4))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(p.blueGreen.versionDir(1))
+	assert.True(t, os.IsNotExist(err))
+	// the version serving is started again
+	assert.Equal(t, p.blueGreen.configPath(3), masters.config(101))
+
+	// the draining master is stopped by its deadline, the master serving
+	// before drains
+	waitUntil(func() bool { return len(draining.Signals()) > 0 })
+	assert.Equal(t, []os.Signal{syscall.SIGTERM}, draining.Signals())
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT}, active.Signals())
+	masters.setConnections(201, 0)
+	waitUntil(func() bool { return len(handoffSnapshot(p).Draining) == 0 })
+	assert.Equal(t, []os.Signal{syscall.SIGQUIT, syscall.SIGTERM}, active.Signals())
+
+	_, err = os.Stat(p.blueGreen.versionDir(2))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(p.blueGreen.configPath(3))
+	assert.Nil(t, err)
+	assert.Equal(t, handoffState{Version: 4, Active: 3, ActivePid: 101}, handoffSnapshot(p))
+
+	assert.Nil(t, p.Stop())
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	nginxCfg      = "/etc/nginx/nginx.conf"
+	nginxTmpl     = "/root/nginx.tmpl"
+	nginxPid      = "/run/nginx.pid"
+	certDir       = "/etc/nginx/certs"
+	luaDir        = "/etc/nginx/lua"
+	upstreamsFile = "/etc/nginx/upstreams.json"
+
+	// apiPort is the port on localhost of the api updating the servers of
+	// the upstreams
+	apiPort = 10246
+)
+
+// server is a port terminating HTTP
+type server struct {
+	Port int
+	// Host is the server_name of a host routed to its own upstream, empty
+	// for the server of the port which serves the hosts not matched
+	Host string
+	// TLS is nil for plain HTTP
+	TLS *certFiles
+	// AcceptProxy expects the PROXY protocol header on the connections,
+	// the address in the header is the one of the client
+	AcceptProxy bool
+	// Upstream is the name of the upstream the requests are proxied to
+	Upstream string
+	// BackendTLS re-encrypts the requests to the upstream, nil for plain
+	// HTTP
+	BackendTLS *backendTLS
+	// Limits are the limits of the port alone, nil if it is unlimited
+	Limits *limits
+	// Redirect redirects the requests to https, nil if they are proxied
+	Redirect *redirect
+}
+
+// Location returns the location of the requests proxied to the upstream,
+// the ACME challenges alone if the others are redirected and none if all
+// of them are
+func (s server) Location() string {
+	switch {
+	case s.Redirect == nil:
+		return "/"
+	case s.Redirect.ExemptACME:
+		return core.ACMEChallengePath
+	}
+	return ""
+}
+
+// redirect is how the requests of a plain HTTP server are redirected to
+// https on the same host
+type redirect struct {
+	// Port is the https port redirected to, the default one if zero
+	Port int
+	// ExemptACME proxies the ACME challenges instead of redirecting them
+	ExemptACME bool
+}
+
+// limits caps the requests in process and the requests per second, a zero
+// cap is unlimited
+type limits struct {
+	MaxConnections int
+	RequestRate    int
+}
+
+// backendTLS is how the requests are re-encrypted to an upstream
+type backendTLS struct {
+	// CA is the path of the CA certificates verifying the servers of the
+	// upstream, they are not verified if it is empty
+	CA string
+}
+
+// certFiles are the paths of a certificate and its key
+type certFiles struct {
+	Cert string
+	Key  string
+}
+
+// accessLog is the access_log of the servers
+type accessLog struct {
+	// Target is the file or the syslog server the logs are written to
+	Target string
+	// Format is the log_format, the default combined one if empty
+	Format string
+	// Percent is the percentage of the requests logged, all if empty
+	Percent string
+}
+
+// defaultAccessLog is the access log of the LoadBalancers without one
+var defaultAccessLog = &accessLog{Target: "/dev/stdout"}
+
+// upstream is the endpoints of a port of a Service, the servers are not
+// rendered but set through the api
+type upstream struct {
+	Name    string           `json:"name"`
+	Servers []upstreamServer `json:"servers"`
+	// Persistence is nil if the servers are picked in round robin
+	Persistence *persistence `json:"persistence,omitempty"`
+}
+
+// persistence makes the balancer keep the server of a client until it is
+// idle for the timeout in seconds
+type persistence struct {
+	Timeout uint32 `json:"timeout"`
+	// Netmask is the prefix length grouping the IPv4 clients sharing the
+	// server, each client alone if it is zero
+	Netmask int `json:"netmask,omitempty"`
+}
+
+// upstreamServer is an endpoint of an upstream
+type upstreamServer struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// config renders the nginx configuration and writes it with the
+// certificates it references
+type config struct {
+	tmpl          *template.Template
+	cfgPath       string
+	certDir       string
+	pidFile       string
+	luaDir        string
+	upstreamsFile string
+	apiPort       int
+	// reusePort makes the listeners share the ports with the listeners of
+	// another nginx master
+	reusePort bool
+	runner    Runner
+	// current is the last configuration written to cfgPath
+	current []byte
+}
+
+func newConfig(runner Runner) *config {
+	return &config{
+		cfgPath:       nginxCfg,
+		certDir:       certDir,
+		pidFile:       nginxPid,
+		luaDir:        luaDir,
+		upstreamsFile: upstreamsFile,
+		apiPort:       apiPort,
+		runner:        runner,
+	}
+}
+
+func (c *config) loadTemplate() error {
+	tmpl, err := template.ParseFiles(nginxTmpl)
+	if err != nil {
+		return err
+	}
+	c.tmpl = tmpl
+	return nil
+}
+
+// render renders the configuration of the model of the LoadBalancer with
+// the template, the default one if it is nil. The data of the template is
+// the contract with the templates overriding the default one, the keys and
+// the fields of their values are only added in the minor releases, and
+// renamed or removed in the major ones:
+//
+//	namespace, name  string      the LoadBalancer
+//	pidFile          string      the pid file nginx is signaled by
+//	luaDir           string      the lua modules balancing the upstreams
+//	upstreamsFile    string      the servers of the upstreams loaded on start
+//	apiPort          int         the port on localhost of the upstreams api
+//	servers          []server    the ports of the LoadBalancer
+//	upstreams        []upstream  the upstreams the servers proxy to
+//	accessLog        *accessLog  nil if the requests are not logged
+//	sourceRanges     []string    the CIDRs of the clients allowed, all if empty
+//	limits           *limits     the limits of all servers, nil if unlimited
+//	rateLimited      bool        whether any limit is set
+//	reusePort        bool        whether the listeners share the ports with another master
+func (c *config) render(tmpl *template.Template, namespace, name string, m *model) ([]byte, error) {
+	if tmpl == nil {
+		tmpl = c.tmpl
+	}
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, map[string]interface{}{
+		"namespace":     namespace,
+		"name":          name,
+		"pidFile":       c.pidFile,
+		"luaDir":        c.luaDir,
+		"upstreamsFile": c.upstreamsFile,
+		"apiPort":       c.apiPort,
+		"servers":       m.Servers,
+		"upstreams":     m.Upstreams,
+		"accessLog":     m.AccessLog,
+		"sourceRanges":  m.SourceRanges,
+		"limits":        m.Limits,
+		"rateLimited":   m.rateLimited(),
+		"reusePort":     c.reusePort,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// update validates the configuration with nginx -t and replaces the file
+// atomically, it returns false if the configuration is unchanged. The file
+// is not touched if nginx rejects the configuration.
+func (c *config) update(data []byte) (bool, error) {
+	old := c.current
+	if old == nil {
+		// the configuration nginx is started with
+		old, _ = ioutil.ReadFile(c.cfgPath)
+	}
+	if bytes.Equal(data, old) {
+		c.current = data
+		return false, nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(c.cfgPath), "."+filepath.Base(c.cfgPath))
+	if err != nil {
+		return false, err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if _, verr := c.runner.Run("-t", "-q", "-c", tmp); verr != nil {
+			err = fmt.Errorf("nginx rejected the configuration: %v", verr)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.cfgPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	c.current = data
+	return true, nil
+}
+
+// writeCertificate writes the certificate and the key readable by root
+// only, the files are named after their content so the ones referenced by
+// the running configuration are never overwritten
+func (c *config) writeCertificate(cert *core.TLSCertificate) (*certFiles, error) {
+	h := sha256.New()
+	h.Write(cert.Cert)
+	h.Write(cert.Key)
+	name := hex.EncodeToString(h.Sum(nil))[:16]
+	files := &certFiles{
+		Cert: filepath.Join(c.certDir, name+".crt"),
+		Key:  filepath.Join(c.certDir, name+".key"),
+	}
+
+	if err := os.MkdirAll(c.certDir, 0700); err != nil {
+		return nil, err
+	}
+	for path, data := range map[string][]byte{files.Cert: cert.Cert, files.Key: cert.Key} {
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := fsutil.WriteFileAtomic(path, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// writeCA writes the CA certificates verifying the upstreams to the file
+// named after their content, and returns its path
+func (c *config) writeCA(ca []byte) (string, error) {
+	sum := sha256.Sum256(ca)
+	path := filepath.Join(c.certDir, hex.EncodeToString(sum[:])[:16]+".ca.crt")
+
+	if err := os.MkdirAll(c.certDir, 0700); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := fsutil.WriteFileAtomic(path, ca, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeStaleCertificates removes the certificates the servers do not
+// reference
+func (c *config) removeStaleCertificates(servers []server) {
+	inUse := make(map[string]bool)
+	for _, s := range servers {
+		if s.TLS != nil {
+			inUse[s.TLS.Cert] = true
+			inUse[s.TLS.Key] = true
+		}
+		if s.BackendTLS != nil && s.BackendTLS.CA != "" {
+			inUse[s.BackendTLS.CA] = true
+		}
+	}
+	files, err := ioutil.ReadDir(c.certDir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		path := filepath.Join(c.certDir, f.Name())
+		if inUse[path] {
+			continue
+		}
+		log.Info("removing stale certificate", log.Fields{"file": path})
+		if err := os.Remove(path); err != nil {
+			log.Error("remove stale certificate error", log.Fields{"file": path, "err": err})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/fsutil"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+)
+
+// apiTimeout bounds the requests to the api of nginx
+const apiTimeout = 5 * time.Second
+
+// model is what the configuration of nginx is rendered from
+type model struct {
+	Servers   []server
+	Upstreams []upstream
+	// AccessLog is nil if the requests are not logged
+	AccessLog *accessLog
+	// SourceRanges are the CIDRs of the clients allowed, all if empty
+	SourceRanges []string
+	// Limits are the limits of all servers together, nil if they are
+	// unlimited
+	Limits *limits
+	// Certificates are reported only, the servers reference the files of
+	// the certificates named after their content
+	Certificates []core.ServingCertificate
+	// Template is the hash of the template overriding the default one the
+	// configuration is rendered from, empty for the default one
+	Template string
+}
+
+// rateLimited returns true if the servers or any of them are limited
+func (m *model) rateLimited() bool {
+	if m.Limits != nil {
+		return true
+	}
+	for _, s := range m.Servers {
+		if s.Limits != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// portHealth returns the health of the ports of the servers, a port without
+// servers in its upstream drops the requests. The health of a port is the
+// one of the hosts not matched, the servers of its hosts are not counted.
+func portHealth(m *model) []core.PortHealth {
+	servers := make(map[string]int, len(m.Upstreams))
+	for _, u := range m.Upstreams {
+		servers[u.Name] = len(u.Servers)
+	}
+	ret := make([]core.PortHealth, 0, len(m.Servers))
+	for _, s := range m.Servers {
+		if s.Host != "" {
+			continue
+		}
+		h := core.PortHealth{Protocol: "tcp", Port: s.Port, Healthy: servers[s.Upstream] > 0}
+		if !h.Healthy {
+			h.Reason = fmt.Sprintf("upstream %s has no server", s.Upstream)
+		}
+		ret = append(ret, h)
+	}
+	return ret
+}
+
+// configChange is how a change of the model is applied to nginx, the
+// greater ones apply the lesser ones too
+type configChange int
+
+const (
+	configUnchanged configChange = iota
+	// configDynamic changes the servers or the persistence of existing
+	// upstreams only, they are pushed to the running nginx through the api
+	configDynamic
+	// configReload changes the servers or the set of upstreams, the
+	// configuration is rewritten and nginx is reloaded
+	configReload
+)
+
+func (c configChange) String() string {
+	switch c {
+	case configUnchanged:
+		return "unchanged"
+	case configDynamic:
+		return "dynamic"
+	case configReload:
+		return "reload"
+	}
+	return fmt.Sprintf("configChange(%d)", int(c))
+}
+
+// diffModels returns how the change from the old model to the current one
+// is applied, and the upstreams whose servers or persistence changed. The servers are
+// compared field by field since a changed port, protocol or certificate
+// needs a reload.
+func diffModels(old, cur *model) (configChange, []upstream) {
+	if old == nil || !reflect.DeepEqual(old.Servers, cur.Servers) || len(old.Upstreams) != len(cur.Upstreams) || !reflect.DeepEqual(old.AccessLog, cur.AccessLog) || !reflect.DeepEqual(old.SourceRanges, cur.SourceRanges) || !reflect.DeepEqual(old.Limits, cur.Limits) || old.Template != cur.Template {
+		return configReload, cur.Upstreams
+	}
+
+	oldUpstreams := make(map[string]upstream, len(old.Upstreams))
+	for _, u := range old.Upstreams {
+		oldUpstreams[u.Name] = u
+	}
+	changed := make([]upstream, 0)
+	for _, u := range cur.Upstreams {
+		o, ok := oldUpstreams[u.Name]
+		if !ok {
+			return configReload, cur.Upstreams
+		}
+		if !reflect.DeepEqual(o, u) {
+			changed = append(changed, u)
+		}
+	}
+	if len(changed) == 0 {
+		return configUnchanged, nil
+	}
+	return configDynamic, changed
+}
+
+// writeUpstreams writes the servers of all upstreams to the file nginx
+// loads them from on start and reload
+func (c *config) writeUpstreams(upstreams []upstream) error {
+	data, err := json.Marshal(upstreams)
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(c.upstreamsFile, data, 0644)
+}
+
+// pushUpstreams sets the servers of the upstreams in the running nginx
+func pushUpstreams(url string, upstreams []upstream) error {
+	data, err := json.Marshal(upstreams)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: apiTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error pushing upstreams to nginx: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("nginx rejected the upstreams: %s: %s", resp.Status, body)
+	}
+	return nil
+}
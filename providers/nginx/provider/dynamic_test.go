@@ -0,0 +1,284 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffModels(t *testing.T) {
+	web := upstream{Name: "default-web-80", Servers: []upstreamServer{{Host: "10.0.1.2", Port: 8080}}}
+	webScaled := upstream{Name: "default-web-80", Servers: []upstreamServer{{Host: "10.0.1.2", Port: 8080}, {Host: "10.0.1.3", Port: 8080}}}
+	webDown := upstream{Name: "default-web-80", Servers: []upstreamServer{}}
+	webSticky := upstream{Name: "default-web-80", Servers: web.Servers, Persistence: &persistence{Timeout: 360}}
+	api := upstream{Name: "default-api-80", Servers: []upstreamServer{{Host: "10.0.2.2", Port: 8080}}}
+	http80 := server{Port: 80, Upstream: "default-web-80"}
+	https443 := server{Port: 443, TLS: &certFiles{Cert: "a.crt", Key: "a.key"}, Upstream: "default-web-80"}
+	api8080 := server{Port: 8080, Upstream: "default-api-80"}
+	old := &model{Servers: []server{http80, https443, api8080}, Upstreams: []upstream{web, api}}
+
+	cases := []struct {
+		name    string
+		old     *model
+		cur     *model
+		change  configChange
+		changed []upstream
+	}{
+		{
+			name:    "first",
+			cur:     old,
+			change:  configReload,
+			changed: []upstream{web, api},
+		},
+		{
+			name:   "unchanged",
+			old:    old,
+			cur:    &model{Servers: []server{http80, https443, api8080}, Upstreams: []upstream{web, api}},
+			change: configUnchanged,
+		},
+		{
+			name:    "endpoint added",
+			old:     old,
+			cur:     &model{Servers: []server{http80, https443, api8080}, Upstreams: []upstream{webScaled, api}},
+			change:  configDynamic,
+			changed: []upstream{webScaled},
+		},
+		{
+			name:    "endpoints gone",
+			old:     old,
+			cur:     &model{Servers: []server{http80, https443, api8080}, Upstreams: []upstream{webDown, api}},
+			change:  configDynamic,
+			changed: []upstream{webDown},
+		},
+		{
+			name:    "persistence changed",
+			old:     old,
+			cur:     &model{Servers: []server{http80, https443, api8080}, Upstreams: []upstream{webSticky, api}},
+			change:  configDynamic,
+			changed: []upstream{webSticky},
+		},
+		{
+			name:    "port changed",
+			old:     old,
+			cur:     &model{Servers: []server{{Port: 81, Upstream: "default-web-80"}, https443, api8080}, Upstreams: []upstream{web, api}},
+			change:  configReload,
+			changed: []upstream{web, api},
+		},
+		{
+			name: "certificate changed",
+			old:  old,
+			cur: &model{
+				Servers:   []server{http80, {Port: 443, TLS: &certFiles{Cert: "b.crt", Key: "b.key"}, Upstream: "default-web-80"}, api8080},
+				Upstreams: []upstream{webScaled, api},
+			},
+			change:  configReload,
+			changed: []upstream{webScaled, api},
+		},
+		{
+			name:    "server added",
+			old:     old,
+			cur:     &model{Servers: []server{http80, https443, api8080, {Port: 8081, Upstream: "default-api-80"}}, Upstreams: []upstream{web, api}},
+			change:  configReload,
+			changed: []upstream{web, api},
+		},
+		{
+			name:    "upstream removed",
+			old:     old,
+			cur:     &model{Servers: []server{http80, https443}, Upstreams: []upstream{web}},
+			change:  configReload,
+			changed: []upstream{web},
+		},
+	}
+	for _, c := range cases {
+		change, changed := diffModels(c.old, c.cur)
+		assert.Equal(t, c.change, change, c.name)
+		assert.Equal(t, c.changed, changed, c.name)
+	}
+}
+
+// fakeAPI is the api of nginx recording the pushed upstreams
+type fakeAPI struct {
+	mu     sync.Mutex
+	status int
+	pushes [][]upstream
+}
+
+func (a *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	upstreams := make([]upstream, 0)
+	json.NewDecoder(r.Body).Decode(&upstreams)
+	a.pushes = append(a.pushes, upstreams)
+	if a.status != 0 {
+		w.WriteHeader(a.status)
+	}
+}
+
+func (a *fakeAPI) Pushes() [][]upstream {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([][]upstream(nil), a.pushes...)
+}
+
+func TestOnUpdateDynamic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	store.addService("api", "10.0.2.2")
+	runner := &fakeRunner{}
+	p := newTestProvider(t, dir, runner)
+	p.apiURL = srv.URL
+	p.SetListers(store.lister())
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80},{"port":8080,"service":"api","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+	assert.Empty(t, api.Pushes())
+	assert.Equal(t, []core.PortHealth{{Protocol: "tcp", Port: 80, Healthy: true}, {Protocol: "tcp", Port: 8080, Healthy: true}}, p.PortHealth())
+
+	// the endpoints of a Service changed, only its upstream is pushed
+	runner.calls = nil
+	store.addService("web", "10.0.1.2", "10.0.1.3")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+	web := upstream{Name: "default-web-80", Servers: []upstreamServer{{Host: "10.0.1.2", Port: 8080}, {Host: "10.0.1.3", Port: 8080}}}
+	assert.Equal(t, [][]upstream{{web}}, api.Pushes())
+
+	// nginx loads all upstreams from the file on start and reload
+	data, err := ioutil.ReadFile(p.config.upstreamsFile)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `[
+		{"name":"default-web-80","servers":[{"host":"10.0.1.2","port":8080},{"host":"10.0.1.3","port":8080}]},
+		{"name":"default-api-80","servers":[{"host":"10.0.2.2","port":8080}]}
+	]`, string(data))
+
+	// a failed push is retried, the endpoints of the Service are gone
+	api.status = http.StatusInternalServerError
+	store.addService("api")
+	assert.NotNil(t, p.OnUpdate(lb))
+	assert.True(t, p.PortHealth()[1].Healthy)
+	api.status = 0
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, core.PortHealth{Protocol: "tcp", Port: 8080, Reason: "upstream default-api-80 has no server"}, p.PortHealth()[1])
+	pushes := api.Pushes()
+	assert.Len(t, pushes, 3)
+	assert.Equal(t, pushes[1], pushes[2])
+	assert.Equal(t, []upstream{{Name: "default-api-80", Servers: []upstreamServer{}}}, pushes[2])
+	assert.Empty(t, runner.calls)
+
+	// the persistence is pushed without reloading
+	for _, c := range []struct {
+		name        string
+		persistence string
+		want        *persistence
+	}{
+		{"on", `{"enabled":true}`, &persistence{Timeout: 360}},
+		{"timeout changed", `{"enabled":true,"timeout":600,"netmask":"255.255.255.0"}`, &persistence{Timeout: 600, Netmask: 24}},
+		{"off", `{"enabled":false}`, nil},
+	} {
+		lb.Annotations[core.AnnotationKeyPersistence] = c.persistence
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		pushes = api.Pushes()
+		last := pushes[len(pushes)-1]
+		assert.Len(t, last, 2, c.name)
+		for _, u := range last {
+			assert.Equal(t, c.want, u.Persistence, c.name)
+		}
+	}
+	assert.Len(t, api.Pushes(), 6)
+	assert.Empty(t, runner.calls)
+}
+
+func TestOnUpdateHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	api := &fakeAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	store.addTLSSecret(t, "cert")
+	store.addTLSSecret(t, "api-cert")
+	runner := &fakeRunner{}
+	p := newTestProvider(t, dir, runner)
+	p.apiURL = srv.URL
+	p.SetListers(store.lister())
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	// the Service of a host is missing
+	lb := newTestLoadBalancer(`[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[{"host":"api.example.com","tlsSecret":"api-cert","service":"api","servicePort":80}]}]`)
+	err = p.OnUpdate(lb)
+	assert.True(t, core.IsPermanentError(err))
+	assert.Equal(t, "ServiceNotFound", err.(*core.PermanentError).Reason)
+	assert.Empty(t, runner.calls)
+
+	store.addService("api", "10.0.2.2")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+	served := p.ServingCertificates()
+	assert.Len(t, served, 2)
+	assert.Equal(t, []string{"", "api.example.com"}, []string{served[0].Host, served[1].Host})
+	assert.Equal(t, []string{"cert", "api-cert"}, []string{served[0].Secret, served[1].Secret})
+	assert.Equal(t, []core.PortHealth{{Protocol: "tcp", Port: 443, Healthy: true}}, p.PortHealth())
+
+	// the endpoints of the Service of a host changed, only its upstream is
+	// pushed
+	runner.calls = nil
+	store.addService("api", "10.0.2.2", "10.0.2.3")
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+	apiUpstream := upstream{Name: "default-api-80", Servers: []upstreamServer{{Host: "10.0.2.2", Port: 8080}, {Host: "10.0.2.3", Port: 8080}}}
+	assert.Equal(t, [][]upstream{{apiUpstream}}, api.Pushes())
+
+	// a host is added
+	lb = newTestLoadBalancer(`[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[
+		{"host":"api.example.com","tlsSecret":"api-cert","service":"api","servicePort":80},
+		{"host":"www.example.com","service":"web","servicePort":80}
+	]}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	data, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "server_name www.example.com;")
+	assert.Len(t, p.ServingCertificates(), 3)
+}
@@ -0,0 +1,558 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/nginx/version"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var (
+	_ core.Provider            = &NginxProvider{}
+	_ core.CertificateProvider = &NginxProvider{}
+	_ core.HealthzProvider     = &NginxProvider{}
+	_ core.PortHealthProvider  = &NginxProvider{}
+	_ core.EventProvider       = &NginxProvider{}
+)
+
+// NginxProvider terminates the HTTP ports of the LoadBalancer with nginx
+// and proxies the requests to the endpoints of the Services
+type NginxProvider struct {
+	storeLister core.StoreLister
+	config      *config
+	runner      Runner
+	newProcess  func(cfgPath string) (process, error)
+	// apiURL is the api of nginx updating the servers of the upstreams
+	apiURL string
+	// model is the last model applied to nginx
+	model *model
+	// pending is the change not applied by a failed reload or push, it is
+	// retried on the next update. The model is only replaced once applied,
+	// so the pushes are retried by diffing with it again.
+	pending configChange
+	// checksum skips the syncs whose model is the one applied last
+	checksum *core.Checksum
+
+	// TemplateConfigMap is the name of the ConfigMap in the namespace of
+	// the LoadBalancer whose TemplateConfigMapKey overrides the default
+	// template, it is not overridden if empty
+	TemplateConfigMap string
+	templates         templates
+
+	// ReloadStrategy is how a new configuration is applied,
+	// ReloadStrategyReload by default
+	ReloadStrategy ReloadStrategy
+	// DrainThreshold is the number of the connections a master retired by
+	// ReloadStrategyBlueGreen is stopped at, and DrainTimeout is how long
+	// it serves them at most
+	DrainThreshold int
+	DrainTimeout   time.Duration
+	blueGreen      *blueGreen
+
+	// backoff delays the starts of nginx after it crashes
+	backoff *flowcontrol.Backoff
+	stopCh  chan struct{}
+
+	mu       sync.Mutex
+	proc     process
+	started  bool
+	stopping bool
+	// exitErr is the error of the last unexpected exit of nginx, it is
+	// cleared once nginx is started again
+	exitErr error
+	// health is the health of the ports of the last model applied
+	health []core.PortHealth
+}
+
+// NewNginxProvider creates a new nginx LoadBalancer Provider.
+func NewNginxProvider() (*NginxProvider, error) {
+	runner := NewRunner()
+	p := &NginxProvider{
+		config:         newConfig(runner),
+		runner:         runner,
+		newProcess:     startNginx,
+		apiURL:         fmt.Sprintf("http://127.0.0.1:%d/configuration/upstreams", apiPort),
+		ReloadStrategy: ReloadStrategyReload,
+		DrainTimeout:   DefaultDrainTimeout,
+		checksum:       core.NewChecksum("nginx"),
+		blueGreen:      newBlueGreen(versionsDir),
+		backoff:        flowcontrol.NewBackOff(nginxInitialBackoff, nginxMaxBackoff),
+		stopCh:         make(chan struct{}),
+	}
+	if err := p.config.loadTemplate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// OnUpdate applies the servers of the HTTP ports of the LoadBalancer to
+// nginx. The changes of the endpoints of the Services only are pushed to the
+// running nginx, the others reload it. A configuration rejected by nginx
+// fails the sync and the previous one keeps serving. A rotated certificate
+// is written to new files and reloads nginx gracefully, the connections are
+// served by the previous workers until they close, while a Secret updated
+// with the same certificate changes nothing. The model applied last is
+// neither written nor applied again unless the LoadBalancer forces a resync,
+// which reloads nginx.
+func (p *NginxProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	log.Info("Updating nginx config", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name})
+
+	ports, err := core.GetHTTPPorts(lb)
+	if err != nil {
+		return err
+	}
+	persistence, err := core.GetPersistence(lb)
+	if err != nil {
+		return err
+	}
+	m, err := p.getModel(lb, ports, getUpstreamPersistence(persistence))
+	if err != nil {
+		return err
+	}
+	pps, err := core.GetProxyProtocols(lb)
+	if err != nil {
+		return err
+	}
+	if err := setProxyProtocols(m.Servers, pps); err != nil {
+		return err
+	}
+	if err := p.setBackendProtocols(lb, m.Servers); err != nil {
+		return err
+	}
+	rateLimit, err := core.GetRateLimit(lb)
+	if err != nil {
+		return err
+	}
+	if err := setRateLimits(m, rateLimit); err != nil {
+		return err
+	}
+	sslRedirect, err := core.GetSSLRedirect(lb)
+	if err != nil {
+		return err
+	}
+	setSSLRedirect(m.Servers, sslRedirect)
+	al, err := core.GetAccessLog(lb)
+	if err != nil {
+		return err
+	}
+	m.AccessLog = getAccessLog(al)
+	ranges, err := core.GetSourceRanges(lb)
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		m.SourceRanges = append(m.SourceRanges, r.String())
+	}
+	tmpl, hash := p.getTemplate(lb)
+	m.Template = hash
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sum := core.Sum([]byte(lb.Namespace), []byte(lb.Name), data)
+	if p.checksum.Unchanged(lb, sum) {
+		return nil
+	}
+
+	change, changed := diffModels(p.model, m)
+	if p.pending > change {
+		change, changed = p.pending, m.Upstreams
+	}
+	if change == configUnchanged && p.checksum.Forced(lb) {
+		// the file may be changed by others
+		p.config.current = nil
+		change = configReload
+	}
+	if change == configUnchanged {
+		// the Secrets may be renamed
+		p.model.Certificates = m.Certificates
+		return nil
+	}
+	log.Info("Applying nginx change", log.Fields{"change": change, "upstreams": len(changed)})
+
+	// nginx loads the servers from the file on start and reload
+	if err := p.config.writeUpstreams(m.Upstreams); err != nil {
+		return err
+	}
+	switch change {
+	case configReload:
+		err = p.applyReload(lb, m, tmpl)
+	case configDynamic:
+		err = p.applyDynamic(changed)
+	}
+	if err != nil {
+		p.pending = change
+		p.checksum.Invalidate()
+		return err
+	}
+	p.pending = configUnchanged
+	p.checksum.Applied(lb, sum)
+	logRotatedCertificates(p.model, m)
+	p.model = m
+	p.mu.Lock()
+	p.health = portHealth(m)
+	p.mu.Unlock()
+
+	p.config.removeStaleCertificates(m.Servers)
+	return nil
+}
+
+// ServingCertificates implements core.CertificateProvider, it returns the
+// certificates of the last model applied to nginx
+func (p *NginxProvider) ServingCertificates() []core.ServingCertificate {
+	if p.model == nil {
+		return nil
+	}
+	return p.model.Certificates
+}
+
+// PortHealth implements core.PortHealthProvider, a port of the last model
+// applied to nginx is healthy if its upstream has servers
+func (p *NginxProvider) PortHealth() []core.PortHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.health
+}
+
+// logRotatedCertificates logs the ports and hosts serving another
+// certificate than the previous model
+func logRotatedCertificates(old, cur *model) {
+	if old == nil {
+		return
+	}
+	type served struct {
+		port int
+		host string
+	}
+	fingerprints := make(map[served]string, len(old.Certificates))
+	for _, c := range old.Certificates {
+		fingerprints[served{c.Port, c.Host}] = c.Fingerprint
+	}
+	for _, c := range cur.Certificates {
+		if fp, ok := fingerprints[served{c.Port, c.Host}]; ok && fp != c.Fingerprint {
+			log.Info("Certificate rotated", log.Fields{"port": c.Port, "host": c.Host, "secret": c.Secret, "fingerprint": c.Fingerprint, "notAfter": c.NotAfter})
+		}
+	}
+}
+
+// applyReload rewrites the configuration of the model with the template
+// and reloads nginx, or hands off to a new master by the blue-green reload
+// strategy. A new override of the template which fails to render
+// or renders a configuration nginx rejects is reported, and the
+// configuration is rendered from the last template applied instead.
+func (p *NginxProvider) applyReload(lb *netv1alpha1.LoadBalancer, m *model, tmpl *template.Template) error {
+	p.prepareHandoff()
+	err := p.writeConfig(lb, m, tmpl)
+	if _, last := p.templates.last(); err != nil && m.Template != last {
+		p.templates.reject(m.Template, fmt.Errorf("nginx template in configmap %s/%s rejected: %v", lb.Namespace, p.TemplateConfigMap, err))
+		tmpl, m.Template = p.templates.last()
+		err = p.writeConfig(lb, m, tmpl)
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.reload(); err != nil {
+		return err
+	}
+	p.templates.applied = nil
+	if m.Template != "" {
+		p.templates.applied = &templateOverride{tmpl: tmpl, hash: m.Template}
+	}
+	return nil
+}
+
+// writeConfig renders the configuration of the model with the template and
+// writes it if nginx accepts it
+func (p *NginxProvider) writeConfig(lb *netv1alpha1.LoadBalancer, m *model, tmpl *template.Template) error {
+	data, err := p.config.render(tmpl, lb.Namespace, lb.Name, m)
+	if err != nil {
+		return err
+	}
+	if _, err := p.config.update(data); err != nil {
+		log.Error("update nginx config error", log.Fields{"err": err})
+		return err
+	}
+	return nil
+}
+
+// applyDynamic pushes the servers of the upstreams to the running nginx,
+// nginx loads them from the file if it is not started yet
+func (p *NginxProvider) applyDynamic(upstreams []upstream) error {
+	if !p.running() {
+		log.Info("nginx is not started, skip pushing upstreams")
+		return nil
+	}
+	return pushUpstreams(p.apiURL, upstreams)
+}
+
+// getModel returns the servers of the ports and of their hosts, and the
+// upstreams they proxy to with the persistence, the certificates of the
+// https ports are written to the files the servers reference
+func (p *NginxProvider) getModel(lb *netv1alpha1.LoadBalancer, ports []core.HTTPPort, pers *persistence) (*model, error) {
+	servers := make([]server, 0, len(ports))
+	upstreams := make([]upstream, 0)
+	certs := make([]core.ServingCertificate, 0)
+	seen := make(map[string]bool)
+	// addServer adds the server proxying to the port of the Service, the
+	// certificate of the secret terminates TLS if it is not empty
+	addServer := func(s server, secret, service string, servicePort int) error {
+		if secret != "" {
+			cert, err := core.GetTLSCertificate(lb, p.storeLister.Secret, secret)
+			if err != nil {
+				return err
+			}
+			s.TLS, err = p.config.writeCertificate(cert)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, core.ServingCertificate{Port: s.Port, Host: s.Host, Secret: secret, Fingerprint: cert.Fingerprint, NotAfter: cert.NotAfter})
+		}
+
+		eps, err := p.storeLister.ServiceEndpoints(lb.Namespace, service, servicePort)
+		if err != nil {
+			return err
+		}
+		// the upstream of a Service without ready endpoints is kept, its
+		// requests fail until the endpoints are pushed
+		s.Upstream = upstreamName(lb.Namespace, service, servicePort)
+		if !seen[s.Upstream] {
+			seen[s.Upstream] = true
+			u := upstream{Name: s.Upstream, Servers: make([]upstreamServer, 0, len(eps)), Persistence: pers}
+			for _, ep := range eps {
+				u.Servers = append(u.Servers, upstreamServer{Host: ep.IP.String(), Port: ep.Port})
+			}
+			upstreams = append(upstreams, u)
+		}
+		servers = append(servers, s)
+		return nil
+	}
+
+	for _, port := range ports {
+		// the server of the port is the first one of the port, which nginx
+		// picks for the hosts not matched
+		if err := addServer(server{Port: port.Port}, port.TLSSecret, port.Service, port.ServicePort); err != nil {
+			return nil, err
+		}
+		for _, h := range port.Hosts {
+			if err := addServer(server{Port: port.Port, Host: h.Host}, h.TLSSecret, h.Service, h.ServicePort); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &model{Servers: servers, Upstreams: upstreams, Certificates: certs}, nil
+}
+
+// setProxyProtocols sets the servers accepting the PROXY protocol. It
+// returns a PermanentError if a port is not served or sends the header,
+// which nginx can not send to the upstreams of http.
+func setProxyProtocols(servers []server, pps []core.ProxyProtocol) error {
+	for _, pp := range pps {
+		if pp.Send != "" {
+			return core.NewPermanentError("UnsupportedProxyProtocol", fmt.Errorf("nginx can not send the proxy protocol of port %d to the http upstreams, the client address is in X-Forwarded-For", pp.Port))
+		}
+		found := false
+		for i := range servers {
+			if servers[i].Port == pp.Port {
+				servers[i].AcceptProxy, found = pp.Accept, true
+			}
+		}
+		if !found {
+			return core.NewPermanentError("InvalidProxyProtocol", fmt.Errorf("proxy protocol of port %d which is not served", pp.Port))
+		}
+	}
+	return nil
+}
+
+// setBackendProtocols sets the servers re-encrypting the requests to their
+// upstreams, the CAs verifying the upstreams are written to the files the
+// servers reference. It returns a PermanentError if a port passes the
+// connections through as TCP, which nginx can not for the HTTP ports.
+func (p *NginxProvider) setBackendProtocols(lb *netv1alpha1.LoadBalancer, servers []server) error {
+	bps, err := core.GetBackendProtocols(lb)
+	if err != nil {
+		return err
+	}
+	for _, bp := range bps {
+		if bp.Protocol == core.BackendProtocolTCP {
+			return core.NewPermanentError("UnsupportedBackendProtocol", fmt.Errorf("nginx can not pass the connections of port %d through as TCP, it proxies HTTP only", bp.Port))
+		}
+		if bp.Protocol != core.BackendProtocolHTTPS {
+			continue
+		}
+		tls := &backendTLS{}
+		if bp.CASecret != "" {
+			ca, err := core.GetBackendCA(lb, p.storeLister.Secret, bp.CASecret)
+			if err != nil {
+				return err
+			}
+			if tls.CA, err = p.config.writeCA(ca); err != nil {
+				return err
+			}
+		}
+		for i := range servers {
+			if servers[i].Port == bp.Port {
+				servers[i].BackendTLS = tls
+			}
+		}
+	}
+	return nil
+}
+
+// setRateLimits sets the limits of all servers together and the ones of
+// each server. It returns a PermanentError if a port is not served.
+func setRateLimits(m *model, rl *core.RateLimit) error {
+	if rl == nil {
+		return nil
+	}
+	m.Limits = getLimits(rl.Limits)
+	for _, pl := range rl.Ports {
+		found := false
+		for i := range m.Servers {
+			if pl.Protocol == "tcp" && m.Servers[i].Port == pl.Port {
+				m.Servers[i].Limits, found = getLimits(pl.Limits), true
+			}
+		}
+		if !found {
+			return core.NewPermanentError("InvalidRateLimit", fmt.Errorf("rate limit of port %v which is not served", pl.CorePort()))
+		}
+	}
+	return nil
+}
+
+// setSSLRedirect sets the servers of the http ports redirected to https
+func setSSLRedirect(servers []server, r *core.SSLRedirect) {
+	for i := range servers {
+		if !r.Redirects(servers[i].Port) {
+			continue
+		}
+		servers[i].Redirect = &redirect{Port: r.HTTPSPort, ExemptACME: r.ExemptACME}
+		if r.HTTPSPort == 443 {
+			servers[i].Redirect.Port = 0
+		}
+	}
+}
+
+// getLimits returns the limits nginx enforces, nil if none
+func getLimits(l core.Limits) *limits {
+	if l.MaxConnections == 0 && l.RequestRate == 0 {
+		return nil
+	}
+	return &limits{MaxConnections: l.MaxConnections, RequestRate: l.RequestRate}
+}
+
+// getUpstreamPersistence returns the persistence of the upstreams, nil if
+// the persistence of the LoadBalancer is not enabled
+func getUpstreamPersistence(p *core.Persistence) *persistence {
+	if p == nil || !p.Enabled {
+		return nil
+	}
+	ret := &persistence{Timeout: p.Timeout}
+	if p.Mask != nil {
+		ret.Netmask, _ = p.Mask.Size()
+	}
+	return ret
+}
+
+// getAccessLog returns the access log of the servers, nil if it is
+// disabled. The requests are logged to stdout if the LoadBalancer does not
+// specify it.
+func getAccessLog(l *core.AccessLog) *accessLog {
+	if l == nil {
+		return defaultAccessLog
+	}
+	if !l.Enabled {
+		return nil
+	}
+	ret := &accessLog{Target: "/dev/stdout", Format: string(l.Format)}
+	if l.Syslog != "" {
+		ret.Target = fmt.Sprintf("syslog:server=%s,tag=nginx", l.Syslog)
+	}
+	if l.Sampling > 1 {
+		// split_clients takes two decimals at most
+		percent := strconv.FormatFloat(100/float64(l.Sampling), 'f', 2, 64)
+		ret.Percent = strings.TrimRight(strings.TrimRight(percent, "0"), ".") + "%"
+	}
+	return ret
+}
+
+// upstreamName returns the name of the upstream of a port of a Service
+func upstreamName(namespace, service string, port int) string {
+	return fmt.Sprintf("%s-%s-%d", namespace, service, port)
+}
+
+// Start starts nginx with the configuration in the image, the first update
+// reloads it with the servers of the LoadBalancer. By the blue-green reload
+// strategy it starts with the version serving before instead, and the
+// handoff interrupted by a restart converges first.
+func (p *NginxProvider) Start() {
+	log.Info("Startting nginx provider")
+	if p.ReloadStrategy == ReloadStrategyBlueGreen {
+		p.recoverHandoff()
+	}
+	go p.run()
+}
+
+// WaitForStart waits for nginx fully run
+func (p *NginxProvider) WaitForStart() bool {
+	err := wait.Poll(time.Second, 60*time.Second, func() (bool, error) {
+		return p.running(), nil
+	})
+
+	if err != nil {
+		return false
+	}
+	return true
+}
+
+// Stop shuts down nginx gracefully
+func (p *NginxProvider) Stop() error {
+	log.Info("Shutting down nginx provider")
+	p.stopProcess()
+	return nil
+}
+
+// Info ...
+func (p *NginxProvider) Info() core.Info {
+	return core.Info{
+		Name:       "nginx",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+		Capabilities: &core.Capabilities{
+			Features: []core.Feature{core.FeatureHTTP, core.FeatureProxyProtocol, core.FeaturePersistence, core.FeatureAccessLog, core.FeatureSourceRanges, core.FeatureBackendProtocol, core.FeatureMaxConnections, core.FeatureRequestRate, core.FeatureHTTPHosts, core.FeatureSSLRedirect},
+		},
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *NginxProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,641 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// fakeRunner records the nginx commands, the validation of a configuration
+// containing reject fails
+type fakeRunner struct {
+	reject string
+	calls  []string
+}
+
+func (f *fakeRunner) Run(args ...string) ([]byte, error) {
+	f.calls = append(f.calls, strings.Join(args, " "))
+	if args[0] == "-t" && f.reject != "" {
+		data, _ := ioutil.ReadFile(args[len(args)-1])
+		if strings.Contains(string(data), f.reject) {
+			return nil, fmt.Errorf("nginx: [emerg] invalid configuration")
+		}
+	}
+	return nil, nil
+}
+
+// fakeProcess is a nginx master which exits on SIGQUIT, or on SIGTERM only
+// if it drains connections
+type fakeProcess struct {
+	pid     int
+	drains  bool
+	mu      sync.Mutex
+	signals []os.Signal
+	exit    chan struct{}
+	exited  bool
+}
+
+func (p *fakeProcess) Pid() int {
+	return p.pid
+}
+
+func (p *fakeProcess) Signal(sig os.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.signals = append(p.signals, sig)
+	if (sig == syscall.SIGTERM || (sig == syscall.SIGQUIT && !p.drains)) && !p.exited {
+		p.exited = true
+		close(p.exit)
+	}
+	return nil
+}
+
+func (p *fakeProcess) Signals() []os.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]os.Signal(nil), p.signals...)
+}
+
+func (p *fakeProcess) Wait() error {
+	<-p.exit
+	return nil
+}
+
+type testStore struct {
+	secrets    cache.Indexer
+	services   cache.Indexer
+	endpoints  cache.Indexer
+	configMaps cache.Indexer
+}
+
+func newTestStore() *testStore {
+	newIndexer := func() cache.Indexer {
+		return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	}
+	return &testStore{secrets: newIndexer(), services: newIndexer(), endpoints: newIndexer(), configMaps: newIndexer()}
+}
+
+func (s *testStore) lister() core.StoreLister {
+	return core.StoreLister{
+		Secret:    v1listers.NewSecretLister(s.secrets),
+		Service:   v1listers.NewServiceLister(s.services),
+		Endpoints: v1listers.NewEndpointsLister(s.endpoints),
+		ConfigMap: v1listers.NewConfigMapLister(s.configMaps),
+	}
+}
+
+// addService adds a Service with the port 80 served by the addresses on
+// port 8080
+func (s *testStore) addService(name string, ips ...string) {
+	meta := metav1.ObjectMeta{Namespace: "default", Name: name}
+	s.services.Add(&v1.Service{ObjectMeta: meta, Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Port: 80}}}})
+	addrs := make([]v1.EndpointAddress, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, v1.EndpointAddress{IP: ip})
+	}
+	s.endpoints.Add(&v1.Endpoints{ObjectMeta: meta, Subsets: []v1.EndpointSubset{
+		{Addresses: addrs, Ports: []v1.EndpointPort{{Port: 8080}}},
+	}})
+}
+
+func (s *testStore) addTLSSecret(t *testing.T, name string) {
+	cert, err := ioutil.ReadFile("testdata/tls.crt")
+	assert.Nil(t, err)
+	key, err := ioutil.ReadFile("testdata/tls.key")
+	assert.Nil(t, err)
+	s.secrets.Add(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+	})
+}
+
+// addCASecret adds a Secret with the test certificate as the CA of the
+// backends
+func (s *testStore) addCASecret(t *testing.T, name string) {
+	ca, err := ioutil.ReadFile("testdata/tls.crt")
+	assert.Nil(t, err)
+	s.secrets.Add(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string][]byte{core.BackendCAKey: ca},
+	})
+}
+
+func newTestProvider(t *testing.T, dir string, runner Runner) *NginxProvider {
+	tmpl, err := template.ParseFiles("../nginx.tmpl")
+	assert.Nil(t, err)
+	c := newConfig(runner)
+	c.tmpl = tmpl
+	c.cfgPath = filepath.Join(dir, "nginx.conf")
+	c.certDir = filepath.Join(dir, "certs")
+	c.upstreamsFile = filepath.Join(dir, "upstreams.json")
+	return &NginxProvider{
+		config: c,
+		runner: runner,
+		newProcess: func(string) (process, error) {
+			return &fakeProcess{exit: make(chan struct{})}, nil
+		},
+		checksum: core.NewChecksum("nginx"),
+		backoff:  flowcontrol.NewBackOff(nginxInitialBackoff, nginxMaxBackoff),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func newTestLoadBalancer(httpPorts string) *netv1alpha1.LoadBalancer {
+	return &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "lb",
+			Annotations: map[string]string{core.AnnotationKeyHTTPPorts: httpPorts},
+		},
+	}
+}
+
+func TestRenderConfig(t *testing.T) {
+	type testCase struct {
+		name          string
+		httpPorts     string
+		proxyProtocol string
+		accessLog     string
+		sourceRanges  string
+		// backendProtocols are the annotations by port
+		backendProtocols map[string]string
+		rateLimit        string
+		sslRedirect      string
+		// exemptACME exempts the ACME challenges from the ssl redirect
+		exemptACME bool
+	}
+	cases := []testCase{
+		{
+			name:      "http",
+			httpPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+		},
+		{
+			name:      "https",
+			httpPorts: `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`,
+		},
+		{
+			name: "multi-port",
+			httpPorts: `[
+				{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+				{"port":80,"service":"web","servicePort":80},
+				{"port":8080,"service":"api","servicePort":80},
+				{"port":8081,"service":"idle","servicePort":80}
+			]`,
+		},
+		{
+			name:          "proxy-protocol",
+			httpPorts:     `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			proxyProtocol: `[{"port":443,"accept":true}]`,
+		},
+		{
+			name:          "source-ranges",
+			httpPorts:     `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			proxyProtocol: `[{"port":443,"accept":true}]`,
+			sourceRanges:  "10.1.0.0/16, 192.168.1.1/32, 2001:db8::/32",
+		},
+		{
+			name:             "backend-https",
+			httpPorts:        `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			backendProtocols: map[string]string{"443": "HTTPS"},
+		},
+		{
+			name:             "backend-https-verify",
+			httpPorts:        `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			backendProtocols: map[string]string{"443": "HTTPS", "80": "HTTPS"},
+		},
+		{
+			name:      "rate-limit",
+			httpPorts: `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			rateLimit: `{"maxConnections":10000,"requestRate":500,"ports":[{"port":80,"maxConnections":1000,"requestRate":50}]}`,
+		},
+		{
+			name:      "rate-limit-port",
+			httpPorts: `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			rateLimit: `{"ports":[{"port":443,"requestRate":50}]}`,
+		},
+		{
+			name: "hosts",
+			httpPorts: `[
+				{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80,"hosts":[
+					{"host":"www.example.com","service":"web","servicePort":80},
+					{"host":"api.example.com","tlsSecret":"api-cert","service":"api","servicePort":80}
+				]},
+				{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]}
+			]`,
+			rateLimit: `{"ports":[{"port":443,"maxConnections":1000}]}`,
+		},
+		{
+			name:        "ssl-redirect",
+			httpPorts:   `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			sslRedirect: "true",
+		},
+		{
+			name:        "ssl-redirect-disabled",
+			httpPorts:   `[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},{"port":80,"service":"web","servicePort":80}]`,
+			sslRedirect: "false",
+		},
+		{
+			name: "ssl-redirect-acme",
+			httpPorts: `[
+				{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80},
+				{"port":80,"service":"web","servicePort":80,"hosts":[{"host":"api.example.com","service":"api","servicePort":80}]},
+				{"port":8080,"service":"api","servicePort":80}
+			]`,
+			sslRedirect: "80",
+			exemptACME:  true,
+		},
+		{
+			name:      "access-log-off",
+			httpPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+			accessLog: `{"enabled":false}`,
+		},
+	}
+	for _, format := range []string{"combined", "json"} {
+		for _, syslog := range []string{"", "10.0.0.10"} {
+			for _, sampling := range []int{0, 3} {
+				c := testCase{
+					name:      "access-log-" + format,
+					httpPorts: `[{"port":80,"service":"web","servicePort":80}]`,
+					accessLog: fmt.Sprintf(`{"enabled":true,"format":%q,"syslog":%q,"sampling":%d}`, format, syslog, sampling),
+				}
+				if syslog != "" {
+					c.name += "-syslog"
+				}
+				if sampling != 0 {
+					c.name += "-sampled"
+				}
+				cases = append(cases, c)
+			}
+		}
+	}
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.3", "10.0.1.2")
+	store.addService("api", "10.0.2.2")
+	store.addService("idle")
+	store.addTLSSecret(t, "cert")
+	store.addTLSSecret(t, "api-cert")
+	store.addCASecret(t, "backend-ca")
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "nginx")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		p := newTestProvider(t, dir, &fakeRunner{})
+		p.SetListers(store.lister())
+		lb := newTestLoadBalancer(c.httpPorts)
+		if c.proxyProtocol != "" {
+			lb.Annotations[core.AnnotationKeyProxyProtocol] = c.proxyProtocol
+		}
+		if c.accessLog != "" {
+			lb.Annotations[core.AnnotationKeyAccessLog] = c.accessLog
+		}
+		if c.sourceRanges != "" {
+			lb.Annotations[core.AnnotationKeySourceRanges] = c.sourceRanges
+		}
+		if c.rateLimit != "" {
+			lb.Annotations[core.AnnotationKeyRateLimit] = c.rateLimit
+		}
+		if c.sslRedirect != "" {
+			lb.Annotations[core.AnnotationKeySSLRedirect] = c.sslRedirect
+		}
+		if c.exemptACME {
+			lb.Annotations[core.AnnotationKeySSLRedirectExemptACME] = "true"
+		}
+		for port, protocol := range c.backendProtocols {
+			lb.Annotations[core.AnnotationKeyBackendProtocolPrefix+port] = protocol
+			if strings.HasSuffix(c.name, "-verify") {
+				lb.Annotations[core.AnnotationKeyBackendCASecretPrefix+port] = "backend-ca"
+			}
+		}
+		assert.Nil(t, p.OnUpdate(lb), c.name)
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err, c.name)
+		got := strings.Replace(string(data), dir, "/etc/nginx", -1)
+
+		golden := filepath.Join("testdata", c.name+".golden")
+		if *update {
+			assert.Nil(t, ioutil.WriteFile(golden, []byte(got), 0644), c.name)
+		}
+		want, err := ioutil.ReadFile(golden)
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, string(want), got, c.name)
+	}
+}
+
+func TestOnUpdateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	store.addTLSSecret(t, "cert")
+	runner := &fakeRunner{}
+	p := newTestProvider(t, dir, runner)
+	p.SetListers(store.lister())
+
+	// nginx reads the configuration on start
+	lb := newTestLoadBalancer(`[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 1)
+	assert.True(t, strings.HasPrefix(runner.calls[0], "-t -q -c "+dir))
+
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	assert.Nil(t, p.Healthz())
+
+	// unchanged
+	runner.calls = nil
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+
+	// the port changed
+	lb = newTestLoadBalancer(`[{"port":8443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+
+	// the access log is rendered
+	runner.calls = nil
+	lb.Annotations[core.AnnotationKeyAccessLog] = `{"enabled":true,"format":"json"}`
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+	// an invalid destination is not retried
+	lb.Annotations[core.AnnotationKeyAccessLog] = `{"enabled":true,"syslog":"tcp://10.0.0.10:514"}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+	delete(lb.Annotations, core.AnnotationKeyAccessLog)
+
+	// the rate limit is added, changed and removed
+	for _, rateLimit := range []string{`{"requestRate":100}`, `{"requestRate":200,"ports":[{"port":8443,"maxConnections":10}]}`, ""} {
+		runner.calls = nil
+		lb.Annotations[core.AnnotationKeyRateLimit] = rateLimit
+		if rateLimit == "" {
+			delete(lb.Annotations, core.AnnotationKeyRateLimit)
+		}
+		assert.Nil(t, p.OnUpdate(lb), rateLimit)
+		assert.Len(t, runner.calls, 2, rateLimit)
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		assert.Equal(t, rateLimit != "", strings.Contains(string(data), "limit_req zone=loadbalancer_req"), rateLimit)
+		assert.Equal(t, strings.Contains(rateLimit, "8443"), strings.Contains(string(data), "limit_conn port_8443_conn 10;"), rateLimit)
+		assert.Equal(t, rateLimit != "", strings.Contains(string(data), "geo $loadbalancer"), rateLimit)
+	}
+
+	// the source ranges are added, shrunk and removed
+	for _, ranges := range []string{"10.1.0.0/16,192.168.1.1/32", "10.1.0.0/16", ""} {
+		runner.calls = nil
+		lb.Annotations[core.AnnotationKeySourceRanges] = ranges
+		assert.Nil(t, p.OnUpdate(lb), ranges)
+		assert.Len(t, runner.calls, 2, ranges)
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		assert.Equal(t, ranges != "", strings.Contains(string(data), "deny all;"), ranges)
+		assert.Equal(t, strings.Contains(ranges, "192.168.1.1/32"), strings.Contains(string(data), "allow 192.168.1.1/32;"), ranges)
+	}
+	lb.Annotations[core.AnnotationKeySourceRanges] = "10.1.0.0"
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+
+	// the certificate of the removed https port is removed
+	certs, _ := ioutil.ReadDir(p.config.certDir)
+	assert.Len(t, certs, 2)
+	assert.Nil(t, p.OnUpdate(newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)))
+	certs, _ = ioutil.ReadDir(p.config.certDir)
+	assert.Empty(t, certs)
+
+	assert.Nil(t, p.Stop())
+	assert.NotNil(t, p.Healthz())
+}
+
+func TestOnUpdateChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	runner := &fakeRunner{}
+	p := newTestProvider(t, dir, runner)
+	p.SetListers(store.lister())
+
+	lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+
+	// the model applied last is neither written nor applied again
+	runner.calls = nil
+	assert.Nil(t, os.Remove(p.config.cfgPath))
+	assert.Nil(t, os.Remove(p.config.upstreamsFile))
+	lb.Spec.Nodes.Names = []string{"node1"}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+	for _, path := range []string{p.config.cfgPath, p.config.upstreamsFile} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+
+	// a forced resync writes the configuration and reloads nginx once
+	lb.Annotations[core.AnnotationKeyForceResync] = "1"
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+	for _, path := range []string{p.config.cfgPath, p.config.upstreamsFile} {
+		_, err = os.Stat(path)
+		assert.Nil(t, err, path)
+	}
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+
+	assert.Nil(t, p.Stop())
+}
+
+func TestOnUpdateRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	store.addService("api", "10.0.2.2")
+	runner := &fakeRunner{reject: "default-api-80"}
+	p := newTestProvider(t, dir, runner)
+	p.SetListers(store.lister())
+
+	assert.Nil(t, p.OnUpdate(newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)))
+	old, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+
+	// the rejected configuration fails the sync and is retried, the
+	// previous one is untouched
+	err = p.OnUpdate(newTestLoadBalancer(`[{"port":80,"service":"api","servicePort":80}]`))
+	assert.NotNil(t, err)
+	assert.False(t, core.IsPermanentError(err))
+	data, err := ioutil.ReadFile(p.config.cfgPath)
+	assert.Nil(t, err)
+	assert.Equal(t, string(old), string(data))
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), "."), "the temporary file is removed")
+	}
+
+	// a missing service is not retried
+	err = p.OnUpdate(newTestLoadBalancer(`[{"port":80,"service":"missing","servicePort":80}]`))
+	assert.True(t, core.IsPermanentError(err))
+
+	// the proxy protocol is not sent to the http upstreams, nor accepted
+	// on a port which is not served
+	for _, value := range []string{`[{"port":80,"send":"v1"}]`, `[{"port":443,"accept":true}]`} {
+		lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)
+		lb.Annotations[core.AnnotationKeyProxyProtocol] = value
+		assert.True(t, core.IsPermanentError(p.OnUpdate(lb)), value)
+	}
+
+	// the connections are not passed through as TCP, and the backends are
+	// not verified by a missing CA
+	for key, value := range map[string]string{
+		core.AnnotationKeyBackendProtocolPrefix + "80": "TCP",
+		core.AnnotationKeyBackendCASecretPrefix + "80": "missing",
+	} {
+		lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)
+		lb.Annotations[core.AnnotationKeyBackendProtocolPrefix+"80"] = "HTTPS"
+		lb.Annotations[key] = value
+		assert.True(t, core.IsPermanentError(p.OnUpdate(lb)), key)
+	}
+
+	// the limits of a port which is not served
+	lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)
+	lb.Annotations[core.AnnotationKeyRateLimit] = `{"ports":[{"port":443,"requestRate":10}]}`
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+// newTestCertificate returns a PEM encoded self-signed certificate and key
+// expiring at the time
+func newTestCertificate(t *testing.T, notAfter time.Time) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    notAfter.Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	setSecret := func(cert, key []byte) {
+		store.secrets.Update(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "cert"},
+			Data:       map[string][]byte{v1.TLSCertKey: cert, v1.TLSPrivateKeyKey: key},
+		})
+	}
+	notAfter := time.Now().Add(time.Hour)
+	cert, key := newTestCertificate(t, notAfter)
+	setSecret(cert, key)
+	runner := &fakeRunner{}
+	p := newTestProvider(t, dir, runner)
+	p.SetListers(store.lister())
+	lb := newTestLoadBalancer(`[{"port":443,"protocol":"https","tlsSecret":"cert","service":"web","servicePort":80}]`)
+	assert.Nil(t, p.OnUpdate(lb))
+	p.Start()
+	assert.True(t, p.WaitForStart())
+	defer p.Stop()
+
+	served := p.ServingCertificates()
+	assert.Len(t, served, 1)
+	assert.Equal(t, 443, served[0].Port)
+	assert.Equal(t, "cert", served[0].Secret)
+	assert.True(t, served[0].NotAfter.Equal(notAfter.Truncate(time.Second)))
+
+	// the Secret is updated with the same certificate
+	runner.calls = nil
+	setSecret(append([]byte{}, cert...), append([]byte{}, key...))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+	assert.Equal(t, served, p.ServingCertificates())
+
+	// the rotated certificate reloads nginx, the previous files are removed
+	// once the configuration no longer references them
+	runner.calls = nil
+	rotated, rotatedKey := newTestCertificate(t, notAfter.Add(time.Hour))
+	setSecret(rotated, rotatedKey)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, runner.calls, 2)
+	assert.Equal(t, "-s reload -c "+p.config.cfgPath, runner.calls[1])
+	assert.NotEqual(t, served[0].Fingerprint, p.ServingCertificates()[0].Fingerprint)
+	certs, _ := ioutil.ReadDir(p.config.certDir)
+	assert.Len(t, certs, 2)
+	served = p.ServingCertificates()
+
+	// an invalid certificate is rejected, the previous one keeps serving
+	expired, expiredKey := newTestCertificate(t, time.Now().Add(-time.Minute))
+	for reason, pair := range map[string][2][]byte{
+		"InvalidTLSSecret": {cert, rotatedKey},
+		"ExpiredTLSSecret": {expired, expiredKey},
+	} {
+		runner.calls = nil
+		setSecret(pair[0], pair[1])
+		err := p.OnUpdate(lb)
+		assert.True(t, core.IsPermanentError(err), reason)
+		assert.Equal(t, reason, err.(*core.PermanentError).Reason)
+		assert.Empty(t, runner.calls, reason)
+		assert.Equal(t, served, p.ServingCertificates(), reason)
+	}
+}
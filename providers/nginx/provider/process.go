@@ -0,0 +1,219 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/zoumo/logdog"
+
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	nginxBackoffID      = "nginx"
+	nginxInitialBackoff = time.Second
+	nginxMaxBackoff     = time.Minute
+)
+
+// Runner runs the nginx(8) commands controlling the running nginx
+type Runner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+type execRunner struct {
+	exec k8sexec.Interface
+}
+
+// NewRunner returns a Runner executing nginx(8)
+func NewRunner() Runner {
+	return &execRunner{exec: k8sexec.New()}
+}
+
+func (r *execRunner) Run(args ...string) ([]byte, error) {
+	out, err := r.exec.Command("nginx", args...).CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("nginx %s error: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out, nil
+}
+
+// process is the running nginx master, it is stopped by signals
+type process interface {
+	Pid() int
+	Signal(os.Signal) error
+	// Wait waits for the process to exit, it may be called concurrently
+	Wait() error
+}
+
+// cmdProcess is a process started by exec
+type cmdProcess struct {
+	cmd  *exec.Cmd
+	once sync.Once
+	err  error
+}
+
+func (p *cmdProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *cmdProcess) Signal(sig os.Signal) error {
+	return p.cmd.Process.Signal(sig)
+}
+
+func (p *cmdProcess) Wait() error {
+	// the callers after the first one block until it returns
+	p.once.Do(func() { p.err = p.cmd.Wait() })
+	return p.err
+}
+
+// startNginx starts nginx with the configuration, which keeps it in
+// foreground
+func startNginx(cfgPath string) (process, error) {
+	cmd := exec.Command("nginx", "-c", cfgPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdProcess{cmd: cmd}, nil
+}
+
+// run supervises nginx until it is stopped, it is started again after an
+// exponential backoff if it exits. It reads the last written configuration
+// on start. The master a handoff replaces the running one with is
+// supervised instead once the running one exits.
+func (p *NginxProvider) run() {
+	var proc process
+	for {
+		var err error
+		if proc == nil {
+			proc, err = p.newProcess(p.activeConfig())
+		}
+		if err == nil {
+			p.mu.Lock()
+			p.proc, p.started, p.exitErr = proc, true, nil
+			stopping := p.stopping
+			p.mu.Unlock()
+			if p.ReloadStrategy == ReloadStrategyBlueGreen {
+				p.blueGreen.setActivePid(proc.Pid())
+			}
+			if stopping {
+				proc.Signal(syscall.SIGQUIT)
+			}
+			err = proc.Wait()
+		}
+
+		p.mu.Lock()
+		stopping := p.stopping
+		if next := p.proc; next != nil && next != proc && !stopping {
+			// handed off, the retired master is drained elsewhere
+			p.mu.Unlock()
+			proc = next
+			continue
+		}
+		proc = nil
+		p.proc = nil
+		if !stopping {
+			if err == nil {
+				err = fmt.Errorf("nginx exited")
+			}
+			p.exitErr = err
+		}
+		p.mu.Unlock()
+
+		if stopping {
+			log.Info("nginx stopped")
+			return
+		}
+
+		p.backoff.Next(nginxBackoffID, p.backoff.Clock.Now())
+		delay := p.backoff.Get(nginxBackoffID)
+		log.Error("nginx exited unexpectedly, starting it again", log.Fields{"err": err, "backoff": delay})
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Healthz implements core.HealthzProvider, it returns an error if nginx is
+// not running
+func (p *NginxProvider) Healthz() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.stopping:
+		return fmt.Errorf("nginx is stopped")
+	case p.exitErr != nil:
+		return fmt.Errorf("nginx is not running: %v", p.exitErr)
+	case !p.started:
+		return fmt.Errorf("nginx is not started")
+	}
+	return nil
+}
+
+// running returns true if the nginx process is started
+func (p *NginxProvider) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.proc != nil
+}
+
+// reload makes nginx read the configuration, the workers of the previous
+// one finish their requests before they exit. nginx reads the
+// configuration on start, so it is not reloaded before it is started.
+func (p *NginxProvider) reload() error {
+	if p.ReloadStrategy == ReloadStrategyBlueGreen {
+		return p.handOff()
+	}
+	if !p.running() {
+		log.Info("nginx is not started, skip reloading")
+		return nil
+	}
+	log.Info("reloading nginx")
+	if _, err := p.runner.Run("-s", "reload", "-c", p.config.cfgPath); err != nil {
+		return fmt.Errorf("error reloading nginx: %v", err)
+	}
+	return nil
+}
+
+// stopProcess shuts down nginx gracefully and stops its supervision
+func (p *NginxProvider) stopProcess() {
+	p.mu.Lock()
+	proc := p.proc
+	if !p.stopping {
+		p.stopping = true
+		close(p.stopCh)
+	}
+	p.mu.Unlock()
+	if proc == nil {
+		return
+	}
+	log.Info("quit nginx process")
+	if err := proc.Signal(syscall.SIGQUIT); err != nil {
+		log.Errorf("error stopping nginx: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"text/template"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	log "github.com/zoumo/logdog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// TemplateConfigMapKey is the key of the template in the ConfigMap
+// overriding the default template
+const TemplateConfigMapKey = "nginx.tmpl"
+
+// templateOverride is a template parsed from a ConfigMap
+type templateOverride struct {
+	tmpl *template.Template
+	hash string
+}
+
+// templates tracks the overrides of the default template. An override
+// which is missing, does not parse or renders a configuration nginx
+// rejects is reported once, and the last one applied keeps serving.
+type templates struct {
+	// applied is the override the configuration was rendered from last,
+	// nil for the default template
+	applied *templateOverride
+	// rejected is the hash of the override rejected last, it is not tried
+	// again until it changes
+	rejected string
+	// reported is the error reported last
+	reported string
+
+	mu      sync.Mutex
+	onEvent func(eventtype, reason, message string)
+}
+
+func (t *templates) setEventHandler(handler func(eventtype, reason, message string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onEvent = handler
+}
+
+// report logs the error of the override and records an event, the same
+// error is reported once
+func (t *templates) report(err error) {
+	if err.Error() == t.reported {
+		return
+	}
+	t.reported = err.Error()
+	log.Warn("nginx template error, keep the last one", log.Fields{"err": err})
+	t.mu.Lock()
+	handler := t.onEvent
+	t.mu.Unlock()
+	if handler != nil {
+		handler(v1.EventTypeWarning, "InvalidNginxTemplate", fmt.Sprintf("%v, the last template applied keeps serving", err))
+	}
+}
+
+// last returns the override applied last, nil for the default template
+func (t *templates) last() (*template.Template, string) {
+	if t.applied == nil {
+		return nil, ""
+	}
+	return t.applied.tmpl, t.applied.hash
+}
+
+// reject reports the error of the override and does not try it again
+func (t *templates) reject(hash string, err error) {
+	t.rejected = hash
+	t.report(err)
+}
+
+// getTemplate returns the template the configuration is rendered from and
+// its hash, the override in the TemplateConfigMap if it is set. The last
+// template applied is returned instead of the overrides which are missing,
+// do not parse or were rejected.
+func (p *NginxProvider) getTemplate(lb *netv1alpha1.LoadBalancer) (*template.Template, string) {
+	if p.TemplateConfigMap == "" {
+		return nil, ""
+	}
+	if p.storeLister.ConfigMap == nil {
+		p.templates.report(fmt.Errorf("no configmap lister to get the nginx template %s/%s", lb.Namespace, p.TemplateConfigMap))
+		return p.templates.last()
+	}
+	cm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(p.TemplateConfigMap)
+	if errors.IsNotFound(err) {
+		p.templates.report(fmt.Errorf("nginx template configmap %s/%s not found", lb.Namespace, p.TemplateConfigMap))
+		return p.templates.last()
+	}
+	if err != nil {
+		log.Error("get nginx template configmap error", log.Fields{"err": err})
+		return p.templates.last()
+	}
+	source, ok := cm.Data[TemplateConfigMapKey]
+	if !ok {
+		p.templates.report(fmt.Errorf("no %s in nginx template configmap %s/%s", TemplateConfigMapKey, lb.Namespace, p.TemplateConfigMap))
+		return p.templates.last()
+	}
+
+	sum := sha256.Sum256([]byte(source))
+	hash := hex.EncodeToString(sum[:])[:16]
+	if tmpl, last := p.templates.last(); hash == last {
+		p.templates.reported = ""
+		return tmpl, last
+	}
+	if hash == p.templates.rejected {
+		return p.templates.last()
+	}
+	tmpl, err := template.New(TemplateConfigMapKey).Parse(source)
+	if err != nil {
+		p.templates.reject(hash, fmt.Errorf("parse nginx template in configmap %s/%s error: %v", lb.Namespace, p.TemplateConfigMap, err))
+		return p.templates.last()
+	}
+	p.templates.reported = ""
+	return tmpl, hash
+}
+
+// SetEventHandler implements core.EventProvider, the errors of the
+// overrides of the template are the events
+func (p *NginxProvider) SetEventHandler(handler func(eventtype, reason, message string)) {
+	p.templates.setEventHandler(handler)
+}
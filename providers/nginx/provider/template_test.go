@@ -0,0 +1,118 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// setTemplate sets the template in the ConfigMap overriding the default one
+func (s *testStore) setTemplate(name, source string) {
+	s.configMaps.Update(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Data:       map[string]string{TemplateConfigMapKey: source},
+	})
+}
+
+func TestTemplateOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	data, err := ioutil.ReadFile("../nginx.tmpl")
+	assert.Nil(t, err)
+	// the overrides add a directive to the default template
+	override := func(directive string) string {
+		return strings.Replace(string(data), "    server_tokens off;", "    server_tokens off;\n    "+directive, 1)
+	}
+
+	store := newTestStore()
+	store.addService("web", "10.0.1.2")
+	runner := &fakeRunner{reject: "rejected_directive"}
+	p := newTestProvider(t, dir, runner)
+	p.TemplateConfigMap = "nginx-template"
+	p.SetListers(store.lister())
+	events := []string{}
+	p.SetEventHandler(func(eventtype, reason, message string) {
+		events = append(events, eventtype+" "+reason)
+	})
+	lb := newTestLoadBalancer(`[{"port":80,"service":"web","servicePort":80}]`)
+	read := func() string {
+		data, err := ioutil.ReadFile(p.config.cfgPath)
+		assert.Nil(t, err)
+		return string(data)
+	}
+
+	// the default template serves until the ConfigMap is created
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.NotContains(t, read(), "large_client_header_buffers")
+	assert.Equal(t, []string{"Warning InvalidNginxTemplate"}, events)
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, events, 1)
+
+	// the override is rendered
+	store.setTemplate("nginx-template", override("large_client_header_buffers 4 10k;"))
+	runner.calls = nil
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Contains(t, read(), "large_client_header_buffers 4 10k;")
+	assert.Len(t, runner.calls, 1)
+	// unchanged
+	runner.calls = nil
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, runner.calls)
+
+	// the hot update of the template is applied
+	store.setTemplate("nginx-template", override("large_client_header_buffers 4 20k;"))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Contains(t, read(), "large_client_header_buffers 4 20k;")
+
+	// a template which does not parse is reported once, the last one keeps
+	// serving and the other changes are applied with it
+	events = nil
+	store.setTemplate("nginx-template", override("{{ .missing"))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Nil(t, p.OnUpdate(newTestLoadBalancer(`[{"port":8080,"service":"web","servicePort":80}]`)))
+	assert.Contains(t, read(), "large_client_header_buffers 4 20k;")
+	assert.Contains(t, read(), "listen 8080")
+	assert.Equal(t, []string{"Warning InvalidNginxTemplate"}, events)
+
+	// so is a template which fails to render or which nginx rejects
+	for _, source := range []string{override("{{ .namespace.missing }}"), override("rejected_directive on;")} {
+		events = nil
+		store.setTemplate("nginx-template", source)
+		assert.Nil(t, p.OnUpdate(lb))
+		assert.Contains(t, read(), "large_client_header_buffers 4 20k;")
+		assert.Contains(t, read(), "listen 80")
+		assert.Equal(t, []string{"Warning InvalidNginxTemplate"}, events)
+		runner.calls = nil
+		assert.Nil(t, p.OnUpdate(lb))
+		assert.Empty(t, runner.calls)
+	}
+
+	// the fixed template is applied
+	store.setTemplate("nginx-template", override("large_client_header_buffers 4 30k;"))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Contains(t, read(), "large_client_header_buffers 4 30k;")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Change is a change of a field of the LoadBalancer, the values are in
+// json and empty if the field is absent
+type Change struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// diff returns the changes of the fields from the old object to the new
+// one, sorted by field. The objects are compared in their json forms.
+func diff(old, cur interface{}) ([]Change, error) {
+	oldFields, err := flatten(old)
+	if err != nil {
+		return nil, err
+	}
+	curFields, err := flatten(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0)
+	for field, value := range curFields {
+		if oldFields[field] != value {
+			changes = append(changes, Change{Field: field, Old: oldFields[field], New: value})
+		}
+	}
+	for field, value := range oldFields {
+		if _, ok := curFields[field]; !ok {
+			changes = append(changes, Change{Field: field, Old: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes, nil
+}
+
+// flatten returns the leaf fields of the object in json by their paths,
+// e.g. spec.nodes.names[0], the empty objects and arrays are left out
+func flatten(obj interface{}) (map[string]string, error) {
+	fields := make(map[string]string)
+	if obj == nil {
+		return fields, nil
+	}
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	walk("", value, fields)
+	return fields, nil
+}
+
+func walk(path string, value interface{}, fields map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			walk(fieldPath(path, key), child, fields)
+		}
+	case []interface{}:
+		for i, child := range v {
+			walk(path+"["+strconv.Itoa(i)+"]", child, fields)
+		}
+	default:
+		data, _ := json.Marshal(v)
+		fields[path] = string(data)
+	}
+}
+
+// fieldPath returns the path of the key under the path, the keys with dots
+// or brackets, e.g. the annotations, are quoted
+func fieldPath(path, key string) string {
+	if strings.ContainsAny(key, ".[]\"") || key == "" {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
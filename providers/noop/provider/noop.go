@@ -0,0 +1,234 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/noop/version"
+	log "github.com/zoumo/logdog"
+)
+
+var (
+	_ core.Provider         = &NoopProvider{}
+	_ core.FamilyProvider   = &NoopProvider{}
+	_ core.DeletionProvider = &NoopProvider{}
+	_ core.HealthzProvider  = &NoopProvider{}
+)
+
+const (
+	// EventUpdate and EventDelete are the events of the records
+	EventUpdate = "update"
+	EventDelete = "delete"
+
+	// DefaultHistory is the default number of the records kept
+	DefaultHistory = 100
+
+	annotationPrefix = "loadbalancer.caicloud.io/"
+)
+
+// reportedAnnotations are the annotations the controller writes, they
+// are not what a backend acts on
+var reportedAnnotations = map[string]bool{
+	core.AnnotationKeyServedVIPs:            true,
+	core.AnnotationKeyProvisionedAddresses:  true,
+	core.AnnotationKeyProvisionedHostname:   true,
+	core.AnnotationKeyMTUCondition:          true,
+	core.AnnotationKeyReachabilityCondition: true,
+	core.AnnotationKeyMaster:                true,
+}
+
+// Node is a node of the LoadBalancer as resolved for the backends
+type Node struct {
+	IP     string `json:"ip"`
+	Weight int    `json:"weight"`
+}
+
+// View is what a backend sees of the LoadBalancer
+type View struct {
+	Spec netv1alpha1.LoadBalancerSpec `json:"spec"`
+	// Annotations are the loadbalancer.caicloud.io annotations but the
+	// ones the controller reports
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Nodes are the nodes by name, of the family of the first VIP
+	Nodes map[string]Node `json:"nodes,omitempty"`
+}
+
+// Record is an update or a deletion of a LoadBalancer with the changes
+// from the previous update
+type Record struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	View      *View     `json:"view,omitempty"`
+	Changes   []Change  `json:"changes,omitempty"`
+}
+
+// NoopProvider changes nothing but logs what changes between the updates
+// of the LoadBalancer as a backend would see them, so that the controller
+// is debugged or canaried safely. The records are served in json as an
+// http.Handler for the debug endpoint.
+type NoopProvider struct {
+	storeLister core.StoreLister
+	size        int
+	now         func() time.Time
+
+	mu      sync.Mutex
+	views   map[string]*View
+	history []Record
+}
+
+// NewNoopProvider creates a new noop LoadBalancer Provider keeping the
+// latest records up to size, DefaultHistory if it is not positive
+func NewNoopProvider(size int) *NoopProvider {
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	return &NoopProvider{
+		size:  size,
+		now:   time.Now,
+		views: make(map[string]*View),
+	}
+}
+
+// view returns the view of the LoadBalancer
+func (p *NoopProvider) view(lb *netv1alpha1.LoadBalancer) *View {
+	v := &View{Spec: lb.Spec, Annotations: make(map[string]string), Nodes: make(map[string]Node)}
+	for key, value := range lb.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) && !reportedAnnotations[key] {
+			v.Annotations[key] = value
+		}
+	}
+	family := corenet.FamilyIPv4
+	if vips, _ := core.GetVIPs(lb); len(vips) > 0 {
+		family = corenet.FamilyOf(vips[0])
+	}
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, family) {
+		v.Nodes[rs.Node] = Node{IP: rs.IP.String(), Weight: rs.Weight}
+	}
+	return v
+}
+
+// record appends the record to the history, the oldest ones are dropped
+func (p *NoopProvider) record(r Record) {
+	p.history = append(p.history, r)
+	if len(p.history) > p.size {
+		p.history = append([]Record(nil), p.history[len(p.history)-p.size:]...)
+	}
+}
+
+// OnUpdate logs the changes of the LoadBalancer since its previous update
+func (p *NoopProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := lb.Namespace + "/" + lb.Name
+	cur := p.view(lb)
+	var old interface{}
+	if v, ok := p.views[key]; ok {
+		old = v
+	}
+	changes, err := diff(old, cur)
+	if err != nil {
+		return err
+	}
+	p.views[key] = cur
+	p.record(Record{Time: p.now(), Event: EventUpdate, Namespace: lb.Namespace, Name: lb.Name, View: cur, Changes: changes})
+
+	log.Info("LoadBalancer updated", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "changes": len(changes)})
+	for _, c := range changes {
+		log.Info("LoadBalancer field changed", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name, "field": c.Field, "old": c.Old, "new": c.New})
+	}
+	return nil
+}
+
+// OnDelete implements core.DeletionProvider, the deletion is recorded and
+// the LoadBalancer is forgotten
+func (p *NoopProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.views, lb.Namespace+"/"+lb.Name)
+	p.record(Record{Time: p.now(), Event: EventDelete, Namespace: lb.Namespace, Name: lb.Name})
+	log.Info("LoadBalancer deleted", log.Fields{"lb.ns": lb.Namespace, "lb.name": lb.Name})
+	return nil
+}
+
+// History returns the records, the oldest first
+func (p *NoopProvider) History() []Record {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Record(nil), p.history...)
+}
+
+// ServeHTTP implements http.Handler, it writes the history in json for
+// debugging
+func (p *NoopProvider) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.History()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Start ...
+func (p *NoopProvider) Start() {
+	log.Info("Startting noop provider")
+}
+
+// WaitForStart returns immediately, there is nothing to start
+func (p *NoopProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop ...
+func (p *NoopProvider) Stop() error {
+	log.Info("Shutting down noop provider")
+	return nil
+}
+
+// Healthz implements core.HealthzProvider, the provider is always healthy
+func (p *NoopProvider) Healthz() error {
+	return nil
+}
+
+// SupportedFamilies implements core.FamilyProvider, every VIP is accepted
+func (p *NoopProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Info ...
+func (p *NoopProvider) Info() core.Info {
+	return core.Info{
+		Name:       "noop",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *NoopProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "192.168.0.100", Scheduler: "rr"}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func TestDiff(t *testing.T) {
+	changes, err := diff(map[string]interface{}{
+		"a": 1,
+		"b": []string{"x", "y"},
+		"c": map[string]string{"k.io/v": "1"},
+	}, map[string]interface{}{
+		"a": 2,
+		"b": []string{"x"},
+		"c": map[string]string{"k.io/v": "1", "w": "2"},
+		"d": map[string]interface{}{},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Field: "a", Old: "1", New: "2"},
+		{Field: "b[1]", Old: `"y"`},
+		{Field: "c.w", New: `"2"`},
+	}, changes)
+}
+
+func TestOnUpdate(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	nodes.Add(newTestNode("node2", "10.0.0.2", true))
+	p := NewNoopProvider(3)
+	p.now = func() time.Time { return time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC) }
+	p.SetListers(core.StoreLister{Node: v1listers.NewNodeLister(nodes)})
+	assert.True(t, p.WaitForStart())
+	assert.Nil(t, p.Healthz())
+
+	// the first update adds every field
+	lb := newTestLoadBalancer("node1")
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":80}]`
+	lb.Annotations[core.AnnotationKeyServedVIPs] = "192.168.0.100"
+	lb.Annotations["other.io/key"] = "value"
+	assert.Nil(t, p.OnUpdate(lb))
+	changes := p.History()[0].Changes
+	fields := make([]string, 0)
+	for _, c := range changes {
+		assert.Empty(t, c.Old)
+		fields = append(fields, c.Field)
+	}
+	assert.Contains(t, fields, `annotations["loadbalancer.caicloud.io/ports"]`)
+	assert.Contains(t, fields, "spec.providers.ipvsdr.vip")
+	assert.Contains(t, fields, "nodes.node1.ip")
+	assert.NotContains(t, fields, `annotations["loadbalancer.caicloud.io/served-vips"]`)
+	assert.NotContains(t, fields, `annotations["other.io/key"]`)
+
+	// nothing changes, the reported annotations are ignored
+	lb.Annotations[core.AnnotationKeyServedVIPs] = ""
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Empty(t, p.History()[1].Changes)
+
+	// spec, annotation and node changes
+	lb = newTestLoadBalancer("node1", "node2")
+	lb.Spec.Providers.Ipvsdr.Scheduler = "wlc"
+	lb.Annotations[core.AnnotationKeyPorts] = `[{"protocol":"tcp","port":443}]`
+	nodes.Update(newTestNode("node1", "10.0.0.1", false))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Equal(t, []Change{
+		{Field: `annotations["loadbalancer.caicloud.io/ports"]`, Old: `"[{\"protocol\":\"tcp\",\"port\":80}]"`, New: `"[{\"protocol\":\"tcp\",\"port\":443}]"`},
+		{Field: "nodes.node1.weight", Old: "100", New: "0"},
+		{Field: "nodes.node2.ip", New: `"10.0.0.2"`},
+		{Field: "nodes.node2.weight", New: "100"},
+		{Field: "spec.nodes.names[1]", New: `"node2"`},
+		{Field: "spec.providers.ipvsdr.scheduler", Old: `"rr"`, New: `"wlc"`},
+	}, p.History()[2].Changes)
+
+	// the deletion is recorded and the oldest record is dropped
+	assert.Nil(t, p.OnDelete(lb))
+	history := p.History()
+	assert.Len(t, history, 3)
+	assert.Equal(t, EventDelete, history[2].Event)
+	assert.Nil(t, history[2].View)
+
+	// the loadbalancer created again is diffed from scratch
+	assert.Nil(t, p.OnUpdate(lb))
+	for _, c := range p.History()[2].Changes {
+		assert.Empty(t, c.Old)
+	}
+
+	// the history is served in json
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/debug/history", nil))
+	served := make([]Record, 0)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Len(t, served, 3)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
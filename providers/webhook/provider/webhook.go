@@ -0,0 +1,433 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/webhook/version"
+	log "github.com/zoumo/logdog"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var (
+	_ core.Provider         = &WebhookProvider{}
+	_ core.FamilyProvider   = &WebhookProvider{}
+	_ core.ResyncProvider   = &WebhookProvider{}
+	_ core.DeletionProvider = &WebhookProvider{}
+	_ core.StatusProvider   = &WebhookProvider{}
+)
+
+const (
+	// TimestampHeader is the header of the unix time the request is sent
+	// at, in seconds
+	TimestampHeader = "X-Loadbalancer-Timestamp"
+	// SignatureHeader is the header of the signature of the request, see
+	// Sign
+	SignatureHeader = "X-Loadbalancer-Signature"
+
+	// HMACKey is the key of the signing key in the Secret
+	HMACKey = "hmac-key"
+	// CAKey is the key of the CA bundle verifying the endpoint in the
+	// Secret, the system roots are used if it is absent
+	CAKey = "ca.crt"
+
+	// ActionUpdate and ActionDelete are the actions of the requests
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+
+	// DefaultTimeout is the default timeout of the requests
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetryDelay and DefaultMaxRetryDelay bound the backoff of the
+	// retries of the failed requests without Retry-After
+	DefaultRetryDelay    = 5 * time.Second
+	DefaultMaxRetryDelay = 5 * time.Minute
+
+	// maxErrorBody is the most of the body of a failed response kept in
+	// the error
+	maxErrorBody = 512
+)
+
+// Config configures the WebhookProvider
+type Config struct {
+	// URL is the endpoint the LoadBalancer is posted to on updates
+	URL string
+	// DeleteURL is the endpoint the LoadBalancer is posted to once it is
+	// deleted, it defaults to the path delete under URL
+	DeleteURL string
+	// Secret is the Secret in the namespace of the LoadBalancer holding
+	// the signing key in hmac-key, the optional CA bundle in ca.crt and the
+	// optional client certificate in tls.crt and tls.key
+	Secret string
+	// Timeout is the timeout of the requests
+	Timeout time.Duration
+	// RetryDelay is the delay of the first retry of the failed requests,
+	// it doubles on every retry up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// Node is a node of the LoadBalancer, the ones weighted to zero, e.g. not
+// ready, should not receive new connections
+type Node struct {
+	Name   string `json:"name"`
+	IP     string `json:"ip"`
+	Weight int    `json:"weight"`
+}
+
+// Request is the body of the requests in json
+type Request struct {
+	// Action is update or delete
+	Action       string                    `json:"action"`
+	LoadBalancer *netv1alpha1.LoadBalancer `json:"loadBalancer"`
+	// VIPs, Ports and Nodes are computed from the LoadBalancer, they are
+	// empty on deletions
+	VIPs  []string       `json:"vips,omitempty"`
+	Ports []corenet.Port `json:"ports,omitempty"`
+	Nodes []Node         `json:"nodes,omitempty"`
+}
+
+// Response is the optional body of the successful responses in json
+type Response struct {
+	// Status is merged into the status of the LoadBalancer
+	Status json.RawMessage `json:"status,omitempty"`
+}
+
+// Sign returns the signature of the request body sent at the timestamp,
+// sha256= followed by the hex encoded HMAC-SHA256 of the timestamp, a dot
+// and the body
+func Sign(key []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns true if the signature is the one of the request body sent
+// at the timestamp, the endpoints should also reject the stale timestamps
+func Verify(key []byte, timestamp, signature string, body []byte) bool {
+	return hmac.Equal([]byte(signature), []byte(Sign(key, timestamp, body)))
+}
+
+// WebhookProvider posts the LoadBalancer to an endpoint, so that the
+// appliances out of the cluster are integrated without a Provider of their
+// own. The endpoints must be idempotent, the LoadBalancer is posted on
+// every sync.
+type WebhookProvider struct {
+	cfg         Config
+	storeLister core.StoreLister
+	now         func() time.Time
+
+	mu     sync.Mutex
+	client *http.Client
+	key    []byte
+	// secretVersion is the resource version of the Secret the client is
+	// created with
+	secretVersion string
+	// failures counts the consecutive failed requests for the backoff
+	failures    uint
+	status      json.RawMessage
+	resyncAfter time.Duration
+}
+
+// NewWebhookProvider creates a new webhook LoadBalancer Provider
+func NewWebhookProvider(cfg Config) *WebhookProvider {
+	if cfg.DeleteURL == "" {
+		cfg.DeleteURL = strings.TrimSuffix(cfg.URL, "/") + "/delete"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = DefaultRetryDelay
+	}
+	if cfg.MaxRetryDelay <= 0 {
+		cfg.MaxRetryDelay = DefaultMaxRetryDelay
+	}
+	return &WebhookProvider{cfg: cfg, now: time.Now}
+}
+
+// getClient returns the client and the signing key of the current Secret
+func (p *WebhookProvider) getClient(lb *netv1alpha1.LoadBalancer) (*http.Client, []byte, error) {
+	secret, err := p.storeLister.Secret.Secrets(lb.Namespace).Get(p.cfg.Secret)
+	if err != nil {
+		return nil, nil, core.NewPermanentError("InvalidWebhookSecret", fmt.Errorf("get webhook secret %s/%s error: %v", lb.Namespace, p.cfg.Secret, err))
+	}
+	if p.client != nil && secret.ResourceVersion == p.secretVersion {
+		return p.client, p.key, nil
+	}
+
+	key := secret.Data[HMACKey]
+	if len(key) == 0 {
+		return nil, nil, core.NewPermanentError("InvalidWebhookSecret", fmt.Errorf("webhook secret %s/%s has no %s", lb.Namespace, secret.Name, HMACKey))
+	}
+	config := &tls.Config{}
+	if ca, ok := secret.Data[CAKey]; ok {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, nil, core.NewPermanentError("InvalidWebhookSecret", fmt.Errorf("no certificate in %s of webhook secret %s/%s", CAKey, lb.Namespace, secret.Name))
+		}
+	}
+	if _, ok := secret.Data[v1.TLSCertKey]; ok {
+		cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, nil, core.NewPermanentError("InvalidWebhookSecret", fmt.Errorf("invalid client certificate in webhook secret %s/%s: %v", lb.Namespace, secret.Name, err))
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	p.client = &http.Client{
+		Timeout: p.cfg.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+	p.key = key
+	p.secretVersion = secret.ResourceVersion
+	return p.client, p.key, nil
+}
+
+// request returns the update request of the LoadBalancer, the nodes are
+// the ones of the family of its first VIP
+func (p *WebhookProvider) request(lb *netv1alpha1.LoadBalancer) (*Request, error) {
+	vips, err := core.GetVIPs(lb)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := core.GetPorts(lb)
+	if err != nil {
+		return nil, err
+	}
+	family := corenet.FamilyIPv4
+	req := &Request{Action: ActionUpdate, LoadBalancer: lb, Ports: ports, Nodes: make([]Node, 0)}
+	for i, vip := range vips {
+		if i == 0 {
+			family = corenet.FamilyOf(vip)
+		}
+		req.VIPs = append(req.VIPs, vip.String())
+	}
+	for _, rs := range p.storeLister.RealServers(lb.Spec.Nodes.Names, family) {
+		req.Nodes = append(req.Nodes, Node{Name: rs.Node, IP: rs.IP.String(), Weight: rs.Weight})
+	}
+	return req, nil
+}
+
+// post signs and posts the request to the url. The failed requests, which
+// time out or are not answered with 2xx, return the delay of their
+// Retry-After.
+func (p *WebhookProvider) post(lb *netv1alpha1.LoadBalancer, url string, req *Request) (*Response, time.Duration, error) {
+	client, key, err := p.getClient(lb)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, core.NewPermanentError("InvalidWebhookURL", err)
+	}
+	timestamp := strconv.FormatInt(p.now().Unix(), 10)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set(TimestampHeader, timestamp)
+	httpReq.Header.Set(SignatureHeader, Sign(key, timestamp, body))
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	after := p.retryAfter(resp.Header.Get("Retry-After"))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return nil, after, fmt.Errorf("webhook %s %s responded %s: %s", req.Action, url, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	ret := &Response{}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, after, err
+	}
+	if len(bytes.TrimSpace(data)) != 0 {
+		if err := json.Unmarshal(data, ret); err != nil {
+			// the change is accepted, the response is not retried
+			log.Warn("invalid webhook response", log.Fields{"url": url, "err": err})
+			ret = &Response{}
+		}
+	}
+	if string(ret.Status) == "null" {
+		ret.Status = nil
+	}
+	return ret, after, nil
+}
+
+// retryAfter returns the delay of the Retry-After header in seconds or in
+// a http date, zero if it is absent or invalid
+func (p *WebhookProvider) retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := t.Sub(p.now()); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// retry translates the failed requests into RetryAfterErrors, after their
+// Retry-After or after a delay doubling on the consecutive ones
+func (p *WebhookProvider) retry(err error, after time.Duration) error {
+	if err == nil {
+		p.failures = 0
+		return nil
+	}
+	if core.IsPermanentError(err) {
+		return err
+	}
+	delay := p.cfg.MaxRetryDelay
+	if p.failures < 16 {
+		if d := p.cfg.RetryDelay << p.failures; d < delay {
+			delay = d
+		}
+	}
+	p.failures++
+	if after > 0 {
+		delay = after
+	}
+	return core.NewRetryAfterError(delay, err)
+}
+
+// OnUpdate posts the LoadBalancer with its VIPs, ports and nodes to the
+// endpoint. The status fragment of the response is kept for Status, and
+// the Retry-After of the response for ResyncAfter.
+func (p *WebhookProvider) OnUpdate(lb *netv1alpha1.LoadBalancer) error {
+	// filtered
+	if lb.Spec.Type != netv1alpha1.LoadBalancerTypeExternal {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	req, err := p.request(lb)
+	if err != nil {
+		return err
+	}
+	resp, after, err := p.post(lb, p.cfg.URL, req)
+	if err != nil {
+		log.Error("post loadbalancer to webhook error", log.Fields{"url": p.cfg.URL, "err": err})
+		return p.retry(err, after)
+	}
+	p.status = resp.Status
+	p.resyncAfter = after
+	return p.retry(nil, 0)
+}
+
+// OnDelete implements core.DeletionProvider, the deleted LoadBalancer is
+// posted to the delete endpoint
+func (p *WebhookProvider) OnDelete(lb *netv1alpha1.LoadBalancer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, after, err := p.post(lb, p.cfg.DeleteURL, &Request{Action: ActionDelete, LoadBalancer: lb})
+	if err != nil {
+		log.Error("post deleted loadbalancer to webhook error", log.Fields{"url": p.cfg.DeleteURL, "err": err})
+	} else {
+		p.status = nil
+		p.resyncAfter = 0
+	}
+	return p.retry(err, after)
+}
+
+// Status implements core.StatusProvider
+func (p *WebhookProvider) Status() json.RawMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// ResyncAfter implements core.ResyncProvider, the endpoints accepting the
+// changes asynchronously ask for the resyncs by Retry-After
+func (p *WebhookProvider) ResyncAfter() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resyncAfter
+}
+
+// SupportedFamilies implements core.FamilyProvider, the VIPs are passed to
+// the endpoint as they are
+func (p *WebhookProvider) SupportedFamilies() []corenet.Family {
+	return []corenet.Family{corenet.FamilyIPv4, corenet.FamilyIPv6}
+}
+
+// Start ...
+func (p *WebhookProvider) Start() {
+	log.Info("Startting webhook provider")
+}
+
+// WaitForStart ...
+func (p *WebhookProvider) WaitForStart() bool {
+	return true
+}
+
+// Stop leaves the endpoint alone, the LoadBalancer outlives the provider
+func (p *WebhookProvider) Stop() error {
+	log.Info("Shutting down webhook provider")
+	return nil
+}
+
+// Info ...
+func (p *WebhookProvider) Info() core.Info {
+	return core.Info{
+		Name:       "webhook",
+		Release:    version.RELEASE,
+		Build:      version.COMMIT,
+		Repository: version.REPO,
+	}
+}
+
+// SetListers sets the configured store listers in the generic ingress controller
+func (p *WebhookProvider) SetListers(lister core.StoreLister) {
+	p.storeLister = lister
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	netv1alpha1 "github.com/caicloud/loadbalancer-controller/pkg/apis/networking/v1alpha1"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/stretchr/testify/assert"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// endpoint records the verified requests and answers them in turn
+type endpoint struct {
+	mu        sync.Mutex
+	key       []byte
+	requests  map[string][]*Request
+	responses []func(w http.ResponseWriter)
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	e.mu.Lock()
+	if !Verify(e.key, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body) {
+		e.mu.Unlock()
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	req := &Request{}
+	if err := json.Unmarshal(body, req); err != nil {
+		e.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.requests[r.URL.Path] = append(e.requests[r.URL.Path], req)
+	if len(e.responses) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	respond := e.responses[0]
+	e.responses = e.responses[1:]
+	e.mu.Unlock()
+	respond(w)
+}
+
+func (e *endpoint) respond(responses ...func(w http.ResponseWriter)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.responses = append(e.responses, responses...)
+}
+
+func (e *endpoint) Requests(path string) []*Request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests[path]
+}
+
+func reply(code int, header, body string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		if header != "" {
+			w.Header().Set("Retry-After", header)
+		}
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}
+}
+
+func newTestNode(name, ip string, ready bool) *v1.Node {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+		},
+	}
+}
+
+func newTestSecret(version string, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "webhook", ResourceVersion: version},
+		Data:       data,
+	}
+}
+
+func newTestLoadBalancer(nodes ...string) *netv1alpha1.LoadBalancer {
+	lb := &netv1alpha1.LoadBalancer{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb", Annotations: map[string]string{}},
+	}
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeExternal
+	lb.Spec.Providers.Ipvsdr = &netv1alpha1.IpvsdrProvider{Vip: "192.168.0.100"}
+	lb.Spec.Nodes.Names = nodes
+	return lb
+}
+
+func newIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+func newTestProvider(url string, nodes, secrets cache.Indexer) *WebhookProvider {
+	p := NewWebhookProvider(Config{URL: url + "/lb", Secret: "webhook", Timeout: 200 * time.Millisecond, RetryDelay: time.Second, MaxRetryDelay: 4 * time.Second})
+	p.now = func() time.Time { return time.Date(2017, 9, 1, 0, 0, 0, 0, time.UTC) }
+	p.SetListers(core.StoreLister{
+		Node:   v1listers.NewNodeLister(nodes),
+		Secret: v1listers.NewSecretLister(secrets),
+	})
+	return p
+}
+
+func TestOnUpdate(t *testing.T) {
+	e := &endpoint{key: []byte("key"), requests: make(map[string][]*Request)}
+	s := httptest.NewServer(e)
+	defer s.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	nodes.Add(newTestNode("node2", "10.0.0.2", false))
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("1", map[string][]byte{HMACKey: []byte("key")}))
+	p := newTestProvider(s.URL, nodes, secrets)
+	lb := newTestLoadBalancer("node1", "node2", "node3")
+
+	// the status fragment of the response is reported
+	e.respond(reply(http.StatusOK, "", `{"status":{"providersStatuses":{"webhook":{"state":"ready"}}}}`))
+	assert.Nil(t, p.OnUpdate(lb))
+	reqs := e.Requests("/lb")
+	if assert.Len(t, reqs, 1) {
+		assert.Equal(t, ActionUpdate, reqs[0].Action)
+		assert.Equal(t, "lb", reqs[0].LoadBalancer.Name)
+		assert.Equal(t, []string{"192.168.0.100"}, reqs[0].VIPs)
+		assert.Equal(t, core.DefaultPorts, reqs[0].Ports)
+		assert.Equal(t, []Node{{Name: "node1", IP: "10.0.0.1", Weight: 100}, {Name: "node2", IP: "10.0.0.2", Weight: 0}}, reqs[0].Nodes)
+	}
+	assert.Equal(t, `{"providersStatuses":{"webhook":{"state":"ready"}}}`, string(p.Status()))
+	assert.Equal(t, time.Duration(0), p.ResyncAfter())
+
+	// the endpoints accepting the change asynchronously ask for a resync
+	e.respond(reply(http.StatusAccepted, "30", ""))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Nil(t, p.Status())
+	assert.Equal(t, 30*time.Second, p.ResyncAfter())
+
+	// an invalid response does not fail the accepted change
+	e.respond(reply(http.StatusOK, "", "not json"))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Nil(t, p.Status())
+
+	// the other types are filtered
+	lb.Spec.Type = netv1alpha1.LoadBalancerTypeInternal
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, e.Requests("/lb"), 3)
+}
+
+func TestRetry(t *testing.T) {
+	e := &endpoint{key: []byte("key"), requests: make(map[string][]*Request)}
+	s := httptest.NewServer(e)
+	defer s.Close()
+	nodes := newIndexer()
+	nodes.Add(newTestNode("node1", "10.0.0.1", true))
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("1", map[string][]byte{HMACKey: []byte("key")}))
+	p := newTestProvider(s.URL, nodes, secrets)
+	lb := newTestLoadBalancer("node1")
+
+	// the failed requests are retried with backoff, or after their
+	// Retry-After in seconds or in a http date
+	e.respond(
+		reply(http.StatusServiceUnavailable, "", "down"),
+		reply(http.StatusBadRequest, "", "bad"),
+		reply(http.StatusTooManyRequests, "7", ""),
+		reply(http.StatusServiceUnavailable, "Fri, 01 Sep 2017 00:01:00 GMT", ""),
+		reply(http.StatusServiceUnavailable, "", ""),
+		func(w http.ResponseWriter) { time.Sleep(time.Second) },
+	)
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 7 * time.Second, time.Minute, 4 * time.Second, 4 * time.Second} {
+		err := p.OnUpdate(lb)
+		if assert.True(t, core.IsRetryAfterError(err), "%v", err) {
+			assert.Equal(t, delay, err.(*core.RetryAfterError).After)
+		}
+	}
+	assert.Nil(t, p.OnUpdate(lb))
+	e.respond(reply(http.StatusInternalServerError, "", ""))
+	assert.Equal(t, time.Second, p.OnUpdate(lb).(*core.RetryAfterError).After)
+
+	// the invalid secrets are not retried
+	secrets.Update(newTestSecret("2", map[string][]byte{}))
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+	secrets.Update(newTestSecret("3", map[string][]byte{HMACKey: []byte("key"), CAKey: []byte("invalid")}))
+	assert.True(t, core.IsPermanentError(p.OnUpdate(lb)))
+}
+
+func TestSignature(t *testing.T) {
+	assert.Equal(t, "sha256=93dd801cdaa4fd2b43b3862b6258199bf8a25e004f7c2e90c79280cdefd5b57c", Sign([]byte("key"), "1504224000", []byte("{}")))
+	assert.True(t, Verify([]byte("key"), "1504224000", Sign([]byte("key"), "1504224000", []byte("{}")), []byte("{}")))
+	assert.False(t, Verify([]byte("key"), "1504224001", Sign([]byte("key"), "1504224000", []byte("{}")), []byte("{}")))
+
+	e := &endpoint{key: []byte("key"), requests: make(map[string][]*Request)}
+	s := httptest.NewTLSServer(e)
+	defer s.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("1", map[string][]byte{HMACKey: []byte("wrong"), CAKey: ca}))
+	p := newTestProvider(s.URL, newIndexer(), secrets)
+	lb := newTestLoadBalancer()
+
+	// the endpoint rejects the requests signed with another key
+	assert.True(t, core.IsRetryAfterError(p.OnUpdate(lb)))
+	assert.Empty(t, e.Requests("/lb"))
+
+	// the client follows the secret
+	secrets.Update(newTestSecret("2", map[string][]byte{HMACKey: []byte("key"), CAKey: ca}))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.Len(t, e.Requests("/lb"), 1)
+
+	// the endpoint is not trusted without the ca bundle
+	secrets.Update(newTestSecret("3", map[string][]byte{HMACKey: []byte("key")}))
+	assert.True(t, core.IsRetryAfterError(p.OnUpdate(lb)))
+}
+
+func TestOnDelete(t *testing.T) {
+	e := &endpoint{key: []byte("key"), requests: make(map[string][]*Request)}
+	s := httptest.NewServer(e)
+	defer s.Close()
+	secrets := newIndexer()
+	secrets.Add(newTestSecret("1", map[string][]byte{HMACKey: []byte("key")}))
+	p := newTestProvider(s.URL, newIndexer(), secrets)
+	lb := newTestLoadBalancer("node1")
+
+	e.respond(reply(http.StatusOK, "", `{"status":{"proxyStatus":{"replicas":1}}}`))
+	assert.Nil(t, p.OnUpdate(lb))
+	assert.NotNil(t, p.Status())
+
+	e.respond(reply(http.StatusServiceUnavailable, "3", ""))
+	assert.Equal(t, 3*time.Second, p.OnDelete(lb).(*core.RetryAfterError).After)
+	assert.Nil(t, p.OnDelete(lb))
+	assert.Nil(t, p.Status())
+
+	reqs := e.Requests("/lb/delete")
+	if assert.Len(t, reqs, 2) {
+		assert.Equal(t, ActionDelete, reqs[1].Action)
+		assert.Equal(t, "lb", reqs[1].LoadBalancer.Name)
+		assert.Empty(t, reqs[1].Nodes)
+	}
+}